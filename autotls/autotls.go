@@ -154,7 +154,7 @@ func Load(name, acmeDir, contactEmail, directoryURL string, shutdown <-chan stru
 
 		cert, err := m.GetCertificate(hello)
 		if err != nil {
-			if errors.Is(err, errHostNotAllowed) {
+			if errors.Is(err, ErrHostNotAllowed) {
 				log.Debugx("requesting certificate", err, mlog.Field("host", hello.ServerName))
 			} else {
 				log.Errorx("requesting certificate", err, mlog.Field("host", hello.ServerName))
@@ -185,7 +185,9 @@ func Load(name, acmeDir, contactEmail, directoryURL string, shutdown <-chan stru
 // After setting the host names, a goroutine is start to check that new host names
 // are fully served by publicIPs (only if non-empty and there is no unspecified
 // address in the list). If no, log an error with a warning that ACME validation
-// may fail.
+// may fail. If checkHosts is set and host names are added to a non-empty list, as
+// on a configuration change, certificates for the added host names are requested
+// in the background.
 func (m *Manager) SetAllowedHostnames(resolver dns.Resolver, hostnames map[dns.Domain]struct{}, publicIPs []string, checkHosts bool) {
 	m.Lock()
 	defer m.Unlock()
@@ -206,8 +208,16 @@ func (m *Manager) SetAllowedHostnames(resolver dns.Resolver, hostnames map[dns.D
 			added = append(added, h)
 		}
 	}
+	initial := len(m.hosts) == 0
 	m.hosts = hostnames
 
+	if checkHosts && !initial && len(added) > 0 {
+		sort.Slice(added, func(i, j int) bool {
+			return added[i].Name() < added[j].Name()
+		})
+		go m.ensureAdded(added)
+	}
+
 	if checkHosts && len(added) > 0 && len(publicIPs) > 0 {
 		for _, ip := range publicIPs {
 			if net.ParseIP(ip).IsUnspecified() {
@@ -251,7 +261,8 @@ func (m *Manager) Hostnames() []dns.Domain {
 	return l
 }
 
-var errHostNotAllowed = errors.New("autotls: host not in allowlist")
+// ErrHostNotAllowed is returned for hosts not in the allowlist.
+var ErrHostNotAllowed = errors.New("autotls: host not in allowlist")
 
 // HostPolicy decides if a host is allowed for use with ACME, i.e. whether a
 // certificate will be returned if present and/or will be requested if not yet
@@ -284,7 +295,7 @@ func (m *Manager) HostPolicy(ctx context.Context, host string) (rerr error) {
 	m.Lock()
 	defer m.Unlock()
 	if _, ok := m.hosts[d]; !ok {
-		return fmt.Errorf("%w: %q", errHostNotAllowed, d)
+		return fmt.Errorf("%w: %q", ErrHostNotAllowed, d)
 	}
 	return nil
 }
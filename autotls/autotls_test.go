@@ -2,10 +2,16 @@ package autotls
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/x509"
 	"errors"
+	"math/big"
 	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	"golang.org/x/crypto/acme/autocert"
 
@@ -25,8 +31,8 @@ func TestAutotls(t *testing.T) {
 	if len(l) != 0 {
 		t.Fatalf("hostnames, got %v, expected empty list", l)
 	}
-	if err := m.HostPolicy(context.Background(), "mox.example"); err == nil || !errors.Is(err, errHostNotAllowed) {
-		t.Fatalf("hostpolicy, got err %v, expected errHostNotAllowed", err)
+	if err := m.HostPolicy(context.Background(), "mox.example"); err == nil || !errors.Is(err, ErrHostNotAllowed) {
+		t.Fatalf("hostpolicy, got err %v, expected ErrHostNotAllowed", err)
 	}
 	m.SetAllowedHostnames(dns.StrictResolver{}, map[dns.Domain]struct{}{{ASCII: "mox.example"}: {}}, nil, false)
 	l = m.Hostnames()
@@ -39,8 +45,8 @@ func TestAutotls(t *testing.T) {
 	if err := m.HostPolicy(context.Background(), "mox.example:80"); err != nil {
 		t.Fatalf("hostpolicy, got err %v, expected no error", err)
 	}
-	if err := m.HostPolicy(context.Background(), "other.mox.example"); err == nil || !errors.Is(err, errHostNotAllowed) {
-		t.Fatalf("hostpolicy, got err %v, expected errHostNotAllowed", err)
+	if err := m.HostPolicy(context.Background(), "other.mox.example"); err == nil || !errors.Is(err, ErrHostNotAllowed) {
+		t.Fatalf("hostpolicy, got err %v, expected ErrHostNotAllowed", err)
 	}
 
 	ctx := context.Background()
@@ -98,3 +104,52 @@ func TestAutotls(t *testing.T) {
 	// Only remove in case of success.
 	os.RemoveAll("../testdata/autotls")
 }
+
+func TestStoreCert(t *testing.T) {
+	os.RemoveAll("../testdata/autotls")
+	os.MkdirAll("../testdata/autotls", 0770)
+
+	shutdown := make(chan struct{})
+	m, err := Load("test", "../testdata/autotls", "mox@localhost", "https://localhost/", shutdown)
+	if err != nil {
+		t.Fatalf("load manager: %v", err)
+	}
+	hosts := map[dns.Domain]struct{}{{ASCII: "mox.example"}: {}, {ASCII: "autoconfig.mox.example"}: {}}
+	m.SetAllowedHostnames(dns.StrictResolver{}, hosts, nil, false)
+
+	// A certificate with multiple names, as from ConsolidateHostnames, is used by
+	// autocert for each name.
+	names := []string{"mox.example", "autoconfig.mox.example"}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(cryptorand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	if err := m.storeCert(context.Background(), names, key, [][]byte{der}); err != nil {
+		t.Fatalf("store certificate: %v", err)
+	}
+	for _, name := range names {
+		if err := m.EnsureCertificate(dns.Domain{ASCII: name}); err != nil {
+			t.Fatalf("ensure certificate for %s: %v", name, err)
+		}
+	}
+
+	// Nothing left to consolidate, no requests to the ACME provider are made.
+	if err := m.ConsolidateHostnames(context.Background(), []dns.Domain{{ASCII: "mox.example"}, {ASCII: "autoconfig.mox.example"}}); err != nil {
+		t.Fatalf("consolidate hostnames: %v", err)
+	}
+	if err := m.ConsolidateHostnames(context.Background(), []dns.Domain{{ASCII: "other.example"}}); err == nil || !errors.Is(err, ErrHostNotAllowed) {
+		t.Fatalf("consolidate hostnames: got err %v, expected ErrHostNotAllowed", err)
+	}
+
+	os.RemoveAll("../testdata/autotls")
+}
@@ -0,0 +1,198 @@
+package autotls
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/mlog"
+)
+
+// EnsureCertificate returns once a certificate for host is present, requesting
+// one if needed. Used to request certificates before the first connection for the
+// host, so clients don't run into their timeouts waiting for the certificate.
+func (m *Manager) EnsureCertificate(host dns.Domain) error {
+	hello := &tls.ClientHelloInfo{
+		ServerName: host.ASCII,
+
+		// Make us fetch an ECDSA P256 cert.
+		// We add TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 to get around the ecDSA check in autocert.
+		CipherSuites:      []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_AES_128_GCM_SHA256},
+		SupportedCurves:   []tls.CurveID{tls.CurveP256},
+		SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedVersions: []uint16{tls.VersionTLS13},
+	}
+	_, err := m.Manager.GetCertificate(hello)
+	return err
+}
+
+// ensureAdded requests certificates for hosts that were added to the allowlist
+// after startup, e.g. autoconfig and mta-sts hosts for a new domain.
+func (m *Manager) ensureAdded(hosts []dns.Domain) {
+	for i, h := range hosts {
+		if i >= 10 {
+			// Don't hit ACME rate limits when many domains are added at once, remaining
+			// certificates are requested on demand.
+			return
+		}
+		if i > 0 {
+			time.Sleep(10 * time.Second)
+		}
+		select {
+		case <-m.shutdown:
+			return
+		default:
+		}
+		// Policy could have changed in the mean time.
+		if err := m.HostPolicy(context.Background(), h.ASCII); err != nil {
+			continue
+		}
+		xlog.Print("ensuring certificate availability for added hostname", mlog.Field("hostname", h))
+		if err := m.EnsureCertificate(h); err != nil {
+			xlog.Errorx("requesting automatic certificate for added hostname", err, mlog.Field("hostname", h))
+		}
+	}
+}
+
+// ConsolidateHostnames requests a single certificate with all hosts that do not
+// yet have a certificate as subject alternative names, instead of a certificate
+// per host. This saves requests at the ACME provider, helping to stay within its
+// rate limits. Authorizations are done with http-01, so the HTTP handler of the
+// autocert manager must be served on port 80. Certificates are stored in the
+// cache for each host, and renewed per host by autocert.
+func (m *Manager) ConsolidateHostnames(ctx context.Context, hosts []dns.Domain) error {
+	log := xlog.WithContext(ctx)
+
+	var names []string
+	for _, h := range hosts {
+		if err := m.HostPolicy(ctx, h.ASCII); err != nil {
+			return err
+		}
+		if _, err := m.Manager.Cache.Get(ctx, h.ASCII); err == nil {
+			continue
+		} else if !errors.Is(err, autocert.ErrCacheMiss) {
+			return fmt.Errorf("looking up certificate for %s: %v", h, err)
+		}
+		names = append(names, h.ASCII)
+	}
+	if len(names) < 2 {
+		// Nothing to consolidate, certificates are requested per host.
+		return nil
+	}
+
+	client := m.Manager.Client
+	contact := []string{"mailto:" + m.Manager.Email}
+	if _, err := client.Register(ctx, &acme.Account{Contact: contact}, m.Manager.Prompt); err != nil && !isAccountExists(err) {
+		return fmt.Errorf("registering acme account: %v", err)
+	}
+
+	o, err := client.AuthorizeOrder(ctx, acme.DomainIDs(names...))
+	if err != nil {
+		return fmt.Errorf("creating order: %v", err)
+	}
+	if o.Status == acme.StatusPending {
+		for _, zurl := range o.AuthzURLs {
+			z, err := client.GetAuthorization(ctx, zurl)
+			if err != nil {
+				return fmt.Errorf("getting authorization: %v", err)
+			}
+			if z.Status != acme.StatusPending {
+				continue
+			}
+			var chal *acme.Challenge
+			for _, c := range z.Challenges {
+				if c.Type == "http-01" {
+					chal = c
+				}
+			}
+			if chal == nil {
+				return fmt.Errorf("no http-01 challenge for %s", z.Identifier.Value)
+			}
+			resp, err := client.HTTP01ChallengeResponse(chal.Token)
+			if err != nil {
+				return fmt.Errorf("http-01 challenge response: %v", err)
+			}
+			// The HTTP handler of autocert looks up tokens in the cache.
+			tokenKey := chal.Token + "+http-01"
+			if err := m.Manager.Cache.Put(ctx, tokenKey, []byte(resp)); err != nil {
+				return fmt.Errorf("storing http-01 token: %v", err)
+			}
+			defer func() {
+				err := m.Manager.Cache.Delete(context.Background(), tokenKey)
+				log.Check(err, "removing http-01 token")
+			}()
+			if _, err := client.Accept(ctx, chal); err != nil {
+				return fmt.Errorf("accepting challenge for %s: %v", z.Identifier.Value, err)
+			}
+			if _, err := client.WaitAuthorization(ctx, z.URI); err != nil {
+				return fmt.Errorf("authorization for %s: %v", z.Identifier.Value, err)
+			}
+		}
+		o, err = client.WaitOrder(ctx, o.URI)
+		if err != nil {
+			return fmt.Errorf("waiting for order: %v", err)
+		}
+	} else if o.Status != acme.StatusReady {
+		return fmt.Errorf("unexpected order status %q", o.Status)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	if err != nil {
+		return fmt.Errorf("generating key: %v", err)
+	}
+	csr, err := x509.CreateCertificateRequest(cryptorand.Reader, &x509.CertificateRequest{DNSNames: names}, key)
+	if err != nil {
+		return fmt.Errorf("creating certificate request: %v", err)
+	}
+	der, _, err := client.CreateOrderCert(ctx, o.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("finalizing order: %v", err)
+	}
+	if err := m.storeCert(ctx, names, key, der); err != nil {
+		return err
+	}
+	log.Info("obtained certificate for multiple hostnames", mlog.Field("hostnames", names))
+	return nil
+}
+
+// storeCert stores the certificate chain der with key in the cache for each
+// name, in the format of autocert.
+func (m *Manager) storeCert(ctx context.Context, names []string, key *ecdsa.PrivateKey, der [][]byte) error {
+	var b bytes.Buffer
+	keyBuf, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("marshal key: %v", err)
+	}
+	if err := pem.Encode(&b, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBuf}); err != nil {
+		return fmt.Errorf("pem encode key: %v", err)
+	}
+	for _, buf := range der {
+		if err := pem.Encode(&b, &pem.Block{Type: "CERTIFICATE", Bytes: buf}); err != nil {
+			return fmt.Errorf("pem encode certificate: %v", err)
+		}
+	}
+	for _, name := range names {
+		if err := m.Manager.Cache.Put(ctx, name, b.Bytes()); err != nil {
+			return fmt.Errorf("storing certificate for %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func isAccountExists(err error) bool {
+	var ae *acme.Error
+	return errors.Is(err, acme.ErrAccountAlreadyExists) || errors.As(err, &ae) && ae.StatusCode == http.StatusConflict
+}
@@ -419,13 +419,18 @@ func backupctl(ctx context.Context, ctl *ctl) {
 		// been removed).
 		tmMsgs := time.Now()
 		seen := map[string]struct{}{}
-		var nlinked, ncopied int
+		var nlinked, ncopied, narchived int
 		err = bstore.QueryDB[store.Message](ctx, db).ForEach(func(m store.Message) error {
 			mp := store.MessagePath(m.ID)
 			seen[mp] = struct{}{}
 			amp := filepath.Join("accounts", acc.Name, "msg", mp)
 			srcpath := filepath.Join(srcDataDir, amp)
 			dstpath := filepath.Join(dstDataDir, amp)
+			if _, err := os.Stat(srcpath); err != nil && store.ArchivedMessagePath(acc.Name, m.ID) != "" {
+				// Message archive storage must be backed up separately.
+				narchived++
+				return nil
+			}
 			if linked, err := linkOrCopy(srcpath, dstpath); err != nil {
 				xerrx("linking/copying account message", err, mlog.Field("srcpath", srcpath), mlog.Field("dstpath", dstpath))
 			} else if linked {
@@ -438,7 +443,7 @@ func backupctl(ctx context.Context, ctl *ctl) {
 		if err != nil {
 			xerrx("processing account messages (not backed up properly)", err, mlog.Field("duration", time.Since(tmMsgs)))
 		} else {
-			xvlog("account message files linked/copied", mlog.Field("linked", nlinked), mlog.Field("copied", ncopied), mlog.Field("duration", time.Since(tmMsgs)))
+			xvlog("account message files linked/copied", mlog.Field("linked", nlinked), mlog.Field("copied", ncopied), mlog.Field("archived", narchived), mlog.Field("duration", time.Since(tmMsgs)))
 		}
 
 		// Read through all files in account directory and warn about anything we haven't handled yet.
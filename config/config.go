@@ -2,6 +2,7 @@ package config
 
 import (
 	"crypto"
+	"crypto/ecdsa"
 	"crypto/tls"
 	"crypto/x509"
 	"net"
@@ -14,6 +15,7 @@ import (
 	"github.com/mjl-/mox/dns"
 	"github.com/mjl-/mox/junk"
 	"github.com/mjl-/mox/mtasts"
+	"github.com/mjl-/mox/oauth"
 	"github.com/mjl-/mox/smtp"
 )
 
@@ -53,8 +55,25 @@ type Static struct {
 		Account string
 		Mailbox string `sconf-doc:"E.g. Postmaster or Inbox."`
 	} `sconf-doc:"Destination for emails delivered to postmaster addresses: a plain 'postmaster' without domain, 'postmaster@<hostname>' (also for each listener with SMTP enabled), and as fallback for each domain without explicitly configured postmaster destination."`
-	DefaultMailboxes []string             `sconf:"optional" sconf-doc:"Mailboxes to create when adding an account. Inbox is always created. If no mailboxes are specified, the following are automatically created: Sent, Archive, Trash, Drafts and Junk."`
-	Transports       map[string]Transport `sconf:"optional" sconf-doc:"Transport are mechanisms for delivering messages. Transports can be referenced from Routes in accounts, domains and the global configuration. There is always an implicit/fallback delivery transport doing direct delivery with SMTP from the outgoing message queue. Transports are typically only configured when using smarthosts, i.e. when delivering through another SMTP server. Zero or one transport methods must be set in a transport, never multiple. When using an external party to send email for a domain, keep in mind you may have to add their IP address to your domain's SPF record, and possibly additional DKIM records."`
+	DefaultMailboxes     []string              `sconf:"optional" sconf-doc:"Mailboxes to create when adding an account. Inbox is always created. If no mailboxes are specified, the following are automatically created: Sent, Archive, Trash, Drafts and Junk."`
+	Transports           map[string]Transport  `sconf:"optional" sconf-doc:"Transport are mechanisms for delivering messages. Transports can be referenced from Routes in accounts, domains and the global configuration. There is always an implicit/fallback delivery transport doing direct delivery with SMTP from the outgoing message queue. Transports are typically only configured when using smarthosts, i.e. when delivering through another SMTP server. Zero or one transport methods must be set in a transport, never multiple. When using an external party to send email for a domain, keep in mind you may have to add their IP address to your domain's SPF record, and possibly additional DKIM records."`
+	PDFRenderCommand     []string              `sconf:"optional" sconf-doc:"Command with arguments for rendering messages to PDF in the account web interface. The command must read HTML on stdin and write the PDF document to stdout, e.g. [\"wkhtmltopdf\", \"--quiet\", \"-\", \"-\"]. If not set, exporting messages as PDF is not available."`
+	ImageProxyURL        string                `sconf:"optional" sconf-doc:"URL prefix of an external image proxy, for loading remote images in HTML messages in the account web interface, e.g. https://imageproxy.example/?url=. The URL-encoded remote image URL is appended. If empty, the built-in image proxy of the account web interface is used, which fetches images without cookies or other identifying information of the user."`
+	OutgoingTLSReports   bool                  `sconf:"optional" sconf-doc:"If set, TLS reports (TLSRPT) are sent daily to recipient domains that publish a TLSRPT DNS record with a mailto reporting address, about deliveries that were done without TLS after a failed attempt with TLS. Only failed sessions are tracked and reported."`
+	AuthCache            *AuthCache            `sconf:"optional" sconf-doc:"If set, results of SPF evaluations (per remote IP, SMTP MAIL FROM and EHLO), and DNS records for DKIM public keys and DMARC policies are cached in memory for incoming SMTP connections, shared by all listeners. Saves DNS lookups and latency for high-volume incoming traffic."`
+	WebPush              *WebPush              `sconf:"optional" sconf-doc:"If set, users can subscribe browsers to Web Push notifications for new messages in the account web interface."`
+	SelfCheck            *SelfCheck            `sconf:"optional" sconf-doc:"If set, test messages are periodically sent through the outgoing queue to a seed address, to check that SPF, DKIM and DMARC pass for outgoing messages. Failures are logged, counted in metrics and reported to the postmaster."`
+	DefaultLanguage      string                `sconf:"optional" sconf-doc:"Language for system-generated messages, such as delivery status notifications, if no language is configured for the account or its domain. Built-in languages are en (default) and nl."`
+	MessageCatalog       string                `sconf:"optional" sconf-doc:"Directory with texts that override or add to the built-in texts for system-generated messages, relative to the config directory if not absolute. Texts are in files named <language>/<key>.txt, with placeholders like {recipient}. See \"mox messagecatalog\" for the keys and built-in texts."`
+	MessageArchive       *MessageArchive       `sconf:"optional" sconf-doc:"If set, message files of older messages are moved to a separate directory, typically on a larger, cheaper and slower filesystem. Message metadata, such as flags and the parsed structure, is kept in the account database. Archived messages remain accessible through IMAP and the web interfaces as before. Archived message files are not included in backups made with \"mox backup\", and are reported as missing by \"mox verifydata\", archive storage must be backed up separately."`
+	SQLExport            *SQLExport            `sconf:"optional" sconf-doc:"If set, operational data is periodically exported as SQL files, for long-term analysis in external tools. Exported are results of delivery attempts of outgoing messages, incoming messages rejected during the SMTP transaction, including junk verdicts, and incoming DMARC aggregate reports. Each file contains the data recorded since the previous export. The files can be loaded in order into an SQLite or PostgreSQL database, e.g. with \"sqlite3 ops.db <file\" or \"psql -f file\". Tables are created if they do not exist, and rows that were already loaded are skipped. The version of the tables is stored in table mox_schema."`
+	Notifications        *Notifications        `sconf:"optional" sconf-doc:"Limits for messages generated by mox itself, such as delivery status notifications (DSNs), TLS reports and reports to the postmaster. Such messages are DKIM-signed for the domain of the From address if configured, rate limited per recipient and checked against the suppression list. Without this section, the default rate limit applies."`
+	Parking              *Parking              `sconf:"optional" sconf-doc:"If set, messages in the outgoing queue for recipients of local accounts that fail with a temporary error because the account is over quota, suspended with SuspendedTempfail, or its domain reached its storage limit, are parked instead of failing after the regular delivery attempts. The sender is notified of the delay with a DSN, and delivery is retried as soon as the condition clears."`
+	OAuth                *OAuth                `sconf:"optional" sconf-doc:"If set, users can authenticate to IMAP and submission with OAuth 2.0 bearer tokens from an identity provider, with the SASL mechanisms OAUTHBEARER and XOAUTH2. The token must be issued for the email address of an account. For listeners without AuthMechanisms, OAUTHBEARER and XOAUTH2 are added to the default mechanisms. Like PLAIN, the mechanisms are only offered on TLS connections, unless the service has NoRequireSTARTTLS."`
+	SlowDBOperation      time.Duration         `sconf:"optional" sconf-doc:"Database transactions by the IMAP and SMTP servers, the queue and the account web interface that take longer than this duration are logged, with statistics about the queries, such as the number of full table scans. Durations of all these transactions are exported as metrics. Default 1s."`
+	TLSMetricsDomains    []string              `sconf:"optional" sconf-doc:"Remote domains for which TLS metrics of messages delivered over SMTP port 25 are exported with their own domain label, e.g. the large email providers you exchange most email with. Incoming messages are counted for their SMTP MAIL FROM domain, outgoing messages for their recipient domain. Messages for other domains are counted under domain label \"other\", keeping the number of metrics bounded."`
+	TLSMetricsDNSDomains []dns.Domain          `sconf:"-" json:"-"`
+	IMAPConnectionLimits *IMAPConnectionLimits `sconf:"optional" sconf-doc:"Limits for simultaneous IMAP connections, for all IMAP services of all listeners. Connections over a limit get an untagged BYE response with code LIMIT, and are closed."`
 
 	// All IPs that were explicitly listen on for external SMTP. Only set when there
 	// are no unspecified external SMTP listeners and there is at most one for IPv4 and
@@ -77,15 +96,18 @@ type Dynamic struct {
 	WebDomainRedirects map[string]string  `sconf:"optional" sconf-doc:"Redirect all requests from domain (key) to domain (value). Always redirects to HTTPS. For plain HTTP redirects, use a WebHandler with a WebRedirect."`
 	WebHandlers        []WebHandler       `sconf:"optional" sconf-doc:"Handle webserver requests by serving static files, redirecting or reverse-proxying HTTP(s). The first matching WebHandler will handle the request. Built-in handlers, e.g. for account, admin, autoconfig and mta-sts always run first. If no handler matches, the response status code is file not found (404). If functionality you need is missng, simply forward the requests to an application that can provide the needed functionality."`
 	Routes             []Route            `sconf:"optional" sconf-doc:"Routes for delivering outgoing messages through the queue. Each delivery attempt evaluates account routes, domain routes and finally these global routes. The transport of the first matching route is used in the delivery attempt. If no routes match, which is the default with no configured routes, messages are delivered directly from the queue."`
+	DMARCOverrides     []DMARCOverride    `sconf:"optional" sconf-doc:"Trusted forwarders and intermediaries, such as mailing lists, for which incoming messages are not rejected when DMARC fails for a From domain with a reject policy. Forwarders often modify messages, breaking DKIM signatures, and send from their own IPs, failing SPF. Messages matching an override are still subject to reputation analysis and the junk filter."`
+	Notices            []Notice           `sconf:"optional" sconf-doc:"Notices for users, e.g. about maintenance windows or policy reminders. Shown in the IMAP greeting (as untagged OK response with ALERT code), in the SMTP banner and at the top of the account and admin web interfaces. Can be managed in the admin web interface."`
 
 	WebDNSDomainRedirects map[dns.Domain]dns.Domain `sconf:"-"`
 }
 
 type ACME struct {
-	DirectoryURL string        `sconf-doc:"For letsencrypt, use https://acme-v02.api.letsencrypt.org/directory."`
-	RenewBefore  time.Duration `sconf:"optional" sconf-doc:"How long before expiration to renew the certificate. Default is 30 days."`
-	ContactEmail string        `sconf-doc:"Email address to register at ACME provider. The provider can email you when certificates are about to expire. If you configure an address for which email is delivered by this server, keep in mind that TLS misconfigurations could result in such notification emails not arriving."`
-	Port         int           `sconf:"optional" sconf-doc:"TLS port for ACME validation, 443 by default. You should only override this if you cannot listen on port 443 directly. ACME will make requests to port 443, so you'll have to add an external mechanism to get the connection here, e.g. by configuring port forwarding."`
+	DirectoryURL         string        `sconf-doc:"For letsencrypt, use https://acme-v02.api.letsencrypt.org/directory."`
+	RenewBefore          time.Duration `sconf:"optional" sconf-doc:"How long before expiration to renew the certificate. Default is 30 days."`
+	ContactEmail         string        `sconf-doc:"Email address to register at ACME provider. The provider can email you when certificates are about to expire. If you configure an address for which email is delivered by this server, keep in mind that TLS misconfigurations could result in such notification emails not arriving."`
+	Port                 int           `sconf:"optional" sconf-doc:"TLS port for ACME validation, 443 by default. You should only override this if you cannot listen on port 443 directly. ACME will make requests to port 443, so you'll have to add an external mechanism to get the connection here, e.g. by configuring port forwarding."`
+	ConsolidateHostnames bool          `sconf:"optional" sconf-doc:"If set, a single certificate is requested at startup for the hostnames of listeners that do not have a certificate yet, with each hostname as subject alternative name, instead of a certificate per hostname. Helps to stay within rate limits of the ACME provider when many hostnames are configured, e.g. autoconfig hosts for many domains. Validation is done with HTTP-01, so only done when a listener serves plain HTTP on port 80. Certificates are renewed per hostname."`
 
 	Manager *autotls.Manager `sconf:"-" json:"-"`
 }
@@ -96,8 +118,14 @@ type Listener struct {
 	Hostname       string     `sconf:"optional" sconf-doc:"If empty, the config global Hostname is used."`
 	HostnameDomain dns.Domain `sconf:"-" json:"-"` // Set when parsing config.
 
-	TLS                *TLS  `sconf:"optional" sconf-doc:"For SMTP/IMAP STARTTLS, direct TLS and HTTPS connections."`
-	SMTPMaxMessageSize int64 `sconf:"optional" sconf-doc:"Maximum size in bytes accepted incoming and outgoing messages. Default is 100MB."`
+	TLS                *TLS              `sconf:"optional" sconf-doc:"For SMTP/IMAP STARTTLS, direct TLS and HTTPS connections."`
+	SMTPMaxMessageSize int64             `sconf:"optional" sconf-doc:"Maximum size in bytes accepted incoming and outgoing messages. Default is 100MB."`
+	ConnectionLimits   *ConnectionLimits `sconf:"optional" sconf-doc:"Limits for incoming connections, shared by all services of this listener (SMTP, IMAP, HTTP). Connections over a limit are closed immediately after being accepted. The SMTP and IMAP services additionally have their own built-in per-IP limits."`
+	AuthMechanisms     []AuthMechanism   `sconf:"optional" sconf-doc:"SASL authentication mechanisms offered and accepted by the Submission, Submissions, IMAP, IMAPS, POP3 and POP3S services of this listener, in order of preference. Default is SCRAM-SHA-256, SCRAM-SHA-1, CRAM-MD5 and PLAIN for all clients. The services still only offer authentication without TLS if they are configured with NoRequireSTARTTLS. The SMTP service, typically on port 25 for incoming email, never offers authentication. When PLAIN is configured here for a listener with a NoRequireSTARTTLS service, it must either have RequireTLS or IPNets set, to prevent accidentally accepting plain text passwords over unencrypted connections from anywhere."`
+	NoAuth             bool              `sconf:"optional" sconf-doc:"Refuse to start if services with authentication are enabled for this listener: Submission, Submissions, IMAP, IMAPS, POP3, POP3S, AccountHTTP, AccountHTTPS, JMAPHTTP, JMAPHTTPS, AdminHTTP and AdminHTTPS. For listeners that should only accept incoming email, e.g. an MX listener on a public IP, to prevent accidentally exposing login services."`
+	SocketOptions      *SocketOptions    `sconf:"optional" sconf-doc:"Options for the listening sockets and accepted connections of all services of this listener. LocalIPs cannot be set for listeners."`
+	ProxyProtocolFrom  []string          `sconf:"optional" sconf-doc:"IPs, or networks in CIDR notation, of TCP load balancers that connect to the services of this listener that have ProxyProtocol enabled. Connections to those services from other IPs are refused. Required if any service enables ProxyProtocol."`
+	ProxyProtocolNets  []net.IPNet       `sconf:"-" json:"-"` // Parsed from ProxyProtocolFrom.
 	SMTP               struct {
 		Enabled         bool
 		Port            int      `sconf:"optional" sconf-doc:"Default 25."`
@@ -106,6 +134,7 @@ type Listener struct {
 		DNSBLs          []string `sconf:"optional" sconf-doc:"Addresses of DNS block lists for incoming messages. Block lists are only consulted for connections/messages without enough reputation to make an accept/reject decision. This prevents sending IPs of all communications to the block list provider. If any of the listed DNSBLs contains a requested IP address, the message is rejected as spam. The DNSBLs are checked for healthiness before use, at most once per 4 hours. Example DNSBLs: sbl.spamhaus.org, bl.spamcop.net"`
 
 		FirstTimeSenderDelay *time.Duration `sconf:"optional" sconf-doc:"Delay before accepting a message from a first-time sender for the destination account. Default: 15s."`
+		Tarpit               *Tarpit        `sconf:"optional" sconf-doc:"If set, responses to SMTP clients with failures, such as rejected recipients or messages rejected due to bad reputation, are progressively slowed down instead of only being rejected immediately. This keeps spammers busy, while legitimate senders with few failures are not affected. Failures are tracked per IP, or /64 network for IPv6."`
 
 		DNSBLZones []dns.Domain `sconf:"-"`
 	} `sconf:"optional"`
@@ -113,20 +142,33 @@ type Listener struct {
 		Enabled           bool
 		Port              int  `sconf:"optional" sconf-doc:"Default 587."`
 		NoRequireSTARTTLS bool `sconf:"optional" sconf-doc:"Do not require STARTTLS. Since users must login, this means password may be sent without encryption. Not recommended."`
+		ProxyProtocol     bool `sconf:"optional" sconf-doc:"Connections start with a HAProxy PROXY protocol header, version 1 or 2, sent by a load balancer listed in ProxyProtocolFrom. The client address from the header is used for logging, rate limiting and IP-based policies."`
 	} `sconf:"optional" sconf-doc:"SMTP for submitting email, e.g. by email applications. Starts out in plain text, can be upgraded to TLS with the STARTTLS command. Prefer using Submissions which is always a TLS connection."`
 	Submissions struct {
-		Enabled bool
-		Port    int `sconf:"optional" sconf-doc:"Default 465."`
+		Enabled       bool
+		Port          int  `sconf:"optional" sconf-doc:"Default 465."`
+		ProxyProtocol bool `sconf:"optional" sconf-doc:"Connections start with a HAProxy PROXY protocol header, version 1 or 2, sent by a load balancer listed in ProxyProtocolFrom. The client address from the header is used for logging, rate limiting and IP-based policies."`
 	} `sconf:"optional" sconf-doc:"SMTP over TLS for submitting email, by email applications. Requires a TLS config."`
 	IMAP struct {
 		Enabled           bool
 		Port              int  `sconf:"optional" sconf-doc:"Default 143."`
 		NoRequireSTARTTLS bool `sconf:"optional" sconf-doc:"Enable this only when the connection is otherwise encrypted (e.g. through a VPN)."`
+		ProxyProtocol     bool `sconf:"optional" sconf-doc:"Connections start with a HAProxy PROXY protocol header, version 1 or 2, sent by a load balancer listed in ProxyProtocolFrom. The client address from the header is used for logging, rate limiting and IP-based policies."`
 	} `sconf:"optional" sconf-doc:"IMAP for reading email, by email applications. Starts out in plain text, can be upgraded to TLS with the STARTTLS command. Prefer using IMAPS instead which is always a TLS connection."`
 	IMAPS struct {
-		Enabled bool
-		Port    int `sconf:"optional" sconf-doc:"Default 993."`
+		Enabled       bool
+		Port          int  `sconf:"optional" sconf-doc:"Default 993."`
+		ProxyProtocol bool `sconf:"optional" sconf-doc:"Connections start with a HAProxy PROXY protocol header, version 1 or 2, sent by a load balancer listed in ProxyProtocolFrom. The client address from the header is used for logging, rate limiting and IP-based policies."`
 	} `sconf:"optional" sconf-doc:"IMAP over TLS for reading email, by email applications. Requires a TLS config."`
+	POP3 struct {
+		Enabled           bool
+		Port              int  `sconf:"optional" sconf-doc:"Default 110."`
+		NoRequireSTARTTLS bool `sconf:"optional" sconf-doc:"Enable this only when the connection is otherwise encrypted (e.g. through a VPN)."`
+	} `sconf:"optional" sconf-doc:"POP3 for retrieving messages from the Inbox, for devices and applications that only support POP3. Starts out in plain text, can be upgraded to TLS with the STLS command. Prefer using POP3S instead which is always a TLS connection, or IMAP."`
+	POP3S struct {
+		Enabled bool
+		Port    int `sconf:"optional" sconf-doc:"Default 995."`
+	} `sconf:"optional" sconf-doc:"POP3 over TLS for retrieving messages from the Inbox. Requires a TLS config."`
 	AccountHTTP struct {
 		Enabled bool
 		Port    int    `sconf:"optional" sconf-doc:"Default 80."`
@@ -137,6 +179,16 @@ type Listener struct {
 		Port    int    `sconf:"optional" sconf-doc:"Default 80."`
 		Path    string `sconf:"optional" sconf-doc:"Path to serve account requests on, e.g. /mox/. Useful if domain serves other resources. Default is /."`
 	} `sconf:"optional" sconf-doc:"Account web interface listener for HTTPS. Requires a TLS config."`
+	JMAPHTTP struct {
+		Enabled bool
+		Port    int    `sconf:"optional" sconf-doc:"Default 80."`
+		Path    string `sconf:"optional" sconf-doc:"Path to serve JMAP requests on, e.g. /mox/jmap/. Default is /jmap/."`
+	} `sconf:"optional" sconf-doc:"JMAP API, for email clients accessing accounts over HTTP. The session resource is served at /jmap/session, and /.well-known/jmap redirects to it. Credentials are sent in plain text, only enable on internal IPs or behind a TLS-terminating proxy."`
+	JMAPHTTPS struct {
+		Enabled bool
+		Port    int    `sconf:"optional" sconf-doc:"Default 443."`
+		Path    string `sconf:"optional" sconf-doc:"Path to serve JMAP requests on, e.g. /mox/jmap/. Default is /jmap/."`
+	} `sconf:"optional" sconf-doc:"JMAP API listener for HTTPS. Requires a TLS config."`
 	AdminHTTP struct {
 		Enabled bool
 		Port    int    `sconf:"optional" sconf-doc:"Default 80."`
@@ -173,16 +225,38 @@ type Listener struct {
 		Enabled bool
 		Port    int `sconf:"optional" sconf-doc:"Port for HTTPS webserver."`
 	} `sconf:"optional" sconf-doc:"All configured WebHandlers will serve on an enabled listener. Either ACME must be configured, or for each WebHandler domain a TLS certificate must be configured."`
+	DNS struct {
+		Enabled bool
+		Port    int      `sconf:"optional" sconf-doc:"Port for both UDP and TCP, 53 by default."`
+		AXFRIPs []string `sconf:"optional" sconf-doc:"IPs of secondary name servers that are allowed zone transfers (AXFR) over TCP. Zone transfers from other IPs are refused."`
+
+		AXFRAllowed []net.IP `sconf:"-" json:"-"` // Parsed AXFRIPs.
+	} `sconf:"optional" sconf-doc:"Authoritative DNS server for the configured domains, answering with exactly the records mox wants published: MX, SPF, DKIM, DMARC, MTA-STS, TLS reporting, autoconfig and SRV records, and TLSA records for listeners with static TLS certificates. A/AAAA records are served for the hostname if it is in one of the domains. Delegate a (sub)domain to mox by adding NS records for it in the parent zone, pointing to the mail server hostname. Queries for names outside the configured domains are refused."`
 }
 
-// Transport is a method to delivery a message. At most one of the fields can
-// be non-nil. The non-nil field represents the type of transport. For a
-// transport with all fields nil, regular email delivery is done.
+// Transport is a method to delivery a message. At most one of the fields
+// Submissions, Submission, SMTP and Socks can be non-nil. The non-nil field
+// represents the type of transport. For a transport with all those fields nil,
+// regular email delivery is done.
 type Transport struct {
 	Submissions *TransportSMTP  `sconf:"optional" sconf-doc:"Submission SMTP over a TLS connection to submit email to a remote queue."`
 	Submission  *TransportSMTP  `sconf:"optional" sconf-doc:"Submission SMTP over a plain TCP connection (possibly with STARTTLS) to submit email to a remote queue."`
 	SMTP        *TransportSMTP  `sconf:"optional" sconf-doc:"SMTP over a plain connection (possibly with STARTTLS), typically for old-fashioned unauthenticated relaying to a remote queue."`
 	Socks       *TransportSocks `sconf:"optional" sconf-doc:"Like regular direct delivery, but makes outgoing connections through a SOCKS proxy."`
+
+	SocketOptions *SocketOptions `sconf:"optional" json:"-" sconf-doc:"Options for outgoing connections made for this transport, to the remote SMTP server or SOCKS proxy. A transport with only SocketOptions does regular direct delivery, e.g. to send from a specific IP or interface."`
+}
+
+// SocketOptions are settings for TCP connections, for multi-homed servers and
+// networks with traffic shaping.
+type SocketOptions struct {
+	Interface   string        `sconf:"optional" sconf-doc:"Bind sockets to this network interface, e.g. eth1, so traffic is only sent and received through it. Linux only. Outgoing connections are made by the unprivileged mox process, which needs Linux 5.7 or newer, or the CAP_NET_RAW capability."`
+	LocalIPs    []string      `sconf:"optional" sconf-doc:"For transports, except Socks, the local IPs to make outgoing connections from, at most one IPv4 and one IPv6 address. The address matching the address family of the remote IP is used. By default, outgoing connections are made from the IPs of SMTP listeners, if they are explicitly configured."`
+	DSCP        int           `sconf:"optional" sconf-doc:"Differentiated services code point, 0-63, set in the TOS (IPv4) or traffic class (IPv6) field of packets that are sent. E.g. 8 (CS1) for low-priority bulk traffic. Default 0."`
+	KeepAlive   time.Duration `sconf:"optional" sconf-doc:"Interval between TCP keepalive probes, e.g. 1m. Default 15s. Negative disables keepalives."`
+	UserTimeout time.Duration `sconf:"optional" sconf-doc:"Maximum time that sent data may remain unacknowledged before the connection is closed, through TCP_USER_TIMEOUT, e.g. 2m. Linux only. By default, the system default is used."`
+
+	IPs []net.IP `sconf:"-" json:"-"` // Parsed LocalIPs.
 }
 
 // TransportSMTP delivers messages by "submission" (SMTP, typically
@@ -220,16 +294,70 @@ type TransportSocks struct {
 }
 
 type Domain struct {
-	Description                string  `sconf:"optional" sconf-doc:"Free-form description of domain."`
-	LocalpartCatchallSeparator string  `sconf:"optional" sconf-doc:"If not empty, only the string before the separator is used to for email delivery decisions. For example, if set to \"+\", you+anything@example.com will be delivered to you@example.com."`
-	LocalpartCaseSensitive     bool    `sconf:"optional" sconf-doc:"If set, upper/lower case is relevant for email delivery."`
-	DKIM                       DKIM    `sconf:"optional" sconf-doc:"With DKIM signing, a domain is taking responsibility for (content of) emails it sends, letting receiving mail servers build up a (hopefully positive) reputation of the domain, which can help with mail delivery."`
-	DMARC                      *DMARC  `sconf:"optional" sconf-doc:"With DMARC, a domain publishes, in DNS, a policy on how other mail servers should handle incoming messages with the From-header matching this domain and/or subdomain (depending on the configured alignment). Receiving mail servers use this to build up a reputation of this domain, which can help with mail delivery. A domain can also publish an email address to which reports about DMARC verification results can be sent by verifying mail servers, useful for monitoring. Incoming DMARC reports are automatically parsed, validated, added to metrics and stored in the reporting database for later display in the admin web pages."`
-	MTASTS                     *MTASTS `sconf:"optional" sconf-doc:"With MTA-STS a domain publishes, in DNS, presence of a policy for using/requiring TLS for SMTP connections. The policy is served over HTTPS."`
-	TLSRPT                     *TLSRPT `sconf:"optional" sconf-doc:"With TLSRPT a domain specifies in DNS where reports about encountered SMTP TLS behaviour should be sent. Useful for monitoring. Incoming TLS reports are automatically parsed, validated, added to metrics and stored in the reporting database for later display in the admin web pages."`
-	Routes                     []Route `sconf:"optional" sconf-doc:"Routes for delivering outgoing messages through the queue. Each delivery attempt evaluates account routes, these domain routes and finally global routes. The transport of the first matching route is used in the delivery attempt. If no routes match, which is the default with no configured routes, messages are delivered directly from the queue."`
+	Description                string           `sconf:"optional" sconf-doc:"Free-form description of domain."`
+	LocalpartCatchallSeparator string           `sconf:"optional" sconf-doc:"If not empty, only the string before the separator is used to for email delivery decisions. For example, if set to \"+\", you+anything@example.com will be delivered to you@example.com."`
+	LocalpartCaseSensitive     bool             `sconf:"optional" sconf-doc:"If set, upper/lower case is relevant for email delivery."`
+	DKIM                       DKIM             `sconf:"optional" sconf-doc:"With DKIM signing, a domain is taking responsibility for (content of) emails it sends, letting receiving mail servers build up a (hopefully positive) reputation of the domain, which can help with mail delivery."`
+	DMARC                      *DMARC           `sconf:"optional" sconf-doc:"With DMARC, a domain publishes, in DNS, a policy on how other mail servers should handle incoming messages with the From-header matching this domain and/or subdomain (depending on the configured alignment). Receiving mail servers use this to build up a reputation of this domain, which can help with mail delivery. A domain can also publish an email address to which reports about DMARC verification results can be sent by verifying mail servers, useful for monitoring. Incoming DMARC reports are automatically parsed, validated, added to metrics and stored in the reporting database for later display in the admin web pages."`
+	MTASTS                     *MTASTS          `sconf:"optional" sconf-doc:"With MTA-STS a domain publishes, in DNS, presence of a policy for using/requiring TLS for SMTP connections. The policy is served over HTTPS."`
+	TLSRPT                     *TLSRPT          `sconf:"optional" sconf-doc:"With TLSRPT a domain specifies in DNS where reports about encountered SMTP TLS behaviour should be sent. Useful for monitoring. Incoming TLS reports are automatically parsed, validated, added to metrics and stored in the reporting database for later display in the admin web pages."`
+	Routes                     []Route          `sconf:"optional" sconf-doc:"Routes for delivering outgoing messages through the queue. Each delivery attempt evaluates account routes, these domain routes and finally global routes. The transport of the first matching route is used in the delivery attempt. If no routes match, which is the default with no configured routes, messages are delivered directly from the queue."`
+	AccountTemplate            *AccountTemplate `sconf:"optional" sconf-doc:"Settings for new accounts with an initial address in this domain, applied when accounts are added through the admin web interface or the command line. Existing accounts are not changed."`
+	TransportRules             []TransportRule  `sconf:"optional" sconf-doc:"Mail flow rules for messages submitted with a From address in this domain (outgoing) and messages delivered to addresses in this domain (incoming). All matching rules are applied, in order."`
+	Language                   string           `sconf:"optional" sconf-doc:"Language for system-generated messages, such as delivery status notifications, to accounts in this domain, and for autoconfig responses without a supported Accept-Language header. A language tag like en or nl. Default is the global DefaultLanguage."`
+	Limits                     *DomainLimits    `sconf:"optional" sconf-doc:"Aggregate limits for all accounts of this domain together, e.g. for a customer when hosting multiple customers on one instance. Accounts belong to the domain of their Domain field."`
+	Namespaces                 *Namespaces      `sconf:"optional" sconf-doc:"IMAP namespaces for mailboxes of other accounts, for users of accounts that belong to this domain through their Domain field. Accounts can override them."`
+	MessageSizeLimit           int64            `sconf:"optional" sconf-doc:"Maximum size in bytes of a single message for accounts that belong to this domain through their Domain field, unless an account has its own MessageSizeLimit. Zero means no limit."`
+	Journal                    bool             `sconf:"optional" sconf-doc:"Journaling for all accounts that belong to this domain through their Domain field, as if Journal was set for each account."`
+	JournalAddress             string           `sconf:"optional" sconf-doc:"Address to forward a copy of each message received or submitted by accounts that belong to this domain to, like JournalAddress for accounts. If an account also has a JournalAddress, copies are forwarded to both addresses."`
+	Hold                       bool             `sconf:"optional" sconf-doc:"Litigation hold for all accounts that belong to this domain through their Domain field, as if Hold was set for each account."`
+
+	Domain      dns.Domain `sconf:"-" json:"-"`
+	JournalPath smtp.Path  `sconf:"-" json:"-"` // Parsed form of JournalAddress.
+}
+
+// DomainLimits are limits for all accounts of a domain together.
+type DomainLimits struct {
+	MaxAccounts               int   `sconf:"optional" sconf-doc:"Maximum number of accounts. Adding more accounts fails. Zero means no limit."`
+	MaxStorage                int64 `sconf:"optional" sconf-doc:"Maximum total size in bytes of the messages in the accounts. When reached, incoming messages for the accounts are rejected with a temporary error, and IMAP APPEND fails. Zero means no limit."`
+	MaxOutgoingMessagesPerDay int   `sconf:"optional" sconf-doc:"Maximum number of outgoing messages of the accounts in a 24 hour window, in addition to the per-account MaxOutgoingMessagesPerDay. Zero means no limit."`
+}
+
+// Namespaces configures the IMAP namespaces in which users see mailboxes of
+// other accounts that were shared with them. ../rfc/2342
+type Namespaces struct {
+	SharedPrefix  string `sconf:"optional" sconf-doc:"Prefix of the namespace with mailboxes shared by other accounts, followed by the name of the owning account, e.g. Shared for Shared/<account>/<mailbox>. Default #shared. Own mailboxes with a name starting with the prefix cannot be accessed over IMAP, and cannot be created; a prefix starting with # cannot clash with own mailboxes."`
+	PublicAccount string `sconf:"optional" sconf-doc:"Name of an account with public folders. Its mailboxes that the user has rights on, typically through the identifier anyone, are in the public namespace instead of the namespace of shared mailboxes. If empty, there is no public namespace."`
+	PublicPrefix  string `sconf:"optional" sconf-doc:"Prefix of the public namespace, e.g. Public for Public/<mailbox>. Default #public."`
+}
+
+// AccountTemplate holds settings for new accounts in a domain.
+type TransportRule struct {
+	Name            string            `sconf-doc:"Name of the rule, used in logging."`
+	Direction       string            `sconf:"optional" sconf-doc:"Either \"incoming\" or \"outgoing\" to only match messages in that direction. If empty, the rule matches in both directions."`
+	SenderRegexp    string            `sconf:"optional" sconf-doc:"Matches if this regular expression matches (a substring of) the address in the message From header, in lower case. E.g. @example\\.org$."`
+	RecipientRegexp string            `sconf:"optional" sconf-doc:"Matches if this regular expression matches (a substring of) the SMTP RCPT TO address, in lower case."`
+	HeadersRegexp   map[string]string `sconf:"optional" sconf-doc:"Matches if these header field/value regular expressions all match (substrings of) the message headers, with the same semantics as HeadersRegexp in rulesets of accounts."`
+
+	BCC           []string `sconf:"optional" sconf-doc:"Addresses to send a copy of the message to, through the queue, e.g. a compliance mailbox. Copies are sent with an empty SMTP MAIL FROM and without requesting DSNs."`
+	SubjectPrefix string   `sconf:"optional" sconf-doc:"Text to prepend to the Subject header, e.g. \"[External] \". Not added again if the subject already contains the text. For outgoing messages, the subject is changed before DKIM signing."`
+	Transport     string   `sconf:"optional" sconf-doc:"For outgoing messages only: transport to deliver the message with, instead of the transport from routes."`
+	Moderate      bool     `sconf:"optional" sconf-doc:"For outgoing messages only: hold the message in the queue until an administrator approves it by kicking it in the queue, or rejects it by removing it from the queue."`
+
+	SenderRegexpCompiled    *regexp.Regexp      `sconf:"-" json:"-"`
+	RecipientRegexpCompiled *regexp.Regexp      `sconf:"-" json:"-"`
+	HeadersRegexpCompiled   [][2]*regexp.Regexp `sconf:"-" json:"-"`
+	BCCPaths                []smtp.Path         `sconf:"-" json:"-"`
+}
 
-	Domain dns.Domain `sconf:"-" json:"-"`
+type AccountTemplate struct {
+	Mailboxes                    []string    `sconf:"optional" sconf-doc:"Mailboxes to create for new accounts, instead of DefaultMailboxes from mox.conf. Inbox is always created."`
+	Rulesets                     []Ruleset   `sconf:"optional" sconf-doc:"Delivery rulesets for the initial address of new accounts."`
+	RejectsMailbox               string      `sconf:"optional" sconf-doc:"Rejects mailbox for new accounts. Default Rejects."`
+	JunkFilter                   *JunkFilter `sconf:"optional" sconf-doc:"Junk filter for new accounts, instead of the default junk filter settings."`
+	MaxOutgoingMessagesPerDay    int         `sconf:"optional" sconf-doc:"Maximum number of outgoing messages per day for new accounts. Default 1000."`
+	MaxFirstTimeRecipientsPerDay int         `sconf:"optional" sconf-doc:"Maximum number of first-time recipients per day for new accounts. Default 200."`
+	SubmissionFromAllowed        []string    `sconf:"optional" sconf-doc:"Additional addresses new accounts can send as, e.g. shared addresses like info@example.com, or '@domain' for all addresses in a domain."`
 }
 
 type DMARC struct {
@@ -292,13 +420,100 @@ type Route struct {
 	ResolvedTransport Transport `sconf:"-" json:"-"`
 }
 
+type DMARCOverride struct {
+	Name        string   `sconf-doc:"Name for the override, used in logging and for the hit counts shown in the admin web interface."`
+	DKIMDomains []string `sconf:"optional" sconf-doc:"Matches if the message has a valid DKIM signature from one of these domains, typically the domain of the forwarder."`
+	IPs         []string `sconf:"optional" sconf-doc:"Matches if the message was delivered from one of these IPs or networks in CIDR notation, e.g. 192.0.2.1 or 2001:db8::/32."`
+	Comment     string   `sconf:"optional" sconf-doc:"Free form comment, e.g. why the override was added."`
+
+	DKIMDNSDomains []dns.Domain `sconf:"-" json:"-"`
+	IPNets         []net.IPNet  `sconf:"-" json:"-"`
+}
+
+// AuthMechanism is a SASL mechanism offered by the services of a listener.
+type AuthMechanism struct {
+	Mechanism  string   `sconf-doc:"One of SCRAM-SHA-256, SCRAM-SHA-1, CRAM-MD5 or PLAIN. PLAIN also controls the IMAP LOGIN command, which sends the password in plain text as well."`
+	IPNets     []string `sconf:"optional" sconf-doc:"If set, the mechanism is only offered to and accepted from clients with an IP in one of these networks in CIDR notation, e.g. 192.168.1.0/24 for legacy devices on a local network that only support CRAM-MD5."`
+	RequireTLS bool     `sconf:"optional" sconf-doc:"Only offer and accept the mechanism on TLS connections, also for services with NoRequireSTARTTLS. Useful for PLAIN, which sends the password in plain text, while still allowing the other mechanisms without TLS."`
+
+	ParsedIPNets []net.IPNet `sconf:"-" json:"-"`
+}
+
+// AuthMechanismsDefault are the SASL mechanisms offered by listeners without
+// AuthMechanisms, in order of preference.
+var AuthMechanismsDefault = []string{"SCRAM-SHA-256", "SCRAM-SHA-1", "CRAM-MD5", "PLAIN"}
+
+// AuthMechanismsOAuth are the SASL mechanisms for bearer tokens, only available
+// with OAuth configured. They are added to AuthMechanismsDefault for listeners
+// without AuthMechanisms.
+var AuthMechanismsOAuth = []string{"OAUTHBEARER", "XOAUTH2"}
+
+// AuthMechanismKnown returns whether mech is a SASL mechanism we implement.
+func AuthMechanismKnown(mech string) bool {
+	for _, l := range [][]string{AuthMechanismsDefault, AuthMechanismsOAuth} {
+		for _, m := range l {
+			if m == mech {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AuthMechanismsAllowed returns the names of the mechanisms in l that a client
+// with remoteIP can use, on a connection with or without TLS. If l is empty,
+// AuthMechanismsDefault is returned, with AuthMechanismsOAuth if oauth is set.
+func AuthMechanismsAllowed(l []AuthMechanism, oauth bool, remoteIP net.IP, tls bool) []string {
+	if len(l) == 0 {
+		if oauth {
+			return append(append([]string{}, AuthMechanismsDefault...), AuthMechanismsOAuth...)
+		}
+		return AuthMechanismsDefault
+	}
+	var r []string
+	for _, m := range l {
+		if m.RequireTLS && !tls {
+			continue
+		}
+		if len(m.ParsedIPNets) > 0 {
+			var match bool
+			for _, ipnet := range m.ParsedIPNets {
+				if ipnet.Contains(remoteIP) {
+					match = true
+					break
+				}
+			}
+			if !match {
+				continue
+			}
+		}
+		r = append(r, m.Mechanism)
+	}
+	return r
+}
+
+type Notice struct {
+	Text      string   `sconf-doc:"Text of the notice, a single line of printable ASCII, e.g. \"Maintenance on Saturday between 10:00 and 12:00 UTC, expect short interruptions.\"."`
+	Services  []string `sconf:"optional" sconf-doc:"Services to show the notice for: imap, smtp and web. Default is all."`
+	Listeners []string `sconf:"optional" sconf-doc:"Names of listeners to show the notice on. Default is all."`
+	Domains   []string `sconf:"optional" sconf-doc:"If set, the notice is only shown to authenticated users of accounts with an address in one of these domains: in IMAP after login, and in the account web interface. Not in the SMTP banner and IMAP greeting, when the user is not yet known."`
+	Start     string   `sconf:"optional" sconf-doc:"If set, the notice is only shown from this time, in RFC 3339 format, e.g. 2023-06-03T10:00:00Z."`
+	End       string   `sconf:"optional" sconf-doc:"If set, the notice is no longer shown after this time, in RFC 3339 format."`
+
+	DNSDomains []dns.Domain `sconf:"-" json:"-"`
+	StartTime  time.Time    `sconf:"-" json:"-"` // Parsed form of Start, zero if not set.
+	EndTime    time.Time    `sconf:"-" json:"-"` // Parsed form of End, zero if not set.
+}
+
 type Account struct {
 	Domain       string                 `sconf-doc:"Default domain for account. Deprecated behaviour: If a destination is not a full address but only a localpart, this domain is added to form a full address."`
 	Description  string                 `sconf:"optional" sconf-doc:"Free form description, e.g. full name or alternative contact info."`
+	Language     string                 `sconf:"optional" sconf-doc:"Language for system-generated messages to this account, such as delivery status notifications. A language tag like en or nl. Default is the language of the domain of the account."`
 	Destinations map[string]Destination `sconf-doc:"Destinations, keys are email addresses (with IDNA domains). If the address is of the form '@domain', i.e. with localpart missing, it serves as a catchall for the domain, matching all messages that are not explicitly configured. Deprecated behaviour: If the address is not a full address but a localpart, it is combined with Domain to form a full address."`
 	SubjectPass  struct {
 		Period time.Duration `sconf-doc:"How long unique values are accepted after generating, e.g. 12h."` // todo: have a reasonable default for this?
 	} `sconf:"optional" sconf-doc:"If configured, messages classified as weakly spam are rejected with instructions to retry delivery, but this time with a signed token added to the subject. During the next delivery attempt, the signed token will bypass the spam filter. Messages with a clear spam signal, such as a known bad reputation, are rejected/delayed without a signed token."`
+	ArchiveByYear      bool   `sconf:"optional" sconf-doc:"If set, messages delivered to the archive mailbox (the mailbox with the Archive special-use flag, e.g. through a ruleset) are stored in a sub-mailbox for the year the message was received, e.g. Archive/2023. This keeps the number of messages per mailbox manageable for IMAP clients. Messages moved to the archive mailbox by sweep rules, moderation, JMAP clients and administrative operations are filed the same way. Messages moved by IMAP clients are not affected: IMAP clients expect moved messages in the mailbox they chose."`
 	RejectsMailbox     string `sconf:"optional" sconf-doc:"Mail that looks like spam will be rejected, but a copy can be stored temporarily in a mailbox, e.g. Rejects. If mail isn't coming in when you expect, you can look there. The mail still isn't accepted, so the remote mail server may retry (hopefully, if legitimate), or give up (hopefully, if indeed a spammer). Messages are automatically removed from this mailbox, so do not set it to a mailbox that has messages you want to keep."`
 	AutomaticJunkFlags struct {
 		Enabled              bool   `sconf-doc:"If enabled, flags will be set automatically if they match a regular expression below. When two of the three mailbox regular expressions are set, the remaining one will match all unmatched messages. Messages are matched in the order specified and the search stops on the first match. Mailboxes are lowercased before matching."`
@@ -306,26 +521,166 @@ type Account struct {
 		NeutralMailboxRegexp string `sconf:"optional" sconf-doc:"Example: ^(inbox|neutral|postmaster|dmarc|tlsrpt|rejects), and you may wish to add trash depending on how you use it, or leave this empty."`
 		NotJunkMailboxRegexp string `sconf:"optional" sconf-doc:"Example: .* or an empty string."`
 	} `sconf:"optional" sconf-doc:"Automatically set $Junk and $NotJunk flags based on mailbox messages are delivered/moved/copied to. Email clients typically have too limited functionality to conveniently set these flags, especially $NonJunk, but they can all move messages to a different mailbox, so this helps them."`
+	MoveOnJunkFlags              bool        `sconf:"optional" sconf-doc:"If set, marking a message as junk in an IMAP client by setting the $Junk or $Phishing flag moves it to the Junk mailbox (the mailbox with the Junk special-use flag), and marking a message in the Junk mailbox as not junk with the $NotJunk flag moves it to the Inbox. The junk filter is trained based on these flags regardless of this setting. For email clients that only set flags, without moving messages."`
 	JunkFilter                   *JunkFilter `sconf:"optional" sconf-doc:"Content-based filtering, using the junk-status of individual messages to rank words in such messages as spam or ham. It is recommended you always set the applicable (non)-junk status on messages, and that you do not empty your Trash because those messages contain valuable ham/spam training information."` // todo: sane defaults for junkfilter
 	MaxOutgoingMessagesPerDay    int         `sconf:"optional" sconf-doc:"Maximum number of outgoing messages for this account in a 24 hour window. This limits the damage to recipients and the reputation of this mail server in case of account compromise. Default 1000."`
 	MaxFirstTimeRecipientsPerDay int         `sconf:"optional" sconf-doc:"Maximum number of first-time recipients in outgoing messages for this account in a 24 hour window. This limits the damage to recipients and the reputation of this mail server in case of account compromise. Default 200."`
+	SubmissionFromAllowed        []string    `sconf:"optional" sconf-doc:"Additional addresses this account can use in the SMTP MAIL FROM and message From header when submitting messages, besides the addresses of its destinations. E.g. for aliases that are delivered to a different account. An entry of the form '@domain' allows all addresses in the domain. Domains must be configured in mox, so submitted messages are DKIM-signed and pass DMARC."`
+	SubmissionFromRewrite        bool        `sconf:"optional" sconf-doc:"If set, a submitted message with an SMTP MAIL FROM and/or message From header the account is not allowed to use is not rejected, but the address is rewritten to the email address used to authenticate. For email clients or devices that are misconfigured or cannot be configured with a proper sender address. The display name in the From header is kept."`
+	SendDelegates                []string    `sconf:"optional" sconf-doc:"Names of other accounts that may send messages as this account, with the addresses of this account in the SMTP MAIL FROM and message From header, e.g. for an assistant or for a shared role. A Sender header with the address of the delegate is added to such messages. Can be changed by the account in the account web interface."`
+	NotifyTLSDowngrade           bool        `sconf:"optional" sconf-doc:"If set, the sender is notified with a delivery status notification when a message submitted by this account was delivered without TLS, after an attempt with TLS failed, e.g. due to an invalid certificate of the remote mail server."`
 	Routes                       []Route     `sconf:"optional" sconf-doc:"Routes for delivering outgoing messages through the queue. Each delivery attempt evaluates these account routes, domain routes and finally global routes. The transport of the first matching route is used in the delivery attempt. If no routes match, which is the default with no configured routes, messages are delivered directly from the queue."`
-
-	DNSDomain      dns.Domain     `sconf:"-"` // Parsed form of Domain.
+	Journal                      bool        `sconf:"optional" sconf-doc:"If set, a copy of each message received for this account over SMTP and of each message submitted by this account is written to the journal directory of the account, at accounts/<name>/journal/ in the data directory, for compliance archiving. Journal files are created read-only, with the SMTP transaction headers included, and are never removed by mox, also not when the original message is removed from its mailbox."`
+	JournalAddress               string      `sconf:"optional" sconf-doc:"If set, a copy of each message received for this account over SMTP and of each message submitted by this account is forwarded through the queue to this address, e.g. an external archiving service. The copies are sent with an empty MAIL FROM and without requesting DSNs."`
+	Hold                         bool        `sconf:"optional" sconf-doc:"Litigation hold. If set, messages cannot be permanently removed from this account: IMAP expunge fails, mailboxes that still have messages cannot be deleted, and messages cannot be cleaned up through the account web interface. Automatic removals, such as of old messages in the rejects mailbox, are skipped. Messages can still be moved and marked as deleted. Often combined with Journal. Can also be set for a domain."`
+	SweepRules                   []SweepRule `sconf:"optional" sconf-doc:"Rules for periodically moving or removing older messages from mailboxes, e.g. moving newsletters older than 30 days to an archive mailbox, or removing read notifications after a week. Rules are applied once a day, at night (local time)."`
+	MessageExpiration            bool        `sconf:"optional" sconf-doc:"If set, messages submitted by this account with an Expires header, e.g. 'Expires: Mon, 2 Oct 2023 15:00:00 +0200', are removed when they expire: all copies with the same Message-ID in mailboxes of this account, such as the copy in the Sent mailbox, and the copies delivered to recipients that are accounts on this mox instance. Copies delivered to external recipients cannot be removed, those recipients keep the message; some email clients only show it as expired. Accounts on litigation hold keep their copies. Expired messages are removed within 15 minutes."`
+	QuotaMessageSize             int64       `sconf:"optional" sconf-doc:"Maximum total size in bytes of the messages in this account. When reached, incoming messages are rejected with a temporary error, and IMAP APPEND and COPY fail. Reported to IMAP clients through the QUOTA extension. Zero means no limit."`
+	QuotaMessageCount            int64       `sconf:"optional" sconf-doc:"Maximum number of messages in this account, handled like QuotaMessageSize. Zero means no limit."`
+	Suspended                    bool        `sconf:"optional" sconf-doc:"If set, authentication for this account is rejected for IMAP, SMTP submission and the web interfaces, e.g. while offboarding a user. Incoming messages are still delivered, unless SuspendedTempfail is set."`
+	SuspendedTempfail            bool        `sconf:"optional" sconf-doc:"If set, incoming messages for this account are rejected with a temporary error while the account is suspended or pending deletion, so remote mail servers retry delivery later."`
+	DeleteAt                     string      `sconf:"optional" sconf-doc:"If set, the account is pending deletion: it is treated as suspended, and is removed, including its messages in the data directory but not its journal directory, after this time, in RFC 3339 format, e.g. 2023-10-02T15:00:00Z. Accounts on litigation hold are not removed. The removal can be canceled by clearing this field before the time has passed."`
+	Webhooks                     []Webhook   `sconf:"optional" sconf-doc:"HTTP endpoints that are notified of events for this account with a POST request with a JSON body: incoming messages delivered over SMTP, and deliveries, delays and failures of messages submitted by this account. Requests for an endpoint are sent in order of the events. Requests are retried with exponential backoff until the endpoint responds with a 2xx status code, for at most about 17 hours. Requests that still fail are kept, and can be sent again from the admin web interface. Each request has an Idempotency-Key header that is the same for retries, so endpoints can skip events they already processed."`
+	Namespaces                   *Namespaces `sconf:"optional" sconf-doc:"IMAP namespaces for mailboxes of other accounts for this account, instead of those of the domain of the account."`
+	MessageSizeLimit             int64       `sconf:"optional" sconf-doc:"Maximum size in bytes of a single message for this account, for messages appended over IMAP, also advertised to IMAP clients with APPENDLIMIT, and messages submitted over SMTP, also for the SMTP SIZE extension after authentication. Only lowers the SMTPMaxMessageSize of the submission listener. Default is the MessageSizeLimit of the domain of the account. Zero means no limit."`
+	FullTextIndex                bool        `sconf:"optional" sconf-doc:"If set, words of incoming and appended messages are added to an index, for fast searching of message text with IMAP SEARCH BODY and TEXT, and in the account web interface, instead of reading each message. With the index, such searches match messages that contain all words of the search string, instead of messages that contain the search string literally. Words must match in full, not as part of longer words. Messages that are not yet in the index, such as those delivered before enabling the index, are still read for each search. They can be added to the index with \"mox textindex\"."`
+	MaxIMAPConnections           int         `sconf:"optional" sconf-doc:"Maximum number of simultaneous authenticated IMAP connections for this account, overriding MaxPerAccount of IMAPConnectionLimits. Zero means the global limit applies."`
+	IMAPReadOnly                 bool        `sconf:"optional" sconf-doc:"If set, IMAP sessions of this account are read-only, e.g. for compliance auditors or for credentials of backup tools. Mailboxes are always opened read-only, as with EXAMINE, so messages are not marked as read. Commands that would change messages, mailboxes, subscriptions, metadata or access rights, such as APPEND, STORE, EXPUNGE, COPY, MOVE, CREATE and DELETE, fail with NOPERM. Incoming messages are still delivered."`
+	POP3LeaveOnServer            bool        `sconf:"optional" sconf-doc:"If set, messages that POP3 clients delete are not removed from the Inbox, but marked as read, so they remain available over IMAP and in the web interface. POP3 clients recognize messages they already retrieved by their unique ID (UIDL)."`
+
+	DNSDomain      dns.Domain     `sconf:"-"`          // Parsed form of Domain.
+	JournalPath    smtp.Path      `sconf:"-" json:"-"` // Parsed form of JournalAddress.
+	DeleteAtTime   time.Time      `sconf:"-" json:"-"` // Parsed form of DeleteAt, zero if not set.
 	JunkMailbox    *regexp.Regexp `sconf:"-" json:"-"`
 	NeutralMailbox *regexp.Regexp `sconf:"-" json:"-"`
 	NotJunkMailbox *regexp.Regexp `sconf:"-" json:"-"`
 }
 
+// SweepRule is a scheduled action on messages in a mailbox.
+type SweepRule struct {
+	Mailbox       string `sconf-doc:"Mailbox to take messages from."`
+	OlderThanDays int    `sconf-doc:"Only messages received more than this many days ago are swept."`
+	SeenOnly      bool   `sconf:"optional" sconf-doc:"If set, only messages marked as read (with the \\Seen flag) are swept."`
+	MoveTo        string `sconf:"optional" sconf-doc:"Mailbox to move the messages to. Created if it does not exist. Either MoveTo or Delete must be set."`
+	Delete        bool   `sconf:"optional" sconf-doc:"If set, messages are permanently removed."`
+}
+
+// Webhook is an HTTP endpoint for events of an account.
+type Webhook struct {
+	URL     string   `sconf-doc:"URL to POST events to, must be http or https."`
+	Events  []string `sconf:"optional" sconf-doc:"Events to send: incoming, delivered, delayed, failed. Default all."`
+	Secrets []string `sconf-doc:"Secrets for signing requests. The X-Mox-Signature header holds a timestamp and an HMAC-SHA256 signature for each secret, of the form t=<unix time>,v1=<hex signature>,v1=<...>, computed over the timestamp, a dot, and the request body. To rotate a secret, add a new secret at the start of the list, update the endpoint, then remove the old secret. At least one secret is required."`
+}
+
+// AuthCache configures caching of SPF, DKIM and DMARC lookups for incoming
+// messages.
+type AuthCache struct {
+	TTL        time.Duration `sconf:"optional" sconf-doc:"Maximum time to cache results. The DNS resolver used by mox does not expose the TTLs of DNS records, so results are cached for this fixed duration, which should be at or below the TTLs commonly used for these records. Results of lookups that failed with a temporary error are not cached. Default 5m."`
+	MaxEntries int           `sconf:"optional" sconf-doc:"Maximum number of entries for each of SPF, DKIM and DMARC. When full, the least recently added entries are removed. Default 10000."`
+}
+
+// WebPush configures sending notifications to browsers with the Web Push protocol.
+type WebPush struct {
+	VAPIDPrivateKeyFile string `sconf-doc:"File with PEM-encoded PKCS#8 ECDSA P-256 private key for identifying this server to push services (VAPID). Generate with \"mox webpush genkey\". If this is a relative path, it is relative to the directory of mox.conf. Changing the key invalidates existing subscriptions."`
+	Subject             string `sconf:"optional" sconf-doc:"Contact for operators of push services, a mailto: or https: URL. Default mailto:postmaster@<hostname>."`
+
+	VAPIDKey *ecdsa.PrivateKey `sconf:"-" json:"-"`
+}
+
+// SelfCheck configures periodic test messages for checking authentication of
+// outgoing messages.
+type SelfCheck struct {
+	From     string        `sconf-doc:"Address of an account to send test messages from. Its domain should have DKIM signing configured, and SPF and DMARC records."`
+	To       string        `sconf-doc:"Seed address to send test messages to. For an address of a local account, the message is delivered over SMTP to the MX host of its domain, like for external recipients, and the SPF, DKIM and DMARC results of the arrived message are checked. For external addresses, only the DKIM signature, the SPF record for explicitly configured SMTP listen IPs, and the DMARC record are verified through DNS, and delivery failures are returned as DSN to the From address."`
+	Interval time.Duration `sconf:"optional" sconf-doc:"Interval between test messages. Default 24h."`
+	Timeout  time.Duration `sconf:"optional" sconf-doc:"Time to wait for arrival of the test message at a local seed address before the check fails. Default 15m."`
+
+	FromAddress smtp.Address `sconf:"-" json:"-"`
+	ToAddress   smtp.Address `sconf:"-" json:"-"`
+}
+
+// Notifications configures messages generated by mox itself.
+type Notifications struct {
+	MaxPerHour int      `sconf:"optional" sconf-doc:"Maximum number of notifications per recipient address per hour. Further notifications in the same hour are dropped and logged. Prevents flooding recipients, e.g. with DSNs for a message sent to many recipients that all fail. Default 20."`
+	Suppress   []string `sconf:"optional" sconf-doc:"Addresses, or domains starting with @, that no notifications are sent to, e.g. for recipients that complained about DSNs or that reject them."`
+
+	SuppressAddresses []smtp.Address `sconf:"-" json:"-"`
+	SuppressDomains   []dns.Domain   `sconf:"-" json:"-"`
+}
+
+// Parking configures parking of queued messages for local recipients that cannot
+// be delivered because of a condition an administrator can fix.
+type Parking struct {
+	Period        time.Duration `sconf:"optional" sconf-doc:"How long a message is kept parked before delivery fails permanently and a DSN is sent to the sender. Default 168h, i.e. one week."`
+	CheckInterval time.Duration `sconf:"optional" sconf-doc:"Interval between checks whether the condition for parked messages has cleared, after which delivery is attempted immediately. Default 5m."`
+}
+
+// OAuth configures validation of bearer tokens for SASL OAUTHBEARER and XOAUTH2.
+// Exactly one of JWTKeyFiles and IntrospectionURL must be set. JWTKeyFiles
+// requires Issuer and Audience.
+type OAuth struct {
+	JWTKeyFiles               []string `sconf:"optional" sconf-doc:"Files with PEM-encoded public keys (RSA, ECDSA or Ed25519, in PKIX form) of the identity provider, for validating tokens that are signed JWTs without contacting the identity provider. If a path is relative, it is relative to the directory of mox.conf. Keys are only read at startup, rotated keys require a restart."`
+	IntrospectionURL          string   `sconf:"optional" sconf-doc:"URL of the token introspection endpoint (RFC 7662) of the identity provider, for validating opaque tokens, or to notice revoked tokens. Each authentication attempt makes a request."`
+	IntrospectionClientID     string   `sconf:"optional" sconf-doc:"Client ID for HTTP basic authentication to the introspection endpoint."`
+	IntrospectionClientSecret string   `sconf:"optional" sconf-doc:"Client secret for HTTP basic authentication to the introspection endpoint."`
+	Issuer                    string   `sconf:"optional" sconf-doc:"If set, tokens must have this issuer (iss claim), e.g. https://idp.example.com. Required with JWTKeyFiles."`
+	Audience                  string   `sconf:"optional" sconf-doc:"If set, tokens must be issued for this audience (aud claim), typically the client ID mail clients use at the identity provider. Required with JWTKeyFiles."`
+	UsernameClaim             string   `sconf:"optional" sconf-doc:"Claim holding the email address of the user, for finding the account. Default email."`
+
+	Validator oauth.Validator `sconf:"-" json:"-"`
+}
+
+// MessageArchive configures moving message files of older messages to
+// archive storage.
+type MessageArchive struct {
+	Path     string        `sconf-doc:"Directory to move message files to, in a subdirectory per account. Relative paths are relative to the data directory, but an absolute path on a different filesystem is typical."`
+	MinAge   time.Duration `sconf-doc:"Message files of messages received longer ago are moved, e.g. 4320h for about 6 months."`
+	Interval time.Duration `sconf:"optional" sconf-doc:"Interval between runs of the migrator, that moves message files of all accounts. Default 24h."`
+}
+
+// SQLExport configures periodic export of operational data as SQL files.
+type SQLExport struct {
+	Dir      string        `sconf-doc:"Directory to write export files to, named export-<time>.sql. Relative paths are relative to the data directory. Files are not removed by mox."`
+	Interval time.Duration `sconf:"optional" sconf-doc:"Interval between exports. Default 24h."`
+}
+
+// Tarpit configures slowing down SMTP clients with failures, with a token bucket
+// per remote IP. Each failure takes a token from the bucket, and a token is added
+// back each RecoverInterval. When the bucket is empty, each response is delayed
+// by DelayPerFailure for each failure over the bucket size.
+type Tarpit struct {
+	Burst           int           `sconf:"optional" sconf-doc:"Number of failures, i.e. the bucket size, tolerated before responses are slowed down. A message rejected due to bad reputation counts as Burst failures, so responses are slowed down immediately after. Default 5."`
+	RecoverInterval time.Duration `sconf:"optional" sconf-doc:"Interval after which one failure is forgiven. Default 1m."`
+	DelayPerFailure time.Duration `sconf:"optional" sconf-doc:"Delay added to each response for each failure over Burst. Default 2s."`
+	MaxDelay        time.Duration `sconf:"optional" sconf-doc:"Maximum delay for a single response. Default 30s."`
+}
+
+// IMAPConnectionLimits are limits for simultaneous IMAP connections.
+type IMAPConnectionLimits struct {
+	MaxPerIP      int `sconf:"optional" sconf-doc:"Maximum number of simultaneous IMAP connections from a single IP, or /64 network for IPv6. Three times as many are allowed from the /26 (IPv4) or /48 (IPv6) network of the IP, and nine times as many from the /21 or /32 network. Checked when a connection is accepted. Default 30."`
+	MaxPerAccount int `sconf:"optional" sconf-doc:"Maximum number of simultaneous authenticated IMAP connections for an account, checked at login. Zero means no limit."`
+}
+
+// ConnectionLimits are connection limits for a listener.
+type ConnectionLimits struct {
+	MaxConnections        int           `sconf:"optional" sconf-doc:"Maximum number of simultaneous connections for all services of the listener. Zero means no limit."`
+	MaxConnectionsPerIP   int           `sconf:"optional" sconf-doc:"Maximum number of simultaneous connections from a single IP. For IPv6, a /64 network is treated as a single IP. Zero means no limit."`
+	AcceptsPerMinutePerIP int           `sconf:"optional" sconf-doc:"Maximum number of new connections per minute from a single IP, or /64 network for IPv6. Zero means no limit."`
+	IdleTimeout           time.Duration `sconf:"optional" sconf-doc:"If set, connections are closed when nothing has been read from them for this duration, e.g. 10m. Services have their own idle timeouts, e.g. 5 minutes for SMTP commands, 30 minutes for IMAP IDLE and 65 seconds for HTTP keep-alive. This timeout can only make them shorter."`
+}
+
 type JunkFilter struct {
-	Threshold float64 `sconf-doc:"Approximate spaminess score between 0 and 1 above which emails are rejected as spam. Each delivery attempt adds a little noise to make it slightly harder for spammers to identify words that strongly indicate non-spaminess and use it to bypass the filter. E.g. 0.95."`
+	Threshold   float64 `sconf-doc:"Approximate spaminess score between 0 and 1 above which emails are rejected as spam. Each delivery attempt adds a little noise to make it slightly harder for spammers to identify words that strongly indicate non-spaminess and use it to bypass the filter. E.g. 0.95."`
+	ScoreHeader bool    `sconf:"optional" sconf-doc:"If set, messages delivered over SMTP get an X-Mox-Junk header with the spam probability and the word (combinations) that contributed most to it, e.g. for client-side rules or for reporting a misclassification. The header is added at the top of the message, clients should only use the first occurrence."`
 	junk.Params
 }
 
 type Destination struct {
-	Mailbox  string    `sconf:"optional" sconf-doc:"Mailbox to deliver to if none of Rulesets match. Default: Inbox."`
+	Mailbox  string    `sconf:"optional" sconf-doc:"Mailbox to deliver to if none of Rulesets match. Default: Inbox. Can also be a special-use attribute, one of \\Archive, \\Drafts, \\Junk, \\Sent or \\Trash, to deliver to the mailbox designated for that use, e.g. \\Junk."`
 	Rulesets []Ruleset `sconf:"optional" sconf-doc:"Delivery rules based on message and SMTP transaction. You may want to match each mailing list by SMTP MailFrom address, VerifiedDomain and/or List-ID header (typically <listname.example.org> if the list address is listname@example.org), delivering them to their own mailbox."`
 
+	Moderators []string `sconf:"optional" sconf-doc:"Accounts that moderate incoming messages for this address, e.g. for an announce address. Accepted incoming messages are held in the Moderation mailbox of this account, and the moderators are notified with a message in their Inbox. Once a moderator approves a message in the account web interface, it is delivered according to Mailbox and Rulesets. Rejected messages are removed. Only settable by the administrator."`
+
 	DMARCReports bool `sconf:"-" json:"-"`
 	TLSReports   bool `sconf:"-" json:"-"`
 }
@@ -351,7 +706,7 @@ type Ruleset struct {
 
 	ListAllowDomain string `sconf:"optional" sconf-doc:"Influence the spam filtering, this does not change whether this ruleset applies to a message. If this domain matches an SPF- and/or DKIM-verified (sub)domain, the message is accepted without further spam checks, such as a junk filter or DMARC reject evaluation. DMARC rejects should not apply for mailing lists that are not configured to rewrite the From-header of messages that don't have a passing DKIM signature of the From-domain. Otherwise, by rejecting messages, you may be automatically unsubscribed from the mailing list. The assumption is that mailing lists do their own spam filtering/moderation."`
 
-	Mailbox string `sconf-doc:"Mailbox to deliver to if this ruleset matches."`
+	Mailbox string `sconf-doc:"Mailbox to deliver to if this ruleset matches. Can be a special-use attribute like \\Junk, see Mailbox of the destination."`
 
 	SMTPMailFromRegexpCompiled *regexp.Regexp      `sconf:"-" json:"-"`
 	VerifiedDNSDomain          dns.Domain          `sconf:"-"`
@@ -376,9 +731,12 @@ type KeyCert struct {
 }
 
 type TLS struct {
-	ACME       string    `sconf:"optional" sconf-doc:"Name of provider from top-level configuration to use for ACME, e.g. letsencrypt."`
-	KeyCerts   []KeyCert `sconf:"optional" sconf-doc:"Key and certificate files are opened by the privileged root process and passed to the unprivileged mox process, so no special permissions are required."`
-	MinVersion string    `sconf:"optional" sconf-doc:"Minimum TLS version. Default: TLSv1.2."`
+	ACME            string    `sconf:"optional" sconf-doc:"Name of provider from top-level configuration to use for ACME, e.g. letsencrypt."`
+	KeyCerts        []KeyCert `sconf:"optional" sconf-doc:"Key and certificate files are opened by the privileged root process and passed to the unprivileged mox process, so no special permissions are required."`
+	MinVersion      string    `sconf:"optional" sconf-doc:"Minimum TLS version. Default: TLSv1.2."`
+	FallbackKeyCert *KeyCert  `sconf:"optional" sconf-doc:"Key and certificate to use for TLS connections with an SNI server name for which no certificate is available, e.g. for a hostname that isn't configured, instead of failing the TLS handshake. With ACME, also used for HTTPS connections on the ACME validation port without SNI server name. Typically a certificate for the main hostname, or a self-signed certificate."`
+
+	FallbackCertificate *tls.Certificate `sconf:"-" json:"-"`
 
 	Config     *tls.Config `sconf:"-" json:"-"` // TLS config for non-ACME-verification connections, i.e. SMTP and IMAP, and not port 443.
 	ACMEConfig *tls.Config `sconf:"-" json:"-"` // TLS config that handles ACME verification, for serving on port 443.
@@ -389,6 +747,7 @@ type WebHandler struct {
 	Domain                string       `sconf-doc:"Both Domain and PathRegexp must match for this WebHandler to match a request. Exactly one of WebStatic, WebRedirect, WebForward must be set."`
 	PathRegexp            string       `sconf-doc:"Regular expression matched against request path, must always start with ^ to ensure matching from the start of the path. The matching prefix can optionally be stripped by WebForward. The regular expression does not have to end with $."`
 	DontRedirectPlainHTTP bool         `sconf:"optional" sconf-doc:"If set, plain HTTP requests are not automatically permanently redirected (308) to HTTPS. If you don't have a HTTPS webserver configured, set this to true."`
+	Auth                  *WebAuth     `sconf:"optional" sconf-doc:"If set, requests must be authenticated before they are handled. For WebForward, the email address of the authenticated user is passed to the backend in the X-Forwarded-User header."`
 	WebStatic             *WebStatic   `sconf:"optional" sconf-doc:"Serve static files."`
 	WebRedirect           *WebRedirect `sconf:"optional" sconf-doc:"Redirect requests to configured URL."`
 	WebForward            *WebForward  `sconf:"optional" sconf-doc:"Forward requests to another webserver, i.e. reverse proxy."`
@@ -407,6 +766,7 @@ func (wh WebHandler) Equal(o WebHandler) bool {
 		x.WebStatic = nil
 		x.WebRedirect = nil
 		x.WebForward = nil
+		x.Auth = nil
 		return x
 	}
 	cwh := clean(wh)
@@ -414,7 +774,10 @@ func (wh WebHandler) Equal(o WebHandler) bool {
 	if cwh != co {
 		return false
 	}
-	if (wh.WebStatic == nil) != (o.WebStatic == nil) || (wh.WebRedirect == nil) != (o.WebRedirect == nil) || (wh.WebForward == nil) != (o.WebForward == nil) {
+	if (wh.WebStatic == nil) != (o.WebStatic == nil) || (wh.WebRedirect == nil) != (o.WebRedirect == nil) || (wh.WebForward == nil) != (o.WebForward == nil) || (wh.Auth == nil) != (o.Auth == nil) {
+		return false
+	}
+	if wh.Auth != nil && !wh.Auth.equal(*o.Auth) {
 		return false
 	}
 	if wh.WebStatic != nil {
@@ -460,6 +823,10 @@ type WebForward struct {
 	URL             string            `sconf-doc:"URL to forward HTTP requests to, e.g. http://127.0.0.1:8123/base. If StripPath is false the full request path is added to the URL. Host headers are sent unmodified. New X-Forwarded-{For,Host,Proto} headers are set. Any query string in the URL is ignored. Requests are made using Go's net/http.DefaultTransport that takes environment variables HTTP_PROXY and HTTPS_PROXY into account. Websocket connections are forwarded and data is copied between client and backend without looking at the framing. The websocket 'version' and 'key'/'accept' headers are verified during the handshake, but other websocket headers, including 'origin', 'protocol' and 'extensions' headers, are not inspected and the backend is responsible for verifying/interpreting them."`
 	ResponseHeaders map[string]string `sconf:"optional" sconf-doc:"Headers to add to the response. Useful for adding security- and cache-related headers."`
 
+	RequestHeaders        map[string]string `sconf:"optional" sconf-doc:"Headers to set on the request to the backend, replacing headers with the same name from the client. An empty value removes the header from the request. The Host header can be set to change the host for the backend."`
+	RemoveResponseHeaders []string          `sconf:"optional" sconf-doc:"Headers to remove from the response from the backend, e.g. Server or X-Powered-By."`
+	HTTP2                 bool              `sconf:"optional" sconf-doc:"Use HTTP/2 without TLS (h2c) for requests to a backend with an http URL, as required for gRPC backends. For backends with an https URL, HTTP/2 is always negotiated during the TLS handshake. Clients must also use HTTP/2 for gRPC, which is enabled for all HTTPS listeners."`
+
 	TargetURL *url.URL `sconf:"-" json:"-"`
 }
 
@@ -468,3 +835,27 @@ func (wf WebForward) equal(o WebForward) bool {
 	o.TargetURL = nil
 	return reflect.DeepEqual(wf, o)
 }
+
+type WebAuth struct {
+	BasicAuth bool     `sconf:"optional" sconf-doc:"Require HTTP basic authentication with the email address and password of an account. Only one of BasicAuth and OIDC can be set."`
+	OIDC      *WebOIDC `sconf:"optional" sconf-doc:"Require login through an OpenID Connect provider. Unauthenticated GET requests are redirected to the provider. After login, a session cookie is set, valid for 12 hours or until mox restarts."`
+	Allow     []string `sconf:"optional" sconf-doc:"Email addresses, or domains when starting with @, of users that are allowed access. For BasicAuth, the address used for logging in is checked, and if Allow is empty, all accounts are allowed. For OIDC, the verified email address from the provider is checked, and Allow must be non-empty."`
+
+	AllowAddresses []smtp.Address `sconf:"-" json:"-"`
+	AllowDomains   []dns.Domain   `sconf:"-" json:"-"`
+}
+
+func (wa WebAuth) equal(o WebAuth) bool {
+	wa.AllowAddresses = nil
+	wa.AllowDomains = nil
+	o.AllowAddresses = nil
+	o.AllowDomains = nil
+	return reflect.DeepEqual(wa, o)
+}
+
+type WebOIDC struct {
+	Issuer       string `sconf-doc:"URL of the OpenID provider, e.g. https://accounts.example.com. Its configuration is fetched from /.well-known/openid-configuration at the URL."`
+	ClientID     string `sconf-doc:"Client ID, as registered at the provider."`
+	ClientSecret string `sconf-doc:"Client secret, as registered at the provider."`
+	CallbackPath string `sconf:"optional" sconf-doc:"Path on the domain of the WebHandler that the provider redirects back to after login, handled by mox. Must be registered at the provider as part of the redirect URI, e.g. https://example.org/.mox/oidc-callback. Default /.mox/oidc-callback."`
+}
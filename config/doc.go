@@ -91,6 +91,15 @@ describe-static" and "mox config describe-domains":
 			# configuring port forwarding. (optional)
 			Port: 0
 
+			# If set, a single certificate is requested at startup for the hostnames of
+			# listeners that do not have a certificate yet, with each hostname as subject
+			# alternative name, instead of a certificate per hostname. Helps to stay within
+			# rate limits of the ACME provider when many hostnames are configured, e.g.
+			# autoconfig hosts for many domains. Validation is done with HTTP-01, so only done
+			# when a listener serves plain HTTP on port 80. Certificates are renewed per
+			# hostname. (optional)
+			ConsolidateHostnames: false
+
 	# File containing hash of admin password, for authentication in the web admin
 	# pages (if enabled). (optional)
 	AdminPasswordFile:
@@ -141,10 +150,120 @@ describe-static" and "mox config describe-domains":
 				# Minimum TLS version. Default: TLSv1.2. (optional)
 				MinVersion:
 
+				# Key and certificate to use for TLS connections with an SNI server name for which
+				# no certificate is available, e.g. for a hostname that isn't configured, instead
+				# of failing the TLS handshake. With ACME, also used for HTTPS connections on the
+				# ACME validation port without SNI server name. Typically a certificate for the
+				# main hostname, or a self-signed certificate. (optional)
+				FallbackKeyCert:
+
+					# Certificate including intermediate CA certificates, in PEM format.
+					CertFile:
+
+					# Private key for certificate, in PEM format. PKCS8 is recommended, but PKCS1 and
+					# EC private keys are recognized as well.
+					KeyFile:
+
 			# Maximum size in bytes accepted incoming and outgoing messages. Default is 100MB.
 			# (optional)
 			SMTPMaxMessageSize: 0
 
+			# Limits for incoming connections, shared by all services of this listener (SMTP,
+			# IMAP, HTTP). Connections over a limit are closed immediately after being
+			# accepted. The SMTP and IMAP services additionally have their own built-in per-IP
+			# limits. (optional)
+			ConnectionLimits:
+
+				# Maximum number of simultaneous connections for all services of the listener.
+				# Zero means no limit. (optional)
+				MaxConnections: 0
+
+				# Maximum number of simultaneous connections from a single IP. For IPv6, a /64
+				# network is treated as a single IP. Zero means no limit. (optional)
+				MaxConnectionsPerIP: 0
+
+				# Maximum number of new connections per minute from a single IP, or /64 network
+				# for IPv6. Zero means no limit. (optional)
+				AcceptsPerMinutePerIP: 0
+
+				# If set, connections are closed when nothing has been read from them for this
+				# duration, e.g. 10m. Services have their own idle timeouts, e.g. 5 minutes for
+				# SMTP commands, 30 minutes for IMAP IDLE and 65 seconds for HTTP keep-alive. This
+				# timeout can only make them shorter. (optional)
+				IdleTimeout: 0s
+
+			# SASL authentication mechanisms offered and accepted by the Submission,
+			# Submissions, IMAP, IMAPS, POP3 and POP3S services of this listener, in order of
+			# preference. Default is SCRAM-SHA-256, SCRAM-SHA-1, CRAM-MD5 and PLAIN for all
+			# clients. The services still only offer authentication without TLS if they are
+			# configured with NoRequireSTARTTLS. The SMTP service, typically on port 25 for
+			# incoming email, never offers authentication. When PLAIN is configured here for a
+			# listener with a NoRequireSTARTTLS service, it must either have RequireTLS or
+			# IPNets set, to prevent accidentally accepting plain text passwords over
+			# unencrypted connections from anywhere. (optional)
+			AuthMechanisms:
+				-
+
+					# One of SCRAM-SHA-256, SCRAM-SHA-1, CRAM-MD5 or PLAIN. PLAIN also controls the
+					# IMAP LOGIN command, which sends the password in plain text as well.
+					Mechanism:
+
+					# If set, the mechanism is only offered to and accepted from clients with an IP in
+					# one of these networks in CIDR notation, e.g. 192.168.1.0/24 for legacy devices
+					# on a local network that only support CRAM-MD5. (optional)
+					IPNets:
+						-
+
+					# Only offer and accept the mechanism on TLS connections, also for services with
+					# NoRequireSTARTTLS. Useful for PLAIN, which sends the password in plain text,
+					# while still allowing the other mechanisms without TLS. (optional)
+					RequireTLS: false
+
+			# Refuse to start if services with authentication are enabled for this listener:
+			# Submission, Submissions, IMAP, IMAPS, POP3, POP3S, AccountHTTP, AccountHTTPS,
+			# JMAPHTTP, JMAPHTTPS, AdminHTTP and AdminHTTPS. For listeners that should only
+			# accept incoming email, e.g. an MX listener on a public IP, to prevent
+			# accidentally exposing login services. (optional)
+			NoAuth: false
+
+			# Options for the listening sockets and accepted connections of all services of
+			# this listener. LocalIPs cannot be set for listeners. (optional)
+			SocketOptions:
+
+				# Bind sockets to this network interface, e.g. eth1, so traffic is only sent and
+				# received through it. Linux only. Outgoing connections are made by the
+				# unprivileged mox process, which needs Linux 5.7 or newer, or the CAP_NET_RAW
+				# capability. (optional)
+				Interface:
+
+				# For transports, except Socks, the local IPs to make outgoing connections from,
+				# at most one IPv4 and one IPv6 address. The address matching the address family
+				# of the remote IP is used. By default, outgoing connections are made from the IPs
+				# of SMTP listeners, if they are explicitly configured. (optional)
+				LocalIPs:
+					-
+
+				# Differentiated services code point, 0-63, set in the TOS (IPv4) or traffic class
+				# (IPv6) field of packets that are sent. E.g. 8 (CS1) for low-priority bulk
+				# traffic. Default 0. (optional)
+				DSCP: 0
+
+				# Interval between TCP keepalive probes, e.g. 1m. Default 15s. Negative disables
+				# keepalives. (optional)
+				KeepAlive: 0s
+
+				# Maximum time that sent data may remain unacknowledged before the connection is
+				# closed, through TCP_USER_TIMEOUT, e.g. 2m. Linux only. By default, the system
+				# default is used. (optional)
+				UserTimeout: 0s
+
+			# IPs, or networks in CIDR notation, of TCP load balancers that connect to the
+			# services of this listener that have ProxyProtocol enabled. Connections to those
+			# services from other IPs are refused. Required if any service enables
+			# ProxyProtocol. (optional)
+			ProxyProtocolFrom:
+				-
+
 			# (optional)
 			SMTP:
 				Enabled: false
@@ -174,6 +293,27 @@ describe-static" and "mox config describe-domains":
 				# account. Default: 15s. (optional)
 				FirstTimeSenderDelay: 0s
 
+				# If set, responses to SMTP clients with failures, such as rejected recipients or
+				# messages rejected due to bad reputation, are progressively slowed down instead
+				# of only being rejected immediately. This keeps spammers busy, while legitimate
+				# senders with few failures are not affected. Failures are tracked per IP, or /64
+				# network for IPv6. (optional)
+				Tarpit:
+
+					# Number of failures, i.e. the bucket size, tolerated before responses are slowed
+					# down. A message rejected due to bad reputation counts as Burst failures, so
+					# responses are slowed down immediately after. Default 5. (optional)
+					Burst: 0
+
+					# Interval after which one failure is forgiven. Default 1m. (optional)
+					RecoverInterval: 0s
+
+					# Delay added to each response for each failure over Burst. Default 2s. (optional)
+					DelayPerFailure: 0s
+
+					# Maximum delay for a single response. Default 30s. (optional)
+					MaxDelay: 0s
+
 			# SMTP for submitting email, e.g. by email applications. Starts out in plain text,
 			# can be upgraded to TLS with the STARTTLS command. Prefer using Submissions which
 			# is always a TLS connection. (optional)
@@ -187,6 +327,11 @@ describe-static" and "mox config describe-domains":
 				# without encryption. Not recommended. (optional)
 				NoRequireSTARTTLS: false
 
+				# Connections start with a HAProxy PROXY protocol header, version 1 or 2, sent by
+				# a load balancer listed in ProxyProtocolFrom. The client address from the header
+				# is used for logging, rate limiting and IP-based policies. (optional)
+				ProxyProtocol: false
+
 			# SMTP over TLS for submitting email, by email applications. Requires a TLS
 			# config. (optional)
 			Submissions:
@@ -195,6 +340,11 @@ describe-static" and "mox config describe-domains":
 				# Default 465. (optional)
 				Port: 0
 
+				# Connections start with a HAProxy PROXY protocol header, version 1 or 2, sent by
+				# a load balancer listed in ProxyProtocolFrom. The client address from the header
+				# is used for logging, rate limiting and IP-based policies. (optional)
+				ProxyProtocol: false
+
 			# IMAP for reading email, by email applications. Starts out in plain text, can be
 			# upgraded to TLS with the STARTTLS command. Prefer using IMAPS instead which is
 			# always a TLS connection. (optional)
@@ -208,6 +358,11 @@ describe-static" and "mox config describe-domains":
 				# VPN). (optional)
 				NoRequireSTARTTLS: false
 
+				# Connections start with a HAProxy PROXY protocol header, version 1 or 2, sent by
+				# a load balancer listed in ProxyProtocolFrom. The client address from the header
+				# is used for logging, rate limiting and IP-based policies. (optional)
+				ProxyProtocol: false
+
 			# IMAP over TLS for reading email, by email applications. Requires a TLS config.
 			# (optional)
 			IMAPS:
@@ -216,6 +371,33 @@ describe-static" and "mox config describe-domains":
 				# Default 993. (optional)
 				Port: 0
 
+				# Connections start with a HAProxy PROXY protocol header, version 1 or 2, sent by
+				# a load balancer listed in ProxyProtocolFrom. The client address from the header
+				# is used for logging, rate limiting and IP-based policies. (optional)
+				ProxyProtocol: false
+
+			# POP3 for retrieving messages from the Inbox, for devices and applications that
+			# only support POP3. Starts out in plain text, can be upgraded to TLS with the
+			# STLS command. Prefer using POP3S instead which is always a TLS connection, or
+			# IMAP. (optional)
+			POP3:
+				Enabled: false
+
+				# Default 110. (optional)
+				Port: 0
+
+				# Enable this only when the connection is otherwise encrypted (e.g. through a
+				# VPN). (optional)
+				NoRequireSTARTTLS: false
+
+			# POP3 over TLS for retrieving messages from the Inbox. Requires a TLS config.
+			# (optional)
+			POP3S:
+				Enabled: false
+
+				# Default 995. (optional)
+				Port: 0
+
 			# Account web interface, for email users wanting to change their accounts, e.g.
 			# set new password, set new delivery rulesets. Served at /. (optional)
 			AccountHTTP:
@@ -239,6 +421,29 @@ describe-static" and "mox config describe-domains":
 				# resources. Default is /. (optional)
 				Path:
 
+			# JMAP API, for email clients accessing accounts over HTTP. The session resource
+			# is served at /jmap/session, and /.well-known/jmap redirects to it. Credentials
+			# are sent in plain text, only enable on internal IPs or behind a TLS-terminating
+			# proxy. (optional)
+			JMAPHTTP:
+				Enabled: false
+
+				# Default 80. (optional)
+				Port: 0
+
+				# Path to serve JMAP requests on, e.g. /mox/jmap/. Default is /jmap/. (optional)
+				Path:
+
+			# JMAP API listener for HTTPS. Requires a TLS config. (optional)
+			JMAPHTTPS:
+				Enabled: false
+
+				# Default 443. (optional)
+				Port: 0
+
+				# Path to serve JMAP requests on, e.g. /mox/jmap/. Default is /jmap/. (optional)
+				Path:
+
 			# Admin web interface, for managing domains, accounts, etc. Served at /admin/.
 			# Preferably only enable on non-public IPs. Hint: use 'ssh -L 8080:localhost:80
 			# you@yourmachine' and open http://localhost:8080/admin/, or set up a tunnel (e.g.
@@ -327,6 +532,24 @@ describe-static" and "mox config describe-domains":
 				# Port for HTTPS webserver. (optional)
 				Port: 0
 
+			# Authoritative DNS server for the configured domains, answering with exactly the
+			# records mox wants published: MX, SPF, DKIM, DMARC, MTA-STS, TLS reporting,
+			# autoconfig and SRV records, and TLSA records for listeners with static TLS
+			# certificates. A/AAAA records are served for the hostname if it is in one of the
+			# domains. Delegate a (sub)domain to mox by adding NS records for it in the parent
+			# zone, pointing to the mail server hostname. Queries for names outside the
+			# configured domains are refused. (optional)
+			DNS:
+				Enabled: false
+
+				# Port for both UDP and TCP, 53 by default. (optional)
+				Port: 0
+
+				# IPs of secondary name servers that are allowed zone transfers (AXFR) over TCP.
+				# Zone transfers from other IPs are refused. (optional)
+				AXFRIPs:
+					-
+
 	# Destination for emails delivered to postmaster addresses: a plain 'postmaster'
 	# without domain, 'postmaster@<hostname>' (also for each listener with SMTP
 	# enabled), and as fallback for each domain without explicitly configured
@@ -467,6 +690,270 @@ describe-static" and "mox config describe-domains":
 				# typically the hostname of the host in the Address field.
 				RemoteHostname:
 
+			# Options for outgoing connections made for this transport, to the remote SMTP
+			# server or SOCKS proxy. A transport with only SocketOptions does regular direct
+			# delivery, e.g. to send from a specific IP or interface. (optional)
+			SocketOptions:
+
+				# Bind sockets to this network interface, e.g. eth1, so traffic is only sent and
+				# received through it. Linux only. Outgoing connections are made by the
+				# unprivileged mox process, which needs Linux 5.7 or newer, or the CAP_NET_RAW
+				# capability. (optional)
+				Interface:
+
+				# For transports, except Socks, the local IPs to make outgoing connections from,
+				# at most one IPv4 and one IPv6 address. The address matching the address family
+				# of the remote IP is used. By default, outgoing connections are made from the IPs
+				# of SMTP listeners, if they are explicitly configured. (optional)
+				LocalIPs:
+					-
+
+				# Differentiated services code point, 0-63, set in the TOS (IPv4) or traffic class
+				# (IPv6) field of packets that are sent. E.g. 8 (CS1) for low-priority bulk
+				# traffic. Default 0. (optional)
+				DSCP: 0
+
+				# Interval between TCP keepalive probes, e.g. 1m. Default 15s. Negative disables
+				# keepalives. (optional)
+				KeepAlive: 0s
+
+				# Maximum time that sent data may remain unacknowledged before the connection is
+				# closed, through TCP_USER_TIMEOUT, e.g. 2m. Linux only. By default, the system
+				# default is used. (optional)
+				UserTimeout: 0s
+
+	# Command with arguments for rendering messages to PDF in the account web
+	# interface. The command must read HTML on stdin and write the PDF document to
+	# stdout, e.g. ["wkhtmltopdf", "--quiet", "-", "-"]. If not set, exporting
+	# messages as PDF is not available. (optional)
+	PDFRenderCommand:
+		-
+
+	# URL prefix of an external image proxy, for loading remote images in HTML
+	# messages in the account web interface, e.g. https://imageproxy.example/?url=.
+	# The URL-encoded remote image URL is appended. If empty, the built-in image proxy
+	# of the account web interface is used, which fetches images without cookies or
+	# other identifying information of the user. (optional)
+	ImageProxyURL:
+
+	# If set, TLS reports (TLSRPT) are sent daily to recipient domains that publish a
+	# TLSRPT DNS record with a mailto reporting address, about deliveries that were
+	# done without TLS after a failed attempt with TLS. Only failed sessions are
+	# tracked and reported. (optional)
+	OutgoingTLSReports: false
+
+	# If set, results of SPF evaluations (per remote IP, SMTP MAIL FROM and EHLO), and
+	# DNS records for DKIM public keys and DMARC policies are cached in memory for
+	# incoming SMTP connections, shared by all listeners. Saves DNS lookups and
+	# latency for high-volume incoming traffic. (optional)
+	AuthCache:
+
+		# Maximum time to cache results. The DNS resolver used by mox does not expose the
+		# TTLs of DNS records, so results are cached for this fixed duration, which should
+		# be at or below the TTLs commonly used for these records. Results of lookups that
+		# failed with a temporary error are not cached. Default 5m. (optional)
+		TTL: 0s
+
+		# Maximum number of entries for each of SPF, DKIM and DMARC. When full, the least
+		# recently added entries are removed. Default 10000. (optional)
+		MaxEntries: 0
+
+	# If set, users can subscribe browsers to Web Push notifications for new messages
+	# in the account web interface. (optional)
+	WebPush:
+
+		# File with PEM-encoded PKCS#8 ECDSA P-256 private key for identifying this server
+		# to push services (VAPID). Generate with "mox webpush genkey". If this is a
+		# relative path, it is relative to the directory of mox.conf. Changing the key
+		# invalidates existing subscriptions.
+		VAPIDPrivateKeyFile:
+
+		# Contact for operators of push services, a mailto: or https: URL. Default
+		# mailto:postmaster@<hostname>. (optional)
+		Subject:
+
+	# If set, test messages are periodically sent through the outgoing queue to a seed
+	# address, to check that SPF, DKIM and DMARC pass for outgoing messages. Failures
+	# are logged, counted in metrics and reported to the postmaster. (optional)
+	SelfCheck:
+
+		# Address of an account to send test messages from. Its domain should have DKIM
+		# signing configured, and SPF and DMARC records.
+		From:
+
+		# Seed address to send test messages to. For an address of a local account, the
+		# message is delivered over SMTP to the MX host of its domain, like for external
+		# recipients, and the SPF, DKIM and DMARC results of the arrived message are
+		# checked. For external addresses, only the DKIM signature, the SPF record for
+		# explicitly configured SMTP listen IPs, and the DMARC record are verified through
+		# DNS, and delivery failures are returned as DSN to the From address.
+		To:
+
+		# Interval between test messages. Default 24h. (optional)
+		Interval: 0s
+
+		# Time to wait for arrival of the test message at a local seed address before the
+		# check fails. Default 15m. (optional)
+		Timeout: 0s
+
+	# Language for system-generated messages, such as delivery status notifications,
+	# if no language is configured for the account or its domain. Built-in languages
+	# are en (default) and nl. (optional)
+	DefaultLanguage:
+
+	# Directory with texts that override or add to the built-in texts for
+	# system-generated messages, relative to the config directory if not absolute.
+	# Texts are in files named <language>/<key>.txt, with placeholders like
+	# {recipient}. See "mox messagecatalog" for the keys and built-in texts.
+	# (optional)
+	MessageCatalog:
+
+	# If set, message files of older messages are moved to a separate directory,
+	# typically on a larger, cheaper and slower filesystem. Message metadata, such as
+	# flags and the parsed structure, is kept in the account database. Archived
+	# messages remain accessible through IMAP and the web interfaces as before.
+	# Archived message files are not included in backups made with "mox backup", and
+	# are reported as missing by "mox verifydata", archive storage must be backed up
+	# separately. (optional)
+	MessageArchive:
+
+		# Directory to move message files to, in a subdirectory per account. Relative
+		# paths are relative to the data directory, but an absolute path on a different
+		# filesystem is typical.
+		Path:
+
+		# Message files of messages received longer ago are moved, e.g. 4320h for about 6
+		# months.
+		MinAge: 0s
+
+		# Interval between runs of the migrator, that moves message files of all accounts.
+		# Default 24h. (optional)
+		Interval: 0s
+
+	# If set, operational data is periodically exported as SQL files, for long-term
+	# analysis in external tools. Exported are results of delivery attempts of
+	# outgoing messages, incoming messages rejected during the SMTP transaction,
+	# including junk verdicts, and incoming DMARC aggregate reports. Each file
+	# contains the data recorded since the previous export. The files can be loaded in
+	# order into an SQLite or PostgreSQL database, e.g. with "sqlite3 ops.db <file" or
+	# "psql -f file". Tables are created if they do not exist, and rows that were
+	# already loaded are skipped. The version of the tables is stored in table
+	# mox_schema. (optional)
+	SQLExport:
+
+		# Directory to write export files to, named export-<time>.sql. Relative paths are
+		# relative to the data directory. Files are not removed by mox.
+		Dir:
+
+		# Interval between exports. Default 24h. (optional)
+		Interval: 0s
+
+	# Limits for messages generated by mox itself, such as delivery status
+	# notifications (DSNs), TLS reports and reports to the postmaster. Such messages
+	# are DKIM-signed for the domain of the From address if configured, rate limited
+	# per recipient and checked against the suppression list. Without this section,
+	# the default rate limit applies. (optional)
+	Notifications:
+
+		# Maximum number of notifications per recipient address per hour. Further
+		# notifications in the same hour are dropped and logged. Prevents flooding
+		# recipients, e.g. with DSNs for a message sent to many recipients that all fail.
+		# Default 20. (optional)
+		MaxPerHour: 0
+
+		# Addresses, or domains starting with @, that no notifications are sent to, e.g.
+		# for recipients that complained about DSNs or that reject them. (optional)
+		Suppress:
+			-
+
+	# If set, messages in the outgoing queue for recipients of local accounts that
+	# fail with a temporary error because the account is over quota, suspended with
+	# SuspendedTempfail, or its domain reached its storage limit, are parked instead
+	# of failing after the regular delivery attempts. The sender is notified of the
+	# delay with a DSN, and delivery is retried as soon as the condition clears.
+	# (optional)
+	Parking:
+
+		# How long a message is kept parked before delivery fails permanently and a DSN is
+		# sent to the sender. Default 168h, i.e. one week. (optional)
+		Period: 0s
+
+		# Interval between checks whether the condition for parked messages has cleared,
+		# after which delivery is attempted immediately. Default 5m. (optional)
+		CheckInterval: 0s
+
+	# If set, users can authenticate to IMAP and submission with OAuth 2.0 bearer
+	# tokens from an identity provider, with the SASL mechanisms OAUTHBEARER and
+	# XOAUTH2. The token must be issued for the email address of an account. For
+	# listeners without AuthMechanisms, OAUTHBEARER and XOAUTH2 are added to the
+	# default mechanisms. Like PLAIN, the mechanisms are only offered on TLS
+	# connections, unless the service has NoRequireSTARTTLS. (optional)
+	OAuth:
+
+		# Files with PEM-encoded public keys (RSA, ECDSA or Ed25519, in PKIX form) of the
+		# identity provider, for validating tokens that are signed JWTs without contacting
+		# the identity provider. If a path is relative, it is relative to the directory of
+		# mox.conf. Keys are only read at startup, rotated keys require a restart.
+		# (optional)
+		JWTKeyFiles:
+			-
+
+		# URL of the token introspection endpoint (RFC 7662) of the identity provider, for
+		# validating opaque tokens, or to notice revoked tokens. Each authentication
+		# attempt makes a request. (optional)
+		IntrospectionURL:
+
+		# Client ID for HTTP basic authentication to the introspection endpoint.
+		# (optional)
+		IntrospectionClientID:
+
+		# Client secret for HTTP basic authentication to the introspection endpoint.
+		# (optional)
+		IntrospectionClientSecret:
+
+		# If set, tokens must have this issuer (iss claim), e.g. https://idp.example.com.
+		# Required with JWTKeyFiles. (optional)
+		Issuer:
+
+		# If set, tokens must be issued for this audience (aud claim), typically the
+		# client ID mail clients use at the identity provider. Required with JWTKeyFiles.
+		# (optional)
+		Audience:
+
+		# Claim holding the email address of the user, for finding the account. Default
+		# email. (optional)
+		UsernameClaim:
+
+	# Database transactions by the IMAP and SMTP servers, the queue and the account
+	# web interface that take longer than this duration are logged, with statistics
+	# about the queries, such as the number of full table scans. Durations of all
+	# these transactions are exported as metrics. Default 1s. (optional)
+	SlowDBOperation: 0s
+
+	# Remote domains for which TLS metrics of messages delivered over SMTP port 25 are
+	# exported with their own domain label, e.g. the large email providers you
+	# exchange most email with. Incoming messages are counted for their SMTP MAIL FROM
+	# domain, outgoing messages for their recipient domain. Messages for other domains
+	# are counted under domain label "other", keeping the number of metrics bounded.
+	# (optional)
+	TLSMetricsDomains:
+		-
+
+	# Limits for simultaneous IMAP connections, for all IMAP services of all
+	# listeners. Connections over a limit get an untagged BYE response with code
+	# LIMIT, and are closed. (optional)
+	IMAPConnectionLimits:
+
+		# Maximum number of simultaneous IMAP connections from a single IP, or /64 network
+		# for IPv6. Three times as many are allowed from the /26 (IPv4) or /48 (IPv6)
+		# network of the IP, and nine times as many from the /21 or /32 network. Checked
+		# when a connection is accepted. Default 30. (optional)
+		MaxPerIP: 0
+
+		# Maximum number of simultaneous authenticated IMAP connections for an account,
+		# checked at login. Zero means no limit. (optional)
+		MaxPerAccount: 0
+
 # domains.conf
 
 	# Domains for which email is accepted. For internationalized domains, use their
@@ -613,6 +1100,221 @@ describe-static" and "mox config describe-domains":
 					MinimumAttempts: 0
 					Transport:
 
+			# Settings for new accounts with an initial address in this domain, applied when
+			# accounts are added through the admin web interface or the command line. Existing
+			# accounts are not changed. (optional)
+			AccountTemplate:
+
+				# Mailboxes to create for new accounts, instead of DefaultMailboxes from mox.conf.
+				# Inbox is always created. (optional)
+				Mailboxes:
+					-
+
+				# Delivery rulesets for the initial address of new accounts. (optional)
+				Rulesets:
+					-
+
+						# Matches if this regular expression matches (a substring of) the SMTP MAIL FROM
+						# address (not the message From-header). E.g. user@example.org. (optional)
+						SMTPMailFromRegexp:
+
+						# Matches if this domain matches an SPF- and/or DKIM-verified (sub)domain.
+						# (optional)
+						VerifiedDomain:
+
+						# Matches if these header field/value regular expressions all match (substrings
+						# of) the message headers. Header fields and valuees are converted to lower case
+						# before matching. Whitespace is trimmed from the value before matching. A header
+						# field can occur multiple times in a message, only one instance has to match. For
+						# mailing lists, you could match on ^list-id$ with the value typically the mailing
+						# list address in angled brackets with @ replaced with a dot, e.g.
+						# <name\.lists\.example\.org>. (optional)
+						HeadersRegexp:
+							x:
+
+						# Influence the spam filtering, this does not change whether this ruleset applies
+						# to a message. If this domain matches an SPF- and/or DKIM-verified (sub)domain,
+						# the message is accepted without further spam checks, such as a junk filter or
+						# DMARC reject evaluation. DMARC rejects should not apply for mailing lists that
+						# are not configured to rewrite the From-header of messages that don't have a
+						# passing DKIM signature of the From-domain. Otherwise, by rejecting messages, you
+						# may be automatically unsubscribed from the mailing list. The assumption is that
+						# mailing lists do their own spam filtering/moderation. (optional)
+						ListAllowDomain:
+
+						# Mailbox to deliver to if this ruleset matches. Can be a special-use attribute
+						# like \Junk, see Mailbox of the destination.
+						Mailbox:
+
+				# Rejects mailbox for new accounts. Default Rejects. (optional)
+				RejectsMailbox:
+
+				# Junk filter for new accounts, instead of the default junk filter settings.
+				# (optional)
+				JunkFilter:
+
+					# Approximate spaminess score between 0 and 1 above which emails are rejected as
+					# spam. Each delivery attempt adds a little noise to make it slightly harder for
+					# spammers to identify words that strongly indicate non-spaminess and use it to
+					# bypass the filter. E.g. 0.95.
+					Threshold: 0.000000
+
+					# If set, messages delivered over SMTP get an X-Mox-Junk header with the spam
+					# probability and the word (combinations) that contributed most to it, e.g. for
+					# client-side rules or for reporting a misclassification. The header is added at
+					# the top of the message, clients should only use the first occurrence. (optional)
+					ScoreHeader: false
+					Params:
+
+						# Track ham/spam ranking for single words. (optional)
+						Onegrams: false
+
+						# Track ham/spam ranking for each two consecutive words. (optional)
+						Twograms: false
+
+						# Track ham/spam ranking for each three consecutive words. (optional)
+						Threegrams: false
+
+						# Maximum power a word (combination) can have. If spaminess is 0.99, and max power
+						# is 0.1, spaminess of the word will be set to 0.9. Similar for ham words.
+						MaxPower: 0.000000
+
+						# Number of most spammy/hammy words to use for calculating probability. E.g. 10.
+						TopWords: 0
+
+						# Ignore words that are this much away from 0.5 haminess/spaminess. E.g. 0.1,
+						# causing word (combinations) of 0.4 to 0.6 to be ignored. (optional)
+						IgnoreWords: 0.000000
+
+						# Occurrences in word database until a word is considered rare and its influence
+						# in calculating probability reduced. E.g. 1 or 2. (optional)
+						RareWords: 0
+
+				# Maximum number of outgoing messages per day for new accounts. Default 1000.
+				# (optional)
+				MaxOutgoingMessagesPerDay: 0
+
+				# Maximum number of first-time recipients per day for new accounts. Default 200.
+				# (optional)
+				MaxFirstTimeRecipientsPerDay: 0
+
+				# Additional addresses new accounts can send as, e.g. shared addresses like
+				# info@example.com, or '@domain' for all addresses in a domain. (optional)
+				SubmissionFromAllowed:
+					-
+
+			# Mail flow rules for messages submitted with a From address in this domain
+			# (outgoing) and messages delivered to addresses in this domain (incoming). All
+			# matching rules are applied, in order. (optional)
+			TransportRules:
+				-
+
+					# Name of the rule, used in logging.
+					Name:
+
+					# Either "incoming" or "outgoing" to only match messages in that direction. If
+					# empty, the rule matches in both directions. (optional)
+					Direction:
+
+					# Matches if this regular expression matches (a substring of) the address in the
+					# message From header, in lower case. E.g. @example\.org$. (optional)
+					SenderRegexp:
+
+					# Matches if this regular expression matches (a substring of) the SMTP RCPT TO
+					# address, in lower case. (optional)
+					RecipientRegexp:
+
+					# Matches if these header field/value regular expressions all match (substrings
+					# of) the message headers, with the same semantics as HeadersRegexp in rulesets of
+					# accounts. (optional)
+					HeadersRegexp:
+						x:
+
+					# Addresses to send a copy of the message to, through the queue, e.g. a compliance
+					# mailbox. Copies are sent with an empty SMTP MAIL FROM and without requesting
+					# DSNs. (optional)
+					BCC:
+						-
+
+					# Text to prepend to the Subject header, e.g. "[External] ". Not added again if
+					# the subject already contains the text. For outgoing messages, the subject is
+					# changed before DKIM signing. (optional)
+					SubjectPrefix:
+
+					# For outgoing messages only: transport to deliver the message with, instead of
+					# the transport from routes. (optional)
+					Transport:
+
+					# For outgoing messages only: hold the message in the queue until an administrator
+					# approves it by kicking it in the queue, or rejects it by removing it from the
+					# queue. (optional)
+					Moderate: false
+
+			# Language for system-generated messages, such as delivery status notifications,
+			# to accounts in this domain, and for autoconfig responses without a supported
+			# Accept-Language header. A language tag like en or nl. Default is the global
+			# DefaultLanguage. (optional)
+			Language:
+
+			# Aggregate limits for all accounts of this domain together, e.g. for a customer
+			# when hosting multiple customers on one instance. Accounts belong to the domain
+			# of their Domain field. (optional)
+			Limits:
+
+				# Maximum number of accounts. Adding more accounts fails. Zero means no limit.
+				# (optional)
+				MaxAccounts: 0
+
+				# Maximum total size in bytes of the messages in the accounts. When reached,
+				# incoming messages for the accounts are rejected with a temporary error, and IMAP
+				# APPEND fails. Zero means no limit. (optional)
+				MaxStorage: 0
+
+				# Maximum number of outgoing messages of the accounts in a 24 hour window, in
+				# addition to the per-account MaxOutgoingMessagesPerDay. Zero means no limit.
+				# (optional)
+				MaxOutgoingMessagesPerDay: 0
+
+			# IMAP namespaces for mailboxes of other accounts, for users of accounts that
+			# belong to this domain through their Domain field. Accounts can override them.
+			# (optional)
+			Namespaces:
+
+				# Prefix of the namespace with mailboxes shared by other accounts, followed by the
+				# name of the owning account, e.g. Shared for Shared/<account>/<mailbox>. Default
+				# #shared. Own mailboxes with a name starting with the prefix cannot be accessed
+				# over IMAP, and cannot be created; a prefix starting with # cannot clash with own
+				# mailboxes. (optional)
+				SharedPrefix:
+
+				# Name of an account with public folders. Its mailboxes that the user has rights
+				# on, typically through the identifier anyone, are in the public namespace instead
+				# of the namespace of shared mailboxes. If empty, there is no public namespace.
+				# (optional)
+				PublicAccount:
+
+				# Prefix of the public namespace, e.g. Public for Public/<mailbox>. Default
+				# #public. (optional)
+				PublicPrefix:
+
+			# Maximum size in bytes of a single message for accounts that belong to this
+			# domain through their Domain field, unless an account has its own
+			# MessageSizeLimit. Zero means no limit. (optional)
+			MessageSizeLimit: 0
+
+			# Journaling for all accounts that belong to this domain through their Domain
+			# field, as if Journal was set for each account. (optional)
+			Journal: false
+
+			# Address to forward a copy of each message received or submitted by accounts that
+			# belong to this domain to, like JournalAddress for accounts. If an account also
+			# has a JournalAddress, copies are forwarded to both addresses. (optional)
+			JournalAddress:
+
+			# Litigation hold for all accounts that belong to this domain through their Domain
+			# field, as if Hold was set for each account. (optional)
+			Hold: false
+
 	# Accounts to which email can be delivered. An account can accept email for
 	# multiple domains, for multiple localparts, and deliver to multiple mailboxes.
 	Accounts:
@@ -625,6 +1327,11 @@ describe-static" and "mox config describe-domains":
 			# Free form description, e.g. full name or alternative contact info. (optional)
 			Description:
 
+			# Language for system-generated messages to this account, such as delivery status
+			# notifications. A language tag like en or nl. Default is the language of the
+			# domain of the account. (optional)
+			Language:
+
 			# Destinations, keys are email addresses (with IDNA domains). If the address is of
 			# the form '@domain', i.e. with localpart missing, it serves as a catchall for the
 			# domain, matching all messages that are not explicitly configured. Deprecated
@@ -633,7 +1340,9 @@ describe-static" and "mox config describe-domains":
 			Destinations:
 				x:
 
-					# Mailbox to deliver to if none of Rulesets match. Default: Inbox. (optional)
+					# Mailbox to deliver to if none of Rulesets match. Default: Inbox. Can also be a
+					# special-use attribute, one of \Archive, \Drafts, \Junk, \Sent or \Trash, to
+					# deliver to the mailbox designated for that use, e.g. \Junk. (optional)
 					Mailbox:
 
 					# Delivery rules based on message and SMTP transaction. You may want to match each
@@ -671,9 +1380,19 @@ describe-static" and "mox config describe-domains":
 							# mailing lists do their own spam filtering/moderation. (optional)
 							ListAllowDomain:
 
-							# Mailbox to deliver to if this ruleset matches.
+							# Mailbox to deliver to if this ruleset matches. Can be a special-use attribute
+							# like \Junk, see Mailbox of the destination.
 							Mailbox:
 
+					# Accounts that moderate incoming messages for this address, e.g. for an announce
+					# address. Accepted incoming messages are held in the Moderation mailbox of this
+					# account, and the moderators are notified with a message in their Inbox. Once a
+					# moderator approves a message in the account web interface, it is delivered
+					# according to Mailbox and Rulesets. Rejected messages are removed. Only settable
+					# by the administrator. (optional)
+					Moderators:
+						-
+
 			# If configured, messages classified as weakly spam are rejected with instructions
 			# to retry delivery, but this time with a signed token added to the subject.
 			# During the next delivery attempt, the signed token will bypass the spam filter.
@@ -684,6 +1403,15 @@ describe-static" and "mox config describe-domains":
 				# How long unique values are accepted after generating, e.g. 12h.
 				Period: 0s
 
+			# If set, messages delivered to the archive mailbox (the mailbox with the Archive
+			# special-use flag, e.g. through a ruleset) are stored in a sub-mailbox for the
+			# year the message was received, e.g. Archive/2023. This keeps the number of
+			# messages per mailbox manageable for IMAP clients. Messages moved to the archive
+			# mailbox by sweep rules, moderation, JMAP clients and administrative operations
+			# are filed the same way. Messages moved by IMAP clients are not affected: IMAP
+			# clients expect moved messages in the mailbox they chose. (optional)
+			ArchiveByYear: false
+
 			# Mail that looks like spam will be rejected, but a copy can be stored temporarily
 			# in a mailbox, e.g. Rejects. If mail isn't coming in when you expect, you can
 			# look there. The mail still isn't accepted, so the remote mail server may retry
@@ -715,6 +1443,14 @@ describe-static" and "mox config describe-domains":
 				# Example: .* or an empty string. (optional)
 				NotJunkMailboxRegexp:
 
+			# If set, marking a message as junk in an IMAP client by setting the $Junk or
+			# $Phishing flag moves it to the Junk mailbox (the mailbox with the Junk
+			# special-use flag), and marking a message in the Junk mailbox as not junk with
+			# the $NotJunk flag moves it to the Inbox. The junk filter is trained based on
+			# these flags regardless of this setting. For email clients that only set flags,
+			# without moving messages. (optional)
+			MoveOnJunkFlags: false
+
 			# Content-based filtering, using the junk-status of individual messages to rank
 			# words in such messages as spam or ham. It is recommended you always set the
 			# applicable (non)-junk status on messages, and that you do not empty your Trash
@@ -727,6 +1463,12 @@ describe-static" and "mox config describe-domains":
 				# spammers to identify words that strongly indicate non-spaminess and use it to
 				# bypass the filter. E.g. 0.95.
 				Threshold: 0.000000
+
+				# If set, messages delivered over SMTP get an X-Mox-Junk header with the spam
+				# probability and the word (combinations) that contributed most to it, e.g. for
+				# client-side rules or for reporting a misclassification. The header is added at
+				# the top of the message, clients should only use the first occurrence. (optional)
+				ScoreHeader: false
 				Params:
 
 					# Track ham/spam ranking for single words. (optional)
@@ -763,6 +1505,35 @@ describe-static" and "mox config describe-domains":
 			# this mail server in case of account compromise. Default 200. (optional)
 			MaxFirstTimeRecipientsPerDay: 0
 
+			# Additional addresses this account can use in the SMTP MAIL FROM and message From
+			# header when submitting messages, besides the addresses of its destinations. E.g.
+			# for aliases that are delivered to a different account. An entry of the form
+			# '@domain' allows all addresses in the domain. Domains must be configured in mox,
+			# so submitted messages are DKIM-signed and pass DMARC. (optional)
+			SubmissionFromAllowed:
+				-
+
+			# If set, a submitted message with an SMTP MAIL FROM and/or message From header
+			# the account is not allowed to use is not rejected, but the address is rewritten
+			# to the email address used to authenticate. For email clients or devices that are
+			# misconfigured or cannot be configured with a proper sender address. The display
+			# name in the From header is kept. (optional)
+			SubmissionFromRewrite: false
+
+			# Names of other accounts that may send messages as this account, with the
+			# addresses of this account in the SMTP MAIL FROM and message From header, e.g.
+			# for an assistant or for a shared role. A Sender header with the address of the
+			# delegate is added to such messages. Can be changed by the account in the account
+			# web interface. (optional)
+			SendDelegates:
+				-
+
+			# If set, the sender is notified with a delivery status notification when a
+			# message submitted by this account was delivered without TLS, after an attempt
+			# with TLS failed, e.g. due to an invalid certificate of the remote mail server.
+			# (optional)
+			NotifyTLSDowngrade: false
+
 			# Routes for delivering outgoing messages through the queue. Each delivery attempt
 			# evaluates these account routes, domain routes and finally global routes. The
 			# transport of the first matching route is used in the delivery attempt. If no
@@ -787,6 +1558,172 @@ describe-static" and "mox config describe-domains":
 					MinimumAttempts: 0
 					Transport:
 
+			# If set, a copy of each message received for this account over SMTP and of each
+			# message submitted by this account is written to the journal directory of the
+			# account, at accounts/<name>/journal/ in the data directory, for compliance
+			# archiving. Journal files are created read-only, with the SMTP transaction
+			# headers included, and are never removed by mox, also not when the original
+			# message is removed from its mailbox. (optional)
+			Journal: false
+
+			# If set, a copy of each message received for this account over SMTP and of each
+			# message submitted by this account is forwarded through the queue to this
+			# address, e.g. an external archiving service. The copies are sent with an empty
+			# MAIL FROM and without requesting DSNs. (optional)
+			JournalAddress:
+
+			# Litigation hold. If set, messages cannot be permanently removed from this
+			# account: IMAP expunge fails, mailboxes that still have messages cannot be
+			# deleted, and messages cannot be cleaned up through the account web interface.
+			# Automatic removals, such as of old messages in the rejects mailbox, are skipped.
+			# Messages can still be moved and marked as deleted. Often combined with Journal.
+			# Can also be set for a domain. (optional)
+			Hold: false
+
+			# Rules for periodically moving or removing older messages from mailboxes, e.g.
+			# moving newsletters older than 30 days to an archive mailbox, or removing read
+			# notifications after a week. Rules are applied once a day, at night (local time).
+			# (optional)
+			SweepRules:
+				-
+
+					# Mailbox to take messages from.
+					Mailbox:
+
+					# Only messages received more than this many days ago are swept.
+					OlderThanDays: 0
+
+					# If set, only messages marked as read (with the \Seen flag) are swept. (optional)
+					SeenOnly: false
+
+					# Mailbox to move the messages to. Created if it does not exist. Either MoveTo or
+					# Delete must be set. (optional)
+					MoveTo:
+
+					# If set, messages are permanently removed. (optional)
+					Delete: false
+
+			# If set, messages submitted by this account with an Expires header, e.g.
+			# 'Expires: Mon, 2 Oct 2023 15:00:00 +0200', are removed when they expire: all
+			# copies with the same Message-ID in mailboxes of this account, such as the copy
+			# in the Sent mailbox, and the copies delivered to recipients that are accounts on
+			# this mox instance. Copies delivered to external recipients cannot be removed,
+			# those recipients keep the message; some email clients only show it as expired.
+			# Accounts on litigation hold keep their copies. Expired messages are removed
+			# within 15 minutes. (optional)
+			MessageExpiration: false
+
+			# Maximum total size in bytes of the messages in this account. When reached,
+			# incoming messages are rejected with a temporary error, and IMAP APPEND and COPY
+			# fail. Reported to IMAP clients through the QUOTA extension. Zero means no limit.
+			# (optional)
+			QuotaMessageSize: 0
+
+			# Maximum number of messages in this account, handled like QuotaMessageSize. Zero
+			# means no limit. (optional)
+			QuotaMessageCount: 0
+
+			# If set, authentication for this account is rejected for IMAP, SMTP submission
+			# and the web interfaces, e.g. while offboarding a user. Incoming messages are
+			# still delivered, unless SuspendedTempfail is set. (optional)
+			Suspended: false
+
+			# If set, incoming messages for this account are rejected with a temporary error
+			# while the account is suspended or pending deletion, so remote mail servers retry
+			# delivery later. (optional)
+			SuspendedTempfail: false
+
+			# If set, the account is pending deletion: it is treated as suspended, and is
+			# removed, including its messages in the data directory but not its journal
+			# directory, after this time, in RFC 3339 format, e.g. 2023-10-02T15:00:00Z.
+			# Accounts on litigation hold are not removed. The removal can be canceled by
+			# clearing this field before the time has passed. (optional)
+			DeleteAt:
+
+			# HTTP endpoints that are notified of events for this account with a POST request
+			# with a JSON body: incoming messages delivered over SMTP, and deliveries, delays
+			# and failures of messages submitted by this account. Requests for an endpoint are
+			# sent in order of the events. Requests are retried with exponential backoff until
+			# the endpoint responds with a 2xx status code, for at most about 17 hours.
+			# Requests that still fail are kept, and can be sent again from the admin web
+			# interface. Each request has an Idempotency-Key header that is the same for
+			# retries, so endpoints can skip events they already processed. (optional)
+			Webhooks:
+				-
+
+					# URL to POST events to, must be http or https.
+					URL:
+
+					# Events to send: incoming, delivered, delayed, failed. Default all. (optional)
+					Events:
+						-
+
+					# Secrets for signing requests. The X-Mox-Signature header holds a timestamp and
+					# an HMAC-SHA256 signature for each secret, of the form t=<unix time>,v1=<hex
+					# signature>,v1=<...>, computed over the timestamp, a dot, and the request body.
+					# To rotate a secret, add a new secret at the start of the list, update the
+					# endpoint, then remove the old secret. At least one secret is required.
+					Secrets:
+						-
+
+			# IMAP namespaces for mailboxes of other accounts for this account, instead of
+			# those of the domain of the account. (optional)
+			Namespaces:
+
+				# Prefix of the namespace with mailboxes shared by other accounts, followed by the
+				# name of the owning account, e.g. Shared for Shared/<account>/<mailbox>. Default
+				# #shared. Own mailboxes with a name starting with the prefix cannot be accessed
+				# over IMAP, and cannot be created; a prefix starting with # cannot clash with own
+				# mailboxes. (optional)
+				SharedPrefix:
+
+				# Name of an account with public folders. Its mailboxes that the user has rights
+				# on, typically through the identifier anyone, are in the public namespace instead
+				# of the namespace of shared mailboxes. If empty, there is no public namespace.
+				# (optional)
+				PublicAccount:
+
+				# Prefix of the public namespace, e.g. Public for Public/<mailbox>. Default
+				# #public. (optional)
+				PublicPrefix:
+
+			# Maximum size in bytes of a single message for this account, for messages
+			# appended over IMAP, also advertised to IMAP clients with APPENDLIMIT, and
+			# messages submitted over SMTP, also for the SMTP SIZE extension after
+			# authentication. Only lowers the SMTPMaxMessageSize of the submission listener.
+			# Default is the MessageSizeLimit of the domain of the account. Zero means no
+			# limit. (optional)
+			MessageSizeLimit: 0
+
+			# If set, words of incoming and appended messages are added to an index, for fast
+			# searching of message text with IMAP SEARCH BODY and TEXT, and in the account web
+			# interface, instead of reading each message. With the index, such searches match
+			# messages that contain all words of the search string, instead of messages that
+			# contain the search string literally. Words must match in full, not as part of
+			# longer words. Messages that are not yet in the index, such as those delivered
+			# before enabling the index, are still read for each search. They can be added to
+			# the index with "mox textindex". (optional)
+			FullTextIndex: false
+
+			# Maximum number of simultaneous authenticated IMAP connections for this account,
+			# overriding MaxPerAccount of IMAPConnectionLimits. Zero means the global limit
+			# applies. (optional)
+			MaxIMAPConnections: 0
+
+			# If set, IMAP sessions of this account are read-only, e.g. for compliance
+			# auditors or for credentials of backup tools. Mailboxes are always opened
+			# read-only, as with EXAMINE, so messages are not marked as read. Commands that
+			# would change messages, mailboxes, subscriptions, metadata or access rights, such
+			# as APPEND, STORE, EXPUNGE, COPY, MOVE, CREATE and DELETE, fail with NOPERM.
+			# Incoming messages are still delivered. (optional)
+			IMAPReadOnly: false
+
+			# If set, messages that POP3 clients delete are not removed from the Inbox, but
+			# marked as read, so they remain available over IMAP and in the web interface.
+			# POP3 clients recognize messages they already retrieved by their unique ID
+			# (UIDL). (optional)
+			POP3LeaveOnServer: false
+
 	# Redirect all requests from domain (key) to domain (value). Always redirects to
 	# HTTPS. For plain HTTP redirects, use a WebHandler with a WebRedirect. (optional)
 	WebDomainRedirects:
@@ -818,6 +1755,43 @@ describe-static" and "mox config describe-domains":
 			# (optional)
 			DontRedirectPlainHTTP: false
 
+			# If set, requests must be authenticated before they are handled. For WebForward,
+			# the email address of the authenticated user is passed to the backend in the
+			# X-Forwarded-User header. (optional)
+			Auth:
+
+				# Require HTTP basic authentication with the email address and password of an
+				# account. Only one of BasicAuth and OIDC can be set. (optional)
+				BasicAuth: false
+
+				# Require login through an OpenID Connect provider. Unauthenticated GET requests
+				# are redirected to the provider. After login, a session cookie is set, valid for
+				# 12 hours or until mox restarts. (optional)
+				OIDC:
+
+					# URL of the OpenID provider, e.g. https://accounts.example.com. Its configuration
+					# is fetched from /.well-known/openid-configuration at the URL.
+					Issuer:
+
+					# Client ID, as registered at the provider.
+					ClientID:
+
+					# Client secret, as registered at the provider.
+					ClientSecret:
+
+					# Path on the domain of the WebHandler that the provider redirects back to after
+					# login, handled by mox. Must be registered at the provider as part of the
+					# redirect URI, e.g. https://example.org/.mox/oidc-callback. Default
+					# /.mox/oidc-callback. (optional)
+					CallbackPath:
+
+				# Email addresses, or domains when starting with @, of users that are allowed
+				# access. For BasicAuth, the address used for logging in is checked, and if Allow
+				# is empty, all accounts are allowed. For OIDC, the verified email address from
+				# the provider is checked, and Allow must be non-empty. (optional)
+				Allow:
+					-
+
 			# Serve static files. (optional)
 			WebStatic:
 
@@ -905,6 +1879,23 @@ describe-static" and "mox config describe-domains":
 				ResponseHeaders:
 					x:
 
+				# Headers to set on the request to the backend, replacing headers with the same
+				# name from the client. An empty value removes the header from the request. The
+				# Host header can be set to change the host for the backend. (optional)
+				RequestHeaders:
+					x:
+
+				# Headers to remove from the response from the backend, e.g. Server or
+				# X-Powered-By. (optional)
+				RemoveResponseHeaders:
+					-
+
+				# Use HTTP/2 without TLS (h2c) for requests to a backend with an http URL, as
+				# required for gRPC backends. For backends with an https URL, HTTP/2 is always
+				# negotiated during the TLS handshake. Clients must also use HTTP/2 for gRPC,
+				# which is enabled for all HTTPS listeners. (optional)
+				HTTP2: false
+
 	# Routes for delivering outgoing messages through the queue. Each delivery attempt
 	# evaluates account routes, domain routes and finally these global routes. The
 	# transport of the first matching route is used in the delivery attempt. If no
@@ -929,6 +1920,65 @@ describe-static" and "mox config describe-domains":
 			MinimumAttempts: 0
 			Transport:
 
+	# Trusted forwarders and intermediaries, such as mailing lists, for which incoming
+	# messages are not rejected when DMARC fails for a From domain with a reject
+	# policy. Forwarders often modify messages, breaking DKIM signatures, and send
+	# from their own IPs, failing SPF. Messages matching an override are still subject
+	# to reputation analysis and the junk filter. (optional)
+	DMARCOverrides:
+		-
+
+			# Name for the override, used in logging and for the hit counts shown in the admin
+			# web interface.
+			Name:
+
+			# Matches if the message has a valid DKIM signature from one of these domains,
+			# typically the domain of the forwarder. (optional)
+			DKIMDomains:
+				-
+
+			# Matches if the message was delivered from one of these IPs or networks in CIDR
+			# notation, e.g. 192.0.2.1 or 2001:db8::/32. (optional)
+			IPs:
+				-
+
+			# Free form comment, e.g. why the override was added. (optional)
+			Comment:
+
+	# Notices for users, e.g. about maintenance windows or policy reminders. Shown in
+	# the IMAP greeting (as untagged OK response with ALERT code), in the SMTP banner
+	# and at the top of the account and admin web interfaces. Can be managed in the
+	# admin web interface. (optional)
+	Notices:
+		-
+
+			# Text of the notice, a single line of printable ASCII, e.g. "Maintenance on
+			# Saturday between 10:00 and 12:00 UTC, expect short interruptions.".
+			Text:
+
+			# Services to show the notice for: imap, smtp and web. Default is all. (optional)
+			Services:
+				-
+
+			# Names of listeners to show the notice on. Default is all. (optional)
+			Listeners:
+				-
+
+			# If set, the notice is only shown to authenticated users of accounts with an
+			# address in one of these domains: in IMAP after login, and in the account web
+			# interface. Not in the SMTP banner and IMAP greeting, when the user is not yet
+			# known. (optional)
+			Domains:
+				-
+
+			# If set, the notice is only shown from this time, in RFC 3339 format, e.g.
+			# 2023-06-03T10:00:00Z. (optional)
+			Start:
+
+			# If set, the notice is no longer shown after this time, in RFC 3339 format.
+			# (optional)
+			End:
+
 # Examples
 
 Mox includes configuration files to illustrate common setups. You can see these
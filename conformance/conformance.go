@@ -0,0 +1,181 @@
+// Package conformance runs scripted protocol conversations against line-based
+// servers, for testing the IMAP and SMTP servers.
+//
+// Scripts are taken from the examples in RFCs, or captured from sessions of real
+// clients, with their quirks. A script is a text file with one line per
+// protocol line, with a prefix:
+//
+//	# A comment, ignored like empty lines.
+//	O: option
+//	C: line sent by the client
+//	S: line expected from the server
+//
+// Client lines are sent with CRLF appended, also for literal data. Literal sizes
+// in client lines must count the CRLFs. Server lines must match exactly, except
+// that "..." matches any text, e.g. "S: * OK ...". Server lines are read as
+// they are needed, so a client can send lines without waiting for a response,
+// like pipelining clients do. Options are free-form words interpreted by the
+// test that runs the script, e.g. to start a submission instead of a regular
+// SMTP server.
+package conformance
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Script is a parsed conversation.
+type Script struct {
+	Name    string
+	Options []string
+	Steps   []Step
+}
+
+// HasOption returns whether the script has the option.
+func (s Script) HasOption(opt string) bool {
+	for _, o := range s.Options {
+		if o == opt {
+			return true
+		}
+	}
+	return false
+}
+
+// Step is a line sent by the client, or a pattern for a line expected from the
+// server.
+type Step struct {
+	LineNumber int
+	Client     bool
+	Text       string
+	pattern    *regexp.Regexp // For server lines.
+}
+
+// ParseFile parses the script in file path.
+func ParseFile(path string) (Script, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Script{}, err
+	}
+	defer f.Close()
+	return Parse(path, f)
+}
+
+// Parse parses a script from r. Name is used in errors.
+func Parse(name string, r io.Reader) (Script, error) {
+	s := Script{Name: name}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	var lineno int
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if len(line) < 2 || line[1] != ':' {
+			return Script{}, fmt.Errorf("%s:%d: line must start with C:, S:, O: or #", name, lineno)
+		}
+		text := strings.TrimPrefix(line[2:], " ")
+		switch line[0] {
+		case 'O':
+			s.Options = append(s.Options, strings.Fields(text)...)
+		case 'C':
+			s.Steps = append(s.Steps, Step{LineNumber: lineno, Client: true, Text: text})
+		case 'S':
+			parts := strings.Split(text, "...")
+			for i, p := range parts {
+				parts[i] = regexp.QuoteMeta(p)
+			}
+			re := regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+			s.Steps = append(s.Steps, Step{LineNumber: lineno, Text: text, pattern: re})
+		default:
+			return Script{}, fmt.Errorf("%s:%d: unknown line type %q", name, lineno, line[:1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Script{}, fmt.Errorf("%s: reading script: %v", name, err)
+	}
+	return s, nil
+}
+
+// Run executes the script over conn, the client side of a connection to a
+// server. An error is returned for the first server line not matching the
+// script, or when an expected line doesn't arrive within timeout. The
+// connection is not closed.
+func Run(conn net.Conn, s Script, timeout time.Duration) error {
+	// Lines are read in the background and queued, so a server writing responses
+	// never blocks while the client is still writing, e.g. on a synchronous
+	// net.Pipe.
+	type lineErr struct {
+		line string
+		err  error
+	}
+	var mu sync.Mutex
+	var queue []lineErr
+	queued := make(chan struct{}, 1)
+	go func() {
+		br := bufio.NewReader(conn)
+		for {
+			line, err := br.ReadString('\n')
+			if line != "" || err != nil {
+				mu.Lock()
+				queue = append(queue, lineErr{strings.TrimSuffix(line, "\r\n"), err})
+				mu.Unlock()
+				select {
+				case queued <- struct{}{}:
+				default:
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	next := func() (lineErr, bool) {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		for {
+			mu.Lock()
+			if len(queue) > 0 {
+				le := queue[0]
+				queue = queue[1:]
+				mu.Unlock()
+				return le, true
+			}
+			mu.Unlock()
+			select {
+			case <-queued:
+			case <-timer.C:
+				return lineErr{}, false
+			}
+		}
+	}
+
+	for _, st := range s.Steps {
+		if st.Client {
+			if _, err := fmt.Fprintf(conn, "%s\r\n", st.Text); err != nil {
+				return fmt.Errorf("%s:%d: writing client line: %v", s.Name, st.LineNumber, err)
+			}
+			continue
+		}
+		le, ok := next()
+		if !ok {
+			return fmt.Errorf("%s:%d: timeout waiting for server line %q", s.Name, st.LineNumber, st.Text)
+		}
+		if le.err != nil && (le.line == "" || !errors.Is(le.err, io.EOF)) {
+			return fmt.Errorf("%s:%d: reading server line, expected %q: %v", s.Name, st.LineNumber, st.Text, le.err)
+		}
+		if !st.pattern.MatchString(le.line) {
+			return fmt.Errorf("%s:%d: server line mismatch:\ngot:      %q\nexpected: %q", s.Name, st.LineNumber, le.line, st.Text)
+		}
+	}
+	return nil
+}
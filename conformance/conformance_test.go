@@ -0,0 +1,66 @@
+package conformance
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	const script = `
+# Greeting and a pipelined command.
+O: pipelining test
+C: ECHO one
+C: ECHO two
+S: 200 one
+S: 200 t...
+C: QUIT
+S: 221 ...
+`
+	s, err := Parse("test", strings.NewReader(script))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if !s.HasOption("pipelining") || s.HasOption("other") {
+		t.Fatalf("bad options %v", s.Options)
+	}
+
+	run := func(s Script) error {
+		serverConn, clientConn := net.Pipe()
+		defer clientConn.Close()
+		go func() {
+			defer serverConn.Close()
+			br := bufio.NewReader(serverConn)
+			for {
+				line, err := br.ReadString('\n')
+				if err != nil {
+					return
+				}
+				line = strings.TrimSuffix(line, "\r\n")
+				if line == "QUIT" {
+					serverConn.Write([]byte("221 bye\r\n"))
+					return
+				}
+				serverConn.Write([]byte("200 " + strings.TrimPrefix(line, "ECHO ") + "\r\n"))
+			}
+		}()
+		return Run(clientConn, s, time.Second)
+	}
+	if err := run(s); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	s, err = Parse("test", strings.NewReader("C: ECHO one\nS: 200 two\n"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if err := run(s); err == nil || !strings.Contains(err.Error(), "test:2: server line mismatch") {
+		t.Fatalf("got err %v, expected mismatch on line 2", err)
+	}
+
+	if _, err := Parse("test", strings.NewReader("X: bogus\n")); err == nil {
+		t.Fatalf("parse of bad line type succeeded")
+	}
+}
@@ -400,7 +400,11 @@ func servectlcmd(ctx context.Context, ctl *ctl, shutdown func()) {
 			if qm.LastAttempt != nil {
 				lastAttempt = time.Since(*qm.LastAttempt).Round(time.Second).String()
 			}
-			fmt.Fprintf(xw, "%5d %s from:%s to:%s next %s last %s error %q\n", qm.ID, qm.Queued.Format(time.RFC3339), qm.Sender().LogString(), qm.Recipient().LogString(), -time.Since(qm.NextAttempt).Round(time.Second), lastAttempt, qm.LastError)
+			next := (-time.Since(qm.NextAttempt).Round(time.Second)).String()
+			if qm.Hold {
+				next = "held"
+			}
+			fmt.Fprintf(xw, "%5d %s from:%s to:%s next %s last %s error %q\n", qm.ID, qm.Queued.Format(time.RFC3339), qm.Sender().LogString(), qm.Recipient().LogString(), next, lastAttempt, qm.LastError)
 		}
 		if len(qmsgs) == 0 {
 			fmt.Fprint(xw, "(empty)\n")
@@ -461,6 +465,147 @@ func servectlcmd(ctx context.Context, ctl *ctl, shutdown func()) {
 		ctl.xwrite(fmt.Sprintf("%d", count))
 		ctl.xwriteok()
 
+	case "messages":
+		/* protocol:
+		> "messages"
+		> op: find, delete, move, redeliver
+		> dryrun: true or false
+		> account
+		> mailbox
+		> messageid
+		> msgfrom
+		> mailfrom
+		> tomailbox
+		< "ok" or error
+		< stream
+		*/
+		op := store.MessageOp(ctl.xread())
+		dryrun := ctl.xread() == "true"
+		var q store.MessageQuery
+		q.Account = ctl.xread()
+		q.Mailbox = ctl.xread()
+		q.MessageID = ctl.xread()
+		q.MsgFrom = ctl.xread()
+		q.MailFrom = ctl.xread()
+		moveTo := ctl.xread()
+		matches, err := store.MessagesOperate(log, q, op, moveTo, dryrun)
+		ctl.xcheck(err, "operating on messages")
+		ctl.xwriteok()
+
+		xw := ctl.writer()
+		for _, mm := range matches {
+			var to string
+			if mm.ToMailbox != "" {
+				to = " -> " + mm.ToMailbox
+			}
+			fmt.Fprintf(xw, "%s %q uid %d%s, id %d, received %s, from %s, mailfrom %s, message-id %s, size %d\n", mm.Account, mm.Mailbox, mm.UID, to, mm.ID, mm.Received.Format(time.RFC3339), mm.MsgFrom, mm.MailFrom, mm.MessageID, mm.Size)
+		}
+		switch {
+		case op == store.MessageOpFind:
+			fmt.Fprintf(xw, "%d messages found\n", len(matches))
+		case dryrun:
+			fmt.Fprintf(xw, "%d messages matched, dry run, no changes made\n", len(matches))
+		default:
+			fmt.Fprintf(xw, "%d messages matched, operation %s done\n", len(matches), op)
+		}
+		xw.xclose()
+
+	case "messagestransfer":
+		/* protocol:
+		> "messagestransfer"
+		> move: true or false
+		> dryrun: true or false
+		> account
+		> mailbox
+		> messageid
+		> msgfrom
+		> mailfrom
+		> destination account
+		> destination mailbox, can be empty
+		< "ok" or error
+		< stream
+		*/
+		move := ctl.xread() == "true"
+		dryrun := ctl.xread() == "true"
+		var q store.MessageQuery
+		q.Account = ctl.xread()
+		q.Mailbox = ctl.xread()
+		q.MessageID = ctl.xread()
+		q.MsgFrom = ctl.xread()
+		q.MailFrom = ctl.xread()
+		dstAccount := ctl.xread()
+		dstMailbox := ctl.xread()
+		matches, err := store.MessagesTransfer(log, q, dstAccount, dstMailbox, move, dryrun)
+		ctl.xcheck(err, "transferring messages")
+		ctl.xwriteok()
+
+		xw := ctl.writer()
+		for _, mm := range matches {
+			fmt.Fprintf(xw, "%s %q uid %d -> %s %q, id %d, received %s, from %s, mailfrom %s, message-id %s, size %d\n", mm.Account, mm.Mailbox, mm.UID, dstAccount, mm.ToMailbox, mm.ID, mm.Received.Format(time.RFC3339), mm.MsgFrom, mm.MailFrom, mm.MessageID, mm.Size)
+		}
+		what := "copied"
+		if move {
+			what = "moved"
+		}
+		if dryrun {
+			fmt.Fprintf(xw, "%d messages matched, dry run, no changes made\n", len(matches))
+		} else {
+			fmt.Fprintf(xw, "%d messages %s\n", len(matches), what)
+		}
+		xw.xclose()
+
+	case "dbstats":
+		/* protocol:
+		> "dbstats"
+		> account, can be empty
+		< "ok" or error
+		< stream
+		*/
+		accName := ctl.xread()
+		var accStats bstore.Stats
+		if accName != "" {
+			acc, err := store.OpenAccount(accName)
+			ctl.xcheck(err, "open account")
+			accStats = acc.DB.Stats()
+			err = acc.Close()
+			log.Check(err, "closing account")
+		}
+		ctl.xwriteok()
+
+		xw := ctl.writer()
+		for _, ss := range store.DBStats() {
+			var avg time.Duration
+			if ss.Operations > 0 {
+				avg = ss.Duration / time.Duration(ss.Operations)
+			}
+			fmt.Fprintf(xw, "subsystem %s: %d transactions, %d slow, average duration %s\n", ss.Subsystem, ss.Operations, ss.Slow, avg)
+			writeDBStats(xw, ss.Stats)
+			var keys []string
+			for k := range ss.Indices {
+				keys = append(keys, k)
+			}
+			sort.Slice(keys, func(i, j int) bool {
+				a, b := ss.Indices[keys[i]], ss.Indices[keys[j]]
+				if a != b {
+					return a > b
+				}
+				return keys[i] < keys[j]
+			})
+			if len(keys) > 0 {
+				fmt.Fprintf(xw, "\ttype/index of last query in transaction:\n")
+			}
+			for _, k := range keys {
+				fmt.Fprintf(xw, "\t\t%s: %d\n", k, ss.Indices[k])
+			}
+		}
+		fmt.Fprintf(xw, "queue database, since startup:\n")
+		writeDBStats(xw, queue.DB.Stats())
+		if accName != "" {
+			fmt.Fprintf(xw, "account %s database, since opening:\n", accName)
+			writeDBStats(xw, accStats)
+		}
+		xw.xclose()
+
 	case "queuedump":
 		/* protocol:
 		> "queuedump"
@@ -487,6 +632,27 @@ func servectlcmd(ctx context.Context, ctl *ctl, shutdown func()) {
 		mbox := cmd == "importmbox"
 		importctl(ctx, ctl, mbox)
 
+	case "importarchive":
+		/* protocol:
+		> "importarchive"
+		> account
+		> src (path to archival export)
+		< "ok" or error
+		< count (of imported messages)
+		*/
+		account := ctl.xread()
+		src := ctl.xread()
+		acc, err := store.OpenAccount(account)
+		ctl.xcheck(err, "open account")
+		defer func() {
+			err := acc.Close()
+			log.Check(err, "closing account after archive import")
+		}()
+		n, err := acc.ImportArchive(ctx, log, src)
+		ctl.xcheck(err, "importing archive")
+		ctl.xwriteok()
+		ctl.xwrite(fmt.Sprintf("%d", n))
+
 	case "domainadd":
 		/* protocol:
 		> "domainadd"
@@ -541,6 +707,40 @@ func servectlcmd(ctx context.Context, ctl *ctl, shutdown func()) {
 		ctl.xcheck(err, "removing account")
 		ctl.xwriteok()
 
+	case "accountsuspend":
+		/* protocol:
+		> "accountsuspend"
+		> account
+		> suspended: true or false
+		> tempfail: true or false
+		< "ok" or error
+		*/
+		account := ctl.xread()
+		suspended := ctl.xread() == "true"
+		tempfail := ctl.xread() == "true"
+		err := mox.AccountSuspendSave(ctx, account, suspended, tempfail)
+		ctl.xcheck(err, "saving account suspension")
+		ctl.xwriteok()
+
+	case "accountdeleteat":
+		/* protocol:
+		> "accountdeleteat"
+		> account
+		> time in RFC 3339 format, or empty to cancel
+		< "ok" or error
+		*/
+		account := ctl.xread()
+		s := ctl.xread()
+		var at time.Time
+		if s != "" {
+			var err error
+			at, err = time.Parse(time.RFC3339, s)
+			ctl.xcheck(err, "parsing time")
+		}
+		err := mox.AccountDeletionSchedule(ctx, account, at)
+		ctl.xcheck(err, "scheduling account deletion")
+		ctl.xwriteok()
+
 	case "addressadd":
 		/* protocol:
 		> "addressadd"
@@ -610,6 +810,53 @@ func servectlcmd(ctx context.Context, ctl *ctl, shutdown func()) {
 		}
 		ctl.xwriteok()
 
+	case "traceadd":
+		/* protocol:
+		> "traceadd"
+		> account (or empty)
+		> ip (or empty)
+		> duration
+		< "ok" or error
+		< id
+		*/
+		account := ctl.xread()
+		ip := ctl.xread()
+		d, err := time.ParseDuration(ctl.xread())
+		ctl.xcheck(err, "parsing duration")
+		t, err := mox.TraceAdd(ctl.log, account, ip, d)
+		ctl.xcheck(err, "adding trace")
+		ctl.xwriteok()
+		ctl.xwrite(fmt.Sprintf("%d", t.ID))
+
+	case "tracelist":
+		/* protocol:
+		> "tracelist"
+		< "ok"
+		< stream
+		*/
+		ctl.xwriteok()
+		var s string
+		for _, t := range mox.TraceList() {
+			what := "account " + t.Account
+			if t.IP != "" {
+				what = "ip " + t.IP
+			}
+			s += fmt.Sprintf("%d %s, expires %s\n", t.ID, what, t.Expires.Format(time.RFC3339))
+		}
+		ctl.xstreamfrom(strings.NewReader(s))
+
+	case "tracerm":
+		/* protocol:
+		> "tracerm"
+		> id
+		< "ok" or error
+		*/
+		id, err := strconv.ParseInt(ctl.xread(), 10, 64)
+		ctl.xcheck(err, "parsing id")
+		err = mox.TraceRemove(ctl.log, id)
+		ctl.xcheck(err, "removing trace")
+		ctl.xwriteok()
+
 	case "retrain":
 		/* protocol:
 		> "retrain"
@@ -668,6 +915,51 @@ func servectlcmd(ctx context.Context, ctl *ctl, shutdown func()) {
 
 		ctl.xwriteok()
 
+	case "textindex":
+		/* protocol:
+		> "textindex"
+		> account
+		< "ok" or error
+		< count
+		*/
+		account := ctl.xread()
+		acc, err := store.OpenAccount(account)
+		ctl.xcheck(err, "open account")
+		defer func() {
+			err := acc.Close()
+			log.Check(err, "closing account after building full-text index")
+		}()
+		if !acc.TextIndexEnabled() {
+			ctl.xcheck(store.ErrTextIndexDisabled, "checking full-text index")
+		}
+		n, err := acc.TextIndexBuild(ctx, ctl.log)
+		ctl.xcheck(err, "building full-text index")
+		ctl.log.Info("added messages to full-text index", mlog.Field("account", account), mlog.Field("count", n))
+		ctl.xwriteok()
+		ctl.xwrite(fmt.Sprintf("%d", n))
+
+	case "recalculatemailboxcounts":
+		/* protocol:
+		> "recalculatemailboxcounts"
+		> account
+		< "ok" or error
+		< count
+		*/
+		account := ctl.xread()
+		acc, err := store.OpenAccount(account)
+		ctl.xcheck(err, "open account")
+		defer func() {
+			err := acc.Close()
+			log.Check(err, "closing account after recalculating mailbox counts")
+		}()
+		var n int
+		acc.WithWLock(func() {
+			n, err = acc.MailboxCountsRecalculate(ctx, ctl.log)
+		})
+		ctl.xcheck(err, "recalculating mailbox counts")
+		ctl.xwriteok()
+		ctl.xwrite(fmt.Sprintf("%d", n))
+
 	case "backup":
 		backupctl(ctx, ctl)
 
@@ -677,3 +969,9 @@ func servectlcmd(ctx context.Context, ctl *ctl, shutdown func()) {
 		return
 	}
 }
+
+func writeDBStats(w io.Writer, st bstore.Stats) {
+	fmt.Fprintf(w, "\tqueries %d, table scans %d, primary key gets %d, unique index gets %d, primary key scans %d, index scans %d, in-memory sorts %d\n", st.Queries, st.PlanTableScan, st.PlanPK, st.PlanUnique, st.PlanPKScan, st.PlanIndexScan, st.Sort)
+	fmt.Fprintf(w, "\trecords get %d, insert %d, update %d, delete %d\n", st.Get, st.Insert, st.Update, st.Delete)
+	fmt.Fprintf(w, "\tkv records get %d, put %d, delete %d, cursor %d; index get %d, put %d, delete %d, cursor %d\n", st.Records.Get, st.Records.Put, st.Records.Delete, st.Records.Cursor, st.Index.Get, st.Index.Put, st.Index.Delete, st.Index.Cursor)
+}
@@ -9,6 +9,9 @@ import (
 	"os"
 	"testing"
 
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/config"
 	"github.com/mjl-/mox/dmarcdb"
 	"github.com/mjl-/mox/dns"
 	"github.com/mjl-/mox/mlog"
@@ -83,6 +86,22 @@ func TestCtl(t *testing.T) {
 		ctlcmdQueueDrop(ctl, 0, "", "")
 	})
 
+	// "messages"
+	testctl(func(ctl *ctl) {
+		ctlcmdMessages(ctl, store.MessageOpFind, store.MessageQuery{MsgFrom: "@mox.example"}, "", false)
+	})
+	testctl(func(ctl *ctl) {
+		ctlcmdMessages(ctl, store.MessageOpDelete, store.MessageQuery{MessageID: "<bogus@mox.example>"}, "", true)
+	})
+
+	// "dbstats"
+	testctl(func(ctl *ctl) {
+		ctlcmdDBStats(ctl, "")
+	})
+	testctl(func(ctl *ctl) {
+		ctlcmdDBStats(ctl, "mjl")
+	})
+
 	// no "queuedump", we don't have a message to dump, and the commands exits without a message.
 
 	// "importmbox"
@@ -100,10 +119,36 @@ func TestCtl(t *testing.T) {
 		ctlcmdConfigDomainAdd(ctl, dns.Domain{ASCII: "mox2.example"}, "mjl", "")
 	})
 
+	// Account template for the new domain.
+	dc := mox.Conf.Dynamic.Domains["mox2.example"]
+	dc.AccountTemplate = &config.AccountTemplate{
+		Mailboxes:                 []string{"Sent", "Lists"},
+		Rulesets:                  []config.Ruleset{{VerifiedDomain: "list.example", Mailbox: "Lists"}},
+		MaxOutgoingMessagesPerDay: 10,
+		SubmissionFromAllowed:     []string{"info@mox2.example"},
+	}
+	mox.Conf.Dynamic.Domains["mox2.example"] = dc
+
 	// "accountadd"
 	testctl(func(ctl *ctl) {
 		ctlcmdConfigAccountAdd(ctl, "mjl2", "mjl2@mox2.example")
 	})
+	accConf, ok := mox.Conf.Account("mjl2")
+	if !ok || len(accConf.Destinations["mjl2@mox2.example"].Rulesets) != 1 || accConf.MaxOutgoingMessagesPerDay != 10 || len(accConf.SubmissionFromAllowed) != 1 {
+		t.Fatalf("account template not applied to new account: %#v", accConf)
+	}
+	acc2, err := store.OpenAccount("mjl2")
+	tcheck(t, err, "open account")
+	err = acc2.DB.Read(ctxbg, func(tx *bstore.Tx) error {
+		n, err := bstore.QueryTx[store.Mailbox](tx).Count()
+		if err == nil && n != 3 {
+			t.Fatalf("got %d mailboxes for new account, expected inbox and mailboxes from template", n)
+		}
+		return err
+	})
+	tcheck(t, err, "count mailboxes")
+	err = acc2.Close()
+	tcheck(t, err, "close account")
 
 	// "addressadd"
 	testctl(func(ctl *ctl) {
@@ -119,11 +164,57 @@ func TestCtl(t *testing.T) {
 		ctlcmdRetrain(ctl, "mjl2")
 	})
 
+	// "textindex", add delivered message to full-text index.
+	accConf = mox.Conf.Dynamic.Accounts["mjl2"]
+	accConf.FullTextIndex = true
+	mox.Conf.Dynamic.Accounts["mjl2"] = accConf
+	testctl(func(ctl *ctl) {
+		ctlcmdTextIndex(ctl, "mjl2")
+	})
+
+	// "recalculatemailboxcounts"
+	testctl(func(ctl *ctl) {
+		ctlcmdRecalculateMailboxCounts(ctl, "mjl2")
+	})
+
 	// "addressrm"
 	testctl(func(ctl *ctl) {
 		ctlcmdConfigAddressRemove(ctl, "mjl3@mox2.example")
 	})
 
+	// "messagestransfer"
+	testctl(func(ctl *ctl) {
+		ctlcmdMessagesTransfer(ctl, store.MessageQuery{Account: "mjl", Mailbox: "Inbox"}, "mjl2", "", false, true)
+	})
+	testctl(func(ctl *ctl) {
+		ctlcmdMessagesTransfer(ctl, store.MessageQuery{Account: "mjl", Mailbox: "Inbox"}, "mjl2", "Handoff", false, false)
+	})
+
+	// "accountsuspend"
+	testctl(func(ctl *ctl) {
+		ctlcmdConfigAccountSuspend(ctl, "mjl2", true, true)
+	})
+	if accConf, _ := mox.Conf.Account("mjl2"); !accConf.Suspended || !accConf.SuspendedTempfail {
+		t.Fatalf("account not suspended")
+	}
+	testctl(func(ctl *ctl) {
+		ctlcmdConfigAccountSuspend(ctl, "mjl2", false, false)
+	})
+
+	// "accountdeleteat"
+	testctl(func(ctl *ctl) {
+		ctlcmdConfigAccountDeleteAt(ctl, "mjl2", "2030-01-02T03:04:05Z")
+	})
+	if accConf, _ := mox.Conf.Account("mjl2"); accConf.DeleteAtTime.IsZero() {
+		t.Fatalf("account deletion not scheduled")
+	}
+	testctl(func(ctl *ctl) {
+		ctlcmdConfigAccountDeleteAt(ctl, "mjl2", "")
+	})
+	if accConf, _ := mox.Conf.Account("mjl2"); accConf.DeleteAt != "" {
+		t.Fatalf("account deletion not canceled")
+	}
+
 	// "accountrm"
 	testctl(func(ctl *ctl) {
 		ctlcmdConfigAccountRemove(ctl, "mjl2")
@@ -147,6 +238,24 @@ func TestCtl(t *testing.T) {
 		ctlcmdSetLoglevels(ctl, "smtpserver", "debug")
 	})
 
+	// "traceadd", "tracelist", "tracerm"
+	var traceID string
+	testctl(func(ctl *ctl) {
+		traceID = ctlcmdTraceAdd(ctl, "mjl", "", "1h")
+	})
+	if l := mox.TraceList(); len(l) != 1 || l[0].Account != "mjl" {
+		t.Fatalf("got traces %v, expected one for mjl", l)
+	}
+	testctl(func(ctl *ctl) {
+		ctlcmdTraceList(ctl)
+	})
+	testctl(func(ctl *ctl) {
+		ctlcmdTraceRemove(ctl, traceID)
+	})
+	if l := mox.TraceList(); len(l) != 0 {
+		t.Fatalf("got traces %v, expected none", l)
+	}
+
 	// Export data, import it again
 	xcmdExport(true, []string{"testdata/ctl/data/tmp/export/mbox/", "testdata/ctl/data/accounts/mjl"}, nil)
 	xcmdExport(false, []string{"testdata/ctl/data/tmp/export/maildir/", "testdata/ctl/data/accounts/mjl"}, nil)
@@ -157,6 +266,18 @@ func TestCtl(t *testing.T) {
 		ctlcmdImport(ctl, false, "mjl", "inbox", "testdata/ctl/data/tmp/export/maildir/Inbox")
 	})
 
+	// "importarchive", after archival export.
+	os.Remove("testdata/ctl/data/tmp/export/archive.tar")
+	xcmdExportArchive("testdata/ctl/data/tmp/export/archive.tar", "testdata/ctl/data/accounts/mjl")
+	f, err := os.Open("testdata/ctl/data/tmp/export/archive.tar")
+	tcheck(t, err, "open archive")
+	_, err = store.VerifyArchive(f)
+	tcheck(t, err, "verify archive")
+	f.Close()
+	testctl(func(ctl *ctl) {
+		ctlcmdImportArchive(ctl, "mjl", "testdata/ctl/data/tmp/export/archive.tar")
+	})
+
 	// "backup", backup account.
 	err = dmarcdb.Init()
 	tcheck(t, err, "dmarcdb init")
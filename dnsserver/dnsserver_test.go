@@ -0,0 +1,119 @@
+package dnsserver
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+func tcheck(t *testing.T, err error, msg string) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %s", msg, err)
+	}
+}
+
+func TestServer(t *testing.T) {
+	mox.Context = context.Background()
+	mox.ConfigStaticPath = "../testdata/dnsserver/mox.conf"
+	mox.ConfigDynamicPath = filepath.Join(filepath.Dir(mox.ConfigStaticPath), "domains.conf")
+	mox.MustLoadConfig(true, false)
+
+	log := mlog.New("dnsserver")
+	axfrIP := net.ParseIP("192.0.2.53")
+
+	query := func(proto, name string, qtype dnsmessage.Type, remoteIP net.IP) []dnsmessage.Message {
+		t.Helper()
+		req := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: 123, RecursionDesired: true},
+			Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}},
+		}
+		buf, err := req.Pack()
+		tcheck(t, err, "pack request")
+		responses, err := handle(log, buf, proto, remoteIP, []net.IP{axfrIP})
+		tcheck(t, err, "handle request")
+		var l []dnsmessage.Message
+		for _, msg := range responses {
+			var resp dnsmessage.Message
+			err := resp.Unpack(msg)
+			tcheck(t, err, "unpack response")
+			if resp.Header.ID != 123 || !resp.Header.Response {
+				t.Fatalf("bad response header %#v", resp.Header)
+			}
+			l = append(l, resp)
+		}
+		return l
+	}
+
+	xquery := func(name string, qtype dnsmessage.Type, rcode dnsmessage.RCode, nanswers int) dnsmessage.Message {
+		t.Helper()
+		l := query("udp", name, qtype, nil)
+		if len(l) != 1 {
+			t.Fatalf("got %d responses, expected 1", len(l))
+		}
+		resp := l[0]
+		if resp.Header.RCode != rcode || len(resp.Answers) != nanswers {
+			t.Fatalf("query %s %s: got rcode %s with %d answers, expected %s with %d answers", name, qtype, resp.Header.RCode, len(resp.Answers), rcode, nanswers)
+		}
+		return resp
+	}
+
+	resp := xquery("mox.example.", dnsmessage.TypeMX, dnsmessage.RCodeSuccess, 1)
+	if !resp.Header.Authoritative {
+		t.Fatalf("response not authoritative")
+	}
+	if mx := resp.Answers[0].Body.(*dnsmessage.MXResource); mx.MX.String() != "mail.mox.example." {
+		t.Fatalf("got mx %s, expected mail.mox.example.", mx.MX)
+	}
+
+	// Case-insensitive.
+	resp = xquery("TestSel._DomainKey.Mox.Example.", dnsmessage.TypeTXT, dnsmessage.RCodeSuccess, 1)
+	if s := strings.Join(resp.Answers[0].Body.(*dnsmessage.TXTResource).TXT, ""); !strings.HasPrefix(s, "v=DKIM1;") {
+		t.Fatalf("got dkim record %q", s)
+	}
+
+	xquery("_smtp._tls.mox.example.", dnsmessage.TypeTXT, dnsmessage.RCodeSuccess, 1)
+	xquery("_imaps._tcp.mox.example.", dnsmessage.TypeSRV, dnsmessage.RCodeSuccess, 1)
+	xquery("mail.mox.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, 1)
+	xquery("mail.mox.example.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, 1)
+	xquery("other.example.", dnsmessage.TypeMX, dnsmessage.RCodeSuccess, 1)
+
+	// CNAME, with target records of the requested type.
+	resp = xquery("autoconfig.mox.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, 2)
+	if resp.Answers[0].Header.Type != dnsmessage.TypeCNAME || resp.Answers[1].Header.Type != dnsmessage.TypeA {
+		t.Fatalf("unexpected answers for cname %#v", resp.Answers)
+	}
+
+	// No data for existing name, and for empty non-terminal. Nonexistent name.
+	resp = xquery("mox.example.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, 0)
+	if len(resp.Authorities) != 1 || resp.Authorities[0].Header.Type != dnsmessage.TypeSOA {
+		t.Fatalf("missing soa in negative response")
+	}
+	xquery("_domainkey.mox.example.", dnsmessage.TypeTXT, dnsmessage.RCodeSuccess, 0)
+	xquery("nonexistent.mox.example.", dnsmessage.TypeA, dnsmessage.RCodeNameError, 0)
+
+	// Not our zone.
+	xquery("example.org.", dnsmessage.TypeA, dnsmessage.RCodeRefused, 0)
+
+	// Zone transfers only over TCP from allowed IPs.
+	xquery("mox.example.", dnsmessage.TypeAXFR, dnsmessage.RCodeRefused, 0)
+	l := query("tcp", "mox.example.", dnsmessage.TypeAXFR, net.ParseIP("192.0.2.1"))
+	if len(l) != 1 || l[0].Header.RCode != dnsmessage.RCodeRefused {
+		t.Fatalf("zone transfer from unlisted ip not refused")
+	}
+	l = query("tcp", "mox.example.", dnsmessage.TypeAXFR, axfrIP)
+	var records []dnsmessage.Resource
+	for _, resp := range l {
+		records = append(records, resp.Answers...)
+	}
+	if len(records) < 3 || records[0].Header.Type != dnsmessage.TypeSOA || records[len(records)-1].Header.Type != dnsmessage.TypeSOA {
+		t.Fatalf("zone transfer does not start and end with soa: %#v", records)
+	}
+}
@@ -0,0 +1,422 @@
+// Package dnsserver is an authoritative DNS server for the configured domains,
+// serving exactly the records mox wants published.
+//
+// Small deployments can delegate a (sub)domain to mox, and never have to edit
+// the DNS records for email by hand again. Records follow the configuration: a
+// new DKIM selector or MTA-STS policy ID is published once the domains config is
+// reloaded. The SOA serial is the modification time of the domains config, for
+// secondary name servers using zone transfers (AXFR).
+package dnsserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+var xlog = mlog.New("dnsserver")
+
+var metricQuery = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mox_dns_query_total",
+		Help: "DNS queries handled by the authoritative DNS server.",
+	},
+	[]string{
+		"proto",  // udp, tcp
+		"result", // success, nameerror, refused, formaterror, notimplemented, axfr
+	},
+)
+
+// Maximum UDP response size with EDNS0, small enough to prevent IP
+// fragmentation.
+const ednsSize = 1232
+
+// Number of records per message in zone transfers.
+const axfrChunk = 50
+
+var zonesCache struct {
+	sync.Mutex
+	mtime time.Time
+	zones []*zone
+}
+
+// zones returns the zones for the configured domains. They are made again when
+// the domains config has changed.
+func zones() ([]*zone, error) {
+	mtime := mox.Conf.DynamicMtime()
+
+	zonesCache.Lock()
+	defer zonesCache.Unlock()
+	if zonesCache.zones != nil && mtime.Equal(zonesCache.mtime) {
+		return zonesCache.zones, nil
+	}
+
+	hosts, err := hosts()
+	if err != nil {
+		return nil, err
+	}
+	var l []*zone
+	for _, name := range mox.Conf.Domains() {
+		d, err := dns.ParseDomain(name)
+		if err != nil {
+			return nil, fmt.Errorf("parsing domain %q: %v", name, err)
+		}
+		domConf, ok := mox.Conf.Domain(d)
+		if !ok {
+			continue
+		}
+		z, err := makeZone(domConf, d, hosts, uint32(mtime.Unix()))
+		if err != nil {
+			return nil, fmt.Errorf("records for domain %s: %v", d, err)
+		}
+		l = append(l, z)
+	}
+	zonesCache.mtime = mtime
+	zonesCache.zones = l
+	return l, nil
+}
+
+// findZone returns the zone the fully qualified lower case name is in, the
+// most specific if multiple match. Nil if no zone matches.
+func findZone(zones []*zone, name string) *zone {
+	var r *zone
+	for _, z := range zones {
+		if z.contains(name) && (r == nil || len(z.origin) > len(r.origin)) {
+			r = z
+		}
+	}
+	return r
+}
+
+// answer adds the records for name and qtype to resp, following CNAMEs within
+// the zone. For unknown names, the response code is set to NXDOMAIN. For
+// negative responses the SOA record is added as authority.
+func (z *zone) answer(resp *dnsmessage.Message, name string, qtype dnsmessage.Type) {
+	rrs, ok := z.records[name]
+	if !ok {
+		if !z.exists(name) {
+			resp.RCode = dnsmessage.RCodeNameError
+		}
+		resp.Authorities = []dnsmessage.Resource{z.soa}
+		return
+	}
+
+	if qtype != dnsmessage.TypeCNAME {
+		for _, r := range rrs {
+			cname, ok := r.Body.(*dnsmessage.CNAMEResource)
+			if !ok {
+				continue
+			}
+			resp.Answers = append(resp.Answers, r)
+			target := strings.ToLower(cname.CNAME.String())
+			if z.contains(target) {
+				for _, tr := range z.records[target] {
+					if qtype == dnsmessage.TypeALL || tr.Header.Type == qtype {
+						resp.Answers = append(resp.Answers, tr)
+					}
+				}
+			}
+			return
+		}
+	}
+
+	for _, r := range rrs {
+		if qtype == dnsmessage.TypeALL || r.Header.Type == qtype {
+			resp.Answers = append(resp.Answers, r)
+		}
+	}
+	if len(resp.Answers) == 0 {
+		resp.Authorities = []dnsmessage.Resource{z.soa}
+	}
+}
+
+// handle returns the response messages for a DNS request. For a zone transfer,
+// multiple messages can be returned, otherwise one. If the request cannot be
+// parsed at all, an error is returned and no response should be sent.
+func handle(log *mlog.Log, buf []byte, proto string, remoteIP net.IP, axfrAllowed []net.IP) (responses [][]byte, rerr error) {
+	var req dnsmessage.Message
+	if err := req.Unpack(buf); err != nil {
+		// If we can parse the header, we reply with a format error.
+		var p dnsmessage.Parser
+		h, herr := p.Start(buf)
+		if herr != nil || h.Response {
+			return nil, fmt.Errorf("parsing request: %v", err)
+		}
+		log.Debugx("parsing dns request", err)
+		metricQuery.WithLabelValues(proto, "formaterror").Inc()
+		resp := dnsmessage.Message{Header: dnsmessage.Header{ID: h.ID, Response: true, OpCode: h.OpCode, RCode: dnsmessage.RCodeFormatError}}
+		msg, err := resp.Pack()
+		if err != nil {
+			return nil, fmt.Errorf("packing response: %v", err)
+		}
+		return [][]byte{msg}, nil
+	}
+	if req.Header.Response {
+		return nil, fmt.Errorf("ignoring dns response message")
+	}
+
+	resp := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               req.Header.ID,
+			Response:         true,
+			OpCode:           req.Header.OpCode,
+			RecursionDesired: req.Header.RecursionDesired,
+		},
+		Questions: req.Questions,
+	}
+
+	maxSize := 512
+	var edns bool
+	for _, r := range req.Additionals {
+		if r.Header.Type == dnsmessage.TypeOPT {
+			edns = true
+			// The class of an OPT record holds the UDP payload size. ../rfc/6891:383
+			if n := int(r.Header.Class); n > maxSize {
+				maxSize = n
+			}
+		}
+	}
+	if maxSize > ednsSize {
+		maxSize = ednsSize
+	}
+	if proto == "tcp" {
+		maxSize = 65535
+	}
+
+	var q dnsmessage.Question
+	var name string
+	var z *zone
+	if req.Header.OpCode != 0 {
+		resp.RCode = dnsmessage.RCodeNotImplemented
+	} else if len(req.Questions) != 1 {
+		resp.RCode = dnsmessage.RCodeFormatError
+	} else {
+		q = req.Questions[0]
+		name = strings.ToLower(q.Name.String())
+		zones, err := zones()
+		if err != nil {
+			return nil, fmt.Errorf("making zones: %v", err)
+		}
+		z = findZone(zones, name)
+		if z == nil || q.Class != dnsmessage.ClassINET && q.Class != dnsmessage.ClassANY {
+			resp.RCode = dnsmessage.RCodeRefused
+		} else if q.Type == dnsmessage.TypeAXFR {
+			// ../rfc/5936:621
+			var allowed bool
+			for _, ip := range axfrAllowed {
+				allowed = allowed || ip.Equal(remoteIP)
+			}
+			if proto != "tcp" || !allowed || name != z.origin {
+				resp.RCode = dnsmessage.RCodeRefused
+			} else {
+				log.Info("dns zone transfer", mlog.Field("zone", z.origin), mlog.Field("remoteip", remoteIP))
+				metricQuery.WithLabelValues(proto, "axfr").Inc()
+				return axfr(resp, z)
+			}
+		} else {
+			resp.Header.Authoritative = true
+			z.answer(&resp, name, q.Type)
+		}
+	}
+
+	rcode := strings.ToLower(strings.TrimPrefix(resp.Header.RCode.String(), "RCode"))
+	log.Debug("dns query", mlog.Field("proto", proto), mlog.Field("name", name), mlog.Field("type", q.Type), mlog.Field("rcode", rcode), mlog.Field("remoteip", remoteIP))
+	metricQuery.WithLabelValues(proto, rcode).Inc()
+
+	if edns {
+		var opt dnsmessage.Resource
+		err := opt.Header.SetEDNS0(ednsSize, dnsmessage.RCodeSuccess, false)
+		if err != nil {
+			return nil, fmt.Errorf("making edns0 record: %v", err)
+		}
+		opt.Body = &dnsmessage.OPTResource{}
+		resp.Additionals = []dnsmessage.Resource{opt}
+	}
+
+	msg, err := resp.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("packing response: %v", err)
+	}
+	if len(msg) > maxSize {
+		// Indicate the client should retry over TCP. ../rfc/2181:407
+		resp.Header.Truncated = true
+		resp.Answers = nil
+		resp.Authorities = nil
+		msg, err = resp.Pack()
+		if err != nil {
+			return nil, fmt.Errorf("packing truncated response: %v", err)
+		}
+	}
+	return [][]byte{msg}, nil
+}
+
+// axfr returns the messages for a zone transfer. The first and last record are
+// the SOA record. ../rfc/5936:1003
+func axfr(resp dnsmessage.Message, z *zone) ([][]byte, error) {
+	resp.Header.Authoritative = true
+	records := append([]dnsmessage.Resource{z.soa}, z.all()...)
+	records = append(records, z.soa)
+
+	var l [][]byte
+	for len(records) > 0 {
+		n := axfrChunk
+		if n > len(records) {
+			n = len(records)
+		}
+		resp.Answers = records[:n]
+		records = records[n:]
+		msg, err := resp.Pack()
+		if err != nil {
+			return nil, fmt.Errorf("packing zone transfer response: %v", err)
+		}
+		l = append(l, msg)
+		// Only the first message includes the question. ../rfc/5936:714
+		resp.Questions = nil
+	}
+	return l, nil
+}
+
+var servers []func()
+
+// Listen prepares listeners for DNS on UDP and TCP, for all listeners with DNS
+// enabled. Call Serve to start handling requests.
+func Listen() {
+	for name, listener := range mox.Conf.Static.Listeners {
+		if !listener.DNS.Enabled {
+			continue
+		}
+		port := config.Port(listener.DNS.Port, 53)
+		for _, ip := range listener.IPs {
+			listen1(name, ip, port, listener.DNS.AXFRAllowed)
+		}
+	}
+}
+
+func listen1(listenerName, ip string, port int, axfrAllowed []net.IP) {
+	addr := net.JoinHostPort(ip, fmt.Sprintf("%d", port))
+	if os.Getuid() == 0 {
+		xlog.Print("listening for dns", mlog.Field("listener", listenerName), mlog.Field("addr", addr))
+	}
+
+	udpNetwork := "udp" + strings.TrimPrefix(mox.Network(ip), "tcp")
+	sockopts := mox.Conf.Static.Listeners[listenerName].SocketOptions
+	conn, err := mox.ListenPacket(udpNetwork, addr, sockopts)
+	if err != nil {
+		xlog.Fatalx("dns: listen for udp", err, mlog.Field("listener", listenerName))
+	}
+	ln, err := mox.Listen(mox.Network(ip), addr, sockopts)
+	if err != nil {
+		xlog.Fatalx("dns: listen for tcp", err, mlog.Field("listener", listenerName))
+	}
+	ln = mox.LimitListener(ln, listenerName)
+
+	serveUDP := func() {
+		buf := make([]byte, 65535)
+		for {
+			n, raddr, err := conn.ReadFrom(buf)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				xlog.Infox("dns: read udp", err, mlog.Field("listener", listenerName))
+				continue
+			}
+			var remoteIP net.IP
+			if a, ok := raddr.(*net.UDPAddr); ok {
+				remoteIP = a.IP
+			}
+			log := xlog.WithCid(mox.Cid())
+			responses, err := handle(log, buf[:n], "udp", remoteIP, axfrAllowed)
+			if err != nil {
+				log.Debugx("handling dns request", err, mlog.Field("remoteip", remoteIP))
+				continue
+			}
+			for _, msg := range responses {
+				_, err := conn.WriteTo(msg, raddr)
+				log.Check(err, "writing dns response", mlog.Field("remoteip", remoteIP))
+			}
+		}
+	}
+
+	serveTCP := func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				xlog.Infox("dns: accept", err, mlog.Field("listener", listenerName))
+				continue
+			}
+			go serveConn(conn, axfrAllowed)
+		}
+	}
+
+	servers = append(servers, serveUDP, serveTCP)
+}
+
+// serveConn handles DNS requests on a TCP connection, each message prefixed
+// with its length. ../rfc/1035:1394 ../rfc/7766:593
+func serveConn(conn net.Conn, axfrAllowed []net.IP) {
+	log := xlog.WithCid(mox.Cid())
+	defer func() {
+		err := conn.Close()
+		log.Check(err, "closing dns connection")
+	}()
+	var remoteIP net.IP
+	if a, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		remoteIP = a.IP
+	}
+
+	for {
+		// Clients that are idle for too long are disconnected. ../rfc/7766:787
+		err := conn.SetDeadline(time.Now().Add(30 * time.Second))
+		log.Check(err, "setting deadline")
+
+		var size uint16
+		if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Debugx("reading dns request size", err)
+			}
+			return
+		}
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			log.Debugx("reading dns request", err)
+			return
+		}
+		responses, err := handle(log, buf, "tcp", remoteIP, axfrAllowed)
+		if err != nil {
+			log.Debugx("handling dns request", err, mlog.Field("remoteip", remoteIP))
+			return
+		}
+		for _, msg := range responses {
+			b := make([]byte, 2, 2+len(msg))
+			binary.BigEndian.PutUint16(b, uint16(len(msg)))
+			if _, err := conn.Write(append(b, msg...)); err != nil {
+				log.Debugx("writing dns response", err)
+				return
+			}
+		}
+	}
+}
+
+// Serve starts serving on all listeners, launching a goroutine per listener.
+func Serve() {
+	for _, serve := range servers {
+		go serve()
+	}
+	servers = nil
+}
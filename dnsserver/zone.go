@@ -0,0 +1,312 @@
+package dnsserver
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/dkim"
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/mox-"
+)
+
+// TTL for all records, same as suggested in the records from "mox config
+// dnsrecords".
+const ttl = 300
+
+// TLSA is not known to package dnsmessage. ../rfc/6698:432
+const typeTLSA dnsmessage.Type = 52
+
+// zone holds the records of a configured domain.
+type zone struct {
+	origin  string                           // Fully qualified, lower case, e.g. "mox.example.".
+	soa     dnsmessage.Resource              // Start of authority, also used in negative responses.
+	names   []string                         // Names with records, in order of addition, for zone transfers.
+	records map[string][]dnsmessage.Resource // By fully qualified lower case name.
+}
+
+// contains returns whether the fully qualified lower case name is in the zone.
+func (z *zone) contains(name string) bool {
+	return name == z.origin || strings.HasSuffix(name, "."+z.origin)
+}
+
+// exists returns whether name has records, or is an empty non-terminal, i.e.
+// has names with records below it.
+func (z *zone) exists(name string) bool {
+	if _, ok := z.records[name]; ok {
+		return true
+	}
+	for _, n := range z.names {
+		if strings.HasSuffix(n, "."+name) {
+			return true
+		}
+	}
+	return false
+}
+
+// all returns all records of the zone, excluding the SOA record, for zone
+// transfers.
+func (z *zone) all() []dnsmessage.Resource {
+	var l []dnsmessage.Resource
+	for _, name := range z.names {
+		for _, r := range z.records[name] {
+			if r.Header.Type != dnsmessage.TypeSOA {
+				l = append(l, r)
+			}
+		}
+	}
+	return l
+}
+
+func (z *zone) add(name string, body dnsmessage.ResourceBody) error {
+	name = strings.ToLower(name)
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		return fmt.Errorf("bad dns name %q: %v", name, err)
+	}
+	var typ dnsmessage.Type
+	if u, ok := body.(*dnsmessage.UnknownResource); ok {
+		typ = u.Type
+	} else {
+		// The type is set when packing, but we need it for matching queries.
+		switch body.(type) {
+		case *dnsmessage.AResource:
+			typ = dnsmessage.TypeA
+		case *dnsmessage.AAAAResource:
+			typ = dnsmessage.TypeAAAA
+		case *dnsmessage.NSResource:
+			typ = dnsmessage.TypeNS
+		case *dnsmessage.CNAMEResource:
+			typ = dnsmessage.TypeCNAME
+		case *dnsmessage.SOAResource:
+			typ = dnsmessage.TypeSOA
+		case *dnsmessage.MXResource:
+			typ = dnsmessage.TypeMX
+		case *dnsmessage.TXTResource:
+			typ = dnsmessage.TypeTXT
+		case *dnsmessage.SRVResource:
+			typ = dnsmessage.TypeSRV
+		default:
+			return fmt.Errorf("unsupported resource %T", body)
+		}
+	}
+	r := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: n, Type: typ, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   body,
+	}
+	if _, ok := z.records[name]; !ok {
+		z.names = append(z.names, name)
+	}
+	z.records[name] = append(z.records[name], r)
+	if typ == dnsmessage.TypeSOA {
+		z.soa = r
+	}
+	return nil
+}
+
+// txt returns a TXT record, with s split in strings of at most 255 bytes.
+func txt(s string) *dnsmessage.TXTResource {
+	var l []string
+	for len(s) > 255 {
+		l = append(l, s[:255])
+		s = s[255:]
+	}
+	return &dnsmessage.TXTResource{TXT: append(l, s)}
+}
+
+// host has the records for a host name of listeners with SMTP enabled.
+type host struct {
+	ips  []net.IP
+	tlsa [][]byte // Hashes of TLS public keys.
+}
+
+// hosts returns the host names with IPs and TLSA hashes of the listeners with
+// SMTP enabled, by fully qualified lower case name.
+func hosts() (map[string]*host, error) {
+	m := map[string]*host{}
+	for name, l := range mox.Conf.Static.Listeners {
+		if !l.SMTP.Enabled {
+			continue
+		}
+		hostname := mox.Conf.Static.HostnameDomain
+		if l.Hostname != "" {
+			hostname = l.HostnameDomain
+		}
+		hn := strings.ToLower(hostname.ASCII) + "."
+		h := m[hn]
+		if h == nil {
+			h = &host{}
+			m[hn] = h
+		}
+
+		// NATed IPs are not the IPs the world can reach us on.
+		if !l.IPsNATed {
+			for _, ipstr := range l.IPs {
+				ip := net.ParseIP(ipstr)
+				if ip == nil || ip.IsUnspecified() || ip.IsLoopback() {
+					continue
+				}
+				var have bool
+				for _, xip := range h.ips {
+					have = have || xip.Equal(ip)
+				}
+				if !have {
+					h.ips = append(h.ips, ip)
+				}
+			}
+		}
+
+		// Certificates from ACME, with keys that change on renewal, are not published.
+		if l.TLS == nil || len(l.TLS.KeyCerts) == 0 || l.TLS.Config == nil {
+			continue
+		}
+		for _, c := range l.TLS.Config.Certificates {
+			if len(c.Certificate) == 0 {
+				continue
+			}
+			cert, err := x509.ParseCertificate(c.Certificate[0])
+			if err != nil {
+				return nil, fmt.Errorf("parsing tls certificate for listener %s: %v", name, err)
+			}
+			// DANE-EE(3), SPKI(1), SHA-256(1). ../rfc/7671:495
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			data := append([]byte{3, 1, 1}, sum[:]...)
+			var have bool
+			for _, t := range h.tlsa {
+				have = have || string(t) == string(data)
+			}
+			if !have {
+				h.tlsa = append(h.tlsa, data)
+			}
+		}
+	}
+	return m, nil
+}
+
+// makeZone returns the records for a configured domain. The records are the same
+// as suggested by DomainRecords in package mox-, except the optional CAA record.
+// Records for listener host names are included for host names within the domain.
+func makeZone(domConf config.Domain, domain dns.Domain, hosts map[string]*host, serial uint32) (*zone, error) {
+	d := strings.ToLower(domain.ASCII) + "."
+	h := strings.ToLower(mox.Conf.Static.HostnameDomain.ASCII) + "."
+	z := &zone{origin: d, records: map[string][]dnsmessage.Resource{}}
+
+	name := func(s string) dnsmessage.Name {
+		return dnsmessage.MustNewName(strings.ToLower(s))
+	}
+
+	// Replies to the responsible person go to postmaster, which must exist for all
+	// domains. Secondaries check every hour.
+	soa := &dnsmessage.SOAResource{
+		NS:      name(h),
+		MBox:    name("postmaster." + d),
+		Serial:  serial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  14 * 24 * 3600,
+		MinTTL:  ttl,
+	}
+
+	var selectors []string
+	for selName := range domConf.DKIM.Selectors {
+		selectors = append(selectors, selName)
+	}
+	sort.Strings(selectors)
+
+	type record struct {
+		name string
+		body dnsmessage.ResourceBody
+	}
+	records := []record{
+		{d, soa},
+		{d, &dnsmessage.NSResource{NS: name(h)}},
+		{d, &dnsmessage.MXResource{Pref: 10, MX: name(h)}},
+		{d, txt("v=spf1 mx ~all")},
+	}
+	for _, selName := range selectors {
+		sel := domConf.DKIM.Selectors[selName]
+		dkimr := dkim.Record{
+			Version:   "DKIM1",
+			Hashes:    []string{"sha256"},
+			PublicKey: sel.Key.Public(),
+		}
+		if _, ok := sel.Key.(ed25519.PrivateKey); ok {
+			dkimr.Key = "ed25519"
+		} else if _, ok := sel.Key.(*rsa.PrivateKey); !ok {
+			return nil, fmt.Errorf("unrecognized private key for DKIM selector %q: %T", selName, sel.Key)
+		}
+		s, err := dkimr.Record()
+		if err != nil {
+			return nil, fmt.Errorf("making DKIM DNS TXT record: %v", err)
+		}
+		records = append(records, record{selName + "._domainkey." + d, txt(s)})
+	}
+	records = append(records,
+		record{"_dmarc." + d, txt(fmt.Sprintf("v=DMARC1; p=reject; rua=mailto:dmarc-reports@%s!10m", domain.ASCII))},
+	)
+	if sts := domConf.MTASTS; sts != nil {
+		records = append(records,
+			record{"mta-sts." + d, &dnsmessage.CNAMEResource{CNAME: name(h)}},
+			record{"_mta-sts." + d, txt(fmt.Sprintf("v=STSv1; id=%s", sts.PolicyID))},
+		)
+	}
+	records = append(records,
+		record{"_smtp._tls." + d, txt(fmt.Sprintf("v=TLSRPTv1; rua=mailto:tls-reports@%s", domain.ASCII))},
+		record{"autoconfig." + d, &dnsmessage.CNAMEResource{CNAME: name(h)}},
+		record{"_autodiscover._tcp." + d, &dnsmessage.SRVResource{Priority: 0, Weight: 1, Port: 443, Target: name("autoconfig." + d)}},
+		// ../rfc/6186:133 ../rfc/8314:692
+		record{"_imaps._tcp." + d, &dnsmessage.SRVResource{Priority: 0, Weight: 1, Port: 993, Target: name(h)}},
+		record{"_submissions._tcp." + d, &dnsmessage.SRVResource{Priority: 0, Weight: 1, Port: 465, Target: name(h)}},
+		// ../rfc/6186:242
+		record{"_imap._tcp." + d, &dnsmessage.SRVResource{Priority: 0, Weight: 1, Port: 143, Target: name(".")}},
+		record{"_submission._tcp." + d, &dnsmessage.SRVResource{Priority: 0, Weight: 1, Port: 587, Target: name(".")}},
+		record{"_pop3._tcp." + d, &dnsmessage.SRVResource{Priority: 0, Weight: 1, Port: 110, Target: name(".")}},
+		record{"_pop3s._tcp." + d, &dnsmessage.SRVResource{Priority: 0, Weight: 1, Port: 995, Target: name(".")}},
+	)
+
+	var hostnames []string
+	for hn := range hosts {
+		hostnames = append(hostnames, hn)
+	}
+	sort.Strings(hostnames)
+	for _, hn := range hostnames {
+		if !z.contains(hn) {
+			continue
+		}
+		// For a host name equal to the domain, the domain SPF record already covers it,
+		// and two SPF records would be an error.
+		if hn != d {
+			// ../rfc/7208:2263 ../rfc/7208:2287
+			records = append(records, record{hn, txt("v=spf1 a -all")})
+		}
+		for _, ip := range hosts[hn].ips {
+			if ip4 := ip.To4(); ip4 != nil {
+				var a [4]byte
+				copy(a[:], ip4)
+				records = append(records, record{hn, &dnsmessage.AResource{A: a}})
+			} else {
+				var a [16]byte
+				copy(a[:], ip)
+				records = append(records, record{hn, &dnsmessage.AAAAResource{AAAA: a}})
+			}
+		}
+		for _, data := range hosts[hn].tlsa {
+			records = append(records, record{"_25._tcp." + hn, &dnsmessage.UnknownResource{Type: typeTLSA, Data: data}})
+		}
+	}
+
+	for _, r := range records {
+		if err := z.add(r.name, r.body); err != nil {
+			return nil, err
+		}
+	}
+	return z, nil
+}
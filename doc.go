@@ -19,14 +19,26 @@ low-maintenance self-hosted email.
 	mox setaccountpassword address
 	mox setadminpassword
 	mox loglevels [level [pkg]]
+	mox trace add [-account account] [-ip ip] duration
+	mox trace list
+	mox trace rm id
 	mox queue list
 	mox queue kick [-id id] [-todomain domain] [-recipient address] [-transport transport]
 	mox queue drop [-id id] [-todomain domain] [-recipient address]
 	mox queue dump id
+	mox messages find [-account account] [-mailbox mailbox] [-messageid message-id] [-msgfrom address|@domain] [-mailfrom address]
+	mox messages delete [-dryrun] [-account account] [-mailbox mailbox] [-messageid message-id] [-msgfrom address|@domain] [-mailfrom address]
+	mox messages move [-dryrun] [-account account] [-mailbox mailbox] [-messageid message-id] [-msgfrom address|@domain] [-mailfrom address] tomailbox
+	mox messages redeliver [-dryrun] [-account account] [-mailbox mailbox] [-messageid message-id] [-msgfrom address|@domain] [-mailfrom address]
+	mox messages transfer [-move] [-dryrun] -account account [-mailbox mailbox] [-messageid message-id] [-msgfrom address|@domain] [-mailfrom address] dstaccount [dstmailbox]
+	mox dbstats [account]
 	mox import maildir accountname mailboxname maildir
 	mox import mbox accountname mailboxname mbox
+	mox import archive accountname archive
 	mox export maildir dst-dir account-path [mailbox]
 	mox export mbox dst-dir account-path [mailbox]
+	mox export archive dst-file account-path
+	mox export verify archive
 	mox localserve
 	mox help [command ...]
 	mox backup dest-dir
@@ -38,6 +50,10 @@ low-maintenance self-hosted email.
 	mox config describe-static >mox.conf
 	mox config account add account address
 	mox config account rm account
+	mox config account suspend [-tempfail] account
+	mox config account unsuspend account
+	mox config account schedule-rm account days
+	mox config account cancel-rm account
 	mox config address add address account
 	mox config address rm address
 	mox config domain add domain account [localpart]
@@ -45,6 +61,7 @@ low-maintenance self-hosted email.
 	mox config describe-sendmail >/etc/moxsubmit.conf
 	mox config printservice >mox.service
 	mox example [name]
+	mox messagecatalog [language]
 	mox checkupdate
 	mox cid cid
 	mox clientconfig domain
@@ -61,6 +78,8 @@ low-maintenance self-hosted email.
 	mox dnsbl checkhealth zone
 	mox mtasts lookup domain
 	mox retrain accountname
+	mox textindex accountname
+	mox recalculatemailboxcounts accountname
 	mox sendmail [-Fname] [ignoredflags] [-t] [<message]
 	mox spf check domain ip
 	mox spf lookup domain
@@ -68,6 +87,7 @@ low-maintenance self-hosted email.
 	mox tlsrpt lookup domain
 	mox tlsrpt parsereportmsg message ...
 	mox version
+	mox webpush genkey >vapid.ecdsap256key.pkcs8.pem
 
 Many commands talk to a running mox instance, through the ctl file in the data
 directory. Specify the configuration file (that holds the path to the data
@@ -174,6 +194,44 @@ Valid labels: error, info, debug, trace, traceauth, tracedata.
 
 	usage: mox loglevels [level [pkg]]
 
+# mox trace add
+
+Write protocol transcripts of IMAP and SMTP connections of an account or remote IP.
+
+For debugging problems of a single user without raising the log level of all
+of mox. Exactly one of -account and -ip must be specified. Connections of an
+account are traced from the moment they authenticate. Connections from an IP
+are traced from the start.
+
+Each connection is written to its own file in the "traces" directory in the
+data directory, with timestamps. Credentials used for authentication are
+redacted, but transcripts can contain messages and other private data. The
+trace stops after the duration, e.g. 30m or 2h, at most 24h. Traces are not
+kept over a restart of mox.
+
+The ID of the new trace is printed.
+
+	usage: mox trace add [-account account] [-ip ip] duration
+	  -account string
+	    	account to trace connections of
+	  -ip string
+	    	remote ip to trace connections from
+
+# mox trace list
+
+List active protocol traces, with their ID.
+
+	usage: mox trace list
+
+# mox trace rm
+
+Stop a protocol trace.
+
+New connections are no longer traced. Transcripts of already traced connections
+are written until the original end of the trace.
+
+	usage: mox trace rm id
+
 # mox queue list
 
 List messages in the delivery queue.
@@ -196,6 +254,9 @@ With the -transport flag, future delivery attempts are done using the specified
 transport. Transports can be configured in mox.conf, e.g. to submit to a remote
 queue over SMTP.
 
+Messages held in the queue for moderation by a transport rule are released by
+kicking them.
+
 	usage: mox queue kick [-id id] [-todomain domain] [-recipient address] [-transport transport]
 	  -id int
 	    	id of message in queue
@@ -229,6 +290,168 @@ The message is printed to stdout and is in standard internet mail format.
 
 	usage: mox queue dump id
 
+# mox messages find
+
+List messages in mailboxes of all accounts matching the criteria.
+
+Messages are selected by Message-ID header, message From address or domain,
+and/or SMTP MAIL FROM address, and can be restricted to a single account and/or
+mailbox. At least one of -messageid, -msgfrom and -mailfrom is required. The
+Message-ID is only known for messages that were delivered with a version of mox
+that stores Message-IDs for all incoming messages.
+
+	usage: mox messages find [-account account] [-mailbox mailbox] [-messageid message-id] [-msgfrom address|@domain] [-mailfrom address]
+	  -account string
+	    	only messages in this account
+	  -mailbox string
+	    	only messages in this mailbox
+	  -mailfrom string
+	    	smtp mail from address
+	  -messageid string
+	    	message-id header of messages
+	  -msgfrom string
+	    	address in message from header, or domain when starting with @
+
+# mox messages delete
+
+Remove messages matching the criteria from mailboxes of all accounts.
+
+For example to remove a phishing message with a specific Message-ID that has
+been delivered to many accounts. Each removed message is logged. Run with
+-dryrun first to see which messages would be removed.
+
+Messages are selected by Message-ID header, message From address or domain,
+and/or SMTP MAIL FROM address, and can be restricted to a single account and/or
+mailbox. At least one of -messageid, -msgfrom and -mailfrom is required. The
+Message-ID is only known for messages that were delivered with a version of mox
+that stores Message-IDs for all incoming messages.
+
+	usage: mox messages delete [-dryrun] [-account account] [-mailbox mailbox] [-messageid message-id] [-msgfrom address|@domain] [-mailfrom address]
+	  -account string
+	    	only messages in this account
+	  -dryrun
+	    	only list messages that would be removed
+	  -mailbox string
+	    	only messages in this mailbox
+	  -mailfrom string
+	    	smtp mail from address
+	  -messageid string
+	    	message-id header of messages
+	  -msgfrom string
+	    	address in message from header, or domain when starting with @
+
+# mox messages move
+
+Move messages matching the criteria to another mailbox, in all accounts.
+
+The destination mailbox is created if it does not exist. Each moved message is
+logged.
+
+Messages are selected by Message-ID header, message From address or domain,
+and/or SMTP MAIL FROM address, and can be restricted to a single account and/or
+mailbox. At least one of -messageid, -msgfrom and -mailfrom is required. The
+Message-ID is only known for messages that were delivered with a version of mox
+that stores Message-IDs for all incoming messages.
+
+	usage: mox messages move [-dryrun] [-account account] [-mailbox mailbox] [-messageid message-id] [-msgfrom address|@domain] [-mailfrom address] tomailbox
+	  -account string
+	    	only messages in this account
+	  -dryrun
+	    	only list messages that would be moved
+	  -mailbox string
+	    	only messages in this mailbox
+	  -mailfrom string
+	    	smtp mail from address
+	  -messageid string
+	    	message-id header of messages
+	  -msgfrom string
+	    	address in message from header, or domain when starting with @
+
+# mox messages redeliver
+
+Move messages to the mailbox selected by the current delivery rulesets.
+
+The delivery rulesets of the recipient address the messages were delivered for
+are evaluated again, e.g. after adding a ruleset for a mailing list. Messages
+are moved to the resulting mailbox if it differs from their current mailbox.
+Messages without recipient address, or with a recipient address that is no
+longer configured for the account, are left in place. Each moved message is
+logged.
+
+Messages are selected by Message-ID header, message From address or domain,
+and/or SMTP MAIL FROM address, and can be restricted to a single account and/or
+mailbox. At least one of -messageid, -msgfrom and -mailfrom is required. The
+Message-ID is only known for messages that were delivered with a version of mox
+that stores Message-IDs for all incoming messages.
+
+	usage: mox messages redeliver [-dryrun] [-account account] [-mailbox mailbox] [-messageid message-id] [-msgfrom address|@domain] [-mailfrom address]
+	  -account string
+	    	only messages in this account
+	  -dryrun
+	    	only list messages that would be moved
+	  -mailbox string
+	    	only messages in this mailbox
+	  -mailfrom string
+	    	smtp mail from address
+	  -messageid string
+	    	message-id header of messages
+	  -msgfrom string
+	    	address in message from header, or domain when starting with @
+
+# mox messages transfer
+
+Copy or move messages to another account.
+
+Messages are copied from the account specified with -account, and can be
+selected by mailbox, and/or the criteria below. With only -mailbox, all
+messages in the mailbox are selected, e.g. to hand off mail of a departing
+user to a colleague. Messages are added to dstmailbox in the destination
+account, or to mailboxes with the same name as in the source account if
+dstmailbox is not specified. Mailboxes are created as needed. The received
+time, flags and keywords of messages are preserved. With -move, the messages are
+removed from the source account after they were added to the destination
+account. Each transferred message is logged.
+
+Messages are selected by Message-ID header, message From address or domain,
+and/or SMTP MAIL FROM address, and can be restricted to a single account and/or
+mailbox. At least one of -messageid, -msgfrom and -mailfrom is required. The
+Message-ID is only known for messages that were delivered with a version of mox
+that stores Message-IDs for all incoming messages.
+
+	usage: mox messages transfer [-move] [-dryrun] -account account [-mailbox mailbox] [-messageid message-id] [-msgfrom address|@domain] [-mailfrom address] dstaccount [dstmailbox]
+	  -account string
+	    	only messages in this account
+	  -dryrun
+	    	only list messages that would be transferred
+	  -mailbox string
+	    	only messages in this mailbox
+	  -mailfrom string
+	    	smtp mail from address
+	  -messageid string
+	    	message-id header of messages
+	  -move
+	    	remove messages from source account after copying
+	  -msgfrom string
+	    	address in message from header, or domain when starting with @
+
+# mox dbstats
+
+Print database usage statistics, for tuning indices and finding slow queries.
+
+Statistics are printed for transactions by the IMAP and SMTP servers, the queue
+and the account web interface, aggregated since startup. Included are the
+number of queries by query plan, e.g. full table scans or index scans, the
+operations on the underlying key/value store for records and indices, and how
+often each type and index was used for the last query in a transaction.
+Transactions taking longer than the configured SlowDBOperation are also logged
+while they happen.
+
+Lifetime statistics of the queue database are printed as well, and for the
+database of the account, if specified. Account databases are closed when no
+longer in use, which resets their statistics.
+
+	usage: mox dbstats [account]
+
 # mox import maildir
 
 Import a maildir into an account.
@@ -272,6 +495,19 @@ maildir directories/files.
 
 	usage: mox import mbox accountname mailboxname mbox
 
+# mox import archive
+
+Import an archival export into an account.
+
+The archive, as created with "mox export archive", is first verified, see "mox
+export verify". Only if it is intact are its mailboxes and messages added to the
+account. Mailboxes are created as needed, messages get new UIDs but keep their
+received time, flags and keywords. The junk filter is trained with the messages.
+
+The archive is read by the mox process, so make sure it has access to the file.
+
+	usage: mox import archive accountname archive
+
 # mox export maildir
 
 Export one or all mailboxes from an account in maildir format.
@@ -300,6 +536,44 @@ otherwise reconstructing the original could lose a ">".
 
 	usage: mox export mbox dst-dir account-path [mailbox]
 
+# mox export archive
+
+Export all mailboxes and messages of an account as archival export.
+
+An archival export is a tar file meant for long-term storage, e.g. for
+compliance, that can be read independent of mox versions. It contains these
+files, in order:
+
+  - mox-archive.txt, with "mox-archive 1", identifying the format and version.
+  - messages/<n>.eml, for n starting at 1, each a message as stored, with CRLF
+    line endings.
+  - manifest.json, with the mailboxes (name, uidvalidity, uidnext, special-use,
+    keywords, subscription) and for each message its file, size, SHA-256
+    checksum, mailbox, uid, received time, flags and keywords.
+  - SHA256SUMS, with the SHA-256 checksums of all files above, to be checked
+    with "sha256sum -c SHA256SUMS" after extracting.
+
+Use "mox export verify" to verify an archive, and "mox import archive" to
+import it into an account. If dst-file is "-", the archive is written to
+stdout.
+
+Export bypasses a running mox instance. It opens the account mailbox/message
+database file directly. This may block if a running mox instance also has the
+database open, e.g. for IMAP connections.
+
+	usage: mox export archive dst-file account-path
+
+# mox export verify
+
+Verify an archival export, as created by "mox export archive".
+
+The format version must be supported, all files must be present with the
+checksums from SHA256SUMS, and all messages from the manifest must be present
+with matching size and checksum. If the archive is intact, the number of
+mailboxes and messages is printed.
+
+	usage: mox export verify archive
+
 # mox localserve
 
 Start a local SMTP/IMAP server that accepts all messages, useful when testing/developing software that sends email.
@@ -475,6 +749,46 @@ these addresses will be rejected.
 
 	usage: mox config account rm account
 
+# mox config account suspend
+
+Suspend an account and reload the configuration.
+
+Authentication for the account is rejected for IMAP, SMTP submission and the
+web interfaces, and existing IMAP sessions are ended. Incoming email is still
+delivered, unless -tempfail is set, in which case it is rejected with a
+temporary error so remote mail servers retry later.
+
+	usage: mox config account suspend [-tempfail] account
+	  -tempfail
+	    	reject incoming email with a temporary error
+
+# mox config account unsuspend
+
+Remove the suspension of an account and reload the configuration.
+
+An account that is pending deletion remains suspended until its deletion is
+canceled.
+
+	usage: mox config account unsuspend account
+
+# mox config account schedule-rm
+
+Schedule removal of an account after a grace period of days.
+
+Until the removal, the account is treated as suspended. After the grace period,
+the account is removed from the configuration and its messages are removed from
+the data directory. The journal directory of the account is kept. Accounts on
+litigation hold are not removed. The removal can be canceled with "config
+account cancel-rm".
+
+	usage: mox config account schedule-rm account days
+
+# mox config account cancel-rm
+
+Cancel a scheduled removal of an account.
+
+	usage: mox config account cancel-rm account
+
 # mox config address add
 
 Adds an address to an account and reloads the configuration.
@@ -533,6 +847,19 @@ List available examples, or print a specific example.
 
 	usage: mox example [name]
 
+# mox messagecatalog
+
+Prints the keys and built-in texts of the message catalog.
+
+The texts are used in system-generated messages, such as DSNs, and can be
+overridden with files in the directory configured as MessageCatalog in
+mox.conf, one file per language and key, named <language>/<key>.txt. Texts
+contain placeholders like {recipient} that are replaced when used.
+
+Without language, the English texts are printed.
+
+	usage: mox messagecatalog [language]
+
 # mox checkupdate
 
 Check if a newer version of mox is available.
@@ -695,6 +1022,29 @@ implementation has changed.
 
 	usage: mox retrain accountname
 
+# mox textindex
+
+Add messages of the account to the full-text index.
+
+Messages delivered before FullTextIndex was enabled for the account are not in
+the index. Searches read those messages, which is slow. This command adds them
+to the index, after which searches only use the index. Messages already in the
+index are skipped.
+
+	usage: mox textindex accountname
+
+# mox recalculatemailboxcounts
+
+Recalculate the message counts of the mailboxes of an account.
+
+The number of messages, unseen and deleted messages, and their size, are kept
+for each mailbox, for quickly answering IMAP STATUS commands. They are updated
+when messages change. This command recalculates them by going through all
+messages, and fixes counts that are wrong, which should only be needed after a
+bug.
+
+	usage: mox recalculatemailboxcounts accountname
+
 # mox sendmail
 
 Sendmail is a drop-in replacement for /usr/sbin/sendmail to deliver emails sent by unix processes like cron.
@@ -775,6 +1125,14 @@ The report is printed in formatted JSON.
 Prints this mox version.
 
 	usage: mox version
+
+# mox webpush genkey
+
+Generate a new ECDSA P-256 private key for use with Web Push (VAPID).
+
+Configure the file as VAPIDPrivateKeyFile in the WebPush section of mox.conf.
+
+	usage: mox webpush genkey >vapid.ecdsap256key.pkcs8.pem
 */
 package main
 
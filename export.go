@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"fmt"
 	"log"
+	"os"
 	"path/filepath"
 	"time"
 
@@ -44,6 +47,90 @@ otherwise reconstructing the original could lose a ">".
 	xcmdExport(true, args, c)
 }
 
+func cmdExportArchive(c *cmd) {
+	c.params = "dst-file account-path"
+	c.help = `Export all mailboxes and messages of an account as archival export.
+
+An archival export is a tar file meant for long-term storage, e.g. for
+compliance, that can be read independent of mox versions. It contains these
+files, in order:
+
+- mox-archive.txt, with "mox-archive 1", identifying the format and version.
+- messages/<n>.eml, for n starting at 1, each a message as stored, with CRLF
+  line endings.
+- manifest.json, with the mailboxes (name, uidvalidity, uidnext, special-use,
+  keywords, subscription) and for each message its file, size, SHA-256
+  checksum, mailbox, uid, received time, flags and keywords.
+- SHA256SUMS, with the SHA-256 checksums of all files above, to be checked
+  with "sha256sum -c SHA256SUMS" after extracting.
+
+Use "mox export verify" to verify an archive, and "mox import archive" to
+import it into an account. If dst-file is "-", the archive is written to
+stdout.
+
+Export bypasses a running mox instance. It opens the account mailbox/message
+database file directly. This may block if a running mox instance also has the
+database open, e.g. for IMAP connections.
+`
+	args := c.Parse()
+	if len(args) != 2 {
+		c.Usage()
+	}
+	xcmdExportArchive(args[0], args[1])
+}
+
+func xcmdExportArchive(dst, accountDir string) {
+	dbpath := filepath.Join(accountDir, "index.db")
+	db, err := bstore.Open(context.Background(), dbpath, &bstore.Options{Timeout: 5 * time.Second, Perm: 0660}, store.DBTypes...)
+	xcheckf(err, "open database %q", dbpath)
+	defer func() {
+		if err := db.Close(); err != nil {
+			log.Printf("closing db after export: %v", err)
+		}
+	}()
+
+	var f *os.File
+	if dst == "-" {
+		f = os.Stdout
+	} else {
+		f, err = os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0660)
+		xcheckf(err, "create archive")
+	}
+	w := bufio.NewWriter(f)
+	err = store.ExportArchive(context.Background(), mlog.New("export"), db, accountDir, w)
+	xcheckf(err, "exporting archive")
+	err = w.Flush()
+	xcheckf(err, "flush archive")
+	if f != os.Stdout {
+		err = f.Sync()
+		xcheckf(err, "sync archive")
+		err = f.Close()
+		xcheckf(err, "close archive")
+	}
+}
+
+func cmdExportVerify(c *cmd) {
+	c.params = "archive"
+	c.help = `Verify an archival export, as created by "mox export archive".
+
+The format version must be supported, all files must be present with the
+checksums from SHA256SUMS, and all messages from the manifest must be present
+with matching size and checksum. If the archive is intact, the number of
+mailboxes and messages is printed.
+`
+	args := c.Parse()
+	if len(args) != 1 {
+		c.Usage()
+	}
+
+	f, err := os.Open(args[0])
+	xcheckf(err, "open archive")
+	defer f.Close()
+	manifest, err := store.VerifyArchive(bufio.NewReader(f))
+	xcheckf(err, "verifying archive")
+	fmt.Printf("archive ok, account %s, created %s, %d mailboxes, %d messages\n", manifest.Account, manifest.Created.Format(time.RFC3339), len(manifest.Mailboxes), len(manifest.Messages))
+}
+
 func xcmdExport(mbox bool, args []string, c *cmd) {
 	if len(args) != 2 && len(args) != 3 {
 		c.Usage()
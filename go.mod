@@ -9,10 +9,12 @@ require (
 	github.com/mjl-/sherpadoc v0.0.10
 	github.com/mjl-/sherpaprom v0.0.2
 	github.com/prometheus/client_golang v1.14.0
+	github.com/prometheus/client_model v0.3.0
 	go.etcd.io/bbolt v1.3.7
 	golang.org/x/crypto v0.10.0
 	golang.org/x/exp v0.0.0-20230626212559-97b1e661b5df
 	golang.org/x/net v0.11.0
+	golang.org/x/sys v0.9.0
 	golang.org/x/text v0.10.0
 )
 
@@ -22,11 +24,9 @@ require (
 	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
 	github.com/mjl-/xfmt v0.0.0-20190521151243-39d9c00752ce // indirect
-	github.com/prometheus/client_model v0.3.0 // indirect
 	github.com/prometheus/common v0.37.0 // indirect
 	github.com/prometheus/procfs v0.8.0 // indirect
 	golang.org/x/mod v0.11.0 // indirect
-	golang.org/x/sys v0.9.0 // indirect
 	golang.org/x/tools v0.6.0 // indirect
 	google.golang.org/protobuf v1.28.1 // indirect
 )
@@ -8,15 +8,18 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
 	_ "embed"
 
+	"github.com/mjl-/bstore"
 	"github.com/mjl-/sherpa"
 	"github.com/mjl-/sherpaprom"
 
@@ -26,6 +29,8 @@ import (
 	"github.com/mjl-/mox/mlog"
 	"github.com/mjl-/mox/mox-"
 	"github.com/mjl-/mox/moxvar"
+	"github.com/mjl-/mox/queue"
+	"github.com/mjl-/mox/smtp"
 	"github.com/mjl-/mox/store"
 )
 
@@ -59,11 +64,20 @@ type Account struct{}
 // check http basic auth, returns account name if valid, and writes http response
 // and returns empty string otherwise.
 func checkAccountAuth(ctx context.Context, log *mlog.Log, w http.ResponseWriter, r *http.Request) string {
+	accName, _ := checkBasicAuth(ctx, log, "httpaccount", "mox account - login with email address and password", w, r)
+	return accName
+}
+
+// checkBasicAuth checks http basic auth with the email address and password of an
+// account, with kind used in metrics. It returns the account name and the email
+// address used for logging in if valid, and writes an http response and returns
+// empty strings otherwise.
+func checkBasicAuth(ctx context.Context, log *mlog.Log, kind, realm string, w http.ResponseWriter, r *http.Request) (accName, address string) {
 	authResult := "error"
 	start := time.Now()
 	var addr *net.TCPAddr
 	defer func() {
-		metrics.AuthenticationInc("httpaccount", "httpbasic", authResult)
+		metrics.AuthenticationInc(kind, "httpbasic", authResult)
 		if authResult == "ok" && addr != nil {
 			mox.LimiterFailedAuth.Reset(addr.IP, start)
 		}
@@ -78,9 +92,9 @@ func checkAccountAuth(ctx context.Context, log *mlog.Log, w http.ResponseWriter,
 		remoteIP = addr.IP
 	}
 	if remoteIP != nil && !mox.LimiterFailedAuth.Add(remoteIP, start, 1) {
-		metrics.AuthenticationRatelimitedInc("httpaccount")
+		metrics.AuthenticationRatelimitedInc(kind)
 		http.Error(w, "429 - too many auth attempts", http.StatusTooManyRequests)
-		return ""
+		return "", ""
 	}
 
 	// store.OpenEmailAuth has an auth cache, so we don't bcrypt for every auth attempt.
@@ -93,6 +107,9 @@ func checkAccountAuth(ctx context.Context, log *mlog.Log, w http.ResponseWriter,
 		if errors.Is(err, store.ErrUnknownCredentials) {
 			authResult = "badcreds"
 			log.Info("failed authentication attempt", mlog.Field("username", t[0]), mlog.Field("remote", remoteIP))
+		} else if errors.Is(err, store.ErrAccountSuspended) {
+			authResult = "suspended"
+			log.Info("authentication for suspended account", mlog.Field("username", t[0]), mlog.Field("remote", remoteIP))
 		}
 		log.Errorx("open account", err)
 	} else {
@@ -100,12 +117,12 @@ func checkAccountAuth(ctx context.Context, log *mlog.Log, w http.ResponseWriter,
 		accName := acc.Name
 		err := acc.Close()
 		log.Check(err, "closing account")
-		return accName
+		return accName, t[0]
 	}
 	// note: browsers don't display the realm to prevent users getting confused by malicious realm messages.
-	w.Header().Set("WWW-Authenticate", `Basic realm="mox account - login with email address and password"`)
-	http.Error(w, "http 401 - unauthorized - mox account - login with email address and password", http.StatusUnauthorized)
-	return ""
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm=%q`, realm))
+	http.Error(w, "http 401 - unauthorized - "+realm, http.StatusUnauthorized)
+	return "", ""
 }
 
 func accountHandle(w http.ResponseWriter, r *http.Request) {
@@ -167,9 +184,18 @@ func accountHandle(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 		}
+	} else if r.URL.Path == "/push-sw.js" {
+		pushServiceWorkerHandle(w, r)
+		return
 	}
 
-	accName := checkAccountAuth(ctx, log, w, r)
+	accName, handled := impersonateHandle(ctx, log, w, r)
+	if handled {
+		return
+	}
+	if accName == "" {
+		accName = checkAccountAuth(ctx, log, w, r)
+	}
 	if accName == "" {
 		// Response already sent.
 		return
@@ -283,6 +309,14 @@ func accountHandle(w http.ResponseWriter, r *http.Request) {
 		_ = json.NewEncoder(w).Encode(map[string]string{"ImportToken": token})
 
 	default:
+		if strings.HasPrefix(r.URL.Path, "/messages/") || r.URL.Path == "/messages-export.zip" {
+			accountMessageHandle(ctx, log, w, r, accName)
+			return
+		}
+		if r.URL.Path == "/imageproxy" {
+			imageProxyHandle(ctx, log, w, r)
+			return
+		}
 		if strings.HasPrefix(r.URL.Path, "/api/") {
 			accountSherpaHandler.ServeHTTP(w, r.WithContext(context.WithValue(ctx, authCtxKey, accName)))
 			return
@@ -346,11 +380,420 @@ func (Account) DestinationSave(ctx context.Context, destName string, oldDest, ne
 	// Keep fields we manage.
 	newDest.DMARCReports = curDest.DMARCReports
 	newDest.TLSReports = curDest.TLSReports
+	newDest.Moderators = curDest.Moderators
 
 	err := mox.DestinationSave(ctx, accountName, destName, newDest)
 	xcheckf(ctx, err, "saving destination")
 }
 
+// SweepRules returns the scheduled rules for moving or removing older messages
+// from mailboxes.
+func (Account) SweepRules(ctx context.Context) []config.SweepRule {
+	accountName := ctx.Value(authCtxKey).(string)
+	accConf, ok := mox.Conf.Account(accountName)
+	if !ok {
+		xcheckf(ctx, errors.New("not found"), "looking up account")
+	}
+	return accConf.SweepRules
+}
+
+// SweepRulesSave replaces the sweep rules of the account. Rules are applied
+// nightly.
+func (Account) SweepRulesSave(ctx context.Context, rules []config.SweepRule) {
+	accountName := ctx.Value(authCtxKey).(string)
+	err := mox.AccountSweepRulesSave(ctx, accountName, rules)
+	xcheckf(ctx, err, "saving sweep rules")
+}
+
+// SendDelegates returns the names of the accounts that may send messages as this
+// account.
+func (Account) SendDelegates(ctx context.Context) []string {
+	accountName := ctx.Value(authCtxKey).(string)
+	accConf, ok := mox.Conf.Account(accountName)
+	if !ok {
+		xcheckf(ctx, errors.New("not found"), "looking up account")
+	}
+	return accConf.SendDelegates
+}
+
+// SendDelegateAdd allows another account to send messages as this account. The
+// delegate is specified by account name or by one of its email addresses.
+func (Account) SendDelegateAdd(ctx context.Context, delegate string) {
+	accountName := ctx.Value(authCtxKey).(string)
+	accConf, ok := mox.Conf.Account(accountName)
+	if !ok {
+		xcheckf(ctx, errors.New("not found"), "looking up account")
+	}
+
+	name := delegate
+	if _, ok := mox.Conf.Account(name); !ok {
+		addr, err := smtp.ParseAddress(delegate)
+		if err != nil {
+			panic(&sherpa.Error{Code: "user:error", Message: "unknown account or address"})
+		}
+		name, _, _, err = mox.FindAccount(addr.Localpart, addr.Domain, false)
+		if err != nil {
+			panic(&sherpa.Error{Code: "user:error", Message: "unknown account or address"})
+		}
+	}
+	if name == accountName {
+		panic(&sherpa.Error{Code: "user:error", Message: "cannot delegate to own account"})
+	}
+	for _, s := range accConf.SendDelegates {
+		if s == name {
+			panic(&sherpa.Error{Code: "user:error", Message: "account is already a delegate"})
+		}
+	}
+
+	delegates := append(append([]string{}, accConf.SendDelegates...), name)
+	err := mox.AccountSendDelegatesSave(ctx, accountName, delegates)
+	xcheckf(ctx, err, "saving send delegates")
+}
+
+// SendDelegateRemove removes an account from the accounts that may send messages
+// as this account.
+func (Account) SendDelegateRemove(ctx context.Context, delegate string) {
+	accountName := ctx.Value(authCtxKey).(string)
+	accConf, ok := mox.Conf.Account(accountName)
+	if !ok {
+		xcheckf(ctx, errors.New("not found"), "looking up account")
+	}
+	var delegates []string
+	for _, s := range accConf.SendDelegates {
+		if s != delegate {
+			delegates = append(delegates, s)
+		}
+	}
+	if len(delegates) == len(accConf.SendDelegates) {
+		panic(&sherpa.Error{Code: "user:error", Message: "account is not a delegate"})
+	}
+	err := mox.AccountSendDelegatesSave(ctx, accountName, delegates)
+	xcheckf(ctx, err, "saving send delegates")
+}
+
+// SendAs is an account that allows this account to send messages as it, with
+// its addresses.
+type SendAs struct {
+	Account   string
+	Addresses []string
+}
+
+// SendAs returns the accounts, and their addresses, that this account may send
+// messages as, i.e. the accounts that have this account as delegate.
+func (Account) SendAs(ctx context.Context) []SendAs {
+	accountName := ctx.Value(authCtxKey).(string)
+	var l []SendAs
+	for _, name := range mox.Conf.Accounts() {
+		accConf, ok := mox.Conf.Account(name)
+		if !ok {
+			continue
+		}
+		var delegate bool
+		for _, s := range accConf.SendDelegates {
+			delegate = delegate || s == accountName
+		}
+		if !delegate {
+			continue
+		}
+		sa := SendAs{Account: name, Addresses: []string{}}
+		for addr := range accConf.Destinations {
+			// Catchall destinations are not addresses that can be used.
+			if !strings.HasPrefix(addr, "@") {
+				sa.Addresses = append(sa.Addresses, addr)
+			}
+		}
+		sort.Strings(sa.Addresses)
+		l = append(l, sa)
+	}
+	return l
+}
+
+// Notices returns the texts of configured notices to show at the top of the
+// account web interface, e.g. about maintenance windows.
+func (Account) Notices(ctx context.Context) []string {
+	accountName := ctx.Value(authCtxKey).(string)
+	listener := requestListener(ctx)
+	l := append(mox.Notices("web", listener, ""), mox.Notices("web", listener, accountName)...)
+	if l == nil {
+		l = []string{}
+	}
+	return l
+}
+
+// Settings returns the preferences of the account for the web interface.
+func (Account) Settings(ctx context.Context) store.Settings {
+	accountName := ctx.Value(authCtxKey).(string)
+	acc, err := store.OpenAccount(accountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		xlog.Check(err, "closing account")
+	}()
+	settings, err := acc.Settings(ctx)
+	xcheckf(ctx, err, "get settings")
+	return settings
+}
+
+// SettingsSave stores the preferences of the account for the web interface.
+func (Account) SettingsSave(ctx context.Context, settings store.Settings) {
+	accountName := ctx.Value(authCtxKey).(string)
+	acc, err := store.OpenAccount(accountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		xlog.Check(err, "closing account")
+	}()
+	err = acc.SettingsSave(ctx, settings)
+	xcheckf(ctx, err, "saving settings")
+}
+
+// Correspondents returns the addresses the account has sent messages to or that
+// were added manually. Messages from correspondents are less likely to be
+// treated as junk.
+func (Account) Correspondents(ctx context.Context) []store.Correspondent {
+	accountName := ctx.Value(authCtxKey).(string)
+	acc, err := store.OpenAccount(accountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		xlog.Check(err, "closing account")
+	}()
+	l, err := acc.Correspondents(ctx)
+	xcheckf(ctx, err, "listing correspondents")
+	return l
+}
+
+// CorrespondentAdd adds an address as correspondent.
+func (Account) CorrespondentAdd(ctx context.Context, address string) store.Correspondent {
+	accountName := ctx.Value(authCtxKey).(string)
+	acc, err := store.OpenAccount(accountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		xlog.Check(err, "closing account")
+	}()
+	c, err := acc.CorrespondentAdd(ctx, address)
+	if errors.Is(err, store.ErrCorrespondentExists) || errors.Is(err, smtp.ErrBadAddress) {
+		panic(&sherpa.Error{Code: "user:error", Message: err.Error()})
+	}
+	xcheckf(ctx, err, "adding correspondent")
+	return c
+}
+
+// CorrespondentRemove removes a correspondent. The address is added again when a
+// message is sent to it.
+func (Account) CorrespondentRemove(ctx context.Context, id int64) {
+	accountName := ctx.Value(authCtxKey).(string)
+	acc, err := store.OpenAccount(accountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		xlog.Check(err, "closing account")
+	}()
+	err = acc.CorrespondentRemove(ctx, id)
+	xcheckf(ctx, err, "removing correspondent")
+}
+
+// BlockedSenders returns the addresses and domains from which incoming messages
+// are filed into the Junk mailbox or not delivered at all.
+func (Account) BlockedSenders(ctx context.Context) []store.BlockedSender {
+	accountName := ctx.Value(authCtxKey).(string)
+	acc, err := store.OpenAccount(accountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		xlog.Check(err, "closing account")
+	}()
+	l, err := acc.BlockedSenders(ctx)
+	xcheckf(ctx, err, "listing blocked senders")
+	return l
+}
+
+// BlockedSenderAdd blocks messages from an address, or from all addresses of a
+// domain if address starts with "@". Action is "junk" to file messages into the
+// Junk mailbox, or "delete" to not deliver them.
+func (Account) BlockedSenderAdd(ctx context.Context, address, action string) store.BlockedSender {
+	accountName := ctx.Value(authCtxKey).(string)
+	acc, err := store.OpenAccount(accountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		xlog.Check(err, "closing account")
+	}()
+	bs, err := acc.BlockedSenderAdd(ctx, address, action)
+	if errors.Is(err, store.ErrBlockedSenderInvalid) || errors.Is(err, store.ErrBlockedSenderExists) {
+		panic(&sherpa.Error{Code: "user:error", Message: err.Error()})
+	}
+	xcheckf(ctx, err, "blocking sender")
+	return bs
+}
+
+// BlockedSenderRemove removes a blocked sender.
+func (Account) BlockedSenderRemove(ctx context.Context, id int64) {
+	accountName := ctx.Value(authCtxKey).(string)
+	acc, err := store.OpenAccount(accountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		xlog.Check(err, "closing account")
+	}()
+	err = acc.BlockedSenderRemove(ctx, id)
+	xcheckf(ctx, err, "removing blocked sender")
+}
+
+// MutedThreads returns the muted threads. New messages in a muted thread are
+// marked as read and filed into the Archive mailbox instead of the Inbox, without
+// notifications.
+func (Account) MutedThreads(ctx context.Context) []store.MutedThread {
+	accountName := ctx.Value(authCtxKey).(string)
+	acc, err := store.OpenAccount(accountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		xlog.Check(err, "closing account")
+	}()
+	l, err := acc.MutedThreads(ctx)
+	xcheckf(ctx, err, "listing muted threads")
+	return l
+}
+
+// ThreadMute mutes the thread of the message with the message-id.
+func (Account) ThreadMute(ctx context.Context, messageID string) store.MutedThread {
+	accountName := ctx.Value(authCtxKey).(string)
+	acc, err := store.OpenAccount(accountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		xlog.Check(err, "closing account")
+	}()
+	mt, err := acc.ThreadMute(ctx, xlog.WithContext(ctx), messageID)
+	if errors.Is(err, bstore.ErrAbsent) || errors.Is(err, store.ErrThreadMuted) {
+		panic(&sherpa.Error{Code: "user:error", Message: err.Error()})
+	}
+	xcheckf(ctx, err, "muting thread")
+	return mt
+}
+
+// ThreadUnmute unmutes a muted thread.
+func (Account) ThreadUnmute(ctx context.Context, id int64) {
+	accountName := ctx.Value(authCtxKey).(string)
+	acc, err := store.OpenAccount(accountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		xlog.Check(err, "closing account")
+	}()
+	err = acc.ThreadUnmute(ctx, id)
+	xcheckf(ctx, err, "unmuting thread")
+}
+
+// Mailboxes returns the mailboxes of the account, with their special-use
+// attributes.
+func (Account) Mailboxes(ctx context.Context) []store.Mailbox {
+	accountName := ctx.Value(authCtxKey).(string)
+	acc, err := store.OpenAccount(accountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		xlog.Check(err, "closing account")
+	}()
+	var l []store.Mailbox
+	err = store.DBRead(ctx, xlog.WithContext(ctx), "http", acc.DB, func(tx *bstore.Tx) error {
+		var err error
+		l, err = bstore.QueryTx[store.Mailbox](tx).SortAsc("Name").List()
+		return err
+	})
+	xcheckf(ctx, err, "listing mailboxes")
+	return l
+}
+
+// MailboxSpecialUseSave sets the special-use attributes of a mailbox, e.g. to
+// designate the mailbox for junk or sent messages. The attributes that are set
+// are removed from other mailboxes. Delivery rules with a special-use attribute
+// as mailbox, like \Junk, deliver to the designated mailbox.
+func (Account) MailboxSpecialUseSave(ctx context.Context, mailbox string, specialUse store.SpecialUse) {
+	accountName := ctx.Value(authCtxKey).(string)
+	acc, err := store.OpenAccount(accountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		xlog.Check(err, "closing account")
+	}()
+	err = acc.SpecialUseSave(ctx, mailbox, specialUse)
+	if errors.Is(err, store.ErrUnknownMailbox) {
+		panic(&sherpa.Error{Code: "user:notFound", Message: err.Error()})
+	}
+	xcheckf(ctx, err, "saving special-use of mailbox")
+}
+
+// ModerationPending returns the incoming messages held for addresses that this
+// account moderates.
+func (Account) ModerationPending(ctx context.Context) []store.ModerationMessage {
+	accountName := ctx.Value(authCtxKey).(string)
+	l, err := store.ModerationPending(ctx, xlog.WithContext(ctx), accountName)
+	xcheckf(ctx, err, "listing messages pending moderation")
+	return l
+}
+
+// ModerationDecide approves or rejects a message held for moderation. An approved
+// message is delivered to the mailbox of the moderated address, a rejected
+// message is removed.
+func (Account) ModerationDecide(ctx context.Context, account string, msgID int64, approve bool) {
+	accountName := ctx.Value(authCtxKey).(string)
+	err := store.ModerationDecide(ctx, xlog.WithContext(ctx), accountName, account, msgID, approve)
+	if errors.Is(err, store.ErrModerationUnknown) || errors.Is(err, store.ErrModerationNotAllowed) || errors.Is(err, store.ErrHold) {
+		panic(&sherpa.Error{Code: "user:error", Message: err.Error()})
+	}
+	xcheckf(ctx, err, "moderating message")
+}
+
+// DeliveryStatus is information about recent deliveries of messages of an
+// account, for troubleshooting.
+type DeliveryStatus struct {
+	Queued     []QueuedMessage   // Outgoing messages still in the queue.
+	Deliveries []queue.Delivery  // Results of recent delivery attempts of outgoing messages, most recent first.
+	Rejections []store.Rejection // Recently rejected incoming messages, most recent first.
+}
+
+// QueuedMessage is an outgoing message of the account that is in the queue.
+type QueuedMessage struct {
+	ID          int64
+	Queued      time.Time
+	Recipient   string
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+	Hold        bool // Held by a transport rule until an administrator releases it.
+}
+
+// DeliveryStatus returns the outgoing messages in the queue, recent delivery
+// attempts for sent messages, and recently rejected incoming messages.
+func (Account) DeliveryStatus(ctx context.Context) DeliveryStatus {
+	accountName := ctx.Value(authCtxKey).(string)
+
+	var ds DeliveryStatus
+	msgs, err := queue.List(ctx)
+	xcheckf(ctx, err, "listing queue")
+	for _, m := range msgs {
+		if m.SenderAccount != accountName {
+			continue
+		}
+		ds.Queued = append(ds.Queued, QueuedMessage{m.ID, m.Queued, m.Recipient().String(), m.Attempts, m.NextAttempt, m.LastError, m.Hold})
+	}
+	ds.Deliveries, err = queue.DeliveryList(ctx, accountName)
+	xcheckf(ctx, err, "listing delivery attempts")
+
+	acc, err := store.OpenAccount(accountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		xlog.Check(err, "closing account")
+	}()
+	ds.Rejections, err = acc.Rejections(ctx)
+	xcheckf(ctx, err, "listing rejections")
+	return ds
+}
+
 // ImportAbort aborts an import that is in progress. If the import exists and isn't
 // finished, no changes will have been made by the import.
 func (Account) ImportAbort(ctx context.Context, importToken string) error {
@@ -358,3 +801,97 @@ func (Account) ImportAbort(ctx context.Context, importToken string) error {
 	importers.Abort <- req
 	return <-req.Response
 }
+
+// StorageUsage is the storage used by an account, with breakdowns by mailbox and
+// largest messages, and suggestions for freeing up storage.
+type StorageUsage struct {
+	Messages        int
+	Size            int64
+	Mailboxes       []store.MailboxUsage
+	LargestMessages []LargeMessage
+	Suggestions     []store.CleanupSuggestion
+}
+
+// LargeMessage is a message in the list of largest messages of an account.
+type LargeMessage struct {
+	ID       int64
+	Mailbox  string
+	Received time.Time
+	Size     int64
+	From     string
+	Subject  string
+}
+
+// Storage returns the storage used by the account.
+func (Account) Storage(ctx context.Context) (usage StorageUsage) {
+	accountName := ctx.Value(authCtxKey).(string)
+	acc, err := store.OpenAccount(accountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		xlog.Check(err, "closing account")
+	}()
+
+	acc.WithRLock(func() {
+		err = store.DBRead(ctx, xlog.WithContext(ctx), "http", acc.DB, func(tx *bstore.Tx) error {
+			var err error
+			usage.Mailboxes, err = acc.MailboxUsages(tx)
+			if err != nil {
+				return err
+			}
+			mailboxNames := map[int64]string{}
+			err = bstore.QueryTx[store.Mailbox](tx).ForEach(func(mb store.Mailbox) error {
+				mailboxNames[mb.ID] = mb.Name
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("listing mailboxes: %w", err)
+			}
+			largest, err := acc.LargestMessages(tx, 20)
+			if err != nil {
+				return err
+			}
+			for _, m := range largest {
+				lm := LargeMessage{ID: m.ID, Mailbox: mailboxNames[m.MailboxID], Received: m.Received, Size: m.Size}
+				if m.MsgFromDomain != "" {
+					lm.From = m.MsgFromLocalpart.String() + "@" + m.MsgFromDomain
+				}
+				mr := acc.MessageReader(m)
+				if p, err := m.LoadPart(mr); err == nil && p.Envelope != nil {
+					lm.Subject = p.Envelope.Subject
+				}
+				err = mr.Close()
+				xlog.Check(err, "closing message reader")
+				usage.LargestMessages = append(usage.LargestMessages, lm)
+			}
+			usage.Suggestions, err = acc.CleanupSuggestions(tx, time.Now())
+			return err
+		})
+	})
+	xcheckf(ctx, err, "gathering storage usage")
+	for _, mu := range usage.Mailboxes {
+		usage.Messages += mu.Messages
+		usage.Size += mu.Size
+	}
+	return
+}
+
+// CleanupApply removes the messages matching a suggestion from Storage, i.e. all
+// messages in the mailbox received before the time and with at least the minimum
+// size. The number of removed messages and their total size is returned.
+func (Account) CleanupApply(ctx context.Context, suggestion store.CleanupSuggestion) (removed int, size int64) {
+	accountName := ctx.Value(authCtxKey).(string)
+	acc, err := store.OpenAccount(accountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		xlog.Check(err, "closing account")
+	}()
+
+	log := xlog.WithContext(ctx)
+	acc.WithWLock(func() {
+		removed, size, err = acc.RemoveMessagesBefore(log, suggestion.Mailbox, suggestion.Before, suggestion.MinSize)
+	})
+	xcheckf(ctx, err, "removing messages")
+	return
+}
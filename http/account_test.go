@@ -7,6 +7,7 @@ import (
 	"compress/gzip"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
@@ -17,11 +18,14 @@ import (
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/mjl-/bstore"
 
+	"github.com/mjl-/mox/config"
 	"github.com/mjl-/mox/mlog"
 	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/queue"
 	"github.com/mjl-/mox/store"
 )
 
@@ -74,6 +78,47 @@ func TestAccount(t *testing.T) {
 	_, dests := Account{}.Destinations(authCtx)
 	Account{}.DestinationSave(authCtx, "mjl@mox.example", dests["mjl@mox.example"], dests["mjl@mox.example"]) // todo: save modified value and compare it afterwards
 
+	rules := []config.SweepRule{{Mailbox: "Newsletters", OlderThanDays: 30, MoveTo: "Archive"}}
+	Account{}.SweepRulesSave(authCtx, rules)
+	if l := (Account{}).SweepRules(authCtx); len(l) != 1 || l[0] != rules[0] {
+		t.Fatalf("got sweep rules %v, expected %v", l, rules)
+	}
+	Account{}.SweepRulesSave(authCtx, nil)
+
+	// Delegation of sending to another account, by address or account name.
+	assistantCtx := context.WithValue(ctxbg, authCtxKey, "assistant")
+	Account{}.SendDelegateAdd(authCtx, "assistant@mox.example")
+	if l := (Account{}).SendDelegates(authCtx); len(l) != 1 || l[0] != "assistant" {
+		t.Fatalf("got send delegates %v, expected assistant", l)
+	}
+	if l := (Account{}).SendAs(assistantCtx); len(l) != 1 || l[0].Account != "mjl" || strings.Join(l[0].Addresses, ",") != "mjl@mox.example,other@mox.example" {
+		t.Fatalf("got send as %v, expected mjl with its addresses", l)
+	}
+	if l := (Account{}).SendAs(authCtx); len(l) != 0 {
+		t.Fatalf("got send as %v, expected none", l)
+	}
+	Account{}.SendDelegateRemove(authCtx, "assistant")
+	if l := (Account{}).SendDelegates(authCtx); len(l) != 0 {
+		t.Fatalf("got send delegates %v, expected none", l)
+	}
+
+	if settings := (Account{}).Settings(authCtx); settings.LoadRemoteContent {
+		t.Fatalf("remote content enabled by default")
+	}
+	Account{}.SettingsSave(authCtx, store.Settings{LoadRemoteContent: true})
+	if settings := (Account{}).Settings(authCtx); !settings.LoadRemoteContent {
+		t.Fatalf("settings not saved")
+	}
+
+	err = queue.Init()
+	tcheck(t, err, "queue init")
+	defer queue.Shutdown()
+	err = acc.RejectionAdd(ctxbg, &store.Rejection{MailFrom: "remote@example.org", RcptTo: "mjl@mox.example", Reason: "junk", Error: "rejected"})
+	tcheck(t, err, "add rejection")
+	if ds := (Account{}).DeliveryStatus(authCtx); len(ds.Queued) != 0 || len(ds.Deliveries) != 0 || len(ds.Rejections) != 1 || ds.Rejections[0].Reason != "junk" {
+		t.Fatalf("got delivery status %v, expected a single rejection", ds)
+	}
+
 	go importManage()
 
 	// Import mbox/maildir tgz/zip.
@@ -170,6 +215,11 @@ func TestAccount(t *testing.T) {
 		return nil
 	})
 
+	usage := Account{}.Storage(authCtx)
+	if usage.Messages != 4 || usage.Size == 0 || len(usage.LargestMessages) != 4 {
+		t.Fatalf("got storage usage %v, expected 4 messages", usage)
+	}
+
 	testExport := func(httppath string, iszip bool, expectFiles int) {
 		t.Helper()
 
@@ -216,4 +266,101 @@ func TestAccount(t *testing.T) {
 	testExport("/mail-export-maildir.zip", true, 6)
 	testExport("/mail-export-mbox.tgz", false, 2)
 	testExport("/mail-export-mbox.zip", true, 2)
+
+	// Per-message export and printing.
+	testMessage := func(httppath string, expCode int, expContentType string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest("GET", httppath, nil)
+		r.Header.Add("Authorization", authOK)
+		w := httptest.NewRecorder()
+		accountHandle(w, r)
+		if w.Code != expCode {
+			t.Fatalf("%s, got status code %d, expected %d: %s", httppath, w.Code, expCode, w.Body.Bytes())
+		}
+		if ct := w.Header().Get("Content-Type"); expContentType != "" && ct != expContentType {
+			t.Fatalf("%s, got content-type %q, expected %q", httppath, ct, expContentType)
+		}
+		return w
+	}
+	lm := usage.LargestMessages[0]
+	msgPath := fmt.Sprintf("/messages/%d", lm.ID)
+	w := testMessage(msgPath+".eml", http.StatusOK, "message/rfc822")
+	if int64(w.Body.Len()) != lm.Size {
+		t.Fatalf("eml export has size %d, expected %d", w.Body.Len(), lm.Size)
+	}
+	w = testMessage(msgPath+"/print", http.StatusOK, "text/html; charset=utf-8")
+	if !strings.Contains(w.Body.String(), "<pre>") {
+		t.Fatalf("print page without text: %s", w.Body.String())
+	}
+	testMessage(msgPath+".pdf", http.StatusNotImplemented, "")
+	PDFRender = testPDFRenderer{}
+	w = testMessage(msgPath+".pdf", http.StatusOK, "application/pdf")
+	PDFRender = nil
+	if !strings.HasPrefix(w.Body.String(), "%PDF") {
+		t.Fatalf("pdf export does not start with pdf marker")
+	}
+	testMessage(msgPath+"/html", http.StatusNotFound, "") // Plain text only.
+	testMessage("/messages/999999.eml", http.StatusNotFound, "")
+	testMessage("/messages/bogus.eml", http.StatusNotFound, "")
+	testMessage("/messages-export.zip", http.StatusBadRequest, "")
+	exportPath := fmt.Sprintf("/messages-export.zip?id=%d&id=%d", usage.LargestMessages[0].ID, usage.LargestMessages[1].ID)
+	testExport(exportPath, true, 2)
+
+	removed, size := Account{}.CleanupApply(authCtx, store.CleanupSuggestion{Mailbox: "importtest", Before: time.Now().Add(time.Minute)})
+	if removed != 2 || size == 0 {
+		t.Fatalf("cleanup removed %d messages with size %d, expected 2 messages", removed, size)
+	}
+	usage = Account{}.Storage(authCtx)
+	if usage.Messages != 2 {
+		t.Fatalf("got %d messages after cleanup, expected 2", usage.Messages)
+	}
+
+	// Impersonation by admin, with notification delivered to the account.
+	impURL := Admin{}.ImpersonateStart(ctxbg, "mjl", "testing", true)
+	if !strings.HasPrefix(impURL, "/impersonate?token=") {
+		t.Fatalf("got impersonation url %q", impURL)
+	}
+	usage = Account{}.Storage(authCtx)
+	if usage.Messages != 3 {
+		t.Fatalf("got %d messages after impersonation notification, expected 3", usage.Messages)
+	}
+
+	testImpersonate := func(method, httppath string, cookies []*http.Cookie, expCode int) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(method, httppath, strings.NewReader(`{"params": []}`))
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		accountHandle(w, r)
+		if w.Code != expCode {
+			t.Fatalf("%s %s, got status code %d, expected %d: %s", method, httppath, w.Code, expCode, w.Body.Bytes())
+		}
+		return w
+	}
+	testImpersonate("GET", "/impersonate?token=bogus", nil, http.StatusBadRequest)
+	cookies := testImpersonate("GET", impURL, nil, http.StatusSeeOther).Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != impersonateCookie || cookies[0].Path != "/" || !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteStrictMode {
+		t.Fatalf("got cookies %v, expected impersonation cookie", cookies)
+	}
+	testImpersonate("GET", "/", nil, http.StatusUnauthorized)
+	testImpersonate("GET", "/", cookies, http.StatusOK)
+	testImpersonate("POST", "/api/Storage", cookies, http.StatusOK)
+	testImpersonate("POST", "/api/SetPassword", cookies, http.StatusForbidden)
+	testImpersonate("GET", "/mail-export-mbox.zip", cookies, http.StatusForbidden)
+	testImpersonate("GET", msgPath+".eml", cookies, http.StatusForbidden)
+
+	// An unknown token clears the cookie, at the same path it was set.
+	bogus := []*http.Cookie{{Name: impersonateCookie, Value: "bogus"}}
+	cleared := testImpersonate("GET", "/", bogus, http.StatusUnauthorized).Result().Cookies()
+	if len(cleared) != 1 || cleared[0].Name != impersonateCookie || cleared[0].MaxAge >= 0 || cleared[0].Path != "/" {
+		t.Fatalf("got cookies %v, expected cleared impersonation cookie", cleared)
+	}
+}
+
+type testPDFRenderer struct{}
+
+func (testPDFRenderer) RenderPDF(ctx context.Context, html []byte, w io.Writer) error {
+	_, err := fmt.Fprintf(w, "%%PDF-1.4\n%d bytes of html\n", len(html))
+	return err
 }
@@ -0,0 +1,296 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mjl-/bstore"
+	"github.com/mjl-/sherpa"
+
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/store"
+)
+
+// Compose is a template for a reply to, or forward of, a message, so email
+// clients using the account API compose well-formed messages. The text is
+// quoted with an attribution line for replies, the threading headers are set,
+// and for messages with an HTML part, an HTML version with inline images is
+// included.
+//
+// Send the text, after editing, with TextFlowed as text/plain part with
+// Content-Type parameters format=flowed and delsp=no. With HTML, send a
+// multipart/alternative with the text and a multipart/related part with the
+// HTML and Inline parts, and use TextFromHTML for the text when only the HTML
+// was edited.
+type Compose struct {
+	Subject    string
+	To         []string // Addresses, possibly with display name, e.g. "Mox <mox@example.org>".
+	Cc         []string
+	InReplyTo  string   // Message-ID with <>, for the In-Reply-To header. Empty for forwards.
+	References []string // Message-IDs with <>, for the References header. Empty for forwards.
+	Text       string   // Plain text body, with lines ending in a newline, not wrapped.
+	HTML       string   // Sanitized HTML body, if the original message has an HTML part.
+
+	// Parts of the original message that HTML references with cid: URLs, e.g. inline
+	// images.
+	Inline []ComposeInline
+
+	// Maximum size in bytes of a message the account can submit, for refusing
+	// attachments before sending. Zero means no limit beyond that of the submission
+	// listener.
+	MessageSizeLimit int64
+}
+
+// ComposeInline is an inline part, e.g. an image, of the original message
+// referenced by the HTML of a Compose.
+type ComposeInline struct {
+	ContentID string // Without <>.
+	MediaType string // Lower case, e.g. "image/png".
+	Name      string // File name, if any.
+	Data      []byte // Decoded content.
+}
+
+// MessageCompose returns a template for a new message in reply to a message of
+// the account, or forwarding it. Mode is "reply" for a reply to the sender,
+// "replyall" for a reply that includes the other recipients, or "forward".
+// Attachments of the original message are not included in forwards, clients can
+// attach the original message instead.
+func (Account) MessageCompose(ctx context.Context, messageID int64, mode string) (compose Compose) {
+	if mode != "reply" && mode != "replyall" && mode != "forward" {
+		panic(&sherpa.Error{Code: "user:error", Message: "mode must be reply, replyall or forward"})
+	}
+
+	accountName := ctx.Value(authCtxKey).(string)
+	acc, err := store.OpenAccount(accountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		xlog.Check(err, "closing account")
+	}()
+
+	m := store.Message{ID: messageID}
+	err = acc.DB.Get(ctx, &m)
+	if err == bstore.ErrAbsent {
+		panic(&sherpa.Error{Code: "user:notFound", Message: "message not found"})
+	}
+	xcheckf(ctx, err, "get message")
+
+	mr := acc.MessageReader(m)
+	defer func() {
+		err := mr.Close()
+		xlog.Check(err, "closing message reader")
+	}()
+	p, err := m.LoadPart(mr)
+	xcheckf(ctx, err, "loading message part")
+
+	conf, _ := acc.Conf()
+	own := func(a message.Address) bool {
+		addr := strings.ToLower(a.User + "@" + a.Host)
+		for dest := range conf.Destinations {
+			if strings.ToLower(dest) == addr || strings.HasPrefix(dest, "@") && strings.EqualFold(dest[1:], a.Host) {
+				return true
+			}
+		}
+		return false
+	}
+
+	env := p.Envelope
+	if env == nil {
+		env = &message.Envelope{}
+	}
+	var from string
+	if len(env.From) > 0 {
+		from = formatAddress(env.From[0])
+	}
+
+	compose.MessageSizeLimit = mox.Conf.MessageSizeLimit(accountName)
+
+	if mode == "forward" {
+		compose.Subject = message.ForwardSubject(env.Subject)
+	} else {
+		compose.Subject = message.ReplySubject(env.Subject)
+
+		// Replies go to the Reply-To addresses, or the sender.
+		seen := map[string]bool{}
+		add := func(l *[]string, addrs []message.Address) {
+			for _, a := range addrs {
+				key := strings.ToLower(a.User + "@" + a.Host)
+				if seen[key] || (mode == "replyall" && own(a)) {
+					continue
+				}
+				seen[key] = true
+				*l = append(*l, formatAddress(a))
+			}
+		}
+		if len(env.ReplyTo) > 0 {
+			add(&compose.To, env.ReplyTo)
+		} else {
+			add(&compose.To, env.From)
+		}
+		if mode == "replyall" {
+			add(&compose.To, env.To)
+			add(&compose.Cc, env.CC)
+		}
+
+		if env.MessageID != "" {
+			compose.InReplyTo = env.MessageID
+			var references string
+			if h, err := p.Header(); err == nil {
+				references = h.Get("References")
+			}
+			compose.References = append(message.ReferencedIDs(references, env.InReplyTo), env.MessageID)
+		}
+	}
+
+	text, err := composeText(&p)
+	xcheckf(ctx, err, "reading text of message")
+	htmlPart := composeFindPart(&p, "HTML")
+
+	// Header for the forwarded message, or the attribution line of the reply.
+	var intro string
+	if mode == "forward" {
+		var b strings.Builder
+		b.WriteString("---------- Forwarded message ----------\n")
+		field := func(k, v string) {
+			if v != "" {
+				fmt.Fprintf(&b, "%s: %s\n", k, v)
+			}
+		}
+		field("From", formatAddresses(env.From))
+		if !env.Date.IsZero() {
+			field("Date", env.Date.Format(time.RFC1123Z))
+		}
+		field("Subject", env.Subject)
+		field("To", formatAddresses(env.To))
+		field("Cc", formatAddresses(env.CC))
+		intro = b.String()
+		compose.Text = intro + "\n" + text
+	} else {
+		intro = message.Attribution(from, env.Date)
+		compose.Text = intro + "\n" + message.QuoteText(text)
+	}
+
+	if htmlPart == nil {
+		return
+	}
+
+	// Remote images are kept, the recipient's email client decides whether they are
+	// loaded. Tracking pixels are removed.
+	keepRemote := func(u *url.URL) string { return u.String() }
+	var body bytes.Buffer
+	result, err := sanitizeHTML(htmlPart.Reader(), &body, keepRemote, true)
+	xcheckf(ctx, err, "sanitizing html")
+	buf := body.Bytes()
+	if !utf8.Valid(buf) {
+		buf = bytes.ToValidUTF8(buf, []byte("�"))
+	}
+	introHTML := strings.ReplaceAll(html.EscapeString(strings.TrimSuffix(intro, "\n")), "\n", "<br>\n")
+	if mode == "forward" {
+		compose.HTML = "<p>" + introHTML + "</p>\n" + string(buf)
+	} else {
+		compose.HTML = "<p>" + introHTML + "</p>\n<blockquote type=\"cite\">\n" + string(buf) + "\n</blockquote>\n"
+	}
+
+	seen := map[string]bool{}
+	for _, cid := range result.ContentIDs {
+		if seen[cid] {
+			continue
+		}
+		seen[cid] = true
+		ip := composeFindContentID(&p, "<"+cid+">")
+		if ip == nil {
+			continue
+		}
+		data, err := io.ReadAll(ip.Reader())
+		xcheckf(ctx, err, "reading inline part")
+		name := ip.ContentTypeParams["name"]
+		compose.Inline = append(compose.Inline, ComposeInline{cid, strings.ToLower(ip.MediaType + "/" + ip.MediaSubType), name, data})
+	}
+	return
+}
+
+// TextFlowed returns text, e.g. from a Compose after editing, encoded as
+// format=flowed, with long lines wrapped and CRLF line endings, for sending as
+// text/plain part with Content-Type parameters format=flowed and delsp=no.
+func (Account) TextFlowed(ctx context.Context, text string) string {
+	return message.FormatFlowed(text)
+}
+
+// TextFromHTML returns a plain text version of an HTML message body, for the
+// text/plain alternative part of a message composed in HTML.
+func (Account) TextFromHTML(ctx context.Context, htmlBody string) string {
+	text, err := message.HTMLToText(strings.NewReader(htmlBody))
+	xcheckf(ctx, err, "converting html to text")
+	return text
+}
+
+// composeText returns the text of a message for quoting or forwarding: its
+// first text/plain part, or the text of its first text/html part.
+func composeText(p *message.Part) (string, error) {
+	if tp := composeFindPart(p, "PLAIN"); tp != nil {
+		buf, err := io.ReadAll(tp.Reader())
+		if err != nil {
+			return "", err
+		}
+		if !utf8.Valid(buf) {
+			buf = bytes.ToValidUTF8(buf, []byte("�"))
+		}
+		return strings.ReplaceAll(string(buf), "\r\n", "\n"), nil
+	}
+	if hp := composeFindPart(p, "HTML"); hp != nil {
+		return message.HTMLToText(hp.Reader())
+	}
+	return "", nil
+}
+
+// composeFindPart returns the first text part with subtype that isn't an
+// attachment.
+func composeFindPart(p *message.Part, subtype string) *message.Part {
+	if p.MediaType == "TEXT" && p.MediaSubType == subtype || subtype == "PLAIN" && p.MediaType == "" {
+		if h, err := p.Header(); err == nil && strings.HasPrefix(strings.ToLower(strings.TrimSpace(h.Get("Content-Disposition"))), "attachment") {
+			return nil
+		}
+		return p
+	}
+	for i := range p.Parts {
+		if tp := composeFindPart(&p.Parts[i], subtype); tp != nil {
+			return tp
+		}
+	}
+	return nil
+}
+
+// composeFindContentID returns the part with Content-ID cid, with <>.
+func composeFindContentID(p *message.Part, cid string) *message.Part {
+	if len(p.Parts) == 0 && strings.EqualFold(p.ContentID, cid) {
+		return p
+	}
+	for i := range p.Parts {
+		if ip := composeFindContentID(&p.Parts[i], cid); ip != nil {
+			return ip
+		}
+	}
+	return nil
+}
+
+// formatAddress returns an address for display and for editing in a header,
+// quoting the name if needed.
+func formatAddress(a message.Address) string {
+	s := a.User + "@" + a.Host
+	if a.Name == "" {
+		return s
+	}
+	name := a.Name
+	if strings.ContainsAny(name, `()<>[]:;@\,."`) {
+		name = `"` + strings.ReplaceAll(strings.ReplaceAll(name, `\`, `\\`), `"`, `\"`) + `"`
+	}
+	return name + " <" + s + ">"
+}
@@ -0,0 +1,142 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/mjl-/bstore"
+	"github.com/mjl-/sherpa"
+
+	"github.com/mjl-/mox/store"
+)
+
+// LabelMessage is a message in the view of a label or in search results,
+// across mailboxes.
+type LabelMessage struct {
+	ID       int64
+	Mailbox  string
+	Received time.Time
+	From     string
+	Subject  string
+	Labels   []string // All labels of the message, i.e. its keywords.
+}
+
+// xlabelError turns errors about bad input into user errors.
+func xlabelError(ctx context.Context, err error, msg string) {
+	if errors.Is(err, store.ErrLabelInvalid) {
+		panic(&sherpa.Error{Code: "user:error", Message: err.Error()})
+	} else if errors.Is(err, bstore.ErrAbsent) {
+		panic(&sherpa.Error{Code: "user:notFound", Message: "message not found"})
+	}
+	xcheckf(ctx, err, "%s", msg)
+}
+
+// Labels returns the labels of the account, with their colors. Labels are
+// keywords on messages, keywords set by IMAP clients are included.
+func (Account) Labels(ctx context.Context) []store.Label {
+	accountName := ctx.Value(authCtxKey).(string)
+	acc, err := store.OpenAccount(accountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		xlog.Check(err, "closing account")
+	}()
+	l, err := acc.Labels(ctx)
+	xcheckf(ctx, err, "listing labels")
+	return l
+}
+
+// LabelSave adds a label, or changes the color of a label.
+func (Account) LabelSave(ctx context.Context, label store.Label) store.Label {
+	accountName := ctx.Value(authCtxKey).(string)
+	acc, err := store.OpenAccount(accountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		xlog.Check(err, "closing account")
+	}()
+	l, err := acc.LabelSave(ctx, label)
+	xlabelError(ctx, err, "saving label")
+	return l
+}
+
+// LabelRemove removes a label, also from all messages that have it.
+func (Account) LabelRemove(ctx context.Context, name string) {
+	accountName := ctx.Value(authCtxKey).(string)
+	acc, err := store.OpenAccount(accountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		xlog.Check(err, "closing account")
+	}()
+	err = acc.LabelRemove(ctx, name)
+	xlabelError(ctx, err, "removing label")
+}
+
+// LabelMessages returns the messages with a label, in all mailboxes, most
+// recently received first.
+func (Account) LabelMessages(ctx context.Context, name string) []LabelMessage {
+	accountName := ctx.Value(authCtxKey).(string)
+	acc, err := store.OpenAccount(accountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		xlog.Check(err, "closing account")
+	}()
+
+	var l []LabelMessage
+	acc.WithRLock(func() {
+		err = store.DBRead(ctx, xlog.WithContext(ctx), "http", acc.DB, func(tx *bstore.Tx) error {
+			msgs, err := acc.LabelMessages(tx, name)
+			if err != nil {
+				return err
+			}
+			l, err = labelMessages(tx, acc, msgs)
+			return err
+		})
+	})
+	xlabelError(ctx, err, "listing messages with label")
+	return l
+}
+
+// labelMessages returns msgs for display in a message list.
+func labelMessages(tx *bstore.Tx, acc *store.Account, msgs []store.Message) ([]LabelMessage, error) {
+	mailboxNames := map[int64]string{}
+	err := bstore.QueryTx[store.Mailbox](tx).ForEach(func(mb store.Mailbox) error {
+		mailboxNames[mb.ID] = mb.Name
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var l []LabelMessage
+	for _, m := range msgs {
+		lm := LabelMessage{ID: m.ID, Mailbox: mailboxNames[m.MailboxID], Received: m.Received, Labels: m.Keywords}
+		if m.MsgFromDomain != "" {
+			lm.From = m.MsgFromLocalpart.String() + "@" + m.MsgFromDomain
+		}
+		mr := acc.MessageReader(m)
+		if p, err := m.LoadPart(mr); err == nil && p.Envelope != nil {
+			lm.Subject = p.Envelope.Subject
+		}
+		err = mr.Close()
+		xlog.Check(err, "closing message reader")
+		l = append(l, lm)
+	}
+	return l, nil
+}
+
+// MessageLabelsChange adds and removes labels of a message. Labels that don't
+// exist yet are created without color.
+func (Account) MessageLabelsChange(ctx context.Context, messageID int64, add, remove []string) {
+	accountName := ctx.Value(authCtxKey).(string)
+	acc, err := store.OpenAccount(accountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		xlog.Check(err, "closing account")
+	}()
+	err = acc.MessageLabelsChange(ctx, messageID, add, remove)
+	xlabelError(ctx, err, "changing labels of message")
+}
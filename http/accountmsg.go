@@ -0,0 +1,454 @@
+package http
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/store"
+)
+
+// Messages of an account can be fetched from the account web interface, for
+// printing or saving. Paths, relative to the account web interface:
+//
+//	messages/<id>.eml	Raw message.
+//	messages/<id>/print	HTML page with headers and text body, for printing.
+//	messages/<id>.pdf	PDF of the print page, if a PDF renderer is available.
+//	messages/<id>/html	Sanitized HTML part, with remote content only through the image proxy.
+//	messages-export.zip	Zip file with .eml files for each "id" query parameter.
+
+// PDFRenderer renders the HTML print page of a message as PDF.
+type PDFRenderer interface {
+	RenderPDF(ctx context.Context, html []byte, w io.Writer) error
+}
+
+// PDFRender is used to render messages as PDF. If nil, and PDFRenderCommand is
+// set in the configuration, that command is used. Otherwise PDF export is not
+// available.
+var PDFRender PDFRenderer
+
+// commandPDFRenderer renders PDF by running a command that reads HTML from stdin
+// and writes PDF to stdout.
+type commandPDFRenderer []string
+
+func (argv commandPDFRenderer) RenderPDF(ctx context.Context, html []byte, w io.Writer) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Stdin = bytes.NewReader(html)
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("running pdf render command: %v (%s)", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func pdfRenderer() PDFRenderer {
+	if PDFRender != nil {
+		return PDFRender
+	}
+	if argv := mox.Conf.Static.PDFRenderCommand; len(argv) > 0 {
+		return commandPDFRenderer(argv)
+	}
+	return nil
+}
+
+var printTemplate = htmltemplate.Must(htmltemplate.New("print").Parse(`<!doctype html>
+<html>
+	<head>
+		<meta charset="utf-8" />
+		<title>{{ .Subject }}</title>
+		<style>
+body { font-family: sans-serif; font-size: 11pt; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th { text-align: right; padding-right: 1em; vertical-align: top; }
+pre { white-space: pre-wrap; font-family: monospace; font-size: 10pt; border-top: 1px solid #ccc; padding-top: 1em; }
+@media print {
+	body { margin: 0; }
+}
+		</style>
+	</head>
+	<body>
+		<table>
+			{{ range .Headers }}<tr><th>{{ .Key }}</th><td>{{ .Value }}</td></tr>
+			{{ end }}
+		</table>
+		{{ if .Attachments }}<p>Attachments: {{ range $i, $a := .Attachments }}{{ if $i }}, {{ end }}{{ $a }}{{ end }}</p>{{ end }}
+		<pre>{{ .Text }}</pre>
+	</body>
+</html>
+`))
+
+type printHeader struct {
+	Key   string
+	Value string
+}
+
+type printMessage struct {
+	Subject     string
+	Headers     []printHeader
+	Attachments []string
+	Text        string
+}
+
+func formatAddresses(l []message.Address) string {
+	var r []string
+	for _, a := range l {
+		s := a.User + "@" + a.Host
+		if a.Name != "" {
+			s = fmt.Sprintf("%s <%s>", a.Name, s)
+		}
+		r = append(r, s)
+	}
+	return strings.Join(r, ", ")
+}
+
+// printText gathers the text of the first text/plain part, and names of other
+// non-multipart parts as attachments.
+func printText(p *message.Part, pm *printMessage) error {
+	if len(p.Parts) > 0 {
+		for i := range p.Parts {
+			if err := printText(&p.Parts[i], pm); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if (p.MediaType == "" || p.MediaType == "TEXT" && p.MediaSubType == "PLAIN") && pm.Text == "" {
+		buf, err := io.ReadAll(p.Reader())
+		if err != nil {
+			return fmt.Errorf("reading text part: %w", err)
+		}
+		if !utf8.Valid(buf) {
+			buf = bytes.ToValidUTF8(buf, []byte("�"))
+		}
+		pm.Text = strings.ReplaceAll(string(buf), "\r\n", "\n")
+		return nil
+	}
+	if p.MediaType == "TEXT" && p.MediaSubType == "HTML" {
+		return nil
+	}
+	name := p.ContentTypeParams["name"]
+	if name == "" {
+		name = strings.ToLower(p.MediaType + "/" + p.MediaSubType)
+	}
+	pm.Attachments = append(pm.Attachments, name)
+	return nil
+}
+
+// messagePrintHTML returns the print page for a message.
+func messagePrintHTML(acc *store.Account, m store.Message) ([]byte, error) {
+	mr := acc.MessageReader(m)
+	defer func() {
+		err := mr.Close()
+		xlog.Check(err, "closing message reader")
+	}()
+	p, err := m.LoadPart(mr)
+	if err != nil {
+		return nil, fmt.Errorf("loading message part: %w", err)
+	}
+
+	var pm printMessage
+	if env := p.Envelope; env != nil {
+		pm.Subject = env.Subject
+		add := func(k, v string) {
+			if v != "" {
+				pm.Headers = append(pm.Headers, printHeader{k, v})
+			}
+		}
+		add("From", formatAddresses(env.From))
+		add("To", formatAddresses(env.To))
+		add("Cc", formatAddresses(env.CC))
+		if !env.Date.IsZero() {
+			add("Date", env.Date.Format(time.RFC1123Z))
+		}
+		add("Subject", env.Subject)
+	}
+	if err := printText(&p, &pm); err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	if err := printTemplate.Execute(&b, pm); err != nil {
+		return nil, fmt.Errorf("executing template: %w", err)
+	}
+	return b.Bytes(), nil
+}
+
+var htmlTemplate = htmltemplate.Must(htmltemplate.New("html").Parse(`<!doctype html>
+<html>
+	<head>
+		<meta charset="{{ .Charset }}" />
+		<title>{{ .Subject }}</title>
+		<style>
+.mox-remote { font-family: sans-serif; font-size: 10pt; background-color: #ffe; border: 1px solid #dda; padding: .5em; margin-bottom: 1em; }
+		</style>
+	</head>
+	<body>
+		{{ if or .RemoteBlocked .TrackingBlocked }}<div class="mox-remote">
+			{{ if .RemoteBlocked }}{{ .RemoteBlocked }} remote image(s) not loaded, to protect your privacy. <a href="?remote=1">Load remote content</a>.{{ end }}
+			{{ if .TrackingBlocked }}{{ .TrackingBlocked }} tracking image(s) removed.{{ end }}
+		</div>{{ end }}
+		{{ .HTML }}
+	</body>
+</html>
+`))
+
+// messageHTML returns a page with the sanitized HTML part of a message, or nil
+// if the message has no HTML part. The HTML is not converted to UTF-8, the page
+// has the charset of the HTML part.
+func messageHTML(acc *store.Account, m store.Message, loadRemote bool) ([]byte, string, error) {
+	mr := acc.MessageReader(m)
+	defer func() {
+		err := mr.Close()
+		xlog.Check(err, "closing message reader")
+	}()
+	p, err := m.LoadPart(mr)
+	if err != nil {
+		return nil, "", fmt.Errorf("loading message part: %w", err)
+	}
+
+	var find func(p *message.Part) *message.Part
+	find = func(p *message.Part) *message.Part {
+		if p.MediaType == "TEXT" && p.MediaSubType == "HTML" {
+			return p
+		}
+		for i := range p.Parts {
+			if hp := find(&p.Parts[i]); hp != nil {
+				return hp
+			}
+		}
+		return nil
+	}
+	hp := find(&p)
+	if hp == nil {
+		return nil, "", nil
+	}
+	charset := strings.ToLower(hp.ContentTypeParams["charset"])
+	if charset == "" || charset == "us-ascii" || strings.Trim(charset, "abcdefghijklmnopqrstuvwxyz0123456789-_:.") != "" {
+		charset = "utf-8"
+	}
+
+	var proxy func(u *url.URL) string
+	if loadRemote {
+		proxy = imageProxyURL
+	}
+	var body bytes.Buffer
+	result, err := sanitizeHTML(hp.Reader(), &body, proxy, false)
+	if err != nil {
+		return nil, "", fmt.Errorf("sanitizing html: %w", err)
+	}
+	buf := body.Bytes()
+	if charset == "utf-8" && !utf8.Valid(buf) {
+		buf = bytes.ToValidUTF8(buf, []byte("�"))
+	}
+
+	var subject string
+	if p.Envelope != nil {
+		subject = p.Envelope.Subject
+	}
+	var b bytes.Buffer
+	err = htmlTemplate.Execute(&b, map[string]any{
+		"Charset":         charset,
+		"Subject":         subject,
+		"RemoteBlocked":   result.RemoteBlocked,
+		"TrackingBlocked": result.TrackingBlocked,
+		"HTML":            htmltemplate.HTML(buf),
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("executing template: %w", err)
+	}
+	return b.Bytes(), charset, nil
+}
+
+// accountMessageHandle serves the message export/print paths for the account.
+func accountMessageHandle(ctx context.Context, log *mlog.Log, w http.ResponseWriter, r *http.Request, accName string) {
+	if r.Method != "GET" {
+		http.Error(w, "405 - method not allowed - get required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var ids []int64
+	var kind string
+	if r.URL.Path == "/messages-export.zip" {
+		for _, s := range r.URL.Query()["id"] {
+			id, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				http.Error(w, "400 - bad request - bad message id", http.StatusBadRequest)
+				return
+			}
+			ids = append(ids, id)
+		}
+		if len(ids) == 0 {
+			http.Error(w, "400 - bad request - no messages selected", http.StatusBadRequest)
+			return
+		}
+		kind = "zip"
+	} else {
+		s := strings.TrimPrefix(r.URL.Path, "/messages/")
+		for _, k := range []string{".eml", "/print", ".pdf", "/html"} {
+			if strings.HasSuffix(s, k) {
+				s = strings.TrimSuffix(s, k)
+				kind = k
+				break
+			}
+		}
+		id, err := strconv.ParseInt(s, 10, 64)
+		if kind == "" || err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		ids = []int64{id}
+	}
+
+	var renderer PDFRenderer
+	if kind == ".pdf" {
+		renderer = pdfRenderer()
+		if renderer == nil {
+			http.Error(w, "501 - not implemented - no pdf renderer configured", http.StatusNotImplemented)
+			return
+		}
+	}
+
+	acc, err := store.OpenAccount(accName)
+	if err != nil {
+		log.Errorx("open account for message export", err)
+		http.Error(w, "500 - internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+
+	var msgs []store.Message
+	acc.WithRLock(func() {
+		err = store.DBRead(ctx, xlog.WithContext(ctx), "http", acc.DB, func(tx *bstore.Tx) error {
+			for _, id := range ids {
+				m := store.Message{ID: id}
+				if err := tx.Get(&m); err != nil {
+					return err
+				}
+				msgs = append(msgs, m)
+			}
+			return nil
+		})
+	})
+	if errors.Is(err, bstore.ErrAbsent) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Errorx("looking up messages for export", err)
+		http.Error(w, "500 - internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h := w.Header()
+	switch kind {
+	case ".eml":
+		m := msgs[0]
+		h.Set("Content-Type", "message/rfc822")
+		h.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%d.eml"`, m.ID))
+		h.Set("Content-Length", fmt.Sprintf("%d", m.Size))
+		mr := acc.MessageReader(m)
+		defer func() {
+			err := mr.Close()
+			log.Check(err, "closing message reader")
+		}()
+		_, err := io.Copy(w, mr)
+		log.Check(err, "writing message")
+
+	case "/print", ".pdf":
+		buf, err := messagePrintHTML(acc, msgs[0])
+		if err != nil {
+			log.Errorx("rendering message for printing", err)
+			http.Error(w, "500 - internal server error - "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if kind == "/print" {
+			h.Set("Content-Type", "text/html; charset=utf-8")
+			_, err = w.Write(buf)
+			log.Check(err, "writing print page")
+			return
+		}
+		var pdf bytes.Buffer
+		if err := renderer.RenderPDF(ctx, buf, &pdf); err != nil {
+			log.Errorx("rendering message as pdf", err)
+			http.Error(w, "500 - internal server error - rendering pdf", http.StatusInternalServerError)
+			return
+		}
+		h.Set("Content-Type", "application/pdf")
+		h.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%d.pdf"`, msgs[0].ID))
+		_, err = w.Write(pdf.Bytes())
+		log.Check(err, "writing pdf")
+
+	case "/html":
+		loadRemote := r.URL.Query().Get("remote") == "1"
+		if !loadRemote {
+			settings, err := acc.Settings(ctx)
+			if err != nil {
+				log.Errorx("get account settings", err)
+				http.Error(w, "500 - internal server error", http.StatusInternalServerError)
+				return
+			}
+			loadRemote = settings.LoadRemoteContent
+		}
+		buf, charset, err := messageHTML(acc, msgs[0], loadRemote)
+		if err != nil {
+			log.Errorx("rendering html message", err)
+			http.Error(w, "500 - internal server error - "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if buf == nil {
+			http.Error(w, "404 - not found - message has no html part", http.StatusNotFound)
+			return
+		}
+		// Styles in the message are inline only, images only through the proxy. No scripts.
+		h.Set("Content-Security-Policy", fmt.Sprintf("default-src 'none'; img-src data: %s; style-src 'unsafe-inline'; frame-ancestors 'self'; form-action 'none'; base-uri 'none'", imageProxyOrigin()))
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Referrer-Policy", "no-referrer")
+		h.Set("Content-Type", "text/html; charset="+charset)
+		_, err = w.Write(buf)
+		log.Check(err, "writing html message")
+
+	case "zip":
+		h.Set("Content-Type", "application/zip")
+		h.Set("Content-Disposition", `attachment; filename="messages.zip"`)
+		zw := zip.NewWriter(w)
+		for _, m := range msgs {
+			fw, err := zw.CreateHeader(&zip.FileHeader{Name: fmt.Sprintf("%d.eml", m.ID), Method: zip.Deflate, Modified: m.Received})
+			if err != nil {
+				log.Errorx("adding message to zip", err)
+				return
+			}
+			mr := acc.MessageReader(m)
+			_, err = io.Copy(fw, mr)
+			xerr := mr.Close()
+			log.Check(xerr, "closing message reader")
+			if err != nil {
+				log.Errorx("writing message to zip", err)
+				return
+			}
+		}
+		err := zw.Close()
+		log.Check(err, "closing zip file")
+	}
+}
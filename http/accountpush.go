@@ -0,0 +1,129 @@
+package http
+
+import (
+	"context"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mjl-/bstore"
+	"github.com/mjl-/sherpa"
+
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/store"
+	"github.com/mjl-/mox/webpush"
+)
+
+// Service worker for the account web interface, registered by browsers that
+// subscribe to push notifications. Served without authentication.
+const pushServiceWorker = `self.addEventListener('push', (e) => {
+	let n = {}
+	try {
+		n = e.data.json()
+	} catch (err) {
+		n = {title: 'New message'}
+	}
+	const body = n.body + (n.mailbox && n.mailbox !== 'Inbox' ? ' (' + n.mailbox + ')' : '')
+	e.waitUntil(self.registration.showNotification(n.title || 'New message', {body: body, tag: 'mox-' + (n.mailbox || '')}))
+})
+
+self.addEventListener('notificationclick', (e) => {
+	e.notification.close()
+	e.waitUntil(self.clients.openWindow(self.registration.scope))
+})
+`
+
+func pushServiceWorkerHandle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "405 - method not allowed - get required", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache; max-age=0")
+	_, _ = w.Write([]byte(pushServiceWorker))
+}
+
+// PushConfig returns the base64url-encoded public key of the server for
+// subscribing browsers to push notifications, or an empty string if push
+// notifications are not configured.
+func (Account) PushConfig(ctx context.Context) string {
+	wp := mox.Conf.Static.WebPush
+	if wp == nil || wp.VAPIDKey == nil {
+		return ""
+	}
+	return webpush.PublicKey(wp.VAPIDKey)
+}
+
+// PushSubscriptions returns the browsers subscribed to push notifications.
+func (Account) PushSubscriptions(ctx context.Context) []store.PushSubscription {
+	accountName := ctx.Value(authCtxKey).(string)
+	acc, err := store.OpenAccount(accountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		xlog.Check(err, "closing account")
+	}()
+	l, err := acc.PushSubscriptions(ctx)
+	xcheckf(ctx, err, "listing push subscriptions")
+	return l
+}
+
+// PushSubscriptionAdd adds a browser subscription for push notifications, with
+// endpoint and keys from the browser push subscription, and criteria for
+// messages to notify about. An existing subscription for the endpoint is
+// replaced.
+func (Account) PushSubscriptionAdd(ctx context.Context, sub store.PushSubscription) {
+	if mox.Conf.Static.WebPush == nil {
+		panic(&sherpa.Error{Code: "user:error", Message: "push notifications not configured"})
+	}
+	u, err := url.Parse(sub.Endpoint)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		panic(&sherpa.Error{Code: "user:error", Message: "endpoint must be an https url"})
+	}
+	// Connections are checked again when sending, after resolving the host name.
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !webpush.AllowIP(ip) || strings.EqualFold(strings.TrimSuffix(u.Hostname(), "."), "localhost") {
+		panic(&sherpa.Error{Code: "user:error", Message: "endpoint must be a public push service"})
+	}
+	if buf, err := base64.RawURLEncoding.DecodeString(sub.P256dh); err != nil || len(buf) != 65 {
+		panic(&sherpa.Error{Code: "user:error", Message: "invalid p256dh key"})
+	}
+	if buf, err := base64.RawURLEncoding.DecodeString(sub.Auth); err != nil || len(buf) != 16 {
+		panic(&sherpa.Error{Code: "user:error", Message: "invalid auth secret"})
+	}
+
+	accountName := ctx.Value(authCtxKey).(string)
+	acc, err := store.OpenAccount(accountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		xlog.Check(err, "closing account")
+	}()
+	if sub.Mailbox != "" {
+		var mb *store.Mailbox
+		err := store.DBRead(ctx, xlog.WithContext(ctx), "http", acc.DB, func(tx *bstore.Tx) (err error) {
+			mb, err = acc.MailboxFind(tx, sub.Mailbox)
+			return err
+		})
+		xcheckf(ctx, err, "looking up mailbox")
+		if mb == nil {
+			panic(&sherpa.Error{Code: "user:error", Message: "mailbox not found"})
+		}
+	}
+	err = acc.PushSubscriptionAdd(ctx, &sub)
+	xcheckf(ctx, err, "adding push subscription")
+}
+
+// PushSubscriptionRemove removes a browser subscription for push notifications.
+func (Account) PushSubscriptionRemove(ctx context.Context, id int64) {
+	accountName := ctx.Value(authCtxKey).(string)
+	acc, err := store.OpenAccount(accountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		xlog.Check(err, "closing account")
+	}()
+	err = acc.PushSubscriptionRemove(ctx, id)
+	xcheckf(ctx, err, "removing push subscription")
+}
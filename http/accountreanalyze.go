@@ -0,0 +1,83 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/mjl-/sherpa"
+
+	"github.com/mjl-/mox/metrics"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/store"
+)
+
+// Re-analysis jobs run in the background, the last report per account is kept
+// in memory for showing in the account web interface.
+var reanalyzes = struct {
+	sync.Mutex
+	reports map[string]*store.ReanalyzeReport
+}{
+	reports: map[string]*store.ReanalyzeReport{},
+}
+
+// ReanalyzeStart starts re-analysis of messages received in the past days in
+// the Inbox and Junk mailboxes, with the current junk filter, blocked senders and
+// delivery rulesets. If refile is set, messages are moved to the mailbox they
+// would be delivered to now, otherwise only a report of the moves is made. The
+// analysis runs in the background, see ReanalyzeStatus.
+func (Account) ReanalyzeStart(ctx context.Context, days int, refile bool) {
+	accountName := ctx.Value(authCtxKey).(string)
+	if days <= 0 || days > 365 {
+		panic(&sherpa.Error{Code: "user:error", Message: "days must be between 1 and 365"})
+	}
+
+	reanalyzes.Lock()
+	defer reanalyzes.Unlock()
+	if r := reanalyzes.reports[accountName]; r != nil && r.End.IsZero() {
+		panic(&sherpa.Error{Code: "user:error", Message: "re-analysis already in progress"})
+	}
+	acc, err := store.OpenAccount(accountName)
+	xcheckf(ctx, err, "open account")
+	reanalyzes.reports[accountName] = &store.ReanalyzeReport{Start: time.Now(), Days: days, Refile: refile}
+
+	log := xlog.WithCid(mox.Cid()).Fields(mlog.Field("account", accountName))
+	go func() {
+		defer func() {
+			x := recover()
+			if x == nil {
+				return
+			}
+			log.Error("unhandled panic in re-analysis", mlog.Field("panic", x))
+			debug.PrintStack()
+			metrics.PanicInc("http")
+			reanalyzes.Lock()
+			reanalyzes.reports[accountName] = &store.ReanalyzeReport{Start: time.Now(), End: time.Now(), Days: days, Refile: refile, Error: fmt.Sprintf("%v", x)}
+			reanalyzes.Unlock()
+		}()
+		defer func() {
+			err := acc.Close()
+			log.Check(err, "closing account after re-analysis")
+		}()
+
+		report, err := acc.Reanalyze(mox.Shutdown, log, days, refile)
+		log.Check(err, "re-analyzing messages")
+		log.Info("re-analysis done", mlog.Field("refile", refile), mlog.Field("analyzed", report.Analyzed), mlog.Field("moves", len(report.Moves)))
+		reanalyzes.Lock()
+		reanalyzes.reports[accountName] = &report
+		reanalyzes.Unlock()
+	}()
+}
+
+// ReanalyzeStatus returns the report of the running or last re-analysis, or
+// nil if none was started since the server started. A running analysis has a
+// zero End time.
+func (Account) ReanalyzeStatus(ctx context.Context) *store.ReanalyzeReport {
+	accountName := ctx.Value(authCtxKey).(string)
+	reanalyzes.Lock()
+	defer reanalyzes.Unlock()
+	return reanalyzes.reports[accountName]
+}
@@ -0,0 +1,45 @@
+package http
+
+import (
+	"context"
+	"errors"
+
+	"github.com/mjl-/bstore"
+	"github.com/mjl-/sherpa"
+
+	"github.com/mjl-/mox/store"
+)
+
+// messageSearchMax is the maximum number of messages returned by MessageSearch.
+const messageSearchMax = 200
+
+// MessageSearch returns the messages, in all mailboxes, with all words of query
+// in their subject, addresses, text or attachment names, most recently received
+// first, using the full-text index of the account. At most 200 messages are
+// returned. Only messages in the index are found.
+func (Account) MessageSearch(ctx context.Context, query string) []LabelMessage {
+	accountName := ctx.Value(authCtxKey).(string)
+	acc, err := store.OpenAccount(accountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		xlog.Check(err, "closing account")
+	}()
+
+	var l []LabelMessage
+	acc.WithRLock(func() {
+		err = store.DBRead(ctx, xlog.WithContext(ctx), "http", acc.DB, func(tx *bstore.Tx) error {
+			msgs, err := acc.TextIndexMessages(tx, query, messageSearchMax)
+			if err != nil {
+				return err
+			}
+			l, err = labelMessages(tx, acc, msgs)
+			return err
+		})
+	})
+	if errors.Is(err, store.ErrTextIndexDisabled) {
+		panic(&sherpa.Error{Code: "user:error", Message: err.Error()})
+	}
+	xcheckf(ctx, err, "searching messages")
+	return l
+}
@@ -26,6 +26,7 @@ import (
 	_ "embed"
 
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/exp/maps"
 
 	"github.com/mjl-/bstore"
 	"github.com/mjl-/sherpa"
@@ -1033,7 +1034,7 @@ When enabling MTA-STS, or updating a policy, always update the policy first (thr
 
 		// We'll assume if any submissions is configured, it is public. Same for imap. And
 		// if not, that there is a plain option.
-		var submissions, imaps bool
+		var submissions, imaps, pop3, pop3s bool
 		for _, l := range mox.Conf.Static.Listeners {
 			if l.TLS != nil && l.Submissions.Enabled {
 				submissions = true
@@ -1041,6 +1042,12 @@ When enabling MTA-STS, or updating a policy, always update the policy first (thr
 			if l.TLS != nil && l.IMAPS.Enabled {
 				imaps = true
 			}
+			if l.TLS != nil && l.POP3S.Enabled {
+				pop3s = true
+			}
+			if l.TLS != nil && l.POP3.Enabled {
+				pop3 = true
+			}
 		}
 		srvhost := func(ok bool) string {
 			if ok {
@@ -1053,8 +1060,8 @@ When enabling MTA-STS, or updating a policy, always update the policy first (thr
 			{name: "_submission", port: 587, host: srvhost(!submissions)},
 			{name: "_imaps", port: 993, host: srvhost(imaps)},
 			{name: "_imap", port: 143, host: srvhost(!imaps)},
-			{name: "_pop3", port: 110, host: "."},
-			{name: "_pop3s", port: 995, host: "."},
+			{name: "_pop3", port: 110, host: srvhost(pop3 && !pop3s)},
+			{name: "_pop3s", port: 995, host: srvhost(pop3s)},
 		}
 		var srvwg sync.WaitGroup
 		srvwg.Add(len(reqs))
@@ -1530,12 +1537,128 @@ func (Admin) SetPassword(ctx context.Context, accountName, password string) {
 	xcheckf(ctx, err, "setting password")
 }
 
+// ImpersonateStart starts a read-only impersonated session in the account web
+// interface for an account, valid for one hour. The reason is logged, and
+// included in the notification message delivered to the Inbox of the account if
+// notify is set. The returned path, with a token, opens the session. It is for the
+// first listener with the account web interface enabled.
+func (Admin) ImpersonateStart(ctx context.Context, accountName, reason string, notify bool) (path string) {
+	log := xlog.WithContext(ctx)
+	token, err := impersonateStart(log, accountName, reason, notify)
+	xcheckf(ctx, err, "starting impersonation")
+
+	path = "/"
+	names := maps.Keys(mox.Conf.Static.Listeners)
+	sort.Strings(names)
+	for _, name := range names {
+		l := mox.Conf.Static.Listeners[name]
+		if !l.AccountHTTP.Enabled && !l.AccountHTTPS.Enabled {
+			continue
+		}
+		if l.AccountHTTP.Enabled && l.AccountHTTP.Path != "" {
+			path = l.AccountHTTP.Path
+		} else if l.AccountHTTPS.Enabled && l.AccountHTTPS.Path != "" {
+			path = l.AccountHTTPS.Path
+		}
+		break
+	}
+	return path + "impersonate?token=" + token
+}
+
+// ListenerConnections returns the connection usage for listeners with connection
+// limits.
+func (Admin) ListenerConnections(ctx context.Context) []mox.ListenerConnections {
+	return mox.ConnectionLimitsUsage()
+}
+
+// DMARCOverrides returns the configured DMARC overrides for trusted forwarders,
+// with the number of messages they matched since startup.
+func (Admin) DMARCOverrides(ctx context.Context) []mox.DMARCOverrideUsage {
+	return mox.DMARCOverrides()
+}
+
+// Notices returns the configured notices for users, shown in the IMAP greeting,
+// SMTP banner and web interfaces.
+func (Admin) Notices(ctx context.Context) []config.Notice {
+	l := mox.Conf.Notices()
+	if l == nil {
+		l = []config.Notice{}
+	}
+	return l
+}
+
+// NoticesSave replaces the configured notices.
+func (Admin) NoticesSave(ctx context.Context, notices []config.Notice) {
+	err := mox.NoticesSave(ctx, notices)
+	xcheckf(ctx, err, "saving notices")
+}
+
+// NoticesActive returns the texts of the notices currently active for the web
+// interfaces, for showing at the top of the admin web interface.
+func (Admin) NoticesActive(ctx context.Context) []string {
+	l := mox.Notices("web", requestListener(ctx), "")
+	if l == nil {
+		l = []string{}
+	}
+	return l
+}
+
 // SetAccountLimits set new limits on outgoing messages for an account.
 func (Admin) SetAccountLimits(ctx context.Context, accountName string, maxOutgoingMessagesPerDay, maxFirstTimeRecipientsPerDay int) {
 	err := mox.AccountLimitsSave(ctx, accountName, maxOutgoingMessagesPerDay, maxFirstTimeRecipientsPerDay)
 	xcheckf(ctx, err, "saving account limits")
 }
 
+// SetAccountSuspended suspends an account, rejecting authentication, or removes
+// the suspension. If tempfail is set, incoming messages are rejected with a
+// temporary error while the account is suspended or pending deletion.
+func (Admin) SetAccountSuspended(ctx context.Context, accountName string, suspended, tempfail bool) {
+	err := mox.AccountSuspendSave(ctx, accountName, suspended, tempfail)
+	xcheckf(ctx, err, "saving account suspension")
+}
+
+// ScheduleAccountRemoval schedules removal of an account and its messages after
+// a grace period of days. Until then, the account is treated as suspended.
+func (Admin) ScheduleAccountRemoval(ctx context.Context, accountName string, days int) {
+	if days < 0 {
+		panic(&sherpa.Error{Code: "user:error", Message: "days must be positive"})
+	}
+	err := mox.AccountDeletionSchedule(ctx, accountName, time.Now().Add(time.Duration(days)*24*time.Hour))
+	xcheckf(ctx, err, "scheduling account removal")
+}
+
+// CancelAccountRemoval cancels a scheduled removal of an account.
+func (Admin) CancelAccountRemoval(ctx context.Context, accountName string) {
+	err := mox.AccountDeletionSchedule(ctx, accountName, time.Time{})
+	xcheckf(ctx, err, "canceling account removal")
+}
+
+// DomainLimits returns the aggregate limits for the accounts of a domain, and
+// their current usage.
+func (Admin) DomainLimits(ctx context.Context, domain string) (limits config.DomainLimits, usage store.DomainUsage) {
+	d, err := dns.ParseDomain(domain)
+	xcheckf(ctx, err, "parsing domain")
+	dc, ok := mox.Conf.Domain(d)
+	if !ok {
+		xcheckf(ctx, errors.New("no such domain"), "looking up domain")
+	}
+	if dc.Limits != nil {
+		limits = *dc.Limits
+	}
+	usage, err = store.DomainUsageGather(ctx, xlog.WithContext(ctx), d)
+	xcheckf(ctx, err, "gathering usage of domain")
+	return
+}
+
+// SetDomainLimits sets new aggregate limits for the accounts of a domain. Zero
+// values mean no limit.
+func (Admin) SetDomainLimits(ctx context.Context, domain string, limits config.DomainLimits) {
+	d, err := dns.ParseDomain(domain)
+	xcheckf(ctx, err, "parsing domain")
+	err = mox.DomainLimitsSave(ctx, d, &limits)
+	xcheckf(ctx, err, "saving domain limits")
+}
+
 // ClientConfigDomain returns configurations for email clients, IMAP and
 // Submission (SMTP) for the domain.
 func (Admin) ClientConfigDomain(ctx context.Context, domain string) mox.ClientConfig {
@@ -1580,6 +1703,77 @@ func (Admin) QueueDrop(ctx context.Context, id int64) {
 	xcheckf(ctx, err, "drop message from queue")
 }
 
+// TraceLookup returns the trace events of a message, by trace ID or Message-ID
+// header, oldest first.
+func (Admin) TraceLookup(ctx context.Context, id string) []queue.TraceEvent {
+	id = strings.TrimSpace(id)
+	if id == "" {
+		panic(&sherpa.Error{Code: "user:error", Message: "trace id or message-id required"})
+	}
+	l, err := queue.TraceLookup(ctx, id)
+	xcheckf(ctx, err, "looking up trace events")
+	return l
+}
+
+// WebhookList returns the webhook requests that have not been delivered yet,
+// including those that failed permanently.
+func (Admin) WebhookList(ctx context.Context) []queue.Hook {
+	l, err := queue.HookList(ctx)
+	xcheckf(ctx, err, "listing webhook requests")
+	return l
+}
+
+// WebhookReplay sends a webhook request that failed permanently again.
+func (Admin) WebhookReplay(ctx context.Context, id int64) {
+	err := queue.HookReplay(ctx, id)
+	xcheckf(ctx, err, "replaying webhook request")
+}
+
+// MessagesFind returns the messages in all accounts matching the query.
+func (Admin) MessagesFind(ctx context.Context, query store.MessageQuery) []store.MessageMatch {
+	l, err := store.MessagesOperate(xlog.WithContext(ctx), query, store.MessageOpFind, "", false)
+	xcheckf(ctx, err, "finding messages")
+	return l
+}
+
+// MessagesDelete removes the messages matching the query from all accounts. With
+// dryRun, only the messages that would be removed are returned.
+func (Admin) MessagesDelete(ctx context.Context, query store.MessageQuery, dryRun bool) []store.MessageMatch {
+	l, err := store.MessagesOperate(xlog.WithContext(ctx), query, store.MessageOpDelete, "", dryRun)
+	xcheckf(ctx, err, "removing messages")
+	return l
+}
+
+// MessagesMove moves the messages matching the query to mailbox toMailbox,
+// created if needed. With dryRun, only the messages that would be moved are
+// returned.
+func (Admin) MessagesMove(ctx context.Context, query store.MessageQuery, toMailbox string, dryRun bool) []store.MessageMatch {
+	l, err := store.MessagesOperate(xlog.WithContext(ctx), query, store.MessageOpMove, toMailbox, dryRun)
+	xcheckf(ctx, err, "moving messages")
+	return l
+}
+
+// MessagesRedeliver moves the messages matching the query to the mailbox
+// selected by the current delivery rulesets for their recipient address. With
+// dryRun, only the messages that would be moved are returned.
+func (Admin) MessagesRedeliver(ctx context.Context, query store.MessageQuery, dryRun bool) []store.MessageMatch {
+	l, err := store.MessagesOperate(xlog.WithContext(ctx), query, store.MessageOpRedeliver, "", dryRun)
+	xcheckf(ctx, err, "redelivering messages")
+	return l
+}
+
+// MessagesTransfer copies the messages matching the query from the account in
+// the query to dstAccount, into mailbox dstMailbox, or into mailboxes with the
+// same name as in the source account if empty. If the query has only a mailbox
+// set, all messages in the mailbox are transferred. With move, the messages are
+// removed from the source account. With dryRun, only the messages that would be
+// transferred are returned.
+func (Admin) MessagesTransfer(ctx context.Context, query store.MessageQuery, dstAccount, dstMailbox string, move, dryRun bool) []store.MessageMatch {
+	l, err := store.MessagesTransfer(xlog.WithContext(ctx), query, dstAccount, dstMailbox, move, dryRun)
+	xcheckf(ctx, err, "transferring messages")
+	return l
+}
+
 // LogLevels returns the current log levels.
 func (Admin) LogLevels(ctx context.Context) map[string]string {
 	m := map[string]string{}
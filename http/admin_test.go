@@ -5,6 +5,7 @@ import (
 	"net"
 	"net/http/httptest"
 	"os"
+	"reflect"
 	"testing"
 	"time"
 
@@ -130,3 +131,20 @@ func TestCheckDomain(t *testing.T) {
 	Admin{}.Domains(ctxbg)        // todo: check results
 	dnsblsStatus(ctxbg, resolver) // todo: check results
 }
+
+func TestSetupACMEHosts(t *testing.T) {
+	mox.Conf.Static.HostnameDomain = dns.Domain{ASCII: "mail.mox.example"}
+	mox.Conf.Static.Listeners = map[string]config.Listener{
+		"public":   {TLS: &config.TLS{ACME: "letsencrypt"}},
+		"other":    {TLS: &config.TLS{ACME: "letsencrypt"}, HostnameDomain: dns.Domain{ASCII: "other.mox.example"}},
+		"internal": {},
+	}
+	hosts := setupACMEHosts()
+	exp := map[dns.Domain]string{
+		{ASCII: "mail.mox.example"}:  "letsencrypt",
+		{ASCII: "other.mox.example"}: "letsencrypt",
+	}
+	if !reflect.DeepEqual(hosts, exp) {
+		t.Fatalf("got acme hosts %v, expected %v", hosts, exp)
+	}
+}
@@ -0,0 +1,132 @@
+package http
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/mjl-/sherpa"
+
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/mlog"
+	mox "github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/queue"
+	"github.com/mjl-/mox/smtp"
+)
+
+// The setup wizard in the admin web interface walks through the same steps as
+// the quickstart: checking the hostname, adding the first domain and account,
+// adding DNS records, getting TLS certificates and sending a test message. The
+// domain, account and DNS steps use the regular API functions.
+
+// SetupStatus is the state of the configuration of the server, for the setup
+// wizard.
+type SetupStatus struct {
+	Hostname      dns.Domain   // Hostname of this mail server, from mox.conf.
+	HostnameIPs   []string     // IPs the hostname resolves to.
+	HostnameError string       // Error resolving the hostname, if any.
+	ListenIPs     []string     // IPs of listeners with SMTP enabled, the hostname should resolve to these, unless NATed.
+	ACMEHosts     []dns.Domain // Hostnames of listeners that get TLS certificates through ACME.
+}
+
+// SetupStatus returns the hostname and its IPs, and the hostnames with
+// certificates through ACME, for the setup wizard.
+func (Admin) SetupStatus(ctx context.Context) (status SetupStatus) {
+	status.Hostname = mox.Conf.Static.HostnameDomain
+
+	resolver := dns.StrictResolver{Pkg: "setup"}
+	nctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	ips, err := resolver.LookupIPAddr(nctx, status.Hostname.ASCII+".")
+	if err != nil {
+		status.HostnameError = err.Error()
+	}
+	for _, ip := range ips {
+		status.HostnameIPs = append(status.HostnameIPs, ip.IP.String())
+	}
+
+	seen := map[string]bool{}
+	for _, l := range mox.Conf.Static.Listeners {
+		if l.SMTP.Enabled && !l.IPsNATed {
+			for _, ip := range l.IPs {
+				if !seen[ip] {
+					seen[ip] = true
+					status.ListenIPs = append(status.ListenIPs, ip)
+				}
+			}
+		}
+	}
+	sort.Strings(status.ListenIPs)
+
+	for host := range setupACMEHosts() {
+		status.ACMEHosts = append(status.ACMEHosts, host)
+	}
+	sort.Slice(status.ACMEHosts, func(i, j int) bool {
+		return status.ACMEHosts[i].Name() < status.ACMEHosts[j].Name()
+	})
+	return
+}
+
+// setupACMEHosts returns the hostnames of listeners with TLS through ACME, with
+// the name of their ACME provider.
+func setupACMEHosts() map[dns.Domain]string {
+	hosts := map[dns.Domain]string{}
+	for _, l := range mox.Conf.Static.Listeners {
+		if l.TLS == nil || l.TLS.ACME == "" {
+			continue
+		}
+		host := l.HostnameDomain
+		if host.IsZero() {
+			host = mox.Conf.Static.HostnameDomain
+		}
+		hosts[host] = l.TLS.ACME
+	}
+	return hosts
+}
+
+// SetupTLS requests TLS certificates through ACME for the hostnames of
+// listeners, if not present yet. For each hostname, an error message is
+// returned, empty if a certificate is present.
+func (Admin) SetupTLS(ctx context.Context) (hostErrors map[string]string) {
+	hosts := setupACMEHosts()
+	if len(hosts) == 0 {
+		panic(&sherpa.Error{Code: "user:error", Message: "no listeners with tls through acme configured"})
+	}
+	hostErrors = map[string]string{}
+	for host, acmeName := range hosts {
+		acme, ok := mox.Conf.Static.ACME[acmeName]
+		if !ok || acme.Manager == nil {
+			hostErrors[host.Name()] = "acme provider not initialized"
+			continue
+		}
+		if err := acme.Manager.EnsureCertificate(host); err != nil {
+			xlog.WithContext(ctx).Errorx("requesting certificate through acme", err, mlog.Field("host", host))
+			hostErrors[host.Name()] = err.Error()
+		} else {
+			hostErrors[host.Name()] = ""
+		}
+	}
+	return hostErrors
+}
+
+// SetupTestMessage sends a test message from an address of an account to
+// another address through the queue. The DKIM, SPF and DMARC records of the
+// from domain are verified. For a local "to" address, the wizard waits for the
+// message to be delivered back to this server, and checks its authentication
+// results. Problems found are returned, none means all checks passed.
+func (Admin) SetupTestMessage(ctx context.Context, from, to string) (problems []string) {
+	fromAddr, err := smtp.ParseAddress(from)
+	if err != nil {
+		panic(&sherpa.Error{Code: "user:error", Message: "parsing from address: " + err.Error()})
+	}
+	toAddr, err := smtp.ParseAddress(to)
+	if err != nil {
+		panic(&sherpa.Error{Code: "user:error", Message: "parsing to address: " + err.Error()})
+	}
+	resolver := dns.StrictResolver{Pkg: "setup"}
+	problems = queue.SelfCheck(ctx, xlog.WithContext(ctx), resolver, fromAddr, toAddr, time.Minute)
+	if problems == nil {
+		problems = []string{}
+	}
+	return problems
+}
@@ -4,6 +4,9 @@ import (
 	"encoding/xml"
 	"fmt"
 	"net/http"
+	"sort"
+
+	"golang.org/x/exp/maps"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -139,6 +142,27 @@ func autoconfHandle(w http.ResponseWriter, r *http.Request) {
 	resp.EmailProvider.OutgoingServer.Username = email
 	resp.EmailProvider.OutgoingServer.Authentication = "password-encrypted"
 
+	// Point to the account web interface, with a description in the language
+	// preferred by the client, or the language of the domain.
+	names := maps.Keys(mox.Conf.Static.Listeners)
+	sort.Strings(names)
+	for _, name := range names {
+		l := mox.Conf.Static.Listeners[name]
+		if !l.AccountHTTPS.Enabled {
+			continue
+		}
+		path := l.AccountHTTPS.Path
+		if path == "" {
+			path = "/"
+		}
+		lang := mox.AcceptLanguage(r.Header.Get("Accept-Language"), mox.DomainLanguage(addr.Domain))
+		doc := &autoconfigDocumentation{URL: fmt.Sprintf("https://%s%s", hostname.ASCII, path)}
+		doc.Descr.Lang = lang
+		doc.Descr.Text = mox.Text(lang, "autoconfig-documentation", "domain", addr.Domain.Name())
+		resp.EmailProvider.Documentation = doc
+		break
+	}
+
 	// todo: should we put the email address in the URL?
 	resp.ClientConfigUpdate.URL = fmt.Sprintf("https://%s/mail/config-v1.1.xml", hostname.ASCII)
 
@@ -319,6 +343,8 @@ type autoconfigResponse struct {
 			Username       string `xml:"username"`
 			Authentication string `xml:"authentication"`
 		} `xml:"outgoingServer"`
+
+		Documentation *autoconfigDocumentation `xml:"documentation,omitempty"`
 	} `xml:"emailProvider"`
 
 	ClientConfigUpdate struct {
@@ -326,6 +352,14 @@ type autoconfigResponse struct {
 	} `xml:"clientConfigUpdate"`
 }
 
+type autoconfigDocumentation struct {
+	URL   string `xml:"url,attr"`
+	Descr struct {
+		Lang string `xml:"lang,attr"`
+		Text string `xml:",chardata"`
+	} `xml:"descr"`
+}
+
 type autodiscoverRequest struct {
 	XMLName xml.Name `xml:"Autodiscover"`
 	Request struct {
@@ -0,0 +1,278 @@
+package http
+
+import (
+	"bytes"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// HTML parts of messages are sanitized before they are shown in the account web
+// interface. Scripts, active content and everything that can make requests
+// without the user knowing are removed. Remote images are only loaded through the
+// image proxy, and only when the user allows remote content. Tracking pixels are
+// always removed. This is on top of a strict Content-Security-Policy for the page.
+
+// Elements that are removed, including their content.
+var sanitizeDropContent = map[atom.Atom]bool{
+	atom.Script:   true,
+	atom.Style:    true,
+	atom.Iframe:   true,
+	atom.Frame:    true,
+	atom.Frameset: true,
+	atom.Object:   true,
+	atom.Embed:    true,
+	atom.Applet:   true,
+	atom.Noscript: true,
+	atom.Template: true,
+	atom.Svg:      true,
+	atom.Math:     true,
+	atom.Audio:    true,
+	atom.Video:    true,
+	atom.Title:    true,
+	atom.Select:   true,
+	atom.Textarea: true,
+}
+
+// Elements that are removed, but their content is kept.
+var sanitizeDropTag = map[atom.Atom]bool{
+	atom.Html:   true,
+	atom.Head:   true,
+	atom.Body:   true,
+	atom.Meta:   true,
+	atom.Link:   true,
+	atom.Base:   true,
+	atom.Form:   true,
+	atom.Input:  true,
+	atom.Button: true,
+	atom.Source: true,
+	atom.Track:  true,
+}
+
+// Attributes that can contain URLs. Only href and src are kept, with safe values.
+var sanitizeURLAttrs = map[string]bool{
+	"href":       true,
+	"src":        true,
+	"srcset":     true,
+	"action":     true,
+	"formaction": true,
+	"background": true,
+	"poster":     true,
+	"lowsrc":     true,
+	"dynsrc":     true,
+	"ping":       true,
+	"xlink:href": true,
+	"cite":       true,
+	"longdesc":   true,
+	"usemap":     true,
+	"data":       true,
+	"codebase":   true,
+}
+
+// htmlSanitizeResult describes what was removed from an HTML part.
+type htmlSanitizeResult struct {
+	RemoteBlocked   int // Remote images not loaded because remote content is not allowed.
+	TrackingBlocked int // Likely tracking pixels, always removed.
+
+	ContentIDs []string // Referenced with cid: image URLs, without <>, if kept.
+}
+
+// sanitizeHTML writes a sanitized version of the HTML read from r to w. If
+// proxy is nil, remote images are not loaded, their URL is kept in a
+// "data-remote-src" attribute. Otherwise proxy returns the URL through which a
+// remote image is loaded. If keepCID is set, images referencing other parts of
+// the message with cid: URLs are kept, e.g. for quoting in a reply.
+func sanitizeHTML(r io.Reader, w io.Writer, proxy func(u *url.URL) string, keepCID bool) (htmlSanitizeResult, error) {
+	var result htmlSanitizeResult
+	z := html.NewTokenizer(r)
+	var dropDepth int // Nesting of elements whose content is dropped.
+	var dropAtom atom.Atom
+	var b bytes.Buffer
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if z.Err() == io.EOF {
+				break
+			}
+			return result, z.Err()
+		}
+		tok := z.Token()
+
+		if dropDepth > 0 {
+			if tok.DataAtom == dropAtom {
+				switch tt {
+				case html.StartTagToken:
+					dropDepth++
+				case html.EndTagToken:
+					dropDepth--
+				}
+			}
+			continue
+		}
+
+		switch tt {
+		case html.CommentToken, html.DoctypeToken:
+			continue
+		case html.TextToken:
+			b.WriteString(html.EscapeString(tok.Data))
+			continue
+		}
+
+		if sanitizeDropContent[tok.DataAtom] {
+			if tt == html.StartTagToken {
+				dropDepth = 1
+				dropAtom = tok.DataAtom
+			}
+			continue
+		}
+		// Namespaced elements, e.g. "o:p" from Office, are dropped too.
+		if sanitizeDropTag[tok.DataAtom] || tok.DataAtom == 0 && strings.Contains(tok.Data, ":") {
+			continue
+		}
+		if tt == html.EndTagToken {
+			b.WriteString(tok.String())
+			continue
+		}
+
+		if tok.DataAtom == atom.Img {
+			if !sanitizeImage(&tok, proxy, keepCID, &result) {
+				continue
+			}
+		} else {
+			tok.Attr = sanitizeAttrs(tok.Attr, tok.DataAtom == atom.A)
+		}
+		if tok.DataAtom == atom.A {
+			tok.Attr = append(tok.Attr, html.Attribute{Key: "target", Val: "_blank"}, html.Attribute{Key: "rel", Val: "noopener noreferrer"})
+		}
+		b.WriteString(tok.String())
+	}
+	_, err := w.Write(b.Bytes())
+	return result, err
+}
+
+// sanitizeAttrs removes event handlers, styles that can load resources, and
+// unsafe URLs. Only a href is kept, if allowHref is set.
+func sanitizeAttrs(attrs []html.Attribute, allowHref bool) []html.Attribute {
+	var l []html.Attribute
+	for _, a := range attrs {
+		k := strings.ToLower(a.Key)
+		if a.Namespace != "" || strings.HasPrefix(k, "on") || k == "target" || k == "rel" {
+			continue
+		}
+		if k == "style" && !safeStyle(a.Val) {
+			continue
+		}
+		if sanitizeURLAttrs[k] {
+			if k != "href" || !allowHref || !safeLink(a.Val) {
+				continue
+			}
+		}
+		l = append(l, html.Attribute{Key: k, Val: a.Val})
+	}
+	return l
+}
+
+// sanitizeImage rewrites the src of an image, returning false if the image must
+// be dropped.
+func sanitizeImage(tok *html.Token, proxy func(u *url.URL) string, keepCID bool, result *htmlSanitizeResult) bool {
+	var src, width, height, style string
+	for _, a := range tok.Attr {
+		switch strings.ToLower(a.Key) {
+		case "src":
+			src = strings.TrimSpace(a.Val)
+		case "width":
+			width = a.Val
+		case "height":
+			height = a.Val
+		case "style":
+			style = a.Val
+		}
+	}
+	attrs := sanitizeAttrs(tok.Attr, false)
+
+	lsrc := strings.ToLower(src)
+	switch {
+	case strings.HasPrefix(lsrc, "data:image/") && !strings.HasPrefix(lsrc, "data:image/svg"):
+		tok.Attr = append(attrs, html.Attribute{Key: "src", Val: src})
+		return true
+	case keepCID && strings.HasPrefix(lsrc, "cid:") && len(src) > 4:
+		if cid, err := url.PathUnescape(src[4:]); err == nil {
+			tok.Attr = append(attrs, html.Attribute{Key: "src", Val: src})
+			result.ContentIDs = append(result.ContentIDs, cid)
+			return true
+		}
+		tok.Attr = attrs
+		return true
+	case strings.HasPrefix(lsrc, "http://"), strings.HasPrefix(lsrc, "https://"), strings.HasPrefix(lsrc, "//"):
+	default:
+		// Relative URLs and cid: references can't be loaded.
+		tok.Attr = attrs
+		return true
+	}
+
+	if trackingPixel(width, height, style) {
+		result.TrackingBlocked++
+		return false
+	}
+	u, err := url.Parse(src)
+	if err != nil {
+		return false
+	}
+	if u.Scheme == "" {
+		u.Scheme = "https"
+	}
+	if proxy == nil {
+		result.RemoteBlocked++
+		tok.Attr = append(attrs, html.Attribute{Key: "data-remote-src", Val: u.String()})
+		return true
+	}
+	tok.Attr = append(attrs, html.Attribute{Key: "src", Val: proxy(u)})
+	return true
+}
+
+// trackingPixel returns whether an image is likely used for tracking: tiny or
+// hidden.
+func trackingPixel(width, height, style string) bool {
+	tiny := func(s string) bool {
+		s = strings.TrimSuffix(strings.TrimSpace(s), "px")
+		v, err := strconv.ParseFloat(s, 64)
+		return err == nil && v <= 2
+	}
+	if tiny(width) || tiny(height) {
+		return true
+	}
+	style = strings.ReplaceAll(strings.ToLower(style), " ", "")
+	return strings.Contains(style, "display:none") || strings.Contains(style, "visibility:hidden") || strings.Contains(style, "width:0") || strings.Contains(style, "height:0") || strings.Contains(style, "width:1px") || strings.Contains(style, "height:1px")
+}
+
+// safeStyle returns whether an inline style cannot load resources or break out of
+// the message.
+func safeStyle(s string) bool {
+	s = strings.ToLower(s)
+	for _, bad := range []string{"url(", "expression(", "@import", "javascript:", "behavior:", "position:fixed", "position: fixed", "\\"} {
+		if strings.Contains(s, bad) {
+			return false
+		}
+	}
+	return true
+}
+
+// safeLink returns whether a link target can be used in a href.
+func safeLink(s string) bool {
+	u, err := url.Parse(strings.TrimSpace(s))
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https", "mailto":
+		return true
+	case "":
+		// Fragments within the message.
+		return strings.HasPrefix(strings.TrimSpace(s), "#")
+	}
+	return false
+}
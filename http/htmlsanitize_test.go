@@ -0,0 +1,85 @@
+package http
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeHTML(t *testing.T) {
+	testCID := func(proxy func(u *url.URL) string, keepCID bool, input, expect string, expResult htmlSanitizeResult) {
+		t.Helper()
+		var b bytes.Buffer
+		result, err := sanitizeHTML(strings.NewReader(input), &b, proxy, keepCID)
+		tcheck(t, err, "sanitize")
+		if b.String() != expect || !reflect.DeepEqual(result, expResult) {
+			t.Fatalf("sanitize %q:\ngot      %q %v\nexpected %q %v", input, b.String(), result, expect, expResult)
+		}
+	}
+	test := func(proxy func(u *url.URL) string, input, expect string, expResult htmlSanitizeResult) {
+		t.Helper()
+		testCID(proxy, false, input, expect, expResult)
+	}
+	proxy := func(u *url.URL) string {
+		return "/proxy?url=" + url.QueryEscape(u.String())
+	}
+
+	test(nil, `<html><head><title>x</title><style>body { background: url(https://track.example/) }</style></head><body><p onclick="alert(1)">hi</p></body></html>`, `<p>hi</p>`, htmlSanitizeResult{})
+	test(nil, `<script>alert(1)</script><b>bold</b><!-- comment -->`, `<b>bold</b>`, htmlSanitizeResult{})
+	test(nil, `<a href="javascript:alert(1)">x</a><a href="https://mox.example/">y</a>`, `<a target="_blank" rel="noopener noreferrer">x</a><a href="https://mox.example/" target="_blank" rel="noopener noreferrer">y</a>`, htmlSanitizeResult{})
+	test(nil, `<div style="background-image: url(https://track.example/)">x</div><span style="color: red">y</span>`, `<div>x</div><span style="color: red">y</span>`, htmlSanitizeResult{})
+	test(nil, `<iframe src="https://evil.example/"><p>nested</p></iframe><form action="https://evil.example/"><input name="x"></form>`, ``, htmlSanitizeResult{})
+
+	// Remote images are not loaded without proxy, tracking pixels always removed.
+	test(nil, `<img src="https://mox.example/logo.png" alt="logo"><img src="https://track.example/p.gif" width="1" height="1">`, `<img alt="logo" data-remote-src="https://mox.example/logo.png">`, htmlSanitizeResult{RemoteBlocked: 1, TrackingBlocked: 1})
+	test(proxy, `<img src="https://mox.example/logo.png" alt="logo"><img src="https://track.example/p.gif" style="display: none">`, `<img alt="logo" src="/proxy?url=https%3A%2F%2Fmox.example%2Flogo.png">`, htmlSanitizeResult{TrackingBlocked: 1})
+	test(proxy, `<img src="data:image/png;base64,AAAA"><img src="data:image/svg+xml,x"><img src="cid:part1">`, `<img src="data:image/png;base64,AAAA"><img><img>`, htmlSanitizeResult{})
+
+	// Inline images are kept when quoting a message.
+	testCID(nil, true, `<img src="cid:part1%40mox.example" alt="x">`, `<img alt="x" src="cid:part1%40mox.example">`, htmlSanitizeResult{ContentIDs: []string{"part1@mox.example"}})
+}
+
+func TestImageProxy(t *testing.T) {
+	images := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Cookie") != "" || r.Header.Get("Referer") != "" {
+			t.Errorf("image proxy passed on identifying headers")
+		}
+		switch r.URL.Path {
+		case "/image.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("png"))
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html>"))
+		}
+	}))
+	defer images.Close()
+
+	test := func(rawURL string, expCode int) {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/imageproxy?url="+url.QueryEscape(rawURL), nil)
+		r.Header.Set("Cookie", "session=secret")
+		w := httptest.NewRecorder()
+		imageProxyHandle(ctxbg, xlog, w, r)
+		if w.Code != expCode {
+			t.Fatalf("%s: got status %d, expected %d", rawURL, w.Code, expCode)
+		}
+	}
+
+	// Test server is on loopback, which is not allowed by default.
+	test(images.URL+"/image.png", http.StatusBadGateway)
+
+	allowIP := imageProxyAllowIP
+	imageProxyAllowIP = func(ip net.IP) bool { return true }
+	defer func() {
+		imageProxyAllowIP = allowIP
+	}()
+	test(images.URL+"/image.png", http.StatusOK)
+	test(images.URL+"/page.html", http.StatusBadGateway)
+	test("file:///etc/passwd", http.StatusBadRequest)
+}
@@ -0,0 +1,123 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+// Maximum size of an image fetched through the image proxy.
+const imageProxyMaxSize = 10 * 1024 * 1024
+
+// imageProxyAllowIP returns whether the image proxy can connect to an IP. Only
+// global unicast addresses are allowed, so the proxy cannot be used to reach
+// internal services. Variable for tests.
+var imageProxyAllowIP = func(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+var imageProxyClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !imageProxyAllowIP(ip) {
+					return fmt.Errorf("connecting to %s not allowed", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 20 * time.Second,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       time.Minute,
+	},
+}
+
+// imageProxyURL returns the URL to load a remote image through: the configured
+// external proxy, or the built-in proxy with a URL relative to the HTML page of a
+// message in the account web interface.
+func imageProxyURL(u *url.URL) string {
+	if prefix := mox.Conf.Static.ImageProxyURL; prefix != "" {
+		return prefix + url.QueryEscape(u.String())
+	}
+	return "../../imageproxy?url=" + url.QueryEscape(u.String())
+}
+
+// imageProxyOrigin returns the origin for the Content-Security-Policy of HTML
+// pages of messages, to allow images loaded through the proxy.
+func imageProxyOrigin() string {
+	if prefix := mox.Conf.Static.ImageProxyURL; prefix != "" {
+		if u, err := url.Parse(prefix); err == nil && u.Host != "" {
+			return u.Scheme + "://" + u.Host
+		}
+	}
+	return "'self'"
+}
+
+// imageProxyHandle fetches a remote image for the account web interface. No
+// request headers of the user are passed on, so the remote server does not learn
+// about the IP, browser or cookies of the user. Only images are returned.
+func imageProxyHandle(ctx context.Context, log *mlog.Log, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "405 - method not allowed - get required", http.StatusMethodNotAllowed)
+		return
+	}
+	u, err := url.Parse(r.URL.Query().Get("url"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		http.Error(w, "400 - bad request - bad url", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		http.Error(w, "400 - bad request - bad url", http.StatusBadRequest)
+		return
+	}
+	req.Header.Set("User-Agent", "mox-imageproxy")
+	req.Header.Set("Accept", "image/*")
+	resp, err := imageProxyClient.Do(req)
+	if err != nil {
+		log.Debugx("fetching remote image", err, mlog.Field("url", u.String()))
+		http.Error(w, "502 - bad gateway - fetching image failed", http.StatusBadGateway)
+		return
+	}
+	defer func() {
+		err := resp.Body.Close()
+		log.Check(err, "closing response body")
+	}()
+
+	ct := strings.ToLower(strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0]))
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(ct, "image/") || strings.HasPrefix(ct, "image/svg") {
+		http.Error(w, "502 - bad gateway - remote did not return an image", http.StatusBadGateway)
+		return
+	}
+	if resp.ContentLength > imageProxyMaxSize {
+		http.Error(w, "502 - bad gateway - image too large", http.StatusBadGateway)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", ct)
+	h.Set("Cache-Control", "private, max-age=86400")
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Content-Security-Policy", "default-src 'none'")
+	_, err = io.Copy(w, io.LimitReader(resp.Body, imageProxyMaxSize))
+	log.Check(err, "copying remote image")
+}
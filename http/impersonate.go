@@ -0,0 +1,201 @@
+package http
+
+import (
+	"context"
+	cryptrand "crypto/rand"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/queue"
+	"github.com/mjl-/mox/smtp"
+	"github.com/mjl-/mox/store"
+)
+
+// Impersonation lets an admin open a read-only session in the account web
+// interface of an account, e.g. to help debug delivery problems, without knowing
+// or resetting the password of the account. An admin starts an impersonation
+// through the admin web interface, which returns a URL with a token. Opening that
+// URL sets a cookie with the token, which is accepted instead of the account
+// credentials until the token expires. Impersonation is logged, and the account
+// can be notified with a message in its Inbox.
+
+const (
+	impersonateLifetime = time.Hour
+	impersonateCookie   = "moximpersonate"
+)
+
+type impersonation struct {
+	Account string
+	Reason  string
+	Expires time.Time
+}
+
+var impersonations = struct {
+	sync.Mutex
+	tokens map[string]impersonation
+}{
+	tokens: map[string]impersonation{},
+}
+
+// Account API functions that can be called in an impersonated session. All other
+// functions are refused.
+var impersonateReadOnly = map[string]bool{
+	"BlockedSenders":    true,
+	"Correspondents":    true,
+	"DeliveryStatus":    true,
+	"Destinations":      true,
+	"Mailboxes":         true,
+	"ModerationPending": true,
+	"MutedThreads":      true,
+	"Notices":           true,
+	"PushConfig":        true,
+	"PushSubscriptions": true,
+	"SendAs":            true,
+	"SendDelegates":     true,
+	"Settings":          true,
+	"Storage":           true,
+	"SweepRules":        true,
+}
+
+// impersonateStart creates a new impersonation token for the account. If notify is
+// set, a message about the impersonation is delivered to the Inbox of the account.
+func impersonateStart(log *mlog.Log, accountName, reason string, notify bool) (string, error) {
+	if _, ok := mox.Conf.Account(accountName); !ok {
+		return "", fmt.Errorf("%w: %q", store.ErrAccountUnknown, accountName)
+	}
+
+	buf := make([]byte, 16)
+	if _, err := cryptrand.Read(buf); err != nil {
+		return "", err
+	}
+	token := fmt.Sprintf("%x", buf)
+	imp := impersonation{accountName, reason, time.Now().Add(impersonateLifetime)}
+
+	if notify {
+		if err := impersonateNotify(log, imp); err != nil {
+			return "", fmt.Errorf("notifying account: %w", err)
+		}
+	}
+
+	impersonations.Lock()
+	defer impersonations.Unlock()
+	now := time.Now()
+	for t, i := range impersonations.tokens {
+		if now.After(i.Expires) {
+			delete(impersonations.tokens, t)
+		}
+	}
+	impersonations.tokens[token] = imp
+	log.Info("admin impersonation of account started", mlog.Field("account", accountName), mlog.Field("reason", reason), mlog.Field("notify", notify), mlog.Field("expires", imp.Expires))
+	return token, nil
+}
+
+// impersonateNotify delivers a message to the Inbox of the account about the
+// impersonation.
+func impersonateNotify(log *mlog.Log, imp impersonation) error {
+	reason := imp.Reason
+	if reason == "" {
+		reason = "(none given)"
+	}
+	lang := mox.AccountLanguage(imp.Account)
+	subject := mox.Text(lang, "impersonate-subject")
+	body := mox.Text(lang, "impersonate-body", "expires", imp.Expires.Format(message.RFC5322Z), "reason", reason)
+	data := append(queue.NotificationHeaders(smtp.Address{}, subject), "\r\n"...)
+	data = append(data, strings.ReplaceAll(body, "\n", "\r\n")...)
+	n := queue.Notification{
+		Kind:    "impersonate",
+		Account: imp.Account,
+		Flags:   store.Flags{Flagged: true},
+		Data:    data,
+	}
+	return queue.Notify(context.Background(), log, n)
+}
+
+// impersonateAccount returns the account name for an impersonation token, if the
+// token exists and has not expired.
+func impersonateAccount(token string) (string, bool) {
+	impersonations.Lock()
+	defer impersonations.Unlock()
+	imp, ok := impersonations.tokens[token]
+	if !ok || time.Now().After(imp.Expires) {
+		return "", false
+	}
+	return imp.Account, true
+}
+
+// impersonateHandle handles the URL for starting an impersonated session, and
+// checks requests in an impersonated session. It returns the impersonated account
+// name if the request should be handled further. If the empty string is returned,
+// the request was either not for an impersonated session, or a response has been
+// written and the handled value is true.
+func impersonateHandle(ctx context.Context, log *mlog.Log, w http.ResponseWriter, r *http.Request) (accName string, handled bool) {
+	if r.URL.Path == "/impersonate" {
+		token := r.URL.Query().Get("token")
+		if _, ok := impersonateAccount(token); !ok {
+			http.Error(w, "400 - bad request - unknown or expired impersonation token", http.StatusBadRequest)
+			return "", true
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     impersonateCookie,
+			Value:    token,
+			Path:     impersonateCookiePath(r),
+			Expires:  time.Now().Add(impersonateLifetime),
+			Secure:   r.TLS != nil,
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+		http.Redirect(w, r, "./", http.StatusSeeOther)
+		return "", true
+	}
+
+	c, err := r.Cookie(impersonateCookie)
+	if err != nil {
+		return "", false
+	}
+	accName, ok := impersonateAccount(c.Value)
+	if !ok {
+		http.SetCookie(w, &http.Cookie{
+			Name:     impersonateCookie,
+			Value:    "",
+			Path:     impersonateCookiePath(r),
+			MaxAge:   -1,
+			Secure:   r.TLS != nil,
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+		return "", false
+	}
+
+	log.Info("impersonated account request", mlog.Field("account", accName), mlog.Field("method", r.Method), mlog.Field("path", r.URL.Path))
+
+	// Only the index page and read-only API functions. Sherpa paths that are not
+	// functions, such as the javascript client, start with a lower case letter or
+	// underscore.
+	readonly := r.URL.Path == "/"
+	if fn := strings.TrimPrefix(r.URL.Path, "/api/"); fn != r.URL.Path {
+		readonly = fn == "" || fn[0] < 'A' || fn[0] > 'Z' || impersonateReadOnly[fn]
+	}
+	if !readonly {
+		http.Error(w, "403 - forbidden - not allowed in read-only impersonated session", http.StatusForbidden)
+		return "", true
+	}
+	return accName, false
+}
+
+// impersonateCookiePath returns the path for the impersonation cookie, the path
+// at which the account web interface is served. We are behind a
+// http.StripPrefix, so the path is taken from the original request URI.
+func impersonateCookiePath(r *http.Request) string {
+	u, err := url.Parse(r.RequestURI)
+	if err != nil {
+		return "/"
+	}
+	return strings.TrimSuffix(u.Path, r.URL.Path) + "/"
+}
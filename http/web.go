@@ -4,6 +4,7 @@
 package http
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
 	"fmt"
@@ -25,6 +26,7 @@ import (
 	"github.com/mjl-/mox/autotls"
 	"github.com/mjl-/mox/config"
 	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/jmapserver"
 	"github.com/mjl-/mox/mlog"
 	"github.com/mjl-/mox/mox-"
 	"github.com/mjl-/mox/ratelimit"
@@ -93,6 +95,25 @@ func (w *loggingWriter) Flush() {
 	w.W.Flush()
 }
 
+// Hijack takes over the connection, for websocket handlers such as for JMAP. The
+// handler writes the response itself, so we assume the switch to the websocket
+// protocol succeeds.
+func (w *loggingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.W.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection not a http.Hijacker (%T)", w.W)
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		w.error(err)
+		return nil, nil, err
+	}
+	w.WebsocketRequest = true
+	w.WebsocketResponse = true
+	w.setStatusCode(http.StatusSwitchingProtocols)
+	return conn, brw, nil
+}
+
 func (w *loggingWriter) Header() http.Header {
 	return w.W.Header()
 }
@@ -235,6 +256,17 @@ type serve struct {
 	TLSConfig    *tls.Config
 	PathHandlers []pathHandler // Sorted, longest first.
 	Webserver    bool          // Whether serving WebHandler. PathHandlers are always evaluated before WebHandlers.
+	Listener     string        // Name of listener, for selecting notices to show in the account and admin web interfaces.
+}
+
+// listenerCtxKey holds the name of the listener a request came in on.
+var listenerCtxKey ctxKey = "listener"
+
+// requestListener returns the name of the listener of the request, empty if
+// unknown.
+func requestListener(ctx context.Context) string {
+	name, _ := ctx.Value(listenerCtxKey).(string)
+	return name
 }
 
 // Handle registers a named handler for a path and optional host. If path ends with
@@ -284,6 +316,7 @@ func (s *serve) ServeHTTP(xw http.ResponseWriter, r *http.Request) {
 	}
 
 	ctx := context.WithValue(r.Context(), mlog.CidKey, mox.Cid())
+	ctx = context.WithValue(ctx, listenerCtxKey, s.Listener)
 	r = r.WithContext(ctx)
 
 	wf, ok := xw.(responseWriterFlusher)
@@ -360,7 +393,7 @@ func Listen() {
 		ensureServe = func(https bool, port int, kind string) *serve {
 			s := portServe[port]
 			if s == nil {
-				s = &serve{nil, nil, nil, false}
+				s = &serve{nil, nil, nil, false, name}
 				portServe[port] = s
 			}
 			s.Kinds = append(s.Kinds, kind)
@@ -376,7 +409,7 @@ func Listen() {
 			return s
 		}
 
-		if l.TLS != nil && l.TLS.ACME != "" && (l.SMTP.Enabled && !l.SMTP.NoSTARTTLS || l.Submissions.Enabled || l.IMAPS.Enabled) {
+		if l.TLS != nil && l.TLS.ACME != "" && (l.SMTP.Enabled && !l.SMTP.NoSTARTTLS || l.Submissions.Enabled || l.IMAPS.Enabled || l.POP3S.Enabled) {
 			port := config.Port(mox.Conf.Static.ACME[l.TLS.ACME].Port, 443)
 			ensureServe(true, port, "acme-tls-alpn-01")
 		}
@@ -404,6 +437,27 @@ func Listen() {
 			redirectToTrailingSlash(srv, "account", path)
 		}
 
+		if l.JMAPHTTP.Enabled {
+			port := config.Port(l.JMAPHTTP.Port, 80)
+			path := "/jmap/"
+			if l.JMAPHTTP.Path != "" {
+				path = l.JMAPHTTP.Path
+			}
+			srv := ensureServe(false, port, "jmap-http at "+path)
+			srv.Handle("jmap", nil, path, safeHeaders(jmapserver.Handler(path)))
+			srv.Handle("jmap", nil, "/.well-known/jmap", safeHeaders(jmapserver.WellKnownHandler(path)))
+		}
+		if l.JMAPHTTPS.Enabled {
+			port := config.Port(l.JMAPHTTPS.Port, 443)
+			path := "/jmap/"
+			if l.JMAPHTTPS.Path != "" {
+				path = l.JMAPHTTPS.Path
+			}
+			srv := ensureServe(true, port, "jmap-https at "+path)
+			srv.Handle("jmap", nil, path, safeHeaders(jmapserver.Handler(path)))
+			srv.Handle("jmap", nil, "/.well-known/jmap", safeHeaders(jmapserver.WellKnownHandler(path)))
+		}
+
 		if l.AdminHTTP.Enabled {
 			port := config.Port(l.AdminHTTP.Port, 80)
 			path := "/admin/"
@@ -467,7 +521,7 @@ func Listen() {
 			if _, ok := portServe[port]; ok {
 				xlog.Fatal("cannot serve pprof on same endpoint as other http services")
 			}
-			srv := &serve{[]string{"pprof-http"}, nil, nil, false}
+			srv := &serve{[]string{"pprof-http"}, nil, nil, false, ""}
 			portServe[port] = srv
 			srv.Handle("pprof", nil, "/", http.DefaultServeMux)
 		}
@@ -490,6 +544,11 @@ func Listen() {
 			if srv, ok := portServe[80]; ok && srv.TLSConfig == nil {
 				srv.Kinds = append(srv.Kinds, "acme-http-01")
 				srv.Handle("acme-http-01", nil, "/.well-known/acme-challenge/", m.Manager.HTTPHandler(nil))
+
+				// Consolidating requires http-01 validation.
+				if mox.Conf.Static.ACME[l.TLS.ACME].ConsolidateHostnames {
+					consolidateManagers[m] = true
+				}
 			}
 
 			hosts := map[dns.Domain]struct{}{
@@ -539,6 +598,10 @@ var servers []func()
 // the certificate to be given during the first https connection.
 var ensureManagerHosts = map[*autotls.Manager]map[dns.Domain]struct{}{}
 
+// Managers for which the hosts in ensureManagerHosts are first requested as a
+// single certificate.
+var consolidateManagers = map[*autotls.Manager]bool{}
+
 // listen prepares a listener, and adds it to "servers", to be launched (if not running as root) through Serve.
 func listen1(ip string, port int, tlsConfig *tls.Config, name string, kinds []string, handler http.Handler) {
 	addr := net.JoinHostPort(ip, fmt.Sprintf("%d", port))
@@ -551,19 +614,31 @@ func listen1(ip string, port int, tlsConfig *tls.Config, name string, kinds []st
 		if os.Getuid() == 0 {
 			xlog.Print("http listener", mlog.Field("name", name), mlog.Field("kinds", strings.Join(kinds, ",")), mlog.Field("address", addr))
 		}
-		ln, err = mox.Listen(mox.Network(ip), addr)
+		ln, err = mox.Listen(mox.Network(ip), addr, mox.Conf.Static.Listeners[name].SocketOptions)
 		if err != nil {
 			xlog.Fatalx("http: listen", err, mlog.Field("addr", addr))
 		}
+		ln = mox.LimitListener(ln, name)
 	} else {
 		protocol = "https"
 		if os.Getuid() == 0 {
 			xlog.Print("https listener", mlog.Field("name", name), mlog.Field("kinds", strings.Join(kinds, ",")), mlog.Field("address", addr))
 		}
-		ln, err = mox.Listen(mox.Network(ip), addr)
+		ln, err = mox.Listen(mox.Network(ip), addr, mox.Conf.Static.Listeners[name].SocketOptions)
 		if err != nil {
 			xlog.Fatalx("https: listen", err, mlog.Field("addr", addr))
 		}
+		ln = mox.LimitListener(ln, name)
+		// Offer HTTP/2 to clients, e.g. for gRPC through a WebForward. The ACME TLS
+		// config already has it.
+		var haveH2 bool
+		for _, p := range tlsConfig.NextProtos {
+			haveH2 = haveH2 || p == "h2"
+		}
+		if !haveH2 {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.NextProtos = append([]string{"h2", "http/1.1"}, tlsConfig.NextProtos...)
+		}
 		ln = tls.NewListener(ln, tlsConfig)
 	}
 
@@ -593,6 +668,23 @@ func Serve() {
 
 	go func() {
 		time.Sleep(1 * time.Second)
+
+		for m := range consolidateManagers {
+			var hosts []dns.Domain
+			for host := range ensureManagerHosts[m] {
+				hosts = append(hosts, host)
+			}
+			sort.Slice(hosts, func(i, j int) bool {
+				return hosts[i].Name() < hosts[j].Name()
+			})
+			ctx, cancel := context.WithTimeout(mox.Shutdown, 5*time.Minute)
+			err := m.ConsolidateHostnames(ctx, hosts)
+			cancel()
+			if err != nil {
+				xlog.Errorx("requesting certificate for multiple hostnames, continuing with certificate per hostname", err, mlog.Field("hostnames", hosts))
+			}
+		}
+
 		i := 0
 		for m, hosts := range ensureManagerHosts {
 			for host := range hosts {
@@ -607,18 +699,8 @@ func Serve() {
 				}
 				i++
 
-				hello := &tls.ClientHelloInfo{
-					ServerName: host.ASCII,
-
-					// Make us fetch an ECDSA P256 cert.
-					// We add TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 to get around the ecDSA check in autocert.
-					CipherSuites:      []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_AES_128_GCM_SHA256},
-					SupportedCurves:   []tls.CurveID{tls.CurveP256},
-					SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
-					SupportedVersions: []uint16{tls.VersionTLS13},
-				}
 				xlog.Print("ensuring certificate availability", mlog.Field("hostname", host))
-				if _, err := m.Manager.GetCertificate(hello); err != nil {
+				if err := m.EnsureCertificate(host); err != nil {
 					xlog.Errorx("requesting automatic certificate", err, mlog.Field("hostname", host))
 				}
 			}
@@ -0,0 +1,662 @@
+package http
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	cryptrand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/metrics"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/smtp"
+)
+
+// Authentication for WebHandlers, with HTTP basic authentication for accounts, or
+// with OpenID Connect. ../rfc/6749 https://openid.net/specs/openid-connect-core-1_0.html
+
+// webAuthKey signs the session and login state cookies. It is generated at
+// startup, so sessions end when mox restarts.
+var webAuthKey = func() []byte {
+	buf := make([]byte, 32)
+	if _, err := cryptrand.Read(buf); err != nil {
+		panic(fmt.Sprintf("generating key for web authentication cookies: %v", err))
+	}
+	return buf
+}()
+
+const webAuthSessionLifetime = 12 * time.Hour
+const webAuthStateLifetime = 15 * time.Minute
+
+// For passing the authenticated user from WebHandle to HandleForward.
+type webAuthUserKey struct{}
+
+// webAuthUser returns the email address of the user authenticated for the
+// request, if any.
+func webAuthUser(r *http.Request) string {
+	user, _ := r.Context().Value(webAuthUserKey{}).(string)
+	return user
+}
+
+// webAuthAllowed returns whether the user with email address addr may access the
+// handler.
+func webAuthAllowed(wa *config.WebAuth, addr smtp.Address) bool {
+	for _, a := range wa.AllowAddresses {
+		if a == addr {
+			return true
+		}
+	}
+	for _, d := range wa.AllowDomains {
+		if d == addr.Domain {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWebAuth checks authentication for a request for a WebHandler with Auth
+// set. If the request is authenticated and the user is allowed access, a request
+// to handle further is returned, with the user in its context, and without the
+// credentials. Otherwise, a response has been written and nil is returned.
+func checkWebAuth(h config.WebHandler, w http.ResponseWriter, r *http.Request) *http.Request {
+	log := xlog.WithContext(r.Context())
+
+	wa := h.Auth
+	var user string
+	if wa.BasicAuth {
+		_, address := checkBasicAuth(r.Context(), log, "httpwebhandler", "login with email address and password", w, r)
+		if address == "" {
+			return nil
+		}
+		addr, err := smtp.ParseAddress(address)
+		if err != nil || len(wa.Allow) > 0 && !webAuthAllowed(wa, addr) {
+			log.Info("authenticated user not allowed for webhandler", mlog.Field("handler", h.Name), mlog.Field("address", address))
+			http.Error(w, "403 - forbidden - no access for user"+recvid(r), http.StatusForbidden)
+			return nil
+		}
+		user = addr.String()
+	} else {
+		var ok bool
+		user, ok = oidcSession(wa, r)
+		if !ok {
+			if r.Method != "GET" && r.Method != "HEAD" {
+				http.Error(w, "401 - unauthorized - login required"+recvid(r), http.StatusUnauthorized)
+				return nil
+			}
+			oidcLogin(wa.OIDC, w, r)
+			return nil
+		}
+	}
+
+	// Don't pass our credentials on to anything we forward to.
+	nr := r.Clone(context.WithValue(r.Context(), webAuthUserKey{}, user))
+	if wa.BasicAuth {
+		nr.Header.Del("Authorization")
+	} else {
+		var cookies []string
+		name := oidcCookieName(wa.OIDC, "moxoidc")
+		for _, c := range r.Cookies() {
+			if c.Name != name {
+				cookies = append(cookies, c.String())
+			}
+		}
+		nr.Header.Del("Cookie")
+		if len(cookies) > 0 {
+			nr.Header.Set("Cookie", strings.Join(cookies, "; "))
+		}
+	}
+	return nr
+}
+
+// oidcCookieName returns the name for a session or state cookie for an OIDC
+// configuration, so multiple providers can be used on a single domain.
+func oidcCookieName(oidc *config.WebOIDC, prefix string) string {
+	h := sha256.Sum256([]byte(oidc.Issuer + "\n" + oidc.ClientID))
+	return fmt.Sprintf("%s-%x", prefix, h[:4])
+}
+
+// signedCookie returns a value with the JSON encoding of v, and a signature.
+func signedCookie(v any) string {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		panic(fmt.Sprintf("marshal cookie: %v", err))
+	}
+	mac := hmac.New(sha256.New, webAuthKey)
+	mac.Write(buf)
+	return base64.RawURLEncoding.EncodeToString(buf) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseSignedCookie verifies the signature of a cookie value from signedCookie,
+// and parses the JSON data into v.
+func parseSignedCookie(s string, v any) error {
+	t := strings.Split(s, ".")
+	if len(t) != 2 {
+		return errors.New("malformed cookie")
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(t[0])
+	if err != nil {
+		return fmt.Errorf("decoding cookie data: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(t[1])
+	if err != nil {
+		return fmt.Errorf("decoding cookie signature: %v", err)
+	}
+	mac := hmac.New(sha256.New, webAuthKey)
+	mac.Write(buf)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return errors.New("bad cookie signature")
+	}
+	return json.Unmarshal(buf, v)
+}
+
+// Session cookie value after login with OIDC.
+type oidcSessionCookie struct {
+	Email   string
+	Issuer  string
+	Expires int64
+}
+
+// Cookie value while logging in with OIDC.
+type oidcStateCookie struct {
+	State   string
+	Nonce   string
+	Return  string // Path, with query string, to redirect to after login.
+	Expires int64
+}
+
+// oidcSession returns the email address of the user of a valid session for the
+// OIDC configuration, if the user is allowed access.
+func oidcSession(wa *config.WebAuth, r *http.Request) (string, bool) {
+	c, err := r.Cookie(oidcCookieName(wa.OIDC, "moxoidc"))
+	if err != nil {
+		return "", false
+	}
+	var sc oidcSessionCookie
+	if err := parseSignedCookie(c.Value, &sc); err != nil {
+		xlog.WithContext(r.Context()).Debugx("parsing oidc session cookie", err)
+		return "", false
+	}
+	if sc.Issuer != wa.OIDC.Issuer || time.Now().Unix() > sc.Expires {
+		return "", false
+	}
+	addr, err := smtp.ParseAddress(sc.Email)
+	if err != nil || !webAuthAllowed(wa, addr) {
+		return "", false
+	}
+	return addr.String(), true
+}
+
+func randomToken() string {
+	buf := make([]byte, 16)
+	if _, err := cryptrand.Read(buf); err != nil {
+		panic(fmt.Sprintf("generating random token: %v", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// oidcRedirectURI returns the URL the provider must redirect back to after login.
+func oidcRedirectURI(oidc *config.WebOIDC, r *http.Request) string {
+	scheme := "https"
+	if r.TLS == nil {
+		scheme = "http"
+	}
+	return (&url.URL{Scheme: scheme, Host: r.Host, Path: oidc.CallbackPath}).String()
+}
+
+// oidcLogin starts a login with the OIDC provider, redirecting to its
+// authorization endpoint.
+func oidcLogin(oidc *config.WebOIDC, w http.ResponseWriter, r *http.Request) {
+	log := xlog.WithContext(r.Context())
+
+	p, err := oidcGetProvider(r.Context(), oidc.Issuer)
+	if err != nil {
+		log.Errorx("fetching oidc provider configuration", err, mlog.Field("issuer", oidc.Issuer))
+		http.Error(w, "502 - bad gateway - fetching login configuration"+recvid(r), http.StatusBadGateway)
+		return
+	}
+
+	sc := oidcStateCookie{
+		State:   randomToken(),
+		Nonce:   randomToken(),
+		Return:  r.URL.RequestURI(),
+		Expires: time.Now().Add(webAuthStateLifetime).Unix(),
+	}
+	// Lax, the cookie must be sent when the provider redirects back to us.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookieName(oidc, "moxoidcstate"),
+		Value:    signedCookie(sc),
+		Path:     "/",
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(webAuthStateLifetime / time.Second),
+	})
+
+	u, err := url.Parse(p.AuthorizationEndpoint)
+	if err != nil {
+		log.Errorx("parsing oidc authorization endpoint", err, mlog.Field("url", p.AuthorizationEndpoint))
+		http.Error(w, "502 - bad gateway - bad login configuration"+recvid(r), http.StatusBadGateway)
+		return
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", oidc.ClientID)
+	q.Set("redirect_uri", oidcRedirectURI(oidc, r))
+	q.Set("scope", "openid email")
+	q.Set("state", sc.State)
+	q.Set("nonce", sc.Nonce)
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+}
+
+// oidcCallback handles the redirect back from the provider after login, with an
+// authorization code that is exchanged for an ID token with the email address of
+// the user. On success, a session cookie is set and the user is redirected to
+// the originally requested path.
+func oidcCallback(wa *config.WebAuth, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := xlog.WithContext(ctx)
+	oidc := wa.OIDC
+
+	authResult := "error"
+	defer func() {
+		metrics.AuthenticationInc("httpwebhandler", "oidc", authResult)
+	}()
+
+	if r.Method != "GET" {
+		http.Error(w, "405 - method not allowed - get required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stateName := oidcCookieName(oidc, "moxoidcstate")
+	var sc oidcStateCookie
+	if c, err := r.Cookie(stateName); err != nil {
+		http.Error(w, "400 - bad request - no login in progress"+recvid(r), http.StatusBadRequest)
+		return
+	} else if err := parseSignedCookie(c.Value, &sc); err != nil || time.Now().Unix() > sc.Expires {
+		http.Error(w, "400 - bad request - login expired"+recvid(r), http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: stateName, Value: "", Path: "/", MaxAge: -1})
+
+	q := r.URL.Query()
+	if !hmac.Equal([]byte(q.Get("state")), []byte(sc.State)) {
+		http.Error(w, "400 - bad request - state mismatch"+recvid(r), http.StatusBadRequest)
+		return
+	}
+	if s := q.Get("error"); s != "" {
+		// ../rfc/6749:2158
+		authResult = "aborted"
+		log.Info("oidc login failed at provider", mlog.Field("error", s), mlog.Field("description", q.Get("error_description")))
+		http.Error(w, "403 - forbidden - login failed: "+s+recvid(r), http.StatusForbidden)
+		return
+	}
+	code := q.Get("code")
+	if code == "" {
+		http.Error(w, "400 - bad request - missing code"+recvid(r), http.StatusBadRequest)
+		return
+	}
+
+	p, err := oidcGetProvider(ctx, oidc.Issuer)
+	if err != nil {
+		log.Errorx("fetching oidc provider configuration", err, mlog.Field("issuer", oidc.Issuer))
+		http.Error(w, "502 - bad gateway - fetching login configuration"+recvid(r), http.StatusBadGateway)
+		return
+	}
+	idToken, err := oidcExchangeCode(ctx, p, oidc, code, oidcRedirectURI(oidc, r))
+	if err != nil {
+		log.Errorx("exchanging oidc authorization code for token", err, mlog.Field("issuer", oidc.Issuer))
+		http.Error(w, "502 - bad gateway - fetching token"+recvid(r), http.StatusBadGateway)
+		return
+	}
+	claims, err := oidcVerifyIDToken(ctx, p, oidc, idToken, sc.Nonce)
+	if err != nil {
+		log.Errorx("verifying oidc id token", err, mlog.Field("issuer", oidc.Issuer))
+		http.Error(w, "502 - bad gateway - invalid token"+recvid(r), http.StatusBadGateway)
+		return
+	}
+	addr, err := smtp.ParseAddress(claims.Email)
+	if err != nil || !claims.emailVerified() {
+		authResult = "badcreds"
+		log.Info("oidc login without verified email address", mlog.Field("email", claims.Email))
+		http.Error(w, "403 - forbidden - no verified email address"+recvid(r), http.StatusForbidden)
+		return
+	}
+	if !webAuthAllowed(wa, addr) {
+		authResult = "badcreds"
+		log.Info("oidc user not allowed for webhandler", mlog.Field("email", addr))
+		http.Error(w, "403 - forbidden - no access for user"+recvid(r), http.StatusForbidden)
+		return
+	}
+
+	authResult = "ok"
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookieName(oidc, "moxoidc"),
+		Value:    signedCookie(oidcSessionCookie{addr.String(), oidc.Issuer, time.Now().Add(webAuthSessionLifetime).Unix()}),
+		Path:     "/",
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(webAuthSessionLifetime / time.Second),
+	})
+	// Only redirect to paths on this host.
+	ret := sc.Return
+	if !strings.HasPrefix(ret, "/") || strings.HasPrefix(ret, "//") {
+		ret = "/"
+	}
+	http.Redirect(w, r, ret, http.StatusSeeOther)
+}
+
+var oidcHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// oidcProvider is the configuration of an OpenID provider, with its signing keys.
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+
+	sync.Mutex
+	keys        map[string]crypto.PublicKey // By key ID.
+	keysFetched time.Time
+}
+
+var oidcProviders = struct {
+	sync.Mutex
+	m map[string]*oidcProvider // By issuer.
+}{m: map[string]*oidcProvider{}}
+
+// oidcGetJSON fetches JSON from url into v.
+func oidcGetJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("response status %s", resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1024*1024)).Decode(v)
+}
+
+// oidcGetProvider returns the configuration of the provider for issuer, fetching
+// it if not yet known.
+func oidcGetProvider(ctx context.Context, issuer string) (*oidcProvider, error) {
+	oidcProviders.Lock()
+	p := oidcProviders.m[issuer]
+	oidcProviders.Unlock()
+	if p != nil {
+		return p, nil
+	}
+
+	p = &oidcProvider{}
+	if err := oidcGetJSON(ctx, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", p); err != nil {
+		return nil, fmt.Errorf("fetching provider configuration: %v", err)
+	}
+	if p.Issuer != issuer {
+		return nil, fmt.Errorf("provider configuration has issuer %q, expected %q", p.Issuer, issuer)
+	}
+	if p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" || p.JWKSURI == "" {
+		return nil, fmt.Errorf("provider configuration is missing endpoints")
+	}
+
+	oidcProviders.Lock()
+	defer oidcProviders.Unlock()
+	if xp := oidcProviders.m[issuer]; xp != nil {
+		return xp, nil
+	}
+	oidcProviders.m[issuer] = p
+	return p, nil
+}
+
+// key returns the public key with id kid, refetching the keys of the provider
+// for unknown keys, at most once per 5 minutes.
+func (p *oidcProvider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	if time.Since(p.keysFetched) < 5*time.Minute {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	p.keysFetched = time.Now()
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := oidcGetJSON(ctx, p.JWKSURI, &jwks); err != nil {
+		return nil, fmt.Errorf("fetching provider keys: %v", err)
+	}
+	bigint := func(s string) (*big.Int, error) {
+		buf, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(buf), nil
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, err := bigint(k.N)
+			if err != nil {
+				continue
+			}
+			e, err := bigint(k.E)
+			if err != nil || !e.IsInt64() {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			if k.Crv != "P-256" {
+				continue
+			}
+			x, err := bigint(k.X)
+			if err != nil {
+				continue
+			}
+			y, err := bigint(k.Y)
+			if err != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		}
+	}
+	p.keys = keys
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+// oidcExchangeCode requests an ID token at the token endpoint of the provider.
+func oidcExchangeCode(ctx context.Context, p *oidcProvider, oidc *config.WebOIDC, code, redirectURI string) (string, error) {
+	// ../rfc/6749:1386
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURI)
+	form.Set("client_id", oidc.ClientID)
+	req, err := http.NewRequestWithContext(ctx, "POST", p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// Client credentials are form-encoded before basic authentication. ../rfc/6749:1033
+	req.SetBasicAuth(url.QueryEscape(oidc.ClientID), url.QueryEscape(oidc.ClientSecret))
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var tr struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1024*1024)).Decode(&tr); err != nil {
+		return "", fmt.Errorf("parsing token response with status %s: %v", resp.Status, err)
+	}
+	if tr.Error != "" {
+		return "", fmt.Errorf("token request failed: %s: %s", tr.Error, tr.ErrorDescription)
+	} else if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token response status %s", resp.Status)
+	} else if tr.IDToken == "" {
+		return "", errors.New("no id token in response")
+	}
+	return tr.IDToken, nil
+}
+
+type oidcClaims struct {
+	Issuer        string       `json:"iss"`
+	Audience      oidcAudience `json:"aud"`
+	Expires       int64        `json:"exp"`
+	Nonce         string       `json:"nonce"`
+	Email         string       `json:"email"`
+	EmailVerified any          `json:"email_verified"` // Some providers use a string.
+}
+
+// emailVerified returns whether the provider did not indicate the email address
+// is not verified.
+func (c oidcClaims) emailVerified() bool {
+	switch v := c.EmailVerified.(type) {
+	case nil:
+		return true
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// oidcAudience is a single string or a list of strings.
+type oidcAudience []string
+
+func (a *oidcAudience) UnmarshalJSON(buf []byte) error {
+	var s string
+	if err := json.Unmarshal(buf, &s); err == nil {
+		*a = []string{s}
+		return nil
+	}
+	var l []string
+	if err := json.Unmarshal(buf, &l); err != nil {
+		return err
+	}
+	*a = l
+	return nil
+}
+
+// oidcVerifyIDToken verifies the signature and claims of a JWT ID token.
+func oidcVerifyIDToken(ctx context.Context, p *oidcProvider, oidc *config.WebOIDC, token, nonce string) (oidcClaims, error) {
+	var claims oidcClaims
+
+	t := strings.Split(token, ".")
+	if len(t) != 3 {
+		return claims, errors.New("malformed token")
+	}
+	headerBuf, err := base64.RawURLEncoding.DecodeString(t[0])
+	if err != nil {
+		return claims, fmt.Errorf("decoding token header: %v", err)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerBuf, &header); err != nil {
+		return claims, fmt.Errorf("parsing token header: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(t[2])
+	if err != nil {
+		return claims, fmt.Errorf("decoding token signature: %v", err)
+	}
+
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return claims, err
+	}
+	digest := sha256.Sum256([]byte(t[0] + "." + t[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" {
+			return claims, fmt.Errorf("unsupported algorithm %q for rsa key", header.Alg)
+		}
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig); err != nil {
+			return claims, fmt.Errorf("verifying signature: %v", err)
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" {
+			return claims, fmt.Errorf("unsupported algorithm %q for ecdsa key", header.Alg)
+		}
+		if len(sig) != 64 {
+			return claims, errors.New("bad signature length")
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, digest[:], r, s) {
+			return claims, errors.New("invalid signature")
+		}
+	default:
+		return claims, errors.New("unsupported key type")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(t[1])
+	if err != nil {
+		return claims, fmt.Errorf("decoding token payload: %v", err)
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, fmt.Errorf("parsing token payload: %v", err)
+	}
+	if claims.Issuer != oidc.Issuer {
+		return claims, fmt.Errorf("token has issuer %q, expected %q", claims.Issuer, oidc.Issuer)
+	}
+	var audienceOK bool
+	for _, aud := range claims.Audience {
+		audienceOK = audienceOK || aud == oidc.ClientID
+	}
+	if !audienceOK {
+		return claims, errors.New("token not for our client id")
+	}
+	if time.Now().Unix() > claims.Expires {
+		return claims, errors.New("token expired")
+	}
+	if !hmac.Equal([]byte(claims.Nonce), []byte(nonce)) {
+		return claims, errors.New("token nonce mismatch")
+	}
+	return claims, nil
+}
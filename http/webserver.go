@@ -24,6 +24,8 @@ import (
 	"syscall"
 	"time"
 
+	"golang.org/x/net/http2"
+
 	"github.com/mjl-/mox/config"
 	"github.com/mjl-/mox/dns"
 	"github.com/mjl-/mox/mlog"
@@ -63,6 +65,17 @@ func WebHandle(w *loggingWriter, r *http.Request, host dns.Domain) (handled bool
 		if host != h.DNSDomain {
 			continue
 		}
+		// Redirect back from the OIDC provider after login, the callback path doesn't
+		// have to match the path of the handler. Multiple handlers can have the same
+		// callback path, the login state cookie identifies the handler.
+		if h.Auth != nil && h.Auth.OIDC != nil && r.URL.Path == h.Auth.OIDC.CallbackPath {
+			if _, err := r.Cookie(oidcCookieName(h.Auth.OIDC, "moxoidcstate")); err == nil {
+				w.Handler = h.Name
+				oidcCallback(h.Auth, w, r)
+				return true
+			}
+		}
+
 		loc := h.Path.FindStringIndex(r.URL.Path)
 		if loc == nil {
 			continue
@@ -80,6 +93,14 @@ func WebHandle(w *loggingWriter, r *http.Request, host dns.Domain) (handled bool
 			return true
 		}
 
+		if h.Auth != nil {
+			r = checkWebAuth(h, w, r)
+			if r == nil {
+				w.Handler = h.Name
+				return true
+			}
+		}
+
 		if h.WebStatic != nil && HandleStatic(h.WebStatic, w, r) {
 			w.Handler = h.Name
 			return true
@@ -421,6 +442,23 @@ func HandleForward(h *config.WebForward, w http.ResponseWriter, r *http.Request,
 
 	// todo: add Forwarded header? is anyone using it?
 
+	// User authenticated by the WebHandler, if any.
+	if user := webAuthUser(r); user != "" {
+		r.Header["X-Forwarded-User"] = []string{user}
+	}
+
+	for k, v := range h.RequestHeaders {
+		if strings.EqualFold(k, "Host") {
+			if v != "" {
+				r.Host = v
+			}
+		} else if v == "" {
+			r.Header.Del(k)
+		} else {
+			r.Header.Set(k, v)
+		}
+	}
+
 	// If we see an Upgrade: websocket, we're going to assume the client needs
 	// websocket and only attempt to talk websocket with the backend. If the backend
 	// doesn't do websocket, we'll send back a "bad request" response. For other values
@@ -443,6 +481,17 @@ func HandleForward(h *config.WebForward, w http.ResponseWriter, r *http.Request,
 	// ReverseProxy will append any remaining path to the configured target URL.
 	proxy := httputil.NewSingleHostReverseProxy(h.TargetURL)
 	proxy.FlushInterval = time.Duration(-1) // Flush after each write.
+	if h.HTTP2 {
+		proxy.Transport = h2cTransport
+	}
+	if len(h.RemoveResponseHeaders) > 0 {
+		proxy.ModifyResponse = func(resp *http.Response) error {
+			for _, k := range h.RemoveResponseHeaders {
+				resp.Header.Del(k)
+			}
+			return nil
+		}
+	}
 	proxy.ErrorLog = golog.New(mlog.ErrWriter(mlog.New("net/http/httputil").WithContext(r.Context()), mlog.LevelDebug, "reverseproxy error"), "", 0)
 	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
 		if errors.Is(err, context.Canceled) {
@@ -464,6 +513,16 @@ func HandleForward(h *config.WebForward, w http.ResponseWriter, r *http.Request,
 	return true
 }
 
+// h2cTransport makes HTTP/2 requests over connections without TLS, for backends
+// like gRPC servers. Trailers are forwarded by the reverse proxy.
+var h2cTransport = &http2.Transport{
+	AllowHTTP: true,
+	DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	},
+}
+
 var errResponseNotWebsocket = errors.New("not a valid websocket response to request")
 var errNotImplemented = errors.New("functionality not yet implemented")
 
@@ -2,8 +2,15 @@ package http
 
 import (
 	"bytes"
+	"crypto"
+	cryptorand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
@@ -12,10 +19,14 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"golang.org/x/net/websocket"
 
 	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/store"
 )
 
 func TestWebserver(t *testing.T) {
@@ -306,3 +317,189 @@ func TestWebsocket(t *testing.T) {
 	test("GET", wsreqhdrs, http.StatusSwitchingProtocols, wsresphdrs)
 
 }
+
+func TestWebForwardAuth(t *testing.T) {
+	os.RemoveAll("../testdata/webauth/data")
+	mox.ConfigStaticPath = "../testdata/webauth/mox.conf"
+	mox.ConfigDynamicPath = filepath.Join(filepath.Dir(mox.ConfigStaticPath), "domains.conf")
+	mox.MustLoadConfig(true, false)
+
+	acc, err := store.OpenAccount("mjl")
+	tcheck(t, err, "open account")
+	err = acc.SetPassword("test1234")
+	tcheck(t, err, "set password")
+	err = acc.Close()
+	tcheck(t, err, "close account")
+
+	srv := &serve{Webserver: true}
+
+	do := func(method, target string, reqhdrs map[string]string, cookies []*http.Cookie, expCode int) *http.Response {
+		t.Helper()
+
+		req := httptest.NewRequest(method, target, nil)
+		for k, v := range reqhdrs {
+			req.Header.Add(k, v)
+		}
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rw := httptest.NewRecorder()
+		rw.Body = &bytes.Buffer{}
+		srv.ServeHTTP(rw, req)
+		resp := rw.Result()
+		if resp.StatusCode != expCode {
+			t.Fatalf("got statuscode %d, expected %d", resp.StatusCode, expCode)
+		}
+		return resp
+	}
+	xheader := func(resp *http.Response, k, v string) {
+		t.Helper()
+		if xv := resp.Header.Get(k); xv != v {
+			t.Fatalf("got %q for header %q, expected %q", xv, k, v)
+		}
+	}
+
+	// Backend that echoes request headers of interest.
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, k := range []string{"X-Forwarded-User", "X-Set", "X-Remove", "Authorization", "Cookie"} {
+			w.Header()["Echo-"+k] = r.Header.Values(k)
+		}
+		w.Header().Set("X-Secret", "secret")
+		w.Write([]byte(r.Proto))
+	}))
+	defer backend.Close()
+	backendURL, err := url.Parse(backend.URL)
+	tcheck(t, err, "parse backend url")
+
+	// Backend with HTTP/2 without TLS, and trailers like gRPC.
+	h2cBackend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte(r.Proto))
+		w.Header().Set("Grpc-Status", "0")
+	}), &http2.Server{}))
+	defer h2cBackend.Close()
+	h2cBackendURL, err := url.Parse(h2cBackend.URL)
+	tcheck(t, err, "parse h2c backend url")
+
+	// Fake OpenID provider.
+	key, err := rsa.GenerateKey(cryptorand.Reader, 2048)
+	tcheck(t, err, "generate key")
+	var nonce string
+	tokenEmail := "mjl@mox.example"
+	var provider *httptest.Server
+	provider = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON := func(v any) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(v)
+		}
+		b64 := base64.RawURLEncoding.EncodeToString
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			writeJSON(map[string]string{
+				"issuer":                 provider.URL,
+				"authorization_endpoint": provider.URL + "/authorize",
+				"token_endpoint":         provider.URL + "/token",
+				"jwks_uri":               provider.URL + "/jwks",
+			})
+		case "/jwks":
+			e := big.NewInt(int64(key.PublicKey.E)).Bytes()
+			writeJSON(map[string]any{"keys": []map[string]string{{"kty": "RSA", "kid": "k1", "use": "sig", "n": b64(key.PublicKey.N.Bytes()), "e": b64(e)}}})
+		case "/token":
+			if user, pass, _ := r.BasicAuth(); user != "mox" || pass != "secret" || r.FormValue("code") != "code1" {
+				w.WriteHeader(http.StatusBadRequest)
+				writeJSON(map[string]string{"error": "invalid_grant"})
+				return
+			}
+			header := b64([]byte(`{"alg":"RS256","kid":"k1"}`))
+			claims, _ := json.Marshal(map[string]any{"iss": provider.URL, "aud": "mox", "exp": time.Now().Add(time.Minute).Unix(), "nonce": nonce, "email": tokenEmail, "email_verified": true})
+			digest := sha256.Sum256([]byte(header + "." + b64(claims)))
+			sig, err := rsa.SignPKCS1v15(cryptorand.Reader, key, crypto.SHA256, digest[:])
+			tcheck(t, err, "sign token")
+			writeJSON(map[string]string{"id_token": header + "." + b64(claims) + "." + b64(sig), "token_type": "Bearer"})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer provider.Close()
+
+	// warning: it is not normally allowed to access the dynamic config without lock. don't propagate accesses like this!
+	handlers := mox.Conf.Dynamic.WebHandlers
+	handlers[0].WebForward.TargetURL = backendURL
+	handlers[1].WebForward.TargetURL = backendURL
+	handlers[1].Auth.OIDC.Issuer = provider.URL
+	handlers[2].WebForward.TargetURL = h2cBackendURL
+
+	// Basic authentication, credentials are not forwarded. Request headers are
+	// rewritten, response headers removed.
+	resp := do("GET", "http://mox.example/basic/", nil, nil, http.StatusUnauthorized)
+	xheader(resp, "WWW-Authenticate", `Basic realm="login with email address and password"`)
+	basicHdrs := map[string]string{"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte("mjl@mox.example:test1234")), "X-Remove": "x", "X-Set": "x"}
+	resp = do("GET", "http://mox.example/basic/", basicHdrs, nil, http.StatusOK)
+	xheader(resp, "Echo-X-Forwarded-User", "mjl@mox.example")
+	xheader(resp, "Echo-Authorization", "")
+	xheader(resp, "Echo-X-Set", "set")
+	xheader(resp, "Echo-X-Remove", "")
+	xheader(resp, "X-Secret", "")
+	// Spoofed user header is not passed on.
+	basicHdrs["X-Forwarded-User"] = "other@mox.example"
+	resp = do("GET", "http://mox.example/basic/", basicHdrs, nil, http.StatusOK)
+	xheader(resp, "Echo-X-Forwarded-User", "mjl@mox.example")
+	do("GET", "http://mox.example/basic/", map[string]string{"X-Forwarded-User": "mjl@mox.example"}, nil, http.StatusUnauthorized)
+
+	// OIDC, redirect to provider for login.
+	resp = do("GET", "http://mox.example/oidc/x?q=1", nil, nil, http.StatusSeeOther)
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	tcheck(t, err, "parse location")
+	if !strings.HasPrefix(loc.String(), provider.URL+"/authorize?") || loc.Query().Get("client_id") != "mox" || loc.Query().Get("redirect_uri") != "http://mox.example/.mox/oidc-callback" {
+		t.Fatalf("unexpected redirect to %s", loc)
+	}
+	state := loc.Query().Get("state")
+	nonce = loc.Query().Get("nonce")
+	stateCookies := resp.Cookies()
+
+	// Requests other than GET don't start a login.
+	do("POST", "http://mox.example/oidc/x", nil, nil, http.StatusUnauthorized)
+
+	// Callback without state cookie is not handled.
+	do("GET", "http://mox.example/.mox/oidc-callback?code=code1&state="+state, nil, nil, http.StatusNotFound)
+	do("GET", "http://mox.example/.mox/oidc-callback?code=code1&state=bogus", nil, stateCookies, http.StatusBadRequest)
+	do("GET", "http://mox.example/.mox/oidc-callback?code=bogus&state="+state, nil, stateCookies, http.StatusBadGateway)
+	resp = do("GET", "http://mox.example/.mox/oidc-callback?code=code1&state="+state, nil, stateCookies, http.StatusSeeOther)
+	xheader(resp, "Location", "/oidc/x?q=1")
+	var sessionCookies []*http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.MaxAge > 0 {
+			sessionCookies = append(sessionCookies, c)
+		}
+	}
+	if len(sessionCookies) != 1 {
+		t.Fatalf("got %d session cookies, expected 1", len(sessionCookies))
+	}
+
+	// Session cookie is not passed to the backend, other cookies are.
+	resp = do("GET", "http://mox.example/oidc/x", nil, append(sessionCookies, &http.Cookie{Name: "app", Value: "1"}), http.StatusOK)
+	xheader(resp, "Echo-X-Forwarded-User", "mjl@mox.example")
+	xheader(resp, "Echo-Cookie", "app=1")
+
+	// Session cookie is not valid for other handlers with other configuration.
+	do("GET", "http://mox.example/basic/", nil, sessionCookies, http.StatusUnauthorized)
+
+	// User that is not allowed.
+	tokenEmail = "other@mox.example"
+	resp = do("GET", "http://mox.example/oidc/x", nil, nil, http.StatusSeeOther)
+	loc, err = url.Parse(resp.Header.Get("Location"))
+	tcheck(t, err, "parse location")
+	nonce = loc.Query().Get("nonce")
+	do("GET", "http://mox.example/.mox/oidc-callback?code=code1&state="+loc.Query().Get("state"), nil, resp.Cookies(), http.StatusForbidden)
+
+	// HTTP/2 to backend, with trailers passed on.
+	resp = do("POST", "http://mox.example/h2c/", nil, nil, http.StatusOK)
+	buf, err := io.ReadAll(resp.Body)
+	tcheck(t, err, "read response")
+	if string(buf) != "HTTP/2.0" {
+		t.Fatalf("backend got request with protocol %q, expected HTTP/2.0", buf)
+	}
+	if v := resp.Trailer.Get("Grpc-Status"); v != "0" {
+		t.Fatalf("got trailer %q, expected 0", v)
+	}
+}
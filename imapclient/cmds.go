@@ -6,9 +6,12 @@ import (
 	"encoding/base64"
 	"fmt"
 	"hash"
+	"io"
+	"net"
 	"strings"
 	"time"
 
+	"github.com/mjl-/mox/moxio"
 	"github.com/mjl-/mox/scram"
 )
 
@@ -34,6 +37,13 @@ func (c *Conn) Logout() (untagged []Untagged, result Result, rerr error) {
 	return c.Transactf("logout")
 }
 
+// Unauthenticate returns the connection to the not authenticated state, after
+// which the client can authenticate again, e.g. as another user.
+func (c *Conn) Unauthenticate() (untagged []Untagged, result Result, rerr error) {
+	defer c.recover(&rerr)
+	return c.Transactf("unauthenticate")
+}
+
 // Starttls enables TLS on the connection with the STARTTLS command.
 func (c *Conn) Starttls(config *tls.Config) (untagged []Untagged, result Result, rerr error) {
 	defer c.recover(&rerr)
@@ -47,6 +57,21 @@ func (c *Conn) Starttls(config *tls.Config) (untagged []Untagged, result Result,
 	return untagged, result, nil
 }
 
+// CompressDeflate enables compression of the connection with the COMPRESS
+// DEFLATE command.
+func (c *Conn) CompressDeflate() (untagged []Untagged, result Result, rerr error) {
+	defer c.recover(&rerr)
+	untagged, result, rerr = c.Transactf("compress deflate")
+	c.xcheckf(rerr, "compress command")
+	var conn net.Conn = c.conn
+	if n := c.r.Buffered(); n > 0 {
+		conn = &moxio.PrefixConn{PrefixReader: io.LimitReader(c.r, int64(n)), Conn: conn}
+	}
+	c.conn = moxio.NewFlateConn(conn)
+	c.r = bufio.NewReader(c.conn)
+	return untagged, result, nil
+}
+
 // Login authenticates with username and password
 func (c *Conn) Login(username, password string) (untagged []Untagged, result Result, rerr error) {
 	defer c.recover(&rerr)
@@ -209,6 +234,50 @@ func (c *Conn) Append(mailbox string, flags []string, received *time.Time, messa
 	return c.Transactf("append %s (%s)%s {%d+}\r\n%s", astring(mailbox), strings.Join(flags, " "), date, len(message), message)
 }
 
+// Replace appends message to mailbox and expunges the message with sequence
+// number seq from the selected mailbox, atomically. Requires the REPLACE
+// capability.
+func (c *Conn) Replace(seq uint32, mailbox string, flags []string, received *time.Time, message []byte) (untagged []Untagged, result Result, rerr error) {
+	defer c.recover(&rerr)
+	var date string
+	if received != nil {
+		date = ` "` + received.Format("_2-Jan-2006 15:04:05 -0700") + `"`
+	}
+	return c.Transactf("replace %d %s (%s)%s {%d+}\r\n%s", seq, astring(mailbox), strings.Join(flags, " "), date, len(message), message)
+}
+
+// UIDReplace is like Replace, but operates on a UID.
+func (c *Conn) UIDReplace(uid uint32, mailbox string, flags []string, received *time.Time, message []byte) (untagged []Untagged, result Result, rerr error) {
+	defer c.recover(&rerr)
+	var date string
+	if received != nil {
+		date = ` "` + received.Format("_2-Jan-2006 15:04:05 -0700") + `"`
+	}
+	return c.Transactf("uid replace %d %s (%s)%s {%d+}\r\n%s", uid, astring(mailbox), strings.Join(flags, " "), date, len(message), message)
+}
+
+// Message is a message to append with MultiAppend.
+type Message struct {
+	Flags    []string
+	Received *time.Time // Optional.
+	Data     []byte
+}
+
+// MultiAppend adds messages to mailbox in a single command. Either all or none
+// of the messages are added. Requires the MULTIAPPEND capability.
+func (c *Conn) MultiAppend(mailbox string, messages ...Message) (untagged []Untagged, result Result, rerr error) {
+	defer c.recover(&rerr)
+	var b strings.Builder
+	for _, m := range messages {
+		fmt.Fprintf(&b, " (%s)", strings.Join(m.Flags, " "))
+		if m.Received != nil {
+			b.WriteString(` "` + m.Received.Format("_2-Jan-2006 15:04:05 -0700") + `"`)
+		}
+		fmt.Fprintf(&b, " {%d+}\r\n%s", len(m.Data), m.Data)
+	}
+	return c.Transactf("append %s%s", astring(mailbox), b.String())
+}
+
 // note: No idle command. Idle is better implemented by writing the request and reading and handling the responses as they come in.
 
 // CloseMailbox closes the currently selected/active mailbox, permanently removing
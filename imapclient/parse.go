@@ -119,6 +119,7 @@ var knownCodes = stringMap(
 	"ALERT", "PARSE", "READ-ONLY", "READ-WRITE", "TRYCREATE", "UIDNOTSTICKY", "UNAVAILABLE", "AUTHENTICATIONFAILED", "AUTHORIZATIONFAILED", "EXPIRED", "PRIVACYREQUIRED", "CONTACTADMIN", "NOPERM", "INUSE", "EXPUNGEISSUED", "CORRUPTION", "SERVERBUG", "CLIENTBUG", "CANNOT", "LIMIT", "OVERQUOTA", "ALREADYEXISTS", "NONEXISTENT", "NOTSAVED", "HASCHILDREN", "CLOSED", "UNKNOWN-CTE",
 	// With parameters.
 	"BADCHARSET", "CAPABILITY", "PERMANENTFLAGS", "UIDNEXT", "UIDVALIDITY", "UNSEEN", "APPENDUID", "COPYUID",
+	"HIGHESTMODSEQ", "MODIFIED", "BADEVENT", "MAILBOXID",
 )
 
 func stringMap(l ...string) map[string]struct{} {
@@ -162,6 +163,16 @@ func (c *Conn) xrespCode() (string, CodeArg) {
 			c.xtake(")")
 		}
 		codeArg = CodeList{W, l}
+	case "BADEVENT":
+		// ../rfc/5465
+		c.xspace()
+		c.xtake("(")
+		l := []string{c.xatom()}
+		for c.take(' ') {
+			l = append(l, c.xatom())
+		}
+		c.xtake(")")
+		codeArg = CodeList{W, l}
 	case "CAPABILITY":
 		c.xtake(" ")
 		caps := []string{c.xatom()}
@@ -192,8 +203,11 @@ func (c *Conn) xrespCode() (string, CodeArg) {
 		c.xspace()
 		destUIDValidity := c.xnzuint32()
 		c.xspace()
-		uid := c.xnzuint32()
-		codeArg = CodeAppendUID{destUIDValidity, uid}
+		uids := c.xuidset()
+		codeArg = CodeAppendUID{UIDValidity: destUIDValidity, UID: uids[0].First}
+		if len(uids) > 1 || uids[0].Last != nil {
+			codeArg = CodeAppendUID{destUIDValidity, uids[0].First, uids}
+		}
 	case "COPYUID":
 		c.xspace()
 		destUIDValidity := c.xnzuint32()
@@ -202,6 +216,20 @@ func (c *Conn) xrespCode() (string, CodeArg) {
 		c.xspace()
 		to := c.xuidset()
 		codeArg = CodeCopyUID{destUIDValidity, from, to}
+	case "HIGHESTMODSEQ":
+		// ../rfc/7162
+		c.xspace()
+		codeArg = CodeHighestModSeq(c.xint64())
+	case "MODIFIED":
+		// ../rfc/7162
+		c.xspace()
+		codeArg = CodeModified(c.xsequenceSet())
+	case "MAILBOXID":
+		// ../rfc/8474
+		c.xspace()
+		c.xtake("(")
+		codeArg = CodeMailboxID(c.xatom())
+		c.xtake(")")
 	}
 	return W, codeArg
 }
@@ -355,13 +383,24 @@ func (c *Conn) xuntagged() Untagged {
 		c.xspace()
 		c.xtake("(")
 		attrs := map[string]int64{}
+		var mailboxID string
 		for !c.take(')') {
-			if len(attrs) > 0 {
+			if len(attrs) > 0 || mailboxID != "" {
 				c.xspace()
 			}
 			s := c.xword()
 			c.xspace()
 			S := strings.ToUpper(s)
+			if S == "MAILBOXID" {
+				// ../rfc/8474
+				if mailboxID != "" {
+					c.xerrorf("status: duplicate attribute %q", s)
+				}
+				c.xtake("(")
+				mailboxID = c.xatom()
+				c.xtake(")")
+				continue
+			}
 			var num int64
 			// ../rfc/9051:7059
 			switch S {
@@ -377,6 +416,9 @@ func (c *Conn) xuntagged() Untagged {
 				num = int64(c.xuint32())
 			case "SIZE":
 				num = c.xint64()
+			case "DELETED-STORAGE":
+				// ../rfc/9208
+				num = c.xint64()
 			case "RECENT":
 				c.xneedDisabled("RECENT status flag", CapIMAP4rev2)
 				num = int64(c.xuint32())
@@ -386,6 +428,8 @@ func (c *Conn) xuntagged() Untagged {
 				} else {
 					num = c.xint64()
 				}
+			case "HIGHESTMODSEQ":
+				num = c.xint64()
 			default:
 				c.xerrorf("status: unknown attribute %q", s)
 			}
@@ -394,7 +438,7 @@ func (c *Conn) xuntagged() Untagged {
 			}
 			attrs[S] = num
 		}
-		r := UntaggedStatus{mailbox, attrs}
+		r := UntaggedStatus{mailbox, attrs, mailboxID}
 		c.xcrlf()
 		return r
 
@@ -415,12 +459,42 @@ func (c *Conn) xuntagged() Untagged {
 		c.xneedDisabled("untagged SEARCH response", CapIMAP4rev2)
 		var nums []uint32
 		for c.take(' ') {
+			// ../rfc/7162
+			if c.take('(') {
+				c.xtake("MODSEQ")
+				c.xspace()
+				modseq := c.xint64()
+				c.xtake(")")
+				c.xcrlf()
+				return UntaggedSearchModSeq{nums, modseq}
+			}
 			nums = append(nums, c.xnzuint32())
 		}
 		r := UntaggedSearch(nums)
 		c.xcrlf()
 		return r
 
+	case "SORT":
+		// ../rfc/5256
+		var nums []uint32
+		for c.take(' ') {
+			nums = append(nums, c.xnzuint32())
+		}
+		r := UntaggedSort(nums)
+		c.xcrlf()
+		return r
+
+	case "THREAD":
+		// ../rfc/5256:787
+		var r UntaggedThread
+		if c.take(' ') {
+			for c.peek('(') {
+				r = append(r, c.xthreadList())
+			}
+		}
+		c.xcrlf()
+		return r
+
 	case "ESEARCH":
 		r := c.xesearchResponse()
 		c.xcrlf()
@@ -456,6 +530,135 @@ func (c *Conn) xuntagged() Untagged {
 		c.xcrlf()
 		return UntaggedID(params)
 
+	case "METADATA":
+		// ../rfc/5464:1076
+		c.xspace()
+		r := UntaggedMetadata{Mailbox: c.xastring()}
+		c.xspace()
+		c.xtake("(")
+		for !c.take(')') {
+			if len(r.Annotations) > 0 {
+				c.xspace()
+			}
+			a := Annotation{Key: c.xastring()}
+			c.xspace()
+			if c.take('~') {
+				a.Value = c.xliteral()
+			} else if c.peek('"') || c.peek('{') {
+				a.Value = []byte(c.xstring())
+				a.IsString = true
+			} else {
+				c.xtake("NIL")
+			}
+			r.Annotations = append(r.Annotations, a)
+		}
+		c.xcrlf()
+		return r
+
+	case "QUOTAROOT":
+		// ../rfc/9208
+		c.xspace()
+		r := UntaggedQuotaroot{Mailbox: c.xastring()}
+		for c.take(' ') {
+			r.Roots = append(r.Roots, c.xastring())
+		}
+		c.xcrlf()
+		return r
+
+	case "QUOTA":
+		// ../rfc/9208
+		c.xspace()
+		r := UntaggedQuota{Root: c.xastring()}
+		c.xspace()
+		c.xtake("(")
+		for !c.take(')') {
+			if len(r.Resources) > 0 {
+				c.xspace()
+			}
+			res := QuotaResource{Name: c.xatom()}
+			c.xspace()
+			res.Usage = c.xint64()
+			c.xspace()
+			res.Limit = c.xint64()
+			r.Resources = append(r.Resources, res)
+		}
+		c.xcrlf()
+		return r
+
+	case "ACL":
+		// ../rfc/4314 section 3.6
+		c.xspace()
+		r := UntaggedACL{Mailbox: c.xastring()}
+		for c.take(' ') {
+			ir := IdentifierRights{Identifier: c.xastring()}
+			c.xspace()
+			ir.Rights = c.xastring()
+			r.Rights = append(r.Rights, ir)
+		}
+		c.xcrlf()
+		return r
+
+	case "LISTRIGHTS":
+		// ../rfc/4314 section 3.7
+		c.xspace()
+		r := UntaggedListrights{Mailbox: c.xastring()}
+		c.xspace()
+		r.Identifier = c.xastring()
+		c.xspace()
+		r.Required = c.xastring()
+		for c.take(' ') {
+			r.Optional = append(r.Optional, c.xastring())
+		}
+		c.xcrlf()
+		return r
+
+	case "MYRIGHTS":
+		// ../rfc/4314 section 3.8
+		c.xspace()
+		r := UntaggedMyrights{Mailbox: c.xastring()}
+		c.xspace()
+		r.Rights = c.xastring()
+		c.xcrlf()
+		return r
+
+	case "GENURLAUTH":
+		// ../rfc/4467
+		var r UntaggedGenurlauth
+		for c.take(' ') {
+			r = append(r, c.xastring())
+		}
+		c.xcrlf()
+		return r
+
+	case "URLFETCH":
+		// ../rfc/4467
+		c.xspace()
+		r := UntaggedURLFetch{URL: c.xastring()}
+		c.xspace()
+		if c.peek('N') {
+			c.xtake("NIL")
+		} else if c.peek('"') {
+			r.Data = []byte(c.xquoted())
+		} else {
+			r.Data = c.xliteral()
+		}
+		c.xcrlf()
+		return r
+
+	case "VANISHED":
+		// ../rfc/7162
+		c.xspace()
+		var r UntaggedVanished
+		if c.take('(') {
+			c.xtake("EARLIER")
+			c.xtake(")")
+			c.xspace()
+			r.Earlier = true
+		}
+		r.UIDs = c.xsequenceSet()
+		c.xcrlf()
+		return r
+
 	default:
 		v, err := strconv.ParseUint(w, 10, 32)
 		if err == nil {
@@ -547,6 +750,62 @@ func (c *Conn) xmsgatt1() FetchAttr {
 		c.xspace()
 		return FetchInternalDate(c.xquoted()) // todo: parsed time
 
+	case "SAVEDATE":
+		// ../rfc/8514
+		c.xspace()
+		if c.peek('n') || c.peek('N') {
+			c.xtake("nil")
+			return FetchSaveDate("")
+		}
+		return FetchSaveDate(c.xquoted()) // todo: parsed time
+
+	case "PREVIEW":
+		// ../rfc/8970
+		c.xspace()
+		if c.peek('n') || c.peek('N') {
+			c.xtake("nil")
+			return FetchPreview{}
+		}
+		s := c.xstring()
+		return FetchPreview{&s}
+
+	case "ANNOTATION":
+		// ../rfc/5257 section 5
+		c.xspace()
+		c.xtake("(")
+		var l FetchAnnotation
+		for {
+			e := AnnotationEntry{Entry: c.xastring()}
+			if c.take(' ') && c.take('(') {
+				for {
+					a := AnnotationAttrib{Name: c.xastring()}
+					c.xspace()
+					if c.peek('n') || c.peek('N') {
+						c.xtake("nil")
+					} else {
+						v := string(c.xnilStringLiteral8())
+						a.Value = &v
+					}
+					e.Attribs = append(e.Attribs, a)
+					if !c.take(' ') {
+						break
+					}
+				}
+				c.xtake(")")
+				l = append(l, e)
+				if !c.take(' ') {
+					break
+				}
+				continue
+			}
+			l = append(l, e)
+			if c.peek(')') {
+				break
+			}
+		}
+		c.xtake(")")
+		return l
+
 	case "RFC822.SIZE":
 		c.xspace()
 		return FetchRFC822Size(c.xint64())
@@ -605,6 +864,34 @@ func (c *Conn) xmsgatt1() FetchAttr {
 	case "UID":
 		c.xspace()
 		return FetchUID(c.xuint32())
+
+	case "MODSEQ":
+		// ../rfc/7162
+		c.xspace()
+		c.xtake("(")
+		modseq := c.xint64()
+		c.xtake(")")
+		return FetchModSeq(modseq)
+
+	case "EMAILID":
+		// ../rfc/8474
+		c.xspace()
+		c.xtake("(")
+		id := c.xatom()
+		c.xtake(")")
+		return FetchEmailID(id)
+
+	case "THREADID":
+		// ../rfc/8474
+		c.xspace()
+		if c.peek('n') || c.peek('N') {
+			c.xtake("nil")
+			return FetchThreadID("")
+		}
+		c.xtake("(")
+		id := c.xatom()
+		c.xtake(")")
+		return FetchThreadID(id)
 	}
 	c.xerrorf("unknown fetch attribute %q", f)
 	panic("not reached")
@@ -1091,6 +1378,38 @@ func (c *Conn) xneedDisabled(msg string, caps ...Capability) {
 	}
 }
 
+// xthreadList parses a thread list, a parenthesized thread. A thread of only
+// nested threads is returned as a dummy parent with Num 0. ../rfc/5256:792
+func (c *Conn) xthreadList() ThreadMember {
+	c.xtake("(")
+	var r ThreadMember
+	if c.peek('(') {
+		for c.peek('(') {
+			r.Children = append(r.Children, c.xthreadList())
+		}
+	} else {
+		r = c.xthreadMembers()
+	}
+	c.xtake(")")
+	return r
+}
+
+// xthreadMembers parses a message with its descendants: either a single child
+// continuing the thread, or nested threads.
+func (c *Conn) xthreadMembers() ThreadMember {
+	r := ThreadMember{Num: c.xnzuint32()}
+	if c.take(' ') {
+		if c.peek('(') {
+			for c.peek('(') {
+				r.Children = append(r.Children, c.xthreadList())
+			}
+		} else {
+			r.Children = []ThreadMember{c.xthreadMembers()}
+		}
+	}
+	return r
+}
+
 // ../rfc/9051:6546
 // Already consumed: "ESEARCH"
 func (c *Conn) xesearchResponse() (r UntaggedEsearch) {
@@ -1103,6 +1422,16 @@ func (c *Conn) xesearchResponse() (r UntaggedEsearch) {
 		c.xtake("TAG")
 		c.xspace()
 		r.Correlator = c.xastring()
+		// MULTISEARCH adds the mailbox. ../rfc/7377
+		if c.take(' ') {
+			c.xtake("MAILBOX")
+			c.xspace()
+			r.Mailbox = c.xastring()
+			c.xspace()
+			c.xtake("UIDVALIDITY")
+			c.xspace()
+			r.UIDValidity = c.xnzuint32()
+		}
 		c.xtake(")")
 	}
 	if !c.take(' ') {
@@ -1156,6 +1485,29 @@ func (c *Conn) xesearchResponse() (r UntaggedEsearch) {
 			num := c.xuint32()
 			r.Count = &num
 
+		case "MODSEQ":
+			// ../rfc/7162
+			if r.ModSeq != 0 {
+				c.xerrorf("duplicate MODSEQ in ESEARCH")
+			}
+			c.xspace()
+			r.ModSeq = c.xint64()
+
+		case "RELEVANCY":
+			// ../rfc/6203
+			if r.Relevancy != nil {
+				c.xerrorf("duplicate RELEVANCY in ESEARCH")
+			}
+			c.xspace()
+			c.xtake("(")
+			r.Relevancy = []int{}
+			for !c.take(')') {
+				if len(r.Relevancy) > 0 {
+					c.xspace()
+				}
+				r.Relevancy = append(r.Relevancy, int(c.xnzuint32()))
+			}
+
 		default:
 			// Validate ../rfc/9051:7090
 			for i, b := range []byte(w) {
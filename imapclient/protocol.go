@@ -9,27 +9,50 @@ import (
 type Capability string
 
 const (
-	CapIMAP4rev1     Capability = "IMAP4rev1"
-	CapIMAP4rev2     Capability = "IMAP4rev2"
-	CapLoginDisabled Capability = "LOGINDISABLED"
-	CapStarttls      Capability = "STARTTLS"
-	CapAuthPlain     Capability = "AUTH=PLAIN"
-	CapLiteralPlus   Capability = "LITERAL+"
-	CapLiteralMinus  Capability = "LITERAL-"
-	CapIdle          Capability = "IDLE"
-	CapNamespace     Capability = "NAMESPACE"
-	CapBinary        Capability = "BINARY"
-	CapUnselect      Capability = "UNSELECT"
-	CapUidplus       Capability = "UIDPLUS"
-	CapEsearch       Capability = "ESEARCH"
-	CapEnable        Capability = "ENABLE"
-	CapSave          Capability = "SAVE"
-	CapListExtended  Capability = "LIST-EXTENDED"
-	CapSpecialUse    Capability = "SPECIAL-USE"
-	CapMove          Capability = "MOVE"
-	CapUTF8Only      Capability = "UTF8=ONLY"
-	CapUTF8Accept    Capability = "UTF8=ACCEPT"
-	CapID            Capability = "ID" // ../rfc/2971:80
+	CapIMAP4rev1            Capability = "IMAP4rev1"
+	CapIMAP4rev2            Capability = "IMAP4rev2"
+	CapLoginDisabled        Capability = "LOGINDISABLED"
+	CapStarttls             Capability = "STARTTLS"
+	CapAuthPlain            Capability = "AUTH=PLAIN"
+	CapLiteralPlus          Capability = "LITERAL+"
+	CapLiteralMinus         Capability = "LITERAL-"
+	CapIdle                 Capability = "IDLE"
+	CapNamespace            Capability = "NAMESPACE"
+	CapBinary               Capability = "BINARY"
+	CapUnselect             Capability = "UNSELECT"
+	CapUidplus              Capability = "UIDPLUS"
+	CapEsearch              Capability = "ESEARCH"
+	CapEnable               Capability = "ENABLE"
+	CapSave                 Capability = "SAVE"
+	CapListExtended         Capability = "LIST-EXTENDED"
+	CapSpecialUse           Capability = "SPECIAL-USE"
+	CapCreateSpecialUse     Capability = "CREATE-SPECIAL-USE"
+	CapMetadata             Capability = "METADATA"
+	CapQuota                Capability = "QUOTA"                 // ../rfc/9208
+	CapQuotaResStorage      Capability = "QUOTA=RES-STORAGE"     // ../rfc/9208
+	CapQuotaResMessage      Capability = "QUOTA=RES-MESSAGE"     // ../rfc/9208
+	CapACL                  Capability = "ACL"                   // ../rfc/4314
+	CapCompressDeflate      Capability = "COMPRESS=DEFLATE"      // ../rfc/4978
+	CapURLAuth              Capability = "URLAUTH"               // ../rfc/4467
+	CapMultiAppend          Capability = "MULTIAPPEND"           // ../rfc/3502
+	CapUnauthenticate       Capability = "UNAUTHENTICATE"        // ../rfc/8437
+	CapReplace              Capability = "REPLACE"               // ../rfc/8508
+	CapAnnotateExperiment1  Capability = "ANNOTATE-EXPERIMENT-1" // ../rfc/5257
+	CapMove                 Capability = "MOVE"
+	CapUTF8Only             Capability = "UTF8=ONLY"
+	CapUTF8Accept           Capability = "UTF8=ACCEPT"
+	CapID                   Capability = "ID"                    // ../rfc/2971:80
+	CapCondstore            Capability = "CONDSTORE"             // ../rfc/7162
+	CapQresync              Capability = "QRESYNC"               // ../rfc/7162
+	CapNotify               Capability = "NOTIFY"                // ../rfc/5465
+	CapMultiSearch          Capability = "MULTISEARCH"           // ../rfc/7377
+	CapSort                 Capability = "SORT"                  // ../rfc/5256
+	CapThreadOrderedSubject Capability = "THREAD=ORDEREDSUBJECT" // ../rfc/5256
+	CapThreadReferences     Capability = "THREAD=REFERENCES"     // ../rfc/5256
+	CapSearchFuzzy          Capability = "SEARCH=FUZZY"          // ../rfc/6203
+	CapObjectID             Capability = "OBJECTID"              // ../rfc/8474
+	CapSaveDate             Capability = "SAVEDATE"              // ../rfc/8514
+	CapPreview              Capability = "PREVIEW"               // ../rfc/8970
 )
 
 // Status is the tagged final result of a command.
@@ -103,11 +126,19 @@ func (c CodeUint) CodeString() string {
 // "APPENDUID" response code.
 type CodeAppendUID struct {
 	UIDValidity uint32
-	UID         uint32
+	UID         uint32     // First UID.
+	UIDs        []NumRange // Only set with MULTIAPPEND if multiple messages were appended. ../rfc/3502
 }
 
 func (c CodeAppendUID) CodeString() string {
-	return fmt.Sprintf("APPENDUID %d %d", c.UIDValidity, c.UID)
+	if c.UIDs == nil {
+		return fmt.Sprintf("APPENDUID %d %d", c.UIDValidity, c.UID)
+	}
+	var l []string
+	for _, e := range c.UIDs {
+		l = append(l, e.String())
+	}
+	return fmt.Sprintf("APPENDUID %d %s", c.UIDValidity, strings.Join(l, ","))
 }
 
 // "COPYUID" response code.
@@ -134,6 +165,27 @@ func (c CodeCopyUID) CodeString() string {
 	return fmt.Sprintf("COPYUID %d %s %s", c.DestUIDValidity, str(c.From), str(c.To))
 }
 
+// "HIGHESTMODSEQ" response code.
+type CodeHighestModSeq int64
+
+func (c CodeHighestModSeq) CodeString() string {
+	return fmt.Sprintf("HIGHESTMODSEQ %d", c)
+}
+
+// "MAILBOXID" response code.
+type CodeMailboxID string
+
+func (c CodeMailboxID) CodeString() string {
+	return fmt.Sprintf("MAILBOXID (%s)", string(c))
+}
+
+// "MODIFIED" response code.
+type CodeModified NumSet
+
+func (c CodeModified) CodeString() string {
+	return fmt.Sprintf("MODIFIED %s", NumSet(c).String())
+}
+
 // RespText represents a response line minus the leading tag.
 type RespText struct {
 	Code    string  // The first word between [] after the status.
@@ -201,9 +253,33 @@ type UntaggedFetch struct {
 	Attrs []FetchAttr
 }
 type UntaggedSearch []uint32
+
+// UntaggedSearchModSeq is a SEARCH response with the highest modseq of the
+// matching messages, for a search with a MODSEQ key. ../rfc/7162
+type UntaggedSearchModSeq struct {
+	Nums   []uint32
+	ModSeq int64
+}
+
+// UntaggedSort is a SORT response, with message sequence numbers or UIDs in
+// sorted order. ../rfc/5256
+type UntaggedSort []uint32
+
+// UntaggedThread is a THREAD response, with threads of message sequence numbers
+// or UIDs. ../rfc/5256
+type UntaggedThread []ThreadMember
+
+// ThreadMember is a message in a thread, with its replies as children. A dummy
+// parent, for threads without a common parent message, has Num 0.
+type ThreadMember struct {
+	Num      uint32
+	Children []ThreadMember
+}
+
 type UntaggedStatus struct {
-	Mailbox string
-	Attrs   map[string]int64 // Upper case status attributes. ../rfc/9051:7059
+	Mailbox   string
+	Attrs     map[string]int64 // Upper case status attributes. ../rfc/9051:7059
+	MailboxID string           // For the MAILBOXID attribute, not in Attrs. ../rfc/8474
 }
 type UntaggedNamespace struct {
 	Personal, Other, Shared []NamespaceDescr
@@ -218,19 +294,106 @@ type UntaggedLsub struct {
 // Fields are optional and zero if absent.
 type UntaggedEsearch struct {
 	// ../rfc/9051:6546
-	Correlator string
-	UID        bool
-	Min        uint32
-	Max        uint32
-	All        NumSet
-	Count      *uint32
-	Exts       []EsearchDataExt
+	Correlator  string
+	Mailbox     string // For MULTISEARCH.
+	UIDValidity uint32 // For MULTISEARCH.
+	UID         bool
+	Min         uint32
+	Max         uint32
+	All         NumSet
+	Count       *uint32
+	ModSeq      int64
+	Relevancy   []int // For SEARCH=FUZZY, scores from 1 to 100 for the messages in All.
+	Exts        []EsearchDataExt
 }
 
 // ../rfc/2971:184
 
 type UntaggedID map[string]string
 
+// UntaggedMetadata is a METADATA response, with annotations of a mailbox, or
+// of the server if Mailbox is empty. ../rfc/5464
+type UntaggedMetadata struct {
+	Mailbox     string
+	Annotations []Annotation
+}
+
+// Annotation is a metadata entry in a METADATA response.
+type Annotation struct {
+	Key      string
+	IsString bool   // False for NIL and binary data from a literal8.
+	Value    []byte // Nil for NIL.
+}
+
+// UntaggedQuotaroot is a QUOTAROOT response, with the quota roots of a
+// mailbox. ../rfc/9208
+type UntaggedQuotaroot struct {
+	Mailbox string
+	Roots   []string
+}
+
+// UntaggedQuota is a QUOTA response, with the usage and limits of the
+// resources of a quota root. ../rfc/9208
+type UntaggedQuota struct {
+	Root      string
+	Resources []QuotaResource
+}
+
+// QuotaResource is the usage and limit of a resource, e.g. STORAGE in units of
+// 1024 bytes, or MESSAGE.
+type QuotaResource struct {
+	Name  string
+	Usage int64
+	Limit int64
+}
+
+// UntaggedACL is an ACL response, with the rights per identifier on a mailbox.
+// ../rfc/4314
+type UntaggedACL struct {
+	Mailbox string
+	Rights  []IdentifierRights
+}
+
+// IdentifierRights is an identifier with its rights, in an ACL response.
+type IdentifierRights struct {
+	Identifier string
+	Rights     string
+}
+
+// UntaggedListrights is a LISTRIGHTS response, with the rights that are always
+// granted to an identifier, and the groups of rights that can be granted.
+// ../rfc/4314
+type UntaggedListrights struct {
+	Mailbox    string
+	Identifier string
+	Required   string
+	Optional   []string
+}
+
+// UntaggedMyrights is a MYRIGHTS response, with the rights of the user on a
+// mailbox. ../rfc/4314
+type UntaggedMyrights struct {
+	Mailbox string
+	Rights  string
+}
+
+// UntaggedGenurlauth is a GENURLAUTH response, with the generated URLs with
+// URLAUTH authorization. ../rfc/4467
+type UntaggedGenurlauth []string
+
+// UntaggedURLFetch is a URLFETCH response, with the data for a URL. Data is nil
+// if the URL is invalid. ../rfc/4467
+type UntaggedURLFetch struct {
+	URL  string
+	Data []byte
+}
+
+// UntaggedVanished is a VANISHED response, with UIDs of expunged messages. ../rfc/7162
+type UntaggedVanished struct {
+	Earlier bool // Whether the messages were expunged earlier, e.g. during QRESYNC SELECT.
+	UIDs    NumSet
+}
+
 // Extended data in an ESEARCH response.
 type EsearchDataExt struct {
 	Tag   string
@@ -349,6 +512,36 @@ type Address struct {
 type FetchInternalDate string            // todo: parsed time
 func (f FetchInternalDate) Attr() string { return "INTERNALDATE" }
 
+// "SAVEDATE" fetch response. Empty for NIL.
+type FetchSaveDate string            // todo: parsed time
+func (f FetchSaveDate) Attr() string { return "SAVEDATE" }
+
+// "PREVIEW" fetch response.
+type FetchPreview struct {
+	Preview *string // Nil for NIL.
+}
+
+func (f FetchPreview) Attr() string { return "PREVIEW" }
+
+// "ANNOTATION" fetch response. ../rfc/5257
+type FetchAnnotation []AnnotationEntry
+
+func (f FetchAnnotation) Attr() string { return "ANNOTATION" }
+
+// AnnotationEntry is an entry in an ANNOTATION fetch response. Attribs is
+// empty when changed entries are announced without values.
+type AnnotationEntry struct {
+	Entry   string
+	Attribs []AnnotationAttrib
+}
+
+// AnnotationAttrib is an attribute of an annotation entry, e.g. "value.priv"
+// or "size.shared".
+type AnnotationAttrib struct {
+	Name  string
+	Value *string // Nil for NIL.
+}
+
 // "RFC822.SIZE" fetch response.
 type FetchRFC822Size int64
 
@@ -450,3 +643,18 @@ func (f FetchBinarySize) Attr() string { return f.RespAttr }
 type FetchUID uint32
 
 func (f FetchUID) Attr() string { return "UID" }
+
+// "MODSEQ" fetch response.
+type FetchModSeq int64
+
+func (f FetchModSeq) Attr() string { return "MODSEQ" }
+
+// "EMAILID" fetch response.
+type FetchEmailID string
+
+func (f FetchEmailID) Attr() string { return "EMAILID" }
+
+// "THREADID" fetch response. Empty for NIL.
+type FetchThreadID string
+
+func (f FetchThreadID) Attr() string { return "THREADID" }
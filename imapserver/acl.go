@@ -0,0 +1,515 @@
+package imapserver
+
+import (
+	"context"
+	"strings"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/smtp"
+	"github.com/mjl-/mox/store"
+)
+
+// Mailboxes of other accounts that were shared with the user are in the "other
+// users" namespace, named "#shared/<account>/<mailbox>" by default. Mailboxes of
+// a configured account with public folders are in the "shared" namespace, named
+// "#public/<mailbox>" by default. Own mailbox names cannot contain a "#", so they
+// cannot clash with the default prefixes. ../rfc/2342
+const (
+	sharedPrefixDefault = "#shared/"
+	publicPrefixDefault = "#public/"
+)
+
+// sharedMailbox is the selected mailbox when it is a shared mailbox of another
+// account.
+type sharedMailbox struct {
+	account *store.Account // Of the owner.
+	comm    *store.Comm    // For changes in the account of the owner.
+	prefix  string         // E.g. "#shared/<owner>/", for mailbox names in responses.
+	rights  string         // Rights of the user on the mailbox.
+}
+
+// namespaces are the prefixes of the namespaces with mailboxes of other accounts
+// for the user.
+type namespaces struct {
+	shared        string // E.g. "#shared/", followed by the account name of the owner.
+	public        string // E.g. "#public/", only used if publicAccount is set.
+	publicAccount string
+}
+
+// namespaces returns the namespaces for the user, as configured for the account
+// or its domain.
+func (c *conn) namespaces() namespaces {
+	ns := namespaces{sharedPrefixDefault, publicPrefixDefault, ""}
+	if conf := mox.Conf.Namespaces(c.userAccountName()); conf != nil {
+		if conf.SharedPrefix != "" {
+			ns.shared = conf.SharedPrefix + "/"
+		}
+		if conf.PublicPrefix != "" {
+			ns.public = conf.PublicPrefix + "/"
+		}
+		ns.publicAccount = conf.PublicAccount
+	}
+	return ns
+}
+
+// sharedMailboxPrefix returns the prefix for mailboxes of account owner, for
+// mailbox names in responses.
+func (c *conn) sharedMailboxPrefix(owner string) string {
+	ns := c.namespaces()
+	if owner == ns.publicAccount {
+		return ns.public
+	}
+	return ns.shared + owner + "/"
+}
+
+// xsharedMailboxName parses a name in the shared or public namespace into the
+// account name of the owner and the mailbox name in that account. ok is false if
+// name is not in one of those namespaces. Prefixes are matched
+// case-insensitively.
+func (c *conn) xsharedMailboxName(name string) (owner, mbname string, ok bool) {
+	ns := c.namespaces()
+	if ns.publicAccount != "" && hasPrefixFold(name, ns.public) {
+		return ns.publicAccount, xcheckmailboxname(name[len(ns.public):], true), true
+	}
+	if !hasPrefixFold(name, ns.shared) {
+		return "", "", false
+	}
+	t := strings.SplitN(name[len(ns.shared):], "/", 2)
+	if len(t) != 2 || t[0] == "" || t[0] == ns.publicAccount {
+		xusercodeErrorf("NONEXISTENT", "%w", store.ErrUnknownMailbox)
+	}
+	return t[0], xcheckmailboxname(t[1], true), true
+}
+
+// xcheckOwnMailboxName fails the command if name is in the shared or public
+// namespace, for creating or renaming own mailboxes. Only relevant for configured
+// prefixes, own mailbox names cannot start with the default prefixes.
+func (c *conn) xcheckOwnMailboxName(name string) {
+	ns := c.namespaces()
+	prefixes := []string{ns.shared}
+	if ns.publicAccount != "" {
+		prefixes = append(prefixes, ns.public)
+	}
+	for _, prefix := range prefixes {
+		if hasPrefixFold(name+"/", prefix) {
+			xusercodeErrorf("CANNOT", "mailbox name in namespace for mailboxes of other accounts")
+		}
+	}
+}
+
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// userAccountName returns the name of the account of the user, also while the
+// connection operates on the account of the owner of a shared mailbox.
+func (c *conn) userAccountName() string {
+	if c.ownAccount != nil {
+		return c.ownAccount.Name
+	}
+	return c.account.Name
+}
+
+// xsharedOpen opens the account of the owner of a shared mailbox, and checks
+// the user has the needed rights. Without the lookup or read right, the mailbox
+// is treated as nonexistent. The caller must close the account.
+func (c *conn) xsharedOpen(owner, mbname, need string) (*store.Account, store.Mailbox, string) {
+	if _, ok := mox.Conf.Account(owner); !ok || owner == c.userAccountName() {
+		xusercodeErrorf("NONEXISTENT", "%w", store.ErrUnknownMailbox)
+	}
+	acc, err := store.OpenAccount(owner)
+	xcheckf(err, "open account of shared mailbox")
+	ok := false
+	defer func() {
+		if !ok {
+			err := acc.Close()
+			c.xsanity(err, "closing account")
+		}
+	}()
+
+	var mb *store.Mailbox
+	var rights string
+	acc.WithRLock(func() {
+		err = store.DBRead(context.TODO(), c.log, "imapserver", acc.DB, func(tx *bstore.Tx) error {
+			var err error
+			mb, err = acc.MailboxFind(tx, mbname)
+			if err == nil && mb != nil {
+				rights, err = store.MailboxACLRights(tx, mb.ID, c.userAccountName())
+			}
+			return err
+		})
+	})
+	xcheckf(err, "looking up shared mailbox")
+	if mb == nil || !strings.ContainsAny(rights, "lr") {
+		xusercodeErrorf("NONEXISTENT", "%w", store.ErrUnknownMailbox)
+	}
+	for _, r := range need {
+		if !strings.ContainsRune(rights, r) {
+			xusercodeErrorf("NOPERM", "missing right %c on shared mailbox", r)
+		}
+	}
+	ok = true
+	return acc, *mb, rights
+}
+
+// swapAccount makes the connection operate on the account of the owner of a
+// shared mailbox, with its comm, until unswap is called. Commands on the selected
+// shared mailbox run this way.
+func (c *conn) swapAccount(acc *store.Account, comm *store.Comm) {
+	if c.ownAccount != nil {
+		xserverErrorf("already operating on account of shared mailbox")
+	}
+	c.ownAccount, c.ownComm = c.account, c.comm
+	c.account, c.comm = acc, comm
+}
+
+// unswap restores the account of the user after swapAccount. It can be called
+// multiple times.
+func (c *conn) unswap() {
+	if c.ownAccount == nil {
+		return
+	}
+	c.account, c.comm = c.ownAccount, c.ownComm
+	c.ownAccount, c.ownComm = nil, nil
+}
+
+// sharedClose closes the selected shared mailbox.
+func (c *conn) sharedClose() {
+	if c.shared == nil {
+		return
+	}
+	c.unswap()
+	c.shared.comm.Unregister()
+	err := c.shared.account.Close()
+	c.xsanity(err, "closing account of shared mailbox")
+	c.shared = nil
+}
+
+// isSelected returns whether the mailbox with id in the account the connection
+// currently operates on is the selected mailbox.
+func (c *conn) isSelected(mailboxID int64) bool {
+	if c.state != stateSelected || c.mailboxID != mailboxID {
+		return false
+	}
+	if c.shared == nil {
+		return c.ownAccount == nil
+	}
+	return c.account == c.shared.account
+}
+
+// hasRight returns whether the user has right r on the selected mailbox. Users
+// have all rights on their own mailboxes, except with a read-only account.
+func (c *conn) hasRight(r rune) bool {
+	if c.readOnlyAccount() && !strings.ContainsRune(readOnlyRights, r) {
+		return false
+	}
+	return c.shared == nil || strings.ContainsRune(c.shared.rights, r)
+}
+
+// Rights of users of accounts with IMAPReadOnly, at most.
+const readOnlyRights = "lr"
+
+// readOnlyAccount returns whether the account of the user is configured as
+// IMAPReadOnly, also while operating on the account of a shared mailbox.
+func (c *conn) readOnlyAccount() bool {
+	acc := c.account
+	if c.ownAccount != nil {
+		acc = c.ownAccount
+	}
+	if acc == nil {
+		return false
+	}
+	conf, _ := acc.Conf()
+	return conf.IMAPReadOnly
+}
+
+// xneedRight fails the command with NOPERM if the user doesn't have right r on
+// the selected mailbox.
+func (c *conn) xneedRight(r rune) {
+	if !c.hasRight(r) {
+		xusercodeErrorf("NOPERM", "missing right %c on shared mailbox", r)
+	}
+}
+
+// applySharedChanges writes pending changes for the selected shared mailbox.
+func (c *conn) applySharedChanges() {
+	if c.shared == nil || c.ownAccount != nil {
+		return
+	}
+	c.swapAccount(c.shared.account, c.shared.comm)
+	defer c.unswap()
+	c.applyChanges(c.comm.Get(), false)
+}
+
+// sharedPending returns the channel that signals pending changes for the
+// selected shared mailbox. It is nil, never ready, if no shared mailbox is
+// selected.
+func (c *conn) sharedPending() <-chan struct{} {
+	if c.shared == nil {
+		return nil
+	}
+	return c.shared.comm.Pending
+}
+
+// xcopyDestination returns the name of the destination mailbox for COPY and
+// MOVE, in the account of the selected mailbox. Messages cannot be copied or
+// moved between accounts. A destination in a shared mailbox needs the insert
+// right.
+func (c *conn) xcopyDestination(name string) string {
+	owner, mbname, isShared := c.xsharedMailboxName(name)
+	if c.shared == nil && !isShared {
+		return xcheckmailboxname(name, true)
+	}
+	if c.shared == nil || !isShared || owner != c.account.Name {
+		xusercodeErrorf("CANNOT", "cannot copy or move messages between accounts")
+	}
+	c.account.WithRLock(func() {
+		c.xdbread(func(tx *bstore.Tx) {
+			mb := c.xmailbox(tx, mbname, "TRYCREATE")
+			rights, err := store.MailboxACLRights(tx, mb.ID, c.userAccountName())
+			xcheckf(err, "looking up rights")
+			if !strings.ContainsAny(rights, "lr") {
+				xusercodeErrorf("TRYCREATE", "%w", store.ErrUnknownMailbox)
+			} else if !strings.ContainsRune(rights, 'i') {
+				xusercodeErrorf("NOPERM", "missing right i on shared mailbox")
+			}
+		})
+	})
+	return mbname
+}
+
+// xaclIdentifier returns the account name for an identifier in an ACL command:
+// "anyone", an account name or an email address of an account.
+func xaclIdentifier(id string) string {
+	if strings.EqualFold(id, store.ACLAnyone) {
+		return store.ACLAnyone
+	}
+	if strings.HasPrefix(id, "-") {
+		// ../rfc/4314 section 2
+		xusercodeErrorf("CANNOT", "negative rights not supported")
+	}
+	if _, ok := mox.Conf.Account(id); ok {
+		return id
+	}
+	if addr, err := smtp.ParseAddress(id); err == nil {
+		// Not through a catchall address.
+		if name, canonical, _, err := mox.FindAccount(addr.Localpart, addr.Domain, false); err == nil && !strings.HasPrefix(canonical, "@") {
+			return name
+		}
+	}
+	xuserErrorf("unknown identifier %q", id)
+	panic("not reached")
+}
+
+// xaclMailbox returns an own mailbox for an ACL command. For shared mailboxes,
+// the user needs the admin right, which cannot be granted.
+func (c *conn) xaclMailbox(tx *bstore.Tx, name string) store.Mailbox {
+	if _, _, ok := c.xsharedMailboxName(name); ok {
+		xusercodeErrorf("NOPERM", "cannot change or view access of shared mailbox")
+	}
+	return c.xmailbox(tx, xcheckmailboxname(name, true), "NONEXISTENT")
+}
+
+// Setacl changes the rights of an identifier on a mailbox of the account.
+// Rights starting with "+" are added, with "-" removed, otherwise they replace
+// the current rights.
+//
+// State: Authenticated and selected.
+func (c *conn) cmdSetacl(tag, cmd string, p *parser) {
+	// Command: ../rfc/4314 section 3.1
+
+	p.xspace()
+	name := p.xmailbox()
+	p.xspace()
+	identifier := p.xastring()
+	p.xspace()
+	rights := p.xastring()
+	p.xempty()
+
+	var op byte
+	if strings.HasPrefix(rights, "+") || strings.HasPrefix(rights, "-") {
+		op = rights[0]
+		rights = rights[1:]
+	}
+	for _, r := range rights {
+		// Unknown rights are a syntax error. ../rfc/4314 section 3.1
+		if !strings.ContainsRune(store.ACLRightsOwner+"cd", r) && !(r >= '0' && r <= '9') {
+			xsyntaxErrorf("unknown right %c", r)
+		}
+	}
+	// Obsolete rights from RFC 2086. ../rfc/4314 section 2.1.1
+	rights = strings.ReplaceAll(rights, "c", "k")
+	rights = strings.ReplaceAll(rights, "d", "te")
+
+	c.xsetacl(name, identifier, op, rights)
+	c.ok(tag, cmd)
+}
+
+// Deleteacl removes the rights of an identifier on a mailbox of the account.
+//
+// State: Authenticated and selected.
+func (c *conn) cmdDeleteacl(tag, cmd string, p *parser) {
+	// Command: ../rfc/4314 section 3.2
+
+	p.xspace()
+	name := p.xmailbox()
+	p.xspace()
+	identifier := p.xastring()
+	p.xempty()
+
+	c.xsetacl(name, identifier, 0, "")
+	c.ok(tag, cmd)
+}
+
+// xsetacl sets rights for SETACL and DELETEACL. op is '+' or '-' for adding or
+// removing rights.
+func (c *conn) xsetacl(name, identifier string, op byte, rights string) {
+	id := xaclIdentifier(identifier)
+	if id == c.account.Name {
+		xusercodeErrorf("CANNOT", "rights of the owner cannot be changed")
+	}
+
+	c.account.WithWLock(func() {
+		c.xdbwrite(func(tx *bstore.Tx) {
+			mb := c.xaclMailbox(tx, name)
+
+			// Current rights of the identifier itself, without those of anyone.
+			acls, err := store.MailboxACLs(tx, mb.ID)
+			xcheckf(err, "listing rights")
+			var cur string
+			for _, acl := range acls {
+				if acl.Identifier == id {
+					cur = acl.Rights
+				}
+			}
+
+			var nrights string
+			switch op {
+			case '+':
+				nrights = cur + rights
+			case '-':
+				for _, r := range cur {
+					if !strings.ContainsRune(rights, r) {
+						nrights += string(r)
+					}
+				}
+			default:
+				nrights = rights
+			}
+			nrights = store.ACLRightsNormalize(nrights)
+			for _, r := range nrights {
+				if !strings.ContainsRune(store.ACLRightsGrantable, r) {
+					xusercodeErrorf("CANNOT", "right %c cannot be granted, only %s", r, store.ACLRightsGrantable)
+				}
+			}
+			err = store.MailboxACLSet(tx, mb.ID, id, nrights)
+			xcheckf(err, "setting rights")
+		})
+	})
+}
+
+// Getacl returns the rights of the owner and the identifiers that were granted
+// rights on a mailbox.
+//
+// State: Authenticated and selected.
+func (c *conn) cmdGetacl(tag, cmd string, p *parser) {
+	// Command: ../rfc/4314 section 3.3
+
+	p.xspace()
+	name := p.xmailbox()
+	p.xempty()
+
+	var mb store.Mailbox
+	var acls []store.MailboxACL
+	c.account.WithRLock(func() {
+		c.xdbread(func(tx *bstore.Tx) {
+			mb = c.xaclMailbox(tx, name)
+			var err error
+			acls, err = store.MailboxACLs(tx, mb.ID)
+			xcheckf(err, "listing rights")
+		})
+	})
+
+	l := []string{astring(c.account.Name).pack(c), store.ACLRightsOwner}
+	for _, acl := range acls {
+		l = append(l, astring(acl.Identifier).pack(c), acl.Rights)
+	}
+	c.bwritelinef("* ACL %s %s", astring(mb.Name).pack(c), strings.Join(l, " "))
+	c.ok(tag, cmd)
+}
+
+// Listrights returns the rights that are always granted to an identifier on a
+// mailbox, and the rights that can be granted.
+//
+// State: Authenticated and selected.
+func (c *conn) cmdListrights(tag, cmd string, p *parser) {
+	// Command: ../rfc/4314 section 3.4
+
+	p.xspace()
+	name := p.xmailbox()
+	p.xspace()
+	identifier := p.xastring()
+	p.xempty()
+
+	id := xaclIdentifier(identifier)
+
+	var mb store.Mailbox
+	c.account.WithRLock(func() {
+		c.xdbread(func(tx *bstore.Tx) {
+			mb = c.xaclMailbox(tx, name)
+		})
+	})
+
+	var rights []string
+	if id == c.account.Name {
+		rights = []string{store.ACLRightsOwner}
+	} else {
+		rights = []string{`""`}
+		for _, r := range store.ACLRightsGrantable {
+			rights = append(rights, string(r))
+		}
+	}
+	c.bwritelinef("* LISTRIGHTS %s %s %s", astring(mb.Name).pack(c), astring(identifier).pack(c), strings.Join(rights, " "))
+	c.ok(tag, cmd)
+}
+
+// Myrights returns the rights of the user on a mailbox. Users have all rights on
+// their own mailboxes.
+//
+// State: Authenticated and selected.
+func (c *conn) cmdMyrights(tag, cmd string, p *parser) {
+	// Command: ../rfc/4314 section 3.5
+
+	p.xspace()
+	name := p.xmailbox()
+	p.xempty()
+
+	var rights string
+	if owner, mbname, ok := c.xsharedMailboxName(name); ok {
+		acc, _, r := c.xsharedOpen(owner, mbname, "")
+		err := acc.Close()
+		c.xsanity(err, "closing account")
+		rights = r
+	} else {
+		name = xcheckmailboxname(name, true)
+		c.account.WithRLock(func() {
+			c.xdbread(func(tx *bstore.Tx) {
+				name = c.xmailbox(tx, name, "NONEXISTENT").Name
+			})
+		})
+		rights = store.ACLRightsOwner
+	}
+	if c.readOnlyAccount() {
+		var l []rune
+		for _, r := range rights {
+			if strings.ContainsRune(readOnlyRights, r) {
+				l = append(l, r)
+			}
+		}
+		rights = string(l)
+	}
+	c.bwritelinef("* MYRIGHTS %s %s", astring(name).pack(c), rights)
+	c.ok(tag, cmd)
+}
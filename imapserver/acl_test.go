@@ -0,0 +1,252 @@
+package imapserver
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/imapclient"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/store"
+)
+
+func TestACL(t *testing.T) {
+	tc := start(t)
+	defer tc.close()
+
+	acc, err := store.OpenAccount("other")
+	tcheck(t, err, "open account")
+	err = acc.SetPassword("testtest")
+	tcheck(t, err, "set password")
+	err = acc.Close()
+	tcheck(t, err, "close account")
+
+	tc2 := startNoSwitchboard(t)
+	defer tc2.close()
+
+	tc.client.Login("mjl@mox.example", "testtest")
+	tc2.client.Login("other@mox.example", "testtest")
+
+	tc.transactf("ok", "namespace")
+	tc.xuntagged(imapclient.UntaggedNamespace{
+		Personal: []imapclient.NamespaceDescr{{Prefix: "", Separator: '/'}},
+		Other:    []imapclient.NamespaceDescr{{Prefix: "#shared/", Separator: '/'}},
+	})
+
+	tc.client.Create("shared")
+	tc.client.Append("shared", nil, nil, []byte(exampleMsg))
+
+	// Owners have all rights on their own mailboxes.
+	tc.transactf("ok", "myrights shared")
+	tc.xuntagged(imapclient.UntaggedMyrights{Mailbox: "shared", Rights: "lrswipkxtea"})
+	tc.transactf("ok", "getacl shared")
+	tc.xuntagged(imapclient.UntaggedACL{Mailbox: "shared", Rights: []imapclient.IdentifierRights{{Identifier: "mjl", Rights: "lrswipkxtea"}}})
+	tc.transactf("ok", "listrights shared other")
+	tc.xuntagged(imapclient.UntaggedListrights{Mailbox: "shared", Identifier: "other", Required: "", Optional: []string{"l", "r", "s", "w", "i", "t", "e"}})
+	tc.transactf("no", "getacl nonexistent")
+	tc.xcode("NONEXISTENT")
+
+	// Not shared yet.
+	tc2.transactf("no", "select #shared/mjl/shared")
+	tc2.xcode("NONEXISTENT")
+	tc2.transactf("ok", `list "" "#*"`)
+	tc2.xuntagged()
+
+	// Grant lookup and read, by email address.
+	tc.transactf("ok", "setacl shared other@mox.example lr")
+	tc.transactf("ok", "getacl shared")
+	tc.xuntagged(imapclient.UntaggedACL{Mailbox: "shared", Rights: []imapclient.IdentifierRights{{Identifier: "mjl", Rights: "lrswipkxtea"}, {Identifier: "other", Rights: "lr"}}})
+
+	tc.transactf("bad", "setacl shared other lz") // Unknown right.
+	tc.transactf("no", "setacl shared other +a")  // Cannot be granted.
+	tc.xcode("CANNOT")
+	tc.transactf("no", "setacl shared mjl l")
+	tc.xcode("CANNOT")
+	tc.transactf("no", "setacl shared -other l")
+	tc.xcode("CANNOT")
+	tc.transactf("no", "setacl shared unknown@mox.example l") // Catchall address.
+
+	tc2.transactf("ok", `list "" "#*"`)
+	tc2.xuntagged(
+		imapclient.UntaggedList{Flags: []string{`\Noselect`}, Separator: '/', Mailbox: "#shared"},
+		imapclient.UntaggedList{Flags: []string{`\Noselect`}, Separator: '/', Mailbox: "#shared/mjl"},
+		imapclient.UntaggedList{Separator: '/', Mailbox: "#shared/mjl/shared"},
+	)
+	tc2.transactf("ok", "myrights #shared/mjl/shared")
+	tc2.xuntagged(imapclient.UntaggedMyrights{Mailbox: "#shared/mjl/shared", Rights: "lr"})
+	tc2.transactf("no", "getacl #shared/mjl/shared")
+	tc2.xcode("NOPERM")
+	tc2.transactf("ok", "status #shared/mjl/shared (messages)")
+	tc2.xuntagged(imapclient.UntaggedStatus{Mailbox: "#shared/mjl/shared", Attrs: map[string]int64{"MESSAGES": 1}})
+	tc2.transactf("no", "delete #shared/mjl/shared")
+
+	// Without rights to make changes, the mailbox is read-only.
+	tc2.transactf("ok", "select #shared/mjl/shared")
+	tc2.xcode("READ-ONLY")
+	tc2.transactf("no", `store 1 +flags (\Seen)`)
+	tc2.transactf("no", "copy 1 inbox")
+	tc2.xcode("CANNOT")
+
+	// Changes by the owner are sent for the shared mailbox.
+	tc.client.Append("shared", nil, nil, []byte(exampleMsg))
+	tc2.transactf("ok", "noop")
+	tc2.xuntagged(imapclient.UntaggedExists(2), imapclient.UntaggedFetch{Seq: 2, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(2), imapclient.FetchFlags(nil)}})
+
+	// With write rights, but without expunge.
+	tc.transactf("ok", "setacl shared other +swit")
+	tc2.transactf("ok", "select #shared/mjl/shared")
+	tc2.xcode("READ-WRITE")
+	tc2.transactf("ok", `store 1 +flags (\Seen \Deleted)`)
+	tc2.xuntagged(imapclient.UntaggedFetch{Seq: 1, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(1), imapclient.FetchFlags{`\Seen`, `\Deleted`}}})
+	tc2.transactf("no", "expunge")
+	tc2.xcode("NOPERM")
+	tc2.transactf("ok", "append #shared/mjl/shared {1+}\r\nx")
+	tc2.xuntagged(imapclient.UntaggedExists(3))
+	tc.transactf("ok", "status shared (messages deleted)")
+	tc.xuntagged(imapclient.UntaggedStatus{Mailbox: "shared", Attrs: map[string]int64{"MESSAGES": 3, "DELETED": 1}})
+
+	tc.transactf("ok", "setacl shared other -i")
+	tc2.transactf("no", "append #shared/mjl/shared {1+}\r\nx")
+	tc2.xcode("NOPERM")
+	tc2.transactf("ok", "unselect")
+
+	// Without rights, the mailbox is gone.
+	tc.transactf("ok", "deleteacl shared other")
+	tc2.transactf("no", "status #shared/mjl/shared (messages)")
+	tc2.xcode("NONEXISTENT")
+
+	// Rights for anyone.
+	tc.transactf("ok", "setacl shared anyone lr")
+	tc2.transactf("ok", "myrights #shared/mjl/shared")
+	tc2.xuntagged(imapclient.UntaggedMyrights{Mailbox: "#shared/mjl/shared", Rights: "lr"})
+
+	// Removing the mailbox removes its rights.
+	tc.client.Delete("shared")
+	tc.client.Create("shared")
+	tc2.transactf("no", "myrights #shared/mjl/shared")
+	tc2.xcode("NONEXISTENT")
+}
+
+func TestNamespaces(t *testing.T) {
+	tc := start(t)
+	defer tc.close()
+
+	// Account "other" has public folders, and mjl uses configured prefixes.
+	accConf := mox.Conf.Dynamic.Accounts["mjl"]
+	defer func() {
+		mox.Conf.Dynamic.Accounts["mjl"] = accConf
+	}()
+	nc := accConf
+	nc.Namespaces = &config.Namespaces{SharedPrefix: "Shared", PublicAccount: "other", PublicPrefix: "Public"}
+	mox.Conf.Dynamic.Accounts["mjl"] = nc
+
+	acc, err := store.OpenAccount("other")
+	tcheck(t, err, "open account")
+	defer func() {
+		err := acc.Close()
+		tcheck(t, err, "close account")
+	}()
+	acc.WithWLock(func() {
+		err = acc.DB.Write(context.Background(), func(tx *bstore.Tx) error {
+			mb, err := acc.MailboxFind(tx, "Inbox")
+			if err != nil {
+				return err
+			}
+			return store.MailboxACLSet(tx, mb.ID, store.ACLAnyone, "lr")
+		})
+	})
+	tcheck(t, err, "granting rights")
+
+	tc.client.Login("mjl@mox.example", "testtest")
+
+	tc.transactf("ok", "namespace")
+	tc.xuntagged(imapclient.UntaggedNamespace{
+		Personal: []imapclient.NamespaceDescr{{Prefix: "", Separator: '/'}},
+		Other:    []imapclient.NamespaceDescr{{Prefix: "Shared/", Separator: '/'}},
+		Shared:   []imapclient.NamespaceDescr{{Prefix: "Public/", Separator: '/'}},
+	})
+
+	// Mailboxes of the public account are in the public namespace, not in the
+	// namespace of other accounts.
+	tc.transactf("ok", `list "" "P*"`)
+	tc.xuntagged(
+		imapclient.UntaggedList{Flags: []string{`\Noselect`}, Separator: '/', Mailbox: "Public"},
+		imapclient.UntaggedList{Separator: '/', Mailbox: "Public/Inbox"},
+	)
+	tc.transactf("ok", `list "" "Shared/*"`)
+	tc.xuntagged()
+	tc.transactf("no", "select Shared/other/Inbox")
+	tc.xcode("NONEXISTENT")
+	tc.transactf("ok", "myrights public/inbox")
+	tc.xuntagged(imapclient.UntaggedMyrights{Mailbox: "public/inbox", Rights: "lr"})
+	tc.transactf("ok", "status Public/Inbox (messages)")
+	tc.xuntagged(imapclient.UntaggedStatus{Mailbox: "Public/Inbox", Attrs: map[string]int64{"MESSAGES": 0}})
+	tc.transactf("ok", "examine Public/Inbox")
+
+	// Own mailboxes cannot be created in the namespaces.
+	tc.transactf("no", "create Shared/test")
+	tc.xcode("CANNOT")
+	tc.transactf("no", "create public")
+	tc.xcode("CANNOT")
+	tc.transactf("no", "rename Sent Public/Sent")
+	tc.xcode("CANNOT")
+	tc.transactf("ok", "create Publications")
+}
+
+func TestReadOnlyAccount(t *testing.T) {
+	tc := start(t)
+	defer tc.close()
+
+	tc.client.Login("mjl@mox.example", "testtest")
+	tc.client.Append("inbox", nil, nil, []byte(exampleMsg))
+
+	accConf := mox.Conf.Dynamic.Accounts["mjl"]
+	defer func() {
+		mox.Conf.Dynamic.Accounts["mjl"] = accConf
+	}()
+	nc := accConf
+	nc.IMAPReadOnly = true
+	mox.Conf.Dynamic.Accounts["mjl"] = nc
+
+	// Reading is allowed.
+	tc.transactf("ok", "list \"\" inbox")
+	tc.transactf("ok", "status inbox (messages)")
+	tc.transactf("ok", "myrights inbox")
+	tc.xuntagged(imapclient.UntaggedMyrights{Mailbox: "Inbox", Rights: "lr"})
+
+	// Select opens read-only, fetch does not mark messages as read.
+	tc.transactf("ok", "select inbox")
+	tc.xcode("READ-ONLY")
+	tc.transactf("ok", "fetch 1 body[]")
+	tc.transactf("ok", "fetch 1 flags")
+	tc.xuntagged(imapclient.UntaggedFetch{Seq: 1, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(1), imapclient.FetchFlags(nil)}})
+	tc.transactf("ok", "search all")
+
+	// Changes are refused.
+	for _, cmd := range []string{
+		"store 1 +flags (\\seen)",
+		"uid store 1 +flags (\\deleted)",
+		"expunge",
+		"uid expunge 1",
+		"copy 1 inbox",
+		"move 1 Archive",
+		"create newbox",
+		"delete Archive",
+		"rename Archive Archive2",
+		"subscribe inbox",
+		"setmetadata inbox (/private/comment \"x\")",
+		fmt.Sprintf("append inbox {%d+}\r\n%s", len(exampleMsg), exampleMsg),
+	} {
+		tc.transactf("no", "%s", cmd)
+		tc.xcode("NOPERM")
+	}
+
+	// Changes are allowed again without the option.
+	mox.Conf.Dynamic.Accounts["mjl"] = accConf
+	tc.transactf("ok", "select inbox")
+	tc.xcode("READ-WRITE")
+	tc.transactf("ok", "store 1 +flags (\\seen)")
+}
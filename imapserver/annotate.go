@@ -0,0 +1,313 @@
+package imapserver
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/store"
+)
+
+// ANNOTATE adds annotations to individual messages, e.g. a comment, with a
+// private value for the user and a shared value for everyone with access to the
+// mailbox. Annotations are fetched with the ANNOTATION fetch attribute, changed
+// with STORE ANNOTATION and searched with the ANNOTATION search key.
+// ../rfc/5257
+//
+// todo: support the ANNOTATION parameter for APPEND.
+
+// annotationAttribNames are the attributes we support, in order of responses.
+var annotationAttribNames = []string{"value.priv", "value.shared", "size.priv", "size.shared"}
+
+// annotationMatcher returns a matcher for the entry or attribute patterns, with
+// "*" matching any text and "%" any text without slash. Matching is case
+// insensitive, entries and attributes are stored in lower case.
+func annotationMatcher(patterns []string) matchStringer {
+	var subs []string
+	for _, pat := range patterns {
+		var rs string
+		for _, c := range strings.ToLower(pat) {
+			if c == '%' {
+				rs += "[^/]*"
+			} else if c == '*' {
+				rs += ".*"
+			} else {
+				rs += regexp.QuoteMeta(string(c))
+			}
+		}
+		subs = append(subs, rs)
+	}
+	if len(subs) == 0 {
+		return noMatch{}
+	}
+	re, err := regexp.Compile("^(" + strings.Join(subs, "|") + ")$")
+	xcheckf(err, "compiling regexp for annotation patterns")
+	return re
+}
+
+// annotationAttribs returns the attributes matching the patterns. An attribute
+// without ".priv" or ".shared" suffix, e.g. "value", matches both.
+// ../rfc/5257 section 3.3
+func annotationAttribs(patterns []string) []string {
+	var l []string
+	for _, pat := range patterns {
+		l = append(l, pat, pat+".priv", pat+".shared")
+	}
+	m := annotationMatcher(l)
+	var attribs []string
+	for _, name := range annotationAttribNames {
+		if m.MatchString(name) {
+			attribs = append(attribs, name)
+		}
+	}
+	return attribs
+}
+
+// annotationVisible returns whether the selected mailbox shows annotation a.
+// Private annotations of the owner of a shared mailbox are not visible to others.
+func (c *conn) annotationVisible(a store.MessageAnnotation) bool {
+	return a.Shared || c.ownAccount == nil
+}
+
+// xfetchAnnotation returns the response for an ANNOTATION fetch attribute, or
+// nil if no entry matches. Entries requested without wildcards are returned
+// with NIL values if they are not present. ../rfc/5257 section 4.3
+func (cmd *fetchCmd) xfetchAnnotation(a fetchAtt) []token {
+	c := cmd.conn
+	m := cmd.xensureMessage()
+
+	entryMatch := annotationMatcher(a.annotationEntries)
+	attribs := annotationAttribs(a.annotationAttribs)
+
+	var entries []string
+	seen := map[string]bool{}
+	add := func(entry string) {
+		if !seen[entry] {
+			seen[entry] = true
+			entries = append(entries, entry)
+		}
+	}
+	for _, ma := range m.Annotations {
+		if c.annotationVisible(ma) && entryMatch.MatchString(ma.Entry) {
+			add(ma.Entry)
+		}
+	}
+	for _, e := range a.annotationEntries {
+		e = strings.ToLower(e)
+		if !strings.ContainsAny(e, "*%") && store.ValidMessageAnnotationEntry(e) {
+			add(e)
+		}
+	}
+	if len(entries) == 0 || len(attribs) == 0 {
+		return nil
+	}
+	sort.Strings(entries)
+
+	find := func(entry string, shared bool) (store.MessageAnnotation, bool) {
+		for _, ma := range m.Annotations {
+			if ma.Entry == entry && ma.Shared == shared && c.annotationVisible(ma) {
+				return ma, true
+			}
+		}
+		return store.MessageAnnotation{}, false
+	}
+
+	var l listspace
+	for _, entry := range entries {
+		var values listspace
+		for _, attr := range attribs {
+			ma, ok := find(entry, strings.HasSuffix(attr, ".shared"))
+			var v token = nilt
+			if ok && strings.HasPrefix(attr, "value.") {
+				v = annotationValue(ma.Value)
+			} else if ok {
+				v = dquote(fmt.Sprintf("%d", len(ma.Value)))
+			}
+			values = append(values, bare(attr), v)
+		}
+		l = append(l, astring(entry), values)
+	}
+	return []token{bare("ANNOTATION"), l}
+}
+
+// annotationValue returns a value as string, or as literal8 for binary data.
+func annotationValue(value []byte) token {
+	if utf8.Valid(value) && !strings.ContainsRune(string(value), 0) {
+		return string0(string(value))
+	}
+	return concat{bare("~"), syncliteral(string(value))}
+}
+
+// xannotationEntry parses an entry name for STORE and checks it is valid.
+func (p *parser) xannotationEntry() string {
+	entry := p.xastring()
+	if !store.ValidMessageAnnotationEntry(entry) {
+		p.xerrorf("invalid annotation entry %q", entry)
+	}
+	return strings.ToLower(entry)
+}
+
+// StoreAnnotation sets or removes annotations of messages, for STORE with an
+// ANNOTATION parameter instead of flags. Called by cmdxStore after parsing the
+// optional modifier.
+//
+// State: Selected
+func (c *conn) cmdxStoreAnnotation(isUID bool, tag, cmd string, p *parser, nums numSet, unchangedSince int64) {
+	// Command: ../rfc/5257 section 4.4
+	// Request syntax: ../rfc/5257 section 5
+
+	type entryValue struct {
+		entry  string
+		shared bool
+		value  []byte // Nil for removing.
+	}
+	var values []entryValue
+
+	p.xtake("(")
+	for {
+		entry := p.xannotationEntry()
+		p.xspace()
+		p.xtake("(")
+		for {
+			attr := strings.ToLower(p.xastring())
+			if attr != "value.priv" && attr != "value.shared" {
+				p.xerrorf("can only store value.priv or value.shared, not %q", attr)
+			}
+			p.xspace()
+			value, _, remove := p.xmetadataValue()
+			if !remove && value == nil {
+				value = []byte{}
+			}
+			values = append(values, entryValue{entry, attr == "value.shared", value})
+			if !p.take(" ") {
+				break
+			}
+		}
+		p.xtake(")")
+		if !p.take(" ") {
+			break
+		}
+	}
+	p.xtake(")")
+	p.xempty()
+
+	if c.readonly {
+		xuserErrorf("mailbox open in read-only mode")
+	}
+	for _, ev := range values {
+		if !ev.shared && c.ownAccount != nil {
+			xuserErrorf("private annotations cannot be stored on shared mailbox")
+		}
+		if len(ev.value) > store.AnnotationValueMax {
+			xusercodeErrorf("ANNOTATE TOOBIG", "annotation value too large, max %d bytes", store.AnnotationValueMax)
+		}
+	}
+	// Annotations are changed like keywords. ../rfc/5257 section 4.6
+	c.xneedRight('w')
+
+	var updated []store.Message
+	var modified []store.UID // Not updated due to UNCHANGEDSINCE.
+
+	c.account.WithWLock(func() {
+		c.xdbwrite(func(tx *bstore.Tx) {
+			c.xmailboxID(tx, c.mailboxID) // Validate.
+
+			if unchangedSince >= 0 {
+				c.xensureCondstore(tx)
+			}
+
+			uidargs := c.xnumSetCondition(isUID, nums)
+			if len(uidargs) == 0 {
+				return
+			}
+
+			q := bstore.QueryTx[store.Message](tx)
+			q.FilterNonzero(store.Message{MailboxID: c.mailboxID})
+			q.FilterEqual("UID", uidargs...)
+			q.SortAsc("UID")
+			msgs, err := q.List()
+			xcheckf(err, "listing messages")
+
+			// All messages changed by this command get the same modseq.
+			modseq, err := c.account.NextModSeq(tx)
+			xcheckf(err, "assigning modseq")
+
+			for _, m := range msgs {
+				// ../rfc/7162
+				if unchangedSince >= 0 && m.ModSeq.Client() > unchangedSince {
+					modified = append(modified, m.UID)
+					continue
+				}
+				for _, ev := range values {
+					m.Annotations = store.SetMessageAnnotation(m.Annotations, ev.entry, ev.shared, ev.value)
+				}
+				if len(m.Annotations) > store.MaxMessageAnnotations {
+					xusercodeErrorf("ANNOTATE TOOMANY", "too many annotations for message, max %d", store.MaxMessageAnnotations)
+				}
+				m.ModSeq = modseq
+				err := tx.Update(&m)
+				xcheckf(err, "storing annotations in message")
+				updated = append(updated, m)
+			}
+		})
+
+		// Other connections learn about the new modseq through a flags change.
+		changes := make([]store.Change, len(updated))
+		for i, m := range updated {
+			changes[i] = store.ChangeFlags{MailboxID: m.MailboxID, UID: m.UID, ModSeq: m.ModSeq, Flags: m.Flags, Keywords: m.Keywords}
+		}
+		c.broadcast(changes)
+	})
+
+	// The changed entries are announced without values. ../rfc/5257 section 4.4
+	var entries listspace
+	seen := map[string]bool{}
+	for _, ev := range values {
+		if !seen[ev.entry] {
+			seen[ev.entry] = true
+			entries = append(entries, astring(ev.entry))
+		}
+	}
+	for _, m := range updated {
+		c.bwritelinef("* %d FETCH (UID %d ANNOTATION %s%s)", c.xsequence(m.UID), m.UID, entries.pack(c), c.modseqAtt(m.ModSeq))
+	}
+
+	if len(modified) > 0 {
+		if !isUID {
+			for i, uid := range modified {
+				modified[i] = store.UID(c.xsequence(uid))
+			}
+		}
+		c.writeresultf("%s OK [MODIFIED %s] conditional store did not modify all", tag, compactUIDSet(modified).String())
+		return
+	}
+	c.ok(tag, cmd)
+}
+
+// annotationSearchMatch returns whether m has a visible annotation value matching
+// the entry and attribute patterns of an ANNOTATION search key, containing the
+// value case-insensitively. ../rfc/5257 section 4.5
+func (c *conn) annotationSearchMatch(m store.Message, sk searchKey) bool {
+	entryMatch := annotationMatcher([]string{sk.annotationEntry})
+	attribs := annotationAttribs([]string{sk.annotationAttrib})
+	lower := strings.ToLower(sk.astring)
+	for _, ma := range m.Annotations {
+		if !c.annotationVisible(ma) || !entryMatch.MatchString(ma.Entry) {
+			continue
+		}
+		attr := "value.priv"
+		if ma.Shared {
+			attr = "value.shared"
+		}
+		for _, a := range attribs {
+			if a == attr && strings.Contains(strings.ToLower(string(ma.Value)), lower) {
+				return true
+			}
+		}
+	}
+	return false
+}
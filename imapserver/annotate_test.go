@@ -0,0 +1,110 @@
+package imapserver
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mjl-/mox/imapclient"
+	"github.com/mjl-/mox/store"
+)
+
+func TestAnnotate(t *testing.T) {
+	defer mockUIDValidity()()
+	tc := start(t)
+	defer tc.close()
+
+	tc2 := startNoSwitchboard(t)
+	defer tc2.close()
+
+	tc.client.Login("mjl@mox.example", "testtest")
+	tc.client.Append("inbox", nil, nil, []byte(exampleMsg))
+	tc.client.Append("inbox", nil, nil, []byte(exampleMsg))
+	tc.client.Select("inbox")
+
+	tc2.client.Login("mjl@mox.example", "testtest")
+	tc2.client.Select("inbox")
+
+	str := func(s string) *string { return &s }
+	fetch := func(seq, uid uint32, entries ...imapclient.AnnotationEntry) imapclient.UntaggedFetch {
+		return imapclient.UntaggedFetch{Seq: seq, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(uid), imapclient.FetchAnnotation(entries)}}
+	}
+
+	tc.transactf("bad", "store 1 annotation ()")                                // Missing entry.
+	tc.transactf("bad", "store 1 annotation (/comment)")                        // Missing attributes.
+	tc.transactf("bad", `store 1 annotation (comment (value.priv "x"))`)        // Entry must start with slash.
+	tc.transactf("bad", `store 1 annotation (/comment/ (value.priv "x"))`)      // Trailing slash.
+	tc.transactf("bad", `store 1 annotation (/com*ment (value.priv "x"))`)      // Wildcard.
+	tc.transactf("bad", `store 1 annotation (/comment (size.priv "x"))`)        // Cannot store size.
+	tc.transactf("bad", `store 1 annotation (/comment (value.priv "x")) extra`) // Leftover data.
+	tc.transactf("bad", "fetch 1 annotation /comment")                          // Missing parens.
+	tc.transactf("bad", "fetch 1 annotation (/comment)")                        // Missing attributes.
+
+	tc.transactf("ok", `store 1 annotation (/comment (value.priv "my note" value.shared "Our Note") /altsubject (value.priv "other"))`)
+	tc.xuntagged(imapclient.UntaggedFetch{Seq: 1, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(1), imapclient.FetchAnnotation{{Entry: "/comment"}, {Entry: "/altsubject"}}}})
+
+	// Other session learns about the change.
+	tc2.transactf("ok", "noop")
+	tc2.xuntagged(imapclient.UntaggedFetch{Seq: 1, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(1), imapclient.FetchFlags(nil)}})
+
+	tc.transactf("ok", "fetch 1 annotation (/comment value)")
+	tc.xuntagged(fetch(1, 1, imapclient.AnnotationEntry{Entry: "/comment", Attribs: []imapclient.AnnotationAttrib{{Name: "value.priv", Value: str("my note")}, {Name: "value.shared", Value: str("Our Note")}}}))
+
+	tc.transactf("ok", "fetch 1 annotation (* (value.priv size.shared))")
+	tc.xuntagged(fetch(1, 1,
+		imapclient.AnnotationEntry{Entry: "/altsubject", Attribs: []imapclient.AnnotationAttrib{{Name: "value.priv", Value: str("other")}, {Name: "size.shared"}}},
+		imapclient.AnnotationEntry{Entry: "/comment", Attribs: []imapclient.AnnotationAttrib{{Name: "value.priv", Value: str("my note")}, {Name: "size.shared", Value: str("8")}}},
+	))
+
+	// Entries without wildcards are returned, also when not present. Message 2 has no annotations.
+	tc.transactf("ok", "fetch 1:2 annotation (/Comment value.shared)")
+	tc.xuntagged(
+		fetch(1, 1, imapclient.AnnotationEntry{Entry: "/comment", Attribs: []imapclient.AnnotationAttrib{{Name: "value.shared", Value: str("Our Note")}}}),
+		fetch(2, 2, imapclient.AnnotationEntry{Entry: "/comment", Attribs: []imapclient.AnnotationAttrib{{Name: "value.shared"}}}),
+	)
+	tc.transactf("ok", "fetch 2 annotation (* value)")
+	tc.xuntagged(imapclient.UntaggedFetch{Seq: 2, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(2)}})
+
+	// Searching, case-insensitive substring match on values.
+	tc.transactf("ok", `search annotation /comment value "NOTE"`)
+	tc.xsearch(1)
+	tc.transactf("ok", `search annotation /comment value.shared "my"`)
+	tc.xsearch()
+	tc.transactf("ok", `search annotation * value.priv "other"`)
+	tc.xsearch(1)
+	tc.transactf("ok", `search not annotation /comment value ""`)
+	tc.xsearch(2)
+
+	// Removing with NIL.
+	tc.transactf("ok", `store 1 annotation (/comment (value.priv NIL value.shared NIL))`)
+	tc.transactf("ok", "fetch 1 annotation (%s value.priv)", "/%")
+	tc.xuntagged(fetch(1, 1, imapclient.AnnotationEntry{Entry: "/altsubject", Attribs: []imapclient.AnnotationAttrib{{Name: "value.priv", Value: str("other")}}}))
+
+	// Binary value, with literal8.
+	tc.transactf("ok", "store 2 annotation (/bin (value.shared ~{3+}\r\na\x00b))")
+	tc.xuntagged(imapclient.UntaggedFetch{Seq: 2, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(2), imapclient.FetchAnnotation{{Entry: "/bin"}}}})
+	tc.transactf("ok", "fetch 2 annotation (/bin value.shared)")
+	tc.xuntagged(fetch(2, 2, imapclient.AnnotationEntry{Entry: "/bin", Attribs: []imapclient.AnnotationAttrib{{Name: "value.shared", Value: str("a\x00b")}}}))
+
+	// Limits.
+	tc.transactf("no", "store 1 annotation (/big (value.priv {%d+}\r\n%s))", store.AnnotationValueMax+1, strings.Repeat("x", store.AnnotationValueMax+1))
+	tc.xcode("ANNOTATE")
+	var entries []string
+	for i := 0; i < store.MaxMessageAnnotations; i++ {
+		entries = append(entries, "/many/"+strings.Repeat("x", i+1)+` (value.priv "x")`)
+	}
+	tc.transactf("no", "store 1 annotation (%s)", strings.Join(entries, " "))
+	tc.xcode("ANNOTATE")
+
+	// Conditional store.
+	tc.transactf("ok", `store 1 (unchangedsince 1) annotation (/comment (value.priv "x"))`)
+	tc.xcode("MODIFIED")
+
+	// Copied messages keep their annotations.
+	tc.transactf("ok", "copy 1 Trash")
+	tc.transactf("ok", "select Trash")
+	tc.transactf("ok", "fetch 1 annotation (/altsubject value.priv)")
+	tc.xuntagged(fetch(1, 1, imapclient.AnnotationEntry{Entry: "/altsubject", Attribs: []imapclient.AnnotationAttrib{{Name: "value.priv", Value: str("other")}}}))
+
+	tc.transactf("ok", "examine inbox")
+	tc.transactf("no", `store 1 annotation (/comment (value.priv "x"))`) // Read-only.
+}
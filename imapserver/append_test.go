@@ -1,9 +1,16 @@
 package imapserver
 
 import (
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/exp/slices"
 
 	"github.com/mjl-/mox/imapclient"
+	"github.com/mjl-/mox/mox-"
 )
 
 func TestAppend(t *testing.T) {
@@ -75,3 +82,151 @@ func TestAppend(t *testing.T) {
 	}
 	tc2.xuntagged(imapclient.UntaggedFetch{Seq: 2, Attrs: []imapclient.FetchAttr{uid2, xbs}})
 }
+
+func TestMultiAppend(t *testing.T) {
+	defer mockUIDValidity()()
+
+	tc := start(t)
+	defer tc.close()
+
+	tc2 := startNoSwitchboard(t)
+	defer tc2.close()
+
+	tc.client.Login("mjl@mox.example", "testtest")
+	tc.client.Select("inbox")
+	tc2.client.Login("mjl@mox.example", "testtest")
+	tc2.client.Select("inbox")
+
+	// Plain, UTF8 and CATENATE messages in a single command.
+	tc.transactf("ok", "append inbox (\\Seen) {1+}\r\nx () \" 1-Jan-2022 10:10:00 +0100\" UTF8 ({1+}\r\ny) CATENATE (TEXT {1+}\r\nz)")
+	tc.xuntagged(imapclient.UntaggedExists(3))
+	last := uint32(3)
+	tc.xcodeArg(imapclient.CodeAppendUID{UIDValidity: 1, UID: 1, UIDs: []imapclient.NumRange{{First: 1, Last: &last}}})
+	tc.transactf("ok", "fetch 3 rfc822.size")
+	tc.xuntagged(imapclient.UntaggedFetch{Seq: 3, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(3), imapclient.FetchRFC822Size(1)}})
+
+	tc2.transactf("ok", "noop")
+	tc2.xuntagged(
+		imapclient.UntaggedExists(3),
+		imapclient.UntaggedFetch{Seq: 1, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(1), imapclient.FetchFlags{`\Seen`}}},
+		imapclient.UntaggedFetch{Seq: 2, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(2), imapclient.FetchFlags(nil)}},
+		imapclient.UntaggedFetch{Seq: 3, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(3), imapclient.FetchFlags(nil)}},
+	)
+
+	// Nothing is appended if a message fails. All messages are still read.
+	tc.transactf("no", "append inbox {1+}\r\nx CATENATE (URL \"/Inbox/;UID=10\") {1+}\r\nx")
+	tc.xcode("BADURL")
+	tc.transactf("ok", "status inbox (messages)")
+	tc.xuntagged(imapclient.UntaggedStatus{Mailbox: "Inbox", Attrs: map[string]int64{"MESSAGES": 3}})
+
+	_, result, err := tc.client.MultiAppend("inbox", imapclient.Message{Data: []byte("a")}, imapclient.Message{Flags: []string{"label1"}, Data: []byte("b")})
+	tcheck(t, err, "multiappend")
+	if s := result.CodeArg.CodeString(); s != "APPENDUID 1 4:5" {
+		t.Fatalf("got code %q, expected APPENDUID 1 4:5", s)
+	}
+}
+
+func TestAppendLimit(t *testing.T) {
+	tc := start(t)
+	defer tc.close()
+
+	domConf := mox.Conf.Dynamic.Domains["mox.example"]
+	defer func() {
+		mox.Conf.Dynamic.Domains["mox.example"] = domConf
+	}()
+	nc := domConf
+	nc.MessageSizeLimit = 10
+	mox.Conf.Dynamic.Domains["mox.example"] = nc
+
+	xappendlimit := func(exp string) {
+		t.Helper()
+		tc.transactf("ok", "capability")
+		caps := tc.lastUntagged[0].(imapclient.UntaggedCapability)
+		if !slices.Contains(caps, "APPENDLIMIT="+exp) {
+			t.Fatalf("capabilities without APPENDLIMIT=%s: %v", exp, caps)
+		}
+	}
+
+	// Limit of domain is advertised after authentication.
+	xappendlimit("9223372036854775807")
+	tc.client.Login("mjl@mox.example", "testtest")
+	xappendlimit("10")
+	tc.transactf("ok", "status inbox (appendlimit)")
+	tc.xuntagged(imapclient.UntaggedStatus{Mailbox: "Inbox", Attrs: map[string]int64{"APPENDLIMIT": 10}})
+
+	// Synchronizing literal is refused before the message is sent.
+	tc.cmdf("", "append inbox {11}")
+	tc.readstatus("no")
+	tc.xcode("TOOBIG")
+
+	// Non-synchronizing literal is read and refused.
+	tc.transactf("no", "append inbox {11+}\r\n01234567890")
+	tc.xcode("TOOBIG")
+	tc.transactf("ok", "append inbox {10+}\r\n0123456789")
+
+	// Limit of account overrides that of the domain.
+	accConf := mox.Conf.Dynamic.Accounts["mjl"]
+	defer func() {
+		mox.Conf.Dynamic.Accounts["mjl"] = accConf
+	}()
+	nac := accConf
+	nac.MessageSizeLimit = 20
+	mox.Conf.Dynamic.Accounts["mjl"] = nac
+	tc.transactf("ok", "append inbox {11+}\r\n01234567890")
+	tc.transactf("ok", "status inbox (appendlimit)")
+	tc.xuntagged(imapclient.UntaggedStatus{Mailbox: "Inbox", Attrs: map[string]int64{"APPENDLIMIT": 20}})
+}
+
+// Messages for APPEND are written to a temporary file while they are read, not
+// kept in memory, and the file is moved into place on delivery.
+func TestAppendSpool(t *testing.T) {
+	tc := start(t)
+	defer tc.close()
+
+	tc.client.Login("mjl@mox.example", "testtest")
+	tc.client.Select("inbox")
+
+	line := strings.Repeat("x", 76) + "\r\n"
+	msg := "Subject: test\r\n\r\n" + strings.Repeat(line, 4*1024*1024/len(line))
+	half := len(msg) / 2
+
+	// spoolSize returns the size of the temporary append file, or -1.
+	tmpDir := mox.DataDirPath("tmp")
+	spoolSize := func() int64 {
+		l, _ := filepath.Glob(filepath.Join(tmpDir, "imap-append*"))
+		if len(l) != 1 {
+			return -1
+		}
+		fi, err := os.Stat(l[0])
+		if err != nil {
+			return -1
+		}
+		return fi.Size()
+	}
+
+	tc.client.LastTag = "x001"
+	tc.writelinef("x001 append inbox {%d+}", len(msg))
+	_, err := tc.client.Write([]byte(msg[:half]))
+	tcheck(t, err, "write first half of message")
+
+	// The data written so far must end up on disk, except for what is still buffered.
+	var size int64
+	for i := 0; i < 100; i++ {
+		if size = spoolSize(); size >= int64(half-64*1024) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if size < int64(half-64*1024) {
+		t.Fatalf("temporary append file has size %d, expected at least %d", size, half-64*1024)
+	}
+
+	_, err = tc.client.Write([]byte(msg[half:] + "\r\n"))
+	tcheck(t, err, "write second half of message")
+	tc.response("ok")
+	tc.xuntagged(imapclient.UntaggedExists(1))
+
+	if size := spoolSize(); size != -1 {
+		t.Fatalf("temporary append file still present after delivery")
+	}
+}
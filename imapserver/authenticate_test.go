@@ -1,6 +1,7 @@
 package imapserver
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/md5"
 	"crypto/sha1"
@@ -9,9 +10,14 @@ import (
 	"errors"
 	"fmt"
 	"hash"
+	"net"
 	"strings"
 	"testing"
 
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/imapclient"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/oauth"
 	"github.com/mjl-/mox/scram"
 )
 
@@ -174,3 +180,103 @@ func TestAuthenticateCRAMMD5(t *testing.T) {
 
 	tc.close()
 }
+
+func TestAuthenticateMechanisms(t *testing.T) {
+	tc := start(t)
+	defer tc.close()
+
+	// Test connections come from 127.0.0.10.
+	_, othernet, _ := net.ParseCIDR("192.168.1.0/24")
+	mox.Conf.Static.Listeners["test"] = config.Listener{
+		AuthMechanisms: []config.AuthMechanism{
+			{Mechanism: "SCRAM-SHA-256"},
+			{Mechanism: "CRAM-MD5", ParsedIPNets: []net.IPNet{*othernet}},
+			{Mechanism: "PLAIN", RequireTLS: true},
+		},
+	}
+	defer delete(mox.Conf.Static.Listeners, "test")
+
+	tc.client.Capability()
+	_, cram := tc.client.CapAvailable["AUTH=CRAM-MD5"]
+	_, plain := tc.client.CapAvailable["AUTH=PLAIN"]
+	_, scram := tc.client.CapAvailable["AUTH=SCRAM-SHA-256"]
+	_, logindisabled := tc.client.CapAvailable["LOGINDISABLED"]
+	if cram || plain || !scram || !logindisabled {
+		t.Fatalf("unexpected capabilities %v", tc.client.CapAvailable)
+	}
+
+	tc.transactf("no", "authenticate plain %s", base64.StdEncoding.EncodeToString([]byte("\u0000mjl@mox.example\u0000testtest")))
+	tc.xcode("CANNOT")
+	tc.transactf("no", "authenticate cram-md5")
+	tc.xcode("CANNOT")
+	tc.transactf("no", `login mjl@mox.example testtest`)
+	tc.xcode("CANNOT")
+	tc.client.AuthenticateSCRAM("SCRAM-SHA-256", sha256.New, "mjl@mox.example", "testtest")
+}
+
+// fakeValidator accepts tokens that are email addresses, and fails on "down".
+type fakeValidator struct{}
+
+func (fakeValidator) Validate(ctx context.Context, token string) (string, error) {
+	if token == "down" {
+		return "", errors.New("identity provider unavailable")
+	} else if !strings.Contains(token, "@") {
+		return "", oauth.ErrInvalidToken
+	}
+	return token, nil
+}
+
+func TestAuthenticateOAuth(t *testing.T) {
+	// Not configured, mechanisms are not available.
+	tc := start(t)
+	hasOAuth := func() bool {
+		tc.transactf("ok", "capability")
+		for _, c := range tc.lastUntagged[0].(imapclient.UntaggedCapability) {
+			if c == "AUTH=OAUTHBEARER" {
+				return true
+			}
+		}
+		return false
+	}
+	if hasOAuth() {
+		t.Fatalf("capabilities with AUTH=OAUTHBEARER without oauth configured")
+	}
+	bearer := func(authz, token string) string {
+		return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("n,%s,\x01auth=Bearer %s\x01\x01", authz, token)))
+	}
+	tc.transactf("no", "authenticate oauthbearer %s", bearer("", "mjl@mox.example"))
+	tc.xcode("CANNOT")
+	tc.close()
+
+	// Configuration is reloaded when starting a test connection.
+	tc = start(t)
+	mox.Conf.Static.OAuth = &config.OAuth{Validator: fakeValidator{}}
+	defer func() {
+		mox.Conf.Static.OAuth = nil
+	}()
+	if !hasOAuth() {
+		t.Fatalf("capabilities without AUTH=OAUTHBEARER")
+	}
+
+	tc.transactf("bad", "authenticate oauthbearer %s", base64.StdEncoding.EncodeToString([]byte("bogus")))
+	tc.transactf("no", "authenticate oauthbearer %s", bearer("", "unknown@mox.example")) // Unknown user.
+	tc.xcode("AUTHENTICATIONFAILED")
+	tc.transactf("no", "authenticate oauthbearer %s", bearer("a=other@mox.example", "mjl@mox.example"))
+	tc.xcode("AUTHORIZATIONFAILED")
+	tc.transactf("no", "authenticate oauthbearer %s", bearer("", "down"))
+	tc.xcode("UNAVAILABLE")
+
+	// Invalid token, error is sent as challenge and client responds with dummy line.
+	tc.cmdf("", "authenticate oauthbearer %s", bearer("", "badtoken"))
+	tc.readprefixline("+ ")
+	tc.writelinef("AQ==")
+	tc.readstatus("no")
+
+	tc.transactf("ok", "authenticate oauthbearer %s", bearer("a=mjl@mox.example", "mjl@mox.example"))
+	tc.close()
+
+	tc = start(t)
+	mox.Conf.Static.OAuth = &config.OAuth{Validator: fakeValidator{}}
+	tc.transactf("ok", "authenticate xoauth2 %s", base64.StdEncoding.EncodeToString([]byte("user=mjl@mox.example\x01auth=Bearer mjl@mox.example\x01\x01")))
+	tc.close()
+}
@@ -0,0 +1,333 @@
+package imapserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/store"
+)
+
+// imapURL is a parsed IMAP URL referencing a message or part of a message, as
+// used in CATENATE and URLAUTH. ../rfc/5092 section 3 ../rfc/4469 section 5
+type imapURL struct {
+	user        string // From the authority, without ";AUTH=". Required with URLAUTH.
+	mailbox     string
+	uidValidity uint32 // Zero if absent.
+	uid         store.UID
+	section     string // Without brackets, empty for the whole message.
+	partial     *partial
+
+	// For URLAUTH-authorized URLs. ../rfc/4467
+	expire     time.Time // Zero if absent.
+	accessKind string    // "anonymous", "authuser", "user" or "submit". Empty without URLAUTH.
+	accessUser string    // For accessKind "user" and "submit".
+	mechanism  string    // Empty for a "rump" URL, as used in GENURLAUTH.
+	token      string
+	rump       string // URL up to and including the access identifier, the input for the token.
+}
+
+// parseIMAPURL parses an absolute IMAP URL, like imap://host/Inbox/;UID=1, or
+// the absolute path of one, like /Inbox;UIDVALIDITY=1/;UID=1/;SECTION=1.2. The
+// URL can end with URLAUTH authorization, like
+// imap://mjl%40mox.example@host/Inbox;UIDVALIDITY=1/;UID=1;URLAUTH=authuser:INTERNAL:<token>.
+func parseIMAPURL(s string) (u imapURL, rerr error) {
+	if i := strings.Index(strings.ToUpper(s), ";URLAUTH="); i >= 0 {
+		t := strings.SplitN(s[i+len(";URLAUTH="):], ":", 3)
+		access := t[0]
+		if len(t) == 3 {
+			u.mechanism, u.token = t[1], t[2]
+			if u.mechanism == "" || u.token == "" {
+				return u, fmt.Errorf("empty urlauth mechanism or token")
+			}
+		} else if len(t) == 2 {
+			return u, fmt.Errorf("urlauth mechanism without token")
+		}
+		u.rump = s[:i+len(";URLAUTH=")+len(access)]
+		s = s[:i]
+
+		// Access identifiers. ../rfc/4467
+		lower := strings.ToLower(access)
+		if lower == "anonymous" || lower == "authuser" {
+			u.accessKind = lower
+		} else if strings.HasPrefix(lower, "user+") || strings.HasPrefix(lower, "submit+") {
+			t := strings.SplitN(access, "+", 2)
+			u.accessKind = strings.ToLower(t[0])
+			var err error
+			u.accessUser, err = url.PathUnescape(t[1])
+			if err != nil || u.accessUser == "" {
+				return u, fmt.Errorf("bad user in urlauth access identifier")
+			}
+		} else {
+			return u, fmt.Errorf("unknown urlauth access identifier %q", access)
+		}
+
+		if j := strings.LastIndex(strings.ToUpper(s), ";EXPIRE="); j >= 0 {
+			var err error
+			u.expire, err = time.Parse(time.RFC3339, s[j+len(";EXPIRE="):])
+			if err != nil {
+				return u, fmt.Errorf("bad expire: %v", err)
+			}
+			s = s[:j]
+		}
+	}
+
+	if strings.HasPrefix(strings.ToLower(s), "imap://") {
+		// We don't check the host, the server can only reference its own messages.
+		t := strings.SplitN(s[len("imap://"):], "/", 2)
+		if len(t) != 2 {
+			return u, fmt.Errorf("missing path in url")
+		}
+		if i := strings.LastIndex(t[0], "@"); i >= 0 {
+			userinfo := t[0][:i]
+			if j := strings.Index(strings.ToUpper(userinfo), ";AUTH="); j >= 0 {
+				userinfo = userinfo[:j]
+			}
+			var err error
+			u.user, err = url.PathUnescape(userinfo)
+			if err != nil {
+				return u, fmt.Errorf("decoding user: %v", err)
+			}
+		}
+		s = "/" + t[1]
+	}
+	if !strings.HasPrefix(s, "/") {
+		return u, fmt.Errorf("url must be absolute")
+	}
+	if u.accessKind != "" && u.user == "" {
+		// ../rfc/4467
+		return u, fmt.Errorf("url with urlauth must have a user")
+	}
+
+	params := strings.Split(s[1:], "/;")
+	mailbox := params[0]
+	if i := strings.Index(strings.ToUpper(mailbox), ";UIDVALIDITY="); i >= 0 {
+		v, err := strconv.ParseUint(mailbox[i+len(";UIDVALIDITY="):], 10, 32)
+		if err != nil || v == 0 {
+			return u, fmt.Errorf("bad uidvalidity")
+		}
+		u.uidValidity = uint32(v)
+		mailbox = mailbox[:i]
+	}
+	var err error
+	u.mailbox, err = url.PathUnescape(mailbox)
+	if err != nil {
+		return u, fmt.Errorf("decoding mailbox: %v", err)
+	}
+
+	for _, param := range params[1:] {
+		t := strings.SplitN(param, "=", 2)
+		if len(t) != 2 {
+			return u, fmt.Errorf("bad url parameter %q", param)
+		}
+		k, v := strings.ToUpper(t[0]), t[1]
+		switch k {
+		case "UID":
+			uid, err := strconv.ParseUint(v, 10, 32)
+			if err != nil || uid == 0 {
+				return u, fmt.Errorf("bad uid")
+			}
+			u.uid = store.UID(uid)
+		case "SECTION":
+			if u.uid == 0 {
+				return u, fmt.Errorf("section without uid")
+			}
+			u.section, err = url.PathUnescape(v)
+			if err != nil {
+				return u, fmt.Errorf("decoding section: %v", err)
+			}
+		case "PARTIAL":
+			if u.uid == 0 {
+				return u, fmt.Errorf("partial without uid")
+			}
+			t := strings.SplitN(v, ".", 2)
+			offset, err := strconv.ParseUint(t[0], 10, 32)
+			if err != nil {
+				return u, fmt.Errorf("bad partial offset")
+			}
+			var count uint64 = 1<<32 - 1
+			if len(t) == 2 {
+				count, err = strconv.ParseUint(t[1], 10, 32)
+				if err != nil || count == 0 {
+					return u, fmt.Errorf("bad partial length")
+				}
+			}
+			u.partial = &partial{uint32(offset), uint32(count)}
+		default:
+			return u, fmt.Errorf("unsupported url parameter %q", t[0])
+		}
+	}
+	if u.uid == 0 {
+		return u, fmt.Errorf("url must reference a message")
+	}
+	return u, nil
+}
+
+// xcatenate reads the parts of an APPEND with CATENATE, writing the composed
+// message to w. The parser must be positioned right after "CATENATE (". Text
+// parts are read from the connection, URL parts reference messages in the
+// mailboxes of the user, including shared mailboxes with the read right.
+//
+// If a URL cannot be resolved, it is returned as badURL with the reason, and the
+// remaining parts are still read, keeping the connection in sync. The returned
+// parser is positioned after the closing parenthesis, for MULTIAPPEND.
+func (c *conn) xcatenate(p *parser, w io.Writer) (np *parser, size int64, badURL string, urlErr error) {
+	// Request syntax: ../rfc/4469 section 5
+	for {
+		if p.take("TEXT ") {
+			n, sync := p.xliteralSize(0, false)
+			if sync {
+				c.writelinef("+")
+			}
+			var dst io.Writer = w
+			if badURL != "" {
+				dst = io.Discard
+			}
+			restore := c.xtrace(mlog.LevelTracedata)
+			copied, err := io.Copy(dst, io.LimitReader(c.br, n))
+			restore()
+			if err != nil {
+				// Cannot use xcheckf due to %w handling of errIO.
+				panic(fmt.Errorf("reading catenate text literal: %s (%w)", err, errIO))
+			}
+			if copied != n {
+				xserverErrorf("read %d bytes for catenate text, expected %d (%w)", copied, n, errIO)
+			}
+			size += n
+			p = newParser(c.readline(false), c)
+		} else if p.take("URL ") {
+			s := p.xastring()
+			if badURL == "" {
+				n, err := c.writeURL(s, w, false)
+				if err != nil {
+					badURL, urlErr = s, err
+				}
+				size += n
+			}
+		} else {
+			p.xerrorf("expected TEXT or URL")
+		}
+		if p.take(")") {
+			break
+		}
+		p.xspace()
+	}
+	return p, size, badURL, urlErr
+}
+
+// writeURL writes the message or part referenced by the IMAP URL s to w. URLs
+// with URLAUTH authorization can reference messages in mailboxes of other
+// accounts, see xurlauthOpen. Other URLs must reference mailboxes of the user,
+// including shared mailboxes with the read right. If needAuth is set, URLs
+// without URLAUTH authorization are refused. User errors, e.g. for unknown
+// mailboxes or messages, bad sections, or failed authorization, are returned.
+func (c *conn) writeURL(s string, w io.Writer, needAuth bool) (n int64, rerr error) {
+	defer func() {
+		x := recover()
+		if x == nil {
+			return
+		}
+		switch err := x.(type) {
+		case userError:
+			rerr = err
+		case syntaxError:
+			rerr = err
+		case attrError:
+			rerr = err
+		default:
+			panic(x)
+		}
+	}()
+
+	u, err := parseIMAPURL(s)
+	if err != nil {
+		return 0, err
+	}
+
+	acc := c.account
+	name := u.mailbox
+	if u.accessKind != "" {
+		acc = c.xurlauthOpen(u)
+		defer func() {
+			err := acc.Close()
+			c.xsanity(err, "closing account of url")
+		}()
+		name = xcheckmailboxname(name, true)
+	} else if needAuth {
+		xuserErrorf("url without urlauth")
+	} else if owner, mbname, isShared := c.xsharedMailboxName(name); isShared {
+		acc, _, _ = c.xsharedOpen(owner, mbname, "r")
+		defer func() {
+			err := acc.Close()
+			c.xsanity(err, "closing account of shared mailbox")
+		}()
+		name = mbname
+	} else {
+		name = xcheckmailboxname(name, true)
+	}
+
+	var section *sectionSpec
+	if u.section != "" {
+		section = newParser("["+u.section+"]", c).xsection()
+	}
+
+	acc.WithRLock(func() {
+		var m store.Message
+		var userErr error
+		err := store.DBRead(context.TODO(), c.log, "imapserver", acc.DB, func(tx *bstore.Tx) error {
+			mb, err := acc.MailboxFind(tx, name)
+			if err != nil {
+				return err
+			} else if mb == nil {
+				userErr = store.ErrUnknownMailbox
+				return nil
+			} else if u.uidValidity != 0 && u.uidValidity != mb.UIDValidity {
+				userErr = errors.New("uidvalidity mismatch")
+				return nil
+			}
+			q := bstore.QueryTx[store.Message](tx)
+			q.FilterNonzero(store.Message{MailboxID: mb.ID, UID: u.uid})
+			m, err = q.Get()
+			if err == bstore.ErrAbsent {
+				userErr = errors.New("no such message")
+				return nil
+			}
+			return err
+		})
+		xcheckf(err, "looking up referenced message")
+		if userErr != nil {
+			xuserErrorf("%s", userErr)
+		}
+
+		msgr := acc.MessageReader(m)
+		defer func() {
+			err := msgr.Close()
+			c.xsanity(err, "closing message reader")
+		}()
+		var r io.Reader = msgr
+		if section != nil {
+			p, err := m.LoadPart(msgr)
+			xcheckf(err, "load parsed message")
+			cmd := &fetchCmd{conn: c}
+			r = cmd.xsection(section, &p)
+		}
+		if u.partial != nil {
+			_, err := io.CopyN(io.Discard, r, int64(u.partial.offset))
+			if err != nil && err != io.EOF {
+				xcheckf(err, "skipping to partial offset")
+			}
+			r = io.LimitReader(r, int64(u.partial.count))
+		}
+		n, err = io.Copy(w, r)
+		xcheckf(err, "copying referenced message data")
+	})
+	return n, nil
+}
@@ -0,0 +1,53 @@
+package imapserver
+
+import (
+	"testing"
+
+	"github.com/mjl-/mox/imapclient"
+)
+
+func TestCatenate(t *testing.T) {
+	defer mockUIDValidity()()
+	tc := start(t)
+	defer tc.close()
+
+	tc.client.Login("mjl@mox.example", "testtest")
+	tc.client.Append("inbox", nil, nil, []byte(exampleMsg))
+	tc.client.Append("inbox", nil, nil, []byte(nestedMessage))
+	tc.client.Select("inbox")
+
+	text := "\r\nForwarded text.\r\n"
+	tc.transactf("ok", "append inbox catenate (url \"/Inbox/;UID=1/;SECTION=HEADER\" text {%d+}\r\n%s url \"/INBOX/;uid=1/;section=TEXT\")", len(text), text)
+	tc.xcodeArg(imapclient.CodeAppendUID{UIDValidity: 1, UID: 3})
+	tc.transactf("ok", "fetch 3 rfc822.size")
+	tc.xuntagged(imapclient.UntaggedFetch{Seq: 3, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(3), imapclient.FetchRFC822Size(len(exampleMsg) + len(text))}})
+
+	// Text only, and partial and section of a nested message, with an absolute URL.
+	tc.transactf("ok", "append inbox catenate (text {18+}\r\nSubject: parts\r\n\r\n url \"imap://mjl@mox.example/Inbox;UIDVALIDITY=1/;UID=2/;SECTION=4/;PARTIAL=0.10\")")
+	tc.transactf("ok", "fetch 4 body.peek[text]")
+	tc.xuntagged(imapclient.UntaggedFetch{Seq: 4, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(4), imapclient.FetchBody{RespAttr: "BODY[TEXT]", Section: "TEXT", Body: "This is <b"}}})
+
+	// Bad URLs. Remaining parts are still read.
+	for _, url := range []string{
+		"/Inbox/;UID=10",              // Unknown message.
+		"/Inbox;UIDVALIDITY=2/;UID=1", // Wrong uidvalidity.
+		"/Bogus/;UID=1",               // Unknown mailbox.
+		"/Inbox",                      // No message.
+		"/Inbox/;UID=1/;SECTION=9",    // No such part.
+		"/Inbox/;UID=1;URLAUTH=anonymous:internal:0123", // URLAUTH without user.
+		"/Inbox/;UID=1/;URLAUTH=x",                      // Unknown access identifier.
+		"imap://mox.example",                            // No path.
+		"Inbox/;UID=1",                                  // Relative.
+		"/Inbox/;UID=1/;SECTION=HEADER[",                // Bad section.
+	} {
+		tc.transactf("no", "append inbox catenate (url %q text {1+}\r\nx)", url)
+		tc.xcodeArg(imapclient.CodeOther{Code: "BADURL", Args: []string{url}})
+	}
+	tc.transactf("no", "append nonexistent catenate (url \"/Inbox/;UID=1\")")
+	tc.xcode("TRYCREATE")
+	tc.transactf("bad", "append inbox catenate (bogus)")
+	tc.transactf("bad", "append inbox catenate ()")
+
+	tc.transactf("ok", "status inbox (messages)")
+	tc.xuntagged(imapclient.UntaggedStatus{Mailbox: "Inbox", Attrs: map[string]int64{"MESSAGES": 4}})
+}
@@ -0,0 +1,31 @@
+package imapserver
+
+import (
+	"testing"
+
+	"github.com/mjl-/mox/imapclient"
+)
+
+func TestCompress(t *testing.T) {
+	tc := start(t)
+	defer tc.close()
+
+	tc.transactf("no", "compress deflate") // Not authenticated.
+
+	tc.client.Login("mjl@mox.example", "testtest")
+	tc.transactf("bad", "compress")
+	tc.transactf("bad", "compress bogus")
+
+	tc.client.CompressDeflate()
+	tc.transactf("no", "compress deflate")
+	tc.xcode("COMPRESSIONACTIVE")
+
+	tc.client.Select("inbox")
+	tc.client.Append("inbox", nil, nil, []byte(exampleMsg))
+	tc.transactf("ok", "noop")
+	tc.transactf("ok", "fetch 1 body.peek[header.fields (Subject)]")
+	tc.xuntagged(imapclient.UntaggedFetch{Seq: 1, Attrs: []imapclient.FetchAttr{
+		imapclient.FetchUID(1),
+		imapclient.FetchBody{RespAttr: "BODY[HEADER.FIELDS (Subject)]", Section: "HEADER.FIELDS (Subject)", Body: "Subject: afternoon meeting\r\n\r\n"},
+	}})
+}
@@ -0,0 +1,85 @@
+package imapserver
+
+import (
+	"testing"
+
+	"github.com/mjl-/mox/imapclient"
+)
+
+func TestCondstore(t *testing.T) {
+	tc := start(t)
+	defer tc.close()
+
+	tc.client.Login("mjl@mox.example", "testtest")
+	tc.client.Enable("imap4rev2")
+
+	tc.client.Append("inbox", nil, nil, []byte(exampleMsg))
+	tc.client.Append("inbox", nil, nil, []byte(exampleMsg))
+
+	// highestModSeq returns the HIGHESTMODSEQ from the untagged responses, or -1.
+	highestModSeq := func() int64 {
+		for _, u := range tc.lastUntagged {
+			if r, ok := u.(imapclient.UntaggedResult); ok && r.Code == "HIGHESTMODSEQ" {
+				return int64(r.CodeArg.(imapclient.CodeHighestModSeq))
+			}
+		}
+		return -1
+	}
+
+	// Without CONDSTORE, no HIGHESTMODSEQ in the select response.
+	tc.transactf("ok", "select inbox")
+	if v := highestModSeq(); v != -1 {
+		t.Fatalf("got highestmodseq %d without condstore", v)
+	}
+
+	// Fetching MODSEQ enables CONDSTORE.
+	tc.transactf("ok", "fetch 1:* modseq")
+	tc.xuntagged(
+		imapclient.UntaggedResult{Status: imapclient.OK, RespText: imapclient.RespText{Code: "HIGHESTMODSEQ", CodeArg: imapclient.CodeHighestModSeq(3), More: "after condstore-enabling command"}},
+		imapclient.UntaggedFetch{Seq: 1, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(1), imapclient.FetchModSeq(2)}},
+		imapclient.UntaggedFetch{Seq: 2, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(2), imapclient.FetchModSeq(3)}},
+	)
+
+	tc.transactf("ok", "select inbox (condstore)")
+	if v := highestModSeq(); v != 3 {
+		t.Fatalf("got highestmodseq %d, expected 3", v)
+	}
+
+	tc.transactf("ok", "status inbox (highestmodseq)")
+	tc.xuntagged(imapclient.UntaggedStatus{Mailbox: "Inbox", Attrs: map[string]int64{"HIGHESTMODSEQ": 3}})
+
+	// Store assigns a new modseq, sent along with the flags. Also for silent stores.
+	tc.transactf("ok", `store 1 flags (\Seen)`)
+	tc.xuntagged(imapclient.UntaggedFetch{Seq: 1, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(1), imapclient.FetchFlags{`\Seen`}, imapclient.FetchModSeq(4)}})
+	tc.transactf("ok", `store 1 flags.silent (\Seen)`)
+	tc.xuntagged(imapclient.UntaggedFetch{Seq: 1, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(1), imapclient.FetchModSeq(5)}})
+
+	// Only messages changed since modseq 3.
+	tc.transactf("ok", "fetch 1:* flags (changedsince 3)")
+	tc.xuntagged(imapclient.UntaggedFetch{Seq: 1, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(1), imapclient.FetchFlags{`\Seen`}, imapclient.FetchModSeq(5)}})
+	tc.transactf("ok", "uid fetch 1:* flags (changedsince 5)")
+	tc.xuntagged()
+
+	// Message 1 was changed after modseq 4, so it is not modified.
+	tc.transactf("ok", `store 1:2 (unchangedsince 4) +flags (\Flagged)`)
+	tc.xuntagged(imapclient.UntaggedFetch{Seq: 2, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(2), imapclient.FetchFlags{`\Flagged`}, imapclient.FetchModSeq(6)}})
+	tc.xcode("MODIFIED")
+	tc.xcodeArg(imapclient.CodeModified{Ranges: []imapclient.NumRange{{First: 1}}})
+	tc.transactf("ok", `uid store 1 (unchangedsince 5) +flags (\Flagged)`)
+	tc.xuntagged(imapclient.UntaggedFetch{Seq: 1, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(1), imapclient.FetchFlags{`\Seen`, `\Flagged`}, imapclient.FetchModSeq(7)}})
+	tc.xcode("")
+
+	ptr := func(v uint32) *uint32 { return &v }
+
+	// Search on modseq, with the highest modseq of the matches. With IMAP4rev2 as
+	// ESEARCH response.
+	tc.transactf("ok", "search modseq 6")
+	tc.xesearch(imapclient.UntaggedEsearch{All: imapclient.NumSet{Ranges: []imapclient.NumRange{{First: 1, Last: ptr(2)}}}, ModSeq: 7})
+	tc.transactf("ok", `search modseq "/flags/\\draft" all 7`)
+	tc.xesearch(imapclient.UntaggedEsearch{All: imapclient.NumSet{Ranges: []imapclient.NumRange{{First: 1}}}, ModSeq: 7})
+	tc.transactf("ok", "search modseq 8")
+	tc.xesearch(imapclient.UntaggedEsearch{})
+
+	tc.transactf("bad", "fetch 1 flags (changedsince)")
+	tc.transactf("bad", "store 1 (unchangedsince x) flags ()")
+}
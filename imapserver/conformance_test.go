@@ -0,0 +1,64 @@
+package imapserver
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mjl-/mox/conformance"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/store"
+)
+
+// TestConformance runs the scripted conversations in
+// ../testdata/imapconformance, each against a fresh account.
+func TestConformance(t *testing.T) {
+	files, err := filepath.Glob("../testdata/imapconformance/*.txt")
+	tcheck(t, err, "listing scripts")
+	if len(files) == 0 {
+		t.Fatalf("no conformance scripts")
+	}
+	for _, file := range files {
+		script, err := conformance.ParseFile(file)
+		tcheck(t, err, "parsing script")
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			defer mockUIDValidity()()
+			limitersInit() // Reset rate limiters.
+
+			os.RemoveAll("../testdata/imap/data")
+			mox.Context = context.Background()
+			mox.ConfigStaticPath = "../testdata/imap/mox.conf"
+			mox.MustLoadConfig(true, false)
+			acc, err := store.OpenAccount("mjl")
+			tcheck(t, err, "open account")
+			err = acc.SetPassword("testtest")
+			tcheck(t, err, "set password")
+			err = acc.Close()
+			tcheck(t, err, "close account")
+			switchDone := store.Switchboard()
+			defer close(switchDone)
+
+			serverConn, clientConn := net.Pipe()
+			tlsConfig := &tls.Config{
+				Certificates: []tls.Certificate{fakeCert(t)},
+			}
+			done := make(chan struct{})
+			connCounter++
+			cid := connCounter
+			go func() {
+				serve("test", cid, tlsConfig, serverConn, false, true)
+				close(done)
+			}()
+			err = conformance.Run(clientConn, script, 10*time.Second)
+			clientConn.Close()
+			<-done
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
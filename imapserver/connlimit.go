@@ -0,0 +1,74 @@
+package imapserver
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+var metricIMAPConnectionLimit = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mox_imap_connection_limit_total",
+		Help: "IMAP connections closed because of a connection limit.",
+	},
+	[]string{
+		"limit", // ip, account
+	},
+)
+
+// Number of authenticated connections per account, for MaxIMAPConnections.
+var accountConns = struct {
+	sync.Mutex
+	counts map[string]int
+}{counts: map[string]int{}}
+
+// xaccountConnAdd counts the just authenticated connection for its account. If
+// the account is already at its connection limit, the account is closed, an
+// untagged BYE with code LIMIT is written and the connection is closed.
+func (c *conn) xaccountConnAdd() {
+	name := c.account.Name
+	max := mox.Conf.MaxIMAPConnections(name)
+
+	accountConns.Lock()
+	n := accountConns.counts[name]
+	ok := max <= 0 || n < max
+	if ok {
+		accountConns.counts[name] = n + 1
+	}
+	accountConns.Unlock()
+
+	if ok {
+		c.connAccount = name
+		return
+	}
+
+	metricIMAPConnectionLimit.WithLabelValues("account").Inc()
+	c.log.Info("refusing authenticated connection due to many open connections for account", mlog.Field("account", name), mlog.Field("limit", max))
+	err := c.account.Close()
+	c.xsanity(err, "close account")
+	c.account = nil
+	c.username = ""
+	// ../rfc/5530 section 3
+	c.writelinef("* BYE [LIMIT] too many open connections for account")
+	panic(cleanClose)
+}
+
+// accountConnRemove stops counting the connection for the account it
+// authenticated as, if any.
+func (c *conn) accountConnRemove() {
+	if c.connAccount == "" {
+		return
+	}
+	accountConns.Lock()
+	defer accountConns.Unlock()
+	if n := accountConns.counts[c.connAccount]; n <= 1 {
+		delete(accountConns.counts, c.connAccount)
+	} else {
+		accountConns.counts[c.connAccount] = n - 1
+	}
+	c.connAccount = ""
+}
@@ -67,3 +67,42 @@ func TestCreate(t *testing.T) {
 	tc.transactf("no", `create "#"`)
 	tc.transactf("no", `create "&"`)
 }
+
+func TestCreateSpecialUse(t *testing.T) {
+	tc := start(t)
+	defer tc.close()
+
+	tc.client.Login("mjl@mox.example", "testtest")
+
+	tc.transactf("ok", `create "Archive2" (USE (\Archive))`)
+	tc.xuntagged(imapclient.UntaggedList{Flags: []string{`\Subscribed`, `\Archive`}, Separator: '/', Mailbox: "Archive2"})
+
+	// The previous archive mailbox lost its special-use.
+	tc.transactf("ok", `list (special-use) "" "*"`)
+	tc.xuntagged(
+		imapclient.UntaggedList{Flags: []string{`\Archive`}, Separator: '/', Mailbox: "Archive2"},
+		imapclient.UntaggedList{Flags: []string{`\Draft`}, Separator: '/', Mailbox: "Drafts"},
+		imapclient.UntaggedList{Flags: []string{`\Junk`}, Separator: '/', Mailbox: "Junk"},
+		imapclient.UntaggedList{Flags: []string{`\Sent`}, Separator: '/', Mailbox: "Sent"},
+		imapclient.UntaggedList{Flags: []string{`\Trash`}, Separator: '/', Mailbox: "Trash"},
+	)
+
+	// Multiple attributes, and parent mailboxes without special-use.
+	tc.transactf("ok", `create "a/b" (USE (\Junk \Trash))`)
+	tc.xuntagged(
+		imapclient.UntaggedList{Flags: []string{`\Subscribed`}, Separator: '/', Mailbox: "a"},
+		imapclient.UntaggedList{Flags: []string{`\Subscribed`, `\Junk`, `\Trash`}, Separator: '/', Mailbox: "a/b"},
+	)
+
+	tc.transactf("ok", `create "Plain" (USE ())`)
+	tc.xuntagged(imapclient.UntaggedList{Flags: []string{`\Subscribed`}, Separator: '/', Mailbox: "Plain"})
+
+	// Unsupported special-use attribute, the mailbox is not created. ../rfc/6154:324
+	tc.transactf("no", `create "All" (USE (\All))`)
+	tc.xcode("USEATTR")
+	tc.transactf("ok", `list "" "All"`)
+	tc.xuntagged()
+
+	tc.transactf("bad", `create "x" (USE)`)
+	tc.transactf("bad", `create "x" (USE (Junk))`)
+}
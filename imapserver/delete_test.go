@@ -55,7 +55,28 @@ func TestDelete(t *testing.T) {
 	// Let's try again with a message present.
 	tc.client.Create("msgs")
 	tc.client.Append("msgs", nil, nil, []byte(exampleMsg))
+	tc.client.Append("msgs", nil, nil, []byte(exampleMsg))
+	tc2.client.Select("msgs")
+	tc3.transactf("ok", "noop") // Drain.
+	tc.transactf("ok", "delete msgs")
+
+	// Session with the mailbox selected gets expunges for its messages, and cannot
+	// continue using the mailbox.
+	tc2.transactf("ok", "noop")
+	tc2.xuntagged(imapclient.UntaggedExpunge(1), imapclient.UntaggedExpunge(1))
+	tc2.transactf("no", "uid fetch 1:* flags")
+	tc2.xcode("NONEXISTENT")
+	tc2.client.Unselect()
+	tc3.transactf("ok", "noop")
+	tc3.xuntagged(imapclient.UntaggedList{Flags: []string{`\NonExistent`}, Separator: '/', Mailbox: "msgs"})
+
+	// Deleting our own selected mailbox.
+	tc.client.Create("msgs")
+	tc.client.Append("msgs", nil, nil, []byte(exampleMsg))
+	tc.client.Select("msgs")
 	tc.transactf("ok", "delete msgs")
+	tc.xuntagged(imapclient.UntaggedExpunge(1))
+	tc.client.Unselect()
 
 	// Delete for inbox/* is allowed.
 	tc.client.Create("inbox/a")
@@ -27,8 +27,11 @@ type fetchCmd struct {
 	tx            *bstore.Tx     // Writable tx, for storing message when first parsed as mime parts.
 	changes       []store.Change // For updated Seen flag.
 	markSeen      bool
+	peekOnly      bool // Never mark messages as seen, for NOTIFY.
 	needFlags     bool
-	expungeIssued bool // Set if a message cannot be read. Can happen for expunged messages.
+	needModseq    bool         // Whether MODSEQ must be in the response, for CHANGEDSINCE and flag changes with CONDSTORE.
+	modseq        store.ModSeq // For marking messages as seen. Assigned when first needed.
+	expungeIssued bool         // Set if a message cannot be read. Can happen for expunged messages.
 
 	// Loaded when first needed, closed when message was processed.
 	m    *store.Message // Message currently being processed.
@@ -69,8 +72,44 @@ func (c *conn) cmdxFetch(isUID bool, tag, cmdstr string, p *parser) {
 	nums := p.xnumSet()
 	p.xspace()
 	atts := p.xfetchAtts()
+	// Fetch modifiers. ../rfc/7162 ../rfc/4466
+	var changedSince int64 = -1
+	var vanished bool
+	if p.take(" (") {
+		for {
+			w := p.xtakelist("CHANGEDSINCE", "VANISHED")
+			switch w {
+			case "CHANGEDSINCE":
+				p.xspace()
+				changedSince = p.xnumber64()
+			case "VANISHED":
+				vanished = true
+			}
+			if !p.take(" ") {
+				break
+			}
+		}
+		p.xtake(")")
+	}
 	p.xempty()
 
+	// VANISHED is only allowed for UID FETCH with CHANGEDSINCE, after enabling
+	// QRESYNC. ../rfc/7162
+	if vanished && (!isUID || changedSince < 0 || !c.enabled[capQresync]) {
+		xsyntaxErrorf("VANISHED requires UID FETCH, CHANGEDSINCE and enabled QRESYNC")
+	}
+
+	// CHANGEDSINCE and MODSEQ are CONDSTORE-enabling. ../rfc/7162
+	var condstore bool
+	if changedSince >= 0 {
+		condstore = true
+	}
+	for _, a := range atts {
+		if a.field == "MODSEQ" {
+			condstore = true
+		}
+	}
+
 	// We don't use c.account.WithRLock because we write to the client while reading messages.
 	// We get the rlock, then we check the mailbox, release the lock and read the messages.
 	// The db transaction still locks out any changes to the database...
@@ -94,8 +133,40 @@ func (c *conn) cmdxFetch(isUID bool, tag, cmdstr string, p *parser) {
 		runlock()
 		runlock = func() {} // Prevent defer from unlocking again.
 
+		if condstore {
+			c.xensureCondstore(tx)
+		}
+
+		if vanished {
+			// Expunged messages in the requested set, before the FETCH responses. ../rfc/7162
+			var vuids []store.UID
+			q := bstore.QueryTx[store.ExpungedUID](tx)
+			q.FilterNonzero(store.ExpungedUID{MailboxID: c.mailboxID})
+			q.FilterGreater("ModSeq", store.ModSeq(changedSince))
+			q.SortAsc("UID")
+			err := q.ForEach(func(eu store.ExpungedUID) error {
+				if nums.containsKnownUID(eu.UID) {
+					vuids = append(vuids, eu.UID)
+				}
+				return nil
+			})
+			xcheckf(err, "listing expunged uids")
+			if len(vuids) > 0 {
+				c.bwritelinef("* VANISHED (EARLIER) %s", compactUIDSet(vuids).String())
+			}
+		}
+
 		for _, uid := range uids {
 			cmd.uid = uid
+			if changedSince >= 0 {
+				// Only messages with a higher modseq, and the response includes the modseq.
+				m := cmd.xchangedMessage(changedSince)
+				if m == nil {
+					continue
+				}
+				cmd.m = m
+				cmd.needModseq = true
+			}
 			cmd.process(atts)
 		}
 	})
@@ -113,6 +184,23 @@ func (c *conn) cmdxFetch(isUID bool, tag, cmdstr string, p *parser) {
 	}
 }
 
+// xchangedMessage returns the message for cmd.uid if its modseq is higher than
+// changedSince. Expunged messages are skipped.
+func (cmd *fetchCmd) xchangedMessage(changedSince int64) *store.Message {
+	q := bstore.QueryTx[store.Message](cmd.tx)
+	q.FilterNonzero(store.Message{MailboxID: cmd.mailboxID, UID: cmd.uid})
+	m, err := q.Get()
+	if err == bstore.ErrAbsent {
+		cmd.expungeIssued = true
+		return nil
+	}
+	xcheckf(err, "get message for uid %d", cmd.uid)
+	if m.ModSeq.Client() <= changedSince {
+		return nil
+	}
+	return &m
+}
+
 func (cmd *fetchCmd) xensureMessage() *store.Message {
 	if cmd.m != nil {
 		return cmd.m
@@ -185,11 +273,24 @@ func (cmd *fetchCmd) process(atts []fetchAtt) {
 
 	if cmd.markSeen {
 		m := cmd.xensureMessage()
+		om := *m
 		m.Seen = true
+		if cmd.modseq == 0 {
+			var err error
+			cmd.modseq, err = cmd.conn.account.NextModSeq(cmd.tx)
+			xcheckf(err, "assigning modseq")
+		}
+		m.ModSeq = cmd.modseq
 		err := cmd.tx.Update(m)
 		xcheckf(err, "marking message as seen")
+		err = store.MailboxCountsUpdate(cmd.tx, om, *m)
+		xcheckf(err, "updating mailbox counts")
 
-		cmd.changes = append(cmd.changes, store.ChangeFlags{MailboxID: cmd.mailboxID, UID: cmd.uid, Mask: store.Flags{Seen: true}, Flags: m.Flags, Keywords: m.Keywords})
+		cmd.changes = append(cmd.changes, store.ChangeFlags{MailboxID: cmd.mailboxID, UID: cmd.uid, ModSeq: m.ModSeq, Mask: store.Flags{Seen: true}, Flags: m.Flags, Keywords: m.Keywords})
+		// With CONDSTORE, flag changes must be sent with their modseq. ../rfc/7162
+		if cmd.conn.enabled[capCondstore] {
+			cmd.needModseq = true
+		}
 	}
 
 	if cmd.needFlags {
@@ -197,6 +298,11 @@ func (cmd *fetchCmd) process(atts []fetchAtt) {
 		data = append(data, bare("FLAGS"), flaglist(m.Flags, m.Keywords))
 	}
 
+	if cmd.needModseq {
+		m := cmd.xensureMessage()
+		data = append(data, bare("MODSEQ"), listspace{bare(fmt.Sprintf("%d", m.ModSeq.Client()))})
+	}
+
 	// Write errors are turned into panics because we write through c.
 	fmt.Fprintf(cmd.conn.bw, "* %d FETCH ", cmd.conn.xsequence(cmd.uid))
 	data.writeTo(cmd.conn, cmd.conn.bw)
@@ -211,6 +317,18 @@ func (cmd *fetchCmd) xprocessAtt(a fetchAtt) []token {
 	case "UID":
 		// Always present.
 		return nil
+	case "MODSEQ":
+		// Added at the end, also for CHANGEDSINCE and flag changes. ../rfc/7162
+		cmd.needModseq = true
+		return nil
+	case "EMAILID":
+		// ../rfc/8474
+		m := cmd.xensureMessage()
+		return []token{bare("EMAILID"), listspace{bare(m.EmailObjectID())}}
+	case "THREADID":
+		// ../rfc/8474
+		m := cmd.xensureMessage()
+		return []token{bare("THREADID"), listspace{bare(m.ThreadObjectID())}}
 	case "ENVELOPE":
 		_, part := cmd.xensureParsed()
 		envelope := xenvelope(part)
@@ -221,6 +339,36 @@ func (cmd *fetchCmd) xprocessAtt(a fetchAtt) []token {
 		m := cmd.xensureMessage()
 		return []token{bare("INTERNALDATE"), dquote(m.Received.Format("_2-Jan-2006 15:04:05 -0700"))}
 
+	case "SAVEDATE":
+		// ../rfc/8514
+		m := cmd.xensureMessage()
+		if m.SaveDate.IsZero() {
+			return []token{bare("SAVEDATE"), nilt}
+		}
+		return []token{bare("SAVEDATE"), dquote(m.SaveDate.Format("_2-Jan-2006 15:04:05 -0700"))}
+
+	case "PREVIEW":
+		// ../rfc/8970
+		m := cmd.xensureMessage()
+		if m.Preview != nil {
+			return []token{bare("PREVIEW"), string0(*m.Preview)}
+		} else if a.previewLazy {
+			// Message from before previews were generated at delivery. Client can ask
+			// again without LAZY.
+			return []token{bare("PREVIEW"), nilt}
+		}
+		_, part := cmd.xensureParsed()
+		preview, err := part.Preview()
+		if err != nil {
+			cmd.conn.log.Debugx("generating preview", err)
+			return []token{bare("PREVIEW"), nilt}
+		}
+		return []token{bare("PREVIEW"), string0(preview)}
+
+	case "ANNOTATION":
+		// ../rfc/5257
+		return cmd.xfetchAnnotation(a)
+
 	case "BODYSTRUCTURE":
 		_, part := cmd.xensureParsed()
 		bs := xbodystructure(part)
@@ -376,7 +524,7 @@ func xenvelope(p *message.Part) token {
 }
 
 func (cmd *fetchCmd) peekOrSeen(peek bool) {
-	if cmd.conn.readonly || peek {
+	if cmd.conn.readonly || peek || cmd.peekOnly || !cmd.conn.hasRight('s') {
 		return
 	}
 	m := cmd.xensureMessage()
@@ -453,6 +601,15 @@ func (cmd *fetchCmd) xbinary(a fetchAtt) (string, token) {
 		xusercodeErrorf("UNKNOWN-CTE", "unknown Content-Transfer-Encoding %q", p.ContentTransferEncoding)
 	}
 
+	// Without transfer encoding, the decoded data is the raw data, and we can seek
+	// into the message file for partials. Text is decoded for line endings.
+	switch p.ContentTransferEncoding {
+	case "", "7BIT", "8BIT", "BINARY":
+		if sr, ok := p.RawReader().(*io.SectionReader); ok && p.MediaType != "TEXT" {
+			return cmd.sectionRespField(a), sectionLiteral(sr, a.partial)
+		}
+	}
+
 	r := p.Reader()
 	if a.partial != nil {
 		r = cmd.xpartialReader(a.partial, r)
@@ -469,6 +626,26 @@ func (cmd *fetchCmd) xpartialReader(partial *partial, r io.Reader) io.Reader {
 	return io.LimitReader(r, int64(partial.count))
 }
 
+// sectionLiteral returns a literal for data of known size, optionally limited to
+// partial. The data before the partial offset is not read, we seek directly into
+// the message file. This keeps fetching large messages in chunks cheap, e.g. for
+// clients resuming a download after an interrupted connection.
+func sectionLiteral(sr *io.SectionReader, partial *partial) token {
+	offset, count := int64(0), sr.Size()
+	if partial != nil {
+		// Offset beyond the data results in an empty string. ../rfc/3501:3143 ../rfc/9051:4418
+		offset = int64(partial.offset)
+		if offset > sr.Size() {
+			offset = sr.Size()
+		}
+		count = int64(partial.count)
+		if offset+count > sr.Size() {
+			count = sr.Size() - offset
+		}
+	}
+	return readerSizeSyncliteral{io.NewSectionReader(sr, offset, count), count}
+}
+
 func (cmd *fetchCmd) xbody(a fetchAtt) (string, token) {
 	msgr, part := cmd.xensureParsed()
 
@@ -499,6 +676,9 @@ func (cmd *fetchCmd) xbody(a fetchAtt) (string, token) {
 	}
 
 	sr := cmd.xsection(a.section, part)
+	if xsr, ok := sr.(*io.SectionReader); ok {
+		return respField, sectionLiteral(xsr, a.partial)
+	}
 
 	if a.partial != nil {
 		n, err := io.Copy(io.Discard, io.LimitReader(sr, int64(a.partial.offset)))
@@ -1,6 +1,9 @@
 package imapserver
 
 import (
+	"fmt"
+	"io"
+	"runtime"
 	"strings"
 	"testing"
 	"time"
@@ -401,3 +404,117 @@ Content-Transfer-Encoding: Quoted-printable
 
 	tc.client.Logout()
 }
+
+// Large messages can be fetched in chunks, with partials not reading the data
+// before the offset.
+func TestFetchLargePartial(t *testing.T) {
+	defer mockUIDValidity()()
+	tc := start(t)
+	defer tc.close()
+
+	tc.client.Login("mjl@mox.example", "testtest")
+	tc.client.Select("inbox")
+
+	// 32MB body of unique lines, so offsets in the wrong place are noticed.
+	var b strings.Builder
+	for i := 0; b.Len() < 32*1024*1024; i++ {
+		fmt.Fprintf(&b, "line %09d 0123456789abcdefghijklmnopqrstuvwxyz\r\n", i)
+	}
+	body := b.String()
+	header := "From: <mjl@mox.example>\r\nSubject: large\r\nMIME-Version: 1.0\r\nContent-Type: application/octet-stream\r\nContent-Transfer-Encoding: 8bit\r\n\r\n"
+	msg := header + body
+	tc.client.Append("inbox", nil, nil, []byte(msg))
+
+	uid1 := imapclient.FetchUID(1)
+	chunk := 1024 * 1024
+	for _, offset := range []int{0, 5*chunk + 123, len(body) - chunk/2, len(body) + 1} {
+		end := offset + chunk
+		xpart := func(s string) string {
+			if offset > len(s) {
+				return ""
+			}
+			if end > len(s) {
+				return s[offset:]
+			}
+			return s[offset:end]
+		}
+
+		tc.transactf("ok", "fetch 1 body.peek[]<%d.%d>", offset, chunk)
+		tc.xuntagged(imapclient.UntaggedFetch{Seq: 1, Attrs: []imapclient.FetchAttr{uid1, imapclient.FetchBody{RespAttr: fmt.Sprintf("BODY[]<%d>", offset), Offset: int32(offset), Body: xpart(msg)}}})
+
+		tc.transactf("ok", "fetch 1 body.peek[text]<%d.%d>", offset, chunk)
+		tc.xuntagged(imapclient.UntaggedFetch{Seq: 1, Attrs: []imapclient.FetchAttr{uid1, imapclient.FetchBody{RespAttr: fmt.Sprintf("BODY[TEXT]<%d>", offset), Section: "TEXT", Offset: int32(offset), Body: xpart(body)}}})
+
+		tc.transactf("ok", "fetch 1 binary.peek[1]<%d.%d>", offset, chunk)
+		tc.xuntagged(imapclient.UntaggedFetch{Seq: 1, Attrs: []imapclient.FetchAttr{uid1, imapclient.FetchBinary{RespAttr: "BINARY[1]", Parts: []uint32{1}, Data: xpart(body)}}})
+	}
+}
+
+// genReaderAt is data of a given size, generated when read, for testing with
+// messages larger than would fit in memory.
+type genReaderAt int64
+
+func (g genReaderAt) ReadAt(buf []byte, off int64) (int, error) {
+	const pattern = "abcdefghijklmnopqrstuvwxyz"
+	if off >= int64(g) {
+		return 0, io.EOF
+	}
+	n := len(buf)
+	if rem := int64(g) - off; int64(n) > rem {
+		n = int(rem)
+	}
+	for i := 0; i < n; {
+		i += copy(buf[i:n], pattern[(off+int64(i))%int64(len(pattern)):])
+	}
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Sections are streamed from the message file, memory use does not depend on the
+// size of the message or section.
+func TestSectionLiteralStreaming(t *testing.T) {
+	const size = 2 << 30
+	sr := io.NewSectionReader(genReaderAt(size), 0, size)
+
+	test := func(p *partial, expSize int64, expLast byte) {
+		t.Helper()
+		tok, ok := sectionLiteral(sr, p).(readerSizeSyncliteral)
+		if !ok {
+			t.Fatalf("got token %T, expected readerSizeSyncliteral", tok)
+		}
+		if tok.size != expSize {
+			t.Fatalf("got literal size %d, expected %d", tok.size, expSize)
+		}
+
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		var last [1]byte
+		n, err := io.Copy(io.Discard, io.TeeReader(tok.r, writerFunc(func(buf []byte) (int, error) {
+			if len(buf) > 0 {
+				last[0] = buf[len(buf)-1]
+			}
+			return len(buf), nil
+		})))
+		runtime.ReadMemStats(&after)
+		tcheck(t, err, "reading literal")
+		if n != expSize || n > 0 && last[0] != expLast {
+			t.Fatalf("read %d bytes ending with %q, expected %d ending with %q", n, last[0], expSize, expLast)
+		}
+		if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 1024*1024 {
+			t.Fatalf("reading literal of %d bytes allocated %d bytes", n, alloc)
+		}
+	}
+
+	test(nil, size, 'a'+(size-1)%26)
+	test(&partial{offset: 1 << 30, count: 1 << 30}, 1<<30, 'a'+(size-1)%26)
+	test(&partial{offset: size - 10, count: 100}, 10, 'a'+(size-1)%26)
+	test(&partial{offset: size + 10, count: 100}, 0, 0)
+}
+
+type writerFunc func(buf []byte) (int, error)
+
+func (f writerFunc) Write(buf []byte) (int, error) {
+	return f(buf)
+}
@@ -1,6 +1,7 @@
 package imapserver
 
 import (
+	"bufio"
 	"context"
 	"encoding/base64"
 	"errors"
@@ -8,6 +9,7 @@ import (
 	"io"
 	"net"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -52,6 +54,12 @@ func FuzzServer(f *testing.F) {
 		"copy 1 Trash",
 		"move 1 Trash",
 		"search 1 all",
+		// Truncated and oversized literals.
+		"append inbox {10}\r\nhi",
+		"append inbox {4294967296+}\r\n",
+		"login {3+}\r\nmjl {8}",
+		// Malformed MIME.
+		"append inbox {64+}\r\nContent-Type: multipart/mixed; boundary=x\r\n\r\n--x\r\nContent-Type: multi",
 	}
 	for _, cmd := range seed {
 		const tag = "x "
@@ -103,12 +111,13 @@ func FuzzServer(f *testing.F) {
 			go func() {
 				defer func() {
 					x := recover()
-					// Protocol can become botched, when fuzzer sends literals.
+					// Protocol can become botched, when fuzzer sends literals. The server closes
+					// the connection for bad input, and for faults injected with build tag moxchaos.
 					if x == nil {
 						return
 					}
 					err, ok := x.(error)
-					if !ok || (!errors.Is(err, os.ErrDeadlineExceeded) && !errors.Is(err, io.EOF)) {
+					if !ok || (!errors.Is(err, os.ErrDeadlineExceeded) && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrClosedPipe)) {
 						panic(x)
 					}
 				}()
@@ -142,3 +151,76 @@ func FuzzServer(f *testing.F) {
 		run([]string{"login mjl@mox.example testtest", "select inbox", xappend})
 	})
 }
+
+// fuzzConn is a connection for FuzzParse, only setting deadlines is needed.
+type fuzzConn struct {
+	net.Conn
+}
+
+func (fuzzConn) SetReadDeadline(t time.Time) error  { return nil }
+func (fuzzConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// Fuzz the command argument parsers. The first line of the fuzz string is parsed,
+// the remainder is read for literals. Only syntax and user errors, and i/o errors
+// for truncated literals, are expected.
+func FuzzParse(f *testing.F) {
+	seed := []string{
+		"1:* (all)",
+		"uid 1,3:5 or seen not (from x subject {3}\r\nabc)",
+		"modseq 1 younger 10 sentbefore 1-Jan-2024",
+		"(body[header.fields (to from)]<0.10> binary.peek[1.2] rfc822.size)",
+		`"17-Jul-1996 02:44:25 -0700"`,
+		`(qresync (1 2 1:10 (1,3 1,3)))`,
+		"(selected-delayed (messagenew messageexpunge)) (subtree-one (inbox {2}\r\nab))",
+		"{5}\r\nabc",
+		"~{3+}\r\n\x00\xff\r",
+	}
+	for _, s := range seed {
+		f.Add(s)
+	}
+
+	parsers := []func(p *parser){
+		func(p *parser) { p.xsearchKey() },
+		func(p *parser) { p.xfetchAtts() },
+		func(p *parser) { p.xnumSet() },
+		func(p *parser) { p.xdateTime() },
+		func(p *parser) { p.xdate() },
+		func(p *parser) { p.xflagList() },
+		func(p *parser) { p.xmboxOrPat() },
+		func(p *parser) { p.xqresyncParams() },
+		func(p *parser) { p.xnotifyGroup() },
+		func(p *parser) { p.xastring() },
+		func(p *parser) { p.xtaggedExtVal() },
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		line, rest, _ := strings.Cut(s, "\r\n")
+		for _, fn := range parsers {
+			c := &conn{
+				conn:    fuzzConn{},
+				br:      bufio.NewReader(strings.NewReader(rest)),
+				bw:      bufio.NewWriter(io.Discard),
+				log:     xlog,
+				enabled: map[capability]bool{},
+			}
+			func() {
+				defer func() {
+					x := recover()
+					if x == nil {
+						return
+					}
+					switch err := x.(type) {
+					case syntaxError, userError:
+					case error:
+						if !errors.Is(err, errIO) && !errors.Is(err, errProtocol) {
+							t.Fatalf("unexpected error for %q: %v", s, err)
+						}
+					default:
+						t.Fatalf("unexpected panic for %q: %v", s, x)
+					}
+				}()
+				fn(newParser(line, c))
+			}()
+		}
+	})
+}
@@ -0,0 +1,163 @@
+package imapserver
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"unicode"
+
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/store"
+)
+
+// Fuzzy search. ../rfc/6203
+//
+// For FUZZY text search keys, the search string is split into terms (words). A
+// message matches if at least one of the terms is present in the text, or a word
+// in the text is within a small edit distance of the term (for terms of at least 4
+// characters). The relevancy score of a search key is the average of the scores of
+// its terms. A present term scores 0.8, increasing towards 1 with its frequency in
+// the text. Terms only matched by edit distance score half. The relevancy of a
+// message is the average score of all fuzzy keys that matched, as percentage.
+
+// fuzzyTerms returns the lower-case words in s.
+func fuzzyTerms(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// fuzzyScore returns the relevancy score between 0 and 1 of lower-case text for
+// the search terms. Zero means no match.
+func fuzzyScore(text string, terms []string) float64 {
+	if len(terms) == 0 {
+		// Like a non-fuzzy search for an empty string, everything matches.
+		return 1
+	}
+
+	var words []string // Lazily initialized, only needed for approximate matches.
+	var total float64
+	for _, t := range terms {
+		if n := strings.Count(text, t); n > 0 {
+			total += 0.8 + 0.2*(1-1/float64(n))
+			continue
+		}
+		if len([]rune(t)) < 4 {
+			continue
+		}
+		if words == nil {
+			words = fuzzyTerms(text)
+		}
+		var n int
+		for _, w := range words {
+			if editDistanceAtMost1(w, t) {
+				n++
+			}
+		}
+		if n > 0 {
+			total += (0.8 + 0.2*(1-1/float64(n))) / 2
+		}
+	}
+	return total / float64(len(terms))
+}
+
+// editDistanceAtMost1 returns whether a can be changed into b with at most one
+// character insertion, deletion or substitution.
+func editDistanceAtMost1(a, b string) bool {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) < len(rb) {
+		ra, rb = rb, ra
+	}
+	if len(ra)-len(rb) > 1 {
+		return false
+	}
+	i := 0
+	for i < len(rb) && ra[i] == rb[i] {
+		i++
+	}
+	if i == len(rb) {
+		return true
+	}
+	if len(ra) == len(rb) {
+		// Substitution.
+		return string(ra[i+1:]) == string(rb[i+1:])
+	}
+	// Deletion from the longer.
+	return string(ra[i+1:]) == string(rb[i:])
+}
+
+// relevancy returns the relevancy score of the message as percentage, from 1 to
+// 100. A message matched without fuzzy search keys has score 100.
+func (s *search) relevancy() int {
+	if len(s.scores) == 0 {
+		return 100
+	}
+	var total float64
+	for _, v := range s.scores {
+		total += v
+	}
+	r := int(math.Round(100 * total / float64(len(s.scores))))
+	if r < 1 {
+		r = 1
+	} else if r > 100 {
+		r = 100
+	}
+	return r
+}
+
+// fuzzyMatch returns whether lower-case text matches the search string of a fuzzy
+// search key, recording its score.
+func (s *search) fuzzyMatch(text, searchString string) bool {
+	score := fuzzyScore(text, fuzzyTerms(searchString))
+	if score > 0 {
+		s.scores = append(s.scores, score)
+		return true
+	}
+	return false
+}
+
+// mailText returns the lower-case (decoded) text bodies of the message or part
+// represented by p, and its header if headerToo is set, like the text that is
+// searched by mailContains.
+func mailText(c *conn, uid store.UID, p *message.Part, headerToo bool) string {
+	var b strings.Builder
+	read := func(r io.Reader) {
+		buf, err := io.ReadAll(r)
+		if err != nil {
+			c.log.Errorx("reading for fuzzy search text match", err, mlog.Field("uid", uid))
+			return
+		}
+		b.WriteString(strings.ToLower(string(buf)))
+		b.WriteString("\n")
+	}
+
+	var text func(p *message.Part, headerToo bool)
+	text = func(p *message.Part, headerToo bool) {
+		if headerToo {
+			read(p.HeaderReader())
+		}
+		if len(p.Parts) == 0 {
+			if p.MediaType == "TEXT" {
+				read(p.Reader())
+			}
+			return
+		}
+		for _, pp := range p.Parts {
+			pp := pp
+			text(&pp, pp.MediaType == "MESSAGE" && (pp.MediaSubType == "RFC822" || pp.MediaSubType == "GLOBAL"))
+		}
+	}
+	text(p, headerToo)
+	return b.String()
+}
+
+// relevancyList returns the scores for a RELEVANCY response, separated by space.
+func relevancyList(l []int) string {
+	s := make([]string, len(l))
+	for i, v := range l {
+		s[i] = fmt.Sprintf("%d", v)
+	}
+	return strings.Join(s, " ")
+}
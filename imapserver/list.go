@@ -1,6 +1,7 @@
 package imapserver
 
 import (
+	"context"
 	"fmt"
 	"path/filepath"
 	"sort"
@@ -11,7 +12,8 @@ import (
 )
 
 // LIST command, for listing mailboxes with various attributes, including about subscriptions and children.
-// We don't have flags Marked, Unmarked, NoSelect and NoInferiors and we don't have REMOTE mailboxes.
+// We don't have flags Marked, Unmarked and NoInferiors and we don't have REMOTE mailboxes. NoSelect is
+// only used for parents of mailboxes in the shared and public namespaces.
 //
 // State: Authenticated and selected.
 func (c *conn) cmdList(tag, cmd string, p *parser) {
@@ -22,6 +24,7 @@ func (c *conn) cmdList(tag, cmd string, p *parser) {
 	p.xspace()
 	var isExtended bool
 	var listSubscribed bool
+	var listSpecialUse bool
 	var listRecursive bool
 	if p.take("(") {
 		// ../rfc/9051:6633
@@ -41,6 +44,9 @@ func (c *conn) cmdList(tag, cmd string, p *parser) {
 			case "SUBSCRIBED":
 				nbase++
 				listSubscribed = true
+			case "SPECIAL-USE":
+				nbase++
+				listSpecialUse = true
 			default:
 				// ../rfc/9051:2398
 				xsyntaxErrorf("bad list selection option %q", w)
@@ -97,6 +103,18 @@ func (c *conn) cmdList(tag, cmd string, p *parser) {
 	}
 	p.xempty()
 
+	// The SPECIAL-USE selection option implies the SPECIAL-USE return option. ../rfc/6154
+	retSpecialUse = retSpecialUse || listSpecialUse
+
+	// Selection options a mailbox matched, for the CHILDINFO extended data item.
+	var childInfo listspace
+	if listSubscribed {
+		childInfo = append(childInfo, dquote("SUBSCRIBED"))
+	}
+	if listSpecialUse {
+		childInfo = append(childInfo, dquote("SPECIAL-USE"))
+	}
+
 	if !isExtended && reference == "" && patterns[0] == "" {
 		// ../rfc/9051:2277 ../rfc/3501:2221
 		c.bwritelinef(`* LIST () "/" ""`)
@@ -117,6 +135,19 @@ func (c *conn) cmdList(tag, cmd string, p *parser) {
 	re := xmailboxPatternMatcher(reference, patterns)
 	var responseLines []string
 
+	// Listing mailboxes shared by other accounts opens those accounts, so we only
+	// do that for patterns that can match the shared or public namespace.
+	ns := c.namespaces()
+	var sharedMailboxes []store.SharedMailbox
+	for _, pat := range patterns {
+		if s := reference + pat; s != "" && (strings.ContainsAny(s[:1], "*%") || strings.EqualFold(s[:1], ns.shared[:1]) || ns.publicAccount != "" && strings.EqualFold(s[:1], ns.public[:1])) {
+			var err error
+			sharedMailboxes, err = store.SharedMailboxes(context.TODO(), c.log, c.account.Name)
+			xcheckf(err, "listing shared mailboxes")
+			break
+		}
+	}
+
 	c.account.WithRLock(func() {
 		c.xdbread(func(tx *bstore.Tx) {
 			type info struct {
@@ -124,7 +155,6 @@ func (c *conn) cmdList(tag, cmd string, p *parser) {
 				subscribed bool
 			}
 			names := map[string]info{}
-			hasSubscribedChild := map[string]bool{}
 			hasChild := map[string]bool{}
 			var nameList []string
 
@@ -147,13 +177,37 @@ func (c *conn) cmdList(tag, cmd string, p *parser) {
 				if !ok {
 					nameList = append(nameList, sub.Name)
 				}
-				for p := filepath.Dir(sub.Name); p != "."; p = filepath.Dir(p) {
-					hasSubscribedChild[p] = true
-				}
 				return nil
 			})
 			xcheckf(err, "listing subscriptions")
 
+			// selected returns whether a mailbox matches the selection options. Without
+			// selection options, only existing mailboxes match. ../rfc/5258
+			selected := func(info info) bool {
+				if listSubscribed && !info.subscribed || !listSubscribed && info.mailbox == nil {
+					return false
+				}
+				return !listSpecialUse || info.mailbox != nil && hasSpecialUse(*info.mailbox)
+			}
+
+			// With RECURSIVEMATCH, parents of mailboxes that match the selection options are
+			// returned with CHILDINFO, also if they don't exist themselves. ../rfc/5258
+			hasSelectedChild := map[string]bool{}
+			if listRecursive {
+				for _, name := range nameList {
+					if !selected(names[name]) {
+						continue
+					}
+					for p := filepath.Dir(name); p != "."; p = filepath.Dir(p) {
+						hasSelectedChild[p] = true
+						if _, ok := names[p]; !ok {
+							names[p] = info{}
+							nameList = append(nameList, p)
+						}
+					}
+				}
+			}
+
 			sort.Strings(nameList) // For predictable order in tests.
 
 			for _, name := range nameList {
@@ -164,17 +218,17 @@ func (c *conn) cmdList(tag, cmd string, p *parser) {
 
 				var flags listspace
 				var extended listspace
-				if listRecursive && hasSubscribedChild[name] {
-					extended = listspace{bare("CHILDINFO"), listspace{dquote("SUBSCRIBED")}}
+				if hasSelectedChild[name] {
+					extended = listspace{bare("CHILDINFO"), childInfo}
+				}
+				if !selected(info) && extended == nil {
+					continue
 				}
 				if listSubscribed && info.subscribed {
 					flags = append(flags, bare(`\Subscribed`))
-					if info.mailbox == nil {
-						flags = append(flags, bare(`\NonExistent`))
-					}
 				}
-				if (info.mailbox == nil || listSubscribed) && flags == nil && extended == nil {
-					continue
+				if info.mailbox == nil {
+					flags = append(flags, bare(`\NonExistent`))
 				}
 
 				if retChildren {
@@ -190,20 +244,8 @@ func (c *conn) cmdList(tag, cmd string, p *parser) {
 					flags = append(flags, bare(`\Subscribed`))
 				}
 				if retSpecialUse && info.mailbox != nil {
-					if info.mailbox.Archive {
-						flags = append(flags, bare(`\Archive`))
-					}
-					if info.mailbox.Draft {
-						flags = append(flags, bare(`\Draft`))
-					}
-					if info.mailbox.Junk {
-						flags = append(flags, bare(`\Junk`))
-					}
-					if info.mailbox.Sent {
-						flags = append(flags, bare(`\Sent`))
-					}
-					if info.mailbox.Trash {
-						flags = append(flags, bare(`\Trash`))
+					for _, f := range specialUseFlags(*info.mailbox) {
+						flags = append(flags, bare(f))
 					}
 				}
 
@@ -221,8 +263,82 @@ func (c *conn) cmdList(tag, cmd string, p *parser) {
 		})
 	})
 
+	// Shared mailboxes cannot be subscribed to and have no special-use flags.
+	if !listSubscribed && !listSpecialUse {
+		responseLines = append(responseLines, c.listSharedLines(re, sharedMailboxes, retChildren)...)
+	}
+
 	for _, line := range responseLines {
 		c.bwritelinef("%s", line)
 	}
 	c.ok(tag, cmd)
 }
+
+// listSharedLines returns LIST responses for shared mailboxes matching re, and
+// their parents in the shared or public namespace, which cannot be selected.
+func (c *conn) listSharedLines(re matchStringer, l []store.SharedMailbox, retChildren bool) []string {
+	shared := map[string]bool{}
+	hasChild := map[string]bool{}
+	var names []string
+	for _, sm := range l {
+		name := c.sharedMailboxPrefix(sm.Owner) + sm.Mailbox.Name
+		shared[name] = true
+		names = append(names, name)
+		for p := filepath.Dir(name); p != "."; p = filepath.Dir(p) {
+			hasChild[p] = true
+		}
+	}
+	for name := range hasChild {
+		if !shared[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var lines []string
+	for _, name := range names {
+		if !re.MatchString(name) {
+			continue
+		}
+		var flags listspace
+		if !shared[name] {
+			flags = append(flags, bare(`\Noselect`))
+		}
+		if retChildren {
+			if hasChild[name] {
+				flags = append(flags, bare(`\HasChildren`))
+			} else {
+				flags = append(flags, bare(`\HasNoChildren`))
+			}
+		}
+		lines = append(lines, fmt.Sprintf(`* LIST %s "/" %s`, flags.pack(c), astring(name).pack(c)))
+	}
+	return lines
+}
+
+// hasSpecialUse returns whether a mailbox has a special-use attribute.
+func hasSpecialUse(mb store.Mailbox) bool {
+	return mb.Archive || mb.Draft || mb.Junk || mb.Sent || mb.Trash
+}
+
+// specialUseFlags returns the special-use attributes of a mailbox, for LIST
+// responses.
+func specialUseFlags(mb store.Mailbox) []string {
+	var l []string
+	if mb.Archive {
+		l = append(l, `\Archive`)
+	}
+	if mb.Draft {
+		l = append(l, `\Draft`)
+	}
+	if mb.Junk {
+		l = append(l, `\Junk`)
+	}
+	if mb.Sent {
+		l = append(l, `\Sent`)
+	}
+	if mb.Trash {
+		l = append(l, `\Trash`)
+	}
+	return l
+}
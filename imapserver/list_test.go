@@ -208,6 +208,35 @@ func TestListExtended(t *testing.T) {
 	tc.transactf("ok", `list (subscribed) "" x return (subscribed)`)
 	tc.xuntagged(imapclient.UntaggedList{Flags: []string{`\Subscribed`, `\NonExistent`}, Separator: '/', Mailbox: "x"})
 
+	// No STATUS for nonexistent mailboxes. ../rfc/5819
+	tc.transactf("ok", `list (subscribed) "" x return (status (messages unseen))`)
+	tc.xuntagged(imapclient.UntaggedList{Flags: []string{`\Subscribed`, `\NonExistent`}, Separator: '/', Mailbox: "x"})
+
+	// Special-use selection option, implies special-use return option.
+	tc.transactf("ok", `list (special-use) "" "*"`)
+	tc.xuntagged(ulist("Archive", Farchive), ulist("Drafts", Fdraft), ulist("Junk", Fjunk), ulist("Sent", Fsent), ulist("Trash", Ftrash))
+
+	tc.transactf("ok", `list (special-use) "" ("inbox" "Sent") return (children)`)
+	tc.xuntagged(ulist("Sent", Fhasnochildren, Fsent))
+
+	tc.transactf("ok", `list (subscribed special-use) "" "*" return (special-use)`)
+	tc.xuntagged(ulist("Archive", Fsubscribed, Farchive), ulist("Drafts", Fsubscribed, Fdraft), ulist("Junk", Fsubscribed, Fjunk), ulist("Sent", Fsubscribed, Fsent), ulist("Trash", Fsubscribed, Ftrash))
+
+	// Parent that doesn't exist and isn't subscribed, but with a subscribed child.
+	tc.client.Subscribe("p/q")
+	tc.transactf("ok", `list (subscribed) "" "p"`)
+	tc.xuntagged()
+
+	tc.transactf("ok", `list (subscribed recursivematch) "" "p"`)
+	tc.xuntagged(xchildlist("p", Fnonexistent))
+
+	tc.transactf("ok", `list (subscribed recursivematch) "" "p*" return (children)`)
+	tc.xuntagged(xchildlist("p", Fnonexistent, Fhasnochildren), ulist("p/q", Fsubscribed, Fnonexistent, Fhasnochildren))
+
+	// Without selection options, nonexistent mailboxes aren't listed.
+	tc.transactf("ok", `list "" "p*" return (subscribed)`)
+	tc.xuntagged()
+
 	tc.transactf("bad", `list (recursivematch) "" "*"`)        // Cannot have recursivematch without a base selection option like subscribed.
 	tc.transactf("bad", `list (recursivematch remote) "" "*"`) // "remote" is not a base selection option.
 	tc.transactf("bad", `list (unknown) "" "*"`)               // Unknown selection options must result in BAD.
@@ -0,0 +1,242 @@
+package imapserver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/store"
+)
+
+// metadataMailbox returns the ID of the mailbox for a METADATA command, for
+// mailbox name, or 0 for the empty name, meaning the server annotations.
+func (c *conn) metadataMailbox(tx *bstore.Tx, name string) int64 {
+	if name == "" {
+		return 0
+	}
+	name = xcheckmailboxname(name, true)
+	return c.xmailbox(tx, name, "NONEXISTENT").ID
+}
+
+// xmetadataEntry parses an entry name and checks it is valid.
+func (p *parser) xmetadataEntry() string {
+	key := p.xastring()
+	if !store.ValidAnnotationKey(key) {
+		p.xerrorf("invalid metadata entry %q", key)
+	}
+	return strings.ToLower(key)
+}
+
+// xmetadataValue parses a value for SETMETADATA: NIL for removing the entry, a
+// string, or a literal8 for binary data. ../rfc/5464:912
+func (p *parser) xmetadataValue() (value []byte, isString, remove bool) {
+	if p.take("NIL") {
+		return nil, false, true
+	}
+	if p.hasPrefix(`"`) {
+		return []byte(p.xstring()), true, false
+	}
+	lit8 := p.hasPrefix("~")
+	// Too large values are rejected with a METADATA MAXSIZE response code, but only
+	// after reading them. Larger literals cannot be accepted at all.
+	size, sync := p.xliteralSize(store.AnnotationTotalMax, true)
+	s := p.conn.xreadliteral(size, sync)
+	line := p.conn.readline(false)
+	p.orig, p.upper, p.o = line, toUpper(line), 0
+	return []byte(s), !lit8, false
+}
+
+// Getmetadata returns annotations of a mailbox, or of the server if the
+// mailbox is the empty string.
+//
+// State: Authenticated and selected.
+func (c *conn) cmdGetmetadata(tag, cmd string, p *parser) {
+	// Command: ../rfc/5464:641
+	// Request syntax: ../rfc/5464:1042
+
+	p.xspace()
+	maxSize := int64(-1)
+	depth := 0 // -1 for infinity.
+	if p.take("(") {
+		for {
+			if p.take("MAXSIZE ") {
+				maxSize = p.xnumber64()
+			} else if p.take("DEPTH ") {
+				switch {
+				case p.take("0"):
+					depth = 0
+				case p.take("1"):
+					depth = 1
+				case p.take("INFINITY"):
+					depth = -1
+				default:
+					p.xerrorf("expected 0, 1 or infinity for depth")
+				}
+			} else {
+				p.xerrorf("expected MAXSIZE or DEPTH")
+			}
+			if !p.take(" ") {
+				break
+			}
+		}
+		p.xtake(")")
+		p.xspace()
+	}
+	name := p.xmailbox()
+	p.xspace()
+	var keys []string
+	if p.take("(") {
+		for {
+			keys = append(keys, p.xmetadataEntry())
+			if !p.take(" ") {
+				break
+			}
+		}
+		p.xtake(")")
+	} else {
+		keys = append(keys, p.xmetadataEntry())
+	}
+	p.xempty()
+
+	// Whether an annotation key is requested, given the depth.
+	match := func(k string) bool {
+		for _, key := range keys {
+			if k == key {
+				return true
+			}
+			if depth == 0 || !strings.HasPrefix(k, key+"/") {
+				continue
+			}
+			if depth < 0 || !strings.Contains(k[len(key)+1:], "/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	var annotations []store.Annotation
+	c.account.WithRLock(func() {
+		c.xdbread(func(tx *bstore.Tx) {
+			mailboxID := c.metadataMailbox(tx, name)
+			q := bstore.QueryTx[store.Annotation](tx)
+			q.FilterEqual("MailboxID", mailboxID)
+			q.FilterFn(func(a store.Annotation) bool {
+				return match(a.Key)
+			})
+			var err error
+			annotations, err = q.List()
+			xcheckf(err, "listing annotations")
+		})
+	})
+	sort.Slice(annotations, func(i, j int) bool {
+		return annotations[i].Key < annotations[j].Key
+	})
+
+	// Entries larger than MAXSIZE are left out, the size of the largest is returned
+	// in the result. ../rfc/5464:680
+	var longest int
+	var l listspace
+	for _, a := range annotations {
+		if maxSize >= 0 && int64(len(a.Value)) > maxSize {
+			if len(a.Value) > longest {
+				longest = len(a.Value)
+			}
+			continue
+		}
+		var v token
+		if a.IsString {
+			v = string0(string(a.Value))
+		} else {
+			v = concat{bare("~"), syncliteral(string(a.Value))}
+		}
+		l = append(l, astring(a.Key), v)
+	}
+	if len(l) > 0 {
+		c.bwritelinef("* METADATA %s %s", astring(name).pack(c), l.pack(c))
+	}
+	if longest > 0 {
+		c.writeresultf("%s OK [METADATA LONGENTRIES %d] getmetadata done", tag, longest)
+		return
+	}
+	c.ok(tag, cmd)
+}
+
+// Setmetadata sets or removes annotations of a mailbox, or of the server if
+// the mailbox is the empty string. Values that are NIL remove an annotation.
+//
+// State: Authenticated and selected.
+func (c *conn) cmdSetmetadata(tag, cmd string, p *parser) {
+	// Command: ../rfc/5464:758
+	// Request syntax: ../rfc/5464:1053
+
+	type entryValue struct {
+		key      string
+		value    []byte
+		isString bool
+		remove   bool
+	}
+
+	p.xspace()
+	name := p.xmailbox()
+	p.xspace()
+	p.xtake("(")
+	var l []entryValue
+	for {
+		key := p.xmetadataEntry()
+		p.xspace()
+		value, isString, remove := p.xmetadataValue()
+		l = append(l, entryValue{key, value, isString, remove})
+		if !p.take(" ") {
+			break
+		}
+	}
+	p.xtake(")")
+	p.xempty()
+
+	for _, ev := range l {
+		if len(ev.value) > store.AnnotationValueMax {
+			// ../rfc/5464:781
+			xusercodeErrorf(fmt.Sprintf("METADATA MAXSIZE %d", store.AnnotationValueMax), "value too large")
+		}
+	}
+
+	c.account.WithWLock(func() {
+		c.xdbwrite(func(tx *bstore.Tx) {
+			mailboxID := c.metadataMailbox(tx, name)
+			for _, ev := range l {
+				q := bstore.QueryTx[store.Annotation](tx)
+				q.FilterEqual("MailboxID", mailboxID)
+				q.FilterNonzero(store.Annotation{Key: ev.key})
+				if ev.remove {
+					_, err := q.Delete()
+					xcheckf(err, "removing annotation")
+					continue
+				}
+				a, err := q.Get()
+				if err == bstore.ErrAbsent {
+					a = store.Annotation{MailboxID: mailboxID, Key: ev.key, IsString: ev.isString, Value: ev.value}
+					err = tx.Insert(&a)
+				} else if err == nil {
+					a.IsString = ev.isString
+					a.Value = ev.value
+					err = tx.Update(&a)
+				}
+				xcheckf(err, "storing annotation")
+			}
+
+			// Limits apply to the account as a whole, including the changes above.
+			count, size, err := store.AnnotationUsage(tx)
+			xcheckf(err, "checking annotation limits")
+			if count > store.AnnotationCountMax {
+				// ../rfc/5464:788
+				xusercodeErrorf("METADATA TOOMANY", "too many annotations, max %d", store.AnnotationCountMax)
+			} else if size > store.AnnotationTotalMax {
+				xusercodeErrorf("METADATA TOOMANY", "total size of annotations too large, max %d bytes", store.AnnotationTotalMax)
+			}
+		})
+	})
+
+	c.ok(tag, cmd)
+}
@@ -0,0 +1,78 @@
+package imapserver
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mjl-/mox/imapclient"
+	"github.com/mjl-/mox/store"
+)
+
+func TestMetadata(t *testing.T) {
+	tc := start(t)
+	defer tc.close()
+
+	tc.client.Login("mjl@mox.example", "testtest")
+
+	// Nothing set yet.
+	tc.transactf("ok", `getmetadata "" /private/comment`)
+	tc.xuntagged()
+
+	tc.transactf("ok", `setmetadata "" (/private/comment "server comment" /shared/vendor/x/y "shared")`)
+	tc.transactf("ok", `setmetadata Inbox (/private/comment "inbox comment" /private/vendor/test/a "a" /private/vendor/test/a/b "b")`)
+
+	tc.transactf("ok", `getmetadata "" /private/comment`)
+	tc.xuntagged(imapclient.UntaggedMetadata{Mailbox: "", Annotations: []imapclient.Annotation{{Key: "/private/comment", IsString: true, Value: []byte("server comment")}}})
+
+	// Multiple entries, case-insensitive.
+	tc.transactf("ok", `getmetadata "Inbox" (/PRIVATE/COMMENT /shared/comment)`)
+	tc.xuntagged(imapclient.UntaggedMetadata{Mailbox: "Inbox", Annotations: []imapclient.Annotation{{Key: "/private/comment", IsString: true, Value: []byte("inbox comment")}}})
+
+	// Depth.
+	tc.transactf("ok", `getmetadata (depth 1) Inbox /private/vendor/test`)
+	tc.xuntagged(imapclient.UntaggedMetadata{Mailbox: "Inbox", Annotations: []imapclient.Annotation{{Key: "/private/vendor/test/a", IsString: true, Value: []byte("a")}}})
+	tc.transactf("ok", `getmetadata (depth infinity) Inbox /private/vendor`)
+	tc.xuntagged(imapclient.UntaggedMetadata{Mailbox: "Inbox", Annotations: []imapclient.Annotation{
+		{Key: "/private/vendor/test/a", IsString: true, Value: []byte("a")},
+		{Key: "/private/vendor/test/a/b", IsString: true, Value: []byte("b")},
+	}})
+
+	// Maxsize leaves out longer values.
+	tc.transactf("ok", `getmetadata (maxsize 5) Inbox (/private/comment /private/vendor/test/a)`)
+	tc.xuntagged(imapclient.UntaggedMetadata{Mailbox: "Inbox", Annotations: []imapclient.Annotation{{Key: "/private/vendor/test/a", IsString: true, Value: []byte("a")}}})
+	tc.xcodeArg(imapclient.CodeOther{Code: "METADATA", Args: []string{"LONGENTRIES", "13"}})
+
+	// Binary value with literal8.
+	tc.transactf("ok", "setmetadata Inbox (/private/vendor/test/bin ~{3+}\r\n\x00\x01\x02)")
+	tc.transactf("ok", `getmetadata Inbox /private/vendor/test/bin`)
+	tc.xuntagged(imapclient.UntaggedMetadata{Mailbox: "Inbox", Annotations: []imapclient.Annotation{{Key: "/private/vendor/test/bin", Value: []byte{0, 1, 2}}}})
+
+	// Removing with NIL.
+	tc.transactf("ok", `setmetadata Inbox (/private/comment NIL)`)
+	tc.transactf("ok", `getmetadata Inbox /private/comment`)
+	tc.xuntagged()
+
+	// Annotations are removed with their mailbox.
+	tc.transactf("ok", `create a`)
+	tc.transactf("ok", `setmetadata a (/private/comment "x")`)
+	tc.transactf("ok", `delete a`)
+	tc.transactf("ok", `create a`)
+	tc.transactf("ok", `getmetadata a /private/comment`)
+	tc.xuntagged()
+
+	tc.transactf("no", `getmetadata nonexistent /private/comment`)
+	tc.xcode("NONEXISTENT")
+	tc.transactf("no", `setmetadata nonexistent (/private/comment "x")`)
+
+	// Bad entry names.
+	tc.transactf("bad", `getmetadata "" /other/comment`)
+	tc.transactf("bad", `getmetadata "" /private/comment/`)
+	tc.transactf("bad", `getmetadata "" /private//comment`)
+	tc.transactf("bad", `getmetadata "" /private/*`)
+	tc.transactf("bad", `getmetadata (depth 2) "" /private/comment`)
+
+	// Limits.
+	large := strings.Repeat("x", store.AnnotationValueMax+1)
+	tc.transactf("no", "setmetadata Inbox (/private/comment {%d+}\r\n%s)", len(large), large)
+	tc.xcodeArg(imapclient.CodeOther{Code: "METADATA", Args: []string{"MAXSIZE", "65536"}})
+}
@@ -0,0 +1,181 @@
+package imapserver
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/store"
+)
+
+// Esearch searches messages in one or more mailboxes, e.g. all mailboxes of the
+// account, returning an ESEARCH response with UIDs for each mailbox with matching
+// messages.
+//
+// State: Authenticated and selected.
+func (c *conn) cmdEsearch(tag, cmd string, p *parser) {
+	// Command: ../rfc/7377
+	// Syntax: ../rfc/7377
+
+	// Without source mailboxes, the selected mailbox is searched. ../rfc/7377
+	groups := []notifyGroup{{filter: "SELECTED"}}
+	if p.take(" IN (") {
+		groups = nil
+		for {
+			g := p.xfilterMailboxes()
+			for i, name := range g.mailboxes {
+				g.mailboxes[i] = xcheckmailboxname(name, true)
+			}
+			groups = append(groups, g)
+			if !p.take(" ") {
+				break
+			}
+		}
+		p.xtake(")")
+	}
+
+	eargs := map[string]bool{}
+	if p.take(" RETURN (") {
+		for !p.take(")") {
+			if len(eargs) > 0 {
+				p.xspace()
+			}
+			// SAVE is not allowed, the result would span mailboxes. ../rfc/7377
+			if w, ok := p.takelist("MIN", "MAX", "ALL", "COUNT", "RELEVANCY"); ok {
+				eargs[w] = true
+			} else {
+				xsyntaxErrorf("ESEARCH result option %q not supported", w)
+			}
+		}
+	}
+	if len(eargs) == 0 {
+		eargs["ALL"] = true
+	}
+
+	if p.take(" CHARSET ") {
+		xsearchCharset(p)
+	}
+	p.xspace()
+	sk := &searchKey{
+		searchKeys: []searchKey{*p.xsearchKey()},
+	}
+	for !p.empty() {
+		p.xspace()
+		sk.searchKeys = append(sk.searchKeys, *p.xsearchKey())
+	}
+	sk.xcheckStrings()
+	// Message sequence numbers and the saved search result are only meaningful for
+	// the selected mailbox. ../rfc/7377
+	if sk.hasSequenceSet() {
+		xsyntaxErrorf("sequence sets and $ not allowed in ESEARCH")
+	}
+	searchModseq := sk.hasModseq()
+
+	var expungeIssued bool
+	var lines []string
+	c.account.WithRLock(func() {
+		c.xdbread(func(tx *bstore.Tx) {
+			if searchModseq {
+				c.xensureCondstore(tx)
+			}
+
+			mailboxes, err := bstore.QueryTx[store.Mailbox](tx).List()
+			xcheckf(err, "listing mailboxes")
+			sort.Slice(mailboxes, func(i, j int) bool {
+				return mailboxes[i].Name < mailboxes[j].Name
+			})
+
+			for _, mb := range mailboxes {
+				selected := c.isSelected(mb.ID)
+				var match bool
+				for _, g := range groups {
+					if g.isSelected() {
+						match = match || selected
+					} else {
+						match = match || c.notifyMatch(tx, g, mb.Name)
+					}
+				}
+				if !match {
+					continue
+				}
+
+				// For the selected mailbox, we search the messages the session knows about.
+				var uids []store.UID
+				if selected {
+					uids = c.uids
+				} else {
+					q := bstore.QueryTx[store.Message](tx)
+					q.FilterNonzero(store.Message{MailboxID: mb.ID})
+					q.SortAsc("UID")
+					err := q.ForEach(func(m store.Message) error {
+						uids = append(uids, m.UID)
+						return nil
+					})
+					xcheckf(err, "listing messages in mailbox")
+				}
+
+				var matches []store.UID
+				var relevancies []int
+				var highestModSeq store.ModSeq
+				for i, uid := range uids {
+					if match, relevancy := c.searchMatchRelevancy(tx, mb.ID, uids, msgseq(i+1), uid, *sk, &expungeIssued); match {
+						matches = append(matches, uid)
+						relevancies = append(relevancies, relevancy)
+					}
+				}
+				if len(matches) == 0 {
+					continue
+				}
+				if searchModseq {
+					uidargs := make([]any, len(matches))
+					for i, uid := range matches {
+						uidargs[i] = uid
+					}
+					q := bstore.QueryTx[store.Message](tx)
+					q.FilterNonzero(store.Message{MailboxID: mb.ID})
+					q.FilterEqual("UID", uidargs...)
+					err := q.ForEach(func(m store.Message) error {
+						if m.ModSeq.Client() > highestModSeq.Client() {
+							highestModSeq = m.ModSeq
+						}
+						return nil
+					})
+					xcheckf(err, "looking up highest modseq of matching messages")
+				}
+
+				// Response always has UIDs, with the mailbox in the correlator. ../rfc/7377
+				resp := fmt.Sprintf("* ESEARCH (TAG %s MAILBOX %s UIDVALIDITY %d) UID", dquote(tag).pack(c), astring(mb.Name).pack(c), mb.UIDValidity)
+				if eargs["MIN"] {
+					resp += fmt.Sprintf(" MIN %d", matches[0])
+				}
+				if eargs["MAX"] {
+					resp += fmt.Sprintf(" MAX %d", matches[len(matches)-1])
+				}
+				if eargs["COUNT"] {
+					resp += fmt.Sprintf(" COUNT %d", len(matches))
+				}
+				if eargs["ALL"] {
+					resp += fmt.Sprintf(" ALL %s", compactUIDSet(matches).String())
+				}
+				if eargs["RELEVANCY"] {
+					resp += " RELEVANCY (" + relevancyList(relevancies) + ")"
+				}
+				if searchModseq {
+					resp += fmt.Sprintf(" MODSEQ %d", highestModSeq.Client())
+				}
+				lines = append(lines, resp)
+			}
+		})
+	})
+
+	for _, line := range lines {
+		c.bwritelinef("%s", line)
+	}
+	if expungeIssued {
+		// ../rfc/9051:5102
+		c.writeresultf("%s OK [EXPUNGEISSUED] done", tag)
+	} else {
+		c.ok(tag, cmd)
+	}
+}
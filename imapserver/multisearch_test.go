@@ -0,0 +1,70 @@
+package imapserver
+
+import (
+	"testing"
+
+	"github.com/mjl-/mox/imapclient"
+)
+
+func TestMultiSearch(t *testing.T) {
+	defer mockUIDValidity()()
+	tc := start(t)
+	defer tc.close()
+
+	tc.client.Login("mjl@mox.example", "testtest")
+	tc.client.Create("Archive/2023")
+	tc.client.Create("Archive/2023/Q1")
+	tc.client.Append("inbox", nil, nil, []byte(exampleMsg))
+	tc.client.Append("inbox", nil, nil, []byte(exampleMsg))
+	tc.client.Append("Archive", nil, nil, []byte(exampleMsg))
+	tc.client.Append("Archive/2023", nil, nil, []byte(exampleMsg))
+	tc.client.Append("Archive/2023/Q1", nil, nil, []byte(exampleMsg))
+
+	uint32ptr := func(v uint32) *uint32 {
+		return &v
+	}
+	uidset := func(first, last uint32) imapclient.NumSet {
+		r := imapclient.NumRange{First: first}
+		if last != first {
+			r.Last = &last
+		}
+		return imapclient.NumSet{Ranges: []imapclient.NumRange{r}}
+	}
+	// Created mailboxes get the next UIDVALIDITY.
+	uidvalidity := map[string]uint32{"Archive/2023": 2, "Archive/2023/Q1": 3}
+	esearch := func(mailbox string, count uint32, all imapclient.NumSet) imapclient.UntaggedEsearch {
+		uidval := uidvalidity[mailbox]
+		if uidval == 0 {
+			uidval = 1
+		}
+		return imapclient.UntaggedEsearch{Correlator: tc.client.LastTag, Mailbox: mailbox, UIDValidity: uidval, UID: true, Count: uint32ptr(count), All: all}
+	}
+
+	tc.transactf("ok", "esearch in (mailboxes (inbox Archive)) return (count all) all")
+	tc.xuntagged(esearch("Archive", 1, uidset(1, 1)), esearch("Inbox", 2, uidset(1, 2)))
+
+	// Mailbox and direct children, and the full subtree.
+	tc.transactf("ok", "esearch in (subtree-one Archive) return (count all) all")
+	tc.xuntagged(esearch("Archive", 1, uidset(1, 1)), esearch("Archive/2023", 1, uidset(1, 1)))
+	tc.transactf("ok", "esearch in (subtree Archive) return (count all) all")
+	tc.xuntagged(esearch("Archive", 1, uidset(1, 1)), esearch("Archive/2023", 1, uidset(1, 1)), esearch("Archive/2023/Q1", 1, uidset(1, 1)))
+
+	// Mailboxes without matches are not in the response.
+	tc.transactf("ok", "esearch in (personal) return (count all) uid 2")
+	tc.xuntagged(esearch("Inbox", 1, uidset(2, 2)))
+	tc.transactf("ok", "esearch in (personal) flagged")
+	tc.xuntagged()
+
+	// Without IN, the selected mailbox is searched. Not when none is selected.
+	tc.transactf("ok", "esearch all")
+	tc.xuntagged()
+	tc.client.Select("inbox")
+	tc.transactf("ok", "esearch return (min max) all")
+	tc.xuntagged(imapclient.UntaggedEsearch{Correlator: tc.client.LastTag, Mailbox: "Inbox", UIDValidity: 1, UID: true, Min: 1, Max: 2})
+
+	tc.transactf("bad", "esearch in (personal) 1:2")               // Sequence set.
+	tc.transactf("bad", "esearch in (personal) uid $")             // Saved search result.
+	tc.transactf("bad", "esearch in (personal) return (save) all") // No SAVE.
+	tc.transactf("bad", "esearch in (unknown) all")
+	tc.transactf("no", "esearch in (personal) charset unknown all")
+}
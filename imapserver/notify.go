@@ -0,0 +1,342 @@
+package imapserver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/store"
+)
+
+// Events we can send notifications for. Others, like annotations and metadata,
+// are not implemented and rejected with BADEVENT.
+var notifyEvents = []string{"MessageNew", "MessageExpunge", "FlagChange", "MailboxName", "SubscriptionChange"}
+
+// Notify sets or clears the events the client wants to receive unsolicited
+// updates for, also for mailboxes other than the selected mailbox. Updates are
+// sent while the client is idle, and while it is not executing a command.
+//
+// State: Authenticated and selected.
+func (c *conn) cmdNotify(tag, cmd string, p *parser) {
+	// Command: ../rfc/5465
+	// Request syntax: ../rfc/5465
+
+	p.xspace()
+	if p.take("NONE") {
+		p.xempty()
+		c.notify = nil
+		c.ok(tag, cmd)
+		return
+	}
+
+	p.xtake("SET")
+	status := p.take(" STATUS")
+	var n notify
+	p.xspace()
+	for {
+		n.groups = append(n.groups, p.xnotifyGroup())
+		if !p.take(" ") {
+			break
+		}
+	}
+	p.xempty()
+
+	var unsupported []string
+	for i, g := range n.groups {
+		for j, name := range g.mailboxes {
+			n.groups[i].mailboxes[j] = xcheckmailboxname(name, true)
+		}
+
+		events := map[string]bool{}
+		for _, e := range g.events {
+			if !notifyEventSupported(e.name) {
+				unsupported = append(unsupported, e.name)
+			}
+			if events[e.name] {
+				xsyntaxErrorf("duplicate event %s", e.name)
+			}
+			events[e.name] = true
+			if len(e.fetchAtts) > 0 && !g.isSelected() {
+				xsyntaxErrorf("fetch attributes for MessageNew only allowed for selected mailbox")
+			}
+		}
+		// ../rfc/5465
+		if events["MESSAGENEW"] != events["MESSAGEEXPUNGE"] {
+			xsyntaxErrorf("MessageNew and MessageExpunge must be specified together")
+		}
+		if (events["FLAGCHANGE"] || events["ANNOTATIONCHANGE"]) && !events["MESSAGENEW"] {
+			xsyntaxErrorf("FlagChange and AnnotationChange require MessageNew and MessageExpunge")
+		}
+	}
+	if len(unsupported) > 0 {
+		xusercodeErrorf("BADEVENT ("+strings.Join(notifyEvents, " ")+")", "unsupported events %s", strings.Join(unsupported, " "))
+	}
+
+	c.notify = &n
+
+	if status {
+		// Current status of the mailboxes the client will receive updates for, excluding
+		// the selected mailbox. ../rfc/5465
+		c.account.WithRLock(func() {
+			c.xdbread(func(tx *bstore.Tx) {
+				q := bstore.QueryTx[store.Mailbox](tx)
+				mailboxes, err := q.List()
+				xcheckf(err, "listing mailboxes")
+				sort.Slice(mailboxes, func(i, j int) bool {
+					return mailboxes[i].Name < mailboxes[j].Name
+				})
+				for _, mb := range mailboxes {
+					if c.isSelected(mb.ID) {
+						continue
+					}
+					if g := c.notifyGroup(tx, mb.Name, false); g != nil && g.hasEvent("MESSAGENEW") {
+						c.bwritelinef("%s", c.xstatusLine(tx, mb, c.notifyStatusAttrs()))
+					}
+				}
+			})
+		})
+	}
+
+	c.ok(tag, cmd)
+}
+
+func notifyEventSupported(name string) bool {
+	for _, e := range notifyEvents {
+		if strings.EqualFold(e, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g notifyGroup) isSelected() bool {
+	return g.filter == "SELECTED" || g.filter == "SELECTED-DELAYED"
+}
+
+func (g notifyGroup) hasEvent(name string) bool {
+	for _, e := range g.events {
+		if e.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyGroup returns the first group of the NOTIFY command that applies to the
+// mailbox, or nil. For the selected mailbox, only the SELECTED and
+// SELECTED-DELAYED filters apply, and only those.
+func (c *conn) notifyGroup(tx *bstore.Tx, name string, selected bool) *notifyGroup {
+	for i, g := range c.notify.groups {
+		if g.isSelected() != selected {
+			continue
+		}
+		if selected || c.notifyMatch(tx, g, name) {
+			return &c.notify.groups[i]
+		}
+	}
+	return nil
+}
+
+// notifyMatch returns whether mailbox name matches the non-selected mailbox
+// filter of g. ../rfc/5465
+func (c *conn) notifyMatch(tx *bstore.Tx, g notifyGroup, name string) bool {
+	switch g.filter {
+	case "PERSONAL":
+		// All mailboxes in an account are personal.
+		return true
+	case "INBOXES":
+		// Mailboxes incoming messages can be delivered to.
+		if name == "Inbox" {
+			return true
+		}
+		conf, _ := c.account.Conf()
+		for _, dest := range conf.Destinations {
+			if dest.Mailbox == name {
+				return true
+			}
+			for _, rs := range dest.Rulesets {
+				if rs.Mailbox == name {
+					return true
+				}
+			}
+		}
+		return name == conf.RejectsMailbox || name == store.ModerationMailbox
+	case "SUBSCRIBED":
+		err := tx.Get(&store.Subscription{Name: name})
+		if err != bstore.ErrAbsent {
+			xcheckf(err, "get subscription")
+		}
+		return err == nil
+	case "SUBTREE":
+		for _, mbName := range g.mailboxes {
+			if name == mbName || strings.HasPrefix(name, mbName+"/") {
+				return true
+			}
+		}
+	case "SUBTREE-ONE":
+		// Mailbox and its direct children. ../rfc/7377
+		for _, mbName := range g.mailboxes {
+			if name == mbName || strings.HasPrefix(name, mbName+"/") && !strings.Contains(name[len(mbName)+1:], "/") {
+				return true
+			}
+		}
+	case "MAILBOXES":
+		for _, mbName := range g.mailboxes {
+			if name == mbName {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// notifyStatusAttrs returns the attributes for STATUS responses about changes in
+// mailboxes other than the selected mailbox.
+func (c *conn) notifyStatusAttrs() []string {
+	attrs := []string{"MESSAGES", "UIDNEXT", "UNSEEN"}
+	if c.enabled[capCondstore] {
+		attrs = append(attrs, "HIGHESTMODSEQ")
+	}
+	return attrs
+}
+
+// notifyFetchAtts returns the fetch attributes requested with MessageNew for the
+// selected mailbox, or nil.
+func (c *conn) notifyFetchAtts() []fetchAtt {
+	if c.notify == nil {
+		return nil
+	}
+	for _, g := range c.notify.groups {
+		if !g.isSelected() {
+			continue
+		}
+		for _, e := range g.events {
+			if e.name == "MESSAGENEW" {
+				return e.fetchAtts
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+// xnotifyFilter filters changes for the events requested with NOTIFY. Changes
+// holds the changes for the selected mailbox and mailbox/subscription changes,
+// others holds the changes for other mailboxes, by mailbox ID, in order of
+// mailboxIDs. Returned are the changes to apply, and STATUS response lines for
+// the other mailboxes.
+func (c *conn) xnotifyFilter(changes []store.Change, mailboxIDs []int64, others map[int64][]store.Change) ([]store.Change, []string) {
+	var n []store.Change
+	var statusLines []string
+	c.xdbread(func(tx *bstore.Tx) {
+		var selected *notifyGroup
+		if c.state == stateSelected {
+			selected = c.notifyGroup(tx, "", true)
+		}
+		mailboxEvent := func(name, event string) bool {
+			g := c.notifyGroup(tx, name, false)
+			return g != nil && g.hasEvent(event)
+		}
+
+		for _, change := range changes {
+			switch ch := change.(type) {
+			case store.ChangeFlags, store.ChangeMailboxKeywords:
+				// Without a filter for the selected mailbox, we send changes as without NOTIFY.
+				if selected != nil && !selected.hasEvent("FLAGCHANGE") {
+					continue
+				}
+			case store.ChangeAddUID, store.ChangeRemoveUIDs:
+				// New and expunged messages are always sent to keep message sequence numbers in
+				// sync.
+			case store.ChangeAddMailbox:
+				if !mailboxEvent(ch.Name, "MAILBOXNAME") {
+					continue
+				}
+			case store.ChangeRemoveMailbox:
+				if !mailboxEvent(ch.Name, "MAILBOXNAME") {
+					continue
+				}
+			case store.ChangeRenameMailbox:
+				if !mailboxEvent(ch.OldName, "MAILBOXNAME") && !mailboxEvent(ch.NewName, "MAILBOXNAME") {
+					continue
+				}
+			case store.ChangeAddSubscription:
+				if !mailboxEvent(ch.Name, "SUBSCRIPTIONCHANGE") {
+					continue
+				}
+			default:
+				panic(fmt.Sprintf("internal error, missing case for %#v", change))
+			}
+			n = append(n, change)
+		}
+
+		for _, mbID := range mailboxIDs {
+			mb := store.Mailbox{ID: mbID}
+			if err := tx.Get(&mb); err == bstore.ErrAbsent {
+				continue
+			} else {
+				xcheckf(err, "get mailbox")
+			}
+			g := c.notifyGroup(tx, mb.Name, false)
+			if g == nil {
+				continue
+			}
+			var send bool
+			for _, change := range others[mbID] {
+				switch change.(type) {
+				case store.ChangeAddUID, store.ChangeRemoveUIDs:
+					send = send || g.hasEvent("MESSAGENEW")
+				case store.ChangeFlags:
+					send = send || g.hasEvent("FLAGCHANGE")
+				}
+			}
+			if send {
+				statusLines = append(statusLines, c.xstatusLine(tx, mb, c.notifyStatusAttrs()))
+			}
+		}
+	})
+	return n, statusLines
+}
+
+// xnotifyFetch writes FETCH responses with the attributes requested with
+// MessageNew for new messages in the selected mailbox. Messages are not marked as
+// seen.
+func (c *conn) xnotifyFetch(uids []store.UID, atts []fetchAtt) {
+	cmd := &fetchCmd{conn: c, mailboxID: c.mailboxID, peekOnly: true}
+	c.xdbread(func(tx *bstore.Tx) {
+		cmd.tx = tx
+		for _, uid := range uids {
+			cmd.uid = uid
+			cmd.process(atts)
+		}
+	})
+}
+
+// xnotifyWait sends changes to the client while waiting for a command, with
+// NOTIFY active. The line is left for reading from c.line.
+func (c *conn) xnotifyWait() {
+	c.applyChanges(c.comm.Get(), false)
+	c.applySharedChanges()
+	c.xflush()
+	for {
+		select {
+		case le := <-c.lineChan():
+			// Put it back for readline.
+			c.line <- le
+			return
+		case <-c.comm.Pending:
+			c.applyChanges(c.comm.Get(), false)
+			c.xflush()
+		case <-c.sharedPending():
+			c.applySharedChanges()
+			c.xflush()
+		case <-mox.Shutdown.Done():
+			// ../rfc/9051:5375
+			c.writelinef("* BYE shutting down")
+			panic(errIO)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package imapserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mjl-/mox/imapclient"
+)
+
+func TestNotify(t *testing.T) {
+	defer mockUIDValidity()()
+	tc := start(t)
+	defer tc.close()
+
+	tc2 := startNoSwitchboard(t)
+	defer tc2.close()
+
+	tc.client.Login("mjl@mox.example", "testtest")
+	tc.client.Select("inbox")
+	tc2.client.Login("mjl@mox.example", "testtest")
+
+	tc.transactf("bad", "notify set (personal (messageNew))")                                // Without MessageExpunge.
+	tc.transactf("bad", "notify set (personal (flagChange))")                                // Without MessageNew.
+	tc.transactf("bad", "notify set (personal (messageNew (uid) messageExpunge))")           // Fetch attributes only for selected.
+	tc.transactf("bad", "notify set (personal (mailboxName mailboxName))")                   // Duplicate.
+	tc.transactf("bad", "notify set")                                                        // Missing event group.
+	tc.transactf("no", "notify set (personal (messageNew messageExpunge annotationChange))") // Unsupported.
+	tc.xcode("BADEVENT")
+	tc.xcodeArg(imapclient.CodeList{Code: "BADEVENT", Args: []string{"MessageNew", "MessageExpunge", "FlagChange", "MailboxName", "SubscriptionChange"}})
+
+	// With STATUS, we get the current status of other mailboxes.
+	tc.transactf("ok", "notify set status (selected (messageNew (uid flags) messageExpunge)) (personal (messageNew messageExpunge flagChange mailboxName subscriptionChange))")
+	tc.xuntaggedCheck(false, imapclient.UntaggedStatus{Mailbox: "Archive", Attrs: map[string]int64{"MESSAGES": 0, "UIDNEXT": 1, "UNSEEN": 0}})
+	for _, u := range tc.lastUntagged {
+		if st, ok := u.(imapclient.UntaggedStatus); ok && st.Mailbox == "Inbox" {
+			t.Fatalf("got status for selected mailbox")
+		}
+	}
+
+	// readUntagged reads n responses the server sends without a command.
+	readUntagged := func(n int) {
+		t.Helper()
+		err := tc.conn.SetReadDeadline(time.Now().Add(time.Second))
+		tc.check(err, "set read deadline")
+		tc.lastUntagged = nil
+		for i := 0; i < n; i++ {
+			untagged, err := tc.client.ReadUntagged()
+			tc.check(err, "read untagged")
+			tc.lastUntagged = append(tc.lastUntagged, untagged)
+		}
+		err = tc.conn.SetReadDeadline(time.Time{})
+		tc.check(err, "clear read deadline")
+	}
+
+	// New message in other mailbox.
+	tc2.client.Append("Archive", nil, nil, []byte(exampleMsg))
+	readUntagged(1)
+	tc.xuntagged(imapclient.UntaggedStatus{Mailbox: "Archive", Attrs: map[string]int64{"MESSAGES": 1, "UIDNEXT": 2, "UNSEEN": 1}})
+
+	// Flag change in other mailbox.
+	tc2.client.Select("Archive")
+	tc2.client.StoreFlagsAdd("1", true, `\Seen`)
+	readUntagged(1)
+	tc.xuntagged(imapclient.UntaggedStatus{Mailbox: "Archive", Attrs: map[string]int64{"MESSAGES": 1, "UIDNEXT": 2, "UNSEEN": 0}})
+
+	// New message in selected mailbox, with requested fetch attributes.
+	tc2.client.Append("inbox", []string{`\Seen`}, nil, []byte(exampleMsg))
+	readUntagged(2)
+	tc.xuntagged(
+		imapclient.UntaggedExists(1),
+		imapclient.UntaggedFetch{Seq: 1, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(1), imapclient.FetchFlags{`\Seen`}}},
+	)
+
+	// Mailbox events.
+	tc2.client.Create("Newbox")
+	readUntagged(1)
+	tc.xuntagged(imapclient.UntaggedList{Flags: []string{`\Subscribed`}, Separator: '/', Mailbox: "Newbox"})
+
+	// Only events for the filtered mailboxes.
+	tc.transactf("ok", "notify set (mailboxes (Archive) (messageNew messageExpunge))")
+	tc2.client.Append("Sent", nil, nil, []byte(exampleMsg))
+	tc2.client.Append("Archive", nil, nil, []byte(exampleMsg))
+	readUntagged(1)
+	tc.xuntagged(imapclient.UntaggedStatus{Mailbox: "Archive", Attrs: map[string]int64{"MESSAGES": 2, "UIDNEXT": 3, "UNSEEN": 1}})
+
+	// Without NOTIFY, no updates for other mailboxes.
+	tc.transactf("ok", "notify none")
+	tc2.client.Append("Archive", nil, nil, []byte(exampleMsg))
+	tc.transactf("ok", "noop")
+	tc.xuntagged()
+}
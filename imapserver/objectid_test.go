@@ -0,0 +1,68 @@
+package imapserver
+
+import (
+	"testing"
+
+	"github.com/mjl-/mox/imapclient"
+)
+
+func TestObjectID(t *testing.T) {
+	defer mockUIDValidity()()
+	tc := start(t)
+	defer tc.close()
+
+	tc.client.Login("mjl@mox.example", "testtest")
+
+	tc.transactf("ok", "create objtest")
+	tc.xcodeArg(imapclient.CodeMailboxID("F7"))
+
+	tc.transactf("ok", "status objtest (messages mailboxid)")
+	tc.xuntagged(imapclient.UntaggedStatus{Mailbox: "objtest", Attrs: map[string]int64{"MESSAGES": 0}, MailboxID: "F7"})
+
+	// Mailbox ID stays the same after a rename.
+	tc.transactf("ok", "rename objtest objtest2")
+	tc.transactf("ok", "status objtest2 (mailboxid)")
+	tc.xuntagged(imapclient.UntaggedStatus{Mailbox: "objtest2", Attrs: map[string]int64{}, MailboxID: "F7"})
+
+	// Second message is a reply to the first, and is in its thread. The third starts
+	// its own thread.
+	msg1 := "Message-Id: <objtest1@mox.example>\r\nSubject: first\r\n\r\nhi\r\n"
+	msg2 := "Message-Id: <objtest2@mox.example>\r\nIn-Reply-To: <objtest1@mox.example>\r\nSubject: Re: first\r\n\r\nhello\r\n"
+	msg3 := "Message-Id: <objtest3@mox.example>\r\nSubject: other\r\n\r\nbye\r\n"
+	for _, msg := range []string{msg1, msg2, msg3} {
+		tc.client.Append("inbox", nil, nil, []byte(msg))
+	}
+	tc.client.Select("inbox")
+
+	fetch := func(seq uint32, uid imapclient.FetchUID, emailID, threadID string) imapclient.UntaggedFetch {
+		return imapclient.UntaggedFetch{Seq: seq, Attrs: []imapclient.FetchAttr{uid, imapclient.FetchEmailID(emailID), imapclient.FetchThreadID(threadID)}}
+	}
+	tc.transactf("ok", "fetch 1:3 (emailid threadid)")
+	tc.xuntagged(fetch(1, 1, "M1", "T1"), fetch(2, 2, "M2", "T1"), fetch(3, 3, "M3", "T3"))
+
+	tc.transactf("ok", "search emailid M2")
+	tc.xuntagged(imapclient.UntaggedSearch{2})
+	tc.transactf("ok", "search threadid T1")
+	tc.xuntagged(imapclient.UntaggedSearch{1, 2})
+	tc.transactf("bad", "search emailid ()") // Invalid object id.
+
+	// A copy keeps the email and thread ID of the original.
+	tc.transactf("ok", "copy 2 objtest2")
+	tc.client.Select("objtest2")
+	tc.transactf("ok", "fetch 1 (emailid threadid)")
+	tc.xuntagged(fetch(1, 1, "M2", "T1"))
+
+	// A reply to the copy is in the same thread.
+	msg4 := "Message-Id: <objtest4@mox.example>\r\nReferences: <objtest1@mox.example> <objtest2@mox.example>\r\nSubject: Re: first\r\n\r\nok\r\n"
+	tc.client.Append("objtest2", nil, nil, []byte(msg4))
+	tc.client.Unselect()
+	tc.client.Select("objtest2")
+	tc.transactf("ok", "fetch 2 (emailid threadid)")
+	tc.xuntagged(fetch(2, 2, "M5", "T1"))
+
+	// A move keeps the email ID.
+	tc.transactf("ok", "uid move 2 inbox")
+	tc.client.Select("inbox")
+	tc.transactf("ok", "fetch 4 (emailid threadid)")
+	tc.xuntagged(fetch(4, 4, "M5", "T1"))
+}
@@ -300,7 +300,7 @@ func (p *parser) xstring() (r string) {
 		esc := false
 		r := ""
 		for i, c := range p.orig[p.o:] {
-			if c == '\\' {
+			if c == '\\' && !esc {
 				esc = true
 			} else if c == '\x00' || c == '\r' || c == '\n' {
 				p.xerrorf("invalid nul, cr or lf in string")
@@ -408,6 +408,15 @@ func (p *parser) xatom() string {
 	return p.xtakechars(atomChar, "atom")
 }
 
+// ../rfc/8474
+func (p *parser) xobjectid() string {
+	s := p.xtakechars("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-", "objectid")
+	if len(s) > 255 {
+		p.xerrorf("objectid too long")
+	}
+	return s
+}
+
 func (p *parser) xmailbox() string {
 	s := p.xastring()
 	// UTF-7 is deprecated in IMAP4rev2. IMAP4rev1 does not fully forbid
@@ -450,8 +459,10 @@ func (p *parser) xmboxOrPat() ([]string, bool) {
 // ../rfc/9051:7056
 // RECENT only in ../rfc/3501:5047
 // APPENDLIMIT is from ../rfc/7889:252
+// HIGHESTMODSEQ is from ../rfc/7162
+// MAILBOXID is from ../rfc/8474
 func (p *parser) xstatusAtt() string {
-	return p.xtakelist("MESSAGES", "UIDNEXT", "UIDVALIDITY", "UNSEEN", "DELETED", "SIZE", "RECENT", "APPENDLIMIT")
+	return p.xtakelist("MESSAGES", "UIDNEXT", "UIDVALIDITY", "UNSEEN", "DELETED-STORAGE", "DELETED", "SIZE", "RECENT", "APPENDLIMIT", "HIGHESTMODSEQ", "MAILBOXID")
 }
 
 // ../rfc/9051:7133 ../rfc/9051:7034
@@ -580,6 +591,11 @@ func (p *parser) xfetchAtt() (r fetchAtt) {
 	words := []string{
 		"ENVELOPE", "FLAGS", "INTERNALDATE", "RFC822.SIZE", "BODYSTRUCTURE", "UID", "BODY.PEEK", "BODY", "BINARY.PEEK", "BINARY.SIZE", "BINARY",
 		"RFC822.HEADER", "RFC822.TEXT", "RFC822", // older IMAP
+		"MODSEQ",              // CONDSTORE, ../rfc/7162
+		"EMAILID", "THREADID", // OBJECTID, ../rfc/8474
+		"SAVEDATE",   // SAVEDATE, ../rfc/8514
+		"PREVIEW",    // PREVIEW, ../rfc/8970
+		"ANNOTATION", // ANNOTATE, ../rfc/5257
 	}
 	f := p.xtakelist(words...)
 	r.peek = strings.HasSuffix(f, ".PEEK")
@@ -600,6 +616,26 @@ func (p *parser) xfetchAtt() (r fetchAtt) {
 		}
 	case "BINARY.SIZE":
 		r.sectionBinary = p.xsectionBinary()
+	case "PREVIEW":
+		// ../rfc/8970
+		if p.take(" (") {
+			for {
+				p.xtakelist("LAZY")
+				r.previewLazy = true
+				if !p.take(" ") {
+					break
+				}
+			}
+			p.xtake(")")
+		}
+	case "ANNOTATION":
+		// ../rfc/5257 section 4.3
+		p.xspace()
+		p.xtake("(")
+		r.annotationEntries, _ = p.xmboxOrPat()
+		p.xspace()
+		r.annotationAttribs, _ = p.xmboxOrPat()
+		p.xtake(")")
 	}
 	return
 }
@@ -772,6 +808,11 @@ var searchKeyWords = []string{
 	"SENTBEFORE", "SENTON",
 	"SENTSINCE", "SMALLER",
 	"UID", "UNDRAFT",
+	"MODSEQ",              // CONDSTORE, ../rfc/7162
+	"FUZZY",               // SEARCH=FUZZY, ../rfc/6203
+	"EMAILID", "THREADID", // OBJECTID, ../rfc/8474
+	"SAVEDBEFORE", "SAVEDON", "SAVEDSINCE", "SAVEDATESUPPORTED", // SAVEDATE, ../rfc/8514
+	"ANNOTATION", // ANNOTATE, ../rfc/5257
 }
 
 // ../rfc/9051:6923 ../rfc/3501:4957
@@ -855,6 +896,10 @@ func (p *parser) xsearchKey() *searchKey {
 	case "NOT":
 		p.xspace()
 		sk.searchKey = p.xsearchKey()
+	case "FUZZY":
+		// ../rfc/6203
+		p.xspace()
+		sk.searchKey = p.xsearchKey()
 	case "OR":
 		p.xspace()
 		sk.searchKey = p.xsearchKey()
@@ -876,12 +921,120 @@ func (p *parser) xsearchKey() *searchKey {
 		p.xspace()
 		sk.uidSet = p.xnumSet()
 	case "UNDRAFT":
+	case "MODSEQ":
+		// ../rfc/7162
+		// The optional entry name and type are ignored: we only keep a modseq per
+		// message, not per flag.
+		p.xspace()
+		if p.hasPrefix(`"`) {
+			p.xstring()
+			p.xspace()
+			p.xtakelist("PRIV", "SHARED", "ALL")
+			p.xspace()
+		}
+		sk.modseq = p.xnumber64()
+	case "EMAILID", "THREADID":
+		// ../rfc/8474
+		p.xspace()
+		sk.atom = p.xobjectid()
+	case "SAVEDBEFORE", "SAVEDON", "SAVEDSINCE":
+		// ../rfc/8514
+		p.xspace()
+		sk.date = p.xdate()
+	case "SAVEDATESUPPORTED":
+	case "ANNOTATION":
+		// ../rfc/5257 section 4.5
+		p.xspace()
+		sk.annotationEntry = p.xlistMailbox()
+		p.xspace()
+		sk.annotationAttrib = p.xlistMailbox()
+		p.xspace()
+		sk.astring = p.xastring()
 	default:
 		p.xerrorf("missing case for op %q", sk.op)
 	}
 	return sk
 }
 
+// ../rfc/7162
+func (p *parser) xqresyncParams() *qresyncParams {
+	p.xtake("(")
+	r := &qresyncParams{}
+	r.uidValidity = p.xnznumber()
+	p.xspace()
+	r.modseq = p.xnumber64()
+	if r.modseq == 0 {
+		p.xerrorf("modseq must be non-zero")
+	}
+	if p.take(" ") {
+		if !p.hasPrefix("(") {
+			ss := p.xnumSet()
+			r.knownUIDs = &ss
+		}
+		if r.knownUIDs == nil || p.take(" ") {
+			// Sequence match data is an optimization for finding expunged messages, but we
+			// keep track of expunged messages explicitly, so we ignore it.
+			p.xtake("(")
+			p.xnumSet()
+			p.xspace()
+			p.xnumSet()
+			p.xtake(")")
+		}
+	}
+	p.xtake(")")
+	return r
+}
+
+// ../rfc/5465
+// filter-mailboxes, for NOTIFY and ESEARCH. ../rfc/5465 ../rfc/7377
+// Only the filter and mailboxes of the returned notifyGroup are set.
+func (p *parser) xfilterMailboxes() (g notifyGroup) {
+	g.filter = p.xtakelist("SELECTED-DELAYED", "SELECTED", "INBOXES", "PERSONAL", "SUBSCRIBED", "SUBTREE-ONE", "SUBTREE", "MAILBOXES")
+	if g.filter == "SUBTREE" || g.filter == "SUBTREE-ONE" || g.filter == "MAILBOXES" {
+		p.xspace()
+		if p.take("(") {
+			for {
+				g.mailboxes = append(g.mailboxes, p.xmailbox())
+				if !p.take(" ") {
+					break
+				}
+			}
+			p.xtake(")")
+		} else {
+			g.mailboxes = []string{p.xmailbox()}
+		}
+	}
+	return g
+}
+
+func (p *parser) xnotifyGroup() notifyGroup {
+	p.xtake("(")
+	g := p.xfilterMailboxes()
+	p.xspace()
+	if !p.take("NONE") {
+		p.xtake("(")
+		for {
+			e := notifyEvent{name: strings.ToUpper(p.xatom())}
+			if e.name == "MESSAGENEW" && p.take(" (") {
+				for {
+					e.fetchAtts = append(e.fetchAtts, p.xfetchAtt())
+					if !p.take(" ") {
+						break
+					}
+				}
+				p.xtake(")")
+			}
+			g.events = append(g.events, e)
+			if !p.take(" ") {
+				break
+			}
+		}
+		p.xtake(")")
+	}
+	p.xtake(")")
+	return g
+}
+
 // ../rfc/9051:6489 ../rfc/3501:4692
 func (p *parser) xdateDay() int {
 	d := p.xdigit()
@@ -0,0 +1,26 @@
+package imapserver
+
+import (
+	"testing"
+
+	"github.com/mjl-/mox/imapclient"
+)
+
+func TestPreview(t *testing.T) {
+	defer mockUIDValidity()()
+	tc := start(t)
+	defer tc.close()
+
+	tc.client.Login("mjl@mox.example", "testtest")
+
+	msg := "Subject: preview\r\n\r\nHello,\r\n\r\nthis is a   test.\r\n> quoted\r\n"
+	tc.client.Append("inbox", nil, nil, []byte(msg))
+	tc.client.Select("inbox")
+
+	preview := "Hello, this is a test."
+	tc.transactf("ok", "fetch 1 preview")
+	tc.xuntagged(imapclient.UntaggedFetch{Seq: 1, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(1), imapclient.FetchPreview{Preview: &preview}}})
+	tc.transactf("ok", "fetch 1 preview (lazy)")
+	tc.xuntagged(imapclient.UntaggedFetch{Seq: 1, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(1), imapclient.FetchPreview{Preview: &preview}}})
+	tc.transactf("bad", "fetch 1 preview (bogus)")
+}
@@ -2,7 +2,9 @@ package imapserver
 
 import (
 	"fmt"
+	"math"
 	"time"
+	"unicode/utf8"
 
 	"github.com/mjl-/mox/store"
 )
@@ -80,6 +82,32 @@ func (ss numSet) containsUID(uid store.UID, uids []store.UID, searchResult []sto
 	return false
 }
 
+// containsKnownUID returns whether uid is in the set, for UID sets from
+// clients that can include UIDs of expunged messages, such as the known UIDs of
+// QRESYNC. A star matches the largest possible UID.
+func (ss numSet) containsKnownUID(uid store.UID) bool {
+	for _, r := range ss.ranges {
+		first := store.UID(r.first.number)
+		if r.first.star {
+			first = math.MaxUint32
+		}
+		last := first
+		if r.last != nil {
+			last = store.UID(r.last.number)
+			if r.last.star {
+				last = math.MaxUint32
+			}
+		}
+		if first > last {
+			first, last = last, first
+		}
+		if uid >= first && uid <= last {
+			return true
+		}
+	}
+	return false
+}
+
 func (ss numSet) String() string {
 	if ss.searchResult {
 		return "$"
@@ -152,6 +180,33 @@ type fetchAtt struct {
 	section       *sectionSpec
 	sectionBinary []uint32
 	partial       *partial
+	previewLazy   bool // For PREVIEW, whether NIL may be returned if no preview is available yet.
+
+	annotationEntries []string // For ANNOTATION, entry patterns.
+	annotationAttribs []string // For ANNOTATION, attribute patterns.
+}
+
+// qresyncParams are the parameters of QRESYNC in SELECT/EXAMINE. ../rfc/7162
+type qresyncParams struct {
+	uidValidity uint32
+	modseq      int64
+	knownUIDs   *numSet // Optional.
+}
+
+// notify holds the mailbox filters and events of a NOTIFY SET command. ../rfc/5465
+type notify struct {
+	groups []notifyGroup
+}
+
+type notifyGroup struct {
+	filter    string        // Upper case: SELECTED, SELECTED-DELAYED, INBOXES, PERSONAL, SUBSCRIBED, SUBTREE, SUBTREE-ONE or MAILBOXES.
+	mailboxes []string      // For SUBTREE, SUBTREE-ONE and MAILBOXES.
+	events    []notifyEvent // Empty for NONE.
+}
+
+type notifyEvent struct {
+	name      string     // Upper case, e.g. MESSAGENEW.
+	fetchAtts []fetchAtt // Optional, with MESSAGENEW for the selected mailbox.
 }
 
 type searchKey struct {
@@ -167,6 +222,80 @@ type searchKey struct {
 	searchKey   *searchKey
 	searchKey2  *searchKey
 	uidSet      numSet
+	modseq      int64 // For MODSEQ, as sent by client.
+
+	annotationEntry  string // For ANNOTATION, entry pattern.
+	annotationAttrib string // For ANNOTATION, attribute pattern.
+}
+
+// xcheckStrings fails with a syntax error if a search string in sk or one of
+// its nested keys is not valid UTF-8. Strings are matched against decoded text.
+// US-ASCII is a subset of UTF-8, and we are lenient with clients that send UTF-8
+// strings without specifying the charset.
+func (sk searchKey) xcheckStrings() {
+	if !utf8.ValidString(sk.astring) {
+		xsyntaxErrorf("search string %q not valid utf-8, only US-ASCII and UTF-8 supported", sk.astring)
+	}
+	for _, k := range sk.searchKeys {
+		k.xcheckStrings()
+	}
+	if sk.searchKey != nil {
+		sk.searchKey.xcheckStrings()
+	}
+	if sk.searchKey2 != nil {
+		sk.searchKey2.xcheckStrings()
+	}
+}
+
+// hasModseq returns whether sk or one of its nested keys is a MODSEQ key.
+func (sk searchKey) hasModseq() bool {
+	if sk.op == "MODSEQ" {
+		return true
+	}
+	for _, k := range sk.searchKeys {
+		if k.hasModseq() {
+			return true
+		}
+	}
+	if sk.searchKey != nil && sk.searchKey.hasModseq() {
+		return true
+	}
+	return sk.searchKey2 != nil && sk.searchKey2.hasModseq()
+}
+
+// hasSequenceSet returns whether sk or one of its nested keys is a sequence set
+// or references the saved search result, which only apply to the selected
+// mailbox.
+func (sk searchKey) hasSequenceSet() bool {
+	if sk.seqSet != nil || sk.op == "UID" && sk.uidSet.searchResult {
+		return true
+	}
+	for _, k := range sk.searchKeys {
+		if k.hasSequenceSet() {
+			return true
+		}
+	}
+	if sk.searchKey != nil && sk.searchKey.hasSequenceSet() {
+		return true
+	}
+	return sk.searchKey2 != nil && sk.searchKey2.hasSequenceSet()
+}
+
+// hasSearchResult returns whether sk or one of its nested keys references the
+// saved search result, "$".
+func (sk searchKey) hasSearchResult() bool {
+	if sk.seqSet != nil && sk.seqSet.searchResult || sk.op == "UID" && sk.uidSet.searchResult {
+		return true
+	}
+	for _, k := range sk.searchKeys {
+		if k.hasSearchResult() {
+			return true
+		}
+	}
+	if sk.searchKey != nil && sk.searchKey.hasSearchResult() {
+		return true
+	}
+	return sk.searchKey2 != nil && sk.searchKey2.hasSearchResult()
 }
 
 func compactUIDSet(l []store.UID) (r numSet) {
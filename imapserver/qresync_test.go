@@ -0,0 +1,92 @@
+package imapserver
+
+import (
+	"testing"
+
+	"github.com/mjl-/mox/imapclient"
+)
+
+func TestQresync(t *testing.T) {
+	defer mockUIDValidity()()
+	tc := start(t)
+	defer tc.close()
+
+	tc.client.Login("mjl@mox.example", "testtest")
+
+	// QRESYNC parameter for select requires QRESYNC to be enabled.
+	tc.transactf("bad", "select inbox (qresync (1 1))")
+
+	tc.transactf("ok", "enable QRESYNC")
+	tc.xuntagged(imapclient.UntaggedEnabled{"QRESYNC"})
+
+	// Messages with modseq 2, 3, 4.
+	tc.client.Append("inbox", nil, nil, []byte(exampleMsg))
+	tc.client.Append("inbox", nil, nil, []byte(exampleMsg))
+	tc.client.Append("inbox", nil, nil, []byte(exampleMsg))
+	tc.client.Select("inbox")
+
+	tc.transactf("ok", `store 2 +flags (\Seen)`)
+	tc.xuntagged(imapclient.UntaggedFetch{Seq: 2, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(2), imapclient.FetchFlags{`\Seen`}, imapclient.FetchModSeq(5)}})
+	tc.transactf("ok", `store 1 +flags.silent (\Deleted)`)
+
+	// With QRESYNC enabled, expunges are sent as VANISHED.
+	tc.transactf("ok", "expunge")
+	tc.xuntagged(imapclient.UntaggedVanished{UIDs: imapclient.NumSet{Ranges: []imapclient.NumRange{{First: 1}}}})
+
+	// VANISHED modifier reports expunged messages in the requested set.
+	tc.transactf("ok", "uid fetch 1:* flags (changedsince 4 vanished)")
+	tc.xuntagged(
+		imapclient.UntaggedVanished{Earlier: true, UIDs: imapclient.NumSet{Ranges: []imapclient.NumRange{{First: 1}}}},
+		imapclient.UntaggedFetch{Seq: 1, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(2), imapclient.FetchFlags{`\Seen`}, imapclient.FetchModSeq(5)}},
+	)
+	tc.transactf("ok", "uid fetch 2:* flags (changedsince 4 vanished)")
+	tc.xuntagged(imapclient.UntaggedFetch{Seq: 1, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(2), imapclient.FetchFlags{`\Seen`}, imapclient.FetchModSeq(5)}})
+	tc.transactf("ok", "uid fetch 1:* flags (changedsince 7 vanished)")
+	tc.xuntagged()
+
+	tc.transactf("bad", "fetch 1:* flags (changedsince 4 vanished)") // Only for UID FETCH.
+	tc.transactf("bad", "uid fetch 1:* flags (vanished)")            // Requires CHANGEDSINCE.
+
+	// Select with modseq of the client resynchronizes: vanished and changed messages.
+	tc.client.Unselect()
+	tc.transactf("ok", "select inbox (qresync (1 4))")
+	tc.xuntaggedCheck(false,
+		imapclient.UntaggedVanished{Earlier: true, UIDs: imapclient.NumSet{Ranges: []imapclient.NumRange{{First: 1}}}},
+		imapclient.UntaggedFetch{Seq: 1, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(2), imapclient.FetchFlags{`\Seen`}, imapclient.FetchModSeq(5)}},
+	)
+
+	// noResync checks that the last select did not return vanished or fetch responses.
+	noResync := func() {
+		t.Helper()
+		for _, u := range tc.lastUntagged {
+			switch u.(type) {
+			case imapclient.UntaggedVanished, imapclient.UntaggedFetch:
+				t.Fatalf("unexpected untagged response %#v", u)
+			}
+		}
+	}
+
+	// Only UIDs the client knows about.
+	tc.client.Unselect()
+	tc.transactf("ok", "select inbox (qresync (1 4 3:5))")
+	noResync()
+
+	tc.client.Unselect()
+	tc.transactf("ok", "select inbox (qresync (1 4 1:3 (1:2 1:2)))")
+	tc.xuntaggedCheck(false,
+		imapclient.UntaggedVanished{Earlier: true, UIDs: imapclient.NumSet{Ranges: []imapclient.NumRange{{First: 1}}}},
+		imapclient.UntaggedFetch{Seq: 1, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(2), imapclient.FetchFlags{`\Seen`}, imapclient.FetchModSeq(5)}},
+	)
+
+	// Different UIDVALIDITY, the client has to resynchronize fully.
+	tc.client.Unselect()
+	tc.transactf("ok", "select inbox (qresync (2 4))")
+	noResync()
+
+	// Up to date.
+	tc.client.Unselect()
+	tc.transactf("ok", "examine inbox (qresync (1 7))")
+	noResync()
+
+	tc.transactf("bad", "select inbox (qresync (1 0))")
+}
@@ -0,0 +1,109 @@
+package imapserver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mjl-/bstore"
+)
+
+// Each account has a single quota root, the empty string, covering all its
+// mailboxes.
+
+// xquotaLine returns a QUOTA response for the quota root of the account. Only
+// resources with a limit are included. STORAGE is in units of 1024 bytes,
+// rounded up. ../rfc/9208 section 5.1
+func (c *conn) xquotaLine(tx *bstore.Tx) string {
+	q, err := c.account.Quota(tx)
+	xcheckf(err, "get quota")
+	var l []string
+	if q.MaxMessageSize > 0 {
+		l = append(l, fmt.Sprintf("STORAGE %d %d", (q.MessageSize+1023)/1024, q.MaxMessageSize/1024))
+	}
+	if q.MaxMessageCount > 0 {
+		l = append(l, fmt.Sprintf("MESSAGE %d %d", q.MessageCount, q.MaxMessageCount))
+	}
+	return fmt.Sprintf(`* QUOTA "" (%s)`, strings.Join(l, " "))
+}
+
+// Getquotaroot returns the quota roots of a mailbox, and the quota of each
+// root.
+//
+// State: Authenticated and selected.
+func (c *conn) cmdGetquotaroot(tag, cmd string, p *parser) {
+	// Command: ../rfc/9208 section 4.3
+	// Request syntax: ../rfc/9208 section 9
+
+	p.xspace()
+	name := p.xmailbox()
+	p.xempty()
+
+	name = xcheckmailboxname(name, true)
+
+	var line string
+	c.account.WithRLock(func() {
+		c.xdbread(func(tx *bstore.Tx) {
+			c.xmailbox(tx, name, "NONEXISTENT")
+			line = c.xquotaLine(tx)
+		})
+	})
+
+	c.bwritelinef(`* QUOTAROOT %s ""`, astring(name).pack(c))
+	c.bwritelinef("%s", line)
+	c.ok(tag, cmd)
+}
+
+// Getquota returns the usage and limits of a quota root. Only the empty root
+// exists.
+//
+// State: Authenticated and selected.
+func (c *conn) cmdGetquota(tag, cmd string, p *parser) {
+	// Command: ../rfc/9208 section 4.2
+	// Request syntax: ../rfc/9208 section 9
+
+	p.xspace()
+	root := p.xastring()
+	p.xempty()
+
+	if root != "" {
+		xusercodeErrorf("NONEXISTENT", "unknown quota root")
+	}
+
+	var line string
+	c.account.WithRLock(func() {
+		c.xdbread(func(tx *bstore.Tx) {
+			line = c.xquotaLine(tx)
+		})
+	})
+
+	c.bwritelinef("%s", line)
+	c.ok(tag, cmd)
+}
+
+// Setquota would change the limits of a quota root. Quota are set by the
+// administrator in the account configuration, so this always fails.
+//
+// State: Authenticated and selected.
+func (c *conn) cmdSetquota(tag, cmd string, p *parser) {
+	// Command: ../rfc/9208 section 4.4
+	// Request syntax: ../rfc/9208 section 9
+
+	p.xspace()
+	p.xastring()
+	p.xspace()
+	p.xtake("(")
+	if !p.take(")") {
+		for {
+			p.xatom()
+			p.xspace()
+			p.xnumber64()
+			if !p.take(" ") {
+				break
+			}
+		}
+		p.xtake(")")
+	}
+	p.xempty()
+
+	xusercodeErrorf("NOPERM", "quota are set in the account configuration")
+}
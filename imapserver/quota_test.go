@@ -0,0 +1,67 @@
+package imapserver
+
+import (
+	"testing"
+
+	"github.com/mjl-/mox/imapclient"
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestQuota(t *testing.T) {
+	tc := start(t)
+	defer tc.close()
+
+	accConf := mox.Conf.Dynamic.Accounts["mjl"]
+	nc := accConf
+	nc.QuotaMessageCount = 2
+	nc.QuotaMessageSize = 10 * 1024
+	mox.Conf.Dynamic.Accounts["mjl"] = nc
+	defer func() {
+		mox.Conf.Dynamic.Accounts["mjl"] = accConf
+	}()
+
+	tc.client.Login("mjl@mox.example", "testtest")
+
+	tc.transactf("ok", `getquotaroot inbox`)
+	tc.xuntagged(
+		imapclient.UntaggedQuotaroot{Mailbox: "Inbox", Roots: []string{""}},
+		imapclient.UntaggedQuota{Root: "", Resources: []imapclient.QuotaResource{{Name: "STORAGE", Usage: 0, Limit: 10}, {Name: "MESSAGE", Usage: 0, Limit: 2}}},
+	)
+
+	tc.client.Append("inbox", nil, nil, []byte(exampleMsg))
+	tc.transactf("ok", `getquota ""`)
+	tc.xuntagged(imapclient.UntaggedQuota{Root: "", Resources: []imapclient.QuotaResource{{Name: "STORAGE", Usage: 1, Limit: 10}, {Name: "MESSAGE", Usage: 1, Limit: 2}}})
+
+	tc.transactf("no", `getquota other`)
+	tc.xcode("NONEXISTENT")
+	tc.transactf("no", `getquotaroot nonexistent`)
+	tc.xcode("NONEXISTENT")
+
+	// Quota are set in the configuration, not by clients.
+	tc.transactf("no", `setquota "" (STORAGE 100)`)
+	tc.xcode("NOPERM")
+	tc.transactf("bad", `setquota "" (STORAGE)`)
+
+	// Reaching the message count limit.
+	tc.client.Create("a")
+	tc.client.Select("inbox")
+	tc.transactf("ok", `copy 1 a`)
+	tc.transactf("no", `copy 1 a`)
+	tc.xcode("OVERQUOTA")
+	tc.transactf("no", "append inbox {1+}\r\nx")
+	tc.xcode("OVERQUOTA")
+
+	// Expunging makes room again.
+	tc.transactf("ok", `store 1 +flags.silent (\Deleted)`)
+	tc.transactf("ok", `status inbox (deleted deleted-storage)`)
+	tc.xuntagged(imapclient.UntaggedStatus{Mailbox: "Inbox", Attrs: map[string]int64{"DELETED": 1, "DELETED-STORAGE": 1}})
+	tc.transactf("ok", `expunge`)
+	tc.transactf("ok", `getquota ""`)
+	tc.xuntagged(imapclient.UntaggedQuota{Root: "", Resources: []imapclient.QuotaResource{{Name: "STORAGE", Usage: 1, Limit: 10}, {Name: "MESSAGE", Usage: 1, Limit: 2}}})
+	tc.transactf("ok", "append inbox {1+}\r\nx")
+
+	// Without limits, no resources are listed.
+	mox.Conf.Dynamic.Accounts["mjl"] = accConf
+	tc.transactf("ok", `getquota ""`)
+	tc.xuntagged(imapclient.UntaggedQuota{Root: ""})
+}
@@ -32,9 +32,10 @@ func TestRename(t *testing.T) {
 	tc.client.Subscribe("x/y/c") // For later rename, but not affected by rename of x.
 	tc2.transactf("ok", "noop")  // Drain.
 
+	// The subscription moves along with the mailbox.
 	tc.transactf("ok", "rename x y")
 	tc2.transactf("ok", "noop")
-	tc2.xuntagged(imapclient.UntaggedList{Separator: '/', Mailbox: "y", OldName: "x"})
+	tc2.xuntagged(imapclient.UntaggedList{Flags: []string{`\Subscribed`}, Separator: '/', Mailbox: "y", OldName: "x"})
 
 	// Rename to a mailbox that only exists in database as subscribed.
 	tc.transactf("ok", "rename y sub")
@@ -50,21 +51,24 @@ func TestRename(t *testing.T) {
 	tc2.transactf("ok", "noop")          // Drain.
 	tc.transactf("ok", "rename a/b x/y") // This will cause new parent "x" to be created, and a/b and a/b/c to be renamed.
 	tc2.transactf("ok", "noop")
-	tc2.xuntagged(imapclient.UntaggedList{Flags: []string{`\Subscribed`}, Separator: '/', Mailbox: "x"}, imapclient.UntaggedList{Separator: '/', Mailbox: "x/y", OldName: "a/b"}, imapclient.UntaggedList{Flags: []string{`\Subscribed`}, Separator: '/', Mailbox: "x/y/c", OldName: "a/b/c"})
+	tc2.xuntagged(imapclient.UntaggedList{Flags: []string{`\Subscribed`}, Separator: '/', Mailbox: "x"}, imapclient.UntaggedList{Flags: []string{`\Subscribed`}, Separator: '/', Mailbox: "x/y", OldName: "a/b"}, imapclient.UntaggedList{Flags: []string{`\Subscribed`}, Separator: '/', Mailbox: "x/y/c", OldName: "a/b/c"})
 
 	tc.client.Create("k/l")
-	tc.transactf("ok", "rename k/l k/l/m") // With "l" renamed, a new "k" will be created.
+	tc2.transactf("ok", "noop")            // Drain.
+	tc.transactf("ok", "rename k/l k/l/m") // With "l" renamed, a new "k/l" will be created, and announced.
+	tc2.transactf("ok", "noop")
+	tc2.xuntagged(imapclient.UntaggedList{Flags: []string{`\Subscribed`}, Separator: '/', Mailbox: "k/l/m", OldName: "k/l"}, imapclient.UntaggedList{Separator: '/', Mailbox: "k/l"})
 	tc.transactf("ok", `list "" "k*" return (subscribed)`)
-	tc.xuntagged(imapclient.UntaggedList{Flags: []string{`\Subscribed`}, Separator: '/', Mailbox: "k"}, imapclient.UntaggedList{Flags: []string{`\Subscribed`}, Separator: '/', Mailbox: "k/l"}, imapclient.UntaggedList{Separator: '/', Mailbox: "k/l/m"})
+	tc.xuntagged(imapclient.UntaggedList{Flags: []string{`\Subscribed`}, Separator: '/', Mailbox: "k"}, imapclient.UntaggedList{Separator: '/', Mailbox: "k/l"}, imapclient.UntaggedList{Flags: []string{`\Subscribed`}, Separator: '/', Mailbox: "k/l/m"})
 
 	// Similar, but with missing parent not subscribed.
 	tc.transactf("ok", "rename k/l/m k/ll")
 	tc.transactf("ok", "delete k/l")
 	tc.transactf("ok", "rename k/ll k/l") // Restored to previous mailboxes now.
 	tc.client.Unsubscribe("k")
-	tc.transactf("ok", "rename k/l k/l/m") // With "l" renamed, a new "k" will be created.
+	tc.transactf("ok", "rename k/l k/l/m") // With "l" renamed, a new "k/l" will be created.
 	tc.transactf("ok", `list "" "k*" return (subscribed)`)
-	tc.xuntagged(imapclient.UntaggedList{Separator: '/', Mailbox: "k"}, imapclient.UntaggedList{Flags: []string{"\\Subscribed"}, Separator: '/', Mailbox: "k/l"}, imapclient.UntaggedList{Separator: '/', Mailbox: "k/l/m"})
+	tc.xuntagged(imapclient.UntaggedList{Separator: '/', Mailbox: "k"}, imapclient.UntaggedList{Separator: '/', Mailbox: "k/l"}, imapclient.UntaggedList{Flags: []string{"\\Subscribed"}, Separator: '/', Mailbox: "k/l/m"})
 
 	// Renaming inbox keeps inbox in existence, moves messages, and does not rename children.
 	tc.transactf("ok", "create inbox/a")
@@ -87,5 +91,15 @@ func TestRename(t *testing.T) {
 	tc.transactf("ok", `list "" "w*"`)
 	tc.xuntagged(imapclient.UntaggedList{Separator: '/', Mailbox: "w"}, imapclient.UntaggedList{Separator: '/', Mailbox: "w/w"})
 
+	// Special-use attributes are announced under the new name. A session with the
+	// renamed mailbox selected keeps its messages.
+	tc2.client.Append("Archive", nil, nil, []byte(exampleMsg))
+	tc2.client.Select("Archive")
+	tc.transactf("ok", "rename Archive Archived")
+	tc2.transactf("ok", "noop")
+	tc2.xuntagged(imapclient.UntaggedList{Flags: []string{`\Subscribed`, `\Archive`}, Separator: '/', Mailbox: "Archived", OldName: "Archive"})
+	tc2.transactf("ok", "uid fetch 1 flags")
+	tc2.xuntagged(imapclient.UntaggedFetch{Seq: 1, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(1), imapclient.FetchFlags(nil)}})
+
 	// todo: test create+delete+rename of/to a name results in a higher uidvalidity.
 }
@@ -0,0 +1,233 @@
+package imapserver
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/store"
+)
+
+// REPLACE appends a new message and expunges an existing message from the
+// selected mailbox in a single transaction. Clients use it to update a draft,
+// without leaving duplicates or losing the message when the connection breaks
+// between the APPEND and EXPUNGE. ../rfc/8508
+
+// Replace replaces a message by sequence number.
+//
+// State: Selected
+func (c *conn) cmdReplace(tag, cmd string, p *parser) {
+	c.cmdxReplace(false, tag, cmd, p)
+}
+
+// UID replace replaces a message by UID.
+//
+// State: Selected
+func (c *conn) cmdUIDReplace(tag, cmd string, p *parser) {
+	c.cmdxReplace(true, tag, cmd, p)
+}
+
+// Replace adds a message to a mailbox, and removes a message from the selected
+// mailbox.
+//
+// State: Selected
+func (c *conn) cmdxReplace(isUID bool, tag, cmd string, p *parser) {
+	// Command: ../rfc/8508 section 3
+
+	// Request syntax: ../rfc/8508 section 6
+	p.xspace()
+	num := p.xnznumber()
+	p.xspace()
+	name := p.xmailbox()
+	p.xspace()
+
+	a := &appendMsg{}
+	defer a.xremove(c)
+
+	// The message to replace and the destination are checked before the message is
+	// read. With a non-synchronizing literal, errors can only be returned after the
+	// message has been read.
+	var uid store.UID
+	var checked bool
+	check := func() {
+		checked = true
+		if isUID {
+			uid = store.UID(num)
+			if uidSearch(c.uids, uid) <= 0 {
+				xuserErrorf("unknown uid %d", num)
+			}
+		} else {
+			if int(num) > len(c.uids) {
+				xsyntaxErrorf("invalid msgseq %d", num)
+			}
+			uid = c.uids[num-1]
+		}
+		if c.readonly {
+			xuserErrorf("mailbox open in read-only mode")
+		}
+		// Replacing is appending and expunging. ../rfc/8508 section 3.2
+		c.xneedRight('t')
+		c.xneedRight('e')
+		name = c.xcopyDestination(name)
+		c.xdbread(func(tx *bstore.Tx) {
+			c.xmailbox(tx, name, "TRYCREATE")
+		})
+	}
+	var badURL string
+	var urlErr error
+	maxSize := mox.Conf.MessageSizeLimit(c.account.Name)
+	p, badURL, urlErr = c.xreadAppendMessage(p, a, maxSize, func(sync bool) {
+		if sync {
+			check()
+		}
+	})
+	p.xempty()
+	if !checked {
+		check()
+	}
+	if badURL != "" {
+		// ../rfc/4469 section 6
+		xusercodeErrorf("BADURL "+strings.ReplaceAll(badURL, "]", "%5D"), "%s", urlErr)
+	}
+	xcheckAppendSize(a, maxSize)
+
+	// File that was delivered. Removed if the transaction fails.
+	var createdID int64
+	defer func() {
+		x := recover()
+		if x == nil {
+			return
+		}
+		if createdID != 0 {
+			p := c.account.MessagePath(createdID)
+			err := os.Remove(p)
+			c.xsanity(err, "cleaning up delivered file")
+		}
+		panic(x)
+	}()
+
+	var mbDst store.Mailbox
+	var m store.Message
+	var removeID int64 // Of replaced message, its file is removed after the transaction.
+	var pendingChanges []store.Change
+
+	c.account.WithWLock(func() {
+		var changes []store.Change
+		c.xdbwrite(func(tx *bstore.Tx) {
+			c.xmailboxID(tx, c.mailboxID) // Validate.
+			mbDst = c.xmailbox(tx, name, "TRYCREATE")
+
+			om := store.Message{MailboxID: c.mailboxID, UID: uid}
+			q := bstore.QueryTx[store.Message](tx)
+			q.FilterNonzero(om)
+			om, err := q.Get()
+			if err == bstore.ErrAbsent {
+				xuserErrorf("message to replace is gone")
+			}
+			xcheckf(err, "looking up message to replace")
+
+			if c.account.OnHold() {
+				xusercodeErrorf("CANNOT", "%s", store.ErrHold)
+			}
+
+			// Only the difference in size is added to the quota, the number of messages
+			// stays the same. OVERQUOTA response code from ../rfc/9208
+			size := a.size + int64(len(a.msgPrefix))
+			if err := c.account.CheckDomainStorage(context.TODO(), c.log, size-om.Size); errors.Is(err, store.ErrDomainStorage) {
+				xusercodeErrorf("OVERQUOTA", "%s", err)
+			} else {
+				xcheckf(err, "checking storage limit of domain")
+			}
+			if err := c.account.CheckQuota(tx, 0, size-om.Size); errors.Is(err, store.ErrOverQuota) {
+				xusercodeErrorf("OVERQUOTA", "%s", err)
+			} else {
+				xcheckf(err, "checking quota")
+			}
+
+			// Ensure keywords are stored in mailbox.
+			var changed bool
+			mbDst.Keywords, changed = store.MergeKeywords(mbDst.Keywords, a.keywords)
+			if changed {
+				err := tx.Update(&mbDst)
+				xcheckf(err, "updating keywords in mailbox")
+			}
+
+			// The new message and the expunge get the same modseq.
+			modseq, err := c.account.NextModSeq(tx)
+			xcheckf(err, "assigning modseq")
+
+			m = store.Message{
+				MailboxID:     mbDst.ID,
+				MailboxOrigID: mbDst.ID,
+				Received:      a.tm,
+				Flags:         a.storeFlags,
+				Keywords:      a.keywords,
+				Size:          a.size,
+				MsgPrefix:     a.msgPrefix,
+				ModSeq:        modseq,
+			}
+			err = c.account.DeliverMessage(c.log, tx, &m, a.file, true, mbDst.Sent, true, false)
+			xcheckf(err, "delivering message")
+			createdID = m.ID
+
+			// The temporary file has been moved into place.
+			err = a.file.Close()
+			c.log.Check(err, "closing appended file")
+			a.file = nil
+
+			// Remove the original message, like an expunge.
+			_, err = bstore.QueryTx[store.Recipient](tx).FilterNonzero(store.Recipient{MessageID: om.ID}).Delete()
+			xcheckf(err, "removing message recipients")
+			err = store.TextIndexRemove(tx, []int64{om.ID})
+			xcheckf(err, "removing message from full-text index")
+			err = tx.Delete(&om)
+			xcheckf(err, "removing replaced message")
+			err = c.account.AddMessageUsage(tx, -1, -om.Size)
+			xcheckf(err, "updating disk usage")
+			err = store.MailboxCountsRemove(tx, om)
+			xcheckf(err, "updating mailbox counts")
+			om.Junk = false
+			om.Notjunk = false
+			err = c.account.RetrainMessages(context.TODO(), c.log, tx, []store.Message{om}, true)
+			xcheckf(err, "untraining replaced message")
+			err = c.account.RecordExpunged(tx, c.mailboxID, []store.UID{uid}, modseq)
+			xcheckf(err, "recording expunged message")
+			err = c.account.RecordRemoved(tx, []store.Message{om}, modseq)
+			xcheckf(err, "recording removed message")
+			removeID = om.ID
+
+			changes = []store.Change{
+				store.ChangeAddUID{MailboxID: mbDst.ID, UID: m.UID, ModSeq: m.ModSeq, Flags: m.Flags, Keywords: m.Keywords},
+				store.ChangeRemoveUIDs{MailboxID: c.mailboxID, UIDs: []store.UID{uid}, ModSeq: modseq},
+			}
+		})
+
+		// Fetch pending changes, possibly with new UIDs, so we can apply them before adding our own new UID.
+		pendingChanges = c.comm.Get()
+
+		c.broadcast(changes)
+	})
+
+	createdID = 0
+
+	defer func() {
+		p := c.account.MessagePath(removeID)
+		err := os.Remove(p)
+		c.xsanity(err, "removing message file of replaced message")
+	}()
+
+	// ../rfc/8508 section 3.3
+	c.bwritelinef("* OK [APPENDUID %d %d] replacement message appended", mbDst.UIDValidity, m.UID)
+	c.applyChanges(pendingChanges, false)
+	if mbDst.ID == c.mailboxID {
+		c.uidAppend(m.UID)
+		c.bwritelinef("* %d EXISTS", len(c.uids))
+	}
+	c.xwriteExpunged([]store.UID{uid})
+
+	c.ok(tag, cmd)
+}
@@ -0,0 +1,74 @@
+package imapserver
+
+import (
+	"testing"
+
+	"github.com/mjl-/mox/imapclient"
+)
+
+func TestReplace(t *testing.T) {
+	defer mockUIDValidity()()
+	tc := start(t)
+	defer tc.close()
+
+	tc2 := startNoSwitchboard(t)
+	defer tc2.close()
+
+	tc.client.Login("mjl@mox.example", "testtest")
+	tc.client.Select("inbox")
+
+	tc2.client.Login("mjl@mox.example", "testtest")
+	tc2.client.Select("inbox")
+
+	tc.transactf("bad", "replace")                // Missing params.
+	tc.transactf("bad", "replace 1")              // Missing params.
+	tc.transactf("bad", "replace 1 inbox")        // Missing message.
+	tc.transactf("bad", "replace 1 inbox {1}")    // Invalid msgseq, before continuation.
+	tc.transactf("no", "uid replace 1 inbox {1}") // Unknown uid.
+
+	// UIDs 1 and 2.
+	tc.client.Append("inbox", nil, nil, []byte(exampleMsg))
+	tc.client.Append("inbox", nil, nil, []byte(exampleMsg))
+	tc2.transactf("ok", "noop") // Drain.
+
+	tc.client.Unselect()
+	tc.client.Examine("inbox")
+	tc.transactf("no", "replace 1 inbox {1}") // Opened readonly.
+	tc.client.Unselect()
+	tc.client.Select("inbox")
+
+	tc.transactf("no", "replace 1 nonexistent {1}")
+	tc.xcode("TRYCREATE")
+
+	// Replace in the same mailbox, the new message is announced, then the old one is expunged.
+	var err error
+	tc.lastUntagged, tc.lastResult, err = tc.client.Replace(1, "inbox", []string{`\Draft`}, nil, []byte(exampleMsg))
+	tcheck(t, err, "replace")
+	tc.xuntagged(
+		imapclient.UntaggedResult{Status: "OK", RespText: imapclient.RespText{Code: "APPENDUID", CodeArg: imapclient.CodeAppendUID{UIDValidity: 1, UID: 3}, More: "replacement message appended"}},
+		imapclient.UntaggedExists(3),
+		imapclient.UntaggedExpunge(1),
+	)
+	tc2.transactf("ok", "noop")
+	tc2.xuntagged(
+		imapclient.UntaggedExists(3),
+		imapclient.UntaggedFetch{Seq: 3, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(3), imapclient.FetchFlags{`\Draft`}}},
+		imapclient.UntaggedExpunge(1),
+	)
+
+	// Replace into another mailbox, with QRESYNC.
+	tc.transactf("ok", "enable qresync")
+	tc.lastUntagged, tc.lastResult, err = tc.client.UIDReplace(2, "Drafts", nil, nil, []byte(exampleMsg))
+	tcheck(t, err, "uid replace")
+	tc.xuntagged(
+		imapclient.UntaggedResult{Status: "OK", RespText: imapclient.RespText{Code: "APPENDUID", CodeArg: imapclient.CodeAppendUID{UIDValidity: 1, UID: 1}, More: "replacement message appended"}},
+		imapclient.UntaggedVanished{UIDs: imapclient.NumSet{Ranges: []imapclient.NumRange{{First: 2}}}},
+	)
+	tc.transactf("ok", "status inbox (messages)")
+	tc.xuntagged(imapclient.UntaggedStatus{Mailbox: "Inbox", Attrs: map[string]int64{"MESSAGES": 1}})
+	tc.transactf("ok", "status Drafts (messages)")
+	tc.xuntagged(imapclient.UntaggedStatus{Mailbox: "Drafts", Attrs: map[string]int64{"MESSAGES": 1}})
+
+	// Replaced message is gone.
+	tc.transactf("no", "uid replace 2 inbox {1}")
+}
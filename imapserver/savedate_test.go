@@ -0,0 +1,48 @@
+package imapserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mjl-/mox/imapclient"
+)
+
+func TestSaveDate(t *testing.T) {
+	defer mockUIDValidity()()
+	tc := start(t)
+	defer tc.close()
+
+	tc.client.Login("mjl@mox.example", "testtest")
+
+	// Internal date far in the past, the save date is the time of the append.
+	tc.transactf("ok", `append inbox "01-Jan-2000 12:00:00 +0000" {%d+}`+"\r\n%s", len(exampleMsg), exampleMsg)
+	tc.client.Select("inbox")
+
+	tc.transactf("ok", "fetch 1 savedate")
+	if len(tc.lastUntagged) != 1 {
+		t.Fatalf("got %v, expected single untagged fetch", tc.lastUntagged)
+	}
+	var fetch imapclient.UntaggedFetch
+	tuntagged(t, tc.lastUntagged[0], &fetch)
+	if len(fetch.Attrs) != 2 {
+		t.Fatalf("got attributes %v, expected uid and savedate", fetch.Attrs)
+	}
+	if sd, ok := fetch.Attrs[1].(imapclient.FetchSaveDate); !ok || sd == "" {
+		t.Fatalf("got %#v, expected savedate", fetch.Attrs[1])
+	}
+
+	today := time.Now().Format("2-Jan-2006")
+	tc.transactf("ok", "search savedon %s", today)
+	tc.xsearch(1)
+	tc.transactf("ok", "search savedsince %s", today)
+	tc.xsearch(1)
+	tc.transactf("ok", "search savedbefore %s", today)
+	tc.xsearch()
+	tc.transactf("ok", "search savedbefore 1-Jan-2001")
+	tc.xsearch()
+	tc.transactf("ok", "search before 1-Jan-2001")
+	tc.xsearch(1)
+	tc.transactf("ok", "search savedatesupported")
+	tc.xsearch(1)
+	tc.transactf("bad", "search savedon") // Missing date.
+}
@@ -37,7 +37,7 @@ func (c *conn) cmdxSearch(isUID bool, tag, cmd string, p *parser) {
 			if len(eargs) > 0 || save {
 				p.xspace()
 			}
-			if w, ok := p.takelist("MIN", "MAX", "ALL", "COUNT", "SAVE"); ok {
+			if w, ok := p.takelist("MIN", "MAX", "ALL", "COUNT", "SAVE", "RELEVANCY"); ok {
 				if w == "SAVE" {
 					save = true
 				} else {
@@ -54,14 +54,23 @@ func (c *conn) cmdxSearch(isUID bool, tag, cmd string, p *parser) {
 		eargs["ALL"] = true
 	}
 
+	if save {
+		// If the command fails, e.g. due to a syntax error in the search criteria, the
+		// saved result is emptied. The previous result must remain available for "$" in
+		// the criteria of this command, so we only clear it on failure, and replace it
+		// below on success. ../rfc/5182
+		defer func() {
+			if x := recover(); x != nil {
+				c.searchResult = []store.UID{}
+				panic(x)
+			}
+		}()
+	}
+
 	// If UTF8=ACCEPT is enabled, we should not accept any charset. We are a bit more
 	// relaxed (reasonable?) and still allow US-ASCII and UTF-8. ../rfc/6855:198
 	if p.take(" CHARSET ") {
-		charset := strings.ToUpper(p.xastring())
-		if charset != "US-ASCII" && charset != "UTF-8" {
-			// ../rfc/3501:2771 ../rfc/9051:3836
-			xusercodeErrorf("BADCHARSET", "only US-ASCII and UTF-8 supported")
-		}
+		xsearchCharset(p)
 	}
 	p.xspace()
 	sk := &searchKey{
@@ -71,11 +80,7 @@ func (c *conn) cmdxSearch(isUID bool, tag, cmd string, p *parser) {
 		p.xspace()
 		sk.searchKeys = append(sk.searchKeys, *p.xsearchKey())
 	}
-
-	// Even in case of error, we ensure search result is changed.
-	if save {
-		c.searchResult = []store.UID{}
-	}
+	sk.xcheckStrings()
 
 	// Note: we only hold the account rlock for verifying the mailbox at the start.
 	c.account.RLock()
@@ -97,27 +102,63 @@ func (c *conn) cmdxSearch(isUID bool, tag, cmd string, p *parser) {
 
 	var expungeIssued bool
 
+	// For a search with MODSEQ, we return the highest modseq of the matching
+	// messages. ../rfc/7162
+	searchModseq := sk.hasModseq()
+	var highestModSeq store.ModSeq
+
 	var uids []store.UID
+	var relevancies []int // For RELEVANCY, for each of uids. ../rfc/6203
 	c.xdbread(func(tx *bstore.Tx) {
 		c.xmailboxID(tx, c.mailboxID) // Validate.
 		runlock()
 		runlock = func() {}
 
+		if searchModseq {
+			c.xensureCondstore(tx)
+		}
+
+		// A repeated search can reuse the previous result if nothing changed.
+		modseq := c.xhighestModSeq(tx)
+		var cached bool
+		uids, relevancies, cached = c.searchCacheGet(sk, modseq)
+		if cached && len(eargs) > 0 && min+max == len(eargs) && len(uids) > 1 {
+			// Only MIN and/or MAX requested, keep the same matches as the searches below,
+			// also for SAVE. ../rfc/5182 section 2.1
+			n := len(uids) - 1
+			switch {
+			case min == 1 && max == 1:
+				uids, relevancies = []store.UID{uids[0], uids[n]}, []int{relevancies[0], relevancies[n]}
+			case min == 1:
+				uids, relevancies = uids[:1], relevancies[:1]
+			default:
+				uids, relevancies = uids[n:], relevancies[n:]
+			}
+		}
+
 		// Normal forward search when we don't have MAX only.
 		var lastIndex = -1
-		if eargs == nil || max == 0 || len(eargs) != 1 {
+		if !cached && (eargs == nil || max == 0 || len(eargs) != 1) {
+			complete := true
 			for i, uid := range c.uids {
 				lastIndex = i
-				if c.searchMatch(tx, msgseq(i+1), uid, *sk, &expungeIssued) {
+				if match, relevancy := c.searchMatchRelevancy(tx, c.mailboxID, c.uids, msgseq(i+1), uid, *sk, &expungeIssued); match {
 					uids = append(uids, uid)
+					relevancies = append(relevancies, relevancy)
 					if min == 1 && min+max == len(eargs) {
+						complete = false
 						break
 					}
 				}
 			}
+			// If messages were expunged by another session, the result differs from what
+			// the database says, and must be evaluated again.
+			if complete && !expungeIssued {
+				c.searchCachePut(sk, modseq, uids, relevancies)
+			}
 		}
 		// And reverse search for MAX if we have only MAX or MAX combined with MIN.
-		if max == 1 && (len(eargs) == 1 || min+max == len(eargs)) {
+		if !cached && max == 1 && (len(eargs) == 1 || min+max == len(eargs)) {
 			for i := len(c.uids) - 1; i > lastIndex; i-- {
 				if c.searchMatch(tx, msgseq(i+1), c.uids[i], *sk, &expungeIssued) {
 					uids = append(uids, c.uids[i])
@@ -125,6 +166,23 @@ func (c *conn) cmdxSearch(isUID bool, tag, cmd string, p *parser) {
 				}
 			}
 		}
+
+		if searchModseq && len(uids) > 0 {
+			uidargs := make([]any, len(uids))
+			for i, uid := range uids {
+				uidargs[i] = uid
+			}
+			q := bstore.QueryTx[store.Message](tx)
+			q.FilterNonzero(store.Message{MailboxID: c.mailboxID})
+			q.FilterEqual("UID", uidargs...)
+			err := q.ForEach(func(m store.Message) error {
+				if m.ModSeq.Client() > highestModSeq.Client() {
+					highestModSeq = m.ModSeq
+				}
+				return nil
+			})
+			xcheckf(err, "looking up highest modseq of matching messages")
+		}
 	})
 
 	if eargs == nil {
@@ -143,6 +201,9 @@ func (c *conn) cmdxSearch(isUID bool, tag, cmd string, p *parser) {
 				s += " " + fmt.Sprintf("%d", v)
 			}
 			uids = uids[n:]
+			if searchModseq && len(uids) == 0 {
+				s += fmt.Sprintf(" (MODSEQ %d)", highestModSeq.Client())
+			}
 			c.bwritelinef("* SEARCH%s", s)
 		}
 	} else {
@@ -190,6 +251,13 @@ func (c *conn) cmdxSearch(isUID bool, tag, cmd string, p *parser) {
 			if eargs["ALL"] && len(uids) > 0 {
 				resp += fmt.Sprintf(" ALL %s", compactUIDSet(uids).String())
 			}
+			if eargs["RELEVANCY"] && len(uids) > 0 {
+				// Scores are in order of the matching messages, like ALL. ../rfc/6203
+				resp += " RELEVANCY (" + relevancyList(relevancies) + ")"
+			}
+			if searchModseq && len(uids) > 0 {
+				resp += fmt.Sprintf(" MODSEQ %d", highestModSeq.Client())
+			}
 			c.bwritelinef("%s", resp)
 		}
 	}
@@ -204,16 +272,33 @@ func (c *conn) cmdxSearch(isUID bool, tag, cmd string, p *parser) {
 type search struct {
 	c             *conn
 	tx            *bstore.Tx
+	mailboxID     int64
+	uids          []store.UID // Of the mailbox, for resolving "*" in UID sets.
 	seq           msgseq
 	uid           store.UID
 	mr            *store.MsgReader
 	m             store.Message
 	p             *message.Part
 	expungeIssued *bool
+	fuzzy         bool      // Whether in a FUZZY search key.
+	scores        []float64 // Of matched fuzzy search keys.
 }
 
 func (c *conn) searchMatch(tx *bstore.Tx, seq msgseq, uid store.UID, sk searchKey, expungeIssued *bool) bool {
-	s := search{c: c, tx: tx, seq: seq, uid: uid, expungeIssued: expungeIssued}
+	return c.searchMatchMailbox(tx, c.mailboxID, c.uids, seq, uid, sk, expungeIssued)
+}
+
+// searchMatchMailbox is like searchMatch, but for a message in any mailbox, with
+// uids the UIDs of the messages in the mailbox.
+func (c *conn) searchMatchMailbox(tx *bstore.Tx, mailboxID int64, uids []store.UID, seq msgseq, uid store.UID, sk searchKey, expungeIssued *bool) bool {
+	match, _ := c.searchMatchRelevancy(tx, mailboxID, uids, seq, uid, sk, expungeIssued)
+	return match
+}
+
+// searchMatchRelevancy is like searchMatchMailbox, but also returns the relevancy
+// score for a matching message, see search.relevancy.
+func (c *conn) searchMatchRelevancy(tx *bstore.Tx, mailboxID int64, uids []store.UID, seq msgseq, uid store.UID, sk searchKey, expungeIssued *bool) (bool, int) {
+	s := search{c: c, tx: tx, mailboxID: mailboxID, uids: uids, seq: seq, uid: uid, expungeIssued: expungeIssued}
 	defer func() {
 		if s.mr != nil {
 			err := s.mr.Close()
@@ -221,7 +306,10 @@ func (c *conn) searchMatch(tx *bstore.Tx, seq msgseq, uid store.UID, sk searchKe
 			s.mr = nil
 		}
 	}()
-	return s.match(sk)
+	if !s.match(sk) {
+		return false, 0
+	}
+	return true, s.relevancy()
 }
 
 func (s *search) match(sk searchKey) bool {
@@ -245,6 +333,9 @@ func (s *search) match(sk searchKey) bool {
 			c.log.Debugx("parsing message header", err, mlog.Field("uid", s.uid))
 			return false
 		}
+		if s.fuzzy {
+			return s.fuzzyMatch(strings.ToLower(strings.Join(h.Values(field), "\n")), value)
+		}
 		for _, v := range h.Values(field) {
 			if strings.Contains(strings.ToLower(v), lower) {
 				return true
@@ -268,17 +359,31 @@ func (s *search) match(sk searchKey) bool {
 		// We do not implement the RECENT flag. All messages are not recent.
 		return false
 	case "NOT":
-		return !s.match(*sk.searchKey)
+		// Scores of fuzzy keys in a negated key don't count.
+		n := len(s.scores)
+		r := !s.match(*sk.searchKey)
+		s.scores = s.scores[:n]
+		return r
+	case "FUZZY":
+		// ../rfc/6203
+		prev := s.fuzzy
+		s.fuzzy = true
+		r := s.match(*sk.searchKey)
+		s.fuzzy = prev
+		return r
 	case "OR":
 		return s.match(*sk.searchKey) || s.match(*sk.searchKey2)
+	case "SAVEDATESUPPORTED":
+		// All our mailboxes store the save date. ../rfc/8514
+		return true
 	case "UID":
-		return sk.uidSet.containsUID(s.uid, c.uids, c.searchResult)
+		return sk.uidSet.containsUID(s.uid, s.uids, c.searchResult)
 	}
 
 	// Parsed message.
 	if s.mr == nil {
 		q := bstore.QueryTx[store.Message](s.tx)
-		q.FilterNonzero(store.Message{MailboxID: c.mailboxID, UID: s.uid})
+		q.FilterNonzero(store.Message{MailboxID: s.mailboxID, UID: s.uid})
 		m, err := q.Get()
 		if err == bstore.ErrAbsent {
 			// ../rfc/2180:607
@@ -302,6 +407,20 @@ func (s *search) match(sk searchKey) bool {
 
 	// Parsed message, basic info.
 	switch sk.op {
+	case "BODY", "TEXT":
+		if !s.fuzzy {
+			if match, ok := c.textIndexMatch(s.tx, s.m.ID, sk.astring, sk.op == "TEXT"); ok {
+				return match
+			}
+		}
+	case "MODSEQ":
+		return s.m.ModSeq.Client() >= sk.modseq
+	case "EMAILID":
+		return s.m.EmailObjectID() == sk.atom
+	case "THREADID":
+		return s.m.ThreadObjectID() == sk.atom
+	case "ANNOTATION":
+		return c.annotationSearchMatch(s.m, sk)
 	case "ANSWERED":
 		return s.m.Answered
 	case "DELETED":
@@ -376,6 +495,23 @@ func (s *search) match(sk searchKey) bool {
 			return rdt >= skdt
 		}
 		panic("missing case")
+	case "SAVEDBEFORE", "SAVEDON", "SAVEDSINCE":
+		// Messages saved before we stored the save date use the internal date. ../rfc/8514
+		tm := s.m.SaveDate
+		if tm.IsZero() {
+			tm = s.m.Received
+		}
+		skdt := sk.date.Format("2006-01-02")
+		dt := tm.Format("2006-01-02")
+		switch sk.op {
+		case "SAVEDBEFORE":
+			return dt < skdt
+		case "SAVEDON":
+			return dt == skdt
+		case "SAVEDSINCE":
+			return dt >= skdt
+		}
+		panic("missing case")
 	case "LARGER":
 		return s.m.Size > sk.number
 	case "SMALLER":
@@ -393,6 +529,9 @@ func (s *search) match(sk searchKey) bool {
 		return filterHeader("Bcc", sk.astring)
 	case "BODY", "TEXT":
 		headerToo := sk.op == "TEXT"
+		if s.fuzzy {
+			return s.fuzzyMatch(mailText(c, s.uid, s.p, headerToo), sk.astring)
+		}
 		lower := strings.ToLower(sk.astring)
 		return mailContains(c, s.uid, s.p, lower, headerToo)
 	case "CC":
@@ -412,6 +551,10 @@ func (s *search) match(sk searchKey) bool {
 			return false
 		}
 		k := textproto.CanonicalMIMEHeaderKey(sk.headerField)
+		if s.fuzzy && lower != "" {
+			values := h.Values(k)
+			return len(values) > 0 && s.fuzzyMatch(strings.ToLower(strings.Join(values, "\n")), sk.astring)
+		}
 		for _, v := range h.Values(k) {
 			if lower == "" || strings.Contains(strings.ToLower(v), lower) {
 				return true
@@ -437,6 +580,48 @@ func (s *search) match(sk searchKey) bool {
 	panic(serverError{fmt.Errorf("missing case for search key op %q", sk.op)})
 }
 
+// textIndexResults holds matches from the full-text index for search strings,
+// for the transaction of a command.
+type textIndexResults struct {
+	tx      *bstore.Tx
+	matches map[string]map[int64]bool // Key is "BODY " or "TEXT " with the search string.
+}
+
+// textIndexMatch returns whether the message matches the search string for
+// BODY, or with headerToo for TEXT, according to the full-text index of the
+// account. If ok is false, the index cannot be used, e.g. because it is not
+// enabled, because the message was not indexed or because the string has no
+// words, and the message must be read instead.
+func (c *conn) textIndexMatch(tx *bstore.Tx, messageID int64, str string, headerToo bool) (match, ok bool) {
+	if !c.account.TextIndexEnabled() {
+		return false, false
+	}
+	if has, err := store.TextIndexHas(tx, messageID); err != nil {
+		xcheckf(err, "checking full-text index")
+	} else if !has {
+		return false, false
+	}
+
+	if c.textIndex == nil || c.textIndex.tx != tx {
+		c.textIndex = &textIndexResults{tx, map[string]map[int64]bool{}}
+	}
+	key := "BODY " + str
+	if headerToo {
+		key = "TEXT " + str
+	}
+	ids, ok := c.textIndex.matches[key]
+	if !ok {
+		var err error
+		ids, err = store.TextIndexSearch(tx, str, headerToo)
+		xcheckf(err, "searching full-text index")
+		c.textIndex.matches[key] = ids
+	}
+	if ids == nil {
+		return false, false
+	}
+	return ids[messageID], true
+}
+
 // mailContains returns whether the mail message or part represented by p contains (case-insensitive) string lower.
 // The (decoded) text bodies are tested for a match.
 // If headerToo is set, the header part of the message is checked as well.
@@ -471,3 +656,14 @@ func mailContainsReader(c *conn, uid store.UID, r io.Reader, lower string) bool
 	}
 	return strings.Contains(strings.ToLower(string(buf)), lower)
 }
+
+// xsearchCharset parses the charset for the search criteria of SEARCH, ESEARCH,
+// SORT and THREAD. Only US-ASCII and UTF-8 are supported, other charsets fail
+// with the BADCHARSET response code that lists the supported charsets.
+// ../rfc/3501:2771 ../rfc/9051:3836
+func xsearchCharset(p *parser) {
+	charset := strings.ToUpper(p.xastring())
+	if charset != "US-ASCII" && charset != "UTF-8" {
+		xusercodeErrorf("BADCHARSET (US-ASCII UTF-8)", "only US-ASCII and UTF-8 supported")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/mjl-/mox/imapclient"
+	"github.com/mjl-/mox/mox-"
 )
 
 var searchMsg = strings.ReplaceAll(`Date: Mon, 1 Jan 2022 10:00:00 +0100 (CEST)
@@ -219,10 +220,16 @@ func TestSearch(t *testing.T) {
 	tc.xsearch(1, 2)
 
 	tc.transactf("no", `search charset unknown text "mox"`)
+	tc.xcode("BADCHARSET")
+	tc.xcodeArg(imapclient.CodeList{Code: "BADCHARSET", Args: []string{"US-ASCII", "UTF-8"}})
 	tc.transactf("ok", `search charset us-ascii text "mox"`)
 	tc.xsearch(2, 3)
 	tc.transactf("ok", `search charset utf-8 text "mox"`)
 	tc.xsearch(2, 3)
+	tc.transactf("ok", "search charset utf-8 text {2+}\r\n\xc3\xa9")
+	tc.xsearch()
+	tc.transactf("bad", "search charset utf-8 text {1+}\r\n\xe9") // Not valid utf-8, e.g. iso-8859-1.
+	tc.transactf("bad", "search not subject {1+}\r\n\xe9")
 
 	// esearchall makes an UntaggedEsearch response with All set, for comparisons.
 	esearchall0 := func(ss string) imapclient.NumSet {
@@ -264,6 +271,12 @@ func TestSearch(t *testing.T) {
 		return &v
 	}
 
+	// ESEARCH is announced, and responses have the tag of the command as correlator,
+	// checked by xesearch.
+	if _, ok := tc.client.CapAvailable[imapclient.Capability("ESEARCH")]; !ok {
+		t.Fatalf("ESEARCH not in capabilities")
+	}
+
 	// Do new-style ESEARCH requests with RETURN. We should get an ESEARCH response.
 	tc.transactf("ok", "search return () all")
 	tc.xesearch(esearchall("1:3")) // Without any options, "ALL" is implicit.
@@ -352,8 +365,178 @@ func TestSearch(t *testing.T) {
 	tc.transactf("ok", "fetch $ (uid)")
 	tc.xuntagged(imapclient.UntaggedFetch{Seq: 1, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(5)}})
 
+	// "$" in the criteria refers to the previously saved result, narrowing it down.
+	tc.transactf("ok", "search return (save) 2:3")
+	tc.transactf("ok", "uid search return (save all) $ uid 7")
+	tc.xesearch(imapclient.UntaggedEsearch{UID: true, All: esearchall0("7")})
+	tc.transactf("ok", "uid fetch $ (uid)")
+	tc.xuntagged(imapclient.UntaggedFetch{Seq: 3, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(7)}})
+
+	// "$" with UID STORE and COPY.
+	tc.transactf("ok", `uid store $ +flags.silent (\Flagged)`)
+	tc.transactf("ok", "search return (all) flagged")
+	tc.xesearch(esearchall("3"))
+	tc.transactf("ok", `uid store $ -flags.silent (\Flagged)`)
+	tc.transactf("ok", "uid copy $ Archive")
+	tc.xcode("COPYUID")
+
+	// A failed search with SAVE empties the saved result.
+	tc.transactf("bad", "search return (save) unknown")
+	tc.transactf("ok", "fetch $ (uid)")
+	tc.xuntagged()
+
 	// Do a seemingly old-style search command with IMAP4rev2 enabled. We'll still get ESEARCH responses.
 	tc.client.Enable("IMAP4rev2")
 	tc.transactf("ok", `search undraft`)
 	tc.xesearch(esearchall("1:2"))
 }
+
+func TestSearchFuzzy(t *testing.T) {
+	defer mockUIDValidity()()
+	tc := start(t)
+	defer tc.close()
+	tc.client.Login("mjl@mox.example", "testtest")
+
+	fuzzyMsg := func(subject, body string) []byte {
+		s := "From: <mjl@mox.example>\nSubject: " + subject + "\nContent-Type: text/plain\n\n" + body + "\n"
+		return []byte(strings.ReplaceAll(s, "\n", "\r\n"))
+	}
+	tc.client.Append("inbox", nil, nil, fuzzyMsg("quarterly report", "the report for the quarter. report attached."))
+	tc.client.Append("inbox", nil, nil, fuzzyMsg("lunch", "raport typo"))
+	tc.client.Append("inbox", nil, nil, fuzzyMsg("other", "nothing"))
+	tc.client.Select("inbox")
+
+	uint32ptr := func(v uint32) *uint32 { return &v }
+
+	tc.transactf("ok", "search body report")
+	tc.xsearch(1)
+
+	// Approximate match for message 2, with lower score.
+	tc.transactf("ok", "search fuzzy body report")
+	tc.xsearch(1, 2)
+
+	tc.transactf("ok", "search return (all relevancy) fuzzy body report")
+	tc.xesearch(imapclient.UntaggedEsearch{All: imapclient.NumSet{Ranges: []imapclient.NumRange{{First: 1, Last: uint32ptr(2)}}}, Relevancy: []int{90, 40}})
+
+	tc.transactf("ok", "uid search return (relevancy) fuzzy text \"quarterly report\"")
+	tc.xesearch(imapclient.UntaggedEsearch{UID: true, Relevancy: []int{87, 20}})
+
+	// Without fuzzy key, all matches have score 100.
+	tc.transactf("ok", "search return (relevancy) subject lunch")
+	tc.xesearch(imapclient.UntaggedEsearch{Relevancy: []int{100}})
+
+	// Fuzzy keys in NOT don't count towards the relevancy.
+	tc.transactf("ok", "search return (all relevancy) fuzzy subject report not fuzzy body nothing")
+	tc.xesearch(imapclient.UntaggedEsearch{All: imapclient.NumSet{Ranges: []imapclient.NumRange{{First: 1}}}, Relevancy: []int{80}})
+
+	tc.transactf("ok", "sort (reverse relevancy) utf-8 fuzzy text \"quarterly report\"")
+	tc.xuntagged(imapclient.UntaggedSort{1, 2})
+
+	tc.transactf("ok", "sort (relevancy) utf-8 fuzzy text \"quarterly report\"")
+	tc.xuntagged(imapclient.UntaggedSort{2, 1})
+
+	tc.transactf("ok", `esearch in (selected) return (relevancy) fuzzy body report`)
+	tc.xuntagged(imapclient.UntaggedEsearch{Correlator: tc.client.LastTag, Mailbox: "Inbox", UIDValidity: 1, UID: true, Relevancy: []int{90, 40}})
+
+	tc.transactf("bad", "search fuzzy") // Missing search key.
+}
+
+func TestSearchTextIndex(t *testing.T) {
+	tc := start(t)
+	defer tc.close()
+
+	accConf := mox.Conf.Dynamic.Accounts["mjl"]
+	defer func() {
+		mox.Conf.Dynamic.Accounts["mjl"] = accConf
+	}()
+
+	tc.client.Login("mjl@mox.example", "testtest")
+
+	textMsg := func(subject, body string) []byte {
+		s := "From: <mjl@mox.example>\nSubject: " + subject + "\nContent-Type: text/plain\n\n" + body + "\n"
+		return []byte(strings.ReplaceAll(s, "\n", "\r\n"))
+	}
+	// Appended before enabling the index, searches read the message.
+	tc.client.Append("inbox", nil, nil, textMsg("old", "old reports"))
+
+	nconf := accConf
+	nconf.FullTextIndex = true
+	mox.Conf.Dynamic.Accounts["mjl"] = nconf
+
+	tc.client.Append("inbox", nil, nil, textMsg("quarterly", "the report for the quarter"))
+	tc.client.Append("inbox", nil, nil, textMsg("lunch", "nothing"))
+	tc.client.Select("inbox")
+
+	tc.transactf("ok", "search body report")
+	tc.xsearch(1, 2)
+
+	// With the index, only full words match.
+	tc.transactf("ok", "search body rep")
+	tc.xsearch(1)
+
+	// All words must be present, in any order.
+	tc.transactf("ok", `search body "quarter the"`)
+	tc.xsearch(2)
+
+	// BODY does not match the subject, TEXT does.
+	tc.transactf("ok", "search body lunch")
+	tc.xsearch()
+	tc.transactf("ok", "search text lunch")
+	tc.xsearch(3)
+
+	// The index is kept for copies.
+	tc.transactf("ok", "copy 2 Archive")
+	tc.client.Select("Archive")
+	tc.transactf("ok", "search body quarter")
+	tc.xsearch(1)
+}
+
+// Repeated searches reuse the previous result, until messages change.
+func TestSearchCache(t *testing.T) {
+	tc := start(t)
+	defer tc.close()
+	tc2 := startNoSwitchboard(t)
+	defer tc2.close()
+
+	tc.client.Login("mjl@mox.example", "testtest")
+	tc.client.Append("inbox", nil, nil, []byte(exampleMsg))
+	tc.client.Append("inbox", nil, nil, []byte(exampleMsg))
+	tc.client.Append("inbox", nil, nil, []byte(exampleMsg))
+	tc.client.Select("inbox")
+
+	tc2.client.Login("mjl@mox.example", "testtest")
+	tc2.client.Select("inbox")
+
+	tc.transactf("ok", "search unseen")
+	tc.xsearch(1, 2, 3)
+	tc.transactf("ok", "search unseen")
+	tc.xsearch(1, 2, 3)
+
+	// MIN and MAX from a cached result, also for SAVE.
+	tc.transactf("ok", "search return (min max) unseen")
+	tc.xesearch(imapclient.UntaggedEsearch{Min: 1, Max: 3})
+	tc.transactf("ok", "search return (max save) unseen")
+	tc.xesearch(imapclient.UntaggedEsearch{Max: 3})
+	tc.transactf("ok", "fetch $ (uid)")
+	tc.xuntagged(imapclient.UntaggedFetch{Seq: 3, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(3)}})
+
+	// Change by this session.
+	tc.transactf("ok", `store 1 +flags.silent (\Seen)`)
+	tc.transactf("ok", "search unseen")
+	tc.xsearch(2, 3)
+
+	// Change by another session, before this session has seen it.
+	tc2.transactf("ok", `store 2 +flags.silent (\Seen)`)
+	tc.transactf("ok", "noop")
+	tc.transactf("ok", "search unseen")
+	tc.xsearch(3)
+
+	// Expunge by another session changes the messages in this session.
+	tc2.transactf("ok", `store 1 +flags.silent (\Deleted)`)
+	tc2.transactf("ok", "expunge")
+	tc.transactf("ok", "noop")
+	tc.transactf("ok", "search unseen")
+	tc.xsearch(2)
+	tc.transactf("ok", "uid search unseen")
+	tc.xsearch(3)
+}
@@ -0,0 +1,77 @@
+package imapserver
+
+import (
+	"reflect"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/mox/store"
+)
+
+var metricSearchCache = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mox_imap_search_cache_total",
+		Help: "IMAP searches of all messages in the selected mailbox, by whether the result of the previous search could be reused.",
+	},
+	[]string{
+		"result", // hit, miss
+	},
+)
+
+// searchCache is the result of the last search of all messages in the selected
+// mailbox. Clients may repeat the same search, e.g. before each FETCH or STORE
+// of the matching messages. Evaluating a search reads each message from the
+// database, or even its message file, which is slow for large mailboxes.
+//
+// A cached result is only used if the account has not changed since, as
+// indicated by its highest modseq, which is incremented for each change to
+// messages, including flags and annotations. The cache is cleared when messages
+// are added to or removed from the session.
+type searchCache struct {
+	mailboxID   int64
+	modseq      store.ModSeq
+	sk          searchKey
+	uids        []store.UID
+	relevancies []int
+}
+
+// searchCacheable returns whether the result for sk can be cached. Searches that
+// reference the saved search result are not cached, it can change without
+// changes to messages.
+func searchCacheable(sk *searchKey) bool {
+	return !sk.hasSearchResult()
+}
+
+// searchCacheGet returns a copy of the cached result for sk, if any is valid.
+func (c *conn) searchCacheGet(sk *searchKey, modseq store.ModSeq) (uids []store.UID, relevancies []int, ok bool) {
+	if !searchCacheable(sk) {
+		return nil, nil, false
+	}
+	sc := c.searchCache
+	if sc == nil || sc.mailboxID != c.mailboxID || sc.modseq != modseq || !reflect.DeepEqual(sc.sk, *sk) {
+		metricSearchCache.WithLabelValues("miss").Inc()
+		return nil, nil, false
+	}
+	metricSearchCache.WithLabelValues("hit").Inc()
+	// Callers may modify the slices.
+	uids = append([]store.UID(nil), sc.uids...)
+	relevancies = append([]int(nil), sc.relevancies...)
+	return uids, relevancies, true
+}
+
+// searchCachePut remembers the result of a search of all messages in the
+// selected mailbox.
+func (c *conn) searchCachePut(sk *searchKey, modseq store.ModSeq, uids []store.UID, relevancies []int) {
+	if !searchCacheable(sk) {
+		c.searchCache = nil
+		return
+	}
+	c.searchCache = &searchCache{
+		c.mailboxID,
+		modseq,
+		*sk,
+		append([]store.UID(nil), uids...),
+		append([]int(nil), relevancies...),
+	}
+}
@@ -40,6 +40,7 @@ func testSelectExamine(t *testing.T, examine bool) {
 	uexists1 := imapclient.UntaggedExists(1)
 	uuidval1 := imapclient.UntaggedResult{Status: imapclient.OK, RespText: imapclient.RespText{Code: "UIDVALIDITY", CodeArg: imapclient.CodeUint{Code: "UIDVALIDITY", Num: 1}, More: "x"}}
 	uuidnext1 := imapclient.UntaggedResult{Status: imapclient.OK, RespText: imapclient.RespText{Code: "UIDNEXT", CodeArg: imapclient.CodeUint{Code: "UIDNEXT", Num: 1}, More: "x"}}
+	umailboxid := imapclient.UntaggedResult{Status: imapclient.OK, RespText: imapclient.RespText{Code: "MAILBOXID", CodeArg: imapclient.CodeMailboxID("F1"), More: "x"}}
 	ulist := imapclient.UntaggedList{Separator: '/', Mailbox: "Inbox"}
 	uunseen := imapclient.UntaggedResult{Status: imapclient.OK, RespText: imapclient.RespText{Code: "UNSEEN", CodeArg: imapclient.CodeUint{Code: "UNSEEN", Num: 1}, More: "x"}}
 	uuidnext2 := imapclient.UntaggedResult{Status: imapclient.OK, RespText: imapclient.RespText{Code: "UIDNEXT", CodeArg: imapclient.CodeUint{Code: "UIDNEXT", Num: 2}, More: "x"}}
@@ -51,22 +52,22 @@ func testSelectExamine(t *testing.T, examine bool) {
 	tc.transactf("no", cmd+" bogus")
 
 	tc.transactf("ok", cmd+" inbox")
-	tc.xuntagged(uflags, upermflags, urecent, uexists0, uuidval1, uuidnext1, ulist)
+	tc.xuntagged(uflags, upermflags, urecent, uexists0, uuidval1, uuidnext1, umailboxid, ulist)
 	tc.xcode(okcode)
 
 	tc.transactf("ok", cmd+` "inbox"`)
-	tc.xuntagged(uclosed, uflags, upermflags, urecent, uexists0, uuidval1, uuidnext1, ulist)
+	tc.xuntagged(uclosed, uflags, upermflags, urecent, uexists0, uuidval1, uuidnext1, umailboxid, ulist)
 	tc.xcode(okcode)
 
 	// Append a message. It will be reported as UNSEEN.
 	tc.client.Append("inbox", nil, nil, []byte(exampleMsg))
 	tc.transactf("ok", cmd+" inbox")
-	tc.xuntagged(uclosed, uflags, upermflags, urecent, uunseen, uexists1, uuidval1, uuidnext2, ulist)
+	tc.xuntagged(uclosed, uflags, upermflags, urecent, uunseen, uexists1, uuidval1, uuidnext2, umailboxid, ulist)
 	tc.xcode(okcode)
 
 	// With imap4rev2, we no longer get untagged RECENT or untagged UNSEEN.
 	tc.client.Enable("imap4rev2")
 	tc.transactf("ok", cmd+" inbox")
-	tc.xuntagged(uclosed, uflags, upermflags, uexists1, uuidval1, uuidnext2, ulist)
+	tc.xuntagged(uclosed, uflags, upermflags, uexists1, uuidval1, uuidnext2, umailboxid, ulist)
 	tc.xcode(okcode)
 }
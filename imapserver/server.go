@@ -11,6 +11,10 @@ extension and announce it as capability. The extensions: LITERAL+, IDLE,
 NAMESPACE, BINARY, UNSELECT, UIDPLUS, ESEARCH, SEARCHRES, SASL-IR, ENABLE,
 LIST-EXTENDED, SPECIAL-USE, MOVE, UTF8=ONLY.
 
+For CONDSTORE, the HIGHESTMODSEQ of a mailbox is the last modseq assigned in
+the account. It is at least the highest modseq of the messages in the mailbox,
+and only causes clients to check for changes more often than necessary.
+
 We take a liberty with UTF8=ONLY. We are supposed to wait for ENABLE of
 UTF8=ACCEPT or IMAP4rev2 before we respond with quoted strings that contain
 non-ASCII UTF-8. But we will unconditionally accept UTF-8 at the moment. See
@@ -29,9 +33,8 @@ not in IMAP4rev2). ../rfc/3501:964
 /*
 - todo: do not return binary data for a fetch body. at least not for imap4rev1. we should be encoding it as base64?
 - todo: on expunge we currently remove the message even if other sessions still have a reference to the uid. if they try to query the uid, they'll get an error. we could be nicer and only actually remove the message when the last reference has gone. we could add a new flag to store.Message marking the message as expunged, not give new session access to such messages, and make store remove them at startup, and clean them when the last session referencing the session goes. however, it will get much more complicated. renaming messages would need special handling. and should we do the same for removed mailboxes?
-- todo: CONDSTORE, QRESYNC. Add fields modseq on mailbox and each message. Keep (log of) deleted messages and their modseqs.
 - todo: try to recover from syntax errors when the last command line ends with a }, i.e. a literal. we currently abort the entire connection. we may want to read some amount of literal data and continue with a next command.
-- future: more extensions: STATUS=SIZE, OBJECTID, MULTISEARCH, REPLACE, NOTIFY, CATENATE, MULTIAPPEND, SORT, THREAD, CREATE-SPECIAL-USE.
+- future: more extensions: STATUS=SIZE, OBJECTID, MULTISEARCH, REPLACE, CATENATE, MULTIAPPEND, SORT, THREAD.
 - future: implement user-defined keyword flags? ../rfc/9051:566
 */
 
@@ -55,11 +58,13 @@ import (
 	"regexp"
 	"runtime/debug"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/exp/slices"
 	"golang.org/x/text/unicode/norm"
 
 	"github.com/mjl-/bstore"
@@ -71,6 +76,7 @@ import (
 	"github.com/mjl-/mox/mox-"
 	"github.com/mjl-/mox/moxio"
 	"github.com/mjl-/mox/moxvar"
+	"github.com/mjl-/mox/oauth"
 	"github.com/mjl-/mox/ratelimit"
 	"github.com/mjl-/mox/scram"
 	"github.com/mjl-/mox/store"
@@ -101,6 +107,15 @@ var (
 			"result", // ok, panic, ioerror, badsyntax, servererror, usererror, error
 		},
 	)
+	metricIMAPClientID = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mox_imap_client_id_total",
+			Help: "Authenticated IMAP connections that identified their client software with the ID command.",
+		},
+		[]string{
+			"name", // Known client software from ID, see clientIDLabel, or "other".
+		},
+	)
 )
 
 var limiterConnectionrate, limiterConnections *ratelimit.Limiter
@@ -120,11 +135,21 @@ func limitersInit() {
 			},
 		},
 	}
-	limiterConnections = &ratelimit.Limiter{
+	limiterConnections = newConnectionsLimiter()
+}
+
+// newConnectionsLimiter returns a limiter for simultaneous connections per IP and
+// network, with limits from the configuration.
+func newConnectionsLimiter() *ratelimit.Limiter {
+	var n int64 = 30
+	if l := mox.Conf.Static.IMAPConnectionLimits; l != nil && l.MaxPerIP > 0 {
+		n = int64(l.MaxPerIP)
+	}
+	return &ratelimit.Limiter{
 		WindowLimits: []ratelimit.WindowLimit{
 			{
 				Window: time.Duration(math.MaxInt64), // All of time.
-				Limits: [...]int64{30, 90, 270},
+				Limits: [...]int64{n, 3 * n, 9 * n},
 			},
 		},
 	}
@@ -134,7 +159,7 @@ func limitersInit() {
 var badClientDelay = time.Second // Before reads and after 1-byte writes for probably spammers.
 var authFailDelay = time.Second  // After authentication failure.
 
-// Capabilities (extensions) the server supports. Connections will add a few more, e.g. STARTTLS, LOGINDISABLED, AUTH=PLAIN.
+// Capabilities (extensions) the server supports. Connections will add a few more, e.g. STARTTLS, LOGINDISABLED and the AUTH= mechanisms.
 // ENABLE: ../rfc/5161
 // LITERAL+: ../rfc/7888
 // IDLE: ../rfc/2177
@@ -147,29 +172,48 @@ var authFailDelay = time.Second  // After authentication failure.
 // MOVE: ../rfc/6851
 // UTF8=ONLY: ../rfc/6855
 // LIST-EXTENDED: ../rfc/5258
-// SPECIAL-USE: ../rfc/6154
+// SPECIAL-USE, CREATE-SPECIAL-USE: ../rfc/6154
 // LIST-STATUS: ../rfc/5819
 // ID: ../rfc/2971
-// AUTH=SCRAM-SHA-256: ../rfc/7677 ../rfc/5802
-// AUTH=SCRAM-SHA-1: ../rfc/5802
-// AUTH=CRAM-MD5: ../rfc/2195
-// APPENDLIMIT, we support the max possible size, 1<<63 - 1: ../rfc/7889:129
-const serverCapabilities = "IMAP4rev2 IMAP4rev1 ENABLE LITERAL+ IDLE SASL-IR BINARY UNSELECT UIDPLUS ESEARCH SEARCHRES MOVE UTF8=ONLY LIST-EXTENDED SPECIAL-USE LIST-STATUS AUTH=SCRAM-SHA-256 AUTH=SCRAM-SHA-1 AUTH=CRAM-MD5 ID APPENDLIMIT=9223372036854775807"
+// APPENDLIMIT, the limit of the account after authentication, otherwise the max possible size, 1<<63 - 1: ../rfc/7889:129
+// CONDSTORE: ../rfc/7162
+// QRESYNC: ../rfc/7162
+// NOTIFY: ../rfc/5465
+// MULTISEARCH: ../rfc/7377
+// SORT, THREAD: ../rfc/5256
+// SEARCH=FUZZY: ../rfc/6203
+// OBJECTID: ../rfc/8474
+// SAVEDATE: ../rfc/8514
+// PREVIEW: ../rfc/8970
+// METADATA: ../rfc/5464
+// QUOTA: ../rfc/9208
+// ACL: ../rfc/4314
+// COMPRESS=DEFLATE: ../rfc/4978
+// CATENATE: ../rfc/4469
+// URLAUTH: ../rfc/4467
+// MULTIAPPEND: ../rfc/3502
+// UNAUTHENTICATE: ../rfc/8437
+// REPLACE: ../rfc/8508
+// ANNOTATE-EXPERIMENT-1: ../rfc/5257
+const serverCapabilities = "IMAP4rev2 IMAP4rev1 ENABLE LITERAL+ IDLE SASL-IR BINARY UNSELECT UIDPLUS ESEARCH SEARCHRES MOVE UTF8=ONLY LIST-EXTENDED SPECIAL-USE CREATE-SPECIAL-USE LIST-STATUS ID CONDSTORE QRESYNC NOTIFY MULTISEARCH SORT THREAD=ORDEREDSUBJECT THREAD=REFERENCES SEARCH=FUZZY OBJECTID SAVEDATE PREVIEW METADATA QUOTA QUOTA=RES-STORAGE QUOTA=RES-MESSAGE ACL RIGHTS=te COMPRESS=DEFLATE CATENATE URLAUTH MULTIAPPEND UNAUTHENTICATE REPLACE ANNOTATE-EXPERIMENT-1"
 
 type conn struct {
 	cid               int64
+	listenerName      string
 	state             state
 	conn              net.Conn
 	tls               bool               // Whether TLS has been initialized.
+	compress          bool               // Whether COMPRESS=DEFLATE is active.
 	br                *bufio.Reader      // From remote, with TLS unwrapped in case of TLS.
 	line              chan lineErr       // If set, instead of reading from br, a line is read from this channel. For reading a line in IDLE while also waiting for mailbox/account updates.
 	lastLine          string             // For detecting if syntax error is fatal, i.e. if this ends with a literal. Without crlf.
 	bw                *bufio.Writer      // To remote, with TLS added in case of TLS.
 	tr                *moxio.TraceReader // Kept to change trace level when reading/writing cmd/auth/data.
 	tw                *moxio.TraceWriter
-	slow              bool        // If set, reads are done with a 1 second sleep, and writes are done 1 byte at a time, to keep spammers busy.
-	lastlog           time.Time   // For printing time since previous log line.
-	tlsConfig         *tls.Config // TLS config to use for handshake.
+	transcript        *moxio.Transcript // If set, for a protocol trace of the account or remote IP.
+	slow              bool              // If set, reads are done with a 1 second sleep, and writes are done 1 byte at a time, to keep spammers busy.
+	lastlog           time.Time         // For printing time since previous log line.
+	tlsConfig         *tls.Config       // TLS config to use for handshake.
 	remoteIP          net.IP
 	noRequireSTARTTLS bool
 	cmd               string // Currently executing, for deciding to applyChanges and logging.
@@ -178,6 +222,8 @@ type conn struct {
 	ncmds             int // Number of commands processed. Used to abort connection when first incoming command is unknown/invalid.
 	log               *mlog.Log
 	enabled           map[capability]bool // All upper-case.
+	clientID          string              // Client name and version from ID command, for logging.
+	clientIDMetric    string              // Label for metricIMAPClientID, counted once authenticated, then cleared.
 
 	// Set by SEARCH with SAVE. Can be used by commands accepting a sequence-set with
 	// value "$". When used, UIDs must be verified to still exist, because they may
@@ -187,11 +233,22 @@ type conn struct {
 	// ../rfc/5182:13 ../rfc/9051:4040
 	searchResult []store.UID
 
+	textIndex   *textIndexResults // Cache for searches with the full-text index, for the current transaction.
+	searchCache *searchCache      // Result of last SEARCH in selected mailbox, cleared when the messages in the session change.
+
 	// Only when authenticated.
-	authFailed int    // Number of failed auth attempts. For slowing down remote with many failures.
-	username   string // Full username as used during login.
-	account    *store.Account
-	comm       *store.Comm // For sending/receiving changes on mailboxes in account, e.g. from messages incoming on smtp, or another imap client.
+	authFailed  int    // Number of failed auth attempts. For slowing down remote with many failures.
+	username    string // Full username as used during login.
+	account     *store.Account
+	connAccount string      // Account this connection is counted for, for MaxIMAPConnections.
+	comm        *store.Comm // For sending/receiving changes on mailboxes in account, e.g. from messages incoming on smtp, or another imap client.
+	notify      *notify     // If set, changes are sent for the requested events, also while not idling. ../rfc/5465
+
+	// While operating on the account of the owner of a selected shared mailbox,
+	// account and comm are of the owner, and these are of the user.
+	ownAccount *store.Account
+	ownComm    *store.Comm
+	shared     *sharedMailbox // If the selected mailbox is a shared mailbox of another account.
 
 	mailboxID int64       // Only for StateSelected.
 	readonly  bool        // If opened mailbox is readonly.
@@ -206,6 +263,8 @@ type capability string
 const (
 	capIMAP4rev2  capability = "IMAP4REV2"
 	capUTF8Accept capability = "UTF8=ACCEPT"
+	capCondstore  capability = "CONDSTORE"
+	capQresync    capability = "QRESYNC"
 )
 
 type lineErr struct {
@@ -232,8 +291,11 @@ func stateCommands(cmds ...string) map[string]struct{} {
 var (
 	commandsStateAny              = stateCommands("capability", "noop", "logout", "id")
 	commandsStateNotAuthenticated = stateCommands("starttls", "authenticate", "login")
-	commandsStateAuthenticated    = stateCommands("enable", "select", "examine", "create", "delete", "rename", "subscribe", "unsubscribe", "list", "namespace", "status", "append", "idle", "lsub")
-	commandsStateSelected         = stateCommands("close", "unselect", "expunge", "search", "fetch", "store", "copy", "move", "uid expunge", "uid search", "uid fetch", "uid store", "uid copy", "uid move")
+	commandsStateAuthenticated    = stateCommands("enable", "select", "examine", "create", "delete", "rename", "subscribe", "unsubscribe", "list", "namespace", "status", "append", "idle", "lsub", "notify", "esearch", "getmetadata", "setmetadata", "getquota", "getquotaroot", "setquota", "setacl", "deleteacl", "getacl", "listrights", "myrights", "compress", "resetkey", "genurlauth", "urlfetch", "unauthenticate")
+	commandsStateSelected         = stateCommands("close", "unselect", "expunge", "search", "sort", "thread", "fetch", "store", "copy", "move", "replace", "uid expunge", "uid search", "uid sort", "uid thread", "uid fetch", "uid store", "uid copy", "uid move", "uid replace")
+
+	// Commands that change the account, refused for accounts with IMAPReadOnly.
+	commandsModify = stateCommands("create", "delete", "rename", "subscribe", "unsubscribe", "append", "setmetadata", "setquota", "setacl", "deleteacl", "resetkey", "genurlauth", "expunge", "store", "copy", "move", "replace", "uid expunge", "uid store", "uid copy", "uid move", "uid replace")
 )
 
 var commands = map[string]func(c *conn, tag, cmd string, p *parser){
@@ -249,20 +311,37 @@ var commands = map[string]func(c *conn, tag, cmd string, p *parser){
 	"login":        (*conn).cmdLogin,
 
 	// Authenticated and selected.
-	"enable":      (*conn).cmdEnable,
-	"select":      (*conn).cmdSelect,
-	"examine":     (*conn).cmdExamine,
-	"create":      (*conn).cmdCreate,
-	"delete":      (*conn).cmdDelete,
-	"rename":      (*conn).cmdRename,
-	"subscribe":   (*conn).cmdSubscribe,
-	"unsubscribe": (*conn).cmdUnsubscribe,
-	"list":        (*conn).cmdList,
-	"lsub":        (*conn).cmdLsub,
-	"namespace":   (*conn).cmdNamespace,
-	"status":      (*conn).cmdStatus,
-	"append":      (*conn).cmdAppend,
-	"idle":        (*conn).cmdIdle,
+	"enable":         (*conn).cmdEnable,
+	"select":         (*conn).cmdSelect,
+	"examine":        (*conn).cmdExamine,
+	"create":         (*conn).cmdCreate,
+	"delete":         (*conn).cmdDelete,
+	"rename":         (*conn).cmdRename,
+	"subscribe":      (*conn).cmdSubscribe,
+	"unsubscribe":    (*conn).cmdUnsubscribe,
+	"list":           (*conn).cmdList,
+	"lsub":           (*conn).cmdLsub,
+	"namespace":      (*conn).cmdNamespace,
+	"status":         (*conn).cmdStatus,
+	"append":         (*conn).cmdAppend,
+	"idle":           (*conn).cmdIdle,
+	"notify":         (*conn).cmdNotify,
+	"esearch":        (*conn).cmdEsearch,
+	"getmetadata":    (*conn).cmdGetmetadata,
+	"setmetadata":    (*conn).cmdSetmetadata,
+	"getquota":       (*conn).cmdGetquota,
+	"getquotaroot":   (*conn).cmdGetquotaroot,
+	"setquota":       (*conn).cmdSetquota,
+	"setacl":         (*conn).cmdSetacl,
+	"deleteacl":      (*conn).cmdDeleteacl,
+	"getacl":         (*conn).cmdGetacl,
+	"listrights":     (*conn).cmdListrights,
+	"myrights":       (*conn).cmdMyrights,
+	"compress":       (*conn).cmdCompress,
+	"resetkey":       (*conn).cmdResetkey,
+	"genurlauth":     (*conn).cmdGenurlauth,
+	"urlfetch":       (*conn).cmdUrlfetch,
+	"unauthenticate": (*conn).cmdUnauthenticate,
 
 	// Selected.
 	"check":       (*conn).cmdCheck,
@@ -272,6 +351,10 @@ var commands = map[string]func(c *conn, tag, cmd string, p *parser){
 	"uid expunge": (*conn).cmdUIDExpunge,
 	"search":      (*conn).cmdSearch,
 	"uid search":  (*conn).cmdUIDSearch,
+	"sort":        (*conn).cmdSort,
+	"uid sort":    (*conn).cmdUIDSort,
+	"thread":      (*conn).cmdThread,
+	"uid thread":  (*conn).cmdUIDThread,
 	"fetch":       (*conn).cmdFetch,
 	"uid fetch":   (*conn).cmdUIDFetch,
 	"store":       (*conn).cmdStore,
@@ -280,6 +363,8 @@ var commands = map[string]func(c *conn, tag, cmd string, p *parser){
 	"uid copy":    (*conn).cmdUIDCopy,
 	"move":        (*conn).cmdMove,
 	"uid move":    (*conn).cmdUIDMove,
+	"replace":     (*conn).cmdReplace,
+	"uid replace": (*conn).cmdUIDReplace,
 }
 
 var errIO = errors.New("fatal io error")             // For read/write errors and errors that should close the connection.
@@ -303,6 +388,9 @@ type msgseq uint32
 
 // Listen initializes all imap listeners for the configuration, and stores them for Serve to start them.
 func Listen() {
+	// Limits may be configured, which wasn't loaded yet during init.
+	limiterConnections = newConnectionsLimiter()
+
 	for name, listener := range mox.Conf.Static.Listeners {
 		var tlsConfig *tls.Config
 		if listener.TLS != nil {
@@ -312,14 +400,14 @@ func Listen() {
 		if listener.IMAP.Enabled {
 			port := config.Port(listener.IMAP.Port, 143)
 			for _, ip := range listener.IPs {
-				listen1("imap", name, ip, port, tlsConfig, false, listener.IMAP.NoRequireSTARTTLS)
+				listen1("imap", name, ip, port, tlsConfig, false, listener.IMAP.NoRequireSTARTTLS, listener.IMAP.ProxyProtocol)
 			}
 		}
 
 		if listener.IMAPS.Enabled {
 			port := config.Port(listener.IMAPS.Port, 993)
 			for _, ip := range listener.IPs {
-				listen1("imaps", name, ip, port, tlsConfig, true, false)
+				listen1("imaps", name, ip, port, tlsConfig, true, false, listener.IMAPS.ProxyProtocol)
 			}
 		}
 	}
@@ -327,16 +415,21 @@ func Listen() {
 
 var servers []func()
 
-func listen1(protocol, listenerName, ip string, port int, tlsConfig *tls.Config, xtls, noRequireSTARTTLS bool) {
+func listen1(protocol, listenerName, ip string, port int, tlsConfig *tls.Config, xtls, noRequireSTARTTLS, proxyProtocol bool) {
 	addr := net.JoinHostPort(ip, fmt.Sprintf("%d", port))
 	if os.Getuid() == 0 {
 		xlog.Print("listening for imap", mlog.Field("listener", listenerName), mlog.Field("addr", addr), mlog.Field("protocol", protocol))
 	}
 	network := mox.Network(ip)
-	ln, err := mox.Listen(network, addr)
+	ln, err := mox.Listen(network, addr, mox.Conf.Static.Listeners[listenerName].SocketOptions)
 	if err != nil {
 		xlog.Fatalx("imap: listen for imap", err, mlog.Field("protocol", protocol), mlog.Field("listener", listenerName))
 	}
+	if proxyProtocol {
+		// Before the limits, which should apply to the IPs of clients, not the load balancer.
+		ln = mox.ProxyListener(ln, listenerName)
+	}
+	ln = mox.LimitListener(ln, listenerName)
 	if xtls {
 		ln = tls.NewListener(ln, tlsConfig)
 	}
@@ -371,7 +464,7 @@ func (c *conn) utf8strings() bool {
 }
 
 func (c *conn) xdbwrite(fn func(tx *bstore.Tx)) {
-	err := c.account.DB.Write(context.TODO(), func(tx *bstore.Tx) error {
+	err := store.DBWrite(context.TODO(), c.log, "imapserver", c.account.DB, func(tx *bstore.Tx) error {
 		fn(tx)
 		return nil
 	})
@@ -379,7 +472,7 @@ func (c *conn) xdbwrite(fn func(tx *bstore.Tx)) {
 }
 
 func (c *conn) xdbread(fn func(tx *bstore.Tx)) {
-	err := c.account.DB.Read(context.TODO(), func(tx *bstore.Tx) error {
+	err := store.DBRead(context.TODO(), c.log, "imapserver", c.account.DB, func(tx *bstore.Tx) error {
 		fn(tx)
 		return nil
 	})
@@ -389,11 +482,13 @@ func (c *conn) xdbread(fn func(tx *bstore.Tx)) {
 // Closes the currently selected/active mailbox, setting state from selected to authenticated.
 // Does not remove messages marked for deletion.
 func (c *conn) unselect() {
+	c.sharedClose()
 	if c.state == stateSelected {
 		c.state = stateAuthenticated
 	}
 	c.mailboxID = 0
 	c.uids = nil
+	c.searchCache = nil
 }
 
 func (c *conn) setSlow(on bool) {
@@ -442,6 +537,17 @@ func (c *conn) xtrace(level mlog.Level) func() {
 	}
 }
 
+// transcriptOpen starts writing a protocol transcript if a protocol trace
+// matches the remote IP, or account if not empty.
+func (c *conn) transcriptOpen(account string) {
+	if c.transcript != nil {
+		return
+	}
+	c.transcript = mox.TranscriptOpen(c.log, "imap", c.cid, c.remoteIP, account)
+	c.tr.SetTranscript(c.transcript)
+	c.tw.SetTranscript(c.transcript)
+}
+
 // Cache of line buffers for reading commands.
 var bufpool = moxio.NewBufpool(8, 16*1024)
 
@@ -526,12 +632,13 @@ func (c *conn) writeresultf(format string, args ...any) {
 // write buffered taggedcommand response, but first write pending changes.
 func (c *conn) bwriteresultf(format string, args ...any) {
 	switch c.cmd {
-	case "fetch", "store", "search":
+	case "fetch", "store", "search", "sort", "thread":
 		// ../rfc/9051:5862
 	default:
 		if c.comm != nil {
 			c.applyChanges(c.comm.Get(), false)
 		}
+		c.applySharedChanges()
 	}
 	c.bwritelinef(format, args...)
 }
@@ -553,6 +660,9 @@ func (c *conn) xflush() {
 }
 
 func (c *conn) readCommand(tag *string) (cmd string, p *parser) {
+	if c.notify != nil && c.comm != nil {
+		c.xnotifyWait()
+	}
 	line := c.readline(true)
 	p = newParser(line, c)
 	p.context("tag")
@@ -563,6 +673,33 @@ func (c *conn) readCommand(tag *string) (cmd string, p *parser) {
 	return cmd, newParser(p.remainder(), c)
 }
 
+var nonSyncLiteralRegexp = regexp.MustCompile(`\{([0-9]+)\+\}$`)
+
+// xdiscardLiterals reads and discards the remainder of the current command while
+// its last line ends with a non-synchronizing literal, for refusing a command
+// before parsing it. Data that the client sends without waiting for the server
+// would otherwise be read as commands.
+func (c *conn) xdiscardLiterals() {
+	for {
+		m := nonSyncLiteralRegexp.FindStringSubmatch(c.lastLine)
+		if m == nil {
+			return
+		}
+		size, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			xsyntaxErrorf("parsing literal size: %v", err)
+		}
+		if err := c.conn.SetReadDeadline(time.Now().Add(30 * time.Second)); err != nil {
+			c.log.Errorx("setting read deadline", err)
+		}
+		if _, err := io.CopyN(io.Discard, c.br, size); err != nil {
+			// Cannot use xcheckf due to %w handling of errIO.
+			panic(fmt.Errorf("reading literal: %s (%w)", err, errIO))
+		}
+		c.readline(false)
+	}
+}
+
 func (c *conn) xreadliteral(size int64, sync bool) string {
 	if sync {
 		c.writelinef("+")
@@ -585,6 +722,7 @@ func (c *conn) xreadliteral(size int64, sync bool) string {
 var cleanClose struct{} // Sentinel value for panic/recover indicating clean close of connection.
 
 func serve(listenerName string, cid int64, tlsConfig *tls.Config, nc net.Conn, xtls, noRequireSTARTTLS bool) {
+	nc = moxio.ChaosConn(nc) // No-op unless built with tag moxchaos.
 	var remoteIP net.IP
 	if a, ok := nc.RemoteAddr().(*net.TCPAddr); ok {
 		remoteIP = a.IP
@@ -595,6 +733,7 @@ func serve(listenerName string, cid int64, tlsConfig *tls.Config, nc net.Conn, x
 
 	c := &conn{
 		cid:               cid,
+		listenerName:      listenerName,
 		conn:              nc,
 		tls:               xtls,
 		lastlog:           time.Now(),
@@ -615,6 +754,9 @@ func serve(listenerName string, cid int64, tlsConfig *tls.Config, nc net.Conn, x
 		if c.username != "" {
 			l = append(l, mlog.Field("username", c.username))
 		}
+		if c.clientID != "" {
+			l = append(l, mlog.Field("clientid", c.clientID))
+		}
 		return l
 	})
 	c.tr = moxio.NewTraceReader(c.log, "C: ", c.conn)
@@ -625,12 +767,19 @@ func serve(listenerName string, cid int64, tlsConfig *tls.Config, nc net.Conn, x
 
 	// Many IMAP connections use IDLE to wait for new incoming messages. We'll enable
 	// keepalive to get a higher chance of the connection staying alive, or otherwise
-	// detecting broken connections early.
+	// detecting broken connections early. If the listener has keepalive configured,
+	// including disabled, it was already set on the accepted connection.
+	// The connection may be wrapped in TLS and/or a listener connection limiter.
 	xconn := c.conn
-	if xtls {
-		xconn = c.conn.(*tls.Conn).NetConn()
+	for {
+		nc, ok := xconn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		xconn = nc.NetConn()
 	}
-	if tcpconn, ok := xconn.(*net.TCPConn); ok {
+	sockopts := mox.Conf.Static.Listeners[listenerName].SocketOptions
+	if tcpconn, ok := xconn.(*net.TCPConn); ok && (sockopts == nil || sockopts.KeepAlive == 0) {
 		if err := tcpconn.SetKeepAlivePeriod(5 * time.Minute); err != nil {
 			c.log.Errorx("setting keepalive period", err)
 		} else if err := tcpconn.SetKeepAlive(true); err != nil {
@@ -642,7 +791,11 @@ func serve(listenerName string, cid int64, tlsConfig *tls.Config, nc net.Conn, x
 
 	defer func() {
 		c.conn.Close()
+		err := c.transcript.Close()
+		c.log.Check(err, "closing protocol transcript")
 
+		c.sharedClose()
+		c.accountConnRemove()
 		if c.account != nil {
 			c.comm.Unregister()
 			err := c.account.Close()
@@ -660,6 +813,7 @@ func serve(listenerName string, cid int64, tlsConfig *tls.Config, nc net.Conn, x
 			c.log.Error("unhandled panic", mlog.Field("err", x))
 			debug.PrintStack()
 			metrics.PanicInc("imapserver")
+			moxio.CrashReport(c.log, "imapserver", nc, x)
 		}
 	}()
 
@@ -685,8 +839,10 @@ func serve(listenerName string, cid int64, tlsConfig *tls.Config, nc net.Conn, x
 	}
 
 	if !limiterConnections.Add(c.remoteIP, time.Now(), 1) {
+		metricIMAPConnectionLimit.WithLabelValues("ip").Inc()
 		c.log.Debug("refusing connection due to many open connections", mlog.Field("remoteip", c.remoteIP))
-		c.writelinef("* BYE too many open connections from your ip or network")
+		// ../rfc/5530 section 3
+		c.writelinef("* BYE [LIMIT] too many open connections from your ip or network")
 		return
 	}
 	defer limiterConnections.Add(c.remoteIP, time.Now(), -1)
@@ -696,7 +852,15 @@ func serve(listenerName string, cid int64, tlsConfig *tls.Config, nc net.Conn, x
 	mox.Connections.Register(nc, "imap", listenerName)
 	defer mox.Connections.Unregister(nc)
 
-	c.writelinef("* OK [CAPABILITY %s] mox imap", c.capabilities())
+	c.transcriptOpen("")
+
+	c.bwritelinef("* OK [CAPABILITY %s] mox imap", c.capabilities())
+	// Configured notices, e.g. about maintenance. Clients must show ALERT texts to
+	// the user. ../rfc/9051
+	for _, text := range mox.Notices("imap", c.listenerName, "") {
+		c.bwritelinef("* OK [ALERT] %s", text)
+	}
+	c.xflush()
 
 	for {
 		c.command()
@@ -816,6 +980,12 @@ func (c *conn) command() {
 	default:
 	}
 
+	// Sessions that authenticated before the account was suspended are ended.
+	if c.account != nil && c.account.Suspended() {
+		c.writelinef("* BYE account is suspended")
+		panic(errIO)
+	}
+
 	fn := commands[cmdlow]
 	if fn == nil {
 		xsyntaxErrorf("unknown command %q", cmd)
@@ -834,6 +1004,17 @@ func (c *conn) command() {
 		xserverErrorf("unrecognized command")
 	}
 
+	if _, ok := commandsModify[cmdlow]; ok && c.readOnlyAccount() {
+		c.xdiscardLiterals()
+		xusercodeErrorf("NOPERM", "account is read-only")
+	}
+
+	// Commands on a selected shared mailbox operate on the account of its owner.
+	if _, ok := commandsStateSelected[cmdlow]; ok && c.shared != nil {
+		c.swapAccount(c.shared.account, c.shared.comm)
+		defer c.unswap()
+	}
+
 	fn(c, tag, cmd, p)
 }
 
@@ -940,6 +1121,7 @@ func (c *conn) sequenceRemove(seq msgseq, uid store.UID) {
 	}
 	copy(c.uids[i:], c.uids[i+1:])
 	c.uids = c.uids[:len(c.uids)-1]
+	c.searchCache = nil
 	if sanityChecks {
 		checkUIDs(c.uids)
 	}
@@ -956,6 +1138,7 @@ func (c *conn) uidAppend(uid store.UID) {
 		xserverErrorf("new uid %d is smaller than last uid %d (%w)", uid, c.uids[len(c.uids)-1], errProtocol)
 	}
 	c.uids = append(c.uids, uid)
+	c.searchCache = nil
 	if sanityChecks {
 		checkUIDs(c.uids)
 	}
@@ -1144,6 +1327,31 @@ func xcheckmailboxname(name string, allowInbox bool) string {
 	return name
 }
 
+// xwriteExpunged removes the expunged uids from the session and writes responses
+// for them. With QRESYNC enabled, a single VANISHED response is written instead
+// of an EXPUNGE response per message. ../rfc/7162
+func (c *conn) xwriteExpunged(uids []store.UID) {
+	if len(uids) == 0 {
+		return
+	}
+	if !c.enabled[capQresync] {
+		for _, uid := range uids {
+			seq := c.xsequence(uid)
+			c.sequenceRemove(seq, uid)
+			c.bwritelinef("* %d EXPUNGE", seq)
+		}
+		return
+	}
+	l := append([]store.UID{}, uids...)
+	sort.Slice(l, func(i, j int) bool {
+		return l[i] < l[j]
+	})
+	for _, uid := range l {
+		c.sequenceRemove(c.xsequence(uid), uid)
+	}
+	c.bwritelinef("* VANISHED %s", compactUIDSet(l).String())
+}
+
 // Lookup mailbox by name.
 // If the mailbox does not exist, panic is called with a user error.
 // Must be called with account rlock held.
@@ -1164,7 +1372,8 @@ func (c *conn) xmailboxID(tx *bstore.Tx, id int64) store.Mailbox {
 	mb := store.Mailbox{ID: id}
 	err := tx.Get(&mb)
 	if err == bstore.ErrAbsent {
-		xuserErrorf("%w", store.ErrUnknownMailbox)
+		// E.g. when another session removed the selected mailbox.
+		xusercodeErrorf("NONEXISTENT", "%w", store.ErrUnknownMailbox)
 	}
 	return mb
 }
@@ -1185,7 +1394,10 @@ func (c *conn) applyChanges(changes []store.Change, initial bool) {
 	c.log.Debug("applying changes", mlog.Field("changes", changes))
 
 	// Only keep changes for the selected mailbox, and changes that are always relevant.
+	// With NOTIFY, changes for other mailboxes are kept for STATUS responses.
 	var n []store.Change
+	var notifyMailboxIDs []int64
+	notifyChanges := map[int64][]store.Change{}
 	for _, change := range changes {
 		var mbID int64
 		switch ch := change.(type) {
@@ -1195,17 +1407,31 @@ func (c *conn) applyChanges(changes []store.Change, initial bool) {
 			mbID = ch.MailboxID
 		case store.ChangeFlags:
 			mbID = ch.MailboxID
+		case store.ChangeMailboxKeywords:
+			mbID = ch.MailboxID
 		case store.ChangeRemoveMailbox, store.ChangeAddMailbox, store.ChangeRenameMailbox, store.ChangeAddSubscription:
-			n = append(n, change)
+			// Mailboxes of the owner of a shared mailbox are not announced.
+			if c.ownAccount == nil {
+				n = append(n, change)
+			}
 			continue
 		default:
 			panic(fmt.Errorf("missing case for %#v", change))
 		}
-		if c.state == stateSelected && mbID == c.mailboxID {
+		if c.isSelected(mbID) {
 			n = append(n, change)
+		} else if c.notify != nil && c.ownAccount == nil {
+			if _, ok := notifyChanges[mbID]; !ok {
+				notifyMailboxIDs = append(notifyMailboxIDs, mbID)
+			}
+			notifyChanges[mbID] = append(notifyChanges[mbID], change)
 		}
 	}
 	changes = n
+	var statusLines []string
+	if c.notify != nil {
+		changes, statusLines = c.xnotifyFilter(changes, notifyMailboxIDs, notifyChanges)
+	}
 
 	i := 0
 	for i < len(changes) {
@@ -1231,9 +1457,17 @@ func (c *conn) applyChanges(changes []store.Change, initial bool) {
 			// long enough after the EXISTS to see these messages, and doesn't request them
 			// again with a FETCH.
 			c.bwritelinef("* %d EXISTS", len(c.uids))
+			if atts := c.notifyFetchAtts(); len(atts) > 0 {
+				uids := make([]store.UID, len(adds))
+				for i, add := range adds {
+					uids[i] = add.UID
+				}
+				c.xnotifyFetch(uids, atts)
+				continue
+			}
 			for _, add := range adds {
 				seq := c.xsequence(add.UID)
-				c.bwritelinef("* %d FETCH (UID %d FLAGS %s)", seq, add.UID, flaglist(add.Flags, add.Keywords).pack(c))
+				c.bwritelinef("* %d FETCH (UID %d%s FLAGS %s)", seq, add.UID, c.modseqAtt(add.ModSeq), flaglist(add.Flags, add.Keywords).pack(c))
 			}
 			continue
 		}
@@ -1243,20 +1477,16 @@ func (c *conn) applyChanges(changes []store.Change, initial bool) {
 
 		switch ch := change.(type) {
 		case store.ChangeRemoveUIDs:
+			if !initial {
+				c.xwriteExpunged(ch.UIDs)
+				break
+			}
 			for _, uid := range ch.UIDs {
-				var seq msgseq
-				if initial {
-					seq = c.sequence(uid)
-					if seq <= 0 {
-						continue
-					}
-				} else {
-					seq = c.xsequence(uid)
+				seq := c.sequence(uid)
+				if seq <= 0 {
+					continue
 				}
 				c.sequenceRemove(seq, uid)
-				if !initial {
-					c.bwritelinef("* %d EXPUNGE", seq)
-				}
 			}
 		case store.ChangeFlags:
 			// The uid can be unknown if we just expunged it while another session marked it as deleted just before.
@@ -1265,7 +1495,12 @@ func (c *conn) applyChanges(changes []store.Change, initial bool) {
 				continue
 			}
 			if !initial {
-				c.bwritelinef("* %d FETCH (UID %d FLAGS %s)", seq, ch.UID, flaglist(ch.Flags, ch.Keywords).pack(c))
+				c.bwritelinef("* %d FETCH (UID %d%s FLAGS %s)", seq, ch.UID, c.modseqAtt(ch.ModSeq), flaglist(ch.Flags, ch.Keywords).pack(c))
+			}
+		case store.ChangeMailboxKeywords:
+			// New keywords in the selected mailbox, we send the full list of flags again.
+			if !initial {
+				c.bwritelinef(`* FLAGS (\Seen \Answered \Flagged \Deleted \Draft $Forwarded $Junk $NotJunk $Phishing $MDNSent%s)`, keywordsSuffix(ch.Keywords))
 			}
 		case store.ChangeRemoveMailbox:
 			// Only announce \NonExistent to modern clients, otherwise they may ignore the
@@ -1284,6 +1519,57 @@ func (c *conn) applyChanges(changes []store.Change, initial bool) {
 			panic(fmt.Sprintf("internal error, missing case for %#v", change))
 		}
 	}
+
+	for _, line := range statusLines {
+		c.bwritelinef("%s", line)
+	}
+}
+
+// keywordsSuffix returns keywords for use in a FLAGS response, with a leading
+// space, or an empty string if there are no keywords.
+func keywordsSuffix(keywords []string) string {
+	if len(keywords) == 0 {
+		return ""
+	}
+	return " " + strings.Join(keywords, " ")
+}
+
+// modseqAtt returns a MODSEQ fetch attribute, with leading space, for use in
+// untagged FETCH responses if CONDSTORE is enabled. Otherwise an empty string is
+// returned.
+func (c *conn) modseqAtt(modseq store.ModSeq) string {
+	if !c.enabled[capCondstore] {
+		return ""
+	}
+	return fmt.Sprintf(" MODSEQ (%d)", modseq.Client())
+}
+
+// xensureCondstore enables CONDSTORE for the session, for commands that
+// implicitly enable it. If a mailbox is selected, its HIGHESTMODSEQ is sent, so
+// the client knows where to start tracking changes. ../rfc/7162
+func (c *conn) xensureCondstore(tx *bstore.Tx) {
+	if c.enabled[capCondstore] {
+		return
+	}
+	c.enabled[capCondstore] = true
+	if c.state != stateSelected {
+		return
+	}
+	var modseq store.ModSeq
+	if tx != nil {
+		modseq = c.xhighestModSeq(tx)
+	} else {
+		c.xdbread(func(tx *bstore.Tx) {
+			modseq = c.xhighestModSeq(tx)
+		})
+	}
+	c.bwritelinef("* OK [HIGHESTMODSEQ %d] after condstore-enabling command", modseq.Client())
+}
+
+func (c *conn) xhighestModSeq(tx *bstore.Tx) store.ModSeq {
+	modseq, err := c.account.HighestModSeq(tx)
+	xcheckf(err, "get highest modseq")
+	return modseq
 }
 
 // Capability returns the capabilities this server implements and currently has
@@ -1307,12 +1593,32 @@ func (c *conn) cmdCapability(tag, cmd string, p *parser) {
 // For use in cmdCapability and untagged OK responses on connection start, login and authenticate.
 func (c *conn) capabilities() string {
 	caps := serverCapabilities
+	limit := int64(math.MaxInt64)
+	if c.account != nil {
+		if l := mox.Conf.MessageSizeLimit(c.userAccountName()); l > 0 {
+			limit = l
+		}
+	}
+	caps += fmt.Sprintf(" APPENDLIMIT=%d", limit)
 	// ../rfc/9051:1238
 	// We only allow starting without TLS when explicitly configured, in violation of RFC.
 	if !c.tls && c.tlsConfig != nil {
 		caps += " STARTTLS"
 	}
-	if c.tls || c.noRequireSTARTTLS {
+	// AUTH=SCRAM-SHA-256: ../rfc/7677 ../rfc/5802
+	// AUTH=SCRAM-SHA-1: ../rfc/5802
+	// AUTH=CRAM-MD5: ../rfc/2195
+	// AUTH=OAUTHBEARER: ../rfc/7628
+	// Mechanisms can be restricted per listener, PLAIN also requires TLS unless configured otherwise.
+	var plain bool
+	for _, mech := range c.authMechanisms() {
+		if mech == "PLAIN" {
+			plain = true
+		} else {
+			caps += " AUTH=" + mech
+		}
+	}
+	if plain {
 		caps += " AUTH=PLAIN"
 	} else {
 		caps += " LOGINDISABLED"
@@ -1320,6 +1626,24 @@ func (c *conn) capabilities() string {
 	return caps
 }
 
+// authMechanisms returns the SASL mechanisms this connection can use, as
+// configured for the listener, with PLAIN and the bearer token mechanisms only
+// if they are allowed without TLS.
+func (c *conn) authMechanisms() []string {
+	l := mox.Conf.Static.Listeners[c.listenerName].AuthMechanisms
+	mechs := config.AuthMechanismsAllowed(l, mox.Conf.Static.OAuth != nil, c.remoteIP, c.tls)
+	if c.tls || c.noRequireSTARTTLS {
+		return mechs
+	}
+	var r []string
+	for _, mech := range mechs {
+		if mech != "PLAIN" && !slices.Contains(config.AuthMechanismsOAuth, mech) {
+			r = append(r, mech)
+		}
+	}
+	return r
+}
+
 // No op, but useful for retrieving pending changes as untagged responses, e.g. of
 // message delivery.
 //
@@ -1378,8 +1702,28 @@ func (c *conn) cmdID(tag, cmd string, p *parser) {
 	}
 	p.xempty()
 
-	// We just log the client id.
+	// We log the client id, and keep the name and version for the remaining log
+	// lines of the connection. Clients should only send a single ID command, we only
+	// count the first for the metric, and only once the connection is authenticated,
+	// so unauthenticated connections cannot inflate it. ../rfc/2971
 	c.log.Info("client id", mlog.Field("params", params))
+	if params != nil && c.clientID == "" && c.clientIDMetric == "" {
+		var name, version string
+		for k, v := range params {
+			// Clients vary in the case of field names.
+			if strings.EqualFold(k, "name") {
+				name = v
+			} else if strings.EqualFold(k, "version") {
+				version = v
+			}
+		}
+		c.clientID = name
+		if version != "" {
+			c.clientID += " " + version
+		}
+		c.clientIDMetric = clientIDLabel(name)
+		c.countClientID()
+	}
 
 	// Response syntax: ../rfc/2971:243
 	// We send our name and version. ../rfc/2971:193
@@ -1387,6 +1731,58 @@ func (c *conn) cmdID(tag, cmd string, p *parser) {
 	c.ok(tag, cmd)
 }
 
+// countClientID increments metricIMAPClientID for the client name from the ID
+// command, if the connection is authenticated and it wasn't counted yet.
+func (c *conn) countClientID() {
+	if c.clientIDMetric == "" || c.state == stateNotAuthenticated {
+		return
+	}
+	metricIMAPClientID.WithLabelValues(c.clientIDMetric).Inc()
+	c.clientIDMetric = ""
+}
+
+// knownClients are substrings of lower case client names from the ID command,
+// with the metric label they are counted under. The first match is used.
+var knownClients = []struct{ match, label string }{
+	{"thunderbird", "thunderbird"},
+	{"k-9", "k-9 mail"},
+	{"fairemail", "fairemail"},
+	{"os x mail", "apple mail"},
+	{"iphone mail", "apple mail"},
+	{"ipad mail", "apple mail"},
+	{"outlook", "outlook"},
+	{"evolution", "evolution"},
+	{"neomutt", "mutt"},
+	{"mutt", "mutt"},
+	{"aerc", "aerc"},
+	{"geary", "geary"},
+	{"kmail", "kmail"},
+	{"akonadi", "kmail"},
+	{"claws mail", "claws mail"},
+	{"mailspring", "mailspring"},
+	{"em client", "em client"},
+	{"roundcube", "roundcube"},
+	{"sogo", "sogo"},
+	{"spark", "spark"},
+	{"bluemail", "bluemail"},
+	{"gmail", "gmail"},
+	{"imapsync", "imapsync"},
+	{"mox", "mox"},
+}
+
+// clientIDLabel returns a metric label value for a client name from the ID
+// command. Remote clients choose the name, so only known clients get their own
+// label, all others are "other".
+func clientIDLabel(name string) string {
+	name = strings.ToLower(name)
+	for _, kc := range knownClients {
+		if strings.Contains(name, kc.match) {
+			return kc.label
+		}
+	}
+	return "other"
+}
+
 // STARTTLS enables TLS on the connection, after a plain text start.
 // Only allowed if TLS isn't already enabled, either through connecting to a
 // TLS-enabled TCP port, or a previous STARTTLS command.
@@ -1427,11 +1823,54 @@ func (c *conn) cmdStarttls(tag, cmd string, p *parser) {
 	c.conn = tlsConn
 	c.tr = moxio.NewTraceReader(c.log, "C: ", c.conn)
 	c.tw = moxio.NewTraceWriter(c.log, "S: ", c)
+	c.tr.SetTranscript(c.transcript)
+	c.tw.SetTranscript(c.transcript)
 	c.br = bufio.NewReader(c.tr)
 	c.bw = bufio.NewWriter(c.tw)
 	c.tls = true
 }
 
+// Compress enables DEFLATE compression of the connection in both directions,
+// starting right after the OK response.
+//
+// Status: Authenticated and selected.
+func (c *conn) cmdCompress(tag, cmd string, p *parser) {
+	// Command: ../rfc/4978 section 3
+
+	// Request syntax: ../rfc/4978 section 4
+	p.xspace()
+	mechanism := p.xatom()
+	p.xempty()
+
+	if !strings.EqualFold(mechanism, "DEFLATE") {
+		xsyntaxErrorf("unknown compression mechanism %q", mechanism)
+	}
+	if c.compress {
+		xusercodeErrorf("COMPRESSIONACTIVE", "compression already active")
+	}
+
+	// The client must wait for our response before sending compressed data, but
+	// pass on any data already read.
+	conn := c.conn
+	if n := c.br.Buffered(); n > 0 {
+		buf := make([]byte, n)
+		_, err := io.ReadFull(c.br, buf)
+		xcheckf(err, "reading buffered data for compression")
+		conn = &prefixConn{buf, conn}
+	}
+	c.ok(tag, cmd)
+	c.log.Debug("compression enabled", mlog.Field("mechanism", "deflate"))
+
+	c.conn = moxio.NewFlateConn(conn)
+	c.tr = moxio.NewTraceReader(c.log, "C: ", c.conn)
+	c.tw = moxio.NewTraceWriter(c.log, "S: ", c)
+	c.tr.SetTranscript(c.transcript)
+	c.tw.SetTranscript(c.transcript)
+	c.br = bufio.NewReader(c.tr)
+	c.bw = bufio.NewWriter(c.tw)
+	c.compress = true
+}
+
 // Authenticate using SASL. Supports multiple back and forths between client and
 // server to finish authentication, unlike LOGIN which is just a single
 // username/password.
@@ -1458,8 +1897,12 @@ func (c *conn) cmdAuthenticate(tag, cmd string, p *parser) {
 	authResult := "error"
 	defer func() {
 		metrics.AuthenticationInc("imap", authVariant, authResult)
+		if authResult == "ok" {
+			c.transcriptOpen(c.account.Name)
+		}
 		switch authResult {
-		case "ok":
+		case "ok", "limit":
+			// Credentials were valid for "limit".
 			mox.LimiterFailedAuth.Reset(c.remoteIP, time.Now())
 		default:
 			mox.LimiterFailedAuth.Add(c.remoteIP, time.Now(), 1)
@@ -1509,14 +1952,18 @@ func (c *conn) cmdAuthenticate(tag, cmd string, p *parser) {
 		return buf
 	}
 
-	switch strings.ToUpper(authType) {
-	case "PLAIN":
-		authVariant = "plain"
-
-		if !c.noRequireSTARTTLS && !c.tls {
+	authType = strings.ToUpper(authType)
+	if config.AuthMechanismKnown(authType) && !slices.Contains(c.authMechanisms(), authType) {
+		if (authType == "PLAIN" || slices.Contains(config.AuthMechanismsOAuth, authType)) && !c.noRequireSTARTTLS && !c.tls {
 			// ../rfc/9051:5194
 			xusercodeErrorf("PRIVACYREQUIRED", "tls required for login")
 		}
+		xusercodeErrorf("CANNOT", "authentication mechanism %s not allowed for this connection", authType)
+	}
+
+	switch authType {
+	case "PLAIN":
+		authVariant = "plain"
 
 		// Plain text passwords, mark as traceauth.
 		defer c.xtrace(mlog.LevelTraceauth)()
@@ -1540,6 +1987,10 @@ func (c *conn) cmdAuthenticate(tag, cmd string, p *parser) {
 				authResult = "badcreds"
 				c.log.Info("authentication failed", mlog.Field("username", authc))
 				xusercodeErrorf("AUTHENTICATIONFAILED", "bad credentials")
+			} else if errors.Is(err, store.ErrAccountSuspended) {
+				authResult = "suspended"
+				c.log.Info("authentication for suspended account", mlog.Field("username", authc))
+				xusercodeErrorf("CONTACTADMIN", "account is suspended")
 			}
 			xusercodeErrorf("", "error")
 		}
@@ -1579,7 +2030,7 @@ func (c *conn) cmdAuthenticate(tag, cmd string, p *parser) {
 		}()
 		var ipadhash, opadhash hash.Hash
 		acc.WithRLock(func() {
-			err := acc.DB.Read(context.TODO(), func(tx *bstore.Tx) error {
+			err := store.DBRead(context.TODO(), c.log, "imapserver", acc.DB, func(tx *bstore.Tx) error {
 				password, err := bstore.QueryTx[store.Password](tx).Get()
 				if err == bstore.ErrAbsent {
 					c.log.Info("failed authentication attempt", mlog.Field("username", addr), mlog.Field("remote", c.remoteIP))
@@ -1652,7 +2103,7 @@ func (c *conn) cmdAuthenticate(tag, cmd string, p *parser) {
 		}
 		var xscram store.SCRAM
 		acc.WithRLock(func() {
-			err := acc.DB.Read(context.TODO(), func(tx *bstore.Tx) error {
+			err := store.DBRead(context.TODO(), c.log, "imapserver", acc.DB, func(tx *bstore.Tx) error {
 				password, err := bstore.QueryTx[store.Password](tx).Get()
 				if authVariant == "scram-sha-1" {
 					xscram = password.SCRAMSHA1
@@ -1694,15 +2145,78 @@ func (c *conn) cmdAuthenticate(tag, cmd string, p *parser) {
 		acc = nil // Cancel cleanup.
 		c.username = ss.Authentication
 
+	case "OAUTHBEARER", "XOAUTH2":
+		authVariant = strings.ToLower(authType)
+
+		// Bearer tokens are credentials, mark as traceauth.
+		defer c.xtrace(mlog.LevelTraceauth)()
+		buf := xreadInitial()
+		c.xtrace(mlog.LevelTrace) // Restore.
+		var authz, token string
+		var err error
+		if authType == "OAUTHBEARER" {
+			authz, token, err = oauth.ParseOAuthBearer(buf)
+		} else {
+			authz, token, err = oauth.ParseXOAuth2(buf)
+		}
+		if err != nil {
+			xsyntaxErrorf("parsing %s: %v", authVariant, err)
+		}
+
+		username, err := mox.Conf.Static.OAuth.Validator.Validate(context.TODO(), token)
+		if err != nil && errors.Is(err, oauth.ErrInvalidToken) {
+			authResult = "badcreds"
+			c.log.Infox("authentication with invalid token", err, mlog.Field("authz", authz), mlog.Field("remote", c.remoteIP))
+			// The error is sent as challenge, the client responds with a dummy line.
+			// ../rfc/7628 section 3.2.2
+			c.writelinef("+ %s", base64.StdEncoding.EncodeToString(oauth.ErrorChallenge()))
+			c.readline(false)
+			xusercodeErrorf("AUTHENTICATIONFAILED", "bad credentials")
+		} else if err != nil {
+			c.log.Errorx("validating token", err)
+			xusercodeErrorf("UNAVAILABLE", "token validation temporarily unavailable")
+		}
+		if authz != "" && !strings.EqualFold(authz, username) {
+			authResult = "badcreds"
+			xusercodeErrorf("AUTHORIZATIONFAILED", "token is for another user")
+		}
+
+		acc, _, err := store.OpenEmail(username)
+		if err != nil {
+			if errors.Is(err, store.ErrUnknownCredentials) {
+				authResult = "badcreds"
+				c.log.Info("authentication with token for unknown user", mlog.Field("username", username), mlog.Field("remote", c.remoteIP))
+				xusercodeErrorf("AUTHENTICATIONFAILED", "bad credentials")
+			}
+			xserverErrorf("looking up address: %v", err)
+		}
+		c.account = acc
+		c.username = username
+
 	default:
 		xuserErrorf("method not supported")
 	}
 
+	// CRAM-MD5, SCRAM and the bearer token mechanisms verify credentials without
+	// store.OpenEmailAuth.
+	if c.account.Suspended() {
+		err := c.account.Close()
+		c.xsanity(err, "close account")
+		c.account = nil
+		c.username = ""
+		authResult = "suspended"
+		xusercodeErrorf("CONTACTADMIN", "account is suspended")
+	}
+
 	c.setSlow(false)
-	authResult = "ok"
 	c.authFailed = 0
+	authResult = "limit"
+	c.xaccountConnAdd()
+	authResult = "ok"
 	c.comm = store.RegisterComm(c.account)
 	c.state = stateAuthenticated
+	c.countClientID()
+	c.writeNoticesAuthenticated()
 	c.writeresultf("%s OK [CAPABILITY %s] authenticate done", tag, c.capabilities())
 }
 
@@ -1715,6 +2229,9 @@ func (c *conn) cmdLogin(tag, cmd string, p *parser) {
 	authResult := "error"
 	defer func() {
 		metrics.AuthenticationInc("imap", "login", authResult)
+		if authResult == "ok" {
+			c.transcriptOpen(c.account.Name)
+		}
 	}()
 
 	// todo: get this line logged with traceauth. the plaintext password is included on the command line, which we've already read (before dispatching to this function).
@@ -1730,6 +2247,10 @@ func (c *conn) cmdLogin(tag, cmd string, p *parser) {
 		// ../rfc/9051:5194
 		xusercodeErrorf("PRIVACYREQUIRED", "tls required for login")
 	}
+	// LOGIN sends the password in plain text, like PLAIN, and is allowed when PLAIN is.
+	if !slices.Contains(c.authMechanisms(), "PLAIN") {
+		xusercodeErrorf("CANNOT", "login not allowed for this connection")
+	}
 
 	// For many failed auth attempts, slow down verification attempts.
 	if c.authFailed > 3 && authFailDelay > 0 {
@@ -1751,6 +2272,10 @@ func (c *conn) cmdLogin(tag, cmd string, p *parser) {
 		if errors.Is(err, store.ErrUnknownCredentials) {
 			code = "AUTHENTICATIONFAILED"
 			c.log.Info("failed authentication attempt", mlog.Field("username", userid), mlog.Field("remote", c.remoteIP))
+		} else if errors.Is(err, store.ErrAccountSuspended) {
+			authResult = "suspended"
+			code = "CONTACTADMIN"
+			c.log.Info("login for suspended account", mlog.Field("username", userid))
 		}
 		xusercodeErrorf(code, "login failed")
 	}
@@ -1758,12 +2283,62 @@ func (c *conn) cmdLogin(tag, cmd string, p *parser) {
 	c.username = userid
 	c.authFailed = 0
 	c.setSlow(false)
+	authResult = "limit"
+	c.xaccountConnAdd()
 	c.comm = store.RegisterComm(acc)
 	c.state = stateAuthenticated
 	authResult = "ok"
+	c.countClientID()
+	c.writeNoticesAuthenticated()
 	c.writeresultf("%s OK [CAPABILITY %s] login done", tag, c.capabilities())
 }
 
+// writeNoticesAuthenticated writes (without flushing) configured notices for
+// the domains of the just authenticated account.
+func (c *conn) writeNoticesAuthenticated() {
+	for _, text := range mox.Notices("imap", c.listenerName, c.account.Name) {
+		c.bwritelinef("* OK [ALERT] %s", text)
+	}
+}
+
+// Unauthenticate closes the selected mailbox, if any, and the account, returning
+// the connection to the not authenticated state. The connection, including TLS
+// and compression, can then be reused to authenticate as another user.
+//
+// State: Authenticated and selected.
+func (c *conn) cmdUnauthenticate(tag, cmd string, p *parser) {
+	// Command: ../rfc/8437
+
+	p.xempty()
+
+	c.unselect()
+	c.accountConnRemove()
+	c.comm.Unregister()
+	err := c.account.Close()
+	c.xsanity(err, "closing account")
+	c.account = nil
+	c.comm = nil
+	c.username = ""
+	c.notify = nil
+	c.searchResult = nil
+	c.readonly = false
+	// Extensions enabled with ENABLE are no longer in effect. ../rfc/8437
+	c.enabled = map[capability]bool{}
+	c.state = stateNotAuthenticated
+	c.ok(tag, cmd)
+
+	// A transcript started for the account must not get the session of a next
+	// login, possibly for another account. We start a new transcript if the remote IP
+	// is traced.
+	c.xflush()
+	err = c.transcript.Close()
+	c.log.Check(err, "closing protocol transcript")
+	c.transcript = nil
+	c.tr.SetTranscript(nil)
+	c.tw.SetTranscript(nil)
+	c.transcriptOpen("")
+}
+
 // Enable explicitly opts in to an extension. A server can typically send new kinds
 // of responses to a client. Most extensions do not require an ENABLE because a
 // client implicitly opts in to new response syntax by making a requests that uses
@@ -1791,6 +2366,14 @@ func (c *conn) cmdEnable(tag, cmd string, p *parser) {
 		case capIMAP4rev2, capUTF8Accept:
 			c.enabled[cap] = true
 			enabled += " " + s
+		case capCondstore:
+			c.xensureCondstore(nil)
+			enabled += " " + s
+		case capQresync:
+			// QRESYNC implies CONDSTORE. ../rfc/7162
+			c.enabled[capQresync] = true
+			c.xensureCondstore(nil)
+			enabled += " " + s
 		}
 	}
 
@@ -1822,8 +2405,32 @@ func (c *conn) cmdSelectExamine(isselect bool, tag, cmd string, p *parser) {
 	// Examine request syntax: ../rfc/9051:6551 ../rfc/3501:4746
 	p.xspace()
 	name := p.xmailbox()
+	// Select parameters. ../rfc/7162 ../rfc/4466
+	var condstore bool
+	var qrs *qresyncParams
+	if p.take(" (") {
+		for {
+			w := p.xtakelist("CONDSTORE", "QRESYNC")
+			switch w {
+			case "CONDSTORE":
+				condstore = true
+			case "QRESYNC":
+				p.xspace()
+				qrs = p.xqresyncParams()
+			}
+			if !p.take(" ") {
+				break
+			}
+		}
+		p.xtake(")")
+	}
 	p.xempty()
 
+	// ../rfc/7162
+	if qrs != nil && !c.enabled[capQresync] {
+		xsyntaxErrorf("QRESYNC must be enabled before use in select/examine")
+	}
+
 	// Deselect before attempting the new select. This means we will deselect when an
 	// error occurs during select.
 	// ../rfc/9051:1809
@@ -1833,18 +2440,53 @@ func (c *conn) cmdSelectExamine(isselect bool, tag, cmd string, p *parser) {
 		c.unselect()
 	}
 
-	name = xcheckmailboxname(name, true)
+	// For a shared mailbox, we operate on the account of its owner, with its own
+	// comm for changes.
+	var shared *sharedMailbox
+	if owner, mbname, ok := c.xsharedMailboxName(name); ok {
+		acc, _, rights := c.xsharedOpen(owner, mbname, "r")
+		comm := store.RegisterComm(acc)
+		shared = &sharedMailbox{acc, comm, c.sharedMailboxPrefix(owner), rights}
+		c.swapAccount(acc, comm)
+		defer func() {
+			c.unswap()
+			if c.shared == nil {
+				comm.Unregister()
+				err := acc.Close()
+				c.xsanity(err, "closing account of shared mailbox")
+			}
+		}()
+		name = mbname
+	} else {
+		name = xcheckmailboxname(name, true)
+	}
+
+	if condstore {
+		c.enabled[capCondstore] = true
+	}
 
 	var firstUnseen msgseq = 0
 	var mb store.Mailbox
+	var highestModSeq store.ModSeq
+	var vanished []store.UID       // For QRESYNC, expunged since the modseq of the client.
+	var qrsChanged []store.Message // For QRESYNC, changed since the modseq of the client.
 	c.account.WithRLock(func() {
 		c.xdbread(func(tx *bstore.Tx) {
 			mb = c.xmailbox(tx, name, "")
+			highestModSeq = c.xhighestModSeq(tx)
+
+			// With a matching UIDVALIDITY, the client only needs the changes since its last
+			// synchronization. ../rfc/7162
+			qrsMatch := qrs != nil && qrs.uidValidity == mb.UIDValidity
+			qrsKnown := func(uid store.UID) bool {
+				return qrs.knownUIDs == nil || qrs.knownUIDs.containsKnownUID(uid)
+			}
 
 			q := bstore.QueryTx[store.Message](tx)
 			q.FilterNonzero(store.Message{MailboxID: mb.ID})
 			q.SortAsc("UID")
 			c.uids = []store.UID{}
+			c.searchCache = nil
 			var seq msgseq = 1
 			err := q.ForEach(func(m store.Message) error {
 				c.uids = append(c.uids, m.UID)
@@ -1852,21 +2494,33 @@ func (c *conn) cmdSelectExamine(isselect bool, tag, cmd string, p *parser) {
 					firstUnseen = seq
 				}
 				seq++
+				if qrsMatch && m.ModSeq.Client() > qrs.modseq && qrsKnown(m.UID) {
+					qrsChanged = append(qrsChanged, m)
+				}
 				return nil
 			})
 			if sanityChecks {
 				checkUIDs(c.uids)
 			}
 			xcheckf(err, "fetching uids")
+
+			if qrsMatch {
+				qeu := bstore.QueryTx[store.ExpungedUID](tx)
+				qeu.FilterNonzero(store.ExpungedUID{MailboxID: mb.ID})
+				qeu.FilterGreater("ModSeq", store.ModSeq(qrs.modseq))
+				err := qeu.ForEach(func(eu store.ExpungedUID) error {
+					if qrsKnown(eu.UID) {
+						vanished = append(vanished, eu.UID)
+					}
+					return nil
+				})
+				xcheckf(err, "listing expunged uids")
+			}
 		})
 	})
 	c.applyChanges(c.comm.Get(), true)
 
-	var flags string
-	if len(mb.Keywords) > 0 {
-		flags = " " + strings.Join(mb.Keywords, " ")
-	}
-	c.bwritelinef(`* FLAGS (\Seen \Answered \Flagged \Deleted \Draft $Forwarded $Junk $NotJunk $Phishing $MDNSent%s)`, flags)
+	c.bwritelinef(`* FLAGS (\Seen \Answered \Flagged \Deleted \Draft $Forwarded $Junk $NotJunk $Phishing $MDNSent%s)`, keywordsSuffix(mb.Keywords))
 	c.bwritelinef(`* OK [PERMANENTFLAGS (\Seen \Answered \Flagged \Deleted \Draft $Forwarded $Junk $NotJunk $Phishing $MDNSent \*)] x`)
 	if !c.enabled[capIMAP4rev2] {
 		c.bwritelinef(`* 0 RECENT`)
@@ -1878,8 +2532,29 @@ func (c *conn) cmdSelectExamine(isselect bool, tag, cmd string, p *parser) {
 	}
 	c.bwritelinef(`* OK [UIDVALIDITY %d] x`, mb.UIDValidity)
 	c.bwritelinef(`* OK [UIDNEXT %d] x`, mb.UIDNext)
-	c.bwritelinef(`* LIST () "/" %s`, astring(mb.Name).pack(c))
-	if isselect {
+	if c.enabled[capCondstore] {
+		// ../rfc/7162
+		c.bwritelinef(`* OK [HIGHESTMODSEQ %d] x`, highestModSeq.Client())
+	}
+	// ../rfc/8474
+	c.bwritelinef(`* OK [MAILBOXID (%s)] x`, mb.ObjectID())
+	listName := mb.Name
+	if shared != nil {
+		listName = shared.prefix + mb.Name
+	}
+	c.bwritelinef(`* LIST () "/" %s`, astring(listName).pack(c))
+	if len(vanished) > 0 {
+		// ../rfc/7162
+		sort.Slice(vanished, func(i, j int) bool {
+			return vanished[i] < vanished[j]
+		})
+		c.bwritelinef("* VANISHED (EARLIER) %s", compactUIDSet(vanished).String())
+	}
+	for _, m := range qrsChanged {
+		c.bwritelinef("* %d FETCH (UID %d FLAGS %s MODSEQ (%d))", c.xsequence(m.UID), m.UID, flaglist(m.Flags, m.Keywords).pack(c), m.ModSeq.Client())
+	}
+	// Without rights to change messages, a shared mailbox is read-only. ../rfc/4314 section 4
+	if isselect && !c.readOnlyAccount() && (shared == nil || strings.ContainsAny(shared.rights, "swte")) {
 		c.bwriteresultf("%s OK [READ-WRITE] x", tag)
 		c.readonly = false
 	} else {
@@ -1888,6 +2563,7 @@ func (c *conn) cmdSelectExamine(isselect bool, tag, cmd string, p *parser) {
 	}
 	c.mailboxID = mb.ID
 	c.state = stateSelected
+	c.shared = shared
 	c.searchResult = nil
 	c.xflush()
 }
@@ -1902,15 +2578,46 @@ func (c *conn) cmdCreate(tag, cmd string, p *parser) {
 	// Request syntax: ../rfc/9051:6484 ../rfc/6154:468 ../rfc/4466:500 ../rfc/3501:4687
 	p.xspace()
 	name := p.xmailbox()
-	// todo: support CREATE-SPECIAL-USE ../rfc/6154:296
+	// Special-use attributes for the new mailbox. ../rfc/6154:296
+	var useAttrs []string
+	if p.space() {
+		p.xtake("(")
+		for {
+			p.xtake("USE")
+			p.xspace()
+			p.xtake("(")
+			for !p.take(")") {
+				if len(useAttrs) > 0 {
+					p.xspace()
+				}
+				p.xtake(`\`)
+				useAttrs = append(useAttrs, `\`+p.xatom())
+			}
+			if !p.space() {
+				break
+			}
+		}
+		p.xtake(")")
+	}
 	p.xempty()
 
 	origName := name
 	name = strings.TrimRight(name, "/") // ../rfc/9051:1930
 	name = xcheckmailboxname(name, false)
+	c.xcheckOwnMailboxName(name)
+
+	var specialUse store.SpecialUse
+	for _, attr := range useAttrs {
+		if !specialUse.Add(attr) {
+			// ../rfc/6154:324
+			xusercodeErrorf("USEATTR", "special-use attribute %s not supported", attr)
+		}
+	}
 
 	var changes []store.Change
 	var created []string // Created mailbox names.
+	var mailboxID string // Object ID of the requested mailbox.
+	var mailbox store.Mailbox
 
 	c.account.WithWLock(func() {
 		c.xdbwrite(func(tx *bstore.Tx) {
@@ -1930,10 +2637,17 @@ func (c *conn) cmdCreate(tag, cmd string, p *parser) {
 					}
 					continue
 				}
-				_, nchanges, err := c.account.MailboxEnsure(tx, p, true)
+				mb, nchanges, err := c.account.MailboxEnsure(tx, p, true)
 				xcheckf(err, "ensuring mailbox exists")
 				changes = append(changes, nchanges...)
 				created = append(created, p)
+				mailboxID = mb.ObjectID()
+				mailbox = mb
+			}
+			if len(useAttrs) > 0 {
+				// Other mailboxes with these special-uses lose them.
+				err := c.account.MailboxSpecialUseSet(tx, &mailbox, specialUse)
+				xcheckf(err, "setting special-use of mailbox")
 			}
 		})
 
@@ -1945,9 +2659,14 @@ func (c *conn) cmdCreate(tag, cmd string, p *parser) {
 		if n == name && name != origName && !(name == "Inbox" || strings.HasPrefix(name, "Inbox/")) {
 			more = fmt.Sprintf(` ("OLDNAME" (%s))`, string0(origName).pack(c))
 		}
-		c.bwritelinef(`* LIST (\Subscribed) "/" %s%s`, astring(n).pack(c), more)
+		flags := []string{`\Subscribed`}
+		if n == name {
+			flags = append(flags, specialUseFlags(mailbox)...)
+		}
+		c.bwritelinef(`* LIST (%s) "/" %s%s`, strings.Join(flags, " "), astring(n).pack(c), more)
 	}
-	c.ok(tag, cmd)
+	// ../rfc/8474
+	c.writeresultf("%s OK [MAILBOXID (%s)] created", tag, mailboxID)
 }
 
 // Delete removes a mailbox and all its messages.
@@ -1968,11 +2687,14 @@ func (c *conn) cmdDelete(tag, cmd string, p *parser) {
 	// Messages to remove after having broadcasted the removal of messages.
 	var remove []store.Message
 
+	var mailboxID int64
+
 	c.account.WithWLock(func() {
-		var mb store.Mailbox
+		var changes []store.Change
 
 		c.xdbwrite(func(tx *bstore.Tx) {
-			mb = c.xmailbox(tx, name, "NONEXISTENT")
+			mb := c.xmailbox(tx, name, "NONEXISTENT")
+			mailboxID = mb.ID
 
 			// Look for existence of child mailboxes. There is a lot of text in the RFCs about
 			// NoInferior and NoSelect. We just require only leaf mailboxes are deleted.
@@ -1992,21 +2714,46 @@ func (c *conn) cmdDelete(tag, cmd string, p *parser) {
 			remove, err = qm.List()
 			xcheckf(err, "listing messages to remove")
 
+			if len(remove) > 0 && c.account.OnHold() {
+				xusercodeErrorf("CANNOT", "%s", store.ErrHold)
+			}
+
 			if len(remove) > 0 {
 				removeIDs := make([]any, len(remove))
+				uids := make([]store.UID, len(remove))
 				for i, m := range remove {
 					removeIDs[i] = m.ID
+					uids[i] = m.UID
 				}
+				// Sessions that have the mailbox selected get expunges for all messages, keeping
+				// their message sequence numbers in sync.
+				modseq, err := c.account.NextModSeq(tx)
+				xcheckf(err, "assigning modseq")
+				changes = append(changes, store.ChangeRemoveUIDs{MailboxID: mb.ID, UIDs: uids, ModSeq: modseq})
+
 				qmr := bstore.QueryTx[store.Recipient](tx)
 				qmr.FilterEqual("MessageID", removeIDs...)
 				_, err = qmr.Delete()
 				xcheckf(err, "removing message recipients for messages")
+				ids := make([]int64, len(remove))
+				for i, m := range remove {
+					ids[i] = m.ID
+				}
+				err = store.TextIndexRemove(tx, ids)
+				xcheckf(err, "removing messages from full-text index")
 
 				qm = bstore.QueryTx[store.Message](tx)
 				qm.FilterNonzero(store.Message{MailboxID: mb.ID})
 				_, err = qm.Delete()
 				xcheckf(err, "removing messages")
 
+				var size int64
+				for _, m := range remove {
+					size += m.Size
+				}
+				err = c.account.AddMessageUsage(tx, -int64(len(remove)), -size)
+				xcheckf(err, "updating disk usage")
+
 				// Mark messages as not needing training. Then retrain them, so that are untrained if they were.
 				for i := range remove {
 					remove[i].Junk = false
@@ -2014,13 +2761,34 @@ func (c *conn) cmdDelete(tag, cmd string, p *parser) {
 				}
 				err = c.account.RetrainMessages(context.TODO(), c.log, tx, remove, true)
 				xcheckf(err, "untraining deleted messages")
+
+				err = c.account.RecordRemoved(tx, remove, modseq)
+				xcheckf(err, "recording removed messages")
 			}
 
+			qeu := bstore.QueryTx[store.ExpungedUID](tx)
+			qeu.FilterNonzero(store.ExpungedUID{MailboxID: mb.ID})
+			_, err = qeu.Delete()
+			xcheckf(err, "removing expunged uids of mailbox")
+
+			_, err = bstore.QueryTx[store.Annotation](tx).FilterNonzero(store.Annotation{MailboxID: mb.ID}).Delete()
+			xcheckf(err, "removing annotations of mailbox")
+
+			_, err = bstore.QueryTx[store.MailboxACL](tx).FilterNonzero(store.MailboxACL{MailboxID: mb.ID}).Delete()
+			xcheckf(err, "removing access rights of mailbox")
+
+			err = store.URLAuthKeyReset(tx, mb.ID)
+			xcheckf(err, "removing urlauth key of mailbox")
+
+			err = store.MailboxCountsRemoveMailbox(tx, mb.ID)
+			xcheckf(err, "removing counts of mailbox")
+
 			err = tx.Delete(&store.Mailbox{ID: mb.ID})
 			xcheckf(err, "removing mailbox")
 		})
 
-		c.broadcast([]store.Change{store.ChangeRemoveMailbox{Name: name}})
+		changes = append(changes, store.ChangeRemoveMailbox{Name: name})
+		c.broadcast(changes)
 	})
 
 	for _, m := range remove {
@@ -2029,14 +2797,25 @@ func (c *conn) cmdDelete(tag, cmd string, p *parser) {
 		c.log.Check(err, "removing message file for mailbox delete", mlog.Field("path", p))
 	}
 
+	// If we deleted our own selected mailbox, its messages are gone for us too.
+	if c.isSelected(mailboxID) {
+		uids := make([]store.UID, len(remove))
+		for i, m := range remove {
+			uids[i] = m.UID
+		}
+		c.xwriteExpunged(uids)
+	}
+
 	c.ok(tag, cmd)
 }
 
 // Rename changes the name of a mailbox.
 // Renaming INBOX is special, it moves the inbox messages to a new mailbox, leaving inbox empty.
 // Renaming a mailbox with submailboxes also renames all submailboxes.
-// Subscriptions stay with the old name, though newly created missing parent
-// mailboxes for the destination name are automatically subscribed.
+// Subscriptions of renamed mailboxes move to the new name, and newly created
+// missing parent mailboxes for the destination name are automatically
+// subscribed. Other sessions get LIST responses with the OLDNAME extended data
+// item, with the subscription and special-use attributes under the new name.
 //
 // State: Authenticated and selected.
 func (c *conn) cmdRename(tag, cmd string, p *parser) {
@@ -2052,6 +2831,7 @@ func (c *conn) cmdRename(tag, cmd string, p *parser) {
 
 	src = xcheckmailboxname(src, true)
 	dst = xcheckmailboxname(dst, false)
+	c.xcheckOwnMailboxName(dst)
 
 	c.account.WithWLock(func() {
 		var changes []store.Change
@@ -2089,31 +2869,42 @@ func (c *conn) cmdRename(tag, cmd string, p *parser) {
 
 				// Move existing messages, with their ID's and on-disk files intact, to the new
 				// mailbox.
+				modseq, err := c.account.NextModSeq(tx)
+				xcheckf(err, "assigning modseq")
 				var oldUIDs []store.UID
+				now := time.Now()
 				q := bstore.QueryTx[store.Message](tx)
 				q.FilterNonzero(store.Message{MailboxID: srcMB.ID})
 				q.SortAsc("UID")
 				err = q.ForEach(func(m store.Message) error {
 					oldUIDs = append(oldUIDs, m.UID)
+					if err := store.MailboxCountsRemove(tx, m); err != nil {
+						return err
+					}
 					m.MailboxID = dstMB.ID
+					m.SaveDate = now
 					m.UID = dstMB.UIDNext
+					m.ModSeq = modseq
 					dstMB.UIDNext++
 					if err := tx.Update(&m); err != nil {
 						return fmt.Errorf("updating message to move to new mailbox: %w", err)
 					}
-					return nil
+					return store.MailboxCountsAdd(tx, m)
 				})
 				xcheckf(err, "moving messages from inbox to destination mailbox")
 
 				err = tx.Update(&dstMB)
 				xcheckf(err, "updating uidnext in destination mailbox")
 
+				err = c.account.RecordExpunged(tx, srcMB.ID, oldUIDs, modseq)
+				xcheckf(err, "recording expunged messages")
+
 				var dstFlags []string
 				if tx.Get(&store.Subscription{Name: dstMB.Name}) == nil {
 					dstFlags = []string{`\Subscribed`}
 				}
 				changes = []store.Change{
-					store.ChangeRemoveUIDs{MailboxID: srcMB.ID, UIDs: oldUIDs},
+					store.ChangeRemoveUIDs{MailboxID: srcMB.ID, UIDs: oldUIDs, ModSeq: modseq},
 					store.ChangeAddMailbox{Name: dstMB.Name, Flags: dstFlags},
 					// todo: in future, we could announce all messages. no one is listening now though.
 				}
@@ -2187,11 +2978,22 @@ func (c *conn) cmdRename(tag, cmd string, p *parser) {
 				err = tx.Update(&srcmb)
 				xcheckf(err, "renaming mailbox")
 
-				// Renaming Inbox is special, it leaves an empty inbox instead of removing it.
+				// The subscription moves along with the mailbox.
+				err = tx.Delete(&store.Subscription{Name: srcName})
+				if err == nil {
+					err = tx.Insert(&store.Subscription{Name: dstName})
+					if err != nil && !errors.Is(err, bstore.ErrUnique) {
+						xcheckf(err, "adding subscription for renamed mailbox")
+					}
+				} else if err != bstore.ErrAbsent {
+					xcheckf(err, "removing subscription for old mailbox name")
+				}
+
 				var dstFlags []string
 				if tx.Get(&store.Subscription{Name: dstName}) == nil {
 					dstFlags = []string{`\Subscribed`}
 				}
+				dstFlags = append(dstFlags, specialUseFlags(srcmb)...)
 				changes = append(changes, store.ChangeRenameMailbox{OldName: srcName, NewName: dstName, Flags: dstFlags})
 			}
 
@@ -2206,6 +3008,11 @@ func (c *conn) cmdRename(tag, cmd string, p *parser) {
 				}
 				err = tx.Insert(&mb)
 				xcheckf(err, "creating mailbox at old path")
+				var flags []string
+				if tx.Get(&store.Subscription{Name: xsrc}) == nil {
+					flags = []string{`\Subscribed`}
+				}
+				changes = append(changes, store.ChangeAddMailbox{Name: xsrc, Flags: flags})
 				xsrc += "/" + dstElems[len(srcElems)+i]
 			}
 		})
@@ -2348,8 +3155,10 @@ func (c *conn) cmdLsub(tag, cmd string, p *parser) {
 	c.ok(tag, cmd)
 }
 
-// The namespace command returns the mailbox path separator. We only implement
-// the personal mailbox hierarchy, no shared/other.
+// The namespace command returns the mailbox path separator. We implement the
+// personal mailbox hierarchy, the "other users" namespace with mailboxes
+// shared by other accounts, and the "shared" namespace with public folders if an
+// account with public folders is configured.
 //
 // In IMAP4rev2, it was an extension before.
 //
@@ -2361,7 +3170,12 @@ func (c *conn) cmdNamespace(tag, cmd string, p *parser) {
 	p.xempty()
 
 	// Response syntax: ../rfc/9051:6778 ../rfc/2342:415
-	c.bwritelinef(`* NAMESPACE (("" "/")) NIL NIL`)
+	ns := c.namespaces()
+	public := "NIL"
+	if ns.publicAccount != "" {
+		public = fmt.Sprintf(`((%s "/"))`, string0(ns.public).pack(c))
+	}
+	c.bwritelinef(`* NAMESPACE (("" "/")) ((%s "/")) %s`, string0(ns.shared).pack(c), public)
 	c.ok(tag, cmd)
 }
 
@@ -2386,6 +3200,20 @@ func (c *conn) cmdStatus(tag, cmd string, p *parser) {
 	}
 	p.xempty()
 
+	// Status of a shared mailbox needs the read right and is gathered from the
+	// account of the owner.
+	var prefix string
+	if owner, mbname, ok := c.xsharedMailboxName(name); ok {
+		acc, _, _ := c.xsharedOpen(owner, mbname, "r")
+		defer func() {
+			err := acc.Close()
+			c.xsanity(err, "closing account of shared mailbox")
+		}()
+		c.swapAccount(acc, nil)
+		defer c.unswap()
+		prefix = c.sharedMailboxPrefix(owner)
+		name = mbname
+	}
 	name = xcheckmailboxname(name, true)
 
 	var mb store.Mailbox
@@ -2394,7 +3222,13 @@ func (c *conn) cmdStatus(tag, cmd string, p *parser) {
 	c.account.WithRLock(func() {
 		c.xdbread(func(tx *bstore.Tx) {
 			mb = c.xmailbox(tx, name, "")
+			mb.Name = prefix + mb.Name
 			responseLine = c.xstatusLine(tx, mb, attrs)
+			for _, a := range attrs {
+				if strings.EqualFold(a, "HIGHESTMODSEQ") {
+					c.xensureCondstore(tx)
+				}
+			}
 		})
 	})
 
@@ -2404,45 +3238,44 @@ func (c *conn) cmdStatus(tag, cmd string, p *parser) {
 
 // Response syntax: ../rfc/9051:6681 ../rfc/9051:7070 ../rfc/9051:7059 ../rfc/3501:4834
 func (c *conn) xstatusLine(tx *bstore.Tx, mb store.Mailbox, attrs []string) string {
-	var count, unseen, deleted int
-	var size int64
-
-	q := bstore.QueryTx[store.Message](tx)
-	q.FilterNonzero(store.Message{MailboxID: mb.ID})
-	err := q.ForEach(func(m store.Message) error {
-		count++
-		if !m.Seen {
-			unseen++
-		}
-		if m.Deleted {
-			deleted++
-		}
-		size += m.Size
-		return nil
-	})
-	xcheckf(err, "processing mailbox messages")
+	// Counts are kept up to date with the messages, no need to go through them.
+	mc, err := store.MailboxCountsGet(tx, mb.ID)
+	xcheckf(err, "get mailbox counts")
 
 	status := []string{}
 	for _, a := range attrs {
 		A := strings.ToUpper(a)
 		switch A {
 		case "MESSAGES":
-			status = append(status, A, fmt.Sprintf("%d", count))
+			status = append(status, A, fmt.Sprintf("%d", mc.Messages))
 		case "UIDNEXT":
 			status = append(status, A, fmt.Sprintf("%d", mb.UIDNext))
 		case "UIDVALIDITY":
 			status = append(status, A, fmt.Sprintf("%d", mb.UIDValidity))
 		case "UNSEEN":
-			status = append(status, A, fmt.Sprintf("%d", unseen))
+			status = append(status, A, fmt.Sprintf("%d", mc.Unseen))
 		case "DELETED":
-			status = append(status, A, fmt.Sprintf("%d", deleted))
+			status = append(status, A, fmt.Sprintf("%d", mc.Deleted))
 		case "SIZE":
-			status = append(status, A, fmt.Sprintf("%d", size))
+			status = append(status, A, fmt.Sprintf("%d", mc.Size))
+		case "DELETED-STORAGE":
+			// In units of 1024 bytes, like the STORAGE quota resource. ../rfc/9208 section 4.2.2
+			status = append(status, A, fmt.Sprintf("%d", (mc.DeletedSize+1023)/1024))
 		case "RECENT":
 			status = append(status, A, "0")
 		case "APPENDLIMIT":
-			// ../rfc/7889:255
-			status = append(status, A, "NIL")
+			// For shared mailboxes, the limit of the owner. ../rfc/7889:255
+			if limit := mox.Conf.MessageSizeLimit(c.account.Name); limit > 0 {
+				status = append(status, A, fmt.Sprintf("%d", limit))
+			} else {
+				status = append(status, A, "NIL")
+			}
+		case "HIGHESTMODSEQ":
+			// ../rfc/7162
+			status = append(status, A, fmt.Sprintf("%d", c.xhighestModSeq(tx).Client()))
+		case "MAILBOXID":
+			// ../rfc/8474
+			status = append(status, A, "("+mb.ObjectID()+")")
 		default:
 			xsyntaxErrorf("unknown attribute %q", a)
 		}
@@ -2503,90 +3336,245 @@ func flaglist(fl store.Flags, keywords []string) listspace {
 	return l
 }
 
-// Append adds a message to a mailbox.
-//
-// State: Authenticated and selected.
-func (c *conn) cmdAppend(tag, cmd string, p *parser) {
-	// Command: ../rfc/9051:3406 ../rfc/6855:204 ../rfc/3501:2527
-	// Examples: ../rfc/9051:3482 ../rfc/3501:2589
+// appendMsg is a message for APPEND or REPLACE, read into a temporary file.
+type appendMsg struct {
+	storeFlags store.Flags
+	keywords   []string
+	tm         time.Time
+	file       *os.File
+	size       int64
+	msgPrefix  []byte
+}
 
-	// Request syntax: ../rfc/9051:6325 ../rfc/6855:219 ../rfc/3501:4547
-	p.xspace()
-	name := p.xmailbox()
-	p.xspace()
-	var storeFlags store.Flags
-	var keywords []string
+// xremove removes the temporary file, if it wasn't delivered.
+func (a *appendMsg) xremove(c *conn) {
+	if a.file != nil {
+		err := os.Remove(a.file.Name())
+		c.xsanity(err, "removing APPEND temporary file")
+		err = a.file.Close()
+		c.xsanity(err, "closing APPEND temporary file")
+		a.file = nil
+	}
+}
+
+// xreadAppendMessage reads the optional flags and date, and the message data of
+// an APPEND or REPLACE into a temporary file for a. Function check is called
+// before reading the message data, with whether the client waits for a
+// continuation, so errors can be returned before the client sends the message.
+// A message larger than maxSize, if > 0, is refused before the client sends it,
+// if it waits for a continuation; otherwise the caller must check the size with
+// xcheckAppendSize. The returned parser is for the remainder of the command. For
+// CATENATE, an invalid URL is returned instead of raised, so the command can be
+// read fully.
+func (c *conn) xreadAppendMessage(p *parser, a *appendMsg, maxSize int64, check func(sync bool)) (np *parser, badURL string, urlErr error) {
 	if p.hasPrefix("(") {
 		// Error must be a syntax error, to properly abort the connection due to literal.
-		storeFlags, keywords = xparseStoreFlags(p.xflagList(), true)
+		a.storeFlags, a.keywords = xparseStoreFlags(p.xflagList(), true)
 		p.xspace()
 	}
-	var tm time.Time
 	if p.hasPrefix(`"`) {
-		tm = p.xdateTime()
+		a.tm = p.xdateTime()
 		p.xspace()
 	} else {
-		tm = time.Now()
+		a.tm = time.Now()
 	}
 	// todo: only with utf8 should we we accept message headers with utf-8. we currently always accept them.
-	// todo: this is only relevant if we also support the CATENATE extension?
 	// ../rfc/6855:204
 	utf8 := p.take("UTF8 (")
-	size, sync := p.xliteralSize(0, utf8)
+	// With CATENATE, the message is composed of text literals and references to
+	// existing messages. ../rfc/4469 section 5
+	catenate := !utf8 && p.take("CATENATE (")
+	var sync bool
+	if catenate {
+		// Errors can be returned immediately unless the line ends with a non-synchronizing literal.
+		sync = !strings.HasSuffix(c.lastLine, "+}")
+	} else {
+		a.size, sync = p.xliteralSize(0, utf8)
+	}
 
-	name = xcheckmailboxname(name, true)
-	c.xdbread(func(tx *bstore.Tx) {
-		c.xmailbox(tx, name, "TRYCREATE")
-	})
-	if sync {
+	check(sync)
+	if sync && !catenate {
+		if maxSize > 0 && a.size > maxSize {
+			xcheckAppendSize(a, maxSize)
+		}
 		c.writelinef("+")
 	}
 
 	// Read the message into a temporary file.
-	msgFile, err := store.CreateMessageTemp("imap-append")
+	var err error
+	a.file, err = store.CreateMessageTemp("imap-append")
 	xcheckf(err, "creating temp file for message")
+	mw := &message.Writer{Writer: a.file}
+	if catenate {
+		p, a.size, badURL, urlErr = c.xcatenate(p, mw)
+	} else {
+		restore := c.xtrace(mlog.LevelTracedata)
+		msize, err := io.Copy(mw, io.LimitReader(c.br, a.size))
+		restore()
+		if err != nil {
+			// Cannot use xcheckf due to %w handling of errIO.
+			panic(fmt.Errorf("reading literal message: %s (%w)", err, errIO))
+		}
+		if msize != a.size {
+			xserverErrorf("read %d bytes for message, expected %d (%w)", msize, a.size, errIO)
+		}
+
+		p = newParser(c.readline(false), c)
+		if utf8 {
+			p.xtake(")")
+		}
+	}
+	a.msgPrefix = []byte{}
+	// todo: should we treat the message as body? i believe headers are required in messages, and bodies are optional. so would make more sense to treat the data as headers. perhaps only if the headers are valid?
+	if !mw.HaveHeaders {
+		a.msgPrefix = []byte("\r\n")
+	}
+	return p, badURL, urlErr
+}
+
+// xcheckAppendSize fails the command with TOOBIG if the message as sent by the
+// client is larger than maxSize, the configured limit of the account, if > 0.
+// ../rfc/7889:178
+func xcheckAppendSize(a *appendMsg, maxSize int64) {
+	if maxSize > 0 && a.size > maxSize {
+		xusercodeErrorf("TOOBIG", "message of %d bytes larger than limit of %d bytes", a.size, maxSize)
+	}
+}
+
+// Append adds one or more messages to a mailbox.
+//
+// State: Authenticated and selected.
+func (c *conn) cmdAppend(tag, cmd string, p *parser) {
+	// Command: ../rfc/9051:3406 ../rfc/6855:204 ../rfc/3501:2527 ../rfc/3502
+	// Examples: ../rfc/9051:3482 ../rfc/3501:2589
+
+	// Request syntax: ../rfc/9051:6325 ../rfc/6855:219 ../rfc/3501:4547 ../rfc/3502 section 6
+	p.xspace()
+	name := p.xmailbox()
+	p.xspace()
+
+	// With MULTIAPPEND, multiple messages can be appended in a single command. All
+	// messages are read into temporary files first, then added in a single
+	// transaction: either all messages are appended, or none. ../rfc/3502 section 3
+	var appends []*appendMsg
 	defer func() {
-		if msgFile != nil {
-			err := os.Remove(msgFile.Name())
-			c.xsanity(err, "removing APPEND temporary file")
-			err = msgFile.Close()
-			c.xsanity(err, "closing APPEND temporary file")
+		for _, a := range appends {
+			a.xremove(c)
 		}
 	}()
-	defer c.xtrace(mlog.LevelTracedata)()
-	mw := &message.Writer{Writer: msgFile}
-	msize, err := io.Copy(mw, io.LimitReader(c.br, size))
-	c.xtrace(mlog.LevelTrace) // Restore.
-	if err != nil {
-		// Cannot use xcheckf due to %w handling of errIO.
-		panic(fmt.Errorf("reading literal message: %s (%w)", err, errIO))
+
+	owner, mbname, isShared := c.xsharedMailboxName(name)
+	// Messages are stored in the account of the owner of a shared mailbox, so its
+	// limit applies.
+	limitAccount := c.account.Name
+	if isShared {
+		limitAccount = owner
+	}
+	maxSize := mox.Conf.MessageSizeLimit(limitAccount)
+	var firstSync bool
+	var badURL string
+	var urlErr error
+	var totalSize int64
+	for {
+		a := &appendMsg{}
+		appends = append(appends, a)
+
+		// Appending to a shared mailbox needs the insert right. With a
+		// non-synchronizing literal, errors can only be returned after the message has
+		// been read.
+		check := func(sync bool) {
+			if len(appends) != 1 {
+				return
+			}
+			firstSync = sync
+			if !isShared {
+				name = xcheckmailboxname(name, true)
+				c.xdbread(func(tx *bstore.Tx) {
+					c.xmailbox(tx, name, "TRYCREATE")
+				})
+			} else if sync {
+				acc, _, _ := c.xsharedOpen(owner, mbname, "i")
+				err := acc.Close()
+				c.xsanity(err, "closing account of shared mailbox")
+			}
+		}
+		var bu string
+		var ue error
+		p, bu, ue = c.xreadAppendMessage(p, a, maxSize, check)
+		if bu != "" && badURL == "" {
+			// Remaining messages are still read, the error is returned at the end.
+			badURL, urlErr = bu, ue
+		}
+		totalSize += a.size + int64(len(a.msgPrefix))
+
+		// Another message follows after a space, otherwise the command is done.
+		if p.empty() {
+			break
+		}
+		p.xspace()
 	}
-	if msize != size {
-		xserverErrorf("read %d bytes for message, expected %d (%w)", msize, size, errIO)
+	if badURL != "" {
+		// ../rfc/4469 section 6
+		xusercodeErrorf("BADURL "+strings.ReplaceAll(badURL, "]", "%5D"), "%s", urlErr)
 	}
-	msgPrefix := []byte{}
-	// todo: should we treat the message as body? i believe headers are required in messages, and bodies are optional. so would make more sense to treat the data as headers. perhaps only if the headers are valid?
-	if !mw.HaveHeaders {
-		msgPrefix = []byte("\r\n")
+	for _, a := range appends {
+		xcheckAppendSize(a, maxSize)
 	}
 
-	if utf8 {
-		line := c.readline(false)
-		np := newParser(line, c)
-		np.xtake(")")
-		np.xempty()
-	} else {
-		line := c.readline(false)
-		np := newParser(line, c)
-		np.xempty()
+	// The messages are added to the account of the owner of a shared mailbox.
+	if isShared {
+		acc, _, _ := c.xsharedOpen(owner, mbname, "i")
+		defer func() {
+			err := acc.Close()
+			c.xsanity(err, "closing account of shared mailbox")
+		}()
+		var comm *store.Comm
+		if c.shared != nil && c.shared.account == acc {
+			comm = c.shared.comm
+		} else {
+			comm = store.RegisterComm(acc)
+			defer comm.Unregister()
+		}
+		c.swapAccount(acc, comm)
+		defer c.unswap()
+		name = mbname
 	}
-	p.xempty()
-	if !sync {
+	if !firstSync {
 		name = xcheckmailboxname(name, true)
 	}
 
+	// OVERQUOTA response code from ../rfc/9208
+	if err := c.account.CheckDomainStorage(context.TODO(), c.log, totalSize); errors.Is(err, store.ErrDomainStorage) {
+		xusercodeErrorf("OVERQUOTA", "%s", err)
+	} else {
+		xcheckf(err, "checking storage limit of domain")
+	}
+	err := c.account.DB.Read(context.TODO(), func(tx *bstore.Tx) error {
+		return c.account.CheckQuota(tx, int64(len(appends)), totalSize)
+	})
+	if errors.Is(err, store.ErrOverQuota) {
+		xusercodeErrorf("OVERQUOTA", "%s", err)
+	} else {
+		xcheckf(err, "checking quota")
+	}
+
+	// Files that were delivered. Remove them if the transaction fails.
+	var createdIDs []int64
+	defer func() {
+		x := recover()
+		if x == nil {
+			return
+		}
+		for _, id := range createdIDs {
+			p := c.account.MessagePath(id)
+			err := os.Remove(p)
+			c.xsanity(err, "cleaning up delivered file")
+		}
+		panic(x)
+	}()
+
 	var mb store.Mailbox
-	var msg store.Message
+	msgs := make([]store.Message, len(appends))
 	var pendingChanges []store.Change
 
 	c.account.WithWLock(func() {
@@ -2594,47 +3582,67 @@ func (c *conn) cmdAppend(tag, cmd string, p *parser) {
 			mb = c.xmailbox(tx, name, "TRYCREATE")
 
 			// Ensure keywords are stored in mailbox.
-			var changed bool
-			mb.Keywords, changed = store.MergeKeywords(mb.Keywords, keywords)
-			if changed {
+			var mbKwChanged bool
+			for _, a := range appends {
+				var changed bool
+				mb.Keywords, changed = store.MergeKeywords(mb.Keywords, a.keywords)
+				mbKwChanged = mbKwChanged || changed
+			}
+			if mbKwChanged {
 				err := tx.Update(&mb)
 				xcheckf(err, "updating keywords in mailbox")
 			}
 
-			msg = store.Message{
-				MailboxID:     mb.ID,
-				MailboxOrigID: mb.ID,
-				Received:      tm,
-				Flags:         storeFlags,
-				Keywords:      keywords,
-				Size:          size,
-				MsgPrefix:     msgPrefix,
+			for i, a := range appends {
+				msgs[i] = store.Message{
+					MailboxID:     mb.ID,
+					MailboxOrigID: mb.ID,
+					Received:      a.tm,
+					Flags:         a.storeFlags,
+					Keywords:      a.keywords,
+					Size:          a.size,
+					MsgPrefix:     a.msgPrefix,
+				}
+				err := c.account.DeliverMessage(c.log, tx, &msgs[i], a.file, true, mb.Sent, true, false)
+				xcheckf(err, "delivering message")
+				createdIDs = append(createdIDs, msgs[i].ID)
+
+				// The temporary file has been moved into place.
+				err = a.file.Close()
+				c.log.Check(err, "closing appended file")
+				a.file = nil
 			}
-			isSent := name == "Sent"
-			err := c.account.DeliverMessage(c.log, tx, &msg, msgFile, true, isSent, true, false)
-			xcheckf(err, "delivering message")
 		})
 
-		// Fetch pending changes, possibly with new UIDs, so we can apply them before adding our own new UID.
+		// Fetch pending changes, possibly with new UIDs, so we can apply them before adding our own new UIDs.
 		if c.comm != nil {
 			pendingChanges = c.comm.Get()
 		}
 
-		// Broadcast the change to other connections.
-		c.broadcast([]store.Change{store.ChangeAddUID{MailboxID: mb.ID, UID: msg.UID, Flags: msg.Flags, Keywords: msg.Keywords}})
+		// Broadcast the changes to other connections.
+		changes := make([]store.Change, len(msgs))
+		for i, m := range msgs {
+			changes[i] = store.ChangeAddUID{MailboxID: mb.ID, UID: m.UID, ModSeq: m.ModSeq, Flags: m.Flags, Keywords: m.Keywords}
+		}
+		c.broadcast(changes)
 	})
 
-	err = msgFile.Close()
-	c.log.Check(err, "closing appended file")
-	msgFile = nil
+	createdIDs = nil
 
-	if c.mailboxID == mb.ID {
+	if c.isSelected(mb.ID) {
 		c.applyChanges(pendingChanges, false)
-		c.uidAppend(msg.UID)
+		for _, m := range msgs {
+			c.uidAppend(m.UID)
+		}
 		c.bwritelinef("* %d EXISTS", len(c.uids))
 	}
 
-	c.writeresultf("%s OK [APPENDUID %d %d] appended", tag, mb.UIDValidity, msg.UID)
+	// The messages were added in a single transaction, so their UIDs are consecutive.
+	uids := fmt.Sprintf("%d", msgs[0].UID)
+	if len(msgs) > 1 {
+		uids += fmt.Sprintf(":%d", msgs[len(msgs)-1].UID)
+	}
+	c.writeresultf("%s OK [APPENDUID %d %s] appended", tag, mb.UIDValidity, uids)
 }
 
 // Idle makes a client wait until the server sends untagged updates, e.g. about
@@ -2660,8 +3668,11 @@ wait:
 			xcheckf(le.err, "get line")
 			line = le.line
 			break wait
-		case changes := <-c.comm.Changes:
-			c.applyChanges(changes, false)
+		case <-c.comm.Pending:
+			c.applyChanges(c.comm.Get(), false)
+			c.xflush()
+		case <-c.sharedPending():
+			c.applySharedChanges()
 			c.xflush()
 		case <-mox.Shutdown.Done():
 			// ../rfc/9051:5375
@@ -2711,7 +3722,9 @@ func (c *conn) cmdClose(tag, cmd string, p *parser) {
 	// Request syntax: ../rfc/9051:6476 ../rfc/3501:4679
 	p.xempty()
 
-	if c.readonly {
+	// For accounts on hold, we don't expunge, the messages stay marked \Deleted.
+	// Without the expunge right on a shared mailbox, we don't expunge either.
+	if c.readonly || c.account.OnHold() || !c.hasRight('e') {
 		c.unselect()
 		c.ok(tag, cmd)
 		return
@@ -2719,9 +3732,11 @@ func (c *conn) cmdClose(tag, cmd string, p *parser) {
 
 	remove := c.xexpunge(nil, true)
 
+	// Unselecting a shared mailbox switches back to the account of the user.
+	acc := c.account
 	defer func() {
 		for _, m := range remove {
-			p := c.account.MessagePath(m.ID)
+			p := acc.MessagePath(m.ID)
 			err := os.Remove(p)
 			c.xsanity(err, "removing message file for expunge for close")
 		}
@@ -2736,6 +3751,8 @@ func (c *conn) cmdClose(tag, cmd string, p *parser) {
 // messages that have been deleted from the database returned, but the corresponding files still have to be removed.
 func (c *conn) xexpunge(uidSet *numSet, missingMailboxOK bool) []store.Message {
 	var remove []store.Message
+	var ouids []store.UID
+	var modseq store.ModSeq
 
 	c.account.WithWLock(func() {
 		c.xdbwrite(func(tx *bstore.Tx) {
@@ -2762,6 +3779,9 @@ func (c *conn) xexpunge(uidSet *numSet, missingMailboxOK bool) []store.Message {
 			if len(remove) == 0 {
 				return
 			}
+			if c.account.OnHold() {
+				xusercodeErrorf("CANNOT", "%s", store.ErrHold)
+			}
 
 			removeIDs := make([]int64, len(remove))
 			anyIDs := make([]any, len(remove))
@@ -2773,12 +3793,23 @@ func (c *conn) xexpunge(uidSet *numSet, missingMailboxOK bool) []store.Message {
 			qmr.FilterEqual("MessageID", anyIDs...)
 			_, err = qmr.Delete()
 			xcheckf(err, "removing message recipients")
+			err = store.TextIndexRemove(tx, removeIDs)
+			xcheckf(err, "removing messages from full-text index")
 
 			qm = bstore.QueryTx[store.Message](tx)
 			qm.FilterIDs(removeIDs)
 			_, err = qm.Delete()
 			xcheckf(err, "removing messages marked for deletion")
 
+			var size int64
+			for _, m := range remove {
+				size += m.Size
+			}
+			err = c.account.AddMessageUsage(tx, -int64(len(remove)), -size)
+			xcheckf(err, "updating disk usage")
+			err = store.MailboxCountsRemove(tx, remove...)
+			xcheckf(err, "updating mailbox counts")
+
 			// Mark removed messages as not needing training, then retrain them, so if they
 			// were trained, they get untrained.
 			for i := range remove {
@@ -2787,16 +3818,23 @@ func (c *conn) xexpunge(uidSet *numSet, missingMailboxOK bool) []store.Message {
 			}
 			err = c.account.RetrainMessages(context.TODO(), c.log, tx, remove, true)
 			xcheckf(err, "untraining deleted messages")
+
+			ouids = make([]store.UID, len(remove))
+			for i, m := range remove {
+				ouids[i] = m.UID
+			}
+			modseq, err = c.account.NextModSeq(tx)
+			xcheckf(err, "assigning modseq")
+			err = c.account.RecordExpunged(tx, c.mailboxID, ouids, modseq)
+			xcheckf(err, "recording expunged messages")
+			err = c.account.RecordRemoved(tx, remove, modseq)
+			xcheckf(err, "recording removed messages")
 		})
 
 		// Broadcast changes to other connections. We may not have actually removed any
 		// messages, so take care not to send an empty update.
 		if len(remove) > 0 {
-			ouids := make([]store.UID, len(remove))
-			for i, m := range remove {
-				ouids[i] = m.UID
-			}
-			changes := []store.Change{store.ChangeRemoveUIDs{MailboxID: c.mailboxID, UIDs: ouids}}
+			changes := []store.Change{store.ChangeRemoveUIDs{MailboxID: c.mailboxID, UIDs: ouids, ModSeq: modseq}}
 			c.broadcast(changes)
 		}
 	})
@@ -2860,6 +3898,8 @@ func (c *conn) cmdUIDExpunge(tag, cmd string, p *parser) {
 func (c *conn) cmdxExpunge(tag, cmd string, uidSet *numSet) {
 	// Command: ../rfc/9051:3687 ../rfc/3501:2695
 
+	c.xneedRight('e')
+
 	remove := c.xexpunge(uidSet, false)
 
 	defer func() {
@@ -2871,11 +3911,11 @@ func (c *conn) cmdxExpunge(tag, cmd string, uidSet *numSet) {
 	}()
 
 	// Response syntax: ../rfc/9051:6742 ../rfc/3501:4864
-	for _, m := range remove {
-		seq := c.xsequence(m.UID)
-		c.sequenceRemove(seq, m.UID)
-		c.bwritelinef("* %d EXPUNGE", seq)
+	uids := make([]store.UID, len(remove))
+	for i, m := range remove {
+		uids[i] = m.UID
 	}
+	c.xwriteExpunged(uids)
 
 	c.ok(tag, cmd)
 }
@@ -2890,6 +3930,26 @@ func (c *conn) cmdUIDSearch(tag, cmd string, p *parser) {
 	c.cmdxSearch(true, tag, cmd, p)
 }
 
+// State: Selected
+func (c *conn) cmdSort(tag, cmd string, p *parser) {
+	c.cmdxSort(false, tag, cmd, p)
+}
+
+// State: Selected
+func (c *conn) cmdUIDSort(tag, cmd string, p *parser) {
+	c.cmdxSort(true, tag, cmd, p)
+}
+
+// State: Selected
+func (c *conn) cmdThread(tag, cmd string, p *parser) {
+	c.cmdxThread(false, tag, cmd, p)
+}
+
+// State: Selected
+func (c *conn) cmdUIDThread(tag, cmd string, p *parser) {
+	c.cmdxThread(true, tag, cmd, p)
+}
+
 // State: Selected
 func (c *conn) cmdFetch(tag, cmd string, p *parser) {
 	c.cmdxFetch(false, tag, cmd, p)
@@ -2962,7 +4022,7 @@ func (c *conn) cmdxCopy(isUID bool, tag, cmd string, p *parser) {
 	name := p.xmailbox()
 	p.xempty()
 
-	name = xcheckmailboxname(name, true)
+	name = c.xcopyDestination(name)
 
 	uids, uidargs := c.gatherCopyMoveUIDs(isUID, nums)
 
@@ -2985,6 +4045,7 @@ func (c *conn) cmdxCopy(isUID bool, tag, cmd string, p *parser) {
 	var origUIDs, newUIDs []store.UID
 	var flags []store.Flags
 	var keywords [][]string
+	var modseq store.ModSeq
 
 	c.account.WithWLock(func() {
 		c.xdbwrite(func(tx *bstore.Tx) {
@@ -3015,6 +4076,19 @@ func (c *conn) cmdxCopy(isUID bool, tag, cmd string, p *parser) {
 				xserverErrorf("uid and message mismatch")
 			}
 
+			// ../rfc/9208
+			var size int64
+			for _, m := range xmsgs {
+				size += m.Size
+			}
+			if err := c.account.CheckQuota(tx, int64(len(xmsgs)), size); errors.Is(err, store.ErrOverQuota) {
+				xusercodeErrorf("OVERQUOTA", "%s", err)
+			} else {
+				xcheckf(err, "checking quota")
+			}
+			err = c.account.AddMessageUsage(tx, int64(len(xmsgs)), size)
+			xcheckf(err, "updating disk usage")
+
 			msgs := map[store.UID]store.Message{}
 			for _, m := range xmsgs {
 				msgs[m.UID] = m
@@ -3023,6 +4097,10 @@ func (c *conn) cmdxCopy(isUID bool, tag, cmd string, p *parser) {
 
 			conf, _ := c.account.Conf()
 
+			modseq, err = c.account.NextModSeq(tx)
+			xcheckf(err, "assigning modseq")
+			now := time.Now()
+
 			// Insert new messages into database.
 			var origMsgIDs, newMsgIDs []int64
 			for i, uid := range uids {
@@ -3033,8 +4111,16 @@ func (c *conn) cmdxCopy(isUID bool, tag, cmd string, p *parser) {
 				origID := m.ID
 				origMsgIDs = append(origMsgIDs, origID)
 				m.ID = 0
+				// Copies share the EMAILID and THREADID of the original. ../rfc/8474
+				if m.EmailID == 0 {
+					m.EmailID = origID
+				}
+				if m.ThreadID == 0 {
+					m.ThreadID = m.EmailID
+				}
 				m.UID = uidFirst + store.UID(i)
 				m.MailboxID = mbDst.ID
+				m.SaveDate = now
 				if mbSrc.Name == conf.RejectsMailbox && m.MailboxDestinedID != 0 {
 					// Incorrectly delivered to Rejects mailbox. Adjust MailboxOrigID so this message
 					// is used for reputation calculation during future deliveries.
@@ -3042,8 +4128,11 @@ func (c *conn) cmdxCopy(isUID bool, tag, cmd string, p *parser) {
 				}
 				m.TrainedJunk = nil
 				m.JunkFlagsForMailbox(mbDst.Name, conf)
+				m.ModSeq = modseq
 				err := tx.Insert(&m)
 				xcheckf(err, "inserting message")
+				err = store.TextIndexCopy(tx, origID, m.ID)
+				xcheckf(err, "copying full-text index")
 				msgs[uid] = m
 				nmsgs[i] = m
 				origUIDs = append(origUIDs, uid)
@@ -3074,6 +4163,9 @@ func (c *conn) cmdxCopy(isUID bool, tag, cmd string, p *parser) {
 				createdIDs = append(createdIDs, newMsgIDs[i])
 			}
 
+			err = store.MailboxCountsAdd(tx, nmsgs...)
+			xcheckf(err, "updating mailbox counts")
+
 			err = c.account.RetrainMessages(context.TODO(), c.log, tx, nmsgs, false)
 			xcheckf(err, "train copied messages")
 		})
@@ -3082,7 +4174,7 @@ func (c *conn) cmdxCopy(isUID bool, tag, cmd string, p *parser) {
 		if len(newUIDs) > 0 {
 			changes := make([]store.Change, len(newUIDs))
 			for i, uid := range newUIDs {
-				changes[i] = store.ChangeAddUID{MailboxID: mbDst.ID, UID: uid, Flags: flags[i], Keywords: keywords[i]}
+				changes[i] = store.ChangeAddUID{MailboxID: mbDst.ID, UID: uid, ModSeq: modseq, Flags: flags[i], Keywords: keywords[i]}
 			}
 			c.broadcast(changes)
 		}
@@ -3151,11 +4243,14 @@ func (c *conn) cmdxMove(isUID bool, tag, cmd string, p *parser) {
 	name := p.xmailbox()
 	p.xempty()
 
-	name = xcheckmailboxname(name, true)
+	name = c.xcopyDestination(name)
 
 	if c.readonly {
 		xuserErrorf("mailbox open in read-only mode")
 	}
+	// Moving is copying, marking deleted and expunging. ../rfc/4314 section 4
+	c.xneedRight('t')
+	c.xneedRight('e')
 
 	uids, uidargs := c.gatherCopyMoveUIDs(isUID, nums)
 
@@ -3194,6 +4289,13 @@ func (c *conn) cmdxMove(isUID bool, tag, cmd string, p *parser) {
 				xserverErrorf("uid and message mismatch")
 			}
 
+			modseq, err := c.account.NextModSeq(tx)
+			xcheckf(err, "assigning modseq")
+			now := time.Now()
+
+			err = store.MailboxCountsRemove(tx, msgs...)
+			xcheckf(err, "updating mailbox counts")
+
 			conf, _ := c.account.Conf()
 			for i := range msgs {
 				m := &msgs[i]
@@ -3201,27 +4303,34 @@ func (c *conn) cmdxMove(isUID bool, tag, cmd string, p *parser) {
 					xserverErrorf("internal error: got uid %d, expected %d, for index %d", m.UID, uids[i], i)
 				}
 				m.MailboxID = mbDst.ID
+				m.SaveDate = now
 				if mbSrc.Name == conf.RejectsMailbox && m.MailboxDestinedID != 0 {
 					// Incorrectly delivered to Rejects mailbox. Adjust MailboxOrigID so this message
 					// is used for reputation calculation during future deliveries.
 					m.MailboxOrigID = m.MailboxDestinedID
 				}
 				m.UID = uidnext
+				m.ModSeq = modseq
 				m.JunkFlagsForMailbox(mbDst.Name, conf)
 				uidnext++
 				err := tx.Update(m)
 				xcheckf(err, "updating moved message in database")
 			}
+			err = store.MailboxCountsAdd(tx, msgs...)
+			xcheckf(err, "updating mailbox counts")
+
+			err = c.account.RecordExpunged(tx, c.mailboxID, uids, modseq)
+			xcheckf(err, "recording expunged messages")
 
 			err = c.account.RetrainMessages(context.TODO(), c.log, tx, msgs, false)
 			xcheckf(err, "retraining messages after move")
 
 			// Prepare broadcast changes to other connections.
 			changes = make([]store.Change, 0, 1+len(msgs))
-			changes = append(changes, store.ChangeRemoveUIDs{MailboxID: c.mailboxID, UIDs: uids})
+			changes = append(changes, store.ChangeRemoveUIDs{MailboxID: c.mailboxID, UIDs: uids, ModSeq: modseq})
 			for _, m := range msgs {
 				newUIDs = append(newUIDs, m.UID)
-				changes = append(changes, store.ChangeAddUID{MailboxID: mbDst.ID, UID: m.UID, Flags: m.Flags, Keywords: m.Keywords})
+				changes = append(changes, store.ChangeAddUID{MailboxID: mbDst.ID, UID: m.UID, ModSeq: m.ModSeq, Flags: m.Flags, Keywords: m.Keywords})
 			}
 		})
 
@@ -3231,11 +4340,7 @@ func (c *conn) cmdxMove(isUID bool, tag, cmd string, p *parser) {
 	// ../rfc/9051:4708 ../rfc/6851:254
 	// ../rfc/9051:4713
 	c.bwritelinef("* OK [COPYUID %d %s %s] moved", mbDst.UIDValidity, compactUIDSet(uids).String(), compactUIDSet(newUIDs).String())
-	for i := 0; i < len(uids); i++ {
-		seq := c.xsequence(uids[i])
-		c.sequenceRemove(seq, uids[i])
-		c.bwritelinef("* %d EXPUNGE", seq)
-	}
+	c.xwriteExpunged(uids)
 
 	c.ok(tag, cmd)
 }
@@ -3250,6 +4355,19 @@ func (c *conn) cmdxStore(isUID bool, tag, cmd string, p *parser) {
 	p.xspace()
 	nums := p.xnumSet()
 	p.xspace()
+	// Store modifier. ../rfc/7162 ../rfc/4466
+	var unchangedSince int64 = -1
+	if p.take("(") {
+		p.xtake("UNCHANGEDSINCE")
+		p.xspace()
+		unchangedSince = p.xnumber64()
+		p.xtake(")")
+		p.xspace()
+	}
+	if p.take("ANNOTATION ") {
+		c.cmdxStoreAnnotation(isUID, tag, cmd, p, nums, unchangedSince)
+		return
+	}
 	var plus, minus bool
 	if p.take("+") {
 		plus = true
@@ -3284,12 +4402,33 @@ func (c *conn) cmdxStore(isUID bool, tag, cmd string, p *parser) {
 		mask = store.FlagsAll
 	}
 
+	// On shared mailboxes, changing \Seen and \Deleted needs separate rights.
+	// ../rfc/4314 section 4
+	if mask.Seen {
+		c.xneedRight('s')
+	}
+	if mask.Deleted {
+		c.xneedRight('t')
+	}
+	other := mask
+	other.Seen, other.Deleted = false, false
+	if other != (store.Flags{}) || len(keywords) > 0 {
+		c.xneedRight('w')
+	}
+
 	var updated []store.Message
+	var moveUIDs []store.UID // Moved out of mailbox due to changed junk flags.
+	var modified []store.UID // Not updated due to UNCHANGEDSINCE.
 
 	c.account.WithWLock(func() {
+		var moveChanges []store.Change
 		c.xdbwrite(func(tx *bstore.Tx) {
 			mb := c.xmailboxID(tx, c.mailboxID) // Validate.
 
+			if unchangedSince >= 0 {
+				c.xensureCondstore(tx)
+			}
+
 			uidargs := c.xnumSetCondition(isUID, nums)
 
 			if len(uidargs) == 0 {
@@ -3306,10 +4445,25 @@ func (c *conn) cmdxStore(isUID bool, tag, cmd string, p *parser) {
 				}
 			}
 
+			// All messages changed by this command get the same modseq.
+			modseq, err := c.account.NextModSeq(tx)
+			xcheckf(err, "assigning modseq")
+
 			q := bstore.QueryTx[store.Message](tx)
 			q.FilterNonzero(store.Message{MailboxID: c.mailboxID})
 			q.FilterEqual("UID", uidargs...)
-			err := q.ForEach(func(m store.Message) error {
+			q.SortAsc("UID")
+			var oldFlags []store.Flags
+			var old []store.Message
+			err = q.ForEach(func(m store.Message) error {
+				// ../rfc/7162
+				if unchangedSince >= 0 && m.ModSeq.Client() > unchangedSince {
+					modified = append(modified, m.UID)
+					return nil
+				}
+				old = append(old, m)
+				oldFlags = append(oldFlags, m.Flags)
+				m.ModSeq = modseq
 				m.Flags = m.Flags.Set(mask, flags)
 				if minus {
 					m.Keywords = store.RemoveKeywords(m.Keywords, keywords)
@@ -3323,24 +4477,57 @@ func (c *conn) cmdxStore(isUID bool, tag, cmd string, p *parser) {
 			})
 			xcheckf(err, "storing flags in messages")
 
+			err = store.MailboxCountsRemove(tx, old...)
+			if err == nil {
+				err = store.MailboxCountsAdd(tx, updated...)
+			}
+			xcheckf(err, "updating mailbox counts")
+
 			err = c.account.RetrainMessages(context.TODO(), c.log, tx, updated, false)
 			xcheckf(err, "training messages")
+
+			_, moveUIDs, moveChanges, err = c.account.JunkFlagsMove(c.log, tx, mb, updated, oldFlags)
+			xcheckf(err, "moving messages for junk flags")
 		})
 
 		// Broadcast changes to other connections.
-		changes := make([]store.Change, len(updated))
+		changes := make([]store.Change, len(updated), len(updated)+len(moveChanges))
 		for i, m := range updated {
-			changes[i] = store.ChangeFlags{MailboxID: m.MailboxID, UID: m.UID, Mask: mask, Flags: m.Flags, Keywords: m.Keywords}
+			changes[i] = store.ChangeFlags{MailboxID: m.MailboxID, UID: m.UID, ModSeq: m.ModSeq, Mask: mask, Flags: m.Flags, Keywords: m.Keywords}
 		}
+		changes = append(changes, moveChanges...)
 		c.broadcast(changes)
 	})
 
 	for _, m := range updated {
 		if !silent {
 			// ../rfc/9051:6749 ../rfc/3501:4869
-			c.bwritelinef("* %d FETCH (UID %d FLAGS %s)", c.xsequence(m.UID), m.UID, flaglist(m.Flags, m.Keywords).pack(c))
+			c.bwritelinef("* %d FETCH (UID %d FLAGS %s%s)", c.xsequence(m.UID), m.UID, flaglist(m.Flags, m.Keywords).pack(c), c.modseqAtt(m.ModSeq))
+		} else if c.enabled[capCondstore] {
+			// With CONDSTORE, the new modseq is sent, also for silent stores. ../rfc/7162
+			c.bwritelinef("* %d FETCH (UID %d%s)", c.xsequence(m.UID), m.UID, c.modseqAtt(m.ModSeq))
 		}
 	}
 
-	c.ok(tag, cmd)
+	// Messages that were not updated due to UNCHANGEDSINCE are returned in the
+	// MODIFIED response code, as sequence numbers for STORE. Computed before expunges
+	// are sent, the sequence numbers refer to the state the client knows about.
+	var modifiedCode string
+	if len(modified) > 0 {
+		if !isUID {
+			for i, uid := range modified {
+				modified[i] = store.UID(c.xsequence(uid))
+			}
+		}
+		modifiedCode = fmt.Sprintf("[MODIFIED %s] ", compactUIDSet(modified).String())
+	}
+
+	c.xwriteExpunged(moveUIDs)
+
+	if modifiedCode != "" {
+		c.bwriteresultf("%s OK %sconditional store did not modify all", tag, modifiedCode)
+		c.xflush()
+	} else {
+		c.ok(tag, cmd)
+	}
 }
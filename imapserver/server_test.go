@@ -10,11 +10,17 @@ import (
 	"math/big"
 	"net"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/mjl-/bstore"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/dns"
 	"github.com/mjl-/mox/imapclient"
 	"github.com/mjl-/mox/mox-"
 	"github.com/mjl-/mox/moxvar"
@@ -296,6 +302,32 @@ func (tc *testconn) close() {
 	tc.client.Close()
 	tc.serverConn.Close()
 	tc.waitDone()
+	tc.checkMailboxCounts()
+}
+
+// checkMailboxCounts verifies the mailbox counts, kept up to date by commands,
+// match the messages in the mailboxes.
+func (tc *testconn) checkMailboxCounts() {
+	tc.t.Helper()
+	acc, err := store.OpenAccount("mjl")
+	tc.check(err, "open account")
+	defer func() {
+		err := acc.Close()
+		tc.check(err, "close account")
+	}()
+	err = acc.DB.Read(context.Background(), func(tx *bstore.Tx) error {
+		return bstore.QueryTx[store.Mailbox](tx).ForEach(func(mb store.Mailbox) error {
+			mc, err := store.MailboxCountsGet(tx, mb.ID)
+			tc.check(err, "get mailbox counts")
+			exp, err := store.MailboxCountsCalculate(tx, mb.ID)
+			tc.check(err, "calculate mailbox counts")
+			if mc != exp {
+				tc.t.Fatalf("mailbox %q has counts %#v, expected %#v", mb.Name, mc, exp)
+			}
+			return nil
+		})
+	})
+	tc.check(err, "checking mailbox counts")
 }
 
 var connCounter int64
@@ -376,6 +408,45 @@ func fakeCert(t *testing.T) tls.Certificate {
 	return c
 }
 
+// Configured notices are sent after the greeting, and notices for domains after
+// authentication.
+func TestNotices(t *testing.T) {
+	tc := start(t)
+	defer tc.close()
+
+	mox.Conf.Dynamic.Notices = []config.Notice{
+		{Text: "maintenance on saturday"},
+		{Text: "smtp only", Services: []string{"smtp"}},
+		{Text: "not yet", StartTime: time.Now().Add(time.Hour)},
+		{Text: "for domain users", Domains: []string{"mox.example"}, DNSDomains: []dns.Domain{{ASCII: "mox.example"}}},
+		{Text: "other domain", Domains: []string{"other.example"}, DNSDomains: []dns.Domain{{ASCII: "other.example"}}},
+	}
+	defer func() {
+		mox.Conf.Dynamic.Notices = nil
+	}()
+
+	// Start a connection with the notices, start() would reload the config.
+	serverConn, clientConn := net.Pipe()
+	done := make(chan struct{})
+	connCounter++
+	cid := connCounter
+	go func() {
+		serve("test", cid, nil, serverConn, false, true)
+		close(done)
+	}()
+	client, err := imapclient.New(clientConn, true)
+	tcheck(t, err, "new client")
+	tc2 := &testconn{t: t, conn: clientConn, client: client, done: done, serverConn: serverConn}
+	defer tc2.close()
+
+	// The notice following the greeting is read with the command response.
+	tc2.transactf("ok", "noop")
+	tc2.xuntagged(imapclient.UntaggedResult{Status: imapclient.OK, RespText: imapclient.RespText{Code: "ALERT", More: "maintenance on saturday"}})
+
+	tc2.transactf("ok", "login mjl@mox.example testtest")
+	tc2.xuntagged(imapclient.UntaggedResult{Status: imapclient.OK, RespText: imapclient.RespText{Code: "ALERT", More: "for domain users"}})
+}
+
 func TestLogin(t *testing.T) {
 	tc := start(t)
 	defer tc.close()
@@ -403,6 +474,24 @@ func TestLogin(t *testing.T) {
 	tc.transactf("ok", "logout")
 }
 
+func TestLoginSuspended(t *testing.T) {
+	tc := start(t)
+	defer tc.close()
+
+	accConf := mox.Conf.Dynamic.Accounts["mjl"]
+	defer func() {
+		mox.Conf.Dynamic.Accounts["mjl"] = accConf
+	}()
+	ac := accConf
+	ac.Suspended = true
+	mox.Conf.Dynamic.Accounts["mjl"] = ac
+
+	tc.transactf("no", "login mjl@mox.example badpass")
+	tc.xcode("AUTHENTICATIONFAILED")
+	tc.transactf("no", "login mjl@mox.example testtest")
+	tc.xcode("CONTACTADMIN")
+}
+
 // Test that commands don't work in the states they are not supposed to.
 func TestState(t *testing.T) {
 	tc := start(t)
@@ -446,6 +535,88 @@ func TestNonIMAP(t *testing.T) {
 	}
 }
 
+func TestConnectionLimits(t *testing.T) {
+	tc := start(t)
+	defer tc.close()
+	tc2 := startNoSwitchboard(t)
+	defer tc2.close()
+	tc3 := startNoSwitchboard(t)
+	defer tc3.close()
+	tc4 := startNoSwitchboard(t)
+	defer tc4.close()
+
+	accConf := mox.Conf.Dynamic.Accounts["mjl"]
+	defer func() {
+		mox.Conf.Dynamic.Accounts["mjl"] = accConf
+	}()
+	nac := accConf
+	nac.MaxIMAPConnections = 1
+	mox.Conf.Dynamic.Accounts["mjl"] = nac
+
+	tc.client.Login("mjl@mox.example", "testtest")
+
+	// Second connection for account is refused, and closed.
+	tc2.cmdf("", "login mjl@mox.example testtest")
+	tc2.readprefixline("* BYE [LIMIT] ")
+	if _, err := tc2.conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("connection not closed after connection limit")
+	}
+
+	// After the first connection no longer uses the account, another can login.
+	// The refused connection is not tc: its server would stop the switchboard while
+	// tc3 still needs it.
+	tc.transactf("ok", "unauthenticate")
+	tc3.transactf("ok", "login mjl@mox.example testtest")
+	tc4.cmdf("", "authenticate plain AG1qbEBtb3guZXhhbXBsZQB0ZXN0dGVzdA==") // "\x00mjl@mox.example\x00testtest"
+	tc4.readprefixline("* BYE [LIMIT] ")
+}
+
+func TestProtocolTrace(t *testing.T) {
+	test := func(account, ip string, expect ...string) {
+		t.Helper()
+
+		// IP traces must exist before the connection, accounts must exist in the config.
+		var tc *testconn
+		if account != "" {
+			tc = start(t)
+		}
+		pt, err := mox.TraceAdd(xlog, account, ip, time.Hour)
+		tcheck(t, err, "add trace")
+		defer mox.TraceRemove(xlog, pt.ID)
+		if tc == nil {
+			tc = start(t)
+		}
+
+		tc.transactf("ok", "login mjl@mox.example testtest")
+		tc.transactf("ok", "noop")
+		tc.close()
+
+		dir := mox.DataDirPath("traces")
+		files, err := os.ReadDir(dir)
+		tcheck(t, err, "list transcripts")
+		if len(files) != 1 {
+			t.Fatalf("got %d transcripts, expected 1", len(files))
+		}
+		buf, err := os.ReadFile(filepath.Join(dir, files[0].Name()))
+		tcheck(t, err, "read transcript")
+		os.RemoveAll(dir)
+		s := string(buf)
+		for _, e := range expect {
+			if !strings.Contains(s, e) {
+				t.Fatalf("transcript %q does not contain %q", s, e)
+			}
+		}
+		if strings.Contains(s, "testtest") {
+			t.Fatalf("transcript %q contains password", s)
+		}
+	}
+
+	// Connections for an account are traced from authentication.
+	test("mjl", "", "C: x002 noop")
+	// Connections from an IP are traced from the start, without credentials.
+	test("", "127.0.0.10", "S: * OK [CAPABILITY", "C: x001 login (credentials redacted)", "C: x002 noop")
+}
+
 func TestLiterals(t *testing.T) {
 	tc := start(t)
 	defer tc.close()
@@ -607,17 +778,54 @@ func TestMailboxDeleted(t *testing.T) {
 }
 
 func TestID(t *testing.T) {
+	// clientIDCount returns the metric count for a client id label.
+	clientIDCount := func(label string) float64 {
+		var m dto.Metric
+		err := metricIMAPClientID.WithLabelValues(label).Write(&m)
+		tcheck(t, err, "reading metric")
+		return m.GetCounter().GetValue()
+	}
+
 	tc := start(t)
 	defer tc.close()
+
+	// Not counted before authentication, but once logged in.
+	n := clientIDCount("thunderbird")
+	tc.transactf("ok", `id ("name" "Thunderbird" "version" "115.0")`)
+	tc.xuntagged(imapclient.UntaggedID{"name": "mox", "version": moxvar.Version})
+	if v := clientIDCount("thunderbird"); v != n {
+		t.Fatalf("client id counted before authentication")
+	}
 	tc.client.Login("mjl@mox.example", "testtest")
+	if v := clientIDCount("thunderbird"); v != n+1 {
+		t.Fatalf("client id count after login is %v, expected %v", v, n+1)
+	}
 
 	tc.transactf("ok", "id nil")
 	tc.xuntagged(imapclient.UntaggedID{"name": "mox", "version": moxvar.Version})
 
 	tc.transactf("ok", `id ("name" "mox" "version" "1.2.3" "other" "test" "test" nil)`)
 	tc.xuntagged(imapclient.UntaggedID{"name": "mox", "version": moxvar.Version})
+	if v := clientIDCount("thunderbird"); v != n+1 {
+		t.Fatalf("client id counted again")
+	}
 
 	tc.transactf("bad", `id ("name" "mox" "name" "mox")`) // Duplicate field.
+
+	for name, exp := range map[string]string{
+		"Thunderbird":   "thunderbird",
+		"K-9 Mail":      "k-9 mail",
+		"Mac OS X Mail": "apple mail",
+		"iPhone Mail":   "apple mail",
+		"NeoMutt":       "mutt",
+		"":              "other",
+		"\x00{}\n":      "other",
+		"a-very-long-client-name-that-is-not-known": "other",
+	} {
+		if s := clientIDLabel(name); s != exp {
+			t.Fatalf("client id label for %q: got %q, expected %q", name, s, exp)
+		}
+	}
 }
 
 func TestSequence(t *testing.T) {
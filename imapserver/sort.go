@@ -0,0 +1,273 @@
+package imapserver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/store"
+)
+
+// sortCriterion is a sort key with optional REVERSE.
+type sortCriterion struct {
+	reverse bool
+	key     string // ARRIVAL, CC, DATE, FROM, SIZE, SUBJECT, TO, RELEVANCY.
+}
+
+// sortMsg holds the values of a message for the sort keys.
+type sortMsg struct {
+	seq     msgseq
+	uid     store.UID
+	arrival time.Time
+	date    time.Time
+	size    int64
+	cc      string
+	from    string
+	subject string // Base subject.
+	to      string
+
+	relevancy int // Of fuzzy search. ../rfc/6203
+}
+
+// Sort returns messages matching search criteria, ordered by sort criteria.
+//
+// State: Selected
+func (c *conn) cmdxSort(isUID bool, tag, cmd string, p *parser) {
+	// Command: ../rfc/5256:117
+	// Syntax: ../rfc/5256:773
+
+	p.xspace()
+	p.xtake("(")
+	var criteria []sortCriterion
+	for {
+		var sc sortCriterion
+		sc.reverse = p.take("REVERSE ")
+		sc.key = p.xtakelist("ARRIVAL", "CC", "DATE", "FROM", "SIZE", "SUBJECT", "TO", "RELEVANCY")
+		criteria = append(criteria, sc)
+		if !p.take(" ") {
+			break
+		}
+	}
+	p.xtake(")")
+
+	var msgs []sortMsg
+	l, expungeIssued := c.xsortThreadMessages(p)
+	for _, sm := range l {
+		msg := c.sortMsg(sm.seq, sm.m)
+		msg.relevancy = sm.relevancy
+		msgs = append(msgs, msg)
+	}
+
+	sort.Slice(msgs, func(i, j int) bool {
+		a, b := msgs[i], msgs[j]
+		for _, sc := range criteria {
+			var cmp int
+			switch sc.key {
+			case "ARRIVAL":
+				cmp = compareTime(a.arrival, b.arrival)
+			case "CC":
+				cmp = compareASCIICasemap(a.cc, b.cc)
+			case "DATE":
+				cmp = compareTime(a.date, b.date)
+			case "FROM":
+				cmp = compareASCIICasemap(a.from, b.from)
+			case "SIZE":
+				if a.size < b.size {
+					cmp = -1
+				} else if a.size > b.size {
+					cmp = 1
+				}
+			case "SUBJECT":
+				cmp = compareASCIICasemap(a.subject, b.subject)
+			case "TO":
+				cmp = compareASCIICasemap(a.to, b.to)
+			case "RELEVANCY":
+				// Like other keys in ascending order, clients use REVERSE for the best matches
+				// first. ../rfc/6203
+				if a.relevancy < b.relevancy {
+					cmp = -1
+				} else if a.relevancy > b.relevancy {
+					cmp = 1
+				}
+			}
+			if sc.reverse {
+				cmp = -cmp
+			}
+			if cmp != 0 {
+				return cmp < 0
+			}
+		}
+		// Ties are broken by message sequence number, also with REVERSE. ../rfc/5256:229
+		return a.seq < b.seq
+	})
+
+	// Response syntax: ../rfc/5256:800
+	// Like SEARCH, we may be splitting into multiple responses. Without matches, we
+	// send an empty response.
+	if len(msgs) == 0 {
+		c.bwritelinef("* SORT")
+	}
+	for len(msgs) > 0 {
+		n := len(msgs)
+		if n > 100 {
+			n = 100
+		}
+		s := ""
+		for _, m := range msgs[:n] {
+			if isUID {
+				s += fmt.Sprintf(" %d", m.uid)
+			} else {
+				s += fmt.Sprintf(" %d", m.seq)
+			}
+		}
+		msgs = msgs[n:]
+		c.bwritelinef("* SORT%s", s)
+	}
+	if expungeIssued {
+		// ../rfc/9051:5102
+		c.writeresultf("%s OK [EXPUNGEISSUED] done", tag)
+	} else {
+		c.ok(tag, cmd)
+	}
+}
+
+// seqMsg is a message with its sequence number in the selected mailbox, and
+// relevancy score for the search criteria.
+type seqMsg struct {
+	seq       msgseq
+	m         store.Message
+	relevancy int
+}
+
+// xsortThreadMessages parses the charset and search criteria of the SORT and
+// THREAD commands, and returns the matching messages in the selected mailbox.
+func (c *conn) xsortThreadMessages(p *parser) (msgs []seqMsg, expungeIssued bool) {
+	// Unlike with SEARCH, the charset is required. ../rfc/5256:137
+	p.xspace()
+	xsearchCharset(p)
+	p.xspace()
+	sk := &searchKey{
+		searchKeys: []searchKey{*p.xsearchKey()},
+	}
+	for !p.empty() {
+		p.xspace()
+		sk.searchKeys = append(sk.searchKeys, *p.xsearchKey())
+	}
+	sk.xcheckStrings()
+
+	// Note: we only hold the account rlock for verifying the mailbox at the start.
+	c.account.RLock()
+	runlock := c.account.RUnlock
+	// Note: in a defer because we replace it below.
+	defer func() {
+		runlock()
+	}()
+
+	c.xdbread(func(tx *bstore.Tx) {
+		c.xmailboxID(tx, c.mailboxID) // Validate.
+		runlock()
+		runlock = func() {}
+
+		if sk.hasModseq() {
+			c.xensureCondstore(tx)
+		}
+
+		matches := map[store.UID]seqMsg{}
+		for i, uid := range c.uids {
+			if match, relevancy := c.searchMatchRelevancy(tx, c.mailboxID, c.uids, msgseq(i+1), uid, *sk, &expungeIssued); match {
+				matches[uid] = seqMsg{seq: msgseq(i + 1), relevancy: relevancy}
+			}
+		}
+		if len(matches) == 0 {
+			return
+		}
+
+		q := bstore.QueryTx[store.Message](tx)
+		q.FilterNonzero(store.Message{MailboxID: c.mailboxID})
+		q.FilterFn(func(m store.Message) bool {
+			_, ok := matches[m.UID]
+			return ok
+		})
+		err := q.ForEach(func(m store.Message) error {
+			sm := matches[m.UID]
+			sm.m = m
+			msgs = append(msgs, sm)
+			return nil
+		})
+		xcheckf(err, "listing matching messages")
+		// Messages expunged by another session are not returned. ../rfc/2180:607
+		if len(msgs) != len(matches) {
+			expungeIssued = true
+		}
+	})
+	return
+}
+
+// sortMsg returns the sort values for a message.
+func (c *conn) sortMsg(seq msgseq, m store.Message) sortMsg {
+	sm := sortMsg{seq: seq, uid: m.UID, arrival: m.Received, date: m.Received, size: m.Size}
+
+	var env *message.Envelope
+	if m.ParsedBuf == nil {
+		c.log.Error("missing parsed message")
+	} else {
+		mr := c.account.MessageReader(m)
+		if p, err := m.LoadPart(mr); err != nil {
+			c.log.Debugx("loading parsed message for sort", err)
+		} else {
+			env = p.Envelope
+		}
+		err := mr.Close()
+		c.xsanity(err, "closing message reader")
+	}
+	if env == nil {
+		return sm
+	}
+
+	// Without valid Date header, the internal date is used. ../rfc/5256:252
+	if !env.Date.IsZero() {
+		sm.date = env.Date
+	}
+
+	// The mailbox (localpart) of the first address is used. ../rfc/5256:240
+	firstMailbox := func(l []message.Address) string {
+		if len(l) == 0 {
+			return ""
+		}
+		return l[0].User
+	}
+	sm.cc = firstMailbox(env.CC)
+	sm.from = firstMailbox(env.From)
+	sm.to = firstMailbox(env.To)
+	sm.subject, _ = message.ThreadSubject(env.Subject)
+	return sm
+}
+
+func compareTime(a, b time.Time) int {
+	if a.Before(b) {
+		return -1
+	} else if a.After(b) {
+		return 1
+	}
+	return 0
+}
+
+// compareASCIICasemap compares strings with the i;ascii-casemap collation: only
+// ASCII letters are compared case-insensitively. ../rfc/4790:1193
+func compareASCIICasemap(a, b string) int {
+	return strings.Compare(asciiUpper(a), asciiUpper(b))
+}
+
+func asciiUpper(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= 'a' && c <= 'z' {
+			b[i] = c - ('a' - 'A')
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,79 @@
+package imapserver
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjl-/mox/imapclient"
+)
+
+func TestSort(t *testing.T) {
+	defer mockUIDValidity()()
+	tc := start(t)
+	defer tc.close()
+	tc.client.Login("mjl@mox.example", "testtest")
+	tc.client.Select("inbox")
+
+	sortMsg := func(date, from, to, subject, body string) []byte {
+		s := fmt.Sprintf("Date: %s\nFrom: <%s>\nTo: <%s>\nSubject: %s\n\n%s\n", date, from, to, subject, body)
+		return []byte(strings.ReplaceAll(s, "\n", "\r\n"))
+	}
+
+	received := time.Date(2022, time.January, 1, 10, 0, 0, 0, time.UTC)
+	tc.client.Append("inbox", nil, &received, sortMsg("Mon, 3 Jan 2022 10:00:00 +0000", "b@mox.example", "c@mox.example", "Re: [list] Fwd: test", "a bit longer body"))
+	received = received.Add(time.Hour)
+	tc.client.Append("inbox", nil, &received, sortMsg("Mon, 1 Jan 2022 10:00:00 +0000", "A@mox.example", "a@mox.example", "test (fwd)", "short"))
+	received = received.Add(-2 * time.Hour)
+	tc.client.Append("inbox", nil, &received, sortMsg("Mon, 2 Jan 2022 10:00:00 +0000", "c@mox.example", "b@mox.example", "another", "a much longer body than the others"))
+
+	tc.transactf("ok", "sort (arrival) utf-8 all")
+	tc.xuntagged(imapclient.UntaggedSort{3, 1, 2})
+
+	tc.transactf("ok", "sort (date) us-ascii all")
+	tc.xuntagged(imapclient.UntaggedSort{2, 3, 1})
+
+	tc.transactf("ok", "sort (reverse date) utf-8 all")
+	tc.xuntagged(imapclient.UntaggedSort{1, 3, 2})
+
+	tc.transactf("ok", "sort (size) utf-8 all")
+	tc.xuntagged(imapclient.UntaggedSort{2, 1, 3})
+
+	// Case-insensitive with i;ascii-casemap.
+	tc.transactf("ok", "sort (from) utf-8 all")
+	tc.xuntagged(imapclient.UntaggedSort{2, 1, 3})
+
+	tc.transactf("ok", "sort (to) utf-8 all")
+	tc.xuntagged(imapclient.UntaggedSort{2, 3, 1})
+
+	// Base subjects "test" are equal, ties broken by sequence number.
+	tc.transactf("ok", "sort (subject) utf-8 all")
+	tc.xuntagged(imapclient.UntaggedSort{3, 1, 2})
+
+	tc.transactf("ok", "sort (subject reverse date) utf-8 all")
+	tc.xuntagged(imapclient.UntaggedSort{3, 1, 2})
+
+	tc.transactf("ok", "sort (reverse subject date) utf-8 all")
+	tc.xuntagged(imapclient.UntaggedSort{2, 1, 3})
+
+	// With search criteria.
+	tc.transactf("ok", "sort (date) utf-8 subject test")
+	tc.xuntagged(imapclient.UntaggedSort{2, 1})
+
+	tc.transactf("ok", "uid sort (reverse arrival) utf-8 all")
+	tc.xuntagged(imapclient.UntaggedSort{2, 1, 3})
+
+	tc.transactf("ok", "sort (arrival) utf-8 subject nothing")
+	tc.xuntagged(imapclient.UntaggedSort(nil))
+
+	tc.transactf("no", "sort (arrival) iso-8859-1 all")
+	tc.xcode("BADCHARSET")
+
+	tc.transactf("bad", "sort (arrival)")                 // Missing charset.
+	tc.transactf("bad", "sort () utf-8 all")              // Missing sort key.
+	tc.transactf("bad", "sort (bogus) utf-8 all")         // Unknown sort key.
+	tc.transactf("bad", "sort (reverse) utf-8 all")       // Missing sort key after reverse.
+	tc.transactf("bad", "sort (arrival) utf-8")           // Missing search key.
+	tc.transactf("bad", "sort (arrival)(date) utf-8 all") // Bad syntax.
+}
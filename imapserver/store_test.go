@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/mjl-/mox/imapclient"
+	"github.com/mjl-/mox/mox-"
 )
 
 func TestStore(t *testing.T) {
@@ -82,3 +83,40 @@ func TestStore(t *testing.T) {
 
 	tc.transactf("no", `store 1 flags ()`) // No permission to set flags.
 }
+
+func TestStoreJunkMove(t *testing.T) {
+	tc := start(t)
+	defer tc.close()
+
+	accConf := mox.Conf.Dynamic.Accounts["mjl"]
+	nc := accConf
+	nc.MoveOnJunkFlags = true
+	mox.Conf.Dynamic.Accounts["mjl"] = nc
+	defer func() {
+		mox.Conf.Dynamic.Accounts["mjl"] = accConf
+	}()
+
+	tc.client.Login("mjl@mox.example", "testtest")
+	tc.client.Enable("imap4rev2")
+
+	tc.client.Append("inbox", nil, nil, []byte(exampleMsg))
+	tc.client.Append("inbox", nil, nil, []byte(exampleMsg))
+	tc.client.Select("inbox")
+
+	// Other flags don't cause a move.
+	tc.transactf("ok", `store 1 flags.silent (\Seen)`)
+	tc.xuntagged()
+
+	// Marking as phishing moves to Junk.
+	tc.transactf("ok", `store 2 +flags.silent ($Phishing)`)
+	tc.xuntagged(imapclient.UntaggedExpunge(2))
+	tc.transactf("ok", `status Junk (messages)`)
+	tc.xuntagged(imapclient.UntaggedStatus{Mailbox: "Junk", Attrs: map[string]int64{"MESSAGES": 1}})
+
+	// Marking as not junk in Junk moves to Inbox.
+	tc.client.Select("Junk")
+	tc.transactf("ok", `store 1 flags.silent ($NotJunk)`)
+	tc.xuntagged(imapclient.UntaggedExpunge(1))
+	tc.transactf("ok", `status inbox (messages)`)
+	tc.xuntagged(imapclient.UntaggedStatus{Mailbox: "Inbox", Attrs: map[string]int64{"MESSAGES": 2}})
+}
@@ -0,0 +1,352 @@
+package imapserver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/store"
+)
+
+// threadNode is a message in a thread, or a dummy parent for messages that only
+// have a common missing parent.
+type threadNode struct {
+	msg      *threadMsg // Nil for dummy.
+	parent   *threadNode
+	children []*threadNode
+}
+
+// threadMsg holds the threading values of a message.
+type threadMsg struct {
+	seq        msgseq
+	uid        store.UID
+	messageID  string
+	refs       []string
+	subject    string // Base subject.
+	isResponse bool
+	date       time.Time
+}
+
+// Thread returns messages matching search criteria, grouped in threads.
+//
+// State: Selected
+func (c *conn) cmdxThread(isUID bool, tag, cmd string, p *parser) {
+	// Command: ../rfc/5256:162
+	// Syntax: ../rfc/5256:781
+
+	p.xspace()
+	algorithm := p.xtakelist("ORDEREDSUBJECT", "REFERENCES")
+
+	l, expungeIssued := c.xsortThreadMessages(p)
+	msgs := make([]*threadMsg, len(l))
+	for i, sm := range l {
+		msgs[i] = c.threadMsg(sm.seq, sm.m)
+	}
+	// Sibling dates compare equal are ordered by sequence number. ../rfc/5256:565
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].seq < msgs[j].seq
+	})
+
+	var roots []*threadNode
+	switch algorithm {
+	case "ORDEREDSUBJECT":
+		roots = threadOrderedSubject(msgs)
+	case "REFERENCES":
+		roots = threadReferences(msgs)
+	}
+
+	// Response syntax: ../rfc/5256:787
+	var b strings.Builder
+	b.WriteString("* THREAD")
+	if len(roots) > 0 {
+		b.WriteString(" ")
+	}
+	for _, n := range roots {
+		b.WriteString("(")
+		threadWrite(&b, n, isUID)
+		b.WriteString(")")
+	}
+	c.bwritelinef("%s", b.String())
+	if expungeIssued {
+		// ../rfc/9051:5102
+		c.writeresultf("%s OK [EXPUNGEISSUED] done", tag)
+	} else {
+		c.ok(tag, cmd)
+	}
+}
+
+// threadMsg returns the threading values for a message. For messages delivered
+// before threading values were stored, they are gathered by parsing the message.
+func (c *conn) threadMsg(seq msgseq, m store.Message) *threadMsg {
+	if m.ThreadDate.IsZero() {
+		if m.ParsedBuf == nil {
+			c.log.Error("missing parsed message")
+			m.ThreadDate = m.Received
+		} else {
+			mr := c.account.MessageReader(m)
+			if p, err := m.LoadPart(mr); err != nil {
+				c.log.Debugx("loading parsed message for thread", err)
+				m.ThreadDate = m.Received
+			} else {
+				m.PrepareThreading(c.log, &p)
+			}
+			err := mr.Close()
+			c.xsanity(err, "closing message reader")
+		}
+	}
+	return &threadMsg{
+		seq:        seq,
+		uid:        m.UID,
+		messageID:  message.MessageIDCanonical(m.MessageID),
+		refs:       m.ThreadRefs,
+		subject:    m.ThreadSubject,
+		isResponse: m.ThreadResponse,
+		date:       m.ThreadDate,
+	}
+}
+
+// threadWrite writes the thread members starting at n: the message and its
+// descendants. A single child is written as continuation, multiple children as
+// nested threads.
+func threadWrite(b *strings.Builder, n *threadNode, isUID bool) {
+	if n.msg != nil {
+		if isUID {
+			fmt.Fprintf(b, "%d", n.msg.uid)
+		} else {
+			fmt.Fprintf(b, "%d", n.msg.seq)
+		}
+		if len(n.children) == 1 {
+			b.WriteString(" ")
+			threadWrite(b, n.children[0], isUID)
+			return
+		} else if len(n.children) > 1 {
+			b.WriteString(" ")
+		}
+	}
+	for _, cn := range n.children {
+		b.WriteString("(")
+		threadWrite(b, cn, isUID)
+		b.WriteString(")")
+	}
+}
+
+// threadOrderedSubject groups messages by base subject. The first message by
+// sent date is the parent of the other messages with the same base subject.
+// Threads are ordered by the sent date of their first message. ../rfc/5256:394
+func threadOrderedSubject(msgs []*threadMsg) []*threadNode {
+	l := append([]*threadMsg{}, msgs...)
+	sort.SliceStable(l, func(i, j int) bool {
+		a, b := l[i], l[j]
+		if cmp := compareASCIICasemap(a.subject, b.subject); cmp != 0 {
+			return cmp < 0
+		}
+		return a.date.Before(b.date)
+	})
+
+	var roots []*threadNode
+	var last *threadNode
+	for _, m := range l {
+		if last != nil && compareASCIICasemap(last.msg.subject, m.subject) == 0 {
+			last.children = append(last.children, &threadNode{msg: m, parent: last})
+			continue
+		}
+		last = &threadNode{msg: m}
+		roots = append(roots, last)
+	}
+	threadSort(roots)
+	return roots
+}
+
+// threadReferences groups messages by the message-ids they reference, and merges
+// threads with the same base subject. ../rfc/5256:412
+func threadReferences(msgs []*threadMsg) []*threadNode {
+	// (1) Link messages through their references, with dummy nodes for referenced
+	// messages that are not present. ../rfc/5256:435
+	ids := map[string]*threadNode{}
+	var nodes []*threadNode // In order of creation, for a deterministic root set.
+	node := func(id string) *threadNode {
+		n := ids[id]
+		if n == nil {
+			n = &threadNode{}
+			ids[id] = n
+			nodes = append(nodes, n)
+		}
+		return n
+	}
+	// isAncestor returns whether a is n or one of its ancestors.
+	isAncestor := func(a, n *threadNode) bool {
+		for ; n != nil; n = n.parent {
+			if n == a {
+				return true
+			}
+		}
+		return false
+	}
+	unlink := func(n *threadNode) {
+		if p := n.parent; p != nil {
+			for i, cn := range p.children {
+				if cn == n {
+					p.children = append(p.children[:i:i], p.children[i+1:]...)
+					break
+				}
+			}
+			n.parent = nil
+		}
+	}
+	link := func(parent, child *threadNode) {
+		unlink(child)
+		child.parent = parent
+		parent.children = append(parent.children, child)
+	}
+	for _, m := range msgs {
+		// Messages without or with a duplicate message-id get a unique id.
+		var n *threadNode
+		if m.messageID != "" {
+			if xn := ids[m.messageID]; xn == nil || xn.msg == nil {
+				n = node(m.messageID)
+			}
+		}
+		if n == nil {
+			n = node(fmt.Sprintf("\x00%d", m.seq))
+		}
+		n.msg = m
+
+		// Link the references parent/child, but don't change existing links, and don't
+		// create loops.
+		var prev *threadNode
+		for _, ref := range m.refs {
+			rn := node(ref)
+			if prev != nil && rn.parent == nil && !isAncestor(rn, prev) {
+				link(prev, rn)
+			}
+			prev = rn
+		}
+		// The last reference is the parent of the message, replacing a link presumed
+		// from the references of other messages.
+		if prev == nil {
+			unlink(n)
+		} else if n.parent != prev && !isAncestor(n, prev) {
+			link(prev, n)
+		}
+	}
+
+	// (2) Gather the root set. (3) We forget about the ids.
+	var roots []*threadNode
+	for _, n := range nodes {
+		if n.parent == nil {
+			roots = append(roots, n)
+		}
+	}
+
+	// (4) Prune dummies. ../rfc/5256:490
+	roots = threadPrune(roots, true)
+	for _, n := range roots {
+		n.parent = nil
+	}
+
+	// (5) Group threads with the same base subject. ../rfc/5256:513
+	subjectNode := func(n *threadNode) *threadMsg {
+		if n.msg != nil {
+			return n.msg
+		}
+		return n.children[0].msg
+	}
+	subjects := map[string]*threadNode{}
+	for _, n := range roots {
+		m := subjectNode(n)
+		if m.subject == "" {
+			continue
+		}
+		k := asciiUpper(m.subject)
+		o := subjects[k]
+		if o == nil || o.msg != nil && n.msg == nil || o.msg != nil && n.msg != nil && o.msg.isResponse && !n.msg.isResponse {
+			subjects[k] = n
+		}
+	}
+	var nroots []*threadNode
+	for _, n := range roots {
+		m := subjectNode(n)
+		if m.subject == "" {
+			nroots = append(nroots, n)
+			continue
+		}
+		k := asciiUpper(m.subject)
+		o := subjects[k]
+		if o == n {
+			nroots = append(nroots, n)
+			continue
+		}
+		switch {
+		case o.msg == nil && n.msg == nil:
+			for _, cn := range n.children {
+				cn.parent = o
+			}
+			o.children = append(o.children, n.children...)
+		case o.msg == nil:
+			link(o, n)
+		case n.msg.isResponse && !o.msg.isResponse:
+			link(o, n)
+		default:
+			// A new dummy with both as children, in the place of the one in the subject table.
+			d := &threadNode{}
+			*d, *o = *o, threadNode{}
+			for _, cn := range d.children {
+				cn.parent = d
+			}
+			o.children = []*threadNode{d, n}
+			d.parent = o
+			n.parent = o
+		}
+	}
+
+	// (6) Sort the siblings by date.
+	threadSort(nroots)
+	return nroots
+}
+
+// threadPrune removes dummies without children, and replaces dummies with
+// children by their children. At the root level, dummies are only replaced if
+// they have a single child. ../rfc/5256:490
+func threadPrune(l []*threadNode, root bool) []*threadNode {
+	var r []*threadNode
+	for _, n := range l {
+		n.children = threadPrune(n.children, false)
+		for _, cn := range n.children {
+			cn.parent = n
+		}
+		if n.msg != nil {
+			r = append(r, n)
+		} else if len(n.children) == 0 {
+			continue
+		} else if root && len(n.children) > 1 {
+			r = append(r, n)
+		} else {
+			r = append(r, n.children...)
+		}
+	}
+	return r
+}
+
+// threadSort sorts siblings by sent date, starting with the deepest descendants.
+// Dummies take the date of their first child. Equal dates are ordered by sequence
+// number. ../rfc/5256:551
+func threadSort(l []*threadNode) {
+	for _, n := range l {
+		threadSort(n.children)
+	}
+	first := func(n *threadNode) *threadMsg {
+		for n.msg == nil {
+			n = n.children[0]
+		}
+		return n.msg
+	}
+	sort.SliceStable(l, func(i, j int) bool {
+		a, b := first(l[i]), first(l[j])
+		if !a.date.Equal(b.date) {
+			return a.date.Before(b.date)
+		}
+		return a.seq < b.seq
+	})
+}
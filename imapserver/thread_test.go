@@ -0,0 +1,70 @@
+package imapserver
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/mjl-/mox/imapclient"
+)
+
+func TestThread(t *testing.T) {
+	defer mockUIDValidity()()
+	tc := start(t)
+	defer tc.close()
+	tc.client.Login("mjl@mox.example", "testtest")
+	tc.client.Select("inbox")
+
+	threadMsg := func(day int, id, refs, subject string) []byte {
+		s := fmt.Sprintf("Date: %d Jan 2022 10:00:00 +0000\nMessage-Id: %s\nSubject: %s\n", day, id, subject)
+		if refs != "" {
+			s += fmt.Sprintf("References: %s\n", refs)
+		}
+		s += "\ntest\n"
+		return []byte(strings.ReplaceAll(s, "\n", "\r\n"))
+	}
+
+	tc.client.Append("inbox", nil, nil, threadMsg(2, "<1@x>", "", "test"))
+	tc.client.Append("inbox", nil, nil, threadMsg(3, "<2@x>", "<1@x>", "Re: test"))
+	tc.client.Append("inbox", nil, nil, threadMsg(4, "<3@x>", "<1@x> <2@x>", "Re: test"))
+	tc.client.Append("inbox", nil, nil, threadMsg(5, "<4@x>", "<missing@x>", "other"))
+	tc.client.Append("inbox", nil, nil, threadMsg(6, "<5@x>", "<missing@x>", "Re: other"))
+	tc.client.Append("inbox", nil, nil, threadMsg(7, "<6@x>", "", "Re: test"))
+	tc.client.Append("inbox", nil, nil, threadMsg(1, "<7@x>", "", "unrelated"))
+
+	type tm = imapclient.ThreadMember
+
+	// Message 6 is added to the thread based on its subject. Messages 4 and 5 have a
+	// common missing parent.
+	tc.transactf("ok", "thread references utf-8 all")
+	tc.xuntagged(imapclient.UntaggedThread{
+		{Num: 7},
+		{Num: 1, Children: []tm{{Num: 2, Children: []tm{{Num: 3}}}, {Num: 6}}},
+		{Children: []tm{{Num: 4}, {Num: 5}}},
+	})
+
+	tc.transactf("ok", "thread orderedsubject us-ascii all")
+	tc.xuntagged(imapclient.UntaggedThread{
+		{Num: 7},
+		{Num: 1, Children: []tm{{Num: 2}, {Num: 3}, {Num: 6}}},
+		{Num: 4, Children: []tm{{Num: 5}}},
+	})
+
+	// Only matching messages are threaded.
+	tc.transactf("ok", "uid thread references utf-8 2:3,5")
+	tc.xuntagged(imapclient.UntaggedThread{
+		{Num: 2, Children: []tm{{Num: 3}}},
+		{Num: 5},
+	})
+
+	tc.transactf("ok", "thread references utf-8 subject nothing")
+	tc.xuntagged(imapclient.UntaggedThread(nil))
+
+	tc.transactf("no", "thread references iso-8859-1 all")
+	tc.xcode("BADCHARSET")
+
+	tc.transactf("bad", "thread bogus utf-8 all")        // Unknown algorithm.
+	tc.transactf("bad", "thread references utf-8")       // Missing search key.
+	tc.transactf("bad", "thread references")             // Missing charset.
+	tc.transactf("bad", "thread (references) utf-8 all") // Bad syntax.
+}
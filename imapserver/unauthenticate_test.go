@@ -0,0 +1,105 @@
+package imapserver
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjl-/mox/imapclient"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/store"
+)
+
+func TestUnauthenticate(t *testing.T) {
+	tc := start(t)
+	defer tc.close()
+
+	acc, err := store.OpenAccount("other")
+	tcheck(t, err, "open account")
+	err = acc.SetPassword("testtest")
+	tcheck(t, err, "set password")
+	err = acc.Close()
+	tcheck(t, err, "close account")
+
+	// Whether the last select returned a HIGHESTMODSEQ, i.e. CONDSTORE was enabled.
+	highestModSeq := func() bool {
+		for _, u := range tc.lastUntagged {
+			if r, ok := u.(imapclient.UntaggedResult); ok && r.Code == "HIGHESTMODSEQ" {
+				return true
+			}
+		}
+		return false
+	}
+
+	tc.transactf("no", "unauthenticate") // Not authenticated.
+
+	tc.client.Login("mjl@mox.example", "testtest")
+	tc.client.Enable("condstore")
+	tc.transactf("ok", "select inbox")
+	if !highestModSeq() {
+		t.Fatalf("no highestmodseq after enabling condstore")
+	}
+
+	tc.transactf("bad", "unauthenticate bogus") // Leftover data.
+	tc.transactf("ok", "unauthenticate")
+	tc.transactf("no", "select inbox") // Not authenticated.
+	tc.transactf("no", "unauthenticate")
+
+	// Enabled extensions are reset for the next login.
+	tc.client.Login("other@mox.example", "testtest")
+	tc.transactf("ok", "select inbox")
+	if highestModSeq() {
+		t.Fatalf("highestmodseq after unauthenticate and login, condstore still enabled")
+	}
+	tc.client.Append("inbox", nil, nil, []byte(exampleMsg))
+	tc.transactf("ok", "unauthenticate")
+
+	// Original account does not have the message delivered to the other account.
+	tc.client.Login("mjl@mox.example", "testtest")
+	tc.transactf("ok", "status inbox (messages)")
+	tc.xuntagged(imapclient.UntaggedStatus{Mailbox: "Inbox", Attrs: map[string]int64{"MESSAGES": 0}})
+}
+
+// A protocol transcript for an account ends at unauthenticate, a next login for
+// another account is not written to it.
+func TestUnauthenticateTranscript(t *testing.T) {
+	tc := start(t)
+	defer tc.close()
+
+	acc, err := store.OpenAccount("other")
+	tcheck(t, err, "open account")
+	err = acc.SetPassword("testtest")
+	tcheck(t, err, "set password")
+	err = acc.Close()
+	tcheck(t, err, "close account")
+
+	pt, err := mox.TraceAdd(xlog, "mjl", "", time.Hour)
+	tcheck(t, err, "add trace")
+	defer mox.TraceRemove(xlog, pt.ID)
+
+	tc.client.Login("mjl@mox.example", "testtest")
+	tc.transactf("ok", "noop")
+	tc.transactf("ok", "unauthenticate")
+	tc.client.Login("other@mox.example", "testtest")
+	tc.transactf("ok", "select inbox")
+	tc.close()
+
+	dir := mox.DataDirPath("traces")
+	defer os.RemoveAll(dir)
+	files, err := os.ReadDir(dir)
+	tcheck(t, err, "list transcripts")
+	if len(files) != 1 {
+		t.Fatalf("got %d transcripts, expected 1", len(files))
+	}
+	buf, err := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	tcheck(t, err, "read transcript")
+	s := string(buf)
+	if !strings.Contains(s, "noop") || !strings.Contains(s, "unauthenticate") {
+		t.Fatalf("transcript %q does not contain session of account", s)
+	}
+	if strings.Contains(s, "select inbox") {
+		t.Fatalf("transcript %q contains session of next login", s)
+	}
+}
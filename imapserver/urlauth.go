@@ -0,0 +1,196 @@
+package imapserver
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/store"
+)
+
+// URLAUTH lets users generate IMAP URLs for their messages that carry an
+// authorization token, so others, e.g. a submission server for BURL, can fetch
+// the message data. Tokens are HMACs over the URL with a per-mailbox key, the
+// "INTERNAL" mechanism. Resetting the key invalidates all URLs of the mailbox.
+// ../rfc/4467
+
+// xurlauthOpen validates the URLAUTH authorization of u for the current user:
+// The access identifier must allow the user, the URL must not be expired, and
+// the token must be valid for the mailbox. The account of the owner of the
+// mailbox, the user in the URL, is returned, and must be closed by the caller.
+func (c *conn) xurlauthOpen(u imapURL) *store.Account {
+	if u.token == "" {
+		xuserErrorf("url without urlauth token")
+	} else if !strings.EqualFold(u.mechanism, "INTERNAL") {
+		xuserErrorf("unsupported urlauth mechanism %q", u.mechanism)
+	} else if !u.expire.IsZero() && !time.Now().Before(u.expire) {
+		xuserErrorf("url has expired")
+	}
+	switch u.accessKind {
+	case "anonymous", "authuser":
+		// We only serve authenticated users.
+	case "user":
+		if !strings.EqualFold(u.accessUser, c.username) {
+			xuserErrorf("url not authorized for user")
+		}
+	default:
+		// Only the submission server acting for the user, for BURL.
+		xuserErrorf("url only authorized for submission")
+	}
+
+	name := xcheckmailboxname(u.mailbox, true)
+	acc, _, err := store.OpenEmail(u.user)
+	if err != nil {
+		c.log.Debugx("open account for urlauth", err, mlog.Field("user", u.user))
+		xuserErrorf("invalid url authorization")
+	}
+	var valid bool
+	acc.WithRLock(func() {
+		err = store.DBRead(context.TODO(), c.log, "imapserver", acc.DB, func(tx *bstore.Tx) error {
+			mb, err := acc.MailboxFind(tx, name)
+			if err != nil || mb == nil || u.uidValidity != mb.UIDValidity {
+				return err
+			}
+			valid, err = store.URLAuthVerify(tx, mb.ID, u.rump, u.token)
+			return err
+		})
+	})
+	if err != nil || !valid {
+		xerr := acc.Close()
+		c.xsanity(xerr, "closing account of url")
+	}
+	xcheckf(err, "verifying url authorization")
+	if !valid {
+		xuserErrorf("invalid url authorization")
+	}
+	return acc
+}
+
+// Reset the urlauth keys of one or all mailboxes.
+//
+// State: Authenticated and Selected.
+func (c *conn) cmdResetkey(tag, cmd string, p *parser) {
+	// Command: ../rfc/4467
+	var name string
+	if p.space() {
+		name = p.xmailbox()
+		for p.space() {
+			if mech := p.xatom(); !strings.EqualFold(mech, "INTERNAL") {
+				xuserErrorf("unsupported urlauth mechanism %q", mech)
+			}
+		}
+	}
+	p.xempty()
+
+	c.account.WithWLock(func() {
+		c.xdbwrite(func(tx *bstore.Tx) {
+			var mailboxID int64
+			if name != "" {
+				name = xcheckmailboxname(name, true)
+				mailboxID = c.xmailbox(tx, name, "NONEXISTENT").ID
+			}
+			err := store.URLAuthKeyReset(tx, mailboxID)
+			xcheckf(err, "resetting urlauth keys")
+		})
+	})
+	c.ok(tag, cmd)
+}
+
+// Generate URLs with URLAUTH authorization.
+//
+// State: Authenticated and Selected.
+func (c *conn) cmdGenurlauth(tag, cmd string, p *parser) {
+	// Command: ../rfc/4467
+	type rumpMech struct {
+		u    imapURL
+		mech string
+	}
+	var l []rumpMech
+	for p.space() {
+		s := p.xastring()
+		p.xspace()
+		mech := p.xatom()
+		u, err := parseIMAPURL(s)
+		if err != nil {
+			xusercodeErrorf("BADURL "+strings.ReplaceAll(s, "]", "%5D"), "parsing url: %v", err)
+		}
+		l = append(l, rumpMech{u, mech})
+	}
+	if len(l) == 0 {
+		xsyntaxErrorf("missing url")
+	}
+	p.xempty()
+
+	for _, rm := range l {
+		u := rm.u
+		badURL := "BADURL " + strings.ReplaceAll(u.rump, "]", "%5D")
+		if u.accessKind == "" || u.token != "" || u.mechanism != "" {
+			xusercodeErrorf(badURL, "url must end with urlauth access identifier, without mechanism")
+		} else if !strings.EqualFold(rm.mech, "INTERNAL") {
+			xusercodeErrorf(badURL, "unsupported urlauth mechanism %q", rm.mech)
+		} else if !strings.EqualFold(u.user, c.username) {
+			xusercodeErrorf(badURL, "url must be for the authenticated user")
+		} else if u.uidValidity == 0 {
+			xusercodeErrorf(badURL, "url must have uidvalidity")
+		}
+	}
+
+	var urls []string
+	c.account.WithWLock(func() {
+		c.xdbwrite(func(tx *bstore.Tx) {
+			for _, rm := range l {
+				u := rm.u
+				name := xcheckmailboxname(u.mailbox, true)
+				mb, err := c.account.MailboxFind(tx, name)
+				xcheckf(err, "looking up mailbox")
+				if mb == nil || mb.UIDValidity != u.uidValidity {
+					xusercodeErrorf("BADURL "+strings.ReplaceAll(u.rump, "]", "%5D"), "unknown mailbox or uidvalidity mismatch")
+				}
+				token, err := store.URLAuthToken(tx, mb.ID, u.rump)
+				xcheckf(err, "generating urlauth token")
+				urls = append(urls, u.rump+":internal:"+token)
+			}
+		})
+	})
+
+	var b strings.Builder
+	b.WriteString("* GENURLAUTH")
+	for _, s := range urls {
+		b.WriteString(" ")
+		b.WriteString(string0(s).pack(c))
+	}
+	c.bwritelinef("%s", b.String())
+	c.ok(tag, cmd)
+}
+
+// Fetch the message data referenced by URLs with URLAUTH authorization.
+//
+// State: Authenticated and Selected.
+func (c *conn) cmdUrlfetch(tag, cmd string, p *parser) {
+	// Command: ../rfc/4467
+	var urls []string
+	for p.space() {
+		urls = append(urls, p.xastring())
+	}
+	if len(urls) == 0 {
+		xsyntaxErrorf("missing url")
+	}
+	p.xempty()
+
+	for _, s := range urls {
+		// todo: stream large messages through a temporary file instead of memory.
+		var buf bytes.Buffer
+		if _, err := c.writeURL(s, &buf, true); err != nil {
+			// Invalid URLs get NIL, the command still succeeds.
+			c.log.Debugx("urlfetch", err, mlog.Field("url", s))
+			c.bwritelinef("* URLFETCH %s NIL", astring(s).pack(c))
+			continue
+		}
+		c.bwritelinef("* URLFETCH %s %s", astring(s).pack(c), syncliteral(buf.String()).pack(c))
+	}
+	c.ok(tag, cmd)
+}
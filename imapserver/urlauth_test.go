@@ -0,0 +1,109 @@
+package imapserver
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjl-/mox/imapclient"
+	"github.com/mjl-/mox/store"
+)
+
+func TestURLAuth(t *testing.T) {
+	defer mockUIDValidity()()
+	tc := start(t)
+	defer tc.close()
+
+	acc, err := store.OpenAccount("other")
+	tcheck(t, err, "open account")
+	err = acc.SetPassword("testtest")
+	tcheck(t, err, "set password")
+	err = acc.Close()
+	tcheck(t, err, "close account")
+
+	tc2 := startNoSwitchboard(t)
+	defer tc2.close()
+
+	tc.client.Login("mjl@mox.example", "testtest")
+	tc2.client.Login("other@mox.example", "testtest")
+	tc.client.Append("inbox", nil, nil, []byte(exampleMsg))
+
+	genurlauth := func(rump string) string {
+		t.Helper()
+		tc.transactf("ok", "genurlauth %q internal", rump)
+		if len(tc.lastUntagged) != 1 {
+			t.Fatalf("got %v, expected single genurlauth response", tc.lastUntagged)
+		}
+		l, ok := tc.lastUntagged[0].(imapclient.UntaggedGenurlauth)
+		if !ok || len(l) != 1 || !strings.HasPrefix(l[0], rump+":internal:") {
+			t.Fatalf("got %v, expected genurlauth response for %s", tc.lastUntagged[0], rump)
+		}
+		return l[0]
+	}
+	urlfetch := func(tc *testconn, url string, data string, valid bool) {
+		t.Helper()
+		tc.transactf("ok", "urlfetch %q", url)
+		exp := imapclient.UntaggedURLFetch{URL: url}
+		if valid {
+			exp.Data = []byte(data)
+		}
+		tc.xuntagged(exp)
+	}
+
+	const base = "imap://mjl%40mox.example@mox.example/Inbox;UIDVALIDITY=1/;UID=1"
+	url := genurlauth(base + ";URLAUTH=authuser")
+	urlfetch(tc, url, exampleMsg, true)
+	urlfetch(tc2, url, exampleMsg, true)
+
+	// Token must match.
+	urlfetch(tc, url[:len(url)-1]+"x", "", false)
+	urlfetch(tc, strings.Replace(url, "UID=1", "UID=2", 1), "", false)
+
+	// Only for a specific user, and for submission.
+	url = genurlauth(base + "/;SECTION=HEADER;URLAUTH=user+other%40mox.example")
+	urlfetch(tc, url, "", false)
+	urlfetch(tc2, url, exampleMsg[:strings.Index(exampleMsg, "\r\n\r\n")+4], true)
+	urlfetch(tc2, genurlauth(base+";URLAUTH=submit+other%40mox.example"), "", false)
+
+	// Expiration.
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	urlfetch(tc2, genurlauth(base+"/;PARTIAL=0.4;EXPIRE="+future+";URLAUTH=anonymous"), exampleMsg[:4], true)
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	urlfetch(tc2, genurlauth(base+";EXPIRE="+past+";URLAUTH=anonymous"), "", false)
+
+	// URLAUTH URLs can be used in CATENATE, also by other users.
+	url = genurlauth(base + ";URLAUTH=authuser")
+	tc2.transactf("ok", "append inbox catenate (url %q)", url)
+	tc2.transactf("ok", "status inbox (messages size)")
+	tc2.xuntagged(imapclient.UntaggedStatus{Mailbox: "Inbox", Attrs: map[string]int64{"MESSAGES": 1, "SIZE": int64(len(exampleMsg))}})
+
+	// URLs without urlauth are not fetched.
+	urlfetch(tc, base, "", false)
+
+	// Resetting the key invalidates urls.
+	tc.transactf("ok", "resetkey inbox internal")
+	urlfetch(tc, url, "", false)
+	url = genurlauth(base + ";URLAUTH=authuser")
+	urlfetch(tc, url, exampleMsg, true)
+	tc.transactf("ok", "resetkey")
+	urlfetch(tc, url, "", false)
+	tc.transactf("no", "resetkey nonexistent")
+	tc.xcode("NONEXISTENT")
+	tc.transactf("no", "resetkey inbox bogus")
+
+	// Generating URLs for other users, without access identifier, with token, unknown
+	// mechanism, mailbox or uidvalidity.
+	for _, rump := range []string{
+		"imap://other%40mox.example@mox.example/Inbox;UIDVALIDITY=1/;UID=1;URLAUTH=authuser",
+		base,
+		base + ";URLAUTH=authuser:internal:0123",
+		"imap://mjl%40mox.example@mox.example/Bogus;UIDVALIDITY=1/;UID=1;URLAUTH=authuser",
+		"imap://mjl%40mox.example@mox.example/Inbox;UIDVALIDITY=2/;UID=1;URLAUTH=authuser",
+		"imap://mjl%40mox.example@mox.example/Inbox/;UID=1;URLAUTH=authuser",
+	} {
+		tc.transactf("no", "genurlauth %q internal", rump)
+	}
+	tc.transactf("no", "genurlauth %q bogus", base+";URLAUTH=authuser")
+	tc.transactf("bad", "genurlauth")
+	tc.transactf("bad", "urlfetch")
+}
@@ -76,6 +76,34 @@ maildir directories/files.
 	ctlcmdImport(xctl(), true, args[0], args[1], args[2])
 }
 
+func cmdImportArchive(c *cmd) {
+	c.params = "accountname archive"
+	c.help = `Import an archival export into an account.
+
+The archive, as created with "mox export archive", is first verified, see "mox
+export verify". Only if it is intact are its mailboxes and messages added to the
+account. Mailboxes are created as needed, messages get new UIDs but keep their
+received time, flags and keywords. The junk filter is trained with the messages.
+
+The archive is read by the mox process, so make sure it has access to the file.
+`
+	args := c.Parse()
+	if len(args) != 2 {
+		c.Usage()
+	}
+	mustLoadConfig()
+	ctlcmdImportArchive(xctl(), args[0], args[1])
+}
+
+func ctlcmdImportArchive(ctl *ctl, account, src string) {
+	ctl.xwrite("importarchive")
+	ctl.xwrite(account)
+	ctl.xwrite(src)
+	ctl.xreadok()
+	count := ctl.xread()
+	fmt.Fprintf(os.Stderr, "%s imported\n", count)
+}
+
 func cmdXImportMaildir(c *cmd) {
 	c.unlisted = true
 	c.params = "accountdir mailboxname maildir"
@@ -281,7 +309,7 @@ func importctl(ctx context.Context, ctl *ctl, mbox bool) {
 		ctl.xcheck(err, "delivering message")
 		deliveredIDs = append(deliveredIDs, m.ID)
 		ctl.log.Debug("delivered message", mlog.Field("id", m.ID))
-		changes = append(changes, store.ChangeAddUID{MailboxID: m.MailboxID, UID: m.UID, Flags: m.Flags, Keywords: m.Keywords})
+		changes = append(changes, store.ChangeAddUID{MailboxID: m.MailboxID, UID: m.UID, ModSeq: m.ModSeq, Flags: m.Flags, Keywords: m.Keywords})
 	}
 
 	// todo: one goroutine for reading messages, one for parsing the message, one adding to database, one for junk filter training.
@@ -0,0 +1,418 @@
+package jmapserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/metrics"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/store"
+)
+
+// Request object. ../rfc/8620 section 3.3
+type request struct {
+	Using       []string          `json:"using"`
+	MethodCalls []invocation      `json:"methodCalls"`
+	CreatedIDs  map[string]string `json:"createdIds,omitempty"`
+}
+
+// Response object. ../rfc/8620 section 3.4
+type response struct {
+	MethodResponses []invocation      `json:"methodResponses"`
+	CreatedIDs      map[string]string `json:"createdIds,omitempty"`
+	SessionState    string            `json:"sessionState"`
+}
+
+// invocation is a method call or method response, a JSON array with the name,
+// the arguments object and the method call ID. ../rfc/8620 section 3.2
+type invocation struct {
+	Name   string
+	Args   json.RawMessage
+	CallID string
+}
+
+func (i invocation) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]any{i.Name, i.Args, i.CallID})
+}
+
+func (i *invocation) UnmarshalJSON(buf []byte) error {
+	var l []json.RawMessage
+	if err := json.Unmarshal(buf, &l); err != nil {
+		return err
+	}
+	if len(l) != 3 {
+		return fmt.Errorf("invocation has %d elements, must have 3", len(l))
+	}
+	if err := json.Unmarshal(l[0], &i.Name); err != nil {
+		return fmt.Errorf("method name: %w", err)
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(l[1]), []byte("{")) {
+		return errors.New("method arguments must be an object")
+	}
+	i.Args = l[1]
+	if err := json.Unmarshal(l[2], &i.CallID); err != nil {
+		return fmt.Errorf("method call id: %w", err)
+	}
+	return nil
+}
+
+// methodError is a method-level error, sent as "error" response.
+// ../rfc/8620 section 3.6.2
+type methodError struct {
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+}
+
+func (e methodError) Error() string {
+	return e.Type + ": " + e.Description
+}
+
+func xmethodErrorf(typ, format string, args ...any) {
+	panic(methodError{typ, fmt.Sprintf(format, args...)})
+}
+
+type serverError struct{ err error }
+
+func (e serverError) Error() string { return e.err.Error() }
+func (e serverError) Unwrap() error { return e.err }
+
+func xcheckf(err error, format string, args ...any) {
+	if err != nil {
+		panic(serverError{fmt.Errorf("%s: %w", fmt.Sprintf(format, args...), err)})
+	}
+}
+
+// call is a method call in an API request.
+type call struct {
+	*session
+	using      map[string]bool   // Capabilities from the request.
+	createdIDs map[string]string // From creation ID to ID, for the whole request.
+	name       string
+	callID     string
+	implicit   []invocation // Method calls to execute after this call, e.g. Email/set after EmailSubmission/set.
+}
+
+type method struct {
+	capability string // Capability that must be in "using" of the request.
+	fn         func(c *call, args json.RawMessage) any
+}
+
+// Methods by name. Methods return an object with the response arguments, or
+// panic with a methodError.
+var methods = map[string]method{
+	"Core/echo": {capCore, (*call).coreEcho},
+
+	"Mailbox/get":          {capMail, (*call).mailboxGet},
+	"Mailbox/changes":      {capMail, (*call).mailboxChanges},
+	"Mailbox/query":        {capMail, (*call).mailboxQuery},
+	"Mailbox/queryChanges": {capMail, (*call).queryChanges},
+	"Mailbox/set":          {capMail, (*call).mailboxSet},
+
+	"Thread/get":     {capMail, (*call).threadGet},
+	"Thread/changes": {capMail, (*call).threadChanges},
+
+	"Email/get":          {capMail, (*call).emailGet},
+	"Email/changes":      {capMail, (*call).emailChanges},
+	"Email/query":        {capMail, (*call).emailQuery},
+	"Email/queryChanges": {capMail, (*call).queryChanges},
+	"Email/set":          {capMail, (*call).emailSet},
+	"Email/import":       {capMail, (*call).emailImport},
+
+	"SearchSnippet/get": {capMail, (*call).searchSnippetGet},
+
+	"Identity/get":     {capSubmission, (*call).identityGet},
+	"Identity/changes": {capSubmission, (*call).identityChanges},
+
+	"EmailSubmission/get":          {capSubmission, (*call).submissionGet},
+	"EmailSubmission/changes":      {capSubmission, (*call).submissionChanges},
+	"EmailSubmission/query":        {capSubmission, (*call).submissionQuery},
+	"EmailSubmission/queryChanges": {capSubmission, (*call).queryChanges},
+	"EmailSubmission/set":          {capSubmission, (*call).submissionSet},
+}
+
+// Capabilities that clients can use.
+var capabilities = map[string]bool{
+	capCore:       true,
+	capMail:       true,
+	capSubmission: true,
+	capWebSocket:  true,
+}
+
+// serveAPI handles an API request with method calls. ../rfc/8620 section 3
+func (s *session) serveAPI(w http.ResponseWriter, r *http.Request) string {
+	ct, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || ct != "application/json" {
+		problem(w, http.StatusBadRequest, "urn:ietf:params:jmap:error:notJSON", "content-type must be application/json", "")
+		return "badrequest"
+	}
+	buf, err := io.ReadAll(io.LimitReader(r.Body, maxSizeRequest+1))
+	if err != nil {
+		s.log.Debugx("reading request", err)
+		http.Error(w, "400 - bad request - reading request", http.StatusBadRequest)
+		return "badrequest"
+	} else if len(buf) > maxSizeRequest {
+		problem(w, http.StatusBadRequest, "urn:ietf:params:jmap:error:limit", "request too large", "maxSizeRequest")
+		return "badrequest"
+	}
+	resp, rerr := s.execute(buf)
+	if rerr != nil {
+		problem(w, rerr.Status, rerr.Type, rerr.Detail, rerr.Limit)
+		return "badrequest"
+	}
+	err = writeJSON(w, http.StatusOK, resp)
+	s.log.Check(err, "writing api response")
+	return "ok"
+}
+
+// requestError is a request-level error, returned to the client as problem
+// details. ../rfc/8620 section 3.6.1
+type requestError struct {
+	Type   string `json:"type"`
+	Status int    `json:"status"`
+	Detail string `json:"detail"`
+	Limit  string `json:"limit,omitempty"`
+}
+
+// execute parses the request object in buf and executes its method calls, for
+// API requests over HTTP and WebSocket.
+func (s *session) execute(buf []byte) (response, *requestError) {
+	var req request
+	if !json.Valid(buf) {
+		return response{}, &requestError{"urn:ietf:params:jmap:error:notJSON", http.StatusBadRequest, "request is not valid json", ""}
+	} else if err := json.Unmarshal(buf, &req); err != nil || req.Using == nil || req.MethodCalls == nil {
+		detail := "request must have using and methodCalls"
+		if err != nil {
+			detail = err.Error()
+		}
+		return response{}, &requestError{"urn:ietf:params:jmap:error:notRequest", http.StatusBadRequest, detail, ""}
+	}
+	using := map[string]bool{}
+	for _, capability := range req.Using {
+		if !capabilities[capability] {
+			return response{}, &requestError{"urn:ietf:params:jmap:error:unknownCapability", http.StatusBadRequest, fmt.Sprintf("unknown capability %q", capability), ""}
+		}
+		using[capability] = true
+	}
+	if len(req.MethodCalls) > maxCallsInRequest {
+		return response{}, &requestError{"urn:ietf:params:jmap:error:limit", http.StatusBadRequest, "too many method calls", "maxCallsInRequest"}
+	}
+
+	resp := response{MethodResponses: []invocation{}, CreatedIDs: req.CreatedIDs}
+	createdIDs := req.CreatedIDs
+	if createdIDs == nil {
+		createdIDs = map[string]string{}
+	}
+	for _, inv := range req.MethodCalls {
+		c := &call{s, using, createdIDs, inv.Name, inv.CallID, nil}
+		resp.MethodResponses = append(resp.MethodResponses, c.dispatch(inv.Args, resp.MethodResponses))
+		for _, im := range c.implicit {
+			ic := &call{s, using, createdIDs, im.Name, im.CallID, nil}
+			resp.MethodResponses = append(resp.MethodResponses, ic.dispatch(im.Args, resp.MethodResponses))
+		}
+	}
+	resp.SessionState = s.resource().State
+	return resp, nil
+}
+
+// dispatch executes the method call with args, resolving result references
+// against the responses of earlier calls.
+func (c *call) dispatch(args json.RawMessage, responses []invocation) (resp invocation) {
+	start := time.Now()
+	result := "error"
+	defer func() {
+		metricMethod.WithLabelValues(c.name, result).Observe(float64(time.Since(start)) / float64(time.Second))
+	}()
+
+	defer func() {
+		x := recover()
+		if x == nil {
+			return
+		}
+		var merr methodError
+		var serr serverError
+		if err, ok := x.(error); ok && errors.As(err, &merr) {
+			c.log.Debugx("method error", err, mlog.Field("method", c.name))
+		} else if err, ok := x.(error); ok && errors.As(err, &serr) {
+			result = "servererror"
+			c.log.Errorx("method server error", err, mlog.Field("method", c.name))
+			merr = methodError{"serverFail", err.Error()}
+		} else {
+			result = "servererror"
+			c.log.Error("method panic", mlog.Field("method", c.name), mlog.Field("panic", x))
+			debug.PrintStack()
+			metrics.PanicInc("jmapserver")
+			merr = methodError{"serverFail", "internal error"}
+		}
+		buf, err := json.Marshal(merr)
+		if err != nil {
+			panic(fmt.Sprintf("marshal method error: %v", err))
+		}
+		resp = invocation{"error", buf, c.callID}
+	}()
+
+	m, ok := methods[c.name]
+	if !ok || !c.using[m.capability] {
+		xmethodErrorf("unknownMethod", "unknown method %q", c.name)
+	}
+	args = c.xresolveReferences(args, responses)
+	v := m.fn(c, args)
+	buf, err := json.Marshal(v)
+	xcheckf(err, "marshal method response")
+	result = "ok"
+	return invocation{c.name, buf, c.callID}
+}
+
+// Result reference in arguments. ../rfc/8620 section 3.7
+type resultReference struct {
+	ResultOf string `json:"resultOf"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+}
+
+// xresolveReferences replaces arguments with a name starting with "#" by the
+// value of the result reference in their value.
+func (c *call) xresolveReferences(args json.RawMessage, responses []invocation) json.RawMessage {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(args, &m); err != nil {
+		xmethodErrorf("invalidArguments", "parsing arguments: %v", err)
+	}
+	var resolved bool
+	for k, v := range m {
+		if !strings.HasPrefix(k, "#") {
+			continue
+		}
+		name := k[1:]
+		if _, ok := m[name]; ok {
+			xmethodErrorf("invalidArguments", "both %q and %q present", k, name)
+		}
+		var ref resultReference
+		dec := json.NewDecoder(bytes.NewReader(v))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&ref); err != nil {
+			xmethodErrorf("invalidResultReference", "parsing result reference for %q: %v", k, err)
+		}
+		value := xevalReference(ref, responses)
+		buf, err := json.Marshal(value)
+		xcheckf(err, "marshal resolved result reference")
+		delete(m, k)
+		m[name] = buf
+		resolved = true
+	}
+	if !resolved {
+		return args
+	}
+	buf, err := json.Marshal(m)
+	xcheckf(err, "marshal arguments")
+	return buf
+}
+
+// xevalReference returns the value from the response of an earlier call for the
+// result reference.
+func xevalReference(ref resultReference, responses []invocation) any {
+	for _, resp := range responses {
+		if resp.CallID != ref.ResultOf {
+			continue
+		}
+		if resp.Name != ref.Name {
+			xmethodErrorf("invalidResultReference", "response for call id %q is %q, not %q", ref.ResultOf, resp.Name, ref.Name)
+		}
+		dec := json.NewDecoder(bytes.NewReader(resp.Args))
+		dec.UseNumber()
+		var v any
+		err := dec.Decode(&v)
+		xcheckf(err, "parsing earlier response")
+		v, err = evalPointer(v, ref.Path)
+		if err != nil {
+			xmethodErrorf("invalidResultReference", "evaluating path %q: %v", ref.Path, err)
+		}
+		return v
+	}
+	xmethodErrorf("invalidResultReference", "no response for call id %q", ref.ResultOf)
+	panic("not reached")
+}
+
+// evalPointer evaluates a JSON pointer on v, with the JMAP extension that "*"
+// applies the rest of the pointer to all elements of an array, flattening
+// resulting arrays. ../rfc/8620 section 3.7 ../rfc/6901
+func evalPointer(v any, path string) (any, error) {
+	if path == "" {
+		return v, nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, errors.New("path must start with a slash")
+	}
+	tokens := strings.Split(path[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return evalTokens(v, tokens)
+}
+
+func evalTokens(v any, tokens []string) (any, error) {
+	if len(tokens) == 0 {
+		return v, nil
+	}
+	t, rest := tokens[0], tokens[1:]
+	switch x := v.(type) {
+	case map[string]any:
+		e, ok := x[t]
+		if !ok {
+			return nil, fmt.Errorf("no member %q", t)
+		}
+		return evalTokens(e, rest)
+	case []any:
+		if t == "*" {
+			r := []any{}
+			for _, e := range x {
+				ev, err := evalTokens(e, rest)
+				if err != nil {
+					return nil, err
+				}
+				if l, ok := ev.([]any); ok {
+					r = append(r, l...)
+				} else {
+					r = append(r, ev)
+				}
+			}
+			return r, nil
+		}
+		index, err := strconv.ParseUint(t, 10, 31)
+		if err != nil || int(index) >= len(x) || t != fmt.Sprintf("%d", index) {
+			return nil, fmt.Errorf("invalid array index %q", t)
+		}
+		return evalTokens(x[index], rest)
+	}
+	return nil, fmt.Errorf("cannot evaluate %q on non-object non-array value", t)
+}
+
+func (c *call) xdbread(fn func(tx *bstore.Tx)) {
+	err := store.DBRead(c.ctx, c.log, "jmapserver", c.acc.DB, func(tx *bstore.Tx) error {
+		fn(tx)
+		return nil
+	})
+	xcheckf(err, "transaction")
+}
+
+func (c *call) xdbwrite(fn func(tx *bstore.Tx)) {
+	err := store.DBWrite(c.ctx, c.log, "jmapserver", c.acc.DB, func(tx *bstore.Tx) error {
+		fn(tx)
+		return nil
+	})
+	xcheckf(err, "transaction")
+}
+
+// coreEcho returns the arguments. ../rfc/8620 section 4
+func (c *call) coreEcho(args json.RawMessage) any {
+	return args
+}
@@ -0,0 +1,912 @@
+package jmapserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/store"
+)
+
+// Default properties for Email/get. ../rfc/8621 section 4.2
+var defaultEmailProperties = []string{"id", "blobId", "threadId", "mailboxIds", "keywords", "size", "receivedAt", "messageId", "inReplyTo", "references", "sender", "from", "to", "cc", "bcc", "replyTo", "subject", "sentAt", "hasAttachment", "preview", "bodyValues", "textBody", "htmlBody", "attachments"}
+
+// Email properties, besides the convenience header properties and
+// "header:..." properties.
+var emailProperties = map[string]bool{"id": true, "blobId": true, "threadId": true, "mailboxIds": true, "keywords": true, "size": true, "receivedAt": true, "headers": true, "bodyStructure": true, "bodyValues": true, "textBody": true, "htmlBody": true, "attachments": true, "hasAttachment": true, "preview": true}
+
+// Arguments for Email/get. ../rfc/8621 section 4.2
+type emailGetRequest struct {
+	getRequest
+	BodyProperties      []string `json:"bodyProperties"`
+	FetchTextBodyValues bool     `json:"fetchTextBodyValues"`
+	FetchHTMLBodyValues bool     `json:"fetchHTMLBodyValues"`
+	FetchAllBodyValues  bool     `json:"fetchAllBodyValues"`
+	MaxBodyValueBytes   int64    `json:"maxBodyValueBytes"`
+}
+
+// xemailID returns the message ID for a JMAP email id, which can be the creation
+// id of an email created earlier in the request.
+func (c *call) xemailID(id string) (int64, bool) {
+	return objectID("E", c.resolveID(id))
+}
+
+// emailPart loads the parsed message of an email on first use. Close must be
+// called when done.
+type emailPart struct {
+	c      *call
+	m      store.Message
+	mr     *store.MsgReader
+	p      *message.Part
+	fields []headerField
+	body   *emailBody
+}
+
+func (ep *emailPart) close() {
+	if ep.mr != nil {
+		err := ep.mr.Close()
+		ep.c.log.Check(err, "closing message reader")
+		ep.mr = nil
+	}
+}
+
+func (ep *emailPart) xpart() *message.Part {
+	if ep.p == nil {
+		ep.mr = ep.c.acc.MessageReader(ep.m)
+		p, err := ep.m.LoadPart(ep.mr)
+		xcheckf(err, "load message part")
+		ep.p = &p
+	}
+	return ep.p
+}
+
+func (ep *emailPart) xheaderFields() []headerField {
+	if ep.fields == nil {
+		var err error
+		ep.fields, err = partHeaderFields(ep.xpart())
+		xcheckf(err, "reading message header")
+	}
+	return ep.fields
+}
+
+func (ep *emailPart) xbody() *emailBody {
+	if ep.body == nil {
+		eb, err := parseEmailBody(ep.m.ID, ep.xpart())
+		xcheckf(err, "parsing message body structure")
+		ep.body = &eb
+	}
+	return ep.body
+}
+
+// xpreview returns the preview of the message, generating it for messages
+// delivered before previews were stored.
+func (ep *emailPart) xpreview() string {
+	if ep.m.Preview != nil {
+		return *ep.m.Preview
+	}
+	preview, err := ep.xpart().Preview()
+	ep.c.log.Check(err, "generating preview", mlog.Field("msgid", ep.m.ID))
+	return preview
+}
+
+// xcheckProperties fails with invalidArguments for properties that are not
+// known and not a "header:..." property. The convenience header properties are
+// only allowed for emails, not body parts.
+func xcheckProperties(props []string, known map[string]bool, email bool) {
+	for _, p := range props {
+		if _, ok := parseHeaderProperty(p); !known[p] && !(email && emailHeaderProperties[p].name != "") && !ok {
+			xmethodErrorf("invalidArguments", "unknown property %q", p)
+		}
+	}
+}
+
+// xemailObject returns the JMAP email object with the requested properties for m.
+func (c *call) xemailObject(m store.Message, req emailGetRequest) map[string]any {
+	ep := &emailPart{c: c, m: m}
+	defer ep.close()
+
+	parts := func(l []*emailBodyPart) []map[string]any {
+		r := make([]map[string]any, len(l))
+		for i, bp := range l {
+			r[i] = bp.properties(req.BodyProperties)
+		}
+		return r
+	}
+
+	o := map[string]any{"id": emailObjectID(m)}
+	for _, p := range req.Properties {
+		switch p {
+		case "id":
+		case "blobId":
+			o[p] = fmt.Sprintf("m%d", m.ID)
+		case "threadId":
+			o[p] = m.ThreadObjectID()
+		case "mailboxIds":
+			o[p] = map[string]bool{store.Mailbox{ID: m.MailboxID}.ObjectID(): true}
+		case "keywords":
+			o[p] = messageKeywords(m)
+		case "size":
+			o[p] = m.Size
+		case "receivedAt":
+			o[p] = m.Received.UTC().Format(time.RFC3339)
+		case "headers":
+			o[p] = ep.xheaderFields()
+		case "bodyStructure":
+			o[p] = ep.xbody().structure.properties(req.BodyProperties)
+		case "textBody":
+			o[p] = parts(ep.xbody().textBody)
+		case "htmlBody":
+			o[p] = parts(ep.xbody().htmlBody)
+		case "attachments":
+			o[p] = parts(ep.xbody().attachments)
+		case "hasAttachment":
+			o[p] = len(ep.xbody().attachments) > 0
+		case "preview":
+			o[p] = ep.xpreview()
+		case "bodyValues":
+			eb := ep.xbody()
+			values := map[string]emailBodyValue{}
+			add := func(l []*emailBodyPart) {
+				for _, bp := range l {
+					if strings.HasPrefix(bp.Type, "text/") {
+						values[*bp.PartID] = bodyValue(bp, req.MaxBodyValueBytes)
+					}
+				}
+			}
+			if req.FetchAllBodyValues {
+				var walk func(bp *emailBodyPart)
+				walk = func(bp *emailBodyPart) {
+					if bp.SubParts == nil {
+						add([]*emailBodyPart{bp})
+					}
+					for _, sp := range bp.SubParts {
+						walk(sp)
+					}
+				}
+				walk(eb.structure)
+			}
+			if req.FetchTextBodyValues {
+				add(eb.textBody)
+			}
+			if req.FetchHTMLBodyValues {
+				add(eb.htmlBody)
+			}
+			o[p] = values
+		default:
+			hp, ok := emailHeaderProperties[p]
+			if !ok {
+				hp, _ = parseHeaderProperty(p)
+			}
+			o[p] = hp.value(ep.xheaderFields())
+		}
+	}
+	return o
+}
+
+// emailGet returns emails. ../rfc/8621 section 4.2
+func (c *call) emailGet(args json.RawMessage) any {
+	var req emailGetRequest
+	xparseArgs(args, &req)
+	c.xcheckAccount(req.AccountID)
+	xcheckIDs(len(req.IDs), maxObjectsInGet)
+	if req.Properties == nil {
+		req.Properties = defaultEmailProperties
+	}
+	if req.BodyProperties == nil {
+		req.BodyProperties = defaultBodyProperties
+	}
+	xcheckProperties(req.Properties, emailProperties, true)
+	xcheckProperties(req.BodyProperties, bodyPartProperties, false)
+	if req.MaxBodyValueBytes < 0 {
+		xmethodErrorf("invalidArguments", "negative maxBodyValueBytes")
+	}
+
+	resp := getResponse{AccountID: req.AccountID, List: []any{}, NotFound: []string{}}
+	c.xdbread(func(tx *bstore.Tx) {
+		resp.State = xemailState(tx, c.acc).String()
+		if req.IDs == nil {
+			n, err := bstore.QueryTx[store.Message](tx).Count()
+			xcheckf(err, "counting messages")
+			xcheckIDs(n, maxObjectsInGet)
+			err = bstore.QueryTx[store.Message](tx).SortAsc("ID").ForEach(func(m store.Message) error {
+				resp.List = append(resp.List, c.xemailObject(m, req))
+				return nil
+			})
+			xcheckf(err, "listing messages")
+			return
+		}
+		for _, id := range req.IDs {
+			msgID, ok := c.xemailID(id)
+			m := store.Message{ID: msgID}
+			var err error
+			if ok {
+				err = tx.Get(&m)
+			}
+			if !ok || err == bstore.ErrAbsent {
+				resp.NotFound = append(resp.NotFound, id)
+				continue
+			}
+			xcheckf(err, "get message")
+			resp.List = append(resp.List, c.xemailObject(m, req))
+		}
+	})
+	return resp
+}
+
+// emailChanges returns the emails created, updated and destroyed since a state.
+// ../rfc/8621 section 4.3
+func (c *call) emailChanges(args json.RawMessage) any {
+	var req changesRequest
+	xparseArgs(args, &req)
+	c.xcheckAccount(req.AccountID)
+
+	var resp changesResponse
+	c.xdbread(func(tx *bstore.Tx) {
+		cur := xemailState(tx, c.acc)
+		since := xparseEmailState(req.SinceState, cur)
+		cs := newChangeSet(since)
+		q := bstore.QueryTx[store.Message](tx)
+		q.FilterGreater("ModSeq", since.ModSeq)
+		err := q.ForEach(func(m store.Message) error {
+			cs.add(emailObjectID(m), m.ID, modseqOf(m), false)
+			return nil
+		})
+		xcheckf(err, "listing changed messages")
+		qr := bstore.QueryTx[store.RemovedMessage](tx)
+		qr.FilterGreater("ModSeq", since.ModSeq)
+		err = qr.ForEach(func(rm store.RemovedMessage) error {
+			cs.add(emailObjectID(store.Message{ID: rm.MessageID}), rm.MessageID, rm.ModSeq, true)
+			return nil
+		})
+		xcheckf(err, "listing removed messages")
+		resp = cs.xresponse(c, req, cur)
+	})
+	return resp
+}
+
+// Thread object. ../rfc/8621 section 3
+type thread struct {
+	ID       string   `json:"id"`
+	EmailIDs []string `json:"emailIds"`
+}
+
+// threadGet returns threads with their emails, oldest first. ../rfc/8621 section 3.1
+func (c *call) threadGet(args json.RawMessage) any {
+	var req getRequest
+	xparseArgs(args, &req)
+	c.xcheckAccount(req.AccountID)
+	xcheckIDs(len(req.IDs), maxObjectsInGet)
+
+	resp := getResponse{AccountID: req.AccountID, List: []any{}, NotFound: []string{}}
+	c.xdbread(func(tx *bstore.Tx) {
+		resp.State = xemailState(tx, c.acc).String()
+
+		var want map[int64]bool
+		if req.IDs != nil {
+			want = map[int64]bool{}
+			for _, id := range req.IDs {
+				if n, ok := objectID("T", id); ok {
+					want[n] = true
+				}
+			}
+		}
+		threads := map[int64][]store.Message{}
+		err := bstore.QueryTx[store.Message](tx).ForEach(func(m store.Message) error {
+			if t := threadNum(m); want == nil || want[t] {
+				threads[t] = append(threads[t], m)
+			}
+			return nil
+		})
+		xcheckf(err, "listing messages for threads")
+
+		obj := func(t int64, l []store.Message) any {
+			sort.Slice(l, func(i, j int) bool {
+				if !l[i].Received.Equal(l[j].Received) {
+					return l[i].Received.Before(l[j].Received)
+				}
+				return l[i].ID < l[j].ID
+			})
+			th := thread{fmt.Sprintf("T%d", t), make([]string, len(l))}
+			for i, m := range l {
+				th.EmailIDs[i] = emailObjectID(m)
+			}
+			return objectProperties(th, req.Properties)
+		}
+		if req.IDs == nil {
+			xcheckIDs(len(threads), maxObjectsInGet)
+			nums := make([]int64, 0, len(threads))
+			for t := range threads {
+				nums = append(nums, t)
+			}
+			sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+			for _, t := range nums {
+				resp.List = append(resp.List, obj(t, threads[t]))
+			}
+			return
+		}
+		for _, id := range req.IDs {
+			n, _ := objectID("T", id)
+			if l, ok := threads[n]; ok {
+				resp.List = append(resp.List, obj(n, l))
+			} else {
+				resp.NotFound = append(resp.NotFound, id)
+			}
+		}
+	})
+	return resp
+}
+
+// threadChanges returns the threads with emails added, changed or removed since a
+// state. A thread without remaining emails is destroyed. ../rfc/8621 section 3.2
+func (c *call) threadChanges(args json.RawMessage) any {
+	var req changesRequest
+	xparseArgs(args, &req)
+	c.xcheckAccount(req.AccountID)
+
+	var resp changesResponse
+	c.xdbread(func(tx *bstore.Tx) {
+		cur := xemailState(tx, c.acc)
+		since := xparseEmailState(req.SinceState, cur)
+
+		changed := map[int64]store.ModSeq{} // Thread number to last modseq.
+		mark := func(t int64, modseq store.ModSeq) {
+			if modseq > changed[t] {
+				changed[t] = modseq
+			}
+		}
+		q := bstore.QueryTx[store.Message](tx)
+		q.FilterGreater("ModSeq", since.ModSeq)
+		err := q.ForEach(func(m store.Message) error {
+			mark(threadNum(m), modseqOf(m))
+			return nil
+		})
+		xcheckf(err, "listing changed messages")
+		qr := bstore.QueryTx[store.RemovedMessage](tx)
+		qr.FilterGreater("ModSeq", since.ModSeq)
+		err = qr.ForEach(func(rm store.RemovedMessage) error {
+			mark(rm.ThreadID, rm.ModSeq)
+			return nil
+		})
+		xcheckf(err, "listing removed messages")
+
+		// Threads of removed messages may have remaining messages.
+		exists := map[int64]bool{}
+		if len(changed) > 0 {
+			err := bstore.QueryTx[store.Message](tx).ForEach(func(m store.Message) error {
+				exists[threadNum(m)] = true
+				return nil
+			})
+			xcheckf(err, "listing messages for threads")
+		}
+		cs := newChangeSet(since)
+		for t, modseq := range changed {
+			cs.add(fmt.Sprintf("T%d", t), t, modseq, !exists[t])
+		}
+		resp = cs.xresponse(c, req, cur)
+	})
+	return resp
+}
+
+// Filter condition for Email/query. ../rfc/8621 section 4.4.1
+type emailFilter struct {
+	Operator                string        `json:"operator"`
+	Conditions              []emailFilter `json:"conditions"`
+	InMailbox               *string       `json:"inMailbox"`
+	InMailboxOtherThan      []string      `json:"inMailboxOtherThan"`
+	Before                  *time.Time    `json:"before"`
+	After                   *time.Time    `json:"after"`
+	MinSize                 *int64        `json:"minSize"`
+	MaxSize                 *int64        `json:"maxSize"`
+	AllInThreadHaveKeyword  *string       `json:"allInThreadHaveKeyword"`
+	SomeInThreadHaveKeyword *string       `json:"someInThreadHaveKeyword"`
+	NoneInThreadHaveKeyword *string       `json:"noneInThreadHaveKeyword"`
+	HasKeyword              *string       `json:"hasKeyword"`
+	NotKeyword              *string       `json:"notKeyword"`
+	HasAttachment           *bool         `json:"hasAttachment"`
+	Text                    *string       `json:"text"`
+	From                    *string       `json:"from"`
+	To                      *string       `json:"to"`
+	Cc                      *string       `json:"cc"`
+	Bcc                     *string       `json:"bcc"`
+	Subject                 *string       `json:"subject"`
+	Body                    *string       `json:"body"`
+	Header                  []string      `json:"header"`
+}
+
+// xparseEmailFilter parses a filter for Email/query or SearchSnippet/get. A
+// null filter matches all emails.
+func xparseEmailFilter(raw json.RawMessage) emailFilter {
+	var f emailFilter
+	if len(raw) == 0 || string(raw) == "null" {
+		return f
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		xmethodErrorf("unsupportedFilter", "parsing filter: %v", err)
+	}
+	return f
+}
+
+// needsThreads returns whether the filter has conditions on the keywords of
+// other emails in the thread.
+func (f emailFilter) needsThreads() bool {
+	for _, ff := range f.Conditions {
+		if ff.needsThreads() {
+			return true
+		}
+	}
+	return f.AllInThreadHaveKeyword != nil || f.SomeInThreadHaveKeyword != nil || f.NoneInThreadHaveKeyword != nil
+}
+
+// terms returns the search strings for text, subject and body conditions, for
+// highlighting in search snippets.
+func (f emailFilter) terms() []string {
+	var l []string
+	if f.Operator != "NOT" {
+		for _, ff := range f.Conditions {
+			l = append(l, ff.terms()...)
+		}
+	}
+	for _, s := range []*string{f.Text, f.Subject, f.Body} {
+		if s != nil {
+			l = append(l, strings.Fields(*s)...)
+		}
+	}
+	return l
+}
+
+// emailSearch matches messages against an email filter, within a transaction.
+type emailSearch struct {
+	c          *call
+	tx         *bstore.Tx
+	mbs        mailboxes
+	threads    map[int64][]store.Message // Thread number to messages, only for filters that need it.
+	textIndex  map[string]map[int64]bool // Matches from the full-text index, by search string.
+	*emailPart                           // Message being matched.
+}
+
+func (c *call) newEmailSearch(tx *bstore.Tx, f emailFilter) *emailSearch {
+	s := &emailSearch{c: c, tx: tx, mbs: xmailboxes(tx), textIndex: map[string]map[int64]bool{}}
+	if f.needsThreads() {
+		s.threads = map[int64][]store.Message{}
+		err := bstore.QueryTx[store.Message](tx).ForEach(func(m store.Message) error {
+			t := threadNum(m)
+			s.threads[t] = append(s.threads[t], m)
+			return nil
+		})
+		xcheckf(err, "listing messages for threads")
+	}
+	return s
+}
+
+// matchMessage returns whether m matches the filter. The parsed message of the
+// last matched message remains available for sorting until the next call,
+// close must be called when done.
+func (s *emailSearch) matchMessage(f emailFilter, m store.Message) bool {
+	if s.emailPart != nil {
+		s.emailPart.close()
+	}
+	s.emailPart = &emailPart{c: s.c, m: m}
+	return s.match(f)
+}
+
+func (s *emailSearch) close() {
+	if s.emailPart != nil {
+		s.emailPart.close()
+	}
+}
+
+func (s *emailSearch) match(f emailFilter) bool {
+	switch f.Operator {
+	case "AND":
+		for _, ff := range f.Conditions {
+			if !s.match(ff) {
+				return false
+			}
+		}
+		return true
+	case "OR":
+		for _, ff := range f.Conditions {
+			if s.match(ff) {
+				return true
+			}
+		}
+		return false
+	case "NOT":
+		for _, ff := range f.Conditions {
+			if s.match(ff) {
+				return false
+			}
+		}
+		return true
+	case "":
+	default:
+		xmethodErrorf("unsupportedFilter", "unknown filter operator %q", f.Operator)
+	}
+
+	m := s.m
+	if f.InMailbox != nil {
+		if mb := s.c.xmailboxID(s.mbs, *f.InMailbox); mb == nil || mb.ID != m.MailboxID {
+			return false
+		}
+	}
+	for _, id := range f.InMailboxOtherThan {
+		if mb := s.c.xmailboxID(s.mbs, id); mb != nil && mb.ID == m.MailboxID {
+			return false
+		}
+	}
+	if f.Before != nil && !m.Received.Before(*f.Before) || f.After != nil && m.Received.Before(*f.After) {
+		return false
+	}
+	if f.MinSize != nil && m.Size < *f.MinSize || f.MaxSize != nil && m.Size >= *f.MaxSize {
+		return false
+	}
+	threadKeyword := func(kw string) (n, total int) {
+		l := s.threads[threadNum(m)]
+		for _, tm := range l {
+			if hasKeyword(tm, strings.ToLower(kw)) {
+				n++
+			}
+		}
+		return n, len(l)
+	}
+	if f.AllInThreadHaveKeyword != nil {
+		if n, total := threadKeyword(*f.AllInThreadHaveKeyword); n != total {
+			return false
+		}
+	}
+	if f.SomeInThreadHaveKeyword != nil {
+		if n, _ := threadKeyword(*f.SomeInThreadHaveKeyword); n == 0 {
+			return false
+		}
+	}
+	if f.NoneInThreadHaveKeyword != nil {
+		if n, _ := threadKeyword(*f.NoneInThreadHaveKeyword); n > 0 {
+			return false
+		}
+	}
+	if f.HasKeyword != nil && !hasKeyword(m, strings.ToLower(*f.HasKeyword)) || f.NotKeyword != nil && hasKeyword(m, strings.ToLower(*f.NotKeyword)) {
+		return false
+	}
+	if f.HasAttachment != nil && *f.HasAttachment != (len(s.xbody().attachments) > 0) {
+		return false
+	}
+	if f.Text != nil && !s.textMatch(*f.Text, true) || f.Body != nil && !s.textMatch(*f.Body, false) {
+		return false
+	}
+	headers := []struct {
+		name  string
+		value *string
+	}{{"From", f.From}, {"To", f.To}, {"Cc", f.Cc}, {"Bcc", f.Bcc}, {"Subject", f.Subject}}
+	for _, h := range headers {
+		if h.value != nil && !s.headerContains(h.name, *h.value) {
+			return false
+		}
+	}
+	if f.Header != nil {
+		if len(f.Header) == 0 || len(f.Header) > 2 {
+			xmethodErrorf("unsupportedFilter", "header filter must have a name and optionally a value")
+		}
+		var value string
+		if len(f.Header) == 2 {
+			value = f.Header[1]
+		}
+		if !s.headerContains(f.Header[0], value) {
+			return false
+		}
+	}
+	return true
+}
+
+// headerContains returns whether a header field with name has a decoded value
+// containing value, case-insensitive.
+func (s *emailSearch) headerContains(name, value string) bool {
+	lower := strings.ToLower(value)
+	for _, hf := range s.xheaderFields() {
+		if strings.EqualFold(hf.Name, name) && strings.Contains(strings.ToLower(headerText(hf.Value)), lower) {
+			return true
+		}
+	}
+	return false
+}
+
+// textMatch returns whether the message contains str, in its text parts, and
+// with headerToo in its header. The full-text index is used if enabled and the
+// message has been indexed.
+func (s *emailSearch) textMatch(str string, headerToo bool) bool {
+	if s.c.acc.TextIndexEnabled() {
+		has, err := store.TextIndexHas(s.tx, s.m.ID)
+		xcheckf(err, "checking full-text index")
+		key := fmt.Sprintf("%v %s", headerToo, str)
+		ids, ok := s.textIndex[key]
+		if has && !ok {
+			ids, err = store.TextIndexSearch(s.tx, str, headerToo)
+			xcheckf(err, "searching full-text index")
+			s.textIndex[key] = ids
+		}
+		if has && ids != nil {
+			return ids[s.m.ID]
+		}
+	}
+
+	lower := strings.ToLower(str)
+	if headerToo {
+		for _, hf := range s.xheaderFields() {
+			if strings.Contains(strings.ToLower(headerText(hf.Value)), lower) {
+				return true
+			}
+		}
+	}
+	return s.partContains(s.xpart(), lower)
+}
+
+// partContains returns whether the decoded text parts of p contain lower.
+func (s *emailSearch) partContains(p *message.Part, lower string) bool {
+	if len(p.Parts) == 0 {
+		if p.MediaType != "TEXT" && p.MediaType != "" {
+			return false
+		}
+		buf, err := io.ReadAll(p.Reader())
+		if err != nil {
+			s.c.log.Debugx("reading part for text search", err, mlog.Field("msgid", s.m.ID))
+		}
+		return strings.Contains(strings.ToLower(string(buf)), lower)
+	}
+	for i := range p.Parts {
+		if s.partContains(&p.Parts[i], lower) {
+			return true
+		}
+	}
+	return false
+}
+
+// Properties Email/query can sort on. ../rfc/8621 section 4.4.2
+var emailSortProperties = []string{"receivedAt", "sentAt", "size", "from", "to", "subject", "hasKeyword"}
+
+// emailSortValues are the values of a message for sorting on header fields.
+type emailSortValues struct {
+	sentAt  time.Time
+	from    string
+	to      string
+	subject string
+}
+
+func (s *emailSearch) sortValues() emailSortValues {
+	var v emailSortValues
+	env := s.xpart().Envelope
+	if env == nil {
+		return v
+	}
+	first := func(l []message.Address) string {
+		if len(l) == 0 {
+			return ""
+		}
+		if l[0].Name != "" {
+			return strings.ToLower(l[0].Name)
+		}
+		return strings.ToLower(l[0].User + "@" + l[0].Host)
+	}
+	v.sentAt = env.Date
+	v.from = first(env.From)
+	v.to = first(env.To)
+	base, _ := message.ThreadSubject(headerText(env.Subject))
+	v.subject = strings.ToLower(base)
+	return v
+}
+
+// emailQuery returns emails matching a filter, sorted. ../rfc/8621 section 4.4
+func (c *call) emailQuery(args json.RawMessage) any {
+	var req struct {
+		queryRequest
+		CollapseThreads bool `json:"collapseThreads"`
+	}
+	xparseArgs(args, &req)
+	c.xcheckAccount(req.AccountID)
+	filter := xparseEmailFilter(req.Filter)
+
+	var headerSort bool
+	for _, cmp := range req.Sort {
+		var ok bool
+		for _, p := range emailSortProperties {
+			ok = ok || p == cmp.Property
+		}
+		if !ok {
+			xmethodErrorf("unsupportedSort", "cannot sort on %q", cmp.Property)
+		}
+		if cmp.Property == "hasKeyword" && cmp.Keyword == "" {
+			xmethodErrorf("invalidArguments", "sort on hasKeyword requires keyword")
+		}
+		headerSort = headerSort || cmp.Property == "sentAt" || cmp.Property == "from" || cmp.Property == "to" || cmp.Property == "subject"
+	}
+
+	type result struct {
+		m store.Message
+		v emailSortValues
+	}
+	var results []result
+	var state string
+	c.xdbread(func(tx *bstore.Tx) {
+		state = xemailState(tx, c.acc).String()
+		s := c.newEmailSearch(tx, filter)
+		defer s.close()
+		q := bstore.QueryTx[store.Message](tx)
+		if filter.Operator == "" && filter.InMailbox != nil {
+			if mb := c.xmailboxID(s.mbs, *filter.InMailbox); mb != nil {
+				q.FilterNonzero(store.Message{MailboxID: mb.ID})
+			}
+		}
+		q.SortAsc("ID")
+		err := q.ForEach(func(m store.Message) error {
+			if !s.matchMessage(filter, m) {
+				return nil
+			}
+			r := result{m: m}
+			if headerSort {
+				r.v = s.sortValues()
+			}
+			results = append(results, r)
+			return nil
+		})
+		xcheckf(err, "listing messages")
+	})
+
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		for _, cmp := range req.Sort {
+			var less, greater bool
+			switch cmp.Property {
+			case "receivedAt":
+				less, greater = a.m.Received.Before(b.m.Received), b.m.Received.Before(a.m.Received)
+			case "sentAt":
+				less, greater = a.v.sentAt.Before(b.v.sentAt), b.v.sentAt.Before(a.v.sentAt)
+			case "size":
+				less, greater = a.m.Size < b.m.Size, a.m.Size > b.m.Size
+			case "from":
+				less, greater = a.v.from < b.v.from, a.v.from > b.v.from
+			case "to":
+				less, greater = a.v.to < b.v.to, a.v.to > b.v.to
+			case "subject":
+				less, greater = a.v.subject < b.v.subject, a.v.subject > b.v.subject
+			case "hasKeyword":
+				kw := strings.ToLower(cmp.Keyword)
+				ka, kb := hasKeyword(a.m, kw), hasKeyword(b.m, kw)
+				less, greater = !ka && kb, ka && !kb
+			}
+			if cmp.IsAscending != nil && !*cmp.IsAscending {
+				less, greater = greater, less
+			}
+			if less || greater {
+				return less
+			}
+		}
+		return false
+	})
+
+	ids := make([]string, 0, len(results))
+	seen := map[int64]bool{}
+	for _, r := range results {
+		if req.CollapseThreads {
+			t := threadNum(r.m)
+			if seen[t] {
+				continue
+			}
+			seen[t] = true
+		}
+		ids = append(ids, emailObjectID(r.m))
+	}
+	resp := queryResponse{AccountID: req.AccountID, QueryState: state}
+	resp.Position, resp.IDs = xpage(req.queryRequest, ids)
+	if req.CalculateTotal {
+		n := int64(len(ids))
+		resp.Total = &n
+	}
+	return resp
+}
+
+// Search snippet object. ../rfc/8621 section 5
+type searchSnippet struct {
+	EmailID string  `json:"emailId"`
+	Subject *string `json:"subject"`
+	Preview *string `json:"preview"`
+}
+
+// highlight returns s as HTML with the terms marked, or nil if s does not contain
+// any of the terms.
+func highlight(s string, terms []string) *string {
+	lower := strings.ToLower(s)
+	if len(lower) != len(s) {
+		// Case-folding changed the length, positions would not match.
+		lower = s
+	}
+	marks := make([]bool, len(s))
+	var found bool
+	for _, t := range terms {
+		t = strings.ToLower(t)
+		if t == "" {
+			continue
+		}
+		for i := 0; ; {
+			j := strings.Index(lower[i:], t)
+			if j < 0 {
+				break
+			}
+			for k := i + j; k < i+j+len(t); k++ {
+				marks[k] = true
+			}
+			found = true
+			i += j + len(t)
+		}
+	}
+	if !found {
+		return nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		j := i
+		for j < len(s) && marks[j] == marks[i] {
+			j++
+		}
+		if marks[i] {
+			b.WriteString("<mark>" + html.EscapeString(s[i:j]) + "</mark>")
+		} else {
+			b.WriteString(html.EscapeString(s[i:j]))
+		}
+		i = j
+	}
+	r := b.String()
+	return &r
+}
+
+// searchSnippetGet returns the subject and preview of emails with the search
+// terms of the filter highlighted. ../rfc/8621 section 5.1
+func (c *call) searchSnippetGet(args json.RawMessage) any {
+	var req struct {
+		AccountID string          `json:"accountId"`
+		Filter    json.RawMessage `json:"filter"`
+		EmailIDs  []string        `json:"emailIds"`
+	}
+	xparseArgs(args, &req)
+	c.xcheckAccount(req.AccountID)
+	xcheckIDs(len(req.EmailIDs), maxObjectsInGet)
+	terms := xparseEmailFilter(req.Filter).terms()
+
+	resp := struct {
+		AccountID string          `json:"accountId"`
+		List      []searchSnippet `json:"list"`
+		NotFound  []string        `json:"notFound"`
+	}{req.AccountID, []searchSnippet{}, []string{}}
+	c.xdbread(func(tx *bstore.Tx) {
+		for _, id := range req.EmailIDs {
+			msgID, ok := c.xemailID(id)
+			m := store.Message{ID: msgID}
+			var err error
+			if ok {
+				err = tx.Get(&m)
+			}
+			if !ok || err == bstore.ErrAbsent {
+				resp.NotFound = append(resp.NotFound, id)
+				continue
+			}
+			xcheckf(err, "get message")
+
+			ep := &emailPart{c: c, m: m}
+			var subject string
+			if env := ep.xpart().Envelope; env != nil {
+				subject = headerText(env.Subject)
+			}
+			resp.List = append(resp.List, searchSnippet{id, highlight(subject, terms), highlight(ep.xpreview(), terms)})
+			ep.close()
+		}
+	})
+	return resp
+}
@@ -0,0 +1,550 @@
+package jmapserver
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/mjl-/mox/message"
+)
+
+// headerField is a header field of a message or part, in raw form.
+// ../rfc/8621 section 4.1.3
+type headerField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"` // After the colon, with folding whitespace.
+}
+
+// parseHeaderFields returns the fields of a header section, in order.
+func parseHeaderFields(buf []byte) []headerField {
+	var l []headerField
+	s := string(buf)
+	for s != "" {
+		// A field ends at a line ending that is not followed by folding whitespace.
+		var i int
+		for {
+			j := strings.IndexByte(s[i:], '\n')
+			if j < 0 {
+				i = len(s)
+				break
+			}
+			i += j + 1
+			if i >= len(s) || s[i] != ' ' && s[i] != '\t' {
+				break
+			}
+		}
+		line := strings.TrimSuffix(strings.TrimSuffix(s[:i], "\n"), "\r")
+		s = s[i:]
+		if line == "" {
+			break
+		}
+		k := strings.IndexByte(line, ':')
+		if k <= 0 {
+			continue
+		}
+		l = append(l, headerField{strings.TrimRight(line[:k], " \t"), line[k+1:]})
+	}
+	return l
+}
+
+// partHeaderFields returns the header fields of part p.
+func partHeaderFields(p *message.Part) ([]headerField, error) {
+	buf, err := io.ReadAll(p.HeaderReader())
+	if err != nil {
+		return nil, err
+	}
+	return parseHeaderFields(buf), nil
+}
+
+// Forms for parsing header field values. ../rfc/8621 section 4.1.2
+var headerForms = []string{"asRaw", "asText", "asAddresses", "asGroupedAddresses", "asMessageIds", "asDate", "asURLs"}
+
+// headerProperty is a parsed "header:{name}[:as{form}][:all]" property.
+// ../rfc/8621 section 4.1.3
+type headerProperty struct {
+	name string
+	form string
+	all  bool
+}
+
+func parseHeaderProperty(s string) (headerProperty, bool) {
+	t := strings.Split(s, ":")
+	if len(t) < 2 || len(t) > 4 || t[0] != "header" || t[1] == "" {
+		return headerProperty{}, false
+	}
+	hp := headerProperty{name: t[1], form: "asRaw"}
+	t = t[2:]
+	if len(t) > 0 && t[len(t)-1] == "all" {
+		hp.all = true
+		t = t[:len(t)-1]
+	}
+	if len(t) == 1 {
+		hp.form = t[0]
+		var ok bool
+		for _, f := range headerForms {
+			ok = ok || f == hp.form
+		}
+		if !ok {
+			return headerProperty{}, false
+		}
+	} else if len(t) > 1 {
+		return headerProperty{}, false
+	}
+	return hp, true
+}
+
+// value returns the value for the header property from fields.
+func (hp headerProperty) value(fields []headerField) any {
+	var values []any
+	for _, f := range fields {
+		if strings.EqualFold(f.Name, hp.name) {
+			values = append(values, headerValue(f.Value, hp.form))
+		}
+	}
+	if hp.all {
+		if values == nil {
+			return []any{}
+		}
+		return values
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	return values[len(values)-1]
+}
+
+// Email properties that are a convenience form of a header field.
+// ../rfc/8621 section 4.1.3
+var emailHeaderProperties = map[string]headerProperty{
+	"messageId":  {"Message-ID", "asMessageIds", false},
+	"inReplyTo":  {"In-Reply-To", "asMessageIds", false},
+	"references": {"References", "asMessageIds", false},
+	"sender":     {"Sender", "asAddresses", false},
+	"from":       {"From", "asAddresses", false},
+	"to":         {"To", "asAddresses", false},
+	"cc":         {"Cc", "asAddresses", false},
+	"bcc":        {"Bcc", "asAddresses", false},
+	"replyTo":    {"Reply-To", "asAddresses", false},
+	"subject":    {"Subject", "asText", false},
+	"sentAt":     {"Date", "asDate", false},
+}
+
+// Decodes encoded-words in utf-8, iso-8859-1 and us-ascii.
+var wordDecoder mime.WordDecoder
+
+// ../rfc/8621 section 4.1.2.3
+type emailAddress struct {
+	Name  *string `json:"name"`
+	Email string  `json:"email"`
+}
+
+// ../rfc/8621 section 4.1.2.4
+type emailAddressGroup struct {
+	Name      *string        `json:"name"`
+	Addresses []emailAddress `json:"addresses"`
+}
+
+// unfold removes the line endings of folded header values.
+func unfold(raw string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(raw, "\r\n", ""), "\n", "")
+}
+
+// headerText returns a raw header value decoded as text. ../rfc/8621 section 4.1.2.2
+func headerText(raw string) string {
+	s := unfold(raw)
+	if d, err := wordDecoder.DecodeHeader(s); err == nil {
+		s = d
+	}
+	return norm.NFC.String(strings.TrimSpace(s))
+}
+
+// headerAddresses parses a raw header value as address list. Groups are
+// flattened. Invalid addresses result in an empty list.
+func headerAddresses(raw string) []emailAddress {
+	p := mail.AddressParser{WordDecoder: &wordDecoder}
+	l, err := p.ParseList(unfold(raw))
+	if err != nil {
+		return []emailAddress{}
+	}
+	r := make([]emailAddress, len(l))
+	for i, a := range l {
+		r[i].Email = a.Address
+		if a.Name != "" {
+			name := a.Name
+			r[i].Name = &name
+		}
+	}
+	return r
+}
+
+// angleValues returns the values between angle brackets in a raw header value,
+// for message-ids and urls.
+func angleValues(raw string) []string {
+	var l []string
+	s := unfold(raw)
+	for {
+		i := strings.IndexByte(s, '<')
+		if i < 0 {
+			break
+		}
+		j := strings.IndexByte(s[i:], '>')
+		if j < 0 {
+			break
+		}
+		if v := strings.TrimSpace(s[i+1 : i+j]); v != "" {
+			l = append(l, v)
+		}
+		s = s[i+j+1:]
+	}
+	return l
+}
+
+// headerValue parses a raw header value in one of the header forms.
+// ../rfc/8621 section 4.1.2
+func headerValue(raw, form string) any {
+	switch form {
+	case "asRaw":
+		return raw
+	case "asText":
+		return headerText(raw)
+	case "asAddresses":
+		return headerAddresses(raw)
+	case "asGroupedAddresses":
+		return []emailAddressGroup{{nil, headerAddresses(raw)}}
+	case "asMessageIds", "asURLs":
+		if l := angleValues(raw); l != nil {
+			return l
+		}
+		return nil
+	case "asDate":
+		t, err := mail.ParseDate(strings.TrimSpace(unfold(raw)))
+		if err != nil {
+			return nil
+		}
+		return t.Format(time.RFC3339)
+	}
+	panic(fmt.Sprintf("unknown header form %q", form))
+}
+
+// emailBodyPart is a part in the body structure of an email.
+// ../rfc/8621 section 4.1.4
+type emailBodyPart struct {
+	PartID      *string          `json:"partId"` // Nil for multipart.
+	BlobID      *string          `json:"blobId"`
+	Size        int64            `json:"size"`
+	Headers     []headerField    `json:"headers"`
+	Name        *string          `json:"name"`
+	Type        string           `json:"type"`
+	Charset     *string          `json:"charset"`
+	Disposition *string          `json:"disposition"`
+	CID         *string          `json:"cid"`
+	Language    []string         `json:"language"`
+	Location    *string          `json:"location"`
+	SubParts    []*emailBodyPart `json:"subParts"` // Only for multipart.
+	part        *message.Part    // Not in JSON.
+}
+
+// Default body properties for Email/get. ../rfc/8621 section 4.2
+var defaultBodyProperties = []string{"partId", "blobId", "size", "name", "type", "charset", "disposition", "cid", "language", "location"}
+
+// bodyPartProperties are the properties of parts that can be requested, in
+// addition to header properties.
+var bodyPartProperties = map[string]bool{"partId": true, "blobId": true, "size": true, "headers": true, "name": true, "type": true, "charset": true, "disposition": true, "cid": true, "language": true, "location": true, "subParts": true}
+
+// properties returns the part with only the requested properties, also for
+// sub parts.
+func (bp *emailBodyPart) properties(props []string) map[string]any {
+	r := map[string]any{}
+	for _, p := range props {
+		switch p {
+		case "partId":
+			r[p] = bp.PartID
+		case "blobId":
+			r[p] = bp.BlobID
+		case "size":
+			r[p] = bp.Size
+		case "headers":
+			r[p] = bp.Headers
+		case "name":
+			r[p] = bp.Name
+		case "type":
+			r[p] = bp.Type
+		case "charset":
+			r[p] = bp.Charset
+		case "disposition":
+			r[p] = bp.Disposition
+		case "cid":
+			r[p] = bp.CID
+		case "language":
+			r[p] = bp.Language
+		case "location":
+			r[p] = bp.Location
+		case "subParts":
+			r[p] = nil // Set below for multiparts.
+		default:
+			if hp, ok := parseHeaderProperty(p); ok {
+				r[p] = hp.value(bp.Headers)
+			}
+		}
+	}
+	// Sub parts are always included, clients need them to walk the structure.
+	if bp.SubParts != nil {
+		l := make([]map[string]any, len(bp.SubParts))
+		for i, sp := range bp.SubParts {
+			l[i] = sp.properties(props)
+		}
+		r["subParts"] = l
+	}
+	return r
+}
+
+// partBlobID returns the blob ID for the decoded data of a part of a message.
+func partBlobID(msgID int64, partID string) string {
+	return fmt.Sprintf("m%d.%s", msgID, partID)
+}
+
+// bodyStructure returns the body structure of message part p, with partID the
+// IMAP-style section number of the part, empty for the top-level multipart.
+func bodyStructure(msgID int64, p *message.Part, partID string) (*emailBodyPart, error) {
+	fields, err := partHeaderFields(p)
+	if err != nil {
+		return nil, fmt.Errorf("reading part header: %w", err)
+	}
+	bp := &emailBodyPart{Headers: fields, part: p}
+	if bp.Headers == nil {
+		bp.Headers = []headerField{}
+	}
+	bp.Type = "text/plain"
+	if p.MediaType != "" {
+		bp.Type = strings.ToLower(p.MediaType + "/" + p.MediaSubType)
+	}
+
+	h, err := p.Header()
+	if err != nil {
+		return nil, fmt.Errorf("parsing part header: %w", err)
+	}
+	optional := func(s string) *string {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			return nil
+		}
+		return &s
+	}
+	name := p.ContentTypeParams["name"]
+	if disp, params, err := mime.ParseMediaType(h.Get("Content-Disposition")); err == nil {
+		bp.Disposition = &disp
+		if params["filename"] != "" {
+			name = params["filename"]
+		}
+	}
+	if name != "" {
+		if d, err := wordDecoder.DecodeHeader(name); err == nil {
+			name = d
+		}
+		bp.Name = &name
+	}
+	bp.CID = optional(strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(p.ContentID), "<"), ">"))
+	bp.Location = optional(h.Get("Content-Location"))
+	for _, lang := range strings.Split(h.Get("Content-Language"), ",") {
+		if lang = strings.TrimSpace(lang); lang != "" {
+			bp.Language = append(bp.Language, lang)
+		}
+	}
+
+	if p.MediaType == "MULTIPART" {
+		bp.SubParts = []*emailBodyPart{}
+		for i := range p.Parts {
+			subID := fmt.Sprintf("%d", i+1)
+			if partID != "" {
+				subID = partID + "." + subID
+			}
+			sp, err := bodyStructure(msgID, &p.Parts[i], subID)
+			if err != nil {
+				return nil, err
+			}
+			bp.SubParts = append(bp.SubParts, sp)
+		}
+		return bp, nil
+	}
+
+	if partID == "" {
+		partID = "1"
+	}
+	blobID := partBlobID(msgID, partID)
+	bp.PartID = &partID
+	bp.BlobID = &blobID
+	bp.Size = p.DecodedSize
+	if strings.HasPrefix(bp.Type, "text/") {
+		charset := "us-ascii"
+		if cs := p.ContentTypeParams["charset"]; cs != "" {
+			charset = strings.ToLower(cs)
+		}
+		bp.Charset = &charset
+	}
+	return bp, nil
+}
+
+// partByID returns the non-multipart part with IMAP-style section number id,
+// as used in part blob IDs, or nil.
+func partByID(p *message.Part, id string) *message.Part {
+	if len(p.Parts) == 0 && p.MediaType != "MULTIPART" {
+		if id == "1" {
+			return p
+		}
+		return nil
+	}
+	for _, s := range strings.Split(id, ".") {
+		n, err := strconv.ParseInt(s, 10, 32)
+		if err != nil || n <= 0 || int(n) > len(p.Parts) || s != fmt.Sprintf("%d", n) {
+			return nil
+		}
+		p = &p.Parts[n-1]
+	}
+	if p.MediaType == "MULTIPART" {
+		return nil
+	}
+	return p
+}
+
+func isInlineMediaType(typ string) bool {
+	return strings.HasPrefix(typ, "image/") || strings.HasPrefix(typ, "audio/") || strings.HasPrefix(typ, "video/")
+}
+
+// flattenParts gathers the parts for the textBody, htmlBody and attachments
+// properties of an email, following the algorithm of the RFC. Nil textBody or
+// htmlBody means parts are not added to it in an alternative.
+// ../rfc/8621 section 4.1.4
+func flattenParts(parts []*emailBodyPart, multipartType string, inAlternative bool, textBody, htmlBody, attachments *[]*emailBodyPart) {
+	textLength, htmlLength := -1, -1
+	if textBody != nil {
+		textLength = len(*textBody)
+	}
+	if htmlBody != nil {
+		htmlLength = len(*htmlBody)
+	}
+	for i, bp := range parts {
+		isInline := (bp.Disposition == nil || *bp.Disposition != "attachment") &&
+			(bp.Type == "text/plain" || bp.Type == "text/html" || isInlineMediaType(bp.Type)) &&
+			(i == 0 || multipartType != "related" && (isInlineMediaType(bp.Type) || bp.Name == nil))
+		if bp.SubParts != nil {
+			subType := strings.TrimPrefix(bp.Type, "multipart/")
+			flattenParts(bp.SubParts, subType, inAlternative || subType == "alternative", textBody, htmlBody, attachments)
+		} else if isInline {
+			if multipartType == "alternative" {
+				switch {
+				case bp.Type == "text/plain" && textBody != nil:
+					*textBody = append(*textBody, bp)
+				case bp.Type == "text/html" && htmlBody != nil:
+					*htmlBody = append(*htmlBody, bp)
+				case bp.Type != "text/plain" && bp.Type != "text/html":
+					*attachments = append(*attachments, bp)
+				}
+				continue
+			} else if inAlternative {
+				if bp.Type == "text/plain" {
+					htmlBody = nil
+				}
+				if bp.Type == "text/html" {
+					textBody = nil
+				}
+			}
+			if textBody != nil {
+				*textBody = append(*textBody, bp)
+			}
+			if htmlBody != nil {
+				*htmlBody = append(*htmlBody, bp)
+			}
+			if (textBody == nil || htmlBody == nil) && isInlineMediaType(bp.Type) {
+				*attachments = append(*attachments, bp)
+			}
+		} else {
+			*attachments = append(*attachments, bp)
+		}
+	}
+	if multipartType == "alternative" && textBody != nil && htmlBody != nil {
+		// Only an html part found, use it for the text body too, and vice versa.
+		if textLength == len(*textBody) && htmlLength != len(*htmlBody) {
+			*textBody = append(*textBody, (*htmlBody)[htmlLength:]...)
+		}
+		if htmlLength == len(*htmlBody) && textLength != len(*textBody) {
+			*htmlBody = append(*htmlBody, (*textBody)[textLength:]...)
+		}
+	}
+}
+
+// emailBody holds the body structure of an email with the flattened lists of
+// parts.
+type emailBody struct {
+	structure   *emailBodyPart
+	textBody    []*emailBodyPart
+	htmlBody    []*emailBodyPart
+	attachments []*emailBodyPart
+}
+
+func parseEmailBody(msgID int64, p *message.Part) (emailBody, error) {
+	bs, err := bodyStructure(msgID, p, "")
+	if err != nil {
+		return emailBody{}, err
+	}
+	eb := emailBody{bs, []*emailBodyPart{}, []*emailBodyPart{}, []*emailBodyPart{}}
+	flattenParts([]*emailBodyPart{bs}, "mixed", false, &eb.textBody, &eb.htmlBody, &eb.attachments)
+	return eb, nil
+}
+
+// ../rfc/8621 section 4.1.4
+type emailBodyValue struct {
+	Value             string `json:"value"`
+	IsEncodingProblem bool   `json:"isEncodingProblem"`
+	IsTruncated       bool   `json:"isTruncated"`
+}
+
+// bodyValue returns the decoded text of a text part, with line endings as LF,
+// truncated to at most max bytes if max is positive. Only the us-ascii, utf-8
+// and iso-8859-1 charsets are decoded, others are an encoding problem.
+func bodyValue(bp *emailBodyPart, max int64) emailBodyValue {
+	var bv emailBodyValue
+	buf, err := io.ReadAll(bp.part.Reader())
+	if err != nil {
+		bv.IsEncodingProblem = true
+	}
+	var charset string
+	if bp.Charset != nil {
+		charset = *bp.Charset
+	}
+	var s string
+	switch charset {
+	case "iso-8859-1", "latin1", "latin-1":
+		r := make([]rune, len(buf))
+		for i, c := range buf {
+			r[i] = rune(c)
+		}
+		s = string(r)
+	case "", "us-ascii", "utf-8", "utf8":
+		s = string(buf)
+	default:
+		s = string(buf)
+		bv.IsEncodingProblem = true
+	}
+	if !utf8.ValidString(s) {
+		s = strings.ToValidUTF8(s, "�")
+		bv.IsEncodingProblem = true
+	}
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	if max > 0 && int64(len(s)) > max {
+		n := int(max)
+		for n > 0 && !utf8.RuneStart(s[n]) {
+			n--
+		}
+		s = s[:n]
+		bv.IsTruncated = true
+	}
+	bv.Value = s
+	return bv
+}
@@ -0,0 +1,805 @@
+package jmapserver
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/store"
+)
+
+// emailAdd is an email to be added by Email/set or Email/import, with its
+// message in a temporary file.
+type emailAdd struct {
+	cid        string
+	file       *os.File
+	size       int64
+	mailboxIDs map[string]bool
+	flags      store.Flags
+	keywords   []string
+	received   time.Time
+}
+
+// xparseKeywords parses a keywords property into flags and keywords.
+func xparseKeywords(raw map[string]bool) (store.Flags, []string) {
+	var m store.Message
+	for kw, v := range raw {
+		if !v {
+			xinvalidProperty("keywords", "keyword values must be true")
+		}
+		xsetKeyword(&m, strings.ToLower(kw), true)
+	}
+	return m.Flags, m.Keywords
+}
+
+// xmailboxSingle returns the mailbox of a mailboxIds property, which must have
+// exactly one mailbox because a message is in a single mailbox.
+func (c *call) xmailboxSingle(mbs mailboxes, mailboxIDs map[string]bool) *store.Mailbox {
+	var l []string
+	for id, v := range mailboxIDs {
+		if v {
+			l = append(l, id)
+		}
+	}
+	if len(l) == 0 {
+		xinvalidProperty("mailboxIds", "email must be in a mailbox")
+	} else if len(l) > 1 {
+		xsetErrorf("tooManyMailboxes", "email can only be in a single mailbox")
+	}
+	mb := c.xmailboxID(mbs, l[0])
+	if mb == nil {
+		xinvalidProperty("mailboxIds", "unknown mailbox %q", l[0])
+	}
+	return mb
+}
+
+// removeAdds closes and removes the temporary files of emails not added.
+func (c *call) removeAdds(adds []*emailAdd) {
+	for _, a := range adds {
+		if a.file == nil {
+			continue
+		}
+		err := a.file.Close()
+		c.log.Check(err, "closing temporary message file")
+		err = os.Remove(a.file.Name())
+		c.log.Check(err, "removing temporary message file", mlog.Field("path", a.file.Name()))
+	}
+}
+
+// xcheckDomainStorage fails with overQuota for all adds if the storage limit of
+// the domain would be exceeded. It must be called outside of a transaction,
+// because the databases of other accounts of the domain are read.
+func (c *call) xcheckDomainStorage(adds []*emailAdd, notCreated map[string]setError) []*emailAdd {
+	var size int64
+	for _, a := range adds {
+		size += a.size
+	}
+	err := c.acc.CheckDomainStorage(c.ctx, c.log, size)
+	if errors.Is(err, store.ErrDomainStorage) {
+		for _, a := range adds {
+			notCreated[a.cid] = setError{Type: "overQuota", Description: err.Error()}
+		}
+		c.removeAdds(adds)
+		return nil
+	}
+	xcheckf(err, "checking storage limit of domain")
+	return adds
+}
+
+// xaddEmails delivers the emails to their mailbox, like an IMAP APPEND. Created
+// email ids are registered for the creation ids, and the ids of delivered
+// messages are appended to delivered, for removing their files if the
+// transaction fails.
+func (c *call) xaddEmails(tx *bstore.Tx, adds []*emailAdd, created map[string]any, notCreated map[string]setError, delivered *[]int64) []store.Change {
+	var changes []store.Change
+	for _, a := range adds {
+		if serr := setObjectWrite(func() func() {
+			mbs := xmailboxes(tx)
+			mb := c.xmailboxSingle(mbs, a.mailboxIDs)
+
+			err := c.acc.CheckQuota(tx, 1, a.size)
+			if errors.Is(err, store.ErrOverQuota) {
+				xsetErrorf("overQuota", "%s", err)
+			}
+			xcheckf(err, "checking quota")
+
+			return func() {
+				var kwChanged bool
+				mb.Keywords, kwChanged = store.MergeKeywords(mb.Keywords, a.keywords)
+				if kwChanged {
+					err := tx.Update(mb)
+					xcheckf(err, "updating keywords in mailbox")
+				}
+
+				m := store.Message{
+					MailboxID:     mb.ID,
+					MailboxOrigID: mb.ID,
+					Received:      a.received,
+					Flags:         a.flags,
+					Keywords:      a.keywords,
+					Size:          a.size,
+				}
+				err := c.acc.DeliverMessage(c.log, tx, &m, a.file, true, mb.Sent, true, false)
+				xcheckf(err, "delivering message")
+				*delivered = append(*delivered, m.ID)
+				// The temporary file has been moved into place.
+				err = a.file.Close()
+				c.log.Check(err, "closing delivered file")
+				a.file = nil
+
+				changes = append(changes, store.ChangeAddUID{MailboxID: mb.ID, UID: m.UID, ModSeq: m.ModSeq, Flags: m.Flags, Keywords: m.Keywords})
+				c.createdIDs[a.cid] = emailObjectID(m)
+				created[a.cid] = map[string]any{
+					"id":       emailObjectID(m),
+					"blobId":   fmt.Sprintf("m%d", m.ID),
+					"threadId": m.ThreadObjectID(),
+					"size":     m.Size,
+				}
+			}
+		}); serr != nil {
+			notCreated[a.cid] = *serr
+		}
+	}
+	return changes
+}
+
+// withEmailAdds calls fn with the account write-locked and in a write
+// transaction, cleaning up temporary files afterwards and files of delivered
+// messages if the transaction fails. The changes returned by fn are broadcasted
+// after the transaction is committed.
+func (c *call) withEmailAdds(adds []*emailAdd, fn func(tx *bstore.Tx, delivered *[]int64) []store.Change) {
+	defer c.removeAdds(adds)
+
+	var delivered []int64
+	defer func() {
+		x := recover()
+		if x == nil {
+			return
+		}
+		for _, id := range delivered {
+			p := c.acc.MessagePath(id)
+			err := os.Remove(p)
+			c.log.Check(err, "removing delivered message file after error", mlog.Field("path", p))
+		}
+		panic(x)
+	}()
+
+	c.acc.WithWLock(func() {
+		var changes []store.Change
+		c.xdbwrite(func(tx *bstore.Tx) {
+			changes = fn(tx, &delivered)
+		})
+		c.broadcast(changes)
+	})
+}
+
+// Creation properties of an email. Header fields in "header:" form are handled
+// separately. ../rfc/8621 section 4.6
+type emailCreate struct {
+	MailboxIDs    map[string]bool           `json:"mailboxIds"`
+	Keywords      map[string]bool           `json:"keywords"`
+	ReceivedAt    *time.Time                `json:"receivedAt"`
+	MessageID     []string                  `json:"messageId"`
+	InReplyTo     []string                  `json:"inReplyTo"`
+	References    []string                  `json:"references"`
+	Sender        []emailAddress            `json:"sender"`
+	From          []emailAddress            `json:"from"`
+	To            []emailAddress            `json:"to"`
+	Cc            []emailAddress            `json:"cc"`
+	Bcc           []emailAddress            `json:"bcc"`
+	ReplyTo       []emailAddress            `json:"replyTo"`
+	Subject       *string                   `json:"subject"`
+	SentAt        *time.Time                `json:"sentAt"`
+	BodyStructure *emailBodyPartCreate      `json:"bodyStructure"`
+	BodyValues    map[string]emailBodyValue `json:"bodyValues"`
+	TextBody      []emailBodyPartCreate     `json:"textBody"`
+	HTMLBody      []emailBodyPartCreate     `json:"htmlBody"`
+	Attachments   []emailBodyPartCreate     `json:"attachments"`
+}
+
+// Creation properties of a body part. Either partId for a value in bodyValues,
+// blobId for data of a blob, or subParts for a multipart must be set.
+type emailBodyPartCreate struct {
+	PartID      *string               `json:"partId"`
+	BlobID      *string               `json:"blobId"`
+	Size        *int64                `json:"size"` // Ignored.
+	Type        string                `json:"type"`
+	Charset     *string               `json:"charset"`
+	Disposition *string               `json:"disposition"`
+	Name        *string               `json:"name"`
+	CID         *string               `json:"cid"`
+	Language    []string              `json:"language"`
+	Location    *string               `json:"location"`
+	SubParts    []emailBodyPartCreate `json:"subParts"`
+}
+
+// encodeHeaderText returns s as header value, with encoded-words if it has
+// non-ascii characters.
+func encodeHeaderText(s string) string {
+	return mime.QEncoding.Encode("utf-8", s)
+}
+
+// formatAddresses returns a header value for an address list, folded.
+func formatAddresses(l []emailAddress) string {
+	hw := &message.HeaderWriter{}
+	for i, a := range l {
+		ma := mail.Address{Address: a.Email}
+		if a.Name != nil {
+			ma.Name = *a.Name
+		}
+		s := ma.String()
+		if i < len(l)-1 {
+			s += ","
+		}
+		hw.Add(" ", s)
+	}
+	return strings.TrimSuffix(hw.String(), "\r\n")
+}
+
+func formatMessageIDs(l []string) string {
+	hw := &message.HeaderWriter{}
+	for _, id := range l {
+		hw.Add(" ", "<"+id+">")
+	}
+	return strings.TrimSuffix(hw.String(), "\r\n")
+}
+
+// xcomposeEmail parses the creation properties of an email, and writes the
+// message to a temporary file.
+func (c *call) xcomposeEmail(cid string, props map[string]json.RawMessage) *emailAdd {
+	var extra []headerField
+	known := map[string]json.RawMessage{}
+	for k, v := range props {
+		if strings.HasPrefix(k, "header:") {
+			hp, ok := parseHeaderProperty(k)
+			if !ok || hp.all || hp.form != "asRaw" && hp.form != "asText" {
+				xinvalidProperty(k, "only header properties as raw or text can be set")
+			}
+			var s string
+			if err := json.Unmarshal(v, &s); err != nil {
+				xinvalidProperty(k, "parsing header value: %v", err)
+			}
+			if strings.ContainsAny(s, "\r\n") && hp.form == "asText" {
+				xinvalidProperty(k, "line endings not allowed in text header value")
+			}
+			if hp.form == "asText" {
+				s = " " + encodeHeaderText(s)
+			}
+			extra = append(extra, headerField{hp.name, s})
+			continue
+		}
+		switch k {
+		case "mailboxIds", "keywords", "receivedAt", "messageId", "inReplyTo", "references", "sender", "from", "to", "cc", "bcc", "replyTo", "subject", "sentAt", "bodyStructure", "bodyValues", "textBody", "htmlBody", "attachments":
+			known[k] = v
+		case "id", "blobId", "threadId", "size", "headers", "hasAttachment", "preview":
+			xinvalidProperty(k, "property %q is server-set", k)
+		default:
+			xinvalidProperty(k, "unknown property %q", k)
+		}
+	}
+	buf, err := json.Marshal(known)
+	xcheckf(err, "marshal email properties")
+	var ec emailCreate
+	if err := json.Unmarshal(buf, &ec); err != nil {
+		xsetErrorf("invalidProperties", "parsing email: %v", err)
+	}
+	if ec.BodyStructure != nil && (ec.TextBody != nil || ec.HTMLBody != nil || ec.Attachments != nil) {
+		xinvalidProperty("bodyStructure", "bodyStructure cannot be combined with textBody, htmlBody or attachments")
+	}
+	if len(ec.TextBody) > 1 || len(ec.HTMLBody) > 1 {
+		xinvalidProperty("textBody", "at most one textBody and one htmlBody part")
+	}
+	for id, bv := range ec.BodyValues {
+		if bv.IsEncodingProblem || bv.IsTruncated {
+			xinvalidProperty("bodyValues/"+id, "isEncodingProblem and isTruncated must be false")
+		}
+	}
+
+	a := &emailAdd{cid: cid, mailboxIDs: ec.MailboxIDs, received: time.Now()}
+	a.flags, a.keywords = xparseKeywords(ec.Keywords)
+	if ec.ReceivedAt != nil {
+		a.received = *ec.ReceivedAt
+	}
+
+	// Build the structure from the convenience properties.
+	root := ec.BodyStructure
+	if root == nil {
+		var body *emailBodyPartCreate
+		text := func(l []emailBodyPartCreate, typ string) *emailBodyPartCreate {
+			if len(l) == 0 {
+				return nil
+			}
+			if l[0].Type == "" {
+				l[0].Type = typ
+			} else if l[0].Type != typ {
+				xinvalidProperty("textBody", "part must be of type %s", typ)
+			}
+			return &l[0]
+		}
+		tp := text(ec.TextBody, "text/plain")
+		hp := text(ec.HTMLBody, "text/html")
+		switch {
+		case tp != nil && hp != nil:
+			body = &emailBodyPartCreate{Type: "multipart/alternative", SubParts: []emailBodyPartCreate{*tp, *hp}}
+		case tp != nil:
+			body = tp
+		case hp != nil:
+			body = hp
+		}
+		if len(ec.Attachments) > 0 {
+			l := ec.Attachments
+			if body != nil {
+				l = append([]emailBodyPartCreate{*body}, l...)
+			}
+			body = &emailBodyPartCreate{Type: "multipart/mixed", SubParts: l}
+		}
+		if body == nil {
+			empty := ""
+			body = &emailBodyPartCreate{Type: "text/plain", PartID: &empty}
+			ec.BodyValues = map[string]emailBodyValue{"": {}}
+		}
+		root = body
+	}
+
+	f, err := store.CreateMessageTemp("jmap-email")
+	xcheckf(err, "creating temporary file for email")
+	a.file = f
+	defer func() {
+		if x := recover(); x != nil {
+			c.removeAdds([]*emailAdd{a})
+			panic(x)
+		}
+	}()
+
+	var hb bytes.Buffer
+	header := func(k, v string) {
+		fmt.Fprintf(&hb, "%s: %s\r\n", k, v)
+	}
+	addresses := []struct {
+		name string
+		l    []emailAddress
+	}{{"From", ec.From}, {"Sender", ec.Sender}, {"Reply-To", ec.ReplyTo}, {"To", ec.To}, {"Cc", ec.Cc}, {"Bcc", ec.Bcc}}
+	for _, h := range addresses {
+		if len(h.l) > 0 {
+			header(h.name, formatAddresses(h.l))
+		}
+	}
+	if ec.Subject != nil {
+		header("Subject", encodeHeaderText(*ec.Subject))
+	}
+	date := time.Now()
+	if ec.SentAt != nil {
+		date = *ec.SentAt
+	}
+	header("Date", date.Format(message.RFC5322Z))
+	msgIDs := ec.MessageID
+	if len(msgIDs) == 0 {
+		msgIDs = []string{mox.MessageIDGen(false)}
+	}
+	header("Message-Id", formatMessageIDs(msgIDs))
+	if len(ec.InReplyTo) > 0 {
+		header("In-Reply-To", formatMessageIDs(ec.InReplyTo))
+	}
+	if len(ec.References) > 0 {
+		header("References", formatMessageIDs(ec.References))
+	}
+	for _, hf := range extra {
+		fmt.Fprintf(&hb, "%s:%s\r\n", hf.Name, hf.Value)
+	}
+	header("MIME-Version", "1.0")
+
+	ph, body := c.xcomposePart(*root, ec.BodyValues)
+	for _, k := range []string{"Content-Type", "Content-Transfer-Encoding", "Content-Disposition", "Content-Id", "Content-Language", "Content-Location"} {
+		if v := ph.Get(k); v != "" {
+			header(k, v)
+		}
+	}
+	hb.WriteString("\r\n")
+
+	size, err := io.Copy(f, io.MultiReader(&hb, bytes.NewReader(body)))
+	xcheckf(err, "writing email")
+	a.size = size
+	if maxSize := mox.Conf.MessageSizeLimit(c.acc.Name); maxSize > 0 && size > maxSize {
+		xsetErrorf("tooLarge", "email larger than maximum size %d", maxSize)
+	}
+	return a
+}
+
+// xcomposePart returns the MIME header and encoded body of a part to create.
+func (c *call) xcomposePart(bp emailBodyPartCreate, values map[string]emailBodyValue) (textproto.MIMEHeader, []byte) {
+	h := textproto.MIMEHeader{}
+	params := map[string]string{}
+	if bp.Name != nil && bp.Disposition == nil {
+		params["name"] = *bp.Name
+	}
+	if bp.Disposition != nil {
+		dparams := map[string]string{}
+		if bp.Name != nil {
+			dparams["filename"] = *bp.Name
+		}
+		h.Set("Content-Disposition", mime.FormatMediaType(*bp.Disposition, dparams))
+	}
+	if bp.CID != nil {
+		h.Set("Content-Id", "<"+*bp.CID+">")
+	}
+	if len(bp.Language) > 0 {
+		h.Set("Content-Language", strings.Join(bp.Language, ", "))
+	}
+	if bp.Location != nil {
+		h.Set("Content-Location", *bp.Location)
+	}
+	typ := strings.ToLower(bp.Type)
+
+	switch {
+	case bp.SubParts != nil:
+		if !strings.HasPrefix(typ, "multipart/") || bp.PartID != nil || bp.BlobID != nil {
+			xinvalidProperty("bodyStructure", "only multipart parts can have subParts")
+		}
+		var b bytes.Buffer
+		mp := multipart.NewWriter(&b)
+		for _, sp := range bp.SubParts {
+			sh, sbody := c.xcomposePart(sp, values)
+			w, err := mp.CreatePart(sh)
+			xcheckf(err, "creating multipart")
+			_, err = w.Write(sbody)
+			xcheckf(err, "writing multipart")
+		}
+		err := mp.Close()
+		xcheckf(err, "closing multipart")
+		params["boundary"] = mp.Boundary()
+		h.Set("Content-Type", mime.FormatMediaType(typ, params))
+		return h, b.Bytes()
+
+	case bp.PartID != nil:
+		if bp.BlobID != nil || !strings.HasPrefix(typ, "text/") {
+			xinvalidProperty("bodyStructure", "parts with partId must be text without blobId")
+		}
+		bv, ok := values[*bp.PartID]
+		if !ok {
+			xinvalidProperty("bodyValues", "missing body value for part %q", *bp.PartID)
+		}
+		text := strings.ReplaceAll(strings.ReplaceAll(bv.Value, "\r\n", "\n"), "\n", "\r\n")
+		params["charset"] = "utf-8"
+		h.Set("Content-Type", mime.FormatMediaType(typ, params))
+		var needQP bool
+		for _, line := range strings.Split(text, "\r\n") {
+			needQP = needQP || len(line) > 78 || strings.ContainsAny(line, "\r\n")
+		}
+		for _, ch := range text {
+			needQP = needQP || ch >= 0x80
+		}
+		if !needQP {
+			h.Set("Content-Transfer-Encoding", "7bit")
+			return h, []byte(text)
+		}
+		var b bytes.Buffer
+		w := quotedprintable.NewWriter(&b)
+		_, err := w.Write([]byte(text))
+		if err == nil {
+			err = w.Close()
+		}
+		xcheckf(err, "encoding text as quoted-printable")
+		h.Set("Content-Transfer-Encoding", "quoted-printable")
+		return h, b.Bytes()
+
+	case bp.BlobID != nil:
+		if typ == "" || strings.HasPrefix(typ, "multipart/") {
+			xinvalidProperty("bodyStructure", "parts with blobId must have a non-multipart type")
+		}
+		if bp.Charset != nil {
+			params["charset"] = *bp.Charset
+		}
+		h.Set("Content-Type", mime.FormatMediaType(typ, params))
+		rc, _, err := c.openBlob(*bp.BlobID)
+		xcheckf(err, "opening blob")
+		if rc == nil {
+			xsetErrorf("blobNotFound", "blob %q not found", *bp.BlobID)
+		}
+		defer func() {
+			err := rc.Close()
+			c.log.Check(err, "closing blob")
+		}()
+		data, err := io.ReadAll(rc)
+		xcheckf(err, "reading blob")
+		h.Set("Content-Transfer-Encoding", "base64")
+		var b bytes.Buffer
+		enc := base64.StdEncoding.EncodeToString(data)
+		for len(enc) > 76 {
+			b.WriteString(enc[:76] + "\r\n")
+			enc = enc[76:]
+		}
+		if enc != "" {
+			b.WriteString(enc + "\r\n")
+		}
+		return h, b.Bytes()
+	}
+	xinvalidProperty("bodyStructure", "part needs partId, blobId or subParts")
+	panic("not reached")
+}
+
+// emailSet creates, updates and destroys emails. Updates can only change
+// keywords and the mailbox. ../rfc/8621 section 4.6
+func (c *call) emailSet(args json.RawMessage) any {
+	var req setRequest
+	xparseArgs(args, &req)
+	c.xcheckAccount(req.AccountID)
+	xcheckIDs(len(req.Create)+len(req.Update)+len(req.Destroy), maxObjectsInSet)
+
+	var resp setResponse
+	c.xdbread(func(tx *bstore.Tx) {
+		state := xemailState(tx, c.acc).String()
+		if req.IfInState != nil && *req.IfInState != state {
+			xmethodErrorf("stateMismatch", "state does not match")
+		}
+		resp = newSetResponse(req.AccountID, state)
+	})
+
+	// Messages are composed before the transaction, the storage limit of the domain
+	// is checked outside of a transaction.
+	var adds []*emailAdd
+	for cid, raw := range req.Create {
+		if serr := setObject(func() {
+			var props map[string]json.RawMessage
+			if err := json.Unmarshal(raw, &props); err != nil {
+				xsetErrorf("invalidProperties", "parsing email: %v", err)
+			}
+			adds = append(adds, c.xcomposeEmail(cid, props))
+		}); serr != nil {
+			resp.NotCreated[cid] = *serr
+		}
+	}
+	adds = c.xcheckDomainStorage(adds, resp.NotCreated)
+
+	// Files of destroyed messages are only removed after the transaction is committed.
+	var remove []store.Message
+	c.withEmailAdds(adds, func(tx *bstore.Tx, delivered *[]int64) []store.Change {
+		if req.IfInState != nil && *req.IfInState != xemailState(tx, c.acc).String() {
+			xmethodErrorf("stateMismatch", "state does not match")
+		}
+		changes := c.xaddEmails(tx, adds, resp.Created, resp.NotCreated, delivered)
+
+		for id, patch := range req.Update {
+			if serr := setObjectWrite(func() func() {
+				update := c.xemailUpdate(tx, id, patch)
+				return func() {
+					changes = append(changes, update()...)
+					resp.Updated[id] = nil
+				}
+			}); serr != nil {
+				resp.NotUpdated[id] = *serr
+			}
+		}
+
+		for _, id := range req.Destroy {
+			if serr := setObjectWrite(func() func() {
+				msgID, ok := c.xemailID(id)
+				m := store.Message{ID: msgID}
+				var err error
+				if ok {
+					err = tx.Get(&m)
+				}
+				if !ok || err == bstore.ErrAbsent {
+					xsetErrorf("notFound", "unknown email")
+				}
+				xcheckf(err, "get message")
+				if c.acc.OnHold() {
+					xsetErrorf("forbidden", "%s", store.ErrHold)
+				}
+				mb := store.Mailbox{ID: m.MailboxID}
+				err = tx.Get(&mb)
+				xcheckf(err, "get mailbox of message")
+				return func() {
+					nchanges, err := c.acc.MessagesRemove(c.ctx, c.log, tx, &mb, []store.Message{m})
+					xcheckf(err, "removing message")
+					changes = append(changes, nchanges...)
+					remove = append(remove, m)
+					resp.Destroyed = append(resp.Destroyed, id)
+				}
+			}); serr != nil {
+				resp.NotDestroyed[id] = *serr
+			}
+		}
+
+		resp.NewState = xemailState(tx, c.acc).String()
+		return changes
+	})
+	for _, m := range remove {
+		p := c.acc.MessagePath(m.ID)
+		err := os.Remove(p)
+		c.log.Check(err, "removing message file for email destroy", mlog.Field("path", p))
+	}
+	return resp
+}
+
+// xemailUpdate checks a patch with keywords and/or mailboxIds for an email, and
+// returns the function that applies it.
+func (c *call) xemailUpdate(tx *bstore.Tx, id string, patch map[string]json.RawMessage) func() []store.Change {
+	msgID, ok := c.xemailID(id)
+	m := store.Message{ID: msgID}
+	var err error
+	if ok {
+		err = tx.Get(&m)
+	}
+	if !ok || err == bstore.ErrAbsent {
+		xsetErrorf("notFound", "unknown email")
+	}
+	xcheckf(err, "get message")
+	mbs := xmailboxes(tx)
+	om := m
+
+	unescape := func(s string) string {
+		return strings.ReplaceAll(strings.ReplaceAll(s, "~1", "/"), "~0", "~")
+	}
+	mailboxIDs := map[string]bool{store.Mailbox{ID: m.MailboxID}.ObjectID(): true}
+	for k, v := range patch {
+		switch {
+		case k == "keywords":
+			var kw map[string]bool
+			if err := json.Unmarshal(v, &kw); err != nil {
+				xinvalidProperty(k, "parsing keywords: %v", err)
+			}
+			// The IMAP \Deleted flag has no keyword, it is kept.
+			deleted := m.Deleted
+			m.Flags, m.Keywords = xparseKeywords(kw)
+			m.Deleted = deleted
+		case strings.HasPrefix(k, "keywords/"):
+			var set *bool
+			if err := json.Unmarshal(v, &set); err != nil || set != nil && !*set {
+				xinvalidProperty(k, "keyword value must be true or null")
+			}
+			xsetKeyword(&m, strings.ToLower(unescape(k[len("keywords/"):])), set != nil)
+		case k == "mailboxIds":
+			mailboxIDs = nil
+			if err := json.Unmarshal(v, &mailboxIDs); err != nil {
+				xinvalidProperty(k, "parsing mailboxIds: %v", err)
+			}
+		case strings.HasPrefix(k, "mailboxIds/"):
+			var set *bool
+			if err := json.Unmarshal(v, &set); err != nil || set != nil && !*set {
+				xinvalidProperty(k, "mailbox value must be true or null")
+			}
+			mbID := unescape(k[len("mailboxIds/"):])
+			if mb := c.xmailboxID(mbs, mbID); mb != nil {
+				mbID = mb.ObjectID()
+			}
+			if set != nil {
+				mailboxIDs[mbID] = true
+			} else {
+				delete(mailboxIDs, mbID)
+			}
+		default:
+			xinvalidProperty(k, "property %q cannot be changed", k)
+		}
+	}
+	mbDst := c.xmailboxSingle(mbs, mailboxIDs)
+
+	return func() []store.Change {
+		var changes []store.Change
+		if m.Flags != om.Flags || strings.Join(m.Keywords, " ") != strings.Join(om.Keywords, " ") {
+			mb := mbs.byID[m.MailboxID]
+			var kwChanged bool
+			mb.Keywords, kwChanged = store.MergeKeywords(mb.Keywords, m.Keywords)
+			if kwChanged {
+				err := tx.Update(mb)
+				xcheckf(err, "updating keywords in mailbox")
+			}
+
+			modseq, err := c.acc.NextModSeq(tx)
+			xcheckf(err, "assigning modseq")
+			m.ModSeq = modseq
+			err = tx.Update(&m)
+			xcheckf(err, "updating flags of message")
+			err = store.MailboxCountsRemove(tx, om)
+			if err == nil {
+				err = store.MailboxCountsAdd(tx, m)
+			}
+			xcheckf(err, "updating mailbox counts")
+			err = c.acc.RetrainMessages(c.ctx, c.log, tx, []store.Message{m}, false)
+			xcheckf(err, "training message")
+
+			var mask store.Flags
+			for _, fk := range flagKeywords {
+				*fk.flag(&mask) = *fk.flag(&m.Flags) != *fk.flag(&om.Flags)
+			}
+			changes = append(changes, store.ChangeFlags{MailboxID: m.MailboxID, UID: m.UID, ModSeq: m.ModSeq, Mask: mask, Flags: m.Flags, Keywords: m.Keywords})
+		}
+		if mbDst.ID != m.MailboxID {
+			mbSrc := mbs.byID[m.MailboxID]
+			nchanges, err := c.acc.MessagesMove(c.ctx, c.log, tx, mbSrc, mbDst, []store.Message{m})
+			xcheckf(err, "moving message")
+			changes = append(changes, nchanges...)
+		}
+		return changes
+	}
+}
+
+// emailImport adds emails from blobs with message data. ../rfc/8621 section 4.8
+func (c *call) emailImport(args json.RawMessage) any {
+	var req struct {
+		AccountID string  `json:"accountId"`
+		IfInState *string `json:"ifInState"`
+		Emails    map[string]struct {
+			BlobID     string          `json:"blobId"`
+			MailboxIDs map[string]bool `json:"mailboxIds"`
+			Keywords   map[string]bool `json:"keywords"`
+			ReceivedAt *time.Time      `json:"receivedAt"`
+		} `json:"emails"`
+	}
+	xparseArgs(args, &req)
+	c.xcheckAccount(req.AccountID)
+	xcheckIDs(len(req.Emails), maxObjectsInSet)
+
+	resp := struct {
+		AccountID  string              `json:"accountId"`
+		OldState   string              `json:"oldState"`
+		NewState   string              `json:"newState"`
+		Created    map[string]any      `json:"created"`
+		NotCreated map[string]setError `json:"notCreated"`
+	}{req.AccountID, "", "", map[string]any{}, map[string]setError{}}
+	c.xdbread(func(tx *bstore.Tx) {
+		resp.OldState = xemailState(tx, c.acc).String()
+	})
+	if req.IfInState != nil && *req.IfInState != resp.OldState {
+		xmethodErrorf("stateMismatch", "state does not match")
+	}
+
+	maxSize := mox.Conf.MessageSizeLimit(c.acc.Name)
+	var adds []*emailAdd
+	for cid, e := range req.Emails {
+		if serr := setObject(func() {
+			a := &emailAdd{cid: cid, mailboxIDs: e.MailboxIDs, received: time.Now()}
+			a.flags, a.keywords = xparseKeywords(e.Keywords)
+			if e.ReceivedAt != nil {
+				a.received = *e.ReceivedAt
+			}
+			rc, _, err := c.openBlob(e.BlobID)
+			xcheckf(err, "opening blob")
+			if rc == nil {
+				xsetErrorf("blobNotFound", "blob not found")
+			}
+			defer func() {
+				err := rc.Close()
+				c.log.Check(err, "closing blob")
+			}()
+			f, err := store.CreateMessageTemp("jmap-import")
+			xcheckf(err, "creating temporary file for email")
+			a.file = f
+			size, err := io.Copy(f, rc)
+			if err == nil && maxSize > 0 && size > maxSize {
+				c.removeAdds([]*emailAdd{a})
+				xsetErrorf("tooLarge", "email larger than maximum size %d", maxSize)
+			} else if err != nil {
+				c.removeAdds([]*emailAdd{a})
+				xcheckf(err, "copying blob")
+			}
+			a.size = size
+			adds = append(adds, a)
+		}); serr != nil {
+			resp.NotCreated[cid] = *serr
+		}
+	}
+	adds = c.xcheckDomainStorage(adds, resp.NotCreated)
+
+	c.withEmailAdds(adds, func(tx *bstore.Tx, delivered *[]int64) []store.Change {
+		changes := c.xaddEmails(tx, adds, resp.Created, resp.NotCreated, delivered)
+		resp.NewState = xemailState(tx, c.acc).String()
+		return changes
+	})
+	return resp
+}
@@ -0,0 +1,515 @@
+package jmapserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/store"
+)
+
+// Arguments of the standard /get method. ../rfc/8620 section 5.1
+type getRequest struct {
+	AccountID  string   `json:"accountId"`
+	IDs        []string `json:"ids"` // Nil for all objects.
+	Properties []string `json:"properties"`
+}
+
+type getResponse struct {
+	AccountID string   `json:"accountId"`
+	State     string   `json:"state"`
+	List      []any    `json:"list"`
+	NotFound  []string `json:"notFound"`
+}
+
+// Arguments of the standard /changes method. ../rfc/8620 section 5.2
+type changesRequest struct {
+	AccountID  string `json:"accountId"`
+	SinceState string `json:"sinceState"`
+	MaxChanges *int64 `json:"maxChanges"`
+}
+
+type changesResponse struct {
+	AccountID      string   `json:"accountId"`
+	OldState       string   `json:"oldState"`
+	NewState       string   `json:"newState"`
+	HasMoreChanges bool     `json:"hasMoreChanges"`
+	Created        []string `json:"created"`
+	Updated        []string `json:"updated"`
+	Destroyed      []string `json:"destroyed"`
+}
+
+// Arguments of the standard /set method. ../rfc/8620 section 5.3
+type setRequest struct {
+	AccountID string                                `json:"accountId"`
+	IfInState *string                               `json:"ifInState"`
+	Create    map[string]json.RawMessage            `json:"create"`
+	Update    map[string]map[string]json.RawMessage `json:"update"` // Patch objects.
+	Destroy   []string                              `json:"destroy"`
+}
+
+type setResponse struct {
+	AccountID    string              `json:"accountId"`
+	OldState     string              `json:"oldState"`
+	NewState     string              `json:"newState"`
+	Created      map[string]any      `json:"created"`
+	Updated      map[string]any      `json:"updated"`
+	Destroyed    []string            `json:"destroyed"`
+	NotCreated   map[string]setError `json:"notCreated"`
+	NotUpdated   map[string]setError `json:"notUpdated"`
+	NotDestroyed map[string]setError `json:"notDestroyed"`
+}
+
+// setError is the error for an object that could not be created, updated or
+// destroyed. ../rfc/8620 section 5.3
+type setError struct {
+	Type        string   `json:"type"`
+	Description string   `json:"description,omitempty"`
+	Properties  []string `json:"properties,omitempty"` // For invalidProperties.
+}
+
+func (e setError) Error() string {
+	return e.Type + ": " + e.Description
+}
+
+// xsetErrorf aborts processing of a single object in a /set method.
+func xsetErrorf(typ, format string, args ...any) {
+	panic(setError{Type: typ, Description: fmt.Sprintf(format, args...)})
+}
+
+// xinvalidProperty aborts processing of a single object in a /set method
+// because of an invalid property.
+func xinvalidProperty(prop, format string, args ...any) {
+	panic(setError{"invalidProperties", fmt.Sprintf(format, args...), []string{prop}})
+}
+
+// setObject calls fn for a single object in a /set method, returning the
+// setError fn panicked with, if any.
+func setObject(fn func()) (rerr *setError) {
+	defer func() {
+		x := recover()
+		if x == nil {
+			return
+		}
+		if err, ok := x.(setError); ok {
+			rerr = &err
+			return
+		}
+		panic(x)
+	}()
+	fn()
+	return nil
+}
+
+// setObjectWrite is like setObject, for objects written in the transaction
+// shared by all objects of a /set method. Writes of a single object cannot be
+// rolled back, so check validates the object without writing, and returns the
+// function doing the writes, which is only called if check did not fail with a
+// setError. A failing write aborts the method call, and its transaction.
+func setObjectWrite(check func() (write func())) *setError {
+	var write func()
+	if serr := setObject(func() { write = check() }); serr != nil {
+		return serr
+	}
+	defer func() {
+		x := recover()
+		if err, ok := x.(setError); ok {
+			panic(serverError{fmt.Errorf("writing object after checks: %w", err)})
+		} else if x != nil {
+			panic(x)
+		}
+	}()
+	write()
+	return nil
+}
+
+func newSetResponse(accountID, oldState string) setResponse {
+	return setResponse{
+		AccountID:    accountID,
+		OldState:     oldState,
+		Created:      map[string]any{},
+		Updated:      map[string]any{},
+		Destroyed:    []string{},
+		NotCreated:   map[string]setError{},
+		NotUpdated:   map[string]setError{},
+		NotDestroyed: map[string]setError{},
+	}
+}
+
+// Arguments of the standard /query method. ../rfc/8620 section 5.5
+type queryRequest struct {
+	AccountID      string          `json:"accountId"`
+	Filter         json.RawMessage `json:"filter"`
+	Sort           []comparator    `json:"sort"`
+	Position       int64           `json:"position"`
+	Anchor         *string         `json:"anchor"`
+	AnchorOffset   int64           `json:"anchorOffset"`
+	Limit          *int64          `json:"limit"`
+	CalculateTotal bool            `json:"calculateTotal"`
+}
+
+type comparator struct {
+	Property    string `json:"property"`
+	IsAscending *bool  `json:"isAscending"`
+	Collation   string `json:"collation"`
+	Keyword     string `json:"keyword"` // For Email/query. ../rfc/8621 section 4.4.2
+}
+
+type queryResponse struct {
+	AccountID           string   `json:"accountId"`
+	QueryState          string   `json:"queryState"`
+	CanCalculateChanges bool     `json:"canCalculateChanges"`
+	Position            int64    `json:"position"`
+	IDs                 []string `json:"ids"`
+	Total               *int64   `json:"total,omitempty"`
+	Limit               *int64   `json:"limit,omitempty"`
+}
+
+// Results from /query methods, without calculateTotal, have at most this many
+// ids.
+const queryLimit = 1000
+
+// xparseArgs parses the method arguments into v, failing with invalidArguments
+// for unknown arguments.
+func xparseArgs(args json.RawMessage, v any) {
+	dec := json.NewDecoder(bytes.NewReader(args))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		xmethodErrorf("invalidArguments", "parsing arguments: %v", err)
+	}
+}
+
+// xcheckAccount fails with accountNotFound if accountID is not the account of
+// the session. ../rfc/8620 section 3.6.2
+func (c *call) xcheckAccount(accountID string) {
+	if accountID != c.acc.Name {
+		xmethodErrorf("accountNotFound", "unknown account %q", accountID)
+	}
+}
+
+// xcheckIDs fails with requestTooLarge if ids has more than max elements.
+func xcheckIDs(n, max int) {
+	if n > max {
+		xmethodErrorf("requestTooLarge", "too many objects, maximum %d", max)
+	}
+}
+
+// xpage returns the window of ids for a query by position, anchor and limit.
+// ../rfc/8620 section 5.5
+func xpage(req queryRequest, ids []string) (int64, []string) {
+	if req.Limit != nil && *req.Limit < 0 {
+		xmethodErrorf("invalidArguments", "negative limit")
+	}
+	limit := int64(queryLimit)
+	if req.Limit != nil && *req.Limit < limit {
+		limit = *req.Limit
+	}
+	n := int64(len(ids))
+	pos := req.Position
+	if req.Anchor != nil {
+		pos = -1
+		for i, id := range ids {
+			if id == *req.Anchor {
+				pos = int64(i)
+				break
+			}
+		}
+		if pos < 0 {
+			xmethodErrorf("anchorNotFound", "anchor not in results")
+		}
+		pos += req.AnchorOffset
+		if pos < 0 {
+			pos = 0
+		}
+	} else if pos < 0 {
+		pos += n
+		if pos < 0 {
+			pos = 0
+		}
+	}
+	if pos > n {
+		pos = n
+	}
+	end := pos + limit
+	if end > n {
+		end = n
+	}
+	return pos, ids[pos:end]
+}
+
+// objectID parses an ID of the form prefix followed by a positive number, as
+// used for mailboxes ("F"), emails ("E"), threads ("T").
+func objectID(prefix, s string) (int64, bool) {
+	if !strings.HasPrefix(s, prefix) {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(s[len(prefix):], 10, 64)
+	if err != nil || id <= 0 || s[len(prefix):] != fmt.Sprintf("%d", id) {
+		return 0, false
+	}
+	return id, true
+}
+
+// resolveID returns the ID for a creation ID reference "#" followed by the
+// creation ID of an object created earlier in the request, and id otherwise.
+// ../rfc/8620 section 5.3
+func (c *call) resolveID(id string) string {
+	if strings.HasPrefix(id, "#") {
+		return c.createdIDs[id[1:]]
+	}
+	return id
+}
+
+// emailObjectID returns the JMAP Email ID of a message. Unlike the IMAP EMAILID,
+// copies of a message in multiple mailboxes are separate emails.
+func emailObjectID(m store.Message) string {
+	return fmt.Sprintf("E%d", m.ID)
+}
+
+// threadNum returns the number in the thread ID of m.
+func threadNum(m store.Message) int64 {
+	n, _ := objectID("T", m.ThreadObjectID())
+	return n
+}
+
+// hashState returns a state string for objects without modification sequence,
+// based on a hash of their JSON representation.
+func hashState(v any) string {
+	buf, err := json.Marshal(v)
+	xcheckf(err, "marshal for state")
+	h := sha256.Sum256(buf)
+	return base64.RawURLEncoding.EncodeToString(h[:12])
+}
+
+// emailState is the state of emails and threads, see xemailState.
+type emailState struct {
+	ModSeq store.ModSeq // Highest modseq of the account.
+	MaxID  int64        // Highest message ID.
+}
+
+func (es emailState) String() string {
+	return fmt.Sprintf("%d-%d", es.ModSeq, es.MaxID)
+}
+
+// xemailState returns the current state of emails and threads. Messages with a
+// higher modseq have changed, messages with a higher ID are newly created.
+// Message IDs are never reused.
+func xemailState(tx *bstore.Tx, acc *store.Account) emailState {
+	modseq, err := acc.HighestModSeq(tx)
+	xcheckf(err, "get highest modseq")
+	var maxID int64
+	m, err := bstore.QueryTx[store.Message](tx).SortDesc("ID").Limit(1).Get()
+	if err == nil {
+		maxID = m.ID
+	} else if err != bstore.ErrAbsent {
+		xcheckf(err, "get highest message id")
+	}
+	return emailState{modseq, maxID}
+}
+
+// xparseEmailState parses a state from a client for a /changes method.
+func xparseEmailState(s string, cur emailState) emailState {
+	t := strings.Split(s, "-")
+	if len(t) == 2 {
+		modseq, err0 := strconv.ParseInt(t[0], 10, 64)
+		maxID, err1 := strconv.ParseInt(t[1], 10, 64)
+		es := emailState{store.ModSeq(modseq), maxID}
+		if err0 == nil && err1 == nil && es.String() == s && es.ModSeq <= cur.ModSeq && es.MaxID <= cur.MaxID {
+			return es
+		}
+	}
+	xmethodErrorf("cannotCalculateChanges", "unknown state %q", s)
+	panic("not reached")
+}
+
+// modseqOf returns the modseq of a message, with messages from before modseqs
+// were tracked treated as modified at the start.
+func modseqOf(m store.Message) store.ModSeq {
+	if m.ModSeq == 0 {
+		return 1
+	}
+	return m.ModSeq
+}
+
+// Kinds of changes in a /changes response.
+const (
+	changeCreated = iota
+	changeUpdated
+	changeDestroyed
+)
+
+// changeSet gathers created/updated/destroyed object IDs with the modseq of
+// their last change, for limiting the number of changes returned in a /changes
+// response.
+type changeSet struct {
+	since emailState
+	kinds map[string]int          // Object ID to change kind.
+	seqs  map[string]store.ModSeq // Object ID to modseq of last change.
+	nums  map[string]int64        // Object ID to its number, for created objects.
+}
+
+func newChangeSet(since emailState) *changeSet {
+	return &changeSet{since, map[string]int{}, map[string]store.ModSeq{}, map[string]int64{}}
+}
+
+// add records the last change of object id at modseq. Objects with a number
+// higher than the highest message ID of the state were created since. Must be
+// called once per object.
+func (cs *changeSet) add(id string, num int64, modseq store.ModSeq, destroyed bool) {
+	switch {
+	case num > cs.since.MaxID && destroyed:
+		// Created and destroyed since the state, the client never saw it.
+		return
+	case num > cs.since.MaxID:
+		cs.kinds[id] = changeCreated
+		cs.nums[id] = num
+	case destroyed:
+		cs.kinds[id] = changeDestroyed
+	default:
+		cs.kinds[id] = changeUpdated
+	}
+	cs.seqs[id] = modseq
+}
+
+// xresponse returns the changes response, with at most maxChanges changes, for
+// the current state.
+func (cs *changeSet) xresponse(c *call, req changesRequest, cur emailState) changesResponse {
+	ids := make([]string, 0, len(cs.kinds))
+	for id := range cs.kinds {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if cs.seqs[ids[i]] != cs.seqs[ids[j]] {
+			return cs.seqs[ids[i]] < cs.seqs[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+
+	newState := cur
+	var more bool
+	if req.MaxChanges != nil && int64(len(ids)) > *req.MaxChanges {
+		if *req.MaxChanges <= 0 {
+			xmethodErrorf("invalidArguments", "maxChanges must be positive")
+		}
+		// Cut at a modseq boundary, so the next call starts at a consistent state.
+		n := int(*req.MaxChanges)
+		for n > 0 && cs.seqs[ids[n-1]] == cs.seqs[ids[n]] {
+			n--
+		}
+		if n == 0 {
+			xmethodErrorf("cannotCalculateChanges", "too many changes for a single modification, maxChanges too low")
+		}
+		newState = emailState{cs.seqs[ids[n-1]], cs.since.MaxID}
+		ids = ids[:n]
+		more = true
+		for _, id := range ids {
+			if cs.nums[id] > newState.MaxID {
+				newState.MaxID = cs.nums[id]
+			}
+		}
+	}
+
+	resp := changesResponse{
+		AccountID:      c.acc.Name,
+		OldState:       req.SinceState,
+		NewState:       newState.String(),
+		HasMoreChanges: more,
+		Created:        []string{},
+		Updated:        []string{},
+		Destroyed:      []string{},
+	}
+	for _, id := range ids {
+		switch cs.kinds[id] {
+		case changeCreated:
+			resp.Created = append(resp.Created, id)
+		case changeUpdated:
+			resp.Updated = append(resp.Updated, id)
+		case changeDestroyed:
+			resp.Destroyed = append(resp.Destroyed, id)
+		}
+	}
+	return resp
+}
+
+// Keywords for message flags. ../rfc/8621 section 4.1.1
+var flagKeywords = []struct {
+	keyword string
+	flag    func(f *store.Flags) *bool
+}{
+	{"$seen", func(f *store.Flags) *bool { return &f.Seen }},
+	{"$answered", func(f *store.Flags) *bool { return &f.Answered }},
+	{"$flagged", func(f *store.Flags) *bool { return &f.Flagged }},
+	{"$forwarded", func(f *store.Flags) *bool { return &f.Forwarded }},
+	{"$junk", func(f *store.Flags) *bool { return &f.Junk }},
+	{"$notjunk", func(f *store.Flags) *bool { return &f.Notjunk }},
+	{"$draft", func(f *store.Flags) *bool { return &f.Draft }},
+	{"$phishing", func(f *store.Flags) *bool { return &f.Phishing }},
+	{"$mdnsent", func(f *store.Flags) *bool { return &f.MDNSent }},
+}
+
+// messageKeywords returns the JMAP keywords for the flags and keywords of m.
+func messageKeywords(m store.Message) map[string]bool {
+	kw := map[string]bool{}
+	f := m.Flags
+	for _, fk := range flagKeywords {
+		if *fk.flag(&f) {
+			kw[fk.keyword] = true
+		}
+	}
+	for _, k := range m.Keywords {
+		kw[k] = true
+	}
+	return kw
+}
+
+// hasKeyword returns whether m has the JMAP keyword kw, in lower case.
+func hasKeyword(m store.Message, kw string) bool {
+	f := m.Flags
+	for _, fk := range flagKeywords {
+		if fk.keyword == kw {
+			return *fk.flag(&f)
+		}
+	}
+	for _, k := range m.Keywords {
+		if k == kw {
+			return true
+		}
+	}
+	return false
+}
+
+// xsetKeyword sets or clears keyword kw, in lower case, on the flags and
+// keywords of m.
+func xsetKeyword(m *store.Message, kw string, set bool) {
+	for _, fk := range flagKeywords {
+		if fk.keyword == kw {
+			*fk.flag(&m.Flags) = set
+			return
+		}
+	}
+	if !store.ValidLowercaseKeyword(kw) {
+		xinvalidProperty("keywords", "invalid keyword %q", kw)
+	}
+	if set {
+		m.Keywords, _ = store.MergeKeywords(m.Keywords, []string{kw})
+	} else {
+		m.Keywords = store.RemoveKeywords(m.Keywords, []string{kw})
+	}
+}
+
+// broadcast sends changes to other sessions of the account, e.g. IMAP.
+func (c *call) broadcast(changes []store.Change) {
+	if len(changes) == 0 {
+		return
+	}
+	comm := store.RegisterComm(c.acc)
+	defer comm.Unregister()
+	comm.Broadcast(changes)
+}
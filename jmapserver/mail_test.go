@@ -0,0 +1,230 @@
+package jmapserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mjl-/mox/queue"
+	"github.com/mjl-/mox/store"
+)
+
+const usingMail = `["urn:ietf:params:jmap:core", "urn:ietf:params:jmap:mail", "urn:ietf:params:jmap:submission"]`
+
+// mailCalls executes method calls, and returns the arguments of the responses,
+// which must not be errors.
+func mailCalls(t *testing.T, calls string) []map[string]any {
+	t.Helper()
+	var resp response
+	xjson(t, do(t, "POST", "/jmap/api", "application/json", fmt.Sprintf(`{"using": %s, "methodCalls": [%s]}`, usingMail, calls), true), http.StatusOK, &resp)
+	var l []map[string]any
+	for _, inv := range resp.MethodResponses {
+		if inv.Name == "error" {
+			t.Fatalf("method call %s: error %s", inv.CallID, inv.Args)
+		}
+		var m map[string]any
+		err := json.Unmarshal(inv.Args, &m)
+		tcheck(t, err, "parsing response arguments")
+		l = append(l, m)
+	}
+	return l
+}
+
+// mailError executes a single method call, that must fail with an error of typ.
+func mailError(t *testing.T, call, typ string) {
+	t.Helper()
+	var resp response
+	xjson(t, do(t, "POST", "/jmap/api", "application/json", fmt.Sprintf(`{"using": %s, "methodCalls": [%s]}`, usingMail, call), true), http.StatusOK, &resp)
+	if r := resp.MethodResponses[0]; r.Name != "error" || !strings.Contains(string(r.Args), `"`+typ+`"`) {
+		t.Fatalf("got %s %s, expected error %s", r.Name, r.Args, typ)
+	}
+}
+
+// list returns the list of a /get response, with ids of a /query or /changes
+// response as strings.
+func list(m map[string]any, key string) []any {
+	l, _ := m[key].([]any)
+	return l
+}
+
+func TestMail(t *testing.T) {
+	defer setup(t)()
+	err := queue.Init()
+	tcheck(t, err, "queue init")
+	defer queue.Shutdown()
+
+	var sr sessionResource
+	xjson(t, do(t, "GET", "/jmap/session", "", "", true), http.StatusOK, &sr)
+	if sr.PrimaryAccounts[capMail] != "mjl" || sr.Accounts["mjl"].AccountCapabilities[capSubmission] == nil {
+		t.Fatalf("missing mail capabilities in session %#v", sr)
+	}
+
+	// Mailboxes.
+	r := mailCalls(t, `["Mailbox/get", {"accountId": "mjl", "ids": null}, "c0"], ["Mailbox/query", {"accountId": "mjl", "filter": {"role": "inbox"}}, "c1"]`)
+	var inboxID string
+	for _, e := range list(r[0], "list") {
+		mb := e.(map[string]any)
+		if mb["name"] == "Inbox" {
+			inboxID = mb["id"].(string)
+			if mb["role"] != "inbox" {
+				t.Fatalf("inbox has role %v", mb["role"])
+			}
+		}
+	}
+	if ids := list(r[1], "ids"); inboxID == "" || len(ids) != 1 || ids[0] != inboxID {
+		t.Fatalf("got query ids %v, inbox %q", ids, inboxID)
+	}
+	mbState := r[0]["state"].(string)
+
+	r = mailCalls(t, `["Mailbox/set", {"accountId": "mjl", "create": {"t": {"name": "Test"}, "u": {"name": "Sub", "parentId": "#t"}, "bad": {"name": "a/b"}}}, "c0"], ["Mailbox/get", {"accountId": "mjl", "ids": ["#u"], "properties": ["name", "parentId"]}, "c1"]`)
+	created := r[0]["created"].(map[string]any)
+	testID := created["t"].(map[string]any)["id"].(string)
+	if _, ok := r[0]["notCreated"].(map[string]any)["bad"]; !ok || len(created) != 2 {
+		t.Fatalf("unexpected mailbox set response %v", r[0])
+	}
+	if l := list(r[1], "list"); len(l) != 1 || l[0].(map[string]any)["parentId"] != testID || l[0].(map[string]any)["name"] != "Sub" {
+		t.Fatalf("unexpected mailbox get response %v", r[1])
+	}
+	mailError(t, fmt.Sprintf(`["Mailbox/changes", {"accountId": "mjl", "sinceState": %q}, "c0"]`, mbState), "cannotCalculateChanges")
+
+	// Emails.
+	r = mailCalls(t, `["Email/get", {"accountId": "mjl", "ids": []}, "c0"]`)
+	emailState := r[0]["state"].(string)
+
+	r = mailCalls(t, fmt.Sprintf(`["Email/set", {"accountId": "mjl", "create": {"e": {"mailboxIds": {%q: true}, "keywords": {"$draft": true}, "from": [{"name": "Mjl", "email": "mjl@mox.example"}], "to": [{"email": "remote@example.org"}], "subject": "hello ümlaut", "textBody": [{"partId": "1", "type": "text/plain"}], "bodyValues": {"1": {"value": "hi there\nline two"}}}, "bad": {"mailboxIds": {}}}}, "c0"], ["Email/get", {"accountId": "mjl", "ids": ["#e"], "properties": ["subject", "from", "to", "keywords", "mailboxIds", "threadId", "preview", "bodyValues", "textBody"], "fetchTextBodyValues": true}, "c1"]`, testID))
+	emailID := r[0]["created"].(map[string]any)["e"].(map[string]any)["id"].(string)
+	if _, ok := r[0]["notCreated"].(map[string]any)["bad"]; !ok {
+		t.Fatalf("email without mailbox was created")
+	}
+	e := list(r[1], "list")[0].(map[string]any)
+	if e["subject"] != "hello ümlaut" || e["preview"] != "hi there line two" || !e["keywords"].(map[string]any)["$draft"].(bool) || !e["mailboxIds"].(map[string]any)[testID].(bool) {
+		t.Fatalf("unexpected email %v", e)
+	}
+	if from := e["from"].([]any)[0].(map[string]any); from["name"] != "Mjl" || from["email"] != "mjl@mox.example" {
+		t.Fatalf("unexpected from %v", from)
+	}
+	if v := e["bodyValues"].(map[string]any)["1"].(map[string]any); v["value"] != "hi there\nline two" {
+		t.Fatalf("unexpected body value %v", v)
+	}
+	threadID := e["threadId"].(string)
+
+	r = mailCalls(t, `["Email/query", {"accountId": "mjl", "filter": {"text": "line two"}, "calculateTotal": true}, "c0"], ["Email/query", {"accountId": "mjl", "filter": {"operator": "NOT", "conditions": [{"hasKeyword": "$draft"}]}}, "c1"], ["Thread/get", {"accountId": "mjl", "ids": [`+fmt.Sprintf("%q", threadID)+`]}, "c2"], ["SearchSnippet/get", {"accountId": "mjl", "filter": {"text": "hello"}, "emailIds": [`+fmt.Sprintf("%q", emailID)+`]}, "c3"]`)
+	if ids := list(r[0], "ids"); len(ids) != 1 || ids[0] != emailID || r[0]["total"] != 1.0 {
+		t.Fatalf("unexpected query response %v", r[0])
+	}
+	if ids := list(r[1], "ids"); len(ids) != 0 {
+		t.Fatalf("unexpected query response %v", r[1])
+	}
+	if th := list(r[2], "list")[0].(map[string]any); len(th["emailIds"].([]any)) != 1 {
+		t.Fatalf("unexpected thread %v", th)
+	}
+	if sn := list(r[3], "list")[0].(map[string]any); sn["subject"] != "<mark>hello</mark> ümlaut" {
+		t.Fatalf("unexpected search snippet %v", sn)
+	}
+
+	r = mailCalls(t, fmt.Sprintf(`["Email/changes", {"accountId": "mjl", "sinceState": %q}, "c0"]`, emailState))
+	if l := list(r[0], "created"); len(l) != 1 || l[0] != emailID {
+		t.Fatalf("unexpected changes %v", r[0])
+	}
+	emailState = r[0]["newState"].(string)
+	mailError(t, fmt.Sprintf(`["Email/set", {"accountId": "mjl", "ifInState": "1-1", "update": {%q: {"keywords/$seen": true}}}, "c0"]`, emailID), "stateMismatch")
+
+	// Identities and submission, with the email moved to the inbox and its draft
+	// keyword cleared on success.
+	r = mailCalls(t, `["Identity/get", {"accountId": "mjl", "ids": null}, "c0"]`)
+	idl := list(r[0], "list")
+	if len(idl) != 1 || idl[0].(map[string]any)["email"] != "mjl@mox.example" {
+		t.Fatalf("unexpected identities %v", idl)
+	}
+	identityID := idl[0].(map[string]any)["id"].(string)
+
+	var resp response
+	body := fmt.Sprintf(`{"using": %s, "methodCalls": [["EmailSubmission/set", {"accountId": "mjl", "create": {"s": {"identityId": %q, "emailId": %q}}, "onSuccessUpdateEmail": {"#s": {"keywords/$draft": null, "mailboxIds": {%q: true}}}}, "c0"]]}`, usingMail, identityID, emailID, inboxID)
+	xjson(t, do(t, "POST", "/jmap/api", "application/json", body, true), http.StatusOK, &resp)
+	if len(resp.MethodResponses) != 2 || resp.MethodResponses[0].Name != "EmailSubmission/set" || resp.MethodResponses[1].Name != "Email/set" || resp.MethodResponses[1].CallID != "c0" {
+		t.Fatalf("unexpected responses for submission %v", resp.MethodResponses)
+	}
+	var sresp setResponse
+	err = json.Unmarshal(resp.MethodResponses[0].Args, &sresp)
+	tcheck(t, err, "parse submission response")
+	submissionID := sresp.Created["s"].(map[string]any)["id"].(string)
+
+	qmsgs, err := queue.List(ctxbg)
+	tcheck(t, err, "list queue")
+	if len(qmsgs) != 1 || qmsgs[0].Recipient().XString(true) != "remote@example.org" || qmsgs[0].SenderAccount != "mjl" {
+		t.Fatalf("unexpected queue %v", qmsgs)
+	}
+
+	r = mailCalls(t, fmt.Sprintf(`["EmailSubmission/get", {"accountId": "mjl", "ids": null}, "c0"], ["EmailSubmission/query", {"accountId": "mjl", "filter": {"emailIds": [%q]}}, "c1"], ["Email/get", {"accountId": "mjl", "ids": [%q], "properties": ["keywords", "mailboxIds"]}, "c2"], ["Email/changes", {"accountId": "mjl", "sinceState": %q}, "c3"]`, emailID, emailID, emailState))
+	sub := list(r[0], "list")[0].(map[string]any)
+	if sub["id"] != submissionID || sub["emailId"] != emailID || sub["identityId"] != identityID || sub["undoStatus"] != "pending" {
+		t.Fatalf("unexpected submission %v", sub)
+	}
+	if ids := list(r[1], "ids"); len(ids) != 1 || ids[0] != submissionID {
+		t.Fatalf("unexpected submission query %v", r[1])
+	}
+	e = list(r[2], "list")[0].(map[string]any)
+	if len(e["keywords"].(map[string]any)) != 0 || !e["mailboxIds"].(map[string]any)[inboxID].(bool) {
+		t.Fatalf("email not updated after submission %v", e)
+	}
+	if l := list(r[3], "updated"); len(l) != 1 || l[0] != emailID {
+		t.Fatalf("unexpected changes %v", r[3])
+	}
+
+	// Cancel the submission, removing it from the queue.
+	r = mailCalls(t, fmt.Sprintf(`["EmailSubmission/set", {"accountId": "mjl", "update": {%q: {"undoStatus": "canceled"}}}, "c0"], ["EmailSubmission/get", {"accountId": "mjl", "ids": null}, "c1"]`, submissionID))
+	if _, ok := r[0]["updated"].(map[string]any)[submissionID]; !ok || len(list(r[1], "list")) != 0 {
+		t.Fatalf("unexpected responses for cancel %v", r)
+	}
+
+	// Submission without envelope, recipients come from the To, Cc and Bcc headers.
+	r = mailCalls(t, fmt.Sprintf(`["Email/set", {"accountId": "mjl", "create": {"e": {"mailboxIds": {%q: true}, "from": [{"email": "mjl@mox.example"}], "to": [{"email": "remote@example.org"}], "bcc": [{"email": "hidden@example.org"}], "subject": "x", "textBody": [{"partId": "1", "type": "text/plain"}], "bodyValues": {"1": {"value": "x"}}}}}, "c0"], ["EmailSubmission/set", {"accountId": "mjl", "create": {"s": {"identityId": %q, "emailId": "#e"}}}, "c1"]`, testID, identityID))
+	bccSubmissionID := r[1]["created"].(map[string]any)["s"].(map[string]any)["id"].(string)
+	qmsgs, err = queue.List(ctxbg)
+	tcheck(t, err, "list queue")
+	rcpts := map[string]bool{}
+	for _, qm := range qmsgs {
+		rcpts[qm.Recipient().XString(true)] = true
+	}
+	if len(qmsgs) != 2 || !rcpts["remote@example.org"] || !rcpts["hidden@example.org"] {
+		t.Fatalf("unexpected queue for submission with bcc %v", qmsgs)
+	}
+	mailCalls(t, fmt.Sprintf(`["EmailSubmission/set", {"accountId": "mjl", "update": {%q: {"undoStatus": "canceled"}}}, "c0"]`, bccSubmissionID))
+
+	// Submission with a From address the account cannot use.
+	r = mailCalls(t, fmt.Sprintf(`["Email/set", {"accountId": "mjl", "create": {"e": {"mailboxIds": {%q: true}, "from": [{"email": "other@example.org"}], "to": [{"email": "remote@example.org"}], "subject": "x", "textBody": [{"partId": "1", "type": "text/plain"}], "bodyValues": {"1": {"value": "x"}}}}}, "c0"], ["EmailSubmission/set", {"accountId": "mjl", "create": {"s": {"identityId": %q, "emailId": "#e"}}}, "c1"]`, testID, identityID))
+	if serr := r[1]["notCreated"].(map[string]any)["s"].(map[string]any); serr["type"] != "forbiddenFrom" {
+		t.Fatalf("unexpected error for submission with bad from %v", serr)
+	}
+
+	// Destroy an email. Its file is removed after the transaction is committed.
+	acc, err := store.OpenAccount("mjl")
+	tcheck(t, err, "open account")
+	defer acc.Close()
+	msgID, _ := objectID("E", emailID)
+	msgPath := acc.MessagePath(msgID)
+	if _, err := os.Stat(msgPath); err != nil {
+		t.Fatalf("message file of email to destroy: %v", err)
+	}
+	r = mailCalls(t, fmt.Sprintf(`["Email/set", {"accountId": "mjl", "destroy": [%q, "E999"]}, "c0"], ["Email/changes", {"accountId": "mjl", "sinceState": %q}, "c1"], ["Thread/get", {"accountId": "mjl", "ids": [%q]}, "c2"]`, emailID, emailState, threadID))
+	if l := list(r[0], "destroyed"); len(l) != 1 || l[0] != emailID {
+		t.Fatalf("unexpected destroy response %v", r[0])
+	}
+	if _, ok := r[0]["notDestroyed"].(map[string]any)["E999"]; !ok {
+		t.Fatalf("unknown email was destroyed")
+	}
+	if l := list(r[1], "destroyed"); len(l) != 1 || l[0] != emailID {
+		t.Fatalf("unexpected changes after destroy %v", r[1])
+	}
+	if l := list(r[2], "notFound"); len(l) != 1 {
+		t.Fatalf("thread of destroyed email still found %v", r[2])
+	}
+	if _, err := os.Stat(msgPath); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("message file of destroyed email still present: %v", err)
+	}
+}
@@ -0,0 +1,784 @@
+package jmapserver
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/store"
+)
+
+// Mailbox object. ../rfc/8621 section 2
+type mailbox struct {
+	ID            string         `json:"id"`
+	Name          string         `json:"name"`
+	ParentID      *string        `json:"parentId"`
+	Role          *string        `json:"role"`
+	SortOrder     int            `json:"sortOrder"`
+	TotalEmails   int64          `json:"totalEmails"`
+	UnreadEmails  int64          `json:"unreadEmails"`
+	TotalThreads  int64          `json:"totalThreads"`
+	UnreadThreads int64          `json:"unreadThreads"`
+	MyRights      mailboxRights  `json:"myRights"`
+	IsSubscribed  bool           `json:"isSubscribed"`
+	mb            *store.Mailbox // Not in JSON.
+}
+
+// ../rfc/8621 section 2
+type mailboxRights struct {
+	MayReadItems   bool `json:"mayReadItems"`
+	MayAddItems    bool `json:"mayAddItems"`
+	MayRemoveItems bool `json:"mayRemoveItems"`
+	MaySetSeen     bool `json:"maySetSeen"`
+	MaySetKeywords bool `json:"maySetKeywords"`
+	MayCreateChild bool `json:"mayCreateChild"`
+	MayRename      bool `json:"mayRename"`
+	MayDelete      bool `json:"mayDelete"`
+	MaySubmit      bool `json:"maySubmit"`
+}
+
+// mailboxRole returns the JMAP role for a mailbox, from its special-use.
+// ../rfc/8621 section 2 ../rfc/8457
+func mailboxRole(mb store.Mailbox) *string {
+	var role string
+	switch {
+	case mb.Name == "Inbox":
+		role = "inbox"
+	case mb.Archive:
+		role = "archive"
+	case mb.Draft:
+		role = "drafts"
+	case mb.Junk:
+		role = "junk"
+	case mb.Sent:
+		role = "sent"
+	case mb.Trash:
+		role = "trash"
+	default:
+		return nil
+	}
+	return &role
+}
+
+// mailboxes holds all mailboxes of an account, for resolving parents.
+type mailboxes struct {
+	byName map[string]*store.Mailbox
+	byID   map[int64]*store.Mailbox
+}
+
+func xmailboxes(tx *bstore.Tx) mailboxes {
+	l, err := bstore.QueryTx[store.Mailbox](tx).List()
+	xcheckf(err, "listing mailboxes")
+	mbs := mailboxes{map[string]*store.Mailbox{}, map[int64]*store.Mailbox{}}
+	for i := range l {
+		mbs.byName[l[i].Name] = &l[i]
+		mbs.byID[l[i].ID] = &l[i]
+	}
+	return mbs
+}
+
+// xmailboxID returns the mailbox for a JMAP mailbox id, which can be the creation
+// id of a mailbox created earlier in the request. Nil is returned for an unknown
+// mailbox.
+func (c *call) xmailboxID(mbs mailboxes, id string) *store.Mailbox {
+	id = c.resolveID(id)
+	if n, ok := objectID("F", id); ok {
+		return mbs.byID[n]
+	}
+	return nil
+}
+
+// parent returns the parent mailbox of mb, the mailbox with the longest name
+// prefix. Parents are normally present, but may be absent for mailboxes created
+// by older versions.
+func (mbs mailboxes) parent(mb store.Mailbox) *store.Mailbox {
+	name := mb.Name
+	for {
+		i := strings.LastIndex(name, "/")
+		if i < 0 {
+			return nil
+		}
+		name = name[:i]
+		if p, ok := mbs.byName[name]; ok {
+			return p
+		}
+	}
+}
+
+// hasChild returns whether mb has child mailboxes.
+func (mbs mailboxes) hasChild(mb store.Mailbox) bool {
+	for name := range mbs.byName {
+		if strings.HasPrefix(name, mb.Name+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// xmailboxState returns the state for mailboxes. Mailboxes do not have a
+// modseq, so the state is a hash of the mailboxes with their counts and
+// subscriptions, and changes cannot be calculated.
+func xmailboxState(tx *bstore.Tx) string {
+	type state struct {
+		Mailbox    store.Mailbox
+		Counts     store.MailboxCounts
+		Subscribed bool
+	}
+	var l []state
+	err := bstore.QueryTx[store.Mailbox](tx).SortAsc("ID").ForEach(func(mb store.Mailbox) error {
+		mc, err := store.MailboxCountsGet(tx, mb.ID)
+		if err != nil {
+			return err
+		}
+		subscribed := tx.Get(&store.Subscription{Name: mb.Name}) == nil
+		l = append(l, state{mb, mc, subscribed})
+		return nil
+	})
+	xcheckf(err, "listing mailboxes for state")
+	return hashState(l)
+}
+
+// xmailboxObjects returns the JMAP mailbox objects for all mailboxes, with
+// thread counts if threads is set.
+func (c *call) xmailboxObjects(tx *bstore.Tx, mbs mailboxes, threads bool) []mailbox {
+	// Thread counts are calculated by going through all messages.
+	total := map[int64]map[int64]bool{}  // Mailbox ID to thread numbers.
+	unread := map[int64]map[int64]bool{} // Mailbox ID to thread numbers with unread messages.
+	if threads {
+		err := bstore.QueryTx[store.Message](tx).ForEach(func(m store.Message) error {
+			t := threadNum(m)
+			if total[m.MailboxID] == nil {
+				total[m.MailboxID] = map[int64]bool{}
+				unread[m.MailboxID] = map[int64]bool{}
+			}
+			total[m.MailboxID][t] = true
+			if !m.Seen {
+				unread[m.MailboxID][t] = true
+			}
+			return nil
+		})
+		xcheckf(err, "listing messages for thread counts")
+	}
+
+	var l []mailbox
+	for _, mb := range mbs.byID {
+		mc, err := store.MailboxCountsGet(tx, mb.ID)
+		xcheckf(err, "get mailbox counts")
+		var parentID *string
+		name := mb.Name
+		if p := mbs.parent(*mb); p != nil {
+			id := p.ObjectID()
+			parentID = &id
+			name = mb.Name[len(p.Name)+1:]
+		}
+		isInbox := mb.Name == "Inbox"
+		l = append(l, mailbox{
+			ID:            mb.ObjectID(),
+			Name:          name,
+			ParentID:      parentID,
+			Role:          mailboxRole(*mb),
+			TotalEmails:   mc.Messages,
+			UnreadEmails:  mc.Unseen,
+			TotalThreads:  int64(len(total[mb.ID])),
+			UnreadThreads: int64(len(unread[mb.ID])),
+			MyRights:      mailboxRights{true, true, true, true, true, true, !isInbox, !isInbox, true},
+			IsSubscribed:  tx.Get(&store.Subscription{Name: mb.Name}) == nil,
+			mb:            mb,
+		})
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].mb.Name < l[j].mb.Name
+	})
+	return l
+}
+
+// objectProperties returns v as JSON object with only the requested
+// properties, and always the id. With nil properties, all properties are
+// returned.
+func objectProperties(v any, properties []string) any {
+	if properties == nil {
+		return v
+	}
+	buf, err := json.Marshal(v)
+	xcheckf(err, "marshal object")
+	var all map[string]json.RawMessage
+	err = json.Unmarshal(buf, &all)
+	xcheckf(err, "unmarshal object")
+	r := map[string]json.RawMessage{"id": all["id"]}
+	for _, p := range properties {
+		v, ok := all[p]
+		if !ok {
+			xmethodErrorf("invalidArguments", "unknown property %q", p)
+		}
+		r[p] = v
+	}
+	return r
+}
+
+// mailboxGet returns mailboxes. ../rfc/8621 section 2.1
+func (c *call) mailboxGet(args json.RawMessage) any {
+	var req getRequest
+	xparseArgs(args, &req)
+	c.xcheckAccount(req.AccountID)
+	xcheckIDs(len(req.IDs), maxObjectsInGet)
+
+	resp := getResponse{AccountID: req.AccountID, List: []any{}, NotFound: []string{}}
+	c.xdbread(func(tx *bstore.Tx) {
+		resp.State = xmailboxState(tx)
+		mbs := xmailboxes(tx)
+		threads := req.Properties == nil
+		for _, p := range req.Properties {
+			threads = threads || p == "totalThreads" || p == "unreadThreads"
+		}
+		objs := c.xmailboxObjects(tx, mbs, threads)
+		if req.IDs == nil {
+			for _, o := range objs {
+				resp.List = append(resp.List, objectProperties(o, req.Properties))
+			}
+			return
+		}
+		byID := map[string]mailbox{}
+		for _, o := range objs {
+			byID[o.ID] = o
+		}
+		for _, id := range req.IDs {
+			if o, ok := byID[c.resolveID(id)]; ok {
+				resp.List = append(resp.List, objectProperties(o, req.Properties))
+			} else {
+				resp.NotFound = append(resp.NotFound, id)
+			}
+		}
+	})
+	return resp
+}
+
+// mailboxChanges only returns no changes if the state is current. Otherwise
+// the client must fetch all mailboxes again. ../rfc/8621 section 2.2
+func (c *call) mailboxChanges(args json.RawMessage) any {
+	var req changesRequest
+	xparseArgs(args, &req)
+	c.xcheckAccount(req.AccountID)
+
+	var state string
+	c.xdbread(func(tx *bstore.Tx) {
+		state = xmailboxState(tx)
+	})
+	if req.SinceState != state {
+		xmethodErrorf("cannotCalculateChanges", "mailbox changes are not tracked, fetch all mailboxes")
+	}
+	return struct {
+		changesResponse
+		UpdatedProperties []string `json:"updatedProperties"`
+	}{changesResponse{req.AccountID, state, state, false, []string{}, []string{}, []string{}}, nil}
+}
+
+// Filter condition for Mailbox/query. ../rfc/8621 section 2.3
+type mailboxFilter struct {
+	Operator     string           `json:"operator"`
+	Conditions   []mailboxFilter  `json:"conditions"`
+	ParentID     *json.RawMessage `json:"parentId"`
+	Name         *string          `json:"name"`
+	Role         *json.RawMessage `json:"role"`
+	HasAnyRole   *bool            `json:"hasAnyRole"`
+	IsSubscribed *bool            `json:"isSubscribed"`
+}
+
+func (f mailboxFilter) match(o mailbox) bool {
+	switch f.Operator {
+	case "AND":
+		for _, ff := range f.Conditions {
+			if !ff.match(o) {
+				return false
+			}
+		}
+		return true
+	case "OR":
+		for _, ff := range f.Conditions {
+			if ff.match(o) {
+				return true
+			}
+		}
+		return false
+	case "NOT":
+		for _, ff := range f.Conditions {
+			if ff.match(o) {
+				return false
+			}
+		}
+		return true
+	case "":
+	default:
+		xmethodErrorf("unsupportedFilter", "unknown filter operator %q", f.Operator)
+	}
+
+	// Null values match mailboxes without parent or role.
+	nullableMatch := func(raw *json.RawMessage, v *string) bool {
+		var s *string
+		if err := json.Unmarshal(*raw, &s); err != nil {
+			xmethodErrorf("unsupportedFilter", "parsing filter value: %v", err)
+		}
+		return s == nil && v == nil || s != nil && v != nil && *s == *v
+	}
+	if f.ParentID != nil && !nullableMatch(f.ParentID, o.ParentID) {
+		return false
+	}
+	if f.Name != nil && !strings.Contains(strings.ToLower(o.Name), strings.ToLower(*f.Name)) {
+		return false
+	}
+	if f.Role != nil && !nullableMatch(f.Role, o.Role) {
+		return false
+	}
+	if f.HasAnyRole != nil && *f.HasAnyRole != (o.Role != nil) {
+		return false
+	}
+	if f.IsSubscribed != nil && *f.IsSubscribed != o.IsSubscribed {
+		return false
+	}
+	return true
+}
+
+// mailboxQuery returns mailbox ids matching a filter. ../rfc/8621 section 2.3
+func (c *call) mailboxQuery(args json.RawMessage) any {
+	var req struct {
+		queryRequest
+		SortAsTree   bool `json:"sortAsTree"`
+		FilterAsTree bool `json:"filterAsTree"`
+	}
+	xparseArgs(args, &req)
+	c.xcheckAccount(req.AccountID)
+
+	var filter mailboxFilter
+	if len(req.Filter) > 0 && string(req.Filter) != "null" {
+		if err := json.Unmarshal(req.Filter, &filter); err != nil {
+			xmethodErrorf("invalidArguments", "parsing filter: %v", err)
+		}
+	}
+	for _, cmp := range req.Sort {
+		if cmp.Property != "name" && cmp.Property != "sortOrder" {
+			xmethodErrorf("unsupportedSort", "cannot sort on %q", cmp.Property)
+		}
+	}
+
+	var objs []mailbox
+	var state string
+	c.xdbread(func(tx *bstore.Tx) {
+		state = xmailboxState(tx)
+		mbs := xmailboxes(tx)
+		for _, o := range c.xmailboxObjects(tx, mbs, false) {
+			if filter.match(o) {
+				objs = append(objs, o)
+			}
+		}
+	})
+
+	// All mailboxes have sort order 0. Objects are sorted by full name, so
+	// parents come before their children as with sortAsTree.
+	var descending bool
+	for _, cmp := range req.Sort {
+		if cmp.Property == "name" {
+			descending = cmp.IsAscending != nil && !*cmp.IsAscending
+			break
+		}
+	}
+	sort.SliceStable(objs, func(i, j int) bool {
+		if descending && !req.SortAsTree {
+			return objs[i].mb.Name > objs[j].mb.Name
+		}
+		return objs[i].mb.Name < objs[j].mb.Name
+	})
+	ids := make([]string, len(objs))
+	for i, o := range objs {
+		ids[i] = o.ID
+	}
+	resp := queryResponse{AccountID: req.AccountID, QueryState: state}
+	resp.Position, resp.IDs = xpage(req.queryRequest, ids)
+	if req.CalculateTotal {
+		n := int64(len(ids))
+		resp.Total = &n
+	}
+	return resp
+}
+
+// queryChanges is used for /queryChanges of all types. Changes to query results
+// are not tracked, clients must query again. ../rfc/8620 section 5.6
+func (c *call) queryChanges(args json.RawMessage) any {
+	var req struct {
+		AccountID       string          `json:"accountId"`
+		Filter          json.RawMessage `json:"filter"`
+		Sort            []comparator    `json:"sort"`
+		SinceQueryState string          `json:"sinceQueryState"`
+		MaxChanges      *int64          `json:"maxChanges"`
+		UpToID          *string         `json:"upToId"`
+		CalculateTotal  bool            `json:"calculateTotal"`
+		CollapseThreads bool            `json:"collapseThreads"`
+	}
+	xparseArgs(args, &req)
+	c.xcheckAccount(req.AccountID)
+	xmethodErrorf("cannotCalculateChanges", "query changes are not tracked, query again")
+	return nil
+}
+
+// xcheckMailboxName checks the name of a mailbox, a single element without
+// hierarchy separator.
+func xcheckMailboxName(name string) {
+	if name == "" {
+		xinvalidProperty("name", "empty mailbox name")
+	} else if len(name) > maxSizeMailboxName {
+		xinvalidProperty("name", "mailbox name longer than %d bytes", maxSizeMailboxName)
+	}
+	if norm.NFC.String(name) != name {
+		xinvalidProperty("name", "non-unicode-normalized mailbox names not allowed")
+	}
+	for _, c := range name {
+		switch c {
+		case '/':
+			xinvalidProperty("name", "slash not allowed in mailbox name")
+		case '%', '*', '#', '&':
+			xinvalidProperty("name", "character %c not allowed in mailbox name", c)
+		}
+		if c <= 0x1f || c >= 0x7f && c <= 0x9f || c == 0x2028 || c == 0x2029 {
+			xinvalidProperty("name", "control characters not allowed in mailbox name")
+		}
+	}
+}
+
+// xmailboxFullName returns the full name for a mailbox with name under parent,
+// which can be nil for a top-level mailbox.
+func xmailboxFullName(parent *store.Mailbox, name string) string {
+	xcheckMailboxName(name)
+	if parent == nil {
+		if strings.EqualFold(name, "inbox") {
+			xinvalidProperty("name", "special mailbox name Inbox not allowed")
+		}
+		return name
+	}
+	return parent.Name + "/" + name
+}
+
+// xparseMailboxProps parses mailbox properties for create or update. Only
+// properties present are set.
+type mailboxProps struct {
+	Name         *string          `json:"name"`
+	ParentID     *json.RawMessage `json:"parentId"`
+	Role         *json.RawMessage `json:"role"`
+	SortOrder    *int             `json:"sortOrder"`
+	IsSubscribed *bool            `json:"isSubscribed"`
+}
+
+func xparseMailboxProps(props map[string]json.RawMessage) mailboxProps {
+	var mp mailboxProps
+	for k, v := range props {
+		v := v
+		var err error
+		switch k {
+		case "name":
+			err = json.Unmarshal(v, &mp.Name)
+		case "parentId":
+			mp.ParentID = &v
+		case "role":
+			mp.Role = &v
+		case "sortOrder":
+			err = json.Unmarshal(v, &mp.SortOrder)
+			if err == nil && mp.SortOrder != nil && *mp.SortOrder != 0 {
+				xinvalidProperty(k, "only sort order 0 supported")
+			}
+		case "isSubscribed":
+			err = json.Unmarshal(v, &mp.IsSubscribed)
+		case "id", "totalEmails", "unreadEmails", "totalThreads", "unreadThreads", "myRights":
+			xinvalidProperty(k, "property %q is server-set", k)
+		default:
+			xinvalidProperty(k, "unknown property %q", k)
+		}
+		if err != nil {
+			xinvalidProperty(k, "parsing property %q: %v", k, err)
+		}
+	}
+	return mp
+}
+
+// xparent returns the parent mailbox for a parentId value, nil for a top-level
+// mailbox.
+func (c *call) xparent(mbs mailboxes, raw json.RawMessage) *store.Mailbox {
+	var id *string
+	if err := json.Unmarshal(raw, &id); err != nil {
+		xinvalidProperty("parentId", "parsing parentId: %v", err)
+	}
+	if id == nil {
+		return nil
+	}
+	p := c.xmailboxID(mbs, *id)
+	if p == nil {
+		xinvalidProperty("parentId", "unknown parent mailbox")
+	}
+	return p
+}
+
+// xparseRole parses a role for a mailbox into its special-use, with isInbox
+// for the inbox.
+func xparseRole(raw json.RawMessage, isInbox bool) store.SpecialUse {
+	var role *string
+	if err := json.Unmarshal(raw, &role); err != nil {
+		xinvalidProperty("role", "parsing role: %v", err)
+	}
+	var su store.SpecialUse
+	if isInbox && (role == nil || *role != "inbox") || !isInbox && role != nil && *role == "inbox" {
+		xinvalidProperty("role", "inbox role is only for the inbox")
+	}
+	if role != nil && !isInbox && !su.Add(`\`+*role) {
+		xinvalidProperty("role", "unsupported role %q", *role)
+	}
+	return su
+}
+
+// xsetSpecialUse sets the special-use of mb if it changed.
+func (c *call) xsetSpecialUse(tx *bstore.Tx, mb *store.Mailbox, su store.SpecialUse) {
+	if mb.SpecialUse() == su {
+		return
+	}
+	err := c.acc.MailboxSpecialUseSet(tx, mb, su)
+	xcheckf(err, "setting special-use of mailbox")
+}
+
+// xsubscribe sets whether mailbox name is subscribed.
+func xsubscribe(tx *bstore.Tx, acc *store.Account, name string, subscribe bool) []store.Change {
+	if subscribe {
+		changes, err := acc.SubscriptionEnsure(tx, name)
+		xcheckf(err, "adding subscription")
+		return changes
+	}
+	// Like IMAP, there is no change to broadcast for a removed subscription.
+	err := tx.Delete(&store.Subscription{Name: name})
+	if err != bstore.ErrAbsent {
+		xcheckf(err, "removing subscription")
+	}
+	return nil
+}
+
+// mailboxSet creates, updates and destroys mailboxes. ../rfc/8621 section 2.5
+func (c *call) mailboxSet(args json.RawMessage) any {
+	var req struct {
+		setRequest
+		OnDestroyRemoveEmails bool `json:"onDestroyRemoveEmails"`
+	}
+	xparseArgs(args, &req)
+	c.xcheckAccount(req.AccountID)
+	xcheckIDs(len(req.Create)+len(req.Update)+len(req.Destroy), maxObjectsInSet)
+
+	var resp setResponse
+	var changes []store.Change
+	// Files of messages in destroyed mailboxes are only removed after the
+	// transaction is committed.
+	var remove []store.Message
+	c.acc.WithWLock(func() {
+		c.xdbwrite(func(tx *bstore.Tx) {
+			state := xmailboxState(tx)
+			if req.IfInState != nil && *req.IfInState != state {
+				xmethodErrorf("stateMismatch", "state does not match")
+			}
+			resp = newSetResponse(req.AccountID, state)
+
+			// Creates are processed in order of creation ID, parents referenced by creation
+			// ID must come first.
+			createIDs := make([]string, 0, len(req.Create))
+			for cid := range req.Create {
+				createIDs = append(createIDs, cid)
+			}
+			sort.Strings(createIDs)
+			for _, cid := range createIDs {
+				if serr := setObjectWrite(func() func() {
+					mbs := xmailboxes(tx)
+					var props map[string]json.RawMessage
+					if err := json.Unmarshal(req.Create[cid], &props); err != nil {
+						xsetErrorf("invalidProperties", "parsing mailbox: %v", err)
+					}
+					mp := xparseMailboxProps(props)
+					if mp.Name == nil {
+						xinvalidProperty("name", "missing name")
+					}
+					var parent *store.Mailbox
+					if mp.ParentID != nil {
+						parent = c.xparent(mbs, *mp.ParentID)
+					}
+					name := xmailboxFullName(parent, *mp.Name)
+					if _, ok := mbs.byName[name]; ok {
+						xinvalidProperty("name", "mailbox already exists")
+					}
+					var su store.SpecialUse
+					if mp.Role != nil {
+						su = xparseRole(*mp.Role, false)
+					}
+					subscribe := mp.IsSubscribed == nil || *mp.IsSubscribed
+					return func() {
+						mb, nchanges, err := c.acc.MailboxEnsure(tx, name, subscribe)
+						xcheckf(err, "creating mailbox")
+						changes = append(changes, nchanges...)
+						c.xsetSpecialUse(tx, &mb, su)
+						c.createdIDs[cid] = mb.ObjectID()
+						resp.Created[cid] = map[string]any{
+							"id":            mb.ObjectID(),
+							"sortOrder":     0,
+							"totalEmails":   0,
+							"unreadEmails":  0,
+							"totalThreads":  0,
+							"unreadThreads": 0,
+							"myRights":      mailboxRights{true, true, true, true, true, true, true, true, true},
+							"isSubscribed":  subscribe,
+						}
+					}
+				}); serr != nil {
+					resp.NotCreated[cid] = *serr
+				}
+			}
+
+			for id, patch := range req.Update {
+				if serr := setObjectWrite(func() func() {
+					mbs := xmailboxes(tx)
+					mb := c.xmailboxID(mbs, id)
+					if mb == nil {
+						xsetErrorf("notFound", "unknown mailbox")
+					}
+					mp := xparseMailboxProps(patch)
+					su := mb.SpecialUse()
+					if mp.Role != nil {
+						su = xparseRole(*mp.Role, mb.Name == "Inbox")
+					}
+					var dst string
+					if mp.Name != nil || mp.ParentID != nil {
+						dst = c.xmailboxRenameDst(mbs, mb, mp)
+					}
+					return func() {
+						if dst != "" {
+							changes = append(changes, c.xmailboxRename(tx, mbs, mb, dst)...)
+						}
+						c.xsetSpecialUse(tx, mb, su)
+						if mp.IsSubscribed != nil {
+							changes = append(changes, xsubscribe(tx, c.acc, mb.Name, *mp.IsSubscribed)...)
+						}
+						resp.Updated[id] = nil
+					}
+				}); serr != nil {
+					resp.NotUpdated[id] = *serr
+				}
+			}
+
+			for _, id := range req.Destroy {
+				if serr := setObjectWrite(func() func() {
+					mbs := xmailboxes(tx)
+					mb := c.xmailboxID(mbs, id)
+					if mb == nil {
+						xsetErrorf("notFound", "unknown mailbox")
+					}
+					if mb.Name == "Inbox" {
+						xsetErrorf("forbidden", "inbox cannot be destroyed")
+					}
+					if mbs.hasChild(*mb) {
+						xsetErrorf("mailboxHasChild", "mailbox has child mailboxes")
+					}
+					mc, err := store.MailboxCountsGet(tx, mb.ID)
+					xcheckf(err, "get mailbox counts")
+					if mc.Messages > 0 && !req.OnDestroyRemoveEmails {
+						xsetErrorf("mailboxHasEmail", "mailbox has emails")
+					} else if mc.Messages > 0 && c.acc.OnHold() {
+						xsetErrorf("forbidden", "%s", store.ErrHold)
+					}
+					return func() {
+						nchanges, removed, err := c.acc.MailboxRemove(c.ctx, c.log, tx, mb)
+						xcheckf(err, "removing mailbox")
+						changes = append(changes, nchanges...)
+						remove = append(remove, removed...)
+						resp.Destroyed = append(resp.Destroyed, id)
+					}
+				}); serr != nil {
+					resp.NotDestroyed[id] = *serr
+				}
+			}
+
+			resp.NewState = xmailboxState(tx)
+		})
+		c.broadcast(changes)
+	})
+	for _, m := range remove {
+		p := c.acc.MessagePath(m.ID)
+		err := os.Remove(p)
+		c.log.Check(err, "removing message file for mailbox destroy", mlog.Field("path", p))
+	}
+	return resp
+}
+
+// xmailboxRenameDst checks a new name and/or parent for mb, and returns the new
+// full name, or an empty string if the name does not change.
+func (c *call) xmailboxRenameDst(mbs mailboxes, mb *store.Mailbox, mp mailboxProps) string {
+	if mb.Name == "Inbox" {
+		xsetErrorf("forbidden", "inbox cannot be renamed")
+	}
+	parent := mbs.parent(*mb)
+	if mp.ParentID != nil {
+		parent = c.xparent(mbs, *mp.ParentID)
+	}
+	name := mb.Name
+	if p := mbs.parent(*mb); p != nil {
+		name = mb.Name[len(p.Name)+1:]
+	}
+	if mp.Name != nil {
+		name = *mp.Name
+	}
+	if parent != nil && (parent.ID == mb.ID || strings.HasPrefix(parent.Name, mb.Name+"/")) {
+		xinvalidProperty("parentId", "mailbox cannot be moved under itself")
+	}
+	dst := xmailboxFullName(parent, name)
+	if dst == mb.Name {
+		return ""
+	}
+	if _, ok := mbs.byName[dst]; ok {
+		xinvalidProperty("name", "mailbox already exists")
+	}
+	return dst
+}
+
+// xmailboxRename renames mb and its children to dst.
+func (c *call) xmailboxRename(tx *bstore.Tx, mbs mailboxes, mb *store.Mailbox, dst string) []store.Change {
+	uidval, err := c.acc.NextUIDValidity(tx)
+	xcheckf(err, "next uid validity")
+
+	var changes []store.Change
+	src := mb.Name
+	var l []*store.Mailbox
+	for _, omb := range mbs.byName {
+		if omb.Name == src || strings.HasPrefix(omb.Name, src+"/") {
+			l = append(l, omb)
+		}
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Name < l[j].Name
+	})
+	for _, omb := range l {
+		srcName := omb.Name
+		dstName := dst + omb.Name[len(src):]
+		omb.Name = dstName
+		omb.UIDValidity = uidval
+		err := tx.Update(omb)
+		xcheckf(err, "renaming mailbox")
+
+		// The subscription moves along with the mailbox.
+		var flags []string
+		err = tx.Delete(&store.Subscription{Name: srcName})
+		if err == nil {
+			err = tx.Insert(&store.Subscription{Name: dstName})
+			if err != nil && !errors.Is(err, bstore.ErrUnique) {
+				xcheckf(err, "adding subscription for renamed mailbox")
+			}
+			flags = []string{`\Subscribed`}
+		} else if err != bstore.ErrAbsent {
+			xcheckf(err, "removing subscription for old mailbox name")
+		}
+		changes = append(changes, store.ChangeRenameMailbox{OldName: srcName, NewName: dstName, Flags: flags})
+	}
+	return changes
+}
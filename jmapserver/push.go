@@ -0,0 +1,396 @@
+package jmapserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/store"
+)
+
+// Capability for JMAP over websocket. ../rfc/8887 section 4
+const capWebSocket = "urn:ietf:params:jmap:websocket"
+
+// Maximum number of simultaneous event source and websocket connections per
+// account. These are long-lived, so they are not limited by
+// maxConcurrentRequests.
+const maxConcurrentPush = 10
+
+var concurrentPush = concurrency{m: map[string]int{}}
+
+// Minimum interval in seconds for pings on an event source.
+const minPingInterval = 30
+
+// WebSocket capability in the session resource. ../rfc/8887 section 4.1
+type webSocketCapability struct {
+	URL          string `json:"url"`
+	SupportsPush bool   `json:"supportsPush"`
+}
+
+// StateChange object, sent to clients for changed types. ../rfc/8620 section 7.1
+type stateChange struct {
+	Type    string                       `json:"@type"`
+	Changed map[string]map[string]string `json:"changed"` // Account ID to type to state.
+}
+
+// Types for which state changes are pushed. These change through the account
+// change broadcast, like for IMAP IDLE. Identity and EmailSubmission are not
+// pushed: identities cannot change, and the queue does not broadcast changes.
+var pushTypes = []string{"Mailbox", "Email", "Thread", "EmailDelivery"}
+
+// typeStates returns the current states of the pushed types.
+func (s *session) typeStates() (states map[string]string, rerr error) {
+	defer func() {
+		x := recover()
+		if x == nil {
+			return
+		}
+		if err, ok := x.(serverError); ok {
+			rerr = err
+			return
+		}
+		panic(x)
+	}()
+
+	err := store.DBRead(s.ctx, s.log, "jmapserver", s.acc.DB, func(tx *bstore.Tx) error {
+		es := xemailState(tx, s.acc)
+		states = map[string]string{
+			"Mailbox": xmailboxState(tx),
+			"Email":   es.String(),
+			"Thread":  es.String(),
+			// We consider any new message a delivery, which includes messages added by
+			// clients.
+			"EmailDelivery": fmt.Sprintf("%d", es.MaxID),
+		}
+		return nil
+	})
+	return states, err
+}
+
+// pusher keeps track of the states last seen by a client, to only push changes.
+type pusher struct {
+	types map[string]bool // Types to push, nil for all.
+	last  map[string]string
+}
+
+// parsePushTypes parses the types the client is interested in, with "*" or nil
+// meaning all types. Unknown types are ignored.
+func parsePushTypes(l []string) map[string]bool {
+	if l == nil {
+		return nil
+	}
+	types := map[string]bool{}
+	for _, t := range l {
+		if t == "*" {
+			return nil
+		}
+		types[t] = true
+	}
+	return types
+}
+
+// next returns a StateChange for the types with a state different from the
+// previous call, or nil if nothing changed.
+func (p *pusher) next(accountID string, states map[string]string) *stateChange {
+	changed := map[string]string{}
+	for _, t := range pushTypes {
+		if (p.types == nil || p.types[t]) && p.last[t] != states[t] {
+			changed[t] = states[t]
+		}
+	}
+	p.last = states
+	if len(changed) == 0 {
+		return nil
+	}
+	return &stateChange{"StateChange", map[string]map[string]string{accountID: changed}}
+}
+
+// servePush checks the limit on push connections for the account, and serves the
+// event source or websocket.
+func (s *session) servePush(w http.ResponseWriter, r *http.Request, kind string) string {
+	if !concurrentPush.acquire(s.acc.Name, maxConcurrentPush) {
+		http.Error(w, "429 - too many push connections", http.StatusTooManyRequests)
+		return "badrequest"
+	}
+	defer concurrentPush.release(s.acc.Name)
+
+	if kind == "eventsource" {
+		return s.serveEventSource(w, r)
+	}
+	return s.serveWebSocket(w, r)
+}
+
+// serveEventSource sends state changes as server-sent events, until the client
+// goes away or after the first change if requested. ../rfc/8620 section 7.3
+func (s *session) serveEventSource(w http.ResponseWriter, r *http.Request) string {
+	q := r.URL.Query()
+	var types []string
+	if v := q.Get("types"); v != "" {
+		types = strings.Split(v, ",")
+	}
+	closeAfter := q.Get("closeafter")
+	if closeAfter == "" {
+		closeAfter = "no"
+	} else if closeAfter != "no" && closeAfter != "state" {
+		http.Error(w, `400 - bad request - closeafter must be "state" or "no"`, http.StatusBadRequest)
+		return "badrequest"
+	}
+	var ping int
+	if v := q.Get("ping"); v != "" {
+		var err error
+		ping, err = strconv.Atoi(v)
+		if err != nil || ping < 0 {
+			http.Error(w, "400 - bad request - ping must be a non-negative number", http.StatusBadRequest)
+			return "badrequest"
+		}
+		if ping > 0 && ping < minPingInterval {
+			ping = minPingInterval
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.log.Error("event source response writer is not a http.Flusher", mlog.Field("writer", fmt.Sprintf("%T", w)))
+		http.Error(w, "500 - internal server error", http.StatusInternalServerError)
+		return "error"
+	}
+
+	// Register before getting the current state, so we don't miss changes.
+	comm := store.RegisterComm(s.acc)
+	defer comm.Unregister()
+
+	states, err := s.typeStates()
+	if err != nil {
+		s.log.Errorx("getting states for event source", err)
+		http.Error(w, "500 - internal server error", http.StatusInternalServerError)
+		return "error"
+	}
+	p := pusher{parsePushTypes(types), states}
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Write an event, returning false if the client went away.
+	event := func(name string, v any) bool {
+		buf, err := json.Marshal(v)
+		if err != nil {
+			panic(fmt.Sprintf("marshal event: %v", err))
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, buf); err != nil {
+			s.log.Debugx("writing event", err)
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+
+	// The ping timer is reset after each event. ../rfc/8620 section 7.3
+	var pingTimer *time.Timer
+	var pingc <-chan time.Time
+	if ping > 0 {
+		pingTimer = time.NewTimer(time.Duration(ping) * time.Second)
+		defer pingTimer.Stop()
+		pingc = pingTimer.C
+	}
+	resetPing := func() {
+		if pingTimer != nil {
+			pingTimer.Reset(time.Duration(ping) * time.Second)
+		}
+	}
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return "ok"
+		case <-mox.Shutdown.Done():
+			return "ok"
+		case <-pingc:
+			if !event("ping", map[string]int{"interval": ping}) {
+				return "ok"
+			}
+			resetPing()
+		case <-comm.Pending:
+			comm.Get()
+			states, err := s.typeStates()
+			if err != nil {
+				s.log.Errorx("getting states for event source", err)
+				return "error"
+			}
+			sc := p.next(s.acc.Name, states)
+			if sc == nil {
+				continue
+			}
+			if !event("state", sc) {
+				return "ok"
+			}
+			if closeAfter == "state" {
+				return "ok"
+			}
+			resetPing()
+		}
+	}
+}
+
+// Request over a websocket. The other fields are those of a regular request.
+// ../rfc/8887 section 4.3.1
+type wsRequest struct {
+	Type      string          `json:"@type"`
+	ID        json.RawMessage `json:"id"`
+	DataTypes []string        `json:"dataTypes"` // For WebSocketPushEnable.
+}
+
+// Response to a request over a websocket. ../rfc/8887 section 4.3.2
+type wsResponse struct {
+	Type      string          `json:"@type"`
+	RequestID json.RawMessage `json:"requestId,omitempty"`
+	response
+}
+
+// Error response to a request over a websocket. ../rfc/8887 section 4.3.4
+type wsRequestError struct {
+	Type      string          `json:"@type"`
+	RequestID json.RawMessage `json:"requestId,omitempty"`
+	requestError
+}
+
+// wsMessage is a message read from the websocket, or the error that stopped
+// reading.
+type wsMessage struct {
+	buf []byte
+	err error
+}
+
+// serveWebSocket handles JMAP over a websocket: API requests, and push of state
+// changes once enabled by the client. ../rfc/8887
+func (s *session) serveWebSocket(w http.ResponseWriter, r *http.Request) string {
+	ws, err := wsUpgrade(w, r, "jmap")
+	if err != nil {
+		s.log.Debugx("websocket upgrade", err)
+		return "badrequest"
+	}
+	closeCode, closeReason := wsCloseNormal, ""
+	defer func() {
+		err := ws.close(closeCode, closeReason)
+		s.log.Check(err, "closing websocket")
+	}()
+
+	comm := store.RegisterComm(s.acc)
+	defer comm.Unregister()
+
+	// Messages are read in a separate goroutine, so we can push while waiting for
+	// the next request.
+	msgc := make(chan wsMessage)
+	go func() {
+		for {
+			buf, err := ws.readMessage(maxSizeRequest)
+			select {
+			case msgc <- wsMessage{buf, err}:
+			case <-s.ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	write := func(v any) bool {
+		buf, err := json.Marshal(v)
+		if err != nil {
+			panic(fmt.Sprintf("marshal websocket message: %v", err))
+		}
+		if err := ws.writeFrame(wsOpText, buf); err != nil {
+			s.log.Debugx("writing websocket message", err)
+			return false
+		}
+		return true
+	}
+
+	var p *pusher // Set when push is enabled.
+	for {
+		select {
+		case <-s.ctx.Done():
+			return "ok"
+		case <-mox.Shutdown.Done():
+			closeCode, closeReason = wsCloseGoingAway, "shutting down"
+			return "ok"
+
+		case <-comm.Pending:
+			comm.Get()
+			if p == nil {
+				continue
+			}
+			states, err := s.typeStates()
+			if err != nil {
+				s.log.Errorx("getting states for websocket push", err)
+				closeCode = wsCloseGoingAway
+				return "error"
+			}
+			if sc := p.next(s.acc.Name, states); sc != nil && !write(sc) {
+				return "ok"
+			}
+
+		case msg := <-msgc:
+			var cerr wsCloseError
+			if errors.As(msg.err, &cerr) {
+				s.log.Debugx("reading websocket message", msg.err)
+				closeCode, closeReason = cerr.code, cerr.reason
+				return "badrequest"
+			} else if errors.Is(msg.err, io.EOF) {
+				return "ok"
+			} else if msg.err != nil {
+				s.log.Debugx("reading websocket message", msg.err)
+				return "ok"
+			}
+
+			var req wsRequest
+			if err := json.Unmarshal(msg.buf, &req); err != nil {
+				rerr := requestError{"urn:ietf:params:jmap:error:notJSON", http.StatusBadRequest, "message is not valid json", ""}
+				if !write(wsRequestError{"RequestError", nil, rerr}) {
+					return "ok"
+				}
+				continue
+			}
+			switch req.Type {
+			case "Request":
+				resp, rerr := s.execute(msg.buf)
+				var ok bool
+				if rerr != nil {
+					ok = write(wsRequestError{"RequestError", req.ID, *rerr})
+				} else {
+					ok = write(wsResponse{"Response", req.ID, resp})
+				}
+				if !ok {
+					return "ok"
+				}
+			case "WebSocketPushEnable":
+				// We don't send pushState, so we ignore it from the client. ../rfc/8887 section 4.3.5.2
+				states, err := s.typeStates()
+				if err != nil {
+					s.log.Errorx("getting states for websocket push", err)
+					closeCode = wsCloseGoingAway
+					return "error"
+				}
+				p = &pusher{parsePushTypes(req.DataTypes), states}
+			case "WebSocketPushDisable":
+				p = nil
+			default:
+				rerr := requestError{"urn:ietf:params:jmap:error:notRequest", http.StatusBadRequest, fmt.Sprintf("unknown @type %q", req.Type), ""}
+				if !write(wsRequestError{"RequestError", req.ID, rerr}) {
+					return "ok"
+				}
+			}
+		}
+	}
+}
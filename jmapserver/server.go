@@ -0,0 +1,678 @@
+// Package jmapserver implements a JMAP server (RFC 8620) with JMAP for Mail (RFC
+// 8621), for email clients accessing their account over HTTP.
+package jmapserver
+
+/*
+Implementation notes
+
+The session resource, API requests and blob up/download all require HTTP basic
+authentication with the credentials of an account, like the account web
+interface. A session only has the account of the authenticated user, with the
+account name as account ID.
+
+Blob IDs start with a letter indicating where the data is: "m" followed by the
+ID of a message for message data, "u" followed by the hex-encoded SHA-256 hash
+of the data for uploaded blobs. Uploaded blobs are stored as files in the
+account directory, and removed after a day. Parts of messages have blob ID "m"
+with the message ID, a dot and the IMAP section of the part, e.g. "m123.2.1".
+
+Objects for mail are backed by the account database. Mailbox IDs are "F" with
+the mailbox ID, email IDs "E" with the message ID, thread IDs "T" with the
+thread ID. A message is in a single mailbox, so an email has exactly one
+mailbox, and copies of a message are separate emails. The email and thread
+state is the highest modseq and highest message ID, changes are found through
+message modseqs, and through records of removed messages. Mailbox, identity
+and submission changes are not tracked, their state is a hash of all objects,
+and clients must fetch all objects again when it changes.
+
+Identities are the addresses of the account, and cannot be changed. An email
+submission is queued like a message submitted over SMTP: the From address must
+be allowed for the account, limits for outgoing messages apply, and the
+message is DKIM-signed. Transport rules of the domain and sending on behalf of
+other accounts don't apply. Submissions are the messages of the account in the
+queue, grouped by trace ID, and disappear from the queue after delivery. Until
+then they can be canceled.
+
+State changes are pushed to clients over an event source and over a websocket,
+driven by the account change broadcast also used for IMAP IDLE. On a change, the
+states of mailboxes, emails and threads are calculated again, and only types
+with a different state are sent. A websocket also takes API requests. Push
+connections are long-lived, and limited separately from API requests.
+*/
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/metrics"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/store"
+)
+
+var xlog = mlog.New("jmapserver")
+
+var (
+	metricRequest = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "mox_jmap_request_duration_seconds",
+			Help:    "JMAP HTTP request duration and result in seconds.",
+			Buckets: []float64{0.001, 0.005, 0.01, 0.05, 0.100, 0.5, 1, 5, 10, 20},
+		},
+		[]string{
+			"kind",   // session, api, upload, download, eventsource, websocket
+			"result", // ok, badrequest, unauthorized, error
+		},
+	)
+	metricMethod = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "mox_jmap_method_duration_seconds",
+			Help:    "JMAP method call duration and result in seconds.",
+			Buckets: []float64{0.001, 0.005, 0.01, 0.05, 0.100, 0.5, 1, 5, 10, 20},
+		},
+		[]string{
+			"method",
+			"result", // ok, error, servererror
+		},
+	)
+)
+
+// Limits advertised in the core capability. ../rfc/8620 section 2
+const (
+	maxSizeUpload         = 50 * 1024 * 1024
+	maxConcurrentUpload   = 4
+	maxSizeRequest        = 10 * 1024 * 1024
+	maxConcurrentRequests = 4
+	maxCallsInRequest     = 16
+	maxObjectsInGet       = 500
+	maxObjectsInSet       = 500
+)
+
+// Maximum size in bytes of a mailbox name, a single element of the mailbox
+// hierarchy. Advertised in the mail capability. ../rfc/8621 section 1.3.1
+const maxSizeMailboxName = 255
+
+var collationAlgorithms = []string{"i;ascii-numeric", "i;ascii-casemap", "i;unicode-casemap"}
+
+// Uploaded blobs are removed after this time. ../rfc/8620 section 6.1
+var uploadExpiration = 24 * time.Hour
+
+// Capability identifiers. ../rfc/8620 section 2 ../rfc/8621 section 1.3
+const (
+	capCore       = "urn:ietf:params:jmap:core"
+	capMail       = "urn:ietf:params:jmap:mail"
+	capSubmission = "urn:ietf:params:jmap:submission"
+)
+
+// concurrency limits the number of concurrent requests per account.
+type concurrency struct {
+	sync.Mutex
+	m map[string]int
+}
+
+var concurrentRequests = concurrency{m: map[string]int{}}
+var concurrentUploads = concurrency{m: map[string]int{}}
+
+// acquire returns whether a request for key can proceed, with at most max
+// concurrent requests. If so, release must be called when done.
+func (c *concurrency) acquire(key string, max int) bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.m[key] >= max {
+		return false
+	}
+	c.m[key]++
+	return true
+}
+
+func (c *concurrency) release(key string) {
+	c.Lock()
+	defer c.Unlock()
+	c.m[key]--
+	if c.m[key] <= 0 {
+		delete(c.m, key)
+	}
+}
+
+// Handler returns a handler for JMAP requests for paths under path, which must
+// end with a slash. Requests must not have the path stripped.
+func Handler(path string) http.Handler {
+	return handler{path}
+}
+
+// WellKnownHandler returns a handler for /.well-known/jmap, redirecting to the
+// session resource under path. ../rfc/8620 section 2.2
+func WellKnownHandler(path string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "405 - method not allowed - get required", http.StatusMethodNotAllowed)
+			return
+		}
+		http.Redirect(w, r, path+"session", http.StatusTemporaryRedirect)
+	})
+}
+
+type handler struct {
+	path string
+}
+
+func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithValue(r.Context(), mlog.CidKey, mox.Cid())
+	log := xlog.WithContext(ctx)
+
+	p := strings.TrimPrefix(r.URL.Path, h.path)
+	var kind, method string
+	switch {
+	case p == "session":
+		kind, method = "session", "GET"
+	case p == "api":
+		kind, method = "api", "POST"
+	case strings.HasPrefix(p, "upload/"):
+		kind, method = "upload", "POST"
+	case strings.HasPrefix(p, "download/"):
+		kind, method = "download", "GET"
+	case p == "eventsource":
+		kind, method = "eventsource", "GET"
+	case p == "ws":
+		kind, method = "websocket", "GET"
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != method && !(method == "GET" && r.Method == "HEAD") {
+		http.Error(w, fmt.Sprintf("405 - method not allowed - %s required", strings.ToLower(method)), http.StatusMethodNotAllowed)
+		return
+	}
+
+	start := time.Now()
+	result := "error"
+	defer func() {
+		metricRequest.WithLabelValues(kind, result).Observe(float64(time.Since(start)) / float64(time.Second))
+	}()
+
+	acc, address := authenticate(ctx, log, w, r)
+	if acc == nil {
+		result = "unauthorized"
+		return
+	}
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+	log = log.Fields(mlog.Field("account", acc.Name))
+
+	if kind == "eventsource" || kind == "websocket" {
+		// Limited in servePush.
+	} else if kind == "upload" {
+		if !concurrentUploads.acquire(acc.Name, maxConcurrentUpload) {
+			result = "badrequest"
+			problem(w, http.StatusTooManyRequests, "urn:ietf:params:jmap:error:limit", "too many concurrent uploads", "maxConcurrentUpload")
+			return
+		}
+		defer concurrentUploads.release(acc.Name)
+	} else {
+		if !concurrentRequests.acquire(acc.Name, maxConcurrentRequests) {
+			result = "badrequest"
+			problem(w, http.StatusTooManyRequests, "urn:ietf:params:jmap:error:limit", "too many concurrent requests", "maxConcurrentRequests")
+			return
+		}
+		defer concurrentRequests.release(acc.Name)
+	}
+
+	s := &session{ctx: ctx, log: log, acc: acc, address: address, base: baseURL(r, h.path)}
+	switch kind {
+	case "session":
+		result = s.serveSession(w, r)
+	case "api":
+		result = s.serveAPI(w, r)
+	case "upload":
+		result = s.serveUpload(w, r, strings.TrimPrefix(p, "upload/"))
+	case "download":
+		result = s.serveDownload(w, r, strings.TrimPrefix(p, "download/"))
+	case "eventsource", "websocket":
+		result = s.servePush(w, r, kind)
+	}
+}
+
+// baseURL returns the absolute URL for path, for URLs in the session resource.
+func baseURL(r *http.Request, path string) string {
+	scheme := "https"
+	if r.TLS == nil {
+		scheme = "http"
+	}
+	return scheme + "://" + r.Host + path
+}
+
+// authenticate checks the HTTP basic authentication credentials of r, and
+// returns the opened account and address the user logged in with. If
+// authentication fails, a response has been written and nil is returned.
+func authenticate(ctx context.Context, log *mlog.Log, w http.ResponseWriter, r *http.Request) (*store.Account, string) {
+	authResult := "error"
+	start := time.Now()
+	var remoteIP net.IP
+	defer func() {
+		metrics.AuthenticationInc("jmap", "httpbasic", authResult)
+		if authResult == "ok" && remoteIP != nil {
+			mox.LimiterFailedAuth.Reset(remoteIP, start)
+		}
+	}()
+
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err != nil {
+		log.Errorx("parsing remote address", err, mlog.Field("addr", r.RemoteAddr))
+	} else {
+		remoteIP = addr.IP
+	}
+	if remoteIP != nil && !mox.LimiterFailedAuth.Add(remoteIP, start, 1) {
+		metrics.AuthenticationRatelimitedInc("jmap")
+		http.Error(w, "429 - too many auth attempts", http.StatusTooManyRequests)
+		return nil, ""
+	}
+
+	// store.OpenEmailAuth has an auth cache, so we don't bcrypt for every request.
+	if auth := r.Header.Get("Authorization"); auth == "" || !strings.HasPrefix(auth, "Basic ") {
+	} else if authBuf, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic ")); err != nil {
+		log.Debugx("parsing base64", err)
+	} else if t := strings.SplitN(string(authBuf), ":", 2); len(t) != 2 {
+		log.Debug("bad user:pass form")
+	} else if acc, err := store.OpenEmailAuth(t[0], t[1]); err != nil {
+		if errors.Is(err, store.ErrUnknownCredentials) {
+			authResult = "badcreds"
+			log.Info("failed authentication attempt", mlog.Field("username", t[0]), mlog.Field("remote", remoteIP))
+		} else if errors.Is(err, store.ErrAccountSuspended) {
+			authResult = "suspended"
+			log.Info("authentication for suspended account", mlog.Field("username", t[0]), mlog.Field("remote", remoteIP))
+		} else {
+			log.Errorx("open account", err)
+		}
+	} else {
+		authResult = "ok"
+		return acc, t[0]
+	}
+	// ../rfc/8620 section 8.2
+	w.Header().Set("WWW-Authenticate", `Basic realm="jmap"`)
+	http.Error(w, "401 - unauthorized - jmap", http.StatusUnauthorized)
+	return nil, ""
+}
+
+// session is an authenticated HTTP request.
+type session struct {
+	ctx     context.Context
+	log     *mlog.Log
+	acc     *store.Account
+	address string // Address the user authenticated with.
+	base    string // Absolute URL for the JMAP path, ending with a slash.
+}
+
+// problem writes a request-level error as problem details. ../rfc/8620 section 3.6.1
+// ../rfc/7807
+func problem(w http.ResponseWriter, status int, typ, detail, limit string) {
+	p := requestError{typ, status, detail, limit}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(p)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
+
+// Session resource. ../rfc/8620 section 2
+type sessionResource struct {
+	Capabilities    map[string]any     `json:"capabilities"`
+	Accounts        map[string]account `json:"accounts"`
+	PrimaryAccounts map[string]string  `json:"primaryAccounts"`
+	Username        string             `json:"username"`
+	APIURL          string             `json:"apiUrl"`
+	DownloadURL     string             `json:"downloadUrl"`
+	UploadURL       string             `json:"uploadUrl"`
+	EventSourceURL  string             `json:"eventSourceUrl"`
+	State           string             `json:"state"`
+}
+
+// ../rfc/8620 section 2
+type coreCapability struct {
+	MaxSizeUpload         int64    `json:"maxSizeUpload"`
+	MaxConcurrentUpload   int      `json:"maxConcurrentUpload"`
+	MaxSizeRequest        int64    `json:"maxSizeRequest"`
+	MaxConcurrentRequests int      `json:"maxConcurrentRequests"`
+	MaxCallsInRequest     int      `json:"maxCallsInRequest"`
+	MaxObjectsInGet       int      `json:"maxObjectsInGet"`
+	MaxObjectsInSet       int      `json:"maxObjectsInSet"`
+	CollationAlgorithms   []string `json:"collationAlgorithms"`
+}
+
+// Mail capability of an account. ../rfc/8621 section 1.3.1
+type mailCapability struct {
+	MaxMailboxesPerEmail       int      `json:"maxMailboxesPerEmail"`
+	MaxMailboxDepth            *int     `json:"maxMailboxDepth"`
+	MaxSizeMailboxName         int      `json:"maxSizeMailboxName"`
+	MaxSizeAttachmentsPerEmail int64    `json:"maxSizeAttachmentsPerEmail"`
+	EmailQuerySortOptions      []string `json:"emailQuerySortOptions"`
+	MayCreateTopLevelMailbox   bool     `json:"mayCreateTopLevelMailbox"`
+}
+
+// Submission capability of an account. ../rfc/8621 section 1.3.2
+type submissionCapability struct {
+	MaxDelayedSend       int                 `json:"maxDelayedSend"`
+	SubmissionExtensions map[string][]string `json:"submissionExtensions"`
+}
+
+// ../rfc/8620 section 2
+type account struct {
+	Name                string         `json:"name"`
+	IsPersonal          bool           `json:"isPersonal"`
+	IsReadOnly          bool           `json:"isReadOnly"`
+	AccountCapabilities map[string]any `json:"accountCapabilities"`
+}
+
+// resource returns the session resource for the account.
+func (s *session) resource() sessionResource {
+	// Attachments are part of the message, which is limited in size.
+	maxAttachments := mox.Conf.MessageSizeLimit(s.acc.Name)
+	if maxAttachments <= 0 {
+		maxAttachments = maxSizeUpload
+	}
+	r := sessionResource{
+		Capabilities: map[string]any{
+			capCore: coreCapability{
+				maxSizeUpload,
+				maxConcurrentUpload,
+				maxSizeRequest,
+				maxConcurrentRequests,
+				maxCallsInRequest,
+				maxObjectsInGet,
+				maxObjectsInSet,
+				collationAlgorithms,
+			},
+			capMail:       struct{}{},
+			capSubmission: struct{}{},
+			capWebSocket:  webSocketCapability{"ws" + strings.TrimPrefix(s.base, "http") + "ws", true},
+		},
+		Accounts: map[string]account{
+			s.acc.Name: {
+				Name:       s.address,
+				IsPersonal: true,
+				AccountCapabilities: map[string]any{
+					capMail:       mailCapability{1, nil, maxSizeMailboxName, maxAttachments, emailSortProperties, true},
+					capSubmission: submissionCapability{0, map[string][]string{}},
+				},
+			},
+		},
+		PrimaryAccounts: map[string]string{
+			capMail:       s.acc.Name,
+			capSubmission: s.acc.Name,
+		},
+		Username:    s.address,
+		APIURL:      s.base + "api",
+		DownloadURL: s.base + "download/{accountId}/{blobId}/{name}?type={type}",
+		UploadURL:   s.base + "upload/{accountId}/",
+		// ../rfc/8620 section 7.3
+		EventSourceURL: s.base + "eventsource?types={types}&closeafter={closeafter}&ping={ping}",
+	}
+	// The state must change when the session resource changes. ../rfc/8620 section 2
+	buf, err := json.Marshal(r)
+	if err != nil {
+		panic(fmt.Sprintf("marshal session resource: %v", err))
+	}
+	h := sha256.Sum256(buf)
+	r.State = base64.RawURLEncoding.EncodeToString(h[:12])
+	return r
+}
+
+func (s *session) serveSession(w http.ResponseWriter, r *http.Request) string {
+	err := writeJSON(w, http.StatusOK, s.resource())
+	s.log.Check(err, "writing session resource")
+	return "ok"
+}
+
+// blobDir returns the directory with uploaded blobs for the account.
+func (s *session) blobDir() string {
+	return filepath.Join(s.acc.Dir, "jmapblob")
+}
+
+// Response to an upload. ../rfc/8620 section 6.1
+type uploadResponse struct {
+	AccountID string `json:"accountId"`
+	BlobID    string `json:"blobId"`
+	Type      string `json:"type"`
+	Size      int64  `json:"size"`
+}
+
+// serveUpload stores the request body as blob. ../rfc/8620 section 6.1
+func (s *session) serveUpload(w http.ResponseWriter, r *http.Request, p string) string {
+	accountID := strings.TrimSuffix(p, "/")
+	if accountID != s.acc.Name || strings.Contains(accountID, "/") {
+		problem(w, http.StatusNotFound, "urn:ietf:params:jmap:error:notFound", "unknown account", "")
+		return "badrequest"
+	}
+	if r.ContentLength > maxSizeUpload {
+		problem(w, http.StatusRequestEntityTooLarge, "urn:ietf:params:jmap:error:limit", "upload too large", "maxSizeUpload")
+		return "badrequest"
+	}
+
+	dir := s.blobDir()
+	os.MkdirAll(dir, 0770)
+	s.removeExpiredBlobs(dir)
+
+	f, err := os.CreateTemp(dir, "upload-*")
+	if err != nil {
+		s.log.Errorx("creating temporary file for upload", err)
+		http.Error(w, "500 - internal server error", http.StatusInternalServerError)
+		return "error"
+	}
+	defer func() {
+		if f != nil {
+			err := f.Close()
+			s.log.Check(err, "closing upload file")
+			err = os.Remove(f.Name())
+			s.log.Check(err, "removing upload file")
+		}
+	}()
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(r.Body, maxSizeUpload+1))
+	if err != nil {
+		s.log.Debugx("reading upload", err)
+		http.Error(w, "400 - bad request - reading upload", http.StatusBadRequest)
+		return "badrequest"
+	} else if size > maxSizeUpload {
+		problem(w, http.StatusRequestEntityTooLarge, "urn:ietf:params:jmap:error:limit", "upload too large", "maxSizeUpload")
+		return "badrequest"
+	}
+	blobID := fmt.Sprintf("u%x", h.Sum(nil))
+	err = f.Close()
+	if err == nil {
+		// Uploading the same data again refreshes the expiration time.
+		err = os.Rename(f.Name(), filepath.Join(dir, blobID))
+	}
+	if err != nil {
+		s.log.Errorx("storing uploaded blob", err)
+		http.Error(w, "500 - internal server error", http.StatusInternalServerError)
+		return "error"
+	}
+	f = nil
+
+	typ := r.Header.Get("Content-Type")
+	if typ == "" {
+		typ = "application/octet-stream"
+	}
+	err = writeJSON(w, http.StatusCreated, uploadResponse{s.acc.Name, blobID, typ, size})
+	s.log.Check(err, "writing upload response")
+	return "ok"
+}
+
+// removeExpiredBlobs removes uploaded blobs older than uploadExpiration.
+func (s *session) removeExpiredBlobs(dir string) {
+	l, err := os.ReadDir(dir)
+	if err != nil {
+		s.log.Errorx("listing uploaded blobs", err)
+		return
+	}
+	for _, e := range l {
+		fi, err := e.Info()
+		if err == nil && time.Since(fi.ModTime()) > uploadExpiration {
+			err = os.Remove(filepath.Join(dir, e.Name()))
+		}
+		s.log.Check(err, "removing expired uploaded blob", mlog.Field("name", e.Name()))
+	}
+}
+
+// openBlob returns a reader for the data of a blob, or nil if it does not exist.
+func (s *session) openBlob(blobID string) (io.ReadSeekCloser, time.Time, error) {
+	if strings.HasPrefix(blobID, "u") && len(blobID) == 1+2*sha256.Size && strings.Trim(blobID[1:], "0123456789abcdef") == "" {
+		f, err := os.Open(filepath.Join(s.blobDir(), blobID))
+		if err != nil && errors.Is(err, os.ErrNotExist) {
+			return nil, time.Time{}, nil
+		} else if err != nil {
+			return nil, time.Time{}, err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, time.Time{}, err
+		}
+		return f, fi.ModTime(), nil
+	} else if strings.HasPrefix(blobID, "m") {
+		msgID, partID, isPart := strings.Cut(blobID[1:], ".")
+		id, err := strconv.ParseInt(msgID, 10, 64)
+		if err != nil || id <= 0 || msgID != fmt.Sprintf("%d", id) || isPart && partID == "" {
+			return nil, time.Time{}, nil
+		}
+		m := store.Message{ID: id}
+		err = store.DBRead(s.ctx, s.log, "jmapserver", s.acc.DB, func(tx *bstore.Tx) error {
+			return tx.Get(&m)
+		})
+		if err == bstore.ErrAbsent {
+			return nil, time.Time{}, nil
+		} else if err != nil {
+			return nil, time.Time{}, err
+		}
+		mr := s.acc.MessageReader(m)
+		if !isPart {
+			return msgReadSeeker{io.NewSectionReader(mr, 0, m.Size), mr}, m.Received, nil
+		}
+		defer func() {
+			err := mr.Close()
+			s.log.Check(err, "closing message reader")
+		}()
+		rc, err := s.openPartBlob(m, mr, partID)
+		return rc, m.Received, err
+	}
+	return nil, time.Time{}, nil
+}
+
+// openPartBlob returns a reader for the decoded data of a part of a message, or
+// nil if the part does not exist. The data is written to a temporary file, which
+// is removed when closed.
+func (s *session) openPartBlob(m store.Message, mr *store.MsgReader, partID string) (io.ReadSeekCloser, error) {
+	mp, err := m.LoadPart(mr)
+	if err != nil {
+		return nil, fmt.Errorf("load message part: %w", err)
+	}
+	p := partByID(&mp, partID)
+	if p == nil {
+		return nil, nil
+	}
+	f, err := store.CreateMessageTemp("jmap-part")
+	if err != nil {
+		return nil, err
+	}
+	pf := tempReadSeeker{f}
+	if _, err := io.Copy(f, p.Reader()); err != nil {
+		pf.Close()
+		return nil, fmt.Errorf("writing decoded part: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		pf.Close()
+		return nil, err
+	}
+	return pf, nil
+}
+
+// tempReadSeeker is a temporary file, removed when closed.
+type tempReadSeeker struct {
+	*os.File
+}
+
+func (r tempReadSeeker) Close() error {
+	err := r.File.Close()
+	if xerr := os.Remove(r.Name()); err == nil {
+		err = xerr
+	}
+	return err
+}
+
+type msgReadSeeker struct {
+	*io.SectionReader
+	mr *store.MsgReader
+}
+
+func (r msgReadSeeker) Close() error {
+	return r.mr.Close()
+}
+
+// serveDownload writes the data of a blob. ../rfc/8620 section 6.2
+func (s *session) serveDownload(w http.ResponseWriter, r *http.Request, p string) string {
+	t := strings.SplitN(p, "/", 3)
+	if len(t) != 3 || t[0] != s.acc.Name {
+		problem(w, http.StatusNotFound, "urn:ietf:params:jmap:error:notFound", "unknown account or blob", "")
+		return "badrequest"
+	}
+	blobID, name := t[1], t[2]
+
+	rc, mtime, err := s.openBlob(blobID)
+	if err != nil {
+		s.log.Errorx("opening blob", err, mlog.Field("blobid", blobID))
+		http.Error(w, "500 - internal server error", http.StatusInternalServerError)
+		return "error"
+	} else if rc == nil {
+		problem(w, http.StatusNotFound, "urn:ietf:params:jmap:error:notFound", "unknown blob", "")
+		return "badrequest"
+	}
+	defer func() {
+		err := rc.Close()
+		s.log.Check(err, "closing blob")
+	}()
+
+	// The type comes from the client, and blobs can be parts of received messages,
+	// e.g. HTML with scripts. Blobs are never rendered inline on our origin: they are
+	// always an attachment, and sandboxed by the CSP in case a browser still renders
+	// them.
+	typ := r.URL.Query().Get("type")
+	if mt, _, err := mime.ParseMediaType(typ); err != nil || !strings.Contains(mt, "/") {
+		typ = "application/octet-stream"
+	}
+	h := w.Header()
+	h.Set("Content-Type", typ)
+	h.Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	if name != "" {
+		h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	} else {
+		h.Set("Content-Disposition", "attachment")
+	}
+	// Blobs are immutable. ../rfc/8620 section 6.2
+	h.Set("Cache-Control", "private, immutable, max-age=31536000")
+	http.ServeContent(w, r, "", mtime, rc)
+	return "ok"
+}
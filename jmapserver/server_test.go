@@ -0,0 +1,375 @@
+package jmapserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/store"
+)
+
+var ctxbg = context.Background()
+
+func tcheck(t *testing.T, err error, msg string) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %s", msg, err)
+	}
+}
+
+func setup(t *testing.T) func() {
+	mox.LimitersInit() // Reset rate limiters.
+	os.RemoveAll("../testdata/jmap/data")
+	mox.Context = ctxbg
+	mox.ConfigStaticPath = "../testdata/jmap/mox.conf"
+	mox.MustLoadConfig(true, false)
+	acc, err := store.OpenAccount("mjl")
+	tcheck(t, err, "open account")
+	err = acc.SetPassword("testtest")
+	tcheck(t, err, "set password")
+	err = acc.Close()
+	tcheck(t, err, "close account")
+	switchDone := store.Switchboard()
+	return func() {
+		close(switchDone)
+	}
+}
+
+// do executes a request against the jmap handler, with credentials if auth is set.
+func do(t *testing.T, method, path, contentType, body string, auth bool) *http.Response {
+	t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	if auth {
+		r.SetBasicAuth("mjl@mox.example", "testtest")
+	}
+	w := httptest.NewRecorder()
+	Handler("/jmap/").ServeHTTP(w, r)
+	return w.Result()
+}
+
+func xjson(t *testing.T, resp *http.Response, expStatus int, v any) {
+	t.Helper()
+	if resp.StatusCode != expStatus {
+		buf, _ := io.ReadAll(resp.Body)
+		t.Fatalf("got status %d, expected %d, body %q", resp.StatusCode, expStatus, buf)
+	}
+	err := json.NewDecoder(resp.Body).Decode(v)
+	tcheck(t, err, "parsing json response")
+}
+
+func TestSession(t *testing.T) {
+	defer setup(t)()
+
+	resp := do(t, "GET", "/jmap/session", "", "", false)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("got status %d without credentials, expected 401", resp.StatusCode)
+	}
+	resp = do(t, "POST", "/jmap/session", "", "", true)
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("got status %d for post, expected 405", resp.StatusCode)
+	}
+
+	var sr sessionResource
+	xjson(t, do(t, "GET", "/jmap/session", "", "", true), http.StatusOK, &sr)
+	if _, ok := sr.Capabilities[capCore]; !ok {
+		t.Fatalf("missing core capability")
+	}
+	if a, ok := sr.Accounts["mjl"]; !ok || a.Name != "mjl@mox.example" || !a.IsPersonal {
+		t.Fatalf("unexpected accounts %#v", sr.Accounts)
+	}
+	if sr.Username != "mjl@mox.example" || sr.APIURL != "http://example.com/jmap/api" || sr.UploadURL != "http://example.com/jmap/upload/{accountId}/" || sr.State == "" {
+		t.Fatalf("unexpected session resource %#v", sr)
+	}
+
+	w := httptest.NewRecorder()
+	WellKnownHandler("/jmap/").ServeHTTP(w, httptest.NewRequest("GET", "/.well-known/jmap", nil))
+	if loc := w.Result().Header.Get("Location"); w.Code != http.StatusTemporaryRedirect || loc != "/jmap/session" {
+		t.Fatalf("got status %d, location %q for well-known, expected redirect to session", w.Code, loc)
+	}
+}
+
+func TestAPI(t *testing.T) {
+	defer setup(t)()
+
+	api := func(body string, expStatus int, v any) {
+		t.Helper()
+		xjson(t, do(t, "POST", "/jmap/api", "application/json", body, true), expStatus, v)
+	}
+
+	var resp response
+	api(`{"using": ["urn:ietf:params:jmap:core"], "methodCalls": [["Core/echo", {"hello": true, "list": [{"id": "a"}, {"id": "b"}]}, "c0"], ["Core/echo", {"#ids": {"resultOf": "c0", "name": "Core/echo", "path": "/list/*/id"}}, "c1"], ["Bogus/get", {}, "c2"], ["Core/echo", {"#x": {"resultOf": "c2", "name": "Core/echo", "path": ""}}, "c3"]]}`, http.StatusOK, &resp)
+	if len(resp.MethodResponses) != 4 {
+		t.Fatalf("got %d method responses, expected 4", len(resp.MethodResponses))
+	}
+	exp := []string{
+		`["Core/echo",{"hello":true,"list":[{"id":"a"},{"id":"b"}]},"c0"]`,
+		`["Core/echo",{"ids":["a","b"]},"c1"]`,
+		`["error",{"type":"unknownMethod","description":"unknown method \"Bogus/get\""},"c2"]`,
+	}
+	for i, e := range exp {
+		buf, err := json.Marshal(resp.MethodResponses[i])
+		tcheck(t, err, "marshal response")
+		// Compact for comparison, whitespace from echo is kept.
+		var v any
+		json.Unmarshal(buf, &v)
+		buf, _ = json.Marshal(v)
+		var ev any
+		json.Unmarshal([]byte(e), &ev)
+		ebuf, _ := json.Marshal(ev)
+		if string(buf) != string(ebuf) {
+			t.Fatalf("response %d: got %s, expected %s", i, buf, ebuf)
+		}
+	}
+	if r := resp.MethodResponses[3]; r.Name != "error" || !strings.Contains(string(r.Args), "invalidResultReference") {
+		t.Fatalf("got %s %s for reference to error response, expected invalidResultReference", r.Name, r.Args)
+	}
+	if resp.SessionState == "" {
+		t.Fatalf("missing session state")
+	}
+
+	// Methods for capabilities not in "using" are unknown.
+	api(`{"using": [], "methodCalls": [["Core/echo", {}, "c0"]]}`, http.StatusOK, &resp)
+	if r := resp.MethodResponses[0]; r.Name != "error" || !strings.Contains(string(r.Args), "unknownMethod") {
+		t.Fatalf("got %s %s for method without capability, expected unknownMethod", r.Name, r.Args)
+	}
+
+	// Request-level errors.
+	problemType := func(contentType, body, expType string) {
+		t.Helper()
+		var p struct {
+			Type string
+		}
+		xjson(t, do(t, "POST", "/jmap/api", contentType, body, true), http.StatusBadRequest, &p)
+		if p.Type != "urn:ietf:params:jmap:error:"+expType {
+			t.Fatalf("got problem type %q, expected %q", p.Type, expType)
+		}
+	}
+	problemType("text/plain", `{}`, "notJSON")
+	problemType("application/json", `{`, "notJSON")
+	problemType("application/json", `{"using": []}`, "notRequest")
+	problemType("application/json", `{"using": [], "methodCalls": [["Core/echo", [], "c0"]]}`, "notRequest")
+	problemType("application/json", `{"using": ["urn:bogus"], "methodCalls": []}`, "unknownCapability")
+	calls := strings.Repeat(`["Core/echo", {}, "c"],`, maxCallsInRequest+1)
+	problemType("application/json", fmt.Sprintf(`{"using": [], "methodCalls": [%s]}`, strings.TrimSuffix(calls, ",")), "limit")
+}
+
+func TestEvalPointer(t *testing.T) {
+	var v any
+	err := json.Unmarshal([]byte(`{"a": [{"b": [1, 2]}, {"b": [3]}], "c/d": {"e~f": "x"}}`), &v)
+	tcheck(t, err, "parse")
+
+	test := func(path string, exp any, expErr bool) {
+		t.Helper()
+		r, err := evalPointer(v, path)
+		if (err != nil) != expErr {
+			t.Fatalf("path %q: got err %v, expected error %v", path, err, expErr)
+		}
+		if err == nil && !reflect.DeepEqual(r, exp) {
+			t.Fatalf("path %q: got %v, expected %v", path, r, exp)
+		}
+	}
+	test("/a/*/b", []any{1.0, 2.0, 3.0}, false)
+	test("/a/1/b/0", 3.0, false)
+	test("/c~1d/e~0f", "x", false)
+	test("/a/2", nil, true)
+	test("/a/01", nil, true)
+	test("/x", nil, true)
+	test("a", nil, true)
+}
+
+func TestBlob(t *testing.T) {
+	defer setup(t)()
+
+	var up uploadResponse
+	xjson(t, do(t, "POST", "/jmap/upload/mjl/", "text/plain", "hello world", true), http.StatusCreated, &up)
+	if up.AccountID != "mjl" || up.Type != "text/plain" || up.Size != 11 || !strings.HasPrefix(up.BlobID, "u") {
+		t.Fatalf("unexpected upload response %#v", up)
+	}
+	resp := do(t, "POST", "/jmap/upload/other/", "text/plain", "hello world", true)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("got status %d for upload to other account, expected 404", resp.StatusCode)
+	}
+
+	download := func(path string, expStatus int, expBody string) *http.Response {
+		t.Helper()
+		resp := do(t, "GET", path, "", "", true)
+		buf, err := io.ReadAll(resp.Body)
+		tcheck(t, err, "read body")
+		if resp.StatusCode != expStatus || expBody != "" && string(buf) != expBody {
+			t.Fatalf("download %s: got status %d, body %q, expected %d, %q", path, resp.StatusCode, buf, expStatus, expBody)
+		}
+		return resp
+	}
+	resp = download("/jmap/download/mjl/"+up.BlobID+"/test.txt?type=text/plain", http.StatusOK, "hello world")
+	if ct := resp.Header.Get("Content-Type"); ct != "text/plain" {
+		t.Fatalf("got content-type %q, expected text/plain", ct)
+	}
+	if cd := resp.Header.Get("Content-Disposition"); cd != `attachment; filename=test.txt` {
+		t.Fatalf("got content-disposition %q", cd)
+	}
+	// Active content is never served inline.
+	resp = download("/jmap/download/mjl/"+up.BlobID+"/?type=text/html", http.StatusOK, "hello world")
+	if cd, csp := resp.Header.Get("Content-Disposition"), resp.Header.Get("Content-Security-Policy"); cd != "attachment" || !strings.Contains(csp, "sandbox") {
+		t.Fatalf("got content-disposition %q, content-security-policy %q, expected attachment and sandbox", cd, csp)
+	}
+	resp = download("/jmap/download/mjl/"+up.BlobID+"/x?type=bogus", http.StatusOK, "hello world")
+	if ct := resp.Header.Get("Content-Type"); ct != "application/octet-stream" {
+		t.Fatalf("got content-type %q for invalid type, expected application/octet-stream", ct)
+	}
+	download("/jmap/download/mjl/u0000/test.txt", http.StatusNotFound, "")
+	download("/jmap/download/other/"+up.BlobID+"/test.txt", http.StatusNotFound, "")
+
+	// Message data is available as blob.
+	acc, err := store.OpenAccount("mjl")
+	tcheck(t, err, "open account")
+	defer acc.Close()
+	msg := "Subject: test\r\n\r\nbody\r\n"
+	f, err := store.CreateMessageTemp("jmaptest")
+	tcheck(t, err, "create temp")
+	defer os.Remove(f.Name())
+	defer f.Close()
+	_, err = f.Write([]byte(msg))
+	tcheck(t, err, "write message")
+	m := store.Message{Size: int64(len(msg))}
+	acc.WithWLock(func() {
+		err = acc.DeliverMailbox(mlog.New("jmaptest"), "Inbox", &m, f, false)
+	})
+	tcheck(t, err, "deliver")
+	download(fmt.Sprintf("/jmap/download/mjl/m%d/msg.eml?type=message/rfc822", m.ID), http.StatusOK, msg)
+	download(fmt.Sprintf("/jmap/download/mjl/m%d/msg.eml", m.ID+1), http.StatusNotFound, "")
+}
+
+func TestPush(t *testing.T) {
+	defer setup(t)()
+
+	ts := httptest.NewServer(Handler("/jmap/"))
+	defer ts.Close()
+
+	createMailbox := func(name string) {
+		t.Helper()
+		var resp response
+		xjson(t, do(t, "POST", "/jmap/api", "application/json", fmt.Sprintf(`{"using": ["urn:ietf:params:jmap:core", "urn:ietf:params:jmap:mail"], "methodCalls": [["Mailbox/set", {"accountId": "mjl", "create": {"m": {"name": %q}}}, "c0"]]}`, name), true), http.StatusOK, &resp)
+	}
+
+	// Event source, closing after the first state change.
+	req, err := http.NewRequest("GET", ts.URL+"/jmap/eventsource?types=Mailbox,Email&closeafter=state&ping=0", nil)
+	tcheck(t, err, "new request")
+	req.SetBasicAuth("mjl@mox.example", "testtest")
+	resp, err := http.DefaultClient.Do(req)
+	tcheck(t, err, "event source request")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("got status %d, content-type %q for event source", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	createMailbox("Push1")
+	buf, err := io.ReadAll(resp.Body)
+	tcheck(t, err, "read events")
+	event, data, _ := strings.Cut(strings.TrimSpace(string(buf)), "\n")
+	var sc stateChange
+	err = json.Unmarshal([]byte(strings.TrimPrefix(data, "data: ")), &sc)
+	tcheck(t, err, "parse state change")
+	if event != "event: state" || sc.Type != "StateChange" || sc.Changed["mjl"]["Mailbox"] == "" || len(sc.Changed["mjl"]) != 1 {
+		t.Fatalf("unexpected event %q %#v", event, sc)
+	}
+
+	wsRequest := func(origin string) *http.Request {
+		t.Helper()
+		req, err := http.NewRequest("GET", ts.URL+"/jmap/ws", nil)
+		tcheck(t, err, "new request")
+		req.SetBasicAuth("mjl@mox.example", "testtest")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		req.Header.Set("Sec-WebSocket-Protocol", "jmap")
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		return req
+	}
+
+	// Websocket from another site is refused.
+	resp, err = http.DefaultClient.Do(wsRequest("https://evil.example"))
+	tcheck(t, err, "websocket request with other origin")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("got status %d for websocket with other origin, expected 403", resp.StatusCode)
+	}
+
+	// Websocket, with an API request and push.
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	tcheck(t, err, "dial")
+	defer conn.Close()
+	req = wsRequest(ts.URL)
+	err = req.Write(conn)
+	tcheck(t, err, "write websocket request")
+	br := bufio.NewReader(conn)
+	resp, err = http.ReadResponse(br, req)
+	tcheck(t, err, "read websocket response")
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("got status %d, headers %v for websocket", resp.StatusCode, resp.Header)
+	}
+
+	wsWrite := func(msg string) {
+		t.Helper()
+		// Client frames must be masked.
+		mask := []byte{1, 2, 3, 4}
+		frame := []byte{0x80 | wsOpText, 0x80 | 126, byte(len(msg) >> 8), byte(len(msg))}
+		frame = append(frame, mask...)
+		for i := range msg {
+			frame = append(frame, msg[i]^mask[i%4])
+		}
+		_, err := conn.Write(frame)
+		tcheck(t, err, "write frame")
+	}
+	wsRead := func() map[string]any {
+		t.Helper()
+		hdr := make([]byte, 2)
+		_, err := io.ReadFull(br, hdr)
+		tcheck(t, err, "read frame header")
+		size := int(hdr[1])
+		if size == 126 {
+			_, err = io.ReadFull(br, hdr)
+			tcheck(t, err, "read frame size")
+			size = int(hdr[0])<<8 | int(hdr[1])
+		}
+		buf := make([]byte, size)
+		_, err = io.ReadFull(br, buf)
+		tcheck(t, err, "read frame payload")
+		var m map[string]any
+		err = json.Unmarshal(buf, &m)
+		tcheck(t, err, "parse message")
+		return m
+	}
+
+	wsWrite(`{"@type": "Request", "id": "r1", "using": ["urn:ietf:params:jmap:core"], "methodCalls": [["Core/echo", {"hello": true}, "c0"]]}`)
+	if m := wsRead(); m["@type"] != "Response" || m["requestId"] != "r1" || len(list(m, "methodResponses")) != 1 {
+		t.Fatalf("unexpected response %v", m)
+	}
+	wsWrite(`{"@type": "Request", "id": "r2", "using": ["urn:bogus"], "methodCalls": []}`)
+	if m := wsRead(); m["@type"] != "RequestError" || m["requestId"] != "r2" || m["type"] != "urn:ietf:params:jmap:error:unknownCapability" {
+		t.Fatalf("unexpected request error %v", m)
+	}
+	wsWrite(`{"@type": "WebSocketPushEnable", "dataTypes": null}`)
+	// Make sure push is enabled before making the change.
+	wsWrite(`{"@type": "Request", "id": "r3", "using": [], "methodCalls": []}`)
+	wsRead()
+	createMailbox("Push2")
+	if m := wsRead(); m["@type"] != "StateChange" {
+		t.Fatalf("unexpected push %v", m)
+	}
+}
@@ -0,0 +1,840 @@
+package jmapserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/dkim"
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/moxio"
+	"github.com/mjl-/mox/queue"
+	"github.com/mjl-/mox/smtp"
+	"github.com/mjl-/mox/store"
+)
+
+// Identity object. ../rfc/8621 section 6
+type identity struct {
+	ID            string         `json:"id"`
+	Name          string         `json:"name"`
+	Email         string         `json:"email"`
+	ReplyTo       []emailAddress `json:"replyTo"`
+	Bcc           []emailAddress `json:"bcc"`
+	TextSignature string         `json:"textSignature"`
+	HTMLSignature string         `json:"htmlSignature"`
+	MayDelete     bool           `json:"mayDelete"`
+	address       smtp.Address   // Zero for wildcard identities.
+	domain        dns.Domain     // For wildcard identities.
+}
+
+// identityObjectID returns the ID of the identity for an address, "*@domain"
+// for a wildcard identity.
+func identityObjectID(email string) string {
+	return "I" + base64.RawURLEncoding.EncodeToString([]byte(email))
+}
+
+// identities returns the identities of the account: its addresses, and
+// wildcards for catchall destinations and domains in SubmissionFromAllowed.
+func (c *call) identities() []identity {
+	conf, _ := c.acc.Conf()
+	seen := map[string]bool{}
+	var l []identity
+	add := func(s string) {
+		var id identity
+		if strings.HasPrefix(s, "@") {
+			d, err := dns.ParseDomain(s[1:])
+			if err != nil {
+				return
+			}
+			id = identity{Email: "*@" + d.Name(), domain: d}
+		} else {
+			addr, err := smtp.ParseAddress(s)
+			if err != nil {
+				return
+			}
+			id = identity{Email: addr.String(), address: addr}
+		}
+		if seen[id.Email] {
+			return
+		}
+		seen[id.Email] = true
+		id.ID = identityObjectID(id.Email)
+		l = append(l, id)
+	}
+	for s := range conf.Destinations {
+		add(s)
+	}
+	for _, s := range conf.SubmissionFromAllowed {
+		add(s)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Email < l[j].Email
+	})
+	return l
+}
+
+// identityGet returns identities. They are derived from the account
+// configuration and cannot be changed. ../rfc/8621 section 6.1
+func (c *call) identityGet(args json.RawMessage) any {
+	var req getRequest
+	xparseArgs(args, &req)
+	c.xcheckAccount(req.AccountID)
+	xcheckIDs(len(req.IDs), maxObjectsInGet)
+
+	ids := c.identities()
+	resp := getResponse{AccountID: req.AccountID, State: hashState(ids), List: []any{}, NotFound: []string{}}
+	if req.IDs == nil {
+		for _, id := range ids {
+			resp.List = append(resp.List, objectProperties(id, req.Properties))
+		}
+		return resp
+	}
+	byID := map[string]identity{}
+	for _, id := range ids {
+		byID[id.ID] = id
+	}
+	for _, s := range req.IDs {
+		if id, ok := byID[s]; ok {
+			resp.List = append(resp.List, objectProperties(id, req.Properties))
+		} else {
+			resp.NotFound = append(resp.NotFound, s)
+		}
+	}
+	return resp
+}
+
+// identityChanges only returns no changes if the state is current, like
+// mailboxChanges. ../rfc/8621 section 6.2
+func (c *call) identityChanges(args json.RawMessage) any {
+	var req changesRequest
+	xparseArgs(args, &req)
+	c.xcheckAccount(req.AccountID)
+
+	state := hashState(c.identities())
+	if req.SinceState != state {
+		xmethodErrorf("cannotCalculateChanges", "identity changes are not tracked, fetch all identities")
+	}
+	return changesResponse{req.AccountID, state, state, false, []string{}, []string{}, []string{}}
+}
+
+// fromAllowed returns whether the account can use the address as MAIL FROM or
+// message From address, like for SMTP submission: when it is an address of the
+// account, or allowed by its SubmissionFromAllowed setting.
+func (c *call) fromAllowed(addr smtp.Address) bool {
+	accName, _, _, err := mox.FindAccount(addr.Localpart, addr.Domain, true)
+	if err == nil && accName == c.acc.Name {
+		return true
+	}
+	dc, ok := mox.Conf.Domain(addr.Domain)
+	if !ok {
+		return false
+	}
+	lp, err := mox.CanonicalLocalpart(addr.Localpart, dc)
+	if err != nil {
+		return false
+	}
+	conf, _ := c.acc.Conf()
+	for _, s := range conf.SubmissionFromAllowed {
+		if strings.HasPrefix(s, "@") {
+			if d, err := dns.ParseDomain(s[1:]); err == nil && d == addr.Domain {
+				return true
+			}
+		} else if a, err := smtp.ParseAddress(s); err == nil && a.Domain == addr.Domain {
+			if alp, err := mox.CanonicalLocalpart(a.Localpart, dc); err == nil && alp == lp {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// EmailSubmission object. A submission is the group of messages in the queue
+// with the same trace ID, one per recipient, and disappears from the queue once
+// delivered. ../rfc/8621 section 7
+type submission struct {
+	ID             string                    `json:"id"`
+	IdentityID     string                    `json:"identityId"`
+	EmailID        *string                   `json:"emailId"` // Nil if no email in the account has the Message-ID.
+	ThreadID       *string                   `json:"threadId"`
+	Envelope       envelope                  `json:"envelope"`
+	SendAt         string                    `json:"sendAt"`
+	UndoStatus     string                    `json:"undoStatus"`
+	DeliveryStatus map[string]deliveryStatus `json:"deliveryStatus"`
+	DSNBlobIDs     []string                  `json:"dsnBlobIds"`
+	MDNBlobIDs     []string                  `json:"mdnBlobIds"`
+	queueIDs       []int64
+	sendAt         time.Time
+}
+
+type envelope struct {
+	MailFrom envelopeAddress   `json:"mailFrom"`
+	RcptTo   []envelopeAddress `json:"rcptTo"`
+}
+
+type envelopeAddress struct {
+	Email      string             `json:"email"`
+	Parameters map[string]*string `json:"parameters"` // SMTP parameters are not supported.
+}
+
+type deliveryStatus struct {
+	SMTPReply string `json:"smtpReply"`
+	Delivered string `json:"delivered"`
+	Displayed string `json:"displayed"`
+}
+
+// submissionObjectID returns the ID of the submission with a trace ID, which
+// is already in base64url.
+func submissionObjectID(traceID string) string {
+	return "S" + traceID
+}
+
+// xsubmissions returns the queued submissions of the account, sorted by time
+// of submission. The email of a submission is looked up by the Message-ID
+// header of the queued message.
+func (c *call) xsubmissions() []*submission {
+	qmsgs, err := queue.List(c.ctx)
+	xcheckf(err, "listing queue")
+
+	bytrace := map[string]*submission{}
+	var l []*submission
+	for _, qm := range qmsgs {
+		// DSNs and copies for journal addresses have an empty MAIL FROM.
+		if qm.SenderAccount != c.acc.Name || qm.SenderLocalpart == "" || qm.TraceID == "" {
+			continue
+		}
+		s := bytrace[qm.TraceID]
+		if s == nil {
+			mailFrom := qm.Sender()
+			var identityID string
+			if addr, err := smtp.ParseAddress(mailFrom.XString(true)); err == nil {
+				identityID = c.identityFor(addr)
+			}
+			s = &submission{
+				ID:             submissionObjectID(qm.TraceID),
+				IdentityID:     identityID,
+				Envelope:       envelope{envelopeAddress{Email: mailFrom.XString(true)}, []envelopeAddress{}},
+				UndoStatus:     "pending",
+				DeliveryStatus: map[string]deliveryStatus{},
+				DSNBlobIDs:     []string{},
+				MDNBlobIDs:     []string{},
+				sendAt:         qm.Queued,
+			}
+			s.EmailID, s.ThreadID = c.xsubmissionEmail(qm)
+			bytrace[qm.TraceID] = s
+			l = append(l, s)
+		}
+		rcpt := qm.Recipient().XString(true)
+		s.Envelope.RcptTo = append(s.Envelope.RcptTo, envelopeAddress{Email: rcpt})
+		reply := "250 2.1.5 Queued"
+		if qm.LastError != "" {
+			reply = qm.LastError
+		}
+		s.DeliveryStatus[rcpt] = deliveryStatus{reply, "queued", "unknown"}
+		s.queueIDs = append(s.queueIDs, qm.ID)
+		if qm.Queued.Before(s.sendAt) {
+			s.sendAt = qm.Queued
+		}
+	}
+	for _, s := range l {
+		s.SendAt = s.sendAt.UTC().Format(time.RFC3339)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		if !l[i].sendAt.Equal(l[j].sendAt) {
+			return l[i].sendAt.Before(l[j].sendAt)
+		}
+		return l[i].ID < l[j].ID
+	})
+	return l
+}
+
+// identityFor returns the ID of the identity for an address, or an empty
+// string.
+func (c *call) identityFor(addr smtp.Address) string {
+	var wildcard string
+	for _, id := range c.identities() {
+		if id.address == addr {
+			return id.ID
+		} else if id.domain == addr.Domain {
+			wildcard = id.ID
+		}
+	}
+	return wildcard
+}
+
+// xsubmissionEmail returns the email and thread of a queued message, found by
+// its Message-ID header. The oldest matching message is used, later copies can
+// be deliveries to the account itself.
+func (c *call) xsubmissionEmail(qm queue.Msg) (emailID, threadID *string) {
+	f, err := queue.OpenMessage(c.ctx, qm.ID)
+	if err != nil {
+		c.log.Debugx("opening queued message for submission", err, mlog.Field("queuemsgid", qm.ID))
+		return nil, nil
+	}
+	defer func() {
+		err := f.Close()
+		c.log.Check(err, "closing queued message")
+	}()
+	r := textproto.NewReader(bufio.NewReader(io.MultiReader(bytes.NewReader(qm.MsgPrefix), f)))
+	h, err := r.ReadMIMEHeader()
+	if err != nil && len(h) == 0 {
+		return nil, nil
+	}
+	msgID := strings.TrimSpace(h.Get("Message-Id"))
+	if msgID == "" {
+		return nil, nil
+	}
+	c.xdbread(func(tx *bstore.Tx) {
+		q := bstore.QueryTx[store.Message](tx)
+		q.FilterNonzero(store.Message{MessageID: msgID})
+		q.SortAsc("ID")
+		q.Limit(1)
+		m, err := q.Get()
+		if err == bstore.ErrAbsent {
+			return
+		}
+		xcheckf(err, "looking up email for submission")
+		eid := emailObjectID(m)
+		tid := m.ThreadObjectID()
+		emailID, threadID = &eid, &tid
+	})
+	return
+}
+
+// submissionGet returns queued submissions. ../rfc/8621 section 7.1
+func (c *call) submissionGet(args json.RawMessage) any {
+	var req getRequest
+	xparseArgs(args, &req)
+	c.xcheckAccount(req.AccountID)
+	xcheckIDs(len(req.IDs), maxObjectsInGet)
+
+	l := c.xsubmissions()
+	resp := getResponse{AccountID: req.AccountID, State: hashState(l), List: []any{}, NotFound: []string{}}
+	if req.IDs == nil {
+		for _, s := range l {
+			resp.List = append(resp.List, objectProperties(s, req.Properties))
+		}
+		return resp
+	}
+	byID := map[string]*submission{}
+	for _, s := range l {
+		byID[s.ID] = s
+	}
+	for _, id := range req.IDs {
+		if s, ok := byID[c.resolveID(id)]; ok {
+			resp.List = append(resp.List, objectProperties(s, req.Properties))
+		} else {
+			resp.NotFound = append(resp.NotFound, id)
+		}
+	}
+	return resp
+}
+
+// submissionChanges only returns no changes if the state is current.
+// ../rfc/8621 section 7.2
+func (c *call) submissionChanges(args json.RawMessage) any {
+	var req changesRequest
+	xparseArgs(args, &req)
+	c.xcheckAccount(req.AccountID)
+
+	state := hashState(c.xsubmissions())
+	if req.SinceState != state {
+		xmethodErrorf("cannotCalculateChanges", "submission changes are not tracked, fetch all submissions")
+	}
+	return changesResponse{req.AccountID, state, state, false, []string{}, []string{}, []string{}}
+}
+
+// Filter condition for EmailSubmission/query. ../rfc/8621 section 7.3
+type submissionFilter struct {
+	IdentityIDs []string   `json:"identityIds"`
+	EmailIDs    []string   `json:"emailIds"`
+	ThreadIDs   []string   `json:"threadIds"`
+	UndoStatus  string     `json:"undoStatus"`
+	Before      *time.Time `json:"before"`
+	After       *time.Time `json:"after"`
+}
+
+func (f submissionFilter) match(s *submission) bool {
+	in := func(l []string, v *string) bool {
+		if l == nil {
+			return true
+		}
+		for _, e := range l {
+			if v != nil && e == *v {
+				return true
+			}
+		}
+		return false
+	}
+	return in(f.IdentityIDs, &s.IdentityID) &&
+		in(f.EmailIDs, s.EmailID) &&
+		in(f.ThreadIDs, s.ThreadID) &&
+		(f.UndoStatus == "" || f.UndoStatus == s.UndoStatus) &&
+		(f.Before == nil || s.sendAt.Before(*f.Before)) &&
+		(f.After == nil || !s.sendAt.Before(*f.After))
+}
+
+// submissionQuery returns the IDs of queued submissions, sorted by sentAt.
+// Filter operators are not supported. ../rfc/8621 section 7.3
+func (c *call) submissionQuery(args json.RawMessage) any {
+	var req queryRequest
+	xparseArgs(args, &req)
+	c.xcheckAccount(req.AccountID)
+
+	var f submissionFilter
+	if len(req.Filter) > 0 && string(req.Filter) != "null" {
+		dec := json.NewDecoder(bytes.NewReader(req.Filter))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&f); err != nil {
+			xmethodErrorf("unsupportedFilter", "parsing filter: %v", err)
+		}
+	}
+	desc := false
+	for i, cmp := range req.Sort {
+		if cmp.Property != "sentAt" || i > 0 {
+			xmethodErrorf("unsupportedSort", "can only sort by sentAt")
+		}
+		desc = cmp.IsAscending != nil && !*cmp.IsAscending
+	}
+
+	l := c.xsubmissions()
+	ids := []string{}
+	for _, s := range l {
+		if f.match(s) {
+			ids = append(ids, s.ID)
+		}
+	}
+	if desc {
+		for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+			ids[i], ids[j] = ids[j], ids[i]
+		}
+	}
+	resp := queryResponse{AccountID: req.AccountID, QueryState: hashState(l), CanCalculateChanges: false}
+	resp.Position, resp.IDs = xpage(req, ids)
+	if req.CalculateTotal {
+		n := int64(len(ids))
+		resp.Total = &n
+	}
+	return resp
+}
+
+// Properties for creating an EmailSubmission. ../rfc/8621 section 7.5
+type submissionCreate struct {
+	IdentityID string    `json:"identityId"`
+	EmailID    string    `json:"emailId"`
+	Envelope   *envelope `json:"envelope"`
+}
+
+// submissionSet creates submissions by queueing an email for delivery, and
+// cancels queued submissions. Emails are checked like messages submitted over
+// SMTP: the From address must be allowed, and the limits for outgoing messages
+// apply. ../rfc/8621 section 7.5
+func (c *call) submissionSet(args json.RawMessage) any {
+	var req struct {
+		setRequest
+		OnSuccessUpdateEmail  map[string]map[string]json.RawMessage `json:"onSuccessUpdateEmail"`
+		OnSuccessDestroyEmail []string                              `json:"onSuccessDestroyEmail"`
+	}
+	xparseArgs(args, &req)
+	c.xcheckAccount(req.AccountID)
+	xcheckIDs(len(req.Create)+len(req.Update)+len(req.Destroy), maxObjectsInSet)
+
+	state := hashState(c.xsubmissions())
+	if req.IfInState != nil && *req.IfInState != state {
+		xmethodErrorf("stateMismatch", "state does not match")
+	}
+	resp := newSetResponse(req.AccountID, state)
+
+	// Email IDs of successfully created and updated submissions, by submission ID
+	// and "#" with creation ID, for the implicit Email/set.
+	emailIDs := map[string]string{}
+
+	for cid, raw := range req.Create {
+		if serr := setObject(func() {
+			var sc submissionCreate
+			dec := json.NewDecoder(bytes.NewReader(raw))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&sc); err != nil {
+				xsetErrorf("invalidProperties", "parsing submission: %v", err)
+			}
+			id, emailID := c.xsubmit(sc)
+			c.createdIDs[cid] = id
+			resp.Created[cid] = map[string]any{"id": id, "undoStatus": "pending", "sendAt": time.Now().UTC().Format(time.RFC3339)}
+			emailIDs["#"+cid] = emailID
+			emailIDs[id] = emailID
+		}); serr != nil {
+			resp.NotCreated[cid] = *serr
+		}
+	}
+
+	if len(req.Update) > 0 {
+		bytrace := map[string]*submission{}
+		for _, s := range c.xsubmissions() {
+			bytrace[s.ID] = s
+		}
+		for id, patch := range req.Update {
+			if serr := setObject(func() {
+				s := bytrace[id]
+				if s == nil {
+					xsetErrorf("notFound", "unknown submission, or already delivered")
+				}
+				for k, v := range patch {
+					var status string
+					if k != "undoStatus" {
+						xinvalidProperty(k, "property %q cannot be changed", k)
+					} else if err := json.Unmarshal(v, &status); err != nil || status != "canceled" {
+						xinvalidProperty(k, "undoStatus can only be changed to canceled")
+					}
+				}
+				var n int
+				for _, qid := range s.queueIDs {
+					nn, err := queue.Drop(c.ctx, qid, "", "")
+					xcheckf(err, "removing message from queue")
+					n += nn
+				}
+				if n == 0 {
+					xsetErrorf("cannotUnsend", "submission already delivered")
+				}
+				resp.Updated[id] = nil
+				if s.EmailID != nil {
+					emailIDs[id] = *s.EmailID
+				}
+			}); serr != nil {
+				resp.NotUpdated[id] = *serr
+			}
+		}
+	}
+
+	for _, id := range req.Destroy {
+		resp.NotDestroyed[id] = setError{Type: "forbidden", Description: "submissions are removed from the queue after delivery, cancel with undoStatus"}
+	}
+
+	resp.NewState = hashState(c.xsubmissions())
+
+	// Changes to emails of successful submissions are made through an implicit
+	// Email/set call. ../rfc/8621 section 7.5
+	update := map[string]map[string]json.RawMessage{}
+	for k, patch := range req.OnSuccessUpdateEmail {
+		if emailID, ok := emailIDs[k]; ok {
+			update[emailID] = patch
+		}
+	}
+	destroy := []string{}
+	for _, k := range req.OnSuccessDestroyEmail {
+		if emailID, ok := emailIDs[k]; ok {
+			destroy = append(destroy, emailID)
+		}
+	}
+	if len(update) > 0 || len(destroy) > 0 {
+		buf, err := json.Marshal(setRequest{AccountID: req.AccountID, Update: update, Destroy: destroy})
+		xcheckf(err, "marshal implicit email set")
+		c.implicit = append(c.implicit, invocation{"Email/set", buf, c.callID})
+	}
+	return resp
+}
+
+// xsubmit queues the email of a submission for delivery, returning the
+// submission and email ID.
+func (c *call) xsubmit(sc submissionCreate) (string, string) {
+	var identityOK bool
+	for _, id := range c.identities() {
+		identityOK = identityOK || id.ID == sc.IdentityID
+	}
+	if !identityOK {
+		xinvalidProperty("identityId", "unknown identity")
+	}
+	msgID, ok := c.xemailID(sc.EmailID)
+	m := store.Message{ID: msgID}
+	var err error
+	if ok {
+		err = c.acc.DB.Get(c.ctx, &m)
+	}
+	if !ok || err == bstore.ErrAbsent {
+		xinvalidProperty("emailId", "unknown email")
+	}
+	xcheckf(err, "get email")
+
+	// Write the message without Bcc header to a temporary file for queueing.
+	f, err := store.CreateMessageTemp("jmap-submit")
+	xcheckf(err, "creating temporary file for submission")
+	defer func() {
+		err := f.Close()
+		c.log.Check(err, "closing temporary submission file")
+		err = os.Remove(f.Name())
+		c.log.Check(err, "removing temporary submission file", mlog.Field("path", f.Name()))
+	}()
+	// The header is parsed from the original message: recipients in its Bcc header
+	// are needed for the envelope.
+	mr := c.acc.MessageReader(m)
+	msgFrom, header, fromErr := message.From(mr)
+	err = writeWithoutBcc(f, mr)
+	if cerr := mr.Close(); err == nil {
+		err = cerr
+	}
+	xcheckf(err, "writing message for submission")
+	if fromErr != nil {
+		xsetErrorf("invalidEmail", "cannot parse header or From address: %v", fromErr)
+	}
+	if !c.fromAllowed(msgFrom) {
+		xsetErrorf("forbiddenFrom", "not allowed to send as %s", msgFrom)
+	}
+	// ../rfc/5321:3233
+	if header.Values("Return-Path") != nil {
+		xsetErrorf("invalidEmail", "email must not have Return-Path header")
+	}
+
+	// Envelope, from the From header and recipient headers if absent.
+	// ../rfc/8621 section 7
+	var mailFrom smtp.Address
+	var rcptTo []smtp.Address
+	if sc.Envelope != nil {
+		xcheckParameters := func(ea envelopeAddress) {
+			for _, v := range ea.Parameters {
+				if v != nil {
+					xinvalidProperty("envelope", "smtp parameters not supported")
+				}
+			}
+		}
+		xcheckParameters(sc.Envelope.MailFrom)
+		mailFrom, err = smtp.ParseAddress(sc.Envelope.MailFrom.Email)
+		if err != nil {
+			xinvalidProperty("envelope", "invalid mailFrom: %v", err)
+		}
+		if !c.fromAllowed(mailFrom) {
+			xsetErrorf("forbiddenMailFrom", "not allowed to send as %s", mailFrom)
+		}
+		var invalid []string
+		for _, ea := range sc.Envelope.RcptTo {
+			xcheckParameters(ea)
+			addr, err := smtp.ParseAddress(ea.Email)
+			if err != nil {
+				invalid = append(invalid, ea.Email)
+			}
+			rcptTo = append(rcptTo, addr)
+		}
+		if len(invalid) > 0 {
+			xsetErrorf("invalidRecipients", "invalid recipient addresses: %s", strings.Join(invalid, ", "))
+		}
+	} else {
+		mailFrom = msgFrom
+		if s := header.Get("Sender"); s != "" {
+			a, err := mail.ParseAddress(s)
+			if err == nil {
+				mailFrom, err = smtp.ParseAddress(a.Address)
+			}
+			if err != nil {
+				xsetErrorf("invalidEmail", "parsing sender header: %v", err)
+			}
+			if !c.fromAllowed(mailFrom) {
+				xsetErrorf("forbiddenMailFrom", "not allowed to send as %s", mailFrom)
+			}
+		}
+		seen := map[smtp.Address]bool{}
+		var invalid []string
+		for _, h := range []string{"To", "Cc", "Bcc"} {
+			for _, s := range header.Values(h) {
+				l, err := mail.ParseAddressList(s)
+				if err != nil {
+					invalid = append(invalid, s)
+					continue
+				}
+				for _, a := range l {
+					addr, err := smtp.ParseAddress(a.Address)
+					if err != nil {
+						invalid = append(invalid, a.Address)
+					} else if !seen[addr] {
+						seen[addr] = true
+						rcptTo = append(rcptTo, addr)
+					}
+				}
+			}
+		}
+		if len(invalid) > 0 {
+			xsetErrorf("invalidRecipients", "invalid recipient addresses: %s", strings.Join(invalid, ", "))
+		}
+	}
+	if len(rcptTo) == 0 {
+		xsetErrorf("noRecipients", "email has no recipients")
+	}
+
+	c.xcheckOutgoingLimits(rcptTo)
+	if err := c.acc.CheckDomainOutgoing(c.ctx, c.log, len(rcptTo)); err != nil {
+		xsetErrorf("forbiddenToSend", "%s", err)
+	}
+
+	smtputf8 := mailFrom.Localpart.IsInternational()
+	for _, addr := range rcptTo {
+		smtputf8 = smtputf8 || addr.Localpart.IsInternational()
+	}
+	has8bit := xhas8bit(f)
+
+	// Add Message-Id and Date headers if missing. ../rfc/5321:4131 ../rfc/6409:751
+	var msgPrefix []byte
+	if header.Get("Message-Id") == "" {
+		msgPrefix = append(msgPrefix, fmt.Sprintf("Message-Id: <%s>\r\n", mox.MessageIDGen(smtputf8))...)
+	}
+	if header.Get("Date") == "" {
+		msgPrefix = append(msgPrefix, "Date: "+time.Now().Format(message.RFC5322Z)+"\r\n"...)
+	}
+
+	confDom, ok := mox.Conf.Domain(msgFrom.Domain)
+	if !ok {
+		xcheckf(fmt.Errorf("domain %s disappeared", msgFrom.Domain), "dkim signing")
+	}
+	if len(confDom.DKIM.Sign) > 0 {
+		if canonical, err := mox.CanonicalLocalpart(msgFrom.Localpart, confDom); err != nil {
+			c.log.Errorx("determining canonical localpart for dkim signing", err, mlog.Field("localpart", msgFrom.Localpart))
+		} else if dkimHeaders, err := dkim.Sign(c.ctx, canonical, msgFrom.Domain, confDom.DKIM, smtputf8, store.FileMsgReader(msgPrefix, f)); err != nil {
+			c.log.Errorx("dkim sign for domain", err, mlog.Field("domain", msgFrom.Domain))
+		} else {
+			msgPrefix = append([]byte(dkimHeaders), msgPrefix...)
+		}
+	}
+
+	fi, err := f.Stat()
+	xcheckf(err, "stat submission file")
+	size := int64(len(msgPrefix)) + fi.Size()
+
+	if err := c.acc.Journal(c.log, "sent", msgPrefix, f); err != nil {
+		c.log.Errorx("writing message to journal", err)
+	}
+	if conf, _ := c.acc.Conf(); conf.JournalAddress != "" {
+		if _, err := queue.Add(c.ctx, c.log, c.acc.Name, smtp.Path{}, conf.JournalPath, has8bit, smtputf8, size, msgPrefix, f, nil, "NEVER", false); err != nil {
+			c.log.Errorx("queueing message for journal address", err, mlog.Field("address", conf.JournalAddress))
+		}
+	}
+
+	traceID := queue.NewTraceID()
+	from := smtp.Path{Localpart: mailFrom.Localpart, IPDomain: dns.IPDomain{Domain: mailFrom.Domain}}
+	for _, addr := range rcptTo {
+		rcpt := smtp.Path{Localpart: addr.Localpart, IPDomain: dns.IPDomain{Domain: addr.Domain}}
+		_, err := queue.AddOpts(c.ctx, c.log, c.acc.Name, from, rcpt, has8bit, smtputf8, size, msgPrefix, f, nil, "", false, queue.AddOptions{TraceID: traceID})
+		xcheckf(err, "queueing message")
+		c.log.Info("message queued for delivery", mlog.Field("mailfrom", from), mlog.Field("rcptto", rcpt), mlog.Field("msgsize", size))
+
+		err = c.acc.DB.Insert(c.ctx, &store.Outgoing{Recipient: rcpt.XString(true)})
+		xcheckf(err, "adding outgoing message")
+	}
+	return submissionObjectID(traceID), emailObjectID(m)
+}
+
+// xhas8bit returns whether the message in f has bytes with the high bit set, for
+// which the 8BITMIME SMTP extension is needed.
+func xhas8bit(f *os.File) bool {
+	br := bufio.NewReader(&moxio.AtReader{R: f})
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			return false
+		}
+		xcheckf(err, "reading message")
+		if b >= 0x80 {
+			return true
+		}
+	}
+}
+
+// writeWithoutBcc copies the message in r to w, leaving out Bcc headers.
+// ../rfc/8621 section 7.5
+func writeWithoutBcc(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriter(w)
+	var skip bool
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if line == "\r\n" || line == "\n" {
+			// End of header.
+			if _, err := bw.WriteString(line); err != nil {
+				return err
+			}
+			break
+		}
+		if !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t") {
+			k, _, _ := strings.Cut(line, ":")
+			skip = strings.EqualFold(strings.TrimSpace(k), "bcc")
+		}
+		if !skip {
+			if _, err := bw.WriteString(line); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return bw.Flush()
+		}
+	}
+	if _, err := io.Copy(bw, br); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// xcheckOutgoingLimits fails with forbiddenToSend if the account would exceed its
+// limits for outgoing messages and first-time recipients in a 24 hour window,
+// like for SMTP submission.
+func (c *call) xcheckOutgoingLimits(rcptTo []smtp.Address) {
+	c.xdbread(func(tx *bstore.Tx) {
+		conf, _ := c.acc.Conf()
+		msgmax := conf.MaxOutgoingMessagesPerDay
+		if msgmax == 0 {
+			msgmax = 1000
+		}
+		rcptmax := conf.MaxFirstTimeRecipientsPerDay
+		if rcptmax == 0 {
+			rcptmax = 200
+		}
+
+		rcpts := map[string]time.Time{}
+		n := 0
+		err := bstore.QueryTx[store.Outgoing](tx).FilterGreater("Submitted", time.Now().Add(-24*time.Hour)).ForEach(func(o store.Outgoing) error {
+			n++
+			if rcpts[o.Recipient].IsZero() || o.Submitted.Before(rcpts[o.Recipient]) {
+				rcpts[o.Recipient] = o.Submitted
+			}
+			return nil
+		})
+		xcheckf(err, "querying message recipients in past 24h")
+		if n+len(rcptTo) > msgmax {
+			xsetErrorf("forbiddenToSend", "max number of messages (%d) over past 24h reached, try increasing per-account setting MaxOutgoingMessagesPerDay", msgmax)
+		}
+		if n+len(rcptTo) < rcptmax {
+			return
+		}
+
+		isFirstTime := func(rcpt string, before time.Time) bool {
+			exists, err := bstore.QueryTx[store.Outgoing](tx).FilterNonzero(store.Outgoing{Recipient: rcpt}).FilterLess("Submitted", before).Exists()
+			xcheckf(err, "checking in database whether recipient is first-time")
+			return !exists
+		}
+		firsttime := 0
+		now := time.Now()
+		for _, addr := range rcptTo {
+			if isFirstTime(smtp.Path{Localpart: addr.Localpart, IPDomain: dns.IPDomain{Domain: addr.Domain}}.XString(true), now) {
+				firsttime++
+			}
+		}
+		for r, t := range rcpts {
+			if isFirstTime(r, t) {
+				firsttime++
+			}
+		}
+		if firsttime > rcptmax {
+			xsetErrorf("forbiddenToSend", "max number of new/first-time recipients (%d) over past 24h reached, try increasing per-account setting MaxFirstTimeRecipientsPerDay", rcptmax)
+		}
+	})
+}
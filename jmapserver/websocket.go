@@ -0,0 +1,277 @@
+package jmapserver
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Websocket opcodes. ../rfc/6455:1041
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+// Status codes for close frames. ../rfc/6455:2163
+const (
+	wsCloseNormal      = 1000
+	wsCloseGoingAway   = 1001
+	wsCloseProtocol    = 1002
+	wsCloseUnsupported = 1003
+	wsCloseTooBig      = 1009
+)
+
+// wsCloseError is returned when reading a message fails for a reason that
+// should be sent to the client in a close frame.
+type wsCloseError struct {
+	code   int
+	reason string
+}
+
+func (e wsCloseError) Error() string {
+	return fmt.Sprintf("websocket close %d: %s", e.code, e.reason)
+}
+
+// wsConn is a server-side websocket connection, after the opening handshake. Only
+// what JMAP needs is implemented: no extensions, no streaming of messages.
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	sync.Mutex // For writing frames, from the connection and its reader goroutine.
+}
+
+// wsUpgrade checks the websocket opening handshake in r for protocol, and
+// hijacks the connection to respond to it. On errors, an http response has been
+// written (if the connection was not hijacked yet) and an error is returned.
+func wsUpgrade(w http.ResponseWriter, r *http.Request, protocol string) (*wsConn, error) {
+	// ../rfc/6455:1160
+	if v := r.Header.Get("Sec-WebSocket-Version"); v != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "400 - bad request - websockets only supported with version 13", http.StatusBadRequest)
+		return nil, fmt.Errorf("Sec-WebSocket-Version %q not supported", v)
+	}
+	// ../rfc/6455:1153
+	if !headerHasToken(r.Header, "Upgrade", "websocket") || !headerHasToken(r.Header, "Connection", "upgrade") {
+		http.Error(w, "400 - bad request - websocket upgrade required", http.StatusBadRequest)
+		return nil, errors.New("missing websocket upgrade headers")
+	}
+	// ../rfc/6455:1156
+	wskey := r.Header.Get("Sec-WebSocket-Key")
+	if key, err := base64.StdEncoding.DecodeString(wskey); err != nil || len(key) != 16 {
+		http.Error(w, "400 - bad request - websockets requires Sec-WebSocket-Key with 16 bytes base64-encoded value", http.StatusBadRequest)
+		return nil, fmt.Errorf("bad Sec-WebSocket-Key %q", wskey)
+	}
+	// ../rfc/6455:1188
+	if !headerHasToken(r.Header, "Sec-WebSocket-Protocol", protocol) {
+		http.Error(w, fmt.Sprintf("400 - bad request - websocket subprotocol %q required", protocol), http.StatusBadRequest)
+		return nil, fmt.Errorf("websocket subprotocol %q not requested", protocol)
+	}
+
+	// Browsers send cached basic auth credentials with cross-site websocket
+	// requests, and don't apply CORS to them. Only same-origin requests are allowed,
+	// so other sites cannot use the JMAP session of a user. Non-browser clients
+	// typically don't send an Origin. ../rfc/6455 section 10.2
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || !strings.EqualFold(u.Host, r.Host) {
+			http.Error(w, "403 - forbidden - websocket origin does not match host", http.StatusForbidden)
+			return nil, fmt.Errorf("websocket origin %q does not match host %q", origin, r.Host)
+		}
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "501 - not implemented - cannot turn this connection into websocket", http.StatusNotImplemented)
+		return nil, errors.New("connection cannot be hijacked")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, "500 - internal server error - cannot turn this connection into websocket", http.StatusInternalServerError)
+		return nil, fmt.Errorf("hijack connection: %w", err)
+	}
+	// Deadlines from the http server no longer apply.
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("clearing deadline: %w", err)
+	}
+
+	// ../rfc/6455:1281
+	accept := sha1.Sum([]byte(wskey + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(accept[:]) + "\r\n" +
+		"Sec-WebSocket-Protocol: " + protocol + "\r\n" +
+		"\r\n"
+	if _, err := brw.WriteString(resp); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("writing handshake response: %w", err)
+	} else if err := brw.Flush(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("writing handshake response: %w", err)
+	}
+	return &wsConn{conn: conn, br: brw.Reader}, nil
+}
+
+// headerHasToken returns whether the comma-separated values of header k contain
+// token, compared case-insensitively.
+func headerHasToken(h http.Header, k, token string) bool {
+	for _, v := range h.Values(k) {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(textproto.TrimString(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readMessage returns the payload of the next text message. Fragmented messages
+// are reassembled, and pings are answered. A close frame from the client results
+// in io.EOF. Messages larger than maxSize, and binary messages, result in a
+// wsCloseError.
+func (c *wsConn) readMessage(maxSize int64) ([]byte, error) {
+	var msg []byte
+	var started bool
+	for {
+		fin, op, payload, err := c.readFrame(maxSize - int64(len(msg)))
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			// Echo the status code. ../rfc/6455:1467
+			if len(payload) >= 2 {
+				payload = payload[:2]
+			}
+			c.writeFrame(wsOpClose, payload)
+			return nil, io.EOF
+		case wsOpText:
+			if started {
+				return nil, wsCloseError{wsCloseProtocol, "new message before end of fragmented message"}
+			}
+			started = true
+		case wsOpContinuation:
+			if !started {
+				return nil, wsCloseError{wsCloseProtocol, "continuation frame without message"}
+			}
+		case wsOpBinary:
+			return nil, wsCloseError{wsCloseUnsupported, "only text messages supported"}
+		default:
+			return nil, wsCloseError{wsCloseProtocol, fmt.Sprintf("unknown opcode %d", op)}
+		}
+		msg = append(msg, payload...)
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+// readFrame reads a single frame from the client. ../rfc/6455:1004
+func (c *wsConn) readFrame(maxSize int64) (fin bool, op int, payload []byte, rerr error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = hdr[0]&0x80 != 0
+	if hdr[0]&0x70 != 0 {
+		return false, 0, nil, wsCloseError{wsCloseProtocol, "reserved bits set"}
+	}
+	op = int(hdr[0] & 0x0f)
+	// Frames from clients must be masked. ../rfc/6455:1085
+	if hdr[1]&0x80 == 0 {
+		return false, 0, nil, wsCloseError{wsCloseProtocol, "frame not masked"}
+	}
+	size := int64(hdr[1] & 0x7f)
+	switch size {
+	case 126:
+		var buf [2]byte
+		if _, err := io.ReadFull(c.br, buf[:]); err != nil {
+			return false, 0, nil, err
+		}
+		size = int64(binary.BigEndian.Uint16(buf[:]))
+	case 127:
+		var buf [8]byte
+		if _, err := io.ReadFull(c.br, buf[:]); err != nil {
+			return false, 0, nil, err
+		}
+		size = int64(binary.BigEndian.Uint64(buf[:]) & (1<<63 - 1))
+	}
+	// Control frames are small and not fragmented. ../rfc/6455:1280
+	if op >= wsOpClose && (size > 125 || !fin) {
+		return false, 0, nil, wsCloseError{wsCloseProtocol, "invalid control frame"}
+	}
+	if op < wsOpClose && size > maxSize {
+		return false, 0, nil, wsCloseError{wsCloseTooBig, "message too large"}
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, size)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// writeFrame writes a single unmasked, unfragmented frame.
+func (c *wsConn) writeFrame(op int, payload []byte) error {
+	c.Lock()
+	defer c.Unlock()
+
+	hdr := []byte{0x80 | byte(op)}
+	n := len(payload)
+	switch {
+	case n < 126:
+		hdr = append(hdr, byte(n))
+	case n <= 0xffff:
+		hdr = append(hdr, 126, 0, 0)
+		binary.BigEndian.PutUint16(hdr[2:], uint16(n))
+	default:
+		hdr = append(hdr, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(hdr[2:], uint64(n))
+	}
+	// A stuck client must not block us forever.
+	if err := c.conn.SetWriteDeadline(time.Now().Add(30 * time.Second)); err != nil {
+		return err
+	}
+	if _, err := c.conn.Write(append(hdr, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// close sends a close frame with code and reason, and closes the connection.
+func (c *wsConn) close(code int, reason string) error {
+	buf := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(buf, uint16(code))
+	buf = append(buf, reason...)
+	c.writeFrame(wsOpClose, buf)
+	return c.conn.Close()
+}
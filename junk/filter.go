@@ -343,19 +343,27 @@ func loadWords(ctx context.Context, db *bstore.DB, l []string, dst map[string]wo
 
 // ClassifyWords returns the spam probability for the given words, and number of recognized ham and spam words.
 func (f *Filter) ClassifyWords(ctx context.Context, words map[string]struct{}) (probability float64, nham, nspam int, rerr error) {
-	if f.closed {
-		return 0, 0, 0, errClosed
-	}
+	probability, topHam, topSpam, err := f.ClassifyWordsTop(ctx, words)
+	return probability, len(topHam), len(topSpam), err
+}
 
-	type xword struct {
-		Word string
-		R    float64
+// TopWord is a word (combination) that contributed to a classification, with its
+// spaminess between 0 (ham) and 1 (spam).
+type TopWord struct {
+	Word string
+	R    float64
+}
+
+// ClassifyWordsTop returns the spam probability for the given words, and the ham
+// and spam words that were used for calculating the probability, most
+// significant first.
+func (f *Filter) ClassifyWordsTop(ctx context.Context, words map[string]struct{}) (probability float64, topHam, topSpam []TopWord, rerr error) {
+	if f.closed {
+		return 0, nil, nil, errClosed
 	}
 
 	var hamHigh float64 = 0
 	var spamLow float64 = 1
-	var topHam []xword
-	var topSpam []xword
 
 	// Find words that should be in the database.
 	lookupWords := []string{}
@@ -384,7 +392,7 @@ func (f *Filter) ClassifyWords(ctx context.Context, words map[string]struct{}) (
 	fetched := map[string]word{}
 	if len(lookupWords) > 0 {
 		if err := loadWords(ctx, f.db, lookupWords, fetched); err != nil {
-			return 0, 0, 0, err
+			return 0, nil, nil, err
 		}
 		for w, c := range fetched {
 			delete(expect, w)
@@ -424,7 +432,7 @@ func (f *Filter) ClassifyWords(ctx context.Context, words map[string]struct{}) (
 			if len(topHam) >= f.TopWords && r > hamHigh {
 				continue
 			}
-			topHam = append(topHam, xword{w, r})
+			topHam = append(topHam, TopWord{w, r})
 			if r > hamHigh {
 				hamHigh = r
 			}
@@ -432,7 +440,7 @@ func (f *Filter) ClassifyWords(ctx context.Context, words map[string]struct{}) (
 			if len(topSpam) >= f.TopWords && r < spamLow {
 				continue
 			}
-			topSpam = append(topSpam, xword{w, r})
+			topSpam = append(topSpam, TopWord{w, r})
 			if r < spamLow {
 				spamLow = r
 			}
@@ -454,11 +462,11 @@ func (f *Filter) ClassifyWords(ctx context.Context, words map[string]struct{}) (
 		return a.R > b.R
 	})
 
-	nham = f.TopWords
+	nham := f.TopWords
 	if nham > len(topHam) {
 		nham = len(topHam)
 	}
-	nspam = f.TopWords
+	nspam := f.TopWords
 	if nspam > len(topSpam) {
 		nspam = len(topSpam)
 	}
@@ -476,7 +484,7 @@ func (f *Filter) ClassifyWords(ctx context.Context, words map[string]struct{}) (
 	f.log.Debug("top words", mlog.Field("hams", topHam), mlog.Field("spams", topSpam))
 
 	prob := 1 / (1 + math.Pow(math.E, eta))
-	return prob, len(topHam), len(topSpam), nil
+	return prob, topHam, topSpam, nil
 }
 
 // ClassifyMessagePath is a convenience wrapper for calling ClassifyMessage on a file.
@@ -153,12 +153,27 @@ func TestFilter(t *testing.T) {
 
 	_, err = spamf.Seek(0, 0)
 	tcheck(t, err, "seek spam message")
-	prob, _, _, _, err = f.ClassifyMessageReader(ctxbg, spamf, spamsize)
+	prob, words, _, _, err := f.ClassifyMessageReader(ctxbg, spamf, spamsize)
 	tcheck(t, err, "classify spam")
 	if prob < 0.9 {
 		t.Fatalf("got prob %v, expected >= 0.9", prob)
 	}
 
+	// Top words explain the same probability, with the spammiest words first.
+	topProb, _, topSpam, err := f.ClassifyWordsTop(ctxbg, words)
+	tcheck(t, err, "classify words with top words")
+	if topProb != prob {
+		t.Fatalf("got prob %v with top words, expected %v", topProb, prob)
+	}
+	if len(topSpam) == 0 || len(topSpam) > params.TopWords {
+		t.Fatalf("got %d top spam words, expected 1 to %d", len(topSpam), params.TopWords)
+	}
+	for i := 1; i < len(topSpam); i++ {
+		if topSpam[i].R > topSpam[i-1].R {
+			t.Fatalf("top spam words not sorted, %v", topSpam)
+		}
+	}
+
 	// Untrain ham & spam.
 	_, err = hamf.Seek(0, 0)
 	tcheck(t, err, "seek ham message")
@@ -45,6 +45,7 @@ import (
 	"github.com/mjl-/mox/tlsrpt"
 	"github.com/mjl-/mox/tlsrptdb"
 	"github.com/mjl-/mox/updates"
+	"github.com/mjl-/mox/webpush"
 )
 
 var (
@@ -79,14 +80,26 @@ var commands = []struct {
 	{"setaccountpassword", cmdSetaccountpassword},
 	{"setadminpassword", cmdSetadminpassword},
 	{"loglevels", cmdLoglevels},
+	{"trace add", cmdTraceAdd},
+	{"trace list", cmdTraceList},
+	{"trace rm", cmdTraceRemove},
 	{"queue list", cmdQueueList},
 	{"queue kick", cmdQueueKick},
 	{"queue drop", cmdQueueDrop},
 	{"queue dump", cmdQueueDump},
+	{"messages find", cmdMessagesFind},
+	{"messages delete", cmdMessagesDelete},
+	{"messages move", cmdMessagesMove},
+	{"messages redeliver", cmdMessagesRedeliver},
+	{"messages transfer", cmdMessagesTransfer},
+	{"dbstats", cmdDBStats},
 	{"import maildir", cmdImportMaildir},
 	{"import mbox", cmdImportMbox},
+	{"import archive", cmdImportArchive},
 	{"export maildir", cmdExportMaildir},
 	{"export mbox", cmdExportMbox},
+	{"export archive", cmdExportArchive},
+	{"export verify", cmdExportVerify},
 	{"localserve", cmdLocalserve},
 	{"help", cmdHelp},
 	{"backup", cmdBackup},
@@ -99,6 +112,10 @@ var commands = []struct {
 	{"config describe-static", cmdConfigDescribeStatic},
 	{"config account add", cmdConfigAccountAdd},
 	{"config account rm", cmdConfigAccountRemove},
+	{"config account suspend", cmdConfigAccountSuspend},
+	{"config account unsuspend", cmdConfigAccountUnsuspend},
+	{"config account schedule-rm", cmdConfigAccountScheduleRemove},
+	{"config account cancel-rm", cmdConfigAccountCancelRemove},
 	{"config address add", cmdConfigAddressAdd},
 	{"config address rm", cmdConfigAddressRemove},
 	{"config domain add", cmdConfigDomainAdd},
@@ -106,6 +123,7 @@ var commands = []struct {
 	{"config describe-sendmail", cmdConfigDescribeSendmail},
 	{"config printservice", cmdConfigPrintservice},
 	{"example", cmdExample},
+	{"messagecatalog", cmdMessageCatalog},
 
 	{"checkupdate", cmdCheckupdate},
 	{"cid", cmdCid},
@@ -124,6 +142,8 @@ var commands = []struct {
 	{"dnsbl checkhealth", cmdDNSBLCheckhealth},
 	{"mtasts lookup", cmdMTASTSLookup},
 	{"retrain", cmdRetrain},
+	{"textindex", cmdTextIndex},
+	{"recalculatemailboxcounts", cmdRecalculateMailboxCounts},
 	{"sendmail", cmdSendmail},
 	{"spf check", cmdSPFCheck},
 	{"spf lookup", cmdSPFLookup},
@@ -131,6 +151,7 @@ var commands = []struct {
 	{"tlsrpt lookup", cmdTLSRPTLookup},
 	{"tlsrpt parsereportmsg", cmdTLSRPTParsereportmsg},
 	{"version", cmdVersion},
+	{"webpush genkey", cmdWebPushGenkey},
 
 	// Not listed.
 	{"helpall", cmdHelpall},
@@ -679,6 +700,99 @@ func ctlcmdConfigAccountRemove(ctl *ctl, account string) {
 	fmt.Println("account removed")
 }
 
+func cmdConfigAccountSuspend(c *cmd) {
+	c.params = "[-tempfail] account"
+	c.help = `Suspend an account and reload the configuration.
+
+Authentication for the account is rejected for IMAP, SMTP submission and the
+web interfaces, and existing IMAP sessions are ended. Incoming email is still
+delivered, unless -tempfail is set, in which case it is rejected with a
+temporary error so remote mail servers retry later.
+`
+	var tempfail bool
+	c.flag.BoolVar(&tempfail, "tempfail", false, "reject incoming email with a temporary error")
+	args := c.Parse()
+	if len(args) != 1 {
+		c.Usage()
+	}
+
+	mustLoadConfig()
+	ctlcmdConfigAccountSuspend(xctl(), args[0], true, tempfail)
+	fmt.Println("account suspended")
+}
+
+func cmdConfigAccountUnsuspend(c *cmd) {
+	c.params = "account"
+	c.help = `Remove the suspension of an account and reload the configuration.
+
+An account that is pending deletion remains suspended until its deletion is
+canceled.
+`
+	args := c.Parse()
+	if len(args) != 1 {
+		c.Usage()
+	}
+
+	mustLoadConfig()
+	ctlcmdConfigAccountSuspend(xctl(), args[0], false, false)
+	fmt.Println("account suspension removed")
+}
+
+func ctlcmdConfigAccountSuspend(ctl *ctl, account string, suspended, tempfail bool) {
+	ctl.xwrite("accountsuspend")
+	ctl.xwrite(account)
+	ctl.xwrite(fmt.Sprintf("%v", suspended))
+	ctl.xwrite(fmt.Sprintf("%v", tempfail))
+	ctl.xreadok()
+}
+
+func cmdConfigAccountScheduleRemove(c *cmd) {
+	c.params = "account days"
+	c.help = `Schedule removal of an account after a grace period of days.
+
+Until the removal, the account is treated as suspended. After the grace period,
+the account is removed from the configuration and its messages are removed from
+the data directory. The journal directory of the account is kept. Accounts on
+litigation hold are not removed. The removal can be canceled with "config
+account cancel-rm".
+`
+	args := c.Parse()
+	if len(args) != 2 {
+		c.Usage()
+	}
+	days, err := strconv.ParseInt(args[1], 10, 64)
+	xcheckf(err, "parsing days")
+	if days < 0 {
+		log.Fatalf("days must be positive")
+	}
+
+	mustLoadConfig()
+	at := time.Now().Add(time.Duration(days) * 24 * time.Hour)
+	ctlcmdConfigAccountDeleteAt(xctl(), args[0], at.UTC().Format(time.RFC3339))
+	fmt.Printf("account removal scheduled at %s\n", at.Format(time.RFC3339))
+}
+
+func cmdConfigAccountCancelRemove(c *cmd) {
+	c.params = "account"
+	c.help = `Cancel a scheduled removal of an account.
+`
+	args := c.Parse()
+	if len(args) != 1 {
+		c.Usage()
+	}
+
+	mustLoadConfig()
+	ctlcmdConfigAccountDeleteAt(xctl(), args[0], "")
+	fmt.Println("account removal canceled")
+}
+
+func ctlcmdConfigAccountDeleteAt(ctl *ctl, account, at string) {
+	ctl.xwrite("accountdeleteat")
+	ctl.xwrite(account)
+	ctl.xwrite(at)
+	ctl.xreadok()
+}
+
 func cmdConfigAddressAdd(c *cmd) {
 	c.params = "address account"
 	c.help = `Adds an address to an account and reloads the configuration.
@@ -970,6 +1084,80 @@ func ctlcmdSetLoglevels(ctl *ctl, pkg, level string) {
 	ctl.xreadok()
 }
 
+func cmdTraceAdd(c *cmd) {
+	c.params = "[-account account] [-ip ip] duration"
+	c.help = `Write protocol transcripts of IMAP and SMTP connections of an account or remote IP.
+
+For debugging problems of a single user without raising the log level of all
+of mox. Exactly one of -account and -ip must be specified. Connections of an
+account are traced from the moment they authenticate. Connections from an IP
+are traced from the start.
+
+Each connection is written to its own file in the "traces" directory in the
+data directory, with timestamps. Credentials used for authentication are
+redacted, but transcripts can contain messages and other private data. The
+trace stops after the duration, e.g. 30m or 2h, at most 24h. Traces are not
+kept over a restart of mox.
+
+The ID of the new trace is printed.
+`
+	var account, ip string
+	c.flag.StringVar(&account, "account", "", "account to trace connections of")
+	c.flag.StringVar(&ip, "ip", "", "remote ip to trace connections from")
+	args := c.Parse()
+	if len(args) != 1 {
+		c.Usage()
+	}
+	mustLoadConfig()
+	fmt.Println(ctlcmdTraceAdd(xctl(), account, ip, args[0]))
+}
+
+func ctlcmdTraceAdd(ctl *ctl, account, ip, duration string) string {
+	ctl.xwrite("traceadd")
+	ctl.xwrite(account)
+	ctl.xwrite(ip)
+	ctl.xwrite(duration)
+	ctl.xreadok()
+	return ctl.xread()
+}
+
+func cmdTraceList(c *cmd) {
+	c.help = `List active protocol traces, with their ID.
+`
+	if len(c.Parse()) != 0 {
+		c.Usage()
+	}
+	mustLoadConfig()
+	ctlcmdTraceList(xctl())
+}
+
+func ctlcmdTraceList(ctl *ctl) {
+	ctl.xwrite("tracelist")
+	ctl.xreadok()
+	ctl.xstreamto(os.Stdout)
+}
+
+func cmdTraceRemove(c *cmd) {
+	c.params = "id"
+	c.help = `Stop a protocol trace.
+
+New connections are no longer traced. Transcripts of already traced connections
+are written until the original end of the trace.
+`
+	args := c.Parse()
+	if len(args) != 1 {
+		c.Usage()
+	}
+	mustLoadConfig()
+	ctlcmdTraceRemove(xctl(), args[0])
+}
+
+func ctlcmdTraceRemove(ctl *ctl, id string) {
+	ctl.xwrite("tracerm")
+	ctl.xwrite(id)
+	ctl.xreadok()
+}
+
 func cmdStop(c *cmd) {
 	c.help = `Shut mox down, giving connections maximum 3 seconds to stop before closing them.
 
@@ -1194,6 +1382,9 @@ without rescheduling.
 With the -transport flag, future delivery attempts are done using the specified
 transport. Transports can be configured in mox.conf, e.g. to submit to a remote
 queue over SMTP.
+
+Messages held in the queue for moderation by a transport rule are released by
+kicking them.
 `
 	var id int64
 	var todomain, recipient, transport string
@@ -1279,6 +1470,198 @@ func ctlcmdQueueDump(ctl *ctl, id string) {
 	}
 }
 
+func cmdDBStats(c *cmd) {
+	c.params = "[account]"
+	c.help = `Print database usage statistics, for tuning indices and finding slow queries.
+
+Statistics are printed for transactions by the IMAP and SMTP servers, the queue
+and the account web interface, aggregated since startup. Included are the
+number of queries by query plan, e.g. full table scans or index scans, the
+operations on the underlying key/value store for records and indices, and how
+often each type and index was used for the last query in a transaction.
+Transactions taking longer than the configured SlowDBOperation are also logged
+while they happen.
+
+Lifetime statistics of the queue database are printed as well, and for the
+database of the account, if specified. Account databases are closed when no
+longer in use, which resets their statistics.
+`
+	args := c.Parse()
+	if len(args) > 1 {
+		c.Usage()
+	}
+	mustLoadConfig()
+	var account string
+	if len(args) == 1 {
+		account = args[0]
+	}
+	ctlcmdDBStats(xctl(), account)
+}
+
+func ctlcmdDBStats(ctl *ctl, account string) {
+	ctl.xwrite("dbstats")
+	ctl.xwrite(account)
+	ctl.xreadok()
+	if _, err := io.Copy(os.Stdout, ctl.reader()); err != nil {
+		log.Fatalf("%s", err)
+	}
+}
+
+const messagesParams = "[-account account] [-mailbox mailbox] [-messageid message-id] [-msgfrom address|@domain] [-mailfrom address]"
+
+const messagesHelp = `
+Messages are selected by Message-ID header, message From address or domain,
+and/or SMTP MAIL FROM address, and can be restricted to a single account and/or
+mailbox. At least one of -messageid, -msgfrom and -mailfrom is required. The
+Message-ID is only known for messages that were delivered with a version of mox
+that stores Message-IDs for all incoming messages.
+`
+
+func messagesFlags(c *cmd, q *store.MessageQuery) {
+	c.flag.StringVar(&q.Account, "account", "", "only messages in this account")
+	c.flag.StringVar(&q.Mailbox, "mailbox", "", "only messages in this mailbox")
+	c.flag.StringVar(&q.MessageID, "messageid", "", "message-id header of messages")
+	c.flag.StringVar(&q.MsgFrom, "msgfrom", "", "address in message from header, or domain when starting with @")
+	c.flag.StringVar(&q.MailFrom, "mailfrom", "", "smtp mail from address")
+}
+
+func cmdMessagesFind(c *cmd) {
+	c.params = messagesParams
+	c.help = `List messages in mailboxes of all accounts matching the criteria.
+` + messagesHelp
+	var q store.MessageQuery
+	messagesFlags(c, &q)
+	if len(c.Parse()) != 0 {
+		c.Usage()
+	}
+	mustLoadConfig()
+	ctlcmdMessages(xctl(), store.MessageOpFind, q, "", false)
+}
+
+func cmdMessagesDelete(c *cmd) {
+	c.params = "[-dryrun] " + messagesParams
+	c.help = `Remove messages matching the criteria from mailboxes of all accounts.
+
+For example to remove a phishing message with a specific Message-ID that has
+been delivered to many accounts. Each removed message is logged. Run with
+-dryrun first to see which messages would be removed.
+` + messagesHelp
+	var q store.MessageQuery
+	var dryrun bool
+	c.flag.BoolVar(&dryrun, "dryrun", false, "only list messages that would be removed")
+	messagesFlags(c, &q)
+	if len(c.Parse()) != 0 {
+		c.Usage()
+	}
+	mustLoadConfig()
+	ctlcmdMessages(xctl(), store.MessageOpDelete, q, "", dryrun)
+}
+
+func cmdMessagesMove(c *cmd) {
+	c.params = "[-dryrun] " + messagesParams + " tomailbox"
+	c.help = `Move messages matching the criteria to another mailbox, in all accounts.
+
+The destination mailbox is created if it does not exist. Each moved message is
+logged.
+` + messagesHelp
+	var q store.MessageQuery
+	var dryrun bool
+	c.flag.BoolVar(&dryrun, "dryrun", false, "only list messages that would be moved")
+	messagesFlags(c, &q)
+	args := c.Parse()
+	if len(args) != 1 {
+		c.Usage()
+	}
+	mustLoadConfig()
+	ctlcmdMessages(xctl(), store.MessageOpMove, q, args[0], dryrun)
+}
+
+func cmdMessagesRedeliver(c *cmd) {
+	c.params = "[-dryrun] " + messagesParams
+	c.help = `Move messages to the mailbox selected by the current delivery rulesets.
+
+The delivery rulesets of the recipient address the messages were delivered for
+are evaluated again, e.g. after adding a ruleset for a mailing list. Messages
+are moved to the resulting mailbox if it differs from their current mailbox.
+Messages without recipient address, or with a recipient address that is no
+longer configured for the account, are left in place. Each moved message is
+logged.
+` + messagesHelp
+	var q store.MessageQuery
+	var dryrun bool
+	c.flag.BoolVar(&dryrun, "dryrun", false, "only list messages that would be moved")
+	messagesFlags(c, &q)
+	if len(c.Parse()) != 0 {
+		c.Usage()
+	}
+	mustLoadConfig()
+	ctlcmdMessages(xctl(), store.MessageOpRedeliver, q, "", dryrun)
+}
+
+func cmdMessagesTransfer(c *cmd) {
+	c.params = "[-move] [-dryrun] -account account [-mailbox mailbox] [-messageid message-id] [-msgfrom address|@domain] [-mailfrom address] dstaccount [dstmailbox]"
+	c.help = `Copy or move messages to another account.
+
+Messages are copied from the account specified with -account, and can be
+selected by mailbox, and/or the criteria below. With only -mailbox, all
+messages in the mailbox are selected, e.g. to hand off mail of a departing
+user to a colleague. Messages are added to dstmailbox in the destination
+account, or to mailboxes with the same name as in the source account if
+dstmailbox is not specified. Mailboxes are created as needed. The received
+time, flags and keywords of messages are preserved. With -move, the messages are
+removed from the source account after they were added to the destination
+account. Each transferred message is logged.
+` + messagesHelp
+	var q store.MessageQuery
+	var move, dryrun bool
+	c.flag.BoolVar(&move, "move", false, "remove messages from source account after copying")
+	c.flag.BoolVar(&dryrun, "dryrun", false, "only list messages that would be transferred")
+	messagesFlags(c, &q)
+	args := c.Parse()
+	if len(args) != 1 && len(args) != 2 {
+		c.Usage()
+	}
+	var dstMailbox string
+	if len(args) == 2 {
+		dstMailbox = args[1]
+	}
+	mustLoadConfig()
+	ctlcmdMessagesTransfer(xctl(), q, args[0], dstMailbox, move, dryrun)
+}
+
+func ctlcmdMessagesTransfer(ctl *ctl, q store.MessageQuery, dstAccount, dstMailbox string, move, dryrun bool) {
+	ctl.xwrite("messagestransfer")
+	ctl.xwrite(fmt.Sprintf("%v", move))
+	ctl.xwrite(fmt.Sprintf("%v", dryrun))
+	ctl.xwrite(q.Account)
+	ctl.xwrite(q.Mailbox)
+	ctl.xwrite(q.MessageID)
+	ctl.xwrite(q.MsgFrom)
+	ctl.xwrite(q.MailFrom)
+	ctl.xwrite(dstAccount)
+	ctl.xwrite(dstMailbox)
+	ctl.xreadok()
+	if _, err := io.Copy(os.Stdout, ctl.reader()); err != nil {
+		log.Fatalf("%s", err)
+	}
+}
+
+func ctlcmdMessages(ctl *ctl, op store.MessageOp, q store.MessageQuery, moveTo string, dryrun bool) {
+	ctl.xwrite("messages")
+	ctl.xwrite(string(op))
+	ctl.xwrite(fmt.Sprintf("%v", dryrun))
+	ctl.xwrite(q.Account)
+	ctl.xwrite(q.Mailbox)
+	ctl.xwrite(q.MessageID)
+	ctl.xwrite(q.MsgFrom)
+	ctl.xwrite(q.MailFrom)
+	ctl.xwrite(moveTo)
+	ctl.xreadok()
+	if _, err := io.Copy(os.Stdout, ctl.reader()); err != nil {
+		log.Fatalf("%s", err)
+	}
+}
+
 func cmdDKIMGenrsa(c *cmd) {
 	c.params = ">$selector._domainkey.$domain.rsakey.pkcs8.pem"
 	c.help = `Generate a new 2048 bit RSA private key for use with DKIM.
@@ -1315,6 +1698,31 @@ so it is recommended to sign messages with both RSA and ed25519 keys.
 	xcheckf(err, "writing dkim ed25519 key")
 }
 
+func cmdWebPushGenkey(c *cmd) {
+	c.params = ">vapid.ecdsap256key.pkcs8.pem"
+	c.help = `Generate a new ECDSA P-256 private key for use with Web Push (VAPID).
+
+Configure the file as VAPIDPrivateKeyFile in the WebPush section of mox.conf.
+`
+	if len(c.Parse()) != 0 {
+		c.Usage()
+	}
+
+	key, err := webpush.GenerateKey()
+	xcheckf(err, "generating vapid key")
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	xcheckf(err, "marshal vapid key")
+	block := &pem.Block{
+		Type: "PRIVATE KEY",
+		Headers: map[string]string{
+			"Note": "ecdsa p-256 webpush vapid private key",
+		},
+		Bytes: pkcs8,
+	}
+	err = pem.Encode(os.Stdout, block)
+	xcheckf(err, "writing vapid key")
+}
+
 func cmdDKIMTXT(c *cmd) {
 	c.params = "<$selector._domainkey.$domain.key.pkcs8.pem"
 	c.help = `Print a DKIM DNS TXT record with the public key derived from the private key read from stdin.
@@ -1832,6 +2240,57 @@ func ctlcmdRetrain(ctl *ctl, account string) {
 	ctl.xreadok()
 }
 
+func cmdTextIndex(c *cmd) {
+	c.params = "accountname"
+	c.help = `Add messages of the account to the full-text index.
+
+Messages delivered before FullTextIndex was enabled for the account are not in
+the index. Searches read those messages, which is slow. This command adds them
+to the index, after which searches only use the index. Messages already in the
+index are skipped.
+`
+	args := c.Parse()
+	if len(args) != 1 {
+		c.Usage()
+	}
+
+	mustLoadConfig()
+	ctlcmdTextIndex(xctl(), args[0])
+}
+
+func ctlcmdTextIndex(ctl *ctl, account string) {
+	ctl.xwrite("textindex")
+	ctl.xwrite(account)
+	ctl.xreadok()
+	fmt.Printf("%s messages added to full-text index\n", ctl.xread())
+}
+
+func cmdRecalculateMailboxCounts(c *cmd) {
+	c.params = "accountname"
+	c.help = `Recalculate the message counts of the mailboxes of an account.
+
+The number of messages, unseen and deleted messages, and their size, are kept
+for each mailbox, for quickly answering IMAP STATUS commands. They are updated
+when messages change. This command recalculates them by going through all
+messages, and fixes counts that are wrong, which should only be needed after a
+bug.
+`
+	args := c.Parse()
+	if len(args) != 1 {
+		c.Usage()
+	}
+
+	mustLoadConfig()
+	ctlcmdRecalculateMailboxCounts(xctl(), args[0])
+}
+
+func ctlcmdRecalculateMailboxCounts(ctl *ctl, account string) {
+	ctl.xwrite("recalculatemailboxcounts")
+	ctl.xwrite(account)
+	ctl.xreadok()
+	fmt.Printf("%s mailboxes with wrong counts fixed\n", ctl.xread())
+}
+
 func cmdTLSRPTDBAddReport(c *cmd) {
 	c.unlisted = true
 	c.params = "< message"
@@ -1972,6 +2431,30 @@ be decrypted to a cid by admin of a mox instance only.
 	fmt.Printf("%x\n", cid)
 }
 
+func cmdMessageCatalog(c *cmd) {
+	c.params = "[language]"
+	c.help = `Prints the keys and built-in texts of the message catalog.
+
+The texts are used in system-generated messages, such as DSNs, and can be
+overridden with files in the directory configured as MessageCatalog in
+mox.conf, one file per language and key, named <language>/<key>.txt. Texts
+contain placeholders like {recipient} that are replaced when used.
+
+Without language, the English texts are printed.
+`
+	args := c.Parse()
+	if len(args) > 1 {
+		c.Usage()
+	}
+	lang := "en"
+	if len(args) == 1 {
+		lang = args[0]
+	}
+	for _, key := range mox.CatalogKeys() {
+		fmt.Printf("# %s\n%s\n\n", key, strings.TrimSpace(mox.Text(lang, key)))
+	}
+}
+
 func cmdVersion(c *cmd) {
 	c.help = "Prints this mox version."
 	if len(c.Parse()) != 0 {
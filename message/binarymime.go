@@ -0,0 +1,321 @@
+package message
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"strings"
+)
+
+// DowngradeBinary writes the message in r of size bytes to w, with the body of
+// each part with Content-Transfer-Encoding "binary" encoded as base64, for
+// delivery to an SMTP server that does not implement BINARYMIME. ../rfc/3030
+//
+// Multipart bodies are searched for their boundaries directly, instead of
+// parsing them as with Parse: binary parts can have bare CR and LF, and long
+// lines. Embedded message/rfc822 and message/global parts are downgraded
+// recursively, they cannot be base64-encoded, their Content-Transfer-Encoding is
+// changed to 8bit. All other data is written unchanged. Existing DKIM signatures
+// over the message body will no longer verify if a part was converted.
+//
+// The message is read in chunks, only header sections are kept in memory.
+//
+// If no part needs conversion, converted is false and the message was written as
+// is.
+func DowngradeBinary(w io.Writer, r io.ReaderAt, size int64) (converted bool, rerr error) {
+	d := downgrader{w: w, r: r}
+	d.part(0, size, false)
+	return d.converted, d.err
+}
+
+type downgrader struct {
+	w         io.Writer
+	r         io.ReaderAt
+	converted bool
+	err       error // First read or write error. Further reads and writes are skipped.
+}
+
+func (d *downgrader) write(buf []byte) {
+	if d.err == nil {
+		_, d.err = d.w.Write(buf)
+	}
+}
+
+// copy writes the data between offsets s and e unchanged.
+func (d *downgrader) copy(s, e int64) {
+	if d.err == nil && e > s {
+		_, d.err = io.Copy(d.w, io.NewSectionReader(d.r, s, e-s))
+	}
+}
+
+// readAt reads into buf from offset o. Only a short buffer after an error.
+func (d *downgrader) readAt(buf []byte, o int64) []byte {
+	if d.err != nil {
+		return nil
+	}
+	n, err := d.r.ReadAt(buf, o)
+	if n == len(buf) {
+		return buf
+	} else if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	d.err = err
+	return nil
+}
+
+// read returns the data between offsets s and e.
+func (d *downgrader) read(s, e int64) []byte {
+	if e <= s {
+		return nil
+	}
+	return d.readAt(make([]byte, e-s), s)
+}
+
+// hasPrefix returns whether the data between offsets s and e starts with prefix.
+func (d *downgrader) hasPrefix(s, e int64, prefix []byte) bool {
+	if e-s < int64(len(prefix)) {
+		return false
+	}
+	return bytes.Equal(d.read(s, s+int64(len(prefix))), prefix)
+}
+
+// index returns the offset of the first occurrence of sep between offsets s and
+// e, or -1.
+func (d *downgrader) index(s, e int64, sep []byte) int64 {
+	// Consecutive chunks overlap, for finding sep across chunk boundaries.
+	buf := make([]byte, 32*1024+len(sep)-1)
+	for s < e {
+		n := int64(len(buf))
+		if e-s < n {
+			n = e - s
+		}
+		chunk := d.readAt(buf[:n], s)
+		if chunk == nil {
+			return -1
+		}
+		if i := bytes.Index(chunk, sep); i >= 0 {
+			return s + int64(i)
+		}
+		if s+n == e {
+			break
+		}
+		s += n - int64(len(sep)-1)
+	}
+	return -1
+}
+
+// part writes a message or part between offsets s and e, with header and body.
+// Nested is set for parts followed by a multipart delimiter, which starts with a
+// CRLF.
+func (d *downgrader) part(s, e int64, nested bool) {
+	// A part without header starts with the empty line. ../rfc/2046:1185
+	var hdr []byte
+	var bs int64 // Start of body.
+	if d.hasPrefix(s, e, []byte("\r\n")) {
+		bs = s + 2
+	} else if i := d.index(s, e, []byte("\r\n\r\n")); i >= 0 {
+		hdr, bs = d.read(s, i+2), i+4
+	} else {
+		// No body, nothing to convert.
+		d.copy(s, e)
+		return
+	}
+
+	var cte, mediaType string
+	var params map[string]string
+	for _, f := range headerFields(hdr) {
+		k, v, _ := strings.Cut(string(f), ":")
+		switch strings.ToLower(strings.TrimSpace(k)) {
+		case "content-transfer-encoding":
+			cte = strings.ToLower(strings.TrimSpace(v))
+		case "content-type":
+			// Invalid content-types are treated as the default, text/plain.
+			mediaType, params, _ = mime.ParseMediaType(strings.TrimSpace(v))
+		}
+	}
+
+	// Multipart and message parts with a base64 or quoted-printable encoding are
+	// invalid, but their body is not binary, so we leave them alone.
+	encoded := cte == "base64" || cte == "quoted-printable"
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" && !encoded:
+		// Multipart can only be 7bit, 8bit or binary. ../rfc/2045:834
+		d.header(hdr, cte, "8bit")
+		d.write([]byte("\r\n"))
+		d.multipart(bs, e, params["boundary"])
+	case (mediaType == "message/rfc822" || mediaType == "message/global") && !encoded:
+		// ../rfc/2046:1360 ../rfc/6532:272
+		d.header(hdr, cte, "8bit")
+		d.write([]byte("\r\n"))
+		d.part(bs, e, nested)
+	case cte == "binary":
+		d.header(hdr, cte, "base64")
+		d.write([]byte("\r\n"))
+		d.base64(bs, e, !nested)
+	default:
+		d.copy(s, e)
+	}
+}
+
+// header writes the header fields in hdr. If cte is "binary", the
+// Content-Transfer-Encoding fields are replaced with newCTE.
+func (d *downgrader) header(hdr []byte, cte, newCTE string) {
+	if cte != "binary" {
+		d.write(hdr)
+		return
+	}
+	d.converted = true
+	for _, f := range headerFields(hdr) {
+		k, _, _ := strings.Cut(string(f), ":")
+		if !strings.EqualFold(strings.TrimSpace(k), "Content-Transfer-Encoding") {
+			d.write(f)
+		}
+	}
+	d.write([]byte("Content-Transfer-Encoding: " + newCTE + "\r\n"))
+}
+
+// base64 writes the data between offsets s and e base64-encoded, in lines of 76
+// characters, separated by CRLF, and ending with CRLF if final is set.
+// ../rfc/2045:1372
+func (d *downgrader) base64(s, e int64, final bool) {
+	// Chunks are a multiple of the 57 bytes encoded per line.
+	buf := make([]byte, 64*57)
+	line := make([]byte, 2, 2+base64.StdEncoding.EncodedLen(57))
+	copy(line, "\r\n")
+	for first := true; s < e && d.err == nil; {
+		n := int64(len(buf))
+		if e-s < n {
+			n = e - s
+		}
+		chunk := d.readAt(buf[:n], s)
+		for len(chunk) > 0 {
+			k := len(chunk)
+			if k > 57 {
+				k = 57
+			}
+			line = line[:2+base64.StdEncoding.EncodedLen(k)]
+			base64.StdEncoding.Encode(line[2:], chunk[:k])
+			if first {
+				d.write(line[2:])
+				first = false
+			} else {
+				d.write(line)
+			}
+			chunk = chunk[k:]
+		}
+		s += n
+	}
+	if final {
+		d.write([]byte("\r\n"))
+	}
+}
+
+// multipart writes the body of a multipart part between offsets bs and e,
+// downgrading each of its parts. The preamble, delimiter lines and epilogue are
+// written unchanged.
+func (d *downgrader) multipart(bs, e int64, boundary string) {
+	s, de, closing := d.nextDelimiter(bs, e, bs, boundary)
+	if s < 0 {
+		d.copy(bs, e)
+		return
+	}
+	d.copy(bs, s)
+	for {
+		d.copy(s, de)
+		if closing {
+			d.copy(de, e)
+			return
+		}
+		ns, ne, nclosing := d.nextDelimiter(bs, e, de, boundary)
+		if ns < 0 {
+			// Missing closing delimiter, we leave the remainder alone.
+			d.copy(de, e)
+			return
+		}
+		d.part(de, ns, true)
+		s, de, closing = ns, ne, nclosing
+	}
+}
+
+// nextDelimiter finds the next delimiter line for boundary in the body between
+// offsets bs and e, starting at offset o. The delimiter starts at s, including
+// the CRLF that precedes it (except at the start of the body), and ends at de,
+// after its trailing CRLF. Closing is set for the close delimiter. If no
+// delimiter is found, s is -1. ../rfc/2046:1206
+func (d *downgrader) nextDelimiter(bs, e, o int64, boundary string) (s, de int64, closing bool) {
+	delim := []byte("\r\n--" + boundary)
+
+	// check returns the end of the delimiter line that has its boundary end at i.
+	check := func(i int64) (int64, bool, bool) {
+		closing := d.hasPrefix(i, e, []byte("--"))
+		if closing {
+			i += 2
+		}
+		// Transport padding. ../rfc/2046:1219
+		i = d.skipPadding(i, e)
+		if i == e {
+			return e, closing, true
+		} else if d.hasPrefix(i, e, []byte("\r\n")) {
+			return i + 2, closing, true
+		}
+		return 0, false, false
+	}
+
+	if o == bs && d.hasPrefix(bs, e, delim[2:]) {
+		if de, closing, ok := check(bs + int64(len(delim)-2)); ok {
+			return bs, de, closing
+		}
+	}
+	for {
+		s := d.index(o, e, delim)
+		if s < 0 {
+			return -1, -1, false
+		}
+		if de, closing, ok := check(s + int64(len(delim))); ok {
+			return s, de, closing
+		}
+		o = s + 1
+	}
+}
+
+// skipPadding returns the offset of the first byte from offset i that is not a
+// space or tab, or e.
+func (d *downgrader) skipPadding(i, e int64) int64 {
+	for i < e {
+		n := e - i
+		if n > 512 {
+			n = 512
+		}
+		buf := d.read(i, i+n)
+		ws := len(buf) - len(bytes.TrimLeft(buf, " \t"))
+		i += int64(ws)
+		if ws < len(buf) || len(buf) == 0 {
+			break
+		}
+	}
+	return i
+}
+
+// headerFields returns the header fields in hdr, each including continuation
+// lines and the trailing CRLF.
+func headerFields(hdr []byte) [][]byte {
+	var l [][]byte
+	for len(hdr) > 0 {
+		n := 0
+		for {
+			i := bytes.Index(hdr[n:], []byte("\r\n"))
+			if i < 0 {
+				n = len(hdr)
+				break
+			}
+			n += i + 2
+			if n >= len(hdr) || hdr[n] != ' ' && hdr[n] != '\t' {
+				break
+			}
+		}
+		l = append(l, hdr[:n])
+		hdr = hdr[n:]
+	}
+	return l
+}
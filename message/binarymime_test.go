@@ -0,0 +1,111 @@
+package message
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDowngradeBinary(t *testing.T) {
+	check := func(msg, expMsg string, expConverted bool) {
+		t.Helper()
+
+		var b bytes.Buffer
+		converted, err := DowngradeBinary(&b, strings.NewReader(msg), int64(len(msg)))
+		tcheck(t, err, "downgrade")
+		if converted != expConverted {
+			t.Fatalf("got converted %v, expected %v", converted, expConverted)
+		}
+		if b.String() != expMsg {
+			t.Fatalf("got:\n%q\nexpected:\n%q", b.String(), expMsg)
+		}
+		if converted {
+			// The result must be parsable.
+			p, err := Parse(bytes.NewReader(b.Bytes()))
+			tcheck(t, err, "parse")
+			err = p.Walk(nil)
+			tcheck(t, err, "walk")
+		}
+	}
+
+	crlf := func(s string) string {
+		return strings.ReplaceAll(s, "\n", "\r\n")
+	}
+
+	// Nothing to convert.
+	plain := crlf("Subject: test\n\nhi\n")
+	check(plain, plain, false)
+
+	// Binary top-level body, with bare CR and LF. The folded header is removed.
+	check("Subject: test\r\nContent-Transfer-Encoding:\r\n binary\r\nContent-Type: application/octet-stream\r\n\r\n\x00\n\r\xff",
+		crlf("Subject: test\nContent-Type: application/octet-stream\nContent-Transfer-Encoding: base64\n\nAAoN/w==\n"), true)
+
+	// Long binary body is split into lines of 76 characters.
+	check("Content-Transfer-Encoding: BINARY\r\n\r\n"+strings.Repeat("\xff", 60),
+		crlf("Content-Transfer-Encoding: base64\n\n"+strings.Repeat("/", 76)+"\n"+"////\n"), true)
+
+	// Multipart with a binary part with something looking like a boundary, and a
+	// text part that is left alone. Preamble, padding and epilogue are kept.
+	multipart := crlf(`Content-Type: multipart/mixed; boundary=x
+Content-Transfer-Encoding: binary
+
+preamble
+--x 
+Content-Type: text/plain
+
+hi
+--x
+Content-Type: application/octet-stream
+Content-Transfer-Encoding: binary
+
+`) + "--xy\n\x00" + crlf(`
+--x--
+epilogue
+`)
+	expMultipart := crlf(`Content-Type: multipart/mixed; boundary=x
+Content-Transfer-Encoding: 8bit
+
+preamble
+--x 
+Content-Type: text/plain
+
+hi
+--x
+Content-Type: application/octet-stream
+Content-Transfer-Encoding: base64
+
+LS14eQoA
+--x--
+epilogue
+`)
+	check(multipart, expMultipart, true)
+
+	// Embedded message is downgraded, and becomes 8bit.
+	check(crlf("Content-Type: message/rfc822\nContent-Transfer-Encoding: binary\n\nContent-Transfer-Encoding: binary\n\n")+"\x00",
+		crlf("Content-Type: message/rfc822\nContent-Transfer-Encoding: 8bit\n\nContent-Transfer-Encoding: base64\n\nAA==\n"), true)
+
+	// Missing closing boundary, remainder is left alone.
+	unclosed := crlf("Content-Type: multipart/mixed; boundary=x\n\n--x\nContent-Transfer-Encoding: binary\n\n\x00")
+	check(unclosed, unclosed, false)
+
+	// Large binary part, read in multiple chunks, with the delimiter crossing the
+	// 32KB chunk size, but within the overlap of consecutive chunks.
+	data := strings.Repeat("\x00\r\n-", 8180) + "xyz"
+	large := crlf("Content-Type: multipart/mixed; boundary=boundary\n\n--boundary\nContent-Transfer-Encoding: binary\n\n") + data + crlf("\n--boundary--\n")
+	var b bytes.Buffer
+	converted, err := DowngradeBinary(&b, strings.NewReader(large), int64(len(large)))
+	tcheck(t, err, "downgrade")
+	if !converted {
+		t.Fatalf("large message not converted")
+	}
+	p, err := Parse(bytes.NewReader(b.Bytes()))
+	tcheck(t, err, "parse")
+	err = p.Walk(nil)
+	tcheck(t, err, "walk")
+	buf, err := io.ReadAll(p.Parts[0].Reader())
+	tcheck(t, err, "read part")
+	if string(buf) != data {
+		t.Fatalf("decoded part of %d bytes differs from original of %d bytes", len(buf), len(data))
+	}
+}
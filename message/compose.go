@@ -0,0 +1,319 @@
+package message
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Helpers for composing replies and forwards, used by the account web interface.
+
+// FlowedWidth is the maximum line length, in characters, for text generated by
+// FormatFlowed. ../rfc/3676
+const FlowedWidth = 78
+
+// ReplySubject returns the subject for a reply to a message with subject, with
+// "Re: " prepended if not yet present.
+func ReplySubject(subject string) string {
+	subject = strings.TrimSpace(subject)
+	if len(subject) >= 3 && strings.EqualFold(subject[:3], "re:") {
+		return subject
+	}
+	return "Re: " + subject
+}
+
+// ForwardSubject returns the subject for forwarding a message with subject, with
+// "Fwd: " prepended if not yet present.
+func ForwardSubject(subject string) string {
+	subject = strings.TrimSpace(subject)
+	if len(subject) >= 4 && strings.EqualFold(subject[:4], "fwd:") {
+		return subject
+	}
+	return "Fwd: " + subject
+}
+
+// Attribution returns the line introducing the quoted text in a reply, e.g.
+// "On Mon, 2 Jan 2006 15:04 -0700, Mox <mox@example.org> wrote:". If date is
+// zero, only the sender is mentioned.
+func Attribution(from string, date time.Time) string {
+	if date.IsZero() {
+		return from + " wrote:"
+	}
+	return fmt.Sprintf("On %s, %s wrote:", date.Format("Mon, 2 Jan 2006 15:04 -0700"), from)
+}
+
+// QuoteText returns text quoted for a reply: each line is prefixed with "> ",
+// or with just ">" for lines that are already quoted. The signature of the
+// original message, after a "-- " line, is left out, as are trailing empty
+// lines. Lines in the result end with a newline.
+func QuoteText(text string) string {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		if line == "-- " {
+			lines = lines[:i]
+			break
+		}
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	var b strings.Builder
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t")
+		if strings.HasPrefix(line, ">") || line == "" {
+			b.WriteString(">" + line + "\n")
+		} else {
+			b.WriteString("> " + line + "\n")
+		}
+	}
+	return b.String()
+}
+
+// FormatFlowed returns text encoded as format=flowed with DelSp=no, for a
+// text/plain part with Content-Type parameter "format=flowed". Long lines are
+// wrapped at spaces into flowed lines, ending in a space, with the quote depth
+// of the original line. Lines are space-stuffed when needed, and the result has
+// CRLF line endings. Recipients that don't support format=flowed see wrapped
+// lines. ../rfc/3676
+func FormatFlowed(text string) string {
+	text = strings.TrimSuffix(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+
+	var b strings.Builder
+	for _, line := range strings.Split(text, "\n") {
+		depth := 0
+		for depth < len(line) && line[depth] == '>' {
+			depth++
+		}
+		quote := line[:depth]
+		content := line[depth:]
+		if depth > 0 {
+			// The space after quote marks is written as stuffing below.
+			content = strings.TrimPrefix(content, " ")
+		}
+		if content != "-- " {
+			// Trailing spaces would mark the line as flowed.
+			content = strings.TrimRight(content, " ")
+		}
+
+		// Quoted lines and lines that could be mistaken for quoted lines are
+		// space-stuffed.
+		prefix := func(s string) string {
+			if depth > 0 || strings.HasPrefix(s, " ") || strings.HasPrefix(s, ">") || strings.HasPrefix(s, "From ") {
+				return quote + " "
+			}
+			return ""
+		}
+
+		for {
+			p := prefix(content)
+			i := flowedBreak(content, FlowedWidth-utf8.RuneCountInString(p))
+			if i < 0 {
+				break
+			}
+			// The space stays at the end of the line, marking it as flowed.
+			b.WriteString(p + content[:i+1] + "\r\n")
+			content = content[i+1:]
+		}
+		b.WriteString(prefix(content) + content + "\r\n")
+	}
+	return b.String()
+}
+
+// flowedBreak returns the index of the space in s to break after, so the
+// line is at most width characters when possible. If words are longer than
+// width, the first space after width is returned. If s does not have to be or
+// cannot be broken, -1 is returned.
+func flowedBreak(s string, width int) int {
+	if utf8.RuneCountInString(s) <= width {
+		return -1
+	}
+	last := -1
+	n := 0
+	for i, c := range s {
+		n++
+		if c != ' ' || i == 0 {
+			continue
+		}
+		if n > width {
+			if last >= 0 {
+				return last
+			}
+			break
+		}
+		last = i
+	}
+	if last >= 0 {
+		return last
+	}
+	// Word is too long, break at the first space after it, if any.
+	if i := strings.Index(s[1:], " "); i >= 0 && i+2 < len(s) {
+		return i + 1
+	}
+	return -1
+}
+
+// HTMLToText returns a plain text version of an HTML document, e.g. for a
+// text/plain alternative part for an HTML message, or for quoting an HTML-only
+// message in a plain text reply. Block elements start new lines, list items are
+// prefixed with "- ", blockquotes are quoted with "> ", and URLs of links are
+// added after the link text.
+func HTMLToText(r io.Reader) (string, error) {
+	t := htmlText{}
+	z := html.NewTokenizer(r)
+	var skip int // Nesting of elements whose content is not shown.
+	var pre int  // Nesting of pre elements, whitespace is kept.
+	var hrefs []string
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			if z.Err() != io.EOF {
+				return "", z.Err()
+			} else if t.b.Len() == 0 {
+				return "", nil
+			}
+			return strings.TrimRight(t.b.String(), "\n") + "\n", nil
+		case html.TextToken:
+			if skip == 0 {
+				t.text(string(z.Text()), pre > 0)
+			}
+		case html.StartTagToken, html.SelfClosingTagToken, html.EndTagToken:
+			tok := z.Token()
+			start := tt != html.EndTagToken
+			switch tok.DataAtom {
+			case atom.Head, atom.Script, atom.Style, atom.Title, atom.Template, atom.Noscript:
+				if tt == html.StartTagToken {
+					skip++
+				} else if tt == html.EndTagToken && skip > 0 {
+					skip--
+				}
+			case atom.Br:
+				t.newlines(1, true)
+			case atom.P, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Table, atom.Ul, atom.Ol, atom.Hr:
+				t.newlines(2, false)
+			case atom.Div, atom.Tr:
+				t.newlines(1, false)
+			case atom.Td, atom.Th:
+				if start {
+					t.space = true
+				}
+			case atom.Li:
+				t.newlines(1, false)
+				if start {
+					t.text("- ", true)
+				}
+			case atom.Pre:
+				t.newlines(1, false)
+				if tt == html.StartTagToken {
+					pre++
+				} else if tt == html.EndTagToken && pre > 0 {
+					pre--
+				}
+			case atom.Blockquote:
+				t.newlines(1, false)
+				if tt == html.StartTagToken {
+					t.quote++
+				} else if tt == html.EndTagToken && t.quote > 0 {
+					t.quote--
+				}
+			case atom.A:
+				if tt == html.StartTagToken {
+					var href string
+					for _, a := range tok.Attr {
+						if a.Key == "href" && (strings.HasPrefix(a.Val, "http://") || strings.HasPrefix(a.Val, "https://")) {
+							href = a.Val
+						}
+					}
+					hrefs = append(hrefs, href)
+					t.linkStart = t.b.Len()
+				} else if tt == html.EndTagToken && len(hrefs) > 0 {
+					href := hrefs[len(hrefs)-1]
+					hrefs = hrefs[:len(hrefs)-1]
+					if href != "" && !strings.Contains(t.b.String()[t.linkStart:], href) {
+						t.text(" <"+href+">", true)
+					}
+				}
+			}
+		}
+	}
+}
+
+// htmlText accumulates text for HTMLToText.
+type htmlText struct {
+	b         strings.Builder
+	lines     int  // Pending newlines.
+	space     bool // Pending space between words.
+	lineStart bool // Whether at the start of a line, for writing the quote prefix.
+	quote     int  // Blockquote depth.
+	linkStart int  // Offset in b where the text of the current link starts.
+}
+
+// newlines ensures text continues after n newlines. If force is set, newlines
+// are also written at the start of the text, e.g. for br elements.
+func (t *htmlText) newlines(n int, force bool) {
+	if t.b.Len() == 0 && !force {
+		return
+	}
+	if force {
+		t.lines++
+	} else if t.lines < n {
+		t.lines = n
+	}
+	t.space = false
+}
+
+func (t *htmlText) text(s string, keepSpace bool) {
+	if !keepSpace {
+		if strings.TrimSpace(s) == "" {
+			t.space = t.space || s != ""
+			return
+		}
+		lead := strings.TrimLeft(s, " \t\r\n") != s
+		trail := strings.TrimRight(s, " \t\r\n") != s
+		s = strings.Join(strings.Fields(s), " ")
+		if lead {
+			t.space = true
+		}
+		defer func() {
+			t.space = trail
+		}()
+	} else {
+		s = strings.ReplaceAll(s, "\r\n", "\n")
+	}
+
+	for i, line := range strings.Split(s, "\n") {
+		if i > 0 {
+			t.lines++
+		}
+		if line == "" {
+			continue
+		}
+		if t.lines > 0 {
+			if t.b.Len() > 0 {
+				t.b.WriteString(strings.Repeat("\n", t.lines))
+				t.lineStart = true
+			}
+			t.lines = 0
+			t.space = false
+		}
+		if t.b.Len() == 0 {
+			t.lineStart = true
+		}
+		if t.lineStart {
+			if t.quote > 0 {
+				t.b.WriteString(strings.Repeat(">", t.quote) + " ")
+			}
+			t.lineStart = false
+		} else if t.space {
+			t.b.WriteString(" ")
+		}
+		t.space = false
+		t.b.WriteString(line)
+	}
+}
@@ -0,0 +1,71 @@
+package message
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompose(t *testing.T) {
+	tcompare(t, ReplySubject("test"), "Re: test")
+	tcompare(t, ReplySubject(" RE: test"), "RE: test")
+	tcompare(t, ForwardSubject("test"), "Fwd: test")
+	tcompare(t, ForwardSubject("fwd: test"), "fwd: test")
+
+	date := time.Date(2023, 3, 6, 10, 20, 0, 0, time.FixedZone("", 3600))
+	tcompare(t, Attribution("Mox <mox@example.org>", date), "On Mon, 6 Mar 2023 10:20 +0100, Mox <mox@example.org> wrote:")
+	tcompare(t, Attribution("mox@example.org", time.Time{}), "mox@example.org wrote:")
+
+	// Quoting, with signature and trailing empty lines removed.
+	tcompare(t, QuoteText("hi\r\n\r\n> earlier  \r\n-- \r\nsig\r\n"), "> hi\n>\n>> earlier\n")
+	tcompare(t, QuoteText("hi\n\n\n"), "> hi\n")
+}
+
+func TestFormatFlowed(t *testing.T) {
+	check := func(text, exp string) {
+		t.Helper()
+		tcompare(t, FormatFlowed(text), strings.ReplaceAll(exp, "\n", "\r\n"))
+	}
+
+	check("short line\n", "short line\n")
+	check("trailing spaces   \n-- \nsig", "trailing spaces\n-- \nsig\n")
+
+	// Space-stuffing.
+	check("From me\n>quoted\n> quoted\n indented\n", " From me\n> quoted\n> quoted\n  indented\n")
+
+	// Wrapping, with flowed lines ending in a space.
+	word := strings.Repeat("x", 9)
+	long := strings.TrimSpace(strings.Repeat(word+" ", 10))
+	check(long, strings.Repeat(word+" ", 7)+"\n"+strings.TrimSpace(strings.Repeat(word+" ", 3))+"\n")
+
+	// Wrapped quoted lines keep their quote depth.
+	check(">> "+long, ">> "+strings.Repeat(word+" ", 7)+"\n>> "+strings.TrimSpace(strings.Repeat(word+" ", 3))+"\n")
+
+	// Words longer than the line length are not broken.
+	longword := strings.Repeat("y", 100)
+	check(longword+" end", longword+" \nend\n")
+	check(longword, longword+"\n")
+
+	for _, line := range strings.Split(FormatFlowed(long+"\n"+long), "\r\n") {
+		if len(line) > FlowedWidth {
+			t.Fatalf("line too long: %q", line)
+		}
+	}
+}
+
+func TestHTMLToText(t *testing.T) {
+	check := func(s, exp string) {
+		t.Helper()
+		text, err := HTMLToText(strings.NewReader(s))
+		tcheck(t, err, "html to text")
+		tcompare(t, text, exp)
+	}
+
+	check("", "")
+	check(`<html><head><title>t</title><style>p {}</style></head><body><p>Hello  &amp;
+welcome</p><p>line<br>break</p><script>x()</script></body></html>`, "Hello & welcome\n\nline\nbreak\n")
+	check(`<ul><li>one</li><li>two</li></ul>`, "- one\n- two\n")
+	check(`<p>reply</p><blockquote><p>quoted</p><blockquote>nested</blockquote></blockquote>`, "reply\n\n> quoted\n\n>> nested\n")
+	check(`<a href="https://example.org">site</a> <a href="https://example.org">https://example.org</a> <a href="mailto:x@example.org">mail</a>`, "site <https://example.org> https://example.org mail\n")
+	check("<pre>a\n  b</pre>", "a\n  b\n")
+}
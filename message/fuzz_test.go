@@ -0,0 +1,36 @@
+package message
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+// Fuzz parsing of messages, including malformed MIME structure and encodings,
+// reading the decoded contents of all parts.
+func FuzzParse(f *testing.F) {
+	f.Add("Subject: test\r\n\r\nbody\r\n")
+	f.Add("Content-Type: multipart/mixed; boundary=x\r\n\r\n--x\r\nContent-Type: text/plain\r\n\r\nhi\r\n--x--\r\n")
+	f.Add("Content-Type: multipart/mixed; boundary=x\r\n\r\n--x\r\nContent-Type: multipart/alternative; boundary=x\r\n\r\n--x")
+	f.Add("Content-Type: message/rfc822\r\n\r\nContent-Type: text/plain\r\nContent-Transfer-Encoding: base64\r\n\r\naGk=\r\n")
+	f.Add("Content-Transfer-Encoding: quoted-printable\r\n\r\n=4\r\n")
+
+	var read func(p *Part)
+	read = func(p *Part) {
+		io.Copy(io.Discard, p.Reader())
+		for i := range p.Parts {
+			read(&p.Parts[i])
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		p, err := EnsurePart(strings.NewReader(s), int64(len(s)))
+		if err != nil {
+			return
+		}
+		if err := p.Walk(nil); err != nil {
+			return
+		}
+		read(&p)
+	})
+}
@@ -0,0 +1,131 @@
+package message
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+// PreviewMaxChars is the maximum length of a preview in characters. ../rfc/8970
+const PreviewMaxChars = 256
+
+// Preview returns a short plain text preview of the message, from its first
+// text/plain part, or its first text/html part if there is none. Quoted text and
+// signatures are left out, whitespace is collapsed. An empty string is returned
+// for messages without text, e.g. with only attachments.
+//
+// The part must have a reader, see SetReaderAt.
+func (p *Part) Preview() (string, error) {
+	tp := p.previewPart("PLAIN")
+	if tp == nil {
+		tp = p.previewPart("HTML")
+	}
+	if tp == nil {
+		return "", nil
+	}
+
+	// Only a bit of text is needed, don't read large parts fully.
+	r := io.LimitReader(tp.Reader(), 16*1024)
+	var text string
+	var err error
+	if tp.MediaSubType == "HTML" {
+		text, err = previewHTML(r)
+	} else {
+		text, err = previewPlain(r)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Collapse whitespace, and limit length.
+	text = strings.Join(strings.Fields(strings.ToValidUTF8(text, "")), " ")
+	if utf8.RuneCountInString(text) > PreviewMaxChars {
+		text = string([]rune(text)[:PreviewMaxChars])
+		text = strings.TrimRightFunc(text, unicode.IsSpace)
+	}
+	return text, nil
+}
+
+// previewPart returns the first text part with subtype, that is not an attachment.
+func (p *Part) previewPart(subtype string) *Part {
+	// Without Content-Type, a part is text/plain. ../rfc/2045
+	if p.MediaType == "TEXT" && p.MediaSubType == subtype || p.MediaType == "" && subtype == "PLAIN" {
+		if h, err := p.Header(); err == nil && strings.HasPrefix(strings.ToLower(strings.TrimSpace(h.Get("Content-Disposition"))), "attachment") {
+			return nil
+		}
+		return p
+	}
+	if p.MediaType != "MULTIPART" {
+		return nil
+	}
+	for i := range p.Parts {
+		if tp := p.Parts[i].previewPart(subtype); tp != nil {
+			return tp
+		}
+	}
+	return nil
+}
+
+func previewPlain(r io.Reader) (string, error) {
+	var b strings.Builder
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 1024), 16*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "-- " {
+			// Signature follows.
+			break
+		}
+		if strings.HasPrefix(line, ">") {
+			// Quoted text from a previous message.
+			continue
+		}
+		b.WriteString(line)
+		b.WriteString(" ")
+		if b.Len() > 4*PreviewMaxChars {
+			break
+		}
+	}
+	// A too long line in the limited reader is not an error for a preview.
+	if err := scanner.Err(); err != nil && err != bufio.ErrTooLong {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func previewHTML(r io.Reader) (string, error) {
+	var b strings.Builder
+	var skip int // Nesting of elements whose text is not shown.
+	z := html.NewTokenizer(r)
+	for b.Len() <= 4*PreviewMaxChars {
+		switch z.Next() {
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				return b.String(), nil
+			}
+			return b.String(), z.Err()
+		case html.StartTagToken:
+			if name, _ := z.TagName(); isPreviewSkipElem(string(name)) {
+				skip++
+			}
+		case html.EndTagToken:
+			if name, _ := z.TagName(); isPreviewSkipElem(string(name)) && skip > 0 {
+				skip--
+			}
+		case html.TextToken:
+			if skip == 0 {
+				b.Write(z.Text())
+				b.WriteString(" ")
+			}
+		}
+	}
+	return b.String(), nil
+}
+
+func isPreviewSkipElem(name string) bool {
+	return name == "head" || name == "script" || name == "style" || name == "blockquote"
+}
@@ -0,0 +1,71 @@
+package message
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPreview(t *testing.T) {
+	check := func(msg, exp string) {
+		t.Helper()
+		msg = strings.ReplaceAll(msg, "\n", "\r\n")
+		p, err := EnsurePart(strings.NewReader(msg), int64(len(msg)))
+		tcheck(t, err, "parse message")
+		err = p.Walk(nil)
+		tcheck(t, err, "walk message")
+		preview, err := p.Preview()
+		tcheck(t, err, "preview")
+		tcompare(t, preview, exp)
+	}
+
+	// Plain text, without quoted text and signature.
+	check(`Subject: test
+
+Hi,
+
+  this is   a test.
+> quoted text
+>> more quoted
+-- 
+signature
+`, "Hi, this is a test.")
+
+	// Only html.
+	check(`Content-Type: text/html
+
+<html><head><title>title</title><style>p { color: red }</style></head>
+<body><p>Hello &amp; welcome</p><blockquote>quoted</blockquote><p>bye</p></body></html>
+`, "Hello & welcome bye")
+
+	// Alternative parts, text/plain is preferred.
+	check(`Content-Type: multipart/alternative; boundary=x
+
+--x
+Content-Type: text/html
+
+<p>html</p>
+--x
+Content-Type: text/plain
+
+plain
+--x--
+`, "plain")
+
+	// Attachments are not used.
+	check(`Content-Type: multipart/mixed; boundary=x
+
+--x
+Content-Type: text/plain
+Content-Disposition: attachment; filename=test.txt
+
+attached
+--x
+Content-Type: application/octet-stream
+
+binary
+--x--
+`, "")
+
+	// Long text is truncated.
+	check("Subject: test\n\n"+strings.Repeat("word ", 100)+"\n", strings.TrimSpace(strings.Repeat("word ", 100)[:PreviewMaxChars]))
+}
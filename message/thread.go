@@ -0,0 +1,145 @@
+package message
+
+import (
+	"mime"
+	"strings"
+)
+
+// ThreadSubject returns the base subject of a message, with reply and forward
+// indicators and mailing list tags removed, and whether the subject indicated
+// the message is a reply or forward. Used for sorting and threading.
+// ../rfc/5256:324
+func ThreadSubject(s string) (base string, isResponse bool) {
+	// (1) Decode encoded words, and make whitespace single spaces.
+	var wd mime.WordDecoder
+	if ds, err := wd.DecodeHeader(s); err == nil {
+		s = ds
+	}
+	s = strings.Join(strings.Fields(s), " ")
+
+	for {
+		// (2) Remove trailers, "(fwd)" and whitespace.
+		for {
+			ns := strings.TrimRight(s, " ")
+			if len(ns) >= 5 && strings.EqualFold(ns[len(ns)-5:], "(fwd)") {
+				ns = ns[:len(ns)-5]
+				isResponse = true
+			}
+			if ns == s {
+				break
+			}
+			s = ns
+		}
+
+		// (3) Remove leaders, and (4) a blob if something would remain. (5) Repeat.
+		for {
+			ns := strings.TrimLeft(s, " ")
+			if xs := trimSubjectReFwd(ns); xs != ns {
+				ns = xs
+				isResponse = true
+			}
+			if blob, rest := subjectBlob(ns); blob && rest != "" {
+				ns = rest
+			}
+			if ns == s {
+				break
+			}
+			s = ns
+		}
+
+		// (6) Remove "[fwd: ...]" wrapper, and start again.
+		if len(s) >= 6 && strings.EqualFold(s[:5], "[fwd:") && strings.HasSuffix(s, "]") {
+			s = s[5 : len(s)-1]
+			isResponse = true
+			continue
+		}
+		return s, isResponse
+	}
+}
+
+// subjectBlob returns whether s starts with a subj-blob, i.e. "[...]" with
+// optional trailing whitespace, and the remainder.
+func subjectBlob(s string) (bool, string) {
+	if !strings.HasPrefix(s, "[") {
+		return false, s
+	}
+	i := strings.IndexAny(s[1:], "[]")
+	if i < 0 || s[1+i] != ']' {
+		return false, s
+	}
+	return true, strings.TrimLeft(s[1+i+1:], " ")
+}
+
+// trimSubjectReFwd removes a subj-refwd leader, "re", "fw" or "fwd", optionally
+// preceded by blobs, and followed by an optional blob and a colon. If s does not
+// start with a leader, it is returned unchanged.
+func trimSubjectReFwd(s string) string {
+	t := s
+	for {
+		blob, rest := subjectBlob(t)
+		if !blob {
+			break
+		}
+		t = rest
+	}
+	lt := strings.ToLower(t)
+	switch {
+	case strings.HasPrefix(lt, "fwd"):
+		t = t[3:]
+	case strings.HasPrefix(lt, "fw"), strings.HasPrefix(lt, "re"):
+		t = t[2:]
+	default:
+		return s
+	}
+	t = strings.TrimLeft(t, " ")
+	if _, rest := subjectBlob(t); rest != t {
+		t = rest
+	}
+	if !strings.HasPrefix(t, ":") {
+		return s
+	}
+	return t[1:]
+}
+
+// ReferencedIDs returns the message-ids, with <>, referenced by a message, for
+// threading. The message-ids of the References header are returned, or if it has
+// none, the first message-id of the In-Reply-To header. ../rfc/5256:443
+func ReferencedIDs(references, inReplyTo string) []string {
+	if l := messageIDs(references); len(l) > 0 {
+		return l
+	}
+	if l := messageIDs(inReplyTo); len(l) > 0 {
+		return l[:1]
+	}
+	return nil
+}
+
+// MessageIDCanonical returns the first message-id in s, with <>, or an empty
+// string if there is none.
+func MessageIDCanonical(s string) string {
+	if l := messageIDs(s); len(l) > 0 {
+		return l[0]
+	}
+	return ""
+}
+
+// messageIDs returns the "<...>" message-ids in s, ignoring other text such as
+// comments and phrases.
+func messageIDs(s string) []string {
+	var l []string
+	for {
+		i := strings.Index(s, "<")
+		if i < 0 {
+			break
+		}
+		j := strings.Index(s[i:], ">")
+		if j < 0 {
+			break
+		}
+		if id := s[i : i+j+1]; len(id) > 2 && !strings.ContainsAny(id[1:len(id)-1], " \t<") {
+			l = append(l, id)
+		}
+		s = s[i+j+1:]
+	}
+	return l
+}
@@ -0,0 +1,49 @@
+package message
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestThreadSubject(t *testing.T) {
+	test := func(s, expBase string, expResponse bool) {
+		t.Helper()
+		base, isResponse := ThreadSubject(s)
+		if base != expBase || isResponse != expResponse {
+			t.Fatalf("thread subject of %q: got %q %v, expected %q %v", s, base, isResponse, expBase, expResponse)
+		}
+	}
+
+	test("test", "test", false)
+	test("  test   subject  ", "test subject", false)
+	test("Re: test", "test", true)
+	test("RE:test", "test", true)
+	test("Fwd: Re: test", "test", true)
+	test("re [2]: test", "test", true)
+	test("[list] Re: test", "test", true)
+	test("[list] test", "test", false)
+	test("[list]", "[list]", false)
+	test("test (fwd)", "test", true)
+	test("test (fwd) (FWD)", "test", true)
+	test("[Fwd: test]", "test", true)
+	test("[fwd: Re: test (fwd)]", "test", true)
+	test("Re: [fwd: test]", "test", true)
+	test("=?utf-8?q?Re:_t=C3=A9st?=", "tést", true)
+	test("Reply: test", "Reply: test", false)
+}
+
+func TestReferencedIDs(t *testing.T) {
+	test := func(refs, inReplyTo string, exp []string) {
+		t.Helper()
+		l := ReferencedIDs(refs, inReplyTo)
+		if !reflect.DeepEqual(l, exp) {
+			t.Fatalf("referenced ids of %q and %q: got %v, expected %v", refs, inReplyTo, l, exp)
+		}
+	}
+
+	test("", "", nil)
+	test("<a@x> <b@x>\r\n <c@x>", "<c@x>", []string{"<a@x>", "<b@x>", "<c@x>"})
+	test("", "<c@x> <d@x>", []string{"<c@x>"})
+	test("", "Your message of today (mjl) <c@x>", []string{"<c@x>"})
+	test("<>", "<bad id> <d@x>", []string{"<d@x>"})
+}
@@ -12,10 +12,10 @@ var (
 			Help: "Authentication attempts and results.",
 		},
 		[]string{
-			"kind",    // submission, imap, httpaccount, httpadmin
-			"variant", // login, plain, scram-sha-256, scram-sha-1, cram-md5, httpbasic
+			"kind",    // submission, imap, pop3, httpaccount, httpadmin, httpwebhandler
+			"variant", // login, plain, scram-sha-256, scram-sha-1, cram-md5, httpbasic, oidc
 			// todo: we currently only use badcreds, but known baduser can be helpful
-			"result", // ok, baduser, badpassword, badcreds, error, aborted
+			"result", // ok, baduser, badpassword, badcreds, suspended, error, aborted
 		},
 	)
 
@@ -25,7 +25,7 @@ var (
 			Help: "Authentication attempts that were refused due to rate limiting.",
 		},
 		[]string{
-			"kind", // submission, imap, httpaccount, httpadmin
+			"kind", // submission, imap, pop3, httpaccount, httpadmin, httpwebhandler
 		},
 	)
 )
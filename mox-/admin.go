@@ -137,6 +137,26 @@ func MakeAccountConfig(addr smtp.Address) config.Account {
 	return account
 }
 
+// applyAccountTemplate changes the config of a new account with initial address
+// addr to the settings of the account template of its domain.
+func applyAccountTemplate(acc *config.Account, addr smtp.Address, t config.AccountTemplate) {
+	if len(t.Rulesets) > 0 {
+		dest := acc.Destinations[addr.String()]
+		dest.Rulesets = append([]config.Ruleset{}, t.Rulesets...)
+		acc.Destinations[addr.String()] = dest
+	}
+	if t.RejectsMailbox != "" {
+		acc.RejectsMailbox = t.RejectsMailbox
+	}
+	if t.JunkFilter != nil {
+		jf := *t.JunkFilter
+		acc.JunkFilter = &jf
+	}
+	acc.MaxOutgoingMessagesPerDay = t.MaxOutgoingMessagesPerDay
+	acc.MaxFirstTimeRecipientsPerDay = t.MaxFirstTimeRecipientsPerDay
+	acc.SubmissionFromAllowed = append([]string(nil), t.SubmissionFromAllowed...)
+}
+
 // MakeDomainConfig makes a new config for a domain, creating DKIM keys, using
 // accountName for DMARC and TLS reports.
 func MakeDomainConfig(ctx context.Context, domain, hostname dns.Domain, accountName string, withMTASTS bool) (config.Domain, []string, error) {
@@ -412,6 +432,48 @@ func DomainRemove(ctx context.Context, domain dns.Domain) (rerr error) {
 	return nil
 }
 
+// DomainLimitsSave saves new aggregate limits for the accounts of a domain. Nil
+// or zero limits remove the limits.
+func DomainLimitsSave(ctx context.Context, domain dns.Domain, limits *config.DomainLimits) (rerr error) {
+	log := xlog.WithContext(ctx)
+	defer func() {
+		if rerr != nil {
+			log.Errorx("saving domain limits", rerr, mlog.Field("domain", domain))
+		}
+	}()
+
+	if limits != nil && (limits.MaxAccounts < 0 || limits.MaxStorage < 0 || limits.MaxOutgoingMessagesPerDay < 0) {
+		return fmt.Errorf("limits cannot be negative")
+	} else if limits != nil && *limits == (config.DomainLimits{}) {
+		limits = nil
+	}
+
+	Conf.dynamicMutex.Lock()
+	defer Conf.dynamicMutex.Unlock()
+
+	c := Conf.Dynamic
+	domConf, ok := c.Domains[domain.Name()]
+	if !ok {
+		return fmt.Errorf("domain does not exist")
+	}
+
+	// Compose new config without modifying existing data structures. If we fail, we
+	// leave no trace.
+	nc := c
+	nc.Domains = map[string]config.Domain{}
+	for name, d := range c.Domains {
+		nc.Domains[name] = d
+	}
+	domConf.Limits = limits
+	nc.Domains[domain.Name()] = domConf
+
+	if err := writeDynamic(ctx, log, nc); err != nil {
+		return fmt.Errorf("writing domains.conf: %v", err)
+	}
+	log.Info("domain limits saved", mlog.Field("domain", domain))
+	return nil
+}
+
 func WebserverConfigSet(ctx context.Context, domainRedirects map[string]string, webhandlers []config.WebHandler) (rerr error) {
 	log := xlog.WithContext(ctx)
 	defer func() {
@@ -437,6 +499,30 @@ func WebserverConfigSet(ctx context.Context, domainRedirects map[string]string,
 	return nil
 }
 
+// NoticesSave saves the notices shown to users in the IMAP greeting, SMTP banner
+// and web interfaces.
+func NoticesSave(ctx context.Context, notices []config.Notice) (rerr error) {
+	log := xlog.WithContext(ctx)
+	defer func() {
+		if rerr != nil {
+			log.Errorx("saving notices", rerr)
+		}
+	}()
+
+	Conf.dynamicMutex.Lock()
+	defer Conf.dynamicMutex.Unlock()
+
+	nc := Conf.Dynamic
+	nc.Notices = notices
+
+	if err := writeDynamic(ctx, log, nc); err != nil {
+		return fmt.Errorf("writing domains.conf: %v", err)
+	}
+
+	log.Info("notices saved", mlog.Field("notices", len(notices)))
+	return nil
+}
+
 // todo: find a way to automatically create the dns records as it would greatly simplify setting up email for a domain. we could also dynamically make changes, e.g. providing grace periods after disabling a dkim key, only automatically removing the dkim dns key after a few days. but this requires some kind of api and authentication to the dns server. there doesn't appear to be a single commonly used api for dns management. each of the numerous cloud providers have their own APIs and rather large SKDs to use them. we don't want to link all of them in.
 
 // DomainRecords returns text lines describing DNS records required for configuring
@@ -592,6 +678,18 @@ func AccountAdd(ctx context.Context, account, address string) (rerr error) {
 		return fmt.Errorf("address not available: %v", err)
 	}
 
+	if l := c.Domains[addr.Domain.Name()].Limits; l != nil && l.MaxAccounts > 0 {
+		var n int
+		for _, a := range c.Accounts {
+			if a.DNSDomain == addr.Domain {
+				n++
+			}
+		}
+		if n >= l.MaxAccounts {
+			return fmt.Errorf("max number of accounts (%d) for domain reached", l.MaxAccounts)
+		}
+	}
+
 	// Compose new config without modifying existing data structures. If we fail, we
 	// leave no trace.
 	nc := c
@@ -599,7 +697,11 @@ func AccountAdd(ctx context.Context, account, address string) (rerr error) {
 	for name, a := range c.Accounts {
 		nc.Accounts[name] = a
 	}
-	nc.Accounts[account] = MakeAccountConfig(addr)
+	acc := MakeAccountConfig(addr)
+	if dc, ok := c.Domains[addr.Domain.Name()]; ok && dc.AccountTemplate != nil {
+		applyAccountTemplate(&acc, addr, *dc.AccountTemplate)
+	}
+	nc.Accounts[account] = acc
 
 	if err := writeDynamic(ctx, log, nc); err != nil {
 		return fmt.Errorf("writing domains.conf: %v", err)
@@ -621,18 +723,32 @@ func AccountRemove(ctx context.Context, account string) (rerr error) {
 	defer Conf.dynamicMutex.Unlock()
 
 	c := Conf.Dynamic
-	if _, ok := c.Accounts[account]; !ok {
+	acc, ok := c.Accounts[account]
+	if !ok {
 		return fmt.Errorf("account does not exist")
 	}
+	// Accounts on litigation hold, directly or through their domain, must keep their
+	// messages.
+	if acc.Hold || c.Domains[acc.DNSDomain.Name()].Hold {
+		return fmt.Errorf("account is on hold, it cannot be removed")
+	}
 
 	// Compose new config without modifying existing data structures. If we fail, we
 	// leave no trace.
 	nc := c
 	nc.Accounts = map[string]config.Account{}
 	for name, a := range c.Accounts {
-		if name != account {
-			nc.Accounts[name] = a
+		if name == account {
+			continue
 		}
+		// The account can no longer send as other accounts.
+		for i, s := range a.SendDelegates {
+			if s == account {
+				a.SendDelegates = append(append([]string{}, a.SendDelegates[:i]...), a.SendDelegates[i+1:]...)
+				break
+			}
+		}
+		nc.Accounts[name] = a
 	}
 
 	if err := writeDynamic(ctx, log, nc); err != nil {
@@ -857,6 +973,155 @@ func AccountLimitsSave(ctx context.Context, account string, maxOutgoingMessagesP
 	return nil
 }
 
+// AccountSuspendSave sets whether an account is suspended, and whether incoming
+// messages are rejected with a temporary error while the account is suspended or
+// pending deletion.
+func AccountSuspendSave(ctx context.Context, account string, suspended, tempfail bool) (rerr error) {
+	log := xlog.WithContext(ctx)
+	defer func() {
+		if rerr != nil {
+			log.Errorx("saving account suspension", rerr, mlog.Field("account", account))
+		}
+	}()
+
+	Conf.dynamicMutex.Lock()
+	defer Conf.dynamicMutex.Unlock()
+
+	c := Conf.Dynamic
+	acc, ok := c.Accounts[account]
+	if !ok {
+		return fmt.Errorf("account not present")
+	}
+
+	// Compose new config without modifying existing data structures. If we fail, we
+	// leave no trace.
+	nc := c
+	nc.Accounts = map[string]config.Account{}
+	for name, a := range c.Accounts {
+		nc.Accounts[name] = a
+	}
+	acc.Suspended = suspended
+	acc.SuspendedTempfail = tempfail
+	nc.Accounts[account] = acc
+
+	if err := writeDynamic(ctx, log, nc); err != nil {
+		return fmt.Errorf("writing domains.conf: %v", err)
+	}
+	log.Info("account suspension saved", mlog.Field("account", account), mlog.Field("suspended", suspended), mlog.Field("tempfail", tempfail))
+	return nil
+}
+
+// AccountDeletionSchedule schedules removal of an account and its messages at
+// time at. Until then, the account is treated as suspended. A zero time cancels a
+// scheduled removal.
+func AccountDeletionSchedule(ctx context.Context, account string, at time.Time) (rerr error) {
+	log := xlog.WithContext(ctx)
+	defer func() {
+		if rerr != nil {
+			log.Errorx("scheduling account deletion", rerr, mlog.Field("account", account))
+		}
+	}()
+
+	Conf.dynamicMutex.Lock()
+	defer Conf.dynamicMutex.Unlock()
+
+	c := Conf.Dynamic
+	acc, ok := c.Accounts[account]
+	if !ok {
+		return fmt.Errorf("account not present")
+	}
+
+	// Compose new config without modifying existing data structures. If we fail, we
+	// leave no trace.
+	nc := c
+	nc.Accounts = map[string]config.Account{}
+	for name, a := range c.Accounts {
+		nc.Accounts[name] = a
+	}
+	if at.IsZero() {
+		acc.DeleteAt = ""
+	} else {
+		acc.DeleteAt = at.UTC().Format(time.RFC3339)
+	}
+	nc.Accounts[account] = acc
+
+	if err := writeDynamic(ctx, log, nc); err != nil {
+		return fmt.Errorf("writing domains.conf: %v", err)
+	}
+	if at.IsZero() {
+		log.Info("account deletion canceled", mlog.Field("account", account))
+	} else {
+		log.Info("account deletion scheduled", mlog.Field("account", account), mlog.Field("deleteat", acc.DeleteAt))
+	}
+	return nil
+}
+
+// AccountSweepRulesSave saves new sweep rules for an account.
+func AccountSweepRulesSave(ctx context.Context, account string, rules []config.SweepRule) (rerr error) {
+	log := xlog.WithContext(ctx)
+	defer func() {
+		if rerr != nil {
+			log.Errorx("saving account sweep rules", rerr, mlog.Field("account", account))
+		}
+	}()
+
+	Conf.dynamicMutex.Lock()
+	defer Conf.dynamicMutex.Unlock()
+
+	c := Conf.Dynamic
+	acc, ok := c.Accounts[account]
+	if !ok {
+		return fmt.Errorf("account not present")
+	}
+
+	nc := c
+	nc.Accounts = map[string]config.Account{}
+	for name, a := range c.Accounts {
+		nc.Accounts[name] = a
+	}
+	acc.SweepRules = rules
+	nc.Accounts[account] = acc
+
+	if err := writeDynamic(ctx, log, nc); err != nil {
+		return fmt.Errorf("writing domains.conf: %v", err)
+	}
+	log.Info("account sweep rules saved", mlog.Field("account", account), mlog.Field("rules", len(rules)))
+	return nil
+}
+
+// AccountSendDelegatesSave saves the accounts that may send as account.
+func AccountSendDelegatesSave(ctx context.Context, account string, delegates []string) (rerr error) {
+	log := xlog.WithContext(ctx)
+	defer func() {
+		if rerr != nil {
+			log.Errorx("saving account send delegates", rerr, mlog.Field("account", account))
+		}
+	}()
+
+	Conf.dynamicMutex.Lock()
+	defer Conf.dynamicMutex.Unlock()
+
+	c := Conf.Dynamic
+	acc, ok := c.Accounts[account]
+	if !ok {
+		return fmt.Errorf("account not present")
+	}
+
+	nc := c
+	nc.Accounts = map[string]config.Account{}
+	for name, a := range c.Accounts {
+		nc.Accounts[name] = a
+	}
+	acc.SendDelegates = delegates
+	nc.Accounts[account] = acc
+
+	if err := writeDynamic(ctx, log, nc); err != nil {
+		return fmt.Errorf("writing domains.conf: %v", err)
+	}
+	log.Info("account send delegates saved", mlog.Field("account", account), mlog.Field("delegates", delegates))
+	return nil
+}
+
 // ClientConfig holds the client configuration for IMAP/Submission for a
 // domain.
 type ClientConfig struct {
@@ -918,6 +1183,12 @@ func ClientConfigDomain(d dns.Domain) (ClientConfig, error) {
 		if l.IMAP.Enabled {
 			c.Entries = append(c.Entries, ClientConfigEntry{"IMAP", host, config.Port(l.IMAPS.Port, 143), name, note(l.TLS != nil, !l.IMAP.NoRequireSTARTTLS)})
 		}
+		if l.POP3S.Enabled {
+			c.Entries = append(c.Entries, ClientConfigEntry{"POP3", host, config.Port(l.POP3S.Port, 995), name, "with TLS"})
+		}
+		if l.POP3.Enabled {
+			c.Entries = append(c.Entries, ClientConfigEntry{"POP3", host, config.Port(l.POP3.Port, 110), name, note(l.TLS != nil, !l.POP3.NoRequireSTARTTLS)})
+		}
 	}
 
 	return c, nil
@@ -0,0 +1,296 @@
+package mox
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/mlog"
+)
+
+// Texts for system-generated messages, per language and key. Texts can have
+// placeholders like {recipient}, replaced by Text. Administrators can override
+// texts and add languages with files in the MessageCatalog directory.
+var builtinCatalog = map[string]map[string]string{
+	"en": {
+		"dsn-failure-subject": "mail delivery failed",
+		"dsn-failure-body": `
+Delivery has failed permanently for your email to:
+
+	{recipient}
+
+No further deliveries will be attempted.
+
+Error during the last delivery attempt:
+
+	{error}
+`,
+		"dsn-delay-subject": "mail delivery delayed",
+		"dsn-delay-body": `
+Delivery has been delayed of your email to:
+
+	{recipient}
+
+Next attempts to deliver: in 4 hours, 8 hours and 16 hours.
+If these attempts all fail, you will receive a notice.
+
+Error during the last delivery attempt:
+
+	{error}
+`,
+		"dsn-success-subject": "mail delivered",
+		"dsn-success-body": `
+Your email has been delivered to the mail server of:
+
+	{recipient}
+
+That server is now responsible for delivering the message to the recipient.
+`,
+		"impersonate-subject": "administrator access to your account",
+		"impersonate-body": `Hi!
+
+An administrator has started a read-only session in the account web interface
+of your account, until {expires}.
+
+Reason: {reason}
+
+Cheers,
+mox
+`,
+		"autoconfig-documentation": "Settings for {domain}, and account management",
+		"moderation-subject":       "message for {address} awaits moderation",
+		"moderation-body": `Hi!
+
+A message for {address} is held until a moderator approves it.
+
+From: {from}
+Subject: {subject}
+
+The message is attached. Approve or reject it in the account web interface:
+
+	{link}
+
+Cheers,
+mox
+`,
+		"selfcheck-subject": "mox self-check failed for {domain}",
+		"selfcheck-body": `Hi!
+
+The self-check of authentication of outgoing messages, from {from} to {to},
+found problems:
+
+{problems}
+Recipients may treat messages from this domain as spam or reject them until
+this is fixed. Check the DNS records in the admin web interface.
+
+Cheers,
+mox
+`,
+	},
+	"nl": {
+		"dsn-failure-subject": "bezorging van e-mail mislukt",
+		"dsn-failure-body": `
+De bezorging van je e-mail is definitief mislukt, aan:
+
+	{recipient}
+
+Er worden geen nieuwe pogingen meer gedaan.
+
+Fout tijdens de laatste bezorgpoging:
+
+	{error}
+`,
+		"dsn-delay-subject": "bezorging van e-mail vertraagd",
+		"dsn-delay-body": `
+De bezorging van je e-mail is vertraagd, aan:
+
+	{recipient}
+
+Volgende bezorgpogingen: over 4 uur, 8 uur en 16 uur.
+Als al deze pogingen mislukken krijg je daarover bericht.
+
+Fout tijdens de laatste bezorgpoging:
+
+	{error}
+`,
+		"dsn-success-subject": "e-mail bezorgd",
+		"dsn-success-body": `
+Je e-mail is bezorgd bij de mailserver van:
+
+	{recipient}
+
+Die server is nu verantwoordelijk voor het bezorgen van het bericht aan de ontvanger.
+`,
+		"impersonate-subject": "beheerder heeft toegang tot je account",
+		"impersonate-body": `Hoi!
+
+Een beheerder is een alleen-lezen sessie gestart in de webinterface van je
+account, tot {expires}.
+
+Reden: {reason}
+
+Groeten,
+mox
+`,
+		"autoconfig-documentation": "Instellingen voor {domain}, en accountbeheer",
+		"moderation-subject":       "bericht voor {address} wacht op moderatie",
+		"moderation-body": `Hoi!
+
+Een bericht voor {address} wordt vastgehouden totdat een moderator het goedkeurt.
+
+Van: {from}
+Onderwerp: {subject}
+
+Het bericht is bijgevoegd. Keur het goed of af in de webinterface van je account:
+
+	{link}
+
+Groeten,
+mox
+`,
+		"selfcheck-subject": "mox zelftest mislukt voor {domain}",
+		"selfcheck-body": `Hoi!
+
+De zelftest van authenticatie van uitgaande berichten, van {from} aan {to},
+heeft problemen gevonden:
+
+{problems}
+Ontvangers kunnen berichten van dit domein als spam behandelen of weigeren
+totdat dit is opgelost. Controleer de DNS-records in de webinterface voor
+beheer.
+
+Groeten,
+mox
+`,
+	},
+}
+
+// CatalogKeys returns the keys of the texts of the built-in message catalog,
+// sorted.
+func CatalogKeys() []string {
+	var l []string
+	for k := range builtinCatalog["en"] {
+		l = append(l, k)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// CatalogLanguages returns the languages of the built-in message catalog and
+// those in the configured MessageCatalog directory, sorted.
+func CatalogLanguages() []string {
+	langs := map[string]bool{}
+	for lang := range builtinCatalog {
+		langs[lang] = true
+	}
+	if dir := Conf.Static.MessageCatalog; dir != "" {
+		if entries, err := os.ReadDir(ConfigDirPath(dir)); err == nil {
+			for _, e := range entries {
+				if e.IsDir() {
+					langs[e.Name()] = true
+				}
+			}
+		}
+	}
+	var l []string
+	for lang := range langs {
+		l = append(l, lang)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// Text returns the text for key in language lang, with placeholders replaced by
+// the values in vars, given as pairs of placeholder names and values. A text in
+// the MessageCatalog directory takes precedence over the built-in text. If no
+// text exists for lang, the English text is used.
+func Text(lang, key string, vars ...string) string {
+	text, ok := catalogText(lang, key)
+	if !ok {
+		text, _ = catalogText("en", key)
+	}
+	if len(vars) == 0 {
+		return text
+	}
+	var l []string
+	for i := 0; i+1 < len(vars); i += 2 {
+		l = append(l, "{"+vars[i]+"}", vars[i+1])
+	}
+	return strings.NewReplacer(l...).Replace(text)
+}
+
+func catalogText(lang, key string) (string, bool) {
+	if dir := Conf.Static.MessageCatalog; dir != "" && lang != "" && !strings.ContainsAny(lang+key, `/\.`) {
+		p := filepath.Join(ConfigDirPath(dir), lang, key+".txt")
+		buf, err := os.ReadFile(p)
+		if err == nil {
+			return string(buf), true
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			xlog.Errorx("reading text from message catalog, using built-in text", err, mlog.Field("path", p))
+		}
+	}
+	text, ok := builtinCatalog[lang][key]
+	return text, ok
+}
+
+// DomainLanguage returns the language for system-generated messages for a
+// domain.
+func DomainLanguage(d dns.Domain) string {
+	if dc, ok := Conf.Domain(d); ok && dc.Language != "" {
+		return dc.Language
+	}
+	if Conf.Static.DefaultLanguage != "" {
+		return Conf.Static.DefaultLanguage
+	}
+	return "en"
+}
+
+// AccountLanguage returns the language for system-generated messages to an
+// account.
+func AccountLanguage(accountName string) string {
+	acc, ok := Conf.Account(accountName)
+	if !ok {
+		return DomainLanguage(dns.Domain{})
+	}
+	if acc.Language != "" {
+		return acc.Language
+	}
+	return DomainLanguage(acc.DNSDomain)
+}
+
+// AcceptLanguage returns the first language from an HTTP Accept-Language header
+// for which a message catalog exists, or fallback. Quality values are ignored,
+// languages are typically listed in order of preference.
+func AcceptLanguage(header, fallback string) string {
+	langs := CatalogLanguages()
+	has := func(lang string) bool {
+		i := sort.SearchStrings(langs, lang)
+		return i < len(langs) && langs[i] == lang
+	}
+	for _, s := range strings.Split(header, ",") {
+		tag := strings.ToLower(strings.TrimSpace(strings.SplitN(s, ";", 2)[0]))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		if has(tag) {
+			return tag
+		}
+		if t, _, ok := strings.Cut(tag, "-"); ok && has(t) {
+			return t
+		}
+	}
+	return fallback
+}
+
+var languageTagRegexp = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,8})*$`)
+
+// isLanguageTag returns whether s is a simple lower-case language tag, like "en"
+// or "pt-br", as used for directory names in the message catalog.
+func isLanguageTag(s string) bool {
+	return languageTagRegexp.MatchString(s)
+}
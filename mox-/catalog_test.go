@@ -0,0 +1,61 @@
+package mox
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCatalog(t *testing.T) {
+	// Every language must have the same keys as English.
+	for lang, texts := range builtinCatalog {
+		for _, key := range CatalogKeys() {
+			if _, ok := texts[key]; !ok {
+				t.Fatalf("language %q missing key %q", lang, key)
+			}
+		}
+		if len(texts) != len(CatalogKeys()) {
+			t.Fatalf("language %q has unknown keys", lang)
+		}
+	}
+
+	if s := Text("nl", "dsn-success-subject"); s != "e-mail bezorgd" {
+		t.Fatalf("got %q for dutch text", s)
+	}
+	if s := Text("xx", "dsn-success-subject"); s != "mail delivered" {
+		t.Fatalf("got %q for unknown language, expected fallback to english", s)
+	}
+	if s := Text("en", "autoconfig-documentation", "domain", "mox.example"); s != "Settings for mox.example, and account management" {
+		t.Fatalf("got %q with placeholder replaced", s)
+	}
+
+	// Override and new language from the catalog directory.
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "de"), 0770); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "de", "dsn-success-subject.txt"), []byte("E-Mail zugestellt"), 0660); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	Conf.Static.MessageCatalog = dir
+	defer func() {
+		Conf.Static.MessageCatalog = ""
+	}()
+	if s := Text("de", "dsn-success-subject"); s != "E-Mail zugestellt" {
+		t.Fatalf("got %q, expected text from catalog directory", s)
+	}
+	if s := Text("de", "dsn-failure-subject"); s != "mail delivery failed" {
+		t.Fatalf("got %q for key missing in catalog directory, expected fallback to english", s)
+	}
+
+	if lang := AcceptLanguage("fr-CH, de-DE;q=0.9, en;q=0.8", "en"); lang != "de" {
+		t.Fatalf("got language %q from accept-language, expected de", lang)
+	}
+	if lang := AcceptLanguage("fr", "nl"); lang != "nl" {
+		t.Fatalf("got language %q from accept-language, expected fallback nl", lang)
+	}
+
+	if !isLanguageTag("pt-br") || isLanguageTag("../en") || isLanguageTag("EN") {
+		t.Fatalf("bad language tag validation")
+	}
+}
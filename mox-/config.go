@@ -3,7 +3,10 @@ package mox
 import (
 	"bytes"
 	"context"
+	"crypto"
+	"crypto/ecdsa"
 	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
@@ -18,12 +21,14 @@ import (
 	"os/user"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"golang.org/x/exp/slices"
 	"golang.org/x/text/unicode/norm"
 
 	"github.com/mjl-/sconf"
@@ -35,6 +40,7 @@ import (
 	"github.com/mjl-/mox/moxio"
 	"github.com/mjl-/mox/moxvar"
 	"github.com/mjl-/mox/mtasts"
+	"github.com/mjl-/mox/oauth"
 	"github.com/mjl-/mox/smtp"
 )
 
@@ -148,6 +154,15 @@ func (c *Config) loadDynamic() []error {
 	return nil
 }
 
+// DynamicMtime returns the modification time of the dynamic config file at the
+// time it was last loaded.
+func (c *Config) DynamicMtime() (mtime time.Time) {
+	c.withDynamicLock(func() {
+		mtime = c.dynamicMtime
+	})
+	return
+}
+
 func (c *Config) Domains() (l []string) {
 	c.withDynamicLock(func() {
 		for name := range c.Dynamic.Domains {
@@ -169,6 +184,19 @@ func (c *Config) Accounts() (l []string) {
 	return
 }
 
+// DomainAccounts returns the names of the accounts with d as their domain, sorted.
+func (c *Config) DomainAccounts(d dns.Domain) (l []string) {
+	c.withDynamicLock(func() {
+		for name, acc := range c.Dynamic.Accounts {
+			if acc.DNSDomain == d {
+				l = append(l, name)
+			}
+		}
+	})
+	sort.Strings(l)
+	return l
+}
+
 // DomainLocalparts returns a mapping of encoded localparts to account names for a
 // domain. An empty localpart is a catchall destination for a domain.
 func (c *Config) DomainLocalparts(d dns.Domain) map[string]string {
@@ -209,6 +237,46 @@ func (c *Config) AccountDestination(addr string) (accDests AccountDestination, o
 	return
 }
 
+// Namespaces returns the IMAP namespaces for an account, as configured for the
+// account, or otherwise for the domain of the account. Nil if not configured.
+func (c *Config) Namespaces(accountName string) (ns *config.Namespaces) {
+	c.withDynamicLock(func() {
+		acc := c.Dynamic.Accounts[accountName]
+		ns = acc.Namespaces
+		if ns == nil {
+			ns = c.Dynamic.Domains[acc.DNSDomain.Name()].Namespaces
+		}
+	})
+	return
+}
+
+// MessageSizeLimit returns the maximum size of a single message for an account,
+// as configured for the account, or otherwise for the domain of the account.
+// Zero means no limit.
+func (c *Config) MessageSizeLimit(accountName string) (limit int64) {
+	c.withDynamicLock(func() {
+		acc := c.Dynamic.Accounts[accountName]
+		limit = acc.MessageSizeLimit
+		if limit == 0 {
+			limit = c.Dynamic.Domains[acc.DNSDomain.Name()].MessageSizeLimit
+		}
+	})
+	return
+}
+
+// MaxIMAPConnections returns the maximum number of simultaneous authenticated
+// IMAP connections for an account, as configured for the account, or otherwise
+// the global limit. Zero means no limit.
+func (c *Config) MaxIMAPConnections(accountName string) (max int) {
+	c.withDynamicLock(func() {
+		max = c.Dynamic.Accounts[accountName].MaxIMAPConnections
+	})
+	if max == 0 && c.Static.IMAPConnectionLimits != nil {
+		max = c.Static.IMAPConnectionLimits.MaxPerAccount
+	}
+	return
+}
+
 func (c *Config) WebServer() (r map[dns.Domain]dns.Domain, l []config.WebHandler) {
 	c.withDynamicLock(func() {
 		r = c.Dynamic.WebDNSDomainRedirects
@@ -217,6 +285,14 @@ func (c *Config) WebServer() (r map[dns.Domain]dns.Domain, l []config.WebHandler
 	return r, l
 }
 
+// Notices returns the configured notices for users.
+func (c *Config) Notices() (l []config.Notice) {
+	c.withDynamicLock(func() {
+		l = c.Dynamic.Notices
+	})
+	return
+}
+
 func (c *Config) Routes(accountName string, domain dns.Domain) (accountRoutes, domainRoutes, globalRoutes []config.Route) {
 	c.withDynamicLock(func() {
 		acc := c.Dynamic.Accounts[accountName]
@@ -488,6 +564,163 @@ func PrepareStaticConfig(ctx context.Context, configFile string, conf *Config, c
 	}
 	c.HostnameDomain = hostname
 
+	if wp := c.WebPush; wp != nil {
+		if wp.Subject == "" {
+			wp.Subject = "mailto:postmaster@" + c.Hostname
+		} else if !strings.HasPrefix(wp.Subject, "mailto:") && !strings.HasPrefix(wp.Subject, "https:") {
+			addErrorf("webpush subject must be a mailto: or https: url")
+		}
+		pemBuf, err := os.ReadFile(configDirPath(configFile, wp.VAPIDPrivateKeyFile))
+		if err != nil {
+			addErrorf("reading webpush vapid private key: %s", err)
+		} else if p, _ := pem.Decode(pemBuf); p == nil {
+			addErrorf("webpush vapid private key has no PEM block")
+		} else if key, err := x509.ParsePKCS8PrivateKey(p.Bytes); err != nil {
+			addErrorf("parsing webpush vapid private key: %s", err)
+		} else if k, ok := key.(*ecdsa.PrivateKey); !ok || k.Curve != elliptic.P256() {
+			addErrorf("webpush vapid private key must be an ecdsa p-256 key")
+		} else {
+			wp.VAPIDKey = k
+		}
+	}
+
+	if oa := c.OAuth; oa != nil {
+		if (len(oa.JWTKeyFiles) > 0) == (oa.IntrospectionURL != "") {
+			addErrorf("oauth: exactly one of JWTKeyFiles and IntrospectionURL must be set")
+		}
+		if len(oa.JWTKeyFiles) > 0 && (oa.Issuer == "" || oa.Audience == "") {
+			addErrorf("oauth: Issuer and Audience must be set with JWTKeyFiles")
+		}
+		if oa.IntrospectionURL != "" {
+			if u, err := url.Parse(oa.IntrospectionURL); err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+				addErrorf("oauth: introspection url must be an absolute http or https url")
+			}
+			oa.Validator = &oauth.Introspection{
+				URL:           oa.IntrospectionURL,
+				ClientID:      oa.IntrospectionClientID,
+				ClientSecret:  oa.IntrospectionClientSecret,
+				Issuer:        oa.Issuer,
+				Audience:      oa.Audience,
+				UsernameClaim: oa.UsernameClaim,
+			}
+		} else {
+			var keys []crypto.PublicKey
+			for _, kf := range oa.JWTKeyFiles {
+				pemBuf, err := os.ReadFile(configDirPath(configFile, kf))
+				if err != nil {
+					addErrorf("oauth: reading jwt key: %s", err)
+				} else if p, _ := pem.Decode(pemBuf); p == nil {
+					addErrorf("oauth: jwt key file %q has no PEM block", kf)
+				} else if key, err := x509.ParsePKIXPublicKey(p.Bytes); err != nil {
+					addErrorf("oauth: parsing jwt key file %q: %s", kf, err)
+				} else {
+					keys = append(keys, key)
+				}
+			}
+			oa.Validator = &oauth.JWT{
+				Keys:          keys,
+				Issuer:        oa.Issuer,
+				Audience:      oa.Audience,
+				UsernameClaim: oa.UsernameClaim,
+			}
+		}
+	}
+
+	if sc := c.SelfCheck; sc != nil {
+		var err error
+		if sc.FromAddress, err = smtp.ParseAddress(sc.From); err != nil {
+			addErrorf("parsing selfcheck from address: %s", err)
+		}
+		if sc.ToAddress, err = smtp.ParseAddress(sc.To); err != nil {
+			addErrorf("parsing selfcheck to address: %s", err)
+		}
+		if sc.Interval == 0 {
+			sc.Interval = 24 * time.Hour
+		}
+		if sc.Timeout == 0 {
+			sc.Timeout = 15 * time.Minute
+		}
+	}
+
+	if pk := c.Parking; pk != nil {
+		if pk.Period < 0 || pk.CheckInterval < 0 {
+			addErrorf("parking: period and check interval must not be negative")
+		}
+		if pk.Period == 0 {
+			pk.Period = 7 * 24 * time.Hour
+		}
+		if pk.CheckInterval == 0 {
+			pk.CheckInterval = 5 * time.Minute
+		}
+	}
+
+	if n := c.Notifications; n != nil {
+		if n.MaxPerHour < 0 {
+			addErrorf("notifications: max per hour must not be negative")
+		} else if n.MaxPerHour == 0 {
+			n.MaxPerHour = 20
+		}
+		for _, s := range n.Suppress {
+			if strings.HasPrefix(s, "@") {
+				if d, err := dns.ParseDomain(s[1:]); err != nil {
+					addErrorf("notifications: parsing suppressed domain %q: %s", s, err)
+				} else {
+					n.SuppressDomains = append(n.SuppressDomains, d)
+				}
+			} else if a, err := smtp.ParseAddress(s); err != nil {
+				addErrorf("notifications: parsing suppressed address %q: %s", s, err)
+			} else {
+				n.SuppressAddresses = append(n.SuppressAddresses, a)
+			}
+		}
+	}
+
+	for _, s := range c.TLSMetricsDomains {
+		if d, err := dns.ParseDomain(s); err != nil {
+			addErrorf("parsing tls metrics domain %q: %s", s, err)
+		} else {
+			c.TLSMetricsDNSDomains = append(c.TLSMetricsDNSDomains, d)
+		}
+	}
+
+	if l := c.IMAPConnectionLimits; l != nil && (l.MaxPerIP < 0 || l.MaxPerAccount < 0) {
+		addErrorf("imap connection limits cannot be negative")
+	}
+
+	if ma := c.MessageArchive; ma != nil {
+		if ma.Path == "" {
+			addErrorf("message archive: path required")
+		}
+		if ma.MinAge <= 0 {
+			addErrorf("message archive: minimum age must be positive")
+		}
+		if ma.Interval == 0 {
+			ma.Interval = 24 * time.Hour
+		}
+	}
+
+	if se := c.SQLExport; se != nil {
+		if se.Dir == "" {
+			addErrorf("sql export: dir required")
+		}
+		if se.Interval < 0 {
+			addErrorf("sql export: interval must be positive")
+		} else if se.Interval == 0 {
+			se.Interval = 24 * time.Hour
+		}
+	}
+
+	if c.DefaultLanguage != "" && !isLanguageTag(c.DefaultLanguage) {
+		addErrorf("invalid DefaultLanguage %q, must be a language tag like \"en\" or \"pt-br\"", c.DefaultLanguage)
+	}
+	if c.MessageCatalog != "" {
+		if fi, err := os.Stat(configDirPath(configFile, c.MessageCatalog)); err != nil {
+			addErrorf("message catalog directory: %v", err)
+		} else if !fi.IsDir() {
+			addErrorf("message catalog %q is not a directory", c.MessageCatalog)
+		}
+	}
+
 	for name, acme := range c.ACME {
 		if checkOnly {
 			continue
@@ -502,8 +735,41 @@ func PrepareStaticConfig(ctx context.Context, configFile string, conf *Config, c
 		c.ACME[name] = acme
 	}
 
+	checkSocketOptions := func(what string, o *config.SocketOptions, outgoing bool) {
+		if o == nil {
+			return
+		}
+		if runtime.GOOS != "linux" && (o.Interface != "" || o.UserTimeout != 0) {
+			addErrorf("%s: socket options Interface and UserTimeout are only supported on linux", what)
+		}
+		if o.DSCP < 0 || o.DSCP > 63 {
+			addErrorf("%s: socket option DSCP must be between 0 and 63", what)
+		}
+		if o.UserTimeout < 0 {
+			addErrorf("%s: socket option UserTimeout cannot be negative", what)
+		}
+		if !outgoing && len(o.LocalIPs) > 0 {
+			addErrorf("%s: socket option LocalIPs only applies to outgoing connections", what)
+		}
+		var have4, have6 bool
+		for _, ipstr := range o.LocalIPs {
+			ip := net.ParseIP(ipstr)
+			if ip == nil {
+				addErrorf("%s: bad local ip %q", what, ipstr)
+				continue
+			}
+			is4 := ip.To4() != nil
+			if is4 && have4 || !is4 && have6 {
+				addErrorf("%s: at most one local IPv4 and one IPv6 address allowed", what)
+			}
+			have4, have6 = have4 || is4, have6 || !is4
+			o.IPs = append(o.IPs, ip)
+		}
+	}
+
 	var haveUnspecifiedSMTPListener bool
 	for name, l := range c.Listeners {
+		checkSocketOptions(fmt.Sprintf("listener %q", name), l.SocketOptions, false)
 		if l.Hostname != "" {
 			d, err := dns.ParseDomain(l.Hostname)
 			if err != nil {
@@ -512,6 +778,16 @@ func PrepareStaticConfig(ctx context.Context, configFile string, conf *Config, c
 			l.HostnameDomain = d
 		}
 		if l.TLS != nil {
+			if kc := l.TLS.FallbackKeyCert; kc != nil && doLoadTLSKeyCerts {
+				cert, err := loadX509KeyPairPrivileged(configDirPath(configFile, kc.CertFile), configDirPath(configFile, kc.KeyFile))
+				if err != nil {
+					addErrorf("listener %q: parsing fallback x509 key pair: %v", name, err)
+				} else {
+					l.TLS.FallbackCertificate = &cert
+				}
+			}
+			fallback := l.TLS.FallbackCertificate
+
 			if l.TLS.ACME != "" && len(l.TLS.KeyCerts) != 0 {
 				addErrorf("listener %q: cannot have ACME and static key/certificates", name)
 			} else if l.TLS.ACME != "" {
@@ -528,6 +804,19 @@ func PrepareStaticConfig(ctx context.Context, configFile string, conf *Config, c
 				} else {
 					tlsconfig = acme.Manager.TLSConfig.Clone()
 					l.TLS.ACMEConfig = acme.Manager.ACMETLSConfig
+					if fallback != nil {
+						// Serve the fallback certificate for hosts we won't request a certificate for,
+						// and for HTTPS connections without SNI.
+						l.TLS.ACMEConfig = acme.Manager.ACMETLSConfig.Clone()
+						acmeGetCert := l.TLS.ACMEConfig.GetCertificate
+						l.TLS.ACMEConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+							cert, err := acmeGetCert(hello)
+							if err != nil && (hello.ServerName == "" || errors.Is(err, autotls.ErrHostNotAllowed)) {
+								return fallback, nil
+							}
+							return cert, err
+						}
+					}
 
 					// SMTP STARTTLS connections are commonly made without SNI, because certificates
 					// often aren't validated.
@@ -540,7 +829,11 @@ func PrepareStaticConfig(ctx context.Context, configFile string, conf *Config, c
 						if hello.ServerName == "" {
 							hello.ServerName = hostname.ASCII
 						}
-						return getCert(hello)
+						cert, err := getCert(hello)
+						if err != nil && fallback != nil && errors.Is(err, autotls.ErrHostNotAllowed) {
+							return fallback, nil
+						}
+						return cert, err
 					}
 				}
 				l.TLS.Config = tlsconfig
@@ -548,6 +841,20 @@ func PrepareStaticConfig(ctx context.Context, configFile string, conf *Config, c
 				if doLoadTLSKeyCerts {
 					if err := loadTLSKeyCerts(configFile, "listener "+name, l.TLS); err != nil {
 						addErrorf("%w", err)
+					} else if fallback != nil {
+						certs := l.TLS.Config.Certificates
+						l.TLS.Config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+							if hello.ServerName == "" {
+								// Without SNI, the first certificate is used.
+								return nil, nil
+							}
+							for i := range certs {
+								if hello.SupportsCertificate(&certs[i]) == nil {
+									return &certs[i], nil
+								}
+							}
+							return fallback, nil
+						}
 					}
 				}
 			} else {
@@ -583,10 +890,12 @@ func PrepareStaticConfig(ctx context.Context, configFile string, conf *Config, c
 				}
 			}
 			needtls("IMAPS", l.IMAPS.Enabled)
+			needtls("POP3S", l.POP3S.Enabled)
 			needtls("SMTP", l.SMTP.Enabled && !l.SMTP.NoSTARTTLS)
 			needtls("Submissions", l.Submissions.Enabled)
 			needtls("Submission", l.Submission.Enabled && !l.Submission.NoRequireSTARTTLS)
 			needtls("AccountHTTPS", l.AccountHTTPS.Enabled)
+			needtls("JMAPHTTPS", l.JMAPHTTPS.Enabled)
 			needtls("AdminHTTPS", l.AdminHTTPS.Enabled)
 			needtls("AutoconfigHTTPS", l.AutoconfigHTTPS.Enabled && !l.AutoconfigHTTPS.NonTLS)
 			needtls("MTASTSHTTPS", l.MTASTSHTTPS.Enabled && !l.MTASTSHTTPS.NonTLS)
@@ -595,6 +904,8 @@ func PrepareStaticConfig(ctx context.Context, configFile string, conf *Config, c
 				addErrorf("listener %q does not specify tls config, but requires tls for %s", name, strings.Join(needsTLS, ", "))
 			}
 		}
+		checkAuthMechanisms(name, &l, c.OAuth != nil, addErrorf)
+		checkProxyProtocol(name, &l, addErrorf)
 		if l.AutoconfigHTTPS.Enabled && l.MTASTSHTTPS.Enabled && l.AutoconfigHTTPS.Port == l.MTASTSHTTPS.Port && l.AutoconfigHTTPS.NonTLS != l.MTASTSHTTPS.NonTLS {
 			addErrorf("listener %q tries to enable autoconfig and mta-sts enabled on same port but with both http and https", name)
 		}
@@ -621,6 +932,14 @@ func PrepareStaticConfig(ctx context.Context, configFile string, conf *Config, c
 				}
 			}
 		}
+		for _, ipstr := range l.DNS.AXFRIPs {
+			ip := net.ParseIP(ipstr)
+			if ip == nil {
+				addErrorf("listener %q has invalid DNS AXFR IP %q", name, ipstr)
+				continue
+			}
+			l.DNS.AXFRAllowed = append(l.DNS.AXFRAllowed, ip)
+		}
 		for _, s := range l.SMTP.DNSBLs {
 			d, err := dns.ParseDomain(s)
 			if err != nil {
@@ -636,6 +955,8 @@ func PrepareStaticConfig(ctx context.Context, configFile string, conf *Config, c
 		}
 		checkPath("AccountHTTP", l.AccountHTTP.Enabled, l.AccountHTTP.Path)
 		checkPath("AccountHTTPS", l.AccountHTTPS.Enabled, l.AccountHTTPS.Path)
+		checkPath("JMAPHTTP", l.JMAPHTTP.Enabled, l.JMAPHTTP.Path)
+		checkPath("JMAPHTTPS", l.JMAPHTTPS.Enabled, l.JMAPHTTPS.Path)
 		checkPath("AdminHTTP", l.AdminHTTP.Enabled, l.AdminHTTP.Path)
 		checkPath("AdminHTTPS", l.AdminHTTPS.Enabled, l.AdminHTTPS.Path)
 		c.Listeners[name] = l
@@ -707,6 +1028,7 @@ func PrepareStaticConfig(ctx context.Context, configFile string, conf *Config, c
 	}
 
 	for name, t := range c.Transports {
+		checkSocketOptions("transport "+name, t.SocketOptions, true)
 		n := 0
 		if t.Submissions != nil {
 			n++
@@ -723,6 +1045,9 @@ func PrepareStaticConfig(ctx context.Context, configFile string, conf *Config, c
 		if t.Socks != nil {
 			n++
 			checkTransportSocks(name, t.Socks)
+			if t.SocketOptions != nil && len(t.SocketOptions.LocalIPs) > 0 {
+				addErrorf("transport %s: cannot have socket option LocalIPs with socks", name)
+			}
 		}
 		if n > 1 {
 			addErrorf("transport %s: cannot have multiple methods in a transport", name)
@@ -796,6 +1121,49 @@ func prepareDynamicConfig(ctx context.Context, dynamicPath string, static config
 		}
 	}
 
+	// Check the namespace prefixes are mailbox names that cannot overlap, and the
+	// public account exists.
+	checkNamespaces := func(ns *config.Namespaces, format string, args ...any) {
+		if ns == nil {
+			return
+		}
+		msg := fmt.Sprintf(format, args...)
+		prefixes := []string{}
+		for _, prefix := range []string{ns.SharedPrefix, ns.PublicPrefix} {
+			if prefix == "" {
+				continue
+			}
+			checkMailboxNormf(prefix, "%s", msg)
+			if strings.HasPrefix(prefix, "/") || strings.HasSuffix(prefix, "/") || strings.ContainsAny(prefix, "*%") || strings.EqualFold(strings.Split(prefix, "/")[0], "Inbox") {
+				addErrorf("%s: invalid namespace prefix %q", msg, prefix)
+			}
+			prefixes = append(prefixes, strings.ToLower(prefix)+"/")
+		}
+		if len(prefixes) == 2 && (strings.HasPrefix(prefixes[0], prefixes[1]) || strings.HasPrefix(prefixes[1], prefixes[0])) {
+			addErrorf("%s: namespace prefixes %q and %q overlap", msg, ns.SharedPrefix, ns.PublicPrefix)
+		}
+		if ns.PublicAccount != "" {
+			if _, ok := c.Accounts[ns.PublicAccount]; !ok {
+				addErrorf("%s: unknown account %q for PublicAccount", msg, ns.PublicAccount)
+			}
+		}
+	}
+
+	// Check that a delivery mailbox starting with a backslash is a known special-use
+	// attribute, delivering to the mailbox with that special-use.
+	checkDeliveryMailboxf := func(mailbox string, format string, args ...any) {
+		checkMailboxNormf(mailbox, format, args...)
+		if !strings.HasPrefix(mailbox, `\`) {
+			return
+		}
+		switch strings.ToLower(mailbox) {
+		case `\archive`, `\drafts`, `\draft`, `\junk`, `\sent`, `\trash`:
+		default:
+			msg := fmt.Sprintf(format, args...)
+			addErrorf("%s: unknown special-use mailbox %q, must be one of \\Archive, \\Drafts, \\Junk, \\Sent or \\Trash", msg, mailbox)
+		}
+	}
+
 	// Validate postmaster account exists.
 	if _, ok := c.Accounts[static.Postmaster.Account]; !ok {
 		addErrorf("postmaster account %q does not exist", static.Postmaster.Account)
@@ -847,6 +1215,102 @@ func prepareDynamicConfig(ctx context.Context, dynamicPath string, static config
 
 	checkRoutes("global routes", c.Routes)
 
+	dmarcOverrideNames := map[string]bool{}
+	for i, o := range c.DMARCOverrides {
+		if o.Name == "" {
+			addErrorf("dmarc override %d: missing name", i+1)
+		} else if dmarcOverrideNames[o.Name] {
+			addErrorf("dmarc override %q: duplicate name", o.Name)
+		}
+		dmarcOverrideNames[o.Name] = true
+		if len(o.DKIMDomains) == 0 && len(o.IPs) == 0 {
+			addErrorf("dmarc override %q: at least one of DKIMDomains and IPs required", o.Name)
+		}
+		o.DKIMDNSDomains = nil
+		for _, s := range o.DKIMDomains {
+			d, err := dns.ParseDomain(s)
+			if err != nil {
+				addErrorf("dmarc override %q: parsing dkim domain %q: %v", o.Name, s, err)
+				continue
+			}
+			o.DKIMDNSDomains = append(o.DKIMDNSDomains, d)
+		}
+		o.IPNets = nil
+		for _, s := range o.IPs {
+			if !strings.Contains(s, "/") {
+				if ip := net.ParseIP(s); ip == nil {
+					addErrorf("dmarc override %q: invalid ip %q", o.Name, s)
+					continue
+				} else if ip.To4() != nil {
+					s += "/32"
+				} else {
+					s += "/128"
+				}
+			}
+			_, ipnet, err := net.ParseCIDR(s)
+			if err != nil {
+				addErrorf("dmarc override %q: parsing ip network %q: %v", o.Name, s, err)
+				continue
+			}
+			o.IPNets = append(o.IPNets, *ipnet)
+		}
+		c.DMARCOverrides[i] = o
+	}
+
+	for i, n := range c.Notices {
+		descr := fmt.Sprintf("notice %d", i+1)
+		if n.Text == "" {
+			addErrorf("%s: missing text", descr)
+		}
+		for _, ch := range n.Text {
+			// Text ends up in IMAP and SMTP responses.
+			if ch < ' ' || ch > '~' {
+				addErrorf("%s: text must be printable ascii", descr)
+				break
+			}
+		}
+		for _, svc := range n.Services {
+			switch svc {
+			case "imap", "smtp", "web":
+			default:
+				addErrorf("%s: unknown service %q, must be imap, smtp or web", descr, svc)
+			}
+		}
+		for _, name := range n.Listeners {
+			if _, ok := static.Listeners[name]; !ok {
+				addErrorf("%s: unknown listener %q", descr, name)
+			}
+		}
+		n.DNSDomains = nil
+		for _, s := range n.Domains {
+			d, err := dns.ParseDomain(s)
+			if err != nil {
+				addErrorf("%s: parsing domain %q: %v", descr, s, err)
+				continue
+			}
+			if _, ok := c.Domains[d.Name()]; !ok {
+				addErrorf("%s: unknown domain %q", descr, s)
+			}
+			n.DNSDomains = append(n.DNSDomains, d)
+		}
+		parseTime := func(s, field string) time.Time {
+			if s == "" {
+				return time.Time{}
+			}
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				addErrorf("%s: parsing %s time %q: %v", descr, field, s, err)
+			}
+			return t
+		}
+		n.StartTime = parseTime(n.Start, "start")
+		n.EndTime = parseTime(n.End, "end")
+		if !n.StartTime.IsZero() && !n.EndTime.IsZero() && !n.EndTime.After(n.StartTime) {
+			addErrorf("%s: end time must be after start time", descr)
+		}
+		c.Notices[i] = n
+	}
+
 	// Validate domains.
 	for d, domain := range c.Domains {
 		dnsdomain, err := dns.ParseDomain(d)
@@ -967,6 +1431,105 @@ func prepareDynamicConfig(ctx context.Context, dynamicPath string, static config
 
 		checkRoutes("routes for domain", domain.Routes)
 
+		for i, tr := range domain.TransportRules {
+			addTRErrorf := func(format string, args ...any) {
+				addErrorf("domain %s: transport rule %d: %s", d, i+1, fmt.Sprintf(format, args...))
+			}
+			if tr.Name == "" {
+				addTRErrorf("name required")
+			}
+			switch tr.Direction {
+			case "", "incoming", "outgoing":
+			default:
+				addTRErrorf("invalid direction %q, must be empty, incoming or outgoing", tr.Direction)
+			}
+			if (tr.Transport != "" || tr.Moderate) && tr.Direction != "outgoing" {
+				addTRErrorf("transport and moderate require direction outgoing")
+			}
+			if tr.Transport != "" {
+				if _, ok := static.Transports[tr.Transport]; !ok {
+					addTRErrorf("unknown transport %q", tr.Transport)
+				}
+			}
+			if len(tr.BCC) == 0 && tr.SubjectPrefix == "" && tr.Transport == "" && !tr.Moderate {
+				addTRErrorf("must have at least one action")
+			}
+			compile := func(s string) *regexp.Regexp {
+				if s == "" {
+					return nil
+				}
+				r, err := regexp.Compile(s)
+				if err != nil {
+					addTRErrorf("invalid regexp %q: %v", s, err)
+				}
+				return r
+			}
+			domain.TransportRules[i].SenderRegexpCompiled = compile(tr.SenderRegexp)
+			domain.TransportRules[i].RecipientRegexpCompiled = compile(tr.RecipientRegexp)
+			var hdr [][2]*regexp.Regexp
+			for k, v := range tr.HeadersRegexp {
+				if strings.ToLower(k) != k || strings.ToLower(v) != v {
+					addTRErrorf("header field %q and value %q must only have lower case characters", k, v)
+				}
+				hdr = append(hdr, [...]*regexp.Regexp{compile(k), compile(v)})
+			}
+			domain.TransportRules[i].HeadersRegexpCompiled = hdr
+			var paths []smtp.Path
+			for _, s := range tr.BCC {
+				addr, err := smtp.ParseAddress(s)
+				if err != nil {
+					addTRErrorf("parsing BCC address %q: %v", s, err)
+					continue
+				}
+				paths = append(paths, smtp.Path{Localpart: addr.Localpart, IPDomain: dns.IPDomain{Domain: addr.Domain}})
+			}
+			domain.TransportRules[i].BCCPaths = paths
+		}
+
+		if domain.Language != "" && !isLanguageTag(domain.Language) {
+			addErrorf("domain %s: invalid Language %q", d, domain.Language)
+		}
+
+		if l := domain.Limits; l != nil && (l.MaxAccounts < 0 || l.MaxStorage < 0 || l.MaxOutgoingMessagesPerDay < 0) {
+			addErrorf("domain %s: limits cannot be negative", d)
+		}
+
+		checkNamespaces(domain.Namespaces, "domain %s", d)
+		if domain.MessageSizeLimit < 0 {
+			addErrorf("domain %s: MessageSizeLimit cannot be negative", d)
+		}
+
+		if domain.JournalAddress != "" {
+			addr, err := smtp.ParseAddress(domain.JournalAddress)
+			if err != nil {
+				addErrorf("domain %s: parsing JournalAddress: %v", d, err)
+			}
+			domain.JournalPath = smtp.Path{Localpart: addr.Localpart, IPDomain: dns.IPDomain{Domain: addr.Domain}}
+		}
+
+		if t := domain.AccountTemplate; t != nil {
+			for _, mb := range t.Mailboxes {
+				checkMailboxNormf(mb, "account template for domain %s", d)
+			}
+			for i, rs := range t.Rulesets {
+				checkMailboxNormf(rs.Mailbox, "account template for domain %s, ruleset %d", d, i+1)
+				if rs.SMTPMailFromRegexp == "" && rs.VerifiedDomain == "" && len(rs.HeadersRegexp) == 0 {
+					addErrorf("account template for domain %s: ruleset %d must have at least one rule", d, i+1)
+				}
+			}
+			for _, s := range t.SubmissionFromAllowed {
+				var err error
+				if strings.HasPrefix(s, "@") {
+					_, err = dns.ParseDomain(s[1:])
+				} else {
+					_, err = smtp.ParseAddress(s)
+				}
+				if err != nil {
+					addErrorf("account template for domain %s: parsing SubmissionFromAllowed %q: %v", d, s, err)
+				}
+			}
+		}
+
 		c.Domains[d] = domain
 	}
 
@@ -979,10 +1542,100 @@ func prepareDynamicConfig(ctx context.Context, dynamicPath string, static config
 			addErrorf("parsing domain %s for account %q: %s", acc.Domain, accName, err)
 		}
 
+		if acc.Language != "" && !isLanguageTag(acc.Language) {
+			addErrorf("account %q: invalid Language %q", accName, acc.Language)
+		}
+
 		if strings.EqualFold(acc.RejectsMailbox, "Inbox") {
 			addErrorf("account %q: cannot set RejectsMailbox to inbox, messages will be removed automatically from the rejects mailbox", accName)
 		}
 		checkMailboxNormf(acc.RejectsMailbox, "account %q", accName)
+		checkNamespaces(acc.Namespaces, "account %q", accName)
+		if acc.MessageSizeLimit < 0 {
+			addErrorf("account %q: MessageSizeLimit cannot be negative", accName)
+		}
+		if acc.MaxIMAPConnections < 0 {
+			addErrorf("account %q: MaxIMAPConnections cannot be negative", accName)
+		}
+
+		if acc.JournalAddress != "" {
+			addr, err := smtp.ParseAddress(acc.JournalAddress)
+			if err != nil {
+				addErrorf("account %q: parsing JournalAddress: %v", accName, err)
+			}
+			acc.JournalPath = smtp.Path{Localpart: addr.Localpart, IPDomain: dns.IPDomain{Domain: addr.Domain}}
+		}
+
+		if acc.DeleteAt != "" {
+			t, err := time.Parse(time.RFC3339, acc.DeleteAt)
+			if err != nil {
+				addErrorf("account %q: parsing DeleteAt time %q: %v", accName, acc.DeleteAt, err)
+			}
+			acc.DeleteAtTime = t
+		}
+
+		for _, s := range acc.SubmissionFromAllowed {
+			var d dns.Domain
+			var err error
+			if strings.HasPrefix(s, "@") {
+				d, err = dns.ParseDomain(s[1:])
+			} else {
+				var addr smtp.Address
+				addr, err = smtp.ParseAddress(s)
+				d = addr.Domain
+			}
+			if err != nil {
+				addErrorf("account %q: parsing SubmissionFromAllowed %q: %v", accName, s, err)
+			} else if _, ok := c.Domains[d.Name()]; !ok {
+				addErrorf("account %q: unknown domain for SubmissionFromAllowed %q", accName, s)
+			}
+		}
+
+		for _, name := range acc.SendDelegates {
+			if name == accName {
+				addErrorf("account %q: cannot be its own SendDelegate", accName)
+			} else if _, ok := c.Accounts[name]; !ok {
+				addErrorf("account %q: unknown account %q for SendDelegates", accName, name)
+			}
+		}
+
+		for i, sr := range acc.SweepRules {
+			if sr.Mailbox == "" {
+				addErrorf("account %q: sweep rule %d: missing mailbox", accName, i+1)
+			}
+			checkMailboxNormf(sr.Mailbox, "account %q: sweep rule %d", accName, i+1)
+			checkMailboxNormf(sr.MoveTo, "account %q: sweep rule %d: MoveTo", accName, i+1)
+			if sr.OlderThanDays <= 0 {
+				addErrorf("account %q: sweep rule %d: OlderThanDays must be positive", accName, i+1)
+			}
+			if (sr.MoveTo == "") == !sr.Delete {
+				addErrorf("account %q: sweep rule %d: exactly one of MoveTo and Delete must be set", accName, i+1)
+			}
+			if sr.MoveTo != "" && sr.MoveTo == sr.Mailbox {
+				addErrorf("account %q: sweep rule %d: MoveTo must be different from Mailbox", accName, i+1)
+			}
+		}
+
+		for i, wh := range acc.Webhooks {
+			if u, err := url.Parse(wh.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				addErrorf("account %q: webhook %d: URL must be an http or https url", accName, i+1)
+			}
+			for _, ev := range wh.Events {
+				switch ev {
+				case "incoming", "delivered", "delayed", "failed":
+				default:
+					addErrorf("account %q: webhook %d: unknown event %q", accName, i+1, ev)
+				}
+			}
+			if len(wh.Secrets) == 0 {
+				addErrorf("account %q: webhook %d: at least one secret required", accName, i+1)
+			}
+			for j, secret := range wh.Secrets {
+				if len(secret) < 16 {
+					addErrorf("account %q: webhook %d: secret %d must be at least 16 characters", accName, i+1, j+1)
+				}
+			}
+		}
 
 		if acc.AutomaticJunkFlags.JunkMailboxRegexp != "" {
 			r, err := regexp.Compile(acc.AutomaticJunkFlags.JunkMailboxRegexp)
@@ -1011,10 +1664,16 @@ func prepareDynamicConfig(ctx context.Context, dynamicPath string, static config
 		replaceLocalparts := map[string]string{}
 
 		for addrName, dest := range acc.Destinations {
-			checkMailboxNormf(dest.Mailbox, "account %q, destination %q", accName, addrName)
+			checkDeliveryMailboxf(dest.Mailbox, "account %q, destination %q", accName, addrName)
+
+			for _, mod := range dest.Moderators {
+				if _, ok := c.Accounts[mod]; !ok {
+					addErrorf("account %q, destination %q: unknown moderator account %q", accName, addrName, mod)
+				}
+			}
 
 			for i, rs := range dest.Rulesets {
-				checkMailboxNormf(rs.Mailbox, "account %q, destination %q, ruleset %d", accName, addrName, i+1)
+				checkDeliveryMailboxf(rs.Mailbox, "account %q, destination %q, ruleset %d", accName, addrName, i+1)
 
 				n := 0
 
@@ -1308,10 +1967,62 @@ func prepareDynamicConfig(ctx context.Context, dynamicPath string, static config
 					addErrorf("webforward %s %s: bad header %q", wh.Domain, wh.PathRegexp, xk)
 				}
 			}
+			for k := range wf.RequestHeaders {
+				xk := k
+				k := strings.TrimSpace(xk)
+				if k != xk || k == "" {
+					addErrorf("webforward %s %s: bad request header %q", wh.Domain, wh.PathRegexp, xk)
+				}
+			}
+			for _, k := range wf.RemoveResponseHeaders {
+				xk := k
+				k := strings.TrimSpace(xk)
+				if k != xk || k == "" {
+					addErrorf("webforward %s %s: bad header to remove %q", wh.Domain, wh.PathRegexp, xk)
+				}
+			}
+			if wf.HTTP2 && u != nil && u.Scheme != "http" {
+				addErrorf("webforward %s %s: HTTP2 only applies to backends with http url, https backends negotiate http/2 automatically", wh.Domain, wh.PathRegexp)
+			}
 		}
 		if n != 1 {
 			addErrorf("webhandler %s %s: must have exactly one handler, not %d", wh.Domain, wh.PathRegexp, n)
 		}
+
+		if wa := wh.Auth; wa != nil {
+			if wa.BasicAuth == (wa.OIDC != nil) {
+				addErrorf("webhandler %s %s: auth must have exactly one of BasicAuth and OIDC", wh.Domain, wh.PathRegexp)
+			}
+			if wa.OIDC != nil {
+				if len(wa.Allow) == 0 {
+					addErrorf("webhandler %s %s: auth with oidc requires allowed addresses or domains", wh.Domain, wh.PathRegexp)
+				}
+				if u, err := url.Parse(wa.OIDC.Issuer); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+					addErrorf("webhandler %s %s: oidc issuer must be an http or https url", wh.Domain, wh.PathRegexp)
+				}
+				if wa.OIDC.ClientID == "" {
+					addErrorf("webhandler %s %s: oidc client id required", wh.Domain, wh.PathRegexp)
+				}
+				if wa.OIDC.CallbackPath == "" {
+					wa.OIDC.CallbackPath = "/.mox/oidc-callback"
+				} else if !strings.HasPrefix(wa.OIDC.CallbackPath, "/") {
+					addErrorf("webhandler %s %s: oidc callback path must start with a slash", wh.Domain, wh.PathRegexp)
+				}
+			}
+			for _, s := range wa.Allow {
+				if strings.HasPrefix(s, "@") {
+					if d, err := dns.ParseDomain(s[1:]); err != nil {
+						addErrorf("webhandler %s %s: auth: parsing allowed domain %q: %s", wh.Domain, wh.PathRegexp, s, err)
+					} else {
+						wa.AllowDomains = append(wa.AllowDomains, d)
+					}
+				} else if a, err := smtp.ParseAddress(s); err != nil {
+					addErrorf("webhandler %s %s: auth: parsing allowed address %q: %s", wh.Domain, wh.PathRegexp, s, err)
+				} else {
+					wa.AllowAddresses = append(wa.AllowAddresses, a)
+				}
+			}
+		}
 	}
 
 	return
@@ -1357,3 +2068,124 @@ func readFilePrivileged(path string) ([]byte, error) {
 	defer f.Close()
 	return io.ReadAll(f)
 }
+
+// checkProxyProtocol parses the load balancer networks of listener l, which are
+// required when a service accepts the PROXY protocol.
+func checkProxyProtocol(name string, l *config.Listener, addErrorf func(format string, args ...any)) {
+	var services []string
+	for _, s := range []struct {
+		name string
+		v    bool
+	}{
+		{"Submission", l.Submission.Enabled && l.Submission.ProxyProtocol},
+		{"Submissions", l.Submissions.Enabled && l.Submissions.ProxyProtocol},
+		{"IMAP", l.IMAP.Enabled && l.IMAP.ProxyProtocol},
+		{"IMAPS", l.IMAPS.Enabled && l.IMAPS.ProxyProtocol},
+	} {
+		if s.v {
+			services = append(services, s.name)
+		}
+	}
+	if len(services) > 0 && len(l.ProxyProtocolFrom) == 0 {
+		addErrorf("listener %q enables ProxyProtocol for %s, but has no ProxyProtocolFrom", name, strings.Join(services, ", "))
+	} else if len(services) == 0 && len(l.ProxyProtocolFrom) > 0 {
+		addErrorf("listener %q has ProxyProtocolFrom, but no enabled service with ProxyProtocol", name)
+	}
+
+	l.ProxyProtocolNets = nil
+	for _, s := range l.ProxyProtocolFrom {
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			l.ProxyProtocolNets = append(l.ProxyProtocolNets, net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			addErrorf("listener %q: parsing ProxyProtocolFrom %q: must be ip or network in cidr notation", name, s)
+			continue
+		}
+		l.ProxyProtocolNets = append(l.ProxyProtocolNets, *ipnet)
+	}
+}
+
+// checkAuthMechanisms validates and parses the SASL mechanisms of listener l,
+// and rejects combinations that would allow authentication where it was not
+// intended.
+func checkAuthMechanisms(name string, l *config.Listener, oauthEnabled bool, addErrorf func(format string, args ...any)) {
+	var authServices []string
+	authService := func(s string, v bool) {
+		if v {
+			authServices = append(authServices, s)
+		}
+	}
+	authService("Submission", l.Submission.Enabled)
+	authService("Submissions", l.Submissions.Enabled)
+	authService("IMAP", l.IMAP.Enabled)
+	authService("IMAPS", l.IMAPS.Enabled)
+	authService("POP3", l.POP3.Enabled)
+	authService("POP3S", l.POP3S.Enabled)
+	authService("AccountHTTP", l.AccountHTTP.Enabled)
+	authService("AccountHTTPS", l.AccountHTTPS.Enabled)
+	authService("JMAPHTTP", l.JMAPHTTP.Enabled)
+	authService("JMAPHTTPS", l.JMAPHTTPS.Enabled)
+	authService("AdminHTTP", l.AdminHTTP.Enabled)
+	authService("AdminHTTPS", l.AdminHTTPS.Enabled)
+	if l.NoAuth {
+		if len(authServices) > 0 {
+			addErrorf("listener %q has NoAuth set, but enables services with authentication: %s", name, strings.Join(authServices, ", "))
+		}
+		if len(l.AuthMechanisms) > 0 {
+			addErrorf("listener %q has NoAuth set, but also configures AuthMechanisms", name)
+		}
+		return
+	}
+	if len(l.AuthMechanisms) > 0 && !l.Submission.Enabled && !l.Submissions.Enabled && !l.IMAP.Enabled && !l.IMAPS.Enabled && !l.POP3.Enabled && !l.POP3S.Enabled {
+		addErrorf("listener %q configures AuthMechanisms, but no submission, imap or pop3 service is enabled", name)
+	}
+
+	// Services that allow authentication without TLS.
+	var plaintextServices []string
+	if l.Submission.Enabled && l.Submission.NoRequireSTARTTLS {
+		plaintextServices = append(plaintextServices, "Submission")
+	}
+	if l.IMAP.Enabled && l.IMAP.NoRequireSTARTTLS {
+		plaintextServices = append(plaintextServices, "IMAP")
+	}
+	if l.POP3.Enabled && l.POP3.NoRequireSTARTTLS {
+		plaintextServices = append(plaintextServices, "POP3")
+	}
+
+	seen := map[string]bool{}
+	for i, m := range l.AuthMechanisms {
+		m.Mechanism = strings.ToUpper(m.Mechanism)
+		if !config.AuthMechanismKnown(m.Mechanism) {
+			addErrorf("listener %q: unknown auth mechanism %q, must be one of %s", name, m.Mechanism, strings.Join(append(append([]string{}, config.AuthMechanismsDefault...), config.AuthMechanismsOAuth...), ", "))
+		} else if slices.Contains(config.AuthMechanismsOAuth, m.Mechanism) && !oauthEnabled {
+			addErrorf("listener %q: auth mechanism %q requires OAuth to be configured", name, m.Mechanism)
+		} else if seen[m.Mechanism] {
+			addErrorf("listener %q: duplicate auth mechanism %q", name, m.Mechanism)
+		}
+		seen[m.Mechanism] = true
+
+		m.ParsedIPNets = nil
+		for _, s := range m.IPNets {
+			_, ipnet, err := net.ParseCIDR(s)
+			if err != nil {
+				addErrorf("listener %q: auth mechanism %q: parsing ip network %q: %v", name, m.Mechanism, s, err)
+				continue
+			}
+			m.ParsedIPNets = append(m.ParsedIPNets, *ipnet)
+		}
+
+		if m.Mechanism == "PLAIN" && !m.RequireTLS && len(m.IPNets) == 0 && len(plaintextServices) > 0 {
+			addErrorf("listener %q: auth mechanism PLAIN would accept plain text passwords without TLS from all networks for %s, set RequireTLS or IPNets", name, strings.Join(plaintextServices, ", "))
+		} else if slices.Contains(config.AuthMechanismsOAuth, m.Mechanism) && !m.RequireTLS && len(m.IPNets) == 0 && len(plaintextServices) > 0 {
+			addErrorf("listener %q: auth mechanism %s would accept bearer tokens without TLS from all networks for %s, set RequireTLS or IPNets", name, m.Mechanism, strings.Join(plaintextServices, ", "))
+		}
+		l.AuthMechanisms[i] = m
+	}
+}
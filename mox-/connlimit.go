@@ -0,0 +1,252 @@
+package mox
+
+import (
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/ratelimit"
+)
+
+var (
+	metricConnectionRefused = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mox_connection_refused_total",
+			Help: "Incoming connections refused due to listener connection limits.",
+		},
+		[]string{
+			"listener",
+			"reason", // "max", "maxperip", "rate"
+		},
+	)
+)
+
+// connLimiter enforces the connection limits of a listener, for all its services.
+type connLimiter struct {
+	listener string
+	limits   config.ConnectionLimits
+
+	perIP *ratelimit.Limiter // Open connections per IP, only if MaxConnectionsPerIP is set.
+	rate  *ratelimit.Limiter // New connections per minute per IP, only if AcceptsPerMinutePerIP is set.
+
+	sync.Mutex
+	open    int64
+	refused int64
+}
+
+var connLimiters = struct {
+	sync.Mutex
+	limiters map[string]*connLimiter
+}{
+	limiters: map[string]*connLimiter{},
+}
+
+// LimitListener returns a listener that enforces the ConnectionLimits of the named
+// listener from the configuration, closing accepted connections that are over a
+// limit. The limits are shared by all network listeners for the same named
+// listener. If no limits are configured, ln is returned as is.
+func LimitListener(ln net.Listener, listenerName string) net.Listener {
+	limits := Conf.Static.Listeners[listenerName].ConnectionLimits
+	if limits == nil {
+		return ln
+	}
+
+	connLimiters.Lock()
+	defer connLimiters.Unlock()
+	cl := connLimiters.limiters[listenerName]
+	if cl == nil {
+		cl = &connLimiter{listener: listenerName, limits: *limits}
+		// The limiters work on three classes of IP, we only limit the first: the IPv4
+		// address or the IPv6 /64 network.
+		if limits.MaxConnectionsPerIP > 0 {
+			cl.perIP = &ratelimit.Limiter{
+				WindowLimits: []ratelimit.WindowLimit{
+					{
+						Window: time.Duration(math.MaxInt64), // All of time.
+						Limits: [...]int64{int64(limits.MaxConnectionsPerIP), math.MaxInt64, math.MaxInt64},
+					},
+				},
+			}
+		}
+		if limits.AcceptsPerMinutePerIP > 0 {
+			cl.rate = &ratelimit.Limiter{
+				WindowLimits: []ratelimit.WindowLimit{
+					{
+						Window: time.Minute,
+						Limits: [...]int64{int64(limits.AcceptsPerMinutePerIP), math.MaxInt64, math.MaxInt64},
+					},
+				},
+			}
+		}
+		promauto.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "mox_listener_connections_open",
+				Help: "Open connections for listeners with connection limits, for all services.",
+				ConstLabels: prometheus.Labels{
+					"listener": listenerName,
+				},
+			},
+			func() float64 {
+				cl.Lock()
+				defer cl.Unlock()
+				return float64(cl.open)
+			},
+		)
+		connLimiters.limiters[listenerName] = cl
+	}
+	return &limitListener{ln, cl}
+}
+
+// add registers a new connection, returning a non-empty reason if the
+// connection is over a limit.
+func (cl *connLimiter) add(ip net.IP, now time.Time) (reason string) {
+	cl.Lock()
+	defer cl.Unlock()
+
+	defer func() {
+		if reason != "" {
+			cl.refused++
+		}
+	}()
+
+	if cl.limits.MaxConnections > 0 && cl.open >= int64(cl.limits.MaxConnections) {
+		return "max"
+	}
+	if cl.rate != nil && ip != nil && !cl.rate.Add(ip, now, 1) {
+		return "rate"
+	}
+	if cl.perIP != nil && ip != nil && !cl.perIP.Add(ip, now, 1) {
+		return "maxperip"
+	}
+	cl.open++
+	return ""
+}
+
+func (cl *connLimiter) remove(ip net.IP) {
+	cl.Lock()
+	defer cl.Unlock()
+	cl.open--
+	if cl.perIP != nil && ip != nil {
+		cl.perIP.Add(ip, time.Now(), -1)
+	}
+}
+
+type limitListener struct {
+	net.Listener
+	cl *connLimiter
+}
+
+// Accept returns the next connection that is within the limits. Connections over
+// a limit are closed and not returned.
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		var ip net.IP
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			ip = addr.IP
+		}
+		if reason := l.cl.add(ip, time.Now()); reason != "" {
+			metricConnectionRefused.WithLabelValues(l.cl.listener, reason).Inc()
+			xlog.Debug("refusing connection due to listener connection limit", mlog.Field("listener", l.cl.listener), mlog.Field("reason", reason), mlog.Field("remoteip", ip))
+			err := conn.Close()
+			xlog.Check(err, "closing refused connection")
+			continue
+		}
+		return &limitConn{Conn: conn, cl: l.cl, ip: ip}, nil
+	}
+}
+
+// limitConn releases its slot in the connection limiter when closed, and applies
+// the idle timeout to reads.
+type limitConn struct {
+	net.Conn
+	cl *connLimiter
+	ip net.IP
+
+	sync.Mutex
+	closed       bool
+	readDeadline time.Time // As set explicitly by the user of the connection.
+}
+
+// NetConn returns the underlying connection, like tls.Conn.NetConn.
+func (c *limitConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *limitConn) Read(buf []byte) (int, error) {
+	if idle := c.cl.limits.IdleTimeout; idle > 0 {
+		c.Lock()
+		deadline := time.Now().Add(idle)
+		if !c.readDeadline.IsZero() && c.readDeadline.Before(deadline) {
+			deadline = c.readDeadline
+		}
+		c.Unlock()
+		if err := c.Conn.SetReadDeadline(deadline); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Read(buf)
+}
+
+func (c *limitConn) SetDeadline(t time.Time) error {
+	c.Lock()
+	c.readDeadline = t
+	c.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *limitConn) SetReadDeadline(t time.Time) error {
+	c.Lock()
+	c.readDeadline = t
+	c.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *limitConn) Close() error {
+	c.Lock()
+	closed := c.closed
+	c.closed = true
+	c.Unlock()
+	if !closed {
+		c.cl.remove(c.ip)
+	}
+	return c.Conn.Close()
+}
+
+// ListenerConnections is the connection usage for a listener with connection
+// limits.
+type ListenerConnections struct {
+	Listener              string
+	Open                  int64 // Currently open connections, for all services.
+	Refused               int64 // Connections refused since startup.
+	MaxConnections        int
+	MaxConnectionsPerIP   int
+	AcceptsPerMinutePerIP int
+}
+
+// ConnectionLimitsUsage returns the connection usage for listeners with
+// connection limits, sorted by listener name.
+func ConnectionLimitsUsage() []ListenerConnections {
+	connLimiters.Lock()
+	defer connLimiters.Unlock()
+	var l []ListenerConnections
+	for _, cl := range connLimiters.limiters {
+		cl.Lock()
+		l = append(l, ListenerConnections{cl.listener, cl.open, cl.refused, cl.limits.MaxConnections, cl.limits.MaxConnectionsPerIP, cl.limits.AcceptsPerMinutePerIP})
+		cl.Unlock()
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Listener < l[j].Listener
+	})
+	return l
+}
@@ -0,0 +1,90 @@
+package mox
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mjl-/mox/config"
+)
+
+func TestLimitListener(t *testing.T) {
+	Conf.Static.Listeners = map[string]config.Listener{
+		"limited": {
+			ConnectionLimits: &config.ConnectionLimits{
+				MaxConnections:      2,
+				MaxConnectionsPerIP: 1,
+				IdleTimeout:         100 * time.Millisecond,
+			},
+		},
+		"unlimited": {},
+	}
+	defer func() {
+		Conf.Static.Listeners = nil
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	if LimitListener(ln, "unlimited") != ln {
+		t.Fatalf("listener without limits was wrapped")
+	}
+	lln := LimitListener(ln, "limited")
+
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := lln.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	dial := func() net.Conn {
+		t.Helper()
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		return conn
+	}
+
+	// First connection is accepted.
+	c0 := dial()
+	defer c0.Close()
+	sc0 := <-accepted
+
+	// Second connection from same IP gets closed immediately.
+	c1 := dial()
+	defer c1.Close()
+	c1.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c1.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read on refused connection, got err %v, expected connection closed", err)
+	}
+
+	usage := ConnectionLimitsUsage()
+	if len(usage) != 1 || usage[0].Listener != "limited" || usage[0].Open != 1 || usage[0].Refused != 1 {
+		t.Fatalf("got usage %v, expected 1 open and 1 refused", usage)
+	}
+
+	// The server side read times out due to the idle timeout.
+	if _, err := sc0.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read, got err %v, expected deadline exceeded", err)
+	}
+
+	// After closing, a new connection is accepted again.
+	sc0.Close()
+	c2 := dial()
+	defer c2.Close()
+	sc2 := <-accepted
+	sc2.Close()
+	ln.Close()
+	<-accepted
+}
@@ -0,0 +1,96 @@
+package mox
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/dkim"
+)
+
+var metricDMARCOverride = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mox_dmarc_override_total",
+		Help: "Incoming messages not rejected despite a failing DMARC reject policy, due to a matching DMARC override.",
+	},
+	[]string{
+		"name",
+	},
+)
+
+var dmarcOverrideHits = struct {
+	sync.Mutex
+	hits map[string]DMARCOverrideUsage
+}{hits: map[string]DMARCOverrideUsage{}}
+
+// DMARCOverrideUsage is a configured DMARC override with the number of messages
+// it matched since startup.
+type DMARCOverrideUsage struct {
+	Override config.DMARCOverride
+	Hits     int64
+	LastHit  time.Time // Zero if no hits.
+}
+
+// DMARCOverrideMatch returns the first configured DMARC override that matches
+// a message delivered from remoteIP with the DKIM results. Only DKIM signatures
+// that pass are considered. A hit is recorded for the returned override.
+func DMARCOverrideMatch(remoteIP net.IP, dkimResults []dkim.Result) (config.DMARCOverride, bool) {
+	var overrides []config.DMARCOverride
+	Conf.withDynamicLock(func() {
+		overrides = Conf.Dynamic.DMARCOverrides
+	})
+
+	match := func(o config.DMARCOverride) bool {
+		for _, ipnet := range o.IPNets {
+			if remoteIP != nil && ipnet.Contains(remoteIP) {
+				return true
+			}
+		}
+		for _, d := range o.DKIMDNSDomains {
+			for _, r := range dkimResults {
+				if r.Status == dkim.StatusPass && r.Sig != nil && r.Sig.Domain == d {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	for _, o := range overrides {
+		if !match(o) {
+			continue
+		}
+		metricDMARCOverride.WithLabelValues(o.Name).Inc()
+		dmarcOverrideHits.Lock()
+		u := dmarcOverrideHits.hits[o.Name]
+		u.Hits++
+		u.LastHit = time.Now()
+		dmarcOverrideHits.hits[o.Name] = u
+		dmarcOverrideHits.Unlock()
+		return o, true
+	}
+	return config.DMARCOverride{}, false
+}
+
+// DMARCOverrides returns the configured DMARC overrides, in configuration order,
+// with their hit counts.
+func DMARCOverrides() []DMARCOverrideUsage {
+	var overrides []config.DMARCOverride
+	Conf.withDynamicLock(func() {
+		overrides = Conf.Dynamic.DMARCOverrides
+	})
+
+	dmarcOverrideHits.Lock()
+	defer dmarcOverrideHits.Unlock()
+	l := make([]DMARCOverrideUsage, len(overrides))
+	for i, o := range overrides {
+		u := dmarcOverrideHits.hits[o.Name]
+		u.Override = o
+		l[i] = u
+	}
+	return l
+}
@@ -16,6 +16,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 
+	"github.com/mjl-/mox/config"
 	"github.com/mjl-/mox/mlog"
 )
 
@@ -143,7 +144,10 @@ var FilesImmediate bool
 // Listen returns a newly created network listener when starting as root, and
 // otherwise (not root) returns a network listener from a file descriptor that was
 // passed by the parent root process.
-func Listen(network, addr string) (net.Listener, error) {
+//
+// If opts is not nil, the socket options are applied to the new listening socket,
+// and to accepted connections.
+func Listen(network, addr string, opts *config.SocketOptions) (net.Listener, error) {
 	if os.Getuid() != 0 && !FilesImmediate {
 		f, ok := passedListeners[addr]
 		if !ok {
@@ -153,6 +157,9 @@ func Listen(network, addr string) (net.Listener, error) {
 		if err != nil {
 			return nil, fmt.Errorf("making network listener from file descriptor for address %s: %v", addr, err)
 		}
+		if opts != nil {
+			ln = sockoptListener{ln, opts}
+		}
 		return ln, nil
 	}
 
@@ -160,7 +167,8 @@ func Listen(network, addr string) (net.Listener, error) {
 		return nil, fmt.Errorf("duplicate listener: %s", addr)
 	}
 
-	ln, err := net.Listen(network, addr)
+	lc := net.ListenConfig{Control: SocketControl(opts)}
+	ln, err := lc.Listen(context.Background(), network, addr)
 	if err != nil {
 		return nil, err
 	}
@@ -173,9 +181,50 @@ func Listen(network, addr string) (net.Listener, error) {
 		return nil, fmt.Errorf("dup listener: %v", err)
 	}
 	passedListeners[addr] = f
+	if opts != nil {
+		ln = sockoptListener{ln, opts}
+	}
 	return ln, err
 }
 
+// ListenPacket is like Listen, but for packet-oriented networks such as UDP.
+// The file descriptor is passed under the address prefixed with "udp:", so a TCP
+// listener on the same address can exist as well.
+func ListenPacket(network, addr string, opts *config.SocketOptions) (net.PacketConn, error) {
+	key := "udp:" + addr
+	if os.Getuid() != 0 && !FilesImmediate {
+		f, ok := passedListeners[key]
+		if !ok {
+			return nil, fmt.Errorf("no file descriptor for packet listener %s", addr)
+		}
+		conn, err := net.FilePacketConn(f)
+		if err != nil {
+			return nil, fmt.Errorf("making packet connection from file descriptor for address %s: %v", addr, err)
+		}
+		return conn, nil
+	}
+
+	if _, ok := passedListeners[key]; ok {
+		return nil, fmt.Errorf("duplicate packet listener: %s", addr)
+	}
+
+	lc := net.ListenConfig{Control: SocketControl(opts)}
+	conn, err := lc.ListenPacket(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+	udpconn, ok := conn.(*net.UDPConn)
+	if !ok {
+		return nil, fmt.Errorf("packet connection not a udp connection, but %T, for network %s, address %s", conn, network, addr)
+	}
+	f, err := udpconn.File()
+	if err != nil {
+		return nil, fmt.Errorf("dup packet connection: %v", err)
+	}
+	passedListeners[key] = f
+	return conn, err
+}
+
 // Open a privileged file, such as a TLS private key. When running as root
 // (during startup), the file is opened and the file descriptor is stored.
 // These file descriptors are passed to the unprivileged process. When in the
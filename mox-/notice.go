@@ -0,0 +1,69 @@
+package mox
+
+import (
+	"strings"
+	"time"
+
+	"github.com/mjl-/mox/config"
+)
+
+// Notices returns the texts of the configured notices that are currently active
+// for service ("imap", "smtp" or "web") on the listener, in configuration order.
+//
+// If accountName is empty, only notices without domain restriction are returned,
+// e.g. for the IMAP greeting. Otherwise, only notices restricted to domains that
+// the account has an address in are returned, to show after authentication.
+func Notices(service, listenerName, accountName string) []string {
+	var notices []config.Notice
+	accountDomains := map[string]bool{}
+	Conf.withDynamicLock(func() {
+		notices = Conf.Dynamic.Notices
+		if accountName == "" {
+			return
+		}
+		for addr, ad := range Conf.accountDestinations {
+			if ad.Account == accountName {
+				// Localparts can contain a quoted "@", domains cannot.
+				accountDomains[addr[strings.LastIndex(addr, "@")+1:]] = true
+			}
+		}
+	})
+
+	has := func(l []string, s string) bool {
+		if len(l) == 0 {
+			return true
+		}
+		for _, e := range l {
+			if e == s {
+				return true
+			}
+		}
+		return false
+	}
+
+	now := time.Now()
+	var l []string
+	for _, n := range notices {
+		if !has(n.Services, service) || !has(n.Listeners, listenerName) {
+			continue
+		}
+		if !n.StartTime.IsZero() && now.Before(n.StartTime) || !n.EndTime.IsZero() && now.After(n.EndTime) {
+			continue
+		}
+		if accountName == "" {
+			if len(n.DNSDomains) > 0 {
+				continue
+			}
+		} else {
+			var match bool
+			for _, d := range n.DNSDomains {
+				match = match || accountDomains[d.Name()]
+			}
+			if !match {
+				continue
+			}
+		}
+		l = append(l, n.Text)
+	}
+	return l
+}
@@ -0,0 +1,309 @@
+package mox
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/mox/mlog"
+)
+
+// HAProxy PROXY protocol, version 1 (text) and 2 (binary), as specified at
+// https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt. A TCP load
+// balancer sends a header with the address of the client before the data of
+// the connection.
+
+var (
+	metricProxyProtocol = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mox_proxyprotocol_connection_total",
+			Help: "Incoming connections to services with PROXY protocol.",
+		},
+		[]string{
+			"listener",
+			"result", // "ok", "untrusted", "error"
+		},
+	)
+)
+
+// Time for a load balancer to send the PROXY header after connecting.
+var proxyHeaderTimeout = 10 * time.Second
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Maximum length of addresses and TLVs in a version 2 header we accept. Plenty
+// for the addresses, TLVs are ignored.
+const proxyV2MaxLength = 4 * 1024
+
+// readProxyHeader reads a version 1 or 2 PROXY header and returns the address of
+// the client. For headers without client address, e.g. health checks by the
+// load balancer itself, a nil address is returned.
+func readProxyHeader(br *bufio.Reader) (net.Addr, error) {
+	buf, err := br.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("reading proxy header: %w", err)
+	}
+	if bytes.Equal(buf, proxyV2Signature) {
+		return readProxyV2(br)
+	} else if bytes.HasPrefix(buf, []byte("PROXY ")) {
+		return readProxyV1(br)
+	}
+	return nil, errors.New("missing proxy header")
+}
+
+func readProxyV1(br *bufio.Reader) (net.Addr, error) {
+	// Line is at most 107 bytes, including CRLF.
+	var line []byte
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("reading proxy v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= 107 {
+			return nil, errors.New("proxy v1 header too long")
+		}
+	}
+	s := string(line)
+	if !strings.HasSuffix(s, "\r\n") {
+		return nil, errors.New("proxy v1 header not terminated by crlf")
+	}
+	s = strings.TrimSuffix(s, "\r\n")
+	t := strings.Split(s, " ")
+	if len(t) >= 2 && t[1] == "UNKNOWN" {
+		// Remainder of line must be ignored.
+		return nil, nil
+	}
+	if len(t) != 6 || (t[1] != "TCP4" && t[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed proxy v1 header %q", s)
+	}
+	ip := net.ParseIP(t[2])
+	// TCP4 has an IPv4 address, TCP6 an IPv6 address.
+	if ip == nil || (t[1] == "TCP4") == strings.Contains(t[2], ":") {
+		return nil, fmt.Errorf("invalid source ip %q for %s in proxy v1 header", t[2], t[1])
+	}
+	if dstip := net.ParseIP(t[3]); dstip == nil {
+		return nil, fmt.Errorf("invalid destination ip %q in proxy v1 header", t[3])
+	}
+	port, err := strconv.ParseUint(t[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source port %q in proxy v1 header", t[4])
+	}
+	if _, err := strconv.ParseUint(t[5], 10, 16); err != nil {
+		return nil, fmt.Errorf("invalid destination port %q in proxy v1 header", t[5])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(br *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, fmt.Errorf("reading proxy v2 header: %w", err)
+	}
+	version := hdr[12] >> 4
+	command := hdr[12] & 0x0f
+	family := hdr[13]
+	n := binary.BigEndian.Uint16(hdr[14:16])
+	if version != 2 {
+		return nil, fmt.Errorf("unsupported proxy version %d", version)
+	}
+	if n > proxyV2MaxLength {
+		return nil, fmt.Errorf("proxy v2 header too long, %d bytes", n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		return nil, fmt.Errorf("reading proxy v2 addresses: %w", err)
+	}
+	switch command {
+	case 0:
+		// LOCAL, connection from the load balancer itself.
+		return nil, nil
+	case 1:
+		// PROXY
+	default:
+		return nil, fmt.Errorf("unknown proxy v2 command %d", command)
+	}
+	switch family {
+	case 0x00:
+		// UNSPEC, addresses must be ignored.
+		return nil, nil
+	case 0x11:
+		// TCP over IPv4: source address, destination address, source port, destination port.
+		if len(buf) < 12 {
+			return nil, errors.New("proxy v2 header too short for ipv4 addresses")
+		}
+		ip := net.IP(append([]byte(nil), buf[0:4]...))
+		return &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(buf[8:10]))}, nil
+	case 0x21:
+		// TCP over IPv6.
+		if len(buf) < 36 {
+			return nil, errors.New("proxy v2 header too short for ipv6 addresses")
+		}
+		ip := net.IP(append([]byte(nil), buf[0:16]...))
+		return &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(buf[32:34]))}, nil
+	}
+	return nil, fmt.Errorf("unsupported proxy v2 address family 0x%02x", family)
+}
+
+// ProxyListener returns a listener for connections that start with a PROXY
+// header, from the load balancers in the ProxyProtocolFrom of the named listener
+// from the configuration. Connections from other IPs, and connections with an
+// invalid header, are closed. The connections returned by Accept have the
+// client address from the header as RemoteAddr, so it must be applied before
+// other listeners that use the remote address, like LimitListener. Headers are
+// read in a goroutine per connection, a slow connection does not hold up others.
+func ProxyListener(ln net.Listener, listenerName string) net.Listener {
+	pl := &proxyListener{
+		Listener: ln,
+		listener: listenerName,
+		nets:     Conf.Static.Listeners[listenerName].ProxyProtocolNets,
+		results:  make(chan proxyAccept),
+		done:     make(chan struct{}),
+	}
+	go pl.accept()
+	return pl
+}
+
+type proxyListener struct {
+	net.Listener
+	listener string
+	nets     []net.IPNet
+
+	results   chan proxyAccept
+	done      chan struct{} // Closed when listener is closed.
+	closeOnce sync.Once
+}
+
+type proxyAccept struct {
+	conn net.Conn
+	err  error
+}
+
+// Accept returns the next connection with a valid PROXY header.
+func (l *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-l.results:
+		return r.conn, r.err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the underlying listener.
+func (l *proxyListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return l.Listener.Close()
+}
+
+func (l *proxyListener) accept() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.results <- proxyAccept{nil, err}:
+			case <-l.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go l.handshake(conn)
+	}
+}
+
+func (l *proxyListener) trusted(ip net.IP) bool {
+	for _, ipnet := range l.nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *proxyListener) handshake(conn net.Conn) {
+	var ip net.IP
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		ip = addr.IP
+	}
+	if ip == nil || !l.trusted(ip) {
+		metricProxyProtocol.WithLabelValues(l.listener, "untrusted").Inc()
+		xlog.Info("refusing connection from ip not in ProxyProtocolFrom", mlog.Field("listener", l.listener), mlog.Field("remoteip", ip))
+		err := conn.Close()
+		xlog.Check(err, "closing refused connection")
+		return
+	}
+
+	br := bufio.NewReader(conn)
+	err := conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	var remote net.Addr
+	if err == nil {
+		remote, err = readProxyHeader(br)
+	}
+	if err == nil {
+		err = conn.SetReadDeadline(time.Time{})
+	}
+	if err != nil {
+		metricProxyProtocol.WithLabelValues(l.listener, "error").Inc()
+		xlog.Infox("reading proxy header, closing connection", err, mlog.Field("listener", l.listener), mlog.Field("remoteip", ip))
+		err := conn.Close()
+		xlog.Check(err, "closing connection")
+		return
+	}
+	metricProxyProtocol.WithLabelValues(l.listener, "ok").Inc()
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	pc := &proxyConn{Conn: conn, br: br, remote: remote}
+	select {
+	case l.results <- proxyAccept{pc, nil}:
+	case <-l.done:
+		err := conn.Close()
+		xlog.Check(err, "closing connection for closed listener")
+	}
+}
+
+// proxyConn is a connection after its PROXY header, with the client address from
+// the header as remote address.
+type proxyConn struct {
+	net.Conn
+	br     *bufio.Reader // With data read after the header, used until empty.
+	remote net.Addr
+}
+
+// NetConn returns the underlying connection, like tls.Conn.NetConn.
+func (c *proxyConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// RemoteAddr returns the client address from the PROXY header.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *proxyConn) Read(buf []byte) (int, error) {
+	if c.br != nil {
+		if c.br.Buffered() > 0 {
+			return c.br.Read(buf)
+		}
+		c.br = nil
+	}
+	return c.Conn.Read(buf)
+}
@@ -0,0 +1,165 @@
+package mox
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjl-/mox/config"
+)
+
+func TestProxyHeader(t *testing.T) {
+	v2 := func(cmd, family byte, addrs string) string {
+		return string(proxyV2Signature) + string([]byte{0x20 | cmd, family, 0, byte(len(addrs))}) + addrs
+	}
+	ipv4 := "\x0a\x00\x00\x01" + "\xc0\x00\x02\x01" + "\x30\x39" + "\x00\x8f"
+	ipv6 := "\x20\x01\x0d\xb8" + strings.Repeat("\x00", 11) + "\x01" + strings.Repeat("\x00", 16) + "\x30\x39" + "\x03\xe1"
+
+	test := func(header, expAddr string, expErr bool) {
+		t.Helper()
+		br := bufio.NewReader(strings.NewReader(header + "rest"))
+		addr, err := readProxyHeader(br)
+		if (err != nil) != expErr {
+			t.Fatalf("header %q: got err %v, expected error %v", header, err, expErr)
+		}
+		if err != nil {
+			return
+		}
+		var s string
+		if addr != nil {
+			s = addr.String()
+		}
+		if s != expAddr {
+			t.Fatalf("header %q: got addr %q, expected %q", header, s, expAddr)
+		}
+		if rest, _ := io.ReadAll(br); string(rest) != "rest" {
+			t.Fatalf("header %q: got remaining data %q, expected rest", header, rest)
+		}
+	}
+
+	test("PROXY TCP4 10.0.0.1 192.0.2.1 12345 143\r\n", "10.0.0.1:12345", false)
+	test("PROXY TCP6 2001:db8::1 2001:db8::2 12345 993\r\n", "[2001:db8::1]:12345", false)
+	test("PROXY UNKNOWN ignored\r\n", "", false)
+	test("PROXY TCP4 2001:db8::1 192.0.2.1 12345 143\r\n", "", true)
+	test("PROXY TCP6 10.0.0.1 2001:db8::2 12345 993\r\n", "", true)
+	test("PROXY TCP4 10.0.0.1 192.0.2.1 123456 143\r\n", "", true)
+	test("PROXY TCP4 10.0.0.1 192.0.2.1 12345\r\n", "", true)
+	test("PROXY TCP4 10.0.0.1 192.0.2.1 12345 143\n", "", true)
+	test("PROXY "+strings.Repeat("x", 110)+"\r\n", "", true)
+	test("* OK imap\r\n", "", true)
+
+	test(v2(1, 0x11, ipv4), "10.0.0.1:12345", false)
+	test(v2(1, 0x21, ipv6), "[2001:db8::1]:12345", false)
+	test(v2(1, 0x11, ipv4+"\x03\x00\x04tlvs"), "10.0.0.1:12345", false) // TLVs are ignored.
+	test(v2(0, 0x00, ""), "", false)                                    // LOCAL
+	test(v2(0, 0x11, ipv4), "", false)                                  // LOCAL, addresses ignored.
+	test(v2(1, 0x00, ""), "", false)                                    // UNSPEC
+	test(v2(1, 0x11, ipv4[:8]), "", true)
+	test(v2(1, 0x21, ipv4), "", true)
+	test(v2(1, 0x31, "/tmp/sock"), "", true) // Unix socket.
+	test(v2(2, 0x11, ipv4), "", true)
+	test(string(proxyV2Signature)+"\x10\x11\x00\x0c"+ipv4, "", true) // Version 1 in binary header.
+	test(string(proxyV2Signature)+"\x21\x11\x00\x20"+ipv4, "", true) // Truncated.
+}
+
+func TestProxyListener(t *testing.T) {
+	Conf.Static.Listeners = map[string]config.Listener{
+		"trusted": {
+			ProxyProtocolNets: []net.IPNet{{IP: net.IPv4(127, 0, 0, 1), Mask: net.CIDRMask(32, 32)}},
+		},
+		"untrusted": {
+			ProxyProtocolNets: []net.IPNet{{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)}},
+		},
+	}
+	defer func() {
+		Conf.Static.Listeners = nil
+	}()
+	defer func(d time.Duration) {
+		proxyHeaderTimeout = d
+	}(proxyHeaderTimeout)
+	proxyHeaderTimeout = 200 * time.Millisecond
+
+	listen := func(name string) net.Listener {
+		t.Helper()
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		return ProxyListener(ln, name)
+	}
+
+	dial := func(ln net.Listener, header string) net.Conn {
+		t.Helper()
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		if _, err := conn.Write([]byte(header)); err != nil {
+			t.Fatalf("write header: %v", err)
+		}
+		return conn
+	}
+
+	accept := func(ln net.Listener) chan net.Conn {
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err == nil {
+				accepted <- conn
+			}
+			close(accepted)
+		}()
+		return accepted
+	}
+
+	ln := listen("trusted")
+	accepted := accept(ln)
+
+	// Connection without header is closed, and does not block the next connection.
+	slow := dial(ln, "")
+	defer slow.Close()
+	c := dial(ln, "PROXY TCP4 192.0.2.10 192.0.2.1 2525 143\r\nhello")
+	defer c.Close()
+
+	conn := <-accepted
+	if conn == nil {
+		t.Fatalf("no connection accepted")
+	}
+	defer conn.Close()
+	if s := conn.RemoteAddr().String(); s != "192.0.2.10:2525" {
+		t.Fatalf("got remote addr %q, expected 192.0.2.10:2525", s)
+	}
+	if _, ok := conn.(interface{ NetConn() net.Conn }).NetConn().(*net.TCPConn); !ok {
+		t.Fatalf("underlying connection not a tcp connection")
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("read after header: got %q, err %v, expected hello", buf, err)
+	}
+	slow.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := slow.Read(buf); err != io.EOF {
+		t.Fatalf("got err %v for connection without header, expected eof", err)
+	}
+
+	ln.Close()
+	if conn, err := ln.Accept(); err == nil {
+		conn.Close()
+		t.Fatalf("accept on closed listener succeeded")
+	}
+
+	// Connections from IPs not in ProxyProtocolFrom are closed.
+	ln = listen("untrusted")
+	defer ln.Close()
+	c = dial(ln, "PROXY TCP4 192.0.2.10 192.0.2.1 2525 143\r\n")
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	// Error may be eof or connection reset, due to the unread header.
+	if _, err := c.Read(buf); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got err %v for untrusted connection, expected closed connection", err)
+	}
+}
@@ -0,0 +1,83 @@
+package mox
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/mjl-/mox/config"
+)
+
+// SocketControl returns a function for the Control field of net.ListenConfig and
+// net.Dialer that applies the socket options to new sockets. Nil is returned for
+// nil opts.
+func SocketControl(opts *config.SocketOptions) func(network, address string, c syscall.RawConn) error {
+	if opts == nil {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		cerr := c.Control(func(fd uintptr) {
+			err = setSocketOptions(int(fd), network, opts, true)
+		})
+		if cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
+
+// SocketDialer returns a dialer for outgoing connections with the socket options.
+// LocalIPs are not applied, the local address depends on the remote address and
+// is for the caller to set.
+func SocketDialer(opts *config.SocketOptions) *net.Dialer {
+	d := &net.Dialer{}
+	if opts != nil {
+		d.KeepAlive = opts.KeepAlive
+		d.Control = SocketControl(opts)
+	}
+	return d
+}
+
+// sockoptListener applies socket options to accepted connections. Listening
+// sockets may have been passed from the privileged process, so settings of the
+// listening socket, e.g. its keepalive, cannot be relied on.
+type sockoptListener struct {
+	net.Listener
+	opts *config.SocketOptions
+}
+
+func (ln sockoptListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return conn, err
+	}
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return conn, nil
+	}
+	if ln.opts.KeepAlive < 0 {
+		err = tc.SetKeepAlive(false)
+	} else if ln.opts.KeepAlive > 0 {
+		err = tc.SetKeepAlivePeriod(ln.opts.KeepAlive)
+	}
+	if err == nil {
+		var rc syscall.RawConn
+		rc, err = tc.SyscallConn()
+		if err == nil {
+			network := "tcp4"
+			if a, ok := tc.LocalAddr().(*net.TCPAddr); ok && a.IP.To4() == nil {
+				network = "tcp6"
+			}
+			cerr := rc.Control(func(fd uintptr) {
+				err = setSocketOptions(int(fd), network, ln.opts, false)
+			})
+			if cerr != nil {
+				err = cerr
+			}
+		}
+	}
+	if err != nil {
+		xlog.Errorx("setting socket options on accepted connection", err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,38 @@
+package mox
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/mjl-/mox/config"
+)
+
+// setSocketOptions sets the options on the socket. The interface is only bound
+// for new sockets, accepted connections inherit it from the listening socket.
+func setSocketOptions(fd int, network string, opts *config.SocketOptions, bind bool) error {
+	if bind && opts.Interface != "" {
+		if err := unix.SetsockoptString(fd, unix.SOL_SOCKET, unix.SO_BINDTODEVICE, opts.Interface); err != nil {
+			return fmt.Errorf("binding socket to interface %q: %v", opts.Interface, err)
+		}
+	}
+	if opts.DSCP != 0 {
+		// DSCP is the upper 6 bits of the TOS/traffic class byte, the lower 2 bits are for ECN.
+		var err error
+		if strings.HasSuffix(network, "6") {
+			err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_TCLASS, opts.DSCP<<2)
+		} else {
+			err = unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TOS, opts.DSCP<<2)
+		}
+		if err != nil {
+			return fmt.Errorf("setting dscp: %v", err)
+		}
+	}
+	if opts.UserTimeout > 0 && strings.HasPrefix(network, "tcp") {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(opts.UserTimeout.Milliseconds())); err != nil {
+			return fmt.Errorf("setting tcp user timeout: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+//go:build !linux
+
+package mox
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/mjl-/mox/config"
+)
+
+// setSocketOptions sets the options on the socket. Interface and UserTimeout are
+// only supported on Linux, the config check refuses them on other systems.
+func setSocketOptions(fd int, network string, opts *config.SocketOptions, bind bool) error {
+	if opts.DSCP != 0 {
+		// DSCP is the upper 6 bits of the TOS/traffic class byte, the lower 2 bits are for ECN.
+		var err error
+		if strings.HasSuffix(network, "6") {
+			err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_TCLASS, opts.DSCP<<2)
+		} else {
+			err = unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TOS, opts.DSCP<<2)
+		}
+		if err != nil {
+			return fmt.Errorf("setting dscp: %v", err)
+		}
+	}
+	return nil
+}
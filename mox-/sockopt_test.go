@@ -0,0 +1,74 @@
+package mox
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/mjl-/mox/config"
+)
+
+func TestSocketOptions(t *testing.T) {
+	opts := &config.SocketOptions{DSCP: 8, KeepAlive: time.Minute}
+	if runtime.GOOS == "linux" {
+		opts.UserTimeout = 2 * time.Minute
+	}
+
+	FilesImmediate = true
+	defer func() {
+		FilesImmediate = false
+	}()
+	ln, err := Listen("tcp4", "127.0.0.1:0", opts)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	defer delete(passedListeners, "127.0.0.1:0")
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Errorf("accept: %v", err)
+		}
+		accepted <- conn
+	}()
+
+	conn, err := SocketDialer(opts).Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	aconn := <-accepted
+	if aconn == nil {
+		t.FailNow()
+	}
+	defer aconn.Close()
+
+	check := func(c net.Conn, what string) {
+		t.Helper()
+		rc, err := c.(*net.TCPConn).SyscallConn()
+		if err != nil {
+			t.Fatalf("syscall conn: %v", err)
+		}
+		var tos int
+		var xerr error
+		err = rc.Control(func(fd uintptr) {
+			tos, xerr = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS)
+		})
+		if err == nil {
+			err = xerr
+		}
+		if err != nil {
+			t.Fatalf("%s: get socket options: %v", what, err)
+		}
+		if tos != 8<<2 {
+			t.Fatalf("%s: tos %d, expected %d", what, tos, 8<<2)
+		}
+	}
+	check(conn, "dialed")
+	check(aconn, "accepted")
+}
@@ -3,6 +3,9 @@ package mox
 import (
 	"crypto/tls"
 	"fmt"
+	"strings"
+
+	"github.com/mjl-/mox/dns"
 )
 
 // TLSInfo returns human-readable strings about the TLS connection, for use in
@@ -27,3 +30,24 @@ func TLSInfo(conn *tls.Conn) (version, ciphersuite string) {
 	ciphersuite = tls.CipherSuiteName(st.CipherSuite)
 	return
 }
+
+// TLSMetricsVersion returns the label for a TLS version as returned by TLSInfo
+// for use in metrics, e.g. "tls1.3", or "none" for an empty version, i.e. a
+// connection without TLS.
+func TLSMetricsVersion(version string) string {
+	if version == "" {
+		return "none"
+	}
+	return strings.ToLower(version)
+}
+
+// TLSMetricsDomain returns the domain label for TLS metrics: the domain itself
+// if it is configured in TLSMetricsDomains, "other" otherwise.
+func TLSMetricsDomain(d dns.Domain) string {
+	for _, md := range Conf.Static.TLSMetricsDNSDomains {
+		if md == d {
+			return d.ASCII
+		}
+	}
+	return "other"
+}
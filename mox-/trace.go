@@ -0,0 +1,137 @@
+package mox
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/moxio"
+)
+
+// TraceMaxDuration is the maximum duration of a protocol trace.
+const TraceMaxDuration = 24 * time.Hour
+
+// ProtocolTrace is a request for protocol transcripts of IMAP and SMTP
+// connections of an account or from a remote IP, until it expires. Transcripts
+// are written to the "traces" directory in the data directory, one file per
+// connection. Traces are kept in memory only, they are gone after a restart.
+type ProtocolTrace struct {
+	ID      int64
+	Account string // If set, connections that authenticate as this account, from the moment of authentication.
+	IP      string // If set, connections from this remote IP.
+	Expires time.Time
+}
+
+var protocolTraces = struct {
+	sync.Mutex
+	traces []ProtocolTrace
+	lastID int64
+}{}
+
+// TraceAdd starts a protocol trace for connections of account or remote IP,
+// exactly one must be set, for duration d.
+func TraceAdd(log *mlog.Log, account, ip string, d time.Duration) (ProtocolTrace, error) {
+	if (account == "") == (ip == "") {
+		return ProtocolTrace{}, fmt.Errorf("exactly one of account and ip must be set")
+	}
+	if d <= 0 || d > TraceMaxDuration {
+		return ProtocolTrace{}, fmt.Errorf("duration must be positive and at most %s", TraceMaxDuration)
+	}
+	if account != "" {
+		if _, ok := Conf.Account(account); !ok {
+			return ProtocolTrace{}, fmt.Errorf("account not found")
+		}
+	} else if parsed := net.ParseIP(ip); parsed == nil {
+		return ProtocolTrace{}, fmt.Errorf("invalid ip")
+	} else {
+		ip = parsed.String()
+	}
+
+	protocolTraces.Lock()
+	defer protocolTraces.Unlock()
+	protocolTraces.lastID++
+	t := ProtocolTrace{protocolTraces.lastID, account, ip, time.Now().Add(d)}
+	protocolTraces.traces = append(protocolTraces.traces, t)
+	log.Info("protocol trace started", mlog.Field("id", t.ID), mlog.Field("account", account), mlog.Field("ip", ip), mlog.Field("expires", t.Expires))
+	return t, nil
+}
+
+// TraceRemove stops a protocol trace. Transcripts of connections that are still
+// open are written until the original expiration time.
+func TraceRemove(log *mlog.Log, id int64) error {
+	protocolTraces.Lock()
+	defer protocolTraces.Unlock()
+	for i, t := range protocolTraces.traces {
+		if t.ID == id {
+			protocolTraces.traces = append(protocolTraces.traces[:i], protocolTraces.traces[i+1:]...)
+			log.Info("protocol trace stopped", mlog.Field("id", id))
+			return nil
+		}
+	}
+	return fmt.Errorf("trace not found")
+}
+
+// TraceList returns the protocol traces that have not yet expired.
+func TraceList() []ProtocolTrace {
+	protocolTraces.Lock()
+	defer protocolTraces.Unlock()
+	traceCleanup()
+	return append([]ProtocolTrace{}, protocolTraces.traces...)
+}
+
+// traceCleanup removes expired traces. Must be called with lock held.
+func traceCleanup() {
+	now := time.Now()
+	var l []ProtocolTrace
+	for _, t := range protocolTraces.traces {
+		if now.Before(t.Expires) {
+			l = append(l, t)
+		}
+	}
+	protocolTraces.traces = l
+}
+
+// TranscriptOpen returns a new transcript if a protocol trace matches the
+// connection. If account is empty, traces are matched on remote IP, for new
+// connections. Otherwise, traces are matched on account, for connections that
+// just authenticated. Nil is returned if no trace matches, or on errors, which
+// are logged.
+func TranscriptOpen(log *mlog.Log, protocol string, cid int64, remoteIP net.IP, account string) *moxio.Transcript {
+	var expires time.Time
+	protocolTraces.Lock()
+	traceCleanup()
+	for _, t := range protocolTraces.traces {
+		if account != "" && t.Account == account || account == "" && t.IP != "" && t.IP == remoteIP.String() {
+			if t.Expires.After(expires) {
+				expires = t.Expires
+			}
+		}
+	}
+	protocolTraces.Unlock()
+	if expires.IsZero() {
+		return nil
+	}
+
+	dir := DataDirPath("traces")
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		log.Errorx("creating directory for protocol transcripts", err)
+		return nil
+	}
+	now := time.Now()
+	p := filepath.Join(dir, fmt.Sprintf("%s-%s-%d.txt", now.UTC().Format("20060102T150405"), protocol, cid))
+	header := fmt.Sprintf("# %s connection, cid %d, remote ip %s, started %s", protocol, cid, remoteIP, now.Format(time.RFC3339))
+	if account != "" {
+		header += fmt.Sprintf(", from authentication as account %s", account)
+	}
+	t, err := moxio.CreateTranscript(p, header, expires)
+	if err != nil {
+		log.Errorx("creating protocol transcript", err)
+		return nil
+	}
+	log.Debug("writing protocol transcript", mlog.Field("path", p))
+	return t
+}
@@ -0,0 +1,134 @@
+//go:build moxchaos
+
+package moxio
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mjl-/mox/mlog"
+)
+
+// With build tag moxchaos, connections of the IMAP and SMTP servers are wrapped
+// to inject faults, for finding bugs in handling of partial reads, truncated
+// commands and literals, and connections that break halfway. Environment variable
+// MOX_CHAOS is the probability for each read and write to inject a fault,
+// default 0.01. Panics that are not handled by the servers are written as crash
+// report, with the last data read from the connection, to the directory in
+// MOX_CHAOS_CRASHDIR, default the temporary directory.
+
+// errChaos is returned for injected failures of reads and writes.
+// It wraps ECONNRESET so the servers treat it like a broken connection.
+var errChaos = fmt.Errorf("chaos: injected connection failure (%w)", syscall.ECONNRESET)
+
+var chaosRand = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+func chaosProbability() float64 {
+	if s := os.Getenv("MOX_CHAOS"); s != "" {
+		if p, err := strconv.ParseFloat(s, 64); err == nil {
+			return p
+		}
+	}
+	return 0.01
+}
+
+// chaos returns a random fault to inject, with probability p: 1 for a short read
+// or write, 2 for a failure, 3 for a delay. Zero means no fault.
+func chaos(p float64) int {
+	chaosRand.Lock()
+	defer chaosRand.Unlock()
+	if chaosRand.Float64() >= p {
+		return 0
+	}
+	return 1 + chaosRand.Intn(3)
+}
+
+type chaosConn struct {
+	net.Conn
+	p float64
+
+	sync.Mutex
+	last []byte // Most recently read data, for crash reports.
+}
+
+// ChaosConn wraps conn to inject faults.
+func ChaosConn(conn net.Conn) net.Conn {
+	return &chaosConn{Conn: conn, p: chaosProbability()}
+}
+
+// NetConn returns the wrapped connection.
+func (c *chaosConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *chaosConn) Read(buf []byte) (int, error) {
+	switch chaos(c.p) {
+	case 1:
+		if len(buf) > 1 {
+			buf = buf[:1+len(buf)/2]
+		}
+	case 2:
+		return 0, errChaos
+	case 3:
+		time.Sleep(100 * time.Millisecond)
+	}
+	n, err := c.Conn.Read(buf)
+	c.Lock()
+	c.last = append(c.last, buf[:n]...)
+	if len(c.last) > 4096 {
+		c.last = c.last[len(c.last)-4096:]
+	}
+	c.Unlock()
+	return n, err
+}
+
+func (c *chaosConn) Write(buf []byte) (int, error) {
+	switch chaos(c.p) {
+	case 1:
+		if len(buf) > 1 {
+			n, err := c.Conn.Write(buf[:len(buf)/2])
+			if err != nil {
+				return n, err
+			}
+			m, err := c.Conn.Write(buf[n:])
+			return n + m, err
+		}
+	case 2:
+		return 0, errChaos
+	case 3:
+		time.Sleep(100 * time.Millisecond)
+	}
+	return c.Conn.Write(buf)
+}
+
+// CrashReport writes a report about panic x while serving conn to a file.
+func CrashReport(log *mlog.Log, pkg string, conn net.Conn, x any) {
+	var last []byte
+	if cc, ok := conn.(*chaosConn); ok {
+		cc.Lock()
+		last = append([]byte{}, cc.last...)
+		cc.Unlock()
+	}
+	dir := os.Getenv("MOX_CHAOS_CRASHDIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	p := filepath.Join(dir, fmt.Sprintf("mox-crash-%s-%d.txt", pkg, time.Now().UnixNano()))
+	report := fmt.Sprintf("panic: %v\n\n%s\nlast data read:\n%q\n", x, debug.Stack(), last)
+	if err := os.WriteFile(p, []byte(report), 0600); err != nil {
+		log.Errorx("writing crash report", err)
+	} else {
+		log.Error("wrote crash report", mlog.Field("path", p))
+	}
+}
@@ -0,0 +1,47 @@
+package moxio
+
+import (
+	"compress/flate"
+	"io"
+	"net"
+)
+
+// FlateConn is a net.Conn that compresses writes and decompresses reads with
+// DEFLATE (RFC 1951, without zlib or gzip framing), e.g. for IMAP
+// COMPRESS=DEFLATE. Each write is flushed, so the remote can decompress all data
+// written so far.
+type FlateConn struct {
+	net.Conn
+	r io.ReadCloser
+	w *flate.Writer
+}
+
+// NewFlateConn returns a FlateConn that reads and writes through conn.
+func NewFlateConn(conn net.Conn) *FlateConn {
+	w, err := flate.NewWriter(conn, flate.DefaultCompression)
+	if err != nil {
+		panic("flate writer with default compression level: " + err.Error()) // Only for invalid levels.
+	}
+	return &FlateConn{conn, flate.NewReader(conn), w}
+}
+
+// Read reads decompressed data.
+func (c *FlateConn) Read(buf []byte) (int, error) {
+	return c.r.Read(buf)
+}
+
+// Write compresses buf, and flushes it to the underlying connection.
+func (c *FlateConn) Write(buf []byte) (int, error) {
+	n, err := c.w.Write(buf)
+	if err == nil {
+		err = c.w.Flush()
+	}
+	return n, err
+}
+
+// Close closes the underlying connection. Pending compressed data has already
+// been flushed by Write.
+func (c *FlateConn) Close() error {
+	c.r.Close()
+	return c.Conn.Close()
+}
@@ -0,0 +1,20 @@
+//go:build !moxchaos
+
+package moxio
+
+import (
+	"net"
+
+	"github.com/mjl-/mox/mlog"
+)
+
+// ChaosConn returns conn unchanged. With build tag moxchaos, it wraps conn to
+// inject faults, see chaos.go.
+func ChaosConn(conn net.Conn) net.Conn {
+	return conn
+}
+
+// CrashReport does nothing. With build tag moxchaos, it writes a report about a
+// panic while serving conn to a file.
+func CrashReport(log *mlog.Log, pkg string, conn net.Conn, x any) {
+}
@@ -7,22 +7,24 @@ import (
 )
 
 type TraceWriter struct {
-	log    *mlog.Log
-	prefix string
-	w      io.Writer
-	level  mlog.Level
+	log        *mlog.Log
+	prefix     string
+	w          io.Writer
+	level      mlog.Level
+	transcript *Transcript
 }
 
 // NewTraceWriter wraps "w" into a writer that logs all writes to "log" with
 // log level trace, prefixed with "prefix".
 func NewTraceWriter(log *mlog.Log, prefix string, w io.Writer) *TraceWriter {
-	return &TraceWriter{log, prefix, w, mlog.LevelTrace}
+	return &TraceWriter{log, prefix, w, mlog.LevelTrace, nil}
 }
 
 // Write logs a trace line for writing buf to the client, then writes to the
 // client.
 func (w *TraceWriter) Write(buf []byte) (int, error) {
 	w.log.Trace(w.level, w.prefix+string(buf))
+	w.transcript.write(false, w.prefix, w.level, buf)
 	return w.w.Write(buf)
 }
 
@@ -30,17 +32,24 @@ func (w *TraceWriter) SetTrace(level mlog.Level) {
 	w.level = level
 }
 
+// SetTranscript makes the writer also add all writes to the transcript, if not
+// nil.
+func (w *TraceWriter) SetTranscript(t *Transcript) {
+	w.transcript = t
+}
+
 type TraceReader struct {
-	log    *mlog.Log
-	prefix string
-	r      io.Reader
-	level  mlog.Level
+	log        *mlog.Log
+	prefix     string
+	r          io.Reader
+	level      mlog.Level
+	transcript *Transcript
 }
 
 // NewTraceReader wraps reader "r" into a reader that logs all reads to "log"
 // with log level trace, prefixed with "prefix".
 func NewTraceReader(log *mlog.Log, prefix string, r io.Reader) *TraceReader {
-	return &TraceReader{log, prefix, r, mlog.LevelTrace}
+	return &TraceReader{log, prefix, r, mlog.LevelTrace, nil}
 }
 
 // Read does a single Read on its underlying reader, logs data of successful
@@ -49,6 +58,7 @@ func (r *TraceReader) Read(buf []byte) (int, error) {
 	n, err := r.r.Read(buf)
 	if n > 0 {
 		r.log.Trace(r.level, r.prefix+string(buf[:n]))
+		r.transcript.write(true, r.prefix, r.level, buf[:n])
 	}
 	return n, err
 }
@@ -56,3 +66,9 @@ func (r *TraceReader) Read(buf []byte) (int, error) {
 func (r *TraceReader) SetTrace(level mlog.Level) {
 	r.level = level
 }
+
+// SetTranscript makes the reader also add all reads to the transcript, if not
+// nil.
+func (r *TraceReader) SetTranscript(t *Transcript) {
+	r.transcript = t
+}
@@ -0,0 +1,104 @@
+package moxio
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/mjl-/mox/mlog"
+)
+
+// Transcript is a protocol transcript of a connection, of all data read and
+// written, for debugging the connection of a specific user. Authentication
+// credentials are redacted. A nil Transcript writes nothing.
+type Transcript struct {
+	sync.Mutex
+	f       *os.File
+	expires time.Time
+
+	// Set after a redacted login command that ends with a literal, to redact the
+	// literal(s) that follow.
+	redactLiteral bool
+}
+
+// Command lines with credentials from clients: IMAP LOGIN, IMAP AUTHENTICATE,
+// SMTP and POP3 AUTH with initial response, and POP3 PASS.
+var credentialsRegexp = regexp.MustCompile(`(?i)^(\S+ +login|\S+ +authenticate +\S+|auth +\S+|pass) +\S`)
+
+// CreateTranscript creates the file at path for a transcript, writes header,
+// and returns a transcript that stops writing after expires.
+func CreateTranscript(path, header string, expires time.Time) (*Transcript, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(f, "%s\n", header); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Transcript{f: f, expires: expires}, nil
+}
+
+// write adds data read from (read is true) or written to the remote to the
+// transcript. Data at trace level traceauth is replaced.
+func (t *Transcript) write(read bool, prefix string, level mlog.Level, buf []byte) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	if t.f == nil {
+		return
+	}
+	now := time.Now()
+	if now.After(t.expires) {
+		t.f.Close()
+		t.f = nil
+		return
+	}
+
+	var b bytes.Buffer
+	tm := now.Format("15:04:05.000")
+	if level == mlog.LevelTraceauth {
+		fmt.Fprintf(&b, "%s %s(%d bytes with credentials redacted)\n", tm, prefix, len(buf))
+	} else {
+		for _, line := range bytes.SplitAfter(buf, []byte("\n")) {
+			if len(line) == 0 {
+				continue
+			}
+			line = bytes.TrimRight(line, "\r\n")
+			if read && t.redactLiteral {
+				t.redactLiteral = bytes.HasSuffix(line, []byte("}"))
+				line = []byte("(literal with credentials redacted)")
+			} else if read {
+				if loc := credentialsRegexp.FindIndex(line); loc != nil {
+					t.redactLiteral = bytes.HasSuffix(line, []byte("}"))
+					line = append(line[:loc[1]-1:loc[1]-1], "(credentials redacted)"...)
+				}
+			}
+			fmt.Fprintf(&b, "%s %s%s\n", tm, prefix, line)
+		}
+	}
+	if _, err := t.f.Write(b.Bytes()); err != nil {
+		t.f.Close()
+		t.f = nil
+	}
+}
+
+// Close closes the transcript file.
+func (t *Transcript) Close() error {
+	if t == nil {
+		return nil
+	}
+	t.Lock()
+	defer t.Unlock()
+	if t.f == nil {
+		return nil
+	}
+	err := t.f.Close()
+	t.f = nil
+	return err
+}
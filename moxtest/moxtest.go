@@ -0,0 +1,411 @@
+// Package moxtest starts an in-process mox instance for integration tests of
+// software that sends or reads email.
+//
+// Start writes a configuration to a (temporary) directory and starts SMTP,
+// submission, IMAP and account HTTP listeners on 127.0.0.1, on random ports,
+// without TLS. Accounts can be added, messages delivered into accounts and
+// mailboxes read through the methods on Server.
+//
+// Messages submitted over SMTP submission are added to the outgoing queue, but
+// the queue is never processed: messages are not delivered, not even to local
+// accounts. Tests can inspect submitted messages with Server.Queue. Incoming SMTP
+// connections are handled as in a normal mox instance, including DNS lookups
+// for SPF/DKIM/DMARC and reputation analysis. For reliably placing messages in
+// an account, use Server.Deliver.
+//
+// Mox keeps its configuration and state in package-level variables, so only a
+// single Server can be started per process, typically from TestMain.
+package moxtest
+
+import (
+	"bytes"
+	"context"
+	cryptorand "crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mjl-/bstore"
+	"github.com/mjl-/sconf"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/dmarcdb"
+	"github.com/mjl-/mox/http"
+	"github.com/mjl-/mox/imapserver"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/mtastsdb"
+	"github.com/mjl-/mox/pop3server"
+	"github.com/mjl-/mox/queue"
+	"github.com/mjl-/mox/smtp"
+	"github.com/mjl-/mox/smtpserver"
+	"github.com/mjl-/mox/store"
+	"github.com/mjl-/mox/tlsrptdb"
+)
+
+var xlog = mlog.New("moxtest")
+
+// Account created by Start, also used for postmaster messages.
+const (
+	DefaultAccount  = "mox"
+	DefaultAddress  = "mox@localhost"
+	DefaultPassword = "moxmoxmox"
+)
+
+// Server is a running in-process mox instance.
+type Server struct {
+	Dir string // Directory with configuration files and data.
+
+	// Addresses to connect to, as host:port.
+	SMTP        string // Incoming SMTP.
+	Submission  string // SMTP submission, authentication is allowed without TLS.
+	IMAP        string // Authentication is allowed without TLS.
+	AccountHTTP string // Account web interface, at path /account/.
+}
+
+var started struct {
+	sync.Mutex
+	done bool
+}
+
+// Start initializes a new mox instance in dir, which must not yet exist or be
+// empty, and starts serving. The instance has a domain "localhost" with account
+// DefaultAccount. Start can only be called once per process.
+func Start(dir string) (*Server, error) {
+	started.Lock()
+	defer started.Unlock()
+	if started.done {
+		return nil, errors.New("moxtest server already started in this process")
+	}
+
+	if l, err := os.ReadDir(dir); err == nil && len(l) > 0 {
+		return nil, fmt.Errorf("directory %s is not empty", dir)
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("absolute path for directory: %v", err)
+	}
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return nil, fmt.Errorf("creating directory: %v", err)
+	}
+
+	ports, err := freePorts(4)
+	if err != nil {
+		return nil, fmt.Errorf("finding free ports: %v", err)
+	}
+	if err := writeConfig(dir, ports); err != nil {
+		return nil, fmt.Errorf("writing config: %v", err)
+	}
+
+	mox.ConfigStaticPath = filepath.Join(dir, "mox.conf")
+	mox.ConfigDynamicPath = filepath.Join(dir, "domains.conf")
+	if errs := mox.LoadConfig(context.Background(), true, false); len(errs) > 0 {
+		return nil, fmt.Errorf("loading config: %v", errs[0])
+	}
+
+	recvidbuf := make([]byte, 16+8)
+	if _, err := cryptorand.Read(recvidbuf); err != nil {
+		return nil, fmt.Errorf("reading random receivedid key: %v", err)
+	}
+	if err := mox.ReceivedIDInit(recvidbuf[:16], recvidbuf[16:]); err != nil {
+		return nil, fmt.Errorf("init receivedid: %v", err)
+	}
+
+	acc, err := store.OpenAccount(DefaultAccount)
+	if err != nil {
+		return nil, fmt.Errorf("open default account: %v", err)
+	}
+	err = acc.SetPassword(DefaultPassword)
+	xerr := acc.Close()
+	xlog.Check(xerr, "closing account")
+	if err != nil {
+		return nil, fmt.Errorf("setting password for default account: %v", err)
+	}
+
+	smtpserver.Listen()
+	imapserver.Listen()
+	pop3server.Listen()
+	http.Listen()
+
+	if err := dmarcdb.Init(); err != nil {
+		return nil, fmt.Errorf("dmarc init: %v", err)
+	}
+	if err := mtastsdb.Init(false); err != nil {
+		return nil, fmt.Errorf("mtasts init: %v", err)
+	}
+	if err := tlsrptdb.Init(); err != nil {
+		return nil, fmt.Errorf("tlsrpt init: %v", err)
+	}
+	// Open the queue database, but don't start delivering.
+	if err := queue.Init(); err != nil {
+		return nil, fmt.Errorf("queue init: %v", err)
+	}
+
+	store.StartAuthCache()
+	smtpserver.Serve()
+	imapserver.Serve()
+	pop3server.Serve()
+	http.Serve()
+	go func() {
+		<-store.Switchboard()
+	}()
+
+	started.done = true
+	s := &Server{
+		Dir:         dir,
+		SMTP:        fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		Submission:  fmt.Sprintf("127.0.0.1:%d", ports[1]),
+		IMAP:        fmt.Sprintf("127.0.0.1:%d", ports[2]),
+		AccountHTTP: fmt.Sprintf("127.0.0.1:%d", ports[3]),
+	}
+	return s, nil
+}
+
+// freePorts returns n ports that were available for listening on 127.0.0.1.
+func freePorts(n int) ([]int, error) {
+	var ports []int
+	var listeners []net.Listener
+	defer func() {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	}()
+	for i := 0; i < n; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+		ports = append(ports, ln.Addr().(*net.TCPAddr).Port)
+	}
+	return ports, nil
+}
+
+func writeConfig(dir string, ports []int) error {
+	local := config.Listener{
+		IPs: []string{"127.0.0.1"},
+	}
+	local.SMTP.Enabled = true
+	local.SMTP.Port = ports[0]
+	local.SMTP.NoSTARTTLS = true
+	local.Submission.Enabled = true
+	local.Submission.Port = ports[1]
+	local.Submission.NoRequireSTARTTLS = true
+	local.IMAP.Enabled = true
+	local.IMAP.Port = ports[2]
+	local.IMAP.NoRequireSTARTTLS = true
+	local.AccountHTTP.Enabled = true
+	local.AccountHTTP.Port = ports[3]
+	local.AccountHTTP.Path = "/account/"
+
+	static := config.Static{
+		DataDir:  ".",
+		LogLevel: "error",
+		Hostname: "localhost",
+		User:     fmt.Sprintf("%d", os.Getuid()),
+		Listeners: map[string]config.Listener{
+			"local": local,
+		},
+	}
+	static.Postmaster.Account = DefaultAccount
+	static.Postmaster.Mailbox = "Inbox"
+
+	var moxconfBuf bytes.Buffer
+	if err := sconf.Write(&moxconfBuf, static); err != nil {
+		return fmt.Errorf("making mox.conf: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "mox.conf"), moxconfBuf.Bytes(), 0660); err != nil {
+		return fmt.Errorf("writing mox.conf: %v", err)
+	}
+
+	dynamic := config.Dynamic{
+		Domains: map[string]config.Domain{
+			"localhost": {
+				LocalpartCatchallSeparator: "+",
+			},
+		},
+		Accounts: map[string]config.Account{
+			DefaultAccount: {
+				Domain: "localhost",
+				Destinations: map[string]config.Destination{
+					DefaultAddress: {},
+				},
+			},
+		},
+	}
+	var domainsconfBuf bytes.Buffer
+	if err := sconf.Write(&domainsconfBuf, dynamic); err != nil {
+		return fmt.Errorf("making domains.conf: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "domains.conf"), domainsconfBuf.Bytes(), 0660); err != nil {
+		return fmt.Errorf("writing domains.conf: %v", err)
+	}
+	return nil
+}
+
+// AccountAdd adds a new account with an initial email address and password. If
+// the domain of the address does not exist, it is added, with the new account
+// receiving postmaster messages for the domain.
+func (s *Server) AccountAdd(name, address, password string) error {
+	ctx := context.Background()
+	addr, err := smtp.ParseAddress(address)
+	if err != nil {
+		return fmt.Errorf("parsing address: %v", err)
+	}
+	if _, ok := mox.Conf.Domain(addr.Domain); ok {
+		err = mox.AccountAdd(ctx, name, address)
+	} else {
+		err = mox.DomainAdd(ctx, addr.Domain, name, addr.Localpart)
+	}
+	if err != nil {
+		return err
+	}
+
+	acc, err := store.OpenAccount(name)
+	if err != nil {
+		return fmt.Errorf("open account: %v", err)
+	}
+	defer func() {
+		err := acc.Close()
+		xlog.Check(err, "closing account")
+	}()
+	return acc.SetPassword(password)
+}
+
+// Deliver delivers a message to the account of address, as if it was received
+// over SMTP, but without any checks. The message is delivered according to the
+// rulesets of the destination, typically to the Inbox.
+func (s *Server) Deliver(address string, msg []byte) error {
+	acc, dest, err := store.OpenEmail(address)
+	if err != nil {
+		return fmt.Errorf("open account for address: %v", err)
+	}
+	defer func() {
+		err := acc.Close()
+		xlog.Check(err, "closing account")
+	}()
+
+	f, err := store.CreateMessageTemp("moxtest")
+	if err != nil {
+		return fmt.Errorf("creating temporary message file: %v", err)
+	}
+	defer func() {
+		if f != nil {
+			err := os.Remove(f.Name())
+			xlog.Check(err, "removing temporary message file")
+			err = f.Close()
+			xlog.Check(err, "closing temporary message file")
+		}
+	}()
+	if _, err := f.Write(msg); err != nil {
+		return fmt.Errorf("writing temporary message file: %v", err)
+	}
+
+	m := &store.Message{Received: time.Now(), Size: int64(len(msg))}
+	acc.WithWLock(func() {
+		err = acc.Deliver(xlog, dest, m, f, true)
+	})
+	if err != nil {
+		return fmt.Errorf("delivering message: %v", err)
+	}
+	f = nil
+	return nil
+}
+
+// Message is a message in a mailbox of an account.
+type Message struct {
+	ID       int64
+	UID      store.UID
+	Received time.Time
+	Flags    store.Flags
+	Keywords []string
+	Raw      []byte // Full message, with headers and body.
+}
+
+// Messages returns the messages in a mailbox of an account, ordered by UID.
+func (s *Server) Messages(account, mailbox string) ([]Message, error) {
+	acc, err := store.OpenAccount(account)
+	if err != nil {
+		return nil, fmt.Errorf("open account: %v", err)
+	}
+	defer func() {
+		err := acc.Close()
+		xlog.Check(err, "closing account")
+	}()
+
+	var msgs []store.Message
+	acc.WithRLock(func() {
+		err = acc.DB.Read(context.Background(), func(tx *bstore.Tx) error {
+			mb, err := acc.MailboxFind(tx, mailbox)
+			if err != nil {
+				return err
+			}
+			if mb == nil {
+				return fmt.Errorf("mailbox %q does not exist", mailbox)
+			}
+			q := bstore.QueryTx[store.Message](tx)
+			q.FilterNonzero(store.Message{MailboxID: mb.ID})
+			q.SortAsc("UID")
+			msgs, err = q.List()
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var l []Message
+	for _, m := range msgs {
+		mr := acc.MessageReader(m)
+		buf, err := io.ReadAll(mr)
+		xerr := mr.Close()
+		xlog.Check(xerr, "closing message reader")
+		if err != nil {
+			return nil, fmt.Errorf("reading message: %v", err)
+		}
+		l = append(l, Message{m.ID, m.UID, m.Received, m.Flags, m.Keywords, buf})
+	}
+	return l, nil
+}
+
+// QueueMessage is a message in the outgoing queue, typically added through a
+// submission.
+type QueueMessage struct {
+	queue.Msg
+	Raw []byte // Full message, with headers and body.
+}
+
+// Queue returns the messages in the outgoing queue, oldest first.
+func (s *Server) Queue() ([]QueueMessage, error) {
+	ctx := context.Background()
+	qmsgs, err := queue.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing queue: %v", err)
+	}
+	var l []QueueMessage
+	for _, qm := range qmsgs {
+		r, err := queue.OpenMessage(ctx, qm.ID)
+		if err != nil {
+			return nil, fmt.Errorf("open queued message: %v", err)
+		}
+		buf, err := io.ReadAll(r)
+		xerr := r.Close()
+		xlog.Check(xerr, "closing queued message")
+		if err != nil {
+			return nil, fmt.Errorf("reading queued message: %v", err)
+		}
+		l = append(l, QueueMessage{qm, buf})
+	}
+	return l, nil
+}
+
+// QueueDrop removes all messages from the outgoing queue.
+func (s *Server) QueueDrop() error {
+	_, err := queue.Drop(context.Background(), 0, "", "")
+	return err
+}
@@ -0,0 +1,81 @@
+package moxtest
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/imapclient"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/sasl"
+	"github.com/mjl-/mox/smtpclient"
+)
+
+func tcheck(t *testing.T, err error, msg string) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %s", msg, err)
+	}
+}
+
+func TestServer(t *testing.T) {
+	s, err := Start(t.TempDir())
+	tcheck(t, err, "start")
+	if _, err := Start(t.TempDir()); err == nil {
+		t.Fatalf("second start succeeded, expected error")
+	}
+
+	err = s.AccountAdd("other", "other@localhost", "test1234")
+	tcheck(t, err, "add account")
+	err = s.AccountAdd("third", "third@mox.example", "test1234") // With new domain.
+	tcheck(t, err, "add account with new domain")
+	err = s.Deliver("third@mox.example", []byte("Subject: test\r\n\r\ntest\r\n"))
+	tcheck(t, err, "deliver to account with new domain")
+
+	msg := strings.ReplaceAll("From: <remote@example.org>\nTo: <other@localhost>\nSubject: test\n\ntest email\n", "\n", "\r\n")
+	err = s.Deliver("other@localhost", []byte(msg))
+	tcheck(t, err, "deliver")
+	msgs, err := s.Messages("other", "Inbox")
+	tcheck(t, err, "messages")
+	if len(msgs) != 1 || !bytes.Equal(msgs[0].Raw, []byte(msg)) {
+		t.Fatalf("got messages %v, expected delivered message", msgs)
+	}
+
+	// The account can log in over IMAP.
+	conn, err := net.Dial("tcp", s.IMAP)
+	tcheck(t, err, "dial imap")
+	ic, err := imapclient.New(conn, false)
+	tcheck(t, err, "imap client")
+	_, _, err = ic.Login("other@localhost", "test1234")
+	tcheck(t, err, "imap login")
+	_, _, err = ic.Select("Inbox")
+	tcheck(t, err, "imap select")
+	ic.Close()
+
+	// Submitted messages end up in the queue, and stay there.
+	conn, err = net.Dial("tcp", s.Submission)
+	tcheck(t, err, "dial submission")
+	auth := []sasl.Client{sasl.NewClientPlain(DefaultAddress, DefaultPassword)}
+	sc, err := smtpclient.New(context.Background(), mlog.New("moxtest"), conn, smtpclient.TLSSkip, dns.Domain{ASCII: "client.example"}, dns.Domain{ASCII: "localhost"}, auth)
+	tcheck(t, err, "smtp client")
+	submitMsg := strings.ReplaceAll("From: <mox@localhost>\nTo: <remote@example.org>\nSubject: test\nMessage-Id: <test@localhost>\n\ntest email\n", "\n", "\r\n")
+	err = sc.Deliver(context.Background(), DefaultAddress, "remote@example.org", int64(len(submitMsg)), strings.NewReader(submitMsg), false, false)
+	tcheck(t, err, "submit")
+	sc.Close()
+
+	qmsgs, err := s.Queue()
+	tcheck(t, err, "queue")
+	if len(qmsgs) != 1 || qmsgs[0].Recipient().String() != "remote@example.org" || !bytes.HasSuffix(qmsgs[0].Raw, []byte(submitMsg)) {
+		t.Fatalf("got queue %v, expected submitted message", qmsgs)
+	}
+	err = s.QueueDrop()
+	tcheck(t, err, "drop queue")
+	qmsgs, err = s.Queue()
+	tcheck(t, err, "queue")
+	if len(qmsgs) != 0 {
+		t.Fatalf("got %d messages in queue after drop, expected 0", len(qmsgs))
+	}
+}
@@ -0,0 +1,71 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Introspection validates tokens by asking the token introspection endpoint of
+// the identity provider, for tokens that cannot be validated locally, e.g.
+// opaque tokens, or to notice revoked tokens. ../rfc/7662
+type Introspection struct {
+	URL           string
+	ClientID      string // For HTTP basic authentication, if set.
+	ClientSecret  string
+	Issuer        string // If set, the "iss" field must match.
+	Audience      string // If set, the "aud" field must contain it.
+	UsernameClaim string // Field with the username, "email" if empty.
+
+	// For requests, http.DefaultClient with a 10 second timeout if nil.
+	Client *http.Client
+}
+
+var _ Validator = (*Introspection)(nil)
+
+// Validate sends the token to the introspection endpoint, and checks the
+// response is for an active token.
+func (in *Introspection) Validate(ctx context.Context, token string) (string, error) {
+	client := in.Client
+	if client == nil {
+		client = http.DefaultClient
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+	}
+
+	// ../rfc/7662 section 2.1
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, "POST", in.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("making introspection request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if in.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(in.ClientID), url.QueryEscape(in.ClientSecret))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("introspection request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("introspection request: status %s", resp.Status)
+	}
+
+	// ../rfc/7662 section 2.2
+	var claims map[string]any
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&claims); err != nil {
+		return "", fmt.Errorf("parsing introspection response: %v", err)
+	}
+	if active, _ := claims["active"].(bool); !active {
+		return "", fmt.Errorf("%w: token not active", ErrInvalidToken)
+	}
+	return checkClaims(claims, time.Now(), in.Issuer, in.Audience, in.UsernameClaim, false)
+}
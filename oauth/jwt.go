@@ -0,0 +1,178 @@
+package oauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// clockSkew is allowed for the expiration and not-before times of tokens.
+const clockSkew = time.Minute
+
+// JWT validates tokens that are JSON Web Tokens signed by the identity
+// provider, without contacting the identity provider. Supported signature
+// algorithms are RS256, RS384, RS512, ES256, ES384, ES512 and EdDSA.
+// ../rfc/7519 ../rfc/9068
+type JWT struct {
+	Keys          []crypto.PublicKey // *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey.
+	Issuer        string             // Required, the "iss" claim must match.
+	Audience      string             // Required, the "aud" claim must contain it.
+	UsernameClaim string             // Claim with the username, "email" if empty.
+
+	now func() time.Time // For tests.
+}
+
+var _ Validator = (*JWT)(nil)
+
+// Validate verifies the signature and claims of the token.
+func (j *JWT) Validate(ctx context.Context, token string) (string, error) {
+	t := strings.Split(token, ".")
+	if len(t) != 3 {
+		return "", fmt.Errorf("%w: not a jwt", ErrInvalidToken)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodePart(t[0], &header); err != nil {
+		return "", fmt.Errorf("%w: parsing header: %v", ErrInvalidToken, err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(t[2])
+	if err != nil {
+		return "", fmt.Errorf("%w: decoding signature: %v", ErrInvalidToken, err)
+	}
+	if !j.verify(header.Alg, []byte(t[0]+"."+t[1]), sig) {
+		return "", fmt.Errorf("%w: signature not valid for any key", ErrInvalidToken)
+	}
+
+	var claims map[string]any
+	if err := decodePart(t[1], &claims); err != nil {
+		return "", fmt.Errorf("%w: parsing claims: %v", ErrInvalidToken, err)
+	}
+	now := time.Now()
+	if j.now != nil {
+		now = j.now()
+	}
+	return checkClaims(claims, now, j.Issuer, j.Audience, j.UsernameClaim, true)
+}
+
+// verify returns whether sig is a valid signature by one of the keys for alg.
+func (j *JWT) verify(alg string, msg, sig []byte) bool {
+	var h hash.Hash
+	var ch crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		h, ch = sha256.New(), crypto.SHA256
+	case "RS384", "ES384":
+		h, ch = sha512.New384(), crypto.SHA384
+	case "RS512", "ES512":
+		h, ch = sha512.New(), crypto.SHA512
+	case "EdDSA":
+	default:
+		// Including "none".
+		return false
+	}
+	var digest []byte
+	if h != nil {
+		h.Write(msg)
+		digest = h.Sum(nil)
+	}
+
+	for _, key := range j.Keys {
+		switch k := key.(type) {
+		case *rsa.PublicKey:
+			if strings.HasPrefix(alg, "RS") && rsa.VerifyPKCS1v15(k, ch, digest, sig) == nil {
+				return true
+			}
+		case *ecdsa.PublicKey:
+			// Signature is r and s, each the size of the curve. ../rfc/7518 section 3.4
+			size := (k.Curve.Params().BitSize + 7) / 8
+			if strings.HasPrefix(alg, "ES") && len(sig) == 2*size {
+				r := new(big.Int).SetBytes(sig[:size])
+				s := new(big.Int).SetBytes(sig[size:])
+				if ecdsa.Verify(k, digest, r, s) {
+					return true
+				}
+			}
+		case ed25519.PublicKey:
+			if alg == "EdDSA" && ed25519.Verify(k, msg, sig) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodePart(s string, v any) error {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
+
+// checkClaims checks the time, issuer and audience claims, and returns the
+// username. For JWTs, an expiration time is required, and issuer and audience
+// must be configured: any token signed by the identity provider would otherwise
+// be accepted, including those issued to other clients.
+func checkClaims(claims map[string]any, now time.Time, issuer, audience, usernameClaim string, jwt bool) (string, error) {
+	if jwt && (issuer == "" || audience == "") {
+		return "", fmt.Errorf("jwt validation requires issuer and audience")
+	}
+	numericTime := func(k string) (time.Time, bool) {
+		f, ok := claims[k].(float64)
+		if !ok {
+			return time.Time{}, false
+		}
+		return time.Unix(int64(f), 0), true
+	}
+	if exp, ok := numericTime("exp"); ok {
+		if now.After(exp.Add(clockSkew)) {
+			return "", fmt.Errorf("%w: token expired", ErrInvalidToken)
+		}
+	} else if jwt {
+		return "", fmt.Errorf("%w: token without expiration time", ErrInvalidToken)
+	}
+	if nbf, ok := numericTime("nbf"); ok && now.Add(clockSkew).Before(nbf) {
+		return "", fmt.Errorf("%w: token not yet valid", ErrInvalidToken)
+	}
+	if issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != issuer {
+			return "", fmt.Errorf("%w: token from issuer %q, expected %q", ErrInvalidToken, iss, issuer)
+		}
+	}
+	if audience != "" {
+		var match bool
+		switch aud := claims["aud"].(type) {
+		case string:
+			match = aud == audience
+		case []any:
+			for _, a := range aud {
+				if s, ok := a.(string); ok && s == audience {
+					match = true
+				}
+			}
+		}
+		if !match {
+			return "", fmt.Errorf("%w: token not for audience %q", ErrInvalidToken, audience)
+		}
+	}
+	if usernameClaim == "" {
+		usernameClaim = "email"
+	}
+	username, _ := claims[usernameClaim].(string)
+	if username == "" {
+		return "", fmt.Errorf("%w: token without %q claim", ErrInvalidToken, usernameClaim)
+	}
+	return username, nil
+}
@@ -0,0 +1,118 @@
+// Package oauth validates OAuth 2.0 bearer tokens that mail clients present
+// with the SASL mechanisms OAUTHBEARER and XOAUTH2, for organizations that
+// authenticate users through an identity provider.
+//
+// Tokens are validated locally as JWTs signed with configured public keys, or
+// by asking the identity provider through its token introspection endpoint.
+// The result is the username, an email address, that the token was issued for.
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidToken is returned for tokens that are malformed, expired, not
+// signed by a trusted key, or rejected by the identity provider.
+var ErrInvalidToken = errors.New("invalid token")
+
+// Validator validates bearer tokens.
+type Validator interface {
+	// Validate returns the username (email address) the token was issued for. For
+	// tokens that are not valid, an error wrapping ErrInvalidToken is returned.
+	// Other errors indicate temporary failures, e.g. an unreachable identity
+	// provider.
+	Validate(ctx context.Context, token string) (username string, err error)
+}
+
+// ParseOAuthBearer parses the initial client response of SASL OAUTHBEARER,
+// returning the optional authorization identity and the bearer token.
+// ../rfc/7628 section 3.1
+func ParseOAuthBearer(buf []byte) (authz, token string, err error) {
+	s := string(buf)
+	// gs2-header: no channel binding, optional authzid.
+	if !strings.HasPrefix(s, "n,") && !strings.HasPrefix(s, "y,") {
+		return "", "", fmt.Errorf("missing gs2 header")
+	}
+	s = s[2:]
+	t := strings.SplitN(s, ",", 2)
+	if len(t) != 2 {
+		return "", "", fmt.Errorf("malformed gs2 header")
+	}
+	if t[0] != "" {
+		if !strings.HasPrefix(t[0], "a=") {
+			return "", "", fmt.Errorf("malformed authzid in gs2 header")
+		}
+		authz = strings.NewReplacer("=2C", ",", "=3D", "=").Replace(t[0][2:])
+	}
+	token, err = parseKVAuth(t[1], true)
+	return authz, token, err
+}
+
+// ParseXOAuth2 parses the initial client response of SASL XOAUTH2, as used by
+// Google and Microsoft, returning the user and the bearer token.
+func ParseXOAuth2(buf []byte) (user, token string, err error) {
+	s := string(buf)
+	if !strings.HasPrefix(s, "user=") {
+		return "", "", fmt.Errorf("missing user")
+	}
+	t := strings.SplitN(s[len("user="):], "\x01", 2)
+	if len(t) != 2 {
+		return "", "", fmt.Errorf("malformed xoauth2 response")
+	}
+	token, err = parseKVAuth(t[1], false)
+	return t[0], token, err
+}
+
+// parseKVAuth parses key/value pairs separated by \x01, ending with \x01\x01,
+// and returns the token from the "auth" key. For OAUTHBEARER, the pairs start
+// with a separator.
+func parseKVAuth(s string, leadingSep bool) (string, error) {
+	if leadingSep {
+		if !strings.HasPrefix(s, "\x01") {
+			return "", fmt.Errorf("missing separator after gs2 header")
+		}
+		s = s[1:]
+	}
+	if !strings.HasSuffix(s, "\x01\x01") {
+		return "", fmt.Errorf("missing terminating separators")
+	}
+	var token string
+	for _, kv := range strings.Split(strings.TrimSuffix(s, "\x01\x01"), "\x01") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return "", fmt.Errorf("malformed key/value pair")
+		}
+		if k != "auth" {
+			// E.g. host and port, which we don't need.
+			continue
+		}
+		scheme, tok, ok := strings.Cut(v, " ")
+		if !ok || !strings.EqualFold(scheme, "bearer") || tok == "" {
+			return "", fmt.Errorf("auth must be a bearer token")
+		}
+		token = tok
+	}
+	if token == "" {
+		return "", fmt.Errorf("missing auth")
+	}
+	return token, nil
+}
+
+// ErrorChallenge returns the JSON error sent to a client as final server
+// challenge after a failed authentication attempt. The client responds with a
+// dummy line, after which the server fails the authentication.
+// ../rfc/7628 section 3.2.2
+func ErrorChallenge() []byte {
+	buf, err := json.Marshal(struct {
+		Status  string `json:"status"`
+		Schemes string `json:"schemes"`
+	}{"invalid_token", "bearer"})
+	if err != nil {
+		panic(err)
+	}
+	return buf
+}
@@ -0,0 +1,205 @@
+package oauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func tcheck(t *testing.T, err error, msg string) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %s", msg, err)
+	}
+}
+
+// sign returns a JWT with the claims, signed with key.
+func sign(t *testing.T, alg string, key crypto.Signer, claims map[string]any) string {
+	t.Helper()
+	enc := func(v any) string {
+		buf, err := json.Marshal(v)
+		tcheck(t, err, "marshal")
+		return base64.RawURLEncoding.EncodeToString(buf)
+	}
+	msg := enc(map[string]string{"alg": alg, "typ": "JWT"}) + "." + enc(claims)
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		h := sha256.Sum256([]byte(msg))
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, h[:])
+		tcheck(t, err, "sign")
+	case *ecdsa.PrivateKey:
+		h := sha256.Sum256([]byte(msg))
+		r, s, err := ecdsa.Sign(rand.Reader, k, h[:])
+		tcheck(t, err, "sign")
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(msg))
+	}
+	return msg + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWT(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	tcheck(t, err, "generate rsa key")
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tcheck(t, err, "generate ecdsa key")
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	tcheck(t, err, "generate ed25519 key")
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	tcheck(t, err, "generate ed25519 key")
+
+	now := time.Unix(1700000000, 0)
+	j := &JWT{
+		Keys:     []crypto.PublicKey{&rsaKey.PublicKey, &ecKey.PublicKey, edKey.Public()},
+		Issuer:   "https://idp.example",
+		Audience: "mox",
+		now:      func() time.Time { return now },
+	}
+
+	claims := func(exp time.Time) map[string]any {
+		return map[string]any{"iss": "https://idp.example", "aud": []string{"other", "mox"}, "exp": exp.Unix(), "email": "mjl@mox.example"}
+	}
+	good := claims(now.Add(time.Hour))
+
+	test := func(token string, expErr error) {
+		t.Helper()
+		username, err := j.Validate(context.Background(), token)
+		if expErr == nil && (err != nil || username != "mjl@mox.example") {
+			t.Fatalf("got username %q, err %v, expected mjl@mox.example", username, err)
+		} else if expErr != nil && !errors.Is(err, expErr) {
+			t.Fatalf("got err %v, expected %v", err, expErr)
+		}
+	}
+
+	test(sign(t, "RS256", rsaKey, good), nil)
+	test(sign(t, "ES256", ecKey, good), nil)
+	test(sign(t, "EdDSA", edKey, good), nil)
+
+	test("bogus", ErrInvalidToken)
+	test(sign(t, "EdDSA", otherKey, good), ErrInvalidToken)                     // Unknown key.
+	test(sign(t, "ES256", rsaKey, good), ErrInvalidToken)                       // Algorithm does not match key.
+	test(sign(t, "none", edKey, good), ErrInvalidToken)                         // Unsigned.
+	test(sign(t, "EdDSA", edKey, claims(now.Add(-time.Hour))), ErrInvalidToken) // Expired.
+
+	c := claims(now.Add(time.Hour))
+	delete(c, "exp")
+	test(sign(t, "EdDSA", edKey, c), ErrInvalidToken) // Expiration required.
+
+	c = claims(now.Add(time.Hour))
+	c["nbf"] = now.Add(time.Hour).Unix()
+	test(sign(t, "EdDSA", edKey, c), ErrInvalidToken) // Not yet valid.
+
+	c = claims(now.Add(time.Hour))
+	c["iss"] = "https://other.example"
+	test(sign(t, "EdDSA", edKey, c), ErrInvalidToken)
+
+	c = claims(now.Add(time.Hour))
+	c["aud"] = "other"
+	test(sign(t, "EdDSA", edKey, c), ErrInvalidToken)
+
+	c = claims(now.Add(time.Hour))
+	delete(c, "email")
+	test(sign(t, "EdDSA", edKey, c), ErrInvalidToken)
+
+	j.UsernameClaim = "preferred_username"
+	c["preferred_username"] = "mjl@mox.example"
+	test(sign(t, "EdDSA", edKey, c), nil)
+
+	// Expired within the allowed clock skew.
+	test(sign(t, "EdDSA", edKey, claims(now.Add(-clockSkew/2))), ErrInvalidToken) // Username claim now missing.
+	j.UsernameClaim = ""
+	test(sign(t, "EdDSA", edKey, claims(now.Add(-clockSkew/2))), nil)
+
+	// Without configured issuer or audience, no token is accepted.
+	for _, jj := range []*JWT{{Issuer: j.Issuer}, {Audience: j.Audience}} {
+		jj.Keys = j.Keys
+		jj.now = j.now
+		if _, err := jj.Validate(context.Background(), sign(t, "EdDSA", edKey, good)); err == nil {
+			t.Fatalf("validated token without issuer or audience configured")
+		}
+	}
+}
+
+func TestIntrospection(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		if user != "mox" || pass != "secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		resp := map[string]any{"active": false}
+		if r.FormValue("token") == "good" {
+			resp = map[string]any{"active": true, "email": "mjl@mox.example", "exp": time.Now().Add(time.Hour).Unix()}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+
+	in := &Introspection{URL: srv.URL, ClientID: "mox", ClientSecret: "secret"}
+	username, err := in.Validate(context.Background(), "good")
+	tcheck(t, err, "validate")
+	if username != "mjl@mox.example" {
+		t.Fatalf("got username %q, expected mjl@mox.example", username)
+	}
+	if _, err := in.Validate(context.Background(), "bad"); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("got err %v, expected ErrInvalidToken", err)
+	}
+
+	// Failing requests are not invalid tokens, but temporary errors.
+	in.ClientSecret = "wrong"
+	if _, err := in.Validate(context.Background(), "good"); err == nil || errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("got err %v, expected other error", err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	authz, token, err := ParseOAuthBearer([]byte("n,a=user@example.com,\x01host=server.example.com\x01port=143\x01auth=Bearer vF9dft4qmTc2Nvb3RlckBhbHRhdmlzdGEuY29tCg==\x01\x01"))
+	tcheck(t, err, "parse oauthbearer")
+	if authz != "user@example.com" || token != "vF9dft4qmTc2Nvb3RlckBhbHRhdmlzdGEuY29tCg==" {
+		t.Fatalf("got authz %q, token %q", authz, token)
+	}
+	authz, token, err = ParseOAuthBearer([]byte("n,,\x01auth=Bearer abc\x01\x01"))
+	tcheck(t, err, "parse oauthbearer without authzid")
+	if authz != "" || token != "abc" {
+		t.Fatalf("got authz %q, token %q", authz, token)
+	}
+	for _, s := range []string{"", "n,", "p=tls-unique,,\x01auth=Bearer abc\x01\x01", "n,,auth=Bearer abc\x01\x01", "n,,\x01auth=Bearer abc\x01", "n,,\x01auth=Basic abc\x01\x01", "n,,\x01host=x\x01\x01"} {
+		if _, _, err := ParseOAuthBearer([]byte(s)); err == nil {
+			t.Fatalf("parsing %q succeeded, expected error", s)
+		}
+	}
+
+	user, token, err := ParseXOAuth2([]byte("user=someuser@example.com\x01auth=Bearer ya29.vF9dft4qmTc2Nvb3RlckBhdHRhdmlzdGEuY29tCg\x01\x01"))
+	tcheck(t, err, "parse xoauth2")
+	if user != "someuser@example.com" || token != "ya29.vF9dft4qmTc2Nvb3RlckBhdHRhdmlzdGEuY29tCg" {
+		t.Fatalf("got user %q, token %q", user, token)
+	}
+	for _, s := range []string{"", "user=x", "user=x\x01auth=Bearer abc", "auth=Bearer abc\x01\x01"} {
+		if _, _, err := ParseXOAuth2([]byte(s)); err == nil {
+			t.Fatalf("parsing %q succeeded, expected error", s)
+		}
+	}
+
+	var v map[string]string
+	err = json.Unmarshal(ErrorChallenge(), &v)
+	tcheck(t, err, "parsing error challenge")
+	if v["status"] != "invalid_token" {
+		t.Fatalf("got %v, expected status invalid_token", v)
+	}
+}
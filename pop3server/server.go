@@ -0,0 +1,1121 @@
+// Package pop3server implements a POP3 server (RFC 1939) with extensions, for
+// retrieving messages from the Inbox of an account.
+package pop3server
+
+/*
+Implementation notes
+
+Extensions: CAPA, TOP, UIDL, USER, SASL, RESP-CODES, AUTH-RESP-CODE, PIPELINING
+and IMPLEMENTATION (../rfc/2449), STLS (../rfc/2595), AUTH (../rfc/5034) and
+the AUTH and SYS response codes (../rfc/3206).
+
+The maildrop is the Inbox of the account, without messages marked \Deleted.
+The messages are listed when the session enters the transaction state. We don't
+lock the maildrop: messages that are removed by other sessions, e.g. over IMAP,
+cannot be retrieved anymore, and are skipped when the session ends. Messages are
+removed at the end of a session with QUIT, or marked as read for accounts with
+POP3LeaveOnServer or on hold.
+
+Unique IDs for UIDL are the UIDVALIDITY of the Inbox and the UID of the message,
+they stay the same for a message across sessions.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"net"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/exp/slices"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/metrics"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/moxio"
+	"github.com/mjl-/mox/ratelimit"
+	"github.com/mjl-/mox/scram"
+	"github.com/mjl-/mox/store"
+)
+
+var xlog = mlog.New("pop3server")
+
+var (
+	metricConnection = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mox_pop3_connection_total",
+			Help: "Incoming POP3 connections.",
+		},
+		[]string{
+			"service", // pop3, pop3s
+		},
+	)
+	metricCommands = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "mox_pop3_command_duration_seconds",
+			Help:    "POP3 command duration and result codes in seconds.",
+			Buckets: []float64{0.001, 0.005, 0.01, 0.05, 0.100, 0.5, 1, 5, 10, 20},
+		},
+		[]string{
+			"cmd",
+			"result", // ok, panic, ioerror, badsyntax, servererror, usererror
+		},
+	)
+)
+
+// Delay after authentication failures. Tests set it to zero.
+var authFailDelay = time.Second // After authentication failure.
+
+// Limits on connections, like for IMAP.
+var limiterConnectionrate, limiterConnections *ratelimit.Limiter
+
+func init() {
+	limitersInit()
+}
+
+func limitersInit() {
+	mox.LimitersInit()
+	limiterConnectionrate = &ratelimit.Limiter{
+		WindowLimits: []ratelimit.WindowLimit{
+			{
+				Window: time.Minute,
+				Limits: [...]int64{300, 900, 2700},
+			},
+		},
+	}
+	limiterConnections = &ratelimit.Limiter{
+		WindowLimits: []ratelimit.WindowLimit{
+			{
+				Window: time.Duration(math.MaxInt64), // All of time.
+				Limits: [...]int64{30, 90, 270},
+			},
+		},
+	}
+}
+
+// Mechanisms we implement, of those allowed by the listener.
+var authMechanisms = []string{"SCRAM-SHA-256", "SCRAM-SHA-1", "PLAIN"}
+
+var errIO = errors.New("fatal io error") // For read/write errors and errors that should close the connection.
+
+// For clean termination of the connection after QUIT.
+var cleanClose struct{}
+
+// userError is returned to the client as -ERR, with an optional response code.
+type userError struct {
+	code string // E.g. "AUTH", "SYS/TEMP".
+	err  error
+}
+
+func (e userError) Error() string { return e.err.Error() }
+func (e userError) Unwrap() error { return e.err }
+
+func xuserErrorf(format string, args ...any) {
+	panic(userError{err: fmt.Errorf(format, args...)})
+}
+
+func xusercodeErrorf(code, format string, args ...any) {
+	panic(userError{code: code, err: fmt.Errorf(format, args...)})
+}
+
+type serverError struct{ err error }
+
+func (e serverError) Error() string { return e.err.Error() }
+func (e serverError) Unwrap() error { return e.err }
+
+func xcheckf(err error, format string, args ...any) {
+	if err != nil {
+		panic(serverError{fmt.Errorf("%s: %w", fmt.Sprintf(format, args...), err)})
+	}
+}
+
+type state byte
+
+const (
+	stateAuthorization state = iota
+	stateTransaction
+)
+
+// msg is a message in the maildrop of a session.
+type msg struct {
+	id      int64 // Of store.Message.
+	uid     store.UID
+	size    int64
+	deleted bool // Marked with DELE, removed at QUIT.
+}
+
+type conn struct {
+	cid               int64
+	state             state
+	conn              net.Conn
+	tls               bool               // Whether TLS has been initialized.
+	br                *bufio.Reader      // From remote, with TLS unwrapped in case of TLS.
+	tr                *moxio.TraceReader // Kept to change trace level when reading sensitive data.
+	bw                *bufio.Writer      // To remote, with TLS added in case of TLS.
+	tw                *moxio.TraceWriter
+	transcript        *moxio.Transcript // Protocol transcript, if a trace matches.
+	lastlog           time.Time         // For printing time since previous log line.
+	tlsConfig         *tls.Config       // TLS config to use for handshake.
+	remoteIP          net.IP
+	noRequireSTARTTLS bool
+	listenerName      string
+	cmd               string    // Currently executing, for deciding to applyChanges and logging.
+	cmdMetric         string    // Currently executing, for metrics.
+	cmdStart          time.Time // For logging and metrics.
+	ncmds             int       // Number of commands processed. Used to abort connection when first incoming command is unknown/invalid.
+	log               *mlog.Log
+
+	authFailed  int    // Consecutive failed authentication attempts.
+	user        string // From USER, for PASS.
+	username    string // Set when authenticated.
+	account     *store.Account
+	uidValidity uint32
+	msgs        []msg // Maildrop, in transaction state.
+}
+
+var servers []func()
+
+// Listen initializes all pop3 listeners for the configuration, and stores them
+// for Serve to start them.
+func Listen() {
+	limitersInit()
+
+	for name, listener := range mox.Conf.Static.Listeners {
+		var tlsConfig *tls.Config
+		if listener.TLS != nil {
+			tlsConfig = listener.TLS.Config
+		}
+
+		if listener.POP3.Enabled {
+			port := config.Port(listener.POP3.Port, 110)
+			for _, ip := range listener.IPs {
+				listen1("pop3", name, ip, port, tlsConfig, false, listener.POP3.NoRequireSTARTTLS)
+			}
+		}
+
+		if listener.POP3S.Enabled {
+			port := config.Port(listener.POP3S.Port, 995)
+			for _, ip := range listener.IPs {
+				listen1("pop3s", name, ip, port, tlsConfig, true, false)
+			}
+		}
+	}
+}
+
+func listen1(protocol, listenerName, ip string, port int, tlsConfig *tls.Config, xtls, noRequireSTARTTLS bool) {
+	addr := net.JoinHostPort(ip, fmt.Sprintf("%d", port))
+	if os.Getuid() == 0 {
+		xlog.Print("listening for pop3", mlog.Field("listener", listenerName), mlog.Field("addr", addr), mlog.Field("protocol", protocol))
+	}
+	network := mox.Network(ip)
+	ln, err := mox.Listen(network, addr, mox.Conf.Static.Listeners[listenerName].SocketOptions)
+	if err != nil {
+		xlog.Fatalx("pop3: listen for pop3", err, mlog.Field("protocol", protocol), mlog.Field("listener", listenerName))
+	}
+	ln = mox.LimitListener(ln, listenerName)
+	if xtls {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+
+	serve := func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				xlog.Infox("pop3: accept", err, mlog.Field("protocol", protocol), mlog.Field("listener", listenerName))
+				continue
+			}
+
+			metricConnection.WithLabelValues(protocol).Inc()
+			go serve(listenerName, mox.Cid(), tlsConfig, conn, xtls, noRequireSTARTTLS)
+		}
+	}
+
+	servers = append(servers, serve)
+}
+
+// Serve starts serving on all listeners, launching a goroutine per listener.
+func Serve() {
+	for _, serve := range servers {
+		go serve()
+	}
+	servers = nil
+}
+
+func serve(listenerName string, cid int64, tlsConfig *tls.Config, nc net.Conn, xtls, noRequireSTARTTLS bool) {
+	nc = moxio.ChaosConn(nc) // No-op unless built with tag moxchaos.
+	var remoteIP net.IP
+	if a, ok := nc.RemoteAddr().(*net.TCPAddr); ok {
+		remoteIP = a.IP
+	} else {
+		// For net.Pipe, during tests.
+		remoteIP = net.ParseIP("127.0.0.10")
+	}
+
+	c := &conn{
+		cid:               cid,
+		listenerName:      listenerName,
+		conn:              nc,
+		tls:               xtls,
+		lastlog:           time.Now(),
+		tlsConfig:         tlsConfig,
+		remoteIP:          remoteIP,
+		noRequireSTARTTLS: noRequireSTARTTLS,
+		cmd:               "(greeting)",
+		cmdStart:          time.Now(),
+	}
+	c.log = xlog.MoreFields(func() []mlog.Pair {
+		now := time.Now()
+		l := []mlog.Pair{
+			mlog.Field("cid", c.cid),
+			mlog.Field("delta", now.Sub(c.lastlog)),
+		}
+		c.lastlog = now
+		if c.username != "" {
+			l = append(l, mlog.Field("username", c.username))
+		}
+		return l
+	})
+	c.setupIO()
+
+	c.log.Info("new connection", mlog.Field("remote", c.conn.RemoteAddr()), mlog.Field("local", c.conn.LocalAddr()), mlog.Field("tls", xtls), mlog.Field("listener", listenerName))
+
+	defer func() {
+		c.conn.Close()
+		err := c.transcript.Close()
+		c.log.Check(err, "closing protocol transcript")
+
+		if c.account != nil {
+			err := c.account.Close()
+			c.log.Check(err, "close account")
+			c.account = nil
+		}
+
+		x := recover()
+		if x == nil || x == cleanClose {
+			c.log.Info("connection closed")
+		} else if err, ok := x.(error); ok && isClosed(err) {
+			c.log.Infox("connection closed", err)
+		} else {
+			c.log.Error("unhandled panic", mlog.Field("err", x))
+			debug.PrintStack()
+			metrics.PanicInc("pop3server")
+			moxio.CrashReport(c.log, "pop3server", nc, x)
+		}
+	}()
+
+	select {
+	case <-mox.Shutdown.Done():
+		c.writelinef("-ERR [SYS/TEMP] mox shutting down")
+		return
+	default:
+	}
+
+	if !limiterConnectionrate.Add(c.remoteIP, time.Now(), 1) {
+		c.writelinef("-ERR [SYS/TEMP] connection rate from your ip or network too high, slow down please")
+		return
+	}
+
+	// If remote IP/network resulted in too many authentication failures, refuse to serve.
+	if !mox.LimiterFailedAuth.CanAdd(c.remoteIP, time.Now(), 1) {
+		metrics.AuthenticationRatelimitedInc("pop3")
+		c.log.Debug("refusing connection due to many auth failures", mlog.Field("remoteip", c.remoteIP))
+		c.writelinef("-ERR [SYS/TEMP] too many auth failures")
+		return
+	}
+
+	if !limiterConnections.Add(c.remoteIP, time.Now(), 1) {
+		c.log.Debug("refusing connection due to many open connections", mlog.Field("remoteip", c.remoteIP))
+		c.writelinef("-ERR [SYS/TEMP] too many open connections from your ip or network")
+		return
+	}
+	defer limiterConnections.Add(c.remoteIP, time.Now(), -1)
+
+	// We register and unregister the original connection, in case it c.conn is
+	// replaced with a TLS connection later on.
+	mox.Connections.Register(nc, "pop3", listenerName)
+	defer mox.Connections.Unregister(nc)
+
+	c.transcriptOpen("")
+
+	c.writelinef("+OK mox pop3")
+
+	for {
+		c.command()
+	}
+}
+
+func (c *conn) setupIO() {
+	c.tr = moxio.NewTraceReader(c.log, "C: ", c.conn)
+	c.tw = moxio.NewTraceWriter(c.log, "S: ", c.conn)
+	c.tr.SetTranscript(c.transcript)
+	c.tw.SetTranscript(c.transcript)
+	c.br = bufio.NewReader(c.tr)
+	c.bw = bufio.NewWriter(c.tw)
+}
+
+// transcriptOpen starts writing a protocol transcript if a protocol trace
+// matches the remote IP, or account if not empty.
+func (c *conn) transcriptOpen(account string) {
+	if c.transcript != nil {
+		return
+	}
+	c.transcript = mox.TranscriptOpen(c.log, "pop3", c.cid, c.remoteIP, account)
+	c.tr.SetTranscript(c.transcript)
+	c.tw.SetTranscript(c.transcript)
+}
+
+// isClosed returns whether i/o failed, typically because the connection is closed.
+func isClosed(err error) bool {
+	return errors.Is(err, errIO) || moxio.IsClosed(err)
+}
+
+// Cache of line buffers for reading commands.
+var bufpool = moxio.NewBufpool(8, 16*1024)
+
+func (c *conn) readline() string {
+	d := 10 * time.Minute // At least 10 minutes idle timeout. ../rfc/1939 section 3
+	if c.state == stateAuthorization {
+		d = 30 * time.Second
+	}
+	err := c.conn.SetReadDeadline(time.Now().Add(d))
+	c.log.Check(err, "setting read deadline")
+
+	line, err := bufpool.Readline(c.br)
+	if err != nil {
+		panic(fmt.Errorf("reading line: %s (%w)", err, errIO))
+	}
+	return line
+}
+
+// bwritelinef writes a line to the buffered writer, it must be flushed.
+func (c *conn) bwritelinef(format string, args ...any) {
+	err := c.conn.SetWriteDeadline(time.Now().Add(5 * time.Minute))
+	c.log.Check(err, "setting write deadline")
+	fmt.Fprintf(c.bw, format+"\r\n", args...)
+}
+
+func (c *conn) xflush() {
+	if err := c.bw.Flush(); err != nil {
+		panic(fmt.Errorf("write: %s (%w)", err, errIO))
+	}
+}
+
+func (c *conn) writelinef(format string, args ...any) {
+	c.bwritelinef(format, args...)
+	c.xflush()
+}
+
+func (c *conn) xtrace(level mlog.Level) func() {
+	c.xflush()
+	c.tr.SetTrace(level)
+	c.tw.SetTrace(level)
+	return func() {
+		c.xflush()
+		c.tr.SetTrace(mlog.LevelTrace)
+		c.tw.SetTrace(mlog.LevelTrace)
+	}
+}
+
+var commands = map[string]func(c *conn, args []string){
+	// Any state.
+	"capa": (*conn).cmdCapa,
+	"quit": (*conn).cmdQuit,
+	"noop": (*conn).cmdNoop,
+
+	// Authorization.
+	"stls": (*conn).cmdStls,
+	"user": (*conn).cmdUser,
+	"pass": (*conn).cmdPass,
+	"auth": (*conn).cmdAuth,
+
+	// Transaction.
+	"stat": (*conn).cmdStat,
+	"list": (*conn).cmdList,
+	"uidl": (*conn).cmdUidl,
+	"retr": (*conn).cmdRetr,
+	"top":  (*conn).cmdTop,
+	"dele": (*conn).cmdDele,
+	"rset": (*conn).cmdRset,
+}
+
+var commandsAuthorization = map[string]bool{"stls": true, "user": true, "pass": true, "auth": true}
+var commandsTransaction = map[string]bool{"stat": true, "list": true, "uidl": true, "retr": true, "top": true, "dele": true, "rset": true}
+
+func (c *conn) command() {
+	defer func() {
+		var result string
+		defer func() {
+			metricCommands.WithLabelValues(c.cmdMetric, result).Observe(float64(time.Since(c.cmdStart)) / float64(time.Second))
+		}()
+
+		logFields := []mlog.Pair{
+			mlog.Field("cmd", c.cmd),
+			mlog.Field("duration", time.Since(c.cmdStart)),
+		}
+		c.cmd = ""
+
+		x := recover()
+		if x == nil || x == cleanClose {
+			c.log.Debug("pop3 command done", logFields...)
+			result = "ok"
+			if x == cleanClose {
+				panic(x)
+			}
+			return
+		}
+		err, ok := x.(error)
+		if !ok {
+			c.log.Error("pop3 command panic", append([]mlog.Pair{mlog.Field("panic", x)}, logFields...)...)
+			result = "panic"
+			panic(x)
+		}
+
+		var uerr userError
+		var serr serverError
+		if isClosed(err) {
+			c.log.Infox("pop3 command ioerror", err, logFields...)
+			result = "ioerror"
+			panic(err)
+		} else if errors.As(err, &serr) {
+			result = "servererror"
+			c.log.Errorx("pop3 command server error", err, logFields...)
+			debug.PrintStack()
+			c.writelinef("-ERR [SYS/TEMP] %s", err)
+		} else if errors.As(err, &uerr) {
+			result = "usererror"
+			if c.ncmds == 0 && uerr.code == "" {
+				// Other side is likely speaking something else than POP3.
+				c.writelinef("-ERR please try again speaking pop3")
+				panic(errIO)
+			}
+			c.log.Debugx("pop3 command user error", err, logFields...)
+			code := ""
+			if uerr.code != "" {
+				code = "[" + uerr.code + "] "
+			}
+			c.writelinef("-ERR %s%s", code, err)
+		} else {
+			// Other type of panic, we pass it on, aborting the connection.
+			result = "panic"
+			c.log.Errorx("pop3 command panic", err, logFields...)
+			panic(err)
+		}
+	}()
+
+	c.cmd = "(unknown)"
+	c.cmdMetric = "(unknown)"
+	line := c.readline()
+	c.cmdStart = time.Now()
+	t := strings.Split(line, " ")
+	cmdlow := strings.ToLower(t[0])
+	fn := commands[cmdlow]
+	if fn == nil {
+		xuserErrorf("unknown command %q", t[0])
+	}
+	c.cmd = cmdlow
+	c.cmdMetric = cmdlow
+	// Arguments after the command are separated by a single space. AUTH can have an
+	// empty initial response, "=". ../rfc/1939 section 3
+	args := t[1:]
+	defer func() {
+		c.ncmds++
+	}()
+
+	if commandsAuthorization[cmdlow] && c.state != stateAuthorization || commandsTransaction[cmdlow] && c.state != stateTransaction {
+		xuserErrorf("command not allowed in this state")
+	}
+
+	fn(c, args)
+}
+
+func xargs(args []string, min, max int) {
+	if len(args) < min || len(args) > max {
+		xuserErrorf("invalid number of arguments")
+	}
+}
+
+// authMechanisms returns the mechanisms allowed for this connection.
+func (c *conn) authMechanisms() []string {
+	l := mox.Conf.Static.Listeners[c.listenerName].AuthMechanisms
+	mechs := config.AuthMechanismsAllowed(l, false, c.remoteIP, c.tls)
+	var r []string
+	for _, mech := range mechs {
+		if !slices.Contains(authMechanisms, mech) {
+			continue
+		}
+		if mech == "PLAIN" && !c.tls && !c.noRequireSTARTTLS {
+			continue
+		}
+		r = append(r, mech)
+	}
+	return r
+}
+
+// Capa writes the capabilities. ../rfc/2449 section 5
+//
+// State: any
+func (c *conn) cmdCapa(args []string) {
+	xargs(args, 0, 0)
+
+	c.bwritelinef("+OK capability list follows")
+	c.bwritelinef("TOP")
+	c.bwritelinef("UIDL")
+	c.bwritelinef("RESP-CODES")
+	c.bwritelinef("AUTH-RESP-CODE")
+	c.bwritelinef("PIPELINING")
+	if c.state == stateAuthorization {
+		mechs := c.authMechanisms()
+		if slices.Contains(mechs, "PLAIN") {
+			c.bwritelinef("USER")
+		}
+		if len(mechs) > 0 {
+			c.bwritelinef("SASL %s", strings.Join(mechs, " "))
+		}
+		if !c.tls && c.tlsConfig != nil {
+			c.bwritelinef("STLS")
+		}
+	}
+	c.bwritelinef("IMPLEMENTATION mox")
+	c.bwritelinef(".")
+	c.xflush()
+}
+
+// Quit ends the session, removes messages marked as deleted at the end of a
+// transaction. ../rfc/1939 section 4 and section 6
+//
+// State: any
+func (c *conn) cmdQuit(args []string) {
+	xargs(args, 0, 0)
+
+	if c.state == stateTransaction {
+		var ids []int64
+		for _, m := range c.msgs {
+			if m.deleted {
+				ids = append(ids, m.id)
+			}
+		}
+		conf, _ := c.account.Conf()
+		keep := conf.POP3LeaveOnServer || c.account.OnHold()
+		var n int
+		var err error
+		c.account.WithWLock(func() {
+			n, err = c.account.POP3Update(c.log, ids, keep)
+		})
+		if err != nil {
+			// Messages must not be removed partially, the transaction is aborted. ../rfc/1939 section 6
+			c.log.Errorx("removing deleted messages", err)
+			c.writelinef("-ERR [SYS/TEMP] some deleted messages not removed")
+			panic(cleanClose)
+		}
+		c.log.Debug("pop3 update", mlog.Field("deleted", len(ids)), mlog.Field("updated", n), mlog.Field("keep", keep))
+		c.writelinef("+OK mox pop3 signing off, %d messages deleted", n)
+		panic(cleanClose)
+	}
+	c.writelinef("+OK mox pop3 signing off")
+	panic(cleanClose)
+}
+
+// Noop does nothing. ../rfc/1939 section 5
+//
+// State: any
+func (c *conn) cmdNoop(args []string) {
+	xargs(args, 0, 0)
+	c.writelinef("+OK")
+}
+
+// Stls starts a TLS session. ../rfc/2595 section 4
+//
+// State: Authorization
+func (c *conn) cmdStls(args []string) {
+	xargs(args, 0, 0)
+	if c.tls {
+		xuserErrorf("tls already active")
+	}
+	if c.tlsConfig == nil {
+		xuserErrorf("tls not available")
+	}
+
+	conn := c.conn
+	if n := c.br.Buffered(); n > 0 {
+		// Commands pipelined after STLS are not allowed. ../rfc/2595 section 4
+		xuserErrorf("data after stls command")
+	}
+	c.writelinef("+OK begin tls negotiation")
+
+	cidctx := context.WithValue(mox.Context, mlog.CidKey, c.cid)
+	ctx, cancel := context.WithTimeout(cidctx, time.Minute)
+	defer cancel()
+	tlsConn := tls.Server(conn, c.tlsConfig)
+	c.log.Debug("starting tls server handshake")
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		panic(fmt.Errorf("stls handshake: %s (%w)", err, errIO))
+	}
+	cancel()
+	tlsversion, ciphersuite := mox.TLSInfo(tlsConn)
+	c.log.Debug("tls server handshake done", mlog.Field("tls", tlsversion), mlog.Field("ciphersuite", ciphersuite))
+
+	c.conn = tlsConn
+	c.setupIO()
+	c.tls = true
+	// Any USER before STLS is forgotten, credentials are only accepted after.
+	c.user = ""
+}
+
+// User sets the username for PASS. ../rfc/1939 section 7
+//
+// State: Authorization
+func (c *conn) cmdUser(args []string) {
+	xargs(args, 1, 1)
+	if !slices.Contains(c.authMechanisms(), "PLAIN") {
+		if !c.tls && !c.noRequireSTARTTLS {
+			xusercodeErrorf("AUTH", "tls required for login")
+		}
+		xusercodeErrorf("AUTH", "user and pass not allowed for this connection")
+	}
+	c.user = args[0]
+	c.writelinef("+OK send password")
+}
+
+// Pass authenticates with the username from USER and a password. ../rfc/1939 section 7
+//
+// State: Authorization
+func (c *conn) cmdPass(args []string) {
+	// Passwords can have spaces.
+	password := strings.Join(args, " ")
+	if c.user == "" {
+		xuserErrorf("user required before pass")
+	}
+	username := c.user
+	c.user = ""
+
+	c.xauthDelay()
+	authResult := "error"
+	defer func() {
+		c.xauthDone("user", authResult)
+	}()
+
+	acc, err := store.OpenEmailAuth(username, password)
+	if err != nil {
+		authResult = "badcreds"
+		if errors.Is(err, store.ErrUnknownCredentials) {
+			c.log.Info("failed authentication attempt", mlog.Field("username", username), mlog.Field("remote", c.remoteIP))
+			xusercodeErrorf("AUTH", "bad credentials")
+		} else if errors.Is(err, store.ErrAccountSuspended) {
+			authResult = "suspended"
+			c.log.Info("login for suspended account", mlog.Field("username", username))
+			xusercodeErrorf("AUTH", "account is suspended")
+		}
+		xcheckf(err, "authenticating")
+	}
+	c.xauthenticated(acc, username)
+	authResult = "ok"
+}
+
+// Auth authenticates with a SASL mechanism. ../rfc/5034 section 4
+//
+// State: Authorization
+func (c *conn) cmdAuth(args []string) {
+	xargs(args, 1, 2)
+	mech := strings.ToUpper(args[0])
+	if !slices.Contains(c.authMechanisms(), mech) {
+		if mech == "PLAIN" && !c.tls && !c.noRequireSTARTTLS {
+			xusercodeErrorf("AUTH", "tls required for login")
+		}
+		xuserErrorf("authentication mechanism %s not supported for this connection", mech)
+	}
+
+	c.xauthDelay()
+	authVariant := strings.ToLower(mech)
+	authResult := "error"
+	defer func() {
+		c.xauthDone(authVariant, authResult)
+	}()
+
+	xdecode := func(s string) []byte {
+		if s == "*" {
+			authResult = "aborted"
+			xuserErrorf("authentication aborted by client") // ../rfc/5034 section 4
+		}
+		if s == "=" {
+			return nil
+		}
+		buf, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			xuserErrorf("parsing base64: %v", err)
+		}
+		return buf
+	}
+	xreadInitial := func() []byte {
+		if len(args) == 2 {
+			return xdecode(args[1])
+		}
+		c.writelinef("+ ")
+		return xdecode(c.readline())
+	}
+	xchallenge := func(s string) []byte {
+		c.writelinef("+ %s", base64.StdEncoding.EncodeToString([]byte(s)))
+		return xdecode(c.readline())
+	}
+
+	switch mech {
+	case "PLAIN":
+		// Plain text passwords, mark as traceauth.
+		restore := c.xtrace(mlog.LevelTraceauth)
+		buf := xreadInitial()
+		restore()
+		plain := bytes.Split(buf, []byte{0})
+		if len(plain) != 3 {
+			xuserErrorf("bad plain auth data, expected 3 nul-separated tokens, got %d tokens", len(plain))
+		}
+		authz := string(plain[0])
+		authc := string(plain[1])
+		password := string(plain[2])
+		if authz != "" && authz != authc {
+			authResult = "badcreds"
+			xusercodeErrorf("AUTH", "cannot assume role")
+		}
+		acc, err := store.OpenEmailAuth(authc, password)
+		if err != nil {
+			authResult = "badcreds"
+			if errors.Is(err, store.ErrUnknownCredentials) {
+				c.log.Info("authentication failed", mlog.Field("username", authc))
+				xusercodeErrorf("AUTH", "bad credentials")
+			} else if errors.Is(err, store.ErrAccountSuspended) {
+				authResult = "suspended"
+				c.log.Info("authentication for suspended account", mlog.Field("username", authc))
+				xusercodeErrorf("AUTH", "account is suspended")
+			}
+			xcheckf(err, "authenticating")
+		}
+		c.xauthenticated(acc, authc)
+
+	case "SCRAM-SHA-1", "SCRAM-SHA-256":
+		var h func() hash.Hash
+		if mech == "SCRAM-SHA-1" {
+			h = sha1.New
+		} else {
+			h = sha256.New
+		}
+
+		c0 := xreadInitial()
+		ss, err := scram.NewServer(h, c0)
+		if err != nil {
+			xuserErrorf("starting scram: %s", err)
+		}
+		c.log.Debug("scram auth", mlog.Field("authentication", ss.Authentication))
+		acc, _, err := store.OpenEmail(ss.Authentication)
+		if err != nil {
+			authResult = "badcreds"
+			c.log.Info("failed authentication attempt", mlog.Field("username", ss.Authentication), mlog.Field("remote", c.remoteIP))
+			xusercodeErrorf("AUTH", "scram not possible")
+		}
+		defer func() {
+			if acc != nil {
+				err := acc.Close()
+				c.log.Check(err, "close account")
+			}
+		}()
+		if ss.Authorization != "" && ss.Authorization != ss.Authentication {
+			authResult = "badcreds"
+			xusercodeErrorf("AUTH", "authentication with authorization for different user not supported")
+		}
+		var xscram store.SCRAM
+		acc.WithRLock(func() {
+			err = store.DBRead(context.TODO(), c.log, "pop3server", acc.DB, func(tx *bstore.Tx) error {
+				password, err := bstore.QueryTx[store.Password](tx).Get()
+				if mech == "SCRAM-SHA-1" {
+					xscram = password.SCRAMSHA1
+				} else {
+					xscram = password.SCRAMSHA256
+				}
+				return err
+			})
+		})
+		if err == bstore.ErrAbsent || err == nil && (len(xscram.Salt) == 0 || xscram.Iterations == 0 || len(xscram.SaltedPassword) == 0) {
+			authResult = "badcreds"
+			c.log.Info("scram auth attempt without derived secrets set, save password again to store secrets", mlog.Field("address", ss.Authentication))
+			xusercodeErrorf("AUTH", "scram not possible")
+		}
+		xcheckf(err, "fetching credentials")
+		s1, err := ss.ServerFirst(xscram.Iterations, xscram.Salt)
+		xcheckf(err, "scram first server step")
+		c2 := xchallenge(s1)
+		s3, err := ss.Finish(c2, xscram.SaltedPassword)
+		if err != nil {
+			authResult = "badcreds"
+			if errors.Is(err, scram.ErrInvalidProof) {
+				c.log.Info("failed authentication attempt", mlog.Field("username", ss.Authentication), mlog.Field("remote", c.remoteIP))
+				xusercodeErrorf("AUTH", "bad credentials")
+			}
+			xuserErrorf("server final: %s", err)
+		}
+		// Additional data on success is sent as challenge, the client responds with an
+		// empty line. ../rfc/5034 section 4
+		xchallenge(s3)
+		if acc.Suspended() {
+			authResult = "suspended"
+			xusercodeErrorf("AUTH", "account is suspended")
+		}
+		c.xauthenticated(acc, ss.Authentication)
+		acc = nil // Cancel cleanup.
+
+	default:
+		xuserErrorf("authentication mechanism not supported")
+	}
+	authResult = "ok"
+}
+
+// xauthDelay slows down authentication attempts after failures.
+func (c *conn) xauthDelay() {
+	if c.authFailed > 3 && authFailDelay > 0 {
+		mox.Sleep(mox.Context, time.Duration(c.authFailed-3)*authFailDelay)
+	}
+	if !mox.LimiterFailedAuth.CanAdd(c.remoteIP, time.Now(), 1) {
+		metrics.AuthenticationRatelimitedInc("pop3")
+		xusercodeErrorf("SYS/TEMP", "too many authentication failures")
+	}
+}
+
+// xauthDone records the result of an authentication attempt.
+func (c *conn) xauthDone(variant, result string) {
+	metrics.AuthenticationInc("pop3", variant, result)
+	if result == "ok" {
+		c.authFailed = 0
+		mox.LimiterFailedAuth.Reset(c.remoteIP, time.Now())
+		c.transcriptOpen(c.account.Name)
+	} else {
+		c.authFailed++
+		mox.LimiterFailedAuth.Add(c.remoteIP, time.Now(), 1)
+	}
+}
+
+// xauthenticated moves the session into the transaction state, with the messages
+// of the Inbox as maildrop. ../rfc/1939 section 4
+func (c *conn) xauthenticated(acc *store.Account, username string) {
+	ok := false
+	defer func() {
+		if !ok {
+			err := acc.Close()
+			c.log.Check(err, "close account")
+		}
+	}()
+
+	var msgs []msg
+	var uidValidity uint32
+	acc.WithRLock(func() {
+		err := store.DBRead(context.TODO(), c.log, "pop3server", acc.DB, func(tx *bstore.Tx) error {
+			mb, err := acc.MailboxFind(tx, "Inbox")
+			if err != nil || mb == nil {
+				return err
+			}
+			uidValidity = mb.UIDValidity
+			q := bstore.QueryTx[store.Message](tx)
+			q.FilterNonzero(store.Message{MailboxID: mb.ID})
+			q.FilterEqual("Deleted", false)
+			q.SortAsc("UID")
+			return q.ForEach(func(m store.Message) error {
+				msgs = append(msgs, msg{id: m.ID, uid: m.UID, size: m.Size})
+				return nil
+			})
+		})
+		xcheckf(err, "listing messages in inbox")
+	})
+
+	ok = true
+	c.account = acc
+	c.username = username
+	c.uidValidity = uidValidity
+	c.msgs = msgs
+	c.state = stateTransaction
+	c.writelinef("+OK mailbox has %d messages", len(msgs))
+}
+
+// xmsg returns the message for the message number in s, which must not be
+// marked as deleted.
+func (c *conn) xmsg(s string) *msg {
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || n == 0 || n > uint64(len(c.msgs)) {
+		xuserErrorf("no such message")
+	}
+	m := &c.msgs[n-1]
+	if m.deleted {
+		xuserErrorf("message is deleted") // ../rfc/1939 section 5
+	}
+	return m
+}
+
+// Stat returns the number and total size of messages. ../rfc/1939 section 5
+//
+// State: Transaction
+func (c *conn) cmdStat(args []string) {
+	xargs(args, 0, 0)
+	var n int
+	var size int64
+	for _, m := range c.msgs {
+		if !m.deleted {
+			n++
+			size += m.size
+		}
+	}
+	c.writelinef("+OK %d %d", n, size)
+}
+
+// List returns the sizes of messages. ../rfc/1939 section 5
+//
+// State: Transaction
+func (c *conn) cmdList(args []string) {
+	xargs(args, 0, 1)
+	if len(args) == 1 {
+		m := c.xmsg(args[0])
+		c.writelinef("+OK %s %d", args[0], m.size)
+		return
+	}
+	c.bwritelinef("+OK scan listing follows")
+	for i, m := range c.msgs {
+		if !m.deleted {
+			c.bwritelinef("%d %d", i+1, m.size)
+		}
+	}
+	c.bwritelinef(".")
+	c.xflush()
+}
+
+// Uidl returns the unique IDs of messages. ../rfc/1939 section 7
+//
+// State: Transaction
+func (c *conn) cmdUidl(args []string) {
+	xargs(args, 0, 1)
+	if len(args) == 1 {
+		m := c.xmsg(args[0])
+		c.writelinef("+OK %s %d.%d", args[0], c.uidValidity, m.uid)
+		return
+	}
+	c.bwritelinef("+OK unique-id listing follows")
+	for i, m := range c.msgs {
+		if !m.deleted {
+			c.bwritelinef("%d %d.%d", i+1, c.uidValidity, m.uid)
+		}
+	}
+	c.bwritelinef(".")
+	c.xflush()
+}
+
+// Retr returns a message. ../rfc/1939 section 5
+//
+// State: Transaction
+func (c *conn) cmdRetr(args []string) {
+	xargs(args, 1, 1)
+	m := c.xmsg(args[0])
+	c.xwriteMessage(m, -1)
+}
+
+// Top returns the header and first lines of the body of a message. ../rfc/1939 section 7
+//
+// State: Transaction
+func (c *conn) cmdTop(args []string) {
+	xargs(args, 2, 2)
+	m := c.xmsg(args[0])
+	lines, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || lines < 0 {
+		xuserErrorf("invalid number of lines")
+	}
+	c.xwriteMessage(m, lines)
+}
+
+// xwriteMessage writes a message as multi-line response, with dot-stuffing. If
+// bodyLines is not negative, only the header and the first bodyLines lines of
+// the body are written.
+func (c *conn) xwriteMessage(m *msg, bodyLines int64) {
+	var sm store.Message
+	c.account.WithRLock(func() {
+		err := store.DBRead(context.TODO(), c.log, "pop3server", c.account.DB, func(tx *bstore.Tx) error {
+			sm = store.Message{ID: m.id}
+			return tx.Get(&sm)
+		})
+		if err == bstore.ErrAbsent {
+			xuserErrorf("message was removed")
+		}
+		xcheckf(err, "get message")
+	})
+	mr := c.account.MessageReader(sm)
+	defer mr.Close()
+	br := bufio.NewReader(mr)
+
+	// Check the message can be read before sending the positive response.
+	if _, err := br.Peek(1); err != nil && err != io.EOF {
+		if errors.Is(err, os.ErrNotExist) {
+			xuserErrorf("message was removed")
+		}
+		xcheckf(err, "reading message")
+	}
+
+	c.bwritelinef("+OK message follows")
+	inHeader := true
+	var n int64
+	for bodyLines < 0 || inHeader || n < bodyLines {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			if !inHeader {
+				n++
+			} else if line == "\r\n" || line == "\n" {
+				inHeader = false
+			}
+			// ../rfc/1939 section 3
+			if strings.HasPrefix(line, ".") {
+				c.bw.WriteString(".")
+			}
+			if !strings.HasSuffix(line, "\n") {
+				line += "\r\n"
+			}
+			c.bw.WriteString(line)
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			// We already started the response, we can only abort the connection.
+			panic(fmt.Errorf("reading message: %s (%w)", err, errIO))
+		}
+	}
+	c.bwritelinef(".")
+	c.xflush()
+}
+
+// Dele marks a message as deleted, to be removed at the end of the session.
+// ../rfc/1939 section 5
+//
+// State: Transaction
+func (c *conn) cmdDele(args []string) {
+	xargs(args, 1, 1)
+	m := c.xmsg(args[0])
+	m.deleted = true
+	c.writelinef("+OK message %s deleted", args[0])
+}
+
+// Rset unmarks messages marked as deleted. ../rfc/1939 section 5
+//
+// State: Transaction
+func (c *conn) cmdRset(args []string) {
+	xargs(args, 0, 0)
+	for i := range c.msgs {
+		c.msgs[i].deleted = false
+	}
+	c.writelinef("+OK maildrop has %d messages", len(c.msgs))
+}
@@ -0,0 +1,352 @@
+package pop3server
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/scram"
+	"github.com/mjl-/mox/store"
+)
+
+var ctxbg = context.Background()
+
+func init() {
+	authFailDelay = 0
+}
+
+func tcheck(t *testing.T, err error, msg string) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %s", msg, err)
+	}
+}
+
+type testconn struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+	done chan struct{}
+}
+
+func (tc *testconn) writelinef(format string, args ...any) {
+	tc.t.Helper()
+	_, err := fmt.Fprintf(tc.conn, format+"\r\n", args...)
+	tcheck(tc.t, err, "write")
+}
+
+func (tc *testconn) readline() string {
+	tc.t.Helper()
+	line, err := tc.br.ReadString('\n')
+	tcheck(tc.t, err, "read line")
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+// cmd writes a command and checks the response starts with exp.
+func (tc *testconn) cmd(exp, format string, args ...any) string {
+	tc.t.Helper()
+	tc.writelinef(format, args...)
+	line := tc.readline()
+	if !strings.HasPrefix(line, exp) {
+		tc.t.Fatalf("command %q: got response %q, expected %q", fmt.Sprintf(format, args...), line, exp)
+	}
+	return line
+}
+
+// multi writes a command and returns the lines of the multi-line response.
+func (tc *testconn) multi(format string, args ...any) []string {
+	tc.t.Helper()
+	tc.cmd("+OK", format, args...)
+	var l []string
+	for {
+		line := tc.readline()
+		if line == "." {
+			return l
+		}
+		l = append(l, line)
+	}
+}
+
+func (tc *testconn) xmulti(exp []string, format string, args ...any) {
+	tc.t.Helper()
+	if l := tc.multi(format, args...); strings.Join(l, "\n") != strings.Join(exp, "\n") {
+		tc.t.Fatalf("command %q: got %q, expected %q", fmt.Sprintf(format, args...), l, exp)
+	}
+}
+
+func (tc *testconn) close() {
+	tc.conn.Close()
+	<-tc.done
+}
+
+func start(t *testing.T, first bool) *testconn {
+	limitersInit() // Reset rate limiters.
+
+	if first {
+		os.RemoveAll("../testdata/pop3/data")
+	}
+	mox.Context = ctxbg
+	mox.ConfigStaticPath = "../testdata/pop3/mox.conf"
+	mox.MustLoadConfig(true, false)
+	if first {
+		acc, err := store.OpenAccount("mjl")
+		tcheck(t, err, "open account")
+		err = acc.SetPassword("testtest")
+		tcheck(t, err, "set password")
+		err = acc.Close()
+		tcheck(t, err, "close account")
+	}
+
+	serverConn, clientConn := net.Pipe()
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{fakeCert(t)},
+	}
+	done := make(chan struct{})
+	go func() {
+		serve("local", mox.Cid(), tlsConfig, serverConn, false, true)
+		close(done)
+	}()
+	tc := &testconn{t: t, conn: clientConn, br: bufio.NewReader(clientConn), done: done}
+	if line := tc.readline(); !strings.HasPrefix(line, "+OK") {
+		t.Fatalf("got greeting %q", line)
+	}
+	return tc
+}
+
+func fakeCert(t *testing.T) tls.Certificate {
+	privKey := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)) // Fake key, don't use this for real!
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1), // Required field...
+	}
+	localCertBuf, err := x509.CreateCertificate(cryptorand.Reader, template, template, privKey.Public(), privKey)
+	if err != nil {
+		t.Fatalf("making certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(localCertBuf)
+	if err != nil {
+		t.Fatalf("parsing generated certificate: %s", err)
+	}
+	c := tls.Certificate{
+		Certificate: [][]byte{localCertBuf},
+		PrivateKey:  privKey,
+		Leaf:        cert,
+	}
+	return c
+}
+
+func deliver(t *testing.T, msg string) store.Message {
+	t.Helper()
+	acc, err := store.OpenAccount("mjl")
+	tcheck(t, err, "open account")
+	defer acc.Close()
+	f, err := store.CreateMessageTemp("pop3test")
+	tcheck(t, err, "create temp")
+	defer os.Remove(f.Name())
+	defer f.Close()
+	_, err = f.Write([]byte(msg))
+	tcheck(t, err, "write message")
+	m := store.Message{Size: int64(len(msg))}
+	acc.WithWLock(func() {
+		err = acc.DeliverMailbox(mlog.New("pop3test"), "Inbox", &m, f, false)
+	})
+	tcheck(t, err, "deliver")
+	return m
+}
+
+func inbox(t *testing.T) (msgs []store.Message) {
+	t.Helper()
+	acc, err := store.OpenAccount("mjl")
+	tcheck(t, err, "open account")
+	defer acc.Close()
+	msgs, err = bstore.QueryDB[store.Message](ctxbg, acc.DB).SortAsc("UID").List()
+	tcheck(t, err, "list messages")
+	return msgs
+}
+
+func TestPOP3(t *testing.T) {
+	tc := start(t, true)
+	defer tc.close()
+	switchDone := store.Switchboard()
+	defer close(switchDone)
+
+	msg1 := "Subject: one\r\n\r\nline1\r\n.dot\r\nline3\r\n"
+	msg2 := "Subject: two\r\n\r\nbody\r\n"
+	m1 := deliver(t, msg1)
+	m2 := deliver(t, msg2)
+	var mb store.Mailbox
+	acc, err := store.OpenAccount("mjl")
+	tcheck(t, err, "open account")
+	mb = store.Mailbox{ID: m1.MailboxID}
+	err = acc.DB.Get(ctxbg, &mb)
+	tcheck(t, err, "get inbox")
+	acc.Close()
+
+	tc.xmulti([]string{"TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE", "PIPELINING", "USER", "SASL SCRAM-SHA-256 SCRAM-SHA-1 PLAIN", "STLS", "IMPLEMENTATION mox"}, "CAPA")
+	tc.cmd("-ERR", "STAT")
+	tc.cmd("-ERR", "PASS testtest")
+	tc.cmd("+OK", "USER mjl@mox.example")
+	tc.cmd("-ERR [AUTH]", "PASS bad")
+	tc.cmd("+OK", "USER mjl@mox.example")
+	tc.cmd("+OK mailbox has 2 messages", "PASS testtest")
+	tc.cmd("-ERR", "USER mjl@mox.example")
+
+	tc.cmd(fmt.Sprintf("+OK 2 %d", m1.Size+m2.Size), "STAT")
+	tc.xmulti([]string{fmt.Sprintf("1 %d", m1.Size), fmt.Sprintf("2 %d", m2.Size)}, "LIST")
+	tc.cmd(fmt.Sprintf("+OK 2 %d", m2.Size), "LIST 2")
+	tc.cmd("-ERR", "LIST 3")
+	tc.xmulti([]string{fmt.Sprintf("1 %d.%d", mb.UIDValidity, m1.UID), fmt.Sprintf("2 %d.%d", mb.UIDValidity, m2.UID)}, "UIDL")
+	tc.cmd(fmt.Sprintf("+OK 1 %d.%d", mb.UIDValidity, m1.UID), "UIDL 1")
+
+	// Lines starting with a dot are dot-stuffed.
+	tc.xmulti([]string{"Subject: one", "", "line1", "..dot", "line3"}, "RETR 1")
+	tc.xmulti([]string{"Subject: one", "", "line1"}, "TOP 1 1")
+	tc.xmulti([]string{"Subject: one", ""}, "TOP 1 0")
+	tc.cmd("-ERR", "TOP 1 -1")
+
+	tc.cmd("+OK", "DELE 1")
+	tc.cmd("-ERR", "DELE 1")
+	tc.cmd("-ERR", "RETR 1")
+	tc.cmd(fmt.Sprintf("+OK 1 %d", m2.Size), "STAT")
+	tc.xmulti([]string{fmt.Sprintf("2 %d", m2.Size)}, "LIST")
+	tc.cmd("+OK", "RSET")
+	tc.cmd("+OK 2", "STAT")
+	tc.cmd("+OK", "DELE 2")
+	tc.cmd("+OK", "NOOP")
+	tc.cmd("+OK mox pop3 signing off, 1 messages deleted", "QUIT")
+	tc.close()
+
+	if msgs := inbox(t); len(msgs) != 1 || msgs[0].ID != m1.ID {
+		t.Fatalf("got %d messages after quit, expected only first message", len(msgs))
+	}
+
+	// Without QUIT, messages are not removed.
+	tc = start(t, false)
+	tc.cmd("+OK", "USER mjl@mox.example")
+	tc.cmd("+OK mailbox has 1 messages", "PASS testtest")
+	tc.cmd("+OK", "DELE 1")
+	tc.close()
+	if msgs := inbox(t); len(msgs) != 1 {
+		t.Fatalf("got %d messages after aborted session, expected 1", len(msgs))
+	}
+
+	// With POP3LeaveOnServer, messages are marked as read.
+	tc = start(t, false)
+	accConf := mox.Conf.Dynamic.Accounts["mjl"]
+	defer func() {
+		mox.Conf.Dynamic.Accounts["mjl"] = accConf
+	}()
+	nconf := accConf
+	nconf.POP3LeaveOnServer = true
+	mox.Conf.Dynamic.Accounts["mjl"] = nconf
+	tc.cmd("+OK", "USER mjl@mox.example")
+	tc.cmd("+OK", "PASS testtest")
+	tc.cmd("+OK", "DELE 1")
+	tc.cmd("+OK mox pop3 signing off, 1 messages deleted", "QUIT")
+	tc.close()
+	if msgs := inbox(t); len(msgs) != 1 || !msgs[0].Seen {
+		t.Fatalf("expected single message marked seen, got %v", msgs)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	tc := start(t, true)
+	defer tc.close()
+	switchDone := store.Switchboard()
+	defer close(switchDone)
+
+	b64 := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	tc.cmd("-ERR", "AUTH BOGUS")
+	tc.cmd("-ERR [AUTH]", "AUTH PLAIN %s", b64("\u0000mjl@mox.example\u0000bad"))
+	tc.cmd("-ERR [AUTH]", "AUTH PLAIN %s", b64("other@mox.example\u0000mjl@mox.example\u0000testtest"))
+	tc.cmd("+ ", "AUTH PLAIN")
+	tc.cmd("-ERR", "*")
+	tc.cmd("+ ", "AUTH PLAIN")
+	tc.cmd("+OK", "%s", b64("\u0000mjl@mox.example\u0000testtest"))
+	tc.cmd("-ERR", "AUTH PLAIN")
+	tc.cmd("+OK", "QUIT")
+	tc.close()
+
+	// SCRAM-SHA-256, with wrong and right password.
+	scramAuth := func(password string, expOK bool) {
+		t.Helper()
+		tc = start(t, false)
+		defer tc.close()
+		sc := scram.NewClient(sha256.New, "mjl@mox.example", "")
+		clientFirst, err := sc.ClientFirst()
+		tcheck(t, err, "scram client first")
+		line := tc.cmd("+ ", "AUTH SCRAM-SHA-256 %s", b64(clientFirst))
+		serverFirst, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(line, "+ "))
+		tcheck(t, err, "decode server first")
+		clientFinal, err := sc.ServerFirst(serverFirst, password)
+		tcheck(t, err, "scram client final")
+		if !expOK {
+			tc.cmd("-ERR [AUTH]", "%s", b64(clientFinal))
+			return
+		}
+		line = tc.cmd("+ ", "%s", b64(clientFinal))
+		serverFinal, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(line, "+ "))
+		tcheck(t, err, "decode server final")
+		err = sc.ServerFinal(serverFinal)
+		tcheck(t, err, "scram server final")
+		tc.cmd("+OK", "")
+		tc.cmd("+OK 0 0", "STAT")
+	}
+	scramAuth("bad", false)
+	scramAuth("testtest", true)
+}
+
+func TestProtocolTrace(t *testing.T) {
+	// IP traces must exist before the connection.
+	pt, err := mox.TraceAdd(xlog, "", "127.0.0.10", time.Hour)
+	tcheck(t, err, "add trace")
+	defer mox.TraceRemove(xlog, pt.ID)
+	tc := start(t, true)
+	defer tc.close()
+	switchDone := store.Switchboard()
+	defer close(switchDone)
+
+	tc.cmd("+OK", "USER mjl@mox.example")
+	tc.cmd("+OK", "PASS testtest")
+	tc.cmd("+OK", "STAT")
+	tc.cmd("+OK", "QUIT")
+	tc.close()
+
+	dir := mox.DataDirPath("traces")
+	defer os.RemoveAll(dir)
+	files, err := os.ReadDir(dir)
+	tcheck(t, err, "list transcripts")
+	if len(files) != 1 {
+		t.Fatalf("got %d transcripts, expected 1", len(files))
+	}
+	buf, err := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	tcheck(t, err, "read transcript")
+	s := string(buf)
+	for _, e := range []string{"C: USER mjl@mox.example", "C: PASS (credentials redacted)", "C: STAT"} {
+		if !strings.Contains(s, e) {
+			t.Fatalf("transcript %q does not contain %q", s, e)
+		}
+	}
+	if strings.Contains(s, "testtest") {
+		t.Fatalf("transcript %q contains password", s)
+	}
+}
@@ -0,0 +1,91 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/dsn"
+	"github.com/mjl-/mox/mlog"
+)
+
+// DeliveryRetention is how long results of delivery attempts are kept.
+const DeliveryRetention = 30 * 24 * time.Hour
+
+// Delivery is the result of a delivery attempt of a message submitted by an
+// account. Results are kept for DeliveryRetention, so the account holder can see
+// what happened to recently sent messages, also after they were removed from the
+// queue.
+type Delivery struct {
+	ID        int64
+	Time      time.Time `bstore:"default now,index"`
+	Account   string    `bstore:"nonzero,index"`
+	MsgID     int64     // ID of message in queue.
+	MailFrom  string
+	Recipient string
+	Attempt   int
+	Result    string // HookDelivered, HookDelayed or HookFailed.
+	RemoteMTA string // Remote mail server or submission host, if any.
+	TLS       bool   // Whether the connection for a successful delivery was protected with TLS.
+	Error     string // For delayed and failed.
+}
+
+// DeliveryList returns the recent delivery results for messages submitted by
+// account, most recent first.
+func DeliveryList(ctx context.Context, account string) ([]Delivery, error) {
+	q := bstore.QueryDB[Delivery](ctx, DB)
+	q.FilterNonzero(Delivery{Account: account})
+	q.FilterGreater("Time", time.Now().Add(-DeliveryRetention))
+	q.SortDesc("Time")
+	return q.List()
+}
+
+// deliveryAdd records the result of a delivery attempt of m, also as trace event.
+// Results older than DeliveryRetention are removed. Errors are logged.
+func deliveryAdd(log *mlog.Log, m Msg, result string, remoteMTA dsn.NameIP, tls bool, errmsg string) {
+	var remote string
+	if remoteMTA.Name != "" {
+		remote = remoteMTA.Name
+	} else if remoteMTA.IP != nil {
+		remote = remoteMTA.IP.String()
+	}
+
+	text := fmt.Sprintf("attempt %d", m.Attempts)
+	if remote != "" {
+		text += ", remote " + remote
+	}
+	if result == HookDelivered {
+		text += fmt.Sprintf(", tls %v", tls)
+	}
+	if errmsg != "" {
+		text += ": " + errmsg
+	}
+	Trace(log, TraceEvent{TraceID: m.TraceID, Stage: result, QueueID: m.ID, Recipient: m.Recipient().XString(true), Text: text})
+
+	if m.SenderAccount == "" || m.Sender().IsZero() {
+		// E.g. DSNs, reports and journal copies.
+		return
+	}
+	d := Delivery{
+		Account:   m.SenderAccount,
+		MsgID:     m.ID,
+		MailFrom:  m.Sender().String(),
+		Recipient: m.Recipient().String(),
+		Attempt:   m.Attempts,
+		Result:    result,
+		RemoteMTA: remote,
+		TLS:       tls,
+		Error:     errmsg,
+	}
+	err := DB.Write(context.Background(), func(tx *bstore.Tx) error {
+		q := bstore.QueryTx[Delivery](tx)
+		q.FilterLess("Time", time.Now().Add(-DeliveryRetention))
+		if _, err := q.Delete(); err != nil {
+			return err
+		}
+		return tx.Insert(&d)
+	})
+	log.Check(err, "recording delivery result")
+}
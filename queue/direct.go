@@ -25,9 +25,19 @@ import (
 
 // todo: rename function, perhaps put some of the params in a delivery struct so we don't pass all the params all the time?
 func fail(qlog *mlog.Log, m Msg, backoff time.Duration, permanent bool, remoteMTA dsn.NameIP, secodeOpt, errmsg string) {
+	if !permanent {
+		if parked, expired := park(qlog, m, remoteMTA, secodeOpt, errmsg); parked {
+			return
+		} else if expired {
+			permanent = true
+		}
+	}
+
 	if permanent || m.Attempts >= 8 {
 		qlog.Errorx("permanent failure delivering from queue", errors.New(errmsg))
 		queueDSNFailure(qlog, m, remoteMTA, secodeOpt, errmsg)
+		hookOutgoing(qlog, m, HookFailed, remoteMTA, errmsg)
+		deliveryAdd(qlog, m, HookFailed, remoteMTA, false, errmsg)
 
 		if err := queueDelete(context.Background(), m.ID); err != nil {
 			qlog.Errorx("deleting message from queue after permanent failure", err)
@@ -40,6 +50,16 @@ func fail(qlog *mlog.Log, m Msg, backoff time.Duration, permanent bool, remoteMT
 	if _, err := qup.UpdateNonzero(Msg{LastError: errmsg, DialedIPs: m.DialedIPs}); err != nil {
 		qlog.Errorx("storing delivery error", err, mlog.Field("deliveryerror", errmsg))
 	}
+	if m.Parked != nil {
+		// The condition for parking has cleared, but delivery failed for another reason.
+		// Regular delivery attempts apply again.
+		m.Parked = nil
+		if _, err := bstore.QueryDB[Msg](context.Background(), DB).FilterID(m.ID).UpdateField("Parked", m.Parked); err != nil {
+			qlog.Errorx("clearing parked time", err)
+		}
+	}
+	hookOutgoing(qlog, m, HookDelayed, remoteMTA, errmsg)
+	deliveryAdd(qlog, m, HookDelayed, remoteMTA, false, errmsg)
 
 	if m.Attempts == 5 {
 		// We've attempted deliveries at these intervals: 0, 7.5m, 15m, 30m, 1h, 2u.
@@ -54,7 +74,7 @@ func fail(qlog *mlog.Log, m Msg, backoff time.Duration, permanent bool, remoteMT
 }
 
 // Delivery by directly dialing MX hosts for destination domain.
-func deliverDirect(cid int64, qlog *mlog.Log, resolver dns.Resolver, dialer contextDialer, ourHostname dns.Domain, transportName string, m Msg, backoff time.Duration) {
+func deliverDirect(cid int64, qlog *mlog.Log, resolver dns.Resolver, dialer contextDialer, localIPs []net.IP, ourHostname dns.Domain, transportName string, m Msg, backoff time.Duration) {
 	hosts, effectiveDomain, permanent, err := gatherHosts(resolver, m, cid, qlog)
 	if err != nil {
 		fail(qlog, m, backoff, permanent, dsn.NameIP{}, "", err.Error())
@@ -115,15 +135,37 @@ func deliverDirect(cid int64, qlog *mlog.Log, resolver dns.Resolver, dialer cont
 		if policy != nil && policy.Mode == mtasts.ModeEnforce {
 			tlsMode = smtpclient.TLSStrictStartTLS
 		}
-		permanent, badTLS, secodeOpt, remoteIP, errmsg, ok = deliverHost(nqlog, resolver, dialer, cid, ourHostname, transportName, h, &m, tlsMode)
+		var tlsVersion string
+		permanent, badTLS, secodeOpt, remoteIP, errmsg, tlsVersion, ok = deliverHost(nqlog, resolver, dialer, localIPs, cid, ourHostname, transportName, h, &m, tlsMode)
+		var tlsErrmsg string
 		if !ok && badTLS && tlsMode == smtpclient.TLSOpportunistic {
 			// In case of failure with opportunistic TLS, try again without TLS. ../rfc/7435:459
 			// todo future: revisit this decision. perhaps it should be a configuration option that defaults to not doing this?
 			nqlog.Info("connecting again for delivery attempt without tls")
-			permanent, badTLS, secodeOpt, remoteIP, errmsg, ok = deliverHost(nqlog, resolver, dialer, cid, ourHostname, transportName, h, &m, smtpclient.TLSSkip)
+			tlsErrmsg = errmsg
+			permanent, badTLS, secodeOpt, remoteIP, errmsg, tlsVersion, ok = deliverHost(nqlog, resolver, dialer, localIPs, cid, ourHostname, transportName, h, &m, smtpclient.TLSSkip)
 		}
 		if ok {
 			nqlog.Info("delivered from queue")
+			verification := "none"
+			if tlsVersion != "" {
+				switch {
+				case tlsMode == smtpclient.TLSStrictStartTLS && policy != nil && policy.Mode == mtasts.ModeEnforce:
+					verification = "mtasts"
+				case tlsMode == smtpclient.TLSStrictStartTLS:
+					verification = "strict"
+				default:
+					verification = "opportunistic"
+				}
+			}
+			metricDeliveryTLS.WithLabelValues(verification, mox.TLSMetricsVersion(tlsVersion), mox.TLSMetricsDomain(m.RecipientDomain.Domain)).Inc()
+			// DSNs are composed from the message file, so before removing it from the queue.
+			if tlsErrmsg != "" {
+				recordTLSDowngrade(nqlog, m, effectiveDomain, policy, h, remoteIP, tlsErrmsg)
+			}
+			queueDSNSuccess(nqlog, m, dsn.NameIP{Name: h.XString(false), IP: remoteIP})
+			hookOutgoing(nqlog, m, HookDelivered, dsn.NameIP{Name: h.XString(false), IP: remoteIP}, "")
+			deliveryAdd(nqlog, m, HookDelivered, dsn.NameIP{Name: h.XString(false), IP: remoteIP}, tlsVersion != "", "")
 			if err := queueDelete(context.Background(), m.ID); err != nil {
 				nqlog.Errorx("deleting message from queue after delivery", err)
 			}
@@ -252,7 +294,7 @@ func gatherHosts(resolver dns.Resolver, m Msg, cid int64, qlog *mlog.Log) (hosts
 
 // deliverHost attempts to deliver m to host.
 // deliverHost updated m.DialedIPs, which must be saved in case of failure to deliver.
-func deliverHost(log *mlog.Log, resolver dns.Resolver, dialer contextDialer, cid int64, ourHostname dns.Domain, transportName string, host dns.IPDomain, m *Msg, tlsMode smtpclient.TLSMode) (permanent, badTLS bool, secodeOpt string, remoteIP net.IP, errmsg string, ok bool) {
+func deliverHost(log *mlog.Log, resolver dns.Resolver, dialer contextDialer, localIPs []net.IP, cid int64, ourHostname dns.Domain, transportName string, host dns.IPDomain, m *Msg, tlsMode smtpclient.TLSMode) (permanent, badTLS bool, secodeOpt string, remoteIP net.IP, errmsg string, tlsVersion string, ok bool) {
 	// About attempting delivery to multiple addresses of a host: ../rfc/5321:3898
 
 	start := time.Now()
@@ -264,7 +306,7 @@ func deliverHost(log *mlog.Log, resolver dns.Resolver, dialer contextDialer, cid
 
 	f, err := os.Open(m.MessagePath())
 	if err != nil {
-		return false, false, "", nil, fmt.Sprintf("open message file: %s", err), false
+		return false, false, "", nil, fmt.Sprintf("open message file: %s", err), "", false
 	}
 	msgr := store.FileMsgReader(m.MsgPrefix, f)
 	defer func() {
@@ -276,7 +318,7 @@ func deliverHost(log *mlog.Log, resolver dns.Resolver, dialer contextDialer, cid
 	ctx, cancel := context.WithTimeout(cidctx, 30*time.Second)
 	defer cancel()
 
-	conn, ip, dualstack, err := dialHost(ctx, log, resolver, dialer, host, 25, m)
+	conn, ip, dualstack, err := dialHost(ctx, log, resolver, dialer, localIPs, host, 25, m)
 	remoteIP = ip
 	cancel()
 	var result string
@@ -293,7 +335,7 @@ func deliverHost(log *mlog.Log, resolver dns.Resolver, dialer contextDialer, cid
 	metricConnection.WithLabelValues(result).Inc()
 	if err != nil {
 		log.Debugx("connecting to remote smtp", err, mlog.Field("host", host))
-		return false, false, "", ip, fmt.Sprintf("dialing smtp server: %v", err), false
+		return false, false, "", ip, fmt.Sprintf("dialing smtp server: %v", err), "", false
 	}
 
 	var mailFrom string
@@ -321,13 +363,31 @@ func deliverHost(log *mlog.Log, resolver dns.Resolver, dialer contextDialer, cid
 		smtputf8 := m.SMTPUTF8
 		var msg io.Reader = msgr
 		size := m.Size
+		binary := m.BinaryMIME && sc.SupportsBinaryMIME()
 		if m.DSNUTF8 != nil && sc.Supports8BITMIME() && sc.SupportsSMTPUTF8() {
 			has8bit = true
 			smtputf8 = true
 			size = int64(len(m.DSNUTF8))
 			msg = bytes.NewReader(m.DSNUTF8)
+		} else if m.BinaryMIME && !binary {
+			var df *os.File
+			df, size, err = downgradeBinary(log, msgr, size)
+			if err == nil {
+				defer func() {
+					err := os.Remove(df.Name())
+					log.Check(err, "removing temporary converted message file")
+					err = df.Close()
+					log.Check(err, "closing temporary converted message file")
+				}()
+				msg = df
+			}
+		}
+		if err == nil && binary {
+			err = sc.DeliverBinary(ctx, mailFrom, rcptTo, size, msg, smtputf8)
+		} else if err == nil {
+			err = sc.Deliver(ctx, mailFrom, rcptTo, size, msg, has8bit, smtputf8)
 		}
-		err = sc.Deliver(ctx, mailFrom, rcptTo, size, msg, has8bit, smtputf8)
+		tlsVersion = sc.TLSVersion()
 	}
 	if err != nil {
 		log.Infox("delivery failed", err)
@@ -349,7 +409,7 @@ func deliverHost(log *mlog.Log, resolver dns.Resolver, dialer contextDialer, cid
 		deliveryResult = "error"
 	}
 	if err == nil {
-		return false, false, "", ip, "", true
+		return false, false, "", ip, "", tlsVersion, true
 	} else if cerr, ok := err.(smtpclient.Error); ok {
 		// If we are being rejected due to policy reasons on the first
 		// attempt and remote has both IPv4 and IPv6, we'll give it
@@ -359,8 +419,8 @@ func deliverHost(log *mlog.Log, resolver dns.Resolver, dialer contextDialer, cid
 		if permanent && m.Attempts == 1 && dualstack && strings.HasPrefix(cerr.Secode, "7.") {
 			permanent = false
 		}
-		return permanent, errors.Is(cerr, smtpclient.ErrTLS), cerr.Secode, ip, cerr.Error(), false
+		return permanent, errors.Is(cerr, smtpclient.ErrTLS), cerr.Secode, ip, cerr.Error(), tlsVersion, false
 	} else {
-		return false, errors.Is(cerr, smtpclient.ErrTLS), "", ip, err.Error(), false
+		return false, errors.Is(cerr, smtpclient.ErrTLS), "", ip, err.Error(), tlsVersion, false
 	}
 }
@@ -2,8 +2,11 @@ package queue
 
 import (
 	"bufio"
-	"fmt"
+	"bytes"
+	"context"
+	"net/mail"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/mjl-/mox/dns"
@@ -15,39 +18,70 @@ import (
 	"github.com/mjl-/mox/store"
 )
 
-func queueDSNFailure(log *mlog.Log, m Msg, remoteMTA dsn.NameIP, secodeOpt, errmsg string) {
-	const subject = "mail delivery failed"
-	message := fmt.Sprintf(`
-Delivery has failed permanently for your email to:
-
-	%s
-
-No further deliveries will be attempted.
-
-Error during the last delivery attempt:
+// Keyword added to a message in the Sent mailbox of the sender when a DSN for a
+// successful delivery is sent to the sender.
+const sentDeliveredKeyword = "$delivered"
 
-	%s
-`, m.Recipient().XString(m.SMTPUTF8), errmsg)
+func queueDSNFailure(log *mlog.Log, m Msg, remoteMTA dsn.NameIP, secodeOpt, errmsg string) {
+	if !m.dsnRequested("FAILURE") {
+		log.Debug("not sending dsn for failure, not requested by sender")
+		return
+	}
+	lang := mox.AccountLanguage(m.SenderAccount)
+	subject := mox.Text(lang, "dsn-failure-subject")
+	message := mox.Text(lang, "dsn-failure-body", "recipient", m.Recipient().XString(m.SMTPUTF8), "error", errmsg)
 
-	queueDSN(log, m, remoteMTA, secodeOpt, errmsg, true, nil, subject, message)
+	queueDSN(log, m, remoteMTA, secodeOpt, errmsg, dsn.Failed, nil, subject, message)
 }
 
 func queueDSNDelay(log *mlog.Log, m Msg, remoteMTA dsn.NameIP, secodeOpt, errmsg string, retryUntil time.Time) {
-	const subject = "mail delivery delayed"
-	message := fmt.Sprintf(`
-Delivery has been delayed of your email to:
+	if !m.dsnRequested("DELAY") {
+		log.Debug("not sending dsn for delay, not requested by sender")
+		return
+	}
+	lang := mox.AccountLanguage(m.SenderAccount)
+	subject := mox.Text(lang, "dsn-delay-subject")
+	message := mox.Text(lang, "dsn-delay-body", "recipient", m.Recipient().XString(false), "error", errmsg)
 
-	%s
+	queueDSN(log, m, remoteMTA, secodeOpt, errmsg, dsn.Delayed, &retryUntil, subject, message)
+}
 
-Next attempts to deliver: in 4 hours, 8 hours and 16 hours.
-If these attempts all fail, you will receive a notice.
+// queueDSNSuccess sends a DSN for a successful delivery if the sender requested
+// it with NOTIFY=SUCCESS. We don't pass the DSN request on to the next hop, so
+// the action is "relayed". ../rfc/3461
+func queueDSNSuccess(log *mlog.Log, m Msg, remoteMTA dsn.NameIP) {
+	if !m.dsnRequested("SUCCESS") {
+		return
+	}
+	lang := mox.AccountLanguage(m.SenderAccount)
+	subject := mox.Text(lang, "dsn-success-subject")
+	message := mox.Text(lang, "dsn-success-body", "recipient", m.Recipient().XString(m.SMTPUTF8))
 
-Error during the last delivery attempt:
+	queueDSN(log, m, remoteMTA, "", "", dsn.Relayed, nil, subject, message)
+}
 
-	%s
-`, m.Recipient().XString(false), errmsg)
+// DSNDelivered sends a DSN for a message delivered directly to a local account,
+// without going through the queue, if the sender requested it with
+// NOTIFY=SUCCESS. Only the fields of m about the sender, recipient, DSN request
+// and trace ID need to be set. Headers are the headers of the delivered message.
+// Like for DSNs from the queue, the message in the Sent mailbox of the sender is
+// marked as delivered. Must not be called with the account lock of the sender held.
+func DSNDelivered(log *mlog.Log, m Msg, headers []byte) {
+	if !m.dsnRequested("SUCCESS") {
+		return
+	}
+	now := time.Now()
+	if m.Queued.IsZero() {
+		m.Queued = now
+	}
+	if m.LastAttempt == nil {
+		m.LastAttempt = &now
+	}
+	lang := mox.AccountLanguage(m.SenderAccount)
+	subject := mox.Text(lang, "dsn-success-subject")
+	message := mox.Text(lang, "dsn-success-body", "recipient", m.Recipient().XString(m.SMTPUTF8))
 
-	queueDSN(log, m, remoteMTA, secodeOpt, errmsg, false, &retryUntil, subject, message)
+	sendDSN(log, m, headers, dsn.NameIP{}, "", "", dsn.Delivered, nil, subject, message)
 }
 
 // We only queue DSNs for delivery failures for emails submitted by authenticated
@@ -55,12 +89,8 @@ Error during the last delivery attempt:
 // ../rfc/5321:1494
 // ../rfc/7208:490
 // todo future: when we implement relaying, we should be able to send DSNs to non-local users. and possibly specify a null mailfrom. ../rfc/5321:1503
-func queueDSN(log *mlog.Log, m Msg, remoteMTA dsn.NameIP, secodeOpt, errmsg string, permanent bool, retryUntil *time.Time, subject, textBody string) {
-	kind := "delayed delivery"
-	if permanent {
-		kind = "failure"
-	}
-
+func queueDSN(log *mlog.Log, m Msg, remoteMTA dsn.NameIP, secodeOpt, errmsg string, action dsn.Action, retryUntil *time.Time, subject, textBody string) {
+	kind := dsnKind(action)
 	qlog := func(text string, err error) {
 		log.Errorx("queue dsn: "+text+": sender will not be informed about dsn", err, mlog.Field("sender", m.Sender().XString(m.SMTPUTF8)), mlog.Field("kind", kind))
 	}
@@ -81,23 +111,37 @@ func queueDSN(log *mlog.Log, m Msg, remoteMTA dsn.NameIP, secodeOpt, errmsg stri
 		return
 	}
 
-	var action dsn.Action
+	sendDSN(log, m, headers, remoteMTA, secodeOpt, errmsg, action, retryUntil, subject, textBody)
+}
+
+// sendDSN composes a DSN about m with the original message headers, and delivers
+// it to the sender.
+func sendDSN(log *mlog.Log, m Msg, headers []byte, remoteMTA dsn.NameIP, secodeOpt, errmsg string, action dsn.Action, retryUntil *time.Time, subject, textBody string) {
+	kind := dsnKind(action)
+	qlog := func(text string, err error) {
+		log.Errorx("queue dsn: "+text+": sender will not be informed about dsn", err, mlog.Field("sender", m.Sender().XString(m.SMTPUTF8)), mlog.Field("kind", kind))
+	}
+
 	var status string
-	if permanent {
+	switch action {
+	case dsn.Failed:
 		status = "5."
-		action = dsn.Failed
-	} else {
-		action = dsn.Delayed
+	case dsn.Delayed:
 		status = "4."
+	default:
+		status = "2."
 	}
 	if secodeOpt != "" {
 		status += secodeOpt
 	} else {
 		status += "0.0"
 	}
-	diagCode := errmsg
-	if !dsn.HasCode(diagCode) {
-		diagCode = status + " " + errmsg
+	var diagCode string
+	if errmsg != "" {
+		diagCode = errmsg
+		if !dsn.HasCode(diagCode) {
+			diagCode = status + " " + errmsg
+		}
 	}
 
 	dsnMsg := &dsn.Message{
@@ -132,53 +176,73 @@ func queueDSN(log *mlog.Log, m Msg, remoteMTA dsn.NameIP, secodeOpt, errmsg stri
 
 	msgData = append(msgData, []byte("Return-Path: <"+dsnMsg.From.XString(m.SMTPUTF8)+">\r\n")...)
 
-	mailbox := "Inbox"
-	acc, err := store.OpenAccount(m.SenderAccount)
-	if err != nil {
-		acc, err = store.OpenAccount(mox.Conf.Static.Postmaster.Account)
-		if err != nil {
-			qlog("looking up postmaster account after sender account was not found", err)
-			return
-		}
-		mailbox = mox.Conf.Static.Postmaster.Mailbox
+	account, mailbox := m.SenderAccount, "Inbox"
+	if _, ok := mox.Conf.Account(account); !ok {
+		account, mailbox = mox.Conf.Static.Postmaster.Account, mox.Conf.Static.Postmaster.Mailbox
 	}
-	defer func() {
-		err := acc.Close()
-		log.Check(err, "queue dsn: closing account", mlog.Field("sender", m.Sender().XString(m.SMTPUTF8)), mlog.Field("kind", kind))
-	}()
+	n := Notification{
+		Kind:     "dsn",
+		From:     dsnMsg.From,
+		To:       m.Sender(),
+		Account:  account,
+		Mailbox:  mailbox,
+		Data:     msgData,
+		Signed:   true,
+		SMTPUTF8: m.SMTPUTF8,
+	}
+	if err := Notify(context.Background(), log, n); err != nil {
+		qlog("delivering dsn", err)
+		return
+	}
+	Trace(log, TraceEvent{TraceID: m.TraceID, Stage: "dsn", QueueID: m.ID, Recipient: m.Recipient().XString(true), Text: kind + " dsn to " + m.Sender().XString(true)})
 
-	msgFile, err := store.CreateMessageTemp("queue-dsn")
+	// Show the delivery status on the message the sender stored in its Sent mailbox.
+	if account != m.SenderAccount || action != dsn.Relayed && action != dsn.Delivered {
+		return
+	}
+	messageID := headerMessageID(headers)
+	if messageID == "" {
+		return
+	}
+	acc, err := store.OpenAccount(account)
 	if err != nil {
-		qlog("creating temporary message file", err)
+		log.Errorx("open account for marking sent message as delivered", err)
 		return
 	}
 	defer func() {
-		if msgFile != nil {
-			err := os.Remove(msgFile.Name())
-			log.Check(err, "removing message file", mlog.Field("path", msgFile.Name()))
-			err = msgFile.Close()
-			log.Check(err, "closing message file")
-		}
+		err := acc.Close()
+		log.Check(err, "queue dsn: closing account", mlog.Field("sender", m.Sender().XString(m.SMTPUTF8)), mlog.Field("kind", kind))
 	}()
+	acc.WithWLock(func() {
+		// Clients typically store the message in the Sent mailbox around the time of
+		// submission, we allow for some clock skew.
+		n, err := acc.SentMessageKeyword(log, messageID, m.Queued.Add(-24*time.Hour), sentDeliveredKeyword)
+		if err != nil {
+			log.Errorx("adding keyword to sent message after successful delivery", err, mlog.Field("messageid", messageID))
+		} else {
+			log.Debug("added keyword to sent messages", mlog.Field("messageid", messageID), mlog.Field("count", n))
+		}
+	})
+}
 
-	msgWriter := &message.Writer{Writer: msgFile}
-	if _, err := msgWriter.Write(msgData); err != nil {
-		qlog("writing dsn message", err)
-		return
+// dsnKind returns a description of the action for logging.
+func dsnKind(action dsn.Action) string {
+	switch action {
+	case dsn.Failed:
+		return "failure"
+	case dsn.Delayed:
+		return "delayed delivery"
+	default:
+		return "success"
 	}
+}
 
-	msg := &store.Message{
-		Received:  time.Now(),
-		Size:      msgWriter.Size,
-		MsgPrefix: []byte{},
+// headerMessageID returns the Message-ID from raw message headers, or an empty
+// string.
+func headerMessageID(headers []byte) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(append(headers, "\r\n"...)))
+	if err != nil {
+		return ""
 	}
-	acc.WithWLock(func() {
-		if err := acc.DeliverMailbox(log, mailbox, msg, msgFile, true); err != nil {
-			qlog("delivering dsn to mailbox", err)
-			return
-		}
-	})
-	err = msgFile.Close()
-	log.Check(err, "closing dsn file")
-	msgFile = nil
+	return strings.TrimSpace(msg.Header.Get("Message-Id"))
 }
@@ -0,0 +1,236 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/mox/dkim"
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/smtp"
+	"github.com/mjl-/mox/store"
+)
+
+var metricNotification = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mox_notification_total",
+		Help: "Messages generated by mox itself, per kind and result.",
+	},
+	[]string{
+		"kind",   // dsn, selfcheck, tlsrpt
+		"result", // ok, suppressed, ratelimited, error
+	},
+)
+
+// Notification is a message generated by mox itself, such as a DSN or a report
+// for the postmaster. All such messages are sent through Notify.
+type Notification struct {
+	Kind string // For logging and metrics, e.g. "dsn", "selfcheck", "tlsrpt".
+
+	// From is used for DKIM signing, the zero value means postmaster@hostname, like
+	// the From header that NotificationHeaders adds.
+	From smtp.Path
+
+	// Recipient, for rate limiting and the suppression list. If Account is empty,
+	// the message is queued for delivery to To with a null reverse path.
+	To smtp.Path
+
+	// If set, the message is delivered directly to Mailbox (default Inbox) of Account
+	// instead of through the queue.
+	Account string
+	Mailbox string
+	Flags   store.Flags
+
+	// Message with headers, without DKIM signature unless Signed is set, e.g. for
+	// messages composed by dsn.Message.Compose.
+	Data     []byte
+	Signed   bool
+	SMTPUTF8 bool
+
+	// For messages queued for delivery: optional message to deliver instead of Data if
+	// the next hop supports SMTPUTF8, already signed. See Add.
+	DataUTF8 []byte
+}
+
+// notificationLimiter counts notifications per recipient in the current hour.
+var notificationLimiter = struct {
+	sync.Mutex
+	hour   int64
+	counts map[string]int
+}{}
+
+// notificationAllowed returns whether a notification to key can be sent,
+// counting it if so.
+func notificationAllowed(key string, tm time.Time, max int) bool {
+	notificationLimiter.Lock()
+	defer notificationLimiter.Unlock()
+	hour := tm.Unix() / 3600
+	if hour != notificationLimiter.hour || notificationLimiter.counts == nil {
+		notificationLimiter.hour = hour
+		notificationLimiter.counts = map[string]int{}
+	}
+	if notificationLimiter.counts[key] >= max {
+		return false
+	}
+	notificationLimiter.counts[key]++
+	return true
+}
+
+// notificationSuppressed returns whether notifications to addr are suppressed by
+// configuration.
+func notificationSuppressed(addr smtp.Address) bool {
+	n := mox.Conf.Static.Notifications
+	if n == nil {
+		return false
+	}
+	for _, a := range n.SuppressAddresses {
+		if a == addr {
+			return true
+		}
+	}
+	for _, d := range n.SuppressDomains {
+		if d == addr.Domain {
+			return true
+		}
+	}
+	return false
+}
+
+// NotificationHeaders returns message headers for a plain text notification from
+// postmaster@hostname to "to" with subject. The To header is left out if "to" is
+// the zero address.
+func NotificationHeaders(to smtp.Address, subject string) []byte {
+	var b bytes.Buffer
+	header := func(k, v string) {
+		fmt.Fprintf(&b, "%s: %s\r\n", k, v)
+	}
+	header("From", fmt.Sprintf("<postmaster@%s>", mox.Conf.Static.HostnameDomain.ASCII))
+	if !to.IsZero() {
+		header("To", fmt.Sprintf("<%s>", to.String()))
+	}
+	header("Subject", mime.QEncoding.Encode("utf-8", subject))
+	header("Message-Id", fmt.Sprintf("<%s>", mox.MessageIDGen(false)))
+	header("Date", time.Now().Format(message.RFC5322Z))
+	header("MIME-Version", "1.0")
+	header("Content-Type", `text/plain; charset="utf-8"`)
+	header("Content-Transfer-Encoding", "8bit")
+	return b.Bytes()
+}
+
+// Notify DKIM-signs the notification if not already signed and the domain of its
+// From address has DKIM signing configured, and delivers it to the account, or
+// queues it. Notifications to suppressed recipients, and to recipients that
+// received the configured maximum number of notifications in the current hour,
+// are dropped. Dropped notifications are logged and counted, but not returned as
+// error.
+func Notify(ctx context.Context, log *mlog.Log, n Notification) (rerr error) {
+	result := "ok"
+	to := n.To.XString(true)
+	defer func() {
+		if rerr != nil {
+			result = "error"
+		}
+		metricNotification.WithLabelValues(n.Kind, result).Inc()
+	}()
+
+	rcpt := smtp.Address{Localpart: n.To.Localpart, Domain: n.To.IPDomain.Domain}
+	if notificationSuppressed(rcpt) {
+		result = "suppressed"
+		log.Info("not sending notification to suppressed recipient", mlog.Field("kind", n.Kind), mlog.Field("to", to))
+		return nil
+	}
+	max := 20
+	if nc := mox.Conf.Static.Notifications; nc != nil {
+		max = nc.MaxPerHour
+	}
+	key := to
+	if n.To.IsZero() {
+		key = "account:" + n.Account
+	}
+	if !notificationAllowed(key, time.Now(), max) {
+		result = "ratelimited"
+		log.Info("not sending notification, rate limit for recipient reached", mlog.Field("kind", n.Kind), mlog.Field("to", to), mlog.Field("account", n.Account))
+		return nil
+	}
+
+	data := n.Data
+	if !n.Signed {
+		from := n.From
+		if from.IsZero() {
+			from = smtp.Path{Localpart: "postmaster", IPDomain: dns.IPDomain{Domain: mox.Conf.Static.HostnameDomain}}
+		}
+		fd := from.IPDomain.Domain
+		if confDom, ok := mox.Conf.Domain(fd); ok && len(confDom.DKIM.Sign) > 0 {
+			if dkimHeaders, err := dkim.Sign(ctx, from.Localpart, fd, confDom.DKIM, n.SMTPUTF8, bytes.NewReader(data)); err != nil {
+				log.Errorx("dkim sign for notification, sending unsigned", err, mlog.Field("kind", n.Kind), mlog.Field("domain", fd))
+			} else {
+				data = append([]byte(dkimHeaders), data...)
+			}
+		}
+	}
+
+	f, err := store.CreateMessageTemp("notification")
+	if err != nil {
+		return fmt.Errorf("creating temporary message file: %w", err)
+	}
+	defer func() {
+		if f != nil {
+			err := os.Remove(f.Name())
+			log.Check(err, "removing temporary notification message file")
+			err = f.Close()
+			log.Check(err, "closing temporary notification message file")
+		}
+	}()
+	msgWriter := &message.Writer{Writer: f}
+	if _, err := msgWriter.Write(data); err != nil {
+		return fmt.Errorf("writing notification message: %w", err)
+	}
+
+	if n.Account == "" {
+		// Queue with null reverse path so failures to deliver will eventually drop the
+		// message instead of causing delivery loops. ../rfc/3464:433
+		if _, err := Add(ctx, log, "", smtp.Path{}, n.To, msgWriter.Has8bit, false, msgWriter.Size, nil, f, n.DataUTF8, "NEVER", true); err != nil {
+			return fmt.Errorf("queueing notification: %w", err)
+		}
+	} else {
+		acc, err := store.OpenAccount(n.Account)
+		if err != nil {
+			return fmt.Errorf("open account: %w", err)
+		}
+		defer func() {
+			err := acc.Close()
+			log.Check(err, "closing account after delivering notification")
+		}()
+		mailbox := n.Mailbox
+		if mailbox == "" {
+			mailbox = "Inbox"
+		}
+		m := &store.Message{
+			Received:  time.Now(),
+			Size:      msgWriter.Size,
+			MsgPrefix: []byte{},
+			Flags:     n.Flags,
+		}
+		acc.WithWLock(func() {
+			err = acc.DeliverMailbox(log, mailbox, m, f, true)
+		})
+		if err != nil {
+			return fmt.Errorf("delivering notification: %w", err)
+		}
+	}
+	err = f.Close()
+	log.Check(err, "closing notification message file")
+	f = nil
+	log.Debug("notification sent", mlog.Field("kind", n.Kind), mlog.Field("to", to), mlog.Field("account", n.Account))
+	return nil
+}
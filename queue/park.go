@@ -0,0 +1,174 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/dsn"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/store"
+)
+
+// Messages for local recipients that cannot be delivered because of a condition
+// an administrator can fix, such as an account over quota, are parked when
+// configured: Instead of failing after the regular delivery attempts, they are
+// kept in the queue for the parking period, and delivery is retried as soon as
+// the condition clears. The sender gets a single DSN about the delay.
+
+var metricParked = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mox_queue_parked_total",
+		Help: "Messages parked for local recipients, unparked after the condition cleared, and failed after the parking period expired.",
+	},
+	[]string{
+		"event", // parked, unparked, expired
+	},
+)
+
+func startParking() {
+	pc := mox.Conf.Static.Parking
+	if pc == nil {
+		return
+	}
+	go func() {
+		for {
+			select {
+			case <-mox.Shutdown.Done():
+				return
+			case <-time.After(pc.CheckInterval):
+			}
+			unparkCleared(mox.Shutdown, xlog.WithCid(mox.Cid()))
+		}
+	}()
+}
+
+// parkReason returns why delivery to the recipient of m is failing because of a
+// fixable condition of the local account of the recipient, or an empty string
+// if the recipient is not local or no such condition applies.
+func parkReason(ctx context.Context, log *mlog.Log, m Msg) string {
+	if m.RecipientDomain.IsIP() {
+		return ""
+	}
+	accName, _, _, err := mox.FindAccount(m.RecipientLocalpart, m.RecipientDomain.Domain, false)
+	if err != nil {
+		return ""
+	}
+	acc, err := store.OpenAccount(accName)
+	if err != nil {
+		log.Errorx("open account of recipient for parking", err)
+		return ""
+	}
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account after checking parking")
+	}()
+
+	if acc.DeliveryTempfail() {
+		return "account is suspended"
+	}
+	if err := acc.CheckDomainStorage(ctx, log, m.Size); errors.Is(err, store.ErrDomainStorage) {
+		return "storage limit of domain reached"
+	} else if err != nil {
+		log.Errorx("checking storage limit of domain for parking", err)
+		return ""
+	}
+	err = acc.DB.Read(ctx, func(tx *bstore.Tx) error {
+		return acc.CheckQuota(tx, 1, m.Size)
+	})
+	if errors.Is(err, store.ErrOverQuota) {
+		return "account is over quota"
+	} else if err != nil {
+		log.Errorx("checking quota for parking", err)
+	}
+	return ""
+}
+
+// park parks m after a temporary delivery failure if parking is configured and
+// the failure is caused by a fixable condition of the local recipient account.
+// If m was already parked and its parking period has expired, expired is
+// returned, and delivery must fail permanently.
+func park(qlog *mlog.Log, m Msg, remoteMTA dsn.NameIP, secodeOpt, errmsg string) (parked, expired bool) {
+	pc := mox.Conf.Static.Parking
+	if pc == nil {
+		return false, false
+	}
+	reason := parkReason(context.Background(), qlog, m)
+	if reason == "" {
+		return false, false
+	}
+
+	now := time.Now()
+	first := m.Parked == nil
+	if first {
+		m.Parked = &now
+	}
+	until := m.Parked.Add(pc.Period)
+	if !now.Before(until) {
+		metricParked.WithLabelValues("expired").Inc()
+		qlog.Info("parking period of message expired", mlog.Field("parked", *m.Parked), mlog.Field("reason", reason))
+		return false, true
+	}
+
+	// Delivery is retried when the condition clears, otherwise once more at the end
+	// of the parking period.
+	m.NextAttempt = until
+	up := map[string]any{"Parked": m.Parked, "NextAttempt": m.NextAttempt, "LastError": errmsg, "DialedIPs": m.DialedIPs}
+	if _, err := bstore.QueryDB[Msg](context.Background(), DB).FilterID(m.ID).UpdateFields(up); err != nil {
+		qlog.Errorx("storing parked message", err)
+		return false, false
+	}
+	hookOutgoing(qlog, m, HookDelayed, remoteMTA, errmsg)
+	deliveryAdd(qlog, m, HookDelayed, remoteMTA, false, errmsg)
+	if !first {
+		qlog.Info("message remains parked", mlog.Field("reason", reason), mlog.Field("until", until))
+		return true, false
+	}
+
+	metricParked.WithLabelValues("parked").Inc()
+	qlog.Info("parking message for local recipient", mlog.Field("reason", reason), mlog.Field("until", until))
+	errmsg = fmt.Sprintf("%s (%s; delivery is attempted again as soon as this is resolved, until %s)", errmsg, reason, until.UTC().Format(time.RFC3339))
+	queueDSNDelay(qlog, m, remoteMTA, secodeOpt, errmsg, until)
+	return true, false
+}
+
+// unparkCleared schedules immediate delivery of parked messages for which the
+// condition has cleared. Returns the number of messages unparked.
+func unparkCleared(ctx context.Context, log *mlog.Log) int {
+	now := time.Now()
+	q := bstore.QueryDB[Msg](ctx, DB)
+	q.FilterGreater("NextAttempt", now)
+	q.FilterFn(func(qm Msg) bool {
+		return qm.Parked != nil
+	})
+	msgs, err := q.List()
+	if err != nil {
+		log.Errorx("listing parked messages", err)
+		return 0
+	}
+
+	var n int
+	for _, m := range msgs {
+		if parkReason(ctx, log, m) != "" {
+			continue
+		}
+		if _, err := bstore.QueryDB[Msg](ctx, DB).FilterID(m.ID).UpdateNonzero(Msg{NextAttempt: now}); err != nil {
+			log.Errorx("scheduling delivery of unparked message", err, mlog.Field("msgid", m.ID))
+			continue
+		}
+		log.Info("condition for parked message cleared, attempting delivery", mlog.Field("msgid", m.ID), mlog.Field("recipient", m.Recipient()))
+		metricParked.WithLabelValues("unparked").Inc()
+		n++
+	}
+	if n > 0 {
+		queuekick()
+	}
+	return n
+}
@@ -4,6 +4,7 @@
 package queue
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"io"
@@ -25,6 +26,7 @@ import (
 	"github.com/mjl-/mox/config"
 	"github.com/mjl-/mox/dns"
 	"github.com/mjl-/mox/dsn"
+	"github.com/mjl-/mox/message"
 	"github.com/mjl-/mox/metrics"
 	"github.com/mjl-/mox/mlog"
 	"github.com/mjl-/mox/mox-"
@@ -58,6 +60,17 @@ var (
 			"result",    // ok, timeout, canceled, temperror, permerror, error
 		},
 	)
+	metricDeliveryTLS = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mox_queue_delivery_tls_total",
+			Help: "Messages delivered directly to remote SMTP servers, by TLS certificate verification, TLS version and recipient domain.",
+		},
+		[]string{
+			"verification", // mtasts (enforced MTA-STS policy), strict (verified after failed policy lookup), opportunistic (not verified), none (cleartext)
+			"version",      // tls1.2, tls1.3, none
+			"domain",       // recipient domain if in TLSMetricsDomains, "other" otherwise
+		},
+	)
 )
 
 type contextDialer interface {
@@ -80,8 +93,8 @@ var dial = func(ctx context.Context, dialer contextDialer, timeout time.Duration
 
 var jitter = mox.NewRand()
 
-var DBTypes = []any{Msg{}} // Types stored in DB.
-var DB *bstore.DB          // Exported for making backups.
+var DBTypes = []any{Msg{}, TLSDowngrade{}, Hook{}, Delivery{}, TraceEvent{}} // Types stored in DB.
+var DB *bstore.DB                                                            // Exported for making backups.
 
 // Set for mox localserve, to prevent queueing.
 var Localserve bool
@@ -103,6 +116,7 @@ type Msg struct {
 	LastError          string
 	Has8bit            bool  // Whether message contains bytes with high bit set, determines whether 8BITMIME SMTP extension is needed.
 	SMTPUTF8           bool  // Whether message requires use of SMTPUTF8.
+	BinaryMIME         bool  // Whether message was received with BODY=BINARYMIME, and may contain binary parts. Converted to base64 for a next hop without BINARYMIME.
 	Size               int64 // Full size of message, combined MsgPrefix with contents of message file.
 	MsgPrefix          []byte
 
@@ -115,6 +129,41 @@ type Msg struct {
 	// admin interface. If empty (the default for a submitted message), regular routing
 	// rules apply.
 	Transport string
+
+	// NOTIFY parameter from the RCPT TO command during submission, "NEVER" or a
+	// comma-separated list of "SUCCESS", "FAILURE" and "DELAY". If empty, DSNs are
+	// sent for failures and delays. ../rfc/3461
+	DSNNotify string
+
+	// If set, no delivery attempts are made until the message is released with
+	// Kick, e.g. after approval by an administrator for a message held for
+	// moderation by a transport rule.
+	Hold bool
+
+	// If set, the time the message was parked because delivery to the local
+	// recipient failed with a condition an administrator can fix, such as an account
+	// over quota. Parked messages are not failed permanently until the configured
+	// parking period has passed, and delivery is retried as soon as the condition
+	// clears.
+	Parked *time.Time
+
+	// For recording events about delivery attempts, see TraceEvent.
+	TraceID string
+}
+
+// dsnRequested returns whether the sender wants a DSN of kind "SUCCESS",
+// "FAILURE" or "DELAY".
+func (m Msg) dsnRequested(kind string) bool {
+	if m.DSNNotify == "" {
+		// Without NOTIFY, the default is to behave as if FAILURE,DELAY was specified. ../rfc/3461
+		return kind != "SUCCESS"
+	}
+	for _, s := range strings.Split(m.DSNNotify, ",") {
+		if s == kind {
+			return true
+		}
+	}
+	return false
 }
 
 // Sender of message as used in MAIL FROM.
@@ -162,7 +211,11 @@ func Shutdown() {
 // List returns all messages in the delivery queue.
 // Ordered by earliest delivery attempt first.
 func List(ctx context.Context) ([]Msg, error) {
-	qmsgs, err := bstore.QueryDB[Msg](ctx, DB).List()
+	var qmsgs []Msg
+	err := store.DBRead(ctx, xlog.WithContext(ctx), "queue", DB, func(tx *bstore.Tx) (err error) {
+		qmsgs, err = bstore.QueryTx[Msg](tx).List()
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -185,8 +238,12 @@ func List(ctx context.Context) ([]Msg, error) {
 }
 
 // Count returns the number of messages in the delivery queue.
-func Count(ctx context.Context) (int, error) {
-	return bstore.QueryDB[Msg](ctx, DB).Count()
+func Count(ctx context.Context) (n int, err error) {
+	err = store.DBRead(ctx, xlog.WithContext(ctx), "queue", DB, func(tx *bstore.Tx) error {
+		n, err = bstore.QueryTx[Msg](tx).Count()
+		return err
+	})
+	return
 }
 
 // Add a new message to the queue. The queue is kicked immediately to start a
@@ -199,7 +256,24 @@ func Count(ctx context.Context) (int, error) {
 // this data is used as the message when delivering the DSN and the remote SMTP
 // server supports SMTPUTF8. If the remote SMTP server does not support SMTPUTF8,
 // the regular non-utf8 message is delivered.
-func Add(ctx context.Context, log *mlog.Log, senderAccount string, mailFrom, rcptTo smtp.Path, has8bit, smtputf8 bool, size int64, msgPrefix []byte, msgFile *os.File, dsnutf8Opt []byte, consumeFile bool) (int64, error) {
+//
+// dsnNotify is the NOTIFY parameter for the recipient, see Msg.DSNNotify.
+func Add(ctx context.Context, log *mlog.Log, senderAccount string, mailFrom, rcptTo smtp.Path, has8bit, smtputf8 bool, size int64, msgPrefix []byte, msgFile *os.File, dsnutf8Opt []byte, dsnNotify string, consumeFile bool) (int64, error) {
+	return AddOpts(ctx, log, senderAccount, mailFrom, rcptTo, has8bit, smtputf8, size, msgPrefix, msgFile, dsnutf8Opt, dsnNotify, consumeFile, AddOptions{})
+}
+
+// AddOptions are optional parameters for AddOpts.
+type AddOptions struct {
+	Transport string // Transport for delivery attempts, instead of the transport from routes.
+	Hold      bool   // Whether to hold the message in the queue, see Msg.Hold.
+	TraceID   string // Trace ID of the message, typically assigned during reception. A new ID is generated if empty.
+
+	// Whether the message was received with BODY=BINARYMIME, see Msg.BinaryMIME.
+	BinaryMIME bool
+}
+
+// AddOpts is like Add, with additional options.
+func AddOpts(ctx context.Context, log *mlog.Log, senderAccount string, mailFrom, rcptTo smtp.Path, has8bit, smtputf8 bool, size int64, msgPrefix []byte, msgFile *os.File, dsnutf8Opt []byte, dsnNotify string, consumeFile bool, opts AddOptions) (int64, error) {
 	// todo: Add should accept multiple rcptTo if they are for the same domain. so we can queue them for delivery in one (or just a few) session(s), transferring the data only once. ../rfc/5321:3759
 
 	if Localserve {
@@ -219,8 +293,13 @@ func Add(ctx context.Context, log *mlog.Log, senderAccount string, mailFrom, rcp
 		}
 	}()
 
+	traceID := opts.TraceID
+	if traceID == "" {
+		traceID = NewTraceID()
+	}
+
 	now := time.Now()
-	qm := Msg{0, now, senderAccount, mailFrom.Localpart, mailFrom.IPDomain, rcptTo.Localpart, rcptTo.IPDomain, formatIPDomain(rcptTo.IPDomain), 0, nil, now, nil, "", has8bit, smtputf8, size, msgPrefix, dsnutf8Opt, ""}
+	qm := Msg{0, now, senderAccount, mailFrom.Localpart, mailFrom.IPDomain, rcptTo.Localpart, rcptTo.IPDomain, formatIPDomain(rcptTo.IPDomain), 0, nil, now, nil, "", has8bit, smtputf8, opts.BinaryMIME, size, msgPrefix, dsnutf8Opt, opts.Transport, dsnNotify, opts.Hold, nil, traceID}
 
 	if err := tx.Insert(&qm); err != nil {
 		return 0, err
@@ -257,6 +336,17 @@ func Add(ctx context.Context, log *mlog.Log, senderAccount string, mailFrom, rcp
 	tx = nil
 	dst = ""
 
+	event := TraceEvent{TraceID: traceID, Stage: "queued", QueueID: qm.ID, Recipient: rcptTo.XString(true)}
+	if qm.Transport != "" {
+		event.Text = fmt.Sprintf("transport %s", qm.Transport)
+	}
+	if qm.Hold {
+		event.Stage = "held"
+		Trace(log, event)
+		log.Info("message held in queue", mlog.Field("queuemsgid", qm.ID))
+		return qm.ID, nil
+	}
+	Trace(log, event)
 	queuekick()
 	return qm.ID, nil
 }
@@ -284,6 +374,40 @@ func writeFile(dst string, r io.Reader) error {
 	return nil
 }
 
+// downgradeBinary writes the message in r of size bytes, with its binary parts
+// converted to base64, to a temporary file, for delivery to a next hop that does
+// not implement BINARYMIME. ../rfc/3030 The returned file is positioned at the
+// start. The caller must close and remove it.
+func downgradeBinary(log *mlog.Log, r io.ReaderAt, size int64) (rf *os.File, rsize int64, rerr error) {
+	f, err := store.CreateMessageTemp("queue-binary")
+	if err != nil {
+		return nil, 0, fmt.Errorf("creating temporary message file: %w", err)
+	}
+	defer func() {
+		if rerr != nil {
+			err := os.Remove(f.Name())
+			log.Check(err, "removing temporary converted message file")
+			err = f.Close()
+			log.Check(err, "closing temporary converted message file")
+		}
+	}()
+
+	bw := bufio.NewWriter(f)
+	if _, err := message.DowngradeBinary(bw, r, size); err != nil {
+		return nil, 0, fmt.Errorf("converting binary message parts: %w", err)
+	} else if err := bw.Flush(); err != nil {
+		return nil, 0, fmt.Errorf("writing converted message: %w", err)
+	}
+	n, err := f.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("seek in converted message: %w", err)
+	}
+	return f, n, nil
+}
+
 func formatIPDomain(d dns.IPDomain) string {
 	if len(d.IP) > 0 {
 		return "[" + d.IP.String() + "]"
@@ -305,7 +429,8 @@ func queuekick() {
 
 // Kick sets the NextAttempt for messages matching all filter parameters (ID,
 // toDomain, recipient) that are nonzero, and kicks the queue, attempting delivery
-// of those messages. If all parameters are zero, all messages are kicked. If
+// of those messages. Held messages are released. If all parameters are zero, all
+// messages are kicked. If
 // transport is set, the delivery attempts for the matching messages will use the
 // transport. An empty string is the default transport, i.e. direct delivery.
 // Returns number of messages queued for immediate delivery.
@@ -322,7 +447,7 @@ func Kick(ctx context.Context, ID int64, toDomain, recipient string, transport *
 			return qm.Recipient().XString(true) == recipient
 		})
 	}
-	up := map[string]any{"NextAttempt": time.Now()}
+	up := map[string]any{"NextAttempt": time.Now(), "Hold": false}
 	if transport != nil {
 		if *transport != "" {
 			_, ok := mox.Conf.Static.Transports[*transport]
@@ -367,6 +492,7 @@ func Drop(ctx context.Context, ID int64, toDomain string, recipient string) (int
 		if err := os.Remove(p); err != nil {
 			xlog.WithContext(ctx).Errorx("removing queue message from file system", err, mlog.Field("queuemsgid", m.ID), mlog.Field("path", p))
 		}
+		Trace(xlog.WithContext(ctx), TraceEvent{TraceID: m.TraceID, Stage: "dropped", QueueID: m.ID, Recipient: m.Recipient().XString(true)})
 	}
 	return n, nil
 }
@@ -399,6 +525,11 @@ func Start(resolver dns.Resolver, done chan struct{}) error {
 		return err
 	}
 
+	startTLSReports(resolver)
+	startSelfCheck(resolver)
+	startHooks()
+	startParking()
+
 	// High-level delivery strategy advice: ../rfc/5321:3685
 	go func() {
 		// Map keys are either dns.Domain.Name()'s, or string-formatted IP addresses.
@@ -437,6 +568,7 @@ func nextWork(ctx context.Context, busyDomains map[string]struct{}) time.Duratio
 		}
 		q.FilterNotEqual("RecipientDomainStr", doms...)
 	}
+	q.FilterEqual("Hold", false)
 	q.SortAsc("NextAttempt")
 	q.Limit(1)
 	qm, err := q.Get()
@@ -450,18 +582,23 @@ func nextWork(ctx context.Context, busyDomains map[string]struct{}) time.Duratio
 }
 
 func launchWork(resolver dns.Resolver, busyDomains map[string]struct{}) int {
-	q := bstore.QueryDB[Msg](mox.Shutdown, DB)
-	q.FilterLessEqual("NextAttempt", time.Now())
-	q.SortAsc("NextAttempt")
-	q.Limit(maxConcurrentDeliveries)
-	if len(busyDomains) > 0 {
-		var doms []any
-		for d := range busyDomains {
-			doms = append(doms, d)
+	var msgs []Msg
+	err := store.DBRead(mox.Shutdown, xlog, "queue", DB, func(tx *bstore.Tx) (err error) {
+		q := bstore.QueryTx[Msg](tx)
+		q.FilterLessEqual("NextAttempt", time.Now())
+		q.FilterEqual("Hold", false)
+		q.SortAsc("NextAttempt")
+		q.Limit(maxConcurrentDeliveries)
+		if len(busyDomains) > 0 {
+			var doms []any
+			for d := range busyDomains {
+				doms = append(doms, d)
+			}
+			q.FilterNotEqual("RecipientDomainStr", doms...)
 		}
-		q.FilterNotEqual("RecipientDomainStr", doms...)
-	}
-	msgs, err := q.List()
+		msgs, err = q.List()
+		return err
+	})
 	if err != nil {
 		xlog.Errorx("querying for work in queue", err)
 		mox.Sleep(mox.Shutdown, 1*time.Second)
@@ -523,10 +660,12 @@ func deliver(resolver dns.Resolver, m Msg) {
 	now := time.Now()
 	m.LastAttempt = &now
 	m.NextAttempt = now.Add(backoff)
-	qup := bstore.QueryDB[Msg](mox.Shutdown, DB)
-	qup.FilterID(m.ID)
 	update := Msg{Attempts: m.Attempts, NextAttempt: m.NextAttempt, LastAttempt: m.LastAttempt}
-	if _, err := qup.UpdateNonzero(update); err != nil {
+	err := store.DBWrite(mox.Shutdown, qlog, "queue", DB, func(tx *bstore.Tx) error {
+		_, err := bstore.QueryTx[Msg](tx).FilterID(m.ID).UpdateNonzero(update)
+		return err
+	})
+	if err != nil {
 		qlog.Errorx("storing delivery attempt", err)
 		return
 	}
@@ -554,17 +693,24 @@ func deliver(resolver dns.Resolver, m Msg) {
 		qlog.Debug("delivering with transport", mlog.Field("transport", transportName))
 	}
 
-	var dialer contextDialer = &net.Dialer{}
+	// Outgoing connections get the socket options of the transport, e.g. a network
+	// interface, DSCP marking or local IPs to connect from.
+	var localIPs []net.IP
+	if transport.SocketOptions != nil {
+		localIPs = transport.SocketOptions.IPs
+	}
+	var dialer contextDialer = mox.SocketDialer(transport.SocketOptions)
 	if transport.Submissions != nil {
-		deliverSubmit(cid, qlog, resolver, dialer, m, backoff, transportName, transport.Submissions, true, 465)
+		deliverSubmit(cid, qlog, resolver, dialer, localIPs, m, backoff, transportName, transport.Submissions, true, 465)
 	} else if transport.Submission != nil {
-		deliverSubmit(cid, qlog, resolver, dialer, m, backoff, transportName, transport.Submission, false, 587)
+		deliverSubmit(cid, qlog, resolver, dialer, localIPs, m, backoff, transportName, transport.Submission, false, 587)
 	} else if transport.SMTP != nil {
-		deliverSubmit(cid, qlog, resolver, dialer, m, backoff, transportName, transport.SMTP, false, 25)
+		deliverSubmit(cid, qlog, resolver, dialer, localIPs, m, backoff, transportName, transport.SMTP, false, 25)
 	} else {
 		ourHostname := mox.Conf.Static.HostnameDomain
 		if transport.Socks != nil {
-			socksdialer, err := proxy.SOCKS5("tcp", transport.Socks.Address, nil, &net.Dialer{})
+			// The socket options apply to the connection to the SOCKS proxy.
+			socksdialer, err := proxy.SOCKS5("tcp", transport.Socks.Address, nil, mox.SocketDialer(transport.SocketOptions))
 			if err != nil {
 				fail(qlog, m, backoff, false, dsn.NameIP{}, "", fmt.Sprintf("socks dialer: %v", err))
 				return
@@ -576,7 +722,7 @@ func deliver(resolver dns.Resolver, m Msg) {
 			}
 			ourHostname = transport.Socks.Hostname
 		}
-		deliverDirect(cid, qlog, resolver, dialer, ourHostname, transportName, m, backoff)
+		deliverDirect(cid, qlog, resolver, dialer, localIPs, ourHostname, transportName, m, backoff)
 	}
 }
 
@@ -623,10 +769,12 @@ func routeMatchDomain(l []string, d dns.Domain) bool {
 // If the previous attempt used IPv4, this attempt will use IPv6 (in case one of the IPs is in a DNSBL).
 // The second attempt for an address family we prefer the same IP as earlier, to increase our chances if remote is doing greylisting.
 // dialHost updates m with the dialed IP and m should be saved in case of failure.
-// If we have fully specified local smtp listen IPs, we set those for the outgoing
+// If localIPs is set, e.g. from socket options of a transport, the outgoing
+// connection is made from the IP of the same address family. Otherwise, if we have
+// fully specified local smtp listen IPs, we set those for the outgoing
 // connection. The admin probably configured these same IPs in SPF, but others
 // possibly not.
-func dialHost(ctx context.Context, log *mlog.Log, resolver dns.Resolver, dialer contextDialer, host dns.IPDomain, port int, m *Msg) (conn net.Conn, ip net.IP, dualstack bool, rerr error) {
+func dialHost(ctx context.Context, log *mlog.Log, resolver dns.Resolver, dialer contextDialer, localIPs []net.IP, host dns.IPDomain, port int, m *Msg) (conn net.Conn, ip net.IP, dualstack bool, rerr error) {
 	var ips []net.IP
 	if len(host.IP) > 0 {
 		ips = []net.IP{host.IP}
@@ -689,7 +837,11 @@ func dialHost(ctx context.Context, log *mlog.Log, resolver dns.Resolver, dialer
 		addr := net.JoinHostPort(ip.String(), fmt.Sprintf("%d", port))
 		log.Debug("dialing remote host for delivery", mlog.Field("addr", addr))
 		var laddr net.Addr
-		for _, lip := range mox.Conf.Static.SpecifiedSMTPListenIPs {
+		lips := mox.Conf.Static.SpecifiedSMTPListenIPs
+		if len(localIPs) > 0 {
+			lips = localIPs
+		}
+		for _, lip := range lips {
 			ipIs4 := ip.To4() != nil
 			lipIs4 := lip.To4() != nil
 			if ipIs4 == lipIs4 {
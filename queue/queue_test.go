@@ -4,14 +4,19 @@ import (
 	"bufio"
 	"context"
 	"crypto/ed25519"
+	"crypto/hmac"
 	cryptorand "crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"math/big"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"reflect"
 	"strings"
@@ -20,10 +25,13 @@ import (
 
 	"github.com/mjl-/bstore"
 
+	"github.com/mjl-/mox/config"
 	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/dsn"
 	"github.com/mjl-/mox/mox-"
 	"github.com/mjl-/mox/smtp"
 	"github.com/mjl-/mox/store"
+	"github.com/mjl-/mox/tlsrpt"
 )
 
 var ctxbg = context.Background()
@@ -85,11 +93,11 @@ func TestQueue(t *testing.T) {
 	}
 
 	path := smtp.Path{Localpart: "mjl", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "mox.example"}}}
-	_, err = Add(ctxbg, xlog, "mjl", path, path, false, false, int64(len(testmsg)), nil, prepareFile(t), nil, true)
+	_, err = Add(ctxbg, xlog, "mjl", path, path, false, false, int64(len(testmsg)), nil, prepareFile(t), nil, "", true)
 	tcheck(t, err, "add message to queue for delivery")
 
 	mf2 := prepareFile(t)
-	_, err = Add(ctxbg, xlog, "mjl", path, path, false, false, int64(len(testmsg)), nil, mf2, nil, false)
+	_, err = Add(ctxbg, xlog, "mjl", path, path, false, false, int64(len(testmsg)), nil, mf2, nil, "", false)
 	tcheck(t, err, "add message to queue for delivery")
 	os.Remove(mf2.Name())
 
@@ -187,6 +195,7 @@ func TestQueue(t *testing.T) {
 	}
 
 	smtpdone := make(chan struct{})
+	var smtpData []byte // Message data received by fakeSMTPServer.
 
 	fakeSMTPServer := func(server net.Conn) {
 		// We do a minimal fake smtp server. We cannot import smtpserver.Serve due to cyclic dependencies.
@@ -201,7 +210,7 @@ func TestQueue(t *testing.T) {
 		br.ReadString('\n') // Should be DATA.
 		fmt.Fprintf(server, "354 continue\r\n")
 		reader := smtp.NewDataReader(br)
-		io.Copy(io.Discard, reader)
+		smtpData, _ = io.ReadAll(reader)
 		fmt.Fprintf(server, "250 ok\r\n")
 		br.ReadString('\n') // Should be QUIT.
 		fmt.Fprintf(server, "221 ok\r\n")
@@ -291,9 +300,24 @@ func TestQueue(t *testing.T) {
 		t.Fatalf("expected net.Dialer as dialer")
 	}
 
+	// Message received with BINARYMIME is converted to base64 for a server without
+	// BINARYMIME.
+	binmsg := "Content-Transfer-Encoding: binary\r\n\r\n\x00\n\r"
+	mf := prepareFile(t)
+	err = mf.Truncate(0)
+	tcheck(t, err, "truncate message file")
+	_, err = mf.WriteAt([]byte(binmsg), 0)
+	tcheck(t, err, "write message file")
+	_, err = AddOpts(ctxbg, xlog, "mjl", path, path, false, false, int64(len(binmsg)), nil, mf, nil, "", true, AddOptions{BinaryMIME: true})
+	tcheck(t, err, "add binary message to queue for delivery")
+	testDeliver(fakeSMTPServer)
+	if exp := "Content-Transfer-Encoding: base64\r\n\r\nAAoN\r\n"; string(smtpData) != exp {
+		t.Fatalf("got delivered message %q, expected %q", smtpData, exp)
+	}
+
 	// Add a message to be delivered with submit because of its route.
 	topath := smtp.Path{Localpart: "mjl", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "submit.example"}}}
-	_, err = Add(ctxbg, xlog, "mjl", path, topath, false, false, int64(len(testmsg)), nil, prepareFile(t), nil, true)
+	_, err = Add(ctxbg, xlog, "mjl", path, topath, false, false, int64(len(testmsg)), nil, prepareFile(t), nil, "", true)
 	tcheck(t, err, "add message to queue for delivery")
 	wasNetDialer = testDeliver(fakeSubmitServer)
 	if !wasNetDialer {
@@ -301,7 +325,7 @@ func TestQueue(t *testing.T) {
 	}
 
 	// Add a message to be delivered with submit because of explicitly configured transport, that uses TLS.
-	msgID, err := Add(ctxbg, xlog, "mjl", path, path, false, false, int64(len(testmsg)), nil, prepareFile(t), nil, true)
+	msgID, err := Add(ctxbg, xlog, "mjl", path, path, false, false, int64(len(testmsg)), nil, prepareFile(t), nil, "", true)
 	tcheck(t, err, "add message to queue for delivery")
 	transportSubmitTLS := "submittls"
 	n, err = Kick(ctxbg, msgID, "", "", &transportSubmitTLS)
@@ -325,7 +349,7 @@ func TestQueue(t *testing.T) {
 	}
 
 	// Add a message to be delivered with socks.
-	msgID, err = Add(ctxbg, xlog, "mjl", path, path, false, false, int64(len(testmsg)), nil, prepareFile(t), nil, true)
+	msgID, err = Add(ctxbg, xlog, "mjl", path, path, false, false, int64(len(testmsg)), nil, prepareFile(t), nil, "", true)
 	tcheck(t, err, "add message to queue for delivery")
 	transportSocks := "socks"
 	n, err = Kick(ctxbg, msgID, "", "", &transportSocks)
@@ -339,7 +363,7 @@ func TestQueue(t *testing.T) {
 	}
 
 	// Add another message that we'll fail to deliver entirely.
-	_, err = Add(ctxbg, xlog, "mjl", path, path, false, false, int64(len(testmsg)), nil, prepareFile(t), nil, true)
+	_, err = Add(ctxbg, xlog, "mjl", path, path, false, false, int64(len(testmsg)), nil, prepareFile(t), nil, "", true)
 	tcheck(t, err, "add message to queue for delivery")
 
 	msgs, err = List(ctxbg)
@@ -426,6 +450,365 @@ func TestQueue(t *testing.T) {
 	case <-timer.C:
 		t.Fatalf("no dsn in 1s")
 	}
+
+	// Delivery results are kept for the account: 5 deliveries, 8 delays and the
+	// final failure.
+	deliveries, err := DeliveryList(ctxbg, "mjl")
+	tcheck(t, err, "list deliveries")
+	counts := map[string]int{}
+	var tlsDeliveries int
+	for _, d := range deliveries {
+		counts[d.Result]++
+		if d.TLS {
+			tlsDeliveries++
+		}
+	}
+	if len(deliveries) != 14 || counts[HookDelivered] != 5 || counts[HookDelayed] != 8 || counts[HookFailed] != 1 || deliveries[0].Result != HookFailed {
+		t.Fatalf("unexpected delivery results %v", deliveries)
+	}
+	if tlsDeliveries != 1 {
+		t.Fatalf("got %d deliveries with tls, expected 1", tlsDeliveries)
+	}
+	if l, err := DeliveryList(ctxbg, "other"); err != nil || len(l) != 0 {
+		t.Fatalf("got deliveries %v, err %v, for other account, expected none", l, err)
+	}
+}
+
+func TestDSNSuccess(t *testing.T) {
+	acc, cleanup := setup(t)
+	defer cleanup()
+	err := Init()
+	tcheck(t, err, "queue init")
+
+	const msg = "From: <mjl@mox.example>\r\nTo: <remote@example.org>\r\nMessage-Id: <dsntest@mox.example>\r\nSubject: test\r\n\r\ntest email\r\n"
+	msgFile, err := store.CreateMessageTemp("queue")
+	tcheck(t, err, "create temp message")
+	defer os.Remove(msgFile.Name())
+	defer msgFile.Close()
+	_, err = msgFile.Write([]byte(msg))
+	tcheck(t, err, "write message file")
+
+	// Message as stored by the client in the Sent mailbox.
+	sent := store.Message{Received: time.Now(), Size: int64(len(msg))}
+	acc.WithWLock(func() {
+		err = acc.DeliverMailbox(xlog, "Sent", &sent, msgFile, false)
+	})
+	tcheck(t, err, "deliver to sent mailbox")
+
+	path := smtp.Path{Localpart: "mjl", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "mox.example"}}}
+	rcpt := smtp.Path{Localpart: "remote", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "example.org"}}}
+	for _, notify := range []string{"NEVER", "SUCCESS,FAILURE"} {
+		_, err = Add(ctxbg, xlog, "mjl", path, rcpt, false, false, int64(len(msg)), nil, msgFile, nil, notify, false)
+		tcheck(t, err, "add message to queue")
+	}
+	msgs, err := List(ctxbg)
+	tcheck(t, err, "list queue")
+	if len(msgs) != 2 {
+		t.Fatalf("got %d messages in queue, expected 2", len(msgs))
+	}
+	now := time.Now()
+	for i := range msgs {
+		msgs[i].LastAttempt = &now
+	}
+
+	if msgs[0].dsnRequested("FAILURE") || msgs[0].dsnRequested("SUCCESS") || !msgs[1].dsnRequested("SUCCESS") || msgs[1].dsnRequested("DELAY") || !(Msg{}).dsnRequested("DELAY") {
+		t.Fatalf("unexpected dsn requested results")
+	}
+
+	countInbox := func() int {
+		t.Helper()
+		var n int
+		err := acc.DB.Read(ctxbg, func(tx *bstore.Tx) error {
+			mb, err := acc.MailboxFind(tx, "Inbox")
+			tcheck(t, err, "find inbox")
+			n, err = bstore.QueryTx[store.Message](tx).FilterNonzero(store.Message{MailboxID: mb.ID}).Count()
+			return err
+		})
+		tcheck(t, err, "count inbox")
+		return n
+	}
+
+	queueDSNFailure(xlog, msgs[0], dsn.NameIP{}, "", "test failure")
+	queueDSNSuccess(xlog, msgs[0], dsn.NameIP{Name: "mx.example.org"})
+	if n := countInbox(); n != 0 {
+		t.Fatalf("got %d messages in inbox with NOTIFY=NEVER, expected 0", n)
+	}
+
+	comm := store.RegisterComm(acc)
+	defer comm.Unregister()
+
+	queueDSNSuccess(xlog, msgs[1], dsn.NameIP{Name: "mx.example.org"})
+	if n := countInbox(); n != 1 {
+		t.Fatalf("got %d messages in inbox after success dsn, expected 1", n)
+	}
+
+	err = acc.DB.Get(ctxbg, &sent)
+	tcheck(t, err, "get sent message")
+	if !reflect.DeepEqual(sent.Keywords, []string{sentDeliveredKeyword}) {
+		t.Fatalf("sent message has keywords %v, expected %q", sent.Keywords, sentDeliveredKeyword)
+	}
+
+	// The new keyword of the Sent mailbox is broadcast.
+	var mbkw *store.ChangeMailboxKeywords
+	for _, ch := range comm.Get() {
+		if c, ok := ch.(store.ChangeMailboxKeywords); ok {
+			mbkw = &c
+		}
+	}
+	if mbkw == nil || mbkw.MailboxName != "Sent" || !reflect.DeepEqual(mbkw.Keywords, []string{sentDeliveredKeyword}) {
+		t.Fatalf("got mailbox keywords change %v, expected keyword for sent mailbox", mbkw)
+	}
+
+	// Messages delivered to local accounts without the queue also get a success DSN.
+	lm := Msg{SenderAccount: "mjl", SenderLocalpart: path.Localpart, SenderDomain: path.IPDomain, RecipientLocalpart: "mjl", RecipientDomain: path.IPDomain, DSNNotify: "SUCCESS"}
+	DSNDelivered(xlog, lm, []byte(msg[:strings.Index(msg, "\r\n\r\n")+2]))
+	if n := countInbox(); n != 2 {
+		t.Fatalf("got %d messages in inbox after local success dsn, expected 2", n)
+	}
+	lm.DSNNotify = ""
+	DSNDelivered(xlog, lm, nil)
+	if n := countInbox(); n != 2 {
+		t.Fatalf("got %d messages in inbox after local delivery without notify, expected 2", n)
+	}
+}
+
+func TestTLSDowngrade(t *testing.T) {
+	acc, cleanup := setup(t)
+	defer cleanup()
+	err := Init()
+	tcheck(t, err, "queue init")
+
+	accConf := mox.Conf.Dynamic.Accounts["mjl"]
+	nc := accConf
+	nc.NotifyTLSDowngrade = true
+	mox.Conf.Dynamic.Accounts["mjl"] = nc
+	defer func() {
+		mox.Conf.Dynamic.Accounts["mjl"] = accConf
+	}()
+
+	path := smtp.Path{Localpart: "mjl", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "mox.example"}}}
+	rcpt := smtp.Path{Localpart: "remote", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "example.org"}}}
+	msgFile := prepareFile(t)
+	defer os.Remove(msgFile.Name())
+	defer msgFile.Close()
+	_, err = Add(ctxbg, xlog, "mjl", path, rcpt, false, false, int64(len(testmsg)), nil, msgFile, nil, "", false)
+	tcheck(t, err, "add message to queue")
+	msgs, err := List(ctxbg)
+	tcheck(t, err, "list queue")
+	m := msgs[0]
+	now := time.Now()
+	m.LastAttempt = &now
+
+	host := dns.IPDomain{Domain: dns.Domain{ASCII: "mx.example.org"}}
+	recordTLSDowngrade(xlog, m, rcpt.IPDomain.Domain, nil, host, net.ParseIP("10.0.0.1"), "tls error: STARTTLS TLS handshake: x509: certificate signed by unknown authority")
+
+	l, err := TLSDowngradeList(ctxbg)
+	tcheck(t, err, "list tls downgrades")
+	if len(l) != 1 || l[0].PolicyDomain != "example.org" || l[0].PolicyType != "no-policy-found" || l[0].ResultType != tlsrpt.ResultCertificateNotTrusted || l[0].MXHost != "mx.example.org" || l[0].RemoteIP != "10.0.0.1" {
+		t.Fatalf("unexpected tls downgrades %#v", l)
+	}
+
+	// Sender is notified.
+	err = acc.DB.Read(ctxbg, func(tx *bstore.Tx) error {
+		mb, err := acc.MailboxFind(tx, "Inbox")
+		tcheck(t, err, "find inbox")
+		n, err := bstore.QueryTx[store.Message](tx).FilterNonzero(store.Message{MailboxID: mb.ID}).Count()
+		if n != 1 {
+			t.Fatalf("got %d messages in inbox, expected downgrade notification", n)
+		}
+		return err
+	})
+	tcheck(t, err, "count inbox")
+
+	err = queueDelete(ctxbg, m.ID)
+	tcheck(t, err, "remove message from queue")
+
+	resolver := dns.MockResolver{
+		TXT: map[string][]string{
+			"_smtp._tls.example.org.": {"v=TLSRPTv1; rua=mailto:tlsrpt@example.org,https://example.org/tlsrpt"},
+		},
+	}
+
+	// Downgrades of the current day are not yet reported.
+	err = sendTLSReports(ctxbg, xlog, resolver, time.Now())
+	tcheck(t, err, "send tls reports")
+	msgs, err = List(ctxbg)
+	tcheck(t, err, "list queue")
+	if len(msgs) != 0 {
+		t.Fatalf("got %d messages in queue, expected none", len(msgs))
+	}
+
+	// Temporary failure looking up the tlsrpt record, downgrades are reported later.
+	failResolver := resolver
+	failResolver.Fail = map[dns.Mockreq]struct{}{{Type: "txt", Name: "_smtp._tls.example.org."}: {}}
+	err = sendTLSReports(ctxbg, xlog, failResolver, time.Now().Add(24*time.Hour))
+	tcheck(t, err, "send tls reports")
+	l, err = TLSDowngradeList(ctxbg)
+	tcheck(t, err, "list tls downgrades")
+	if len(l) != 1 || l[0].Reported {
+		t.Fatalf("tls downgrade marked as reported after temporary failure")
+	}
+
+	err = sendTLSReports(ctxbg, xlog, resolver, time.Now().Add(24*time.Hour))
+	tcheck(t, err, "send tls reports")
+	msgs, err = List(ctxbg)
+	tcheck(t, err, "list queue")
+	if len(msgs) != 1 || msgs[0].Recipient().String() != "tlsrpt@example.org" || !msgs[0].Sender().IsZero() {
+		t.Fatalf("got queue %v, expected single tls report to tlsrpt@example.org", msgs)
+	}
+	f, err := OpenMessage(ctxbg, msgs[0].ID)
+	tcheck(t, err, "open report message")
+	defer f.Close()
+	report, err := tlsrpt.ParseMessage(f)
+	tcheck(t, err, "parse tls report")
+	if len(report.Policies) != 1 || report.Policies[0].Summary.TotalFailureSessionCount != 1 || len(report.Policies[0].FailureDetails) != 1 || report.Policies[0].FailureDetails[0].ResultType != tlsrpt.ResultCertificateNotTrusted {
+		t.Fatalf("unexpected report %#v", report)
+	}
+
+	// Reported downgrades are not reported again.
+	l, err = TLSDowngradeList(ctxbg)
+	tcheck(t, err, "list tls downgrades")
+	if len(l) != 1 || !l[0].Reported {
+		t.Fatalf("tls downgrade not marked as reported")
+	}
+	err = sendTLSReports(ctxbg, xlog, resolver, time.Now().Add(24*time.Hour))
+	tcheck(t, err, "send tls reports")
+	msgs, err = List(ctxbg)
+	tcheck(t, err, "list queue")
+	if len(msgs) != 1 {
+		t.Fatalf("got %d messages in queue, expected 1", len(msgs))
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	_, cleanup := setup(t)
+	defer cleanup()
+	err := Init()
+	tcheck(t, err, "queue init")
+
+	type request struct {
+		key, event, attempt, signature string
+	}
+	var requests []request
+	var fails int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, request{r.Header.Get("Idempotency-Key"), r.Header.Get("X-Mox-Event"), r.Header.Get("X-Mox-Attempt"), r.Header.Get("X-Mox-Signature")})
+		if fails > 0 {
+			fails--
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	secrets := []string{"new-secret-0123456789", "old-secret-0123456789"}
+	accConf := mox.Conf.Dynamic.Accounts["mjl"]
+	nc := accConf
+	nc.Webhooks = []config.Webhook{{URL: srv.URL, Events: []string{HookDelivered, HookDelayed}, Secrets: secrets}}
+	mox.Conf.Dynamic.Accounts["mjl"] = nc
+	defer func() {
+		mox.Conf.Dynamic.Accounts["mjl"] = accConf
+	}()
+
+	path := smtp.Path{Localpart: "mjl", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "mox.example"}}}
+	rcpt := smtp.Path{Localpart: "remote", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "example.org"}}}
+	m := Msg{ID: 1, SenderAccount: "mjl", SenderLocalpart: path.Localpart, SenderDomain: path.IPDomain, RecipientLocalpart: rcpt.Localpart, RecipientDomain: rcpt.IPDomain, Attempts: 1}
+
+	// Same event is added only once. Events the webhook isn't interested in are not added.
+	hookOutgoing(xlog, m, HookDelayed, dsn.NameIP{Name: "mx.example.org"}, "temporary error")
+	hookOutgoing(xlog, m, HookDelayed, dsn.NameIP{Name: "mx.example.org"}, "temporary error")
+	hookOutgoing(xlog, m, HookDelivered, dsn.NameIP{Name: "mx.example.org"}, "")
+	HookAddIncoming(xlog, HookEvent{Account: "mjl", MsgID: 1})
+	// No events for messages without sender, e.g. DSNs.
+	hookOutgoing(xlog, Msg{ID: 2, SenderAccount: "mjl"}, HookFailed, dsn.NameIP{}, "error")
+	hooks, err := HookList(ctxbg)
+	tcheck(t, err, "list webhooks")
+	if len(hooks) != 2 || hooks[0].Event != HookDelayed || hooks[0].IdempotencyKey != "delayed-1-1" || hooks[1].Event != HookDelivered {
+		t.Fatalf("unexpected webhooks %#v", hooks)
+	}
+
+	launch := func(expected int) time.Duration {
+		t.Helper()
+		busy := map[string]bool{}
+		d := hookLaunch(busy)
+		if len(busy) != expected {
+			t.Fatalf("launched %d webhook requests, expected %d", len(busy), expected)
+		}
+		for range busy {
+			<-hookResult
+		}
+		return d
+	}
+	xhooks := func() []Hook {
+		t.Helper()
+		l, err := HookList(ctxbg)
+		tcheck(t, err, "list webhooks")
+		return l
+	}
+
+	// First attempt fails. The later request for the same URL is not attempted.
+	fails = 1
+	launch(1)
+	hooks = xhooks()
+	if len(requests) != 1 || hooks[0].Attempts != 1 || hooks[0].Failed || !hooks[0].NextAttempt.After(time.Now()) || hooks[1].Attempts != 0 {
+		t.Fatalf("unexpected requests %v and webhooks %#v", requests, hooks)
+	}
+	if d := launch(0); d <= 0 || d > time.Minute {
+		t.Fatalf("next webhook attempt in %v, expected within 1 minute", d)
+	}
+
+	// Last attempt fails, after which the next request is sent.
+	fails = 1
+	h := hooks[0]
+	h.Attempts = hookMaxAttempts - 1
+	h.NextAttempt = time.Now()
+	err = DB.Update(ctxbg, &h)
+	tcheck(t, err, "update webhook")
+	launch(1)
+	hooks = xhooks()
+	if len(hooks) != 2 || !hooks[0].Failed || hooks[0].LastError == "" {
+		t.Fatalf("unexpected webhooks %#v", hooks)
+	}
+	launch(1)
+	hooks = xhooks()
+	if len(requests) != 3 || len(hooks) != 1 || hooks[0].ID != h.ID || requests[2].event != HookDelivered {
+		t.Fatalf("unexpected requests %v and webhooks %#v", requests, hooks)
+	}
+	launch(0)
+
+	// Replay the failed request.
+	err = HookReplay(ctxbg, h.ID)
+	tcheck(t, err, "replay webhook")
+	launch(1)
+	if hooks := xhooks(); len(hooks) != 0 {
+		t.Fatalf("unexpected webhooks %#v", hooks)
+	}
+	err = HookReplay(ctxbg, h.ID)
+	if err == nil {
+		t.Fatalf("replaying delivered webhook succeeded")
+	}
+
+	// Retries have the same idempotency key. Requests are signed with all secrets.
+	if len(requests) != 4 || requests[0].key != "delayed-1-1" || requests[1].key != requests[0].key || requests[3].key != requests[0].key || requests[3].attempt != "1" {
+		t.Fatalf("unexpected requests %v", requests)
+	}
+	for _, r := range requests {
+		var ts int64
+		if _, err := fmt.Sscanf(r.signature, "t=%d,", &ts); err != nil {
+			t.Fatalf("parsing signature %q: %v", r.signature, err)
+		}
+		l := strings.Split(r.signature, ",")
+		if len(l) != 3 || !strings.HasPrefix(l[1], "v1=") || !strings.HasPrefix(l[2], "v1=") {
+			t.Fatalf("unexpected signature %q", r.signature)
+		}
+	}
+	payload := []byte(`{"Event":"delivered"}`)
+	sig := hookSignature(secrets[:1], time.Unix(1, 0), payload)
+	mac := hmac.New(sha256.New, []byte(secrets[0]))
+	mac.Write([]byte("1."))
+	mac.Write(payload)
+	if exp := "t=1,v1=" + hex.EncodeToString(mac.Sum(nil)); sig != exp {
+		t.Fatalf("got signature %q, expected %q", sig, exp)
+	}
 }
 
 // test Start and that it attempts to deliver.
@@ -473,7 +856,7 @@ func TestQueueStart(t *testing.T) {
 	}
 
 	path := smtp.Path{Localpart: "mjl", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "mox.example"}}}
-	_, err = Add(ctxbg, xlog, "mjl", path, path, false, false, int64(len(testmsg)), nil, prepareFile(t), nil, true)
+	_, err = Add(ctxbg, xlog, "mjl", path, path, false, false, int64(len(testmsg)), nil, prepareFile(t), nil, "", true)
 	tcheck(t, err, "add message to queue for delivery")
 	checkDialed(true)
 
@@ -628,14 +1011,26 @@ func TestDialHost(t *testing.T) {
 	}
 
 	m := Msg{DialedIPs: map[string][]net.IP{}}
-	_, ip, dualstack, err := dialHost(ctxbg, xlog, resolver, nil, ipdomain("dualstack.example"), 25, &m)
+	_, ip, dualstack, err := dialHost(ctxbg, xlog, resolver, nil, nil, ipdomain("dualstack.example"), 25, &m)
 	if err != nil || ip.String() != "10.0.0.1" || !dualstack {
 		t.Fatalf("expected err nil, address 10.0.0.1, dualstack true, got %v %v %v", err, ip, dualstack)
 	}
-	_, ip, dualstack, err = dialHost(ctxbg, xlog, resolver, nil, ipdomain("dualstack.example"), 25, &m)
+	_, ip, dualstack, err = dialHost(ctxbg, xlog, resolver, nil, nil, ipdomain("dualstack.example"), 25, &m)
 	if err != nil || ip.String() != "2001:db8::1" || !dualstack {
 		t.Fatalf("expected err nil, address 2001:db8::1, dualstack true, got %v %v %v", err, ip, dualstack)
 	}
+
+	// Local IPs, e.g. from transport socket options, are used for the matching address family.
+	var dialedLocal net.Addr
+	dial = func(ctx context.Context, dialer contextDialer, timeout time.Duration, addr string, laddr net.Addr) (net.Conn, error) {
+		dialedLocal = laddr
+		return nil, nil
+	}
+	localIPs := []net.IP{net.ParseIP("2001:db8::2"), net.ParseIP("10.0.0.2")}
+	_, ip, _, err = dialHost(ctxbg, xlog, resolver, nil, localIPs, ipdomain("dualstack.example"), 25, &m)
+	if err != nil || ip.String() != "10.0.0.1" || dialedLocal == nil || dialedLocal.String() != "10.0.0.2:0" {
+		t.Fatalf("expected err nil, address 10.0.0.1 from 10.0.0.2, got %v %v %v", err, ip, dialedLocal)
+	}
 }
 
 // Just a cert that appears valid.
@@ -669,3 +1064,248 @@ func fakeCert(t *testing.T, name string, expired bool) tls.Certificate {
 	}
 	return c
 }
+
+func TestSelfCheck(t *testing.T) {
+	acc, cleanup := setup(t)
+	defer cleanup()
+	err := Init()
+	tcheck(t, err, "queue init")
+
+	resolver := dns.MockResolver{
+		TXT: map[string][]string{
+			"_dmarc.mox.example.": {"v=DMARC1; p=reject"},
+		},
+	}
+	from := smtp.Address{Localpart: "mjl", Domain: dns.Domain{ASCII: "mox.example"}}
+	to := smtp.Address{Localpart: "seed", Domain: dns.Domain{ASCII: "example.org"}}
+
+	// No DKIM signing configured in test config.
+	problems := SelfCheck(ctxbg, xlog, resolver, from, to, 0)
+	if len(problems) != 1 || !strings.Contains(problems[0], "no dkim signing") {
+		t.Fatalf("got problems %v, expected missing dkim signing", problems)
+	}
+	msgs, err := List(ctxbg)
+	tcheck(t, err, "list queue")
+	if len(msgs) != 1 || msgs[0].Recipient().String() != "seed@example.org" || msgs[0].SenderAccount != "mjl" {
+		t.Fatalf("got queue %v, expected single test message to seed@example.org", msgs)
+	}
+
+	// Local seed address, message does not arrive because delivery isn't started.
+	problems = SelfCheck(ctxbg, xlog, resolver, from, from, 0)
+	if len(problems) != 2 || !strings.Contains(problems[1], "not delivered") {
+		t.Fatalf("got problems %v, expected test message not delivered", problems)
+	}
+
+	// Unknown sender.
+	problems = SelfCheck(ctxbg, xlog, resolver, to, from, 0)
+	if len(problems) != 1 || !strings.Contains(problems[0], "not an address of an account") {
+		t.Fatalf("got problems %v, expected unknown account", problems)
+	}
+
+	// Problems are reported to the postmaster.
+	selfCheckResult(xlog, from, to, problems)
+	err = acc.DB.Read(ctxbg, func(tx *bstore.Tx) error {
+		mb, err := acc.MailboxFind(tx, "postmaster")
+		tcheck(t, err, "find postmaster mailbox")
+		n, err := bstore.QueryTx[store.Message](tx).FilterNonzero(store.Message{MailboxID: mb.ID}).Count()
+		if n != 1 {
+			t.Fatalf("got %d messages in postmaster mailbox, expected self-check report", n)
+		}
+		return err
+	})
+	tcheck(t, err, "count postmaster mailbox")
+}
+
+func TestNotify(t *testing.T) {
+	acc, cleanup := setup(t)
+	defer cleanup()
+	err := Init()
+	tcheck(t, err, "queue init")
+
+	notificationLimiter.Lock()
+	notificationLimiter.counts = nil
+	notificationLimiter.Unlock()
+
+	rcpt := smtp.Path{Localpart: "mjl", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "mox.example"}}}
+	notify := func(to smtp.Path) {
+		t.Helper()
+		data := append(NotificationHeaders(smtp.Address{Localpart: to.Localpart, Domain: to.IPDomain.Domain}, "test"), "\r\ntest\r\n"...)
+		err := Notify(ctxbg, xlog, Notification{Kind: "test", To: to, Account: "mjl", Data: data})
+		tcheck(t, err, "notify")
+	}
+	count := func(expect int) {
+		t.Helper()
+		err := acc.DB.Read(ctxbg, func(tx *bstore.Tx) error {
+			mb, err := acc.MailboxFind(tx, "Inbox")
+			tcheck(t, err, "find inbox")
+			n, err := bstore.QueryTx[store.Message](tx).FilterNonzero(store.Message{MailboxID: mb.ID}).Count()
+			if n != expect {
+				t.Fatalf("got %d messages in inbox, expected %d", n, expect)
+			}
+			return err
+		})
+		tcheck(t, err, "count inbox")
+	}
+
+	// Rate limited after the default of 20 per hour.
+	for i := 0; i < 21; i++ {
+		notify(rcpt)
+	}
+	count(20)
+
+	// Suppressed addresses and domains.
+	mox.Conf.Static.Notifications = &config.Notifications{
+		MaxPerHour:        100,
+		SuppressAddresses: []smtp.Address{{Localpart: "mjl", Domain: dns.Domain{ASCII: "mox.example"}}},
+		SuppressDomains:   []dns.Domain{{ASCII: "other.example"}},
+	}
+	defer func() {
+		mox.Conf.Static.Notifications = nil
+	}()
+	notify(rcpt)
+	notify(smtp.Path{Localpart: "other", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "other.example"}}})
+	count(20)
+	notify(smtp.Path{Localpart: "other", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "mox.example"}}})
+	count(21)
+}
+
+func TestTrace(t *testing.T) {
+	_, cleanup := setup(t)
+	defer cleanup()
+	err := Init()
+	tcheck(t, err, "queue init")
+
+	path := smtp.Path{Localpart: "mjl", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "mox.example"}}}
+	id, err := AddOpts(ctxbg, xlog, "mjl", path, path, false, false, int64(len(testmsg)), nil, prepareFile(t), nil, "", true, AddOptions{TraceID: "trace1", Hold: true})
+	tcheck(t, err, "add message to queue")
+	Trace(xlog, TraceEvent{TraceID: "trace1", Stage: "submitted", MessageID: "<test@mox.example>"})
+
+	// Message without trace ID gets a new one.
+	_, err = Add(ctxbg, xlog, "mjl", path, path, false, false, int64(len(testmsg)), nil, prepareFile(t), nil, "", true)
+	tcheck(t, err, "add message to queue")
+	msgs, err := List(ctxbg)
+	tcheck(t, err, "listing queue")
+	if len(msgs) != 2 || msgs[0].TraceID != "trace1" || msgs[1].TraceID == "" || msgs[1].TraceID == "trace1" {
+		t.Fatalf("got messages %v, expected trace ids", msgs)
+	}
+
+	xcheckEvents := func(lookup string, stages ...string) {
+		t.Helper()
+		l, err := TraceLookup(ctxbg, lookup)
+		tcheck(t, err, "trace lookup")
+		var got []string
+		for _, e := range l {
+			got = append(got, e.Stage)
+		}
+		if fmt.Sprintf("%v", got) != fmt.Sprintf("%v", stages) {
+			t.Fatalf("got stages %v, expected %v", got, stages)
+		}
+	}
+	xcheckEvents("trace1", "held", "submitted")
+	xcheckEvents("<test@mox.example>", "held", "submitted")
+	xcheckEvents("bogus")
+
+	n, err := Drop(ctxbg, id, "", "")
+	tcheck(t, err, "drop message")
+	if n != 1 {
+		t.Fatalf("dropped %d messages, expected 1", n)
+	}
+	xcheckEvents("trace1", "held", "submitted", "dropped")
+}
+
+func TestParking(t *testing.T) {
+	acc, cleanup := setup(t)
+	defer cleanup()
+	err := Init()
+	tcheck(t, err, "queue init")
+
+	notificationLimiter.Lock()
+	notificationLimiter.counts = nil
+	notificationLimiter.Unlock()
+
+	mox.Conf.Static.Parking = &config.Parking{Period: time.Hour, CheckInterval: time.Minute}
+	defer func() {
+		mox.Conf.Static.Parking = nil
+	}()
+	accConf := mox.Conf.Dynamic.Accounts["mjl"]
+	nc := accConf
+	nc.QuotaMessageSize = 1
+	mox.Conf.Dynamic.Accounts["mjl"] = nc
+	defer func() {
+		mox.Conf.Dynamic.Accounts["mjl"] = accConf
+	}()
+
+	path := smtp.Path{Localpart: "mjl", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "mox.example"}}}
+	id, err := Add(ctxbg, xlog, "mjl", path, path, false, false, int64(len(testmsg)), nil, prepareFile(t), nil, "", true)
+	tcheck(t, err, "add message to queue")
+	get := func() Msg {
+		t.Helper()
+		qm := Msg{ID: id}
+		err := DB.Get(ctxbg, &qm)
+		tcheck(t, err, "get message")
+		return qm
+	}
+	inboxCount := func() int {
+		t.Helper()
+		var n int
+		err := acc.DB.Read(ctxbg, func(tx *bstore.Tx) error {
+			mb, err := acc.MailboxFind(tx, "Inbox")
+			tcheck(t, err, "find inbox")
+			n, err = bstore.QueryTx[store.Message](tx).FilterNonzero(store.Message{MailboxID: mb.ID}).Count()
+			return err
+		})
+		tcheck(t, err, "count inbox")
+		return n
+	}
+
+	// Temporary failure for over quota local recipient parks the message, with a
+	// single delay DSN to the sender.
+	m := get()
+	now := time.Now()
+	m.Attempts = 1
+	m.LastAttempt = &now
+	fail(xlog, m, time.Minute, false, dsn.NameIP{}, "4.2.2", "mailbox full")
+	m = get()
+	if m.Parked == nil || !m.NextAttempt.Equal(m.Parked.Add(time.Hour)) {
+		t.Fatalf("message not parked, parked %v, next attempt %v", m.Parked, m.NextAttempt)
+	}
+	if n := inboxCount(); n != 1 {
+		t.Fatalf("got %d messages in inbox, expected 1 delay dsn", n)
+	}
+	parked := *m.Parked
+	m.Attempts = 8
+	fail(xlog, m, time.Minute, false, dsn.NameIP{}, "4.2.2", "mailbox full")
+	m = get()
+	if m.Parked == nil || !m.Parked.Equal(parked) || inboxCount() != 1 {
+		t.Fatalf("message not kept parked without new dsn, parked %v", m.Parked)
+	}
+
+	// Not unparked while still over quota.
+	if n := unparkCleared(ctxbg, xlog); n != 0 {
+		t.Fatalf("unparked %d messages, expected 0", n)
+	}
+	mox.Conf.Dynamic.Accounts["mjl"] = accConf
+	if n := unparkCleared(ctxbg, xlog); n != 1 {
+		t.Fatalf("unparked %d messages, expected 1", n)
+	}
+	if m = get(); m.NextAttempt.After(time.Now()) {
+		t.Fatalf("unparked message not scheduled for immediate delivery, next attempt %v", m.NextAttempt)
+	}
+
+	// Other temporary errors, after the condition cleared, follow regular attempts.
+	fail(xlog, m, time.Minute, false, dsn.NameIP{}, "", "connection refused")
+	if m = get(); m.Parked != nil {
+		t.Fatalf("message still parked after condition cleared")
+	}
+
+	// After the parking period, delivery fails permanently.
+	mox.Conf.Dynamic.Accounts["mjl"] = nc
+	past := time.Now().Add(-2 * time.Hour)
+	m.Parked = &past
+	m.Attempts = 2
+	m.LastAttempt = &now
+	fail(xlog, m, time.Minute, false, dsn.NameIP{}, "4.2.2", "mailbox full")
+	if err := DB.Get(ctxbg, &Msg{ID: id}); err != bstore.ErrAbsent {
+		t.Fatalf("got err %v for message after parking period, expected absent", err)
+	}
+}
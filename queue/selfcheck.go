@@ -0,0 +1,279 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/dkim"
+	"github.com/mjl-/mox/dmarc"
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/smtp"
+	"github.com/mjl-/mox/spf"
+	"github.com/mjl-/mox/store"
+)
+
+var (
+	metricSelfCheck = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mox_selfcheck_total",
+			Help: "Self-checks of outgoing message authentication, per result.",
+		},
+		[]string{
+			"result", // ok, fail
+		},
+	)
+	metricSelfCheckFailing = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "mox_selfcheck_failing",
+			Help: "Whether the last self-check of outgoing message authentication failed.",
+		},
+	)
+)
+
+func startSelfCheck(resolver dns.Resolver) {
+	sc := mox.Conf.Static.SelfCheck
+	if sc == nil {
+		return
+	}
+	go func() {
+		for {
+			select {
+			case <-mox.Shutdown.Done():
+				return
+			case <-time.After(sc.Interval):
+			}
+			log := xlog.WithCid(mox.Cid())
+			problems := SelfCheck(mox.Shutdown, log, resolver, sc.FromAddress, sc.ToAddress, sc.Timeout)
+			selfCheckResult(log, sc.FromAddress, sc.ToAddress, problems)
+		}
+	}()
+}
+
+// SelfCheck sends a test message from "from" to "to" through the queue, and
+// returns problems found with DKIM, SPF and DMARC for the message. If "to" is a
+// local address, it waits up to timeout for the message to arrive and checks the
+// authentication results of the delivered message. Used for the periodic
+// self-check, and by the setup wizard in the admin web interface.
+func SelfCheck(ctx context.Context, log *mlog.Log, resolver dns.Resolver, from, to smtp.Address, timeout time.Duration) (problems []string) {
+	addf := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	senderAccount, _, _, err := mox.FindAccount(from.Localpart, from.Domain, false)
+	if err != nil {
+		addf("from address %s is not an address of an account: %v", from, err)
+		return
+	}
+
+	messageID := mox.MessageIDGen(false)
+	var b bytes.Buffer
+	header := func(k, v string) {
+		fmt.Fprintf(&b, "%s: %s\r\n", k, v)
+	}
+	header("From", fmt.Sprintf("<%s>", from.String()))
+	header("To", fmt.Sprintf("<%s>", to.String()))
+	header("Subject", "mox self-check")
+	header("Message-Id", fmt.Sprintf("<%s>", messageID))
+	header("Date", time.Now().Format(message.RFC5322Z))
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain")
+	b.WriteString("\r\n")
+	b.WriteString("This is a test message sent by mox to check that SPF, DKIM and DMARC pass\r\nfor outgoing messages.\r\n")
+	data := b.Bytes()
+
+	// Verify our own DKIM signature through DNS. This catches broken keys and
+	// missing or outdated DNS records before the message arrives anywhere.
+	if confDom, ok := mox.Conf.Domain(from.Domain); !ok || len(confDom.DKIM.Sign) == 0 {
+		addf("no dkim signing configured for domain %s", from.Domain)
+	} else if dkimHeaders, err := dkim.Sign(ctx, from.Localpart, from.Domain, confDom.DKIM, false, bytes.NewReader(data)); err != nil {
+		addf("dkim signing: %v", err)
+	} else {
+		data = append([]byte(dkimHeaders), data...)
+		results, err := dkim.Verify(ctx, resolver, false, dkim.DefaultPolicy, bytes.NewReader(data), true)
+		if err != nil {
+			addf("dkim verification of own signature: %v", err)
+		}
+		for _, r := range results {
+			if r.Status != dkim.StatusPass {
+				sel := ""
+				if r.Sig != nil {
+					sel = r.Sig.Selector.ASCII
+				}
+				addf("dkim verification of own signature with selector %s: %s: %v", sel, r.Status, r.Err)
+			}
+		}
+	}
+
+	// Check SPF for the IPs we explicitly send from, if known.
+	for _, ip := range mox.Conf.Static.SpecifiedSMTPListenIPs {
+		args := spf.Args{
+			RemoteIP:          ip,
+			MailFromLocalpart: from.Localpart,
+			MailFromDomain:    from.Domain,
+			HelloDomain:       dns.IPDomain{Domain: mox.Conf.Static.HostnameDomain},
+			LocalIP:           ip,
+			LocalHostname:     mox.Conf.Static.HostnameDomain,
+		}
+		received, _, _, err := spf.Verify(ctx, resolver, args)
+		if err != nil || received.Result != spf.StatusPass {
+			addf("spf for ip %s and domain %s: %s: %v", ip, from.Domain, received.Result, err)
+		}
+	}
+
+	if status, _, _, _, err := dmarc.Lookup(ctx, resolver, from.Domain); err != nil {
+		addf("dmarc record for domain %s: %s: %v", from.Domain, status, err)
+	}
+
+	f, err := store.CreateMessageTemp("queue-selfcheck")
+	if err != nil {
+		addf("creating temporary message file: %v", err)
+		return
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		mailFrom := smtp.Path{Localpart: from.Localpart, IPDomain: dns.IPDomain{Domain: from.Domain}}
+		rcptTo := smtp.Path{Localpart: to.Localpart, IPDomain: dns.IPDomain{Domain: to.Domain}}
+		_, err = Add(ctx, log, senderAccount, mailFrom, rcptTo, false, false, int64(len(data)), nil, f, nil, "", true)
+	}
+	if err != nil {
+		xerr := os.Remove(f.Name())
+		log.Check(xerr, "removing temporary message file")
+	}
+	xerr := f.Close()
+	log.Check(xerr, "closing temporary message file")
+	if err != nil {
+		addf("queueing test message: %v", err)
+		return
+	}
+	log.Info("queued self-check message", mlog.Field("from", from), mlog.Field("to", to), mlog.Field("messageid", messageID))
+
+	rcptAccount, _, _, err := mox.FindAccount(to.Localpart, to.Domain, true)
+	if err != nil {
+		// External seed address, nothing more to check.
+		return
+	}
+	m, err := selfCheckArrived(ctx, log, rcptAccount, "<"+messageID+">", timeout)
+	if err != nil {
+		addf("waiting for test message at %s: %v", to, err)
+		return
+	}
+	if m.MailFromValidation != store.ValidationPass {
+		addf("spf for arrived test message is %s, expected pass", validationString(m.MailFromValidation))
+	}
+	var signed bool
+	for _, d := range m.DKIMDomains {
+		if strings.EqualFold(d, from.Domain.Name()) {
+			signed = true
+		}
+	}
+	if !signed {
+		addf("no valid dkim signature of domain %s on arrived test message, signatures are: %s", from.Domain, strings.Join(m.DKIMDomains, ", "))
+	}
+	if !m.MsgFromValidated {
+		addf("dmarc for arrived test message did not pass, from validation %s", validationString(m.MsgFromValidation))
+	}
+	return
+}
+
+// selfCheckArrived waits for a message with messageID to arrive in account and
+// returns it.
+func selfCheckArrived(ctx context.Context, log *mlog.Log, accountName, messageID string, timeout time.Duration) (store.Message, error) {
+	acc, err := store.OpenAccount(accountName)
+	if err != nil {
+		return store.Message{}, fmt.Errorf("open account: %v", err)
+	}
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		m, err := bstore.QueryDB[store.Message](ctx, acc.DB).FilterNonzero(store.Message{MessageID: messageID}).Get()
+		if err == nil {
+			return m, nil
+		} else if err != bstore.ErrAbsent {
+			return store.Message{}, err
+		}
+		if !time.Now().Before(deadline) {
+			return store.Message{}, fmt.Errorf("message not delivered within %s", timeout)
+		}
+		select {
+		case <-ctx.Done():
+			return store.Message{}, ctx.Err()
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+func validationString(v store.Validation) string {
+	switch v {
+	case store.ValidationStrict:
+		return "strict"
+	case store.ValidationDMARC:
+		return "dmarc"
+	case store.ValidationRelaxed:
+		return "relaxed"
+	case store.ValidationPass:
+		return "pass"
+	case store.ValidationNeutral:
+		return "neutral"
+	case store.ValidationTemperror:
+		return "temperror"
+	case store.ValidationPermerror:
+		return "permerror"
+	case store.ValidationFail:
+		return "fail"
+	case store.ValidationSoftfail:
+		return "softfail"
+	}
+	return "unknown"
+}
+
+// selfCheckResult logs and records the result of a self-check, and delivers a
+// report to the postmaster mailbox if there are problems.
+func selfCheckResult(log *mlog.Log, from, to smtp.Address, problems []string) {
+	if len(problems) == 0 {
+		metricSelfCheck.WithLabelValues("ok").Inc()
+		metricSelfCheckFailing.Set(0)
+		log.Info("self-check of outgoing message authentication passed", mlog.Field("from", from), mlog.Field("to", to))
+		return
+	}
+	metricSelfCheck.WithLabelValues("fail").Inc()
+	metricSelfCheckFailing.Set(1)
+	log.Error("self-check of outgoing message authentication failed", mlog.Field("from", from), mlog.Field("to", to), mlog.Field("problems", strings.Join(problems, "; ")))
+
+	var problemLines string
+	for _, p := range problems {
+		problemLines += "- " + p + "\n"
+	}
+	lang := mox.AccountLanguage(mox.Conf.Static.Postmaster.Account)
+	subject := mox.Text(lang, "selfcheck-subject", "domain", from.Domain.ASCII)
+	body := mox.Text(lang, "selfcheck-body", "from", from.String(), "to", to.String(), "problems", problemLines)
+	postmaster := smtp.Path{Localpart: "postmaster", IPDomain: dns.IPDomain{Domain: mox.Conf.Static.HostnameDomain}}
+	data := append(NotificationHeaders(smtp.Address{Localpart: postmaster.Localpart, Domain: postmaster.IPDomain.Domain}, subject), "\r\n"...)
+	data = append(data, strings.ReplaceAll(body, "\n", "\r\n")...)
+	n := Notification{
+		Kind:    "selfcheck",
+		To:      postmaster,
+		Account: mox.Conf.Static.Postmaster.Account,
+		Mailbox: mox.Conf.Static.Postmaster.Mailbox,
+		Flags:   store.Flags{Flagged: true},
+		Data:    data,
+	}
+	if err := Notify(context.Background(), log, n); err != nil {
+		log.Errorx("delivering self-check report to postmaster", err)
+	}
+}
@@ -24,7 +24,7 @@ import (
 
 // deliver via another SMTP server, e.g. relaying to a smart host, possibly
 // with authentication (submission).
-func deliverSubmit(cid int64, qlog *mlog.Log, resolver dns.Resolver, dialer contextDialer, m Msg, backoff time.Duration, transportName string, transport *config.TransportSMTP, dialTLS bool, defaultPort int) {
+func deliverSubmit(cid int64, qlog *mlog.Log, resolver dns.Resolver, dialer contextDialer, localIPs []net.IP, m Msg, backoff time.Duration, transportName string, transport *config.TransportSMTP, dialTLS bool, defaultPort int) {
 	// todo: configurable timeouts
 
 	port := transport.Port
@@ -54,7 +54,7 @@ func deliverSubmit(cid int64, qlog *mlog.Log, resolver dns.Resolver, dialer cont
 	dialctx, dialcancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer dialcancel()
 	addr := net.JoinHostPort(transport.Host, fmt.Sprintf("%d", port))
-	conn, _, _, err := dialHost(dialctx, qlog, resolver, dialer, dns.IPDomain{Domain: transport.DNSHost}, port, &m)
+	conn, _, _, err := dialHost(dialctx, qlog, resolver, dialer, localIPs, dns.IPDomain{Domain: transport.DNSHost}, port, &m)
 	var result string
 	switch {
 	case err == nil:
@@ -123,10 +123,12 @@ func deliverSubmit(cid int64, qlog *mlog.Log, resolver dns.Resolver, dialer cont
 	clientcancel()
 
 	var msgr io.ReadCloser
+	var msgra io.ReaderAt // For converting binary parts.
 	var size int64
 	var req8bit, reqsmtputf8 bool
 	if len(m.DSNUTF8) > 0 && client.SupportsSMTPUTF8() {
-		msgr = io.NopCloser(bytes.NewReader(m.DSNUTF8))
+		br := bytes.NewReader(m.DSNUTF8)
+		msgr, msgra = io.NopCloser(br), br
 		reqsmtputf8 = true
 		size = int64(len(m.DSNUTF8))
 	} else {
@@ -141,16 +143,41 @@ func deliverSubmit(cid int64, qlog *mlog.Log, resolver dns.Resolver, dialer cont
 			fail(qlog, m, backoff, false, dsn.NameIP{}, "", errmsg)
 			return
 		}
-		msgr = store.FileMsgReader(m.MsgPrefix, f)
+		fmr := store.FileMsgReader(m.MsgPrefix, f)
+		msgr, msgra = fmr, fmr
 		defer func() {
 			err := msgr.Close()
 			qlog.Check(err, "closing message after delivery attempt")
 		}()
 	}
 
+	var msg io.Reader = msgr
+	binary := m.BinaryMIME && client.SupportsBinaryMIME()
+	if m.BinaryMIME && !binary {
+		df, dsize, err := downgradeBinary(qlog, msgra, size)
+		if err != nil {
+			qlog.Errorx("converting binary message for delivery", err, mlog.Field("remote", addr))
+			errmsg = fmt.Sprintf("transport %s: converting binary message for submission: %v", transportName, err)
+			fail(qlog, m, backoff, false, dsn.NameIP{}, "", errmsg)
+			return
+		}
+		defer func() {
+			err := os.Remove(df.Name())
+			qlog.Check(err, "removing temporary converted message file")
+			err = df.Close()
+			qlog.Check(err, "closing temporary converted message file")
+		}()
+		size = dsize
+		msg = df
+	}
+
 	deliverctx, delivercancel := context.WithTimeout(context.Background(), time.Duration(60+size/(1024*1024))*time.Second)
 	defer delivercancel()
-	err = client.Deliver(deliverctx, m.Sender().String(), m.Recipient().String(), size, msgr, req8bit, reqsmtputf8)
+	if binary {
+		err = client.DeliverBinary(deliverctx, m.Sender().String(), m.Recipient().String(), size, msg, reqsmtputf8)
+	} else {
+		err = client.Deliver(deliverctx, m.Sender().String(), m.Recipient().String(), size, msg, req8bit, reqsmtputf8)
+	}
 	if err != nil {
 		qlog.Infox("delivery failed", err)
 	}
@@ -188,4 +215,7 @@ func deliverSubmit(cid int64, qlog *mlog.Log, resolver dns.Resolver, dialer cont
 	if err := queueDelete(context.Background(), m.ID); err != nil {
 		qlog.Errorx("deleting message from queue after delivery", err)
 	}
+	queueDSNSuccess(qlog, m, dsn.NameIP{Name: transport.Host})
+	hookOutgoing(qlog, m, HookDelivered, dsn.NameIP{Name: transport.Host}, "")
+	deliveryAdd(qlog, m, HookDelivered, dsn.NameIP{Name: transport.Host}, client.TLSEnabled(), "")
 }
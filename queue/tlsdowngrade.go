@@ -0,0 +1,397 @@
+package queue
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/dsn"
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/mtasts"
+	"github.com/mjl-/mox/smtp"
+	"github.com/mjl-/mox/tlsrpt"
+)
+
+// TLSDowngrade is a delivery that was done without TLS, after an attempt with TLS
+// failed. With opportunistic TLS, we fall back to plain text delivery when the
+// STARTTLS command or TLS handshake fails. Such downgrades are recorded, included
+// in TLS reports (TLSRPT) sent to the recipient domain if enabled, and optionally
+// reported to the sender.
+type TLSDowngrade struct {
+	ID            int64
+	Time          time.Time `bstore:"default now,index"`
+	SenderAccount string    // Empty for messages not submitted by an account.
+	Recipient     string    // Full address.
+
+	// Domain of the recipient, after following CNAMEs, in ASCII. This is the domain
+	// the TLS policy was looked up for, and TLS reports are sent to.
+	PolicyDomain string   `bstore:"index"`
+	PolicyType   string   // "sts" for a (non-enforced) MTA-STS policy, "no-policy-found" otherwise. As in TLSRPT.
+	PolicyString []string // Lines of the MTA-STS policy, if any.
+
+	MXHost     string
+	RemoteIP   string
+	ResultType tlsrpt.ResultType
+	Error      string // From the failed TLS attempt.
+	Reported   bool   // Whether this downgrade was processed for sending TLS reports.
+}
+
+// TLSDowngradeList returns recorded TLS downgrades, most recent first.
+func TLSDowngradeList(ctx context.Context) ([]TLSDowngrade, error) {
+	return bstore.QueryDB[TLSDowngrade](ctx, DB).SortDesc("Time").List()
+}
+
+// tlsResultType returns the TLSRPT result type for the error message of a failed
+// TLS delivery attempt.
+func tlsResultType(errmsg string) tlsrpt.ResultType {
+	switch {
+	case strings.Contains(errmsg, "STARTTLS: got"):
+		return tlsrpt.ResultSTARTTLSNotSupported
+	case strings.Contains(errmsg, "certificate is valid for"), strings.Contains(errmsg, "certificate is not valid for"):
+		return tlsrpt.ResultCertificateHostMismatch
+	case strings.Contains(errmsg, "certificate has expired"):
+		return tlsrpt.ResultCertificateExpired
+	case strings.Contains(errmsg, "certificate signed by unknown authority"):
+		return tlsrpt.ResultCertificateNotTrusted
+	}
+	return tlsrpt.ResultValidationFailure
+}
+
+// recordTLSDowngrade stores a TLS downgrade for the delivery of m, and notifies
+// the sender if its account has NotifyTLSDowngrade set.
+func recordTLSDowngrade(log *mlog.Log, m Msg, policyDomain dns.Domain, policy *mtasts.Policy, host dns.IPDomain, remoteIP net.IP, tlsErrmsg string) {
+	d := TLSDowngrade{
+		SenderAccount: m.SenderAccount,
+		Recipient:     m.Recipient().XString(true),
+		PolicyDomain:  policyDomain.ASCII,
+		PolicyType:    "no-policy-found",
+		MXHost:        host.XString(false),
+		ResultType:    tlsResultType(tlsErrmsg),
+		Error:         tlsErrmsg,
+	}
+	if policy != nil {
+		d.PolicyType = "sts"
+		d.PolicyString = strings.Split(strings.TrimSuffix(policy.String(), "\r\n"), "\r\n")
+	}
+	if remoteIP != nil {
+		d.RemoteIP = remoteIP.String()
+	}
+	if err := DB.Insert(context.Background(), &d); err != nil {
+		log.Errorx("storing tls downgrade", err)
+	}
+	log.Info("delivered with tls downgrade", mlog.Field("policydomain", policyDomain), mlog.Field("mxhost", d.MXHost), mlog.Field("resulttype", d.ResultType))
+
+	if m.SenderAccount == "" {
+		return
+	}
+	accConf, ok := mox.Conf.Account(m.SenderAccount)
+	if !ok || !accConf.NotifyTLSDowngrade {
+		return
+	}
+	const subject = "mail delivered without encryption"
+	text := fmt.Sprintf(`
+Your email has been delivered to the mail server of:
+
+	%s
+
+But the connection to that mail server could not be protected with TLS, so the
+message was delivered without encryption. The message may have been read or
+modified by others on the network path. The TLS error was:
+
+	%s
+`, m.Recipient().XString(m.SMTPUTF8), tlsErrmsg)
+	queueDSN(log, m, dsn.NameIP{Name: d.MXHost, IP: remoteIP}, "", "", dsn.Relayed, nil, subject, text)
+}
+
+// startTLSReports sends TLS reports about downgrades of the previous day, every
+// day shortly after midnight UTC, if enabled with OutgoingTLSReports.
+func startTLSReports(resolver dns.Resolver) {
+	go func() {
+		for {
+			now := time.Now().UTC()
+			next := time.Date(now.Year(), now.Month(), now.Day(), 0, 15, 0, 0, time.UTC)
+			if !next.After(now) {
+				next = next.AddDate(0, 0, 1)
+			}
+			select {
+			case <-mox.Shutdown.Done():
+				return
+			case <-time.After(time.Until(next)):
+			}
+			if !mox.Conf.Static.OutgoingTLSReports {
+				continue
+			}
+			log := xlog.WithCid(mox.Cid())
+			if err := sendTLSReports(mox.Shutdown, log, resolver, time.Now()); err != nil {
+				log.Errorx("sending tls reports", err)
+			}
+		}
+	}()
+}
+
+// sendTLSReports queues TLS reports for unreported downgrades that happened
+// before the start of the current UTC day, one report per policy domain per day.
+// Reports are only sent to "mailto:" reporting URIs. Downgrades older than 30
+// days are removed.
+func sendTLSReports(ctx context.Context, log *mlog.Log, resolver dns.Resolver, now time.Time) error {
+	now = now.UTC()
+	end := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	q := bstore.QueryDB[TLSDowngrade](ctx, DB)
+	q.FilterEqual("Reported", false)
+	q.FilterLess("Time", end)
+	q.SortAsc("Time")
+	l, err := q.List()
+	if err != nil {
+		return fmt.Errorf("listing tls downgrades: %w", err)
+	}
+
+	type key struct {
+		domain string
+		day    time.Time
+	}
+	groups := map[key][]TLSDowngrade{}
+	for _, d := range l {
+		t := d.Time.UTC()
+		k := key{d.PolicyDomain, time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)}
+		groups[k] = append(groups[k], d)
+	}
+	for k, dl := range groups {
+		// Downgrades are marked as reported after sending, or if the policy domain has no
+		// TLSRPT record. After other errors, e.g. a temporary DNS failure, we try again
+		// the next time.
+		err := sendTLSReport(ctx, log, resolver, k.domain, k.day, dl)
+		if errors.Is(err, tlsrpt.ErrNoRecord) {
+			log.Debug("no tlsrpt record for policy domain, not sending tls report", mlog.Field("policydomain", k.domain))
+		} else if err != nil {
+			log.Errorx("sending tls report, will retry", err, mlog.Field("policydomain", k.domain))
+			continue
+		}
+		for _, d := range dl {
+			d.Reported = true
+			if err := DB.Update(ctx, &d); err != nil {
+				return fmt.Errorf("marking tls downgrade as reported: %w", err)
+			}
+		}
+	}
+
+	qd := bstore.QueryDB[TLSDowngrade](ctx, DB)
+	qd.FilterLess("Time", end.AddDate(0, 0, -30))
+	if _, err := qd.Delete(); err != nil {
+		return fmt.Errorf("removing old tls downgrades: %w", err)
+	}
+	return nil
+}
+
+// tlsReport returns a TLSRPT report for the downgrades of one policy domain for
+// the day starting at start. We only keep track of failed sessions, the number
+// of successful sessions is reported as zero. ../rfc/8460:472
+func tlsReport(domain string, start time.Time, reportID string, dl []TLSDowngrade) tlsrpt.Report {
+	type detailsKey struct {
+		resultType tlsrpt.ResultType
+		mxHost     string
+		remoteIP   string
+		errmsg     string
+	}
+	counts := map[detailsKey]int64{}
+	var keys []detailsKey
+	mxHosts := map[string]struct{}{}
+	for _, d := range dl {
+		k := detailsKey{d.ResultType, d.MXHost, d.RemoteIP, d.Error}
+		if _, ok := counts[k]; !ok {
+			keys = append(keys, k)
+		}
+		counts[k]++
+		mxHosts[d.MXHost] = struct{}{}
+	}
+
+	last := dl[len(dl)-1]
+	result := tlsrpt.Result{
+		Policy: tlsrpt.ResultPolicy{
+			Type:   last.PolicyType,
+			String: last.PolicyString,
+			Domain: domain,
+		},
+		Summary: tlsrpt.Summary{TotalFailureSessionCount: int64(len(dl))},
+	}
+	for h := range mxHosts {
+		result.Policy.MXHost = append(result.Policy.MXHost, h)
+	}
+	sort.Strings(result.Policy.MXHost)
+	for _, k := range keys {
+		result.FailureDetails = append(result.FailureDetails, tlsrpt.FailureDetails{
+			ResultType:            k.resultType,
+			ReceivingMXHostname:   k.mxHost,
+			ReceivingIP:           k.remoteIP,
+			FailedSessionCount:    counts[k],
+			AdditionalInformation: k.errmsg,
+		})
+	}
+
+	return tlsrpt.Report{
+		OrganizationName: mox.Conf.Static.HostnameDomain.ASCII,
+		DateRange: tlsrpt.TLSRPTDateRange{
+			Start: start,
+			End:   start.Add(24*time.Hour - time.Second),
+		},
+		ContactInfo: smtp.Address{Localpart: "postmaster", Domain: mox.Conf.Static.HostnameDomain}.String(),
+		ReportID:    reportID,
+		Policies:    []tlsrpt.Result{result},
+	}
+}
+
+// sendTLSReport looks up the TLSRPT record of domain and queues a report for
+// each "mailto:" reporting URI.
+func sendTLSReport(ctx context.Context, log *mlog.Log, resolver dns.Resolver, domain string, start time.Time, dl []TLSDowngrade) error {
+	d, err := dns.ParseDomain(domain)
+	if err != nil {
+		return fmt.Errorf("parsing policy domain: %v", err)
+	}
+	record, _, err := tlsrpt.Lookup(ctx, resolver, d)
+	if err != nil {
+		return fmt.Errorf("looking up tlsrpt record: %w", err)
+	}
+	var rcpts []smtp.Path
+	for _, l := range record.RUAs {
+		for _, s := range l {
+			u, err := url.Parse(s)
+			if err != nil || !strings.EqualFold(u.Scheme, "mailto") {
+				continue
+			}
+			addr, err := smtp.ParseAddress(u.Opaque)
+			if err != nil {
+				log.Debugx("parsing tlsrpt mailto address", err, mlog.Field("rua", s))
+				continue
+			}
+			rcpts = append(rcpts, smtp.Path{Localpart: addr.Localpart, IPDomain: dns.IPDomain{Domain: addr.Domain}})
+		}
+	}
+	if len(rcpts) == 0 {
+		log.Debug("no mailto reporting uri in tlsrpt record, not sending tls report", mlog.Field("policydomain", domain))
+		return nil
+	}
+
+	submitter := mox.Conf.Static.HostnameDomain
+	reportID := fmt.Sprintf("%s.%s@%s", start.Format("20060102"), domain, submitter.ASCII)
+	report := tlsReport(domain, start, reportID, dl)
+	msg, err := composeTLSReport(log, d, report)
+	if err != nil {
+		return fmt.Errorf("composing tls report: %w", err)
+	}
+
+	// If the report is queued for at least one recipient, we don't try again, we
+	// would send duplicate reports to the others.
+	var lastErr error
+	var queued int
+	for _, rcpt := range rcpts {
+		n := Notification{
+			Kind: "tlsrpt",
+			From: smtp.Path{Localpart: "postmaster", IPDomain: dns.IPDomain{Domain: submitter}},
+			To:   rcpt,
+			Data: msg,
+		}
+		if err := Notify(ctx, log, n); err != nil {
+			log.Errorx("queueing tls report", err, mlog.Field("policydomain", domain), mlog.Field("rcpt", rcpt.XString(true)))
+			lastErr = err
+			continue
+		}
+		queued++
+		log.Info("queued tls report", mlog.Field("policydomain", domain), mlog.Field("rcpt", rcpt.XString(true)), mlog.Field("failures", len(dl)))
+	}
+	if queued == 0 && lastErr != nil {
+		return fmt.Errorf("queueing tls report: %w", lastErr)
+	}
+	return nil
+}
+
+// composeTLSReport returns a TLS report message, with the report as gzipped JSON
+// attachment. ../rfc/8460:728
+func composeTLSReport(log *mlog.Log, policyDomain dns.Domain, report tlsrpt.Report) ([]byte, error) {
+	submitter := mox.Conf.Static.HostnameDomain
+	from := smtp.Address{Localpart: "postmaster", Domain: submitter}
+
+	var reportBuf bytes.Buffer
+	gzw := gzip.NewWriter(&reportBuf)
+	if err := json.NewEncoder(gzw).Encode(report); err != nil {
+		return nil, fmt.Errorf("encoding report: %v", err)
+	}
+	if err := gzw.Close(); err != nil {
+		return nil, fmt.Errorf("compressing report: %v", err)
+	}
+
+	var b bytes.Buffer
+	header := func(k, v string) {
+		fmt.Fprintf(&b, "%s: %s\r\n", k, v)
+	}
+	header("From", fmt.Sprintf("<%s>", from.String()))
+	header("To", fmt.Sprintf("<postmaster@%s>", policyDomain.ASCII))
+	header("Subject", fmt.Sprintf("Report Domain: %s Submitter: %s Report-ID: <%s>", policyDomain.ASCII, submitter.ASCII, report.ReportID))
+	header("Message-Id", fmt.Sprintf("<%s>", mox.MessageIDGen(false)))
+	header("Date", time.Now().Format(message.RFC5322Z))
+	header("TLS-Report-Domain", policyDomain.ASCII)
+	header("TLS-Report-Submitter", submitter.ASCII)
+	header("MIME-Version", "1.0")
+	mp := multipart.NewWriter(&b)
+	header("Content-Type", fmt.Sprintf(`multipart/report; report-type="tlsrpt"; boundary="%s"`, mp.Boundary()))
+	b.WriteString("\r\n")
+
+	textHdr := textproto.MIMEHeader{}
+	textHdr.Set("Content-Type", "text/plain")
+	textHdr.Set("Content-Transfer-Encoding", "7BIT")
+	textp, err := mp.CreatePart(textHdr)
+	if err != nil {
+		return nil, err
+	}
+	text := fmt.Sprintf("This is an aggregate TLS report from %s about deliveries to %s that were\r\ndone without TLS after a failed attempt with TLS.\r\n", submitter.ASCII, policyDomain.ASCII)
+	if _, err := textp.Write([]byte(text)); err != nil {
+		return nil, err
+	}
+
+	// ../rfc/8460:756
+	filename := fmt.Sprintf("%s!%s!%d!%d.json.gz", submitter.ASCII, policyDomain.ASCII, report.DateRange.Start.Unix(), report.DateRange.End.Unix())
+	reportHdr := textproto.MIMEHeader{}
+	reportHdr.Set("Content-Type", fmt.Sprintf(`application/tlsrpt+gzip; name="%s"`, filename))
+	reportHdr.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	reportHdr.Set("Content-Transfer-Encoding", "base64")
+	reportp, err := mp.CreatePart(reportHdr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := reportp.Write([]byte(wrapBase64(reportBuf.Bytes()))); err != nil {
+		return nil, err
+	}
+	if err := mp.Close(); err != nil {
+		return nil, err
+	}
+
+	// The report is DKIM-signed by Notify.
+	return b.Bytes(), nil
+}
+
+// wrapBase64 returns buf base64-encoded in lines of 76 characters.
+func wrapBase64(buf []byte) string {
+	s := base64.StdEncoding.EncodeToString(buf)
+	var b strings.Builder
+	for len(s) > 76 {
+		b.WriteString(s[:76] + "\r\n")
+		s = s[76:]
+	}
+	b.WriteString(s + "\r\n")
+	return b.String()
+}
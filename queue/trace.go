@@ -0,0 +1,102 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+// TraceRetention is how long trace events are kept.
+const TraceRetention = 14 * 24 * time.Hour
+
+// TraceEvent is a step in the handling of a message, such as its reception over
+// SMTP, the analysis and delivery to a mailbox of an incoming message, queueing of
+// an outgoing message, and its delivery attempts. Events for a message have the
+// same trace ID, assigned when the message is received. With multiple recipients,
+// there are events for each recipient. Events are kept for TraceRetention, so the
+// timeline of a message can be looked up, e.g. when helping a user.
+type TraceEvent struct {
+	ID        int64
+	TraceID   string    `bstore:"nonzero,index"`
+	Time      time.Time `bstore:"default now,index"`
+	Stage     string    // E.g. "received", "submitted", "delivered", "rejected", "queued", "delayed", "failed".
+	Cid       int64     // Of the SMTP connection, for finding its log lines. Zero for events from the queue.
+	QueueID   int64     // Of the queued message, for events from the queue.
+	MessageID string    `bstore:"index"` // Message-ID header, if known.
+	Recipient string    // If event is for a single recipient.
+	Text      string    // Details, e.g. remote host, mailbox or error.
+}
+
+// NewTraceID returns a new trace ID for a message. Like the IDs in Received
+// headers, it is an obfuscated cid, not revealing the number of messages handled.
+func NewTraceID() string {
+	return mox.ReceivedID(mox.Cid())
+}
+
+// Trace records event e. Events older than TraceRetention are removed. Errors are
+// logged. Nothing is recorded if e has no trace ID.
+func Trace(log *mlog.Log, e TraceEvent) {
+	if e.TraceID == "" {
+		return
+	}
+	e.ID = 0
+	err := DB.Write(context.Background(), func(tx *bstore.Tx) error {
+		q := bstore.QueryTx[TraceEvent](tx)
+		q.FilterLess("Time", time.Now().Add(-TraceRetention))
+		if _, err := q.Delete(); err != nil {
+			return err
+		}
+		return tx.Insert(&e)
+	})
+	log.Check(err, "recording trace event", mlog.Field("traceid", e.TraceID), mlog.Field("stage", e.Stage))
+}
+
+// TraceLookup returns the events with trace ID id, oldest first. If there are no
+// such events, id is treated as Message-ID header, and the events of all messages
+// with that Message-ID are returned, e.g. of a message that was submitted and
+// delivered to a local recipient.
+func TraceLookup(ctx context.Context, id string) ([]TraceEvent, error) {
+	q := bstore.QueryDB[TraceEvent](ctx, DB)
+	q.FilterNonzero(TraceEvent{TraceID: id})
+	l, err := q.List()
+	if err != nil {
+		return nil, fmt.Errorf("listing events for trace id: %v", err)
+	}
+	if len(l) == 0 {
+		var traceIDs []any
+		seen := map[string]bool{}
+		q := bstore.QueryDB[TraceEvent](ctx, DB)
+		q.FilterNonzero(TraceEvent{MessageID: id})
+		err := q.ForEach(func(e TraceEvent) error {
+			if !seen[e.TraceID] {
+				seen[e.TraceID] = true
+				traceIDs = append(traceIDs, e.TraceID)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("looking up trace ids for message-id: %v", err)
+		}
+		if len(traceIDs) > 0 {
+			q = bstore.QueryDB[TraceEvent](ctx, DB)
+			q.FilterEqual("TraceID", traceIDs...)
+			l, err = q.List()
+			if err != nil {
+				return nil, fmt.Errorf("listing events for trace ids: %v", err)
+			}
+		}
+	}
+	sort.SliceStable(l, func(i, j int) bool {
+		if !l[i].Time.Equal(l[j].Time) {
+			return l[i].Time.Before(l[j].Time)
+		}
+		return l[i].ID < l[j].ID
+	})
+	return l, nil
+}
@@ -0,0 +1,395 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/dsn"
+	"github.com/mjl-/mox/metrics"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/moxvar"
+	"github.com/mjl-/mox/store"
+)
+
+var (
+	metricHook = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mox_queue_webhook_total",
+			Help: "Webhook requests to account endpoints.",
+		},
+		[]string{
+			"result", // "ok", "error", "failed"
+		},
+	)
+)
+
+// Webhook events.
+const (
+	HookIncoming  = "incoming"  // Message delivered to account over SMTP.
+	HookDelivered = "delivered" // Outgoing message delivered to remote.
+	HookDelayed   = "delayed"   // Temporary failure delivering outgoing message, will be retried.
+	HookFailed    = "failed"    // Permanent failure delivering outgoing message.
+)
+
+// Delivery attempts for a webhook request: immediately, then after 1m, 2m, 4m,
+// up to 512m, for a total of about 17 hours.
+const hookMaxAttempts = 11
+
+// Hook is a webhook request to an endpoint of an account, for an event.
+//
+// Requests for the same URL are sent in order of ID: a request is only attempted
+// after all earlier requests for the URL were delivered or failed permanently.
+// Delivered requests are removed. Requests that failed permanently are kept with
+// Failed set, until replayed.
+type Hook struct {
+	ID             int64
+	Created        time.Time `bstore:"default now"`
+	Account        string    `bstore:"nonzero"`
+	URL            string    `bstore:"nonzero,unique URL+IdempotencyKey"`
+	IdempotencyKey string    `bstore:"nonzero"` // Same for all attempts, and for requests for the same event.
+	Event          string    `bstore:"nonzero"`
+	Payload        string    // JSON, a HookEvent.
+	Attempts       int
+	NextAttempt    time.Time
+	LastAttempt    *time.Time
+	LastError      string
+	Failed         bool `bstore:"index"` // No more automatic attempts.
+}
+
+// HookEvent is the JSON body of a webhook request.
+type HookEvent struct {
+	Event     string    // One of the Hook* constants.
+	Time      time.Time // Time of the event.
+	Account   string
+	MailFrom  string // SMTP MAIL FROM, can be empty.
+	Recipient string // SMTP RCPT TO.
+	MsgID     int64  // For incoming messages, the ID of the message in the account. For outgoing messages, the ID in the queue.
+
+	// For incoming messages.
+	Mailbox   string `json:",omitempty"`
+	MessageID string `json:",omitempty"` // Message-ID header.
+	Subject   string `json:",omitempty"`
+	Size      int64  `json:",omitempty"`
+
+	// For outgoing messages.
+	Attempts  int    `json:",omitempty"`
+	RemoteMTA string `json:",omitempty"` // Remote mail server or submission host, if any.
+	Error     string `json:",omitempty"` // For delayed and failed.
+}
+
+var (
+	hookKick   = make(chan struct{}, 1)
+	hookResult = make(chan string, 1)
+)
+
+var hookClient = &http.Client{
+	Timeout: 30 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		// A redirect is treated as failure, endpoints should be configured with their
+		// final URL.
+		return http.ErrUseLastResponse
+	},
+}
+
+func hookkick() {
+	select {
+	case hookKick <- struct{}{}:
+	default:
+	}
+}
+
+// HookList returns all webhook requests not yet delivered.
+func HookList(ctx context.Context) ([]Hook, error) {
+	return bstore.QueryDB[Hook](ctx, DB).List()
+}
+
+// HookReplay schedules a webhook request that failed permanently for
+// immediate delivery again, with its attempts reset. The request is sent before
+// later requests for the same URL.
+func HookReplay(ctx context.Context, id int64) error {
+	err := store.DBWrite(ctx, xlog.WithContext(ctx), "queue", DB, func(tx *bstore.Tx) error {
+		h := Hook{ID: id}
+		if err := tx.Get(&h); err != nil {
+			return fmt.Errorf("get webhook: %w", err)
+		}
+		if !h.Failed {
+			return fmt.Errorf("webhook has not failed")
+		}
+		h.Failed = false
+		h.Attempts = 0
+		h.NextAttempt = time.Now()
+		return tx.Update(&h)
+	})
+	if err == nil {
+		hookkick()
+	}
+	return err
+}
+
+// hookAdd adds webhook requests for an event to the endpoints of the account that
+// want the event. The key identifies the event. If a request with the same key
+// already exists for an endpoint, no new request is added.
+func hookAdd(log *mlog.Log, account, key string, event HookEvent) {
+	conf, ok := mox.Conf.Account(account)
+	if !ok || len(conf.Webhooks) == 0 {
+		return
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Errorx("marshal webhook event", err)
+		return
+	}
+
+	var added bool
+	for _, wh := range conf.Webhooks {
+		if !hookWants(wh, event.Event) {
+			continue
+		}
+		h := Hook{
+			Account:        account,
+			URL:            wh.URL,
+			IdempotencyKey: key,
+			Event:          event.Event,
+			Payload:        string(payload),
+			NextAttempt:    time.Now(),
+		}
+		if err := DB.Insert(context.Background(), &h); errors.Is(err, bstore.ErrUnique) {
+			log.Debug("webhook request for event already present", mlog.Field("key", key), mlog.Field("url", wh.URL))
+		} else if err != nil {
+			log.Errorx("adding webhook request", err, mlog.Field("url", wh.URL))
+		} else {
+			added = true
+		}
+	}
+	if added {
+		hookkick()
+	}
+}
+
+func hookWants(wh config.Webhook, event string) bool {
+	if len(wh.Events) == 0 {
+		return true
+	}
+	for _, ev := range wh.Events {
+		if ev == event {
+			return true
+		}
+	}
+	return false
+}
+
+// HookAddIncoming adds webhook requests for a message delivered to an account.
+func HookAddIncoming(log *mlog.Log, event HookEvent) {
+	event.Event = HookIncoming
+	hookAdd(log, event.Account, fmt.Sprintf("%s-%s-%d", HookIncoming, event.Account, event.MsgID), event)
+}
+
+// hookOutgoing adds webhook requests for a delivery event for a message submitted
+// by an account. For delays, the event is identified by the delivery attempt.
+func hookOutgoing(log *mlog.Log, m Msg, event string, remoteMTA dsn.NameIP, errmsg string) {
+	if m.SenderAccount == "" || m.Sender().IsZero() {
+		// E.g. DSNs, reports and journal copies.
+		return
+	}
+	key := fmt.Sprintf("%s-%d", event, m.ID)
+	if event == HookDelayed {
+		key += fmt.Sprintf("-%d", m.Attempts)
+	}
+	var remote string
+	if remoteMTA.Name != "" {
+		remote = remoteMTA.Name
+	} else if remoteMTA.IP != nil {
+		remote = remoteMTA.IP.String()
+	}
+	hookAdd(log, m.SenderAccount, key, HookEvent{
+		Event:     event,
+		Time:      time.Now(),
+		Account:   m.SenderAccount,
+		MailFrom:  m.Sender().String(),
+		Recipient: m.Recipient().String(),
+		MsgID:     m.ID,
+		Attempts:  m.Attempts,
+		RemoteMTA: remote,
+		Error:     errmsg,
+	})
+}
+
+// startHooks starts delivering webhook requests, one at a time per URL.
+func startHooks() {
+	go func() {
+		busy := map[string]bool{} // URLs with a request in progress.
+		timer := time.NewTimer(0)
+		for {
+			select {
+			case <-mox.Shutdown.Done():
+				return
+			case <-hookKick:
+			case <-timer.C:
+			case u := <-hookResult:
+				delete(busy, u)
+			}
+			timer.Reset(hookLaunch(busy))
+		}
+	}()
+}
+
+// hookLaunch starts delivery of the first pending request of each URL that is
+// not busy and due. It returns the time until the next request is due.
+func hookLaunch(busy map[string]bool) time.Duration {
+	q := bstore.QueryDB[Hook](mox.Shutdown, DB)
+	q.FilterEqual("Failed", false)
+	q.SortAsc("ID")
+	l, err := q.List()
+	if err != nil {
+		xlog.Errorx("listing webhook requests", err)
+		return time.Minute
+	}
+
+	next := 24 * time.Hour
+	now := time.Now()
+	seen := map[string]bool{}
+	for _, h := range l {
+		if seen[h.URL] {
+			continue
+		}
+		seen[h.URL] = true
+		if busy[h.URL] {
+			continue
+		}
+		if d := h.NextAttempt.Sub(now); d > 0 {
+			if d < next {
+				next = d
+			}
+			continue
+		}
+		busy[h.URL] = true
+		go func(h Hook) {
+			defer func() {
+				hookResult <- h.URL
+			}()
+			hookDeliver(h)
+		}(h)
+	}
+	return next
+}
+
+// hookDeliver makes a delivery attempt for a webhook request, removing it when
+// delivered, or updating it for a next attempt or as failed.
+func hookDeliver(h Hook) {
+	log := xlog.WithCid(mox.Cid()).Fields(mlog.Field("hookid", h.ID), mlog.Field("url", h.URL), mlog.Field("event", h.Event), mlog.Field("attempts", h.Attempts))
+
+	defer func() {
+		x := recover()
+		if x != nil {
+			log.Error("webhook delivery panic", mlog.Field("panic", x))
+			debug.PrintStack()
+			metrics.PanicInc("queue")
+		}
+	}()
+
+	h.Attempts++
+	now := time.Now()
+	h.LastAttempt = &now
+
+	var err error
+	var secrets []string
+	conf, _ := mox.Conf.Account(h.Account)
+	for _, wh := range conf.Webhooks {
+		if wh.URL == h.URL {
+			secrets = wh.Secrets
+			break
+		}
+	}
+	if secrets == nil {
+		// Webhook removed from config, or account removed.
+		err = errors.New("webhook no longer configured for account")
+		h.Attempts = hookMaxAttempts
+	} else {
+		ctx, cancel := context.WithTimeout(mox.Shutdown, 30*time.Second)
+		err = hookSend(ctx, h, secrets, now)
+		cancel()
+	}
+
+	if err == nil {
+		log.Info("webhook delivered")
+		metricHook.WithLabelValues("ok").Inc()
+		if err := DB.Delete(context.Background(), &h); err != nil {
+			log.Errorx("removing delivered webhook request", err)
+		}
+		return
+	}
+
+	h.LastError = err.Error()
+	if h.Attempts >= hookMaxAttempts {
+		log.Errorx("webhook delivery failed permanently", err)
+		metricHook.WithLabelValues("failed").Inc()
+		h.Failed = true
+	} else {
+		backoff := time.Minute << (h.Attempts - 1)
+		log.Infox("webhook delivery failed, will retry", err, mlog.Field("backoff", backoff))
+		metricHook.WithLabelValues("error").Inc()
+		h.NextAttempt = now.Add(backoff)
+	}
+	if err := DB.Update(context.Background(), &h); err != nil {
+		log.Errorx("storing webhook delivery attempt", err)
+	}
+}
+
+// hookSend makes the HTTP request for a webhook request. Any response other
+// than a 2xx status code is an error.
+func hookSend(ctx context.Context, h Hook, secrets []string, now time.Time) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", h.URL, bytes.NewReader([]byte(h.Payload)))
+	if err != nil {
+		return fmt.Errorf("new request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mox/"+moxvar.Version)
+	req.Header.Set("Idempotency-Key", h.IdempotencyKey)
+	req.Header.Set("X-Mox-Event", h.Event)
+	req.Header.Set("X-Mox-Attempt", fmt.Sprintf("%d", h.Attempts))
+	req.Header.Set("X-Mox-Signature", hookSignature(secrets, now, []byte(h.Payload)))
+	resp, err := hookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		buf, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("response status %s: %q", resp.Status, buf)
+	}
+	_, err = io.Copy(io.Discard, io.LimitReader(resp.Body, 1024*1024))
+	return err
+}
+
+// hookSignature returns the value for the X-Mox-Signature header: the timestamp
+// and a signature for each secret over the timestamp and body. Multiple
+// signatures allow endpoints to switch to a new secret while the old secret is
+// still configured.
+func hookSignature(secrets []string, t time.Time, body []byte) string {
+	ts := fmt.Sprintf("%d", t.Unix())
+	s := "t=" + ts
+	for _, secret := range secrets {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(ts + "."))
+		mac.Write(body)
+		s += ",v1=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	return s
+}
@@ -22,16 +22,19 @@ import (
 	"github.com/mjl-/mox/dmarcdb"
 	"github.com/mjl-/mox/dns"
 	"github.com/mjl-/mox/dnsbl"
+	"github.com/mjl-/mox/dnsserver"
 	"github.com/mjl-/mox/http"
 	"github.com/mjl-/mox/imapserver"
-	"github.com/mjl-/mox/message"
 	"github.com/mjl-/mox/metrics"
 	"github.com/mjl-/mox/mlog"
 	"github.com/mjl-/mox/mox-"
 	"github.com/mjl-/mox/moxvar"
 	"github.com/mjl-/mox/mtastsdb"
+	"github.com/mjl-/mox/pop3server"
 	"github.com/mjl-/mox/queue"
+	"github.com/mjl-/mox/smtp"
 	"github.com/mjl-/mox/smtpserver"
+	"github.com/mjl-/mox/sqlexport"
 	"github.com/mjl-/mox/store"
 	"github.com/mjl-/mox/tlsrptdb"
 	"github.com/mjl-/mox/updates"
@@ -279,40 +282,21 @@ requested, other TLS certificates are requested on demand.
 			}
 			cl += "----"
 
-			a, err := store.OpenAccount(mox.Conf.Static.Postmaster.Account)
-			if err != nil {
-				log.Infox("open account for postmaster changelog delivery", err)
-				return next
-			}
-			defer func() {
-				err := a.Close()
-				log.Check(err, "closing account")
-			}()
-			f, err := store.CreateMessageTemp("changelog")
-			if err != nil {
-				log.Infox("making temporary message file for changelog delivery", err)
-				return next
-			}
-			defer func() {
-				if f != nil {
-					err := os.Remove(f.Name())
-					log.Check(err, "removing temp changelog file")
-					err = f.Close()
-					log.Check(err, "closing temp changelog file")
-				}
-			}()
-			m := &store.Message{Received: time.Now(), Flags: store.Flags{Flagged: true}}
-			n, err := fmt.Fprintf(f, "Date: %s\r\nSubject: mox %s available\r\n\r\nHi!\r\n\r\nVersion %s of mox is available, this install is at %s.\r\n\r\nChanges:\r\n\r\n%s\r\n\r\nRemember to make a backup with \"mox backup\" before upgrading.\r\nPlease report any issues at https://github.com/mjl-/mox, thanks!\r\n\r\nCheers,\r\nmox\r\n", time.Now().Format(message.RFC5322Z), latest, latest, current, strings.ReplaceAll(cl, "\n", "\r\n"))
-			if err != nil {
-				log.Infox("writing temporary message file for changelog delivery", err)
-				return next
+			postmaster := smtp.Path{Localpart: "postmaster", IPDomain: dns.IPDomain{Domain: mox.Conf.Static.HostnameDomain}}
+			data := append(queue.NotificationHeaders(smtp.Address{Localpart: postmaster.Localpart, Domain: postmaster.IPDomain.Domain}, fmt.Sprintf("mox %s available", latest)), "\r\n"...)
+			data = append(data, fmt.Sprintf("Hi!\r\n\r\nVersion %s of mox is available, this install is at %s.\r\n\r\nChanges:\r\n\r\n%s\r\n\r\nRemember to make a backup with \"mox backup\" before upgrading.\r\nPlease report any issues at https://github.com/mjl-/mox, thanks!\r\n\r\nCheers,\r\nmox\r\n", latest, current, strings.ReplaceAll(cl, "\n", "\r\n"))...)
+			n := queue.Notification{
+				Kind:    "changelog",
+				To:      postmaster,
+				Account: mox.Conf.Static.Postmaster.Account,
+				Mailbox: mox.Conf.Static.Postmaster.Mailbox,
+				Flags:   store.Flags{Flagged: true},
+				Data:    data,
 			}
-			m.Size = int64(n)
-			if err := a.DeliverMailbox(log, mox.Conf.Static.Postmaster.Mailbox, m, f, true); err != nil {
+			if err := queue.Notify(mox.Shutdown, log, n); err != nil {
 				log.Errorx("changelog delivery", err)
 				return next
 			}
-			f = nil
 			log.Info("delivered changelog", mlog.Field("current", current), mlog.Field("lastknown", lastknown), mlog.Field("latest", latest))
 			if err := mox.StoreLastKnown(latest); err != nil {
 				// This will be awkward, we'll keep notifying the postmaster once every 24h...
@@ -584,7 +568,9 @@ func fixperms(log *mlog.Log, workdir, configdir, datadir string, moxuid, moxgid
 func start(mtastsdbRefresher, skipForkExec bool) error {
 	smtpserver.Listen()
 	imapserver.Listen()
+	pop3server.Listen()
 	http.Listen()
+	dnsserver.Listen()
 
 	if !skipForkExec {
 		// If we were just launched as root, fork and exec as unprivileged user, handing
@@ -616,9 +602,16 @@ func start(mtastsdbRefresher, skipForkExec bool) error {
 	}
 
 	store.StartAuthCache()
+	store.StartSweeper()
+	store.StartExpirer()
+	store.StartAccountPurger()
+	store.StartMessageArchiver()
+	sqlexport.Start()
 	smtpserver.Serve()
 	imapserver.Serve()
+	pop3server.Serve()
 	http.Serve()
+	dnsserver.Serve()
 
 	go func() {
 		<-store.Switchboard()
@@ -41,6 +41,12 @@ var (
 			"secode",
 		},
 	)
+	metricPipelinedRoundtrips = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mox_smtpclient_pipelined_roundtrips_saved_total",
+			Help: "Number of round trips saved by sending multiple SMTP commands in a single group with PIPELINING.",
+		},
+	)
 )
 
 var (
@@ -52,6 +58,8 @@ var (
 	ErrTLS                 = errors.New("tls error")                                               // E.g. handshake failure, or hostname validation was required and failed.
 	ErrBotched             = errors.New("smtp connection is botched")                              // Set on a client, and returned for new operations, after an i/o error or malformed SMTP response.
 	ErrClosed              = errors.New("client is closed")
+
+	ErrBinaryMIMEUnsupported = errors.New("remote smtp server does not implement binarymime and chunking extensions, required by message")
 )
 
 // TLSMode indicates if TLS must, should or must not be used.
@@ -101,6 +109,8 @@ type Client struct {
 	extSize           bool     // Remote server supports SIZE parameter.
 	maxSize           int64    // Max size of email message.
 	extPipelining     bool     // Remote server supports command pipelining.
+	extChunking       bool     // Remote server supports BDAT instead of DATA.
+	extBinaryMIME     bool     // Remote server supports BODY=BINARYMIME, with CHUNKING.
 	extSMTPUTF8       bool     // Remote server supports SMTPUTF8 extension.
 	extAuthMechanisms []string // Supported authentication mechanisms.
 }
@@ -496,6 +506,10 @@ func (c *Client) hello(ctx context.Context, tlsMode TLSMode, ourHostname, remote
 		default:
 			c.xerrorf(code/100 == 5, code, "", lastLine, "%w: expected 250, got %d", ErrStatus, code)
 		}
+		// The extensions from an EHLO after STARTTLS replace those announced earlier, we
+		// must not pipeline if remote only announced PIPELINING before TLS. ../rfc/3207
+		c.extStartTLS, c.extEcodes, c.ext8bitmime, c.extPipelining = false, false, false, false
+		c.extSMTPUTF8, c.extSize, c.maxSize, c.extAuthMechanisms, c.extChunking, c.extBinaryMIME = false, false, 0, nil, false, false
 		for _, s := range remains[1:] {
 			// ../rfc/5321:1869
 			s = strings.ToUpper(strings.TrimSpace(s))
@@ -508,6 +522,10 @@ func (c *Client) hello(ctx context.Context, tlsMode TLSMode, ourHostname, remote
 				c.ext8bitmime = true
 			case "PIPELINING":
 				c.extPipelining = true
+			case "CHUNKING":
+				c.extChunking = true
+			case "BINARYMIME":
+				c.extBinaryMIME = true
 			default:
 				// For SMTPUTF8 we must ignore any parameter. ../rfc/6531:207
 				if s == "SMTPUTF8" || strings.HasPrefix(s, "SMTPUTF8 ") {
@@ -696,6 +714,31 @@ func (c *Client) SupportsSMTPUTF8() bool {
 	return c.extSMTPUTF8
 }
 
+// SupportsBinaryMIME returns whether the SMTP server supports the BINARYMIME
+// extension, with the CHUNKING extension it requires, needed for sending messages
+// with binary parts.
+func (c *Client) SupportsBinaryMIME() bool {
+	return c.extBinaryMIME && c.extChunking
+}
+
+// TLSEnabled returns whether the connection to the SMTP server is protected with
+// TLS, either through STARTTLS or immediate TLS.
+func (c *Client) TLSEnabled() bool {
+	_, ok := c.conn.(*tls.Conn)
+	return ok
+}
+
+// TLSVersion returns the negotiated TLS version of the connection, e.g.
+// "TLS1.3", or an empty string if the connection is not protected with TLS.
+func (c *Client) TLSVersion() string {
+	tlsc, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	version, _ := mox.TLSInfo(tlsc)
+	return version
+}
+
 // Deliver attempts to deliver a message to a mail server.
 //
 // mailFrom must be an email address, or empty in case of a DSN. rcptTo must be
@@ -710,23 +753,42 @@ func (c *Client) SupportsSMTPUTF8() bool {
 // the remote server must support the SMTPUTF8 extension or delivery will fail.
 //
 // Deliver uses the following SMTP extensions if the remote server supports them:
-// 8BITMIME, SMTPUTF8, SIZE, PIPELINING, ENHANCEDSTATUSCODES, STARTTLS.
+// 8BITMIME, SMTPUTF8, SIZE, PIPELINING, CHUNKING, ENHANCEDSTATUSCODES, STARTTLS.
 //
 // Returned errors can be of type Error, one of the Err-variables in this package
 // or other underlying errors, e.g. for i/o. Use errors.Is to check.
 func (c *Client) Deliver(ctx context.Context, mailFrom string, rcptTo string, msgSize int64, msg io.Reader, req8bitmime, reqSMTPUTF8 bool) (rerr error) {
+	return c.deliver(ctx, mailFrom, rcptTo, msgSize, msg, req8bitmime, reqSMTPUTF8, false)
+}
+
+// DeliverBinary is like Deliver, but for a message that may contain binary
+// parts. The message is sent with BODY=BINARYMIME. The remote server must
+// support the BINARYMIME and CHUNKING extensions, otherwise
+// ErrBinaryMIMEUnsupported is returned, see SupportsBinaryMIME. ../rfc/3030
+func (c *Client) DeliverBinary(ctx context.Context, mailFrom string, rcptTo string, msgSize int64, msg io.Reader, reqSMTPUTF8 bool) (rerr error) {
+	// BINARYMIME implies 8-bit data, 8BITMIME is not required.
+	return c.deliver(ctx, mailFrom, rcptTo, msgSize, msg, false, reqSMTPUTF8, true)
+}
+
+func (c *Client) deliver(ctx context.Context, mailFrom string, rcptTo string, msgSize int64, msg io.Reader, req8bitmime, reqSMTPUTF8, reqBinaryMIME bool) (rerr error) {
 	defer c.recover(&rerr)
 
+	// With PIPELINING, the RSET is sent in the same group as the other commands.
+	rset := c.needRset && c.extPipelining
 	if c.origConn == nil {
 		return ErrClosed
 	} else if c.botched {
 		return ErrBotched
-	} else if c.needRset {
+	} else if c.needRset && !rset {
 		if err := c.Reset(); err != nil {
 			return err
 		}
 	}
 
+	if reqBinaryMIME && !c.SupportsBinaryMIME() {
+		// The caller should have checked, and converted the message.
+		c.xerrorf(false, 0, "", "", "%w", ErrBinaryMIMEUnsupported)
+	}
 	if !c.ext8bitmime && req8bitmime {
 		// Temporary error, e.g. OpenBSD spamd does not announce 8bitmime support, but once
 		// you get through, the mail server behind it probably does. Just needs a few
@@ -746,7 +808,10 @@ func (c *Client) Deliver(ctx context.Context, mailFrom string, rcptTo string, ms
 	if c.extSize {
 		mailSize = fmt.Sprintf(" SIZE=%d", msgSize)
 	}
-	if c.ext8bitmime {
+	if reqBinaryMIME {
+		// ../rfc/3030
+		bodyType = " BODY=BINARYMIME"
+	} else if c.ext8bitmime {
 		if req8bitmime {
 			bodyType = " BODY=8BITMIME"
 		} else {
@@ -763,6 +828,7 @@ func (c *Client) Deliver(ctx context.Context, mailFrom string, rcptTo string, ms
 	// MAIL FROM: ../rfc/5321:1879
 	// RCPT TO: ../rfc/5321:1916
 	// DATA: ../rfc/5321:1992
+	// BDAT, instead of DATA: ../rfc/3030
 	lineMailFrom := fmt.Sprintf("MAIL FROM:<%s>%s%s%s", mailFrom, mailSize, bodyType, smtputf8Arg)
 	lineRcptTo := fmt.Sprintf("RCPT TO:<%s>", rcptTo)
 
@@ -770,13 +836,37 @@ func (c *Client) Deliver(ctx context.Context, mailFrom string, rcptTo string, ms
 	c.needRset = true
 
 	if c.extPipelining {
-		c.cmds = []string{"mailfrom", "rcptto", "data"}
+		// All commands are sent in a single group, a single round trip instead of one
+		// per command. RSET and MAIL FROM can be followed by other commands, DATA must be
+		// last in the group. ../rfc/2920
+		c.cmds = []string{"mailfrom", "rcptto"}
+		if !c.extChunking {
+			c.cmds = append(c.cmds, "data")
+		}
+		if rset {
+			c.cmds = append([]string{"rset"}, c.cmds...)
+		}
 		c.cmdStart = time.Now()
 		// todo future: write in a goroutine to prevent potential deadlock if remote does not consume our writes before expecting us to read. could potentially happen with greylisting and a small tcp send window?
+		if rset {
+			c.xbwriteline("RSET")
+		}
 		c.xbwriteline(lineMailFrom)
 		c.xbwriteline(lineRcptTo)
-		c.xbwriteline("DATA")
+		if !c.extChunking {
+			c.xbwriteline("DATA")
+		}
 		c.xflush()
+		metricPipelinedRoundtrips.Add(float64(len(c.cmds) - 1))
+
+		if rset {
+			code, secode, lastline, _ := c.xread()
+			if code != smtp.C250Completed {
+				// The responses to the other commands are still pending, we cannot continue
+				// with this connection.
+				c.xbotchf(code, secode, lastline, "%w: got %d, expected 2xx", ErrStatus, code)
+			}
+		}
 
 		// We read the response to RCPT TO and DATA without panic on read error. Servers
 		// may be aborting the connection after a failed MAIL FROM, e.g. outlook when it
@@ -786,7 +876,12 @@ func (c *Client) Deliver(ctx context.Context, mailFrom string, rcptTo string, ms
 
 		mfcode, mfsecode, mflastline, _ := c.xread()
 		rtcode, rtsecode, rtlastline, _, rterr := c.read()
-		datacode, datasecode, datalastline, _, dataerr := c.read()
+		var datacode int
+		var datasecode, datalastline string
+		var dataerr error
+		if !c.extChunking {
+			datacode, datasecode, datalastline, _, dataerr = c.read()
+		}
 
 		if mfcode != smtp.C250Completed {
 			c.xerrorf(mfcode/100 == 5, mfcode, mfsecode, mflastline, "%w: got %d, expected 2xx", ErrStatus, mfcode)
@@ -800,7 +895,7 @@ func (c *Client) Deliver(ctx context.Context, mailFrom string, rcptTo string, ms
 		if dataerr != nil {
 			panic(dataerr)
 		}
-		if datacode != smtp.C354Continue {
+		if !c.extChunking && datacode != smtp.C354Continue {
 			c.xerrorf(datacode/100 == 5, datacode, datasecode, datalastline, "%w: got %d, expected 354", ErrStatus, datacode)
 		}
 	} else {
@@ -820,24 +915,30 @@ func (c *Client) Deliver(ctx context.Context, mailFrom string, rcptTo string, ms
 			c.xerrorf(code/100 == 5, code, secode, lastline, "%w: got %d, expected 2xx", ErrStatus, code)
 		}
 
-		c.cmds[0] = "data"
-		c.cmdStart = time.Now()
-		c.xwriteline("DATA")
-		code, secode, lastline, _ = c.xread()
-		if code != smtp.C354Continue {
-			c.xerrorf(code/100 == 5, code, secode, lastline, "%w: got %d, expected 354", ErrStatus, code)
+		if !c.extChunking {
+			c.cmds[0] = "data"
+			c.cmdStart = time.Now()
+			c.xwriteline("DATA")
+			code, secode, lastline, _ = c.xread()
+			if code != smtp.C354Continue {
+				c.xerrorf(code/100 == 5, code, secode, lastline, "%w: got %d, expected 354", ErrStatus, code)
+			}
 		}
 	}
 
-	// For a DATA write, the suggested timeout is 3 minutes, we use 30 seconds for all
-	// writes through timeoutWriter. ../rfc/5321:3651
-	defer c.xtrace(mlog.LevelTracedata)()
-	err := smtp.DataWrite(c.w, msg)
-	if err != nil {
-		c.xbotchf(0, "", "", "writing message as smtp data: %w", err)
+	if c.extChunking {
+		c.xbdat(msg)
+	} else {
+		// For a DATA write, the suggested timeout is 3 minutes, we use 30 seconds for all
+		// writes through timeoutWriter. ../rfc/5321:3651
+		defer c.xtrace(mlog.LevelTracedata)()
+		err := smtp.DataWrite(c.w, msg)
+		if err != nil {
+			c.xbotchf(0, "", "", "writing message as smtp data: %w", err)
+		}
+		c.xflush()
+		c.xtrace(mlog.LevelTrace) // Restore.
 	}
-	c.xflush()
-	c.xtrace(mlog.LevelTrace) // Restore.
 	code, secode, lastline, _ := c.xread()
 	if code != smtp.C250Completed {
 		c.xerrorf(code/100 == 5, code, secode, lastline, "%w: got %d, expected 2xx", ErrStatus, code)
@@ -847,6 +948,43 @@ func (c *Client) Deliver(ctx context.Context, mailFrom string, rcptTo string, ms
 	return
 }
 
+// Size of chunks for BDAT. A variable for tests.
+var bdatChunkSize = 1024 * 1024
+
+// xbdat writes msg in BDAT chunks, without dot-stuffing. The response to each
+// chunk except the last is read, the caller reads the response to the last chunk.
+// ../rfc/3030
+func (c *Client) xbdat(msg io.Reader) {
+	buf := make([]byte, bdatChunkSize)
+	for {
+		n, err := io.ReadFull(msg, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			c.xbotchf(0, "", "", "reading message for bdat: %w", err)
+		}
+
+		c.cmds = []string{"bdat"}
+		c.cmdStart = time.Now()
+		if last {
+			c.xbwritelinef("BDAT %d LAST", n)
+		} else {
+			c.xbwritelinef("BDAT %d", n)
+		}
+		restore := c.xtrace(mlog.LevelTracedata)
+		if _, err := c.w.Write(buf[:n]); err != nil {
+			c.xbotchf(0, "", "", "writing bdat chunk: %w", err)
+		}
+		restore()
+		if last {
+			return
+		}
+		code, secode, lastline, _ := c.xread()
+		if code != smtp.C250Completed {
+			c.xerrorf(code/100 == 5, code, secode, lastline, "%w: got %d, expected 2xx", ErrStatus, code)
+		}
+	}
+}
+
 // Reset sends an SMTP RSET command to reset the message transaction state. Deliver
 // automatically sends it if needed.
 func (c *Client) Reset() (rerr error) {
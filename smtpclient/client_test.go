@@ -17,6 +17,7 @@ import (
 	"math/big"
 	"net"
 	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -43,12 +44,15 @@ func TestClient(t *testing.T) {
 		starttls     bool
 		eightbitmime bool
 		smtputf8     bool
+		chunking     bool
+		binarymime   bool
 		ehlo         bool
 
 		tlsMode      TLSMode
 		tlsHostname  dns.Domain
 		need8bitmime bool
 		needsmtputf8 bool
+		needbinary   bool     // Deliver with BODY=BINARYMIME.
 		auths        []string // Allowed mechanisms.
 
 		nodeliver bool // For server, whether client will attempt a delivery.
@@ -146,6 +150,12 @@ func TestClient(t *testing.T) {
 				if opts.smtputf8 {
 					writeline("250-SMTPUTF8")
 				}
+				if opts.chunking {
+					writeline("250-CHUNKING")
+				}
+				if opts.binarymime {
+					writeline("250-BINARYMIME")
+				}
 				if opts.auths != nil {
 					writeline("250-AUTH " + strings.Join(opts.auths, " "))
 				}
@@ -228,30 +238,51 @@ func TestClient(t *testing.T) {
 				}
 			}
 
-			if expClientErr == nil && !opts.nodeliver {
-				readline("MAIL FROM:")
+			readdata := func() {
+				if !opts.chunking {
+					readline("DATA")
+					writeline("354 continue")
+					reader := smtp.NewDataReader(br)
+					io.Copy(io.Discard, reader)
+					writeline("250 ok")
+					return
+				}
+				for {
+					t := strings.Split(readline("BDAT "), " ")
+					size, err := strconv.ParseInt(t[0], 10, 64)
+					if err != nil || len(t) > 2 || len(t) == 2 && t[1] != "LAST" {
+						fail("bad bdat command %q", t)
+					}
+					io.CopyN(io.Discard, br, size)
+					writeline("250 ok")
+					if len(t) == 2 {
+						return
+					}
+				}
+			}
+
+			readmailfrom := func() {
+				s := readline("MAIL FROM:")
+				if opts.needbinary != strings.HasSuffix(s, " BODY=BINARYMIME") {
+					fail("mail from %q, expected binarymime %v", s, opts.needbinary)
+				}
 				writeline("250 ok")
+			}
+
+			if expClientErr == nil && !opts.nodeliver {
+				readmailfrom()
 				readline("RCPT TO:")
 				writeline("250 ok")
-				readline("DATA")
-				writeline("354 continue")
-				reader := smtp.NewDataReader(br)
-				io.Copy(io.Discard, reader)
-				writeline("250 ok")
+				readdata()
 
 				if expDeliverErr == nil {
 					readline("RSET")
 					writeline("250 ok")
 
-					readline("MAIL FROM:")
-					writeline("250 ok")
+					readmailfrom()
 					readline("RCPT TO:")
 					writeline("250 ok")
-					readline("DATA")
-					writeline("354 continue")
-					reader = smtp.NewDataReader(br)
-					io.Copy(io.Discard, reader)
-					writeline("250 ok")
+					readdata()
 				}
 			}
 
@@ -279,16 +310,25 @@ func TestClient(t *testing.T) {
 				result <- nil
 				return
 			}
-			err = c.Deliver(ctx, "postmaster@mox.example", "mjl@mox.example", int64(len(msg)), strings.NewReader(msg), opts.need8bitmime, opts.needsmtputf8)
+			deliver := func() error {
+				if opts.needbinary {
+					return c.DeliverBinary(ctx, "postmaster@mox.example", "mjl@mox.example", int64(len(msg)), strings.NewReader(msg), opts.needsmtputf8)
+				}
+				return c.Deliver(ctx, "postmaster@mox.example", "mjl@mox.example", int64(len(msg)), strings.NewReader(msg), opts.need8bitmime, opts.needsmtputf8)
+			}
+			err = deliver()
 			if (err == nil) != (expDeliverErr == nil) || err != nil && !errors.Is(err, expDeliverErr) {
 				fail("first deliver: got err %v, expected %v", err, expDeliverErr)
 			}
+			if v := c.TLSVersion(); (v != "") != c.TLSEnabled() || v != "" && !strings.HasPrefix(v, "TLS1.") {
+				fail("got tls version %q with tls enabled %v", v, c.TLSEnabled())
+			}
 			if err == nil {
 				err = c.Reset()
 				if err != nil {
 					fail("reset: %v", err)
 				}
-				err = c.Deliver(ctx, "postmaster@mox.example", "mjl@mox.example", int64(len(msg)), strings.NewReader(msg), opts.need8bitmime, opts.needsmtputf8)
+				err = deliver()
 				if (err == nil) != (expDeliverErr == nil) || err != nil && !errors.Is(err, expDeliverErr) {
 					fail("second deliver: got err %v, expected %v", err, expDeliverErr)
 				}
@@ -337,6 +377,13 @@ test
 	test(msg, options{}, nil, nil, nil, nil)
 	test(msg, allopts, nil, nil, nil, nil)
 	test(msg, options{ehlo: true, eightbitmime: true}, nil, nil, nil, nil)
+	test(msg, options{ehlo: true, chunking: true}, nil, nil, nil, nil)
+	bdatChunkSize = 16 // Message in multiple chunks.
+	test(msg, options{ehlo: true, pipelining: true, chunking: true}, nil, nil, nil, nil)
+	test(msg[:32], options{ehlo: true, chunking: true}, nil, nil, nil, nil) // Empty last chunk.
+	bdatChunkSize = 1024 * 1024
+	test(msg, options{ehlo: true, chunking: true, binarymime: true, needbinary: true}, nil, nil, nil, nil)
+	test(msg, options{ehlo: true, binarymime: true, needbinary: true, nodeliver: true}, nil, nil, ErrBinaryMIMEUnsupported, nil) // BINARYMIME requires CHUNKING.
 	test(msg, options{ehlo: true, eightbitmime: false, need8bitmime: true, nodeliver: true}, nil, nil, Err8bitmimeUnsupported, nil)
 	test(msg, options{ehlo: true, smtputf8: false, needsmtputf8: true, nodeliver: true}, nil, nil, ErrSMTPUTF8Unsupported, nil)
 	test(msg, options{ehlo: true, starttls: true, tlsMode: TLSStrictStartTLS, tlsHostname: dns.Domain{ASCII: "mismatch.example"}, nodeliver: true}, nil, ErrTLS, nil, &net.OpError{}) // Server TLS handshake is a net.OpError with "remote error" as text.
@@ -440,6 +487,9 @@ func TestErrors(t *testing.T) {
 		if err != nil {
 			panic(err)
 		}
+		if c.extPipelining {
+			panic("pipelining still enabled after starttls")
+		}
 		msg := ""
 		err = c.Deliver(ctx, "postmaster@other.example", "mjl@mox.example", int64(len(msg)), strings.NewReader(msg), false, false)
 		var xerr Error
@@ -610,6 +660,84 @@ func TestErrors(t *testing.T) {
 			panic(fmt.Errorf("got %#v, expected ErrStatus with Permanent", err))
 		}
 	})
+
+	// With pipelining, the RSET after a failed transaction is sent in the same group
+	// as the commands for the next transaction. The server only responds after
+	// reading all commands.
+	run(t, func(s xserver) {
+		s.writeline("220 mox.example")
+		s.readline("EHLO")
+		s.writeline("250-mox.example")
+		s.writeline("250 PIPELINING")
+		s.readline("MAIL FROM:")
+		s.readline("RCPT TO:")
+		s.readline("DATA")
+		s.writeline("250 ok")
+		s.writeline("550 no such user")
+		s.writeline("503 no valid recipients")
+
+		s.readline("RSET")
+		s.readline("MAIL FROM:")
+		s.readline("RCPT TO:")
+		s.readline("DATA")
+		s.writeline("250 ok")
+		s.writeline("250 ok")
+		s.writeline("250 ok")
+		s.writeline("354 continue")
+		s.readline(".")
+		s.writeline("250 ok")
+	}, func(conn net.Conn) {
+		c, err := New(ctx, log, conn, TLSOpportunistic, localhost, zerohost, nil)
+		if err != nil {
+			panic(err)
+		}
+
+		msg := ""
+		err = c.Deliver(ctx, "postmaster@other.example", "unknown@mox.example", int64(len(msg)), strings.NewReader(msg), false, false)
+		var xerr Error
+		if err == nil || !errors.Is(err, ErrStatus) || !errors.As(err, &xerr) || !xerr.Permanent {
+			panic(fmt.Errorf("got %#v, expected ErrStatus with Permanent", err))
+		}
+
+		err = c.Deliver(ctx, "postmaster@other.example", "mjl@mox.example", int64(len(msg)), strings.NewReader(msg), false, false)
+		if err != nil {
+			panic(fmt.Errorf("second delivery: %v", err))
+		}
+	})
+
+	// Extensions announced before STARTTLS are not used after TLS if they are not
+	// announced again.
+	run(t, func(s xserver) {
+		s.writeline("220 mox.example")
+		s.readline("EHLO")
+		s.writeline("250-mox.example")
+		s.writeline("250-PIPELINING")
+		s.writeline("250 STARTTLS")
+		s.readline("STARTTLS")
+		s.writeline("220 go")
+		tlsConn := tls.Server(s.conn, &tls.Config{Certificates: []tls.Certificate{fakeCert(t, false)}})
+		s = xserver{tlsConn, bufio.NewReader(tlsConn)}
+		s.readline("EHLO")
+		s.writeline("250 mox.example")
+		s.readline("MAIL FROM:")
+		s.writeline("250 ok")
+		s.readline("RCPT TO:")
+		s.writeline("250 ok")
+		s.readline("DATA")
+		s.writeline("354 continue")
+		s.readline(".")
+		s.writeline("250 ok")
+	}, func(conn net.Conn) {
+		c, err := New(ctx, log, conn, TLSOpportunistic, localhost, zerohost, nil)
+		if err != nil {
+			panic(err)
+		}
+		msg := ""
+		err = c.Deliver(ctx, "postmaster@other.example", "mjl@mox.example", int64(len(msg)), strings.NewReader(msg), false, false)
+		if err != nil {
+			panic(fmt.Errorf("delivery: %v", err))
+		}
+	})
 }
 
 type xserver struct {
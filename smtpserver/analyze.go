@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/mjl-/bstore"
@@ -15,6 +17,7 @@ import (
 	"github.com/mjl-/mox/dns"
 	"github.com/mjl-/mox/dnsbl"
 	"github.com/mjl-/mox/iprev"
+	"github.com/mjl-/mox/junk"
 	"github.com/mjl-/mox/mlog"
 	"github.com/mjl-/mox/mox-"
 	"github.com/mjl-/mox/smtp"
@@ -88,8 +91,17 @@ func analyze(ctx context.Context, log *mlog.Log, resolver dns.Resolver, d delive
 		}
 	}
 
+	var dmarcOverride bool
 	if d.dmarcUse && d.dmarcResult.Reject {
-		return reject(smtp.C550MailboxUnavail, smtp.SePol7MultiAuthFails26, "rejecting per dmarc policy", nil, reasonDMARCPolicy)
+		// Forwarders can break DMARC for the original From domain. If the administrator
+		// marked the forwarder as trusted, we continue with the reputation-based
+		// analysis instead of rejecting.
+		if o, ok := mox.DMARCOverrideMatch(net.ParseIP(d.m.RemoteIP), d.dkimResults); ok {
+			dmarcOverride = true
+			log.Info("not rejecting per dmarc policy due to dmarc override", mlog.Field("override", o.Name), mlog.Field("fromdomain", d.msgFrom.Domain), mlog.Field("remoteip", d.m.RemoteIP))
+		} else {
+			return reject(smtp.C550MailboxUnavail, smtp.SePol7MultiAuthFails26, "rejecting per dmarc policy", nil, reasonDMARCPolicy)
+		}
 	}
 	// todo: should we also reject messages that have a dmarc pass but an spf record "v=spf1 -all"? suggested by m3aawg best practices.
 
@@ -161,7 +173,7 @@ func analyze(ctx context.Context, log *mlog.Log, resolver dns.Resolver, d delive
 	var reason string
 	var err error
 	d.acc.WithRLock(func() {
-		err = d.acc.DB.Read(ctx, func(tx *bstore.Tx) error {
+		err = store.DBRead(ctx, log, "smtpserver", d.acc.DB, func(tx *bstore.Tx) error {
 			// Set message MailboxID to which mail will be delivered. Reputation is
 			// per-mailbox. If referenced mailbox is not found (e.g. does not yet exist), we
 			// can still determine a reputation because we also base it on outgoing
@@ -173,6 +185,10 @@ func analyze(ctx context.Context, log *mlog.Log, resolver dns.Resolver, d delive
 			if rs != nil {
 				mailbox = rs.Mailbox
 			}
+			mailbox, err := d.acc.DeliveryMailbox(tx, mailbox)
+			if err != nil {
+				return err
+			}
 			mb, err := d.acc.MailboxFind(tx, mailbox)
 			if err != nil {
 				return fmt.Errorf("finding destination mailbox: %w", err)
@@ -211,11 +227,15 @@ func analyze(ctx context.Context, log *mlog.Log, resolver dns.Resolver, d delive
 		return analysis{accept: true, dmarcReport: dmarcReport, tlsReport: tlsReport, reason: reasonReporting}
 	}
 	// If there was no previous message from sender or its domain, and we have an SPF
-	// (soft)fail, reject the message.
+	// (soft)fail, reject the message. Except for messages from trusted forwarders,
+	// they typically fail SPF for the original sender.
 	switch method {
 	case methodDKIMSPF, methodIP1, methodIP2, methodIP3, methodNone:
 		switch d.m.MailFromValidation {
 		case store.ValidationFail, store.ValidationSoftfail:
+			if dmarcOverride {
+				break
+			}
 			return reject(smtp.C451LocalErr, smtp.SeSys3Other0, "error processing", nil, reasonSPFPolicy)
 		}
 	}
@@ -279,6 +299,11 @@ func analyze(ctx context.Context, log *mlog.Log, resolver dns.Resolver, d delive
 			threshold = 0.25
 			log.Info("setting junk threshold due to iprev fail", mlog.Field("threshold", 0.25))
 			reason = reasonJunkContentStrict
+		} else if method == methodCorrespondent && isjunk != nil && !*isjunk {
+			// Known correspondent without verified From address, we allow more junk-like
+			// content.
+			threshold += (1 - threshold) / 2
+			log.Info("setting junk threshold for correspondent", mlog.Field("threshold", threshold))
 		}
 		accept = contentProb <= threshold
 		junkSubjectpass = contentProb < threshold-0.2
@@ -335,3 +360,54 @@ func analyze(ctx context.Context, log *mlog.Log, resolver dns.Resolver, d delive
 
 	return reject(smtp.C451LocalErr, smtp.SeSys3Other0, "error processing", nil, reason)
 }
+
+// junkScoreHeader returns an X-Mox-Junk header for the message with the spam
+// probability according to the junk filter of the account, and the word
+// (combinations) that contributed most, to be added to the message on delivery
+// for accounts with JunkFilter.ScoreHeader set. An empty string is returned if
+// the account has no junk filter, or the message could not be classified.
+func junkScoreHeader(ctx context.Context, log *mlog.Log, d delivery) string {
+	f, _, err := d.acc.OpenJunkFilter(ctx, log)
+	if err != nil {
+		if err != store.ErrNoJunkFilter {
+			log.Errorx("open junkfilter for score header", err)
+		}
+		return ""
+	}
+	defer func() {
+		err := f.Close()
+		log.Check(err, "closing junkfilter")
+	}()
+
+	prob, words, _, _, err := f.ClassifyMessageReader(ctx, store.FileMsgReader(d.m.MsgPrefix, d.dataFile), d.m.Size)
+	if err != nil {
+		log.Errorx("classifying message for junk score header", err)
+		return ""
+	}
+	var topHam, topSpam []junk.TopWord
+	if words != nil {
+		prob, topHam, topSpam, err = f.ClassifyWordsTop(ctx, words)
+		if err != nil {
+			log.Errorx("classifying words for junk score header", err)
+			return ""
+		}
+	}
+
+	// Words are quoted as ASCII, keeping the header 7-bit. Each list goes on its own
+	// (folded) line.
+	format := func(l []junk.TopWord) string {
+		var s []string
+		for _, w := range l {
+			s = append(s, fmt.Sprintf("%s:%.3f", strconv.QuoteToASCII(w.Word), w.R))
+		}
+		return strings.Join(s, ",")
+	}
+	h := fmt.Sprintf("X-Mox-Junk: probability=%.3f", prob)
+	if len(topSpam) > 0 {
+		h += ";\r\n\tspam=" + format(topSpam)
+	}
+	if len(topHam) > 0 {
+		h += ";\r\n\tham=" + format(topHam)
+	}
+	return h + "\r\n"
+}
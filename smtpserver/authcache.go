@@ -0,0 +1,186 @@
+package smtpserver
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/spf"
+)
+
+var (
+	metricAuthCache = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mox_smtpserver_authcache_lookup_total",
+			Help: "Lookups in the cache of SPF evaluations and DKIM/DMARC DNS records for incoming messages.",
+		},
+		[]string{
+			"kind",   // "spf", "dkim", "dmarc"
+			"result", // "hit", "miss"
+		},
+	)
+)
+
+// authCache holds results for one kind of lookup, with a fixed TTL. When full,
+// the oldest entries are removed first.
+type authCache struct {
+	kind       string
+	ttl        time.Duration
+	maxEntries int
+
+	sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // Of *authCacheEntry, oldest at front.
+}
+
+type authCacheEntry struct {
+	key     string
+	expires time.Time
+	value   any
+}
+
+func newAuthCache(kind string, ttl time.Duration, maxEntries int) *authCache {
+	if ttl <= 0 {
+		ttl = 5 * time.Minute
+	}
+	if maxEntries <= 0 {
+		maxEntries = 10000
+	}
+	return &authCache{kind: kind, ttl: ttl, maxEntries: maxEntries, entries: map[string]*list.Element{}, order: list.New()}
+}
+
+func (ac *authCache) get(key string, now time.Time) (any, bool) {
+	ac.Lock()
+	defer ac.Unlock()
+	e, ok := ac.entries[key]
+	if ok && now.Before(e.Value.(*authCacheEntry).expires) {
+		metricAuthCache.WithLabelValues(ac.kind, "hit").Inc()
+		return e.Value.(*authCacheEntry).value, true
+	}
+	if ok {
+		ac.order.Remove(e)
+		delete(ac.entries, key)
+	}
+	metricAuthCache.WithLabelValues(ac.kind, "miss").Inc()
+	return nil, false
+}
+
+func (ac *authCache) put(key string, value any, now time.Time) {
+	ac.Lock()
+	defer ac.Unlock()
+	if e, ok := ac.entries[key]; ok {
+		ac.order.Remove(e)
+		delete(ac.entries, key)
+	}
+	for len(ac.entries) >= ac.maxEntries {
+		e := ac.order.Front()
+		ac.order.Remove(e)
+		delete(ac.entries, e.Value.(*authCacheEntry).key)
+	}
+	ac.entries[key] = ac.order.PushBack(&authCacheEntry{key, now.Add(ac.ttl), value})
+}
+
+// The caches, shared by all listeners. Nil if AuthCache is not configured.
+var authCaches struct {
+	sync.Mutex
+	spf, dkim, dmarc *authCache
+}
+
+// authCachesGet returns the caches, initializing them on first use. Nil values are
+// returned if caching is not enabled.
+func authCachesGet() (spfCache, dkimCache, dmarcCache *authCache) {
+	conf := mox.Conf.Static.AuthCache
+	if conf == nil {
+		return nil, nil, nil
+	}
+	authCaches.Lock()
+	defer authCaches.Unlock()
+	if authCaches.spf == nil {
+		authCaches.spf = newAuthCache("spf", conf.TTL, conf.MaxEntries)
+		authCaches.dkim = newAuthCache("dkim", conf.TTL, conf.MaxEntries)
+		authCaches.dmarc = newAuthCache("dmarc", conf.TTL, conf.MaxEntries)
+	}
+	return authCaches.spf, authCaches.dkim, authCaches.dmarc
+}
+
+// cacheResolver caches TXT lookups for DKIM public keys and DMARC policies,
+// including lookups for names that do not exist. Other lookups are passed on.
+type cacheResolver struct {
+	dns.Resolver
+	dkim, dmarc *authCache
+}
+
+type txtResult struct {
+	txt []string
+	err error // Only "not found" errors, other errors are not cached.
+}
+
+func (r cacheResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	var ac *authCache
+	lname := strings.ToLower(name)
+	if strings.Contains(lname, "._domainkey.") {
+		ac = r.dkim
+	} else if strings.HasPrefix(lname, "_dmarc.") {
+		ac = r.dmarc
+	}
+	if ac == nil {
+		return r.Resolver.LookupTXT(ctx, name)
+	}
+
+	now := time.Now()
+	if v, ok := ac.get(lname, now); ok {
+		res := v.(txtResult)
+		return res.txt, res.err
+	}
+	txt, err := r.Resolver.LookupTXT(ctx, name)
+	if err == nil || dns.IsNotFound(err) {
+		ac.put(lname, txtResult{txt, err}, now)
+	}
+	return txt, err
+}
+
+type spfResult struct {
+	received    spf.Received
+	domain      dns.Domain
+	explanation string
+	err         error
+}
+
+// spfVerify evaluates SPF, using the cache if enabled. Results with temporary
+// errors are not cached.
+func spfVerify(ctx context.Context, resolver dns.Resolver, args spf.Args) (spf.Received, dns.Domain, string, error) {
+	spfCache, _, _ := authCachesGet()
+	if spfCache == nil {
+		return spf.Verify(ctx, resolver, args)
+	}
+
+	key := fmt.Sprintf("%s %s@%s %s %s %s", args.RemoteIP, args.MailFromLocalpart, args.MailFromDomain.Name(), args.HelloDomain, args.LocalIP, args.LocalHostname.Name())
+	now := time.Now()
+	if v, ok := spfCache.get(key, now); ok {
+		res := v.(spfResult)
+		return res.received, res.domain, res.explanation, res.err
+	}
+	received, domain, expl, err := spf.Verify(ctx, resolver, args)
+	if received.Result != spf.StatusTemperror && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+		spfCache.put(key, spfResult{received, domain, expl, err}, now)
+	}
+	return received, domain, expl, err
+}
+
+// authResolver returns a resolver that caches DKIM and DMARC lookups, if enabled.
+func authResolver(resolver dns.Resolver) dns.Resolver {
+	_, dkimCache, dmarcCache := authCachesGet()
+	if dkimCache == nil {
+		return resolver
+	}
+	return cacheResolver{resolver, dkimCache, dmarcCache}
+}
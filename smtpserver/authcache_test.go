@@ -0,0 +1,122 @@
+package smtpserver
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/spf"
+)
+
+type countResolver struct {
+	dns.MockResolver
+	txt int
+}
+
+func (r *countResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	r.txt++
+	return r.MockResolver.LookupTXT(ctx, name)
+}
+
+func TestAuthCache(t *testing.T) {
+	ac := newAuthCache("test", time.Minute, 2)
+	now := time.Now()
+	ac.put("a", 1, now)
+	ac.put("b", 2, now)
+	ac.put("c", 3, now) // Removes "a".
+	if _, ok := ac.get("a", now); ok {
+		t.Fatalf("oldest entry not removed")
+	}
+	if v, ok := ac.get("c", now); !ok || v.(int) != 3 {
+		t.Fatalf("got %v %v, expected 3", v, ok)
+	}
+	if _, ok := ac.get("b", now.Add(time.Minute)); ok {
+		t.Fatalf("expired entry returned")
+	}
+
+	mock := dns.MockResolver{
+		TXT: map[string][]string{
+			"sel._domainkey.example.org.": {"v=DKIM1; p=..."},
+			"_dmarc.example.org.":         {"v=DMARC1; p=reject"},
+			"example.org.":                {"v=spf1 ip4:10.0.0.1 -all"},
+		},
+		Fail: map[dns.Mockreq]struct{}{{Type: "txt", Name: "_dmarc.temperror.example."}: {}},
+	}
+	cr := &countResolver{MockResolver: mock}
+	r := cacheResolver{cr, newAuthCache("dkim", time.Minute, 10), newAuthCache("dmarc", time.Minute, 10)}
+
+	lookup := func(name string, expLookups int) {
+		t.Helper()
+		cr.txt = 0
+		r.LookupTXT(context.Background(), name)
+		r.LookupTXT(context.Background(), name)
+		if cr.txt != expLookups {
+			t.Fatalf("txt lookups for %s: got %d, expected %d", name, cr.txt, expLookups)
+		}
+	}
+	lookup("sel._domainkey.example.org.", 1)
+	lookup("_dmarc.example.org.", 1)
+	lookup("_dmarc.absent.example.", 1) // Not found is cached.
+	lookup("_dmarc.temperror.example.", 2)
+	lookup("example.org.", 2) // Not cached.
+
+	txt, err := r.LookupTXT(context.Background(), "_dmarc.absent.example.")
+	if len(txt) != 0 || !dns.IsNotFound(err) {
+		t.Fatalf("got %v %v for cached absent record, expected not found", txt, err)
+	}
+}
+
+func TestSPFVerifyCache(t *testing.T) {
+	resetResolver := func() *countResolver {
+		return &countResolver{MockResolver: dns.MockResolver{
+			TXT: map[string][]string{"example.org.": {"v=spf1 ip4:10.0.0.1 -all"}},
+		}}
+	}
+	args := spf.Args{
+		RemoteIP:          net.ParseIP("10.0.0.1"),
+		MailFromLocalpart: "remote",
+		MailFromDomain:    dns.Domain{ASCII: "example.org"},
+		HelloDomain:       dns.IPDomain{Domain: dns.Domain{ASCII: "mx.example.org"}},
+		LocalIP:           net.ParseIP("127.0.0.1"),
+		LocalHostname:     dns.Domain{ASCII: "mox.example"},
+	}
+
+	// Without AuthCache in the config, the cache is not used.
+	resolver := resetResolver()
+	spfVerify(context.Background(), resolver, args)
+	spfVerify(context.Background(), resolver, args)
+	if resolver.txt != 2 {
+		t.Fatalf("got %d lookups without cache, expected 2", resolver.txt)
+	}
+
+	mox.Conf.Static.AuthCache = &config.AuthCache{}
+	defer func() {
+		mox.Conf.Static.AuthCache = nil
+		authCaches.Lock()
+		authCaches.spf, authCaches.dkim, authCaches.dmarc = nil, nil, nil
+		authCaches.Unlock()
+	}()
+
+	resolver = resetResolver()
+	received, _, _, err := spfVerify(context.Background(), resolver, args)
+	if err != nil || received.Result != spf.StatusPass {
+		t.Fatalf("spf verify: got %v %v, expected pass", received.Result, err)
+	}
+	received, _, _, err = spfVerify(context.Background(), resolver, args)
+	if err != nil || received.Result != spf.StatusPass || resolver.txt != 1 {
+		t.Fatalf("spf verify from cache: got %v %v with %d lookups, expected pass with 1 lookup", received.Result, err, resolver.txt)
+	}
+
+	// A different sender is evaluated again. Temporary errors are not cached.
+	args.MailFromLocalpart = "other"
+	resolver.Fail = map[dns.Mockreq]struct{}{{Type: "txt", Name: "example.org."}: {}}
+	received, _, _, _ = spfVerify(context.Background(), resolver, args)
+	spfVerify(context.Background(), resolver, args)
+	if received.Result != spf.StatusTemperror || resolver.txt != 3 {
+		t.Fatalf("got %v with %d lookups, expected temperror with 3 lookups", received.Result, resolver.txt)
+	}
+}
@@ -0,0 +1,52 @@
+package smtpserver
+
+import (
+	"crypto/tls"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mjl-/mox/conformance"
+	"github.com/mjl-/mox/dns"
+)
+
+// TestConformance runs the scripted conversations in
+// ../testdata/smtpconformance. Scripts with option "submission" are run against
+// a submission server, others against a server for incoming deliveries, with
+// example.org as remote MTA.
+func TestConformance(t *testing.T) {
+	files, err := filepath.Glob("../testdata/smtpconformance/*.txt")
+	tcheck(t, err, "listing scripts")
+	if len(files) == 0 {
+		t.Fatalf("no conformance scripts")
+	}
+	for _, file := range files {
+		script, err := conformance.ParseFile(file)
+		tcheck(t, err, "parsing script")
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			resolver := dns.MockResolver{
+				A:   map[string][]string{"example.org.": {"127.0.0.10"}},
+				PTR: map[string][]string{"127.0.0.10": {"example.org."}},
+			}
+			ts := newTestServer(t, "../testdata/smtp/mox.conf", resolver)
+			defer ts.close()
+
+			serverConn, clientConn := net.Pipe()
+			tlsConfig := &tls.Config{
+				Certificates: []tls.Certificate{fakeCert(t)},
+			}
+			done := make(chan struct{})
+			go func() {
+				serve("test", ts.cid, dns.Domain{ASCII: "mox.example"}, tlsConfig, serverConn, resolver, script.HasOption("submission"), false, 100<<20, false, false, nil, 0)
+				close(done)
+			}()
+			err = conformance.Run(clientConn, script, 10*time.Second)
+			clientConn.Close()
+			<-done
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
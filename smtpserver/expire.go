@@ -0,0 +1,59 @@
+package smtpserver
+
+import (
+	"context"
+	"net/mail"
+	"time"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/store"
+)
+
+// messageExpire schedules removal of the copies of a submitted message with an
+// Expires header, in the account of the sender and the accounts of local
+// recipients, if the account of the sender has MessageExpiration set. Messages
+// are found by their Message-ID. Failures are logged, the message is still sent.
+func (c *conn) messageExpire(ctx context.Context, expiresHdr, messageID string) {
+	conf, _ := c.account.Conf()
+	if !conf.MessageExpiration || expiresHdr == "" {
+		return
+	}
+	expires, err := mail.ParseDate(expiresHdr)
+	if err != nil {
+		c.log.Infox("parsing expires header, not scheduling expiration", err, mlog.Field("expires", expiresHdr))
+		return
+	}
+	if !expires.After(time.Now()) {
+		c.log.Info("expires header in the past, not scheduling expiration", mlog.Field("expires", expires))
+		return
+	}
+
+	accounts := map[string]struct{}{c.account.Name: {}}
+	for _, rcptAcc := range c.recipients {
+		accName, _, _, err := mox.FindAccount(rcptAcc.rcptTo.Localpart, rcptAcc.rcptTo.IPDomain.Domain, false)
+		if err == nil {
+			accounts[accName] = struct{}{}
+		}
+	}
+	for accName := range accounts {
+		log := c.log.Fields(mlog.Field("account", accName))
+		acc := c.account
+		if accName != c.account.Name {
+			acc, err = store.OpenAccount(accName)
+			if err != nil {
+				log.Errorx("open account for message expiration", err)
+				continue
+			}
+		}
+		if err := acc.MessageExpireAdd(ctx, messageID, expires); err != nil {
+			log.Errorx("scheduling message expiration", err)
+		} else {
+			log.Info("scheduled message expiration", mlog.Field("messageid", messageID), mlog.Field("expires", expires))
+		}
+		if acc != c.account {
+			err := acc.Close()
+			log.Check(err, "closing account after scheduling message expiration")
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package smtpserver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"strings"
+
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/smtp"
+	"github.com/mjl-/mox/store"
+)
+
+// submissionFromAllowed returns whether the authenticated account can use the
+// address as MAIL FROM or message From address in a submission: when it is an
+// address of the account, or when it is allowed by the SubmissionFromAllowed
+// setting of the account.
+func (c *conn) submissionFromAllowed(localpart smtp.Localpart, domain dns.Domain, allowPostmaster bool) bool {
+	accName, _, _, err := mox.FindAccount(localpart, domain, allowPostmaster)
+	if err == nil && accName == c.account.Name {
+		return true
+	}
+
+	dc, ok := mox.Conf.Domain(domain)
+	if !ok {
+		return false
+	}
+	lp, err := mox.CanonicalLocalpart(localpart, dc)
+	if err != nil {
+		return false
+	}
+	conf, _ := c.account.Conf()
+	for _, s := range conf.SubmissionFromAllowed {
+		if strings.HasPrefix(s, "@") {
+			if d, err := dns.ParseDomain(s[1:]); err == nil && d == domain {
+				return true
+			}
+		} else if addr, err := smtp.ParseAddress(s); err == nil && addr.Domain == domain {
+			if alp, err := mox.CanonicalLocalpart(addr.Localpart, dc); err == nil && alp == lp {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// submissionFromDelegated returns whether the authenticated account can use the
+// address of another account as MAIL FROM or message From address in a
+// submission, because that account has it listed in its SendDelegates.
+func (c *conn) submissionFromDelegated(localpart smtp.Localpart, domain dns.Domain) bool {
+	accName, _, _, err := mox.FindAccount(localpart, domain, false)
+	if err != nil || accName == c.account.Name {
+		return false
+	}
+	accConf, ok := mox.Conf.Account(accName)
+	if !ok {
+		return false
+	}
+	for _, name := range accConf.SendDelegates {
+		if name == c.account.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// submissionFromRewrite returns the address to rewrite a disallowed MAIL FROM or
+// message From address to, if the account has SubmissionFromRewrite set: the
+// address used for authentication.
+func (c *conn) submissionFromRewrite() (smtp.Address, bool) {
+	conf, _ := c.account.Conf()
+	if !conf.SubmissionFromRewrite {
+		return smtp.Address{}, false
+	}
+	addr, err := smtp.ParseAddress(c.username)
+	if err != nil || !c.submissionFromAllowed(addr.Localpart, addr.Domain, false) {
+		return smtp.Address{}, false
+	}
+	return addr, true
+}
+
+// rewriteFrom writes the message in msgFile to a new temporary file, with the From
+// header replaced by one with addr, keeping the display name of the original
+// From header. The new file and its size are returned.
+func rewriteFrom(msgFile *os.File, addr smtp.Address) (rf *os.File, size int64, rerr error) {
+	f, err := store.CreateMessageTemp("smtp-rewrite")
+	if err != nil {
+		return nil, 0, fmt.Errorf("creating temporary file: %w", err)
+	}
+	defer func() {
+		if rerr != nil {
+			err := os.Remove(f.Name())
+			xlog.Check(err, "removing temporary file for rewritten message")
+			err = f.Close()
+			xlog.Check(err, "closing temporary file for rewritten message")
+		}
+	}()
+
+	fi, err := msgFile.Stat()
+	if err != nil {
+		return nil, 0, fmt.Errorf("stat message file: %w", err)
+	}
+	br := bufio.NewReader(io.NewSectionReader(msgFile, 0, fi.Size()))
+	bw := bufio.NewWriter(f)
+
+	// The From header can span multiple lines, we gather its value and write the new
+	// header when we see the next header or the end of the header section.
+	var inFrom bool
+	var fromValue string
+	flushFrom := func() error {
+		if !inFrom {
+			return nil
+		}
+		inFrom = false
+		var name string
+		unfolded := strings.ReplaceAll(strings.ReplaceAll(fromValue, "\r", ""), "\n", "")
+		if a, err := mail.ParseAddress(strings.TrimSpace(unfolded)); err == nil {
+			name = a.Name
+		}
+		_, err := bw.WriteString("From: " + (&mail.Address{Name: name, Address: addr.Pack(true)}).String() + "\r\n")
+		return err
+	}
+	for {
+		line, err := br.ReadString('\n')
+		if err == io.EOF && line == "" {
+			// Message without empty line after the header section, and without body.
+			if err := flushFrom(); err != nil {
+				return nil, 0, fmt.Errorf("writing from header: %w", err)
+			}
+			break
+		} else if err != nil && err != io.EOF {
+			return nil, 0, fmt.Errorf("reading message header: %w", err)
+		}
+		if inFrom && (line[0] == ' ' || line[0] == '\t') {
+			fromValue += line
+			continue
+		}
+		if err := flushFrom(); err != nil {
+			return nil, 0, fmt.Errorf("writing from header: %w", err)
+		}
+		if strings.HasPrefix(strings.ToLower(line), "from:") {
+			inFrom = true
+			fromValue = line[len("from:"):]
+			continue
+		}
+		if _, err := bw.WriteString(line); err != nil {
+			return nil, 0, fmt.Errorf("writing message header: %w", err)
+		}
+		if line == "\r\n" || line == "\n" {
+			break
+		}
+	}
+	if _, err := io.Copy(bw, br); err != nil {
+		return nil, 0, fmt.Errorf("copying message body: %w", err)
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, 0, fmt.Errorf("flush rewritten message: %w", err)
+	}
+	fi, err = f.Stat()
+	if err != nil {
+		return nil, 0, fmt.Errorf("stat rewritten message: %w", err)
+	}
+	return f, fi.Size(), nil
+}
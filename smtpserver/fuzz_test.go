@@ -111,3 +111,46 @@ func FuzzServer(f *testing.F) {
 		// todo: submission with login
 	})
 }
+
+// Fuzz the command argument parsers. Only syntax errors are expected.
+func FuzzParse(f *testing.F) {
+	f.Add("<@hosta.int,@jkl.org:userc@d.bar.org>")
+	f.Add(`<"quoted\"@local"@[IPv6:::1]>`)
+	f.Add("<møx@møx.example> SMTPUTF8")
+	f.Add("[127.0.0.1]")
+	f.Add("e+3Dmc2@example.com")
+	f.Add("SIZE=1000 BODY=8BITMIME")
+
+	parsers := []func(p *parser){
+		func(p *parser) { p.xforwardPath() },
+		func(p *parser) { newParser(p.xrawReversePath(), p.smtputf8, p.conn).xbareReversePath() },
+		func(p *parser) { p.xipdomain(true) },
+		func(p *parser) { p.xtext() },
+		func(p *parser) { p.xsaslMech() },
+		func(p *parser) {
+			for !p.empty() {
+				p.xspace()
+				p.xparamKeyword()
+				if p.take("=") {
+					p.xparamValue()
+				}
+			}
+		},
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		for _, smtputf8 := range []bool{false, true} {
+			for _, fn := range parsers {
+				func() {
+					defer func() {
+						x := recover()
+						if _, ok := x.(smtpError); x != nil && !ok {
+							t.Fatalf("unexpected panic for %q: %v", s, x)
+						}
+					}()
+					fn(newParser(s, smtputf8, &conn{}))
+				}()
+			}
+		}
+	})
+}
@@ -119,6 +119,9 @@ func (p *parser) xspace() {
 }
 
 func (p *parser) xtaken(n int) string {
+	if p.o+n > len(p.orig) {
+		p.xerrorf("unexpected end of line")
+	}
 	r := p.orig[p.o : p.o+n]
 	p.o += n
 	return r
@@ -20,4 +20,15 @@ func TestParse(t *testing.T) {
 
 	tcompare(t, newParser("e+3Dmc2@example.com", false, nil).xtext(), "e=mc2@example.com")
 	tcompare(t, newParser("", false, nil).xtext(), "")
+
+	// Truncated hex escape is a syntax error, not an out of bounds panic.
+	func() {
+		defer func() {
+			x := recover()
+			if _, ok := x.(smtpError); !ok {
+				t.Fatalf("got %v, expected smtpError", x)
+			}
+		}()
+		newParser("e+3", false, &conn{}).xtext()
+	}()
 }
@@ -17,6 +17,7 @@ type reputationMethod string
 const (
 	methodMsgfromFull      reputationMethod = "msgfromfull"
 	methodMsgtoFull        reputationMethod = "msgtofull"
+	methodCorrespondent    reputationMethod = "correspondent"
 	methodMsgfromDomain    reputationMethod = "msgfromdomain"
 	methodMsgfromOrgDomain reputationMethod = "msgfromorgdomain"
 	methodMsgtoDomain      reputationMethod = "msgtodomain"
@@ -79,6 +80,9 @@ const (
 // - Messages matching full "message from" address, either with strict/relaxed
 // dkim/spf-verification, or without.
 // - Messages the user sent to the "message from" address.
+// - Known correspondents of the account, addresses the user sent messages to in
+// the past (even if those messages have been removed) or added manually. Only
+// conclusive if the "message from" address is verified.
 // - Messages matching only the domain of the "message from" address (different
 // localpart), again with verification or without.
 // - Messages sent to an address in the domain of the "message from" address.
@@ -195,6 +199,14 @@ func reputation(tx *bstore.Tx, log *mlog.Log, m *store.Message) (rjunk *bool, rc
 			return xfalse, true, methodMsgtoFull, nil
 		}
 
+		// Look if this is a known correspondent. Without verification, the From address
+		// could be spoofed, so we only let the junk filter be more lenient.
+		if ok, err := store.IsCorrespondent(tx, m.MsgFromLocalpart, m.MsgFromDomain); err != nil {
+			panic(queryError(fmt.Sprintf("checking for correspondent: %v", err)))
+		} else if ok {
+			return xfalse, m.MsgFromValidated, methodCorrespondent, nil
+		}
+
 		// Look for domain match, then for organizational domain match.
 		for _, orgdomain := range []bool{false, true} {
 			qm := store.Message{}
@@ -96,6 +96,9 @@ func TestReputation(t *testing.T) {
 		return m
 	}
 
+	// Inserted along with history by check.
+	var correspondents []store.Correspondent
+
 	check := func(m store.Message, history []store.Message, expJunk *bool, expConclusive bool, expMethod reputationMethod) {
 		t.Helper()
 
@@ -121,6 +124,10 @@ func TestReputation(t *testing.T) {
 				err = tx.Insert(&r)
 				tcheck(t, err, "insert recipient")
 			}
+			for _, c := range correspondents {
+				err := tx.Insert(&c)
+				tcheck(t, err, "insert correspondent")
+			}
 
 			return nil
 		})
@@ -217,6 +224,18 @@ func TestReputation(t *testing.T) {
 	m = message(false, 0, "host.othersite.example", "", "other@remote.example", "mjl@local.example", store.ValidationNone, []string{}, false, false, "10.10.0.1")
 	check(m, msgs, xfalse, true, methodMsgtoFull)
 
+	// Known correspondent, e.g. after removing sent messages. Only conclusive with
+	// verified from address.
+	msgs = []store.Message{
+		message(true, 3, "host.othersite.example", "", "a@remote.example", "mjl@local.example", store.ValidationStrict, []string{"remote.example"}, true, true, "10.0.0.1"), // other localpart
+	}
+	correspondents = []store.Correspondent{{Localpart: "other", Domain: "remote.example"}}
+	m = message(false, 0, "host.othersite.example", "", "Other@remote.example", "mjl@local.example", store.ValidationNone, []string{}, false, false, "10.10.0.1")
+	check(m, msgs, xfalse, false, methodCorrespondent)
+	m = message(false, 0, "host.othersite.example", "", "other@remote.example", "mjl@local.example", store.ValidationDMARC, []string{"remote.example"}, true, true, "10.10.0.1")
+	check(m, msgs, xfalse, true, methodCorrespondent)
+	correspondents = nil
+
 	// Other messages in same domain, inconclusive.
 	msgs = []store.Message{
 		message(true, 7*30, "host.othersite.example", "", "second@remote.example", "mjl@local.example", store.ValidationStrict, []string{"othersite.example"}, true, true, "10.0.0.1"),
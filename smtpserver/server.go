@@ -17,6 +17,7 @@ import (
 	"io"
 	"math"
 	"net"
+	"net/mail"
 	"os"
 	"runtime/debug"
 	"strconv"
@@ -26,6 +27,7 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/exp/slices"
 
 	"github.com/mjl-/bstore"
 
@@ -42,6 +44,7 @@ import (
 	"github.com/mjl-/mox/mox-"
 	"github.com/mjl-/mox/moxio"
 	"github.com/mjl-/mox/moxvar"
+	"github.com/mjl-/mox/oauth"
 	"github.com/mjl-/mox/publicsuffix"
 	"github.com/mjl-/mox/queue"
 	"github.com/mjl-/mox/ratelimit"
@@ -144,6 +147,16 @@ var (
 			"reason",
 		},
 	)
+	metricDeliveryTLS = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mox_smtpserver_delivery_tls_total",
+			Help: "SMTP incoming messages from external source, not submission, by TLS version and MAIL FROM domain.",
+		},
+		[]string{
+			"version", // tls1.2, tls1.3, none
+			"domain",  // mail from domain if in TLSMetricsDomains, "other" otherwise
+		},
+	)
 	metricSubmission = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "mox_smtpserver_submission_total",
@@ -195,7 +208,7 @@ func Listen() {
 			port := config.Port(listener.SMTP.Port, 25)
 			for _, ip := range listener.IPs {
 				firstTimeSenderDelay := durationDefault(listener.SMTP.FirstTimeSenderDelay, firstTimeSenderDelayDefault)
-				listen1("smtp", name, ip, port, hostname, tlsConfig, false, false, maxMsgSize, false, listener.SMTP.RequireSTARTTLS, listener.SMTP.DNSBLZones, firstTimeSenderDelay)
+				listen1("smtp", name, ip, port, hostname, tlsConfig, false, false, maxMsgSize, false, listener.SMTP.RequireSTARTTLS, listener.SMTP.DNSBLZones, firstTimeSenderDelay, false)
 			}
 		}
 		if listener.Submission.Enabled {
@@ -205,7 +218,7 @@ func Listen() {
 			}
 			port := config.Port(listener.Submission.Port, 587)
 			for _, ip := range listener.IPs {
-				listen1("submission", name, ip, port, hostname, tlsConfig, true, false, maxMsgSize, !listener.Submission.NoRequireSTARTTLS, !listener.Submission.NoRequireSTARTTLS, nil, 0)
+				listen1("submission", name, ip, port, hostname, tlsConfig, true, false, maxMsgSize, !listener.Submission.NoRequireSTARTTLS, !listener.Submission.NoRequireSTARTTLS, nil, 0, listener.Submission.ProxyProtocol)
 			}
 		}
 
@@ -216,7 +229,7 @@ func Listen() {
 			}
 			port := config.Port(listener.Submissions.Port, 465)
 			for _, ip := range listener.IPs {
-				listen1("submissions", name, ip, port, hostname, tlsConfig, true, true, maxMsgSize, true, true, nil, 0)
+				listen1("submissions", name, ip, port, hostname, tlsConfig, true, true, maxMsgSize, true, true, nil, 0, listener.Submissions.ProxyProtocol)
 			}
 		}
 	}
@@ -224,16 +237,21 @@ func Listen() {
 
 var servers []func()
 
-func listen1(protocol, name, ip string, port int, hostname dns.Domain, tlsConfig *tls.Config, submission, xtls bool, maxMessageSize int64, requireTLSForAuth, requireTLSForDelivery bool, dnsBLs []dns.Domain, firstTimeSenderDelay time.Duration) {
+func listen1(protocol, name, ip string, port int, hostname dns.Domain, tlsConfig *tls.Config, submission, xtls bool, maxMessageSize int64, requireTLSForAuth, requireTLSForDelivery bool, dnsBLs []dns.Domain, firstTimeSenderDelay time.Duration, proxyProtocol bool) {
 	addr := net.JoinHostPort(ip, fmt.Sprintf("%d", port))
 	if os.Getuid() == 0 {
 		xlog.Print("listening for smtp", mlog.Field("listener", name), mlog.Field("address", addr), mlog.Field("protocol", protocol))
 	}
 	network := mox.Network(ip)
-	ln, err := mox.Listen(network, addr)
+	ln, err := mox.Listen(network, addr, mox.Conf.Static.Listeners[name].SocketOptions)
 	if err != nil {
 		xlog.Fatalx("smtp: listen for smtp", err, mlog.Field("protocol", protocol), mlog.Field("listener", name))
 	}
+	if proxyProtocol {
+		// Before the limits, which should apply to the IPs of clients, not the load balancer.
+		ln = mox.ProxyListener(ln, name)
+	}
+	ln = mox.LimitListener(ln, name)
 	if xtls {
 		ln = tls.NewListener(ln, tlsConfig)
 	}
@@ -270,15 +288,18 @@ type conn struct {
 	origConn net.Conn
 	conn     net.Conn
 
+	listenerName          string
 	tls                   bool
 	resolver              dns.Resolver
 	r                     *bufio.Reader
 	w                     *bufio.Writer
 	tr                    *moxio.TraceReader // Kept for changing trace level during cmd/auth/data.
 	tw                    *moxio.TraceWriter
-	slow                  bool      // If set, reads are done with a 1 second sleep, and writes are done 1 byte at a time, to keep spammers busy.
-	lastlog               time.Time // Used for printing the delta time since the previous logging for this connection.
-	submission            bool      // ../rfc/6409:19 applies
+	transcript            *moxio.Transcript // If set, for a protocol trace of the account or remote IP.
+	slow                  bool              // If set, reads are done with a 1 second sleep, and writes are done 1 byte at a time, to keep spammers busy.
+	tarpit                *tarpit           // If set, error responses are counted as failures for the remote IP, and responses are delayed for IPs with many failures.
+	lastlog               time.Time         // Used for printing the delta time since the previous logging for this connection.
+	submission            bool              // ../rfc/6409:19 applies
 	tlsConfig             *tls.Config
 	localIP               net.IP
 	remoteIP              net.IP
@@ -311,8 +332,15 @@ type conn struct {
 	// Message transaction.
 	mailFrom    *smtp.Path
 	has8bitmime bool // If MAIL FROM parameter BODY=8BITMIME was sent. Required for SMTPUTF8.
+	binarymime  bool // If MAIL FROM parameter BODY=BINARYMIME was sent. Message data must be sent with BDAT.
 	smtputf8    bool // todo future: we should keep track of this per recipient. perhaps only a specific recipient requires smtputf8, e.g. due to a utf8 localpart. we should decide ourselves if the message needs smtputf8, e.g. due to utf8 header values.
 	recipients  []rcptAccount
+	traceID     string // Assigned when the message data has been read, see queue.TraceEvent.
+
+	// Message data received so far with BDAT, processed after the last chunk. Nil if
+	// no BDAT command was given in this transaction. ../rfc/3030
+	bdatFile   *os.File
+	bdatWriter *message.Writer
 }
 
 type rcptAccount struct {
@@ -323,6 +351,31 @@ type rcptAccount struct {
 	accountName      string
 	destination      config.Destination
 	canonicalAddress string // Optional catchall part stripped and/or lowercased.
+
+	notify string // NOTIFY parameter for DSNs, see queue.Msg.DSNNotify. Only for submission.
+}
+
+// xparseNotify parses the value of the NOTIFY parameter for RCPT TO, returning it
+// uppercased. It is either "NEVER", or a comma-separated list of "SUCCESS",
+// "FAILURE" and "DELAY". ../rfc/3461
+func xparseNotify(v string) string {
+	v = strings.ToUpper(v)
+	if v == "NEVER" {
+		return v
+	}
+	seen := map[string]bool{}
+	for _, s := range strings.Split(v, ",") {
+		switch s {
+		case "SUCCESS", "FAILURE", "DELAY":
+		default:
+			xsmtpUserErrorf(smtp.C501BadParamSyntax, smtp.SeProto5BadParams4, "bad NOTIFY value %q", v)
+		}
+		if seen[s] {
+			xsmtpUserErrorf(smtp.C501BadParamSyntax, smtp.SeProto5BadParams4, "duplicate NOTIFY value %q", s)
+		}
+		seen[s] = true
+	}
+	return v
 }
 
 func isClosed(err error) bool {
@@ -331,6 +384,16 @@ func isClosed(err error) bool {
 
 // completely reset connection state as if greeting has just been sent.
 // ../rfc/3207:210
+// trace records an event for the message of the current transaction. The
+// recipient is optional.
+func (c *conn) trace(stage string, rcptTo smtp.Path, messageID, text string) {
+	var rcpt string
+	if !rcptTo.IsZero() {
+		rcpt = rcptTo.XString(true)
+	}
+	queue.Trace(c.log, queue.TraceEvent{TraceID: c.traceID, Stage: stage, Cid: c.cid, MessageID: messageID, Recipient: rcpt, Text: text})
+}
+
 func (c *conn) reset() {
 	c.ehlo = false
 	c.hello = dns.IPDomain{}
@@ -348,8 +411,17 @@ func (c *conn) reset() {
 func (c *conn) rset() {
 	c.mailFrom = nil
 	c.has8bitmime = false
+	c.binarymime = false
 	c.smtputf8 = false
 	c.recipients = nil
+	if c.bdatFile != nil {
+		err := os.Remove(c.bdatFile.Name())
+		c.log.Check(err, "removing temporary message file for bdat", mlog.Field("path", c.bdatFile.Name()))
+		err = c.bdatFile.Close()
+		c.log.Check(err, "closing temporary message file for bdat")
+		c.bdatFile = nil
+		c.bdatWriter = nil
+	}
 }
 
 func (c *conn) earliestDeadline(d time.Duration) time.Time {
@@ -367,6 +439,17 @@ func (c *conn) xcheckAuth() {
 	}
 }
 
+// transcriptOpen starts writing a protocol transcript if a protocol trace
+// matches the remote IP, or account if not empty.
+func (c *conn) transcriptOpen(account string) {
+	if c.transcript != nil {
+		return
+	}
+	c.transcript = mox.TranscriptOpen(c.log, c.kind(), c.cid, c.remoteIP, account)
+	c.tr.SetTranscript(c.transcript)
+	c.tw.SetTranscript(c.transcript)
+}
+
 func (c *conn) xtrace(level mlog.Level) func() {
 	c.xflush()
 	c.tr.SetTrace(level)
@@ -467,6 +550,19 @@ func (c *conn) bwritecodeline(code int, secode string, msg string, err error) {
 	metricCommands.WithLabelValues(c.kind(), c.cmd, fmt.Sprintf("%d", code), ecode).Observe(float64(time.Since(c.cmdStart)) / float64(time.Second))
 	c.log.Debugx("smtp command result", err, mlog.Field("kind", c.kind()), mlog.Field("cmd", c.cmd), mlog.Field("code", fmt.Sprintf("%d", code)), mlog.Field("ecode", ecode), mlog.Field("duration", time.Since(c.cmdStart)))
 
+	if c.tarpit != nil {
+		now := time.Now()
+		if code >= 400 {
+			c.tarpit.failure(c.remoteIP, 1, now)
+		}
+		if d := c.tarpit.delay(c.remoteIP, now); d > 0 {
+			c.log.Debug("tarpit, delaying response", mlog.Field("delay", d))
+			metricTarpitDelay.Observe(float64(d) / float64(time.Second))
+			c.xflush()
+			mox.Sleep(mox.Context, d)
+		}
+	}
+
 	var sep string
 	if ecode != "" {
 		sep = " "
@@ -519,6 +615,7 @@ func (c *conn) writelinef(format string, args ...any) {
 var cleanClose struct{} // Sentinel value for panic/recover indicating clean close of connection.
 
 func serve(listenerName string, cid int64, hostname dns.Domain, tlsConfig *tls.Config, nc net.Conn, resolver dns.Resolver, submission, tls bool, maxMessageSize int64, requireTLSForAuth, requireTLSForDelivery bool, dnsBLs []dns.Domain, firstTimeSenderDelay time.Duration) {
+	nc = moxio.ChaosConn(nc) // No-op unless built with tag moxchaos.
 	var localIP, remoteIP net.IP
 	if a, ok := nc.LocalAddr().(*net.TCPAddr); ok {
 		localIP = a.IP
@@ -535,6 +632,7 @@ func serve(listenerName string, cid int64, hostname dns.Domain, tlsConfig *tls.C
 
 	c := &conn{
 		cid:                   cid,
+		listenerName:          listenerName,
 		origConn:              nc,
 		conn:                  nc,
 		submission:            submission,
@@ -551,6 +649,9 @@ func serve(listenerName string, cid int64, hostname dns.Domain, tlsConfig *tls.C
 		dnsBLs:                dnsBLs,
 		firstTimeSenderDelay:  firstTimeSenderDelay,
 	}
+	if !submission {
+		c.tarpit = tarpitForListener(listenerName)
+	}
 	c.log = xlog.MoreFields(func() []mlog.Pair {
 		now := time.Now()
 		l := []mlog.Pair{
@@ -574,6 +675,11 @@ func serve(listenerName string, cid int64, hostname dns.Domain, tlsConfig *tls.C
 	defer func() {
 		c.origConn.Close() // Close actual TCP socket, regardless of TLS on top.
 		c.conn.Close()     // If TLS, will try to write alert notification to already closed socket, returning error quickly.
+		err := c.transcript.Close()
+		c.log.Check(err, "closing protocol transcript")
+
+		// Remove data of an unfinished BDAT transaction.
+		c.rset()
 
 		if c.account != nil {
 			err := c.account.Close()
@@ -590,6 +696,7 @@ func serve(listenerName string, cid int64, hostname dns.Domain, tlsConfig *tls.C
 			c.log.Error("unhandled panic", mlog.Field("err", x))
 			debug.PrintStack()
 			metrics.PanicInc("smtpserver")
+			moxio.CrashReport(c.log, "smtpserver", nc, x)
 		}
 	}()
 
@@ -626,12 +733,29 @@ func serve(listenerName string, cid int64, hostname dns.Domain, tlsConfig *tls.C
 	mox.Connections.Register(nc, "smtp", listenerName)
 	defer mox.Connections.Unregister(nc)
 
+	c.transcriptOpen("")
+
 	// ../rfc/5321:964 ../rfc/5321:4294 about announcing software and version
 	// Syntax: ../rfc/5321:2586
 	// We include the string ESMTP. https://cr.yp.to/smtp/greeting.html recommends it.
 	// Should not be too relevant nowadays, but does not hurt and default blackbox
 	// exporter SMTP health check expects it.
-	c.writelinef("%d %s ESMTP mox %s", smtp.C220ServiceReady, c.hostname.ASCII, moxvar.Version)
+	// Configured notices, e.g. about maintenance, are added as additional lines of a
+	// multiline greeting. The first line must start with our hostname. ../rfc/5321:2586
+	notices := mox.Notices("smtp", listenerName, "")
+	sep := " "
+	if len(notices) > 0 {
+		sep = "-"
+	}
+	c.bwritelinef("%d%s%s ESMTP mox %s", smtp.C220ServiceReady, sep, c.hostname.ASCII, moxvar.Version)
+	for i, text := range notices {
+		sep := "-"
+		if i == len(notices)-1 {
+			sep = " "
+		}
+		c.bwritelinef("%d%s%s", smtp.C220ServiceReady, sep, text)
+	}
+	c.xflush()
 
 	for {
 		command(c)
@@ -657,6 +781,7 @@ var commands = map[string]func(c *conn, p *parser){
 	"mail":     (*conn).cmdMail,
 	"rcpt":     (*conn).cmdRcpt,
 	"data":     (*conn).cmdData,
+	"bdat":     (*conn).cmdBdat,
 	"rset":     (*conn).cmdRset,
 	"vrfy":     (*conn).cmdVrfy,
 	"expn":     (*conn).cmdExpn,
@@ -799,8 +924,8 @@ func (c *conn) cmdHello(p *parser, ehlo bool) {
 	// https://www.iana.org/assignments/mail-parameters/mail-parameters.xhtml
 
 	c.bwritelinef("250-%s", c.hostname.ASCII)
-	c.bwritelinef("250-PIPELINING")                // ../rfc/2920:108
-	c.bwritelinef("250-SIZE %d", c.maxMessageSize) // ../rfc/1870:70
+	c.bwritelinef("250-PIPELINING")                    // ../rfc/2920:108
+	c.bwritelinef("250-SIZE %d", c.messageSizeLimit()) // ../rfc/1870:70
 	// ../rfc/3207:237
 	if !c.tls && c.tlsConfig != nil {
 		// ../rfc/3207:90
@@ -809,14 +934,26 @@ func (c *conn) cmdHello(p *parser, ehlo bool) {
 	if c.submission {
 		// ../rfc/4954:123
 		if c.tls || !c.requireTLSForAuth {
-			c.bwritelinef("250-AUTH SCRAM-SHA-256 SCRAM-SHA-1 CRAM-MD5 PLAIN")
+			c.bwritelinef("250-AUTH %s", strings.Join(c.authMechanisms(), " "))
 		} else {
 			c.bwritelinef("250-AUTH ")
 		}
 	}
 	c.bwritelinef("250-ENHANCEDSTATUSCODES") // ../rfc/2034:71
-	// todo future? c.writelinef("250-DSN")
-	c.bwritelinef("250-8BITMIME")              // ../rfc/6152:86
+	if c.submission {
+		// We only handle DSN requests for submitted messages, they are delivered
+		// through the queue. ../rfc/3461
+		// todo future: also for incoming messages, for which we would generate DSNs for local deliveries.
+		c.bwritelinef("250-DSN")
+	}
+	c.bwritelinef("250-8BITMIME") // ../rfc/6152:86
+	if !c.submission {
+		// Submitted messages are DKIM-signed. If they could have binary parts, they may
+		// have to be converted to base64 for the next hop, after signing, which would
+		// invalidate the signature. ../rfc/3030
+		c.bwritelinef("250-BINARYMIME")
+	}
+	c.bwritelinef("250-CHUNKING")              // ../rfc/3030
 	c.bwritecodeline(250, "", "SMTPUTF8", nil) // ../rfc/6531:201
 	c.xflush()
 }
@@ -861,6 +998,8 @@ func (c *conn) cmdStarttls(p *parser) {
 	c.conn = tlsConn
 	c.tr = moxio.NewTraceReader(c.log, "RC: ", c)
 	c.tw = moxio.NewTraceWriter(c.log, "LS: ", c)
+	c.tr.SetTranscript(c.transcript)
+	c.tw.SetTranscript(c.transcript)
 	c.r = bufio.NewReader(c.tr)
 	c.w = bufio.NewWriter(c.tw)
 
@@ -868,6 +1007,25 @@ func (c *conn) cmdStarttls(p *parser) {
 	c.tls = true
 }
 
+// messageSizeLimit returns the maximum message size for the connection: that of
+// the listener, lowered by the limit of the authenticated account, if any.
+func (c *conn) messageSizeLimit() int64 {
+	limit := c.maxMessageSize
+	if c.account != nil {
+		if l := mox.Conf.MessageSizeLimit(c.account.Name); l > 0 && l < limit {
+			limit = l
+		}
+	}
+	return limit
+}
+
+// authMechanisms returns the SASL mechanisms this connection can use, as
+// configured for the listener.
+func (c *conn) authMechanisms() []string {
+	l := mox.Conf.Static.Listeners[c.listenerName].AuthMechanisms
+	return config.AuthMechanismsAllowed(l, mox.Conf.Static.OAuth != nil, c.remoteIP, c.tls)
+}
+
 // ../rfc/4954:139
 func (c *conn) cmdAuth(p *parser) {
 	c.xneedHello()
@@ -906,6 +1064,9 @@ func (c *conn) cmdAuth(p *parser) {
 	authResult := "error"
 	defer func() {
 		metrics.AuthenticationInc("submission", authVariant, authResult)
+		if authResult == "ok" {
+			c.transcriptOpen(c.account.Name)
+		}
 		switch authResult {
 		case "ok":
 			mox.LimiterFailedAuth.Reset(c.remoteIP, time.Now())
@@ -964,6 +1125,12 @@ func (c *conn) cmdAuth(p *parser) {
 		return buf
 	}
 
+	// Mechanisms can be restricted per listener, e.g. to networks or TLS connections.
+	if config.AuthMechanismKnown(mech) && !slices.Contains(c.authMechanisms(), mech) {
+		// ../rfc/4954:176
+		xsmtpUserErrorf(smtp.C504ParamNotImpl, smtp.SeProto5BadParams4, "mechanism %s not allowed for this connection", mech)
+	}
+
 	switch mech {
 	case "PLAIN":
 		authVariant = "plain"
@@ -997,6 +1164,10 @@ func (c *conn) cmdAuth(p *parser) {
 			authResult = "badcreds"
 			c.log.Info("failed authentication attempt", mlog.Field("username", authc), mlog.Field("remote", c.remoteIP))
 			xsmtpUserErrorf(smtp.C535AuthBadCreds, smtp.SePol7AuthBadCreds8, "bad user/pass")
+		} else if err != nil && errors.Is(err, store.ErrAccountSuspended) {
+			authResult = "suspended"
+			c.log.Info("authentication for suspended account", mlog.Field("username", authc))
+			xsmtpUserErrorf(smtp.C535AuthBadCreds, smtp.SePol7AccountDisabled13, "account is suspended")
 		}
 		xcheckf(err, "verifying credentials")
 
@@ -1040,7 +1211,7 @@ func (c *conn) cmdAuth(p *parser) {
 		}()
 		var ipadhash, opadhash hash.Hash
 		acc.WithRLock(func() {
-			err := acc.DB.Read(context.TODO(), func(tx *bstore.Tx) error {
+			err := store.DBRead(context.TODO(), c.log, "smtpserver", acc.DB, func(tx *bstore.Tx) error {
 				password, err := bstore.QueryTx[store.Password](tx).Get()
 				if err == bstore.ErrAbsent {
 					c.log.Info("failed authentication attempt", mlog.Field("username", addr), mlog.Field("remote", c.remoteIP))
@@ -1071,6 +1242,12 @@ func (c *conn) cmdAuth(p *parser) {
 			xsmtpUserErrorf(smtp.C535AuthBadCreds, smtp.SePol7AuthBadCreds8, "bad user/pass")
 		}
 
+		if acc.Suspended() {
+			authResult = "suspended"
+			c.log.Info("authentication for suspended account", mlog.Field("username", addr))
+			xsmtpUserErrorf(smtp.C535AuthBadCreds, smtp.SePol7AccountDisabled13, "account is suspended")
+		}
+
 		authResult = "ok"
 		c.authFailed = 0
 		c.setSlow(false)
@@ -1117,7 +1294,7 @@ func (c *conn) cmdAuth(p *parser) {
 		}
 		var xscram store.SCRAM
 		acc.WithRLock(func() {
-			err := acc.DB.Read(context.TODO(), func(tx *bstore.Tx) error {
+			err := store.DBRead(context.TODO(), c.log, "smtpserver", acc.DB, func(tx *bstore.Tx) error {
 				password, err := bstore.QueryTx[store.Password](tx).Get()
 				if authVariant == "scram-sha-1" {
 					xscram = password.SCRAMSHA1
@@ -1156,6 +1333,12 @@ func (c *conn) cmdAuth(p *parser) {
 		// The message should be empty. todo: should we require it is empty?
 		xreadContinuation()
 
+		if acc.Suspended() {
+			authResult = "suspended"
+			c.log.Info("authentication for suspended account", mlog.Field("username", ss.Authentication))
+			xsmtpUserErrorf(smtp.C535AuthBadCreds, smtp.SePol7AccountDisabled13, "account is suspended")
+		}
+
 		authResult = "ok"
 		c.authFailed = 0
 		c.setSlow(false)
@@ -1165,6 +1348,69 @@ func (c *conn) cmdAuth(p *parser) {
 		// ../rfc/4954:276
 		c.writecodeline(smtp.C235AuthSuccess, smtp.SePol7Other0, "nice", nil)
 
+	case "OAUTHBEARER", "XOAUTH2":
+		authVariant = strings.ToLower(mech)
+
+		// Bearer tokens are credentials, like passwords.
+		if !c.tls && c.requireTLSForAuth {
+			xsmtpUserErrorf(smtp.C538EncReqForAuth, smtp.SePol7EncReqForAuth11, "authentication requires tls")
+		}
+
+		defer c.xtrace(mlog.LevelTraceauth)()
+		buf := xreadInitial()
+		c.xtrace(mlog.LevelTrace) // Restore.
+		var authz, token string
+		var err error
+		if mech == "OAUTHBEARER" {
+			authz, token, err = oauth.ParseOAuthBearer(buf)
+		} else {
+			authz, token, err = oauth.ParseXOAuth2(buf)
+		}
+		if err != nil {
+			xsmtpUserErrorf(smtp.C501BadParamSyntax, smtp.SeProto5BadParams4, "parsing %s: %s", authVariant, err)
+		}
+
+		username, err := mox.Conf.Static.OAuth.Validator.Validate(context.TODO(), token)
+		if err != nil && errors.Is(err, oauth.ErrInvalidToken) {
+			authResult = "badcreds"
+			c.log.Infox("authentication with invalid token", err, mlog.Field("authz", authz), mlog.Field("remote", c.remoteIP))
+			// The error is sent as challenge, the client responds with a dummy line.
+			// ../rfc/7628 section 3.2.2
+			c.writelinef("%d %s", smtp.C334ContinueAuth, base64.StdEncoding.EncodeToString(oauth.ErrorChallenge()))
+			c.readline()
+			xsmtpUserErrorf(smtp.C535AuthBadCreds, smtp.SePol7AuthBadCreds8, "bad token")
+		} else if err != nil {
+			c.log.Errorx("validating token", err)
+			xsmtpServerErrorf(codes{smtp.C454TempAuthFail, smtp.SeSys3Other0}, "token validation temporarily unavailable")
+		}
+		if authz != "" && !strings.EqualFold(authz, username) {
+			authResult = "badcreds"
+			xsmtpUserErrorf(smtp.C535AuthBadCreds, smtp.SePol7AuthBadCreds8, "token is for another user")
+		}
+
+		acc, _, err := store.OpenEmail(username)
+		if err != nil && errors.Is(err, store.ErrUnknownCredentials) {
+			authResult = "badcreds"
+			c.log.Info("authentication with token for unknown user", mlog.Field("username", username), mlog.Field("remote", c.remoteIP))
+			xsmtpUserErrorf(smtp.C535AuthBadCreds, smtp.SePol7AuthBadCreds8, "bad token")
+		}
+		xcheckf(err, "looking up address")
+		if acc.Suspended() {
+			err := acc.Close()
+			c.log.Check(err, "closing account")
+			authResult = "suspended"
+			c.log.Info("authentication for suspended account", mlog.Field("username", username))
+			xsmtpUserErrorf(smtp.C535AuthBadCreds, smtp.SePol7AccountDisabled13, "account is suspended")
+		}
+
+		authResult = "ok"
+		c.authFailed = 0
+		c.setSlow(false)
+		c.account = acc
+		c.username = username
+		// ../rfc/4954:276
+		c.writecodeline(smtp.C235AuthSuccess, smtp.SePol7Other0, "nice", nil)
+
 	default:
 		// ../rfc/4954:176
 		xsmtpUserErrorf(smtp.C504ParamNotImpl, smtp.SeProto5BadParams4, "mechanism %s not supported", mech)
@@ -1220,7 +1466,7 @@ func (c *conn) cmdMail(p *parser) {
 		case "SIZE":
 			p.xtake("=")
 			size := p.xnumber(20) // ../rfc/1870:90
-			if size > c.maxMessageSize {
+			if size > c.messageSizeLimit() {
 				// ../rfc/1870:136 ../rfc/3463:382
 				ecode := smtp.SeSys3MsgLimitExceeded4
 				if size < defaultMaxMsgSize {
@@ -1237,8 +1483,19 @@ func (c *conn) cmdMail(p *parser) {
 			switch strings.ToUpper(v) {
 			case "7BIT":
 				c.has8bitmime = false
+				c.binarymime = false
 			case "8BITMIME":
 				c.has8bitmime = true
+				c.binarymime = false
+			case "BINARYMIME":
+				if c.submission {
+					// Not announced for submission, see cmdHello.
+					xsmtpUserErrorf(smtp.C555UnrecognizedAddrParams, smtp.SeProto5BadParams4, "BODY=BINARYMIME not supported for submission")
+				}
+				// Binary data can only be sent with BDAT, so we don't have to look for a
+				// terminating dot line in the data. ../rfc/3030
+				c.has8bitmime = true
+				c.binarymime = true
 			default:
 				xsmtpUserErrorf(smtp.C555UnrecognizedAddrParams, smtp.SeProto5BadParams4, "unrecognized parameter %q", key)
 			}
@@ -1258,6 +1515,22 @@ func (c *conn) cmdMail(p *parser) {
 		case "SMTPUTF8":
 			// ../rfc/6531:213
 			c.smtputf8 = true
+		case "RET", "ENVID":
+			// ../rfc/3461
+			if !c.submission {
+				xsmtpUserErrorf(smtp.C555UnrecognizedAddrParams, smtp.SeSys3NotSupported3, "unrecognized parameter %q", key)
+			}
+			p.xtake("=")
+			if K == "RET" {
+				// We always return only the headers of the message in a DSN, which is allowed for RET=FULL too.
+				v := strings.ToUpper(p.xparamValue())
+				if v != "FULL" && v != "HDRS" {
+					xsmtpUserErrorf(smtp.C501BadParamSyntax, smtp.SeProto5BadParams4, "unrecognized RET value %q", v)
+				}
+			} else {
+				// todo: include ENVID as Original-Envelope-Id in DSNs.
+				p.xtext()
+			}
 		default:
 			// ../rfc/5321:2230
 			xsmtpUserErrorf(smtp.C555UnrecognizedAddrParams, smtp.SeSys3NotSupported3, "unrecognized parameter %q", key)
@@ -1278,8 +1551,7 @@ func (c *conn) cmdMail(p *parser) {
 		if rpath.IsZero() {
 			return true
 		}
-		accName, _, _, err := mox.FindAccount(rpath.Localpart, rpath.IPDomain.Domain, false)
-		return err == nil && accName == c.account.Name
+		return c.submissionFromAllowed(rpath.Localpart, rpath.IPDomain.Domain, false) || c.submissionFromDelegated(rpath.Localpart, rpath.IPDomain.Domain)
 	}
 
 	if !c.submission && !rpath.IPDomain.Domain.IsZero() {
@@ -1300,9 +1572,15 @@ func (c *conn) cmdMail(p *parser) {
 	}
 
 	if c.submission && (len(rpath.IPDomain.IP) > 0 || !rpathAllowed()) {
-		// ../rfc/6409:522
-		c.log.Info("submission with unconfigured mailfrom", mlog.Field("user", c.username), mlog.Field("mailfrom", rpath.String()))
-		xsmtpUserErrorf(smtp.C550MailboxUnavail, smtp.SePol7DeliveryUnauth1, "must match authenticated user")
+		if addr, ok := c.submissionFromRewrite(); ok {
+			// ../rfc/6409:625
+			c.log.Info("rewriting unconfigured mailfrom for submission", mlog.Field("user", c.username), mlog.Field("mailfrom", rpath.String()), mlog.Field("rewritten", addr))
+			rpath = smtp.Path{Localpart: addr.Localpart, IPDomain: dns.IPDomain{Domain: addr.Domain}}
+		} else {
+			// ../rfc/6409:522
+			c.log.Info("submission with unconfigured mailfrom", mlog.Field("user", c.username), mlog.Field("mailfrom", rpath.String()))
+			xsmtpUserErrorf(smtp.C550MailboxUnavail, smtp.SePol7DeliveryUnauth1, "must match authenticated user")
+		}
 	} else if !c.submission && len(rpath.IPDomain.IP) > 0 {
 		// todo future: allow if the IP is the same as this connection is coming from? does later code allow this?
 		c.log.Info("delivery from address without domain", mlog.Field("mailfrom", rpath.String()))
@@ -1337,12 +1615,32 @@ func (c *conn) cmdRcpt(p *parser) {
 	} else {
 		fpath = p.xforwardPath()
 	}
+	var notify string
+	paramSeen := map[string]bool{}
 	for p.space() {
 		// ../rfc/5321:2275
 		key := p.xparamKeyword()
 		K := strings.ToUpper(key)
+		if paramSeen[K] {
+			xsmtpUserErrorf(smtp.C501BadParamSyntax, smtp.SeProto5BadParams4, "duplicate param %q", key)
+		}
+		paramSeen[K] = true
 		switch K {
-		// todo future: DSN, ../rfc/3461, with "NOTIFY"
+		case "NOTIFY":
+			// ../rfc/3461
+			if !c.submission {
+				xsmtpUserErrorf(smtp.C555UnrecognizedAddrParams, smtp.SeSys3NotSupported3, "unrecognized parameter %q", key)
+			}
+			p.xtake("=")
+			notify = xparseNotify(p.xparamValue())
+		case "ORCPT":
+			// ../rfc/3461
+			if !c.submission {
+				xsmtpUserErrorf(smtp.C555UnrecognizedAddrParams, smtp.SeSys3NotSupported3, "unrecognized parameter %q", key)
+			}
+			// todo: include as Original-Recipient in DSNs.
+			p.xtake("=")
+			p.xparamValue()
 		default:
 			// ../rfc/5321:2230
 			xsmtpUserErrorf(smtp.C555UnrecognizedAddrParams, smtp.SeSys3NotSupported3, "unrecognized parameter %q", key)
@@ -1390,7 +1688,7 @@ func (c *conn) cmdRcpt(p *parser) {
 			cidctx := context.WithValue(mox.Context, mlog.CidKey, c.cid)
 			spfctx, spfcancel := context.WithTimeout(cidctx, time.Minute)
 			defer spfcancel()
-			receivedSPF, _, _, err := spf.Verify(spfctx, c.resolver, spfArgs)
+			receivedSPF, _, _, err := spfVerify(spfctx, c.resolver, spfArgs)
 			spfcancel()
 			if err != nil {
 				c.log.Errorx("spf verify for multiple recipients", err)
@@ -1412,21 +1710,21 @@ func (c *conn) cmdRcpt(p *parser) {
 		// which is typically the mox user.
 		acc, _ := mox.Conf.Account("mox")
 		dest := acc.Destinations["mox@localhost"]
-		c.recipients = append(c.recipients, rcptAccount{fpath, true, "mox", dest, "mox@localhost"})
+		c.recipients = append(c.recipients, rcptAccount{fpath, true, "mox", dest, "mox@localhost", notify})
 	} else if len(fpath.IPDomain.IP) > 0 {
 		if !c.submission {
 			xsmtpUserErrorf(smtp.C550MailboxUnavail, smtp.SeAddr1UnknownDestMailbox1, "not accepting email for ip")
 		}
-		c.recipients = append(c.recipients, rcptAccount{fpath, false, "", config.Destination{}, ""})
+		c.recipients = append(c.recipients, rcptAccount{fpath, false, "", config.Destination{}, "", notify})
 	} else if accountName, canonical, addr, err := mox.FindAccount(fpath.Localpart, fpath.IPDomain.Domain, true); err == nil {
 		// note: a bare postmaster, without domain, is handled by FindAccount. ../rfc/5321:735
-		c.recipients = append(c.recipients, rcptAccount{fpath, true, accountName, addr, canonical})
+		c.recipients = append(c.recipients, rcptAccount{fpath, true, accountName, addr, canonical, notify})
 	} else if errors.Is(err, mox.ErrDomainNotFound) {
 		if !c.submission {
 			xsmtpUserErrorf(smtp.C550MailboxUnavail, smtp.SeAddr1UnknownDestMailbox1, "not accepting email for domain")
 		}
 		// We'll be delivering this email.
-		c.recipients = append(c.recipients, rcptAccount{fpath, false, "", config.Destination{}, ""})
+		c.recipients = append(c.recipients, rcptAccount{fpath, false, "", config.Destination{}, "", notify})
 	} else if errors.Is(err, mox.ErrAccountNotFound) {
 		if c.submission {
 			// For submission, we're transparent about which user exists. Should be fine for the typical small-scale deploy.
@@ -1436,7 +1734,7 @@ func (c *conn) cmdRcpt(p *parser) {
 		// We pretend to accept. We don't want to let remote know the user does not exist
 		// until after DATA. Because then remote has committed to sending a message.
 		// note: not local for !c.submission is the signal this address is in error.
-		c.recipients = append(c.recipients, rcptAccount{fpath, false, "", config.Destination{}, ""})
+		c.recipients = append(c.recipients, rcptAccount{fpath, false, "", config.Destination{}, "", notify})
 	} else {
 		c.log.Errorx("looking up account for delivery", err, mlog.Field("rcptto", fpath))
 		xsmtpServerErrorf(codes{smtp.C451LocalErr, smtp.SeSys3Other0}, "error processing")
@@ -1457,6 +1755,14 @@ func (c *conn) cmdData(p *parser) {
 		// ../rfc/5321:1130
 		xsmtpUserErrorf(smtp.C503BadCmdSeq, smtp.SeProto5BadCmdOrSeq1, "missing RCPT TO")
 	}
+	if c.bdatFile != nil {
+		// ../rfc/3030
+		xsmtpUserErrorf(smtp.C503BadCmdSeq, smtp.SeProto5BadCmdOrSeq1, "cannot mix DATA and BDAT in a transaction")
+	}
+	if c.binarymime {
+		// ../rfc/3030
+		xsmtpUserErrorf(smtp.C503BadCmdSeq, smtp.SeProto5BadCmdOrSeq1, "message with BODY=BINARYMIME must be sent with BDAT")
+	}
 
 	// ../rfc/5321:2066
 	p.xend()
@@ -1517,10 +1823,132 @@ func (c *conn) cmdData(p *parser) {
 		io.Copy(io.Discard, dr)
 		return
 	}
+	c.processMessage(cmdctx, msgWriter, &dataFile)
+}
+
+// ../rfc/3030
+func (c *conn) cmdBdat(p *parser) {
+	// The chunk data follows the command. If we cannot parse its size, we cannot find
+	// the next command, and abort the connection.
+	var size int64 = -1
+	var last bool
+	t := strings.Split(p.remainder(), " ")
+	if len(t) == 2 || len(t) == 3 && strings.EqualFold(t[2], "LAST") {
+		v, err := strconv.ParseInt(t[1], 10, 64)
+		if err == nil && v >= 0 && t[0] == "" && t[1] == fmt.Sprintf("%d", v) {
+			size = v
+			last = len(t) == 3
+		}
+	}
+	if size < 0 {
+		c.writecodeline(smtp.C501BadParamSyntax, smtp.SeProto5Syntax2, "bad syntax for BDAT, expected chunk size and optional LAST", nil)
+		panic(fmt.Errorf("bad bdat syntax: %w", errIO))
+	}
+
+	// Entire chunk, and delivery for the last chunk, should be done within 30
+	// minutes, or we abort.
+	cidctx := context.WithValue(mox.Context, mlog.CidKey, c.cid)
+	cmdctx, cmdcancel := context.WithTimeout(cidctx, 30*time.Minute)
+	defer cmdcancel()
+	// Deadline is taken into account by Read and Write.
+	c.deadline, _ = cmdctx.Deadline()
+	defer func() {
+		c.deadline = time.Time{}
+	}()
+
+	// Mark as tracedata.
+	restore := c.xtrace(mlog.LevelTracedata)
+	chunk := io.LimitReader(c.r, size)
+	discard := func() {
+		_, err := io.Copy(io.Discard, chunk)
+		c.log.Check(err, "discarding bdat chunk")
+		restore()
+	}
+
+	// The chunk must always be read, also when we respond with an error. After an
+	// error, we reset the transaction, so remaining chunks are refused as well.
+	var xerr any
+	func() {
+		defer func() {
+			xerr = recover()
+		}()
+		c.xneedHello()
+		c.xcheckAuth()
+		c.xneedTLSForDelivery()
+		if c.mailFrom == nil {
+			xsmtpUserErrorf(smtp.C503BadCmdSeq, smtp.SeProto5BadCmdOrSeq1, "missing MAIL FROM")
+		}
+		if len(c.recipients) == 0 {
+			xsmtpUserErrorf(smtp.C503BadCmdSeq, smtp.SeProto5BadCmdOrSeq1, "missing RCPT TO")
+		}
+		if c.bdatFile == nil {
+			f, err := store.CreateMessageTemp("smtp-deliver")
+			if err != nil {
+				xsmtpServerErrorf(errCodes(smtp.C451LocalErr, smtp.SeSys3Other0, err), "creating temporary file for message: %s", err)
+			}
+			c.bdatFile = f
+			c.bdatWriter = &message.Writer{Writer: f}
+		}
+	}()
+	if xerr != nil {
+		discard()
+		panic(xerr)
+	}
+
+	_, err := io.Copy(&limitWriter{maxSize: c.maxMessageSize - c.bdatWriter.Size, w: c.bdatWriter}, chunk)
+	if err != nil {
+		discard()
+		c.rset()
+		if errors.Is(err, errMessageTooLarge) {
+			// ../rfc/1870:136 and ../rfc/3463:382
+			ecode := smtp.SeSys3MsgLimitExceeded4
+			if c.maxMessageSize < defaultMaxMsgSize {
+				ecode = smtp.SeMailbox2MsgLimitExceeded3
+			}
+			xsmtpUserErrorf(smtp.C552MailboxFull, ecode, "message larger than limit of %d bytes", c.maxMessageSize)
+		}
+		xsmtpServerErrorf(errCodes(smtp.C451LocalErr, smtp.SeSys3Other0, err), "error copying data to file: %s", err)
+	}
+	restore()
+
+	if !last {
+		c.bwritecodeline(smtp.C250Completed, smtp.SeOther00, fmt.Sprintf("%d octets received", size), nil)
+		return
+	}
+
+	// We take over the message file, it is removed when done.
+	dataFile := c.bdatFile
+	msgWriter := c.bdatWriter
+	c.bdatFile = nil
+	c.bdatWriter = nil
+	defer func() {
+		if dataFile != nil {
+			err := os.Remove(dataFile.Name())
+			c.log.Check(err, "removing temporary message file", mlog.Field("path", dataFile.Name()))
+			err = dataFile.Close()
+			c.log.Check(err, "removing temporary message file")
+		}
+	}()
+	c.processMessage(cmdctx, msgWriter, &dataFile)
+}
+
+// processMessage checks and delivers or submits a message received with DATA or
+// BDAT. The data file is set to nil if it was taken over.
+func (c *conn) processMessage(cmdctx context.Context, msgWriter *message.Writer, pdataFile **os.File) {
+	dataFile := *pdataFile
+	n := msgWriter.Size
+
+	c.traceID = queue.NewTraceID()
+	c.log.Debug("message data received", mlog.Field("traceid", c.traceID), mlog.Field("size", msgWriter.Size))
 
 	// Basic sanity checks on messages before we send them out to the world. Just
 	// trying to be strict in what we do to others and liberal in what we accept.
 	if c.submission {
+		// The limit of the account is lower than that of the listener, so we can still
+		// respond instead of dropping the connection. ../rfc/1870:136
+		if limit := c.messageSizeLimit(); n > limit {
+			xsmtpUserErrorf(smtp.C552MailboxFull, smtp.SeMailbox2MsgLimitExceeded3, "message of %d bytes larger than limit of %d bytes for account", n, limit)
+		}
 		if !msgWriter.HaveHeaders {
 			// ../rfc/6409:541
 			xsmtpUserErrorf(smtp.C554TransactionFailed, smtp.SeMsg6Other0, "message requires both header and body section")
@@ -1565,6 +1993,7 @@ func (c *conn) cmdData(p *parser) {
 		iprevctx, iprevcancel := context.WithTimeout(cmdctx, time.Minute)
 		var revName string
 		var revNames []string
+		var err error
 		iprevStatus, revName, revNames, err = iprev.Lookup(iprevctx, c.resolver, c.remoteIP)
 		iprevcancel()
 		if err != nil {
@@ -1626,9 +2055,9 @@ func (c *conn) cmdData(p *parser) {
 	// handle it first, and leave the rest of the function for handling wild west
 	// internet traffic.
 	if c.submission {
-		c.submit(cmdctx, recvHdrFor, msgWriter, &dataFile)
+		c.submit(cmdctx, recvHdrFor, msgWriter, pdataFile)
 	} else {
-		c.deliver(cmdctx, recvHdrFor, msgWriter, iprevStatus, &dataFile)
+		c.deliver(cmdctx, recvHdrFor, msgWriter, iprevStatus, pdataFile)
 	}
 }
 
@@ -1657,15 +2086,31 @@ func (c *conn) submit(ctx context.Context, recvHdrFor func(string) string, msgWr
 		c.log.Infox("parsing message From address", err, mlog.Field("user", c.username))
 		xsmtpUserErrorf(smtp.C550MailboxUnavail, smtp.SeMsg6Other0, "cannot parse header or From address: %v", err)
 	}
-	accName, _, _, err := mox.FindAccount(msgFrom.Localpart, msgFrom.Domain, true)
-	if err != nil || accName != c.account.Name {
-		// ../rfc/6409:522
-		if err == nil {
-			err = mox.ErrAccountNotFound
-		}
-		metricSubmission.WithLabelValues("badfrom").Inc()
-		c.log.Infox("verifying message From address", err, mlog.Field("user", c.username), mlog.Field("msgfrom", msgFrom))
-		xsmtpUserErrorf(smtp.C550MailboxUnavail, smtp.SePol7DeliveryUnauth1, "must match authenticated user")
+	var delegated bool
+	if !c.submissionFromAllowed(msgFrom.Localpart, msgFrom.Domain, true) && c.submissionFromDelegated(msgFrom.Localpart, msgFrom.Domain) {
+		c.log.Info("submission on behalf of delegating account", mlog.Field("user", c.username), mlog.Field("msgfrom", msgFrom))
+		delegated = true
+	} else if !c.submissionFromAllowed(msgFrom.Localpart, msgFrom.Domain, true) {
+		addr, ok := c.submissionFromRewrite()
+		if !ok {
+			// ../rfc/6409:522
+			metricSubmission.WithLabelValues("badfrom").Inc()
+			c.log.Info("verifying message From address", mlog.Field("user", c.username), mlog.Field("msgfrom", msgFrom))
+			xsmtpUserErrorf(smtp.C550MailboxUnavail, smtp.SePol7DeliveryUnauth1, "must match authenticated user")
+		}
+
+		// ../rfc/6409:625
+		c.log.Info("rewriting unconfigured message From address for submission", mlog.Field("user", c.username), mlog.Field("msgfrom", msgFrom), mlog.Field("rewritten", addr))
+		rf, size, err := rewriteFrom(dataFile, addr)
+		xcheckf(err, "rewriting message From header")
+		err = os.Remove(dataFile.Name())
+		c.log.Check(err, "removing temporary message file after rewriting from header", mlog.Field("path", dataFile.Name()))
+		err = dataFile.Close()
+		c.log.Check(err, "closing temporary message file after rewriting from header")
+		dataFile = rf
+		*pdataFile = rf
+		msgWriter.Size = size
+		msgFrom = addr
 	}
 
 	// Outgoing messages should not have a Return-Path header. The final receiving mail
@@ -1676,11 +2121,35 @@ func (c *conn) submit(ctx context.Context, recvHdrFor func(string) string, msgWr
 		xsmtpUserErrorf(smtp.C550MailboxUnavail, smtp.SeMsg6Other0, "message must not have Return-Path header")
 	}
 
+	// A message sent on behalf of another account identifies the delegate in the
+	// Sender header. ../rfc/5322:1353
+	if delegated {
+		if sender := header.Get("Sender"); sender != "" {
+			a, err := mail.ParseAddress(sender)
+			var addr smtp.Address
+			if err == nil {
+				addr, err = smtp.ParseAddress(a.Address)
+			}
+			if err != nil || !c.submissionFromAllowed(addr.Localpart, addr.Domain, false) {
+				metricSubmission.WithLabelValues("badheader").Inc()
+				c.log.Infox("verifying message Sender address", err, mlog.Field("user", c.username), mlog.Field("sender", sender))
+				xsmtpUserErrorf(smtp.C550MailboxUnavail, smtp.SePol7DeliveryUnauth1, "sender header must match authenticated user")
+			}
+		} else {
+			addr, err := smtp.ParseAddress(c.username)
+			xcheckf(err, "parsing username as address for sender header")
+			msgPrefix = append(msgPrefix, "Sender: <"+addr.Pack(c.smtputf8)+">\r\n"...)
+		}
+	}
+
 	// Add Message-Id header if missing.
 	// ../rfc/5321:4131 ../rfc/6409:751
-	if header.Get("Message-Id") == "" {
-		msgPrefix = append(msgPrefix, fmt.Sprintf("Message-Id: <%s>\r\n", mox.MessageIDGen(c.smtputf8))...)
+	messageID := header.Get("Message-Id")
+	if messageID == "" {
+		messageID = fmt.Sprintf("<%s>", mox.MessageIDGen(c.smtputf8))
+		msgPrefix = append(msgPrefix, "Message-Id: "+messageID+"\r\n"...)
 	}
+	c.trace("submitted", smtp.Path{}, messageID, fmt.Sprintf("by %s from %s, from %s, %d recipients, size %d", c.username, c.remoteIP, c.mailFrom.XString(true), len(c.recipients), msgWriter.Size))
 
 	// ../rfc/6409:745
 	if header.Get("Date") == "" {
@@ -1690,7 +2159,7 @@ func (c *conn) submit(ctx context.Context, recvHdrFor func(string) string, msgWr
 	// Limit damage to the internet and our reputation in case of account compromise by
 	// limiting the max number of messages sent in a 24 hour window, both total number
 	// of messages and number of first-time recipients.
-	err = c.account.DB.Read(ctx, func(tx *bstore.Tx) error {
+	err = store.DBRead(ctx, c.log, "smtpserver", c.account.DB, func(tx *bstore.Tx) error {
 		conf, _ := c.account.Conf()
 		msgmax := conf.MaxOutgoingMessagesPerDay
 		if msgmax == 0 {
@@ -1752,6 +2221,12 @@ func (c *conn) submit(ctx context.Context, recvHdrFor func(string) string, msgWr
 	})
 	xcheckf(err, "read-only transaction")
 
+	// Aggregate limit for the accounts of the domain, e.g. of a hosting customer.
+	if err := c.account.CheckDomainOutgoing(ctx, c.log, len(c.recipients)); err != nil {
+		metricSubmission.WithLabelValues("domainlimiterror").Inc()
+		xsmtpUserErrorf(smtp.C451LocalErr, smtp.SePol7DeliveryUnauth1, "%s", err)
+	}
+
 	// todo future: in a pedantic mode, we can parse the headers, and return an error if rcpt is only in To or Cc header, and not in the non-empty Bcc header. indicates a client that doesn't blind those bcc's.
 
 	// Add DKIM signatures.
@@ -1761,6 +2236,35 @@ func (c *conn) submit(ctx context.Context, recvHdrFor func(string) string, msgWr
 		xsmtpServerErrorf(codes{smtp.C451LocalErr, smtp.SeSys3Other0}, "internal error")
 	}
 
+	// Transport rules of the domain, evaluated per recipient. Subject prefixes and
+	// copies apply once for the message when a rule matches any recipient.
+	rcptRules := make([][]config.TransportRule, len(c.recipients))
+	var matchedRules []config.TransportRule
+	matchedNames := map[string]bool{}
+	for i, rcptAcc := range c.recipients {
+		rcptRules[i] = transportRules(confDom, "outgoing", msgFrom, rcptAcc.rcptTo, header)
+		for _, tr := range rcptRules[i] {
+			if !matchedNames[tr.Name] {
+				matchedNames[tr.Name] = true
+				matchedRules = append(matchedRules, tr)
+			}
+		}
+	}
+	if len(matchedRules) > 0 {
+		c.log.Info("transport rules matched", mlog.Field("rules", transportRuleNames(matchedRules)))
+		if rf, size, err := rewriteSubject(dataFile, subjectPrefixes(matchedRules)); err != nil {
+			c.log.Errorx("adding subject prefix for transport rule, continuing without", err)
+		} else if rf != nil {
+			err = os.Remove(dataFile.Name())
+			c.log.Check(err, "removing temporary message file after rewriting subject header", mlog.Field("path", dataFile.Name()))
+			err = dataFile.Close()
+			c.log.Check(err, "closing temporary message file after rewriting subject header")
+			dataFile = rf
+			*pdataFile = rf
+			msgWriter.Size = size
+		}
+	}
+
 	dkimConfig := confDom.DKIM
 	if len(dkimConfig.Sign) > 0 {
 		if canonical, err := mox.CanonicalLocalpart(msgFrom.Localpart, confDom); err != nil {
@@ -1789,7 +2293,16 @@ func (c *conn) submit(ctx context.Context, recvHdrFor func(string) string, msgWr
 	msgPrefix = append(msgPrefix, []byte(authResults.Header())...)
 
 	if Localserve {
+		// Headers of the message, for DSNs about successful deliveries.
+		var rawHeaders []byte
+		if msgWriter.HaveHeaders {
+			var err error
+			rawHeaders, err = message.ReadHeaders(bufio.NewReader(&moxio.AtReader{R: dataFile}))
+			c.log.Check(err, "reading message headers for dsn")
+		}
+
 		var timeout bool
+		var delivered []rcptAccount
 		c.account.WithWLock(func() {
 			for i, rcptAcc := range c.recipients {
 				var code int
@@ -1834,6 +2347,7 @@ func (c *conn) submit(ctx context.Context, recvHdrFor func(string) string, msgWr
 					DKIMDomains:        nil,
 					Size:               msgSize,
 					MsgPrefix:          xmsgPrefix,
+					TraceID:            c.traceID,
 				}
 
 				if err := c.account.Deliver(c.log, rcptAcc.destination, &m, dataFile, i == len(c.recipients)-1); err != nil {
@@ -1845,6 +2359,8 @@ func (c *conn) submit(ctx context.Context, recvHdrFor func(string) string, msgWr
 				}
 				metricSubmission.WithLabelValues("ok").Inc()
 				c.log.Info("submitted message delivered", mlog.Field("mailfrom", *c.mailFrom), mlog.Field("rcptto", rcptAcc.rcptTo), mlog.Field("smtputf8", c.smtputf8), mlog.Field("msgsize", msgSize))
+				c.trace("delivered", rcptAcc.rcptTo, messageID, "to account "+c.account.Name)
+				delivered = append(delivered, rcptAcc)
 
 				err := c.account.DB.Insert(ctx, &store.Outgoing{Recipient: rcptAcc.rcptTo.XString(true)})
 				xcheckf(err, "adding outgoing message")
@@ -1857,11 +2373,38 @@ func (c *conn) submit(ctx context.Context, recvHdrFor func(string) string, msgWr
 			xsmtpServerErrorf(codes{smtp.C451LocalErr, smtp.SeSys3Other0}, "timing out submission due to special localpart")
 		}
 
+		// Delivery to local accounts does not go through the queue, so we send the DSNs
+		// for successful deliveries ourselves, outside of the account lock.
+		for _, rcptAcc := range delivered {
+			hdrs := append(append([]byte(recvHdrFor(rcptAcc.rcptTo.String())), msgPrefix...), rawHeaders...)
+			qm := queue.Msg{
+				SenderAccount:      c.account.Name,
+				SenderLocalpart:    c.mailFrom.Localpart,
+				SenderDomain:       c.mailFrom.IPDomain,
+				RecipientLocalpart: rcptAcc.rcptTo.Localpart,
+				RecipientDomain:    rcptAcc.rcptTo.IPDomain,
+				SMTPUTF8:           c.smtputf8,
+				DSNNotify:          rcptAcc.notify,
+				TraceID:            c.traceID,
+			}
+			queue.DSNDelivered(c.log, qm, hdrs)
+		}
+
 	} else {
 		// We always deliver through the queue. It would be more efficient to deliver
 		// directly, but we don't want to circumvent all the anti-spam measures. Accounts
 		// on a single mox instance should be allowed to block each other.
 
+		c.messageExpire(ctx, header.Get("Expires"), messageID)
+
+		// Journal before queueing, the last recipient consumes the data file.
+		jmsgPrefix := msgPrefix
+		if !msgWriter.HaveHeaders {
+			jmsgPrefix = append(append([]byte{}, msgPrefix...), "\r\n"...)
+		}
+		journal(ctx, c.log, c.account, "sent", msgWriter.Has8bit, c.smtputf8, c.binarymime, jmsgPrefix, dataFile, int64(len(jmsgPrefix))+msgWriter.Size)
+		transportRuleBCC(ctx, c.log, c.account.Name, matchedRules, msgWriter.Has8bit, c.smtputf8, c.binarymime, jmsgPrefix, dataFile, int64(len(jmsgPrefix))+msgWriter.Size)
+
 		for i, rcptAcc := range c.recipients {
 			xmsgPrefix := append([]byte(recvHdrFor(rcptAcc.rcptTo.String())), msgPrefix...)
 			// todo: don't convert the headers to a body? it seems the body part is optional. does this have consequences for us in other places? ../rfc/5322:343
@@ -1870,7 +2413,14 @@ func (c *conn) submit(ctx context.Context, recvHdrFor func(string) string, msgWr
 			}
 
 			msgSize := int64(len(xmsgPrefix)) + msgWriter.Size
-			if _, err := queue.Add(ctx, c.log, c.account.Name, *c.mailFrom, rcptAcc.rcptTo, msgWriter.Has8bit, c.smtputf8, msgSize, xmsgPrefix, dataFile, nil, i == len(c.recipients)-1); err != nil {
+			opts := queue.AddOptions{TraceID: c.traceID, BinaryMIME: c.binarymime}
+			for _, tr := range rcptRules[i] {
+				if tr.Transport != "" {
+					opts.Transport = tr.Transport
+				}
+				opts.Hold = opts.Hold || tr.Moderate
+			}
+			if _, err := queue.AddOpts(ctx, c.log, c.account.Name, *c.mailFrom, rcptAcc.rcptTo, msgWriter.Has8bit, c.smtputf8, msgSize, xmsgPrefix, dataFile, nil, rcptAcc.notify, i == len(c.recipients)-1, opts); err != nil {
 				// Aborting the transaction is not great. But continuing and generating DSNs will
 				// probably result in errors as well...
 				metricSubmission.WithLabelValues("queueerror").Inc()
@@ -1895,6 +2445,54 @@ func (c *conn) submit(ctx context.Context, recvHdrFor func(string) string, msgWr
 	c.writecodeline(smtp.C250Completed, smtp.SeMailbox2Other0, "it is done", nil)
 }
 
+// journal writes a copy of a submitted or delivered message to the journal of
+// acc and queues copies for the journal addresses, if configured for the account
+// or its domain. The message has already been accepted, so errors are logged and
+// not returned.
+func journal(ctx context.Context, log *mlog.Log, acc *store.Account, kind string, has8bit, smtputf8, binarymime bool, msgPrefix []byte, msgFile *os.File, size int64) {
+	if err := acc.Journal(log, kind, msgPrefix, msgFile); err != nil {
+		log.Errorx("writing message to journal", err)
+	}
+
+	opts := queue.AddOptions{BinaryMIME: binarymime}
+	for _, p := range acc.JournalPaths() {
+		if _, err := queue.AddOpts(ctx, log, acc.Name, smtp.Path{}, p, has8bit, smtputf8, size, msgPrefix, msgFile, nil, "NEVER", false, opts); err != nil {
+			log.Errorx("queueing message for journal address", err, mlog.Field("address", p))
+		}
+	}
+}
+
+// hookIncoming adds webhook requests for a message delivered to an account, if
+// the account has webhooks.
+func hookIncoming(ctx context.Context, log *mlog.Log, acc *store.Account, m store.Message, rcptTo smtp.Path, msgFile *os.File) {
+	conf, _ := acc.Conf()
+	if len(conf.Webhooks) == 0 {
+		return
+	}
+
+	mb := store.Mailbox{ID: m.MailboxID}
+	if err := acc.DB.Get(ctx, &mb); err != nil {
+		log.Errorx("get mailbox for webhook", err)
+	}
+	var subject string
+	if p, err := m.LoadPart(store.FileMsgReader(m.MsgPrefix, msgFile)); err != nil {
+		log.Infox("parsing message for webhook", err)
+	} else if p.Envelope != nil {
+		subject = p.Envelope.Subject
+	}
+	queue.HookAddIncoming(log, queue.HookEvent{
+		Time:      m.Received,
+		Account:   acc.Name,
+		MailFrom:  m.MailFrom,
+		Recipient: rcptTo.XString(true),
+		MsgID:     m.ID,
+		Mailbox:   mb.Name,
+		MessageID: m.MessageID,
+		Subject:   subject,
+		Size:      m.Size,
+	})
+}
+
 func ipmasked(ip net.IP) (string, string, string) {
 	if ip.To4() != nil {
 		m1 := ip.String()
@@ -1955,6 +2553,13 @@ func (c *conn) deliver(ctx context.Context, recvHdrFor func(string) string, msgW
 	if err != nil {
 		c.log.Infox("parsing message for From address", err)
 	}
+	traceMessageID := headers.Get("Message-Id")
+	var tlsVersion string
+	if tlsc, ok := c.conn.(*tls.Conn); ok {
+		tlsVersion, _ = mox.TLSInfo(tlsc)
+	}
+	metricDeliveryTLS.WithLabelValues(mox.TLSMetricsVersion(tlsVersion), mox.TLSMetricsDomain(c.mailFrom.IPDomain.Domain)).Inc()
+	c.trace("received", smtp.Path{}, traceMessageID, fmt.Sprintf("from %s (ehlo %s), from %s, %d recipients, size %d", c.remoteIP, c.hello.Domain.Name(), c.mailFrom.XString(true), len(c.recipients), msgWriter.Size))
 
 	// Basic loop detection. ../rfc/5321:4065 ../rfc/5321:1526
 	if len(headers.Values("Received")) > 100 {
@@ -2000,7 +2605,7 @@ func (c *conn) deliver(ctx context.Context, recvHdrFor func(string) string, msgW
 		dkimctx, dkimcancel := context.WithTimeout(ctx, time.Minute)
 		defer dkimcancel()
 		// todo future: we could let user configure which dkim headers they require
-		dkimResults, dkimErr = dkim.Verify(dkimctx, c.resolver, c.smtputf8, dkim.DefaultPolicy, dataFile, ignoreTestMode)
+		dkimResults, dkimErr = dkim.Verify(dkimctx, authResolver(c.resolver), c.smtputf8, dkim.DefaultPolicy, dataFile, ignoreTestMode)
 		dkimcancel()
 	}()
 
@@ -2030,7 +2635,7 @@ func (c *conn) deliver(ctx context.Context, recvHdrFor func(string) string, msgW
 		defer wg.Done()
 		spfctx, spfcancel := context.WithTimeout(ctx, time.Minute)
 		defer spfcancel()
-		receivedSPF, spfDomain, spfExpl, spfErr = spf.Verify(spfctx, c.resolver, spfArgs)
+		receivedSPF, spfDomain, spfExpl, spfErr = spfVerify(spfctx, c.resolver, spfArgs)
 		spfcancel()
 		if spfErr != nil {
 			c.log.Infox("spf verify", spfErr)
@@ -2188,7 +2793,7 @@ func (c *conn) deliver(ctx context.Context, recvHdrFor func(string) string, msgW
 
 		dmarcctx, dmarccancel := context.WithTimeout(ctx, time.Minute)
 		defer dmarccancel()
-		dmarcUse, dmarcResult = dmarc.Verify(dmarcctx, c.resolver, msgFrom.Domain, dkimResults, receivedSPF.Result, spfIdentity, applyRandomPercentage)
+		dmarcUse, dmarcResult = dmarc.Verify(dmarcctx, authResolver(c.resolver), msgFrom.Domain, dkimResults, receivedSPF.Result, spfIdentity, applyRandomPercentage)
 		dmarccancel()
 		dmarcMethod = AuthMethod{
 			Method: "dmarc",
@@ -2247,6 +2852,23 @@ func (c *conn) deliver(ctx context.Context, recvHdrFor func(string) string, msgW
 		e := deliverError{rcptAcc.rcptTo, code, secode, userError, errmsg}
 		c.log.Info("deliver error", mlog.Field("rcptto", e.rcptTo), mlog.Field("code", code), mlog.Field("secode", "secode"), mlog.Field("usererror", userError), mlog.Field("errmsg", errmsg))
 		deliverErrors = append(deliverErrors, e)
+		c.trace("rejected", rcptAcc.rcptTo, traceMessageID, fmt.Sprintf("%d %s: %s", code, secode, errmsg))
+	}
+
+	// For rejections of messages for an account, we keep a record that the account
+	// holder can see when troubleshooting missing messages.
+	addRejection := func(log *mlog.Log, acc *store.Account, rcptAcc rcptAccount, reason, errmsg string) {
+		r := store.Rejection{
+			MailFrom: c.mailFrom.String(),
+			RcptTo:   rcptAcc.rcptTo.String(),
+			Reason:   reason,
+			Error:    errmsg,
+		}
+		if !msgFrom.IsZero() {
+			r.MsgFrom = msgFrom.String()
+		}
+		err := acc.RejectionAdd(ctx, &r)
+		log.Check(err, "recording rejection for account")
 	}
 
 	// For each recipient, do final spam analysis and delivery.
@@ -2285,7 +2907,7 @@ func (c *conn) deliver(ctx context.Context, recvHdrFor func(string) string, msgW
 		// account. They may fill up the mailbox, either with messages that have to be
 		// purged, or by filling the disk. We check both cases for IP's and networks.
 		var rateError bool // Whether returned error represents a rate error.
-		err = acc.DB.Read(ctx, func(tx *bstore.Tx) (retErr error) {
+		err = store.DBRead(ctx, log, "smtpserver", acc.DB, func(tx *bstore.Tx) (retErr error) {
 			now := time.Now()
 			defer func() {
 				log.Debugx("checking message and size delivery rates", retErr, mlog.Field("duration", time.Since(now)))
@@ -2360,10 +2982,42 @@ func (c *conn) deliver(ctx context.Context, recvHdrFor func(string) string, msgW
 			log.Debugx("refusing due to high delivery rate", err)
 			metricDelivery.WithLabelValues("highrate", "").Inc()
 			c.setSlow(true)
+			addRejection(log, acc, rcptAcc, "highrate", err.Error())
 			addError(rcptAcc, smtp.C452StorageFull, smtp.SeMailbox2Full2, true, err.Error())
 			continue
 		}
 
+		if acc.DeliveryTempfail() {
+			log.Info("refusing delivery, account is suspended")
+			metricDelivery.WithLabelValues("suspended", "").Inc()
+			addError(rcptAcc, smtp.C451LocalErr, smtp.SeMailbox2Disabled1, false, "mailbox temporarily unavailable")
+			continue
+		}
+
+		if err := acc.CheckDomainStorage(ctx, log, msgWriter.Size); errors.Is(err, store.ErrDomainStorage) {
+			log.Info("refusing delivery, storage limit of domain reached")
+			metricDelivery.WithLabelValues("domainstorage", "").Inc()
+			addError(rcptAcc, smtp.C452StorageFull, smtp.SeMailbox2Full2, false, err.Error())
+			continue
+		} else if err != nil {
+			log.Errorx("checking storage limit of domain", err)
+			addError(rcptAcc, smtp.C451LocalErr, smtp.SeSys3Other0, false, "error processing")
+			continue
+		}
+		err = acc.DB.Read(ctx, func(tx *bstore.Tx) error {
+			return acc.CheckQuota(tx, 1, msgWriter.Size)
+		})
+		if errors.Is(err, store.ErrOverQuota) {
+			log.Info("refusing delivery, account over quota")
+			metricDelivery.WithLabelValues("overquota", "").Inc()
+			addError(rcptAcc, smtp.C452StorageFull, smtp.SeMailbox2Full2, false, err.Error())
+			continue
+		} else if err != nil {
+			log.Errorx("checking quota", err)
+			addError(rcptAcc, smtp.C451LocalErr, smtp.SeSys3Other0, false, "error processing")
+			continue
+		}
+
 		// ../rfc/5321:3204
 		// ../rfc/5321:3300
 		// Received-SPF header goes before Received. ../rfc/7208:2038
@@ -2396,14 +3050,24 @@ func (c *conn) deliver(ctx context.Context, recvHdrFor func(string) string, msgW
 			DKIMDomains:        verifiedDKIMDomains,
 			Size:               int64(len(msgPrefix)) + msgWriter.Size,
 			MsgPrefix:          msgPrefix,
+			TraceID:            c.traceID,
 		}
 		d := delivery{m, dataFile, rcptAcc, acc, msgFrom, c.dnsBLs, dmarcUse, dmarcResult, dkimResults, iprevStatus}
 		a := analyze(ctx, log, c.resolver, d)
+		// Classified before we add headers, like in analyze.
+		var xmoxjunk string
+		if accConf, _ := acc.Conf(); accConf.JunkFilter != nil && accConf.JunkFilter.ScoreHeader {
+			xmoxjunk = junkScoreHeader(ctx, log, d)
+		}
 		if a.reason != "" {
 			xmoxreason := "X-Mox-Reason: " + a.reason + "\r\n"
 			m.MsgPrefix = append([]byte(xmoxreason), m.MsgPrefix...)
 			m.Size += int64(len(xmoxreason))
 		}
+		if xmoxjunk != "" {
+			m.MsgPrefix = append([]byte(xmoxjunk), m.MsgPrefix...)
+			m.Size += int64(len(xmoxjunk))
+		}
 		if !a.accept {
 			conf, _ := acc.Conf()
 			if conf.RejectsMailbox != "" {
@@ -2438,6 +3102,11 @@ func (c *conn) deliver(ctx context.Context, recvHdrFor func(string) string, msgW
 			log.Info("incoming message rejected", mlog.Field("reason", a.reason), mlog.Field("msgfrom", msgFrom))
 			metricDelivery.WithLabelValues("reject", a.reason).Inc()
 			c.setSlow(true)
+			if c.tarpit != nil {
+				// Slow down responses right away. The error response adds another failure.
+				c.tarpit.failure(c.remoteIP, c.tarpit.burst, time.Now())
+			}
+			addRejection(log, acc, rcptAcc, a.reason, a.errmsg)
 			addError(rcptAcc, a.code, a.secode, a.userError, a.errmsg)
 			continue
 		}
@@ -2492,15 +3161,79 @@ func (c *conn) deliver(ctx context.Context, recvHdrFor func(string) string, msgW
 				addError(rcptAcc, code, smtp.SeOther00, false, fmt.Sprintf("failure with code %d due to special localpart", code))
 			}
 		} else {
+			// Transport rules of the recipient domain.
+			msgFile := dataFile
+			if dc, ok := mox.Conf.Domain(rcptAcc.rcptTo.IPDomain.Domain); ok {
+				if rules := transportRules(dc, "incoming", msgFrom, rcptAcc.rcptTo, headers); len(rules) > 0 {
+					log.Info("transport rules matched", mlog.Field("rules", transportRuleNames(rules)))
+					if rf, size, err := rewriteSubject(dataFile, subjectPrefixes(rules)); err != nil {
+						log.Errorx("adding subject prefix for transport rule, continuing without", err)
+					} else if rf != nil {
+						msgFile = rf
+						m.Size = int64(len(m.MsgPrefix)) + size
+					}
+					transportRuleBCC(ctx, log, acc.Name, rules, msgWriter.Has8bit, c.smtputf8, c.binarymime, m.MsgPrefix, msgFile, m.Size)
+				}
+			}
+
+			var moderated bool
 			acc.WithWLock(func() {
-				if err := acc.Deliver(log, rcptAcc.destination, m, dataFile, false); err != nil {
+				// Blocked senders and muted threads of the account.
+				df, err := acc.DeliveryFilter(log, rcptAcc.destination, m, msgFile)
+				if err != nil {
+					log.Errorx("applying blocked senders and muted threads, delivering normally", err)
+					df = store.DeliveryFilter{}
+				}
+				if df.Drop {
+					metricDelivery.WithLabelValues("blocked", a.reason).Inc()
+					log.Info("incoming message from blocked sender not delivered", mlog.Field("msgfrom", msgFrom))
+					c.trace("dropped", rcptAcc.rcptTo, traceMessageID, "blocked sender "+msgFrom.String())
+					return
+				}
+
+				// Messages for moderated addresses are held until a moderator approves them.
+				// Messages filed into Junk for blocked senders are not held.
+				if len(rcptAcc.destination.Moderators) > 0 && df.Reason != "blocked" {
+					df.Mailbox = store.ModerationMailbox
+					df.Quiet = true
+					df.Reason = "moderated"
+					moderated = true
+				}
+
+				if df.Mailbox != "" {
+					err = acc.DeliverMailbox(log, df.Mailbox, m, msgFile, false)
+				} else {
+					err = acc.Deliver(log, rcptAcc.destination, m, msgFile, false)
+				}
+				if err != nil {
 					log.Errorx("delivering", err)
 					metricDelivery.WithLabelValues("delivererror", a.reason).Inc()
 					addError(rcptAcc, smtp.C451LocalErr, smtp.SeSys3Other0, false, "error processing")
+					moderated = false
 					return
 				}
 				metricDelivery.WithLabelValues("delivered", a.reason).Inc()
 				log.Info("incoming message delivered", mlog.Field("reason", a.reason), mlog.Field("msgfrom", msgFrom))
+				if df.Reason != "" {
+					log.Info("message filed due to blocked sender, muted thread or moderation", mlog.Field("filter", df.Reason), mlog.Field("mailbox", df.Mailbox))
+				}
+				text := fmt.Sprintf("to account %s, analysis %s", acc.Name, a.reason)
+				mb := store.Mailbox{ID: m.MailboxID}
+				if err := acc.DB.Get(ctx, &mb); err != nil {
+					log.Errorx("get mailbox for trace", err)
+				} else {
+					text += ", mailbox " + mb.Name
+				}
+				if df.Reason != "" {
+					text += ", filter " + df.Reason
+				}
+				c.trace("delivered", rcptAcc.rcptTo, traceMessageID, text)
+
+				journal(ctx, log, acc, "received", msgWriter.Has8bit, c.smtputf8, c.binarymime, m.MsgPrefix, msgFile, m.Size)
+				hookIncoming(ctx, log, acc, *m, rcptAcc.rcptTo, msgFile)
+				if !df.Quiet {
+					pushIncoming(ctx, log, acc, *m, msgFile)
+				}
 
 				conf, _ := acc.Conf()
 				if conf.RejectsMailbox != "" && messageID != "" {
@@ -2509,6 +3242,16 @@ func (c *conn) deliver(ctx context.Context, recvHdrFor func(string) string, msgW
 					}
 				}
 			})
+			// Notify outside of the lock, a moderator can be the account itself.
+			if moderated {
+				store.ModerationNotify(log, rcptAcc.destination.Moderators, rcptAcc.canonicalAddress, *m, msgFile)
+			}
+			if msgFile != dataFile {
+				err := os.Remove(msgFile.Name())
+				log.Check(err, "removing temporary message file with rewritten subject", mlog.Field("path", msgFile.Name()))
+				err = msgFile.Close()
+				log.Check(err, "closing temporary message file with rewritten subject")
+			}
 		}
 
 		err = acc.Close()
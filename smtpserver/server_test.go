@@ -4,6 +4,7 @@ package smtpserver
 // todo: test delivering a message to multiple recipients, and with some of them failing.
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/ed25519"
@@ -13,11 +14,13 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"math/big"
 	"mime/quotedprintable"
 	"net"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
 	"testing"
@@ -29,8 +32,10 @@ import (
 	"github.com/mjl-/mox/dkim"
 	"github.com/mjl-/mox/dmarcdb"
 	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/message"
 	"github.com/mjl-/mox/mlog"
 	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/oauth"
 	"github.com/mjl-/mox/queue"
 	"github.com/mjl-/mox/sasl"
 	"github.com/mjl-/mox/smtp"
@@ -433,6 +438,13 @@ func TestSpam(t *testing.T) {
 
 		// Message should now be in Rejects mailbox.
 		checkRejectsCount(1)
+
+		// And the rejection is recorded for the account.
+		rejections, err := ts.acc.Rejections(ctxbg)
+		tcheck(t, err, "list rejections")
+		if len(rejections) != 1 || rejections[0].MailFrom != mailFrom || rejections[0].RcptTo != rcptTo || rejections[0].Reason == "" {
+			t.Fatalf("got rejections %v, expected 1 for delivery", rejections)
+		}
 	})
 
 	// Mark the messages as having good reputation.
@@ -460,7 +472,16 @@ func TestSpam(t *testing.T) {
 	tcheck(t, err, "update junkiness")
 	tretrain(t, ts.acc)
 
-	// Message should be refused for spammy content.
+	// Message should be refused for spammy content. With a junk score header.
+	accConf := mox.Conf.Dynamic.Accounts["mjl"]
+	defer func() {
+		mox.Conf.Dynamic.Accounts["mjl"] = accConf
+	}()
+	nconf := accConf
+	jf := *accConf.JunkFilter
+	jf.ScoreHeader = true
+	nconf.JunkFilter = &jf
+	mox.Conf.Dynamic.Accounts["mjl"] = nconf
 	ts.run(func(err error, client *smtpclient.Client) {
 		mailFrom := "remote@example.org"
 		rcptTo := "mjl@mox.example"
@@ -471,6 +492,118 @@ func TestSpam(t *testing.T) {
 		if err == nil || !errors.As(err, &cerr) || cerr.Code != smtp.C451LocalErr {
 			t.Fatalf("attempt to deliver spamy message, got err %v, expected smtpclient.Error with code %d", err, smtp.C451LocalErr)
 		}
+
+		checkRejectsCount(1)
+		q := bstore.QueryDB[store.Message](ctxbg, ts.acc.DB)
+		q.SortDesc("ID")
+		q.Limit(1)
+		rm, err := q.Get()
+		tcheck(t, err, "get rejected message")
+		if !strings.HasPrefix(string(rm.MsgPrefix), "X-Mox-Junk: probability=") || !strings.Contains(string(rm.MsgPrefix), ";\r\n\tspam=\"") {
+			t.Fatalf("rejected message without junk score header, prefix %q", rm.MsgPrefix)
+		}
+	})
+}
+
+// Test that a failing DMARC reject policy is ignored for a trusted forwarder
+// configured as DMARC override.
+func TestDMARCOverride(t *testing.T) {
+	resolver := dns.MockResolver{
+		A: map[string][]string{
+			"example.org.": {"127.0.0.10"}, // For mx check.
+		},
+		TXT: map[string][]string{
+			"example.org.":        {"v=spf1 -all"},
+			"_dmarc.example.org.": {"v=DMARC1;p=reject"},
+		},
+		PTR: map[string][]string{
+			"127.0.0.10": {"example.org."}, // For iprev check.
+		},
+	}
+	ts := newTestServer(t, "../testdata/smtp/mox.conf", resolver)
+	defer ts.close()
+
+	deliver := func(expCode int) {
+		t.Helper()
+		ts.run(func(err error, client *smtpclient.Client) {
+			t.Helper()
+			mailFrom := "remote@example.org"
+			rcptTo := "mjl@mox.example"
+			if err == nil {
+				err = client.Deliver(ctxbg, mailFrom, rcptTo, int64(len(deliverMessage)), strings.NewReader(deliverMessage), false, false)
+			}
+			var cerr smtpclient.Error
+			if expCode == 0 {
+				tcheck(t, err, "deliver")
+			} else if err == nil || !errors.As(err, &cerr) || cerr.Code != expCode {
+				t.Fatalf("deliver, got err %v, expected smtpclient.Error with code %d", err, expCode)
+			}
+		})
+	}
+
+	// DMARC fails, message is rejected.
+	deliver(smtp.C550MailboxUnavail)
+
+	// Override for a different network does not match.
+	_, otherNet, _ := net.ParseCIDR("192.0.2.0/24")
+	_, ourNet, _ := net.ParseCIDR("127.0.0.10/32")
+	mox.Conf.Dynamic.DMARCOverrides = []config.DMARCOverride{{Name: "other", IPs: []string{"192.0.2.0/24"}, IPNets: []net.IPNet{*otherNet}}}
+	deliver(smtp.C550MailboxUnavail)
+
+	// With a matching override, the message is accepted.
+	mox.Conf.Dynamic.DMARCOverrides = append(mox.Conf.Dynamic.DMARCOverrides, config.DMARCOverride{Name: "forwarder", IPs: []string{"127.0.0.10"}, IPNets: []net.IPNet{*ourNet}})
+	defer func() {
+		mox.Conf.Dynamic.DMARCOverrides = nil
+	}()
+	deliver(0)
+
+	l := mox.DMARCOverrides()
+	if len(l) != 2 || l[0].Hits != 0 || l[1].Hits != 1 || l[1].LastHit.IsZero() {
+		t.Fatalf("got dmarc override usage %#v, expected 1 hit for second override", l)
+	}
+}
+
+// Configured notices are added to the greeting for matching service and
+// listener, and clients still parse the multiline greeting.
+func TestNotices(t *testing.T) {
+	ts := newTestServer(t, "../testdata/smtp/mox.conf", dns.MockResolver{})
+	defer ts.close()
+
+	mox.Conf.Dynamic.Notices = []config.Notice{
+		{Text: "maintenance on saturday"},
+		{Text: "imap only", Services: []string{"imap"}},
+		{Text: "other listener", Listeners: []string{"other"}},
+		{Text: "ended", EndTime: time.Now().Add(-time.Hour)},
+		{Text: "for domain users", Domains: []string{"mox.example"}, DNSDomains: []dns.Domain{{ASCII: "mox.example"}}},
+	}
+	defer func() {
+		mox.Conf.Dynamic.Notices = nil
+	}()
+
+	serverConn, clientConn := net.Pipe()
+	serverdone := make(chan struct{})
+	go func() {
+		serve("test", ts.cid, dns.Domain{ASCII: "mox.example"}, nil, serverConn, ts.resolver, false, false, 100<<20, false, false, nil, 0)
+		close(serverdone)
+	}()
+	br := bufio.NewReader(clientConn)
+	var lines []string
+	for {
+		line, err := br.ReadString('\n')
+		tcheck(t, err, "read greeting")
+		lines = append(lines, line)
+		if strings.HasPrefix(line, "220 ") {
+			break
+		}
+	}
+	clientConn.Close()
+	<-serverdone
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "220-mox.example ESMTP mox ") || lines[1] != "220 maintenance on saturday\r\n" {
+		t.Fatalf("got greeting %q, expected hostname and single notice", lines)
+	}
+
+	ts.run(func(err error, client *smtpclient.Client) {
+		tcheck(t, err, "init client")
 	})
 }
 
@@ -942,6 +1075,230 @@ func TestNonSMTP(t *testing.T) {
 	}
 }
 
+// Test BINARYMIME is not announced for submission, those messages are DKIM-signed
+// and could not be converted for a next hop without BINARYMIME.
+func TestBinaryMIMESubmission(t *testing.T) {
+	ts := newTestServer(t, "../testdata/smtp/mox.conf", dns.MockResolver{})
+	defer ts.close()
+
+	for _, submission := range []bool{false, true} {
+		ts.submission = submission
+		ts.run(func(err error, client *smtpclient.Client) {
+			tcheck(t, err, "init client")
+			if client.SupportsBinaryMIME() == submission {
+				t.Fatalf("binarymime announced %v for submission %v", client.SupportsBinaryMIME(), submission)
+			}
+		})
+	}
+}
+
+// Test DSN extension parameters, only allowed for submission.
+func TestDSNParams(t *testing.T) {
+	ts := newTestServer(t, "../testdata/smtp/mox.conf", dns.MockResolver{})
+	defer ts.close()
+
+	test := func(submission bool, cmds []string, expDSN bool, expCodes []string) {
+		t.Helper()
+
+		ts.cid += 2
+		serverConn, clientConn := net.Pipe()
+		defer serverConn.Close()
+		serverdone := make(chan struct{})
+		defer func() { <-serverdone }()
+		go func() {
+			serve("test", ts.cid-2, dns.Domain{ASCII: "mox.example"}, nil, serverConn, ts.resolver, submission, false, 100<<20, false, false, ts.dnsbls, 0)
+			close(serverdone)
+		}()
+		defer clientConn.Close()
+
+		br := bufio.NewReader(clientConn)
+		readResponse := func() (lines []string) {
+			t.Helper()
+			for {
+				line, err := br.ReadString('\n')
+				tcheck(t, err, "read response")
+				lines = append(lines, strings.TrimRight(line, "\r\n"))
+				if len(line) < 4 || line[3] != '-' {
+					return
+				}
+			}
+		}
+		readResponse() // Greeting.
+
+		fmt.Fprintf(clientConn, "EHLO mox.example\r\n")
+		var haveDSN bool
+		for _, line := range readResponse() {
+			haveDSN = haveDSN || line[4:] == "DSN"
+		}
+		if haveDSN != expDSN {
+			t.Fatalf("got dsn extension %v, expected %v", haveDSN, expDSN)
+		}
+		for i, cmd := range cmds {
+			fmt.Fprintf(clientConn, "%s\r\n", cmd)
+			lines := readResponse()
+			if last := lines[len(lines)-1]; !strings.HasPrefix(last, expCodes[i]+" ") {
+				t.Fatalf("command %q: got response %q, expected code %s", cmd, last, expCodes[i])
+			}
+		}
+	}
+
+	auth := "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00mjl@mox.example\x00testtest"))
+	test(true, []string{
+		auth,
+		"MAIL FROM:<mjl@mox.example> RET=HDRS ENVID=test+2Bid",
+		"RCPT TO:<remote@example.org> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;remote@example.org",
+		"RCPT TO:<remote2@example.org> NOTIFY=never",
+		"RCPT TO:<remote3@example.org> NOTIFY=SUCCESS,NEVER",
+		"RCPT TO:<remote3@example.org> NOTIFY=DELAY,DELAY",
+		"RCPT TO:<remote3@example.org> NOTIFY=DELAY NOTIFY=DELAY",
+	}, true, []string{"235", "250", "250", "250", "501", "501", "501"})
+	test(true, []string{auth, "MAIL FROM:<mjl@mox.example> RET=BOGUS"}, true, []string{"235", "501"})
+	test(false, []string{"MAIL FROM:<remote@example.org> RET=HDRS"}, false, []string{"555"})
+}
+
+// Test SASL mechanisms configured for a listener, restricted by network.
+func TestAuthMechanisms(t *testing.T) {
+	ts := newTestServer(t, "../testdata/smtp/mox.conf", dns.MockResolver{})
+	defer ts.close()
+
+	origListener := mox.Conf.Static.Listeners["test"]
+	defer func() {
+		mox.Conf.Static.Listeners["test"] = origListener
+	}()
+	_, localnet, _ := net.ParseCIDR("127.0.0.0/8")
+	_, othernet, _ := net.ParseCIDR("192.168.1.0/24")
+	l := origListener
+	l.AuthMechanisms = []config.AuthMechanism{
+		{Mechanism: "SCRAM-SHA-256"},
+		{Mechanism: "CRAM-MD5", ParsedIPNets: []net.IPNet{*othernet}},
+		{Mechanism: "PLAIN", ParsedIPNets: []net.IPNet{*localnet}},
+	}
+	mox.Conf.Static.Listeners["test"] = l
+
+	test := func(expAuth string, cmd string, expCode string) {
+		t.Helper()
+
+		ts.cid += 2
+		serverConn, clientConn := net.Pipe()
+		defer serverConn.Close()
+		serverdone := make(chan struct{})
+		defer func() { <-serverdone }()
+		go func() {
+			serve("test", ts.cid-2, dns.Domain{ASCII: "mox.example"}, nil, serverConn, ts.resolver, true, false, 100<<20, false, false, nil, 0)
+			close(serverdone)
+		}()
+		defer clientConn.Close()
+
+		br := bufio.NewReader(clientConn)
+		readResponse := func() (lines []string) {
+			t.Helper()
+			for {
+				line, err := br.ReadString('\n')
+				tcheck(t, err, "read response")
+				lines = append(lines, strings.TrimRight(line, "\r\n"))
+				if len(line) < 4 || line[3] != '-' {
+					return
+				}
+			}
+		}
+		readResponse() // Greeting.
+
+		fmt.Fprintf(clientConn, "EHLO mox.example\r\n")
+		var auth string
+		for _, line := range readResponse() {
+			if strings.HasPrefix(line[4:], "AUTH ") {
+				auth = line[4:]
+			}
+		}
+		if auth != expAuth {
+			t.Fatalf("got ehlo %q, expected %q", auth, expAuth)
+		}
+		fmt.Fprintf(clientConn, "%s\r\n", cmd)
+		lines := readResponse()
+		if last := lines[len(lines)-1]; !strings.HasPrefix(last, expCode+" ") {
+			t.Fatalf("command %q: got response %q, expected code %s", cmd, last, expCode)
+		}
+	}
+
+	// Test connections come from 127.0.0.10.
+	plain := "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00mjl@mox.example\x00testtest"))
+	test("AUTH SCRAM-SHA-256 PLAIN", plain, "235")
+	test("AUTH SCRAM-SHA-256 PLAIN", "AUTH CRAM-MD5", "504")
+	test("AUTH SCRAM-SHA-256 PLAIN", "AUTH SCRAM-SHA-1 biwsbj1tamxAbW94LmV4YW1wbGUscj1ub25jZQ==", "504")
+
+	// PLAIN is removed when restricted to TLS.
+	l.AuthMechanisms[2] = config.AuthMechanism{Mechanism: "PLAIN", RequireTLS: true}
+	test("AUTH SCRAM-SHA-256", plain, "504")
+
+	// Bearer tokens, when oauth is configured.
+	bearer := func(mech, resp string) string {
+		return "AUTH " + mech + " " + base64.StdEncoding.EncodeToString([]byte(resp))
+	}
+	l.AuthMechanisms = nil
+	mox.Conf.Static.Listeners["test"] = l
+	test("AUTH SCRAM-SHA-256 SCRAM-SHA-1 CRAM-MD5 PLAIN", bearer("OAUTHBEARER", "n,,\x01auth=Bearer mjl@mox.example\x01\x01"), "504")
+	mox.Conf.Static.OAuth = &config.OAuth{Validator: fakeValidator{}}
+	defer func() {
+		mox.Conf.Static.OAuth = nil
+	}()
+	l.AuthMechanisms = []config.AuthMechanism{{Mechanism: "OAUTHBEARER"}, {Mechanism: "XOAUTH2"}}
+	mox.Conf.Static.Listeners["test"] = l
+	test("AUTH OAUTHBEARER XOAUTH2", bearer("OAUTHBEARER", "n,,\x01auth=Bearer mjl@mox.example\x01\x01"), "235")
+	test("AUTH OAUTHBEARER XOAUTH2", bearer("XOAUTH2", "user=mjl@mox.example\x01auth=Bearer mjl@mox.example\x01\x01"), "235")
+	test("AUTH OAUTHBEARER XOAUTH2", bearer("OAUTHBEARER", "n,a=other@mox.example,\x01auth=Bearer mjl@mox.example\x01\x01"), "535")
+	test("AUTH OAUTHBEARER XOAUTH2", bearer("OAUTHBEARER", "n,,\x01auth=Bearer unknown@mox.example\x01\x01"), "535")
+	test("AUTH OAUTHBEARER XOAUTH2", bearer("OAUTHBEARER", "n,,\x01auth=Bearer down\x01\x01"), "454")
+	// Invalid token, the error is sent as challenge.
+	test("AUTH OAUTHBEARER XOAUTH2", bearer("OAUTHBEARER", "n,,\x01auth=Bearer badtoken\x01\x01"), "334")
+}
+
+// fakeValidator accepts tokens that are email addresses, and fails on "down".
+type fakeValidator struct{}
+
+func (fakeValidator) Validate(ctx context.Context, token string) (string, error) {
+	if token == "down" {
+		return "", errors.New("identity provider unavailable")
+	} else if !strings.Contains(token, "@") {
+		return "", oauth.ErrInvalidToken
+	}
+	return token, nil
+}
+
+// Test the message size limit of an account for submissions.
+func TestMessageSizeLimit(t *testing.T) {
+	ts := newTestServer(t, "../testdata/smtp/mox.conf", dns.MockResolver{})
+	defer ts.close()
+
+	ts.user = "mjl@mox.example"
+	ts.pass = "testtest"
+	ts.submission = true
+
+	accConf := mox.Conf.Dynamic.Accounts["mjl"]
+	defer func() {
+		mox.Conf.Dynamic.Accounts["mjl"] = accConf
+	}()
+	nc := accConf
+	nc.MessageSizeLimit = int64(len(submitMessage))
+	mox.Conf.Dynamic.Accounts["mjl"] = nc
+
+	testSubmit := func(msg string, expErr *smtpclient.Error) {
+		t.Helper()
+		ts.run(func(err error, client *smtpclient.Client) {
+			t.Helper()
+			if err == nil {
+				err = client.Deliver(ctxbg, "mjl@mox.example", "remote@example.org", int64(len(msg)), strings.NewReader(msg), false, false)
+			}
+			var cerr smtpclient.Error
+			if expErr == nil && err != nil || expErr != nil && (err == nil || !errors.As(err, &cerr) || cerr.Secode != expErr.Secode) {
+				t.Fatalf("got err %#v, expected %#v", err, expErr)
+			}
+		})
+	}
+
+	testSubmit(submitMessage, nil)
+	testSubmit(submitMessage+"more\r\n", &smtpclient.Error{Code: smtp.C552MailboxFull, Secode: smtp.SeMailbox2MsgLimitExceeded3})
+}
+
 // Test limits on outgoing messages.
 func TestLimitOutgoing(t *testing.T) {
 	ts := newTestServer(t, "../testdata/smtp/sendlimit/mox.conf", dns.MockResolver{})
@@ -1180,3 +1537,276 @@ func TestEmptylocalpart(t *testing.T) {
 
 	testDeliver(`""@mox.example`, nil)
 }
+
+// Test submission with From addresses not belonging to the account, and
+// rewriting them.
+func TestSubmissionFrom(t *testing.T) {
+	ts := newTestServer(t, "../testdata/smtp/mox.conf", dns.MockResolver{})
+	defer ts.close()
+
+	ts.user = "mjl@mox.example"
+	ts.pass = "testtest"
+	ts.submission = true
+
+	testSubmit := func(mailFrom, msgFrom string, expErr *smtpclient.Error) {
+		t.Helper()
+		ts.run(func(err error, client *smtpclient.Client) {
+			t.Helper()
+			msg := strings.ReplaceAll(fmt.Sprintf(`From: "Other" <%s>
+To: <remote@example.org>
+Subject: test
+Message-Id: <test@mox.example>
+
+test email
+`, msgFrom), "\n", "\r\n")
+			if err == nil {
+				err = client.Deliver(ctxbg, mailFrom, "remote@example.org", int64(len(msg)), strings.NewReader(msg), false, false)
+			}
+			var cerr smtpclient.Error
+			if expErr == nil && err != nil || expErr != nil && (err == nil || !errors.As(err, &cerr) || cerr.Secode != expErr.Secode) {
+				t.Fatalf("got err %#v, expected %#v", err, expErr)
+			}
+		})
+	}
+
+	badFrom := &smtpclient.Error{Code: smtp.C550MailboxUnavail, Secode: smtp.SePol7DeliveryUnauth1}
+	testSubmit("other@mox2.example", "mjl@mox.example", badFrom)
+	testSubmit("mjl@mox.example", "other@mox2.example", badFrom)
+
+	accConf := mox.Conf.Dynamic.Accounts["mjl"]
+	defer func() {
+		mox.Conf.Dynamic.Accounts["mjl"] = accConf
+	}()
+	conf := accConf
+	conf.SubmissionFromAllowed = []string{"@mox2.example"}
+	mox.Conf.Dynamic.Accounts["mjl"] = conf
+	testSubmit("other@mox2.example", "other@mox2.example", nil)
+	testSubmit("mjl@mox.example", "x@other.example", badFrom)
+
+	conf.SubmissionFromAllowed = nil
+	conf.SubmissionFromRewrite = true
+	mox.Conf.Dynamic.Accounts["mjl"] = conf
+	testSubmit("other@mox2.example", "other@mox2.example", nil)
+
+	msgs, err := queue.List(ctxbg)
+	tcheck(t, err, "listing queue")
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].ID > msgs[j].ID
+	})
+	tcompare(t, msgs[0].Sender().String(), "mjl@mox.example")
+	f, err := queue.OpenMessage(ctxbg, msgs[0].ID)
+	tcheck(t, err, "open message in queue")
+	defer f.Close()
+	msgFrom, _, err := message.From(f)
+	tcheck(t, err, "parsing message from")
+	tcompare(t, msgFrom.String(), "mjl@mox.example")
+}
+
+// Test rewriting the From header of messages without body, and without empty
+// line after the header section.
+func TestRewriteFrom(t *testing.T) {
+	ts := newTestServer(t, "../testdata/smtp/mox.conf", dns.MockResolver{})
+	defer ts.close()
+
+	addr := smtp.Address{Localpart: "mjl", Domain: dns.Domain{ASCII: "mox.example"}}
+	test := func(msg, exp string) {
+		t.Helper()
+		msgFile, err := store.CreateMessageTemp("test")
+		tcheck(t, err, "create temp file")
+		defer os.Remove(msgFile.Name())
+		defer msgFile.Close()
+		_, err = msgFile.Write([]byte(msg))
+		tcheck(t, err, "write message")
+
+		f, size, err := rewriteFrom(msgFile, addr)
+		tcheck(t, err, "rewrite from")
+		defer os.Remove(f.Name())
+		defer f.Close()
+		buf, err := io.ReadAll(io.NewSectionReader(f, 0, size))
+		tcheck(t, err, "read rewritten message")
+		tcompare(t, string(buf), exp)
+	}
+
+	test("From: \"Other\" <other@mox2.example>\r\nSubject: test\r\n\r\nbody\r\n", "From: \"Other\" <mjl@mox.example>\r\nSubject: test\r\n\r\nbody\r\n")
+	test("Subject: test\r\nFrom: \"Other\" <other@mox2.example>\r\n", "Subject: test\r\nFrom: \"Other\" <mjl@mox.example>\r\n")
+	test("Subject: test\r\nFrom: \"Other\"\r\n <other@mox2.example>", "Subject: test\r\nFrom: \"Other\" <mjl@mox.example>\r\n")
+}
+
+// Test submission with From address of another account that has the
+// authenticated account as send delegate.
+func TestSubmissionDelegate(t *testing.T) {
+	ts := newTestServer(t, "../testdata/smtp/mox.conf", dns.MockResolver{})
+	defer ts.close()
+
+	ts.user = "mjl@mox.example"
+	ts.pass = "testtest"
+	ts.submission = true
+
+	testSubmit := func(mailFrom, msgFrom, sender string, expErr *smtpclient.Error) {
+		t.Helper()
+		ts.run(func(err error, client *smtpclient.Client) {
+			t.Helper()
+			var senderHdr string
+			if sender != "" {
+				senderHdr = fmt.Sprintf("Sender: <%s>\n", sender)
+			}
+			msg := strings.ReplaceAll(fmt.Sprintf(`From: "Other" <%s>
+%sTo: <remote@example.org>
+Subject: test
+Message-Id: <test@mox.example>
+
+test email
+`, msgFrom, senderHdr), "\n", "\r\n")
+			if err == nil {
+				err = client.Deliver(ctxbg, mailFrom, "remote@example.org", int64(len(msg)), strings.NewReader(msg), false, false)
+			}
+			var cerr smtpclient.Error
+			if expErr == nil && err != nil || expErr != nil && (err == nil || !errors.As(err, &cerr) || cerr.Secode != expErr.Secode) {
+				t.Fatalf("got err %#v, expected %#v", err, expErr)
+			}
+		})
+	}
+
+	badFrom := &smtpclient.Error{Code: smtp.C550MailboxUnavail, Secode: smtp.SePol7DeliveryUnauth1}
+	testSubmit("other@mox2.example", "other@mox2.example", "", badFrom)
+	testSubmit("mjl@mox.example", "other@mox2.example", "", badFrom)
+
+	accConf := mox.Conf.Dynamic.Accounts["other"]
+	defer func() {
+		mox.Conf.Dynamic.Accounts["other"] = accConf
+	}()
+	conf := accConf
+	conf.SendDelegates = []string{"mjl"}
+	mox.Conf.Dynamic.Accounts["other"] = conf
+	testSubmit("other@mox2.example", "other@mox2.example", "", nil)
+	testSubmit("mjl@mox.example", "other@mox2.example", "mjl@mox2.example", nil)
+	testSubmit("mjl@mox.example", "other@mox2.example", "other@mox2.example", badFrom) // Sender must be delegate.
+
+	msgs, err := queue.List(ctxbg)
+	tcheck(t, err, "listing queue")
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].ID < msgs[j].ID
+	})
+	if len(msgs) != 2 {
+		t.Fatalf("got %d messages in queue, expected 2", len(msgs))
+	}
+	for i, exp := range []string{"<mjl@mox.example>", "<mjl@mox2.example>"} {
+		f, err := queue.OpenMessage(ctxbg, msgs[i].ID)
+		tcheck(t, err, "open message in queue")
+		_, header, err := message.From(f)
+		f.Close()
+		tcheck(t, err, "parsing message header")
+		tcompare(t, header.Values("Sender"), []string{exp})
+	}
+}
+
+// Test transport rules for outgoing and incoming messages.
+func TestTransportRules(t *testing.T) {
+	resolver := dns.MockResolver{
+		A: map[string][]string{
+			"example.org.": {"127.0.0.10"}, // For mx check.
+		},
+		PTR: map[string][]string{
+			"127.0.0.10": {"example.org."}, // For iprev check.
+		},
+	}
+	ts := newTestServer(t, "../testdata/smtp/mox.conf", resolver)
+	defer ts.close()
+
+	xregexp := func(s string) *regexp.Regexp {
+		return regexp.MustCompile(s)
+	}
+	dom, _ := mox.Conf.Domain(dns.Domain{ASCII: "mox.example"})
+	origDom := dom
+	defer func() {
+		mox.Conf.Dynamic.Domains["mox.example"] = origDom
+	}()
+	dom.TransportRules = []config.TransportRule{
+		{
+			Name:                    "moderate",
+			Direction:               "outgoing",
+			RecipientRegexp:         "@example\\.org$",
+			RecipientRegexpCompiled: xregexp("@example\\.org$"),
+			SubjectPrefix:           "[Ext] ",
+			BCC:                     []string{"compliance@other.example"},
+			BCCPaths:                []smtp.Path{{Localpart: "compliance", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "other.example"}}}},
+			Moderate:                true,
+		},
+		{
+			Name:                  "external",
+			Direction:             "incoming",
+			HeadersRegexpCompiled: [][2]*regexp.Regexp{{xregexp("^subject$"), xregexp("test")}},
+			SubjectPrefix:         "[External] ",
+		},
+		{
+			Name:                 "nomatch",
+			SenderRegexpCompiled: xregexp("@nomatch\\.example$"),
+			SubjectPrefix:        "[Nomatch] ",
+		},
+	}
+	mox.Conf.Dynamic.Domains["mox.example"] = dom
+
+	subject := func(r io.ReaderAt) string {
+		t.Helper()
+		_, header, err := message.From(r)
+		tcheck(t, err, "parsing message")
+		return header.Get("Subject")
+	}
+
+	// Outgoing: message is held, with subject prefix, and a copy is queued.
+	ts.user = "mjl@mox.example"
+	ts.pass = "testtest"
+	ts.submission = true
+	ts.run(func(err error, client *smtpclient.Client) {
+		t.Helper()
+		if err == nil {
+			err = client.Deliver(ctxbg, "mjl@mox.example", "remote@example.org", int64(len(submitMessage)), strings.NewReader(submitMessage), false, false)
+		}
+		tcheck(t, err, "submit")
+	})
+	msgs, err := queue.List(ctxbg)
+	tcheck(t, err, "listing queue")
+	if len(msgs) != 2 {
+		t.Fatalf("got %d messages in queue, expected 2", len(msgs))
+	}
+	for _, qm := range msgs {
+		switch qm.Recipient().String() {
+		case "remote@example.org":
+			tcompare(t, qm.Hold, true)
+		case "compliance@other.example":
+			tcompare(t, qm.Hold, false)
+			tcompare(t, qm.Sender().String(), "")
+		default:
+			t.Fatalf("unexpected recipient %s in queue", qm.Recipient())
+		}
+		f, err := queue.OpenMessage(ctxbg, qm.ID)
+		tcheck(t, err, "open message in queue")
+		tcompare(t, subject(f), "[Ext] test")
+		f.Close()
+	}
+
+	// Kicking releases the held message.
+	n, err := queue.Kick(ctxbg, 0, "example.org", "", nil)
+	tcheck(t, err, "kick")
+	tcompare(t, n, 1)
+	msgs, err = queue.List(ctxbg)
+	tcheck(t, err, "listing queue")
+	for _, qm := range msgs {
+		tcompare(t, qm.Hold, false)
+	}
+
+	// Incoming: subject prefix is added.
+	ts.submission = false
+	ts.user = ""
+	ts.pass = ""
+	ts.run(func(err error, client *smtpclient.Client) {
+		t.Helper()
+		if err == nil {
+			err = client.Deliver(ctxbg, "remote@example.org", "mjl@mox.example", int64(len(deliverMessage)), strings.NewReader(deliverMessage), false, false)
+		}
+		tcheck(t, err, "deliver")
+	})
+	m, err := bstore.QueryDB[store.Message](ctxbg, ts.acc.DB).SortDesc("ID").Limit(1).Get()
+	tcheck(t, err, "get delivered message")
+	tcompare(t, subject(ts.acc.MessageReader(m)), "[External] test")
+}
@@ -0,0 +1,152 @@
+package smtpserver
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/mox-"
+)
+
+var (
+	metricTarpitDelay = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "mox_smtpserver_tarpit_delay_seconds",
+			Help:    "Delays of SMTP responses to clients with failures, for listeners with a tarpit.",
+			Buckets: []float64{1, 2, 5, 10, 20, 30, 60},
+		},
+	)
+)
+
+// tarpit keeps a token bucket per remote IP (IPv4 address or IPv6 /64) for an SMTP
+// listener. Failures take tokens. When the bucket is empty, responses are delayed.
+type tarpit struct {
+	burst           float64
+	recoverInterval time.Duration
+	delayPerFailure time.Duration
+	maxDelay        time.Duration
+
+	sync.Mutex
+	buckets   map[string]*tarpitBucket
+	lastClean time.Time
+}
+
+type tarpitBucket struct {
+	tokens float64 // Negative when clients have more failures than the burst.
+	last   time.Time
+}
+
+var tarpits = struct {
+	sync.Mutex
+	listeners map[string]*tarpit
+}{
+	listeners: map[string]*tarpit{},
+}
+
+// tarpitForListener returns the tarpit for the named listener, or nil if the
+// listener has no tarpit configured. All SMTP listeners for the same named
+// listener share state.
+func tarpitForListener(listenerName string) *tarpit {
+	conf := mox.Conf.Static.Listeners[listenerName].SMTP.Tarpit
+	if conf == nil {
+		return nil
+	}
+
+	tarpits.Lock()
+	defer tarpits.Unlock()
+	tp := tarpits.listeners[listenerName]
+	if tp == nil {
+		tp = newTarpit(*conf)
+		tarpits.listeners[listenerName] = tp
+	}
+	return tp
+}
+
+func newTarpit(conf config.Tarpit) *tarpit {
+	tp := &tarpit{
+		burst:           float64(conf.Burst),
+		recoverInterval: conf.RecoverInterval,
+		delayPerFailure: conf.DelayPerFailure,
+		maxDelay:        conf.MaxDelay,
+		buckets:         map[string]*tarpitBucket{},
+	}
+	if tp.burst <= 0 {
+		tp.burst = 5
+	}
+	if tp.recoverInterval <= 0 {
+		tp.recoverInterval = time.Minute
+	}
+	if tp.delayPerFailure <= 0 {
+		tp.delayPerFailure = 2 * time.Second
+	}
+	if tp.maxDelay <= 0 {
+		tp.maxDelay = 30 * time.Second
+	}
+	return tp
+}
+
+func tarpitKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+// bucket returns the bucket for ip, refilled for the time passed since its last
+// use. Must be called with lock held.
+func (tp *tarpit) bucket(ip net.IP, now time.Time) *tarpitBucket {
+	// Remove buckets that are full again, so the map doesn't keep growing.
+	if now.Sub(tp.lastClean) > time.Hour {
+		for k, b := range tp.buckets {
+			if b.tokens+float64(now.Sub(b.last))/float64(tp.recoverInterval) >= tp.burst {
+				delete(tp.buckets, k)
+			}
+		}
+		tp.lastClean = now
+	}
+
+	k := tarpitKey(ip)
+	b := tp.buckets[k]
+	if b == nil {
+		b = &tarpitBucket{tokens: tp.burst, last: now}
+		tp.buckets[k] = b
+		return b
+	}
+	b.tokens += float64(now.Sub(b.last)) / float64(tp.recoverInterval)
+	if b.tokens > tp.burst {
+		b.tokens = tp.burst
+	}
+	b.last = now
+	return b
+}
+
+// failure takes n tokens from the bucket of ip. The deficit is limited to what is
+// needed for the maximum delay, so clients can recover in reasonable time.
+func (tp *tarpit) failure(ip net.IP, n float64, now time.Time) {
+	tp.Lock()
+	defer tp.Unlock()
+	b := tp.bucket(ip, now)
+	b.tokens -= n
+	if min := -float64(tp.maxDelay) / float64(tp.delayPerFailure); b.tokens < min {
+		b.tokens = min
+	}
+}
+
+// delay returns how long to wait before sending a response to ip.
+func (tp *tarpit) delay(ip net.IP, now time.Time) time.Duration {
+	tp.Lock()
+	defer tp.Unlock()
+	b := tp.bucket(ip, now)
+	if b.tokens >= 0 {
+		return 0
+	}
+	d := time.Duration(-b.tokens * float64(tp.delayPerFailure))
+	if d > tp.maxDelay {
+		d = tp.maxDelay
+	}
+	return d
+}
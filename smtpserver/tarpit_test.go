@@ -0,0 +1,41 @@
+package smtpserver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mjl-/mox/config"
+)
+
+func TestTarpit(t *testing.T) {
+	tp := newTarpit(config.Tarpit{Burst: 2, RecoverInterval: time.Minute, DelayPerFailure: time.Second, MaxDelay: 5 * time.Second})
+
+	ip := net.ParseIP("10.0.0.1")
+	now := time.Now()
+	check := func(ip net.IP, tm time.Time, exp time.Duration) {
+		t.Helper()
+		if d := tp.delay(ip, tm); d != exp {
+			t.Fatalf("got delay %v, expected %v", d, exp)
+		}
+	}
+
+	check(ip, now, 0)
+	tp.failure(ip, 1, now)
+	tp.failure(ip, 1, now)
+	check(ip, now, 0) // Within burst.
+	tp.failure(ip, 1, now)
+	check(ip, now, time.Second)
+	tp.failure(ip, 10, now)
+	check(ip, now, 5*time.Second) // Limited to max delay.
+
+	// Other IP, and IPv6 in same /64 is treated as same IP.
+	check(net.ParseIP("10.0.0.2"), now, 0)
+	ip6 := net.ParseIP("2001:db8::1")
+	tp.failure(ip6, 3, now)
+	check(net.ParseIP("2001:db8::2"), now, time.Second)
+
+	// Recovering over time.
+	check(ip, now.Add(2*time.Minute), 3*time.Second)
+	check(ip, now.Add(5*time.Minute), 0)
+}
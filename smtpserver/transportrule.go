@@ -0,0 +1,197 @@
+package smtpserver
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/textproto"
+	"os"
+	"strings"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/queue"
+	"github.com/mjl-/mox/smtp"
+	"github.com/mjl-/mox/store"
+)
+
+// transportRules returns the transport rules of domain dc that match a message
+// in direction, "incoming" or "outgoing".
+func transportRules(dc config.Domain, direction string, msgFrom smtp.Address, rcptTo smtp.Path, header textproto.MIMEHeader) []config.TransportRule {
+	from := strings.ToLower(msgFrom.Pack(true))
+	rcpt := strings.ToLower(rcptTo.XString(true))
+
+	var l []config.TransportRule
+rule:
+	for _, tr := range dc.TransportRules {
+		if tr.Direction != "" && tr.Direction != direction {
+			continue
+		}
+		if tr.SenderRegexpCompiled != nil && !tr.SenderRegexpCompiled.MatchString(from) {
+			continue
+		}
+		if tr.RecipientRegexpCompiled != nil && !tr.RecipientRegexpCompiled.MatchString(rcpt) {
+			continue
+		}
+	header:
+		for _, t := range tr.HeadersRegexpCompiled {
+			for k, vl := range header {
+				k = strings.ToLower(k)
+				if !t[0].MatchString(k) {
+					continue
+				}
+				for _, v := range vl {
+					v = strings.ToLower(strings.TrimSpace(v))
+					if t[1].MatchString(v) {
+						continue header
+					}
+				}
+			}
+			continue rule
+		}
+		l = append(l, tr)
+	}
+	return l
+}
+
+// transportRuleNames returns the names of rules, for logging.
+func transportRuleNames(rules []config.TransportRule) []string {
+	l := make([]string, len(rules))
+	for i, tr := range rules {
+		l[i] = tr.Name
+	}
+	return l
+}
+
+// subjectPrefixes returns the non-empty subject prefixes of rules.
+func subjectPrefixes(rules []config.TransportRule) []string {
+	var l []string
+	for _, tr := range rules {
+		if tr.SubjectPrefix != "" {
+			l = append(l, tr.SubjectPrefix)
+		}
+	}
+	return l
+}
+
+// transportRuleBCC queues copies of a message for the BCC addresses of rules. The
+// message has already been accepted, so errors are logged and not returned.
+func transportRuleBCC(ctx context.Context, log *mlog.Log, senderAccount string, rules []config.TransportRule, has8bit, smtputf8, binarymime bool, msgPrefix []byte, msgFile *os.File, size int64) {
+	for _, tr := range rules {
+		for _, p := range tr.BCCPaths {
+			opts := queue.AddOptions{BinaryMIME: binarymime}
+			if _, err := queue.AddOpts(ctx, log, senderAccount, smtp.Path{}, p, has8bit, smtputf8, size, msgPrefix, msgFile, nil, "NEVER", false, opts); err != nil {
+				log.Errorx("queueing copy of message for transport rule", err, mlog.Field("rule", tr.Name), mlog.Field("address", p.XString(true)))
+			}
+		}
+	}
+}
+
+// rewriteSubject writes the message in msgFile to a new temporary file, with the
+// prefixes prepended to the Subject header. Prefixes that the subject already
+// contains are not added again. If no prefix needs to be added, a nil file is
+// returned. The size of the new file is returned.
+func rewriteSubject(msgFile *os.File, prefixes []string) (rf *os.File, size int64, rerr error) {
+	fi, err := msgFile.Stat()
+	if err != nil {
+		return nil, 0, fmt.Errorf("stat message file: %w", err)
+	}
+	br := bufio.NewReader(io.NewSectionReader(msgFile, 0, fi.Size()))
+
+	// Read the header, remembering the Subject header with its continuation lines.
+	var lines []string
+	subject := -1
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, 0, fmt.Errorf("reading message header: %w", err)
+		}
+		if line == "\r\n" || line == "\n" {
+			lines = append(lines, line)
+			break
+		}
+		if subject >= 0 && subject == len(lines)-1 && (line[0] == ' ' || line[0] == '\t') {
+			lines[subject] += line
+			continue
+		}
+		if subject < 0 && strings.HasPrefix(strings.ToLower(line), "subject:") {
+			subject = len(lines)
+		}
+		lines = append(lines, line)
+	}
+
+	var value string
+	if subject >= 0 {
+		value = lines[subject][len("subject:"):]
+	} else {
+		value = "\r\n"
+	}
+	unfolded := strings.ReplaceAll(strings.ReplaceAll(value, "\r", ""), "\n", "")
+	var wd mime.WordDecoder
+	decoded, err := wd.DecodeHeader(unfolded)
+	if err != nil {
+		decoded = unfolded
+	}
+	var add string
+	for _, prefix := range prefixes {
+		if strings.Contains(decoded, strings.TrimSpace(prefix)) {
+			continue
+		}
+		decoded = prefix + decoded
+		if isASCII(prefix) {
+			add = prefix + add
+		} else {
+			add = mime.QEncoding.Encode("utf-8", strings.TrimSpace(prefix)) + " " + add
+		}
+	}
+	if add == "" {
+		return nil, 0, nil
+	}
+	hdr := "Subject: " + add + strings.TrimLeft(value, " \t")
+	if subject >= 0 {
+		lines[subject] = hdr
+	} else {
+		lines = append(lines[:len(lines)-1], hdr, lines[len(lines)-1])
+	}
+
+	f, err := store.CreateMessageTemp("smtp-rewrite")
+	if err != nil {
+		return nil, 0, fmt.Errorf("creating temporary file: %w", err)
+	}
+	defer func() {
+		if rerr != nil {
+			err := os.Remove(f.Name())
+			xlog.Check(err, "removing temporary file for rewritten message")
+			err = f.Close()
+			xlog.Check(err, "closing temporary file for rewritten message")
+		}
+	}()
+	bw := bufio.NewWriter(f)
+	for _, line := range lines {
+		if _, err := bw.WriteString(line); err != nil {
+			return nil, 0, fmt.Errorf("writing message header: %w", err)
+		}
+	}
+	if _, err := io.Copy(bw, br); err != nil {
+		return nil, 0, fmt.Errorf("copying message body: %w", err)
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, 0, fmt.Errorf("flush rewritten message: %w", err)
+	}
+	fi, err = f.Stat()
+	if err != nil {
+		return nil, 0, fmt.Errorf("stat rewritten message: %w", err)
+	}
+	return f, fi.Size(), nil
+}
+
+func isASCII(s string) bool {
+	for _, c := range s {
+		if c >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,132 @@
+package smtpserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/store"
+	"github.com/mjl-/mox/webpush"
+)
+
+// pushNotification is the payload of a Web Push notification, shown by the
+// service worker of the account web interface.
+type pushNotification struct {
+	Title   string `json:"title"`
+	Body    string `json:"body"`
+	Mailbox string `json:"mailbox"`
+}
+
+// pushIncoming sends Web Push notifications for a message delivered to an
+// account, to the subscriptions with matching criteria. Notifications are sent in
+// the background.
+func pushIncoming(ctx context.Context, log *mlog.Log, acc *store.Account, m store.Message, msgFile *os.File) {
+	wp := mox.Conf.Static.WebPush
+	if wp == nil || wp.VAPIDKey == nil {
+		return
+	}
+	subs, err := acc.PushSubscriptions(ctx)
+	if err != nil {
+		log.Errorx("listing push subscriptions", err)
+		return
+	} else if len(subs) == 0 {
+		return
+	}
+
+	mb := store.Mailbox{ID: m.MailboxID}
+	if err := acc.DB.Get(ctx, &mb); err != nil {
+		log.Errorx("get mailbox for push notification", err)
+		return
+	}
+	var from, subject string
+	var important bool
+	if p, err := m.LoadPart(store.FileMsgReader(m.MsgPrefix, msgFile)); err != nil {
+		log.Infox("parsing message for push notification", err)
+	} else {
+		if p.Envelope != nil {
+			subject = p.Envelope.Subject
+			if len(p.Envelope.From) > 0 {
+				a := p.Envelope.From[0]
+				from = a.User + "@" + a.Host
+				if a.Name != "" {
+					from = a.Name + " <" + from + ">"
+				}
+			}
+		}
+		if h, err := p.Header(); err != nil {
+			log.Infox("parsing message header for push notification", err)
+		} else {
+			important = messageImportant(h.Get("Importance"), h.Get("Priority"), h.Get("X-Priority"))
+		}
+	}
+
+	var matched []store.PushSubscription
+	for _, s := range subs {
+		if s.Matches(mb, from, important) {
+			matched = append(matched, s)
+		}
+	}
+	if len(matched) == 0 {
+		return
+	}
+	payload, err := json.Marshal(pushNotification{from, subject, mb.Name})
+	if err != nil {
+		log.Errorx("marshal push notification", err)
+		return
+	}
+
+	accName := acc.Name
+	go func() {
+		defer func() {
+			x := recover() // Should not happen, but don't take program down if it does.
+			if x != nil {
+				log.Error("push notification panic", mlog.Field("err", x))
+				debug.PrintStack()
+			}
+		}()
+
+		for _, s := range matched {
+			ctx, cancel := context.WithTimeout(mox.Shutdown, 30*time.Second)
+			err := webpush.Send(ctx, wp.VAPIDKey, wp.Subject, webpush.Subscription{Endpoint: s.Endpoint, P256dh: s.P256dh, Auth: s.Auth}, payload, 24*time.Hour)
+			cancel()
+			if errors.Is(err, webpush.ErrGone) || errors.Is(err, webpush.ErrKey) {
+				log.Infox("removing invalid push subscription", err, mlog.Field("account", accName), mlog.Field("subscription", s.ID))
+				pushSubscriptionRemove(log, accName, s.Endpoint)
+			} else if err != nil {
+				log.Infox("sending push notification", err, mlog.Field("account", accName), mlog.Field("subscription", s.ID))
+			}
+		}
+	}()
+}
+
+func pushSubscriptionRemove(log *mlog.Log, accName, endpoint string) {
+	acc, err := store.OpenAccount(accName)
+	if err != nil {
+		log.Errorx("open account for removing push subscription", err)
+		return
+	}
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account after removing push subscription")
+	}()
+	err = acc.PushSubscriptionRemoveEndpoint(context.Background(), endpoint)
+	log.Check(err, "removing push subscription")
+}
+
+// messageImportant returns whether the message header fields mark the message
+// as high priority. ../rfc/4021
+func messageImportant(importance, priority, xpriority string) bool {
+	if strings.EqualFold(strings.TrimSpace(importance), "high") || strings.EqualFold(strings.TrimSpace(priority), "urgent") {
+		return true
+	}
+	// X-Priority is non-standard, with values 1 (highest) to 5, often followed by a
+	// comment like "(Highest)".
+	xpriority = strings.TrimSpace(xpriority)
+	return strings.HasPrefix(xpriority, "1") || strings.HasPrefix(xpriority, "2")
+}
@@ -0,0 +1,272 @@
+// Package sqlexport periodically exports operational data as SQL files, for
+// long-term analysis in external tools.
+//
+// Exported are the results of delivery attempts of outgoing messages, incoming
+// messages rejected during the SMTP transaction (including junk verdicts) and
+// incoming DMARC aggregate reports. The files use a subset of SQL supported by
+// both SQLite and PostgreSQL, and can be loaded with "sqlite3 ops.db <file" or
+// "psql -f file". Each file only creates tables that do not exist yet, and
+// skips rows that were already loaded, so files can be loaded in order into the
+// same database, and loading a file twice does no harm.
+package sqlexport
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/dmarcdb"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/queue"
+	"github.com/mjl-/mox/store"
+)
+
+var xlog = mlog.New("sqlexport")
+
+// SchemaVersion is the version of the tables in the exported files. It is
+// incremented for incompatible changes, and stored in table mox_schema. Files
+// with a newer version contain statements to upgrade tables of earlier versions.
+const SchemaVersion = 1
+
+// DMARC reports are typically sent a day after the period they cover ends. We
+// export reports with a period ending this long before the previous export, so
+// reports that arrived late are not missed.
+const dmarcReportDelay = 7 * 24 * time.Hour
+
+// timeLayout is understood by both SQLite date functions and PostgreSQL
+// timestamp columns.
+const timeLayout = "2006-01-02 15:04:05"
+
+// File names are the time of the export with fileTimeLayout, so the last export
+// can be found after a restart.
+const fileTimeLayout = "20060102T150405Z"
+
+var schema = []string{
+	`create table if not exists mox_schema (version integer primary key)`,
+	fmt.Sprintf(`insert into mox_schema (version) values (%d) on conflict do nothing`, SchemaVersion),
+	`create table if not exists delivery (
+	id bigint primary key,
+	time timestamp not null,
+	account text not null,
+	queue_msg_id bigint not null,
+	mail_from text not null,
+	recipient text not null,
+	attempt integer not null,
+	result text not null,
+	remote_mta text not null,
+	tls integer not null,
+	error text not null
+)`,
+	`create table if not exists rejection (
+	account text not null,
+	id bigint not null,
+	time timestamp not null,
+	mail_from text not null,
+	msg_from text not null,
+	rcpt_to text not null,
+	reason text not null,
+	error text not null,
+	primary key (account, id)
+)`,
+	`create table if not exists dmarc_report (
+	id bigint primary key,
+	domain text not null,
+	from_domain text not null,
+	org_name text not null,
+	report_id text not null,
+	period_begin timestamp not null,
+	period_end timestamp not null,
+	policy text not null
+)`,
+	`create table if not exists dmarc_record (
+	report bigint not null,
+	record integer not null,
+	source_ip text not null,
+	count integer not null,
+	disposition text not null,
+	dkim text not null,
+	spf text not null,
+	header_from text not null,
+	envelope_from text not null,
+	primary key (report, record)
+)`,
+}
+
+// Export writes the data recorded since "since" as SQL statements to w, in a
+// single transaction. With a zero since, all data is exported.
+func Export(ctx context.Context, log *mlog.Log, w io.Writer, since time.Time) error {
+	bw := bufio.NewWriter(w)
+	stmt := func(s string, args ...any) {
+		fmt.Fprintf(bw, s+";\n", args...)
+	}
+
+	stmt("begin")
+	for _, s := range schema {
+		stmt("%s", s)
+	}
+
+	q := bstore.QueryDB[queue.Delivery](ctx, queue.DB)
+	q.FilterGreaterEqual("Time", since)
+	q.SortAsc("Time")
+	err := q.ForEach(func(d queue.Delivery) error {
+		stmt("insert into delivery values (%d, %s, %s, %d, %s, %s, %d, %s, %s, %s, %s) on conflict do nothing", d.ID, sqlTime(d.Time), sqlString(d.Account), d.MsgID, sqlString(d.MailFrom), sqlString(d.Recipient), d.Attempt, sqlString(d.Result), sqlString(d.RemoteMTA), sqlBool(d.TLS), sqlString(d.Error))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("listing deliveries: %w", err)
+	}
+
+	for _, accName := range mox.Conf.Accounts() {
+		acc, err := store.OpenAccount(accName)
+		if err != nil {
+			return fmt.Errorf("open account %s: %w", accName, err)
+		}
+		q := bstore.QueryDB[store.Rejection](ctx, acc.DB)
+		q.FilterGreaterEqual("Time", since)
+		q.SortAsc("Time")
+		err = q.ForEach(func(r store.Rejection) error {
+			stmt("insert into rejection values (%s, %d, %s, %s, %s, %s, %s, %s) on conflict do nothing", sqlString(accName), r.ID, sqlTime(r.Time), sqlString(r.MailFrom), sqlString(r.MsgFrom), sqlString(r.RcptTo), sqlString(r.Reason), sqlString(r.Error))
+			return nil
+		})
+		xerr := acc.Close()
+		log.Check(xerr, "closing account")
+		if err != nil {
+			return fmt.Errorf("listing rejections for account %s: %w", accName, err)
+		}
+	}
+
+	reports, err := dmarcdb.Records(ctx)
+	if err != nil {
+		return fmt.Errorf("listing dmarc reports: %w", err)
+	}
+	var dmarcSince int64
+	if !since.IsZero() {
+		dmarcSince = since.Add(-dmarcReportDelay).Unix()
+	}
+	for _, r := range reports {
+		dr := r.ReportMetadata.DateRange
+		if dr.End < dmarcSince {
+			continue
+		}
+		stmt("insert into dmarc_report values (%d, %s, %s, %s, %s, %s, %s, %s) on conflict do nothing", r.ID, sqlString(r.Domain), sqlString(r.FromDomain), sqlString(r.ReportMetadata.OrgName), sqlString(r.ReportMetadata.ReportID), sqlTime(time.Unix(dr.Begin, 0)), sqlTime(time.Unix(dr.End, 0)), sqlString(string(r.PolicyPublished.Policy)))
+		for i, rec := range r.Records {
+			row := rec.Row
+			stmt("insert into dmarc_record values (%d, %d, %s, %d, %s, %s, %s, %s, %s) on conflict do nothing", r.ID, i, sqlString(row.SourceIP), row.Count, sqlString(string(row.PolicyEvaluated.Disposition)), sqlString(string(row.PolicyEvaluated.DKIM)), sqlString(string(row.PolicyEvaluated.SPF)), sqlString(rec.Identifiers.HeaderFrom), sqlString(rec.Identifiers.EnvelopeFrom))
+		}
+	}
+
+	stmt("commit")
+	return bw.Flush()
+}
+
+func sqlString(s string) string {
+	// PostgreSQL text cannot hold NUL bytes.
+	s = strings.ReplaceAll(s, "\x00", "")
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func sqlTime(tm time.Time) string {
+	return "'" + tm.UTC().Format(timeLayout) + "'"
+}
+
+func sqlBool(v bool) string {
+	if v {
+		return "1"
+	}
+	return "0"
+}
+
+// Start starts a goroutine that periodically writes an export file with the data
+// recorded since the previous export, if configured.
+func Start() {
+	se := mox.Conf.Static.SQLExport
+	if se == nil {
+		return
+	}
+	go func() {
+		for {
+			select {
+			case <-mox.Shutdown.Done():
+				return
+			case <-time.After(se.Interval):
+			}
+			log := xlog.WithCid(mox.Cid())
+			if p, err := exportFile(mox.Shutdown, log, mox.DataDirPath(se.Dir), time.Now()); err != nil {
+				log.Errorx("exporting operational data", err)
+			} else {
+				log.Info("exported operational data", mlog.Field("path", p))
+			}
+		}
+	}()
+}
+
+// exportFile writes a new export file in dir, named after now, with data since
+// the time of the most recent export file in dir.
+func exportFile(ctx context.Context, log *mlog.Log, dir string, now time.Time) (string, error) {
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return "", fmt.Errorf("creating export directory: %w", err)
+	}
+	since, err := lastExport(dir)
+	if err != nil {
+		return "", err
+	}
+
+	p := filepath.Join(dir, "export-"+now.UTC().Format(fileTimeLayout)+".sql")
+	f, err := os.CreateTemp(dir, "export-*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("creating temporary export file: %w", err)
+	}
+	defer func() {
+		if f != nil {
+			err := os.Remove(f.Name())
+			log.Check(err, "removing temporary export file")
+			err = f.Close()
+			log.Check(err, "closing temporary export file")
+		}
+	}()
+	if err := Export(ctx, log, f, since); err != nil {
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		return "", fmt.Errorf("sync export file: %w", err)
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		return "", fmt.Errorf("renaming export file: %w", err)
+	}
+	err = f.Close()
+	log.Check(err, "closing export file")
+	f = nil
+	return p, nil
+}
+
+// lastExport returns the time of the most recent export file in dir, or the zero
+// time if there is none.
+func lastExport(dir string) (time.Time, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("listing export directory: %w", err)
+	}
+	var times []time.Time
+	for _, e := range entries {
+		s := strings.TrimSuffix(strings.TrimPrefix(e.Name(), "export-"), ".sql")
+		if tm, err := time.Parse(fileTimeLayout, s); err == nil {
+			times = append(times, tm)
+		}
+	}
+	if len(times) == 0 {
+		return time.Time{}, nil
+	}
+	sort.Slice(times, func(i, j int) bool {
+		return times[i].Before(times[j])
+	})
+	return times[len(times)-1], nil
+}
@@ -0,0 +1,127 @@
+package sqlexport
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjl-/mox/dmarcdb"
+	"github.com/mjl-/mox/dmarcrpt"
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/queue"
+	"github.com/mjl-/mox/store"
+)
+
+var ctxbg = context.Background()
+
+func tcheck(t *testing.T, err error, msg string) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %s", msg, err)
+	}
+}
+
+func TestExport(t *testing.T) {
+	os.RemoveAll("../testdata/sqlexport/data")
+	mox.Context = ctxbg
+	mox.Shutdown = ctxbg
+	mox.ConfigStaticPath = "../testdata/sqlexport/mox.conf"
+	mox.ConfigDynamicPath = filepath.Join(filepath.Dir(mox.ConfigStaticPath), "domains.conf")
+	mox.MustLoadConfig(true, false)
+	switchDone := store.Switchboard()
+	defer close(switchDone)
+
+	log := mlog.New("sqlexport")
+
+	err := queue.Init()
+	tcheck(t, err, "queue init")
+	defer queue.Shutdown()
+	err = dmarcdb.Init()
+	tcheck(t, err, "dmarcdb init")
+
+	acc, err := store.OpenAccount("mjl")
+	tcheck(t, err, "open account")
+	defer acc.Close()
+
+	now := time.Now()
+	old := now.Add(-48 * time.Hour)
+
+	err = queue.DB.Insert(ctxbg, &queue.Delivery{Time: old, Account: "mjl", MsgID: 1, MailFrom: "mjl@mox.example", Recipient: "old@remote.example", Attempt: 1, Result: queue.HookDelivered})
+	tcheck(t, err, "insert delivery")
+	err = queue.DB.Insert(ctxbg, &queue.Delivery{Time: now, Account: "mjl", MsgID: 2, MailFrom: "mjl@mox.example", Recipient: "new@remote.example", Attempt: 2, Result: queue.HookDelayed, Error: "it's down"})
+	tcheck(t, err, "insert delivery")
+	err = acc.RejectionAdd(ctxbg, &store.Rejection{MailFrom: "spammer@remote.example", RcptTo: "mjl@mox.example", Reason: "junk", Error: "rejected"})
+	tcheck(t, err, "add rejection")
+
+	feedback := &dmarcrpt.Feedback{
+		ReportMetadata: dmarcrpt.ReportMetadata{
+			OrgName:   "remote.example",
+			ReportID:  "1",
+			DateRange: dmarcrpt.DateRange{Begin: old.Unix(), End: old.Add(24 * time.Hour).Unix()},
+		},
+		PolicyPublished: dmarcrpt.PolicyPublished{Domain: "mox.example", Policy: dmarcrpt.DispositionReject},
+		Records: []dmarcrpt.ReportRecord{
+			{
+				Row:         dmarcrpt.Row{SourceIP: "127.0.0.1", Count: 3, PolicyEvaluated: dmarcrpt.PolicyEvaluated{Disposition: dmarcrpt.DispositionNone, DKIM: dmarcrpt.DMARCPass, SPF: dmarcrpt.DMARCFail}},
+				Identifiers: dmarcrpt.Identifiers{HeaderFrom: "mox.example"},
+			},
+		},
+	}
+	err = dmarcdb.AddReport(ctxbg, feedback, dns.Domain{ASCII: "mox.example"})
+	tcheck(t, err, "add dmarc report")
+
+	var b bytes.Buffer
+	err = Export(ctxbg, log, &b, time.Time{})
+	tcheck(t, err, "export")
+	s := b.String()
+	for _, exp := range []string{
+		"insert into mox_schema (version) values (1) on conflict do nothing;\n",
+		"'old@remote.example'",
+		"'new@remote.example', 2, 'delayed', '', 0, 'it''s down') on conflict do nothing;\n",
+		"insert into rejection values ('mjl', 1, ",
+		"'spammer@remote.example', '', 'mjl@mox.example', 'junk', 'rejected') on conflict do nothing;\n",
+		"'mox.example', 'mox.example', 'remote.example', '1', ",
+		"insert into dmarc_record values (1, 0, '127.0.0.1', 3, 'none', 'pass', 'fail', 'mox.example', '') on conflict do nothing;\n",
+		"commit;\n",
+	} {
+		if !strings.Contains(s, exp) {
+			t.Fatalf("export does not contain %q:\n%s", exp, s)
+		}
+	}
+
+	// Only data since the previous export. The DMARC report is still included,
+	// reports can arrive after the period they cover.
+	b.Reset()
+	err = Export(ctxbg, log, &b, now.Add(-time.Hour))
+	tcheck(t, err, "export")
+	s = b.String()
+	if strings.Contains(s, "old@remote.example") || !strings.Contains(s, "new@remote.example") || !strings.Contains(s, "insert into dmarc_report") {
+		t.Fatalf("unexpected export since previous export:\n%s", s)
+	}
+
+	// Export files in a directory, continuing from the previous file.
+	dir := mox.DataDirPath("sqlexport")
+	p, err := exportFile(ctxbg, log, dir, now.Add(-time.Hour))
+	tcheck(t, err, "export file")
+	if filepath.Base(p) != "export-"+now.Add(-time.Hour).UTC().Format(fileTimeLayout)+".sql" {
+		t.Fatalf("unexpected export file name %q", p)
+	}
+	since, err := lastExport(dir)
+	tcheck(t, err, "last export")
+	if !since.Equal(now.Add(-time.Hour).UTC().Truncate(time.Second)) {
+		t.Fatalf("got last export %v, expected %v", since, now.Add(-time.Hour))
+	}
+	p, err = exportFile(ctxbg, log, dir, now.Add(time.Hour))
+	tcheck(t, err, "export file")
+	buf, err := os.ReadFile(p)
+	tcheck(t, err, "read export file")
+	if strings.Contains(string(buf), "old@remote.example") || !strings.Contains(string(buf), "new@remote.example") {
+		t.Fatalf("unexpected data in second export file:\n%s", buf)
+	}
+}
@@ -7,6 +7,7 @@ Layout of storage for accounts:
 
 	<DataDir>/accounts/<name>/index.db
 	<DataDir>/accounts/<name>/msg/[a-zA-Z0-9_-]+/<id>
+	<DataDir>/accounts/<name>/journal/<yyyy>/<mm>/<time>-<kind>-<random>.eml (optional)
 
 Index.db holds tables for user information, mailboxes, and messages. Messages
 are stored in the msg/ subdirectory, each in their own file. The on-disk message
@@ -150,6 +151,56 @@ type NextUIDValidity struct {
 	Next uint32
 }
 
+// ModSeq is a modification sequence, for IMAP CONDSTORE. Changes to messages,
+// such as delivery, moves and flag changes, assign a new modseq to the changed
+// messages. ../rfc/7162
+type ModSeq int64
+
+// Client returns the modseq as shown to IMAP clients. Messages from before
+// modseqs were tracked have ModSeq 0, which is not a valid value in IMAP, so they
+// are shown with modseq 1.
+func (ms ModSeq) Client() int64 {
+	if ms == 0 {
+		return 1
+	}
+	return int64(ms)
+}
+
+// SyncState holds the last assigned modseq of the account.
+type SyncState struct {
+	ID int // Just a single record with ID 1.
+
+	// Last assigned modseq. The first modseq assigned is 2, 1 is used for messages
+	// without modseq.
+	LastModSeq ModSeq `bstore:"nonzero"`
+}
+
+// ExpungedUID is a message that was removed from a mailbox. Kept so IMAP clients
+// with QRESYNC can learn which messages were expunged since they last
+// synchronized. ../rfc/7162
+type ExpungedUID struct {
+	ID        int64
+	MailboxID int64  `bstore:"nonzero,index"`
+	UID       UID    `bstore:"nonzero"`
+	ModSeq    ModSeq `bstore:"nonzero"`
+}
+
+// RemovedMessage is a message that was removed from the account, not moved to
+// another mailbox. Kept so JMAP clients can learn which emails and threads were
+// destroyed since they last synchronized. ../rfc/8620 section 5.2
+type RemovedMessage struct {
+	ID        int64
+	MessageID int64  `bstore:"nonzero"`
+	ThreadID  int64  `bstore:"nonzero"` // As returned by Message.threadID.
+	ModSeq    ModSeq `bstore:"nonzero,index"`
+}
+
+// ThreadObjectID returns the THREADID the removed message had, see
+// Message.ThreadObjectID.
+func (rm RemovedMessage) ThreadObjectID() string {
+	return fmt.Sprintf("T%d", rm.ThreadID)
+}
+
 // Mailbox is collection of messages, e.g. Inbox or Sent.
 type Mailbox struct {
 	ID int64
@@ -167,7 +218,8 @@ type Mailbox struct {
 	UIDNext UID
 
 	// Special-use hints. The mailbox holds these types of messages. Used
-	// in IMAP LIST (mailboxes) response.
+	// in IMAP LIST (mailboxes) response. At most one mailbox has each special-use,
+	// see MailboxSpecialUseSet.
 	Archive bool
 	Draft   bool
 	Junk    bool
@@ -254,6 +306,11 @@ type Message struct {
 
 	Received time.Time `bstore:"default now,index"`
 
+	// Time the message was saved in its current mailbox, by delivery, copy or move.
+	// Zero for messages saved before this was recorded. For the IMAP SAVEDATE
+	// extension.
+	SaveDate time.Time
+
 	// Full IP address of remote SMTP server. Empty if not delivered over
 	// SMTP.
 	RemoteIP        string
@@ -290,13 +347,46 @@ type Message struct {
 	// delivered only once. Value includes <>.
 	MessageID string `bstore:"index"`
 
+	// Trace ID assigned when the message was received over SMTP, for looking up the
+	// trace events of the message in the queue database, see queue.TraceEvent.
+	TraceID string
+
+	// Threading fields, set during delivery from the message headers, for the IMAP
+	// THREAD command. ThreadRefs are the message-ids (with <>) of the References
+	// header, or of In-Reply-To if References is absent. ThreadSubject is the base
+	// subject, ThreadResponse is whether the subject indicated a reply or forward.
+	// ThreadDate is the date from the Date header, or the received time if absent.
+	// ThreadDate is zero for messages delivered before threading fields were stored.
+	ThreadRefs     []string
+	ThreadSubject  string
+	ThreadResponse bool
+	ThreadDate     time.Time
+
+	// Object identifiers, for the IMAP OBJECTID extension. EmailID is the ID of the
+	// message this message is a copy of, ThreadID the email ID of the first message in
+	// its thread. Both are zero if they are the ID of the message itself. See
+	// EmailObjectID and ThreadObjectID.
+	EmailID  int64
+	ThreadID int64
+
 	MessageHash []byte // Hash of message. For rejects delivery, so optional like MessageID.
 	Flags
-	Keywords    []string `bstore:"index"` // Non-system or well-known $-flags. Only in "atom" syntax, stored in lower case.
+	Keywords    []string            `bstore:"index"` // Non-system or well-known $-flags. Only in "atom" syntax, stored in lower case.
+	Annotations []MessageAnnotation // For the IMAP ANNOTATE extension, sorted by entry.
 	Size        int64
 	TrainedJunk *bool  // If nil, no training done yet. Otherwise, true is trained as junk, false trained as nonjunk.
 	MsgPrefix   []byte // Typically holds received headers and/or header separator.
 
+	// Modification sequence, set to a new value when the message is delivered,
+	// moved or its flags are changed. Zero for messages from before modseqs were
+	// tracked.
+	ModSeq ModSeq
+
+	// Short plain text preview of the message, for the IMAP PREVIEW extension. Set at
+	// delivery. Nil for messages delivered before previews were generated, the
+	// preview is then generated when requested.
+	Preview *string
+
 	// ParsedBuf message structure. Currently saved as JSON of message.Part because bstore
 	// cannot yet store recursive types. Created when first needed, and saved in the
 	// database.
@@ -318,16 +408,103 @@ func (m Message) LoadPart(r io.ReaderAt) (message.Part, error) {
 	return p, nil
 }
 
+// PrepareThreading sets the threading fields of m from the headers of the parsed
+// message. The part must have a reader set.
+func (m *Message) PrepareThreading(log *mlog.Log, part *message.Part) {
+	m.ThreadRefs = nil
+	m.ThreadSubject = ""
+	m.ThreadResponse = false
+	m.ThreadDate = m.Received
+	if m.ThreadDate.IsZero() {
+		m.ThreadDate = time.Now()
+	}
+	if part.Envelope == nil {
+		return
+	}
+	if !part.Envelope.Date.IsZero() {
+		m.ThreadDate = part.Envelope.Date
+	}
+	m.ThreadSubject, m.ThreadResponse = message.ThreadSubject(part.Envelope.Subject)
+	h, err := part.Header()
+	if err != nil {
+		log.Debugx("parsing message header for threading", err)
+		return
+	}
+	m.ThreadRefs = message.ReferencedIDs(h.Get("References"), h.Get("In-Reply-To"))
+}
+
+// emailID returns the ID shared by copies of the message.
+func (m Message) emailID() int64 {
+	if m.EmailID != 0 {
+		return m.EmailID
+	}
+	return m.ID
+}
+
+// threadID returns the email ID of the first message in the thread of m.
+func (m Message) threadID() int64 {
+	if m.ThreadID != 0 {
+		return m.ThreadID
+	}
+	return m.emailID()
+}
+
+// EmailObjectID returns the EMAILID of the message, for the IMAP OBJECTID
+// extension. Copies of a message have the same EMAILID, a moved message keeps it.
+func (m Message) EmailObjectID() string {
+	return fmt.Sprintf("M%d", m.emailID())
+}
+
+// ThreadObjectID returns the THREADID of the message, for the IMAP OBJECTID
+// extension. Messages in the same thread have the same THREADID.
+func (m Message) ThreadObjectID() string {
+	return fmt.Sprintf("T%d", m.threadID())
+}
+
+// ObjectID returns the MAILBOXID of the mailbox, for the IMAP OBJECTID extension.
+// It is the same after a rename.
+func (mb Mailbox) ObjectID() string {
+	return fmt.Sprintf("F%d", mb.ID)
+}
+
+// assignThread sets the ThreadID of a new message m to the thread of the message
+// it references, if any, looked up by message-id in the account. Messages that
+// arrive before the messages they reference start their own thread, thread IDs are
+// not changed after delivery.
+func assignThread(tx *bstore.Tx, m *Message) error {
+	for i := len(m.ThreadRefs) - 1; i >= 0; i-- {
+		q := bstore.QueryTx[Message](tx)
+		q.FilterNonzero(Message{MessageID: m.ThreadRefs[i]})
+		q.Limit(1)
+		pm, err := q.Get()
+		if err == bstore.ErrAbsent {
+			continue
+		} else if err != nil {
+			return err
+		}
+		m.ThreadID = pm.threadID()
+		return nil
+	}
+	return nil
+}
+
 // NeedsTraining returns whether message needs a training update, based on
 // TrainedJunk (current training status) and new Junk/Notjunk flags.
 func (m Message) NeedsTraining() bool {
 	untrain := m.TrainedJunk != nil
 	untrainJunk := untrain && *m.TrainedJunk
-	train := m.Junk || m.Notjunk && !(m.Junk && m.Notjunk)
-	trainJunk := m.Junk
+	junk := m.trainsJunk()
+	train := junk || m.Notjunk && !(junk && m.Notjunk)
+	trainJunk := junk
 	return untrain != train || untrain && train && untrainJunk != trainJunk
 }
 
+// trainsJunk returns whether the flags mark a message as junk for the junk
+// filter. Messages marked as phishing are junk too.
+func (f Flags) trainsJunk() bool {
+	return f.Junk || f.Phishing
+}
+
 // JunkFlagsForMailbox sets Junk and Notjunk flags based on mailbox name if configured. Often
 // used when delivering/moving/copying messages to a mailbox. Mail clients are not
 // very helpful with setting junk/notjunk flags. But clients can move/copy messages
@@ -384,8 +561,18 @@ type Outgoing struct {
 	Submitted time.Time `bstore:"nonzero,default now"`
 }
 
+// Settings are preferences of the account owner for the web interface. There
+// is at most one record, with ID 1.
+type Settings struct {
+	ID int64
+
+	// Whether remote content, such as images, in HTML messages is loaded by default.
+	// Remote images are always fetched through the image proxy.
+	LoadRemoteContent bool
+}
+
 // Types stored in DB.
-var DBTypes = []any{NextUIDValidity{}, Message{}, Recipient{}, Mailbox{}, Subscription{}, Outgoing{}, Password{}, Subjectpass{}}
+var DBTypes = []any{NextUIDValidity{}, SyncState{}, ExpungedUID{}, RemovedMessage{}, Message{}, Recipient{}, Mailbox{}, Subscription{}, Outgoing{}, Password{}, Subjectpass{}, Settings{}, MessageExpire{}, PushSubscription{}, Correspondent{}, BlockedSender{}, MutedThread{}, MutedMessageID{}, Rejection{}, Label{}, Annotation{}, DiskUsage{}, MailboxACL{}, URLAuthKey{}, TextIndex{}, MailboxCounts{}}
 
 // Account holds the information about a user, includings mailboxes, messages, imap subscriptions.
 type Account struct {
@@ -480,9 +667,13 @@ func openAccount(name string) (a *Account, rerr error) {
 	}()
 
 	if isNew {
-		if err := initAccount(db); err != nil {
+		if err := initAccount(db, name); err != nil {
 			return nil, fmt.Errorf("initializing account: %v", err)
 		}
+	} else if err := diskUsageEnsure(context.TODO(), db); err != nil {
+		return nil, fmt.Errorf("initializing disk usage: %v", err)
+	} else if err := mailboxCountsEnsure(context.TODO(), db); err != nil {
+		return nil, fmt.Errorf("initializing mailbox counts: %v", err)
 	}
 
 	return &Account{
@@ -493,12 +684,18 @@ func openAccount(name string) (a *Account, rerr error) {
 	}, nil
 }
 
-func initAccount(db *bstore.DB) error {
+func initAccount(db *bstore.DB, name string) error {
 	return db.Write(context.TODO(), func(tx *bstore.Tx) error {
 		uidvalidity := InitialUIDValidity()
 
 		mailboxes := InitialMailboxes
 		defaultMailboxes := mox.Conf.Static.DefaultMailboxes
+		// The account template of the domain of the account can specify other mailboxes.
+		if accConf, ok := mox.Conf.Account(name); ok {
+			if domConf, ok := mox.Conf.Domain(accConf.DNSDomain); ok && domConf.AccountTemplate != nil && len(domConf.AccountTemplate.Mailboxes) > 0 {
+				defaultMailboxes = domConf.AccountTemplate.Mailboxes
+			}
+		}
 		if len(defaultMailboxes) > 0 {
 			mailboxes = []string{"Inbox"}
 			for _, name := range defaultMailboxes {
@@ -534,6 +731,9 @@ func initAccount(db *bstore.DB) error {
 		if err := tx.Insert(&NextUIDValidity{1, uidvalidity}); err != nil {
 			return fmt.Errorf("inserting nextuidvalidity: %w", err)
 		}
+		if err := tx.Insert(&DiskUsage{ID: 1}); err != nil {
+			return fmt.Errorf("inserting disk usage: %w", err)
+		}
 		return nil
 	})
 }
@@ -564,6 +764,60 @@ func (a *Account) NextUIDValidity(tx *bstore.Tx) (uint32, error) {
 	return v, nil
 }
 
+// NextModSeq returns a new modseq for messages that are changed in tx.
+func (a *Account) NextModSeq(tx *bstore.Tx) (ModSeq, error) {
+	ss := SyncState{ID: 1}
+	if err := tx.Get(&ss); err == bstore.ErrAbsent {
+		ss.LastModSeq = 2
+		if err := tx.Insert(&ss); err != nil {
+			return 0, err
+		}
+		return ss.LastModSeq, nil
+	} else if err != nil {
+		return 0, err
+	}
+	ss.LastModSeq++
+	if err := tx.Update(&ss); err != nil {
+		return 0, err
+	}
+	return ss.LastModSeq, nil
+}
+
+// RecordExpunged records uids as expunged from the mailbox at modseq, typically
+// just assigned with NextModSeq and also used in ChangeRemoveUIDs.
+func (a *Account) RecordExpunged(tx *bstore.Tx, mailboxID int64, uids []UID, modseq ModSeq) error {
+	for _, uid := range uids {
+		if err := tx.Insert(&ExpungedUID{MailboxID: mailboxID, UID: uid, ModSeq: modseq}); err != nil {
+			return fmt.Errorf("inserting expunged uid: %w", err)
+		}
+	}
+	return nil
+}
+
+// RecordRemoved records msgs as removed from the account at modseq, in addition
+// to RecordExpunged for the mailbox they were in.
+func (a *Account) RecordRemoved(tx *bstore.Tx, msgs []Message, modseq ModSeq) error {
+	for _, m := range msgs {
+		if err := tx.Insert(&RemovedMessage{MessageID: m.ID, ThreadID: m.threadID(), ModSeq: modseq}); err != nil {
+			return fmt.Errorf("inserting removed message: %w", err)
+		}
+	}
+	return nil
+}
+
+// HighestModSeq returns the last assigned modseq of the account. It is at least
+// as high as the modseq of each message in the account, so it is used as
+// HIGHESTMODSEQ of each mailbox.
+func (a *Account) HighestModSeq(tx *bstore.Tx) (ModSeq, error) {
+	ss := SyncState{ID: 1}
+	if err := tx.Get(&ss); err == bstore.ErrAbsent {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return ss.LastModSeq, nil
+}
+
 // WithWLock runs fn with account writelock held. Necessary for account/mailbox modification. For message delivery, a read lock is required.
 func (a *Account) WithWLock(fn func()) {
 	a.Lock()
@@ -610,6 +864,17 @@ func (a *Account) DeliverMessage(log *mlog.Log, tx *bstore.Tx, m *Message, msgFi
 	conf, _ := a.Conf()
 	m.JunkFlagsForMailbox(mb.Name, conf)
 
+	if m.ModSeq == 0 {
+		modseq, err := a.NextModSeq(tx)
+		if err != nil {
+			return fmt.Errorf("assigning modseq: %w", err)
+		}
+		m.ModSeq = modseq
+	}
+	if m.SaveDate.IsZero() {
+		m.SaveDate = time.Now()
+	}
+
 	var part *message.Part
 	if m.ParsedBuf == nil {
 		mr := FileMsgReader(m.MsgPrefix, msgFile) // We don't close, it would close the msgFile.
@@ -619,6 +884,10 @@ func (a *Account) DeliverMessage(log *mlog.Log, tx *bstore.Tx, m *Message, msgFi
 			// We continue, p is still valid.
 		}
 		part = &p
+		if m.MessageID == "" && p.Envelope != nil {
+			// For finding messages by Message-ID, e.g. for expiration.
+			m.MessageID = p.Envelope.MessageID
+		}
 		buf, err := json.Marshal(part)
 		if err != nil {
 			return fmt.Errorf("marshal parsed message: %w", err)
@@ -626,14 +895,71 @@ func (a *Account) DeliverMessage(log *mlog.Log, tx *bstore.Tx, m *Message, msgFi
 		m.ParsedBuf = buf
 	}
 
+	if m.ThreadDate.IsZero() {
+		if part == nil {
+			if p, err := m.LoadPart(FileMsgReader(m.MsgPrefix, msgFile)); err != nil {
+				log.Errorx("unmarshal parsed message for threading, continuing", err, mlog.Field("parse", ""))
+			} else {
+				part = &p
+			}
+		}
+		if part != nil {
+			m.PrepareThreading(log, part)
+		}
+	}
+
+	if m.Preview == nil {
+		if part == nil {
+			if p, err := m.LoadPart(FileMsgReader(m.MsgPrefix, msgFile)); err != nil {
+				log.Errorx("unmarshal parsed message for preview, continuing", err, mlog.Field("parse", ""))
+			} else {
+				part = &p
+			}
+		}
+		if part != nil {
+			if preview, err := part.Preview(); err != nil {
+				log.Infox("generating preview of message, continuing", err)
+			} else {
+				m.Preview = &preview
+			}
+		}
+	}
+
 	// If we are delivering to the originally intended mailbox, no need to store the mailbox ID again.
 	if m.MailboxDestinedID != 0 && m.MailboxDestinedID == m.MailboxOrigID {
 		m.MailboxDestinedID = 0
 	}
 
+	if m.EmailID == 0 && m.ThreadID == 0 {
+		if err := assignThread(tx, m); err != nil {
+			return fmt.Errorf("looking up thread of message: %w", err)
+		}
+	}
+
 	if err := tx.Insert(m); err != nil {
 		return fmt.Errorf("inserting message: %w", err)
 	}
+	if err := a.AddMessageUsage(tx, 1, m.Size); err != nil {
+		return err
+	}
+	if err := MailboxCountsAdd(tx, *m); err != nil {
+		return err
+	}
+
+	if a.TextIndexEnabled() {
+		if part == nil {
+			if p, err := m.LoadPart(FileMsgReader(m.MsgPrefix, msgFile)); err != nil {
+				log.Errorx("unmarshal parsed message for full-text index, continuing", err, mlog.Field("parse", ""))
+			} else {
+				part = &p
+			}
+		}
+		if part != nil {
+			if err := textIndexAdd(log, tx, m, part); err != nil {
+				return err
+			}
+		}
+	}
 
 	if isSent {
 		// Attempt to parse the message for its To/Cc/Bcc headers, which we insert into Recipient.
@@ -676,6 +1002,9 @@ func (a *Account) DeliverMessage(log *mlog.Log, tx *bstore.Tx, m *Message, msgFi
 				if err := tx.Insert(&mr); err != nil {
 					return fmt.Errorf("inserting sent message recipients: %w", err)
 				}
+				if err := correspondentSent(tx, mr.Localpart, mr.Domain, sent); err != nil {
+					return fmt.Errorf("updating correspondent: %w", err)
+				}
 			}
 		}
 	}
@@ -1012,9 +1341,10 @@ ruleset:
 	return nil
 }
 
-// MessagePath returns the file system path of a message.
+// MessagePath returns the file system path of a message. If the message file
+// was moved to archive storage, the path in archive storage is returned.
 func (a *Account) MessagePath(messageID int64) string {
-	return filepath.Join(a.Dir, "msg", MessagePath(messageID))
+	return messageFilePath(a.Dir, messageID)
 }
 
 // MessageReader opens a message for reading, transparently combining the
@@ -1040,14 +1370,25 @@ func (a *Account) Deliver(log *mlog.Log, dest config.Destination, m *Message, ms
 	return a.DeliverMailbox(log, mailbox, m, msgFile, consumeFile)
 }
 
-// DeliverMailbox delivers an email to the specified mailbox.
+// DeliverMailbox delivers an email to the specified mailbox. Mailbox can be a
+// special-use attribute like `\Junk`, see DeliveryMailbox. If the account is
+// configured with ArchiveByYear and mailbox is the archive mailbox, the message is
+// delivered to the sub-mailbox for the year the message was received.
 //
 // Caller must hold account wlock (mailbox may be created).
 // Message delivery and possible mailbox creation are broadcasted.
 func (a *Account) DeliverMailbox(log *mlog.Log, mailbox string, m *Message, msgFile *os.File, consumeFile bool) error {
 	var changes []Change
 	err := a.DB.Write(context.TODO(), func(tx *bstore.Tx) error {
-		mb, chl, err := a.MailboxEnsure(tx, mailbox, true)
+		name, err := a.DeliveryMailbox(tx, mailbox)
+		if err != nil {
+			return err
+		}
+		name, err = a.archivePartition(tx, name, m.Received)
+		if err != nil {
+			return fmt.Errorf("archive mailbox for year: %w", err)
+		}
+		mb, chl, err := a.MailboxEnsure(tx, name, true)
 		if err != nil {
 			return fmt.Errorf("ensuring mailbox: %w", err)
 		}
@@ -1062,13 +1403,40 @@ func (a *Account) DeliverMailbox(log *mlog.Log, mailbox string, m *Message, msgF
 		return err
 	}
 
-	changes = append(changes, ChangeAddUID{m.MailboxID, m.UID, m.Flags, m.Keywords})
+	changes = append(changes, ChangeAddUID{m.MailboxID, m.UID, m.ModSeq, m.Flags, m.Keywords})
 	comm := RegisterComm(a)
 	defer comm.Unregister()
 	comm.Broadcast(changes)
 	return nil
 }
 
+// archivePartition returns the name of the mailbox to deliver a message received
+// at "received" to. If the account has ArchiveByYear set and mailbox is the
+// archive mailbox, the name of the sub-mailbox for the year is returned, e.g.
+// "Archive/2023". Otherwise mailbox is returned unchanged.
+func (a *Account) archivePartition(tx *bstore.Tx, mailbox string, received time.Time) (string, error) {
+	conf, _ := a.Conf()
+	if !conf.ArchiveByYear {
+		return mailbox, nil
+	}
+	mb, err := a.MailboxFind(tx, mailbox)
+	if err != nil {
+		return "", err
+	} else if mb == nil || !mb.Archive {
+		return mailbox, nil
+	}
+	return fmt.Sprintf("%s/%d", mb.Name, archiveYear(received)), nil
+}
+
+// archiveYear returns the year for the archive sub-mailbox of a message received
+// at "received", the current year if not known.
+func archiveYear(received time.Time) int {
+	if received.IsZero() {
+		return time.Now().Year()
+	}
+	return received.Year()
+}
+
 // TidyRejectsMailbox removes old reject emails, and returns whether there is space for a new delivery.
 //
 // Caller most hold account wlock.
@@ -1096,19 +1464,22 @@ func (a *Account) TidyRejectsMailbox(log *mlog.Log, rejectsMailbox string) (hasS
 			return nil
 		}
 
-		// Gather old messages to remove.
-		old := time.Now().Add(-14 * 24 * time.Hour)
-		qdel := bstore.QueryTx[Message](tx)
-		qdel.FilterNonzero(Message{MailboxID: mb.ID})
-		qdel.FilterLess("Received", old)
-		remove, err = qdel.List()
-		if err != nil {
-			return fmt.Errorf("listing old messages: %w", err)
-		}
+		// Gather old messages to remove. Nothing is removed from accounts on hold, the
+		// rejects mailbox can fill up.
+		if !a.OnHold() {
+			old := time.Now().Add(-14 * 24 * time.Hour)
+			qdel := bstore.QueryTx[Message](tx)
+			qdel.FilterNonzero(Message{MailboxID: mb.ID})
+			qdel.FilterLess("Received", old)
+			remove, err = qdel.List()
+			if err != nil {
+				return fmt.Errorf("listing old messages: %w", err)
+			}
 
-		changes, err = a.removeMessages(context.TODO(), log, tx, mb, remove)
-		if err != nil {
-			return fmt.Errorf("removing messages: %w", err)
+			changes, err = a.removeMessages(context.TODO(), log, tx, mb, remove)
+			if err != nil {
+				return fmt.Errorf("removing messages: %w", err)
+			}
 		}
 
 		// We allow up to n messages.
@@ -1135,10 +1506,16 @@ func (a *Account) TidyRejectsMailbox(log *mlog.Log, rejectsMailbox string) (hasS
 	return hasSpace, nil
 }
 
+// removeMessages removes messages l from mailbox mb. All paths that remove
+// messages end up here, so accounts on hold are checked again, failing with
+// ErrHold.
 func (a *Account) removeMessages(ctx context.Context, log *mlog.Log, tx *bstore.Tx, mb *Mailbox, l []Message) ([]Change, error) {
 	if len(l) == 0 {
 		return nil, nil
 	}
+	if a.OnHold() {
+		return nil, ErrHold
+	}
 	ids := make([]int64, len(l))
 	anyids := make([]any, len(l))
 	for i, m := range l {
@@ -1153,6 +1530,9 @@ func (a *Account) removeMessages(ctx context.Context, log *mlog.Log, tx *bstore.
 	if _, err := qdmr.Delete(); err != nil {
 		return nil, fmt.Errorf("deleting from message recipient: %w", err)
 	}
+	if err := TextIndexRemove(tx, ids); err != nil {
+		return nil, err
+	}
 
 	// Actually remove the messages.
 	qdm := bstore.QueryTx[Message](tx)
@@ -1162,6 +1542,16 @@ func (a *Account) removeMessages(ctx context.Context, log *mlog.Log, tx *bstore.
 	if _, err := qdm.Delete(); err != nil {
 		return nil, fmt.Errorf("deleting from messages: %w", err)
 	}
+	var size int64
+	for _, m := range deleted {
+		size += m.Size
+	}
+	if err := a.AddMessageUsage(tx, -int64(len(deleted)), -size); err != nil {
+		return nil, err
+	}
+	if err := MailboxCountsRemove(tx, deleted...); err != nil {
+		return nil, err
+	}
 
 	// Mark as neutral and train so junk filter gets untrained with these (junk) messages.
 	for i := range deleted {
@@ -1172,17 +1562,37 @@ func (a *Account) removeMessages(ctx context.Context, log *mlog.Log, tx *bstore.
 		return nil, fmt.Errorf("training deleted messages: %w", err)
 	}
 
+	uids := make([]UID, len(l))
+	for i, m := range l {
+		uids[i] = m.UID
+	}
+	modseq, err := a.NextModSeq(tx)
+	if err != nil {
+		return nil, fmt.Errorf("assigning modseq: %w", err)
+	}
+	if err := a.RecordExpunged(tx, mb.ID, uids, modseq); err != nil {
+		return nil, fmt.Errorf("recording expunged messages: %w", err)
+	}
+	if err := a.RecordRemoved(tx, l, modseq); err != nil {
+		return nil, fmt.Errorf("recording removed messages: %w", err)
+	}
+
 	changes := make([]Change, len(l))
 	for i, m := range l {
-		changes[i] = ChangeRemoveUIDs{mb.ID, []UID{m.UID}}
+		changes[i] = ChangeRemoveUIDs{mb.ID, []UID{m.UID}, modseq}
 	}
 	return changes, nil
 }
 
-// RejectsRemove removes a message from the rejects mailbox if present.
+// RejectsRemove removes a message from the rejects mailbox if present. Nothing
+// is removed from accounts on hold.
 // Caller most hold account wlock.
 // Changes are broadcasted.
 func (a *Account) RejectsRemove(log *mlog.Log, rejectsMailbox, messageID string) error {
+	if a.OnHold() {
+		return nil
+	}
+
 	var changes []Change
 
 	var remove []Message
@@ -1229,6 +1639,82 @@ func (a *Account) RejectsRemove(log *mlog.Log, rejectsMailbox, messageID string)
 	return nil
 }
 
+// SentMessageKeyword adds keyword to messages in mailboxes marked as Sent that have
+// messageID as their Message-ID header and that were received at or after since.
+// Used to show the delivery status of a sent message, e.g. after sending a DSN
+// about a successful delivery. The number of messages updated is returned.
+//
+// Caller must hold account wlock.
+// Changes are broadcasted.
+func (a *Account) SentMessageKeyword(log *mlog.Log, messageID string, since time.Time, keyword string) (int, error) {
+	messageID = strings.TrimSuffix(strings.TrimPrefix(messageID, "<"), ">")
+
+	var n int
+	var changes []Change
+	err := a.DB.Write(context.TODO(), func(tx *bstore.Tx) error {
+		q := bstore.QueryTx[Mailbox](tx)
+		q.FilterEqual("Sent", true)
+		mailboxes, err := q.List()
+		if err != nil {
+			return fmt.Errorf("listing sent mailboxes: %w", err)
+		}
+		for _, mb := range mailboxes {
+			var updated bool
+			qm := bstore.QueryTx[Message](tx)
+			qm.FilterNonzero(Message{MailboxID: mb.ID})
+			qm.FilterGreaterEqual("Received", since)
+			err := qm.ForEach(func(m Message) error {
+				var p message.Part
+				if m.ParsedBuf == nil || json.Unmarshal(m.ParsedBuf, &p) != nil || p.Envelope == nil {
+					return nil
+				}
+				if strings.TrimSuffix(strings.TrimPrefix(p.Envelope.MessageID, "<"), ">") != messageID {
+					return nil
+				}
+				var changed bool
+				m.Keywords, changed = MergeKeywords(m.Keywords, []string{keyword})
+				if !changed {
+					return nil
+				}
+				m.ModSeq, err = a.NextModSeq(tx)
+				if err != nil {
+					return fmt.Errorf("assigning modseq: %w", err)
+				}
+				if err := tx.Update(&m); err != nil {
+					return fmt.Errorf("updating message keywords: %w", err)
+				}
+				updated = true
+				n++
+				changes = append(changes, ChangeFlags{MailboxID: mb.ID, UID: m.UID, ModSeq: m.ModSeq, Mask: Flags{}, Flags: m.Flags, Keywords: m.Keywords})
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("looking up sent message: %w", err)
+			}
+			if updated {
+				var changed bool
+				mb.Keywords, changed = MergeKeywords(mb.Keywords, []string{keyword})
+				if changed {
+					if err := tx.Update(&mb); err != nil {
+						return fmt.Errorf("updating mailbox keywords: %w", err)
+					}
+					changes = append(changes, ChangeMailboxKeywords{mb.ID, mb.Name, mb.Keywords})
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	comm := RegisterComm(a)
+	defer comm.Unregister()
+	comm.Broadcast(changes)
+
+	return n, nil
+}
+
 // We keep a cache of recent successful authentications, so we don't have to bcrypt successful calls each time.
 var authCache = struct {
 	sync.Mutex
@@ -1257,7 +1743,9 @@ func manageAuthCache() {
 
 // OpenEmailAuth opens an account given an email address and password.
 //
-// The email address may contain a catchall separator.
+// The email address may contain a catchall separator. For accounts that are
+// suspended or pending deletion, ErrAccountSuspended is returned after
+// verifying the password.
 func OpenEmailAuth(email string, password string) (acc *Account, rerr error) {
 	acc, _, rerr = OpenEmail(email)
 	if rerr != nil {
@@ -1282,16 +1770,19 @@ func OpenEmailAuth(email string, password string) (acc *Account, rerr error) {
 	authCache.Lock()
 	ok := len(password) >= 8 && authCache.success[authKey{email, pw.Hash}] == password
 	authCache.Unlock()
-	if ok {
-		return
-	}
-	if err := bcrypt.CompareHashAndPassword([]byte(pw.Hash), []byte(password)); err != nil {
-		rerr = ErrUnknownCredentials
-	} else {
+	if !ok {
+		if err := bcrypt.CompareHashAndPassword([]byte(pw.Hash), []byte(password)); err != nil {
+			return acc, ErrUnknownCredentials
+		}
 		authCache.Lock()
 		authCache.success[authKey{email, pw.Hash}] = password
 		authCache.Unlock()
 	}
+	// Only after verifying the password, so the account state isn't revealed to
+	// password guessers.
+	if acc.Suspended() {
+		return acc, ErrAccountSuspended
+	}
 	return
 }
 
@@ -198,6 +198,57 @@ func TestMailbox(t *testing.T) {
 		}
 
 		acc.RejectsRemove(log, "Rejects", "m01@mox.example")
+
+		// Delivery to the archive mailbox goes to a sub-mailbox for the year.
+		marchive := Message{
+			Received:  time.Date(2023, 3, 1, 12, 0, 0, 0, time.Local),
+			Size:      int64(len(msgPrefix)) + msgWriter.Size,
+			MsgPrefix: msgPrefix,
+		}
+		err = acc.DeliverMailbox(xlog, "Archive", &marchive, msgFile, false)
+		tcheck(t, err, "deliver to archive")
+		err = acc.DB.Read(ctxbg, func(tx *bstore.Tx) error {
+			mb, err := acc.MailboxFind(tx, "Archive/2023")
+			tcheck(t, err, "find archive year mailbox")
+			if mb == nil || marchive.MailboxID != mb.ID {
+				t.Fatalf("message not delivered to Archive/2023, mailbox %v, message mailbox id %d", mb, marchive.MailboxID)
+			}
+			return nil
+		})
+		tcheck(t, err, "read tx")
+
+		// Other mailboxes are not partitioned.
+		mtestbox := marchive
+		mtestbox.ID = 0
+		err = acc.DeliverMailbox(xlog, "Testbox", &mtestbox, msgFile, false)
+		tcheck(t, err, "deliver to testbox")
+		err = acc.DB.Read(ctxbg, func(tx *bstore.Tx) error {
+			mb, err := acc.MailboxFind(tx, "Testbox")
+			tcheck(t, err, "find testbox")
+			if mtestbox.MailboxID != mb.ID {
+				t.Fatalf("message not delivered to Testbox")
+			}
+			return nil
+		})
+		tcheck(t, err, "read tx")
+
+		// Moving to the archive mailbox also goes to the sub-mailbox for the year.
+		err = acc.DB.Write(ctxbg, func(tx *bstore.Tx) error {
+			mbSrc, err := acc.MailboxFind(tx, "Testbox")
+			tcheck(t, err, "find testbox")
+			mbDst, err := acc.MailboxFind(tx, "Archive")
+			tcheck(t, err, "find archive")
+			m, err := bstore.QueryTx[Message](tx).FilterNonzero(Message{ID: mtestbox.ID}).Get()
+			tcheck(t, err, "get message")
+			msgs := []Message{m}
+			_, err = acc.moveMessages(ctxbg, xlog, tx, mbSrc, mbDst, msgs)
+			tcheck(t, err, "move messages")
+			if msgs[0].MailboxID != marchive.MailboxID {
+				t.Fatalf("message moved to mailbox id %d, expected Archive/2023 with id %d", msgs[0].MailboxID, marchive.MailboxID)
+			}
+			return nil
+		})
+		tcheck(t, err, "write tx")
 	})
 
 	// Run the auth tests twice for possible cache effects.
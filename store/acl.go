@@ -0,0 +1,170 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+// Rights on mailboxes, as letters of IMAP ACL. ../rfc/4314 section 2.1
+const (
+	// All rights, the owner of a mailbox always has them.
+	ACLRightsOwner = "lrswipkxtea"
+
+	// Rights that can be granted to other accounts: lookup, read, keep seen,
+	// write flags, insert messages, mark deleted, expunge. Other accounts cannot
+	// create, delete or rename mailboxes, or change access.
+	ACLRightsGrantable = "lrswite"
+
+	// Identifier for rights of all accounts.
+	ACLAnyone = "anyone"
+)
+
+// MailboxACL grants the rights of an account, or all accounts with identifier
+// "anyone", on a mailbox of the account. Mailboxes that other accounts have
+// rights on are shared mailboxes, made available to those accounts in a separate
+// namespace, e.g. through IMAP.
+type MailboxACL struct {
+	ID         int64
+	MailboxID  int64  `bstore:"nonzero,index MailboxID+Identifier,ref Mailbox"`
+	Identifier string `bstore:"nonzero,index"` // Account name, or "anyone".
+	Rights     string `bstore:"nonzero"`       // Letters of ACLRightsGrantable, in that order.
+}
+
+// SharedMailbox is a mailbox of another account that an account has rights on.
+type SharedMailbox struct {
+	Owner   string // Account name.
+	Mailbox Mailbox
+	Rights  string
+}
+
+// ACLRightsNormalize returns rights with the letters in the order of
+// ACLRightsOwner and without duplicates. Letters that are not rights are
+// dropped.
+func ACLRightsNormalize(rights string) string {
+	var r string
+	for _, c := range ACLRightsOwner {
+		if strings.ContainsRune(rights, c) {
+			r += string(c)
+		}
+	}
+	return r
+}
+
+// MailboxACLs returns the rights granted on a mailbox, ordered by identifier.
+func MailboxACLs(tx *bstore.Tx, mailboxID int64) ([]MailboxACL, error) {
+	q := bstore.QueryTx[MailboxACL](tx)
+	q.FilterNonzero(MailboxACL{MailboxID: mailboxID})
+	q.SortAsc("Identifier")
+	l, err := q.List()
+	if err != nil {
+		return nil, fmt.Errorf("listing mailbox acls: %w", err)
+	}
+	return l, nil
+}
+
+// MailboxACLSet sets the rights of identifier on a mailbox. Rights must only
+// contain letters of ACLRightsGrantable. Empty rights remove the grant.
+func MailboxACLSet(tx *bstore.Tx, mailboxID int64, identifier, rights string) error {
+	rights = ACLRightsNormalize(rights)
+	for _, c := range rights {
+		if !strings.ContainsRune(ACLRightsGrantable, c) {
+			return fmt.Errorf("right %c cannot be granted", c)
+		}
+	}
+
+	q := bstore.QueryTx[MailboxACL](tx)
+	q.FilterNonzero(MailboxACL{MailboxID: mailboxID, Identifier: identifier})
+	acl, err := q.Get()
+	if err == bstore.ErrAbsent {
+		if rights == "" {
+			return nil
+		}
+		acl = MailboxACL{MailboxID: mailboxID, Identifier: identifier, Rights: rights}
+		err = tx.Insert(&acl)
+	} else if err == nil && rights == "" {
+		err = tx.Delete(&acl)
+	} else if err == nil {
+		acl.Rights = rights
+		err = tx.Update(&acl)
+	}
+	if err != nil {
+		return fmt.Errorf("storing mailbox acl: %w", err)
+	}
+	return nil
+}
+
+// MailboxACLRights returns the rights that accountName has on a mailbox of
+// another account, from grants to the account itself and to anyone.
+func MailboxACLRights(tx *bstore.Tx, mailboxID int64, accountName string) (string, error) {
+	q := bstore.QueryTx[MailboxACL](tx)
+	q.FilterNonzero(MailboxACL{MailboxID: mailboxID})
+	q.FilterEqual("Identifier", accountName, ACLAnyone)
+	var rights string
+	err := q.ForEach(func(acl MailboxACL) error {
+		rights += acl.Rights
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("looking up mailbox acls: %w", err)
+	}
+	return ACLRightsNormalize(rights), nil
+}
+
+// SharedMailboxes returns the mailboxes of other accounts on which accountName
+// has the lookup right, ordered by owner and mailbox name.
+func SharedMailboxes(ctx context.Context, log *mlog.Log, accountName string) ([]SharedMailbox, error) {
+	var l []SharedMailbox
+	for _, owner := range mox.Conf.Accounts() {
+		if owner == accountName {
+			continue
+		}
+		acc, err := OpenAccount(owner)
+		if err != nil {
+			return nil, fmt.Errorf("open account %s: %w", owner, err)
+		}
+		acc.WithRLock(func() {
+			err = acc.DB.Read(ctx, func(tx *bstore.Tx) error {
+				rights := map[int64]string{}
+				q := bstore.QueryTx[MailboxACL](tx)
+				q.FilterEqual("Identifier", accountName, ACLAnyone)
+				err := q.ForEach(func(acl MailboxACL) error {
+					rights[acl.MailboxID] += acl.Rights
+					return nil
+				})
+				if err != nil {
+					return fmt.Errorf("listing mailbox acls: %w", err)
+				}
+				for mbID, r := range rights {
+					if !strings.Contains(r, "l") {
+						continue
+					}
+					mb := Mailbox{ID: mbID}
+					if err := tx.Get(&mb); err != nil {
+						return fmt.Errorf("get shared mailbox: %w", err)
+					}
+					l = append(l, SharedMailbox{owner, mb, ACLRightsNormalize(r)})
+				}
+				return nil
+			})
+		})
+		xerr := acc.Close()
+		log.Check(xerr, "closing account")
+		if err != nil {
+			return nil, fmt.Errorf("account %s: %w", owner, err)
+		}
+	}
+	sort.Slice(l, func(i, j int) bool {
+		if l[i].Owner != l[j].Owner {
+			return l[i].Owner < l[j].Owner
+		}
+		return l[i].Mailbox.Name < l[j].Mailbox.Name
+	})
+	return l, nil
+}
@@ -0,0 +1,84 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestMailboxACL(t *testing.T) {
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = "../testdata/store/mox.conf"
+	mox.ConfigDynamicPath = filepath.Join(filepath.Dir(mox.ConfigStaticPath), "domains.conf")
+	mox.MustLoadConfig(true, false)
+	acc, err := OpenAccount("mjl2")
+	tcheck(t, err, "open account")
+	defer acc.Close()
+	switchDone := Switchboard()
+	defer close(switchDone)
+
+	log := mlog.New("acl")
+
+	if r := ACLRightsNormalize("tlrxlz"); r != "lrxt" {
+		t.Fatalf("normalized rights %q, expected lrxt", r)
+	}
+
+	var inbox *Mailbox
+	err = acc.DB.Write(ctxbg, func(tx *bstore.Tx) error {
+		var err error
+		inbox, err = acc.MailboxFind(tx, "Inbox")
+		tcheck(t, err, "find inbox")
+
+		err = MailboxACLSet(tx, inbox.ID, "mjl", "rl")
+		tcheck(t, err, "set acl")
+		err = MailboxACLSet(tx, inbox.ID, ACLAnyone, "s")
+		tcheck(t, err, "set acl")
+		if err := MailboxACLSet(tx, inbox.ID, "mjl", "lra"); err == nil {
+			t.Fatalf("granting admin right succeeded")
+		}
+
+		rights, err := MailboxACLRights(tx, inbox.ID, "mjl")
+		tcheck(t, err, "rights")
+		if rights != "lrs" {
+			t.Fatalf("rights %q, expected lrs", rights)
+		}
+		acls, err := MailboxACLs(tx, inbox.ID)
+		tcheck(t, err, "acls")
+		if len(acls) != 2 || acls[0].Identifier != ACLAnyone || acls[1].Identifier != "mjl" || acls[1].Rights != "lr" {
+			t.Fatalf("unexpected acls %v", acls)
+		}
+		return nil
+	})
+	tcheck(t, err, "write")
+
+	l, err := SharedMailboxes(ctxbg, log, "mjl")
+	tcheck(t, err, "shared mailboxes")
+	exp := []SharedMailbox{{"mjl2", *inbox, "lrs"}}
+	if !reflect.DeepEqual(l, exp) {
+		t.Fatalf("shared mailboxes %v, expected %v", l, exp)
+	}
+
+	// Without lookup right, the mailbox isn't shared. Empty rights remove the grant.
+	err = acc.DB.Write(ctxbg, func(tx *bstore.Tx) error {
+		err := MailboxACLSet(tx, inbox.ID, "mjl", "")
+		tcheck(t, err, "remove acl")
+		acls, err := MailboxACLs(tx, inbox.ID)
+		tcheck(t, err, "acls")
+		if len(acls) != 1 {
+			t.Fatalf("unexpected acls %v", acls)
+		}
+		return nil
+	})
+	tcheck(t, err, "write")
+	l, err = SharedMailboxes(ctxbg, log, "mjl")
+	tcheck(t, err, "shared mailboxes")
+	if len(l) != 0 {
+		t.Fatalf("shared mailboxes %v, expected none", l)
+	}
+}
@@ -0,0 +1,122 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mjl-/bstore"
+)
+
+// Limits for annotations of an account, also announced in IMAP METADATA
+// responses.
+const (
+	AnnotationValueMax = 64 * 1024   // Max size of a single annotation value.
+	AnnotationTotalMax = 1024 * 1024 // Max total size of all keys and values of the annotations of an account.
+	AnnotationCountMax = 1000        // Max number of annotations of an account.
+)
+
+// Annotation is a metadata entry for a mailbox, or for the account, as set
+// and retrieved through IMAP METADATA. Clients use annotations for e.g. a
+// comment on a mailbox, or for syncing their settings. ../rfc/5464
+type Annotation struct {
+	ID int64
+
+	// Zero for server annotations, i.e. those for the account, not for a mailbox.
+	MailboxID int64 `bstore:"index MailboxID+Key"`
+
+	// Entry name, e.g. "/private/comment", in lower case.
+	Key string `bstore:"nonzero"`
+
+	// Whether Value is a string, as opposed to binary data as set with an IMAP
+	// literal8.
+	IsString bool
+	Value    []byte
+}
+
+// MaxMessageAnnotations is the maximum number of annotations, counting private
+// and shared values separately, of a single message.
+const MaxMessageAnnotations = 100
+
+// MessageAnnotation is an annotation of a single message, e.g. a comment or an
+// alternative subject, as set through IMAP ANNOTATE. Private annotations are for
+// the account itself, shared annotations are also visible to users with access
+// to the mailbox through an ACL. ../rfc/5257
+type MessageAnnotation struct {
+	Entry  string // E.g. "/comment", in lower case.
+	Shared bool
+	Value  []byte
+}
+
+// ValidMessageAnnotationEntry returns whether entry is a valid name for a
+// message annotation: starting with a slash, and without wildcards, empty
+// components or a trailing slash. ../rfc/5257 section 3.1
+func ValidMessageAnnotationEntry(entry string) bool {
+	if !strings.HasPrefix(entry, "/") || entry == "/" || strings.HasSuffix(entry, "/") || strings.Contains(entry, "//") || strings.ContainsAny(entry, "*%") {
+		return false
+	}
+	for _, c := range entry {
+		if c < 0x20 || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// SetMessageAnnotation returns annotations with the value for entry set, or
+// removed if value is nil. The returned list is sorted by entry, private before
+// shared.
+func SetMessageAnnotation(annotations []MessageAnnotation, entry string, shared bool, value []byte) []MessageAnnotation {
+	l := make([]MessageAnnotation, 0, len(annotations)+1)
+	for _, a := range annotations {
+		if a.Entry != entry || a.Shared != shared {
+			l = append(l, a)
+		}
+	}
+	if value != nil {
+		l = append(l, MessageAnnotation{entry, shared, value})
+	}
+	sort.Slice(l, func(i, j int) bool {
+		if l[i].Entry != l[j].Entry {
+			return l[i].Entry < l[j].Entry
+		}
+		return !l[i].Shared && l[j].Shared
+	})
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
+// ValidAnnotationKey returns whether key is a valid entry name for an
+// annotation: starting with "/private/" or "/shared/", and without wildcards,
+// empty components or a trailing slash. ../rfc/5464:865
+func ValidAnnotationKey(key string) bool {
+	lkey := strings.ToLower(key)
+	if !strings.HasPrefix(lkey, "/private/") && !strings.HasPrefix(lkey, "/shared/") {
+		return false
+	}
+	if strings.HasSuffix(key, "/") || strings.Contains(key, "//") || strings.ContainsAny(key, "*%") {
+		return false
+	}
+	for _, c := range key {
+		if c < 0x20 || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// AnnotationUsage returns the number of annotations of the account and their
+// total size, for comparison against AnnotationCountMax and AnnotationTotalMax.
+func AnnotationUsage(tx *bstore.Tx) (count int, size int64, rerr error) {
+	err := bstore.QueryTx[Annotation](tx).ForEach(func(a Annotation) error {
+		count++
+		size += int64(len(a.Key) + len(a.Value))
+		return nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("gathering annotation usage: %w", err)
+	}
+	return count, size, nil
+}
@@ -0,0 +1,587 @@
+package store
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+)
+
+// Archival exports are tar files (PAX format) meant for long-term storage of all
+// messages of an account, with their metadata, independent of mox versions. The
+// format, version 1, consists of these files, in order:
+//
+//   - "mox-archive.txt", with contents "mox-archive 1\n", identifying the format
+//     and its version.
+//   - "messages/<n>.eml", for n starting at 1, each with a message as received,
+//     including headers added by mox, with CRLF line endings.
+//   - "manifest.json", with the mailboxes and metadata of the messages, see
+//     ArchiveManifest. Fields may be added in the future, but not removed or
+//     changed in meaning without a new version.
+//   - "SHA256SUMS", with the hex SHA-256 checksum of each file above, in the
+//     format of "sha256sum", so an extracted archive can be verified without mox
+//     with "sha256sum -c SHA256SUMS".
+//
+// ArchiveManifest.Messages also holds the size and SHA-256 checksum of each
+// message file.
+
+// ArchiveVersion is the version of the archival export format written by
+// ExportArchive.
+const ArchiveVersion = 1
+
+const (
+	archiveFormatFile   = "mox-archive.txt"
+	archiveManifestFile = "manifest.json"
+	archiveSumsFile     = "SHA256SUMS"
+)
+
+// ArchiveManifest describes the mailboxes and messages in an archival export.
+type ArchiveManifest struct {
+	Version   int
+	Created   time.Time
+	Account   string
+	Mailboxes []ArchiveMailbox // Sorted by name, parents before children.
+	Messages  []ArchiveMessage // Ordered by file name.
+}
+
+// ArchiveMailbox is a mailbox in an archival export.
+type ArchiveMailbox struct {
+	Name        string // Slash-separated for hierarchy, "Inbox" for the IMAP INBOX.
+	UIDValidity uint32
+	UIDNext     UID
+	SpecialUse  []string // IMAP special-use attributes, e.g. `\Sent`.
+	Keywords    []string // Keywords used in this mailbox, lower case.
+	Subscribed  bool
+}
+
+// ArchiveMessage is a message in an archival export.
+type ArchiveMessage struct {
+	File     string // Path in the archive, e.g. "messages/1.eml".
+	Size     int64
+	SHA256   string // Hex-encoded checksum of the file.
+	Mailbox  string
+	UID      UID // UID in the mailbox at the time of export.
+	Received time.Time
+	Flags    []string // IMAP system flags and well-known keywords, e.g. `\Seen`, `$Junk`.
+	Keywords []string // Other keywords, lower case.
+}
+
+// archiveFlags are the flags stored in ArchiveMessage.Flags.
+var archiveFlags = []struct {
+	name  string
+	field func(f *Flags) *bool
+}{
+	{`\Seen`, func(f *Flags) *bool { return &f.Seen }},
+	{`\Answered`, func(f *Flags) *bool { return &f.Answered }},
+	{`\Flagged`, func(f *Flags) *bool { return &f.Flagged }},
+	{`\Deleted`, func(f *Flags) *bool { return &f.Deleted }},
+	{`\Draft`, func(f *Flags) *bool { return &f.Draft }},
+	{`$Forwarded`, func(f *Flags) *bool { return &f.Forwarded }},
+	{`$Junk`, func(f *Flags) *bool { return &f.Junk }},
+	{`$NotJunk`, func(f *Flags) *bool { return &f.Notjunk }},
+	{`$Phishing`, func(f *Flags) *bool { return &f.Phishing }},
+	{`$MDNSent`, func(f *Flags) *bool { return &f.MDNSent }},
+}
+
+// ExportArchive writes an archival export of all mailboxes and messages in db,
+// the database of the account in accountDir, as tar file to w. Unlike
+// ExportMessages, the export fails if a message file cannot be read.
+func ExportArchive(ctx context.Context, log *mlog.Log, db *bstore.DB, accountDir string, w io.Writer) error {
+	manifest := ArchiveManifest{
+		Version: ArchiveVersion,
+		Created: time.Now().Round(0),
+		Account: filepath.Base(accountDir),
+	}
+
+	// We read the messages in a single transaction, so the manifest is consistent.
+	// Message files don't change, and are only removed under the account write lock.
+	var msgs []Message
+	mailboxNames := map[int64]string{}
+	err := db.Read(ctx, func(tx *bstore.Tx) error {
+		subscribed := map[string]bool{}
+		err := bstore.QueryTx[Subscription](tx).ForEach(func(s Subscription) error {
+			subscribed[s.Name] = true
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("listing subscriptions: %w", err)
+		}
+
+		mailboxes, err := bstore.QueryTx[Mailbox](tx).List()
+		if err != nil {
+			return fmt.Errorf("listing mailboxes: %w", err)
+		}
+		sort.Slice(mailboxes, func(i, j int) bool {
+			return mailboxes[i].Name < mailboxes[j].Name
+		})
+		for _, mb := range mailboxes {
+			mailboxNames[mb.ID] = mb.Name
+			var su []string
+			for _, x := range []struct {
+				set  bool
+				attr string
+			}{{mb.Archive, `\Archive`}, {mb.Draft, `\Drafts`}, {mb.Junk, `\Junk`}, {mb.Sent, `\Sent`}, {mb.Trash, `\Trash`}} {
+				if x.set {
+					su = append(su, x.attr)
+				}
+			}
+			manifest.Mailboxes = append(manifest.Mailboxes, ArchiveMailbox{mb.Name, mb.UIDValidity, mb.UIDNext, su, mb.Keywords, subscribed[mb.Name]})
+		}
+
+		q := bstore.QueryTx[Message](tx)
+		q.SortAsc("MailboxID", "UID")
+		msgs, err = q.List()
+		if err != nil {
+			return fmt.Errorf("listing messages: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return mailboxNames[msgs[i].MailboxID] < mailboxNames[msgs[j].MailboxID]
+	})
+
+	tw := tar.NewWriter(w)
+	var sums bytes.Buffer
+	add := func(name string, size int64, mtime time.Time, r io.Reader) (string, error) {
+		hdr := tar.Header{
+			Name:    name,
+			Size:    size,
+			Mode:    0660,
+			ModTime: mtime,
+			Format:  tar.FormatPAX,
+		}
+		if err := tw.WriteHeader(&hdr); err != nil {
+			return "", fmt.Errorf("writing tar header for %s: %w", name, err)
+		}
+		h := sha256.New()
+		if n, err := io.Copy(io.MultiWriter(tw, h), r); err != nil {
+			return "", fmt.Errorf("writing %s: %w", name, err)
+		} else if n != size {
+			return "", fmt.Errorf("writing %s: got %d bytes, expected %d", name, n, size)
+		}
+		sum := hex.EncodeToString(h.Sum(nil))
+		fmt.Fprintf(&sums, "%s  %s\n", sum, name)
+		return sum, nil
+	}
+
+	format := fmt.Sprintf("mox-archive %d\n", ArchiveVersion)
+	if _, err := add(archiveFormatFile, int64(len(format)), manifest.Created, strings.NewReader(format)); err != nil {
+		return err
+	}
+
+	for i, m := range msgs {
+		am := ArchiveMessage{
+			File:     fmt.Sprintf("messages/%d.eml", i+1),
+			Mailbox:  mailboxNames[m.MailboxID],
+			UID:      m.UID,
+			Received: m.Received,
+			Keywords: m.Keywords,
+		}
+		for _, f := range archiveFlags {
+			if *f.field(&m.Flags) {
+				am.Flags = append(am.Flags, f.name)
+			}
+		}
+
+		err := func() error {
+			if m.Size == int64(len(m.MsgPrefix)) {
+				// No message file.
+				var err error
+				am.Size = m.Size
+				am.SHA256, err = add(am.File, am.Size, m.Received, bytes.NewReader(m.MsgPrefix))
+				return err
+			}
+			p := messageFilePath(accountDir, m.ID)
+			mf, err := os.Open(p)
+			if err != nil {
+				return fmt.Errorf("open message file for id %d: %w", m.ID, err)
+			}
+			defer func() {
+				err := mf.Close()
+				log.Check(err, "closing message file after archival export")
+			}()
+			fi, err := mf.Stat()
+			if err != nil {
+				return fmt.Errorf("stat message file for id %d: %w", m.ID, err)
+			}
+			am.Size = int64(len(m.MsgPrefix)) + fi.Size()
+			am.SHA256, err = add(am.File, am.Size, m.Received, io.MultiReader(bytes.NewReader(m.MsgPrefix), mf))
+			return err
+		}()
+		if err != nil {
+			return err
+		}
+		manifest.Messages = append(manifest.Messages, am)
+	}
+
+	buf, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return fmt.Errorf("marshal manifest: %w", err)
+	}
+	buf = append(buf, '\n')
+	if _, err := add(archiveManifestFile, int64(len(buf)), manifest.Created, bytes.NewReader(buf)); err != nil {
+		return err
+	}
+
+	hdr := tar.Header{
+		Name:    archiveSumsFile,
+		Size:    int64(sums.Len()),
+		Mode:    0660,
+		ModTime: manifest.Created,
+		Format:  tar.FormatPAX,
+	}
+	if err := tw.WriteHeader(&hdr); err != nil {
+		return fmt.Errorf("writing tar header for %s: %w", archiveSumsFile, err)
+	}
+	if _, err := tw.Write(sums.Bytes()); err != nil {
+		return fmt.Errorf("writing %s: %w", archiveSumsFile, err)
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("closing tar file: %w", err)
+	}
+	log.Info("archival export done", mlog.Field("account", manifest.Account), mlog.Field("mailboxes", len(manifest.Mailboxes)), mlog.Field("messages", len(manifest.Messages)))
+	return nil
+}
+
+// VerifyArchive reads an archival export from r and checks it is complete and
+// intact: The format version must be supported, all files must be listed in
+// SHA256SUMS with a matching checksum, and all messages in the manifest must be
+// present with matching size and checksum. The manifest is returned.
+func VerifyArchive(r io.Reader) (ArchiveManifest, error) {
+	var manifest ArchiveManifest
+	var manifestBuf, sumsBuf []byte
+	sums := map[string]string{} // File name to hex checksum, as calculated.
+	sizes := map[string]int64{}
+	var names []string
+
+	tr := tar.NewReader(r)
+	for i := 0; ; i++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return manifest, fmt.Errorf("reading tar file: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return manifest, fmt.Errorf("unexpected non-regular file %q in archive", hdr.Name)
+		}
+		if i == 0 && hdr.Name != archiveFormatFile {
+			return manifest, fmt.Errorf("first file in archive is %q, expected %q, not a mox archive", hdr.Name, archiveFormatFile)
+		}
+		if _, ok := sizes[hdr.Name]; ok {
+			return manifest, fmt.Errorf("duplicate file %q in archive", hdr.Name)
+		}
+		if sumsBuf != nil {
+			return manifest, fmt.Errorf("unexpected file %q after %s", hdr.Name, archiveSumsFile)
+		}
+
+		var buf bytes.Buffer
+		var w io.Writer = io.Discard
+		switch hdr.Name {
+		case archiveFormatFile, archiveManifestFile, archiveSumsFile:
+			w = &buf
+		}
+		h := sha256.New()
+		n, err := io.Copy(io.MultiWriter(w, h), tr)
+		if err != nil {
+			return manifest, fmt.Errorf("reading %s: %w", hdr.Name, err)
+		}
+
+		switch hdr.Name {
+		case archiveFormatFile:
+			var version int
+			if _, err := fmt.Sscanf(buf.String(), "mox-archive %d\n", &version); err != nil {
+				return manifest, fmt.Errorf("parsing archive format: %v", err)
+			} else if version != ArchiveVersion {
+				return manifest, fmt.Errorf("unsupported archive format version %d, expected %d", version, ArchiveVersion)
+			}
+		case archiveManifestFile:
+			manifestBuf = buf.Bytes()
+		case archiveSumsFile:
+			sumsBuf = buf.Bytes()
+			continue
+		}
+		names = append(names, hdr.Name)
+		sums[hdr.Name] = hex.EncodeToString(h.Sum(nil))
+		sizes[hdr.Name] = n
+	}
+
+	if manifestBuf == nil {
+		return manifest, fmt.Errorf("missing %s", archiveManifestFile)
+	} else if sumsBuf == nil {
+		return manifest, fmt.Errorf("missing %s", archiveSumsFile)
+	}
+
+	listed := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSuffix(string(sumsBuf), "\n"), "\n") {
+		t := strings.SplitN(line, "  ", 2)
+		if len(t) != 2 {
+			return manifest, fmt.Errorf("malformed line in %s: %q", archiveSumsFile, line)
+		}
+		sum, ok := sums[t[1]]
+		if !ok {
+			return manifest, fmt.Errorf("file %q in %s not in archive", t[1], archiveSumsFile)
+		} else if sum != t[0] {
+			return manifest, fmt.Errorf("checksum mismatch for %q, calculated %s, expected %s", t[1], sum, t[0])
+		}
+		listed[t[1]] = true
+	}
+	for _, name := range names {
+		if !listed[name] {
+			return manifest, fmt.Errorf("file %q not listed in %s", name, archiveSumsFile)
+		}
+	}
+
+	if err := json.Unmarshal(manifestBuf, &manifest); err != nil {
+		return manifest, fmt.Errorf("parsing manifest: %w", err)
+	}
+	if manifest.Version != ArchiveVersion {
+		return manifest, fmt.Errorf("manifest has version %d, expected %d", manifest.Version, ArchiveVersion)
+	}
+	mailboxes := map[string]bool{}
+	for _, mb := range manifest.Mailboxes {
+		mailboxes[mb.Name] = true
+	}
+	files := map[string]bool{}
+	for _, am := range manifest.Messages {
+		if !strings.HasPrefix(am.File, "messages/") {
+			return manifest, fmt.Errorf("message file %q outside messages/", am.File)
+		} else if files[am.File] {
+			return manifest, fmt.Errorf("message file %q listed multiple times in manifest", am.File)
+		} else if !mailboxes[am.Mailbox] {
+			return manifest, fmt.Errorf("message file %q in unknown mailbox %q", am.File, am.Mailbox)
+		}
+		files[am.File] = true
+		if size, ok := sizes[am.File]; !ok {
+			return manifest, fmt.Errorf("message file %q missing from archive", am.File)
+		} else if size != am.Size {
+			return manifest, fmt.Errorf("size mismatch for message file %q, got %d, expected %d", am.File, size, am.Size)
+		} else if sums[am.File] != am.SHA256 {
+			return manifest, fmt.Errorf("checksum mismatch for message file %q", am.File)
+		}
+	}
+	for _, name := range names {
+		if strings.HasPrefix(name, "messages/") && !files[name] {
+			return manifest, fmt.Errorf("message file %q not in manifest", name)
+		}
+	}
+	return manifest, nil
+}
+
+// ImportArchive verifies the archival export in file path with VerifyArchive,
+// and adds its mailboxes and messages to the account. Mailboxes are created as
+// needed, for new mailboxes the special-use attributes and subscription are
+// restored. Messages get new UIDs, their received time, flags and keywords are
+// preserved. The junk filter is trained with the messages. Nothing is imported
+// if verification fails. The number of imported messages is returned.
+//
+// Changes are broadcasted.
+func (a *Account) ImportArchive(ctx context.Context, log *mlog.Log, path string) (n int, rerr error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("open archive: %w", err)
+	}
+	defer func() {
+		err := f.Close()
+		log.Check(err, "closing archive after import")
+	}()
+	manifest, err := VerifyArchive(f)
+	if err != nil {
+		return 0, fmt.Errorf("verifying archive: %w", err)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return 0, fmt.Errorf("seek to start of archive: %w", err)
+	}
+	msgs := map[string]ArchiveMessage{}
+	for _, am := range manifest.Messages {
+		if strings.EqualFold(am.Mailbox, "inbox") {
+			am.Mailbox = "Inbox"
+		}
+		for _, kw := range am.Keywords {
+			if !ValidLowercaseKeyword(kw) {
+				return 0, fmt.Errorf("invalid keyword %q for message file %q", kw, am.File)
+			}
+		}
+		msgs[am.File] = am
+	}
+
+	var changes []Change
+	var deliveredIDs []int64
+	defer func() {
+		if rerr == nil {
+			return
+		}
+		for _, id := range deliveredIDs {
+			p := a.MessagePath(id)
+			err := os.Remove(p)
+			log.Check(err, "removing message file after failed archive import", mlog.Field("path", p))
+		}
+	}()
+
+	a.WithWLock(func() {
+		rerr = a.DB.Write(ctx, func(tx *bstore.Tx) error {
+			mailboxes := map[string]Mailbox{}
+			keywords := map[string]map[string]bool{}
+			for _, amb := range manifest.Mailboxes {
+				name := amb.Name
+				if strings.EqualFold(name, "inbox") {
+					name = "Inbox"
+				}
+				exists, err := a.MailboxExists(tx, name)
+				if err != nil {
+					return fmt.Errorf("checking mailbox: %w", err)
+				}
+				mb, mbChanges, err := a.MailboxEnsure(tx, name, amb.Subscribed)
+				if err != nil {
+					return fmt.Errorf("ensuring mailbox %q: %w", name, err)
+				}
+				changes = append(changes, mbChanges...)
+				if !exists && len(amb.SpecialUse) > 0 {
+					var su SpecialUse
+					for _, attr := range amb.SpecialUse {
+						su.Add(attr)
+					}
+					if err := a.MailboxSpecialUseSet(tx, &mb, su); err != nil {
+						return err
+					}
+				}
+				mailboxes[name] = mb
+				keywords[name] = map[string]bool{}
+				for _, kw := range amb.Keywords {
+					keywords[name][kw] = true
+				}
+			}
+
+			var delivered []Message
+			tr := tar.NewReader(f)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					return fmt.Errorf("reading tar file: %w", err)
+				}
+				am, ok := msgs[hdr.Name]
+				if !ok {
+					continue
+				}
+
+				m := Message{
+					MailboxID:     mailboxes[am.Mailbox].ID,
+					MailboxOrigID: mailboxes[am.Mailbox].ID,
+					Received:      am.Received,
+					Keywords:      am.Keywords,
+					Size:          am.Size,
+				}
+				for _, fl := range am.Flags {
+					var known bool
+					for _, af := range archiveFlags {
+						if strings.EqualFold(af.name, fl) {
+							*af.field(&m.Flags) = true
+							known = true
+						}
+					}
+					if !known {
+						return fmt.Errorf("unknown flag %q for message file %q", fl, am.File)
+					}
+				}
+
+				err = func() error {
+					mf, err := CreateMessageTemp("import-archive")
+					if err != nil {
+						return fmt.Errorf("creating temp message file: %w", err)
+					}
+					defer func() {
+						if mf != nil {
+							err := os.Remove(mf.Name())
+							log.Check(err, "removing temporary message file")
+							err = mf.Close()
+							log.Check(err, "closing temporary message file")
+						}
+					}()
+					if _, err := io.Copy(mf, tr); err != nil {
+						return fmt.Errorf("copying message to temp file: %w", err)
+					}
+					const consumeFile = true
+					const sync = false
+					const notrain = true
+					if err := a.DeliverMessage(log, tx, &m, mf, consumeFile, am.Mailbox == "Sent", sync, notrain); err != nil {
+						return err
+					}
+					err = mf.Close()
+					log.Check(err, "closing message file after delivery")
+					mf = nil
+					return nil
+				}()
+				if err != nil {
+					return fmt.Errorf("delivering message file %q: %w", am.File, err)
+				}
+				deliveredIDs = append(deliveredIDs, m.ID)
+				delivered = append(delivered, m)
+				for _, kw := range m.Keywords {
+					keywords[am.Mailbox][kw] = true
+				}
+				changes = append(changes, ChangeAddUID{m.MailboxID, m.UID, m.ModSeq, m.Flags, m.Keywords})
+			}
+			if len(delivered) != len(msgs) {
+				return fmt.Errorf("imported %d messages, expected %d", len(delivered), len(msgs))
+			}
+
+			// Mailbox UIDNext was changed during delivery, we fetch it again for updating keywords.
+			for name, kws := range keywords {
+				if len(kws) == 0 {
+					continue
+				}
+				var l []string
+				for kw := range kws {
+					l = append(l, kw)
+				}
+				mb := Mailbox{ID: mailboxes[name].ID}
+				if err := tx.Get(&mb); err != nil {
+					return fmt.Errorf("get mailbox: %w", err)
+				}
+				var changed bool
+				mb.Keywords, changed = MergeKeywords(mb.Keywords, l)
+				if changed {
+					if err := tx.Update(&mb); err != nil {
+						return fmt.Errorf("updating mailbox keywords: %w", err)
+					}
+				}
+			}
+
+			if err := a.RetrainMessages(ctx, log, tx, delivered, false); err != nil {
+				return fmt.Errorf("training junk filter: %w", err)
+			}
+			n = len(delivered)
+			return nil
+		})
+		if rerr != nil {
+			return
+		}
+		deliveredIDs = nil
+
+		comm := RegisterComm(a)
+		defer comm.Unregister()
+		comm.Broadcast(changes)
+	})
+	if rerr == nil {
+		log.Info("imported archive", mlog.Field("account", a.Name), mlog.Field("path", path), mlog.Field("messages", n))
+	}
+	return n, rerr
+}
@@ -0,0 +1,126 @@
+package store
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestArchival(t *testing.T) {
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = "../testdata/store/mox.conf"
+	mox.ConfigDynamicPath = filepath.Join(filepath.Dir(mox.ConfigStaticPath), "domains.conf")
+	mox.MustLoadConfig(true, false)
+	acc, err := OpenAccount("mjl")
+	tcheck(t, err, "open account")
+	defer acc.Close()
+	switchDone := Switchboard()
+	defer close(switchDone)
+
+	log := mlog.New("archival")
+
+	const msg = "test: test\r\n\r\ntest\r\n"
+	deliver := func(mailbox string, flags Flags, keywords []string) {
+		t.Helper()
+		msgFile, err := CreateMessageTemp("archival-test")
+		tcheck(t, err, "create temp")
+		defer os.Remove(msgFile.Name())
+		_, err = msgFile.Write([]byte(msg))
+		tcheck(t, err, "write message")
+		m := Message{Received: time.Now().Round(0), Size: int64(len(msg)), Flags: flags, Keywords: keywords}
+		acc.WithWLock(func() {
+			err = acc.DB.Write(ctxbg, func(tx *bstore.Tx) error {
+				mb, _, err := acc.MailboxEnsure(tx, mailbox, true)
+				tcheck(t, err, "ensure mailbox")
+				m.MailboxID = mb.ID
+				m.MailboxOrigID = mb.ID
+				return acc.DeliverMessage(xlog, tx, &m, msgFile, false, false, false, true)
+			})
+		})
+		tcheck(t, err, "deliver")
+	}
+	deliver("Inbox", Flags{Seen: true, Forwarded: true}, []string{"work"})
+	deliver("Lists/mox", Flags{Flagged: true}, nil)
+
+	var buf bytes.Buffer
+	err = ExportArchive(ctxbg, log, acc.DB, acc.Dir, &buf)
+	tcheck(t, err, "export archive")
+
+	manifest, err := VerifyArchive(bytes.NewReader(buf.Bytes()))
+	tcheck(t, err, "verify archive")
+	if manifest.Account != "mjl" || len(manifest.Messages) != 2 {
+		t.Fatalf("unexpected manifest %#v", manifest)
+	}
+	am := manifest.Messages[0]
+	if am.File != "messages/1.eml" || am.Mailbox != "Inbox" || am.Size != int64(len(msg)) || !reflect.DeepEqual(am.Flags, []string{`\Seen`, `$Forwarded`}) || !reflect.DeepEqual(am.Keywords, []string{"work"}) {
+		t.Fatalf("unexpected first message in manifest %#v", am)
+	}
+
+	// Any modification must be detected.
+	corrupt := bytes.Replace(buf.Bytes(), []byte("\r\n\r\ntest\r\n"), []byte("\r\n\r\nTEST\r\n"), 1)
+	if _, err := VerifyArchive(bytes.NewReader(corrupt)); err == nil {
+		t.Fatalf("corrupted archive verified")
+	}
+	if _, err := VerifyArchive(bytes.NewReader([]byte(msg))); err == nil {
+		t.Fatalf("non-archive verified")
+	}
+
+	// Import into another account.
+	archivePath := filepath.Join(t.TempDir(), "archive.tar")
+	err = os.WriteFile(archivePath, buf.Bytes(), 0660)
+	tcheck(t, err, "write archive")
+	acc2, err := OpenAccount("mjl2")
+	tcheck(t, err, "open account")
+	defer acc2.Close()
+	n, err := acc2.ImportArchive(ctxbg, log, archivePath)
+	tcheck(t, err, "import archive")
+	if n != 2 {
+		t.Fatalf("imported %d messages, expected 2", n)
+	}
+
+	err = acc2.DB.Read(ctxbg, func(tx *bstore.Tx) error {
+		mb, err := acc2.MailboxFind(tx, "Lists/mox")
+		tcheck(t, err, "find mailbox")
+		if mb == nil {
+			t.Fatalf("mailbox not imported")
+		}
+		m, err := bstore.QueryTx[Message](tx).FilterNonzero(Message{MailboxID: mb.ID}).Get()
+		tcheck(t, err, "get imported message")
+		if m.Flags != (Flags{Flagged: true}) || !m.Received.Equal(manifest.Messages[1].Received) {
+			t.Fatalf("unexpected imported message %#v", m)
+		}
+
+		inbox, err := acc2.MailboxFind(tx, "Inbox")
+		tcheck(t, err, "find inbox")
+		m, err = bstore.QueryTx[Message](tx).FilterNonzero(Message{MailboxID: inbox.ID}).Get()
+		tcheck(t, err, "get imported message")
+		if m.Flags != (Flags{Seen: true, Forwarded: true}) || !reflect.DeepEqual(m.Keywords, []string{"work"}) {
+			t.Fatalf("unexpected imported message %#v", m)
+		}
+		if !reflect.DeepEqual(inbox.Keywords, []string{"work"}) {
+			t.Fatalf("mailbox keywords %v, expected work", inbox.Keywords)
+		}
+		return nil
+	})
+	tcheck(t, err, "read")
+
+	// Importing a corrupt archive imports nothing.
+	err = os.WriteFile(archivePath, corrupt, 0660)
+	tcheck(t, err, "write archive")
+	if _, err := acc2.ImportArchive(ctxbg, log, archivePath); err == nil {
+		t.Fatalf("importing corrupt archive succeeded")
+	}
+	count, err := bstore.QueryDB[Message](ctxbg, acc2.DB).Count()
+	tcheck(t, err, "count messages")
+	if count != 2 {
+		t.Fatalf("%d messages after failed import, expected 2", count)
+	}
+}
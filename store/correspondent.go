@@ -0,0 +1,93 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/smtp"
+)
+
+// Correspondent is an address the account has sent messages to, or that was
+// added by the user. Messages from correspondents with a validated From address
+// are accepted based on reputation, and are treated more leniently by the junk
+// filter otherwise. Unlike Recipient, correspondents are kept when sent messages
+// are removed.
+type Correspondent struct {
+	ID        int64
+	Localpart smtp.Localpart `bstore:"nonzero"`                         // Lower case.
+	Domain    string         `bstore:"nonzero,unique Domain+Localpart"` // Unicode string, lower case.
+	Added     time.Time      `bstore:"default now"`
+	Manual    bool           // Added by user, instead of by sending a message.
+	LastSent  time.Time      // Zero if never sent to.
+	Sent      int            // Number of messages sent to this address.
+}
+
+// ErrCorrespondentExists is returned when adding a correspondent that already
+// exists.
+var ErrCorrespondentExists = errors.New("correspondent already exists")
+
+func correspondentKey(localpart smtp.Localpart, domain string) Correspondent {
+	return Correspondent{Localpart: smtp.Localpart(strings.ToLower(string(localpart))), Domain: strings.ToLower(domain)}
+}
+
+// correspondentSent registers that a message to the address was sent at "sent".
+func correspondentSent(tx *bstore.Tx, localpart smtp.Localpart, domain string, sent time.Time) error {
+	k := correspondentKey(localpart, domain)
+	c, err := bstore.QueryTx[Correspondent](tx).FilterNonzero(k).Get()
+	if err == bstore.ErrAbsent {
+		c = k
+		c.Sent = 1
+		c.LastSent = sent
+		return tx.Insert(&c)
+	} else if err != nil {
+		return err
+	}
+	c.Sent++
+	if sent.After(c.LastSent) {
+		c.LastSent = sent
+	}
+	return tx.Update(&c)
+}
+
+// IsCorrespondent returns whether the address is a correspondent of the account.
+func IsCorrespondent(tx *bstore.Tx, localpart smtp.Localpart, domain string) (bool, error) {
+	return bstore.QueryTx[Correspondent](tx).FilterNonzero(correspondentKey(localpart, domain)).Exists()
+}
+
+// Correspondents returns all correspondents of the account, sorted by domain and
+// localpart.
+func (a *Account) Correspondents(ctx context.Context) ([]Correspondent, error) {
+	return bstore.QueryDB[Correspondent](ctx, a.DB).SortAsc("Domain", "Localpart").List()
+}
+
+// CorrespondentAdd adds address as correspondent. ErrCorrespondentExists is
+// returned if it already exists.
+func (a *Account) CorrespondentAdd(ctx context.Context, address string) (Correspondent, error) {
+	addr, err := smtp.ParseAddress(address)
+	if err != nil {
+		return Correspondent{}, fmt.Errorf("parsing address: %w", err)
+	}
+	c := correspondentKey(addr.Localpart, addr.Domain.Name())
+	c.Manual = true
+	err = a.DB.Write(ctx, func(tx *bstore.Tx) error {
+		exists, err := bstore.QueryTx[Correspondent](tx).FilterNonzero(correspondentKey(c.Localpart, c.Domain)).Exists()
+		if err != nil {
+			return err
+		} else if exists {
+			return ErrCorrespondentExists
+		}
+		return tx.Insert(&c)
+	})
+	return c, err
+}
+
+// CorrespondentRemove removes a correspondent by ID. The address is added again
+// when the account sends a message to it.
+func (a *Account) CorrespondentRemove(ctx context.Context, id int64) error {
+	return a.DB.Delete(ctx, &Correspondent{ID: id})
+}
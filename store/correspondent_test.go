@@ -0,0 +1,89 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestCorrespondents(t *testing.T) {
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = "../testdata/store/mox.conf"
+	mox.MustLoadConfig(true, false)
+	acc, err := OpenAccount("mjl")
+	tcheck(t, err, "open account")
+	defer acc.Close()
+
+	log := mlog.New("correspondent")
+
+	sent := func() {
+		t.Helper()
+		msg := "From: <mjl@mox.example>\r\nTo: <Remote@Remote.example>\r\nCc: <other@remote.example>\r\nSubject: test\r\n\r\ntest\r\n"
+		msgFile, err := CreateMessageTemp("correspondent")
+		tcheck(t, err, "create temp")
+		defer os.Remove(msgFile.Name())
+		defer msgFile.Close()
+		_, err = msgFile.Write([]byte(msg))
+		tcheck(t, err, "write message")
+		m := Message{Size: int64(len(msg))}
+		acc.WithWLock(func() {
+			err = acc.DB.Write(ctxbg, func(tx *bstore.Tx) error {
+				mb, err := acc.MailboxFind(tx, "Sent")
+				tcheck(t, err, "find sent mailbox")
+				m.MailboxID = mb.ID
+				m.MailboxOrigID = mb.ID
+				return acc.DeliverMessage(log, tx, &m, msgFile, false, true, false, false)
+			})
+		})
+		tcheck(t, err, "deliver")
+	}
+	sent()
+	sent()
+
+	l, err := acc.Correspondents(ctxbg)
+	tcheck(t, err, "list correspondents")
+	if len(l) != 2 || l[0].Localpart != "other" || l[1].Localpart != "remote" || l[1].Domain != "remote.example" || l[1].Sent != 2 || l[1].Manual {
+		t.Fatalf("got correspondents %#v, expected other and remote", l)
+	}
+
+	_, err = acc.CorrespondentAdd(ctxbg, "REMOTE@remote.example")
+	if !errors.Is(err, ErrCorrespondentExists) {
+		t.Fatalf("adding existing correspondent, got err %v, expected ErrCorrespondentExists", err)
+	}
+	if _, err := acc.CorrespondentAdd(ctxbg, "bogus"); err == nil {
+		t.Fatalf("adding invalid address succeeded")
+	}
+	c, err := acc.CorrespondentAdd(ctxbg, "new@Other.example")
+	tcheck(t, err, "add correspondent")
+	if !c.Manual || c.Domain != "other.example" {
+		t.Fatalf("added correspondent %#v, expected manual with lower case domain", c)
+	}
+
+	err = acc.DB.Read(ctxbg, func(tx *bstore.Tx) error {
+		ok, err := IsCorrespondent(tx, "New", "OTHER.example")
+		tcheck(t, err, "is correspondent")
+		if !ok {
+			t.Fatalf("new@other.example not a correspondent")
+		}
+		ok, err = IsCorrespondent(tx, "nobody", "other.example")
+		tcheck(t, err, "is correspondent")
+		if ok {
+			t.Fatalf("nobody@other.example is a correspondent")
+		}
+		return nil
+	})
+	tcheck(t, err, "read")
+
+	err = acc.CorrespondentRemove(ctxbg, c.ID)
+	tcheck(t, err, "remove correspondent")
+	l, err = acc.Correspondents(ctxbg)
+	tcheck(t, err, "list correspondents")
+	if len(l) != 2 {
+		t.Fatalf("got %d correspondents after remove, expected 2", len(l))
+	}
+}
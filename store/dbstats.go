@@ -0,0 +1,187 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+var (
+	metricDBOperation = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "mox_db_operation_duration_seconds",
+			Help:    "Duration of database transactions.",
+			Buckets: []float64{0.0001, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 30},
+		},
+		[]string{
+			"subsystem", // imapserver, smtpserver, queue, http
+			"op",        // read, write
+		},
+	)
+	metricDBOperationSlow = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mox_db_operation_slow_total",
+			Help: "Database transactions that took longer than the configured SlowDBOperation duration.",
+		},
+		[]string{
+			"subsystem", // imapserver, smtpserver, queue, http
+		},
+	)
+)
+
+// DBSubsystemStats holds aggregated statistics for database transactions done
+// through DBRead and DBWrite for a subsystem, since startup.
+type DBSubsystemStats struct {
+	Subsystem  string
+	Operations int64
+	Slow       int64
+	Duration   time.Duration // Total duration of all operations.
+	Stats      bstore.Stats  // Summed counters of all transactions.
+
+	// Number of transactions whose last query was on a type and index, keyed by type
+	// name followed by "." and the index name, or just the type name if the query
+	// did not use an index.
+	Indices map[string]int64
+}
+
+var dbStats = struct {
+	sync.Mutex
+	subsystems map[string]*DBSubsystemStats
+}{subsystems: map[string]*DBSubsystemStats{}}
+
+// DBRead is like bstore.DB.Read, but records the duration of the transaction
+// as metric for subsystem, adds its statistics to those of the subsystem, and
+// logs the transaction when it takes longer than the configured
+// SlowDBOperation.
+func DBRead(ctx context.Context, log *mlog.Log, subsystem string, db *bstore.DB, fn func(tx *bstore.Tx) error) error {
+	return dbOperation(ctx, log, subsystem, "read", db, fn)
+}
+
+// DBWrite is like DBRead, but for a writable transaction.
+func DBWrite(ctx context.Context, log *mlog.Log, subsystem string, db *bstore.DB, fn func(tx *bstore.Tx) error) error {
+	return dbOperation(ctx, log, subsystem, "write", db, fn)
+}
+
+func dbOperation(ctx context.Context, log *mlog.Log, subsystem, op string, db *bstore.DB, fn func(tx *bstore.Tx) error) error {
+	var stats bstore.Stats
+	xfn := func(tx *bstore.Tx) error {
+		// Stats of the transaction are gathered on return, also when fn panics.
+		defer func() {
+			stats = tx.Stats()
+		}()
+		return fn(tx)
+	}
+
+	t0 := time.Now()
+	var err error
+	defer func() {
+		dbObserve(log, subsystem, op, time.Since(t0), stats, err)
+	}()
+	if op == "write" {
+		err = db.Write(ctx, xfn)
+	} else {
+		err = db.Read(ctx, xfn)
+	}
+	return err
+}
+
+func dbObserve(log *mlog.Log, subsystem, op string, duration time.Duration, stats bstore.Stats, err error) {
+	metricDBOperation.WithLabelValues(subsystem, op).Observe(float64(duration) / float64(time.Second))
+
+	slow := mox.Conf.Static.SlowDBOperation
+	if slow == 0 {
+		slow = time.Second
+	}
+	isSlow := duration >= slow
+	if isSlow {
+		metricDBOperationSlow.WithLabelValues(subsystem).Inc()
+		log.Infox("slow database operation", err,
+			mlog.Field("subsystem", subsystem),
+			mlog.Field("op", op),
+			mlog.Field("duration", duration),
+			mlog.Field("queries", stats.Queries),
+			mlog.Field("tablescans", stats.PlanTableScan),
+			mlog.Field("indexscans", stats.PlanIndexScan),
+			mlog.Field("sorts", stats.Sort),
+			mlog.Field("recordcursor", stats.Records.Cursor),
+			mlog.Field("indexcursor", stats.Index.Cursor),
+			mlog.Field("lasttype", stats.LastType),
+			mlog.Field("lastindex", stats.LastIndex))
+	}
+
+	dbStats.Lock()
+	defer dbStats.Unlock()
+	ss := dbStats.subsystems[subsystem]
+	if ss == nil {
+		ss = &DBSubsystemStats{Subsystem: subsystem, Indices: map[string]int64{}}
+		dbStats.subsystems[subsystem] = ss
+	}
+	ss.Operations++
+	if isSlow {
+		ss.Slow++
+	}
+	ss.Duration += duration
+	dbStatsAdd(&ss.Stats, stats)
+	if stats.LastType != "" {
+		k := stats.LastType
+		if stats.LastIndex != "" {
+			k += "." + stats.LastIndex
+		}
+		ss.Indices[k]++
+	}
+}
+
+func dbStatsKVAdd(kv *bstore.StatsKV, n bstore.StatsKV) {
+	kv.Get += n.Get
+	kv.Put += n.Put
+	kv.Delete += n.Delete
+	kv.Cursor += n.Cursor
+}
+
+func dbStatsAdd(st *bstore.Stats, n bstore.Stats) {
+	st.Reads += n.Reads
+	st.Writes += n.Writes
+	dbStatsKVAdd(&st.Bucket, n.Bucket)
+	dbStatsKVAdd(&st.Records, n.Records)
+	dbStatsKVAdd(&st.Index, n.Index)
+	st.Get += n.Get
+	st.Insert += n.Insert
+	st.Update += n.Update
+	st.Delete += n.Delete
+	st.Queries += n.Queries
+	st.PlanTableScan += n.PlanTableScan
+	st.PlanPK += n.PlanPK
+	st.PlanUnique += n.PlanUnique
+	st.PlanPKScan += n.PlanPKScan
+	st.PlanIndexScan += n.PlanIndexScan
+	st.Sort += n.Sort
+}
+
+// DBStats returns a copy of the aggregated statistics per subsystem, sorted by
+// subsystem name.
+func DBStats() []DBSubsystemStats {
+	dbStats.Lock()
+	defer dbStats.Unlock()
+	var l []DBSubsystemStats
+	for _, ss := range dbStats.subsystems {
+		x := *ss
+		x.Indices = map[string]int64{}
+		for k, v := range ss.Indices {
+			x.Indices[k] = v
+		}
+		l = append(l, x)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Subsystem < l[j].Subsystem
+	})
+	return l
+}
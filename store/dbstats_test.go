@@ -0,0 +1,49 @@
+package store
+
+import (
+	"os"
+	"testing"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestDBStats(t *testing.T) {
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = "../testdata/store/mox.conf"
+	mox.MustLoadConfig(true, false)
+	acc, err := OpenAccount("mjl")
+	tcheck(t, err, "open account")
+	defer acc.Close()
+
+	log := mlog.New("dbstats")
+	err = DBRead(ctxbg, log, "test", acc.DB, func(tx *bstore.Tx) error {
+		_, err := bstore.QueryTx[Mailbox](tx).FilterNonzero(Mailbox{Name: "Inbox"}).Get()
+		return err
+	})
+	tcheck(t, err, "read")
+	err = DBWrite(ctxbg, log, "test", acc.DB, func(tx *bstore.Tx) error {
+		_, err := bstore.QueryTx[Message](tx).List()
+		return err
+	})
+	tcheck(t, err, "write")
+
+	var ss *DBSubsystemStats
+	l := DBStats()
+	for i := range l {
+		if l[i].Subsystem == "test" {
+			ss = &l[i]
+		}
+	}
+	if ss == nil {
+		t.Fatalf("no stats for subsystem")
+	}
+	if ss.Operations != 2 || ss.Stats.Queries != 2 || ss.Stats.PlanTableScan != 1 || ss.Stats.PlanUnique != 1 {
+		t.Fatalf("unexpected stats %#v", ss)
+	}
+	if ss.Indices["Mailbox.Name"] != 1 || ss.Indices["Message"] != 1 {
+		t.Fatalf("unexpected index usage %#v", ss.Indices)
+	}
+}
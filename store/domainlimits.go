@@ -0,0 +1,123 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+// ErrDomainStorage is returned when storing a message would exceed the storage
+// limit of the domain of the account.
+var ErrDomainStorage = errors.New("storage limit of domain reached")
+
+// DomainUsage is the usage of the accounts of a domain together, for comparison
+// against the limits of the domain.
+type DomainUsage struct {
+	Accounts                int   // Number of accounts with the domain as their domain.
+	Storage                 int64 // Total size of messages.
+	OutgoingMessagesPastDay int   // Number of messages submitted in the past 24 hours.
+}
+
+// forDomainAccounts calls fn with a read-only transaction for each account of
+// the domain.
+func forDomainAccounts(ctx context.Context, log *mlog.Log, domain dns.Domain, fn func(tx *bstore.Tx) error) error {
+	for _, name := range mox.Conf.DomainAccounts(domain) {
+		acc, err := OpenAccount(name)
+		if err != nil {
+			return fmt.Errorf("open account %s: %w", name, err)
+		}
+		err = DBRead(ctx, log, "store", acc.DB, fn)
+		xerr := acc.Close()
+		log.Check(xerr, "closing account")
+		if err != nil {
+			return fmt.Errorf("account %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func messagesSize(tx *bstore.Tx) (int64, error) {
+	du := DiskUsage{ID: 1}
+	err := tx.Get(&du)
+	return du.MessageSize, err
+}
+
+func outgoingSince(tx *bstore.Tx, since time.Time) (int, error) {
+	return bstore.QueryTx[Outgoing](tx).FilterGreater("Submitted", since).Count()
+}
+
+// DomainUsageGather returns the current usage of the accounts of domain.
+func DomainUsageGather(ctx context.Context, log *mlog.Log, domain dns.Domain) (DomainUsage, error) {
+	var u DomainUsage
+	since := time.Now().Add(-24 * time.Hour)
+	err := forDomainAccounts(ctx, log, domain, func(tx *bstore.Tx) error {
+		size, err := messagesSize(tx)
+		if err != nil {
+			return fmt.Errorf("gathering message sizes: %w", err)
+		}
+		n, err := outgoingSince(tx, since)
+		if err != nil {
+			return fmt.Errorf("counting outgoing messages: %w", err)
+		}
+		u.Accounts++
+		u.Storage += size
+		u.OutgoingMessagesPastDay += n
+		return nil
+	})
+	return u, err
+}
+
+// CheckDomainStorage returns ErrDomainStorage if adding a message of size bytes
+// to the account would exceed the storage limit of the domain of the account.
+func (a *Account) CheckDomainStorage(ctx context.Context, log *mlog.Log, size int64) error {
+	conf, _ := a.Conf()
+	dc, ok := mox.Conf.Domain(conf.DNSDomain)
+	if !ok || dc.Limits == nil || dc.Limits.MaxStorage <= 0 {
+		return nil
+	}
+	var total int64
+	err := forDomainAccounts(ctx, log, conf.DNSDomain, func(tx *bstore.Tx) error {
+		size, err := messagesSize(tx)
+		total += size
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("gathering storage usage of domain: %w", err)
+	}
+	if total+size > dc.Limits.MaxStorage {
+		return ErrDomainStorage
+	}
+	return nil
+}
+
+// CheckDomainOutgoing returns an error if submitting n more messages by the
+// account would exceed the limit of outgoing messages in a 24 hour window of the
+// domain of the account.
+func (a *Account) CheckDomainOutgoing(ctx context.Context, log *mlog.Log, n int) error {
+	conf, _ := a.Conf()
+	dc, ok := mox.Conf.Domain(conf.DNSDomain)
+	if !ok || dc.Limits == nil || dc.Limits.MaxOutgoingMessagesPerDay <= 0 {
+		return nil
+	}
+	var total int
+	since := time.Now().Add(-24 * time.Hour)
+	err := forDomainAccounts(ctx, log, conf.DNSDomain, func(tx *bstore.Tx) error {
+		count, err := outgoingSince(tx, since)
+		total += count
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("counting outgoing messages of domain: %w", err)
+	}
+	if total+n > dc.Limits.MaxOutgoingMessagesPerDay {
+		return fmt.Errorf("max number of messages (%d) for domain over past 24h reached", dc.Limits.MaxOutgoingMessagesPerDay)
+	}
+	return nil
+}
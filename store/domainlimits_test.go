@@ -0,0 +1,75 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestDomainLimits(t *testing.T) {
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = "../testdata/store/mox.conf"
+	mox.MustLoadConfig(true, false)
+	acc, err := OpenAccount("mjl")
+	tcheck(t, err, "open account")
+	defer acc.Close()
+	acc2, err := OpenAccount("mjl2")
+	tcheck(t, err, "open account")
+	defer acc2.Close()
+	switchDone := Switchboard()
+	defer close(switchDone)
+
+	log := mlog.New("domainlimits")
+
+	msgFile, err := os.CreateTemp("", "mox-test-domainlimits")
+	tcheck(t, err, "create temp")
+	defer os.Remove(msgFile.Name())
+	const msg = "Subject: test\r\n\r\ntest\r\n"
+	_, err = msgFile.Write([]byte(msg))
+	tcheck(t, err, "write message")
+
+	acc.WithWLock(func() {
+		m := Message{Size: 100}
+		err := acc.DeliverMailbox(log, "Inbox", &m, msgFile, false)
+		tcheck(t, err, "deliver")
+	})
+	err = acc2.DB.Insert(ctxbg, &Outgoing{Recipient: "remote@example.org"})
+	tcheck(t, err, "insert outgoing")
+
+	domain := dns.Domain{ASCII: "mox.example"}
+	usage, err := DomainUsageGather(ctxbg, log, domain)
+	tcheck(t, err, "domain usage")
+	if usage != (DomainUsage{Accounts: 2, Storage: 100, OutgoingMessagesPastDay: 1}) {
+		t.Fatalf("got usage %#v, expected 2 accounts, 100 bytes, 1 outgoing message", usage)
+	}
+
+	// Without limits, everything is allowed.
+	err = acc.CheckDomainStorage(ctxbg, log, 1000)
+	tcheck(t, err, "check domain storage")
+	err = acc.CheckDomainOutgoing(ctxbg, log, 1000)
+	tcheck(t, err, "check domain outgoing")
+
+	domConf := mox.Conf.Dynamic.Domains["mox.example"]
+	defer func() {
+		mox.Conf.Dynamic.Domains["mox.example"] = domConf
+	}()
+	dc := domConf
+	dc.Limits = &config.DomainLimits{MaxStorage: 150, MaxOutgoingMessagesPerDay: 2}
+	mox.Conf.Dynamic.Domains["mox.example"] = dc
+
+	err = acc.CheckDomainStorage(ctxbg, log, 50)
+	tcheck(t, err, "check domain storage")
+	if err := acc2.CheckDomainStorage(ctxbg, log, 51); !errors.Is(err, ErrDomainStorage) {
+		t.Fatalf("got err %v, expected ErrDomainStorage", err)
+	}
+	err = acc.CheckDomainOutgoing(ctxbg, log, 1)
+	tcheck(t, err, "check domain outgoing")
+	if err := acc.CheckDomainOutgoing(ctxbg, log, 2); err == nil {
+		t.Fatalf("got nil, expected error for outgoing messages over limit")
+	}
+}
@@ -0,0 +1,153 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+// MessageExpire schedules removal of messages with a Message-ID from the
+// account, for messages submitted with an Expires header.
+type MessageExpire struct {
+	ID        int64
+	MessageID string    `bstore:"nonzero,unique"` // Message-ID header, as in Message.MessageID, including <>.
+	Expires   time.Time `bstore:"nonzero,index"`
+}
+
+// MessageExpireAdd schedules removal of messages with messageID from the account
+// at expires. If an expiration is already present for the Message-ID, the earliest
+// expiration is kept.
+func (a *Account) MessageExpireAdd(ctx context.Context, messageID string, expires time.Time) error {
+	return a.DB.Write(ctx, func(tx *bstore.Tx) error {
+		me, err := bstore.QueryTx[MessageExpire](tx).FilterNonzero(MessageExpire{MessageID: messageID}).Get()
+		if err == bstore.ErrAbsent {
+			return tx.Insert(&MessageExpire{MessageID: messageID, Expires: expires})
+		} else if err != nil {
+			return err
+		}
+		if expires.Before(me.Expires) {
+			me.Expires = expires
+			return tx.Update(&me)
+		}
+		return nil
+	})
+}
+
+// ExpireMessages removes the messages in all mailboxes with a Message-ID for which
+// the expiration time has passed. The number of removed messages is returned.
+// Fails with ErrHold for accounts on hold, keeping the expirations.
+//
+// Caller must hold account wlock.
+// Changes are broadcasted.
+func (a *Account) ExpireMessages(log *mlog.Log, now time.Time) (removed int, rerr error) {
+	exists, err := bstore.QueryDB[MessageExpire](context.TODO(), a.DB).FilterLessEqual("Expires", now).Exists()
+	if err != nil {
+		return 0, fmt.Errorf("looking for expired messages: %w", err)
+	} else if !exists {
+		return 0, nil
+	}
+	if a.OnHold() {
+		return 0, ErrHold
+	}
+
+	var changes []Change
+	var remove []Message
+	defer func() {
+		for _, m := range remove {
+			p := a.MessagePath(m.ID)
+			err := os.Remove(p)
+			log.Check(err, "removing expired message file", mlog.Field("path", p))
+		}
+	}()
+
+	err = a.DB.Write(context.TODO(), func(tx *bstore.Tx) error {
+		q := bstore.QueryTx[MessageExpire](tx)
+		q.FilterLessEqual("Expires", now)
+		expired, err := q.List()
+		if err != nil {
+			return fmt.Errorf("listing expirations: %w", err)
+		}
+
+		for _, me := range expired {
+			qm := bstore.QueryTx[Message](tx)
+			qm.FilterNonzero(Message{MessageID: me.MessageID})
+			msgs, err := qm.List()
+			if err != nil {
+				return fmt.Errorf("listing expired messages: %w", err)
+			}
+			byMailbox := map[int64][]Message{}
+			for _, m := range msgs {
+				byMailbox[m.MailboxID] = append(byMailbox[m.MailboxID], m)
+			}
+			for mbID, l := range byMailbox {
+				mb := Mailbox{ID: mbID}
+				if err := tx.Get(&mb); err != nil {
+					return fmt.Errorf("get mailbox: %w", err)
+				}
+				mbChanges, err := a.removeMessages(context.TODO(), log, tx, &mb, l)
+				if err != nil {
+					return fmt.Errorf("removing expired messages: %w", err)
+				}
+				changes = append(changes, mbChanges...)
+				remove = append(remove, l...)
+			}
+			if err := tx.Delete(&me); err != nil {
+				return fmt.Errorf("removing expiration: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		remove = nil // Don't remove files on failure.
+		return 0, err
+	}
+	if len(changes) > 0 {
+		comm := RegisterComm(a)
+		defer comm.Unregister()
+		comm.Broadcast(changes)
+	}
+	return len(remove), nil
+}
+
+// StartExpirer starts a goroutine that removes expired messages from all
+// accounts, every 15 minutes.
+func StartExpirer() {
+	go func() {
+		for {
+			time.Sleep(15 * time.Minute)
+			expireAccounts(time.Now())
+		}
+	}()
+}
+
+func expireAccounts(now time.Time) {
+	log := xlog.WithCid(mox.Cid())
+	for _, accName := range mox.Conf.Accounts() {
+		alog := log.Fields(mlog.Field("account", accName))
+		acc, err := OpenAccount(accName)
+		if err != nil {
+			alog.Errorx("open account for expiring messages", err)
+			continue
+		}
+		var n int
+		acc.WithWLock(func() {
+			n, err = acc.ExpireMessages(alog, now)
+		})
+		if errors.Is(err, ErrHold) {
+			alog.Debug("not removing expired messages for account on hold")
+		} else if err != nil {
+			alog.Errorx("removing expired messages", err)
+		} else if n > 0 {
+			alog.Info("removed expired messages", mlog.Field("messages", n))
+		}
+		err = acc.Close()
+		alog.Check(err, "closing account after expiring messages")
+	}
+}
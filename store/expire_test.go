@@ -0,0 +1,102 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestExpireMessages(t *testing.T) {
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = "../testdata/store/mox.conf"
+	mox.MustLoadConfig(true, false)
+	acc, err := OpenAccount("mjl")
+	tcheck(t, err, "open account")
+	defer acc.Close()
+	switchDone := Switchboard()
+	defer close(switchDone)
+
+	log := mlog.New("expire")
+
+	deliver := func(mailbox, msgID string) {
+		t.Helper()
+		msg := "Message-Id: " + msgID + "\r\nSubject: test\r\n\r\ntest\r\n"
+		msgFile, err := CreateMessageTemp("expire")
+		tcheck(t, err, "create temp")
+		defer os.Remove(msgFile.Name())
+		defer msgFile.Close()
+		_, err = msgFile.Write([]byte(msg))
+		tcheck(t, err, "write message")
+		m := Message{Size: int64(len(msg))}
+		acc.WithWLock(func() {
+			err = acc.DeliverMailbox(log, mailbox, &m, msgFile, true)
+		})
+		tcheck(t, err, "deliver")
+		if m.MessageID != msgID {
+			t.Fatalf("got message-id %q, expected %q", m.MessageID, msgID)
+		}
+	}
+	deliver("Sent", "<expire1@mox.example>")
+	deliver("Inbox", "<expire1@mox.example>")
+	deliver("Inbox", "<keep@mox.example>")
+
+	count := func() int {
+		t.Helper()
+		n, err := bstore.QueryDB[Message](ctxbg, acc.DB).Count()
+		tcheck(t, err, "count messages")
+		return n
+	}
+
+	now := time.Now()
+	err = acc.MessageExpireAdd(ctxbg, "<expire1@mox.example>", now.Add(2*time.Hour))
+	tcheck(t, err, "add expiration")
+	// Earliest expiration is kept.
+	err = acc.MessageExpireAdd(ctxbg, "<expire1@mox.example>", now.Add(time.Hour))
+	tcheck(t, err, "add expiration")
+	err = acc.MessageExpireAdd(ctxbg, "<expire1@mox.example>", now.Add(3*time.Hour))
+	tcheck(t, err, "add expiration")
+
+	expire := func(tm time.Time, exp int) {
+		t.Helper()
+		var n int
+		acc.WithWLock(func() {
+			n, err = acc.ExpireMessages(log, tm)
+		})
+		tcheck(t, err, "expire messages")
+		if n != exp {
+			t.Fatalf("removed %d messages, expected %d", n, exp)
+		}
+	}
+	expire(now, 0)
+	if n := count(); n != 3 {
+		t.Fatalf("got %d messages, expected 3", n)
+	}
+
+	// Accounts on hold keep their messages.
+	accConf := mox.Conf.Dynamic.Accounts["mjl"]
+	nc := accConf
+	nc.Hold = true
+	mox.Conf.Dynamic.Accounts["mjl"] = nc
+	acc.WithWLock(func() {
+		_, err = acc.ExpireMessages(log, now.Add(90*time.Minute))
+	})
+	mox.Conf.Dynamic.Accounts["mjl"] = accConf
+	if !errors.Is(err, ErrHold) {
+		t.Fatalf("expire messages on hold, got err %v, expected ErrHold", err)
+	}
+
+	expire(now.Add(90*time.Minute), 2)
+	if n := count(); n != 1 {
+		t.Fatalf("got %d messages, expected 1", n)
+	}
+	if n, err := bstore.QueryDB[MessageExpire](ctxbg, acc.DB).Count(); err != nil || n != 0 {
+		t.Fatalf("got %d expirations, err %v, expected 0", n, err)
+	}
+	expire(now.Add(4*time.Hour), 0)
+}
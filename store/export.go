@@ -295,7 +295,7 @@ func ExportMessages(ctx context.Context, log *mlog.Log, db *bstore.DB, accountDi
 	}
 
 	exportMessage := func(m Message) error {
-		mp := filepath.Join(accountDir, "msg", MessagePath(m.ID))
+		mp := messageFilePath(accountDir, m.ID)
 		var mr io.ReadCloser
 		if m.Size == int64(len(m.MsgPrefix)) {
 			mr = io.NopCloser(bytes.NewReader(m.MsgPrefix))
@@ -0,0 +1,70 @@
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+)
+
+// MessagesRemove removes msgs, all in mailbox mb, from the account, like an IMAP
+// expunge. The message files must be removed by the caller after the transaction
+// is committed.
+//
+// Caller must hold account wlock.
+// Changes are returned and must be broadcasted by the caller.
+func (a *Account) MessagesRemove(ctx context.Context, log *mlog.Log, tx *bstore.Tx, mb *Mailbox, msgs []Message) ([]Change, error) {
+	return a.removeMessages(ctx, log, tx, mb, msgs)
+}
+
+// MessagesMove moves msgs from mbSrc to mbDst, assigning new UIDs, like an IMAP
+// move. Both mailboxes are updated in the database.
+//
+// Caller must hold account wlock.
+// Changes are returned and must be broadcasted by the caller.
+func (a *Account) MessagesMove(ctx context.Context, log *mlog.Log, tx *bstore.Tx, mbSrc, mbDst *Mailbox, msgs []Message) ([]Change, error) {
+	return a.moveMessages(ctx, log, tx, mbSrc, mbDst, msgs)
+}
+
+// MailboxRemove removes mailbox mb and its messages, like an IMAP delete. The
+// caller must check the mailbox has no child mailboxes. The removed messages are
+// returned, their files must be removed by the caller after the transaction is
+// committed.
+//
+// Caller must hold account wlock.
+// Changes are returned and must be broadcasted by the caller.
+func (a *Account) MailboxRemove(ctx context.Context, log *mlog.Log, tx *bstore.Tx, mb *Mailbox) ([]Change, []Message, error) {
+	q := bstore.QueryTx[Message](tx)
+	q.FilterNonzero(Message{MailboxID: mb.ID})
+	remove, err := q.List()
+	if err != nil {
+		return nil, nil, fmt.Errorf("listing messages to remove: %w", err)
+	}
+	changes, err := a.removeMessages(ctx, log, tx, mb, remove)
+	if err != nil {
+		return nil, nil, fmt.Errorf("removing messages: %w", err)
+	}
+
+	if _, err := bstore.QueryTx[ExpungedUID](tx).FilterNonzero(ExpungedUID{MailboxID: mb.ID}).Delete(); err != nil {
+		return nil, nil, fmt.Errorf("removing expunged uids of mailbox: %w", err)
+	}
+	if _, err := bstore.QueryTx[Annotation](tx).FilterNonzero(Annotation{MailboxID: mb.ID}).Delete(); err != nil {
+		return nil, nil, fmt.Errorf("removing annotations of mailbox: %w", err)
+	}
+	if _, err := bstore.QueryTx[MailboxACL](tx).FilterNonzero(MailboxACL{MailboxID: mb.ID}).Delete(); err != nil {
+		return nil, nil, fmt.Errorf("removing access rights of mailbox: %w", err)
+	}
+	if err := URLAuthKeyReset(tx, mb.ID); err != nil {
+		return nil, nil, fmt.Errorf("removing urlauth key of mailbox: %w", err)
+	}
+	if err := MailboxCountsRemoveMailbox(tx, mb.ID); err != nil {
+		return nil, nil, fmt.Errorf("removing counts of mailbox: %w", err)
+	}
+	if err := tx.Delete(&Mailbox{ID: mb.ID}); err != nil {
+		return nil, nil, fmt.Errorf("removing mailbox: %w", err)
+	}
+	changes = append(changes, ChangeRemoveMailbox{Name: mb.Name})
+	return changes, remove, nil
+}
@@ -0,0 +1,107 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/moxio"
+	"github.com/mjl-/mox/smtp"
+)
+
+// ErrHold is returned for operations that would permanently remove messages from
+// an account that is on (litigation) hold.
+var ErrHold = errors.New("account is on hold, messages cannot be removed")
+
+// OnHold returns whether the account is on litigation hold, in which case
+// messages must not be permanently removed.
+func (a *Account) OnHold() bool {
+	conf, _ := a.Conf()
+	return AccountOnHold(conf)
+}
+
+// AccountOnHold returns whether an account with configuration conf is on
+// litigation hold, through its own configuration or that of its domain.
+func AccountOnHold(conf config.Account) bool {
+	if conf.Hold {
+		return true
+	}
+	dc, ok := mox.Conf.Domain(conf.DNSDomain)
+	return ok && dc.Hold
+}
+
+// JournalPaths returns the addresses to forward copies of messages to, from the
+// configuration of the account and of its domain.
+func (a *Account) JournalPaths() []smtp.Path {
+	conf, _ := a.Conf()
+	var l []smtp.Path
+	if conf.JournalAddress != "" {
+		l = append(l, conf.JournalPath)
+	}
+	dc, ok := mox.Conf.Domain(conf.DNSDomain)
+	if ok && dc.JournalAddress != "" && (len(l) == 0 || !l[0].Equal(dc.JournalPath)) {
+		l = append(l, dc.JournalPath)
+	}
+	return l
+}
+
+// Journal writes a copy of a message, msgPrefix with the contents of msgFile,
+// to the journal directory of the account, if journaling is enabled for the
+// account or its domain. Kind is "received" or "sent", and is part of the file
+// name.
+//
+// Journal files are stored in <DataDir>/accounts/<name>/journal/<yyyy>/<mm>/,
+// are created read-only and are never modified or removed by mox.
+func (a *Account) Journal(log *mlog.Log, kind string, msgPrefix []byte, msgFile *os.File) error {
+	conf, _ := a.Conf()
+	if !conf.Journal {
+		if dc, ok := mox.Conf.Domain(conf.DNSDomain); !ok || !dc.Journal {
+			return nil
+		}
+	}
+
+	now := time.Now()
+	dir := filepath.Join(a.Dir, "journal", now.Format("2006"), now.Format("01"))
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return fmt.Errorf("creating journal directory: %w", err)
+	}
+	f, err := os.CreateTemp(dir, now.Format("20060102T150405")+"-"+kind+"-*.eml")
+	if err != nil {
+		return fmt.Errorf("creating journal file: %w", err)
+	}
+	p := f.Name()
+	defer func() {
+		if f != nil {
+			err := f.Close()
+			log.Check(err, "closing journal file after error")
+			err = os.Remove(p)
+			log.Check(err, "removing partial journal file", mlog.Field("path", p))
+		}
+	}()
+	mr := FileMsgReader(msgPrefix, msgFile) // We don't close, it would close the msgFile.
+	if _, err := io.Copy(f, mr); err != nil {
+		return fmt.Errorf("writing journal file: %w", err)
+	}
+	if err := f.Chmod(0440); err != nil {
+		return fmt.Errorf("making journal file read-only: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("sync journal file: %w", err)
+	}
+	err = f.Close()
+	f = nil
+	if err != nil {
+		return fmt.Errorf("closing journal file: %w", err)
+	}
+	if err := moxio.SyncDir(dir); err != nil {
+		return fmt.Errorf("sync journal directory: %w", err)
+	}
+	log.Debug("message written to journal", mlog.Field("path", p))
+	return nil
+}
@@ -0,0 +1,148 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/smtp"
+)
+
+func TestJournalHold(t *testing.T) {
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = "../testdata/store/mox.conf"
+	mox.MustLoadConfig(true, false)
+	acc, err := OpenAccount("mjl")
+	tcheck(t, err, "open account")
+	defer acc.Close()
+	switchDone := Switchboard()
+	defer close(switchDone)
+
+	log := mlog.New("journal")
+
+	msgFile, err := os.CreateTemp("", "mox-test-journal")
+	tcheck(t, err, "create temp")
+	defer os.Remove(msgFile.Name())
+	defer msgFile.Close()
+	const msg = "Subject: test\r\n\r\ntest\r\n"
+	_, err = msgFile.Write([]byte(msg))
+	tcheck(t, err, "write message")
+
+	journalFiles := func() []string {
+		t.Helper()
+		l, err := filepath.Glob(filepath.Join(acc.Dir, "journal", "*", "*", "*.eml"))
+		tcheck(t, err, "listing journal files")
+		return l
+	}
+
+	// Journaling not enabled, nothing is written.
+	err = acc.Journal(log, "received", []byte("Return-Path: <remote@example.org>\r\n"), msgFile)
+	tcheck(t, err, "journal")
+	if l := journalFiles(); len(l) != 0 {
+		t.Fatalf("got journal files %v, expected none", l)
+	}
+
+	accConf := mox.Conf.Dynamic.Accounts["mjl"]
+	defer func() {
+		mox.Conf.Dynamic.Accounts["mjl"] = accConf
+	}()
+	conf := accConf
+	conf.Journal = true
+	conf.Hold = true
+	mox.Conf.Dynamic.Accounts["mjl"] = conf
+
+	const prefix = "Return-Path: <remote@example.org>\r\n"
+	err = acc.Journal(log, "received", []byte(prefix), msgFile)
+	tcheck(t, err, "journal")
+	l := journalFiles()
+	if len(l) != 1 {
+		t.Fatalf("got journal files %v, expected 1", l)
+	}
+	buf, err := os.ReadFile(l[0])
+	tcheck(t, err, "read journal file")
+	if string(buf) != prefix+msg {
+		t.Fatalf("got journal file %q, expected %q", buf, prefix+msg)
+	}
+	fi, err := os.Stat(l[0])
+	tcheck(t, err, "stat journal file")
+	if fi.Mode().Perm()&0222 != 0 {
+		t.Fatalf("journal file is writable, mode %v", fi.Mode())
+	}
+
+	if !acc.OnHold() {
+		t.Fatalf("account not on hold")
+	}
+	acc.WithWLock(func() {
+		m := Message{Received: time.Now().Add(-time.Hour), Size: int64(len(msg))}
+		err := acc.DeliverMailbox(log, "Inbox", &m, msgFile, false)
+		tcheck(t, err, "deliver")
+
+		_, _, err = acc.RemoveMessagesBefore(log, "Inbox", time.Now(), 0)
+		if !errors.Is(err, ErrHold) {
+			t.Fatalf("remove messages on hold, got err %v, expected ErrHold", err)
+		}
+
+		mox.Conf.Dynamic.Accounts["mjl"] = accConf
+		n, _, err := acc.RemoveMessagesBefore(log, "Inbox", time.Now(), 0)
+		tcheck(t, err, "remove messages")
+		if n != 1 {
+			t.Fatalf("removed %d messages, expected 1", n)
+		}
+	})
+
+	// Journaling and hold through the domain.
+	domConf := mox.Conf.Dynamic.Domains["mox.example"]
+	defer func() {
+		mox.Conf.Dynamic.Domains["mox.example"] = domConf
+	}()
+	dc := domConf
+	dc.Journal = true
+	dc.Hold = true
+	dc.JournalAddress = "journal@archive.example"
+	dc.JournalPath = smtp.Path{Localpart: "journal", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "archive.example"}}}
+	mox.Conf.Dynamic.Domains["mox.example"] = dc
+
+	err = acc.Journal(log, "sent", []byte(prefix), msgFile)
+	tcheck(t, err, "journal")
+	if l := journalFiles(); len(l) != 2 {
+		t.Fatalf("got journal files %v, expected 2", l)
+	}
+	if l := acc.JournalPaths(); len(l) != 1 || !l[0].Equal(dc.JournalPath) {
+		t.Fatalf("got journal paths %v, expected domain journal address", l)
+	}
+	if !acc.OnHold() {
+		t.Fatalf("account not on hold through domain")
+	}
+
+	// Old messages in the rejects mailbox are not removed automatically.
+	acc.WithWLock(func() {
+		m := Message{Received: time.Now().Add(-30 * 24 * time.Hour), Size: int64(len(msg))}
+		err := acc.DeliverMailbox(log, "Rejects", &m, msgFile, false)
+		tcheck(t, err, "deliver to rejects")
+
+		hasSpace, err := acc.TidyRejectsMailbox(log, "Rejects")
+		tcheck(t, err, "tidy rejects")
+		if !hasSpace {
+			t.Fatalf("no space in rejects mailbox")
+		}
+		err = acc.DB.Get(ctxbg, &m)
+		tcheck(t, err, "get rejects message after tidying")
+
+		err = acc.DB.Write(ctxbg, func(tx *bstore.Tx) error {
+			mb, err := acc.MailboxFind(tx, "Rejects")
+			tcheck(t, err, "find rejects mailbox")
+			_, err = acc.removeMessages(ctxbg, log, tx, mb, []Message{m})
+			return err
+		})
+		if !errors.Is(err, ErrHold) {
+			t.Fatalf("removing message on hold, got err %v, expected ErrHold", err)
+		}
+	})
+}
@@ -0,0 +1,97 @@
+package store
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+)
+
+// JunkFlagsMove moves messages from mailbox mbSrc for which a user changed the
+// junk flags, if the account has MoveOnJunkFlags set: Messages that got the $Junk
+// or $Phishing flag are moved to the Junk mailbox, messages in the Junk mailbox
+// that got the $NotJunk flag are moved to the Inbox. The flags of msgs must
+// already be updated in the database, oldFlags has the flags before the update,
+// for each message.
+//
+// The moved messages are returned with their new mailbox and UID, along with
+// their original UIDs and the changes to broadcast. The msgs slice is not
+// modified. Flags of moved messages are kept as set by the user.
+//
+// Caller must hold account wlock.
+func (a *Account) JunkFlagsMove(log *mlog.Log, tx *bstore.Tx, mbSrc Mailbox, msgs []Message, oldFlags []Flags) (moved []Message, origUIDs []UID, changes []Change, rerr error) {
+	conf, _ := a.Conf()
+	if !conf.MoveOnJunkFlags {
+		return nil, nil, nil, nil
+	}
+
+	var l []Message
+	for i, m := range msgs {
+		if !mbSrc.Junk && m.trainsJunk() && !oldFlags[i].trainsJunk() || mbSrc.Junk && m.Notjunk && !m.trainsJunk() && !oldFlags[i].Notjunk {
+			l = append(l, m)
+		}
+	}
+	if len(l) == 0 {
+		return nil, nil, nil, nil
+	}
+
+	var mbDst Mailbox
+	if mbSrc.Junk {
+		mb, err := a.MailboxFind(tx, "Inbox")
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("looking up inbox: %w", err)
+		} else if mb == nil {
+			return nil, nil, nil, fmt.Errorf("inbox not found")
+		}
+		mbDst = *mb
+	} else {
+		mb, err := bstore.QueryTx[Mailbox](tx).FilterEqual("Junk", true).Limit(1).Get()
+		if err == bstore.ErrAbsent {
+			log.Info("no junk mailbox to move messages marked as junk to")
+			return nil, nil, nil, nil
+		} else if err != nil {
+			return nil, nil, nil, fmt.Errorf("looking up junk mailbox: %w", err)
+		}
+		mbDst = mb
+	}
+
+	modseq, err := a.NextModSeq(tx)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("assigning modseq: %w", err)
+	}
+	if err := MailboxCountsRemove(tx, l...); err != nil {
+		return nil, nil, nil, err
+	}
+	changes = []Change{ChangeRemoveUIDs{mbSrc.ID, nil, modseq}}
+	now := time.Now()
+	for _, m := range l {
+		origUIDs = append(origUIDs, m.UID)
+		m.MailboxID = mbDst.ID
+		m.SaveDate = now
+		if mbSrc.Name == conf.RejectsMailbox && m.MailboxDestinedID != 0 {
+			// As with moves by users, see the IMAP MOVE command.
+			m.MailboxOrigID = m.MailboxDestinedID
+		}
+		m.UID = mbDst.UIDNext
+		mbDst.UIDNext++
+		m.ModSeq = modseq
+		if err := tx.Update(&m); err != nil {
+			return nil, nil, nil, fmt.Errorf("updating moved message: %w", err)
+		}
+		moved = append(moved, m)
+		changes = append(changes, ChangeAddUID{mbDst.ID, m.UID, m.ModSeq, m.Flags, m.Keywords})
+	}
+	if err := tx.Update(&mbDst); err != nil {
+		return nil, nil, nil, fmt.Errorf("updating destination mailbox uidnext: %w", err)
+	}
+	if err := MailboxCountsAdd(tx, moved...); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := a.RecordExpunged(tx, mbSrc.ID, origUIDs, modseq); err != nil {
+		return nil, nil, nil, fmt.Errorf("recording expunged messages: %w", err)
+	}
+	changes[0] = ChangeRemoveUIDs{mbSrc.ID, origUIDs, modseq}
+	return moved, origUIDs, changes, nil
+}
@@ -0,0 +1,223 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mjl-/bstore"
+	"golang.org/x/exp/slices"
+)
+
+// ErrLabelInvalid is returned for a label name that is not a valid keyword.
+var ErrLabelInvalid = errors.New("invalid label, must be a keyword without spaces or special characters like parenthesis, braces and quotes")
+
+// Label is a label for messages, independent of the mailbox they are in. Labels
+// are stored as keywords of messages, so IMAP clients that support keywords can
+// see and change them. A Label record holds the display settings, keywords in use
+// on messages without a record are labels too.
+type Label struct {
+	ID    int64
+	Name  string `bstore:"nonzero,unique"` // Keyword, lower case.
+	Color string // CSS color for display, e.g. "#8bc8ff". Empty for the default color.
+}
+
+// LabelNormalize returns name as lower-case keyword, or ErrLabelInvalid.
+func LabelNormalize(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if !ValidLowercaseKeyword(name) {
+		return "", ErrLabelInvalid
+	}
+	return name, nil
+}
+
+// Labels returns the labels of the account: those with a Label record, and
+// keywords used in its mailboxes. Labels are sorted by name, those without record
+// have a zero ID.
+func (a *Account) Labels(ctx context.Context) ([]Label, error) {
+	var labels []Label
+	err := a.DB.Read(ctx, func(tx *bstore.Tx) error {
+		var err error
+		labels, err = bstore.QueryTx[Label](tx).List()
+		if err != nil {
+			return fmt.Errorf("listing labels: %w", err)
+		}
+		known := map[string]bool{}
+		for _, l := range labels {
+			known[l.Name] = true
+		}
+		return bstore.QueryTx[Mailbox](tx).ForEach(func(mb Mailbox) error {
+			for _, kw := range mb.Keywords {
+				if !known[kw] {
+					known[kw] = true
+					labels = append(labels, Label{Name: kw})
+				}
+			}
+			return nil
+		})
+	})
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+	return labels, err
+}
+
+// LabelSave adds or updates the label with the name of l.
+func (a *Account) LabelSave(ctx context.Context, l Label) (Label, error) {
+	name, err := LabelNormalize(l.Name)
+	if err != nil {
+		return Label{}, err
+	}
+	l.Name = name
+	err = a.DB.Write(ctx, func(tx *bstore.Tx) error {
+		ol, err := bstore.QueryTx[Label](tx).FilterNonzero(Label{Name: l.Name}).Get()
+		if err == bstore.ErrAbsent {
+			l.ID = 0
+			return tx.Insert(&l)
+		} else if err != nil {
+			return fmt.Errorf("looking up label: %w", err)
+		}
+		l.ID = ol.ID
+		return tx.Update(&l)
+	})
+	return l, err
+}
+
+// LabelRemove removes a label: its record, and the keyword from all messages
+// and mailboxes.
+//
+// Changes are broadcasted.
+func (a *Account) LabelRemove(ctx context.Context, name string) error {
+	name, err := LabelNormalize(name)
+	if err != nil {
+		return err
+	}
+
+	var changes []Change
+	a.WithWLock(func() {
+		err = a.DB.Write(ctx, func(tx *bstore.Tx) error {
+			if _, err := bstore.QueryTx[Label](tx).FilterNonzero(Label{Name: name}).Delete(); err != nil {
+				return fmt.Errorf("removing label: %w", err)
+			}
+
+			msgs, err := bstore.QueryTx[Message](tx).FilterIn("Keywords", name).List()
+			if err != nil {
+				return fmt.Errorf("listing messages with label: %w", err)
+			}
+			for _, m := range msgs {
+				m.Keywords = RemoveKeywords(m.Keywords, []string{name})
+				m.ModSeq, err = a.NextModSeq(tx)
+				if err != nil {
+					return fmt.Errorf("assigning modseq: %w", err)
+				}
+				if err := tx.Update(&m); err != nil {
+					return fmt.Errorf("updating message keywords: %w", err)
+				}
+				changes = append(changes, ChangeFlags{MailboxID: m.MailboxID, UID: m.UID, ModSeq: m.ModSeq, Mask: Flags{}, Flags: m.Flags, Keywords: m.Keywords})
+			}
+
+			return bstore.QueryTx[Mailbox](tx).ForEach(func(mb Mailbox) error {
+				if slices.Index(mb.Keywords, name) < 0 {
+					return nil
+				}
+				mb.Keywords = RemoveKeywords(mb.Keywords, []string{name})
+				if err := tx.Update(&mb); err != nil {
+					return fmt.Errorf("updating mailbox keywords: %w", err)
+				}
+				return nil
+			})
+		})
+		if err == nil {
+			comm := RegisterComm(a)
+			defer comm.Unregister()
+			comm.Broadcast(changes)
+		}
+	})
+	return err
+}
+
+// LabelMessages returns the messages with the label, in all mailboxes, most
+// recently received first. This is a view on the account like a mailbox, but
+// based on labels.
+func (a *Account) LabelMessages(tx *bstore.Tx, name string) ([]Message, error) {
+	name, err := LabelNormalize(name)
+	if err != nil {
+		return nil, err
+	}
+	q := bstore.QueryTx[Message](tx)
+	q.FilterIn("Keywords", name)
+	q.SortDesc("Received")
+	return q.List()
+}
+
+// MessageLabelsChange adds and removes labels of a message. Labels are added to
+// the keywords of the mailbox of the message if needed.
+//
+// Changes are broadcasted.
+func (a *Account) MessageLabelsChange(ctx context.Context, messageID int64, add, remove []string) error {
+	normalize := func(l []string) ([]string, error) {
+		var r []string
+		for _, s := range l {
+			name, err := LabelNormalize(s)
+			if err != nil {
+				return nil, err
+			}
+			r = append(r, name)
+		}
+		return r, nil
+	}
+	add, err := normalize(add)
+	if err != nil {
+		return err
+	}
+	remove, err = normalize(remove)
+	if err != nil {
+		return err
+	}
+
+	var changes []Change
+	a.WithWLock(func() {
+		err = a.DB.Write(ctx, func(tx *bstore.Tx) error {
+			m := Message{ID: messageID}
+			if err := tx.Get(&m); err != nil {
+				return err
+			}
+			orig := append([]string{}, m.Keywords...)
+			m.Keywords = RemoveKeywords(m.Keywords, remove)
+			m.Keywords, _ = MergeKeywords(m.Keywords, add)
+			if slices.Equal(orig, m.Keywords) {
+				return nil
+			}
+			var err error
+			m.ModSeq, err = a.NextModSeq(tx)
+			if err != nil {
+				return fmt.Errorf("assigning modseq: %w", err)
+			}
+			if err := tx.Update(&m); err != nil {
+				return fmt.Errorf("updating message keywords: %w", err)
+			}
+			changes = append(changes, ChangeFlags{MailboxID: m.MailboxID, UID: m.UID, ModSeq: m.ModSeq, Mask: Flags{}, Flags: m.Flags, Keywords: m.Keywords})
+
+			mb := Mailbox{ID: m.MailboxID}
+			if err := tx.Get(&mb); err != nil {
+				return fmt.Errorf("get mailbox: %w", err)
+			}
+			var changed bool
+			mb.Keywords, changed = MergeKeywords(mb.Keywords, add)
+			if changed {
+				if err := tx.Update(&mb); err != nil {
+					return fmt.Errorf("updating mailbox keywords: %w", err)
+				}
+			}
+			return nil
+		})
+		if err == nil {
+			comm := RegisterComm(a)
+			defer comm.Unregister()
+			comm.Broadcast(changes)
+		}
+	})
+	return err
+}
@@ -0,0 +1,125 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestLabels(t *testing.T) {
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = "../testdata/store/mox.conf"
+	mox.ConfigDynamicPath = filepath.Join(filepath.Dir(mox.ConfigStaticPath), "domains.conf")
+	mox.MustLoadConfig(true, false)
+	acc, err := OpenAccount("mjl")
+	tcheck(t, err, "open account")
+	defer acc.Close()
+	switchDone := Switchboard()
+	defer close(switchDone)
+
+	log := mlog.New("label")
+
+	deliver := func(mailbox string) Message {
+		t.Helper()
+		msg := "Subject: test\r\n\r\ntest\r\n"
+		msgFile, err := CreateMessageTemp("label")
+		tcheck(t, err, "create temp")
+		defer os.Remove(msgFile.Name())
+		defer msgFile.Close()
+		_, err = msgFile.Write([]byte(msg))
+		tcheck(t, err, "write message")
+		m := Message{Size: int64(len(msg))}
+		acc.WithWLock(func() {
+			err = acc.DeliverMailbox(log, mailbox, &m, msgFile, false)
+		})
+		tcheck(t, err, "deliver")
+		return m
+	}
+	m0 := deliver("Inbox")
+	m1 := deliver("Archive")
+
+	labelNames := func() []string {
+		t.Helper()
+		l, err := acc.Labels(ctxbg)
+		tcheck(t, err, "list labels")
+		var names []string
+		for _, label := range l {
+			names = append(names, label.Name)
+		}
+		return names
+	}
+
+	keywords := func(id int64) []string {
+		t.Helper()
+		m := Message{ID: id}
+		err := acc.DB.Get(ctxbg, &m)
+		tcheck(t, err, "get message")
+		return m.Keywords
+	}
+
+	labelMessages := func(name string) []int64 {
+		t.Helper()
+		var ids []int64
+		err := acc.DB.Read(ctxbg, func(tx *bstore.Tx) error {
+			msgs, err := acc.LabelMessages(tx, name)
+			for _, m := range msgs {
+				ids = append(ids, m.ID)
+			}
+			return err
+		})
+		tcheck(t, err, "label messages")
+		return ids
+	}
+
+	_, err = acc.LabelSave(ctxbg, Label{Name: "Work", Color: "#ff0000"})
+	tcheck(t, err, "save label")
+	if _, err := acc.LabelSave(ctxbg, Label{Name: "bad label"}); !errors.Is(err, ErrLabelInvalid) {
+		t.Fatalf("saving invalid label, got err %v, expected ErrLabelInvalid", err)
+	}
+	l, err := acc.LabelSave(ctxbg, Label{Name: "work", Color: "#00ff00"})
+	tcheck(t, err, "update label")
+	if l.ID == 0 || l.Color != "#00ff00" {
+		t.Fatalf("updated label %#v, expected existing label with new color", l)
+	}
+
+	err = acc.MessageLabelsChange(ctxbg, m0.ID, []string{"Work", "todo"}, nil)
+	tcheck(t, err, "add labels")
+	err = acc.MessageLabelsChange(ctxbg, m1.ID, []string{"work"}, nil)
+	tcheck(t, err, "add labels")
+	if kw := keywords(m0.ID); !reflect.DeepEqual(kw, []string{"work", "todo"}) {
+		t.Fatalf("got keywords %v, expected work and todo", kw)
+	}
+	if names := labelNames(); !reflect.DeepEqual(names, []string{"todo", "work"}) {
+		t.Fatalf("got labels %v, expected todo and work", names)
+	}
+	if ids := labelMessages("work"); !reflect.DeepEqual(ids, []int64{m1.ID, m0.ID}) {
+		t.Fatalf("got messages %v for label, expected %d and %d", ids, m1.ID, m0.ID)
+	}
+
+	err = acc.MessageLabelsChange(ctxbg, m0.ID, nil, []string{"todo"})
+	tcheck(t, err, "remove label")
+	if kw := keywords(m0.ID); !reflect.DeepEqual(kw, []string{"work"}) {
+		t.Fatalf("got keywords %v, expected work", kw)
+	}
+
+	err = acc.LabelRemove(ctxbg, "work")
+	tcheck(t, err, "remove label")
+	if ids := labelMessages("work"); len(ids) != 0 {
+		t.Fatalf("got messages %v for removed label, expected none", ids)
+	}
+	if kw := keywords(m1.ID); len(kw) != 0 {
+		t.Fatalf("got keywords %v after removing label, expected none", kw)
+	}
+
+	err = acc.MessageLabelsChange(ctxbg, 999, []string{"work"}, nil)
+	if !errors.Is(err, bstore.ErrAbsent) {
+		t.Fatalf("changing labels of unknown message, got err %v, expected ErrAbsent", err)
+	}
+}
@@ -0,0 +1,114 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+// ErrAccountSuspended is returned when authenticating for an account that is
+// suspended or pending deletion.
+var ErrAccountSuspended = errors.New("account is suspended")
+
+var errAccountInUse = errors.New("account is in use")
+
+// Suspended returns whether the account is suspended or pending deletion, in
+// which case authentication must be rejected.
+func (a *Account) Suspended() bool {
+	conf, _ := a.Conf()
+	return conf.Suspended || !conf.DeleteAtTime.IsZero()
+}
+
+// DeliveryTempfail returns whether incoming messages for the account must be
+// rejected with a temporary error, for suspended accounts configured with
+// SuspendedTempfail.
+func (a *Account) DeliveryTempfail() bool {
+	conf, _ := a.Conf()
+	return conf.SuspendedTempfail && (conf.Suspended || !conf.DeleteAtTime.IsZero())
+}
+
+// StartAccountPurger starts a goroutine that removes accounts for which the
+// scheduled deletion time has passed, every hour.
+func StartAccountPurger() {
+	go func() {
+		t := time.NewTimer(time.Hour)
+		defer t.Stop()
+		for {
+			select {
+			case <-mox.Shutdown.Done():
+				return
+			case <-t.C:
+			}
+			purgeAccounts(time.Now())
+			t.Reset(time.Hour)
+		}
+	}()
+}
+
+func purgeAccounts(now time.Time) {
+	log := xlog.WithCid(mox.Cid())
+	for _, accName := range mox.Conf.Accounts() {
+		alog := log.Fields(mlog.Field("account", accName))
+		conf, ok := mox.Conf.Account(accName)
+		if !ok || conf.DeleteAtTime.IsZero() || conf.DeleteAtTime.After(now) {
+			continue
+		}
+		if AccountOnHold(conf) {
+			alog.Info("not removing account pending deletion that is on hold")
+			continue
+		}
+		err := purgeAccount(mox.Context, alog, accName)
+		if errors.Is(err, errAccountInUse) {
+			alog.Info("account pending deletion still in use, postponing removal")
+		} else if err != nil {
+			alog.Errorx("removing account pending deletion", err)
+		} else {
+			alog.Info("account pending deletion removed")
+		}
+	}
+}
+
+// purgeAccount removes the account from the configuration, and its data
+// directory. The journal directory of the account is kept. Fails with
+// errAccountInUse if the account is open.
+func purgeAccount(ctx context.Context, log *mlog.Log, accName string) error {
+	// We hold the lock while removing, so the account can't be opened in the mean time.
+	openAccounts.Lock()
+	defer openAccounts.Unlock()
+	if _, ok := openAccounts.names[accName]; ok {
+		return errAccountInUse
+	}
+
+	if err := mox.AccountRemove(ctx, accName); err != nil {
+		return fmt.Errorf("removing account from configuration: %w", err)
+	}
+
+	dir := filepath.Join(mox.DataDirPath("accounts"), accName)
+	entries, err := os.ReadDir(dir)
+	if err != nil && os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("reading account directory: %w", err)
+	}
+	var keep bool
+	for _, e := range entries {
+		if e.Name() == "journal" {
+			keep = true
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return fmt.Errorf("removing account data: %w", err)
+		}
+	}
+	if !keep {
+		err := os.Remove(dir)
+		log.Check(err, "removing account directory")
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestAccountLifecycle(t *testing.T) {
+	os.RemoveAll("../testdata/store/data")
+	err := os.MkdirAll("../testdata/store/data", 0770)
+	tcheck(t, err, "mkdir")
+	buf, err := os.ReadFile("../testdata/store/domains.conf")
+	tcheck(t, err, "read domains.conf")
+	// Account changes write the dynamic config file, work on a copy.
+	err = os.WriteFile("../testdata/store/data/domains.conf", buf, 0660)
+	tcheck(t, err, "write domains.conf")
+	mox.ConfigStaticPath = "../testdata/store/mox.conf"
+	mox.ConfigDynamicPath = "../testdata/store/data/domains.conf"
+	mox.MustLoadConfig(true, false)
+
+	err = mox.AccountAdd(ctxbg, "gone", "gone@mox.example")
+	tcheck(t, err, "add account")
+	acc, err := OpenAccount("gone")
+	tcheck(t, err, "open account")
+	err = acc.SetPassword("testtest")
+	tcheck(t, err, "set password")
+
+	err = mox.AccountSuspendSave(ctxbg, "gone", true, true)
+	tcheck(t, err, "suspend account")
+	if !acc.Suspended() || !acc.DeliveryTempfail() {
+		t.Fatalf("account not suspended")
+	}
+	if _, err := OpenEmailAuth("gone@mox.example", "bogus"); !errors.Is(err, ErrUnknownCredentials) {
+		t.Fatalf("got err %v, expected ErrUnknownCredentials", err)
+	}
+	if _, err := OpenEmailAuth("gone@mox.example", "testtest"); !errors.Is(err, ErrAccountSuspended) {
+		t.Fatalf("got err %v, expected ErrAccountSuspended", err)
+	}
+
+	err = mox.AccountSuspendSave(ctxbg, "gone", false, false)
+	tcheck(t, err, "unsuspend account")
+	acc2, err := OpenEmailAuth("gone@mox.example", "testtest")
+	tcheck(t, err, "auth after unsuspend")
+	err = acc2.Close()
+	tcheck(t, err, "close account")
+
+	// Pending deletion is treated as suspended.
+	err = mox.AccountDeletionSchedule(ctxbg, "gone", time.Now().Add(-time.Minute))
+	tcheck(t, err, "schedule deletion")
+	if !acc.Suspended() || acc.DeliveryTempfail() {
+		t.Fatalf("account pending deletion not suspended, or tempfailing")
+	}
+
+	// Not removed while in use.
+	purgeAccounts(time.Now())
+	if _, ok := mox.Conf.Account("gone"); !ok {
+		t.Fatalf("account in use was removed")
+	}
+	journalDir := filepath.Join(acc.Dir, "journal")
+	err = os.MkdirAll(journalDir, 0770)
+	tcheck(t, err, "mkdir journal")
+	dir := acc.Dir
+	err = acc.Close()
+	tcheck(t, err, "close account")
+
+	// Not removed while on hold.
+	ac := mox.Conf.Dynamic.Accounts["gone"]
+	ac.Hold = true
+	mox.Conf.Dynamic.Accounts["gone"] = ac
+	purgeAccounts(time.Now())
+	if _, ok := mox.Conf.Account("gone"); !ok {
+		t.Fatalf("account on hold was removed")
+	}
+	if err := mox.AccountRemove(ctxbg, "gone"); err == nil {
+		t.Fatalf("admin removed account on hold")
+	}
+	ac.Hold = false
+	mox.Conf.Dynamic.Accounts["gone"] = ac
+
+	// Also not through a hold of the domain.
+	dc := mox.Conf.Dynamic.Domains["mox.example"]
+	dc.Hold = true
+	mox.Conf.Dynamic.Domains["mox.example"] = dc
+	if err := mox.AccountRemove(ctxbg, "gone"); err == nil {
+		t.Fatalf("admin removed account in domain on hold")
+	}
+	purgeAccounts(time.Now())
+	if _, ok := mox.Conf.Account("gone"); !ok {
+		t.Fatalf("account in domain on hold was removed")
+	}
+	dc.Hold = false
+	mox.Conf.Dynamic.Domains["mox.example"] = dc
+
+	purgeAccounts(time.Now())
+	if _, ok := mox.Conf.Account("gone"); ok {
+		t.Fatalf("account pending deletion not removed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "index.db")); err == nil {
+		t.Fatalf("account database not removed")
+	}
+	if _, err := os.Stat(journalDir); err != nil {
+		t.Fatalf("journal directory removed: %v", err)
+	}
+}
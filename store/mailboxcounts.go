@@ -0,0 +1,195 @@
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+)
+
+// MailboxCounts are the number and size of messages in a mailbox, in total and
+// by flags. They are kept up to date when messages are added, removed, moved or
+// their flags change, so IMAP STATUS can be answered without going through all
+// messages of a mailbox. A mailbox without MailboxCounts has no messages yet.
+type MailboxCounts struct {
+	ID          int64 // Of Mailbox.
+	Messages    int64 // Including messages with \Deleted.
+	Unseen      int64
+	Deleted     int64
+	Size        int64 // Of all messages.
+	DeletedSize int64 // Of messages with \Deleted.
+}
+
+// messageCounts returns the contribution of m to the counts of its mailbox.
+func messageCounts(m Message) MailboxCounts {
+	mc := MailboxCounts{ID: m.MailboxID, Messages: 1, Size: m.Size}
+	if !m.Seen {
+		mc.Unseen = 1
+	}
+	if m.Deleted {
+		mc.Deleted = 1
+		mc.DeletedSize = m.Size
+	}
+	return mc
+}
+
+func (mc *MailboxCounts) add(o MailboxCounts, sign int64) {
+	mc.Messages += sign * o.Messages
+	mc.Unseen += sign * o.Unseen
+	mc.Deleted += sign * o.Deleted
+	mc.Size += sign * o.Size
+	mc.DeletedSize += sign * o.DeletedSize
+}
+
+// mailboxCountsEnsure adds the MailboxCounts for mailboxes that don't have them
+// yet, e.g. after upgrading, by going through their messages once.
+func mailboxCountsEnsure(ctx context.Context, db *bstore.DB) error {
+	return db.Write(ctx, func(tx *bstore.Tx) error {
+		mailboxes, err := bstore.QueryTx[Mailbox](tx).List()
+		if err != nil {
+			return fmt.Errorf("listing mailboxes: %w", err)
+		}
+		for _, mb := range mailboxes {
+			mc := MailboxCounts{ID: mb.ID}
+			if err := tx.Get(&mc); err == nil {
+				continue
+			} else if err != bstore.ErrAbsent {
+				return fmt.Errorf("get mailbox counts: %w", err)
+			}
+			mc, err = MailboxCountsCalculate(tx, mb.ID)
+			if err != nil {
+				return err
+			}
+			if err := tx.Insert(&mc); err != nil {
+				return fmt.Errorf("inserting mailbox counts: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// MailboxCountsGet returns the counts of the messages in a mailbox.
+func MailboxCountsGet(tx *bstore.Tx, mailboxID int64) (MailboxCounts, error) {
+	mc := MailboxCounts{ID: mailboxID}
+	if err := tx.Get(&mc); err != nil && err != bstore.ErrAbsent {
+		return MailboxCounts{}, fmt.Errorf("get mailbox counts: %w", err)
+	}
+	return mc, nil
+}
+
+// MailboxCountsCalculate returns the counts of a mailbox by going through all
+// its messages, ignoring the stored counts.
+func MailboxCountsCalculate(tx *bstore.Tx, mailboxID int64) (MailboxCounts, error) {
+	mc := MailboxCounts{ID: mailboxID}
+	q := bstore.QueryTx[Message](tx)
+	q.FilterNonzero(Message{MailboxID: mailboxID})
+	err := q.ForEach(func(m Message) error {
+		mc.add(messageCounts(m), 1)
+		return nil
+	})
+	if err != nil {
+		return MailboxCounts{}, fmt.Errorf("counting messages in mailbox: %w", err)
+	}
+	return mc, nil
+}
+
+// mailboxCountsChange applies the counts of msgs to their mailboxes, adding for
+// sign 1, subtracting for sign -1.
+func mailboxCountsChange(tx *bstore.Tx, sign int64, msgs []Message) error {
+	deltas := map[int64]MailboxCounts{}
+	for _, m := range msgs {
+		d := deltas[m.MailboxID]
+		d.add(messageCounts(m), 1)
+		deltas[m.MailboxID] = d
+	}
+	for mbID, d := range deltas {
+		mc := MailboxCounts{ID: mbID}
+		err := tx.Get(&mc)
+		if err != nil && err != bstore.ErrAbsent {
+			return fmt.Errorf("get mailbox counts: %w", err)
+		}
+		mc.add(d, sign)
+		if err == bstore.ErrAbsent {
+			err = tx.Insert(&mc)
+		} else {
+			err = tx.Update(&mc)
+		}
+		if err != nil {
+			return fmt.Errorf("updating mailbox counts: %w", err)
+		}
+	}
+	return nil
+}
+
+// MailboxCountsAdd adds messages to the counts of their mailboxes. Must be
+// called in the same transaction that adds the messages or moves them into the
+// mailboxes, with their new mailbox and flags.
+func MailboxCountsAdd(tx *bstore.Tx, msgs ...Message) error {
+	return mailboxCountsChange(tx, 1, msgs)
+}
+
+// MailboxCountsRemove removes messages from the counts of their mailboxes. Must
+// be called in the same transaction that removes the messages or moves them out
+// of the mailboxes, with their old mailbox and flags.
+func MailboxCountsRemove(tx *bstore.Tx, msgs ...Message) error {
+	return mailboxCountsChange(tx, -1, msgs)
+}
+
+// MailboxCountsUpdate updates the counts for a message that changed, such as
+// its flags, with om the message before the change.
+func MailboxCountsUpdate(tx *bstore.Tx, om, m Message) error {
+	if messageCounts(om) == messageCounts(m) {
+		return nil
+	}
+	if err := MailboxCountsRemove(tx, om); err != nil {
+		return err
+	}
+	return MailboxCountsAdd(tx, m)
+}
+
+// MailboxCountsRemoveMailbox removes the counts of a mailbox that is removed.
+func MailboxCountsRemoveMailbox(tx *bstore.Tx, mailboxID int64) error {
+	if err := tx.Delete(&MailboxCounts{ID: mailboxID}); err != nil && err != bstore.ErrAbsent {
+		return fmt.Errorf("removing mailbox counts: %w", err)
+	}
+	return nil
+}
+
+// MailboxCountsRecalculate calculates the counts of all mailboxes of the
+// account by going through their messages, and fixes the stored counts that
+// are different. The number of fixed mailboxes is returned. Stored counts should
+// always be correct, this is for verification and recovery from bugs.
+func (a *Account) MailboxCountsRecalculate(ctx context.Context, log *mlog.Log) (int, error) {
+	var fixed int
+	err := a.DB.Write(ctx, func(tx *bstore.Tx) error {
+		mailboxes, err := bstore.QueryTx[Mailbox](tx).List()
+		if err != nil {
+			return fmt.Errorf("listing mailboxes: %w", err)
+		}
+		for _, mb := range mailboxes {
+			stored, err := MailboxCountsGet(tx, mb.ID)
+			if err != nil {
+				return err
+			}
+			mc, err := MailboxCountsCalculate(tx, mb.ID)
+			if err != nil {
+				return err
+			}
+			if mc == stored {
+				continue
+			}
+			log.Info("fixing mailbox counts", mlog.Field("mailbox", mb.Name), mlog.Field("stored", stored), mlog.Field("calculated", mc))
+			fixed++
+			if err := tx.Delete(&MailboxCounts{ID: mb.ID}); err != nil && err != bstore.ErrAbsent {
+				return fmt.Errorf("removing old mailbox counts: %w", err)
+			}
+			if err := tx.Insert(&mc); err != nil {
+				return fmt.Errorf("inserting mailbox counts: %w", err)
+			}
+		}
+		return nil
+	})
+	return fixed, err
+}
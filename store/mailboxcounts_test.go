@@ -0,0 +1,107 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestMailboxCounts(t *testing.T) {
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = "../testdata/store/mox.conf"
+	mox.ConfigDynamicPath = filepath.Join(filepath.Dir(mox.ConfigStaticPath), "domains.conf")
+	mox.MustLoadConfig(true, false)
+	acc, err := OpenAccount("mjl")
+	tcheck(t, err, "open account")
+	defer func() {
+		if acc != nil {
+			acc.Close()
+		}
+	}()
+	switchDone := Switchboard()
+	defer close(switchDone)
+
+	log := mlog.New("mailboxcounts")
+
+	deliver := func(flags Flags) Message {
+		t.Helper()
+		msg := "Subject: test\r\n\r\ntest\r\n"
+		msgFile, err := CreateMessageTemp("mailboxcounts")
+		tcheck(t, err, "create temp")
+		defer os.Remove(msgFile.Name())
+		defer msgFile.Close()
+		_, err = msgFile.Write([]byte(msg))
+		tcheck(t, err, "write message")
+		m := Message{Size: int64(len(msg)), Flags: flags}
+		acc.WithWLock(func() {
+			err = acc.DeliverMailbox(log, "Inbox", &m, msgFile, false)
+		})
+		tcheck(t, err, "deliver")
+		return m
+	}
+	m0 := deliver(Flags{})
+	deliver(Flags{Seen: true})
+	deliver(Flags{Seen: true, Deleted: true})
+	size := m0.Size
+
+	counts := func() (mc MailboxCounts) {
+		t.Helper()
+		err := acc.DB.Read(ctxbg, func(tx *bstore.Tx) error {
+			var err error
+			mc, err = MailboxCountsGet(tx, m0.MailboxID)
+			return err
+		})
+		tcheck(t, err, "get mailbox counts")
+		return
+	}
+	exp := MailboxCounts{m0.MailboxID, 3, 1, 1, 3 * size, size}
+	if mc := counts(); mc != exp {
+		t.Fatalf("got counts %#v, expected %#v", mc, exp)
+	}
+
+	// Removing the message updates the counts.
+	acc.WithWLock(func() {
+		err = acc.DB.Write(ctxbg, func(tx *bstore.Tx) error {
+			_, err := acc.removeMessages(ctxbg, log, tx, &Mailbox{ID: m0.MailboxID}, []Message{m0})
+			return err
+		})
+	})
+	tcheck(t, err, "remove message")
+	exp = MailboxCounts{m0.MailboxID, 2, 0, 1, 2 * size, size}
+	if mc := counts(); mc != exp {
+		t.Fatalf("got counts %#v, expected %#v", mc, exp)
+	}
+
+	// Wrong counts are fixed by recalculating.
+	err = acc.DB.Write(ctxbg, func(tx *bstore.Tx) error {
+		return tx.Update(&MailboxCounts{ID: m0.MailboxID, Messages: 10})
+	})
+	tcheck(t, err, "break mailbox counts")
+	n, err := acc.MailboxCountsRecalculate(ctxbg, log)
+	tcheck(t, err, "recalculate mailbox counts")
+	if n != 1 {
+		t.Fatalf("recalculate fixed %d mailboxes, expected 1", n)
+	}
+	if mc := counts(); mc != exp {
+		t.Fatalf("got counts %#v, expected %#v", mc, exp)
+	}
+
+	// Missing counts, e.g. after upgrading, are calculated when opening the account.
+	err = acc.DB.Write(ctxbg, func(tx *bstore.Tx) error {
+		return tx.Delete(&MailboxCounts{ID: m0.MailboxID})
+	})
+	tcheck(t, err, "remove mailbox counts")
+	err = acc.Close()
+	tcheck(t, err, "close account")
+	acc = nil
+	acc, err = OpenAccount("mjl")
+	tcheck(t, err, "open account")
+	if mc := counts(); mc != exp {
+		t.Fatalf("got counts %#v after opening account, expected %#v", mc, exp)
+	}
+}
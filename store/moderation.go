@@ -0,0 +1,345 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/maps"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+// ModerationMailbox is the mailbox incoming messages for moderated addresses are
+// delivered to, until a moderator approves or rejects them.
+const ModerationMailbox = "Moderation"
+
+var (
+	ErrModerationUnknown    = errors.New("no such message pending moderation")
+	ErrModerationNotAllowed = errors.New("not a moderator for this message")
+)
+
+// ModerationMessage is a message held for moderation, as shown to a moderator.
+type ModerationMessage struct {
+	Account  string // Account holding the message.
+	ID       int64  // ID of the message in the account.
+	Address  string // Recipient address that is moderated.
+	Received time.Time
+	MailFrom string
+	MsgFrom  string
+	Subject  string
+	Size     int64
+}
+
+// isModerator returns whether moderator is in moderators.
+func isModerator(moderators []string, moderator string) bool {
+	for _, mod := range moderators {
+		if mod == moderator {
+			return true
+		}
+	}
+	return false
+}
+
+// moderationAddress returns the recipient address of a held message, if the
+// address still delivers to the account and moderator is one of its moderators.
+func (a *Account) moderationAddress(m Message, moderator string) (string, bool) {
+	if m.RcptToDomain == "" {
+		return "", false
+	}
+	rcptDomain, err := dns.ParseDomain(m.RcptToDomain)
+	if err != nil {
+		return "", false
+	}
+	accName, addr, dest, err := mox.FindAccount(m.RcptToLocalpart, rcptDomain, false)
+	if err != nil || accName != a.Name || !isModerator(dest.Moderators, moderator) {
+		return "", false
+	}
+	return addr, true
+}
+
+// ModerationPending returns the messages held for moderation at addresses that
+// moderator moderates, sorted by time of receipt.
+func ModerationPending(ctx context.Context, log *mlog.Log, moderator string) ([]ModerationMessage, error) {
+	var l []ModerationMessage
+	for _, accName := range mox.Conf.Accounts() {
+		accConf, ok := mox.Conf.Account(accName)
+		if !ok {
+			continue
+		}
+		var moderated bool
+		for _, dest := range accConf.Destinations {
+			moderated = moderated || isModerator(dest.Moderators, moderator)
+		}
+		if !moderated {
+			continue
+		}
+
+		acc, err := OpenAccount(accName)
+		if err != nil {
+			return nil, fmt.Errorf("open account: %w", err)
+		}
+		err = acc.DB.Read(ctx, func(tx *bstore.Tx) error {
+			mb, err := acc.MailboxFind(tx, ModerationMailbox)
+			if err != nil || mb == nil {
+				return err
+			}
+			q := bstore.QueryTx[Message](tx)
+			q.FilterNonzero(Message{MailboxID: mb.ID})
+			return q.ForEach(func(m Message) error {
+				addr, ok := acc.moderationAddress(m, moderator)
+				if !ok {
+					return nil
+				}
+				mm := ModerationMessage{acc.Name, m.ID, addr, m.Received, m.MailFrom, msgFromAddress(m), "", m.Size}
+				if p, err := m.LoadPart(acc.MessageReader(m)); err != nil {
+					log.Infox("parsing message for subject", err, mlog.Field("account", acc.Name), mlog.Field("msgid", m.ID))
+				} else if p.Envelope != nil {
+					mm.Subject = p.Envelope.Subject
+				}
+				l = append(l, mm)
+				return nil
+			})
+		})
+		xerr := acc.Close()
+		log.Check(xerr, "closing account")
+		if err != nil {
+			return nil, fmt.Errorf("listing messages pending moderation: %w", err)
+		}
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Received.Before(l[j].Received)
+	})
+	return l, nil
+}
+
+// ModerationDecide approves or rejects message msgID of account accountName,
+// held for moderation. An approved message is moved to the mailbox it would have
+// been delivered to without moderation, according to the destination of the
+// recipient address. A rejected message is removed. Moderator must be one of the
+// moderators of the recipient address.
+//
+// Changes are broadcasted.
+func ModerationDecide(ctx context.Context, log *mlog.Log, moderator, accountName string, msgID int64, approve bool) (rerr error) {
+	acc, err := OpenAccount(accountName)
+	if err != nil {
+		return fmt.Errorf("open account: %w", err)
+	}
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+
+	acc.WithWLock(func() {
+		if !approve && acc.OnHold() {
+			rerr = ErrHold
+			return
+		}
+
+		var changes []Change
+		var remove *Message
+		err := acc.DB.Write(ctx, func(tx *bstore.Tx) error {
+			mb, err := acc.MailboxFind(tx, ModerationMailbox)
+			if err != nil {
+				return fmt.Errorf("finding moderation mailbox: %w", err)
+			} else if mb == nil {
+				return ErrModerationUnknown
+			}
+			m := Message{ID: msgID}
+			if err := tx.Get(&m); err == bstore.ErrAbsent || err == nil && m.MailboxID != mb.ID {
+				return ErrModerationUnknown
+			} else if err != nil {
+				return fmt.Errorf("get message: %w", err)
+			}
+			addr, ok := acc.moderationAddress(m, moderator)
+			if !ok {
+				return ErrModerationNotAllowed
+			}
+
+			if !approve {
+				chl, err := acc.removeMessages(ctx, log, tx, mb, []Message{m})
+				if err != nil {
+					return fmt.Errorf("removing message: %w", err)
+				}
+				changes = append(changes, chl...)
+				remove = &m
+				log.Info("moderated message rejected", mlog.Field("moderator", moderator), mlog.Field("account", acc.Name), mlog.Field("msgid", m.ID), mlog.Field("address", addr))
+				return nil
+			}
+
+			dst, err := acc.redeliverMailbox(log, m)
+			if err != nil {
+				return fmt.Errorf("determining destination mailbox: %w", err)
+			}
+			if dst == "" || dst == ModerationMailbox {
+				dst = "Inbox"
+			}
+			mbDst, chl, err := acc.MailboxEnsure(tx, dst, true)
+			if err != nil {
+				return fmt.Errorf("ensuring destination mailbox: %w", err)
+			}
+			changes = append(changes, chl...)
+			chl, err = acc.moveMessages(ctx, log, tx, mb, &mbDst, []Message{m})
+			if err != nil {
+				return fmt.Errorf("moving message: %w", err)
+			}
+			changes = append(changes, chl...)
+			log.Info("moderated message approved", mlog.Field("moderator", moderator), mlog.Field("account", acc.Name), mlog.Field("msgid", m.ID), mlog.Field("address", addr), mlog.Field("mailbox", dst))
+			return nil
+		})
+		if err != nil {
+			rerr = err
+			return
+		}
+		if remove != nil {
+			p := acc.MessagePath(remove.ID)
+			err := os.Remove(p)
+			log.Check(err, "removing message file", mlog.Field("path", p))
+		}
+		comm := RegisterComm(acc)
+		defer comm.Unregister()
+		comm.Broadcast(changes)
+	})
+	return rerr
+}
+
+// ModerationNotify delivers a message to the Inbox of each moderator about
+// message m, that was just held for moderation for address. The held message is
+// attached. Errors are logged, the message has already been accepted.
+func ModerationNotify(log *mlog.Log, moderators []string, address string, m Message, msgFile *os.File) {
+	var subject string
+	if p, err := m.LoadPart(FileMsgReader(m.MsgPrefix, msgFile)); err != nil {
+		log.Infox("parsing message for subject", err)
+	} else if p.Envelope != nil {
+		subject = p.Envelope.Subject
+	}
+
+	for _, mod := range moderators {
+		if err := moderationNotify(log, mod, address, subject, m, msgFile); err != nil {
+			log.Errorx("notifying moderator of held message", err, mlog.Field("moderator", mod))
+		}
+	}
+}
+
+func moderationNotify(log *mlog.Log, moderator, address, subject string, m Message, msgFile *os.File) (rerr error) {
+	acc, err := OpenAccount(moderator)
+	if err != nil {
+		return fmt.Errorf("open account: %w", err)
+	}
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+
+	f, err := CreateMessageTemp("moderation")
+	if err != nil {
+		return fmt.Errorf("creating temporary message file: %w", err)
+	}
+	defer func() {
+		if f != nil {
+			err := os.Remove(f.Name())
+			log.Check(err, "removing temporary message file")
+			err = f.Close()
+			log.Check(err, "closing temporary message file")
+		}
+	}()
+
+	lang := mox.AccountLanguage(moderator)
+	msgFrom := msgFromAddress(m)
+	if msgFrom == "" {
+		msgFrom = m.MailFrom
+	}
+	vars := []string{"address", address, "from", msgFrom, "subject", subject, "link", moderationLink()}
+	text := strings.ReplaceAll(mox.Text(lang, "moderation-body", vars...), "\n", "\r\n")
+
+	now := time.Now()
+	mp := multipart.NewWriter(f)
+	header := func(k, v string) {
+		if err == nil {
+			_, err = fmt.Fprintf(f, "%s: %s\r\n", k, v)
+		}
+	}
+	header("Date", now.Format(message.RFC5322Z))
+	header("Subject", mime.QEncoding.Encode("utf-8", mox.Text(lang, "moderation-subject", vars...)))
+	header("Message-Id", fmt.Sprintf("<%s>", mox.MessageIDGen(false)))
+	header("MIME-Version", "1.0")
+	header("Content-Type", fmt.Sprintf(`multipart/mixed; boundary="%s"`, mp.Boundary()))
+	if err != nil {
+		return fmt.Errorf("writing message header: %w", err)
+	}
+	if _, err := f.Write([]byte("\r\n")); err != nil {
+		return fmt.Errorf("writing message header: %w", err)
+	}
+
+	textHdr := textproto.MIMEHeader{}
+	textHdr.Set("Content-Type", "text/plain; charset=utf-8")
+	textHdr.Set("Content-Transfer-Encoding", "8bit")
+	textp, err := mp.CreatePart(textHdr)
+	if err != nil {
+		return fmt.Errorf("creating text part: %w", err)
+	}
+	if _, err := textp.Write([]byte(text)); err != nil {
+		return fmt.Errorf("writing text part: %w", err)
+	}
+
+	origHdr := textproto.MIMEHeader{}
+	origHdr.Set("Content-Type", "message/rfc822")
+	origHdr.Set("Content-Disposition", "attachment")
+	origHdr.Set("Content-Transfer-Encoding", "8bit")
+	origp, err := mp.CreatePart(origHdr)
+	if err != nil {
+		return fmt.Errorf("creating attachment part: %w", err)
+	}
+	if _, err := io.Copy(origp, FileMsgReader(m.MsgPrefix, msgFile)); err != nil {
+		return fmt.Errorf("writing attachment part: %w", err)
+	}
+	if err := mp.Close(); err != nil {
+		return fmt.Errorf("closing multipart: %w", err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat temporary message file: %w", err)
+	}
+	nm := &Message{Received: now, Flags: Flags{Flagged: true}, Size: fi.Size()}
+	acc.WithWLock(func() {
+		err = acc.DeliverMailbox(log, "Inbox", nm, f, true)
+	})
+	if err != nil {
+		return fmt.Errorf("delivering message: %w", err)
+	}
+	f = nil
+	return nil
+}
+
+// moderationLink returns the URL of the moderation page in the account web
+// interface of the first listener that has it enabled, or the empty string.
+func moderationLink() string {
+	names := maps.Keys(mox.Conf.Static.Listeners)
+	sort.Strings(names)
+	for _, name := range names {
+		l := mox.Conf.Static.Listeners[name]
+		if !l.AccountHTTPS.Enabled {
+			continue
+		}
+		path := l.AccountHTTPS.Path
+		if path == "" {
+			path = "/"
+		}
+		return fmt.Sprintf("https://%s%s#moderation", mox.Conf.Static.HostnameDomain.ASCII, path)
+	}
+	return ""
+}
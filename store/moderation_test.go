@@ -0,0 +1,96 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestModeration(t *testing.T) {
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = "../testdata/store/mox.conf"
+	mox.MustLoadConfig(true, false)
+	acc, err := OpenAccount("mjl2")
+	tcheck(t, err, "open account")
+	defer acc.Close()
+	modAcc, err := OpenAccount("mjl")
+	tcheck(t, err, "open moderator account")
+	defer modAcc.Close()
+	switchDone := Switchboard()
+	defer close(switchDone)
+
+	log := mlog.New("moderation")
+
+	hold := func() Message {
+		t.Helper()
+		msg := "From: <remote@example.org>\r\nSubject: announcement\r\n\r\ntest\r\n"
+		msgFile, err := CreateMessageTemp("moderation")
+		tcheck(t, err, "create temp")
+		defer os.Remove(msgFile.Name())
+		defer msgFile.Close()
+		_, err = msgFile.Write([]byte(msg))
+		tcheck(t, err, "write message")
+		m := Message{RcptToLocalpart: "mjl2", RcptToDomain: "mox.example", MsgFromLocalpart: "remote", MsgFromDomain: "example.org", Size: int64(len(msg))}
+		acc.WithWLock(func() {
+			err = acc.DeliverMailbox(log, ModerationMailbox, &m, msgFile, false)
+		})
+		tcheck(t, err, "deliver")
+		ModerationNotify(log, []string{"mjl"}, "mjl2@mox.example", m, msgFile)
+		return m
+	}
+	m0 := hold()
+	m1 := hold()
+
+	// Moderator got notified for each message.
+	inbox, err := bstore.QueryDB[Mailbox](ctxbg, modAcc.DB).FilterNonzero(Mailbox{Name: "Inbox"}).Get()
+	tcheck(t, err, "get moderator inbox")
+	if count, err := bstore.QueryDB[Message](ctxbg, modAcc.DB).FilterNonzero(Message{MailboxID: inbox.ID}).Count(); err != nil || count != 2 {
+		t.Fatalf("got %d notifications, err %v, expected 2", count, err)
+	}
+
+	l, err := ModerationPending(ctxbg, log, "mjl")
+	tcheck(t, err, "pending")
+	if len(l) != 2 || l[0].ID != m0.ID || l[0].Address != "mjl2@mox.example" || l[0].Subject != "announcement" || l[0].MsgFrom != "remote@example.org" {
+		t.Fatalf("unexpected pending messages %#v", l)
+	}
+	l, err = ModerationPending(ctxbg, log, "mjl2")
+	tcheck(t, err, "pending for non-moderator")
+	if len(l) != 0 {
+		t.Fatalf("got %d pending messages for non-moderator, expected 0", len(l))
+	}
+
+	err = ModerationDecide(ctxbg, log, "mjl2", "mjl2", m0.ID, true)
+	if !errors.Is(err, ErrModerationNotAllowed) {
+		t.Fatalf("got err %v for non-moderator, expected ErrModerationNotAllowed", err)
+	}
+
+	err = ModerationDecide(ctxbg, log, "mjl", "mjl2", m0.ID, true)
+	tcheck(t, err, "approve")
+	m, err := bstore.QueryDB[Message](ctxbg, acc.DB).FilterID(m0.ID).Get()
+	tcheck(t, err, "get approved message")
+	mb, err := bstore.QueryDB[Mailbox](ctxbg, acc.DB).FilterID(m.MailboxID).Get()
+	tcheck(t, err, "get mailbox of approved message")
+	if mb.Name != "Inbox" {
+		t.Fatalf("approved message in mailbox %q, expected Inbox", mb.Name)
+	}
+
+	err = ModerationDecide(ctxbg, log, "mjl", "mjl2", m1.ID, false)
+	tcheck(t, err, "reject")
+	if exists, err := bstore.QueryDB[Message](ctxbg, acc.DB).FilterID(m1.ID).Exists(); err != nil || exists {
+		t.Fatalf("rejected message still present, err %v", err)
+	}
+	if _, err := os.Stat(acc.MessagePath(m1.ID)); err == nil {
+		t.Fatalf("message file of rejected message still present")
+	}
+
+	// Decided messages are no longer pending.
+	err = ModerationDecide(ctxbg, log, "mjl", "mjl2", m0.ID, false)
+	if !errors.Is(err, ErrModerationUnknown) {
+		t.Fatalf("got err %v for decided message, expected ErrModerationUnknown", err)
+	}
+}
@@ -0,0 +1,201 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+var metricMessagesArchived = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "mox_store_messages_archived_total",
+		Help: "Message files moved to archive storage.",
+	},
+)
+
+// ArchivedMessagePath returns the path of the message file in archive storage
+// for messageID of the account, if archive storage is configured and the
+// message file was moved there. Otherwise an empty string is returned.
+func ArchivedMessagePath(accountName string, messageID int64) string {
+	p := archiveMessagePath(accountName, messageID)
+	if p == "" {
+		return ""
+	}
+	if _, err := os.Stat(p); err != nil {
+		return ""
+	}
+	return p
+}
+
+// archiveMessagePath returns the path in archive storage for a message file,
+// whether it exists or not, or an empty string if no archive storage is
+// configured.
+func archiveMessagePath(accountName string, messageID int64) string {
+	ma := mox.Conf.Static.MessageArchive
+	if ma == nil {
+		return ""
+	}
+	return filepath.Join(mox.DataDirPath(ma.Path), accountName, "msg", MessagePath(messageID))
+}
+
+// messageFilePath returns the path to the message file in accountDir, or the
+// path in archive storage if the message file was moved there.
+func messageFilePath(accountDir string, messageID int64) string {
+	p := filepath.Join(accountDir, "msg", MessagePath(messageID))
+	if mox.Conf.Static.MessageArchive == nil {
+		return p
+	}
+	if _, err := os.Stat(p); err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return p
+	}
+	if ap := ArchivedMessagePath(filepath.Base(accountDir), messageID); ap != "" {
+		return ap
+	}
+	return p
+}
+
+// ArchiveMessages moves message files of messages received before "before" to
+// archive storage. Message files that were already moved are skipped. The number
+// of moved message files is returned.
+//
+// Files are copied without holding the account lock, and the original file is
+// only removed after the copy is synced to disk, with the account wlock held.
+func (a *Account) ArchiveMessages(ctx context.Context, log *mlog.Log, before time.Time) (moved int, rerr error) {
+	if mox.Conf.Static.MessageArchive == nil {
+		return 0, errors.New("no message archive configured")
+	}
+
+	var ids []int64
+	err := a.DB.Read(ctx, func(tx *bstore.Tx) error {
+		q := bstore.QueryTx[Message](tx)
+		q.FilterLess("Received", before)
+		return q.ForEach(func(m Message) error {
+			ids = append(ids, m.ID)
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, fmt.Errorf("listing messages: %w", err)
+	}
+
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return moved, ctx.Err()
+		}
+		p := filepath.Join(a.Dir, "msg", MessagePath(id))
+		if _, err := os.Stat(p); err != nil && errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		ap := archiveMessagePath(a.Name, id)
+		if err := archiveCopy(p, ap); err != nil {
+			return moved, fmt.Errorf("copying message file to archive: %w", err)
+		}
+
+		// Only remove the original if the message still exists, it may have been removed
+		// while we were copying.
+		var exists bool
+		a.WithWLock(func() {
+			exists, err = bstore.QueryDB[Message](ctx, a.DB).FilterID(id).Exists()
+			if err == nil && exists {
+				err = os.Remove(p)
+			}
+		})
+		if err != nil {
+			xerr := os.Remove(ap)
+			log.Check(xerr, "removing archive copy of message file after error", mlog.Field("path", ap))
+			return moved, fmt.Errorf("removing original message file: %w", err)
+		} else if !exists {
+			err := os.Remove(ap)
+			log.Check(err, "removing archive copy of removed message", mlog.Field("path", ap))
+			continue
+		}
+		moved++
+		metricMessagesArchived.Inc()
+	}
+	return moved, nil
+}
+
+// archiveCopy copies src to dst, creating the directory of dst, and syncs dst.
+func archiveCopy(src, dst string) (rerr error) {
+	if err := os.MkdirAll(filepath.Dir(dst), 0770); err != nil {
+		return err
+	}
+	sf, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer sf.Close()
+	df, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if df != nil {
+			df.Close()
+		}
+		if rerr != nil {
+			os.Remove(dst)
+		}
+	}()
+	if _, err := io.Copy(df, sf); err != nil {
+		return err
+	}
+	if err := df.Sync(); err != nil {
+		return err
+	}
+	err = df.Close()
+	df = nil
+	return err
+}
+
+// StartMessageArchiver starts a goroutine that periodically moves message files
+// of older messages of all accounts to archive storage, if configured.
+func StartMessageArchiver() {
+	ma := mox.Conf.Static.MessageArchive
+	if ma == nil {
+		return
+	}
+	go func() {
+		for {
+			select {
+			case <-mox.Shutdown.Done():
+				return
+			case <-time.After(ma.Interval):
+			}
+			archiveAccounts(mox.Shutdown, time.Now().Add(-ma.MinAge))
+		}
+	}()
+}
+
+func archiveAccounts(ctx context.Context, before time.Time) {
+	log := xlog.WithCid(mox.Cid())
+	for _, accName := range mox.Conf.Accounts() {
+		alog := log.Fields(mlog.Field("account", accName))
+		acc, err := OpenAccount(accName)
+		if err != nil {
+			alog.Errorx("open account for archiving message files", err)
+			continue
+		}
+		n, err := acc.ArchiveMessages(ctx, alog, before)
+		if err != nil {
+			alog.Errorx("archiving message files", err, mlog.Field("moved", n))
+		} else if n > 0 {
+			alog.Info("moved message files to archive storage", mlog.Field("moved", n))
+		}
+		err = acc.Close()
+		alog.Check(err, "closing account after archiving message files")
+	}
+}
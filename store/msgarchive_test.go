@@ -0,0 +1,84 @@
+package store
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestMessageArchive(t *testing.T) {
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = "../testdata/store/mox.conf"
+	mox.MustLoadConfig(true, false)
+	acc, err := OpenAccount("mjl")
+	tcheck(t, err, "open account")
+	defer acc.Close()
+	switchDone := Switchboard()
+	defer close(switchDone)
+
+	log := mlog.New("msgarchive")
+
+	mox.Conf.Static.MessageArchive = &config.MessageArchive{Path: "archive", MinAge: 24 * time.Hour}
+	defer func() {
+		mox.Conf.Static.MessageArchive = nil
+	}()
+
+	now := time.Now()
+	deliver := func(received time.Time) Message {
+		t.Helper()
+		msg := "Subject: test\r\n\r\ntest\r\n"
+		msgFile, err := CreateMessageTemp("msgarchive")
+		tcheck(t, err, "create temp")
+		defer os.Remove(msgFile.Name())
+		defer msgFile.Close()
+		_, err = msgFile.Write([]byte(msg))
+		tcheck(t, err, "write message")
+		m := Message{Received: received, Size: int64(len(msg))}
+		acc.WithWLock(func() {
+			err = acc.DeliverMailbox(log, "Inbox", &m, msgFile, false)
+		})
+		tcheck(t, err, "deliver")
+		return m
+	}
+	old := deliver(now.Add(-48 * time.Hour))
+	recent := deliver(now)
+
+	localPath := func(m Message) string {
+		return filepath.Join(acc.Dir, "msg", MessagePath(m.ID))
+	}
+
+	n, err := acc.ArchiveMessages(ctxbg, log, now.Add(-24*time.Hour))
+	tcheck(t, err, "archive messages")
+	if n != 1 {
+		t.Fatalf("archived %d messages, expected 1", n)
+	}
+	if _, err := os.Stat(localPath(old)); err == nil {
+		t.Fatalf("local message file still present after archiving")
+	}
+	if ArchivedMessagePath("mjl", old.ID) == "" || ArchivedMessagePath("mjl", recent.ID) != "" {
+		t.Fatalf("archived message paths not as expected")
+	}
+	if p := acc.MessagePath(recent.ID); p != localPath(recent) {
+		t.Fatalf("got message path %q for recent message, expected local path %q", p, localPath(recent))
+	}
+
+	// Archived message is still readable.
+	buf, err := io.ReadAll(acc.MessageReader(old))
+	tcheck(t, err, "read archived message")
+	if string(buf) != "Subject: test\r\n\r\ntest\r\n" {
+		t.Fatalf("got archived message %q", buf)
+	}
+
+	// Running again does not move anything.
+	n, err = acc.ArchiveMessages(ctxbg, log, now.Add(-24*time.Hour))
+	tcheck(t, err, "archive messages again")
+	if n != 0 {
+		t.Fatalf("archived %d messages again, expected 0", n)
+	}
+}
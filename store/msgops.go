@@ -0,0 +1,441 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/smtp"
+)
+
+// MessageQuery selects messages for administrative operations on messages across
+// accounts. At least one of MessageID, MsgFrom and MailFrom must be set, and all
+// set fields must match.
+type MessageQuery struct {
+	Account   string // If empty, all accounts.
+	Mailbox   string // If empty, all mailboxes.
+	MessageID string // Message-ID header, with or without <>. Only known for messages delivered after Message-IDs were stored for all incoming messages.
+	MsgFrom   string // Message From header address, or domain when starting with "@".
+	MailFrom  string // SMTP MAIL FROM address.
+}
+
+// MessageOp is an operation on messages matching a MessageQuery.
+type MessageOp string
+
+const (
+	MessageOpFind      MessageOp = "find"
+	MessageOpDelete    MessageOp = "delete"
+	MessageOpMove      MessageOp = "move"      // Into a mailbox, created if needed.
+	MessageOpRedeliver MessageOp = "redeliver" // Into the mailbox selected by the delivery rulesets of the recipient address.
+)
+
+// MessageMatch is a message that matched a MessageQuery.
+type MessageMatch struct {
+	Account   string
+	Mailbox   string
+	ID        int64 // Message ID in account.
+	UID       UID   // Before the operation.
+	Received  time.Time
+	MailFrom  string
+	MsgFrom   string
+	MessageID string
+	Size      int64
+	ToMailbox string // For move and redeliver, mailbox the message is (or would be) moved to. Empty if the message stays in its mailbox.
+}
+
+func (q MessageQuery) check() error {
+	if q.MessageID == "" && q.MsgFrom == "" && q.MailFrom == "" {
+		return errors.New("at least one of message-id, message from and smtp mail from is required")
+	}
+	return nil
+}
+
+// normalize adds <> to the Message-ID if missing.
+func (q *MessageQuery) normalize() {
+	if q.MessageID != "" && !strings.HasPrefix(q.MessageID, "<") {
+		q.MessageID = "<" + q.MessageID + ">"
+	}
+}
+
+// MessagesOperate finds the messages matching q in all accounts or the account
+// in q, and applies op to them, unless dryRun is set. For op MessageOpMove,
+// moveTo is the destination mailbox. The matching messages are returned, for a
+// dry run the messages that would be affected.
+//
+// Each message operated on is logged with its account and mailbox, for auditing.
+// Changes are broadcasted.
+func MessagesOperate(log *mlog.Log, q MessageQuery, op MessageOp, moveTo string, dryRun bool) ([]MessageMatch, error) {
+	if err := q.check(); err != nil {
+		return nil, err
+	}
+	switch op {
+	case MessageOpFind, MessageOpDelete, MessageOpRedeliver:
+	case MessageOpMove:
+		if moveTo == "" {
+			return nil, errors.New("destination mailbox required for move")
+		}
+		if strings.EqualFold(moveTo, "inbox") {
+			moveTo = "Inbox"
+		}
+	default:
+		return nil, fmt.Errorf("unknown operation %q", op)
+	}
+	q.normalize()
+
+	accounts := mox.Conf.Accounts()
+	if q.Account != "" {
+		if _, ok := mox.Conf.Account(q.Account); !ok {
+			return nil, mox.ErrAccountNotFound
+		}
+		accounts = []string{q.Account}
+	}
+
+	var matches []MessageMatch
+	for _, accName := range accounts {
+		acc, err := OpenAccount(accName)
+		if err != nil {
+			return matches, fmt.Errorf("open account %s: %w", accName, err)
+		}
+		var l []MessageMatch
+		acc.WithWLock(func() {
+			l, err = acc.messagesOperate(log, q, op, moveTo, dryRun)
+		})
+		xerr := acc.Close()
+		log.Check(xerr, "closing account after message operation")
+		matches = append(matches, l...)
+		if err != nil {
+			return matches, fmt.Errorf("account %s: %w", accName, err)
+		}
+	}
+	return matches, nil
+}
+
+// messagesOperate applies op to messages in the account.
+//
+// Caller must hold account wlock.
+// Changes are broadcasted.
+func (a *Account) messagesOperate(log *mlog.Log, q MessageQuery, op MessageOp, moveTo string, dryRun bool) (matches []MessageMatch, rerr error) {
+	if op == MessageOpDelete && !dryRun && a.OnHold() {
+		return nil, ErrHold
+	}
+
+	var changes []Change
+	var remove []Message
+	defer func() {
+		for _, m := range remove {
+			p := a.MessagePath(m.ID)
+			err := os.Remove(p)
+			log.Check(err, "removing message file", mlog.Field("path", p))
+		}
+	}()
+
+	err := a.DB.Write(context.TODO(), func(tx *bstore.Tx) error {
+		msgs, err := a.messagesQuery(tx, q)
+		if err != nil {
+			return err
+		}
+		if len(msgs) == 0 {
+			return nil
+		}
+
+		mailboxes := map[int64]*Mailbox{}
+		mailbox := func(id int64) (*Mailbox, error) {
+			if mb, ok := mailboxes[id]; ok {
+				return mb, nil
+			}
+			mb := &Mailbox{ID: id}
+			if err := tx.Get(mb); err != nil {
+				return nil, fmt.Errorf("get mailbox: %w", err)
+			}
+			mailboxes[id] = mb
+			return mb, nil
+		}
+
+		// Determine destination mailbox names for moves, by message.
+		var dstNames []string
+		for _, m := range msgs {
+			mb, err := mailbox(m.MailboxID)
+			if err != nil {
+				return err
+			}
+			var dst string
+			switch op {
+			case MessageOpMove:
+				dst = moveTo
+			case MessageOpRedeliver:
+				dst, err = a.redeliverMailbox(log, m)
+				if err != nil {
+					return err
+				}
+			}
+			if dst == mb.Name {
+				dst = ""
+			}
+			dstNames = append(dstNames, dst)
+			matches = append(matches, MessageMatch{a.Name, mb.Name, m.ID, m.UID, m.Received, m.MailFrom, msgFromAddress(m), m.MessageID, m.Size, dst})
+		}
+
+		if op == MessageOpFind {
+			return nil
+		}
+		for _, mm := range matches {
+			log.Info("admin message operation",
+				mlog.Field("op", op),
+				mlog.Field("dryrun", dryRun),
+				mlog.Field("account", mm.Account),
+				mlog.Field("mailbox", mm.Mailbox),
+				mlog.Field("msgid", mm.ID),
+				mlog.Field("messageid", mm.MessageID),
+				mlog.Field("tomailbox", mm.ToMailbox))
+		}
+		if dryRun {
+			return nil
+		}
+
+		if op == MessageOpDelete {
+			byMailbox := map[int64][]Message{}
+			for _, m := range msgs {
+				byMailbox[m.MailboxID] = append(byMailbox[m.MailboxID], m)
+			}
+			for mbID, l := range byMailbox {
+				mbChanges, err := a.removeMessages(context.TODO(), log, tx, mailboxes[mbID], l)
+				if err != nil {
+					return fmt.Errorf("removing messages: %w", err)
+				}
+				changes = append(changes, mbChanges...)
+				remove = append(remove, l...)
+			}
+			return nil
+		}
+
+		type move struct {
+			src, dst int64
+		}
+		var moveOrder []move
+		moves := map[move][]Message{}
+		for i, m := range msgs {
+			if dstNames[i] == "" {
+				continue
+			}
+			mbDst, mbChanges, err := a.MailboxEnsure(tx, dstNames[i], true)
+			if err != nil {
+				return fmt.Errorf("ensuring destination mailbox: %w", err)
+			}
+			changes = append(changes, mbChanges...)
+			if _, ok := mailboxes[mbDst.ID]; !ok {
+				mailboxes[mbDst.ID] = &mbDst
+			}
+			k := move{m.MailboxID, mbDst.ID}
+			if _, ok := moves[k]; !ok {
+				moveOrder = append(moveOrder, k)
+			}
+			moves[k] = append(moves[k], m)
+		}
+		for _, k := range moveOrder {
+			mvChanges, err := a.moveMessages(context.TODO(), log, tx, mailboxes[k.src], mailboxes[k.dst], moves[k])
+			if err != nil {
+				return fmt.Errorf("moving messages: %w", err)
+			}
+			changes = append(changes, mvChanges...)
+		}
+		return nil
+	})
+	if err != nil {
+		remove = nil // Don't remove files on failure.
+		return nil, err
+	}
+	if len(changes) > 0 {
+		comm := RegisterComm(a)
+		defer comm.Unregister()
+		comm.Broadcast(changes)
+	}
+	return matches, nil
+}
+
+// messagesQuery returns the messages in the account matching q, ordered by ID.
+func (a *Account) messagesQuery(tx *bstore.Tx, q MessageQuery) ([]Message, error) {
+	qm := bstore.QueryTx[Message](tx)
+	if q.Mailbox != "" {
+		mb, err := a.MailboxFind(tx, q.Mailbox)
+		if err != nil {
+			return nil, fmt.Errorf("finding mailbox: %w", err)
+		} else if mb == nil {
+			return nil, nil
+		}
+		qm.FilterNonzero(Message{MailboxID: mb.ID})
+	}
+	if q.MessageID != "" {
+		qm.FilterNonzero(Message{MessageID: q.MessageID})
+	}
+	if strings.HasPrefix(q.MsgFrom, "@") {
+		qm.FilterFn(func(m Message) bool {
+			return strings.EqualFold(m.MsgFromDomain, q.MsgFrom[1:])
+		})
+	} else if q.MsgFrom != "" {
+		qm.FilterFn(func(m Message) bool {
+			return strings.EqualFold(msgFromAddress(m), q.MsgFrom)
+		})
+	}
+	if q.MailFrom != "" {
+		qm.FilterFn(func(m Message) bool {
+			return strings.EqualFold(m.MailFrom, q.MailFrom)
+		})
+	}
+	qm.SortAsc("ID")
+	msgs, err := qm.List()
+	if err != nil {
+		return nil, fmt.Errorf("listing messages: %w", err)
+	}
+	return msgs, nil
+}
+
+// redeliverMailbox returns the mailbox a message would be delivered to by the
+// rulesets of the destination it was delivered for. For messages without
+// recipient, or a recipient that is no longer an address of this account, an
+// empty string is returned, keeping the message in place.
+func (a *Account) redeliverMailbox(log *mlog.Log, m Message) (string, error) {
+	if m.RcptToDomain == "" {
+		return "", nil
+	}
+	rcptDomain, err := dns.ParseDomain(m.RcptToDomain)
+	if err != nil {
+		log.Infox("parsing recipient domain for redelivery, keeping message", err, mlog.Field("msgid", m.ID))
+		return "", nil
+	}
+	accName, _, dest, err := mox.FindAccount(m.RcptToLocalpart, rcptDomain, true)
+	if err != nil || accName != a.Name {
+		log.Info("recipient address no longer delivers to account, keeping message", mlog.Field("msgid", m.ID), mlog.Field("recipient", smtp.NewAddress(m.RcptToLocalpart, rcptDomain).String()))
+		return "", nil
+	}
+
+	f, err := os.Open(a.MessagePath(m.ID))
+	if err != nil {
+		return "", fmt.Errorf("open message file: %w", err)
+	}
+	defer func() {
+		err := f.Close()
+		log.Check(err, "closing message file")
+	}()
+	if rs := MessageRuleset(log, dest, &m, m.MsgPrefix, f); rs != nil {
+		return rs.Mailbox, nil
+	} else if dest.Mailbox != "" {
+		return dest.Mailbox, nil
+	}
+	return "Inbox", nil
+}
+
+func msgFromAddress(m Message) string {
+	if m.MsgFromDomain == "" {
+		return ""
+	}
+	return string(m.MsgFromLocalpart) + "@" + m.MsgFromDomain
+}
+
+// moveMessages moves msgs from mbSrc to mbDst, assigning new UIDs, and retrains
+// the junk filter for the messages. Both mailboxes are updated in the database.
+// If the account is configured with ArchiveByYear and mbDst is the archive
+// mailbox, the messages are moved to the sub-mailboxes for the year they were
+// received instead, like for delivery. Changes are returned and must be
+// broadcasted by the caller.
+//
+// Caller must hold account wlock.
+func (a *Account) moveMessages(ctx context.Context, log *mlog.Log, tx *bstore.Tx, mbSrc, mbDst *Mailbox, msgs []Message) ([]Change, error) {
+	conf, _ := a.Conf()
+	if !conf.ArchiveByYear || !mbDst.Archive {
+		return a.moveMessagesMailbox(ctx, log, tx, mbSrc, mbDst, msgs)
+	}
+
+	// Group by year, keeping track of the original index to update msgs.
+	indexes := map[int][]int{}
+	var years []int
+	for i, m := range msgs {
+		y := archiveYear(m.Received)
+		if _, ok := indexes[y]; !ok {
+			years = append(years, y)
+		}
+		indexes[y] = append(indexes[y], i)
+	}
+	sort.Ints(years)
+
+	var changes []Change
+	for _, y := range years {
+		mb, mbChanges, err := a.MailboxEnsure(tx, fmt.Sprintf("%s/%d", mbDst.Name, y), true)
+		if err != nil {
+			return nil, fmt.Errorf("ensuring archive mailbox for year: %w", err)
+		}
+		changes = append(changes, mbChanges...)
+		l := make([]Message, len(indexes[y]))
+		for j, i := range indexes[y] {
+			l[j] = msgs[i]
+		}
+		mvChanges, err := a.moveMessagesMailbox(ctx, log, tx, mbSrc, &mb, l)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, mvChanges...)
+		for j, i := range indexes[y] {
+			msgs[i] = l[j]
+		}
+	}
+	return changes, nil
+}
+
+// moveMessagesMailbox moves msgs from mbSrc to mbDst, see moveMessages, without
+// archive partitioning.
+func (a *Account) moveMessagesMailbox(ctx context.Context, log *mlog.Log, tx *bstore.Tx, mbSrc, mbDst *Mailbox, msgs []Message) ([]Change, error) {
+	conf, _ := a.Conf()
+	modseq, err := a.NextModSeq(tx)
+	if err != nil {
+		return nil, fmt.Errorf("assigning modseq: %w", err)
+	}
+	uids := make([]UID, len(msgs))
+	now := time.Now()
+	if err := MailboxCountsRemove(tx, msgs...); err != nil {
+		return nil, err
+	}
+	for i := range msgs {
+		m := &msgs[i]
+		uids[i] = m.UID
+		m.MailboxID = mbDst.ID
+		m.SaveDate = now
+		if mbSrc.Name == conf.RejectsMailbox && m.MailboxDestinedID != 0 {
+			// Like a user moving a message out of the rejects mailbox, see the IMAP MOVE
+			// command.
+			m.MailboxOrigID = m.MailboxDestinedID
+		}
+		m.UID = mbDst.UIDNext
+		mbDst.UIDNext++
+		m.ModSeq = modseq
+		m.JunkFlagsForMailbox(mbDst.Name, conf)
+		if err := tx.Update(m); err != nil {
+			return nil, fmt.Errorf("updating moved message: %w", err)
+		}
+	}
+	if err := tx.Update(mbDst); err != nil {
+		return nil, fmt.Errorf("updating destination mailbox uidnext: %w", err)
+	}
+	if err := MailboxCountsAdd(tx, msgs...); err != nil {
+		return nil, err
+	}
+	if err := a.RecordExpunged(tx, mbSrc.ID, uids, modseq); err != nil {
+		return nil, fmt.Errorf("recording expunged messages: %w", err)
+	}
+	if err := a.RetrainMessages(ctx, log, tx, msgs, false); err != nil {
+		return nil, fmt.Errorf("retraining moved messages: %w", err)
+	}
+
+	changes := []Change{ChangeRemoveUIDs{mbSrc.ID, uids, modseq}}
+	for _, m := range msgs {
+		changes = append(changes, ChangeAddUID{mbDst.ID, m.UID, m.ModSeq, m.Flags, m.Keywords})
+	}
+	return changes, nil
+}
@@ -0,0 +1,127 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestMessagesOperate(t *testing.T) {
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = "../testdata/store/mox.conf"
+	mox.ConfigDynamicPath = filepath.Join(filepath.Dir(mox.ConfigStaticPath), "domains.conf")
+	mox.MustLoadConfig(true, false)
+	acc, err := OpenAccount("mjl")
+	tcheck(t, err, "open account")
+	defer acc.Close()
+	switchDone := Switchboard()
+	defer close(switchDone)
+
+	log := mlog.New("msgops")
+
+	deliver := func(mailbox, rcptLocalpart, msgID, subject string) {
+		t.Helper()
+		msg := "From: <spammer@spam.example>\r\nMessage-Id: " + msgID + "\r\nSubject: " + subject + "\r\n\r\ntest\r\n"
+		msgFile, err := CreateMessageTemp("msgops")
+		tcheck(t, err, "create temp")
+		defer os.Remove(msgFile.Name())
+		defer msgFile.Close()
+		_, err = msgFile.Write([]byte(msg))
+		tcheck(t, err, "write message")
+		m := Message{
+			Size:             int64(len(msg)),
+			RcptToLocalpart:  "mjl",
+			RcptToDomain:     "mox.example",
+			MailFrom:         "bounce@spam.example",
+			MsgFromLocalpart: "spammer",
+			MsgFromDomain:    "spam.example",
+		}
+		if rcptLocalpart != "" {
+			m.RcptToLocalpart = "other"
+		}
+		acc.WithWLock(func() {
+			err = acc.DeliverMailbox(log, mailbox, &m, msgFile, true)
+		})
+		tcheck(t, err, "deliver")
+	}
+	deliver("Inbox", "", "<phish@spam.example>", "test")
+	deliver("Sent", "", "<phish@spam.example>", "test")
+	deliver("Inbox", "other", "<other@spam.example>", "hi")
+	deliver("Inbox", "", "<list@spam.example>", "hi")
+
+	count := func(mailbox string) int {
+		t.Helper()
+		var n int
+		err := acc.DB.Read(ctxbg, func(tx *bstore.Tx) error {
+			mb, err := acc.MailboxFind(tx, mailbox)
+			if err != nil || mb == nil {
+				return err
+			}
+			n, err = bstore.QueryTx[Message](tx).FilterNonzero(Message{MailboxID: mb.ID}).Count()
+			return err
+		})
+		tcheck(t, err, "count messages")
+		return n
+	}
+
+	operate := func(q MessageQuery, op MessageOp, moveTo string, dryRun bool, exp int) []MessageMatch {
+		t.Helper()
+		l, err := MessagesOperate(log, q, op, moveTo, dryRun)
+		tcheck(t, err, "operate on messages")
+		if len(l) != exp {
+			t.Fatalf("got %d matches, expected %d: %#v", len(l), exp, l)
+		}
+		return l
+	}
+
+	// Criteria are required.
+	if _, err := MessagesOperate(log, MessageQuery{Account: "mjl"}, MessageOpFind, "", false); err == nil {
+		t.Fatalf("operate without criteria succeeded")
+	}
+	if _, err := MessagesOperate(log, MessageQuery{Account: "bogus", MessageID: "x"}, MessageOpFind, "", false); err == nil {
+		t.Fatalf("operate on unknown account succeeded")
+	}
+
+	operate(MessageQuery{MessageID: "phish@spam.example"}, MessageOpFind, "", false, 2)
+	operate(MessageQuery{MessageID: "<phish@spam.example>", Mailbox: "Sent"}, MessageOpFind, "", false, 1)
+	operate(MessageQuery{MsgFrom: "@SPAM.example"}, MessageOpFind, "", false, 4)
+	operate(MessageQuery{MsgFrom: "other@spam.example"}, MessageOpFind, "", false, 0)
+	operate(MessageQuery{MailFrom: "bounce@spam.example", Mailbox: "Inbox"}, MessageOpFind, "", false, 3)
+
+	operate(MessageQuery{MessageID: "phish@spam.example"}, MessageOpDelete, "", true, 2)
+	if n := count("Inbox"); n != 3 {
+		t.Fatalf("dry run removed messages, got %d in inbox, expected 3", n)
+	}
+	operate(MessageQuery{MessageID: "phish@spam.example"}, MessageOpDelete, "", false, 2)
+	if n, m := count("Inbox"), count("Sent"); n != 2 || m != 0 {
+		t.Fatalf("got %d in inbox and %d in sent, expected 2 and 0", n, m)
+	}
+
+	// Rulesets deliver "hi" to Catchall for mjl@, and to Other for other@.
+	l := operate(MessageQuery{MsgFrom: "@spam.example"}, MessageOpRedeliver, "", true, 2)
+	if l[0].ToMailbox != "Other" || l[1].ToMailbox != "Catchall" {
+		t.Fatalf("dry run redeliver, got %#v, expected other and catchall", l)
+	}
+	operate(MessageQuery{MsgFrom: "@spam.example"}, MessageOpRedeliver, "", false, 2)
+	if n, m, o := count("Inbox"), count("Catchall"), count("Other"); n != 0 || m != 1 || o != 1 {
+		t.Fatalf("got %d in inbox, %d in catchall, %d in other, expected 0, 1, 1", n, m, o)
+	}
+	// Redelivering again is a noop.
+	l = operate(MessageQuery{MsgFrom: "@spam.example"}, MessageOpRedeliver, "", false, 2)
+	if l[0].ToMailbox != "" || l[1].ToMailbox != "" {
+		t.Fatalf("second redeliver moved messages: %#v", l)
+	}
+
+	operate(MessageQuery{MessageID: "list@spam.example"}, MessageOpMove, "Lists", false, 1)
+	if n := count("Lists"); n != 1 {
+		t.Fatalf("got %d in lists after move, expected 1", n)
+	}
+	if _, err := MessagesOperate(log, MessageQuery{MessageID: "list@spam.example"}, MessageOpMove, "", false); err == nil {
+		t.Fatalf("move without destination succeeded")
+	}
+}
@@ -0,0 +1,295 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+// MessagesTransfer copies messages matching q from account q.Account to account
+// dstAccount, removing them from the source account if move is set. Unlike
+// MessagesOperate, q can select all messages in a mailbox by only setting
+// q.Mailbox. Messages are added to mailbox dstMailbox, or to the mailbox with the
+// same name as in the source account if dstMailbox is empty. Mailboxes are
+// created as needed. Received time, flags and keywords are preserved, the junk
+// filter of the destination account is trained with the messages.
+//
+// The matching messages are returned, with ToMailbox set to the mailbox in the
+// destination account. For a dry run no changes are made. Each message
+// transferred is logged. Changes are broadcasted.
+func MessagesTransfer(log *mlog.Log, q MessageQuery, dstAccount, dstMailbox string, move, dryRun bool) ([]MessageMatch, error) {
+	if q.Account == "" || dstAccount == "" {
+		return nil, errors.New("source and destination account required")
+	} else if q.Account == dstAccount {
+		return nil, errors.New("source and destination account must be different")
+	} else if q.Mailbox == "" {
+		if err := q.check(); err != nil {
+			return nil, fmt.Errorf("mailbox or message criteria required: %w", err)
+		}
+	}
+	q.normalize()
+	if strings.EqualFold(dstMailbox, "inbox") {
+		dstMailbox = "Inbox"
+	}
+	if _, ok := mox.Conf.Account(q.Account); !ok {
+		return nil, fmt.Errorf("source account: %w", mox.ErrAccountNotFound)
+	} else if _, ok := mox.Conf.Account(dstAccount); !ok {
+		return nil, fmt.Errorf("destination account: %w", mox.ErrAccountNotFound)
+	}
+
+	src, err := OpenAccount(q.Account)
+	if err != nil {
+		return nil, fmt.Errorf("open source account: %w", err)
+	}
+	defer func() {
+		err := src.Close()
+		log.Check(err, "closing source account after transfer")
+	}()
+	dst, err := OpenAccount(dstAccount)
+	if err != nil {
+		return nil, fmt.Errorf("open destination account: %w", err)
+	}
+	defer func() {
+		err := dst.Close()
+		log.Check(err, "closing destination account after transfer")
+	}()
+
+	if move && !dryRun && src.OnHold() {
+		return nil, ErrHold
+	}
+
+	// Gather the messages and the names of their mailboxes.
+	var msgs []Message
+	var matches []MessageMatch
+	src.WithRLock(func() {
+		err = src.DB.Read(context.TODO(), func(tx *bstore.Tx) error {
+			var err error
+			msgs, err = src.messagesQuery(tx, q)
+			if err != nil {
+				return err
+			}
+			names := map[int64]string{}
+			for _, m := range msgs {
+				name, ok := names[m.MailboxID]
+				if !ok {
+					mb := Mailbox{ID: m.MailboxID}
+					if err := tx.Get(&mb); err != nil {
+						return fmt.Errorf("get mailbox: %w", err)
+					}
+					name = mb.Name
+					names[m.MailboxID] = name
+				}
+				to := dstMailbox
+				if to == "" {
+					to = name
+				}
+				matches = append(matches, MessageMatch{src.Name, name, m.ID, m.UID, m.Received, m.MailFrom, msgFromAddress(m), m.MessageID, m.Size, to})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, mm := range matches {
+		log.Info("admin message transfer",
+			mlog.Field("move", move),
+			mlog.Field("dryrun", dryRun),
+			mlog.Field("account", mm.Account),
+			mlog.Field("mailbox", mm.Mailbox),
+			mlog.Field("msgid", mm.ID),
+			mlog.Field("messageid", mm.MessageID),
+			mlog.Field("toaccount", dstAccount),
+			mlog.Field("tomailbox", mm.ToMailbox))
+	}
+	if dryRun || len(msgs) == 0 {
+		return matches, nil
+	}
+
+	dst.WithWLock(func() {
+		err = dst.transferDeliver(log, src, msgs, matches)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("adding messages to destination account: %w", err)
+	}
+
+	if move {
+		src.WithWLock(func() {
+			err = src.transferRemove(log, msgs)
+		})
+		if err != nil {
+			return matches, fmt.Errorf("messages copied, but removing from source account: %w", err)
+		}
+	}
+	return matches, nil
+}
+
+// transferDeliver adds copies of msgs from account src to the mailboxes in
+// matches.
+//
+// Caller must hold account wlock.
+// Changes are broadcasted.
+func (a *Account) transferDeliver(log *mlog.Log, src *Account, msgs []Message, matches []MessageMatch) (rerr error) {
+	var changes []Change
+	var deliveredIDs []int64
+	defer func() {
+		if rerr == nil {
+			return
+		}
+		for _, id := range deliveredIDs {
+			p := a.MessagePath(id)
+			err := os.Remove(p)
+			log.Check(err, "removing message file after failed transfer", mlog.Field("path", p))
+		}
+	}()
+
+	err := a.DB.Write(context.TODO(), func(tx *bstore.Tx) error {
+		mailboxes := map[string]Mailbox{}
+		keywords := map[string]map[string]bool{}
+		var delivered []Message
+		for i, sm := range msgs {
+			name := matches[i].ToMailbox
+			mb, ok := mailboxes[name]
+			if !ok {
+				var mbChanges []Change
+				var err error
+				mb, mbChanges, err = a.MailboxEnsure(tx, name, true)
+				if err != nil {
+					return fmt.Errorf("ensuring destination mailbox: %w", err)
+				}
+				changes = append(changes, mbChanges...)
+				mailboxes[name] = mb
+				keywords[name] = map[string]bool{}
+			}
+
+			m := sm
+			m.ID = 0
+			m.UID = 0
+			m.MailboxID = mb.ID
+			m.MailboxOrigID = mb.ID
+			m.MailboxDestinedID = 0
+			m.EmailID = 0
+			m.SaveDate = time.Time{}
+			m.ThreadID = 0
+			m.TrainedJunk = nil
+			err := func() error {
+				f, err := os.Open(src.MessagePath(sm.ID))
+				if err != nil {
+					return fmt.Errorf("open message file: %w", err)
+				}
+				defer func() {
+					err := f.Close()
+					log.Check(err, "closing source message file")
+				}()
+				const consumeFile = false
+				const sync = true
+				const notrain = true
+				return a.DeliverMessage(log, tx, &m, f, consumeFile, name == "Sent", sync, notrain)
+			}()
+			if err != nil {
+				return fmt.Errorf("delivering message %d: %w", sm.ID, err)
+			}
+			deliveredIDs = append(deliveredIDs, m.ID)
+			delivered = append(delivered, m)
+			for _, kw := range m.Keywords {
+				keywords[name][kw] = true
+			}
+			changes = append(changes, ChangeAddUID{m.MailboxID, m.UID, m.ModSeq, m.Flags, m.Keywords})
+		}
+
+		// Mailbox UIDNext was changed during delivery, we fetch it again for updating keywords.
+		for name, kws := range keywords {
+			if len(kws) == 0 {
+				continue
+			}
+			mb := Mailbox{ID: mailboxes[name].ID}
+			if err := tx.Get(&mb); err != nil {
+				return fmt.Errorf("get mailbox: %w", err)
+			}
+			var l []string
+			for kw := range kws {
+				l = append(l, kw)
+			}
+			var changed bool
+			mb.Keywords, changed = MergeKeywords(mb.Keywords, l)
+			if changed {
+				if err := tx.Update(&mb); err != nil {
+					return fmt.Errorf("updating mailbox keywords: %w", err)
+				}
+			}
+		}
+
+		if err := a.RetrainMessages(context.TODO(), log, tx, delivered, false); err != nil {
+			return fmt.Errorf("training junk filter: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	comm := RegisterComm(a)
+	defer comm.Unregister()
+	comm.Broadcast(changes)
+	return nil
+}
+
+// transferRemove removes msgs after they were transferred to another account.
+// Messages that were removed in the mean time are skipped.
+//
+// Caller must hold account wlock.
+// Changes are broadcasted.
+func (a *Account) transferRemove(log *mlog.Log, msgs []Message) error {
+	ids := make([]int64, len(msgs))
+	for i, m := range msgs {
+		ids[i] = m.ID
+	}
+
+	var changes []Change
+	var remove []Message
+	err := a.DB.Write(context.TODO(), func(tx *bstore.Tx) error {
+		l, err := bstore.QueryTx[Message](tx).FilterIDs(ids).List()
+		if err != nil {
+			return fmt.Errorf("listing messages: %w", err)
+		}
+		byMailbox := map[int64][]Message{}
+		for _, m := range l {
+			byMailbox[m.MailboxID] = append(byMailbox[m.MailboxID], m)
+		}
+		for mbID, ml := range byMailbox {
+			mb := Mailbox{ID: mbID}
+			if err := tx.Get(&mb); err != nil {
+				return fmt.Errorf("get mailbox: %w", err)
+			}
+			mbChanges, err := a.removeMessages(context.TODO(), log, tx, &mb, ml)
+			if err != nil {
+				return fmt.Errorf("removing messages: %w", err)
+			}
+			changes = append(changes, mbChanges...)
+			remove = append(remove, ml...)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, m := range remove {
+		p := a.MessagePath(m.ID)
+		err := os.Remove(p)
+		log.Check(err, "removing message file", mlog.Field("path", p))
+	}
+
+	comm := RegisterComm(a)
+	defer comm.Unregister()
+	comm.Broadcast(changes)
+	return nil
+}
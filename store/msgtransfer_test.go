@@ -0,0 +1,129 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestMessagesTransfer(t *testing.T) {
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = "../testdata/store/mox.conf"
+	mox.ConfigDynamicPath = filepath.Join(filepath.Dir(mox.ConfigStaticPath), "domains.conf")
+	mox.MustLoadConfig(true, false)
+	acc, err := OpenAccount("mjl")
+	tcheck(t, err, "open account")
+	defer acc.Close()
+	acc2, err := OpenAccount("mjl2")
+	tcheck(t, err, "open account")
+	defer acc2.Close()
+	switchDone := Switchboard()
+	defer close(switchDone)
+
+	log := mlog.New("msgtransfer")
+
+	received := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	deliver := func(mailbox, msgID string, flags Flags, keywords []string) {
+		t.Helper()
+		msg := "From: <mjl@mox.example>\r\nMessage-Id: " + msgID + "\r\nSubject: test\r\n\r\ntest\r\n"
+		msgFile, err := CreateMessageTemp("msgtransfer")
+		tcheck(t, err, "create temp")
+		defer os.Remove(msgFile.Name())
+		defer msgFile.Close()
+		_, err = msgFile.Write([]byte(msg))
+		tcheck(t, err, "write message")
+		m := Message{
+			Size:             int64(len(msg)),
+			Received:         received,
+			Flags:            flags,
+			Keywords:         keywords,
+			MsgFromLocalpart: "mjl",
+			MsgFromDomain:    "mox.example",
+		}
+		acc.WithWLock(func() {
+			err = acc.DeliverMailbox(log, mailbox, &m, msgFile, true)
+		})
+		tcheck(t, err, "deliver")
+	}
+	deliver("Sent", "<sent1@mox.example>", Flags{Seen: true}, []string{"work"})
+	deliver("Sent", "<sent2@mox.example>", Flags{}, nil)
+	deliver("Drafts", "<draft@mox.example>", Flags{Draft: true}, nil)
+
+	list := func(a *Account, mailbox string) []Message {
+		t.Helper()
+		var l []Message
+		err := a.DB.Read(ctxbg, func(tx *bstore.Tx) error {
+			mb, err := a.MailboxFind(tx, mailbox)
+			if err != nil || mb == nil {
+				return err
+			}
+			l, err = bstore.QueryTx[Message](tx).FilterNonzero(Message{MailboxID: mb.ID}).SortAsc("ID").List()
+			return err
+		})
+		tcheck(t, err, "list messages")
+		return l
+	}
+
+	transfer := func(q MessageQuery, dstAccount, dstMailbox string, move, dryRun bool, exp int) {
+		t.Helper()
+		l, err := MessagesTransfer(log, q, dstAccount, dstMailbox, move, dryRun)
+		tcheck(t, err, "transfer messages")
+		if len(l) != exp {
+			t.Fatalf("got %d matches, expected %d: %#v", len(l), exp, l)
+		}
+	}
+
+	if _, err := MessagesTransfer(log, MessageQuery{Account: "mjl"}, "mjl2", "", false, false); err == nil {
+		t.Fatalf("transfer without mailbox or criteria succeeded")
+	}
+	if _, err := MessagesTransfer(log, MessageQuery{Account: "mjl", Mailbox: "Sent"}, "mjl", "", false, false); err == nil {
+		t.Fatalf("transfer to same account succeeded")
+	}
+	if _, err := MessagesTransfer(log, MessageQuery{Account: "mjl", Mailbox: "Sent"}, "bogus", "", false, false); err == nil {
+		t.Fatalf("transfer to unknown account succeeded")
+	}
+
+	transfer(MessageQuery{Account: "mjl", Mailbox: "Sent"}, "mjl2", "", false, true, 2)
+	if l := list(acc2, "Sent"); len(l) != 0 {
+		t.Fatalf("dry run copied messages")
+	}
+
+	// Copy whole mailbox, keeping mailbox name, flags, keywords and received time.
+	transfer(MessageQuery{Account: "mjl", Mailbox: "Sent"}, "mjl2", "", false, false, 2)
+	l := list(acc2, "Sent")
+	if len(l) != 2 || !l[0].Received.Equal(received) || !l[0].Seen || len(l[0].Keywords) != 1 || l[0].Keywords[0] != "work" {
+		t.Fatalf("unexpected copied messages %#v", l)
+	}
+	if buf, err := os.ReadFile(acc2.MessagePath(l[0].ID)); err != nil || len(buf) != int(l[0].Size) {
+		t.Fatalf("reading copied message: %v, size %d, expected %d", err, len(buf), l[0].Size)
+	}
+	if n := len(list(acc, "Sent")); n != 2 {
+		t.Fatalf("copy removed messages from source, %d left", n)
+	}
+	err = acc2.DB.Read(ctxbg, func(tx *bstore.Tx) error {
+		mb, err := acc2.MailboxFind(tx, "Sent")
+		if err != nil {
+			return err
+		}
+		if len(mb.Keywords) != 1 || mb.Keywords[0] != "work" {
+			t.Fatalf("mailbox keywords %v, expected work", mb.Keywords)
+		}
+		return nil
+	})
+	tcheck(t, err, "get mailbox")
+
+	// Move matching message to other mailbox.
+	transfer(MessageQuery{Account: "mjl", MessageID: "draft@mox.example"}, "mjl2", "Handoff/Drafts", true, false, 1)
+	if l := list(acc2, "Handoff/Drafts"); len(l) != 1 || !l[0].Draft {
+		t.Fatalf("unexpected moved messages %#v", l)
+	}
+	if n := len(list(acc, "Drafts")); n != 0 {
+		t.Fatalf("move left %d messages in source", n)
+	}
+}
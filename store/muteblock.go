@@ -0,0 +1,294 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/smtp"
+)
+
+// Actions for blocked senders.
+const (
+	BlockActionJunk   = "junk"   // Deliver to the Junk mailbox.
+	BlockActionDelete = "delete" // Accept but do not deliver.
+)
+
+// BlockedSender is an address or domain whose incoming messages are not
+// delivered to their regular mailbox. Matching is on the message From address.
+type BlockedSender struct {
+	ID      int64
+	Address string    `bstore:"nonzero,unique"` // Lower case, "localpart@domain", or "@domain" for all addresses of a domain.
+	Action  string    `bstore:"nonzero"`        // BlockActionJunk or BlockActionDelete.
+	Created time.Time `bstore:"default now"`
+}
+
+// MutedThread is a conversation for which new messages are delivered to the
+// Archive mailbox, marked as read and without notifications, instead of to the
+// Inbox.
+type MutedThread struct {
+	ID      int64
+	Subject string    // Of the message through which the thread was muted.
+	Created time.Time `bstore:"default now"`
+}
+
+// MutedMessageID is a message-id that is part of a muted thread. Incoming
+// messages that reference one of the message-ids of a muted thread are part of
+// the thread, and their message-id is added to the thread.
+type MutedMessageID struct {
+	ID        int64
+	MessageID string `bstore:"nonzero,unique"` // With <>.
+	ThreadID  int64  `bstore:"nonzero,ref MutedThread,index"`
+}
+
+var (
+	ErrBlockedSenderInvalid = errors.New("invalid blocked sender")
+	ErrBlockedSenderExists  = errors.New("sender already blocked")
+	ErrThreadMuted          = errors.New("thread already muted")
+)
+
+// BlockedSenders returns the blocked senders of the account, sorted by address.
+func (a *Account) BlockedSenders(ctx context.Context) ([]BlockedSender, error) {
+	return bstore.QueryDB[BlockedSender](ctx, a.DB).SortAsc("Address").List()
+}
+
+// BlockedSenderAdd blocks an address, or all addresses of a domain if address
+// starts with "@". ErrBlockedSenderExists is returned if the address is already
+// blocked.
+func (a *Account) BlockedSenderAdd(ctx context.Context, address, action string) (BlockedSender, error) {
+	switch action {
+	case BlockActionJunk, BlockActionDelete:
+	default:
+		return BlockedSender{}, fmt.Errorf("%w: unknown action %q", ErrBlockedSenderInvalid, action)
+	}
+	var addr string
+	if strings.HasPrefix(address, "@") {
+		d, err := dns.ParseDomain(address[1:])
+		if err != nil {
+			return BlockedSender{}, fmt.Errorf("%w: parsing domain: %v", ErrBlockedSenderInvalid, err)
+		}
+		addr = "@" + d.Name()
+	} else {
+		a, err := smtp.ParseAddress(address)
+		if err != nil {
+			return BlockedSender{}, fmt.Errorf("%w: parsing address: %v", ErrBlockedSenderInvalid, err)
+		}
+		addr = strings.ToLower(string(a.Localpart)) + "@" + a.Domain.Name()
+	}
+	bs := BlockedSender{Address: addr, Action: action}
+	err := a.DB.Write(ctx, func(tx *bstore.Tx) error {
+		exists, err := bstore.QueryTx[BlockedSender](tx).FilterNonzero(BlockedSender{Address: addr}).Exists()
+		if err != nil {
+			return err
+		} else if exists {
+			return ErrBlockedSenderExists
+		}
+		return tx.Insert(&bs)
+	})
+	return bs, err
+}
+
+// BlockedSenderRemove removes a blocked sender by ID.
+func (a *Account) BlockedSenderRemove(ctx context.Context, id int64) error {
+	return a.DB.Delete(ctx, &BlockedSender{ID: id})
+}
+
+// MutedThreads returns the muted threads of the account, most recent first.
+func (a *Account) MutedThreads(ctx context.Context) ([]MutedThread, error) {
+	return bstore.QueryDB[MutedThread](ctx, a.DB).SortDesc("Created").List()
+}
+
+// ThreadMute mutes the thread of the message with messageID in the account. The
+// message-ids of the message itself and the messages it references are added to
+// the thread. ErrThreadMuted is returned if the message is already part of a
+// muted thread.
+func (a *Account) ThreadMute(ctx context.Context, log *mlog.Log, messageID string) (MutedThread, error) {
+	if !strings.HasPrefix(messageID, "<") {
+		messageID = "<" + messageID + ">"
+	}
+
+	var mt MutedThread
+	err := a.DB.Write(ctx, func(tx *bstore.Tx) error {
+		m, err := bstore.QueryTx[Message](tx).FilterNonzero(Message{MessageID: messageID}).Limit(1).Get()
+		if err == bstore.ErrAbsent {
+			return fmt.Errorf("%w: no message with message-id %s", err, messageID)
+		} else if err != nil {
+			return fmt.Errorf("looking up message: %w", err)
+		}
+
+		ids := []string{messageID}
+		f, err := os.Open(a.MessagePath(m.ID))
+		if err != nil {
+			return fmt.Errorf("open message: %w", err)
+		}
+		defer func() {
+			err := f.Close()
+			log.Check(err, "closing message file")
+		}()
+		subject, _, refs := threadHeaders(log, FileMsgReader(m.MsgPrefix, f))
+		ids = append(ids, refs...)
+
+		if n, err := bstore.QueryTx[MutedMessageID](tx).FilterEqual("MessageID", messageID).Count(); err != nil {
+			return err
+		} else if n > 0 {
+			return ErrThreadMuted
+		}
+		mt = MutedThread{Subject: subject}
+		if err := tx.Insert(&mt); err != nil {
+			return fmt.Errorf("inserting muted thread: %w", err)
+		}
+		return threadAddMessageIDs(tx, mt.ID, ids)
+	})
+	return mt, err
+}
+
+// ThreadUnmute removes a muted thread by ID.
+func (a *Account) ThreadUnmute(ctx context.Context, id int64) error {
+	return a.DB.Write(ctx, func(tx *bstore.Tx) error {
+		if _, err := bstore.QueryTx[MutedMessageID](tx).FilterNonzero(MutedMessageID{ThreadID: id}).Delete(); err != nil {
+			return fmt.Errorf("removing message-ids of thread: %w", err)
+		}
+		return tx.Delete(&MutedThread{ID: id})
+	})
+}
+
+// threadAddMessageIDs adds message-ids to a muted thread, skipping message-ids
+// that are already known.
+func threadAddMessageIDs(tx *bstore.Tx, threadID int64, ids []string) error {
+	for _, id := range ids {
+		exists, err := bstore.QueryTx[MutedMessageID](tx).FilterNonzero(MutedMessageID{MessageID: id}).Exists()
+		if err != nil {
+			return err
+		} else if exists {
+			continue
+		}
+		if err := tx.Insert(&MutedMessageID{MessageID: id, ThreadID: threadID}); err != nil {
+			return fmt.Errorf("inserting message-id of muted thread: %w", err)
+		}
+	}
+	return nil
+}
+
+// threadHeaders returns the subject, message-id and the message-ids from the
+// In-Reply-To and References headers of a message.
+func threadHeaders(log *mlog.Log, r *MsgReader) (subject, messageID string, refs []string) {
+	p, err := message.Parse(r)
+	if err != nil {
+		log.Infox("parsing message for thread headers", err)
+		return "", "", nil
+	}
+	h, err := p.Header()
+	if err != nil {
+		log.Infox("parsing message header for thread headers", err)
+		return "", "", nil
+	}
+	for _, s := range []string{h.Get("In-Reply-To"), h.Get("References")} {
+		for {
+			i := strings.Index(s, "<")
+			if i < 0 {
+				break
+			}
+			j := strings.Index(s[i:], ">")
+			if j < 0 {
+				break
+			}
+			refs = append(refs, s[i:i+j+1])
+			s = s[i+j+1:]
+		}
+	}
+	return h.Get("Subject"), strings.TrimSpace(h.Get("Message-Id")), refs
+}
+
+// blockedSender returns the blocked sender matching the message From address or
+// domain of m, or nil.
+func blockedSender(tx *bstore.Tx, m Message) (*BlockedSender, error) {
+	if m.MsgFromDomain == "" {
+		return nil, nil
+	}
+	addrs := []any{"@" + m.MsgFromDomain}
+	if m.MsgFromLocalpart != "" {
+		addrs = append(addrs, strings.ToLower(string(m.MsgFromLocalpart))+"@"+m.MsgFromDomain)
+	}
+	bs, err := bstore.QueryTx[BlockedSender](tx).FilterEqual("Address", addrs...).Limit(1).Get()
+	if err == bstore.ErrAbsent {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("looking up blocked sender: %w", err)
+	}
+	return &bs, nil
+}
+
+// DeliveryFilter is the result of applying the blocked senders and muted
+// threads of an account to an incoming message.
+type DeliveryFilter struct {
+	Drop    bool   // Message is from a blocked sender with action delete and must not be delivered.
+	Mailbox string // If non-empty, mailbox to deliver to instead of the destination mailbox.
+	Quiet   bool   // No notifications must be sent for the message.
+	Reason  string // "blocked", "muted" or "moderated", for logging.
+}
+
+// DeliveryFilter applies the blocked senders and muted threads of the account
+// to a message that is about to be delivered to dest. Messages in a muted thread
+// that would be delivered to the Inbox are marked as read and filed into the
+// Archive mailbox, and their message-id is added to the thread.
+func (a *Account) DeliveryFilter(log *mlog.Log, dest config.Destination, m *Message, msgFile *os.File) (df DeliveryFilter, rerr error) {
+	rerr = a.DB.Write(context.TODO(), func(tx *bstore.Tx) error {
+		// Blocked sender, by full address or domain.
+		if bs, err := blockedSender(tx, *m); err != nil {
+			return err
+		} else if bs != nil {
+			df.Reason = "blocked"
+			df.Quiet = true
+			if bs.Action == BlockActionDelete {
+				df.Drop = true
+				return nil
+			}
+			df.Mailbox, err = a.DeliveryMailbox(tx, `\Junk`)
+			return err
+		}
+
+		// Muted thread. Only messages that would be delivered to the Inbox are filed
+		// away, rulesets still apply.
+		_, messageID, refs := threadHeaders(log, FileMsgReader(m.MsgPrefix, msgFile))
+		if len(refs) == 0 {
+			return nil
+		}
+		var xrefs []any
+		for _, ref := range refs {
+			xrefs = append(xrefs, ref)
+		}
+		mid, err := bstore.QueryTx[MutedMessageID](tx).FilterEqual("MessageID", xrefs...).Limit(1).Get()
+		if err == bstore.ErrAbsent {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("looking up muted thread: %w", err)
+		}
+		if messageID != "" {
+			if err := threadAddMessageIDs(tx, mid.ThreadID, []string{messageID}); err != nil {
+				return err
+			}
+		}
+		df.Reason = "muted"
+		df.Quiet = true
+		mailbox := dest.Mailbox
+		if rs := MessageRuleset(log, dest, m, m.MsgPrefix, msgFile); rs != nil {
+			mailbox = rs.Mailbox
+		}
+		if mailbox != "" && !strings.EqualFold(mailbox, "Inbox") {
+			return nil
+		}
+		m.Seen = true
+		df.Mailbox, err = a.DeliveryMailbox(tx, `\Archive`)
+		return err
+	})
+	return
+}
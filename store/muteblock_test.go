@@ -0,0 +1,132 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestMuteBlock(t *testing.T) {
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = "../testdata/store/mox.conf"
+	mox.ConfigDynamicPath = filepath.Join(filepath.Dir(mox.ConfigStaticPath), "domains.conf")
+	mox.MustLoadConfig(true, false)
+	acc, err := OpenAccount("mjl2")
+	tcheck(t, err, "open account")
+	defer acc.Close()
+	switchDone := Switchboard()
+	defer close(switchDone)
+
+	log := mlog.New("muteblock")
+
+	// deliver applies the delivery filter and delivers the message, returning the
+	// filter and the mailbox the message was delivered to.
+	deliver := func(from, headers string) (DeliveryFilter, Message) {
+		t.Helper()
+		msg := "From: <" + from + ">\r\n" + headers + "Subject: test\r\n\r\ntest\r\n"
+		msgFile, err := CreateMessageTemp("muteblock")
+		tcheck(t, err, "create temp")
+		defer os.Remove(msgFile.Name())
+		defer msgFile.Close()
+		_, err = msgFile.Write([]byte(msg))
+		tcheck(t, err, "write message")
+		m := Message{Size: int64(len(msg)), MsgFromLocalpart: "remote", MsgFromDomain: "remote.example"}
+		if from != "remote@remote.example" {
+			m.MsgFromLocalpart = "other"
+			m.MsgFromDomain = "other.example"
+		}
+		df, err := acc.DeliveryFilter(log, config.Destination{}, &m, msgFile)
+		tcheck(t, err, "delivery filter")
+		if df.Drop {
+			return df, Message{}
+		}
+		mailbox := df.Mailbox
+		if mailbox == "" {
+			mailbox = "Inbox"
+		}
+		acc.WithWLock(func() {
+			err = acc.DeliverMailbox(log, mailbox, &m, msgFile, false)
+		})
+		tcheck(t, err, "deliver")
+		return df, m
+	}
+
+	mailboxName := func(m Message) string {
+		t.Helper()
+		mb := Mailbox{ID: m.MailboxID}
+		err := acc.DB.Get(ctxbg, &mb)
+		tcheck(t, err, "get mailbox")
+		return mb.Name
+	}
+
+	// Blocked senders.
+	_, err = acc.BlockedSenderAdd(ctxbg, "Remote@Remote.example", BlockActionJunk)
+	tcheck(t, err, "block sender")
+	if _, err := acc.BlockedSenderAdd(ctxbg, "remote@remote.example", BlockActionDelete); !errors.Is(err, ErrBlockedSenderExists) {
+		t.Fatalf("blocking sender again, got err %v, expected ErrBlockedSenderExists", err)
+	}
+	if _, err := acc.BlockedSenderAdd(ctxbg, "@other.example", "bogus"); !errors.Is(err, ErrBlockedSenderInvalid) {
+		t.Fatalf("blocking with bad action, got err %v, expected ErrBlockedSenderInvalid", err)
+	}
+	dom, err := acc.BlockedSenderAdd(ctxbg, "@other.example", BlockActionDelete)
+	tcheck(t, err, "block domain")
+
+	df, m := deliver("remote@remote.example", "Message-Id: <1@remote.example>\r\n")
+	if df.Reason != "blocked" || !df.Quiet || mailboxName(m) != "Junk" {
+		t.Fatalf("got filter %#v, mailbox %q, expected blocked into junk", df, mailboxName(m))
+	}
+	df, _ = deliver("other@other.example", "Message-Id: <2@other.example>\r\n")
+	if !df.Drop {
+		t.Fatalf("got filter %#v, expected drop for blocked domain", df)
+	}
+	l, err := acc.BlockedSenders(ctxbg)
+	tcheck(t, err, "list blocked senders")
+	if len(l) != 2 || l[0].Address != "@other.example" || l[1].Address != "remote@remote.example" {
+		t.Fatalf("got blocked senders %#v", l)
+	}
+	err = acc.BlockedSenderRemove(ctxbg, dom.ID)
+	tcheck(t, err, "remove blocked sender")
+
+	// Muted threads.
+	df, m = deliver("other@other.example", "Message-Id: <root@other.example>\r\n")
+	if df.Reason != "" || mailboxName(m) != "Inbox" {
+		t.Fatalf("got filter %#v, mailbox %q, expected regular delivery", df, mailboxName(m))
+	}
+	if _, err := acc.ThreadMute(ctxbg, log, "bogus@other.example"); !errors.Is(err, bstore.ErrAbsent) {
+		t.Fatalf("muting thread for unknown message, got err %v, expected ErrAbsent", err)
+	}
+	mt, err := acc.ThreadMute(ctxbg, log, "root@other.example")
+	tcheck(t, err, "mute thread")
+	if _, err := acc.ThreadMute(ctxbg, log, "<root@other.example>"); !errors.Is(err, ErrThreadMuted) {
+		t.Fatalf("muting thread again, got err %v, expected ErrThreadMuted", err)
+	}
+
+	df, m = deliver("other@other.example", "Message-Id: <reply@other.example>\r\nIn-Reply-To: <root@other.example>\r\n")
+	if df.Reason != "muted" || !df.Quiet || !m.Seen || mailboxName(m) != "Archive" {
+		t.Fatalf("got filter %#v, mailbox %q, seen %v, expected muted into archive", df, mailboxName(m), m.Seen)
+	}
+	// Reply to the reply, without references to the root message.
+	df, m = deliver("other@other.example", "Message-Id: <reply2@other.example>\r\nReferences: <reply@other.example>\r\n")
+	if df.Reason != "muted" || mailboxName(m) != "Archive" {
+		t.Fatalf("got filter %#v, mailbox %q, expected muted into archive", df, mailboxName(m))
+	}
+
+	err = acc.ThreadUnmute(ctxbg, mt.ID)
+	tcheck(t, err, "unmute thread")
+	df, m = deliver("other@other.example", "Message-Id: <reply3@other.example>\r\nReferences: <root@other.example>\r\n")
+	if df.Reason != "" || mailboxName(m) != "Inbox" {
+		t.Fatalf("got filter %#v, mailbox %q, expected regular delivery after unmute", df, mailboxName(m))
+	}
+	mtl, err := acc.MutedThreads(ctxbg)
+	tcheck(t, err, "list muted threads")
+	if len(mtl) != 0 {
+		t.Fatalf("got %d muted threads after unmute, expected 0", len(mtl))
+	}
+}
@@ -0,0 +1,99 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+)
+
+// POP3Update removes the messages with ids from the Inbox, for messages a POP3
+// client deleted during its session. Messages no longer in the Inbox are
+// skipped. With keep, e.g. for accounts with POP3LeaveOnServer or on hold, the
+// messages are marked as read instead of being removed. The number of messages
+// removed or kept is returned.
+//
+// Caller must hold account wlock.
+// Changes are broadcasted.
+func (a *Account) POP3Update(log *mlog.Log, ids []int64, keep bool) (int, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	var n int
+	var changes []Change
+	var remove []Message
+	defer func() {
+		for _, m := range remove {
+			p := a.MessagePath(m.ID)
+			err := os.Remove(p)
+			log.Check(err, "removing message file", mlog.Field("path", p))
+		}
+	}()
+
+	err := a.DB.Write(context.TODO(), func(tx *bstore.Tx) error {
+		mb, err := a.MailboxFind(tx, "Inbox")
+		if err != nil {
+			return fmt.Errorf("finding inbox: %w", err)
+		}
+		if mb == nil {
+			return nil
+		}
+
+		q := bstore.QueryTx[Message](tx)
+		q.FilterIDs(ids)
+		q.FilterNonzero(Message{MailboxID: mb.ID})
+		msgs, err := q.List()
+		if err != nil {
+			return fmt.Errorf("listing messages: %w", err)
+		}
+		n = len(msgs)
+
+		if !keep {
+			changes, err = a.removeMessages(context.TODO(), log, tx, mb, msgs)
+			if err != nil {
+				return fmt.Errorf("removing messages: %w", err)
+			}
+			remove = msgs
+			return nil
+		}
+
+		var modseq ModSeq
+		for _, m := range msgs {
+			if m.Seen {
+				continue
+			}
+			if modseq == 0 {
+				modseq, err = a.NextModSeq(tx)
+				if err != nil {
+					return fmt.Errorf("assigning modseq: %w", err)
+				}
+			}
+			om := m
+			m.Seen = true
+			m.ModSeq = modseq
+			if err := tx.Update(&m); err != nil {
+				return fmt.Errorf("updating message flags: %w", err)
+			}
+			if err := MailboxCountsUpdate(tx, om, m); err != nil {
+				return err
+			}
+			changes = append(changes, ChangeFlags{MailboxID: mb.ID, UID: m.UID, ModSeq: m.ModSeq, Mask: Flags{Seen: true}, Flags: m.Flags, Keywords: m.Keywords})
+		}
+		return nil
+	})
+	if err != nil {
+		remove = nil // Don't remove files on failure.
+		return 0, err
+	}
+
+	if len(changes) > 0 {
+		comm := RegisterComm(a)
+		defer comm.Unregister()
+		comm.Broadcast(changes)
+	}
+	return n, nil
+}
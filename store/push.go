@@ -0,0 +1,66 @@
+package store
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/mjl-/bstore"
+)
+
+// PushSubscription is a browser subscribed to Web Push notifications for new
+// messages, with criteria for messages to notify about.
+type PushSubscription struct {
+	ID       int64
+	Created  time.Time `bstore:"default now"`
+	Endpoint string    `bstore:"nonzero,unique"` // URL at push service, unique per browser.
+	P256dh   string    `bstore:"nonzero"`        // Public key of browser, base64url.
+	Auth     string    `bstore:"nonzero"`        // Authentication secret, base64url.
+
+	Name      string // Description by user, e.g. "phone".
+	Mailbox   string // If set, only notify for messages delivered to this mailbox. Otherwise for any mailbox except Junk.
+	From      string // If set, only notify for messages with this substring in the From address, case-insensitive.
+	Important bool   // If set, only notify for messages marked as high priority.
+}
+
+// Matches returns whether a message delivered to mailbox mb, with message From
+// address from, should result in a notification.
+func (s PushSubscription) Matches(mb Mailbox, from string, important bool) bool {
+	if s.Mailbox != "" && s.Mailbox != mb.Name || s.Mailbox == "" && mb.Junk {
+		return false
+	}
+	if s.From != "" && !strings.Contains(strings.ToLower(from), strings.ToLower(s.From)) {
+		return false
+	}
+	return !s.Important || important
+}
+
+// PushSubscriptions returns all push subscriptions of the account.
+func (a *Account) PushSubscriptions(ctx context.Context) ([]PushSubscription, error) {
+	return bstore.QueryDB[PushSubscription](ctx, a.DB).SortAsc("ID").List()
+}
+
+// PushSubscriptionAdd adds a push subscription. An existing subscription for the
+// same endpoint is replaced, browsers subscribe again when keys change.
+func (a *Account) PushSubscriptionAdd(ctx context.Context, s *PushSubscription) error {
+	return a.DB.Write(ctx, func(tx *bstore.Tx) error {
+		_, err := bstore.QueryTx[PushSubscription](tx).FilterNonzero(PushSubscription{Endpoint: s.Endpoint}).Delete()
+		if err != nil {
+			return err
+		}
+		s.ID = 0
+		return tx.Insert(s)
+	})
+}
+
+// PushSubscriptionRemove removes a push subscription by ID.
+func (a *Account) PushSubscriptionRemove(ctx context.Context, id int64) error {
+	return a.DB.Delete(ctx, &PushSubscription{ID: id})
+}
+
+// PushSubscriptionRemoveEndpoint removes the push subscription for endpoint, e.g.
+// after the push service indicated it is no longer valid.
+func (a *Account) PushSubscriptionRemoveEndpoint(ctx context.Context, endpoint string) error {
+	_, err := bstore.QueryDB[PushSubscription](ctx, a.DB).FilterNonzero(PushSubscription{Endpoint: endpoint}).Delete()
+	return err
+}
@@ -0,0 +1,61 @@
+package store
+
+import (
+	"os"
+	"testing"
+
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestPushSubscriptions(t *testing.T) {
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = "../testdata/store/mox.conf"
+	mox.MustLoadConfig(true, false)
+	acc, err := OpenAccount("mjl")
+	tcheck(t, err, "open account")
+	defer acc.Close()
+
+	s := PushSubscription{Endpoint: "https://push.example/1", P256dh: "key", Auth: "auth", Name: "phone"}
+	err = acc.PushSubscriptionAdd(ctxbg, &s)
+	tcheck(t, err, "add subscription")
+	// Same endpoint replaces subscription.
+	s2 := PushSubscription{Endpoint: "https://push.example/1", P256dh: "key2", Auth: "auth2", Mailbox: "Inbox"}
+	err = acc.PushSubscriptionAdd(ctxbg, &s2)
+	tcheck(t, err, "add subscription")
+	s3 := PushSubscription{Endpoint: "https://push.example/3", P256dh: "key", Auth: "auth"}
+	err = acc.PushSubscriptionAdd(ctxbg, &s3)
+	tcheck(t, err, "add subscription")
+
+	l, err := acc.PushSubscriptions(ctxbg)
+	tcheck(t, err, "list subscriptions")
+	if len(l) != 2 || l[0].ID != s2.ID || l[0].P256dh != "key2" || l[1].ID != s3.ID {
+		t.Fatalf("got subscriptions %#v, expected s2 and s3", l)
+	}
+
+	err = acc.PushSubscriptionRemove(ctxbg, s2.ID)
+	tcheck(t, err, "remove subscription")
+	err = acc.PushSubscriptionRemoveEndpoint(ctxbg, s3.Endpoint)
+	tcheck(t, err, "remove subscription by endpoint")
+	l, err = acc.PushSubscriptions(ctxbg)
+	tcheck(t, err, "list subscriptions")
+	if len(l) != 0 {
+		t.Fatalf("got %d subscriptions, expected 0", len(l))
+	}
+
+	inbox := Mailbox{Name: "Inbox"}
+	junk := Mailbox{Name: "Junk", Junk: true}
+	test := func(s PushSubscription, mb Mailbox, from string, important, exp bool) {
+		t.Helper()
+		if r := s.Matches(mb, from, important); r != exp {
+			t.Fatalf("matches %#v for mailbox %s, from %q, important %v: got %v, expected %v", s, mb.Name, from, important, r, exp)
+		}
+	}
+	test(PushSubscription{}, inbox, "", false, true)
+	test(PushSubscription{}, junk, "", false, false)
+	test(PushSubscription{Mailbox: "Junk"}, junk, "", false, true)
+	test(PushSubscription{Mailbox: "Junk"}, inbox, "", false, false)
+	test(PushSubscription{From: "@Boss.example"}, inbox, "Boss <boss@boss.example>", false, true)
+	test(PushSubscription{From: "@boss.example"}, inbox, "other@other.example", false, false)
+	test(PushSubscription{Important: true}, inbox, "", false, false)
+	test(PushSubscription{Important: true}, inbox, "", true, true)
+}
@@ -0,0 +1,103 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/mjl-/bstore"
+)
+
+// ErrOverQuota is returned when adding messages would exceed the quota of the
+// account.
+var ErrOverQuota = errors.New("account over quota")
+
+// DiskUsage is the number and total size of the messages in the account. It is
+// kept up to date when messages are added and removed, so quota usage can be
+// reported and checked without going through all messages. There is a single
+// record, with ID 1.
+type DiskUsage struct {
+	ID           int64
+	MessageCount int64
+	MessageSize  int64
+}
+
+// Quota is the usage of an account with its limits. A zero limit means no
+// limit.
+type Quota struct {
+	MessageCount    int64
+	MessageSize     int64
+	MaxMessageCount int64
+	MaxMessageSize  int64
+}
+
+// diskUsageEnsure adds the DiskUsage record for an account that doesn't have
+// one yet, e.g. after upgrading, by going through all messages once.
+func diskUsageEnsure(ctx context.Context, db *bstore.DB) error {
+	return db.Write(ctx, func(tx *bstore.Tx) error {
+		du := DiskUsage{ID: 1}
+		if err := tx.Get(&du); err == nil {
+			return nil
+		} else if err != bstore.ErrAbsent {
+			return fmt.Errorf("get disk usage: %w", err)
+		}
+		err := bstore.QueryTx[Message](tx).ForEach(func(m Message) error {
+			du.MessageCount++
+			du.MessageSize += m.Size
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("gathering message sizes: %w", err)
+		}
+		return tx.Insert(&du)
+	})
+}
+
+// DiskUsage returns the number and total size of the messages in the account.
+func (a *Account) DiskUsage(tx *bstore.Tx) (DiskUsage, error) {
+	du := DiskUsage{ID: 1}
+	if err := tx.Get(&du); err != nil {
+		return DiskUsage{}, fmt.Errorf("get disk usage: %w", err)
+	}
+	return du, nil
+}
+
+// AddMessageUsage adds count messages with a total of size bytes to the disk
+// usage of the account. Negative values are used for removed messages. Must be
+// called in the same transaction that adds or removes the messages.
+func (a *Account) AddMessageUsage(tx *bstore.Tx, count, size int64) error {
+	du, err := a.DiskUsage(tx)
+	if err != nil {
+		return err
+	}
+	du.MessageCount += count
+	du.MessageSize += size
+	if err := tx.Update(&du); err != nil {
+		return fmt.Errorf("updating disk usage: %w", err)
+	}
+	return nil
+}
+
+// Quota returns the usage of the account with the quota from the account
+// configuration.
+func (a *Account) Quota(tx *bstore.Tx) (Quota, error) {
+	du, err := a.DiskUsage(tx)
+	if err != nil {
+		return Quota{}, err
+	}
+	conf, _ := a.Conf()
+	return Quota{du.MessageCount, du.MessageSize, conf.QuotaMessageCount, conf.QuotaMessageSize}, nil
+}
+
+// CheckQuota returns ErrOverQuota if adding count messages with a total of size
+// bytes would exceed the quota of the account.
+func (a *Account) CheckQuota(tx *bstore.Tx, count, size int64) error {
+	q, err := a.Quota(tx)
+	if err != nil {
+		return err
+	}
+	if q.MaxMessageCount > 0 && q.MessageCount+count > q.MaxMessageCount || q.MaxMessageSize > 0 && q.MessageSize+size > q.MaxMessageSize {
+		return ErrOverQuota
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestQuota(t *testing.T) {
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = "../testdata/store/mox.conf"
+	mox.ConfigDynamicPath = filepath.Join(filepath.Dir(mox.ConfigStaticPath), "domains.conf")
+	mox.MustLoadConfig(true, false)
+	acc, err := OpenAccount("mjl2")
+	tcheck(t, err, "open account")
+	defer acc.Close()
+	switchDone := Switchboard()
+	defer close(switchDone)
+
+	log := mlog.New("quota")
+
+	deliver := func() {
+		t.Helper()
+		msg := "Subject: test\r\n\r\ntest\r\n"
+		msgFile, err := CreateMessageTemp("quota")
+		tcheck(t, err, "create temp")
+		defer os.Remove(msgFile.Name())
+		defer msgFile.Close()
+		_, err = msgFile.Write([]byte(msg))
+		tcheck(t, err, "write message")
+		m := Message{Size: int64(len(msg))}
+		acc.WithWLock(func() {
+			err = acc.DeliverMailbox(log, "Inbox", &m, msgFile, false)
+		})
+		tcheck(t, err, "deliver")
+	}
+
+	xquota := func(expCount, expSize int64) Quota {
+		t.Helper()
+		var q Quota
+		err := acc.DB.Read(ctxbg, func(tx *bstore.Tx) error {
+			var err error
+			q, err = acc.Quota(tx)
+			return err
+		})
+		tcheck(t, err, "get quota")
+		if q.MessageCount != expCount || q.MessageSize != expSize {
+			t.Fatalf("got usage %d messages, %d bytes, expected %d, %d", q.MessageCount, q.MessageSize, expCount, expSize)
+		}
+		return q
+	}
+
+	xquota(0, 0)
+	deliver()
+	deliver()
+	xquota(2, 2*23)
+
+	// Limits from the configuration.
+	accConf := mox.Conf.Dynamic.Accounts["mjl2"]
+	nc := accConf
+	nc.QuotaMessageCount = 2
+	mox.Conf.Dynamic.Accounts["mjl2"] = nc
+	defer func() {
+		mox.Conf.Dynamic.Accounts["mjl2"] = accConf
+	}()
+	if q := xquota(2, 2*23); q.MaxMessageCount != 2 || q.MaxMessageSize != 0 {
+		t.Fatalf("got limits %d, %d, expected 2, 0", q.MaxMessageCount, q.MaxMessageSize)
+	}
+	err = acc.DB.Read(ctxbg, func(tx *bstore.Tx) error {
+		return acc.CheckQuota(tx, 1, 1)
+	})
+	if !errors.Is(err, ErrOverQuota) {
+		t.Fatalf("got err %v, expected ErrOverQuota", err)
+	}
+
+	// Removing messages lowers usage.
+	removed, _, err := acc.RemoveMessagesBefore(log, "Inbox", time.Now().Add(time.Minute), 0)
+	tcheck(t, err, "remove messages")
+	if removed != 2 {
+		t.Fatalf("removed %d messages, expected 2", removed)
+	}
+	xquota(0, 0)
+
+	// The usage record is computed again when missing, e.g. for accounts from before
+	// usage was tracked.
+	deliver()
+	err = acc.DB.Delete(ctxbg, &DiskUsage{ID: 1})
+	tcheck(t, err, "remove disk usage")
+	err = diskUsageEnsure(ctxbg, acc.DB)
+	tcheck(t, err, "ensure disk usage")
+	xquota(1, 23)
+}
@@ -0,0 +1,273 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+)
+
+// ReanalyzeMove is a message that re-analysis moved to another mailbox, or
+// would move if refiling was not requested.
+type ReanalyzeMove struct {
+	MessageID   int64
+	Received    time.Time
+	From        string
+	Subject     string
+	FromMailbox string
+	ToMailbox   string
+	Reason      string  // "blocked", "ruleset", "junk" or "notjunk".
+	Probability float64 // Junk filter spam probability, -1 if not evaluated.
+}
+
+// ReanalyzeReport is the result of re-analyzing recently delivered messages
+// with the current junk filter, blocked senders and delivery rulesets.
+type ReanalyzeReport struct {
+	Start    time.Time
+	End      time.Time // Zero while the analysis is running.
+	Days     int
+	Refile   bool
+	Analyzed int
+	Moves    []ReanalyzeMove // Messages that were moved, or that would be moved without Refile.
+	Error    string          // If the analysis failed.
+}
+
+// Reanalyze evaluates messages received in the past days in the Inbox and Junk
+// mailboxes again, as if they were delivered now: Inbox messages from blocked
+// senders, scoring above the junk filter threshold or matching a ruleset for
+// another mailbox are moved out of the Inbox. Messages in the Junk mailbox that
+// are not from a blocked sender and that the junk filter now considers clearly
+// ham, i.e. scoring below 1-threshold, are moved to the mailbox the rulesets
+// select, typically the Inbox. Messages that are no longer in the mailbox they
+// were delivered to, e.g. moved by a user, and Inbox messages that a user marked
+// as not junk are kept in place.
+//
+// If refile is false, nothing is changed and the report lists the moves that
+// would be made. The messages are analyzed without holding the account lock,
+// messages that changed mailbox in the meantime are skipped when refiling.
+//
+// Changes are broadcasted.
+func (a *Account) Reanalyze(ctx context.Context, log *mlog.Log, days int, refile bool) (report ReanalyzeReport, rerr error) {
+	report = ReanalyzeReport{Start: time.Now(), Days: days, Refile: refile}
+	defer func() {
+		report.End = time.Now()
+		if rerr != nil {
+			report.Error = rerr.Error()
+		}
+	}()
+	if days <= 0 {
+		return report, errors.New("number of days must be positive")
+	}
+
+	// Gather candidate messages.
+	var inbox, junkmb *Mailbox
+	var msgs []Message
+	a.WithRLock(func() {
+		rerr = a.DB.Read(ctx, func(tx *bstore.Tx) error {
+			var err error
+			inbox, err = a.MailboxFind(tx, "Inbox")
+			if err != nil {
+				return fmt.Errorf("looking up inbox: %w", err)
+			}
+			junkName, err := a.DeliveryMailbox(tx, `\Junk`)
+			if err != nil {
+				return err
+			}
+			junkmb, err = a.MailboxFind(tx, junkName)
+			if err != nil {
+				return fmt.Errorf("looking up junk mailbox: %w", err)
+			}
+			var ids []any
+			for _, mb := range []*Mailbox{inbox, junkmb} {
+				if mb != nil {
+					ids = append(ids, mb.ID)
+				}
+			}
+			if len(ids) == 0 {
+				return nil
+			}
+			q := bstore.QueryTx[Message](tx)
+			q.FilterEqual("MailboxID", ids...)
+			q.FilterGreaterEqual("Received", report.Start.AddDate(0, 0, -days))
+			q.FilterFn(func(m Message) bool {
+				return m.MailboxOrigID == m.MailboxID
+			})
+			q.SortAsc("Received")
+			msgs, err = q.List()
+			return err
+		})
+	})
+	if rerr != nil {
+		return report, fmt.Errorf("listing messages: %w", rerr)
+	}
+
+	f, jf, err := a.OpenJunkFilter(ctx, log)
+	if err != nil && !errors.Is(err, ErrNoJunkFilter) {
+		return report, fmt.Errorf("open junk filter: %w", err)
+	}
+	if f != nil {
+		defer func() {
+			err := f.Close()
+			log.Check(err, "closing junk filter")
+		}()
+	}
+
+	// Determine the mailbox each message should be in.
+	var moves []Message
+	for _, m := range msgs {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		report.Analyzed++
+
+		mv := ReanalyzeMove{MessageID: m.ID, Received: m.Received, From: msgFromAddress(m), Probability: -1}
+		isJunk := junkmb != nil && m.MailboxID == junkmb.ID
+		if isJunk {
+			mv.FromMailbox = junkmb.Name
+		} else {
+			mv.FromMailbox = inbox.Name
+		}
+
+		var blocked bool
+		err := a.DB.Read(ctx, func(tx *bstore.Tx) error {
+			bs, err := blockedSender(tx, m)
+			blocked = bs != nil
+			return err
+		})
+		if err != nil {
+			return report, err
+		}
+
+		mr := a.MessageReader(m)
+		if p, err := m.LoadPart(mr); err == nil && p.Envelope != nil {
+			mv.Subject = p.Envelope.Subject
+		}
+		if f != nil && (blocked || !m.Notjunk) {
+			mv.Probability, _, _, _, err = f.ClassifyMessageReader(ctx, mr, m.Size)
+			if err != nil {
+				log.Infox("classifying message for re-analysis, skipping", err, mlog.Field("msgid", m.ID))
+				mv.Probability = -1
+			}
+		}
+		err = mr.Close()
+		log.Check(err, "closing message reader")
+
+		if !isJunk {
+			if blocked {
+				mv.Reason = "blocked"
+			} else if mailbox, err := a.redeliverMailbox(log, m); err != nil {
+				log.Infox("evaluating rulesets for re-analysis, skipping", err, mlog.Field("msgid", m.ID))
+			} else if mailbox != "" && !strings.EqualFold(mailbox, "Inbox") {
+				mv.ToMailbox = mailbox
+				mv.Reason = "ruleset"
+			} else if jf != nil && !m.Notjunk && mv.Probability >= jf.Threshold {
+				mv.Reason = "junk"
+			}
+			if mv.Reason == "blocked" || mv.Reason == "junk" {
+				mv.ToMailbox = `\Junk`
+			}
+		} else if !blocked && jf != nil && mv.Probability >= 0 && mv.Probability < 1-jf.Threshold {
+			mailbox, err := a.redeliverMailbox(log, m)
+			if err != nil {
+				log.Infox("evaluating rulesets for re-analysis, skipping", err, mlog.Field("msgid", m.ID))
+				continue
+			}
+			if mailbox == "" {
+				mailbox = "Inbox"
+			}
+			mv.ToMailbox = mailbox
+			mv.Reason = "notjunk"
+		}
+		if mv.Reason == "" {
+			continue
+		}
+
+		// Resolve special-use names, and skip rulesets that deliver to the same mailbox.
+		err = a.DB.Read(ctx, func(tx *bstore.Tx) error {
+			var err error
+			mv.ToMailbox, err = a.DeliveryMailbox(tx, mv.ToMailbox)
+			return err
+		})
+		if err != nil {
+			return report, err
+		}
+		if strings.EqualFold(mv.ToMailbox, "Inbox") {
+			mv.ToMailbox = "Inbox"
+		}
+		if mv.ToMailbox == mv.FromMailbox {
+			continue
+		}
+		report.Moves = append(report.Moves, mv)
+		moves = append(moves, m)
+	}
+
+	if !refile || len(moves) == 0 {
+		return report, nil
+	}
+
+	var changes []Change
+	a.WithWLock(func() {
+		rerr = a.DB.Write(ctx, func(tx *bstore.Tx) error {
+			mailboxes := map[int64]*Mailbox{}
+			type move struct {
+				src, dst int64
+			}
+			var moveOrder []move
+			bymove := map[move][]Message{}
+			var moved []ReanalyzeMove
+			for i, om := range moves {
+				// Skip messages that were moved or removed while we were analyzing.
+				m := Message{ID: om.ID}
+				if err := tx.Get(&m); err == bstore.ErrAbsent {
+					continue
+				} else if err != nil {
+					return fmt.Errorf("get message: %w", err)
+				}
+				if m.MailboxID != om.MailboxID || m.UID != om.UID {
+					continue
+				}
+				if _, ok := mailboxes[m.MailboxID]; !ok {
+					mb := Mailbox{ID: m.MailboxID}
+					if err := tx.Get(&mb); err != nil {
+						return fmt.Errorf("get mailbox: %w", err)
+					}
+					mailboxes[mb.ID] = &mb
+				}
+				mbDst, mbChanges, err := a.MailboxEnsure(tx, report.Moves[i].ToMailbox, true)
+				if err != nil {
+					return fmt.Errorf("ensuring destination mailbox: %w", err)
+				}
+				changes = append(changes, mbChanges...)
+				if _, ok := mailboxes[mbDst.ID]; !ok {
+					mailboxes[mbDst.ID] = &mbDst
+				}
+				k := move{m.MailboxID, mbDst.ID}
+				if _, ok := bymove[k]; !ok {
+					moveOrder = append(moveOrder, k)
+				}
+				bymove[k] = append(bymove[k], m)
+				moved = append(moved, report.Moves[i])
+			}
+			for _, k := range moveOrder {
+				mvChanges, err := a.moveMessages(ctx, log, tx, mailboxes[k.src], mailboxes[k.dst], bymove[k])
+				if err != nil {
+					return fmt.Errorf("moving messages: %w", err)
+				}
+				changes = append(changes, mvChanges...)
+			}
+			report.Moves = moved
+			return nil
+		})
+		if rerr == nil && len(changes) > 0 {
+			comm := RegisterComm(a)
+			defer comm.Unregister()
+			comm.Broadcast(changes)
+		}
+	})
+	return report, rerr
+}
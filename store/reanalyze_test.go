@@ -0,0 +1,93 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/smtp"
+)
+
+func TestReanalyze(t *testing.T) {
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = "../testdata/store/mox.conf"
+	mox.ConfigDynamicPath = filepath.Join(filepath.Dir(mox.ConfigStaticPath), "domains.conf")
+	mox.MustLoadConfig(true, false)
+	acc, err := OpenAccount("mjl2")
+	tcheck(t, err, "open account")
+	defer acc.Close()
+	switchDone := Switchboard()
+	defer close(switchDone)
+
+	log := mlog.New("reanalyze")
+
+	deliver := func(mailbox, fromLocalpart, fromDomain string) Message {
+		t.Helper()
+		msg := "From: <" + fromLocalpart + "@" + fromDomain + ">\r\nSubject: test\r\n\r\ntest\r\n"
+		msgFile, err := CreateMessageTemp("reanalyze")
+		tcheck(t, err, "create temp")
+		defer os.Remove(msgFile.Name())
+		defer msgFile.Close()
+		_, err = msgFile.Write([]byte(msg))
+		tcheck(t, err, "write message")
+		m := Message{Size: int64(len(msg)), MsgFromLocalpart: smtp.Localpart(fromLocalpart), MsgFromDomain: fromDomain}
+		acc.WithWLock(func() {
+			err = acc.DeliverMailbox(log, mailbox, &m, msgFile, false)
+		})
+		tcheck(t, err, "deliver")
+		return m
+	}
+
+	mailboxName := func(id int64) string {
+		t.Helper()
+		m := Message{ID: id}
+		err := acc.DB.Get(ctxbg, &m)
+		tcheck(t, err, "get message")
+		mb := Mailbox{ID: m.MailboxID}
+		err = acc.DB.Get(ctxbg, &mb)
+		tcheck(t, err, "get mailbox")
+		return mb.Name
+	}
+
+	if _, err := acc.Reanalyze(ctxbg, log, 0, false); err == nil {
+		t.Fatalf("reanalyze with zero days, expected error")
+	}
+
+	blocked := deliver("Inbox", "remote", "remote.example")
+	deliver("Inbox", "other", "other.example")
+	deliver("Junk", "junk", "junk.example")
+
+	_, err = acc.BlockedSenderAdd(ctxbg, "remote@remote.example", BlockActionJunk)
+	tcheck(t, err, "block sender")
+
+	// Without refiling, only a report is made.
+	report, err := acc.Reanalyze(ctxbg, log, 7, false)
+	tcheck(t, err, "reanalyze")
+	if report.Analyzed != 3 || len(report.Moves) != 1 || report.End.IsZero() {
+		t.Fatalf("got report %#v, expected 3 analyzed and 1 move", report)
+	}
+	if mv := report.Moves[0]; mv.MessageID != blocked.ID || mv.Reason != "blocked" || mv.FromMailbox != "Inbox" || mv.ToMailbox != "Junk" {
+		t.Fatalf("got move %#v, expected blocked message from inbox to junk", mv)
+	}
+	if name := mailboxName(blocked.ID); name != "Inbox" {
+		t.Fatalf("message in mailbox %q after report, expected Inbox", name)
+	}
+
+	report, err = acc.Reanalyze(ctxbg, log, 7, true)
+	tcheck(t, err, "reanalyze with refile")
+	if len(report.Moves) != 1 {
+		t.Fatalf("got %d moves, expected 1", len(report.Moves))
+	}
+	if name := mailboxName(blocked.ID); name != "Junk" {
+		t.Fatalf("message in mailbox %q after refile, expected Junk", name)
+	}
+
+	// The moved message is no longer in the mailbox it was delivered to, so left alone.
+	report, err = acc.Reanalyze(ctxbg, log, 7, true)
+	tcheck(t, err, "reanalyze again")
+	if report.Analyzed != 2 || len(report.Moves) != 0 {
+		t.Fatalf("got report %#v, expected 2 analyzed and no moves", report)
+	}
+}
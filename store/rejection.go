@@ -0,0 +1,47 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/mjl-/bstore"
+)
+
+// RejectionRetention is how long rejections of incoming messages are kept.
+const RejectionRetention = 30 * 24 * time.Hour
+
+// Rejection is an incoming message for the account that was rejected during the
+// SMTP transaction. Rejections are kept for RejectionRetention, so the account
+// holder can find out why a message did not arrive. Only information the sender
+// could also see is stored, such as the error message returned to the sender.
+type Rejection struct {
+	ID       int64
+	Time     time.Time `bstore:"default now,index"`
+	MailFrom string    // SMTP MAIL FROM, can be empty.
+	MsgFrom  string    // Address from message From header, can be empty.
+	RcptTo   string    // SMTP RCPT TO, address of the account.
+	Reason   string    // Short reason, e.g. "junk", "dmarc", "dnsbl", "highrate".
+	Error    string    // Error message returned to the sender.
+}
+
+// RejectionAdd records a rejection of an incoming message. Rejections older than
+// RejectionRetention are removed.
+func (a *Account) RejectionAdd(ctx context.Context, r *Rejection) error {
+	return a.DB.Write(ctx, func(tx *bstore.Tx) error {
+		q := bstore.QueryTx[Rejection](tx)
+		q.FilterLess("Time", time.Now().Add(-RejectionRetention))
+		if _, err := q.Delete(); err != nil {
+			return err
+		}
+		return tx.Insert(r)
+	})
+}
+
+// Rejections returns the recorded rejections of incoming messages, most recent
+// first.
+func (a *Account) Rejections(ctx context.Context) ([]Rejection, error) {
+	q := bstore.QueryDB[Rejection](ctx, a.DB)
+	q.FilterGreater("Time", time.Now().Add(-RejectionRetention))
+	q.SortDesc("Time")
+	return q.List()
+}
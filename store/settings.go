@@ -0,0 +1,33 @@
+package store
+
+import (
+	"context"
+	"errors"
+
+	"github.com/mjl-/bstore"
+)
+
+// Settings returns the settings of the account, with defaults if they were
+// never saved.
+func (a *Account) Settings(ctx context.Context) (Settings, error) {
+	s := Settings{ID: 1}
+	err := a.DB.Get(ctx, &s)
+	if errors.Is(err, bstore.ErrAbsent) {
+		return Settings{ID: 1}, nil
+	}
+	return s, err
+}
+
+// SettingsSave stores the settings of the account.
+func (a *Account) SettingsSave(ctx context.Context, s Settings) error {
+	s.ID = 1
+	return a.DB.Write(ctx, func(tx *bstore.Tx) error {
+		err := tx.Get(&Settings{ID: 1})
+		if errors.Is(err, bstore.ErrAbsent) {
+			return tx.Insert(&s)
+		} else if err != nil {
+			return err
+		}
+		return tx.Update(&s)
+	})
+}
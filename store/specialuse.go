@@ -0,0 +1,141 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/mjl-/bstore"
+)
+
+// SpecialUse is the set of special-use attributes of a mailbox, indicating the
+// kind of messages it holds. An account has at most one mailbox for each
+// special-use, used for e.g. delivery of junk mail or copies of sent messages.
+//
+// ../rfc/6154
+type SpecialUse struct {
+	Archive bool
+	Draft   bool
+	Junk    bool
+	Sent    bool
+	Trash   bool
+}
+
+// SpecialUse returns the special-use attributes of the mailbox.
+func (mb Mailbox) SpecialUse() SpecialUse {
+	return SpecialUse{mb.Archive, mb.Draft, mb.Junk, mb.Sent, mb.Trash}
+}
+
+// specialUseAttrs are the IMAP special-use attributes with their default
+// mailbox name. "\Draft" is accepted as alternative spelling of "\Drafts", as
+// used in LIST responses.
+var specialUseAttrs = []struct {
+	attr        string
+	defaultName string
+	field       string
+	set         func(su *SpecialUse) *bool
+}{
+	{`\Archive`, "Archive", "Archive", func(su *SpecialUse) *bool { return &su.Archive }},
+	{`\Drafts`, "Drafts", "Draft", func(su *SpecialUse) *bool { return &su.Draft }},
+	{`\Draft`, "Drafts", "Draft", func(su *SpecialUse) *bool { return &su.Draft }},
+	{`\Junk`, "Junk", "Junk", func(su *SpecialUse) *bool { return &su.Junk }},
+	{`\Sent`, "Sent", "Sent", func(su *SpecialUse) *bool { return &su.Sent }},
+	{`\Trash`, "Trash", "Trash", func(su *SpecialUse) *bool { return &su.Trash }},
+}
+
+// Add adds the special-use attribute attr, e.g. `\Junk`, matched case
+// insensitively. False is returned if attr is not a supported special-use
+// attribute.
+func (su *SpecialUse) Add(attr string) bool {
+	for _, a := range specialUseAttrs {
+		if strings.EqualFold(a.attr, attr) {
+			*a.set(su) = true
+			return true
+		}
+	}
+	return false
+}
+
+// IsSpecialUseMailbox returns whether name, as configured for delivery, is a
+// special-use attribute like `\Junk` instead of a mailbox name.
+func IsSpecialUseMailbox(name string) bool {
+	var su SpecialUse
+	return strings.HasPrefix(name, `\`) && su.Add(name)
+}
+
+// MailboxSpecialUseSet sets the special-use attributes of mailbox mb, and
+// removes the attributes that are set from other mailboxes. Used to designate
+// the mailbox for e.g. junk or sent messages.
+//
+// Caller must hold account wlock.
+func (a *Account) MailboxSpecialUseSet(tx *bstore.Tx, mb *Mailbox, su SpecialUse) error {
+	others, err := bstore.QueryTx[Mailbox](tx).FilterNotEqual("ID", mb.ID).List()
+	if err != nil {
+		return fmt.Errorf("listing mailboxes: %w", err)
+	}
+	for _, omb := range others {
+		o := omb.SpecialUse()
+		n := SpecialUse{
+			o.Archive && !su.Archive,
+			o.Draft && !su.Draft,
+			o.Junk && !su.Junk,
+			o.Sent && !su.Sent,
+			o.Trash && !su.Trash,
+		}
+		if n == o {
+			continue
+		}
+		omb.Archive, omb.Draft, omb.Junk, omb.Sent, omb.Trash = n.Archive, n.Draft, n.Junk, n.Sent, n.Trash
+		if err := tx.Update(&omb); err != nil {
+			return fmt.Errorf("updating special-use of mailbox %q: %w", omb.Name, err)
+		}
+	}
+
+	mb.Archive, mb.Draft, mb.Junk, mb.Sent, mb.Trash = su.Archive, su.Draft, su.Junk, su.Sent, su.Trash
+	if err := tx.Update(mb); err != nil {
+		return fmt.Errorf("updating special-use of mailbox: %w", err)
+	}
+	return nil
+}
+
+// SpecialUseSave sets the special-use attributes of the mailbox with name, see
+// MailboxSpecialUseSet. ErrUnknownMailbox is returned if the mailbox does not
+// exist.
+func (a *Account) SpecialUseSave(ctx context.Context, name string, su SpecialUse) (rerr error) {
+	a.WithWLock(func() {
+		rerr = a.DB.Write(ctx, func(tx *bstore.Tx) error {
+			mb, err := a.MailboxFind(tx, name)
+			if err != nil {
+				return err
+			} else if mb == nil {
+				return ErrUnknownMailbox
+			}
+			return a.MailboxSpecialUseSet(tx, mb, su)
+		})
+	})
+	return
+}
+
+// DeliveryMailbox returns the name of the mailbox to deliver to for mailbox as
+// configured in a destination or ruleset. If mailbox is a special-use attribute,
+// e.g. `\Junk`, the name of the mailbox with that special-use is returned, or
+// the default name for the special-use, e.g. "Junk", if no mailbox has it.
+// Other names are returned unchanged.
+func (a *Account) DeliveryMailbox(tx *bstore.Tx, mailbox string) (string, error) {
+	if !strings.HasPrefix(mailbox, `\`) {
+		return mailbox, nil
+	}
+	for _, su := range specialUseAttrs {
+		if !strings.EqualFold(su.attr, mailbox) {
+			continue
+		}
+		mb, err := bstore.QueryTx[Mailbox](tx).FilterEqual(su.field, true).Limit(1).Get()
+		if err == bstore.ErrAbsent {
+			return su.defaultName, nil
+		} else if err != nil {
+			return "", fmt.Errorf("looking up mailbox for special-use %s: %w", su.attr, err)
+		}
+		return mb.Name, nil
+	}
+	return mailbox, nil
+}
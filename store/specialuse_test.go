@@ -0,0 +1,103 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestSpecialUse(t *testing.T) {
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = "../testdata/store/mox.conf"
+	mox.ConfigDynamicPath = filepath.Join(filepath.Dir(mox.ConfigStaticPath), "domains.conf")
+	mox.MustLoadConfig(true, false)
+	acc, err := OpenAccount("mjl")
+	tcheck(t, err, "open account")
+	defer acc.Close()
+	switchDone := Switchboard()
+	defer close(switchDone)
+
+	log := mlog.New("specialuse")
+
+	var su SpecialUse
+	if !su.Add(`\junk`) || !su.Add(`\Drafts`) || su.Add(`\All`) || su != (SpecialUse{Junk: true, Draft: true}) {
+		t.Fatalf("bad special-use after adding attributes: %#v", su)
+	}
+	if !IsSpecialUseMailbox(`\Sent`) || IsSpecialUseMailbox("Sent") || IsSpecialUseMailbox(`\Bogus`) {
+		t.Fatalf("bad IsSpecialUseMailbox")
+	}
+
+	deliveryMailbox := func(mailbox, exp string) {
+		t.Helper()
+		var name string
+		err := acc.DB.Read(ctxbg, func(tx *bstore.Tx) error {
+			var err error
+			name, err = acc.DeliveryMailbox(tx, mailbox)
+			return err
+		})
+		tcheck(t, err, "delivery mailbox")
+		if name != exp {
+			t.Fatalf("delivery mailbox for %q is %q, expected %q", mailbox, name, exp)
+		}
+	}
+	deliveryMailbox(`\Junk`, "Junk")
+	deliveryMailbox("Inbox", "Inbox")
+
+	// Designate another mailbox as Junk, the initial Junk mailbox loses it.
+	acc.WithWLock(func() {
+		err = acc.DB.Write(ctxbg, func(tx *bstore.Tx) error {
+			_, _, err := acc.MailboxEnsure(tx, "Spam", true)
+			return err
+		})
+	})
+	tcheck(t, err, "create mailbox")
+	err = acc.SpecialUseSave(ctxbg, "Spam", SpecialUse{Junk: true})
+	tcheck(t, err, "save special-use")
+	deliveryMailbox(`\junk`, "Spam")
+
+	err = acc.DB.Read(ctxbg, func(tx *bstore.Tx) error {
+		mb, err := acc.MailboxFind(tx, "Junk")
+		tcheck(t, err, "find mailbox")
+		if mb.Junk {
+			t.Fatalf("old junk mailbox still has junk special-use")
+		}
+		return nil
+	})
+	tcheck(t, err, "read")
+
+	// Delivery to a special-use.
+	msg := "Subject: test\r\n\r\ntest\r\n"
+	msgFile, err := CreateMessageTemp("specialuse")
+	tcheck(t, err, "create temp")
+	defer os.Remove(msgFile.Name())
+	defer msgFile.Close()
+	_, err = msgFile.Write([]byte(msg))
+	tcheck(t, err, "write message")
+	m := Message{Size: int64(len(msg))}
+	acc.WithWLock(func() {
+		err = acc.DeliverMailbox(log, `\Junk`, &m, msgFile, false)
+	})
+	tcheck(t, err, "deliver")
+	mb := Mailbox{ID: m.MailboxID}
+	err = acc.DB.Get(ctxbg, &mb)
+	tcheck(t, err, "get mailbox")
+	if mb.Name != "Spam" {
+		t.Fatalf("delivered to mailbox %q, expected Spam", mb.Name)
+	}
+
+	// Removing the special-use again, delivery uses the default name.
+	err = acc.SpecialUseSave(ctxbg, "Spam", SpecialUse{})
+	tcheck(t, err, "save special-use")
+	deliveryMailbox(`\Junk`, "Junk")
+
+	err = acc.SpecialUseSave(ctxbg, "Bogus", SpecialUse{})
+	if !errors.Is(err, ErrUnknownMailbox) {
+		t.Fatalf("got err %v, expected ErrUnknownMailbox", err)
+	}
+}
@@ -1,7 +1,7 @@
 package store
 
 import (
-	"sync/atomic"
+	"sync"
 )
 
 var (
@@ -26,6 +26,7 @@ type Change any
 type ChangeAddUID struct {
 	MailboxID int64
 	UID       UID
+	ModSeq    ModSeq
 	Flags     Flags    // System flags.
 	Keywords  []string // Other flags.
 }
@@ -34,17 +35,27 @@ type ChangeAddUID struct {
 type ChangeRemoveUIDs struct {
 	MailboxID int64
 	UIDs      []UID
+	ModSeq    ModSeq // Of the expunge, for VANISHED responses.
 }
 
 // ChangeFlags is sent for an update to flags for a message, e.g. "Seen".
 type ChangeFlags struct {
 	MailboxID int64
 	UID       UID
+	ModSeq    ModSeq
 	Mask      Flags    // Which flags are actually modified.
 	Flags     Flags    // New flag values. All are set, not just mask.
 	Keywords  []string // Other flags.
 }
 
+// ChangeMailboxKeywords is sent when keywords are added to the list of keywords
+// known in a mailbox, e.g. after a message with a new keyword was added.
+type ChangeMailboxKeywords struct {
+	MailboxID   int64
+	MailboxName string
+	Keywords    []string // All keywords of the mailbox.
+}
+
 // ChangeRemoveMailbox is sent for a removed mailbox.
 type ChangeRemoveMailbox struct {
 	Name string
@@ -68,16 +79,32 @@ type ChangeAddSubscription struct {
 	Name string
 }
 
-var switchboardBusy atomic.Bool
+// The currently running switchboard, if any.
+var switchboard struct {
+	sync.Mutex
+	done   chan struct{} // Closed by the caller of Switchboard to stop it.
+	exited chan struct{} // Closed when the switchboard goroutine has stopped.
+}
 
 // Switchboard distributes changes to accounts to interested listeners. See Comm and Change.
 func Switchboard() chan struct{} {
 	regs := map[*Account]map[*Comm][]Change{}
 	done := make(chan struct{})
-
-	if !switchboardBusy.CompareAndSwap(false, true) {
-		panic("switchboard already busy")
+	exited := make(chan struct{})
+
+	switchboard.Lock()
+	defer switchboard.Unlock()
+	if switchboard.done != nil {
+		select {
+		case <-switchboard.done:
+			// Previous switchboard is stopping, e.g. between tests. Wait until it is gone.
+			<-switchboard.exited
+		default:
+			panic("switchboard already busy")
+		}
 	}
+	switchboard.done = done
+	switchboard.exited = exited
 
 	go func() {
 		for {
@@ -101,19 +128,16 @@ func Switchboard() chan struct{} {
 					}
 					regs[acc][c] = append(changes, chReq.changes...)
 					select {
-					case c.Changes <- regs[acc][c]:
-						regs[acc][c] = nil
+					case c.Pending <- struct{}{}:
 					default:
 					}
 				}
 				chReq.comm.r <- struct{}{}
 			case c := <-get:
-				c.Changes <- regs[c.acc][c]
+				c.changes <- regs[c.acc][c]
 				regs[c.acc][c] = nil
 			case <-done:
-				if !switchboardBusy.CompareAndSwap(true, false) {
-					panic("switchboard already unregistered?")
-				}
+				close(exited)
 				return
 			}
 		}
@@ -124,14 +148,20 @@ func Switchboard() chan struct{} {
 // Comm handles communication with the goroutine that maintains the
 // account/mailbox/message state.
 type Comm struct {
-	Changes chan []Change // Receives block until changes come in, e.g. for IMAP IDLE.
+	// Receives when changes are pending, e.g. for IMAP IDLE and NOTIFY. The changes
+	// for all mailboxes of the account are retrieved with Get. A receive does not
+	// block after changes came in while the receiver was busy, so no changes are
+	// missed.
+	Pending chan struct{}
+
+	changes chan []Change // Response to Get.
 	acc     *Account
 	r       chan struct{}
 }
 
 // Register starts a Comm for the account. Unregister must be called.
 func RegisterComm(acc *Account) *Comm {
-	c := &Comm{make(chan []Change), acc, make(chan struct{})}
+	c := &Comm{make(chan struct{}, 1), make(chan []Change), acc, make(chan struct{})}
 	register <- c
 	return c
 }
@@ -154,6 +184,6 @@ func (c *Comm) Broadcast(ch []Change) {
 // is returned.
 func (c *Comm) Get() []Change {
 	get <- c
-	changes := <-c.Changes
+	changes := <-c.changes
 	return changes
 }
@@ -0,0 +1,151 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+// Sweep applies a sweep rule to the messages in the account, moving or removing
+// messages received more than rule.OlderThanDays before now. The number of swept
+// messages is returned. If the mailbox does not exist, nothing is swept.
+//
+// Caller must hold account wlock.
+// Changes are broadcasted.
+func (a *Account) Sweep(log *mlog.Log, rule config.SweepRule, now time.Time) (swept int, rerr error) {
+	if rule.Delete && a.OnHold() {
+		return 0, ErrHold
+	}
+
+	before := now.AddDate(0, 0, -rule.OlderThanDays)
+
+	var changes []Change
+	var remove []Message
+	defer func() {
+		for _, m := range remove {
+			p := a.MessagePath(m.ID)
+			err := os.Remove(p)
+			log.Check(err, "removing swept message file", mlog.Field("path", p))
+		}
+	}()
+
+	err := a.DB.Write(context.TODO(), func(tx *bstore.Tx) error {
+		mbSrc, err := a.MailboxFind(tx, rule.Mailbox)
+		if err != nil {
+			return fmt.Errorf("finding mailbox: %w", err)
+		}
+		if mbSrc == nil {
+			return nil
+		}
+
+		q := bstore.QueryTx[Message](tx)
+		q.FilterNonzero(Message{MailboxID: mbSrc.ID})
+		q.FilterLess("Received", before)
+		if rule.SeenOnly {
+			q.FilterFn(func(m Message) bool {
+				return m.Seen
+			})
+		}
+		q.SortAsc("UID")
+		msgs, err := q.List()
+		if err != nil {
+			return fmt.Errorf("listing messages to sweep: %w", err)
+		}
+		if len(msgs) == 0 {
+			return nil
+		}
+
+		if rule.Delete {
+			remove = msgs
+			changes, err = a.removeMessages(context.TODO(), log, tx, mbSrc, msgs)
+			if err != nil {
+				return fmt.Errorf("removing messages: %w", err)
+			}
+			swept = len(msgs)
+			return nil
+		}
+
+		mbDst, mbChanges, err := a.MailboxEnsure(tx, rule.MoveTo, true)
+		if err != nil {
+			return fmt.Errorf("ensuring destination mailbox: %w", err)
+		}
+		changes = append(changes, mbChanges...)
+
+		mvChanges, err := a.moveMessages(context.TODO(), log, tx, mbSrc, &mbDst, msgs)
+		if err != nil {
+			return err
+		}
+		changes = append(changes, mvChanges...)
+		swept = len(msgs)
+		return nil
+	})
+	if err != nil {
+		remove = nil // Don't remove files on failure.
+		return 0, err
+	}
+	if len(changes) > 0 {
+		comm := RegisterComm(a)
+		defer comm.Unregister()
+		comm.Broadcast(changes)
+	}
+	return swept, nil
+}
+
+// StartSweeper starts a goroutine that applies the sweep rules of all accounts,
+// every night at 03:00 local time.
+func StartSweeper() {
+	go func() {
+		for {
+			now := time.Now()
+			next := time.Date(now.Year(), now.Month(), now.Day(), 3, 0, 0, 0, time.Local)
+			if !next.After(now) {
+				next = next.AddDate(0, 0, 1)
+			}
+			time.Sleep(time.Until(next))
+			sweepAccounts(time.Now())
+		}
+	}()
+}
+
+func sweepAccounts(now time.Time) {
+	log := xlog.WithCid(mox.Cid())
+	for _, accName := range mox.Conf.Accounts() {
+		accConf, ok := mox.Conf.Account(accName)
+		if !ok || len(accConf.SweepRules) == 0 {
+			continue
+		}
+		sweepAccount(log, accName, accConf.SweepRules, now)
+	}
+}
+
+func sweepAccount(log *mlog.Log, accName string, rules []config.SweepRule, now time.Time) {
+	log = log.Fields(mlog.Field("account", accName))
+	acc, err := OpenAccount(accName)
+	if err != nil {
+		log.Errorx("open account for sweep", err)
+		return
+	}
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account after sweep")
+	}()
+
+	for _, rule := range rules {
+		var n int
+		acc.WithWLock(func() {
+			n, err = acc.Sweep(log, rule, now)
+		})
+		if err != nil {
+			log.Errorx("applying sweep rule", err, mlog.Field("mailbox", rule.Mailbox))
+		} else if n > 0 {
+			log.Info("applied sweep rule", mlog.Field("mailbox", rule.Mailbox), mlog.Field("moveto", rule.MoveTo), mlog.Field("delete", rule.Delete), mlog.Field("messages", n))
+		}
+	}
+}
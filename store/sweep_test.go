@@ -0,0 +1,91 @@
+package store
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestSweep(t *testing.T) {
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = "../testdata/store/mox.conf"
+	mox.MustLoadConfig(true, false)
+	acc, err := OpenAccount("mjl")
+	tcheck(t, err, "open account")
+	defer acc.Close()
+	switchDone := Switchboard()
+	defer close(switchDone)
+
+	log := mlog.New("sweep")
+
+	const msg = "Subject: test\r\n\r\ntest\r\n"
+	now := time.Now()
+	deliver := func(received time.Time, seen bool) {
+		t.Helper()
+		msgFile, err := CreateMessageTemp("sweep")
+		tcheck(t, err, "create temp")
+		defer os.Remove(msgFile.Name())
+		defer msgFile.Close()
+		_, err = msgFile.Write([]byte(msg))
+		tcheck(t, err, "write message")
+		m := Message{Received: received, Size: int64(len(msg)), Flags: Flags{Seen: seen}}
+		acc.WithWLock(func() {
+			err = acc.DeliverMailbox(log, "Inbox", &m, msgFile, true)
+		})
+		tcheck(t, err, "deliver")
+	}
+	deliver(now.AddDate(0, 0, -40), false)
+	deliver(now.AddDate(0, 0, -40), true)
+	deliver(now.AddDate(0, 0, -10), true)
+
+	count := func(mailbox string) int {
+		t.Helper()
+		var n int
+		err := acc.DB.Read(ctxbg, func(tx *bstore.Tx) error {
+			mb, err := acc.MailboxFind(tx, mailbox)
+			if err != nil || mb == nil {
+				return err
+			}
+			n, err = bstore.QueryTx[Message](tx).FilterNonzero(Message{MailboxID: mb.ID}).Count()
+			return err
+		})
+		tcheck(t, err, "counting messages")
+		return n
+	}
+
+	sweep := func(rule config.SweepRule, exp int) {
+		t.Helper()
+		var n int
+		acc.WithWLock(func() {
+			n, err = acc.Sweep(log, rule, now)
+		})
+		tcheck(t, err, "sweep")
+		if n != exp {
+			t.Fatalf("swept %d messages, expected %d", n, exp)
+		}
+	}
+
+	// Only the old read message is moved, to a new mailbox.
+	sweep(config.SweepRule{Mailbox: "Inbox", OlderThanDays: 30, SeenOnly: true, MoveTo: "Swept"}, 1)
+	if n := count("Swept"); n != 1 {
+		t.Fatalf("got %d messages in Swept, expected 1", n)
+	}
+	sweep(config.SweepRule{Mailbox: "Inbox", OlderThanDays: 30, MoveTo: "Swept"}, 1)
+	if n := count("Inbox"); n != 1 {
+		t.Fatalf("got %d messages in Inbox, expected 1", n)
+	}
+
+	// Sweeping a mailbox that does not exist is not an error.
+	sweep(config.SweepRule{Mailbox: "Bogus", OlderThanDays: 1, Delete: true}, 0)
+
+	sweep(config.SweepRule{Mailbox: "Swept", OlderThanDays: 30, Delete: true}, 2)
+	if n := count("Swept"); n != 0 {
+		t.Fatalf("got %d messages in Swept, expected 0", n)
+	}
+}
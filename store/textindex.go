@@ -0,0 +1,325 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/mlog"
+)
+
+// Limits for the words indexed for a message.
+const (
+	textIndexWordMax  = 64        // Longer words are skipped, e.g. base64 data in text.
+	textIndexPartMax  = 1 << 20   // Bytes read from a single text part.
+	textIndexWordsMax = 20 * 1000 // Distinct words of a message.
+)
+
+// TextIndex holds the words of a message for full-text search, for accounts
+// with FullTextIndex enabled. Used by IMAP SEARCH for BODY and TEXT, and for
+// searching messages in the account web interface. Messages delivered before
+// the index was enabled have no TextIndex, searches read those messages.
+type TextIndex struct {
+	MessageID   int64    // ID of Message.
+	Words       []string `bstore:"index"` // From text parts and names of attachments.
+	HeaderWords []string `bstore:"index"` // From the subject and addresses.
+}
+
+// TextIndexEnabled returns whether messages of the account are added to the
+// full-text index.
+func (a *Account) TextIndexEnabled() bool {
+	conf, _ := a.Conf()
+	return conf.FullTextIndex
+}
+
+// TextWords returns the distinct lower-case words in s, as used for the
+// full-text index. Words are sequences of letters and digits.
+func TextWords(s string) []string {
+	words := map[string]struct{}{}
+	addWords(words, s)
+	return sortedWords(words)
+}
+
+func addWords(words map[string]struct{}, s string) {
+	for _, w := range strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len(words) >= textIndexWordsMax {
+			return
+		}
+		if utf8.RuneCountInString(w) > 1 && len(w) <= textIndexWordMax {
+			words[w] = struct{}{}
+		}
+	}
+}
+
+func sortedWords(words map[string]struct{}) []string {
+	l := make([]string, 0, len(words))
+	for w := range words {
+		l = append(l, w)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// textIndexWords returns the words for the index from a parsed message, which
+// must have a reader set.
+func textIndexWords(log *mlog.Log, p *message.Part) (words, headerWords []string) {
+	hw := map[string]struct{}{}
+	if e := p.Envelope; e != nil {
+		addWords(hw, e.Subject)
+		for _, l := range [][]message.Address{e.From, e.Sender, e.ReplyTo, e.To, e.CC, e.BCC} {
+			for _, a := range l {
+				addWords(hw, a.Name+" "+a.User+"@"+a.Host)
+			}
+		}
+	}
+
+	bw := map[string]struct{}{}
+	var walk func(p *message.Part)
+	walk = func(p *message.Part) {
+		if name := partName(p); name != "" {
+			addWords(bw, name)
+		}
+		if len(p.Parts) > 0 {
+			for i := range p.Parts {
+				pp := &p.Parts[i]
+				// Subject of attached messages is part of the body.
+				if pp.MediaType == "MESSAGE" && pp.Message != nil && pp.Message.Envelope != nil {
+					addWords(bw, pp.Message.Envelope.Subject)
+				}
+				walk(pp)
+			}
+			return
+		}
+		if p.MediaType != "TEXT" && p.MediaType != "" {
+			return
+		}
+		buf, err := io.ReadAll(io.LimitReader(p.Reader(), textIndexPartMax))
+		if err != nil {
+			log.Debugx("reading text part for full-text index, skipping", err)
+			return
+		}
+		s := string(buf)
+		if p.MediaSubType == "HTML" {
+			s = htmlText(s)
+		}
+		addWords(bw, s)
+	}
+	walk(p)
+	return sortedWords(bw), sortedWords(hw)
+}
+
+// partName returns the file name of an attachment, if any.
+func partName(p *message.Part) string {
+	if name := p.ContentTypeParams["name"]; name != "" {
+		return name
+	}
+	h, err := p.Header()
+	if err != nil {
+		return ""
+	}
+	if _, params, err := mime.ParseMediaType(h.Get("Content-Disposition")); err == nil {
+		return params["filename"]
+	}
+	return ""
+}
+
+// htmlText returns the text of HTML, without tags, comments, styles and scripts.
+// It is only good enough for extracting words.
+func htmlText(s string) string {
+	var b strings.Builder
+	skipUntil := ""
+	lower := strings.ToLower(s)
+	for i := 0; i < len(s); {
+		if skipUntil != "" {
+			j := strings.Index(lower[i:], skipUntil)
+			if j < 0 {
+				break
+			}
+			i += j + len(skipUntil)
+			skipUntil = ""
+			continue
+		}
+		if s[i] != '<' {
+			j := strings.IndexByte(s[i:], '<')
+			if j < 0 {
+				j = len(s) - i
+			}
+			b.WriteString(s[i : i+j])
+			b.WriteByte(' ')
+			i += j
+			continue
+		}
+		switch {
+		case strings.HasPrefix(lower[i:], "<!--"):
+			skipUntil = "-->"
+		case strings.HasPrefix(lower[i:], "<style"):
+			skipUntil = "</style>"
+		case strings.HasPrefix(lower[i:], "<script"):
+			skipUntil = "</script>"
+		default:
+			skipUntil = ">"
+		}
+	}
+	return b.String()
+}
+
+// textIndexAdd adds the words of a message to the full-text index. Part must have
+// a reader set.
+func textIndexAdd(log *mlog.Log, tx *bstore.Tx, m *Message, p *message.Part) error {
+	words, headerWords := textIndexWords(log, p)
+	ti := TextIndex{m.ID, words, headerWords}
+	if err := tx.Insert(&ti); err != nil {
+		return fmt.Errorf("inserting full-text index for message: %w", err)
+	}
+	return nil
+}
+
+// TextIndexCopy adds the full-text index of message origID, if any, for a copy
+// with newID.
+func TextIndexCopy(tx *bstore.Tx, origID, newID int64) error {
+	ti := TextIndex{MessageID: origID}
+	if err := tx.Get(&ti); err == bstore.ErrAbsent {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("get full-text index of message: %w", err)
+	}
+	ti.MessageID = newID
+	if err := tx.Insert(&ti); err != nil {
+		return fmt.Errorf("inserting full-text index for copied message: %w", err)
+	}
+	return nil
+}
+
+// TextIndexRemove removes the full-text index of messages, if present.
+func TextIndexRemove(tx *bstore.Tx, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if _, err := bstore.QueryTx[TextIndex](tx).FilterIDs(ids).Delete(); err != nil {
+		return fmt.Errorf("removing full-text index of messages: %w", err)
+	}
+	return nil
+}
+
+// TextIndexHas returns whether the message has been added to the full-text
+// index.
+func TextIndexHas(tx *bstore.Tx, messageID int64) (bool, error) {
+	return bstore.QueryTx[TextIndex](tx).FilterID(messageID).Exists()
+}
+
+// TextIndexSearch returns the IDs of indexed messages that have all words of
+// query, in their body or attachment names, and with headerToo also in their
+// subject or addresses. If query has no words, nil is returned and the index
+// cannot be used.
+func TextIndexSearch(tx *bstore.Tx, query string, headerToo bool) (map[int64]bool, error) {
+	words := TextWords(query)
+	if len(words) == 0 {
+		return nil, nil
+	}
+	var result map[int64]bool
+	for _, w := range words {
+		matches := map[int64]bool{}
+		fields := []string{"Words"}
+		if headerToo {
+			fields = append(fields, "HeaderWords")
+		}
+		for _, f := range fields {
+			var ids []int64
+			if err := bstore.QueryTx[TextIndex](tx).FilterIn(f, w).IDs(&ids); err != nil {
+				return nil, fmt.Errorf("searching full-text index: %w", err)
+			}
+			for _, id := range ids {
+				if result == nil || result[id] {
+					matches[id] = true
+				}
+			}
+		}
+		result = matches
+		if len(result) == 0 {
+			break
+		}
+	}
+	return result, nil
+}
+
+// ErrTextIndexDisabled is returned when searching messages of an account
+// without FullTextIndex.
+var ErrTextIndexDisabled = errors.New("full-text index not enabled for account")
+
+// TextIndexMessages returns indexed messages with all words of query in their
+// subject, addresses, body or attachment names, most recently received first, at
+// most limit.
+func (a *Account) TextIndexMessages(tx *bstore.Tx, query string, limit int) ([]Message, error) {
+	if !a.TextIndexEnabled() {
+		return nil, ErrTextIndexDisabled
+	}
+	matches, err := TextIndexSearch(tx, query, true)
+	if err != nil || len(matches) == 0 {
+		return nil, err
+	}
+	ids := make([]int64, 0, len(matches))
+	for id := range matches {
+		ids = append(ids, id)
+	}
+	q := bstore.QueryTx[Message](tx)
+	q.FilterIDs(ids)
+	q.SortDesc("Received")
+	q.Limit(limit)
+	return q.List()
+}
+
+// TextIndexBuild adds messages of the account that are not yet in the full-text
+// index, e.g. those delivered before the index was enabled. The number of added
+// messages is returned.
+func (a *Account) TextIndexBuild(ctx context.Context, log *mlog.Log) (int, error) {
+	var n int
+	// Messages are indexed in batches, to not hold the write lock for too long.
+	var lastID int64
+	for {
+		var batch int
+		err := a.DB.Write(ctx, func(tx *bstore.Tx) error {
+			q := bstore.QueryTx[Message](tx)
+			q.FilterGreater("ID", lastID)
+			q.SortAsc("ID")
+			q.Limit(100)
+			return q.ForEach(func(m Message) error {
+				batch++
+				lastID = m.ID
+				if has, err := TextIndexHas(tx, m.ID); err != nil {
+					return err
+				} else if has {
+					return nil
+				}
+				mr := a.MessageReader(m)
+				defer mr.Close()
+				p, err := m.LoadPart(mr)
+				if err != nil {
+					log.Debugx("loading parsed message for full-text index, skipping", err, mlog.Field("message", m.ID))
+					return nil
+				}
+				if err := textIndexAdd(log, tx, &m, &p); err != nil {
+					return err
+				}
+				n++
+				return nil
+			})
+		})
+		if err != nil {
+			return n, err
+		}
+		if batch == 0 {
+			return n, nil
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestTextIndex(t *testing.T) {
+	if l := TextWords("Hello, wörld! a hello-again 42"); !reflect.DeepEqual(l, []string{"42", "again", "hello", "wörld"}) {
+		t.Fatalf("got words %v", l)
+	}
+	if s := TextWords(htmlText(`<style>p { x: y }</style><p>some <b>bold</b><!-- comment --> text</p><script>code()</script>`)); !reflect.DeepEqual(s, []string{"bold", "some", "text"}) {
+		t.Fatalf("got html words %v", s)
+	}
+
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = "../testdata/store/mox.conf"
+	mox.ConfigDynamicPath = filepath.Join(filepath.Dir(mox.ConfigStaticPath), "domains.conf")
+	mox.MustLoadConfig(true, false)
+	acc, err := OpenAccount("mjl")
+	tcheck(t, err, "open account")
+	defer acc.Close()
+	switchDone := Switchboard()
+	defer close(switchDone)
+
+	log := mlog.New("textindex")
+
+	deliver := func(subject, body string) Message {
+		t.Helper()
+		msg := strings.ReplaceAll("From: <sender@remote.example>\nSubject: "+subject+"\nContent-Type: text/plain\n\n"+body+"\n", "\n", "\r\n")
+		msgFile, err := CreateMessageTemp("textindex")
+		tcheck(t, err, "create temp")
+		defer os.Remove(msgFile.Name())
+		defer msgFile.Close()
+		_, err = msgFile.Write([]byte(msg))
+		tcheck(t, err, "write message")
+		m := Message{Size: int64(len(msg))}
+		acc.WithWLock(func() {
+			err = acc.DeliverMailbox(log, "Inbox", &m, msgFile, false)
+		})
+		tcheck(t, err, "deliver")
+		return m
+	}
+
+	search := func(query string) []int64 {
+		t.Helper()
+		var ids []int64
+		err := acc.DB.Read(ctxbg, func(tx *bstore.Tx) error {
+			l, err := acc.TextIndexMessages(tx, query, 10)
+			for _, m := range l {
+				ids = append(ids, m.ID)
+			}
+			return err
+		})
+		tcheck(t, err, "search")
+		return ids
+	}
+
+	// Message delivered before enabling the index.
+	m0 := deliver("before", "quarterly numbers")
+
+	err = acc.DB.Read(ctxbg, func(tx *bstore.Tx) error {
+		_, err := acc.TextIndexMessages(tx, "report", 10)
+		return err
+	})
+	if !errors.Is(err, ErrTextIndexDisabled) {
+		t.Fatalf("got err %v, expected ErrTextIndexDisabled", err)
+	}
+
+	accConf := mox.Conf.Dynamic.Accounts["mjl"]
+	defer func() {
+		mox.Conf.Dynamic.Accounts["mjl"] = accConf
+	}()
+	nconf := accConf
+	nconf.FullTextIndex = true
+	mox.Conf.Dynamic.Accounts["mjl"] = nconf
+
+	m1 := deliver("lunch", "the report is attached")
+	m2 := deliver("report", "nothing")
+
+	if ids := search("report"); !reflect.DeepEqual(ids, []int64{m2.ID, m1.ID}) {
+		t.Fatalf("got ids %v, expected %d and %d", ids, m2.ID, m1.ID)
+	}
+	if ids := search("REPORT attached"); !reflect.DeepEqual(ids, []int64{m1.ID}) {
+		t.Fatalf("got ids %v, expected %d", ids, m1.ID)
+	}
+	if ids := search("rep"); len(ids) != 0 {
+		t.Fatalf("got ids %v for partial word, expected none", ids)
+	}
+	if ids := search("sender remote.example"); len(ids) != 2 {
+		t.Fatalf("got ids %v for address, expected 2", ids)
+	}
+
+	// Body-only search does not match the subject.
+	err = acc.DB.Read(ctxbg, func(tx *bstore.Tx) error {
+		matches, err := TextIndexSearch(tx, "lunch", false)
+		if err == nil && len(matches) != 0 {
+			t.Fatalf("got matches %v, expected none", matches)
+		}
+		if matches, err := TextIndexSearch(tx, ".", false); err == nil && matches != nil {
+			t.Fatalf("got matches %v for query without words, expected nil", matches)
+		}
+		return err
+	})
+	tcheck(t, err, "search body")
+
+	// Add the message delivered before enabling the index.
+	n, err := acc.TextIndexBuild(ctxbg, log)
+	tcheck(t, err, "build index")
+	if n != 1 {
+		t.Fatalf("build index added %d messages, expected 1", n)
+	}
+	if ids := search("quarterly"); !reflect.DeepEqual(ids, []int64{m0.ID}) {
+		t.Fatalf("got ids %v, expected %d", ids, m0.ID)
+	}
+	n, err = acc.TextIndexBuild(ctxbg, log)
+	tcheck(t, err, "build index again")
+	if n != 0 {
+		t.Fatalf("build index added %d messages, expected 0", n)
+	}
+
+	// Removed messages are removed from the index.
+	err = acc.DB.Write(ctxbg, func(tx *bstore.Tx) error {
+		return TextIndexRemove(tx, []int64{m1.ID})
+	})
+	tcheck(t, err, "remove from index")
+	if ids := search("report"); !reflect.DeepEqual(ids, []int64{m2.ID}) {
+		t.Fatalf("got ids %v, expected %d", ids, m2.ID)
+	}
+}
@@ -85,12 +85,13 @@ func (a *Account) RetrainMessages(ctx context.Context, log *mlog.Log, tx *bstore
 }
 
 // RetrainMessage untrains and/or trains a message, if relevant given m.TrainedJunk
-// and m.Junk/m.Notjunk. Updates m.TrainedJunk after retraining.
+// and m.Junk/m.Phishing/m.Notjunk. Updates m.TrainedJunk after retraining.
 func (a *Account) RetrainMessage(ctx context.Context, log *mlog.Log, tx *bstore.Tx, jf *junk.Filter, m *Message, absentOK bool) error {
 	untrain := m.TrainedJunk != nil
 	untrainJunk := untrain && *m.TrainedJunk
-	train := m.Junk || m.Notjunk && !(m.Junk && m.Notjunk)
-	trainJunk := m.Junk
+	junk := m.trainsJunk()
+	train := junk || m.Notjunk && !(junk && m.Notjunk)
+	trainJunk := junk
 
 	if !untrain && !train || (untrain && train && untrainJunk == trainJunk) {
 		return nil
@@ -139,7 +140,8 @@ func (a *Account) RetrainMessage(ctx context.Context, log *mlog.Log, tx *bstore.
 // TrainMessage trains the junk filter based on the current m.Junk/m.Notjunk flags,
 // disregarding m.TrainedJunk and not updating that field.
 func (a *Account) TrainMessage(ctx context.Context, log *mlog.Log, jf *junk.Filter, m Message) (bool, error) {
-	if !m.Junk && !m.Notjunk || (m.Junk && m.Notjunk) {
+	junk := m.trainsJunk()
+	if !junk && !m.Notjunk || (junk && m.Notjunk) {
 		return false, nil
 	}
 
@@ -161,5 +163,5 @@ func (a *Account) TrainMessage(ctx context.Context, log *mlog.Log, jf *junk.Filt
 		return false, nil
 	}
 
-	return true, jf.Train(ctx, m.Notjunk, words)
+	return true, jf.Train(ctx, !junk, words)
 }
@@ -0,0 +1,85 @@
+package store
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/mjl-/bstore"
+)
+
+// URLAuthKey is the mailbox access key for generating and verifying IMAP URLs
+// with URLAUTH authorization, for the "INTERNAL" mechanism. Keys are created on
+// first use, and can be reset to invalidate all URLs of a mailbox.
+//
+// ../rfc/4467
+type URLAuthKey struct {
+	ID        int64
+	MailboxID int64  `bstore:"nonzero,unique"`
+	Key       []byte `bstore:"nonzero"`
+}
+
+// URLAuthToken returns the token for the "INTERNAL" URLAUTH mechanism, for the
+// "rump" URL, i.e. the URL up to and including the ";URLAUTH=<access>"
+// parameter. The access key for the mailbox is created if it doesn't exist yet.
+func URLAuthToken(tx *bstore.Tx, mailboxID int64, rump string) (string, error) {
+	k, err := urlAuthKey(tx, mailboxID, true)
+	if err != nil {
+		return "", err
+	}
+	return urlAuthToken(k.Key, rump), nil
+}
+
+// URLAuthVerify returns whether token is valid for the rump URL for the mailbox,
+// see URLAuthToken. Tokens are always invalid if no access key exists for the
+// mailbox.
+func URLAuthVerify(tx *bstore.Tx, mailboxID int64, rump, token string) (bool, error) {
+	k, err := urlAuthKey(tx, mailboxID, false)
+	if err != nil || k.Key == nil {
+		return false, err
+	}
+	exp := urlAuthToken(k.Key, rump)
+	return subtle.ConstantTimeCompare([]byte(exp), []byte(token)) == 1, nil
+}
+
+// URLAuthKeyReset removes the access key for the mailbox, or for all mailboxes
+// if mailboxID is zero, invalidating all previously generated URLs.
+func URLAuthKeyReset(tx *bstore.Tx, mailboxID int64) error {
+	q := bstore.QueryTx[URLAuthKey](tx)
+	if mailboxID != 0 {
+		q.FilterNonzero(URLAuthKey{MailboxID: mailboxID})
+	}
+	if _, err := q.Delete(); err != nil {
+		return fmt.Errorf("removing urlauth keys: %w", err)
+	}
+	return nil
+}
+
+func urlAuthKey(tx *bstore.Tx, mailboxID int64, create bool) (URLAuthKey, error) {
+	k, err := bstore.QueryTx[URLAuthKey](tx).FilterNonzero(URLAuthKey{MailboxID: mailboxID}).Get()
+	if err == bstore.ErrAbsent && create {
+		k = URLAuthKey{MailboxID: mailboxID, Key: make([]byte, 32)}
+		if _, err := rand.Read(k.Key); err != nil {
+			return URLAuthKey{}, fmt.Errorf("generating urlauth key: %w", err)
+		}
+		if err := tx.Insert(&k); err != nil {
+			return URLAuthKey{}, fmt.Errorf("storing urlauth key: %w", err)
+		}
+		return k, nil
+	} else if err == bstore.ErrAbsent {
+		return URLAuthKey{}, nil
+	} else if err != nil {
+		return URLAuthKey{}, fmt.Errorf("looking up urlauth key: %w", err)
+	}
+	return k, nil
+}
+
+func urlAuthToken(key []byte, rump string) string {
+	// Token must have at least 128 bits. ../rfc/4467
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(rump))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,194 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+)
+
+// MailboxUsage is the number of messages and their total size for a mailbox.
+type MailboxUsage struct {
+	Name     string
+	Messages int
+	Size     int64
+}
+
+// MailboxUsages returns the message count and total message size for each
+// mailbox, ordered by size, largest first.
+func (a *Account) MailboxUsages(tx *bstore.Tx) ([]MailboxUsage, error) {
+	mailboxes, err := bstore.QueryTx[Mailbox](tx).List()
+	if err != nil {
+		return nil, fmt.Errorf("listing mailboxes: %w", err)
+	}
+	usages := map[int64]*MailboxUsage{}
+	for _, mb := range mailboxes {
+		usages[mb.ID] = &MailboxUsage{Name: mb.Name}
+	}
+
+	err = bstore.QueryTx[Message](tx).ForEach(func(m Message) error {
+		if u, ok := usages[m.MailboxID]; ok {
+			u.Messages++
+			u.Size += m.Size
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("gathering message sizes: %w", err)
+	}
+
+	l := make([]MailboxUsage, 0, len(usages))
+	for _, u := range usages {
+		l = append(l, *u)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		if l[i].Size != l[j].Size {
+			return l[i].Size > l[j].Size
+		}
+		return l[i].Name < l[j].Name
+	})
+	return l, nil
+}
+
+// LargestMessages returns up to n messages in the account, ordered by size,
+// largest first.
+func (a *Account) LargestMessages(tx *bstore.Tx, n int) ([]Message, error) {
+	q := bstore.QueryTx[Message](tx)
+	q.SortDesc("Size")
+	q.Limit(n)
+	l, err := q.List()
+	if err != nil {
+		return nil, fmt.Errorf("listing messages: %w", err)
+	}
+	return l, nil
+}
+
+// CleanupSuggestion describes messages that could be removed to free up storage,
+// matching all messages in Mailbox received before Before and with at least
+// MinSize bytes. The suggestion can be applied with RemoveMessagesBefore.
+type CleanupSuggestion struct {
+	Mailbox  string
+	Reason   string
+	Before   time.Time
+	MinSize  int64
+	Messages int
+	Size     int64
+}
+
+// Thresholds for cleanup suggestions.
+var (
+	cleanupJunkTrashAge  = 30 * 24 * time.Hour
+	cleanupLargeAge      = 365 * 24 * time.Hour
+	cleanupLargeMinSize  = int64(5 * 1024 * 1024)
+	cleanupMinSuggestion = int64(1024 * 1024) // Suggestions freeing less are not worth mentioning.
+)
+
+// CleanupSuggestions returns suggestions for removing messages to free up
+// storage: old messages in Junk and Trash mailboxes, and old large messages
+// (typically with large attachments) in other mailboxes.
+func (a *Account) CleanupSuggestions(tx *bstore.Tx, now time.Time) ([]CleanupSuggestion, error) {
+	mailboxes, err := bstore.QueryTx[Mailbox](tx).List()
+	if err != nil {
+		return nil, fmt.Errorf("listing mailboxes: %w", err)
+	}
+
+	var l []CleanupSuggestion
+	for _, mb := range mailboxes {
+		var s CleanupSuggestion
+		if mb.Junk || mb.Trash {
+			s = CleanupSuggestion{Mailbox: mb.Name, Reason: "old messages in junk or trash mailbox", Before: now.Add(-cleanupJunkTrashAge)}
+		} else {
+			s = CleanupSuggestion{Mailbox: mb.Name, Reason: "old large messages", Before: now.Add(-cleanupLargeAge), MinSize: cleanupLargeMinSize}
+		}
+		q := bstore.QueryTx[Message](tx)
+		q.FilterNonzero(Message{MailboxID: mb.ID})
+		q.FilterLess("Received", s.Before)
+		if s.MinSize > 0 {
+			q.FilterGreaterEqual("Size", s.MinSize)
+		}
+		err := q.ForEach(func(m Message) error {
+			s.Messages++
+			s.Size += m.Size
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("gathering messages for mailbox %q: %w", mb.Name, err)
+		}
+		if s.Size >= cleanupMinSuggestion {
+			l = append(l, s)
+		}
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Size > l[j].Size
+	})
+	return l, nil
+}
+
+// RemoveMessagesBefore removes messages from mailbox that were received before
+// "before" and that have a size of at least minSize, e.g. as suggested by
+// CleanupSuggestions. The number of messages removed and their total size is
+// returned. Fails with ErrHold for accounts on hold.
+//
+// Caller must hold account wlock.
+// Changes are broadcasted.
+func (a *Account) RemoveMessagesBefore(log *mlog.Log, mailbox string, before time.Time, minSize int64) (removed int, size int64, rerr error) {
+	if a.OnHold() {
+		return 0, 0, ErrHold
+	}
+
+	var changes []Change
+
+	var remove []Message
+	defer func() {
+		for _, m := range remove {
+			p := a.MessagePath(m.ID)
+			err := os.Remove(p)
+			log.Check(err, "removing message file", mlog.Field("path", p))
+		}
+	}()
+
+	err := a.DB.Write(context.TODO(), func(tx *bstore.Tx) error {
+		mb, err := a.MailboxFind(tx, mailbox)
+		if err != nil {
+			return fmt.Errorf("finding mailbox: %w", err)
+		}
+		if mb == nil {
+			return fmt.Errorf("mailbox does not exist")
+		}
+
+		q := bstore.QueryTx[Message](tx)
+		q.FilterNonzero(Message{MailboxID: mb.ID})
+		q.FilterLess("Received", before)
+		if minSize > 0 {
+			q.FilterGreaterEqual("Size", minSize)
+		}
+		remove, err = q.List()
+		if err != nil {
+			return fmt.Errorf("listing messages to remove: %w", err)
+		}
+
+		changes, err = a.removeMessages(context.TODO(), log, tx, mb, remove)
+		if err != nil {
+			return fmt.Errorf("removing messages: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		remove = nil // Don't remove files on failure.
+		return 0, 0, err
+	}
+
+	comm := RegisterComm(a)
+	defer comm.Unregister()
+	comm.Broadcast(changes)
+
+	for _, m := range remove {
+		size += m.Size
+	}
+	return len(remove), size, nil
+}
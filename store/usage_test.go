@@ -0,0 +1,101 @@
+package store
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestUsage(t *testing.T) {
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = "../testdata/store/mox.conf"
+	mox.MustLoadConfig(true, false)
+	acc, err := OpenAccount("mjl")
+	tcheck(t, err, "open account")
+	defer acc.Close()
+	switchDone := Switchboard()
+	defer close(switchDone)
+
+	log := mlog.New("usage")
+
+	msgFile, err := os.CreateTemp("", "mox-test-usage")
+	tcheck(t, err, "create temp")
+	defer os.Remove(msgFile.Name())
+	const msg = "Subject: test\r\n\r\ntest\r\n"
+	_, err = msgFile.Write([]byte(msg))
+	tcheck(t, err, "write message")
+
+	// Make large messages count as large and suggestions count regardless of size.
+	defer func(minSize, minSuggestion int64) {
+		cleanupLargeMinSize = minSize
+		cleanupMinSuggestion = minSuggestion
+	}(cleanupLargeMinSize, cleanupMinSuggestion)
+	cleanupLargeMinSize = 100
+	cleanupMinSuggestion = 1
+
+	now := time.Now()
+	old := now.Add(-2 * 365 * 24 * time.Hour)
+	deliver := func(mailbox string, received time.Time, size int64) {
+		t.Helper()
+		m := Message{Received: received, Size: size}
+		err := acc.DeliverMailbox(log, mailbox, &m, msgFile, false)
+		tcheck(t, err, "deliver")
+	}
+	acc.WithWLock(func() {
+		deliver("Inbox", now, 10)
+		deliver("Inbox", old, 10)
+		deliver("Inbox", old, 1000)
+		deliver("Trash", now, 10)
+		deliver("Trash", old, 10)
+	})
+
+	err = acc.DB.Read(ctxbg, func(tx *bstore.Tx) error {
+		usages, err := acc.MailboxUsages(tx)
+		tcheck(t, err, "mailbox usages")
+		if len(usages) == 0 || usages[0] != (MailboxUsage{"Inbox", 3, 1020}) {
+			t.Fatalf("got usages %v, expected Inbox with 3 messages and 1020 bytes first", usages)
+		}
+
+		largest, err := acc.LargestMessages(tx, 2)
+		tcheck(t, err, "largest messages")
+		if len(largest) != 2 || largest[0].Size != 1000 || largest[1].Size != 10 {
+			t.Fatalf("got largest messages %v, expected sizes 1000 and 10", largest)
+		}
+
+		suggestions, err := acc.CleanupSuggestions(tx, now)
+		tcheck(t, err, "cleanup suggestions")
+		if len(suggestions) != 2 {
+			t.Fatalf("got suggestions %v, expected 2", suggestions)
+		}
+		s0, s1 := suggestions[0], suggestions[1]
+		if s0.Mailbox != "Inbox" || s0.Messages != 1 || s0.Size != 1000 || s1.Mailbox != "Trash" || s1.Messages != 1 || s1.Size != 10 {
+			t.Fatalf("got suggestions %v, expected old large message in Inbox and old message in Trash", suggestions)
+		}
+		return nil
+	})
+	tcheck(t, err, "read tx")
+
+	acc.WithWLock(func() {
+		removed, size, err := acc.RemoveMessagesBefore(log, "Trash", now.Add(-time.Hour), 0)
+		tcheck(t, err, "remove messages")
+		if removed != 1 || size != 10 {
+			t.Fatalf("removed %d messages with size %d, expected 1 message of 10 bytes", removed, size)
+		}
+
+		_, _, err = acc.RemoveMessagesBefore(log, "Bogus", now, 0)
+		if err == nil {
+			t.Fatalf("removing from unknown mailbox succeeded")
+		}
+	})
+
+	n, err := bstore.QueryDB[Message](ctxbg, acc.DB).Count()
+	tcheck(t, err, "count messages")
+	if n != 4 {
+		t.Fatalf("got %d messages, expected 4", n)
+	}
+}
@@ -253,6 +253,28 @@ possibly making them potentially no longer readable by the previous version.
 				return nil
 			})
 			checkf(err, dbpath, "reading messages in account database to check files")
+
+			// Check the mailbox counts against the messages. Mailboxes of accounts not yet
+			// opened after upgrading don't have counts yet.
+			err = db.Read(ctxbg, func(tx *bstore.Tx) error {
+				return bstore.QueryTx[store.Mailbox](tx).ForEach(func(mb store.Mailbox) error {
+					mc := store.MailboxCounts{ID: mb.ID}
+					if err := tx.Get(&mc); err == bstore.ErrAbsent {
+						return nil
+					} else if err != nil {
+						return err
+					}
+					exp, err := store.MailboxCountsCalculate(tx, mb.ID)
+					if err != nil {
+						return err
+					}
+					if mc != exp {
+						checkf(errors.New(`inconsistent mailbox counts, see "mox recalculatemailboxcounts"`), dbpath, "mailbox id %d has counts %+v, messages have %+v", mb.ID, mc, exp)
+					}
+					return nil
+				})
+			})
+			checkf(err, dbpath, "checking mailbox counts")
 		}
 
 		// Walk through all files in the msg directory. Warn about files that weren't in
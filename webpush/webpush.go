@@ -0,0 +1,261 @@
+// Package webpush sends notifications to browsers with the Web Push protocol.
+//
+// Payloads are encrypted with the "aes128gcm" content coding, and requests are
+// authenticated to push services with VAPID.
+package webpush
+
+// ../rfc/8030 ../rfc/8291 ../rfc/8292 ../rfc/8188
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/mox/moxvar"
+)
+
+var (
+	metricSend = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mox_webpush_send_total",
+			Help: "Web Push notifications sent to push services.",
+		},
+		[]string{
+			"result", // "ok", "gone", "error"
+		},
+	)
+)
+
+var (
+	// ErrGone is returned when the push service indicates the subscription no longer
+	// exists. The subscription should be removed.
+	ErrGone = errors.New("webpush: subscription no longer valid")
+
+	ErrKey = errors.New("webpush: invalid key in subscription")
+)
+
+// Subscription is a push subscription from a browser, as returned by
+// pushManager.subscribe.
+type Subscription struct {
+	Endpoint string // URL of push service to send notifications to.
+	P256dh   string // Public key of browser, base64url-encoded uncompressed P-256 point.
+	Auth     string // Authentication secret, base64url-encoded.
+}
+
+var b64 = base64.RawURLEncoding
+
+// AllowIP returns whether requests can be sent to a push service at ip. Push
+// endpoints are provided by users, only global unicast addresses are allowed so
+// they cannot be used to reach internal services: No private, loopback or
+// link-local addresses.
+func AllowIP(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+// HTTPClient is used for requests to push services. It only connects to IPs
+// allowed by AllowIP, checked after resolving the host name of the endpoint.
+var HTTPClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !AllowIP(ip) {
+					return fmt.Errorf("webpush: connecting to %s not allowed", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 20 * time.Second,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       time.Minute,
+	},
+}
+
+// GenerateKey returns a new private key for VAPID.
+func GenerateKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+}
+
+// PublicKey returns the base64url-encoded uncompressed public key, as used for
+// applicationServerKey in browsers.
+func PublicKey(key *ecdsa.PrivateKey) string {
+	return b64.EncodeToString(elliptic.Marshal(elliptic.P256(), key.X, key.Y))
+}
+
+// Send encrypts payload for the subscription and sends it to the push service,
+// which keeps it for at most ttl while the browser is not reachable. The VAPID key
+// and subject (a mailto: or https: URL) identify the application server to the
+// push service.
+func Send(ctx context.Context, key *ecdsa.PrivateKey, subject string, sub Subscription, payload []byte, ttl time.Duration) error {
+	u, err := url.Parse(sub.Endpoint)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("webpush: bad endpoint url %q", sub.Endpoint)
+	}
+
+	body, err := encrypt(sub, payload, cryptorand.Reader)
+	if err != nil {
+		return err
+	}
+	token, err := vapidToken(key, u.Scheme+"://"+u.Host, subject, time.Now())
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("webpush: new request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", fmt.Sprintf("%d", int(ttl/time.Second)))
+	req.Header.Set("Authorization", fmt.Sprintf("vapid t=%s, k=%s", token, PublicKey(key)))
+	req.Header.Set("User-Agent", "mox/"+moxvar.Version)
+	resp, err := HTTPClient.Do(req)
+	if err != nil {
+		metricSend.WithLabelValues("error").Inc()
+		return fmt.Errorf("webpush: sending to push service: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		metricSend.WithLabelValues("gone").Inc()
+		return ErrGone
+	case resp.StatusCode/100 != 2:
+		metricSend.WithLabelValues("error").Inc()
+		return fmt.Errorf("webpush: push service responded with status %s", resp.Status)
+	}
+	metricSend.WithLabelValues("ok").Inc()
+	return nil
+}
+
+// vapidToken returns a signed JWT for the push service at audience (an origin).
+func vapidToken(key *ecdsa.PrivateKey, audience, subject string, now time.Time) (string, error) {
+	header := b64.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, err := json.Marshal(struct {
+		Aud string `json:"aud"`
+		Exp int64  `json:"exp"`
+		Sub string `json:"sub"`
+	}{audience, now.Add(12 * time.Hour).Unix(), subject})
+	if err != nil {
+		return "", fmt.Errorf("webpush: marshal vapid claims: %v", err)
+	}
+	msg := header + "." + b64.EncodeToString(claims)
+	h := sha256.Sum256([]byte(msg))
+	r, s, err := ecdsa.Sign(cryptorand.Reader, key, h[:])
+	if err != nil {
+		return "", fmt.Errorf("webpush: signing vapid token: %v", err)
+	}
+	// JWS ES256 signatures are the fixed-size big-endian R and S concatenated.
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return msg + "." + b64.EncodeToString(sig), nil
+}
+
+// encrypt returns the request body with payload encrypted for sub, as a single
+// record.
+func encrypt(sub Subscription, payload []byte, random io.Reader) ([]byte, error) {
+	uaPublic, err := b64.DecodeString(sub.P256dh)
+	if err != nil {
+		return nil, fmt.Errorf("%w: p256dh: %v", ErrKey, err)
+	}
+	authSecret, err := b64.DecodeString(sub.Auth)
+	if err != nil || len(authSecret) != 16 {
+		return nil, fmt.Errorf("%w: auth secret", ErrKey)
+	}
+	curve := elliptic.P256()
+	uaX, uaY := elliptic.Unmarshal(curve, uaPublic)
+	if uaX == nil {
+		return nil, fmt.Errorf("%w: p256dh is not a valid p-256 point", ErrKey)
+	}
+
+	asKey, err := ecdsa.GenerateKey(curve, random)
+	if err != nil {
+		return nil, fmt.Errorf("webpush: generating key: %v", err)
+	}
+	asPublic := elliptic.Marshal(curve, asKey.X, asKey.Y)
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(random, salt); err != nil {
+		return nil, fmt.Errorf("webpush: reading random salt: %v", err)
+	}
+
+	cek, nonce := deriveKeys(ecdh(curve, asKey.D, uaX, uaY), authSecret, uaPublic, asPublic, salt)
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, fmt.Errorf("webpush: new cipher: %v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("webpush: new gcm: %v", err)
+	}
+	// Padding delimiter 2 marks the last record. ../rfc/8188
+	plain := append(append([]byte{}, payload...), 2)
+	const recordSize = 4096
+	if len(plain)+gcm.Overhead() > recordSize {
+		return nil, fmt.Errorf("webpush: payload too large")
+	}
+
+	// Header: salt, record size, key id length and key id (our public key).
+	var b bytes.Buffer
+	b.Write(salt)
+	binary.Write(&b, binary.BigEndian, uint32(recordSize))
+	b.WriteByte(byte(len(asPublic)))
+	b.Write(asPublic)
+	b.Write(gcm.Seal(nil, nonce, plain, nil))
+	return b.Bytes(), nil
+}
+
+// ecdh returns the x coordinate of the shared point, fixed-size.
+func ecdh(curve elliptic.Curve, priv *big.Int, x, y *big.Int) []byte {
+	sx, _ := curve.ScalarMult(x, y, priv.FillBytes(make([]byte, 32)))
+	return sx.FillBytes(make([]byte, 32))
+}
+
+// deriveKeys returns the content encryption key and nonce for the record.
+// ../rfc/8291
+func deriveKeys(ecdhSecret, authSecret, uaPublic, asPublic, salt []byte) (cek, nonce []byte) {
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaPublic...), asPublic...)
+	ikm := hkdf(authSecret, ecdhSecret, keyInfo, 32)
+	cek = hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce = hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+	return cek, nonce
+}
+
+// hkdf returns the first n bytes of HKDF-SHA-256, n at most 32.
+func hkdf(salt, ikm, info []byte, n int) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	prk := mac.Sum(nil)
+	mac = hmac.New(sha256.New, prk)
+	mac.Write(info)
+	mac.Write([]byte{1})
+	return mac.Sum(nil)[:n]
+}
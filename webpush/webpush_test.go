@@ -0,0 +1,163 @@
+package webpush
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tcheck(t *testing.T, err error, msg string) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %s", msg, err)
+	}
+}
+
+// decrypt is what a browser does with a received body.
+func decrypt(t *testing.T, uaKey *ecdsa.PrivateKey, authSecret, body []byte) []byte {
+	t.Helper()
+	if len(body) < 21 {
+		t.Fatalf("body too short")
+	}
+	salt := body[:16]
+	rs := binary.BigEndian.Uint32(body[16:20])
+	idlen := int(body[20])
+	asPublic := body[21 : 21+idlen]
+	ciphertext := body[21+idlen:]
+	if rs != 4096 || idlen != 65 {
+		t.Fatalf("unexpected record size %d or key id length %d", rs, idlen)
+	}
+
+	curve := elliptic.P256()
+	asX, asY := elliptic.Unmarshal(curve, asPublic)
+	if asX == nil {
+		t.Fatalf("bad key id")
+	}
+	uaPublic := elliptic.Marshal(curve, uaKey.X, uaKey.Y)
+	cek, nonce := deriveKeys(ecdh(curve, uaKey.D, asX, asY), authSecret, uaPublic, asPublic, salt)
+	block, err := aes.NewCipher(cek)
+	tcheck(t, err, "new cipher")
+	gcm, err := cipher.NewGCM(block)
+	tcheck(t, err, "new gcm")
+	plain, err := gcm.Open(nil, nonce, ciphertext, nil)
+	tcheck(t, err, "decrypt")
+	if len(plain) == 0 || plain[len(plain)-1] != 2 {
+		t.Fatalf("missing last record delimiter")
+	}
+	return plain[:len(plain)-1]
+}
+
+func TestSend(t *testing.T) {
+	vapidKey, err := GenerateKey()
+	tcheck(t, err, "generate vapid key")
+	uaKey, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	tcheck(t, err, "generate browser key")
+	authSecret := make([]byte, 16)
+	_, err = cryptorand.Read(authSecret)
+	tcheck(t, err, "random auth secret")
+
+	var status int
+	var body []byte
+	var header http.Header
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	origClient := HTTPClient
+	defer func() {
+		HTTPClient = origClient
+	}()
+
+	sub := Subscription{
+		Endpoint: srv.URL + "/push/abc",
+		P256dh:   b64.EncodeToString(elliptic.Marshal(elliptic.P256(), uaKey.X, uaKey.Y)),
+		Auth:     b64.EncodeToString(authSecret),
+	}
+	payload := []byte(`{"title":"test"}`)
+
+	status = http.StatusCreated
+
+	// The default client refuses to connect to the push service on a loopback IP.
+	err = Send(context.Background(), vapidKey, "mailto:postmaster@mox.example", sub, payload, time.Hour)
+	if err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Fatalf("send to loopback ip, got err %v, expected not allowed", err)
+	}
+	if AllowIP(net.ParseIP("10.1.2.3")) || AllowIP(net.ParseIP("169.254.169.254")) || AllowIP(net.ParseIP("::1")) || !AllowIP(net.ParseIP("198.51.100.1")) {
+		t.Fatalf("unexpected AllowIP results")
+	}
+
+	HTTPClient = srv.Client()
+	err = Send(context.Background(), vapidKey, "mailto:postmaster@mox.example", sub, payload, time.Hour)
+	tcheck(t, err, "send")
+	if got := decrypt(t, uaKey, authSecret, body); string(got) != string(payload) {
+		t.Fatalf("decrypted %q, expected %q", got, payload)
+	}
+	if header.Get("Content-Encoding") != "aes128gcm" || header.Get("TTL") != "3600" {
+		t.Fatalf("unexpected headers %v", header)
+	}
+
+	// Verify the VAPID token.
+	auth := header.Get("Authorization")
+	var token, k string
+	for _, s := range strings.Split(strings.TrimPrefix(auth, "vapid "), ",") {
+		s = strings.TrimSpace(s)
+		if strings.HasPrefix(s, "t=") {
+			token = s[2:]
+		} else if strings.HasPrefix(s, "k=") {
+			k = s[2:]
+		}
+	}
+	if k != PublicKey(vapidKey) {
+		t.Fatalf("got key %q, expected %q", k, PublicKey(vapidKey))
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("bad token %q", token)
+	}
+	claimsBuf, err := b64.DecodeString(parts[1])
+	tcheck(t, err, "decode claims")
+	var claims struct {
+		Aud string `json:"aud"`
+		Sub string `json:"sub"`
+	}
+	err = json.Unmarshal(claimsBuf, &claims)
+	tcheck(t, err, "parse claims")
+	if claims.Aud != srv.URL || claims.Sub != "mailto:postmaster@mox.example" {
+		t.Fatalf("unexpected claims %s", claimsBuf)
+	}
+	sig, err := b64.DecodeString(parts[2])
+	tcheck(t, err, "decode signature")
+	h := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if len(sig) != 64 || !ecdsa.Verify(&vapidKey.PublicKey, h[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		t.Fatalf("bad vapid signature")
+	}
+
+	status = http.StatusGone
+	err = Send(context.Background(), vapidKey, "mailto:postmaster@mox.example", sub, payload, time.Hour)
+	if !errors.Is(err, ErrGone) {
+		t.Fatalf("got err %v, expected ErrGone", err)
+	}
+
+	sub.P256dh = "bad"
+	err = Send(context.Background(), vapidKey, "mailto:postmaster@mox.example", sub, payload, time.Hour)
+	if !errors.Is(err, ErrKey) {
+		t.Fatalf("got err %v, expected ErrKey", err)
+	}
+}